@@ -0,0 +1,234 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lsendel/impl-zamaz/pkg/device"
+	"github.com/lsendel/impl-zamaz/pkg/i18n"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+)
+
+// Limits on device imports
+const (
+	maxImportRows  = 1000
+	maxImportBytes = 4 << 20
+)
+
+// exportColumns are the columns of a CSV export
+var exportColumns = []string{
+	"id", "owner_id", "name", "platform", "fingerprint", "attestation_status", "integrity",
+	"state", "compliance", "trust_score", "registered_at", "verified_at", "last_seen_at",
+}
+
+// ImportDevices godoc
+// @Summary Import devices
+// @Description Register a batch of devices from JSON or CSV (text/csv, with a header of owner_id, name, platform and fingerprint). Rows are registered independently; the report says which were rejected and why. With dry_run nothing is registered.
+// @Tags devices
+// @Accept json
+// @Accept text/csv
+// @Produce json
+// @Security Bearer
+// @Param devices body DeviceImportRequest true "Devices"
+// @Param dry_run query bool false "Only validate the batch"
+// @Success 200 {object} DeviceImportResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Router /devices/import [post]
+func (h *Handlers) ImportDevices(c *gin.Context) {
+	dryRun, err := strconv.ParseBool(c.DefaultQuery("dry_run", "false"))
+	if err != nil {
+		deviceError(c, device.ErrInvalid)
+		return
+	}
+	rows, err := readImport(c)
+	if err != nil {
+		deviceError(c, err)
+		return
+	}
+
+	ctx, importer := c.Request.Context(), subject(c)
+	response := DeviceImportResponse{DryRun: dryRun, Results: make([]DeviceImportResult, 0, len(rows))}
+	seen := make(map[string]int, len(rows))
+	for i, row := range rows {
+		result := DeviceImportResult{Row: i + 1}
+		owner := row.OwnerID
+		if owner == "" {
+			owner = importer
+		}
+		reg := device.Registration{Name: row.Name, Platform: row.Platform, Fingerprint: row.Fingerprint}
+		if first, ok := seen[owner+"\x00"+row.Fingerprint]; ok && row.Fingerprint != "" {
+			err = fmt.Errorf("%w: same owner and fingerprint as row %d", device.ErrDuplicate, first)
+		} else if dryRun {
+			err = h.devices.Check(ctx, owner, reg)
+		} else {
+			var info *interfaces.DeviceInfo
+			if info, err = h.devices.Register(ctx, owner, reg); err == nil {
+				result.DeviceID = info.ID
+			}
+		}
+		if err != nil {
+			status, code := deviceErrorCode(err)
+			result.Code, result.Message = code, err.Error()
+			if status == http.StatusInternalServerError {
+				slog.Error("Device import failed", "user_id", importer, "row", result.Row, "error", err)
+				result.Message = i18n.Message(c, code)
+			}
+			response.Rejected++
+		} else {
+			seen[owner+"\x00"+row.Fingerprint] = result.Row
+			response.Imported++
+		}
+		response.Results = append(response.Results, result)
+	}
+	slog.Info("Devices imported", "user_id", importer, "imported", response.Imported, "rejected", response.Rejected, "dry_run", dryRun)
+	c.JSON(http.StatusOK, response)
+}
+
+// ExportDevices godoc
+// @Summary Export devices
+// @Description Snapshot every registered device passing the filters, oldest first, as JSON or CSV
+// @Tags devices
+// @Produce json
+// @Produce text/csv
+// @Security Bearer
+// @Param format query string false "json or csv" default(json)
+// @Param owner_id query string false "Owner"
+// @Param platform query string false "Platform"
+// @Param attestation_status query string false "pending, verified or failed"
+// @Param state query string false "active, stale or quarantined"
+// @Param compliance query string false "compliant, noncompliant or unknown"
+// @Success 200 {object} DeviceListResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Router /devices/export [get]
+func (h *Handlers) ExportDevices(c *gin.Context) {
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "csv" {
+		deviceError(c, device.ErrInvalid)
+		return
+	}
+	devices, err := h.devices.Export(c.Request.Context(), device.Filter{
+		OwnerID:           c.Query("owner_id"),
+		Platform:          c.Query("platform"),
+		AttestationStatus: c.Query("attestation_status"),
+		State:             c.Query("state"),
+		Compliance:        c.Query("compliance"),
+	})
+	if err != nil {
+		deviceError(c, err)
+		return
+	}
+
+	filename := "devices-" + time.Now().UTC().Format("20060102T150405Z")
+	if format == "json" {
+		c.Header("Content-Disposition", `attachment; filename="`+filename+`.json"`)
+		c.JSON(http.StatusOK, DeviceListResponse{Devices: devices, Page: 1, PageSize: len(devices), Total: len(devices), TotalPages: 1})
+		return
+	}
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`.csv"`)
+	c.Status(http.StatusOK)
+	w := csv.NewWriter(c.Writer)
+	w.Write(exportColumns)
+	for _, d := range devices {
+		w.Write([]string{
+			d.ID, d.OwnerID, d.Name, d.Platform, d.Fingerprint, d.AttestationStatus, d.Integrity,
+			d.State, d.Compliance, strconv.Itoa(d.TrustScore), d.RegisteredAt.Format(time.RFC3339),
+			formatTime(d.VerifiedAt), formatTime(d.LastSeenAt),
+		})
+	}
+	w.Flush()
+}
+
+// readImport reads the rows of a JSON or CSV import
+func readImport(c *gin.Context) ([]DeviceImportRow, error) {
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, maxImportBytes)
+	var rows []DeviceImportRow
+	if strings.HasPrefix(c.ContentType(), "text/csv") {
+		var err error
+		if rows, err = readImportCSV(body); err != nil {
+			return nil, err
+		}
+	} else {
+		var req DeviceImportRequest
+		if err := json.NewDecoder(body).Decode(&req); err != nil {
+			return nil, fmt.Errorf("%w: malformed JSON", device.ErrInvalid)
+		}
+		rows = req.Devices
+	}
+	switch {
+	case len(rows) == 0:
+		return nil, fmt.Errorf("%w: no devices to import", device.ErrInvalid)
+	case len(rows) > maxImportRows:
+		return nil, fmt.Errorf("%w: at most %d devices per import", device.ErrInvalid, maxImportRows)
+	}
+	return rows, nil
+}
+
+// readImportCSV reads a CSV import whose header names its columns, in any
+// order; owner_id and name may be left out
+func readImportCSV(body io.Reader) ([]DeviceImportRow, error) {
+	r := csv.NewReader(body)
+	r.TrimLeadingSpace = true
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%w: missing CSV header", device.ErrInvalid)
+	}
+	index := make(map[string]int, len(header))
+	for i, column := range header {
+		index[strings.ToLower(strings.TrimSpace(column))] = i
+	}
+	for _, required := range []string{"platform", "fingerprint"} {
+		if _, ok := index[required]; !ok {
+			return nil, fmt.Errorf("%w: CSV header must name the %s column", device.ErrInvalid, required)
+		}
+	}
+	field := func(record []string, column string) string {
+		if i, ok := index[column]; ok && i < len(record) {
+			return record[i]
+		}
+		return ""
+	}
+
+	var rows []DeviceImportRow
+	for {
+		record, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", device.ErrInvalid, err)
+		}
+		if len(rows) == maxImportRows {
+			return nil, fmt.Errorf("%w: at most %d devices per import", device.ErrInvalid, maxImportRows)
+		}
+		row := DeviceImportRow{
+			OwnerID:     field(record, "owner_id"),
+			Name:        field(record, "name"),
+			Platform:    field(record, "platform"),
+			Fingerprint: field(record, "fingerprint"),
+		}
+		rows = append(rows, row)
+	}
+}
+
+// formatTime formats an optional time as RFC 3339, or empty
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
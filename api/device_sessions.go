@@ -0,0 +1,96 @@
+package api
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lsendel/impl-zamaz/pkg/i18n"
+)
+
+// GetDeviceSessions godoc
+// @Summary List a device's sessions
+// @Description List the live SSO sessions created from any user's device
+// @Tags devices
+// @Produce json
+// @Security Bearer
+// @Param id path string true "Device ID"
+// @Success 200 {object} DeviceSessionsResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /devices/{id}/sessions [get]
+func (h *Handlers) GetDeviceSessions(c *gin.Context) {
+	if !h.sessionsEnabled(c) {
+		return
+	}
+	ctx := c.Request.Context()
+	info, err := h.devices.Lookup(ctx, c.Param("id"))
+	if err != nil {
+		deviceError(c, err)
+		return
+	}
+	sessions, err := h.sessions.ForDevice(ctx, info.ID)
+	if err != nil {
+		deviceError(c, err)
+		return
+	}
+	response := DeviceSessionsResponse{DeviceID: info.ID, Sessions: make([]DeviceSession, 0, len(sessions)), Total: len(sessions)}
+	for _, sess := range sessions {
+		response.Sessions = append(response.Sessions, DeviceSession{
+			UserID:         sess.User.ID,
+			Username:       sess.User.Username,
+			IP:             sess.IP,
+			CreatedAt:      sess.CreatedAt,
+			ExpiresAt:      sess.ExpiresAt,
+			TrustCap:       sess.TrustCap,
+			ReauthRequired: sess.ReauthRequired,
+		})
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// TerminateDeviceSessions godoc
+// @Summary End a device's sessions
+// @Description End every live SSO session created from any user's device at once
+// @Tags devices
+// @Produce json
+// @Security Bearer
+// @Param id path string true "Device ID"
+// @Success 200 {object} TerminateDeviceSessionsResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /devices/{id}/sessions [delete]
+func (h *Handlers) TerminateDeviceSessions(c *gin.Context) {
+	if !h.sessionsEnabled(c) {
+		return
+	}
+	ctx := c.Request.Context()
+	info, err := h.devices.Lookup(ctx, c.Param("id"))
+	if err != nil {
+		deviceError(c, err)
+		return
+	}
+	terminated, err := h.sessions.EndDevice(ctx, info.ID, true)
+	if err != nil {
+		deviceError(c, err)
+		return
+	}
+	slog.Info("Device sessions terminated", "device_id", info.ID, "sessions", terminated, "admin", subject(c))
+	c.JSON(http.StatusOK, TerminateDeviceSessionsResponse{DeviceID: info.ID, Terminated: terminated})
+}
+
+// sessionsEnabled answers 404 when SSO sessions are off
+func (h *Handlers) sessionsEnabled(c *gin.Context) bool {
+	if h.sessions != nil {
+		return true
+	}
+	c.JSON(http.StatusNotFound, ErrorResponse{
+		Error:   http.StatusText(http.StatusNotFound),
+		Code:    "SESSIONS_DISABLED",
+		Message: i18n.Message(c, "SESSIONS_DISABLED"),
+	})
+	return false
+}
@@ -0,0 +1,169 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lsendel/impl-zamaz/pkg/device"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/trust"
+)
+
+// StartDeviceVerification godoc
+// @Summary Start verifying a device
+// @Description Challenge the owner to verify a device: an email method mails a code to answer at /verify, push waits for approval from another of the owner's verified, hardware-bound devices, and admin for an administrator's approval
+// @Tags devices
+// @Accept json
+// @Produce json
+// @Security Bearer
+// @Param id path string true "Device ID"
+// @Param request body StartVerificationRequest true "Method"
+// @Success 201 {object} device.Verification
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Router /devices/{id}/verify/challenge [post]
+func (h *Handlers) StartDeviceVerification(c *gin.Context) {
+	var req StartVerificationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		deviceError(c, device.ErrInvalid)
+		return
+	}
+	var address string
+	if user, ok := c.Get("user"); ok {
+		if info, ok := user.(*interfaces.UserInfo); ok {
+			address = info.Email
+		}
+	}
+	v, err := h.devices.StartVerification(c.Request.Context(), subject(c), c.Param("id"), req.Method, address)
+	if err != nil {
+		deviceError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, v)
+}
+
+// GetDeviceVerifications godoc
+// @Summary List a device's verifications
+// @Description List the verifications of one of the user's devices with their outcomes, newest first
+// @Tags devices
+// @Produce json
+// @Security Bearer
+// @Param id path string true "Device ID"
+// @Success 200 {object} VerificationListResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /devices/{id}/verifications [get]
+func (h *Handlers) GetDeviceVerifications(c *gin.Context) {
+	verifications, err := h.devices.Verifications(c.Request.Context(), subject(c), c.Param("id"))
+	if err != nil {
+		deviceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, VerificationListResponse{Verifications: verifications})
+}
+
+// GetPendingApprovals godoc
+// @Summary List verifications to approve
+// @Description List the push verifications of the user's devices waiting for approval from another of them
+// @Tags devices
+// @Produce json
+// @Security Bearer
+// @Success 200 {object} VerificationListResponse
+// @Failure 401 {object} ErrorResponse
+// @Router /devices/approvals [get]
+func (h *Handlers) GetPendingApprovals(c *gin.Context) {
+	verifications, err := h.devices.PendingApprovals(c.Request.Context(), subject(c))
+	if err != nil {
+		deviceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, VerificationListResponse{Verifications: verifications})
+}
+
+// DecideDeviceVerification godoc
+// @Summary Approve a push verification
+// @Description Approve or deny a push verification of one of the user's devices. The request must carry the X-Device-Assertion of another of the user's verified, hardware-bound devices.
+// @Tags devices
+// @Accept json
+// @Produce json
+// @Security Bearer
+// @Param id path string true "Device ID"
+// @Param vid path string true "Verification ID"
+// @Param request body VerificationDecisionRequest true "Decision"
+// @Success 200 {object} interfaces.DeviceInfo
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Router /devices/{id}/verifications/{vid}/decision [post]
+func (h *Handlers) DecideDeviceVerification(c *gin.Context) {
+	var req VerificationDecisionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		deviceError(c, device.ErrInvalid)
+		return
+	}
+	var approver *interfaces.DeviceInfo
+	if bound, ok := c.Get(trust.BoundDeviceKey); ok {
+		approver, _ = bound.(*interfaces.DeviceInfo)
+	}
+	info, err := h.devices.ApproveFromDevice(c.Request.Context(), subject(c), approver, c.Param("id"), c.Param("vid"), req.Approve)
+	if err != nil {
+		deviceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, info)
+}
+
+// GetAdminApprovals godoc
+// @Summary List verifications awaiting an administrator
+// @Description List the admin verifications of every user's devices waiting for a decision, newest first
+// @Tags admin
+// @Produce json
+// @Security Bearer
+// @Success 200 {object} VerificationListResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Router /admin/devices/verifications [get]
+func (h *Handlers) GetAdminApprovals(c *gin.Context) {
+	verifications, err := h.devices.PendingAdminApprovals(c.Request.Context())
+	if err != nil {
+		deviceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, VerificationListResponse{Verifications: verifications})
+}
+
+// DecideAdminVerification godoc
+// @Summary Decide an admin verification
+// @Description Approve or deny an admin verification of any user's device
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Security Bearer
+// @Param id path string true "Device ID"
+// @Param vid path string true "Verification ID"
+// @Param request body VerificationDecisionRequest true "Decision"
+// @Success 200 {object} interfaces.DeviceInfo
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Router /admin/devices/{id}/verifications/{vid}/decision [post]
+func (h *Handlers) DecideAdminVerification(c *gin.Context) {
+	var req VerificationDecisionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		deviceError(c, device.ErrInvalid)
+		return
+	}
+	info, err := h.devices.Decide(c.Request.Context(), c.Param("id"), c.Param("vid"), subject(c), req.Approve)
+	if err != nil {
+		deviceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, info)
+}
@@ -0,0 +1,405 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lsendel/impl-zamaz/pkg/device"
+	"github.com/lsendel/impl-zamaz/pkg/i18n"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/trust"
+)
+
+// defaultDevicePageSize is the page size of GetDevices without page_size
+const defaultDevicePageSize = 20
+
+// GetDevices godoc
+// @Summary List devices
+// @Description List the authenticated user's registered devices, oldest first
+// @Tags devices
+// @Produce json
+// @Security Bearer
+// @Param page query int false "Page, from 1" default(1)
+// @Param page_size query int false "Devices per page, at most 100" default(20)
+// @Success 200 {object} DeviceListResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Router /devices [get]
+func (h *Handlers) GetDevices(c *gin.Context) {
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil {
+		deviceError(c, device.ErrInvalid)
+		return
+	}
+	pageSize, err := strconv.Atoi(c.DefaultQuery("page_size", strconv.Itoa(defaultDevicePageSize)))
+	if err != nil {
+		deviceError(c, device.ErrInvalid)
+		return
+	}
+	devices, total, err := h.devices.List(c.Request.Context(), subject(c), page, pageSize)
+	if err != nil {
+		deviceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, DeviceListResponse{
+		Devices:    devices,
+		Page:       page,
+		PageSize:   pageSize,
+		Total:      total,
+		TotalPages: (total + pageSize - 1) / pageSize,
+	})
+}
+
+// RegisterDevice godoc
+// @Summary Register a device
+// @Description Register a device to the authenticated user; it is pending attestation until verified
+// @Tags devices
+// @Accept json
+// @Produce json
+// @Security Bearer
+// @Param device body DeviceRequest true "Device"
+// @Success 201 {object} interfaces.DeviceInfo
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Router /devices/register [post]
+func (h *Handlers) RegisterDevice(c *gin.Context) {
+	reg, ok := bindDevice(c)
+	if !ok {
+		return
+	}
+	info, err := h.devices.Register(c.Request.Context(), subject(c), reg)
+	if err != nil {
+		deviceError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, info)
+}
+
+// GetDevice godoc
+// @Summary Get a device
+// @Tags devices
+// @Produce json
+// @Security Bearer
+// @Param id path string true "Device ID"
+// @Success 200 {object} interfaces.DeviceInfo
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /devices/{id} [get]
+func (h *Handlers) GetDevice(c *gin.Context) {
+	info, err := h.devices.Get(c.Request.Context(), subject(c), c.Param("id"))
+	if err != nil {
+		deviceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, info)
+}
+
+// UpdateDevice godoc
+// @Summary Update a device
+// @Description Replace a device's details; a new fingerprint makes it pending attestation again
+// @Tags devices
+// @Accept json
+// @Produce json
+// @Security Bearer
+// @Param id path string true "Device ID"
+// @Param device body DeviceRequest true "Device"
+// @Success 200 {object} interfaces.DeviceInfo
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Router /devices/{id} [put]
+func (h *Handlers) UpdateDevice(c *gin.Context) {
+	reg, ok := bindDevice(c)
+	if !ok {
+		return
+	}
+	info, err := h.devices.Update(c.Request.Context(), subject(c), c.Param("id"), reg)
+	if err != nil {
+		deviceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, info)
+}
+
+// DeleteDevice godoc
+// @Summary Delete a device
+// @Tags devices
+// @Security Bearer
+// @Param id path string true "Device ID"
+// @Success 204
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /devices/{id} [delete]
+func (h *Handlers) DeleteDevice(c *gin.Context) {
+	if err := h.devices.Delete(c.Request.Context(), subject(c), c.Param("id")); err != nil {
+		deviceError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// VerifyDevice godoc
+// @Summary Verify a device
+// @Description Check a device's attestation evidence and record whether it passed, or answer an email verification with its code
+// @Tags devices
+// @Accept json
+// @Produce json
+// @Security Bearer
+// @Param id path string true "Device ID"
+// @Param evidence body VerifyDeviceRequest true "Attestation evidence"
+// @Success 200 {object} interfaces.DeviceInfo
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 503 {object} ErrorResponse
+// @Router /devices/{id}/verify [post]
+func (h *Handlers) VerifyDevice(c *gin.Context) {
+	var req VerifyDeviceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		deviceError(c, device.ErrInvalid)
+		return
+	}
+	var info *interfaces.DeviceInfo
+	var err error
+	switch {
+	case req.VerificationID != "":
+		info, err = h.devices.CompleteVerification(c.Request.Context(), subject(c), c.Param("id"), req.VerificationID, req.Code)
+	case req.Fingerprint == "":
+		err = fmt.Errorf("%w: fingerprint or verification_id is required", device.ErrInvalid)
+	default:
+		info, err = h.devices.Verify(c.Request.Context(), subject(c), c.Param("id"), device.Evidence{
+			Fingerprint: req.Fingerprint,
+			Attestation: req.Attestation,
+			Nonce:       req.Nonce,
+		})
+	}
+	if err != nil {
+		deviceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, info)
+}
+
+// QuarantineDevice godoc
+// @Summary Quarantine a device
+// @Description Quarantine any user's device until it is verified again. It loses its trust, and sessions created from it must re-authenticate at once.
+// @Tags devices
+// @Accept json
+// @Produce json
+// @Security Bearer
+// @Param id path string true "Device ID"
+// @Param request body DeviceActionRequest false "Reason"
+// @Success 200 {object} interfaces.DeviceInfo
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Router /devices/{id}/quarantine [post]
+func (h *Handlers) QuarantineDevice(c *gin.Context) {
+	h.restrictDevice(c, h.devices.Quarantine)
+}
+
+// BlockDevice godoc
+// @Summary Block a device
+// @Description Block any user's device for good. Its assertions are refused, it cannot be verified again and sessions created from it end at once.
+// @Tags devices
+// @Accept json
+// @Produce json
+// @Security Bearer
+// @Param id path string true "Device ID"
+// @Param request body DeviceActionRequest false "Reason"
+// @Success 200 {object} interfaces.DeviceInfo
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /devices/{id}/block [post]
+func (h *Handlers) BlockDevice(c *gin.Context) {
+	h.restrictDevice(c, h.devices.Block)
+}
+
+// restrictDevice quarantines or blocks the device with action
+func (h *Handlers) restrictDevice(c *gin.Context, action func(ctx context.Context, id, reason string) (*interfaces.DeviceInfo, error)) {
+	var req DeviceActionRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			deviceError(c, device.ErrInvalid)
+			return
+		}
+	}
+	info, err := action(c.Request.Context(), c.Param("id"), req.Reason)
+	if err != nil {
+		deviceError(c, err)
+		return
+	}
+	slog.Info("Device restricted", "device_id", info.ID, "state", info.State, "admin", subject(c))
+	c.JSON(http.StatusOK, info)
+}
+
+// BindChallenge godoc
+// @Summary Start binding a device to a key
+// @Description Issue the challenge a device's hardware-backed key signs to bind the device to it
+// @Tags devices
+// @Produce json
+// @Security Bearer
+// @Param id path string true "Device ID"
+// @Success 200 {object} BindChallengeResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /devices/{id}/bind/challenge [post]
+func (h *Handlers) BindChallenge(c *gin.Context) {
+	challenge, err := h.devices.Challenge(c.Request.Context(), subject(c), c.Param("id"))
+	if err != nil {
+		deviceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, BindChallengeResponse{Challenge: challenge, ExpiresIn: 300})
+}
+
+// BindDevice godoc
+// @Summary Bind a device to a key
+// @Description Bind a device to a TPM or WebAuthn key that signed its binding challenge; the device then signs requests with X-Device-Assertion
+// @Tags devices
+// @Accept json
+// @Produce json
+// @Security Bearer
+// @Param id path string true "Device ID"
+// @Param binding body BindDeviceRequest true "Key and proof of possession"
+// @Success 200 {object} interfaces.DeviceInfo
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /devices/{id}/bind [post]
+func (h *Handlers) BindDevice(c *gin.Context) {
+	var req BindDeviceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		deviceError(c, device.ErrInvalid)
+		return
+	}
+	info, err := h.devices.Bind(c.Request.Context(), subject(c), c.Param("id"), device.Binding{
+		PublicKey: req.PublicKey,
+		Proof: device.Proof{
+			Signature:         req.Signature,
+			AuthenticatorData: req.AuthenticatorData,
+			ClientDataJSON:    req.ClientDataJSON,
+		},
+	})
+	if err != nil {
+		deviceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, info)
+}
+
+// GetDeviceTrustScore godoc
+// @Summary Get a device's trust score
+// @Description Score the authenticated user on the device and record the score on it
+// @Tags devices
+// @Produce json
+// @Security Bearer
+// @Param id path string true "Device ID"
+// @Success 200 {object} DeviceTrustScoreResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /devices/{id}/trust-score [get]
+func (h *Handlers) GetDeviceTrustScore(c *gin.Context) {
+	ctx, owner := c.Request.Context(), subject(c)
+	info, err := h.devices.Get(ctx, owner, c.Param("id"))
+	if err != nil {
+		deviceError(c, err)
+		return
+	}
+	signals := trust.RequestContext(c)
+	signals["device_verified"] = strconv.FormatBool(info.AttestationStatus == device.AttestationVerified)
+	if info.Integrity != "" {
+		signals["device_integrity"] = info.Integrity
+	}
+	if signals[trust.ContextDeviceID] != info.ID {
+		// The request was signed by another device, if any
+		delete(signals, trust.ContextDeviceBound)
+	}
+	signals[trust.ContextDeviceState] = info.State
+	signals[trust.ContextDeviceCompliance] = info.Compliance
+	score, err := h.scorer.Score(ctx, trust.Input{Subject: owner, Device: info.ID, Context: signals})
+	if err != nil {
+		deviceError(c, err)
+		return
+	}
+	if info, err = h.devices.SetTrustScore(ctx, owner, info.ID, score.Overall); err != nil {
+		deviceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, DeviceTrustScoreResponse{
+		DeviceID:          info.ID,
+		AttestationStatus: info.AttestationStatus,
+		Integrity:         info.Integrity,
+		Compliance:        info.Compliance,
+		TrustScore:        info.TrustScore,
+		Explanations:      score.Explanations,
+		Timestamp:         time.Now().Format(time.RFC3339),
+	})
+}
+
+// bindDevice reads a DeviceRequest, answering 400 itself when it is
+// malformed
+func bindDevice(c *gin.Context) (device.Registration, bool) {
+	var req DeviceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		deviceError(c, device.ErrInvalid)
+		return device.Registration{}, false
+	}
+	return device.Registration{Name: req.Name, Platform: req.Platform, Fingerprint: req.Fingerprint, Attestation: req.Attestation, Nonce: req.Nonce}, true
+}
+
+// deviceError answers with the response matching a registry error
+func deviceError(c *gin.Context, err error) {
+	status, code := deviceErrorCode(err)
+	if status == http.StatusInternalServerError {
+		slog.Error("Device request failed", "user_id", subject(c), "error", err)
+	}
+	c.JSON(status, ErrorResponse{
+		Error:   http.StatusText(status),
+		Code:    code,
+		Message: i18n.Message(c, code),
+	})
+}
+
+// deviceErrorCode maps registry errors to a status and error code
+func deviceErrorCode(err error) (int, string) {
+	status, code := http.StatusInternalServerError, "INTERNAL_ERROR"
+	switch {
+	case errors.Is(err, device.ErrInvalid):
+		status, code = http.StatusBadRequest, "VALIDATION_ERROR"
+	case errors.Is(err, device.ErrNotFound):
+		status, code = http.StatusNotFound, "RESOURCE_NOT_FOUND"
+	case errors.Is(err, device.ErrDuplicate):
+		status, code = http.StatusConflict, "DEVICE_ALREADY_REGISTERED"
+	case errors.Is(err, device.ErrConflict):
+		status, code = http.StatusConflict, "RESOURCE_CONFLICT"
+	case errors.Is(err, device.ErrBlocked):
+		status, code = http.StatusConflict, "DEVICE_BLOCKED"
+	case errors.Is(err, device.ErrWrongCode):
+		status, code = http.StatusBadRequest, "VERIFICATION_CODE_INVALID"
+	case errors.Is(err, device.ErrVerificationClosed):
+		status, code = http.StatusConflict, "VERIFICATION_CLOSED"
+	case errors.Is(err, device.ErrApproverInvalid):
+		status, code = http.StatusForbidden, "VERIFICATION_APPROVER_INVALID"
+	case errors.Is(err, device.ErrInvalidProof):
+		status, code = http.StatusBadRequest, "DEVICE_ASSERTION_INVALID"
+	case errors.Is(err, device.ErrAttestationUnavailable):
+		status, code = http.StatusServiceUnavailable, "ATTESTATION_UNAVAILABLE"
+	}
+	return status, code
+}
@@ -6,16 +6,82 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+
+	"github.com/lsendel/impl-zamaz/pkg/auth"
+	"github.com/lsendel/impl-zamaz/pkg/device"
+	"github.com/lsendel/impl-zamaz/pkg/i18n"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/middleware"
+	"github.com/lsendel/impl-zamaz/pkg/policy"
+	"github.com/lsendel/impl-zamaz/pkg/rbac"
+	"github.com/lsendel/impl-zamaz/pkg/session"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+	"github.com/lsendel/impl-zamaz/pkg/trust"
 )
 
+// demoUserID is scored when no user is authenticated
+const demoUserID = "550e8400-e29b-41d4-a716-446655440000"
+
 // Handlers contains all API handlers
 type Handlers struct {
-	// Add your dependencies here (e.g., Keycloak client, DB, etc.)
+	verifier interfaces.CredentialVerifier
+	scorer   trust.Scorer
+	devices  *device.Registry
+	sessions *session.Manager
+	policies *policy.Engine
+	rbac     *rbac.Manager
 }
 
-// NewHandlers creates a new handlers instance
+// NewHandlers creates a new handlers instance without a credential verifier,
+// so Login answers 503
 func NewHandlers() *Handlers {
-	return &Handlers{}
+	return NewHandlersWithVerifier(nil)
+}
+
+// NewHandlersWithVerifier creates handlers that log users in with v. Its
+// errors are mapped to responses with auth.LoginError.
+func NewHandlersWithVerifier(v interfaces.CredentialVerifier) *Handlers {
+	return &Handlers{
+		verifier: v,
+		scorer:   trust.DemoScorer{},
+		devices:  device.NewRegistry(device.Config{}, store.NewMemoryStore()),
+		policies: policy.NewEngine(policy.Config{}, store.NewMemoryStore()),
+		rbac:     rbac.NewManager(rbac.Config{}, store.NewMemoryStore()),
+	}
+}
+
+// WithScorer makes the handlers report trust scores from s instead of the
+// demo scorer
+func (h *Handlers) WithScorer(s trust.Scorer) *Handlers {
+	h.scorer = s
+	return h
+}
+
+// WithDevices makes the handlers keep devices in r instead of an in-memory
+// registry
+func (h *Handlers) WithDevices(r *device.Registry) *Handlers {
+	h.devices = r
+	return h
+}
+
+// WithSessions lets the handlers list and end the SSO sessions in m
+func (h *Handlers) WithSessions(m *session.Manager) *Handlers {
+	h.sessions = m
+	return h
+}
+
+// WithPolicies makes the handlers keep policies in e instead of an
+// in-memory engine
+func (h *Handlers) WithPolicies(e *policy.Engine) *Handlers {
+	h.policies = e
+	return h
+}
+
+// WithRBAC makes the handlers keep roles in m instead of an in-memory
+// manager
+func (h *Handlers) WithRBAC(m *rbac.Manager) *Handlers {
+	h.rbac = m
+	return h
 }
 
 // Login godoc
@@ -27,6 +93,8 @@ func NewHandlers() *Handlers {
 // @Param credentials body LoginRequest true "Login credentials"
 // @Success 200 {object} LoginResponse
 // @Failure 401 {object} ErrorResponse
+// @Failure 423 {object} ErrorResponse
+// @Failure 503 {object} ErrorResponse
 // @Router /auth/login [post]
 func (h *Handlers) Login(c *gin.Context) {
 	var req LoginRequest
@@ -35,25 +103,48 @@ func (h *Handlers) Login(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, ErrorResponse{
 			Error:   "Bad Request",
 			Code:    "REQ_001",
-			Message: "Invalid request format",
+			Message: i18n.Message(c, "REQ_001"),
+		})
+		return
+	}
+
+	if h.verifier == nil {
+		c.JSON(http.StatusServiceUnavailable, ErrorResponse{
+			Error:   http.StatusText(http.StatusServiceUnavailable),
+			Code:    "IDP_UNAVAILABLE",
+			Message: i18n.Message(c, "IDP_UNAVAILABLE"),
+		})
+		return
+	}
+
+	resp, err := h.verifier.Authenticate(c.Request.Context(), req.Username, req.Password)
+	if err != nil {
+		status, code := auth.LoginError(err)
+		if status >= http.StatusInternalServerError {
+			slog.Error("Login failed at identity provider", "error", err, "client_ip", c.ClientIP())
+		} else {
+			slog.Warn("Login rejected", "username", req.Username, "code", code, "client_ip", c.ClientIP())
+		}
+		c.JSON(status, ErrorResponse{
+			Error:   http.StatusText(status),
+			Code:    code,
+			Message: i18n.Message(c, code),
 		})
 		return
 	}
 
-	// TODO: Implement actual Keycloak authentication
-	// For demo purposes, returning mock response
 	c.JSON(http.StatusOK, LoginResponse{
-		AccessToken:  "eyJhbGciOiJSUzI1NiIsInR5cCI6IkpXVCJ9...",
-		RefreshToken: "eyJhbGciOiJIUzI1NiIsInR5cCI6IkpXVCJ9...",
-		ExpiresIn:    300,
-		TokenType:    "Bearer",
+		AccessToken:  resp.AccessToken,
+		RefreshToken: resp.RefreshToken,
+		ExpiresIn:    resp.ExpiresIn,
+		TokenType:    resp.TokenType,
 		User: UserInfo{
-			ID:       "550e8400-e29b-41d4-a716-446655440000",
-			Username: req.Username,
-			Email:    req.Username + "@example.com",
-			Roles:    []string{"user"},
+			ID:       resp.User.ID,
+			Username: resp.User.Username,
+			Email:    resp.User.Email,
+			Roles:    resp.User.Roles,
 		},
-		TrustScore: 88,
+		TrustScore: resp.TrustScore,
 	})
 }
 
@@ -66,47 +157,92 @@ func (h *Handlers) Login(c *gin.Context) {
 // @Security Bearer
 // @Success 200 {object} TrustScoreResponse
 // @Failure 401 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
 // @Router /trust-score [get]
 func (h *Handlers) GetTrustScore(c *gin.Context) {
-	// Get user from context (set by auth middleware)
-	userID := "550e8400-e29b-41d4-a716-446655440000" // TODO: Get from context
-
+	score, ok := h.score(c)
+	if !ok {
+		return
+	}
 	c.JSON(http.StatusOK, TrustScoreResponse{
-		UserID:  userID,
-		Overall: 88,
+		UserID:  score.UserID,
+		Overall: score.Overall,
 		Factors: map[string]int{
-			"identity": 30,
-			"device":   20,
-			"behavior": 18,
-			"location": 12,
-			"risk":     8,
+			trust.FactorIdentity: score.Factors.Identity,
+			trust.FactorDevice:   score.Factors.Device,
+			trust.FactorBehavior: score.Factors.Behavior,
+			trust.FactorLocation: score.Factors.Location,
+			trust.FactorRisk:     score.Factors.Risk,
 		},
-		Timestamp: time.Now().Format(time.RFC3339),
-		NextCheck: time.Now().Add(5 * time.Minute).Format(time.RFC3339),
+		Explanations: score.Explanations,
+		Timestamp:    time.Now().Format(time.RFC3339),
+		NextCheck:    time.Now().Add(5 * time.Minute).Format(time.RFC3339),
 	})
 }
 
 // GetProtectedResource godoc
 // @Summary Access protected resource
-// @Description Access a resource that requires specific trust level
+// @Description Access a resource that requires the trust level declared for its route
 // @Tags resources
 // @Accept json
 // @Produce json
 // @Security Bearer
-// @Param trust query int false "Required trust level" default(50)
 // @Success 200 {object} map[string]interface{}
 // @Failure 401 {object} ErrorResponse
 // @Failure 403 {object} ErrorResponse
 // @Router /protected [get]
 func (h *Handlers) GetProtectedResource(c *gin.Context) {
+	required, _ := middleware.RequiredTrustLevel(c)
+	level := c.GetInt(middleware.TrustLevelKey)
+	if _, checked := c.Get(middleware.TrustLevelKey); !checked {
+		score, ok := h.score(c)
+		if !ok {
+			return
+		}
+		level = score.Overall
+	}
 	c.JSON(http.StatusOK, gin.H{
 		"data":                 "This is protected data",
 		"accessed_at":          time.Now().Format(time.RFC3339),
-		"trust_level_required": 50,
-		"your_trust_level":     88,
+		"trust_level_required": required,
+		"your_trust_level":     level,
 	})
 }
 
+// CurrentTrust implements middleware.TrustSource with the handlers' scorer
+func (h *Handlers) CurrentTrust(c *gin.Context) (*interfaces.TrustScore, error) {
+	return h.scorer.Score(c.Request.Context(), trust.Input{
+		Subject: subject(c),
+		Context: trust.RequestContext(c),
+	})
+}
+
+// score scores the authenticated user, or the demo user without one, and
+// answers 500 itself when scoring fails
+func (h *Handlers) score(c *gin.Context) (*interfaces.TrustScore, bool) {
+	score, err := h.CurrentTrust(c)
+	if err != nil {
+		slog.Error("Failed to calculate trust score", "user_id", subject(c), "error", err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Error:   http.StatusText(http.StatusInternalServerError),
+			Code:    "INTERNAL_ERROR",
+			Message: i18n.Message(c, "INTERNAL_ERROR"),
+		})
+		return nil, false
+	}
+	return score, true
+}
+
+// subject is the authenticated user's ID, or the demo user without one
+func subject(c *gin.Context) string {
+	if user, ok := c.Get("user"); ok {
+		if info, ok := user.(*interfaces.UserInfo); ok {
+			return info.ID
+		}
+	}
+	return demoUserID
+}
+
 // Health godoc
 // @Summary Health check
 // @Description Check service health status
@@ -0,0 +1,416 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+
+	"github.com/lsendel/impl-zamaz/pkg/i18n"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/policy"
+	"github.com/lsendel/impl-zamaz/pkg/trust"
+)
+
+// maxBundleBytes bounds policy bundles
+const maxBundleBytes = 4 << 20
+
+// GetPolicies godoc
+// @Summary List policies
+// @Description List every access policy by name
+// @Tags policies
+// @Produce json
+// @Security Bearer
+// @Success 200 {object} PolicyListResponse
+// @Failure 401 {object} ErrorResponse
+// @Router /policies [get]
+func (h *Handlers) GetPolicies(c *gin.Context) {
+	policies, err := h.policies.List(c.Request.Context())
+	if err != nil {
+		policyError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, PolicyListResponse{Policies: policies, Total: len(policies)})
+}
+
+// CreatePolicy godoc
+// @Summary Create a policy
+// @Description Create an access policy granting or denying actions on resources to subjects
+// @Tags policies
+// @Accept json
+// @Produce json
+// @Security Bearer
+// @Param policy body PolicyRequest true "Policy"
+// @Success 201 {object} policy.Policy
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Router /policies [post]
+func (h *Handlers) CreatePolicy(c *gin.Context) {
+	p, ok := bindPolicy(c)
+	if !ok {
+		return
+	}
+	created, err := h.policies.Create(c.Request.Context(), p)
+	if err != nil {
+		policyError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, created)
+}
+
+// GetPolicy godoc
+// @Summary Get a policy
+// @Tags policies
+// @Produce json
+// @Security Bearer
+// @Param id path string true "Policy ID"
+// @Success 200 {object} policy.Policy
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /policies/{id} [get]
+func (h *Handlers) GetPolicy(c *gin.Context) {
+	p, err := h.policies.Get(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		policyError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, p)
+}
+
+// UpdatePolicy godoc
+// @Summary Update a policy
+// @Description Replace an access policy
+// @Tags policies
+// @Accept json
+// @Produce json
+// @Security Bearer
+// @Param id path string true "Policy ID"
+// @Param policy body PolicyRequest true "Policy"
+// @Success 200 {object} policy.Policy
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Router /policies/{id} [put]
+func (h *Handlers) UpdatePolicy(c *gin.Context) {
+	p, ok := bindPolicy(c)
+	if !ok {
+		return
+	}
+	updated, err := h.policies.Update(c.Request.Context(), c.Param("id"), p)
+	if err != nil {
+		policyError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, updated)
+}
+
+// DeletePolicy godoc
+// @Summary Delete a policy
+// @Tags policies
+// @Security Bearer
+// @Param id path string true "Policy ID"
+// @Success 204
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /policies/{id} [delete]
+func (h *Handlers) DeletePolicy(c *gin.Context) {
+	if err := h.policies.Delete(c.Request.Context(), c.Param("id")); err != nil {
+		policyError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// GetPolicyVersions godoc
+// @Summary List policy versions
+// @Description List the kept versions of an access policy, newest first
+// @Tags policies
+// @Produce json
+// @Security Bearer
+// @Param id path string true "Policy ID"
+// @Success 200 {object} PolicyVersionListResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /policies/{id}/versions [get]
+func (h *Handlers) GetPolicyVersions(c *gin.Context) {
+	versions, err := h.policies.Versions(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		policyError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, PolicyVersionListResponse{Versions: versions, Total: len(versions)})
+}
+
+// RollbackPolicy godoc
+// @Summary Roll back a policy
+// @Description Make an earlier version of an access policy its next version
+// @Tags policies
+// @Produce json
+// @Security Bearer
+// @Param id path string true "Policy ID"
+// @Param version path int true "Version to roll back to"
+// @Success 200 {object} policy.Policy
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Router /policies/{id}/rollback/{version} [post]
+func (h *Handlers) RollbackPolicy(c *gin.Context) {
+	version, err := strconv.Atoi(c.Param("version"))
+	if err != nil {
+		policyError(c, policy.ErrInvalid)
+		return
+	}
+	rolledBack, err := h.policies.Rollback(c.Request.Context(), c.Param("id"), version)
+	if err != nil {
+		policyError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, rolledBack)
+}
+
+// ExportPolicies godoc
+// @Summary Export policies
+// @Description Snapshot every access policy as a bundle, as JSON or YAML, to keep in version control
+// @Tags policies
+// @Produce json
+// @Produce application/yaml
+// @Security Bearer
+// @Param format query string false "json or yaml" default(json)
+// @Success 200 {object} policy.Bundle
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Router /policies/export [get]
+func (h *Handlers) ExportPolicies(c *gin.Context) {
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "yaml" {
+		policyError(c, policy.ErrInvalid)
+		return
+	}
+	bundle, err := h.policies.Export(c.Request.Context())
+	if err != nil {
+		policyError(c, err)
+		return
+	}
+
+	filename := "policies-" + time.Now().UTC().Format("20060102T150405Z")
+	if format == "json" {
+		c.Header("Content-Disposition", `attachment; filename="`+filename+`.json"`)
+		c.JSON(http.StatusOK, bundle)
+		return
+	}
+	out, err := yaml.Marshal(bundle)
+	if err != nil {
+		policyError(c, err)
+		return
+	}
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`.yaml"`)
+	c.Data(http.StatusOK, "application/yaml", out)
+}
+
+// ImportPolicies godoc
+// @Summary Import policies
+// @Description Make the access policies match a JSON or YAML bundle. Bundle policies replace the policy with their ID or name and the others are created; with prune, policies missing from the bundle are deleted. Nothing is changed when any policy is rejected or on a dry run.
+// @Tags policies
+// @Accept json
+// @Accept application/yaml
+// @Produce json
+// @Security Bearer
+// @Param dry_run query bool false "Plan the import without changing policies"
+// @Param prune query bool false "Delete policies missing from the bundle"
+// @Param bundle body policy.Bundle true "Policies"
+// @Success 200 {object} policy.ImportResult
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Router /policies/import [post]
+func (h *Handlers) ImportPolicies(c *gin.Context) {
+	var opts policy.ImportOptions
+	var err error
+	if opts.DryRun, err = strconv.ParseBool(c.DefaultQuery("dry_run", "false")); err != nil {
+		policyError(c, policy.ErrInvalid)
+		return
+	}
+	if opts.Prune, err = strconv.ParseBool(c.DefaultQuery("prune", "false")); err != nil {
+		policyError(c, policy.ErrInvalid)
+		return
+	}
+	bundle, err := readBundle(c)
+	if err != nil {
+		policyError(c, err)
+		return
+	}
+	result, err := h.policies.Import(c.Request.Context(), bundle, opts)
+	if err != nil {
+		policyError(c, err)
+		return
+	}
+	slog.Info("Policies imported", "user_id", subject(c), "created", result.Created, "updated", result.Updated,
+		"deleted", result.Deleted, "rejected", result.Rejected, "dry_run", opts.DryRun)
+	c.JSON(http.StatusOK, result)
+}
+
+// LintPolicies godoc
+// @Summary Lint policies
+// @Description Check the policies a bundle would leave, as importing it would, for invalid and unreachable policies, conflicting allows and denies, broad wildcards and duplicates. With prune the bundle is checked alone; without a body the stored policies are.
+// @Tags policies
+// @Accept json
+// @Accept application/yaml
+// @Produce json
+// @Security Bearer
+// @Param prune query bool false "Check the bundle without the stored policies"
+// @Param bundle body policy.Bundle false "Policies"
+// @Success 200 {object} policy.LintResult
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Router /policies/lint [post]
+func (h *Handlers) LintPolicies(c *gin.Context) {
+	var opts policy.ImportOptions
+	var err error
+	if opts.Prune, err = strconv.ParseBool(c.DefaultQuery("prune", "false")); err != nil {
+		policyError(c, policy.ErrInvalid)
+		return
+	}
+	var bundle policy.Bundle
+	if c.Request.ContentLength != 0 {
+		if bundle, err = readBundle(c); err != nil {
+			policyError(c, err)
+			return
+		}
+	}
+	result, err := h.policies.Lint(c.Request.Context(), bundle, opts)
+	if err != nil {
+		policyError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// readBundle reads a JSON or YAML policy bundle, rejecting unknown fields
+func readBundle(c *gin.Context) (policy.Bundle, error) {
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, maxBundleBytes)
+	var bundle policy.Bundle
+	switch c.ContentType() {
+	case "application/yaml", "application/x-yaml", "text/yaml", "text/x-yaml":
+		decoder := yaml.NewDecoder(body)
+		decoder.KnownFields(true)
+		if err := decoder.Decode(&bundle); err != nil {
+			return bundle, fmt.Errorf("%w: malformed YAML", policy.ErrInvalid)
+		}
+	default:
+		decoder := json.NewDecoder(body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&bundle); err != nil {
+			return bundle, fmt.Errorf("%w: malformed JSON", policy.ErrInvalid)
+		}
+	}
+	return bundle, nil
+}
+
+// GetPolicySchema godoc
+// @Summary Policy JSON Schema
+// @Description The JSON Schema policies are created and replaced with, describing every condition operator
+// @Tags policies
+// @Produce json
+// @Security Bearer
+// @Success 200 {object} object
+// @Failure 401 {object} ErrorResponse
+// @Router /policies/schema [get]
+func (h *Handlers) GetPolicySchema(c *gin.Context) {
+	c.Data(http.StatusOK, "application/schema+json", policy.Schema())
+}
+
+// EvaluatePolicy godoc
+// @Summary Evaluate policies
+// @Description Decide whether a subject may take an action on a resource. Without a subject the authenticated user is evaluated with their roles and the request's trust signals as context. Without tags the resource has those it is registered with.
+// @Tags policies
+// @Accept json
+// @Produce json
+// @Security Bearer
+// @Param request body PolicyEvaluationRequest true "Request to decide"
+// @Success 200 {object} policy.Decision
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Router /policies/evaluate [post]
+func (h *Handlers) EvaluatePolicy(c *gin.Context) {
+	var req PolicyEvaluationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		policyError(c, policy.ErrInvalid)
+		return
+	}
+	in := policy.Request{Subject: req.Subject, Roles: req.Roles, Resource: req.Resource, Action: req.Action, Context: req.Context, Tags: req.Tags}
+	if in.Subject == "" {
+		in.Subject = subject(c)
+		if user, ok := c.Get("user"); ok {
+			if info, ok := user.(*interfaces.UserInfo); ok {
+				in.Roles = info.Roles
+			}
+		}
+		signals := trust.RequestContext(c)
+		for attribute, value := range req.Context {
+			signals[attribute] = value
+		}
+		in.Context = signals
+	}
+	decision, err := h.policies.Evaluate(c.Request.Context(), in)
+	if err != nil {
+		policyError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, decision)
+}
+
+// bindPolicy reads a PolicyRequest, answering 400 itself when it is
+// malformed
+func bindPolicy(c *gin.Context) (policy.Policy, bool) {
+	var req PolicyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		policyError(c, policy.ErrInvalid)
+		return policy.Policy{}, false
+	}
+	return policy.Policy{
+		Name:        req.Name,
+		Description: req.Description,
+		Subjects:    req.Subjects,
+		Resources:   req.Resources,
+		Actions:     req.Actions,
+		Conditions:  req.Conditions,
+		Effect:      req.Effect,
+		Obligations: req.Obligations,
+	}, true
+}
+
+// policyError answers with the response matching an engine error
+func policyError(c *gin.Context, err error) {
+	status, code := http.StatusInternalServerError, "INTERNAL_ERROR"
+	switch {
+	case errors.Is(err, policy.ErrInvalid):
+		status, code = http.StatusBadRequest, "VALIDATION_ERROR"
+	case errors.Is(err, policy.ErrNotFound), errors.Is(err, policy.ErrResourceNotFound):
+		status, code = http.StatusNotFound, "RESOURCE_NOT_FOUND"
+	case errors.Is(err, policy.ErrConflict), errors.Is(err, policy.ErrResourceInUse):
+		status, code = http.StatusConflict, "RESOURCE_CONFLICT"
+	case errors.Is(err, policy.ErrLimit):
+		status, code = http.StatusConflict, "POLICY_LIMIT_REACHED"
+	default:
+		slog.Error("Policy request failed", "user_id", subject(c), "error", err)
+	}
+	c.JSON(status, ErrorResponse{
+		Error:   http.StatusText(status),
+		Code:    code,
+		Message: i18n.Message(c, code),
+	})
+}
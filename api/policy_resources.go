@@ -0,0 +1,140 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lsendel/impl-zamaz/pkg/policy"
+)
+
+// GetPolicyResources godoc
+// @Summary List registered resources
+// @Description List the resources policies can select by tag, by name
+// @Tags policies
+// @Produce json
+// @Security Bearer
+// @Success 200 {object} PolicyResourceListResponse
+// @Failure 401 {object} ErrorResponse
+// @Router /policies/resources [get]
+func (h *Handlers) GetPolicyResources(c *gin.Context) {
+	resources, err := h.policies.ListResources(c.Request.Context())
+	if err != nil {
+		policyError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, PolicyResourceListResponse{Resources: resources, Total: len(resources)})
+}
+
+// CreatePolicyResource godoc
+// @Summary Register a resource
+// @Description Register an API or part of one with tags, under its service or another resource, so policies can select it with tag:<name>=<value>
+// @Tags policies
+// @Accept json
+// @Produce json
+// @Security Bearer
+// @Param resource body PolicyResourceRequest true "Resource"
+// @Success 201 {object} policy.Resource
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Router /policies/resources [post]
+func (h *Handlers) CreatePolicyResource(c *gin.Context) {
+	r, ok := bindPolicyResource(c)
+	if !ok {
+		return
+	}
+	created, err := h.policies.CreateResource(c.Request.Context(), r)
+	if err != nil {
+		policyError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, created)
+}
+
+// GetPolicyResource godoc
+// @Summary Get a registered resource
+// @Tags policies
+// @Produce json
+// @Security Bearer
+// @Param id path string true "Resource ID"
+// @Success 200 {object} policy.Resource
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /policies/resources/{id} [get]
+func (h *Handlers) GetPolicyResource(c *gin.Context) {
+	r, err := h.policies.GetResource(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		policyError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, r)
+}
+
+// UpdatePolicyResource godoc
+// @Summary Update a registered resource
+// @Description Replace a registered resource
+// @Tags policies
+// @Accept json
+// @Produce json
+// @Security Bearer
+// @Param id path string true "Resource ID"
+// @Param resource body PolicyResourceRequest true "Resource"
+// @Success 200 {object} policy.Resource
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Router /policies/resources/{id} [put]
+func (h *Handlers) UpdatePolicyResource(c *gin.Context) {
+	r, ok := bindPolicyResource(c)
+	if !ok {
+		return
+	}
+	updated, err := h.policies.UpdateResource(c.Request.Context(), c.Param("id"), r)
+	if err != nil {
+		policyError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, updated)
+}
+
+// DeletePolicyResource godoc
+// @Summary Delete a registered resource
+// @Description Delete a registered resource no other resource is under
+// @Tags policies
+// @Security Bearer
+// @Param id path string true "Resource ID"
+// @Success 204
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Router /policies/resources/{id} [delete]
+func (h *Handlers) DeletePolicyResource(c *gin.Context) {
+	if err := h.policies.DeleteResource(c.Request.Context(), c.Param("id")); err != nil {
+		policyError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// bindPolicyResource reads a PolicyResourceRequest, answering 400 itself
+// when it is malformed
+func bindPolicyResource(c *gin.Context) (policy.Resource, bool) {
+	var req PolicyResourceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		policyError(c, policy.ErrInvalid)
+		return policy.Resource{}, false
+	}
+	return policy.Resource{
+		Name:        req.Name,
+		Description: req.Description,
+		Parent:      req.Parent,
+		Patterns:    req.Patterns,
+		Tags:        req.Tags,
+		Actions:     req.Actions,
+	}, true
+}
@@ -0,0 +1,398 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lsendel/impl-zamaz/pkg/i18n"
+)
+
+// PostmanSchema is the collection format produced by NewPostmanCollection.
+// Insomnia imports the same format.
+const PostmanSchema = "https://schema.getpostman.com/json/collection/v2.1.0/collection.json"
+
+// Collection variables; QA fills in username and password and the auth
+// helper keeps accessToken current
+const (
+	VarBaseURL     = "baseUrl"
+	VarAccessToken = "accessToken"
+	VarUsername    = "username"
+	VarPassword    = "password"
+)
+
+// loginPath is the operation the auth helper calls to obtain a token
+const loginPath = "/auth/login"
+
+// authHelper logs in with the collection credentials before any request
+// that needs a token while accessToken is empty
+var authHelper = []string{
+	"if (pm.request.auth && pm.request.auth.type === 'noauth') { return; }",
+	"if (pm.collectionVariables.get('" + VarAccessToken + "')) { return; }",
+	"pm.sendRequest({",
+	"  url: pm.collectionVariables.get('" + VarBaseURL + "') + '" + loginPath + "',",
+	"  method: 'POST',",
+	"  header: { 'Content-Type': 'application/json' },",
+	"  body: { mode: 'raw', raw: JSON.stringify({",
+	"    username: pm.collectionVariables.get('" + VarUsername + "'),",
+	"    password: pm.collectionVariables.get('" + VarPassword + "')",
+	"  }) }",
+	"}, function (err, res) {",
+	"  if (!err && res.code === 200) { pm.collectionVariables.set('" + VarAccessToken + "', res.json().access_token); }",
+	"});",
+}
+
+// saveToken stores the token returned by the login request itself
+var saveToken = []string{
+	"if (pm.response.code === 200) { pm.collectionVariables.set('" + VarAccessToken + "', pm.response.json().access_token); }",
+}
+
+// PostmanCollection is a Postman v2.1 collection
+type PostmanCollection struct {
+	Info     PostmanInfo       `json:"info"`
+	Auth     *PostmanAuth      `json:"auth,omitempty"`
+	Event    []PostmanEvent    `json:"event,omitempty"`
+	Variable []PostmanVariable `json:"variable"`
+	Item     []PostmanItem     `json:"item"`
+}
+
+// PostmanInfo describes the collection
+type PostmanInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Version     string `json:"version,omitempty"`
+	Schema      string `json:"schema"`
+}
+
+// PostmanAuth is a request or collection auth setting
+type PostmanAuth struct {
+	Type   string            `json:"type"`
+	Bearer []PostmanVariable `json:"bearer,omitempty"`
+}
+
+// PostmanEvent is a pre-request or test script
+type PostmanEvent struct {
+	Listen string        `json:"listen"`
+	Script PostmanScript `json:"script"`
+}
+
+// PostmanScript holds the script source, one line per element
+type PostmanScript struct {
+	Type string   `json:"type"`
+	Exec []string `json:"exec"`
+}
+
+// PostmanVariable is a key/value pair used for variables, headers and
+// query parameters
+type PostmanVariable struct {
+	Key         string `json:"key"`
+	Value       string `json:"value"`
+	Type        string `json:"type,omitempty"`
+	Description string `json:"description,omitempty"`
+	Disabled    bool   `json:"disabled,omitempty"`
+}
+
+// PostmanItem is either a folder (Item set) or a request (Request set)
+type PostmanItem struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Item        []PostmanItem   `json:"item,omitempty"`
+	Request     *PostmanRequest `json:"request,omitempty"`
+	Event       []PostmanEvent  `json:"event,omitempty"`
+}
+
+// PostmanRequest is a single request
+type PostmanRequest struct {
+	Method      string            `json:"method"`
+	Header      []PostmanVariable `json:"header"`
+	URL         PostmanURL        `json:"url"`
+	Body        *PostmanBody      `json:"body,omitempty"`
+	Auth        *PostmanAuth      `json:"auth,omitempty"`
+	Description string            `json:"description,omitempty"`
+}
+
+// PostmanURL is a request URL built on the baseUrl variable
+type PostmanURL struct {
+	Raw      string            `json:"raw"`
+	Host     []string          `json:"host"`
+	Path     []string          `json:"path"`
+	Query    []PostmanVariable `json:"query,omitempty"`
+	Variable []PostmanVariable `json:"variable,omitempty"`
+}
+
+// PostmanBody is a raw JSON request body
+type PostmanBody struct {
+	Mode    string                 `json:"mode"`
+	Raw     string                 `json:"raw"`
+	Options map[string]interface{} `json:"options,omitempty"`
+}
+
+// swaggerSpec is the subset of a Swagger 2.0 document the export reads
+type swaggerSpec struct {
+	Info struct {
+		Title       string `json:"title"`
+		Description string `json:"description"`
+		Version     string `json:"version"`
+	} `json:"info"`
+	Host        string                                 `json:"host"`
+	BasePath    string                                 `json:"basePath"`
+	Schemes     []string                               `json:"schemes"`
+	Paths       map[string]map[string]swaggerOperation `json:"paths"`
+	Definitions map[string]swaggerSchema               `json:"definitions"`
+	Security    []map[string][]string                  `json:"security"`
+}
+
+type swaggerOperation struct {
+	Summary     string                `json:"summary"`
+	Description string                `json:"description"`
+	Tags        []string              `json:"tags"`
+	Consumes    []string              `json:"consumes"`
+	Parameters  []swaggerParameter    `json:"parameters"`
+	Security    []map[string][]string `json:"security"`
+}
+
+type swaggerParameter struct {
+	Name        string         `json:"name"`
+	In          string         `json:"in"`
+	Description string         `json:"description"`
+	Required    bool           `json:"required"`
+	Type        string         `json:"type"`
+	Default     interface{}    `json:"default"`
+	Schema      *swaggerSchema `json:"schema"`
+}
+
+type swaggerSchema struct {
+	Ref        string                   `json:"$ref"`
+	Type       string                   `json:"type"`
+	Example    interface{}              `json:"example"`
+	Properties map[string]swaggerSchema `json:"properties"`
+	Items      *swaggerSchema           `json:"items"`
+}
+
+// operationMethods are the Swagger path item keys that are operations, in
+// the order requests are listed within a path
+var operationMethods = []string{"get", "post", "put", "patch", "delete", "head", "options"}
+
+// maxExampleDepth stops example generation on recursive definitions
+const maxExampleDepth = 8
+
+// NewPostmanCollection converts a Swagger 2.0 document into a collection.
+// Requests are grouped in one folder per first tag, in path order, and send
+// their bearer token from the accessToken variable. baseURL is the initial
+// value of the baseUrl variable and should include the spec's base path.
+func NewPostmanCollection(spec []byte, baseURL string) (*PostmanCollection, error) {
+	var doc swaggerSpec
+	if err := json.Unmarshal(spec, &doc); err != nil {
+		return nil, fmt.Errorf("invalid OpenAPI document: %w", err)
+	}
+	if len(doc.Paths) == 0 {
+		return nil, fmt.Errorf("OpenAPI document has no paths")
+	}
+
+	collection := &PostmanCollection{
+		Info: PostmanInfo{
+			Name:        doc.Info.Title,
+			Description: doc.Info.Description,
+			Version:     doc.Info.Version,
+			Schema:      PostmanSchema,
+		},
+		Auth: &PostmanAuth{
+			Type:   "bearer",
+			Bearer: []PostmanVariable{{Key: "token", Value: "{{" + VarAccessToken + "}}", Type: "string"}},
+		},
+		Event: []PostmanEvent{{Listen: "prerequest", Script: PostmanScript{Type: "text/javascript", Exec: authHelper}}},
+		Variable: []PostmanVariable{
+			{Key: VarBaseURL, Value: baseURL, Type: "string"},
+			{Key: VarAccessToken, Value: "", Type: "string"},
+			{Key: VarUsername, Value: "", Type: "string"},
+			{Key: VarPassword, Value: "", Type: "string"},
+		},
+	}
+
+	paths := make([]string, 0, len(doc.Paths))
+	for p := range doc.Paths {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	folders := make(map[string]*PostmanItem)
+	var folderOrder []string
+	for _, p := range paths {
+		for _, method := range operationMethods {
+			op, ok := doc.Paths[p][method]
+			if !ok {
+				continue
+			}
+			tag := "default"
+			if len(op.Tags) > 0 {
+				tag = op.Tags[0]
+			}
+			folder, ok := folders[tag]
+			if !ok {
+				folder = &PostmanItem{Name: tag}
+				folders[tag] = folder
+				folderOrder = append(folderOrder, tag)
+			}
+			folder.Item = append(folder.Item, doc.item(p, method, op))
+		}
+	}
+	sort.Strings(folderOrder)
+	for _, tag := range folderOrder {
+		collection.Item = append(collection.Item, *folders[tag])
+	}
+	return collection, nil
+}
+
+// item builds the request for one operation
+func (doc *swaggerSpec) item(p, method string, op swaggerOperation) PostmanItem {
+	name := op.Summary
+	if name == "" {
+		name = strings.ToUpper(method) + " " + p
+	}
+
+	url := PostmanURL{Host: []string{"{{" + VarBaseURL + "}}"}}
+	for _, segment := range strings.Split(strings.Trim(p, "/"), "/") {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			segment = ":" + strings.Trim(segment, "{}")
+		}
+		url.Path = append(url.Path, segment)
+	}
+
+	req := &PostmanRequest{
+		Method:      strings.ToUpper(method),
+		Header:      []PostmanVariable{},
+		Description: op.Description,
+	}
+	for _, param := range op.Parameters {
+		switch param.In {
+		case "path":
+			url.Variable = append(url.Variable, PostmanVariable{Key: param.Name, Value: exampleString(param), Description: param.Description})
+		case "query":
+			url.Query = append(url.Query, PostmanVariable{Key: param.Name, Value: exampleString(param), Description: param.Description, Disabled: !param.Required})
+		case "header":
+			req.Header = append(req.Header, PostmanVariable{Key: param.Name, Value: exampleString(param), Description: param.Description})
+		case "body":
+			body, _ := json.MarshalIndent(doc.example(param.Schema, 0), "", "  ")
+			req.Body = &PostmanBody{
+				Mode:    "raw",
+				Raw:     string(body),
+				Options: map[string]interface{}{"raw": map[string]string{"language": "json"}},
+			}
+			req.Header = append(req.Header, PostmanVariable{Key: "Content-Type", Value: "application/json"})
+		}
+	}
+	url.Raw = "{{" + VarBaseURL + "}}/" + strings.Join(url.Path, "/")
+	req.URL = url
+
+	security := op.Security
+	if security == nil {
+		security = doc.Security
+	}
+	if len(security) == 0 {
+		req.Auth = &PostmanAuth{Type: "noauth"}
+	}
+
+	item := PostmanItem{Name: name, Request: req}
+	if p == loginPath && method == "post" {
+		item.Event = []PostmanEvent{{Listen: "test", Script: PostmanScript{Type: "text/javascript", Exec: saveToken}}}
+	}
+	return item
+}
+
+// example builds a sample value for schema from the documented examples
+func (doc *swaggerSpec) example(schema *swaggerSchema, depth int) interface{} {
+	if schema == nil || depth > maxExampleDepth {
+		return nil
+	}
+	if schema.Ref != "" {
+		def, ok := doc.Definitions[strings.TrimPrefix(schema.Ref, "#/definitions/")]
+		if !ok {
+			return nil
+		}
+		return doc.example(&def, depth+1)
+	}
+	if schema.Example != nil {
+		return schema.Example
+	}
+	switch schema.Type {
+	case "object", "":
+		if len(schema.Properties) == 0 {
+			return map[string]interface{}{}
+		}
+		obj := make(map[string]interface{}, len(schema.Properties))
+		for name, prop := range schema.Properties {
+			prop := prop
+			obj[name] = doc.example(&prop, depth+1)
+		}
+		return obj
+	case "array":
+		return []interface{}{doc.example(schema.Items, depth+1)}
+	case "integer", "number":
+		return 0
+	case "boolean":
+		return false
+	default:
+		return ""
+	}
+}
+
+func exampleString(param swaggerParameter) string {
+	if param.Default != nil {
+		return fmt.Sprint(param.Default)
+	}
+	return ""
+}
+
+// PostmanHandler serves GET /api-docs/postman, generating the collection
+// from the spec returned by spec on every request so it never drifts from
+// the served OpenAPI document
+func PostmanHandler(spec func() ([]byte, error)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		data, err := spec()
+		var doc struct {
+			BasePath string `json:"basePath"`
+		}
+		if err == nil {
+			err = json.Unmarshal(data, &doc)
+		}
+		var collection *PostmanCollection
+		if err == nil {
+			collection, err = NewPostmanCollection(data, requestBaseURL(c)+doc.BasePath)
+		}
+		if err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"error": i18n.Message(c, "API_SPEC_UNAVAILABLE"),
+				"code":  "API_SPEC_UNAVAILABLE",
+			})
+			return
+		}
+
+		filename := strings.Map(func(r rune) rune {
+			if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' {
+				return r
+			}
+			return '-'
+		}, strings.ToLower(collection.Info.Name))
+		if filename == "" {
+			filename = "api"
+		}
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.postman_collection.json"`, filename))
+		c.JSON(http.StatusOK, collection)
+	}
+}
+
+// requestBaseURL is the scheme and host the client used to reach the server
+func requestBaseURL(c *gin.Context) string {
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	if proto := c.GetHeader("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+	return scheme + "://" + c.Request.Host
+}
@@ -0,0 +1,655 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lsendel/impl-zamaz/pkg/i18n"
+	"github.com/lsendel/impl-zamaz/pkg/rbac"
+)
+
+// GetRoles godoc
+// @Summary List roles
+// @Description List roles and the permissions they grant, by name
+// @Tags rbac
+// @Produce json
+// @Security Bearer
+// @Success 200 {object} RoleListResponse
+// @Failure 401 {object} ErrorResponse
+// @Router /rbac/roles [get]
+func (h *Handlers) GetRoles(c *gin.Context) {
+	roles, err := h.rbac.Roles(c.Request.Context())
+	if err != nil {
+		rbacError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, RoleListResponse{Roles: roles, Total: len(roles)})
+}
+
+// CreateRole godoc
+// @Summary Create a role
+// @Description Create a role granting and denying registered permissions, or patterns of them with '*' for any segment, and inheriting those of other roles
+// @Tags rbac
+// @Accept json
+// @Produce json
+// @Security Bearer
+// @Param role body RoleRequest true "Role"
+// @Success 201 {object} rbac.Role
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Router /rbac/roles [post]
+func (h *Handlers) CreateRole(c *gin.Context) {
+	role, reason, ok := bindRole(c)
+	if !ok {
+		return
+	}
+	created, err := h.rbac.CreateRole(change(c, reason), role)
+	if err != nil {
+		rbacError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, created)
+}
+
+// GetRole godoc
+// @Summary Get a role
+// @Tags rbac
+// @Produce json
+// @Security Bearer
+// @Param id path string true "Role ID"
+// @Success 200 {object} rbac.Role
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /rbac/roles/{id} [get]
+func (h *Handlers) GetRole(c *gin.Context) {
+	role, err := h.rbac.Role(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		rbacError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, role)
+}
+
+// UpdateRole godoc
+// @Summary Update a role
+// @Description Replace a role's name, description, granted and denied permissions and inherited roles
+// @Tags rbac
+// @Accept json
+// @Produce json
+// @Security Bearer
+// @Param id path string true "Role ID"
+// @Param role body RoleRequest true "Role"
+// @Success 200 {object} rbac.Role
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Router /rbac/roles/{id} [put]
+func (h *Handlers) UpdateRole(c *gin.Context) {
+	role, reason, ok := bindRole(c)
+	if !ok {
+		return
+	}
+	updated, err := h.rbac.UpdateRole(change(c, reason), c.Param("id"), role)
+	if err != nil {
+		rbacError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, updated)
+}
+
+// DeleteRole godoc
+// @Summary Delete a role
+// @Description Delete a role no user is assigned and no role inherits
+// @Tags rbac
+// @Security Bearer
+// @Param id path string true "Role ID"
+// @Param reason query string false "Why the change is made, for the audit trail"
+// @Success 204
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Router /rbac/roles/{id} [delete]
+func (h *Handlers) DeleteRole(c *gin.Context) {
+	if err := h.rbac.DeleteRole(change(c, ""), c.Param("id")); err != nil {
+		rbacError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// GetPermissions godoc
+// @Summary List permissions
+// @Description List the permissions roles can grant, by name
+// @Tags rbac
+// @Produce json
+// @Security Bearer
+// @Success 200 {object} PermissionListResponse
+// @Failure 401 {object} ErrorResponse
+// @Router /rbac/permissions [get]
+func (h *Handlers) GetPermissions(c *gin.Context) {
+	permissions, err := h.rbac.Permissions(c.Request.Context())
+	if err != nil {
+		rbacError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, PermissionListResponse{Permissions: permissions, Total: len(permissions)})
+}
+
+// CreatePermission godoc
+// @Summary Register a permission
+// @Description Register a <resource>:<action> or <service>:<resource>:<action> permission roles can grant
+// @Tags rbac
+// @Accept json
+// @Produce json
+// @Security Bearer
+// @Param permission body PermissionRequest true "Permission"
+// @Success 201 {object} rbac.Permission
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Router /rbac/permissions [post]
+func (h *Handlers) CreatePermission(c *gin.Context) {
+	var req PermissionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		rbacError(c, rbac.ErrInvalid)
+		return
+	}
+	created, err := h.rbac.CreatePermission(change(c, req.Reason), rbac.Permission{Name: req.Name, Description: req.Description})
+	if err != nil {
+		rbacError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, created)
+}
+
+// DeletePermission godoc
+// @Summary Delete a permission
+// @Description Delete a permission no role grants or denies by name
+// @Tags rbac
+// @Security Bearer
+// @Param name path string true "Permission name"
+// @Param reason query string false "Why the change is made, for the audit trail"
+// @Success 204
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Router /rbac/permissions/{name} [delete]
+func (h *Handlers) DeletePermission(c *gin.Context) {
+	if err := h.rbac.DeletePermission(change(c, ""), c.Param("name")); err != nil {
+		rbacError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// AssignRole godoc
+// @Summary Assign a role
+// @Description Give a user a role, optionally until it expires and only while conditions on the attributes of checks hold. Naming an approver asks them to approve the assignment instead.
+// @Tags rbac
+// @Accept json
+// @Produce json
+// @Security Bearer
+// @Param assignment body RoleAssignmentRequest true "Assignment"
+// @Success 201 {object} rbac.Assignment
+// @Success 202 {object} rbac.Elevation
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse "Already assigned, or mutually exclusive with a role the user holds"
+// @Router /rbac/assign [post]
+func (h *Handlers) AssignRole(c *gin.Context) {
+	var req RoleAssignmentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		rbacError(c, rbac.ErrInvalid)
+		return
+	}
+	if req.Approver != "" {
+		if len(req.Conditions) > 0 {
+			rbacError(c, rbac.ErrInvalid)
+			return
+		}
+		elevation, err := h.rbac.RequestElevation(c.Request.Context(), rbac.Elevation{
+			UserID:      req.UserID,
+			RoleID:      req.RoleID,
+			Reason:      req.Reason,
+			ExpiresAt:   req.ExpiresAt,
+			Approver:    req.Approver,
+			RequestedBy: subject(c),
+		})
+		if err != nil {
+			rbacError(c, err)
+			return
+		}
+		c.JSON(http.StatusAccepted, elevation)
+		return
+	}
+	assignment, err := h.rbac.Assign(change(c, req.Reason), rbac.Assignment{
+		UserID:     req.UserID,
+		RoleID:     req.RoleID,
+		Conditions: req.Conditions,
+		AssignedBy: subject(c),
+		ExpiresAt:  req.ExpiresAt,
+	})
+	if err != nil {
+		rbacError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, assignment)
+}
+
+// UnassignRole godoc
+// @Summary Unassign a role
+// @Description Take a role from a user
+// @Tags rbac
+// @Security Bearer
+// @Param id path string true "User ID"
+// @Param role path string true "Role ID"
+// @Param reason query string false "Why the change is made, for the audit trail"
+// @Success 204
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /rbac/users/{id}/roles/{role} [delete]
+func (h *Handlers) UnassignRole(c *gin.Context) {
+	if err := h.rbac.Unassign(change(c, ""), c.Param("id"), c.Param("role")); err != nil {
+		rbacError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// GetUserRoles godoc
+// @Summary List a user's roles
+// @Tags rbac
+// @Produce json
+// @Security Bearer
+// @Param id path string true "User ID"
+// @Success 200 {object} RoleListResponse
+// @Failure 401 {object} ErrorResponse
+// @Router /rbac/users/{id}/roles [get]
+func (h *Handlers) GetUserRoles(c *gin.Context) {
+	roles, err := h.rbac.UserRoles(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		rbacError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, RoleListResponse{Roles: roles, Total: len(roles)})
+}
+
+// GetUserPermissions godoc
+// @Summary List a user's permissions
+// @Description List the permissions the user's roles grant and, when effective, those of the roles they inherit
+// @Tags rbac
+// @Produce json
+// @Security Bearer
+// @Param id path string true "User ID"
+// @Param effective query bool false "Include inherited permissions"
+// @Success 200 {object} UserPermissionsResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Router /rbac/users/{id}/permissions [get]
+func (h *Handlers) GetUserPermissions(c *gin.Context) {
+	var query struct {
+		Effective bool `form:"effective"`
+	}
+	if err := c.ShouldBindQuery(&query); err != nil {
+		rbacError(c, rbac.ErrInvalid)
+		return
+	}
+	permissions, err := h.rbac.UserPermissions(c.Request.Context(), c.Param("id"), query.Effective)
+	if err != nil {
+		rbacError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, UserPermissionsResponse{UserID: c.Param("id"), Effective: query.Effective, Permissions: permissions})
+}
+
+// CheckPermission godoc
+// @Summary Check a permission
+// @Description Decide whether a subject may take an action on a resource, that is whether one of their roles grants [<service>:]<resource>:<action>, directly or by a pattern, with its conditions holding for the context and none of their roles denies it, so other services can authorize by the same roles
+// @Tags rbac
+// @Accept json
+// @Produce json
+// @Security Bearer
+// @Param check body PermissionCheckRequest true "Check"
+// @Success 200 {object} rbac.Decision
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Router /rbac/check [post]
+func (h *Handlers) CheckPermission(c *gin.Context) {
+	var req PermissionCheckRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		rbacError(c, rbac.ErrInvalid)
+		return
+	}
+	permission := req.Resource + ":" + req.Action
+	if req.Service != "" {
+		permission = req.Service + ":" + permission
+	}
+	decision, err := h.rbac.Check(c.Request.Context(), rbac.CheckRequest{
+		User:       req.Subject,
+		Permission: permission,
+		Attributes: req.Context,
+	})
+	if err != nil {
+		rbacError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, decision)
+}
+
+// RequestElevation godoc
+// @Summary Request an elevation
+// @Description Ask for a role for a while, for just-in-time access; it is assigned once approved
+// @Tags rbac
+// @Accept json
+// @Produce json
+// @Security Bearer
+// @Param elevation body ElevationRequest true "Elevation"
+// @Success 201 {object} rbac.Elevation
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Router /rbac/elevations [post]
+func (h *Handlers) RequestElevation(c *gin.Context) {
+	var req ElevationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		rbacError(c, rbac.ErrInvalid)
+		return
+	}
+	elevation, err := h.rbac.RequestElevation(c.Request.Context(), rbac.Elevation{
+		UserID:      subject(c),
+		RoleID:      req.RoleID,
+		Reason:      req.Reason,
+		Duration:    req.Duration,
+		Approver:    req.Approver,
+		RequestedBy: subject(c),
+	})
+	if err != nil {
+		rbacError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, elevation)
+}
+
+// GetElevations godoc
+// @Summary List elevations
+// @Description List elevations, oldest first, optionally only those with a status
+// @Tags rbac
+// @Produce json
+// @Security Bearer
+// @Param status query string false "pending, approved or denied"
+// @Success 200 {object} ElevationListResponse
+// @Failure 401 {object} ErrorResponse
+// @Router /rbac/elevations [get]
+func (h *Handlers) GetElevations(c *gin.Context) {
+	elevations, err := h.rbac.Elevations(c.Request.Context(), c.Query("status"))
+	if err != nil {
+		rbacError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, ElevationListResponse{Elevations: elevations, Total: len(elevations)})
+}
+
+// GetElevation godoc
+// @Summary Get an elevation
+// @Tags rbac
+// @Produce json
+// @Security Bearer
+// @Param id path string true "Elevation ID"
+// @Success 200 {object} rbac.Elevation
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /rbac/elevations/{id} [get]
+func (h *Handlers) GetElevation(c *gin.Context) {
+	elevation, err := h.rbac.Elevation(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		rbacError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, elevation)
+}
+
+// ApproveElevation godoc
+// @Summary Approve an elevation
+// @Description Approve someone else's pending elevation, assigning its role until it expires
+// @Tags rbac
+// @Produce json
+// @Security Bearer
+// @Param id path string true "Elevation ID"
+// @Success 201 {object} rbac.Assignment
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Router /rbac/elevations/{id}/approve [post]
+func (h *Handlers) ApproveElevation(c *gin.Context) {
+	assignment, err := h.rbac.ApproveElevation(change(c, ""), c.Param("id"), subject(c))
+	if err != nil {
+		rbacError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, assignment)
+}
+
+// DenyElevation godoc
+// @Summary Deny an elevation
+// @Description Deny someone else's pending elevation
+// @Tags rbac
+// @Produce json
+// @Security Bearer
+// @Param id path string true "Elevation ID"
+// @Success 200 {object} rbac.Elevation
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Router /rbac/elevations/{id}/deny [post]
+func (h *Handlers) DenyElevation(c *gin.Context) {
+	elevation, err := h.rbac.DenyElevation(c.Request.Context(), c.Param("id"), subject(c))
+	if err != nil {
+		rbacError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, elevation)
+}
+
+// GetConstraints godoc
+// @Summary List separation-of-duties constraints
+// @Description List the pairs of mutually exclusive roles, oldest first
+// @Tags rbac
+// @Produce json
+// @Security Bearer
+// @Success 200 {object} ConstraintListResponse
+// @Failure 401 {object} ErrorResponse
+// @Router /rbac/constraints [get]
+func (h *Handlers) GetConstraints(c *gin.Context) {
+	constraints, err := h.rbac.Constraints(c.Request.Context())
+	if err != nil {
+		rbacError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, ConstraintListResponse{Constraints: constraints, Total: len(constraints)})
+}
+
+// CreateConstraint godoc
+// @Summary Create a separation-of-duties constraint
+// @Description Make two roles mutually exclusive, so no user may be assigned both, directly or through inheritance. Users already holding both are listed by the violations report.
+// @Tags rbac
+// @Accept json
+// @Produce json
+// @Security Bearer
+// @Param constraint body ConstraintRequest true "Constraint"
+// @Success 201 {object} rbac.Constraint
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Router /rbac/constraints [post]
+func (h *Handlers) CreateConstraint(c *gin.Context) {
+	var req ConstraintRequest
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.Roles) != 2 {
+		rbacError(c, rbac.ErrInvalid)
+		return
+	}
+	created, err := h.rbac.CreateConstraint(change(c, req.Reason), rbac.Constraint{
+		Description: req.Description,
+		Roles:       [2]string{req.Roles[0], req.Roles[1]},
+		CreatedBy:   subject(c),
+	})
+	if err != nil {
+		rbacError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, created)
+}
+
+// DeleteConstraint godoc
+// @Summary Delete a separation-of-duties constraint
+// @Tags rbac
+// @Security Bearer
+// @Param id path string true "Constraint ID"
+// @Param reason query string false "Why the change is made, for the audit trail"
+// @Success 204
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /rbac/constraints/{id} [delete]
+func (h *Handlers) DeleteConstraint(c *gin.Context) {
+	if err := h.rbac.DeleteConstraint(change(c, ""), c.Param("id")); err != nil {
+		rbacError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// GetViolations godoc
+// @Summary Report separation-of-duties violations
+// @Description List the users holding both roles of a constraint, assigned before it was created or through a role since made to inherit another
+// @Tags rbac
+// @Produce json
+// @Security Bearer
+// @Success 200 {object} ViolationListResponse
+// @Failure 401 {object} ErrorResponse
+// @Router /rbac/constraints/violations [get]
+func (h *Handlers) GetViolations(c *gin.Context) {
+	violations, err := h.rbac.Violations(c.Request.Context())
+	if err != nil {
+		rbacError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, ViolationListResponse{Violations: violations, Total: len(violations)})
+}
+
+// GetRBACAudit godoc
+// @Summary List RBAC changes
+// @Description List the changes made to roles, permissions, assignments and constraints, newest first, each with who made it, why, the state before and after and a diff of the two
+// @Tags rbac
+// @Produce json
+// @Security Bearer
+// @Param actor query string false "Who made the change"
+// @Param action query string false "e.g. role.update or assignment.create"
+// @Param target query string false "Role ID, permission name, constraint ID or <user>/<role ID>"
+// @Param since query string false "RFC 3339 time"
+// @Param until query string false "RFC 3339 time"
+// @Param before_seq query int false "Continue below the next_before_seq of the previous page"
+// @Param limit query int false "Page size, at most 1000"
+// @Success 200 {object} RBACChangeListResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Router /rbac/audit [get]
+func (h *Handlers) GetRBACAudit(c *gin.Context) {
+	var query struct {
+		Actor     string    `form:"actor"`
+		Action    string    `form:"action"`
+		Target    string    `form:"target"`
+		Since     time.Time `form:"since" time_format:"2006-01-02T15:04:05Z07:00"`
+		Until     time.Time `form:"until" time_format:"2006-01-02T15:04:05Z07:00"`
+		BeforeSeq int64     `form:"before_seq"`
+		Limit     int       `form:"limit"`
+	}
+	if err := c.ShouldBindQuery(&query); err != nil || query.BeforeSeq < 0 || query.Limit < 0 {
+		rbacError(c, rbac.ErrInvalid)
+		return
+	}
+	changes, next, err := h.rbac.Changes(c.Request.Context(), rbac.ChangeQuery{
+		Actor:     query.Actor,
+		Action:    query.Action,
+		Target:    query.Target,
+		Since:     query.Since,
+		Until:     query.Until,
+		BeforeSeq: query.BeforeSeq,
+		Limit:     query.Limit,
+	})
+	if err != nil {
+		rbacError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, RBACChangeListResponse{Changes: changes, Count: len(changes), NextBeforeSeq: next})
+}
+
+// bindRole reads a RoleRequest and the reason for the change, answering
+// 400 itself when it is malformed
+func bindRole(c *gin.Context) (rbac.Role, string, bool) {
+	var req RoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		rbacError(c, rbac.ErrInvalid)
+		return rbac.Role{}, "", false
+	}
+	return rbac.Role{
+		Name:        req.Name,
+		Description: req.Description,
+		Permissions: req.Permissions,
+		Deny:        req.Deny,
+		Inherits:    req.Inherits,
+		Conditions:  req.Conditions,
+	}, req.Reason, true
+}
+
+// change attributes the RBAC changes a request makes to its user, for
+// reason or else the reason query parameter
+func change(c *gin.Context, reason string) context.Context {
+	if reason == "" {
+		reason = c.Query("reason")
+	}
+	return rbac.WithChange(c.Request.Context(), subject(c), reason)
+}
+
+func rbacError(c *gin.Context, err error) {
+	status, code := http.StatusInternalServerError, "INTERNAL_ERROR"
+	switch {
+	case errors.Is(err, rbac.ErrInvalid):
+		status, code = http.StatusBadRequest, "VALIDATION_ERROR"
+	case errors.Is(err, rbac.ErrNotFound):
+		status, code = http.StatusNotFound, "RESOURCE_NOT_FOUND"
+	case errors.Is(err, rbac.ErrExists), errors.Is(err, rbac.ErrInUse), errors.Is(err, rbac.ErrConflict), errors.Is(err, rbac.ErrLimit):
+		status, code = http.StatusConflict, "RESOURCE_CONFLICT"
+	case errors.Is(err, rbac.ErrForbidden):
+		status, code = http.StatusForbidden, "ELEVATION_APPROVER_INVALID"
+	case errors.Is(err, rbac.ErrClosed):
+		status, code = http.StatusConflict, "ELEVATION_CLOSED"
+	case errors.Is(err, rbac.ErrSeparation):
+		status, code = http.StatusConflict, "SEPARATION_OF_DUTIES"
+	default:
+		slog.Error("RBAC request failed", "user_id", subject(c), "error", err)
+	}
+	c.JSON(status, ErrorResponse{
+		Error:   http.StatusText(status),
+		Code:    code,
+		Message: i18n.Message(c, code),
+	})
+}
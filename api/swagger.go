@@ -1,9 +1,16 @@
 package api
 
 import (
+	"time"
+
 	"github.com/gin-gonic/gin"
 	swaggerFiles "github.com/swaggo/files"
 	ginSwagger "github.com/swaggo/gin-swagger"
+
+	"github.com/lsendel/impl-zamaz/pkg/device"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/policy"
+	"github.com/lsendel/impl-zamaz/pkg/rbac"
 )
 
 // SwaggerInfo holds exported Swagger Info so clients can modify it
@@ -108,11 +115,12 @@ type UserInfo struct {
 // TrustScoreResponse represents current trust score
 // @Description Detailed trust score breakdown
 type TrustScoreResponse struct {
-	UserID    string         `json:"user_id" example:"550e8400-e29b-41d4-a716-446655440000"`
-	Overall   int            `json:"overall" example:"88"`
-	Factors   map[string]int `json:"factors"`
-	Timestamp string         `json:"timestamp" example:"2025-06-22T12:00:00Z"`
-	NextCheck string         `json:"next_check" example:"2025-06-22T12:05:00Z"`
+	UserID       string                         `json:"user_id" example:"550e8400-e29b-41d4-a716-446655440000"`
+	Overall      int                            `json:"overall" example:"88"`
+	Factors      map[string]int                 `json:"factors"`
+	Explanations []interfaces.FactorExplanation `json:"explanations,omitempty"`
+	Timestamp    string                         `json:"timestamp" example:"2025-06-22T12:00:00Z"`
+	NextCheck    string                         `json:"next_check" example:"2025-06-22T12:05:00Z"`
 } // @name TrustScoreResponse
 
 // ErrorResponse represents API error
@@ -131,3 +139,331 @@ type HealthResponse struct {
 	Version   string `json:"version" example:"1.0.0"`
 	Timestamp string `json:"timestamp" example:"2025-06-22T12:00:00Z"`
 } // @name HealthResponse
+
+// DeviceRequest registers or updates a device
+// @Description Device details reported by its agent
+type DeviceRequest struct {
+	Name        string `json:"name" example:"Work laptop"`
+	Platform    string `json:"platform" binding:"required" example:"macos"`
+	Fingerprint string `json:"fingerprint" binding:"required" example:"tpm:4f2a9c..."`
+	// Attestation is a Play Integrity or DeviceCheck token verified on
+	// registration, requested with Nonce from
+	// POST /devices/attestation/challenges
+	Attestation string `json:"attestation,omitempty"`
+	Nonce       string `json:"nonce,omitempty"`
+} // @name DeviceRequest
+
+// VerifyDeviceRequest carries attestation evidence
+// @Description Evidence a device presents to be verified
+type VerifyDeviceRequest struct {
+	// Fingerprint, Attestation and its Nonce are attestation evidence
+	Fingerprint string `json:"fingerprint,omitempty" example:"tpm:4f2a9c..."`
+	Attestation string `json:"attestation,omitempty"`
+	Nonce       string `json:"nonce,omitempty"`
+	// VerificationID and Code instead answer an email verification
+	VerificationID string `json:"verification_id,omitempty"`
+	Code           string `json:"code,omitempty" example:"042917"`
+} // @name VerifyDeviceRequest
+
+// StartVerificationRequest starts a device verification
+// @Description How the owner will verify the device: an emailed code, approval from another of their devices, or an administrator's approval
+type StartVerificationRequest struct {
+	Method string `json:"method" binding:"required" enums:"email,push,admin" example:"email"`
+} // @name StartVerificationRequest
+
+// VerificationDecisionRequest approves or denies a verification
+// @Description Whether the verification is approved
+type VerificationDecisionRequest struct {
+	Approve bool `json:"approve"`
+} // @name VerificationDecisionRequest
+
+// VerificationListResponse lists device verifications
+// @Description Device verifications, newest first
+type VerificationListResponse struct {
+	Verifications []*device.Verification `json:"verifications"`
+} // @name VerificationListResponse
+
+// DeviceActionRequest explains quarantining or blocking a device
+// @Description Why an administrator is quarantining or blocking the device
+type DeviceActionRequest struct {
+	Reason string `json:"reason,omitempty" example:"Reported stolen"`
+} // @name DeviceActionRequest
+
+// BindDeviceRequest binds a device to a hardware-backed key
+// @Description The key and its signature over the binding challenge
+type BindDeviceRequest struct {
+	PublicKey string `json:"public_key" binding:"required" example:"MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAE..."`
+	Signature string `json:"signature" binding:"required"`
+	// AuthenticatorData and ClientDataJSON are set when a WebAuthn
+	// authenticator signed the challenge
+	AuthenticatorData string `json:"authenticator_data,omitempty"`
+	ClientDataJSON    string `json:"client_data_json,omitempty"`
+} // @name BindDeviceRequest
+
+// BindChallengeResponse is a challenge for binding a device to a key
+// @Description Challenge the device key must sign
+type BindChallengeResponse struct {
+	Challenge string `json:"challenge" example:"q3Jx0d1c5b0tP8Xn6mVw2sQ9yE4rU7aL1kH3gF5jD0c"`
+	ExpiresIn int    `json:"expires_in" example:"300"`
+} // @name BindChallengeResponse
+
+// DeviceImportRow is a device to import
+// @Description A device to register; owner_id defaults to the importing user
+type DeviceImportRow struct {
+	OwnerID     string `json:"owner_id,omitempty" example:"user-123"`
+	Name        string `json:"name" example:"Work laptop"`
+	Platform    string `json:"platform" example:"windows"`
+	Fingerprint string `json:"fingerprint" example:"tpm:4f2a9c..."`
+} // @name DeviceImportRow
+
+// DeviceImportRequest is a JSON batch of devices to import
+// @Description Devices to import
+type DeviceImportRequest struct {
+	Devices []DeviceImportRow `json:"devices"`
+} // @name DeviceImportRequest
+
+// DeviceImportResult is the outcome of importing one row
+// @Description Outcome of one row; code is set for rejected rows
+type DeviceImportResult struct {
+	// Row counts from 1, excluding a CSV header
+	Row      int    `json:"row" example:"1"`
+	DeviceID string `json:"device_id,omitempty" example:"0b8e2a34-5c1d-4f7e-9a3b-2d6c8e1f0a47"`
+	Code     string `json:"code,omitempty" example:"DEVICE_ALREADY_REGISTERED"`
+	Message  string `json:"message,omitempty"`
+} // @name DeviceImportResult
+
+// DeviceImportResponse is the validation report of an import
+// @Description Rows imported, or that would be on a dry run, and rejected
+type DeviceImportResponse struct {
+	DryRun   bool                 `json:"dry_run"`
+	Imported int                  `json:"imported" example:"48"`
+	Rejected int                  `json:"rejected" example:"2"`
+	Results  []DeviceImportResult `json:"results"`
+} // @name DeviceImportResponse
+
+// DeviceSession is an SSO session created from a device
+// @Description A live session logged in from the device
+type DeviceSession struct {
+	UserID    string    `json:"user_id" example:"550e8400-e29b-41d4-a716-446655440000"`
+	Username  string    `json:"username,omitempty" example:"alice"`
+	IP        string    `json:"ip,omitempty" example:"203.0.113.7"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// TrustCap and ReauthRequired are set by continuous verification
+	TrustCap       int  `json:"trust_cap,omitempty"`
+	ReauthRequired bool `json:"reauth_required,omitempty"`
+} // @name DeviceSession
+
+// DeviceSessionsResponse lists the sessions created from a device
+// @Description Live sessions created from the device, oldest first
+type DeviceSessionsResponse struct {
+	DeviceID string          `json:"device_id"`
+	Sessions []DeviceSession `json:"sessions"`
+	Total    int             `json:"total" example:"2"`
+} // @name DeviceSessionsResponse
+
+// TerminateDeviceSessionsResponse reports a bulk termination
+// @Description How many sessions created from the device were ended
+type TerminateDeviceSessionsResponse struct {
+	DeviceID   string `json:"device_id"`
+	Terminated int    `json:"terminated" example:"2"`
+} // @name TerminateDeviceSessionsResponse
+
+// DeviceListResponse is a page of the user's devices
+// @Description Registered devices, oldest first
+type DeviceListResponse struct {
+	Devices    []*interfaces.DeviceInfo `json:"devices"`
+	Page       int                      `json:"page" example:"1"`
+	PageSize   int                      `json:"page_size" example:"20"`
+	Total      int                      `json:"total" example:"3"`
+	TotalPages int                      `json:"total_pages" example:"1"`
+} // @name DeviceListResponse
+
+// DeviceTrustScoreResponse is a device's current trust score
+// @Description Trust score of the user on a device
+type DeviceTrustScoreResponse struct {
+	DeviceID          string                         `json:"device_id" example:"0b8e2a34-5c1d-4f7e-9a3b-2d6c8e1f0a47"`
+	AttestationStatus string                         `json:"attestation_status" example:"verified"`
+	Integrity         string                         `json:"integrity,omitempty" example:"device"`
+	Compliance        string                         `json:"compliance,omitempty" example:"compliant"`
+	TrustScore        int                            `json:"trust_score" example:"88"`
+	Explanations      []interfaces.FactorExplanation `json:"explanations,omitempty"`
+	Timestamp         string                         `json:"timestamp" example:"2025-06-22T12:00:00Z"`
+} // @name DeviceTrustScoreResponse
+
+// PolicyRequest is an access policy to create or replace
+// @Description Access policy
+type PolicyRequest struct {
+	Name        string             `json:"name" binding:"required" example:"Admins manage devices"`
+	Description string             `json:"description,omitempty" example:"Administrators on trusted networks"`
+	Subjects    []string           `json:"subjects" binding:"required" example:"role:admin"`
+	Resources   []string           `json:"resources" binding:"required" example:"devices/*"`
+	Actions     []string           `json:"actions" binding:"required" example:"read,write"`
+	Conditions  []policy.Condition `json:"conditions,omitempty"`
+	Effect      string             `json:"effect" binding:"required" example:"allow"`
+	Obligations []string           `json:"obligations,omitempty" example:"audit"`
+} // @name PolicyRequest
+
+// PolicyListResponse lists access policies
+// @Description Access policies by name
+type PolicyListResponse struct {
+	Policies []*policy.Policy `json:"policies"`
+	Total    int              `json:"total" example:"3"`
+} // @name PolicyListResponse
+
+// PolicyVersionListResponse lists the versions of an access policy
+// @Description Versions of an access policy, newest first
+type PolicyVersionListResponse struct {
+	Versions []*policy.Policy `json:"versions"`
+	Total    int              `json:"total" example:"4"`
+} // @name PolicyVersionListResponse
+
+// PolicyEvaluationRequest is a request to decide against the policies
+// @Description Subject, resource and action to decide, with the attributes conditions test
+type PolicyEvaluationRequest struct {
+	Subject  string            `json:"subject,omitempty" example:"550e8400-e29b-41d4-a716-446655440000"`
+	Roles    []string          `json:"roles,omitempty" example:"admin"`
+	Resource string            `json:"resource" binding:"required" example:"devices/42"`
+	Action   string            `json:"action" binding:"required" example:"write"`
+	Context  map[string]string `json:"context,omitempty"`
+	Tags     map[string]string `json:"tags,omitempty"`
+} // @name PolicyEvaluationRequest
+
+// PolicyResourceRequest is a resource to register or replace
+// @Description Resource policies can select by tag
+type PolicyResourceRequest struct {
+	Name        string                       `json:"name" binding:"required" example:"Devices"`
+	Description string                       `json:"description,omitempty" example:"Registered devices and their posture"`
+	Parent      string                       `json:"parent,omitempty" example:"550e8400-e29b-41d4-a716-446655440000"`
+	Patterns    []string                     `json:"patterns,omitempty" example:"devices,devices/*"`
+	Tags        map[string]string            `json:"tags,omitempty"`
+	Actions     map[string]map[string]string `json:"actions,omitempty"`
+} // @name PolicyResourceRequest
+
+// PolicyResourceListResponse lists registered resources
+// @Description Resources policies can select by tag, by name
+type PolicyResourceListResponse struct {
+	Resources []*policy.Resource `json:"resources"`
+	Total     int                `json:"total" example:"6"`
+} // @name PolicyResourceListResponse
+
+// RoleRequest is a role to create or replace
+// @Description Role granting registered permissions
+type RoleRequest struct {
+	Name        string   `json:"name" binding:"required" example:"support-agent"`
+	Description string   `json:"description,omitempty" example:"Answers customer tickets"`
+	Permissions []string `json:"permissions,omitempty" example:"devices:read,billing:invoices:*"`
+	// Deny withholds permissions whatever grants them
+	Deny     []string `json:"deny,omitempty" example:"billing:invoices:delete"`
+	Inherits []string `json:"inherits,omitempty" example:"7c9e6679-7425-40de-944b-e07fc1f90ae7"`
+	// Conditions limit the grant of some permissions, by permission
+	Conditions map[string][]policy.Condition `json:"conditions,omitempty"`
+	// Reason is why the role is changed, for the audit trail
+	Reason string `json:"reason,omitempty" example:"Support now handles device resets"`
+} // @name RoleRequest
+
+// RoleListResponse lists roles
+// @Description Roles by name
+type RoleListResponse struct {
+	Roles []*rbac.Role `json:"roles"`
+	Total int          `json:"total" example:"3"`
+} // @name RoleListResponse
+
+// PermissionRequest is a permission to register
+// @Description Permission roles can grant
+type PermissionRequest struct {
+	Name        string `json:"name" binding:"required" example:"billing:invoices:approve"`
+	Description string `json:"description,omitempty" example:"Approve invoices"`
+	Reason      string `json:"reason,omitempty" example:"Invoice approval moves to the billing service"`
+} // @name PermissionRequest
+
+// PermissionListResponse lists permissions
+// @Description Permissions by name
+type PermissionListResponse struct {
+	Permissions []*rbac.Permission `json:"permissions"`
+	Total       int                `json:"total" example:"12"`
+} // @name PermissionListResponse
+
+// RoleAssignmentRequest gives a user a role
+// @Description Role to give a user
+type RoleAssignmentRequest struct {
+	UserID string `json:"user_id" binding:"required" example:"550e8400-e29b-41d4-a716-446655440000"`
+	RoleID string `json:"role_id" binding:"required" example:"7c9e6679-7425-40de-944b-e07fc1f90ae7"`
+	// Conditions limit the assignment, e.g. to a tenant
+	Conditions []policy.Condition `json:"conditions,omitempty"`
+	// ExpiresAt, when set, is when the assignment lapses
+	ExpiresAt *time.Time `json:"expires_at,omitempty" example:"2025-01-01T18:00:00Z"`
+	// Approver, when set, must approve the assignment before it is made
+	Approver string `json:"approver,omitempty" example:"security-lead"`
+	Reason   string `json:"reason,omitempty" example:"Incident INC-1234"`
+} // @name RoleAssignmentRequest
+
+// PermissionCheckRequest asks whether a subject may take an action on a
+// resource
+// @Description Permission check for other services
+type PermissionCheckRequest struct {
+	Subject string `json:"subject" binding:"required" example:"550e8400-e29b-41d4-a716-446655440000"`
+	// Service, when set, scopes the permission to <service>:<resource>:<action>
+	Service  string `json:"service,omitempty" example:"billing"`
+	Resource string `json:"resource" binding:"required" example:"invoices"`
+	Action   string `json:"action" binding:"required" example:"approve"`
+	// Context holds the attributes conditions test, e.g. department
+	Context map[string]string `json:"context,omitempty"`
+} // @name PermissionCheckRequest
+
+// ElevationRequest asks for a role for a while
+// @Description Just-in-time elevation to a role
+type ElevationRequest struct {
+	RoleID   string `json:"role_id" binding:"required" example:"7c9e6679-7425-40de-944b-e07fc1f90ae7"`
+	Reason   string `json:"reason" binding:"required" example:"Incident INC-1234"`
+	Duration string `json:"duration" binding:"required" example:"1h"`
+	// Approver, when set, is the only user who may decide the elevation
+	Approver string `json:"approver,omitempty" example:"security-lead"`
+} // @name ElevationRequest
+
+// ElevationListResponse lists elevations
+// @Description Elevations, oldest first
+type ElevationListResponse struct {
+	Elevations []*rbac.Elevation `json:"elevations"`
+	Total      int               `json:"total" example:"2"`
+} // @name ElevationListResponse
+
+// ConstraintRequest makes two roles mutually exclusive
+// @Description Separation-of-duties constraint
+type ConstraintRequest struct {
+	Roles       []string `json:"roles" binding:"required" example:"7c9e6679-7425-40de-944b-e07fc1f90ae7,9b2f4c1e-3d5a-4e6f-8a7b-0c1d2e3f4a5b"`
+	Description string   `json:"description,omitempty" example:"Whoever requests payments may not approve them"`
+	Reason      string   `json:"reason,omitempty" example:"SOX control FIN-12"`
+} // @name ConstraintRequest
+
+// RBACChangeListResponse lists RBAC changes
+// @Description RBAC changes, newest first
+type RBACChangeListResponse struct {
+	Changes []*rbac.Change `json:"changes"`
+	Count   int            `json:"count" example:"20"`
+	// NextBeforeSeq continues with the next page, or is 0 on the last
+	NextBeforeSeq int64 `json:"next_before_seq" example:"118"`
+} // @name RBACChangeListResponse
+
+// ConstraintListResponse lists constraints
+// @Description Separation-of-duties constraints, oldest first
+type ConstraintListResponse struct {
+	Constraints []*rbac.Constraint `json:"constraints"`
+	Total       int                `json:"total" example:"1"`
+} // @name ConstraintListResponse
+
+// ViolationListResponse lists users breaking constraints
+// @Description Separation-of-duties violations, by user
+type ViolationListResponse struct {
+	Violations []*rbac.Violation `json:"violations"`
+	Total      int               `json:"total" example:"0"`
+} // @name ViolationListResponse
+
+// UserPermissionsResponse lists the permissions a user's roles grant
+// @Description Permissions of a user, by name
+type UserPermissionsResponse struct {
+	UserID string `json:"user_id" example:"550e8400-e29b-41d4-a716-446655440000"`
+	// Effective is whether the permissions of inherited roles are included
+	Effective   bool     `json:"effective" example:"true"`
+	Permissions []string `json:"permissions" example:"devices:read,sessions:read"`
+} // @name UserPermissionsResponse
@@ -3,13 +3,17 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"log/slog"
+	"math"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -18,15 +22,44 @@ import (
 	"github.com/gin-gonic/gin"
 	ginSwagger "github.com/swaggo/gin-swagger"
 	swaggerFiles "github.com/swaggo/files"
+	"github.com/swaggo/swag"
+	"google.golang.org/grpc"
 
 	"github.com/lsendel/impl-zamaz/api"
+	"github.com/lsendel/impl-zamaz/pkg/admin"
+	"github.com/lsendel/impl-zamaz/pkg/attestation"
+	"github.com/lsendel/impl-zamaz/pkg/audit"
+	"github.com/lsendel/impl-zamaz/pkg/auth"
+	"github.com/lsendel/impl-zamaz/pkg/auth/apikeys"
+	"github.com/lsendel/impl-zamaz/pkg/authz"
+	"github.com/lsendel/impl-zamaz/pkg/device"
+	"github.com/lsendel/impl-zamaz/pkg/email"
+	"github.com/lsendel/impl-zamaz/pkg/extauthz"
+	"github.com/lsendel/impl-zamaz/pkg/groupsync"
+	"github.com/lsendel/impl-zamaz/pkg/health"
+	"github.com/lsendel/impl-zamaz/pkg/i18n"
+	"github.com/lsendel/impl-zamaz/pkg/mdm"
+	"github.com/lsendel/impl-zamaz/pkg/observability"
+	"github.com/lsendel/impl-zamaz/pkg/oidc"
+	"github.com/lsendel/impl-zamaz/pkg/policy"
+	"github.com/lsendel/impl-zamaz/pkg/posture"
+	"github.com/lsendel/impl-zamaz/pkg/proxy"
+	"github.com/lsendel/impl-zamaz/pkg/rbac"
+	"github.com/lsendel/impl-zamaz/pkg/replication"
+	"github.com/lsendel/impl-zamaz/pkg/risk"
+	"github.com/lsendel/impl-zamaz/pkg/scim"
+	"github.com/lsendel/impl-zamaz/pkg/session"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+	"github.com/lsendel/impl-zamaz/pkg/threatintel"
+	"github.com/lsendel/impl-zamaz/pkg/tracing"
+	"github.com/lsendel/impl-zamaz/pkg/trust"
+	"github.com/lsendel/impl-zamaz/pkg/webhook"
 	// Note: Advanced imports disabled for demo build
 	// "github.com/lsendel/impl-zamaz/pkg/discovery"
 	// "github.com/lsendel/impl-zamaz/pkg/interfaces"
 	// "github.com/lsendel/impl-zamaz/pkg/metrics"
 	// "github.com/lsendel/impl-zamaz/pkg/middleware"
 	// "github.com/lsendel/impl-zamaz/pkg/cache"
-	// frameworkHealth "github.com/lsendel/root-zamaz/libraries/observability-framework/pkg/health"
 	// "github.com/lsendel/impl-zamaz/pkg/security"
 	// "github.com/lsendel/impl-zamaz/pkg/performance"
 )
@@ -47,15 +80,437 @@ type Config struct {
 	ServerIdleTimeout   int    `env:"SERVER_IDLE_TIMEOUT" envDefault:"60"`
 	RateLimitRPM        int    `env:"RATE_LIMIT_RPM" envDefault:"100"`
 	RateLimitRetryAfter int    `env:"RATE_LIMIT_RETRY_AFTER" envDefault:"60"`
+	// Request bodies over MAX_REQUEST_SIZE bytes are refused with 413, and
+	// JSON bodies nesting deeper than MAX_JSON_DEPTH with 400; 0 disables
+	// a limit. SCIM groups need up to 4MB.
+	MaxRequestSize int64 `env:"MAX_REQUEST_SIZE" envDefault:"4194304"`
+	MaxJSONDepth   int   `env:"MAX_JSON_DEPTH" envDefault:"10"`
+	// Algorithms: fixed-window, token-bucket, sliding-window-log, leaky-bucket
+	RateLimitAlgorithm      string `env:"RATE_LIMIT_ALGORITHM" envDefault:"fixed-window"`
+	RateLimitBurst          int    `env:"RATE_LIMIT_BURST" envDefault:"0"`
+	LoginRateLimitRPM       int    `env:"LOGIN_RATE_LIMIT_RPM" envDefault:"10"`
+	LoginRateLimitAlgorithm string `env:"LOGIN_RATE_LIMIT_ALGORITHM" envDefault:"token-bucket"`
+	LoginRateLimitBurst     int    `env:"LOGIN_RATE_LIMIT_BURST" envDefault:"3"`
+	// Limits per user, API key, role and route are admin resources
+	// (/api/v1/admin/rate-limit-policies); replicas reload them every
+	// RATE_LIMIT_POLICY_CACHE_TTL seconds
+	RateLimitPolicyCacheTTL int `env:"RATE_LIMIT_POLICY_CACHE_TTL" envDefault:"10"`
+	// Failed logins that lock an account for LOGIN_LOCKOUT_TIME seconds; the
+	// counters live in the shared store. 0 disables lockout.
+	LoginMaxAttempts        int    `env:"LOGIN_MAX_ATTEMPTS" envDefault:"5"`
+	LoginLockoutTime        int    `env:"LOGIN_LOCKOUT_TIME" envDefault:"1800"`
+	// Failed logins spread over accounts or addresses block the addresses
+	// involved for LOGIN_IP_BLOCK_TIME seconds: LOGIN_MAX_ACCOUNTS_PER_IP
+	// accounts failing from one address, or LOGIN_MAX_IPS_PER_ACCOUNT
+	// addresses failing against one account, within LOGIN_FAILURE_WINDOW
+	// seconds. 0 disables a check.
+	LoginMaxAccountsPerIP   int    `env:"LOGIN_MAX_ACCOUNTS_PER_IP" envDefault:"10"`
+	LoginMaxIPsPerAccount   int    `env:"LOGIN_MAX_IPS_PER_ACCOUNT" envDefault:"10"`
+	LoginFailureWindow      int    `env:"LOGIN_FAILURE_WINDOW" envDefault:"900"`
+	LoginIPBlockTime        int    `env:"LOGIN_IP_BLOCK_TIME" envDefault:"3600"`
 	CORSMaxAge          int    `env:"CORS_MAX_AGE" envDefault:"86400"`
 	HealthEndpoint      string `env:"HEALTH_ENDPOINT" envDefault:"/health"`
 	HealthTimeout       int    `env:"HEALTH_TIMEOUT_SECONDS" envDefault:"5"`
+	HealthInterval      int    `env:"HEALTH_CHECK_INTERVAL" envDefault:"30"`
+	// HEALTH_CHECKS_FILE declares extra dependencies: postgres, kafka, nats,
+	// smtp, url and disk checks with their own timeout and criticality
+	HealthChecksFile string `env:"HEALTH_CHECKS_FILE"`
+
+	// Shared state configuration; use "redis" when running more than one replica
+	StateBackend string `env:"STATE_BACKEND" envDefault:"memory"`
+	RedisURL     string `env:"REDIS_URL" envDefault:"redis://localhost:6379"`
+
+	// Service registry backend: "store" keeps services in the shared state
+	// store, "consul" in the Consul KV store and "etcd" in etcd, under
+	// DISCOVERY_PREFIX. "kubernetes" lists the Endpoints of
+	// DISCOVERY_KUBERNETES_NAMESPACE read-only, defaulting to the pod's
+	// service account and namespace.
+	DiscoveryBackend             string `env:"DISCOVERY_BACKEND" envDefault:"store"`
+	DiscoveryPrefix              string `env:"DISCOVERY_PREFIX"`
+	DiscoveryConsulAddr          string `env:"DISCOVERY_CONSUL_ADDR" envDefault:"http://localhost:8500"`
+	DiscoveryConsulToken         string `env:"DISCOVERY_CONSUL_TOKEN"`
+	DiscoveryConsulDatacenter    string `env:"DISCOVERY_CONSUL_DATACENTER"`
+	DiscoveryEtcdEndpoint        string `env:"DISCOVERY_ETCD_ENDPOINT" envDefault:"http://localhost:2379"`
+	DiscoveryEtcdUsername        string `env:"DISCOVERY_ETCD_USERNAME"`
+	DiscoveryEtcdPassword        string `env:"DISCOVERY_ETCD_PASSWORD"`
+	DiscoveryKubernetesAPIServer string `env:"DISCOVERY_KUBERNETES_API_SERVER"`
+	DiscoveryKubernetesNamespace string `env:"DISCOVERY_KUBERNETES_NAMESPACE"`
+	DiscoveryKubernetesSelector  string `env:"DISCOVERY_KUBERNETES_SELECTOR"`
+	// Client certificate and key files presented by service health checks
+	// with mutual_tls set; reloaded when rotated
+	DiscoveryHealthClientCert string `env:"DISCOVERY_HEALTH_CLIENT_CERT"`
+	DiscoveryHealthClientKey  string `env:"DISCOVERY_HEALTH_CLIENT_KEY"`
+	// Anti-entropy between replicas; DISCOVERY_SYNC_PEERS lists the base
+	// URLs of the other replicas, DISCOVERY_SYNC_SECRET is shared by all
+	// and DISCOVERY_SYNC_REPLICA defaults to the hostname
+	DiscoverySyncPeers    string `env:"DISCOVERY_SYNC_PEERS"`
+	DiscoverySyncSecret   string `env:"DISCOVERY_SYNC_SECRET"`
+	DiscoverySyncReplica  string `env:"DISCOVERY_SYNC_REPLICA"`
+	DiscoverySyncInterval int    `env:"DISCOVERY_SYNC_INTERVAL" envDefault:"30"`
+	// DNS interface of the registry; DISCOVERY_DNS_ADDR, such as :8053,
+	// answers SRV and A queries for <name>.DISCOVERY_DNS_DOMAIN over UDP
+	// and TCP. TTL is in seconds.
+	DiscoveryDNSAddr   string `env:"DISCOVERY_DNS_ADDR"`
+	DiscoveryDNSDomain string `env:"DISCOVERY_DNS_DOMAIN" envDefault:"zt.local"`
+	DiscoveryDNSTTL    int    `env:"DISCOVERY_DNS_TTL" envDefault:"5"`
+
+	// Keycloak configuration
+	KeycloakBaseURL      string `env:"KEYCLOAK_BASE_URL" envDefault:"http://localhost:8082"`
+	KeycloakRealm        string `env:"KEYCLOAK_REALM" envDefault:"zerotrust-test"`
+	KeycloakClientID     string `env:"KEYCLOAK_CLIENT_ID" envDefault:"zerotrust-client"`
+	KeycloakClientSecret string `env:"KEYCLOAK_CLIENT_SECRET"`
+
+	// Login credential verification: "keycloak" (password grant), "local"
+	// (AUTH_LOCAL_USERS_FILE with bcrypt hashes) or "ldap" (simple bind).
+	// Backends other than keycloak get tokens from the token issuer.
+	AuthBackend        string `env:"AUTH_BACKEND" envDefault:"keycloak"`
+	AuthLocalUsersFile string `env:"AUTH_LOCAL_USERS_FILE"`
+	LDAPURL            string `env:"LDAP_URL"`
+	LDAPUserDNTemplate string `env:"LDAP_USER_DN_TEMPLATE"`
+	LDAPBindDN         string `env:"LDAP_BIND_DN"`
+	LDAPBindPassword   string `env:"LDAP_BIND_PASSWORD"`
+	LDAPBaseDN         string `env:"LDAP_BASE_DN"`
+	LDAPUserAttribute  string `env:"LDAP_USER_ATTRIBUTE" envDefault:"uid"`
+	LDAPGroupAttribute string `env:"LDAP_GROUP_ATTRIBUTE" envDefault:"memberOf"`
+
+	// Role assignments are synced every GROUP_SYNC_INTERVAL seconds from the
+	// groups of Keycloak, with the client's service account, when
+	// GROUP_SYNC_KEYCLOAK is set, and of the LDAP directory when
+	// GROUP_SYNC_LDAP is set. Mappings of groups to roles are managed under
+	// /api/v1/rbac/group-mappings.
+	GroupSyncInterval    int    `env:"GROUP_SYNC_INTERVAL" envDefault:"900"`
+	GroupSyncKeycloak    bool   `env:"GROUP_SYNC_KEYCLOAK"`
+	GroupSyncLDAP        bool   `env:"GROUP_SYNC_LDAP"`
+	LDAPGroupBaseDN      string `env:"LDAP_GROUP_BASE_DN"`
+	LDAPGroupObjectClass string `env:"LDAP_GROUP_OBJECT_CLASS" envDefault:"groupOfNames"`
+	LDAPMemberAttribute  string `env:"LDAP_GROUP_MEMBER_ATTRIBUTE" envDefault:"member"`
+
+	// SCIM 2.0 provisioning at /scim/v2 for identity providers such as Okta
+	// and Entra ID, authenticated with an API key with the scim:write scope.
+	// SCIM_SUBJECT is the user attribute that is the user's ID at login:
+	// userName or externalId.
+	SCIMEnabled bool   `env:"SCIM_ENABLED"`
+	SCIMSubject string `env:"SCIM_SUBJECT" envDefault:"userName"`
+
+	// Request authorization shared by the sidecar proxy and the ext_authz server
+	AuthzMinTrustLevel     int    `env:"AUTHZ_MIN_TRUST_LEVEL" envDefault:"0"`
+	AuthzDefaultTrustLevel int    `env:"AUTHZ_DEFAULT_TRUST_LEVEL" envDefault:"0"`
+	AuthzIntrospectionURL  string `env:"AUTHZ_INTROSPECTION_URL"`
+	AuthzRulesFile         string `env:"AUTHZ_RULES_FILE"`
+	// Token validation mode: "introspection" or "jwks" (local verification)
+	AuthzTokenValidation string `env:"AUTHZ_TOKEN_VALIDATION" envDefault:"introspection"`
+	AuthzJWKSURL         string `env:"AUTHZ_JWKS_URL"`
+	AuthzIssuer          string `env:"AUTHZ_ISSUER"`
+	AuthzAudience        string `env:"AUTHZ_AUDIENCE"`
+	AuthzJWKSRefresh     int    `env:"AUTHZ_JWKS_REFRESH_INTERVAL" envDefault:"900"`
+
+	// Envoy ext_authz gRPC server; 0 disables it
+	ExtAuthzPort int `env:"EXT_AUTHZ_GRPC_PORT" envDefault:"0"`
+
+	// OpenID Connect provider; setting OIDC_ISSUER enables it
+	OIDCIssuer         string `env:"OIDC_ISSUER"`
+	OIDCSigningKeyFile string `env:"OIDC_SIGNING_KEY_FILE"`
+	OIDCClientsFile    string `env:"OIDC_CLIENTS_FILE"`
+	OIDCUsersFile      string `env:"OIDC_USERS_FILE"`
+	// OIDC_CLAIM_MAPPING_FILE renames, removes and adds token claims
+	OIDCClaimMappingFile string `env:"OIDC_CLAIM_MAPPING_FILE"`
+	OIDCAccessTokenTTL int    `env:"OIDC_ACCESS_TOKEN_TTL" envDefault:"900"`
+	OIDCAuthCodeTTL    int    `env:"OIDC_AUTH_CODE_TTL" envDefault:"60"`
+
+	// OpenID Connect relying party: browser login with the authorization code
+	// flow and PKCE against the Keycloak realm. Setting OIDC_RP_REDIRECT_URL,
+	// the absolute URL of /api/v1/auth/callback, enables it; it requires
+	// SESSION_SECRET since the login ends in an SSO session.
+	OIDCRPRedirectURL string `env:"OIDC_RP_REDIRECT_URL"`
+	OIDCRPReturnTo    string `env:"OIDC_RP_RETURN_TO" envDefault:"/"`
+	OIDCRPStateTTL    int    `env:"OIDC_RP_STATE_TTL" envDefault:"600"`
+
+	// Token issuer shared by the OIDC provider and /auth/refresh.
+	// JWT_SIGNING_KEYS_FILE schedules RS256/ES256 keys for rotation; without
+	// it OIDC_SIGNING_KEY_FILE or an ephemeral JWT_SIGNING_ALGORITHM key
+	// is used. Durations are in seconds.
+	JWTIssuer           string `env:"JWT_ISSUER"`
+	JWTSigningKeysFile  string `env:"JWT_SIGNING_KEYS_FILE"`
+	JWTSigningAlgorithm string `env:"JWT_SIGNING_ALGORITHM" envDefault:"RS256"`
+	JWTKeyPrePublish    int    `env:"JWT_KEY_PREPUBLISH" envDefault:"3600"`
+	JWTKeyOverlap       int    `env:"JWT_KEY_OVERLAP" envDefault:"86400"`
+	JWTAccessTokenTTL   int    `env:"JWT_ACCESS_TOKEN_TTL" envDefault:"900"`
+	JWTRefreshTokenTTL  int    `env:"JWT_REFRESH_TOKEN_TTL" envDefault:"86400"`
+
+	// Step-up authentication: callers below a route's trust level answer a
+	// challenge with an enrolled factor to be elevated for a while.
+	// STEP_UP_TOTP_SECRETS_FILE maps user IDs to base32 TOTP secrets.
+	// Durations are in seconds.
+	StepUpTOTPSecretsFile string `env:"STEP_UP_TOTP_SECRETS_FILE"`
+	StepUpChallengeTTL    int    `env:"STEP_UP_CHALLENGE_TTL" envDefault:"300"`
+	StepUpElevationTTL    int    `env:"STEP_UP_ELEVATION_TTL" envDefault:"900"`
+	StepUpMaxAttempts     int    `env:"STEP_UP_MAX_ATTEMPTS" envDefault:"5"`
+	StepUpLockoutTime     int    `env:"STEP_UP_LOCKOUT_TIME" envDefault:"900"`
+	StepUpProtectedLevel  int    `env:"STEP_UP_PROTECTED_TRUST_LEVEL" envDefault:"50"`
+
+	// Fields masked in the responses of policy-decided routes to callers
+	// rated below SENSITIVE_FIELDS_TRUST_LEVEL, comma-separated names or
+	// dotted paths as in mask obligations, e.g. "email,phone,devices.*.serial"
+	SensitiveFields     string `env:"SENSITIVE_FIELDS"`
+	SensitiveTrustLevel int    `env:"SENSITIVE_FIELDS_TRUST_LEVEL" envDefault:"50"`
+
+	// Points each trust factor contributes at full confidence, e.g.
+	// "identity=30,device=25,behavior=20,location=15,risk=10" (the default);
+	// they must add up to 100
+	TrustWeights string `env:"TRUST_WEIGHTS"`
+	// Custom factors registered with trust.RegisterFactor count once they
+	// are weighted in TRUST_WEIGHTS. Each evaluation is bounded by
+	// TRUST_FACTOR_TIMEOUT seconds and runs through a circuit breaker named
+	// trust_factor:<name>.
+	TrustFactorTimeout int `env:"TRUST_FACTOR_TIMEOUT" envDefault:"2"`
+
+	// Impossible-travel detection; GEOIP_FILE, a JSON array of {cidr, country,
+	// city, latitude, longitude}, or GEOIP_MMDB enables it. Logins implying travel faster
+	// than TRAVEL_MAX_SPEED_KMH lower the trust score for TRAVEL_FLAG_TTL
+	// seconds, and are refused when TRAVEL_DENY is set.
+	GeoIPFile           string  `env:"GEOIP_FILE"`
+	TravelMaxSpeedKMH   float64 `env:"TRAVEL_MAX_SPEED_KMH" envDefault:"1000"`
+	TravelMinDistanceKM float64 `env:"TRAVEL_MIN_DISTANCE_KM" envDefault:"500"`
+	TravelDeny          bool    `env:"TRAVEL_DENY" envDefault:"false"`
+	TravelFlagTTL       int     `env:"TRAVEL_FLAG_TTL" envDefault:"86400"`
+
+	// MaxMind GeoIP2/GeoLite2 databases may be used instead of GEOIP_FILE:
+	// GEOIP_MMDB is a City or Country database and GEOIP_ASN_MMDB an
+	// optional ASN database; the last GEOIP_CACHE_SIZE lookups are cached.
+	// Set, LOCATION_ALLOWED_COUNTRIES (e.g. "US,CA") and
+	// LOCATION_ALLOWED_ASNS (e.g. "AS64500") lower the location factor of
+	// callers from anywhere else.
+	GeoIPMMDB                string `env:"GEOIP_MMDB"`
+	GeoIPASNMMDB             string `env:"GEOIP_ASN_MMDB"`
+	GeoIPCacheSize           int    `env:"GEOIP_CACHE_SIZE" envDefault:"10000"`
+	LocationAllowedCountries string `env:"LOCATION_ALLOWED_COUNTRIES"`
+	LocationAllowedASNs      string `env:"LOCATION_ALLOWED_ASNS"`
+
+	// The behavior factor compares each request's user agent, languages and
+	// X-TLS-Fingerprint (set by the TLS-terminating proxy) with the clients
+	// the user has used; a client is fully trusted after
+	// BEHAVIOR_CONSISTENT_AFTER requests. BEHAVIOR_PROFILE_TTL is in seconds.
+	BehaviorConsistentAfter int `env:"BEHAVIOR_CONSISTENT_AFTER" envDefault:"10"`
+	BehaviorMaxValues       int `env:"BEHAVIOR_MAX_VALUES" envDefault:"3"`
+	BehaviorProfileTTL      int `env:"BEHAVIOR_PROFILE_TTL" envDefault:"7776000"`
+
+	// The risk factor combines the RISK_DETECTORS enabled from velocity,
+	// new_geo (needs a GeoIP source), new_device, privilege_escalation,
+	// off_hours, baseline and ip_reputation (needs threat intelligence). Windows are in seconds; working hours run from
+	// RISK_WORK_START to RISK_WORK_END in RISK_TIMEZONE, which baselines
+	// also count hours in. Baselines score deviations once learned from
+	// RISK_BASELINE_MIN_REQUESTS requests and are kept RISK_BASELINE_TTL
+	// seconds.
+	RiskDetectors           string `env:"RISK_DETECTORS" envDefault:"velocity,new_geo,new_device,privilege_escalation,baseline,ip_reputation"`
+	RiskVelocityLimit       int    `env:"RISK_VELOCITY_LIMIT" envDefault:"120"`
+	RiskVelocityWindow      int    `env:"RISK_VELOCITY_WINDOW" envDefault:"60"`
+	RiskEscalationThreshold int    `env:"RISK_ESCALATION_THRESHOLD" envDefault:"3"`
+	RiskEscalationWindow    int    `env:"RISK_ESCALATION_WINDOW" envDefault:"600"`
+	RiskTimezone            string `env:"RISK_TIMEZONE" envDefault:"UTC"`
+	RiskWorkStart           int    `env:"RISK_WORK_START" envDefault:"7"`
+	RiskWorkEnd             int    `env:"RISK_WORK_END" envDefault:"19"`
+	RiskWorkWeekends        bool   `env:"RISK_WORK_WEEKENDS" envDefault:"false"`
+	RiskBaselineMinRequests int    `env:"RISK_BASELINE_MIN_REQUESTS" envDefault:"50"`
+	RiskBaselineTTL         int    `env:"RISK_BASELINE_TTL" envDefault:"7776000"`
+
+	// Threat intelligence scores client addresses for the ip_reputation
+	// risk detector. THREAT_INTEL_LISTS are comma-separated block list
+	// files or URLs reloaded every THREAT_INTEL_REFRESH seconds;
+	// THREAT_INTEL_API_URL is an AbuseIPDB-style API, e.g.
+	// https://api.abuseipdb.com/api/v2/check, queried with
+	// THREAT_INTEL_API_KEY. Verdicts are cached THREAT_INTEL_CACHE_TTL
+	// seconds. Set, THREAT_INTEL_BLOCK_SCORE (0-1) rejects sources scoring
+	// at least that much.
+	ThreatIntelLists      string  `env:"THREAT_INTEL_LISTS"`
+	ThreatIntelRefresh    int     `env:"THREAT_INTEL_REFRESH" envDefault:"3600"`
+	ThreatIntelAPIURL     string  `env:"THREAT_INTEL_API_URL"`
+	ThreatIntelAPIKey     string  `env:"THREAT_INTEL_API_KEY"`
+	ThreatIntelCacheTTL   int     `env:"THREAT_INTEL_CACHE_TTL" envDefault:"3600"`
+	ThreatIntelBlockScore float64 `env:"THREAT_INTEL_BLOCK_SCORE" envDefault:"0"`
+
+	// Client addresses allowed or denied per route are admin resources
+	// (/api/v1/admin/network-rules); replicas reload them every
+	// NETWORK_RULES_CACHE_TTL seconds. X-Forwarded-For is only believed
+	// from TRUSTED_PROXIES, comma-separated CIDR ranges or addresses.
+	NetworkRulesCacheTTL int    `env:"NETWORK_RULES_CACHE_TTL" envDefault:"10"`
+	TrustedProxies       string `env:"TRUSTED_PROXIES"`
+
+	// Kill switches taking the service, or routes of it, out of use are
+	// admin resources (/api/v1/admin/kill-switches); replicas reload them
+	// every KILL_SWITCH_CACHE_TTL seconds
+	KillSwitchCacheTTL int `env:"KILL_SWITCH_CACHE_TTL" envDefault:"5"`
+
+	// Device attestation. Android devices are verified with Play Integrity
+	// when PLAY_INTEGRITY_PACKAGE_NAME is set, using the base64 response
+	// encryption keys from the Play Console; iOS devices with DeviceCheck
+	// when DEVICECHECK_TEAM_ID is set, signing with the .p8 key in
+	// DEVICECHECK_KEY_FILE. DEVICECHECK_DEVELOPMENT uses Apple's
+	// development environment. Other platforms are verified by fingerprint.
+	// Tokens must be requested with a nonce from
+	// /api/v1/devices/attestation/challenges, usable once within
+	// ATTESTATION_NONCE_TTL seconds.
+	AttestationNonceTTL          int    `env:"ATTESTATION_NONCE_TTL" envDefault:"300"`
+	PlayIntegrityPackageName     string `env:"PLAY_INTEGRITY_PACKAGE_NAME"`
+	PlayIntegrityDecryptionKey   string `env:"PLAY_INTEGRITY_DECRYPTION_KEY"`
+	PlayIntegrityVerificationKey string `env:"PLAY_INTEGRITY_VERIFICATION_KEY"`
+	PlayIntegrityCertDigests     string `env:"PLAY_INTEGRITY_CERT_DIGESTS"`
+	DeviceCheckTeamID            string `env:"DEVICECHECK_TEAM_ID"`
+	DeviceCheckKeyID             string `env:"DEVICECHECK_KEY_ID"`
+	DeviceCheckKeyFile           string `env:"DEVICECHECK_KEY_FILE"`
+	DeviceCheckDevelopment       bool   `env:"DEVICECHECK_DEVELOPMENT" envDefault:"false"`
+
+	// Devices bound to a TPM or WebAuthn key sign requests with
+	// X-Device-Assertion, accepted within DEVICE_ASSERTION_WINDOW seconds
+	// of the server clock. DEVICE_WEBAUTHN_RP_ID, when set, is the relying
+	// party WebAuthn keys must be scoped to.
+	DeviceAssertionWindow int    `env:"DEVICE_ASSERTION_WINDOW" envDefault:"60"`
+	DeviceWebAuthnRPID    string `env:"DEVICE_WEBAUTHN_RP_ID"`
+
+	// Devices unseen for DEVICE_STALE_AFTER days lose trust, and after
+	// DEVICE_QUARANTINE_AFTER days are quarantined until verified again.
+	// Devices are checked every DEVICE_DECAY_INTERVAL seconds; 0 disables
+	// it. Devices are seen when they sign requests, report posture or pass
+	// verification.
+	DeviceStaleAfter      int `env:"DEVICE_STALE_AFTER" envDefault:"30"`
+	DeviceQuarantineAfter int `env:"DEVICE_QUARANTINE_AFTER" envDefault:"90"`
+	DeviceDecayInterval   int `env:"DEVICE_DECAY_INTERVAL" envDefault:"3600"`
+
+	// Owners verify devices with a code mailed through SMTP_ADDR, approval
+	// from another of their bound devices or an administrator's approval,
+	// answered within DEVICE_VERIFICATION_TTL seconds. Codes fail after
+	// DEVICE_VERIFICATION_MAX_ATTEMPTS wrong answers.
+	DeviceVerificationTTL         int `env:"DEVICE_VERIFICATION_TTL" envDefault:"600"`
+	DeviceVerificationMaxAttempts int `env:"DEVICE_VERIFICATION_MAX_ATTEMPTS" envDefault:"5"`
+
+	// Logins from a fingerprint (X-Device-Fingerprint) none of the user's
+	// devices have are mailed to the user, audited and sent to webhooks,
+	// once per DEVICE_UNKNOWN_TTL days. DEVICE_UNKNOWN_TRUST_CAP, when set,
+	// caps the trust level of their SSO sessions until the device is
+	// registered and verified.
+	DeviceUnknownTTL      int `env:"DEVICE_UNKNOWN_TTL" envDefault:"30"`
+	DeviceUnknownTrustCap int `env:"DEVICE_UNKNOWN_TRUST_CAP" envDefault:"0"`
+
+	// Device compliance is synced every MDM_SYNC_INTERVAL seconds from
+	// Intune when INTUNE_TENANT_ID is set and from Jamf Pro when JAMF_URL
+	// is set. Jamf computers are compliant when managed and, if
+	// JAMF_COMPLIANCE_GROUP_ID is set, members of that smart group.
+	MDMSyncInterval       int    `env:"MDM_SYNC_INTERVAL" envDefault:"900"`
+	IntuneTenantID        string `env:"INTUNE_TENANT_ID"`
+	IntuneClientID        string `env:"INTUNE_CLIENT_ID"`
+	IntuneClientSecret    string `env:"INTUNE_CLIENT_SECRET"`
+	JamfURL               string `env:"JAMF_URL"`
+	JamfClientID          string `env:"JAMF_CLIENT_ID"`
+	JamfClientSecret      string `env:"JAMF_CLIENT_SECRET"`
+	JamfComplianceGroupID int    `env:"JAMF_COMPLIANCE_GROUP_ID"`
+
+	// Endpoint agents report device posture to /api/v1/devices/:id/posture.
+	// Devices are non-compliant below the POSTURE_MIN_OS_VERSIONS of their
+	// platform (e.g. "windows=10.0.19045,macos=14.0"), without disk
+	// encryption or EDR when required, with patches older than
+	// POSTURE_MAX_PATCH_AGE days (0 disables the check), or without a
+	// report for POSTURE_MAX_REPORT_AGE seconds; this lowers their trust.
+	PostureMinOSVersions         string `env:"POSTURE_MIN_OS_VERSIONS"`
+	PostureRequireDiskEncryption bool   `env:"POSTURE_REQUIRE_DISK_ENCRYPTION" envDefault:"true"`
+	PostureMaxPatchAge           int    `env:"POSTURE_MAX_PATCH_AGE" envDefault:"90"`
+	PostureRequireEDR            bool   `env:"POSTURE_REQUIRE_EDR" envDefault:"false"`
+	PostureMaxReportAge          int    `env:"POSTURE_MAX_REPORT_AGE" envDefault:"86400"`
+
+	// Webhooks notified when trust scores cross thresholds are admin
+	// resources (/api/v1/admin/webhooks); failed deliveries are retried up
+	// to WEBHOOK_MAX_ATTEMPTS times. WEBHOOK_TIMEOUT is in seconds.
+	WebhookMaxAttempts int `env:"WEBHOOK_MAX_ATTEMPTS" envDefault:"5"`
+	WebhookTimeout     int `env:"WEBHOOK_TIMEOUT" envDefault:"10"`
+
+	// Access levels granted per trust score come from the admin resource
+	// /api/v1/admin/access-policies/default, falling back to the built-in
+	// thresholds; replicas reload it every ACCESS_POLICY_CACHE_TTL seconds.
+	AccessPolicyCacheTTL int `env:"ACCESS_POLICY_CACHE_TTL" envDefault:"10"`
+
+	// Email login with a one-time link or code; setting MAGIC_LINK_VERIFY_URL,
+	// the absolute URL of /api/v1/auth/magic-link/verify, enables it. Users
+	// come from AUTH_LOCAL_USERS_FILE, or else any address in
+	// MAGIC_LINK_ALLOWED_DOMAINS may log in with DEMO_ROLE. Without SMTP_ADDR
+	// emails are only logged.
+	MagicLinkVerifyURL      string `env:"MAGIC_LINK_VERIFY_URL"`
+	MagicLinkTTL            int    `env:"MAGIC_LINK_TTL" envDefault:"600"`
+	MagicLinkAllowedDomains string `env:"MAGIC_LINK_ALLOWED_DOMAINS"`
+	SMTPAddr                string `env:"SMTP_ADDR"`
+	SMTPUsername            string `env:"SMTP_USERNAME"`
+	SMTPPassword            string `env:"SMTP_PASSWORD"`
+	SMTPFrom                string `env:"SMTP_FROM" envDefault:"no-reply@localhost"`
+
+	// Browser SSO session shared by first-party apps; setting SESSION_SECRET
+	// enables it. Use a parent domain such as ".example.com" to span subdomains.
+	SessionSecret       string `env:"SESSION_SECRET"`
+	SessionCookieName   string `env:"SESSION_COOKIE_NAME" envDefault:"zamaz_session"`
+	SessionCookieDomain string `env:"SESSION_COOKIE_DOMAIN"`
+	SessionCookieSecure bool   `env:"SESSION_COOKIE_SECURE" envDefault:"true"`
+	SessionSameSite     string `env:"SESSION_SAME_SITE" envDefault:"lax"`
+	SessionTTL          int    `env:"SESSION_TTL" envDefault:"28800"`
+	// Sessions without requests for SESSION_IDLE_TIMEOUT seconds end early; 0
+	// keeps them for the whole SESSION_TTL
+	SessionIdleTimeout  int    `env:"SESSION_IDLE_TIMEOUT" envDefault:"1800"`
+
+	// Continuous verification re-scores the users of SSO sessions every
+	// VERIFICATION_INTERVAL seconds (0 disables it). Sessions scoring below
+	// VERIFICATION_DOWNGRADE_BELOW need step-up for routes above their score,
+	// below VERIFICATION_REAUTH_BELOW they end at their next use and below
+	// VERIFICATION_TERMINATE_BELOW they end at once.
+	VerificationInterval       int `env:"VERIFICATION_INTERVAL" envDefault:"60"`
+	VerificationDowngradeBelow int `env:"VERIFICATION_DOWNGRADE_BELOW" envDefault:"50"`
+	VerificationReauthBelow    int `env:"VERIFICATION_REAUTH_BELOW" envDefault:"25"`
+	VerificationTerminateBelow int `env:"VERIFICATION_TERMINATE_BELOW" envDefault:"10"`
+
+	// Sidecar proxy configuration; setting PROXY_UPSTREAM enables proxy mode
+	ProxyUpstream             string `env:"PROXY_UPSTREAM"`
+	ProxyForwardAuthorization bool   `env:"PROXY_FORWARD_AUTHORIZATION" envDefault:"false"`
+	// Gateway mode routes /proxy/:service/* to registered services, enforcing
+	// their trust levels; PROXY_FORWARD_AUTHORIZATION applies to it too.
+	// Each service is called through a circuit breaker named
+	// "service:<name>", degraded in discovery while it is open.
+	GatewayEnabled bool `env:"GATEWAY_ENABLED" envDefault:"false"`
 	
-	// Demo user configuration
-	DemoUserID       string `env:"DEMO_USER_ID" envDefault:"demo-user"`
-	DemoUsername     string `env:"DEMO_USERNAME" envDefault:"demo"`
-	DemoEmail        string `env:"DEMO_EMAIL" envDefault:"demo@example.com"`
-	DemoRole         string `env:"DEMO_ROLE" envDefault:"user"`
+	// Role of users without a directory entry, e.g. those signing in by email
+	DemoRole string `env:"DEMO_ROLE" envDefault:"user"`
+
+	// Role required for the declarative admin API
+	AdminRole string `env:"ADMIN_ROLE" envDefault:"admin"`
+
+	// Audit log; AUDIT_ENDPOINTS_FILE lists the per-tenant SOC webhooks
+	AuditEndpointsFile string `env:"AUDIT_ENDPOINTS_FILE"`
+	AuditRetention     int    `env:"AUDIT_RETENTION" envDefault:"604800"`
+	AuditDefaultTenant string `env:"AUDIT_DEFAULT_TENANT" envDefault:"default"`
+
+	// Signed machine requests; API_KEYS_FILE lists the HMAC keys and
+	// SIGNATURE_WINDOW the accepted timestamp skew in seconds. Requests to
+	// the comma-separated path prefixes in SIGNED_ROUTES must be signed.
+	APIKeysFile     string `env:"API_KEYS_FILE"`
+	SignatureWindow int    `env:"SIGNATURE_WINDOW" envDefault:"300"`
+	SignedRoutes    string `env:"SIGNED_ROUTES"`
+
+	// Managed API keys sent as X-API-Key; limits are requests per minute
+	// and apply to keys created without their own
+	APIKeyDefaultRateLimit int `env:"API_KEY_DEFAULT_RATE_LIMIT" envDefault:"600"`
+	APIKeyMaxRateLimit     int `env:"API_KEY_MAX_RATE_LIMIT" envDefault:"6000"`
+
+	// Multi-region replication; REPLICATION_FILE names the region, its
+	// peers and the shared secret
+	ReplicationFile string `env:"REPLICATION_FILE"`
+
+	// Fail-static mode; while the shared store is down reads are served
+	// from local copies at most FAIL_STATIC_MAX_STALE seconds old and
+	// mutations are refused with 503
+	FailStatic         bool `env:"FAIL_STATIC" envDefault:"true"`
+	FailStaticMaxStale int  `env:"FAIL_STATIC_MAX_STALE" envDefault:"300"`
+
+	// Thresholds for the generated Prometheus rules
+	PrometheusJob          string  `env:"PROMETHEUS_JOB" envDefault:"impl-zamaz"`
+	SLOAvailabilityTarget  float64 `env:"SLO_AVAILABILITY_TARGET" envDefault:"0.999"`
+	AlertAuthFailureRate   float64 `env:"ALERT_AUTH_FAILURE_RATE" envDefault:"1"`
+	AlertHealthFlapChanges int     `env:"ALERT_HEALTH_FLAP_CHANGES" envDefault:"4"`
+
+	// CIRCUIT_BREAKERS_FILE sets per-dependency breaker thresholds
+	CircuitBreakersFile string `env:"CIRCUIT_BREAKERS_FILE"`
 }
 
 // Global variables
@@ -85,6 +540,13 @@ func main() {
 	}))
 	slog.SetDefault(logger)
 
+	// Trace requests with OpenTelemetry, exporting over OTLP when configured
+	shutdownTracing, exportingTraces, err := tracing.Setup(context.Background(), "impl-zamaz", "1.0.0")
+	if err != nil {
+		log.Fatal("Failed to initialize tracing:", err)
+	}
+	logger.Info("Tracing initialized", "exporting", exportingTraces)
+
 	// Initialize enhanced metrics collector using framework
 	metricsCollector := metrics.NewEnhancedPrometheusCollector()
 	structLogger := &structuredLogger{logger}
@@ -106,26 +568,51 @@ func main() {
 		// Continue without cache for demo
 	}
 
+	// Initialize shared state store so replicas agree on rate limits and registry state
+	sharedStore, err := store.New(cfg.StateBackend, cfg.RedisURL)
+	if err != nil {
+		log.Fatal("Failed to initialize shared state store:", err)
+	}
+	var replicator *replication.Replicator
+	var replicationConfig replication.Config
+	if cfg.ReplicationFile != "" {
+		if replicationConfig, err = replication.LoadConfig(cfg.ReplicationFile); err != nil {
+			log.Fatal("Failed to load replication config:", err)
+		}
+		if replicator, err = replication.New(sharedStore, replicationConfig, structLogger, metricsCollector); err != nil {
+			log.Fatal("Failed to initialize replication:", err)
+		}
+		sharedStore = replicator
+		logger.Info("Multi-region replication enabled", "region", replicator.Region(), "peers", len(replicationConfig.Peers))
+	}
+	var failStatic *store.FailStaticStore
+	if cfg.FailStatic {
+		failStatic = store.NewFailStaticStore(sharedStore, time.Duration(cfg.FailStaticMaxStale)*time.Second, structLogger, metricsCollector)
+		sharedStore = failStatic
+	}
+	sharedStore = store.NewTracedStore(sharedStore)
+	logger.Info("Shared state store initialized", "backend", cfg.StateBackend, "fail_static", cfg.FailStatic)
+
 	// Initialize security components
 	securityConfig := &security.SecurityConfig{
 		JWTSecret:           "your-secret-key-change-in-production",
 		JWTExpiration:       15 * time.Minute,
 		RefreshExpiration:   7 * 24 * time.Hour,
-		MaxLoginAttempts:    5,
-		LoginLockoutTime:    30 * time.Minute,
+		MaxLoginAttempts:    cfg.LoginMaxAttempts,
+		LoginLockoutTime:    time.Duration(cfg.LoginLockoutTime) * time.Second,
 		RequireHTTPS:        false, // Set to true in production
 		RequireStrongPasswd: true,
-		SessionTimeout:      24 * time.Hour,
+		SessionTimeout:      time.Duration(cfg.SessionIdleTimeout) * time.Second,
 		CSRFTokenExpiry:     1 * time.Hour,
 	}
 	
 	authManager := security.NewAuthManager(securityConfig, structLogger, metricsCollector)
 	
 	validationConfig := &security.ValidationConfig{
-		MaxRequestSize:    1048576, // 1MB
-		MaxHeaderSize:     8192,    // 8KB
+		MaxRequestSize:    cfg.MaxRequestSize,
+		MaxHeaderSize:     8192, // 8KB
 		MaxQueryParams:    100,
-		MaxJSONDepth:      10,
+		MaxJSONDepth:      cfg.MaxJSONDepth,
 		EnableSQLCheck:    true,
 		EnableXSSCheck:    true,
 		EnablePathCheck:   true,
@@ -138,7 +625,31 @@ func main() {
 	
 	inputValidator := security.NewInputValidator(validationConfig, structLogger, metricsCollector)
 	
-	circuitBreakerManager := security.NewCircuitBreakerManager(structLogger, metricsCollector)
+	circuitBreakerManager := security.NewCircuitBreakerManager(sharedStore, structLogger, metricsCollector)
+	if cfg.CircuitBreakersFile != "" {
+		if err := circuitBreakerManager.LoadBreakers(cfg.CircuitBreakersFile); err != nil {
+			log.Fatal("Failed to load circuit breakers:", err)
+		}
+	}
+
+	// Revocations outlive every token they can block, refresh tokens included
+	revocations := security.NewRevocationStore(sharedStore, time.Duration(cfg.JWTRefreshTokenTTL)*time.Second, structLogger, metricsCollector)
+	var lockout *security.Lockout
+	if cfg.LoginMaxAttempts > 0 {
+		lockout = security.NewLockout(security.LockoutConfig{
+			MaxAttempts: cfg.LoginMaxAttempts,
+			LockoutTime: time.Duration(cfg.LoginLockoutTime) * time.Second,
+		}, sharedStore, structLogger, metricsCollector)
+	}
+	var bruteForce *security.BruteForce
+	if cfg.LoginMaxAccountsPerIP > 0 || cfg.LoginMaxIPsPerAccount > 0 {
+		bruteForce = security.NewBruteForce(security.BruteForceConfig{
+			MaxAccountsPerIP: cfg.LoginMaxAccountsPerIP,
+			MaxIPsPerAccount: cfg.LoginMaxIPsPerAccount,
+			Window:           time.Duration(cfg.LoginFailureWindow) * time.Second,
+			BlockTime:        time.Duration(cfg.LoginIPBlockTime) * time.Second,
+		}, sharedStore, structLogger, metricsCollector)
+	}
 	
 	// Initialize performance manager
 	performanceConfig := &performance.PerformanceConfig{
@@ -163,25 +674,289 @@ func main() {
 	
 	performanceManager := performance.NewPerformanceManager(performanceConfig, structLogger, metricsCollector)
 
-	// Initialize framework health checker
-	healthChecker := frameworkHealth.NewHealthChecker()
-	
-	// Register dependencies with health checker
-	healthChecker.RegisterDependency("redis", &frameworkHealth.RedisCheck{
-		URL:     "localhost:6379",
-		Timeout: 3 * time.Second,
-	})
-	
+	// Initialize dependency health checks; the shared store is critical
+	// unless fail-static mode keeps the service answering without it
+	healthChecker := health.NewChecker(structLogger, metricsCollector)
+	if err := healthChecker.Register(health.Dependency{
+		Name:     cfg.StateBackend,
+		Check:    health.CheckFunc(sharedStore.Ping),
+		Timeout:  time.Duration(cfg.HealthTimeout) * time.Second,
+		Critical: !cfg.FailStatic,
+	}); err != nil {
+		log.Fatal("Failed to register health check:", err)
+	}
+	if replicator != nil {
+		if err := healthChecker.Register(health.Dependency{
+			Name:  "replication",
+			Check: health.CheckFunc(replicator.HealthCheck),
+		}); err != nil {
+			log.Fatal("Failed to register health check:", err)
+		}
+	}
+	if cfg.HealthChecksFile != "" {
+		deps, err := health.LoadChecks(cfg.HealthChecksFile)
+		if err != nil {
+			log.Fatal("Failed to load health checks:", err)
+		}
+		for _, dep := range deps {
+			if err := healthChecker.Register(dep); err != nil {
+				log.Fatal("Failed to register health check:", err)
+			}
+		}
+	}
+
 	// Initialize service registry
-	serviceRegistry := discovery.NewServiceRegistry()
+	registryBackend, err := discovery.NewBackend(discovery.BackendConfig{
+		Kind:   cfg.DiscoveryBackend,
+		Prefix: cfg.DiscoveryPrefix,
+		Consul: discovery.ConsulConfig{
+			Address:    cfg.DiscoveryConsulAddr,
+			Token:      cfg.DiscoveryConsulToken,
+			Datacenter: cfg.DiscoveryConsulDatacenter,
+		},
+		Etcd: discovery.EtcdConfig{
+			Endpoint: cfg.DiscoveryEtcdEndpoint,
+			Username: cfg.DiscoveryEtcdUsername,
+			Password: cfg.DiscoveryEtcdPassword,
+		},
+		Kubernetes: discovery.KubernetesConfig{
+			APIServer:     cfg.DiscoveryKubernetesAPIServer,
+			Namespace:     cfg.DiscoveryKubernetesNamespace,
+			LabelSelector: cfg.DiscoveryKubernetesSelector,
+		},
+	}, sharedStore)
+	if err != nil {
+		log.Fatal("Failed to initialize service registry backend:", err)
+	}
+	serviceRegistry := discovery.NewServiceRegistryWithBackend(registryBackend)
+	if cfg.DiscoveryHealthClientCert != "" {
+		if err := serviceRegistry.SetClientCertificate(cfg.DiscoveryHealthClientCert, cfg.DiscoveryHealthClientKey); err != nil {
+			log.Fatal("Failed to load health check client certificate:", err)
+		}
+	}
+	logger.Info("Service registry initialized", "backend", cfg.DiscoveryBackend)
+	var registrySync *discovery.Syncer
+	if cfg.DiscoverySyncPeers != "" {
+		replica := cfg.DiscoverySyncReplica
+		if replica == "" {
+			replica, _ = os.Hostname()
+		}
+		var peers []string
+		for _, peer := range strings.Split(cfg.DiscoverySyncPeers, ",") {
+			if peer = strings.TrimSpace(peer); peer != "" {
+				peers = append(peers, peer)
+			}
+		}
+		registrySync, err = discovery.NewSyncer(serviceRegistry, discovery.SyncConfig{
+			Replica:  replica,
+			Secret:   cfg.DiscoverySyncSecret,
+			Peers:    peers,
+			Interval: time.Duration(cfg.DiscoverySyncInterval) * time.Second,
+		})
+		if err != nil {
+			log.Fatal("Failed to initialize service registry sync:", err)
+		}
+		logger.Info("Service registry sync enabled", "replica", replica, "peers", len(peers))
+	}
+
+	// Declarative admin resources for infrastructure-as-code tooling
+	adminManager := admin.NewManager(sharedStore, structLogger, metricsCollector,
+		admin.RoleKind(),
+		admin.PolicyKind(),
+		admin.TenantKind(),
+		admin.ServiceKind(serviceRegistry),
+		admin.WebhookKind(),
+		admin.AccessPolicyKind(),
+		admin.RateLimitPolicyKind(),
+		admin.NetworkRuleKind(),
+		admin.KillSwitchKind(),
+	)
+
+	// Initialize the optional SSO session
+	var sessions *session.Manager
+	if cfg.SessionSecret != "" {
+		sameSite, err := session.ParseSameSite(cfg.SessionSameSite)
+		if err != nil {
+			log.Fatal("Invalid SESSION_SAME_SITE:", err)
+		}
+		sessions, err = session.NewManager(session.Config{
+			CookieName:  cfg.SessionCookieName,
+			Domain:      cfg.SessionCookieDomain,
+			Secure:      cfg.SessionCookieSecure,
+			SameSite:    sameSite,
+			TTL:         time.Duration(cfg.SessionTTL) * time.Second,
+			IdleTimeout: time.Duration(cfg.SessionIdleTimeout) * time.Second,
+			Secret:      []byte(cfg.SessionSecret),
+			Device: func(c *gin.Context) string {
+				if bound, ok := c.Get(trust.BoundDeviceKey); ok {
+					return bound.(*interfaces.DeviceInfo).ID
+				}
+				return ""
+			},
+		}, sharedStore, structLogger, metricsCollector)
+		if err != nil {
+			log.Fatal("Failed to initialize SSO sessions:", err)
+		}
+		logger.Info("SSO session cookie enabled", "domain", cfg.SessionCookieDomain, "same_site", cfg.SessionSameSite)
+	}
 
 	// Start health checks in background
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	go serviceRegistry.StartHealthChecks(ctx, time.Duration(cfg.HealthCheckTimeout)*time.Second)
+	healthChecker.Start(ctx, time.Duration(cfg.HealthInterval)*time.Second)
+	if replicator != nil {
+		replicator.Start(ctx)
+	}
+	if registrySync != nil {
+		registrySync.Start(ctx)
+	}
+	if cfg.DiscoveryDNSAddr != "" {
+		dnsServer, err := discovery.NewDNSServer(serviceRegistry, discovery.DNSConfig{
+			Addr:   cfg.DiscoveryDNSAddr,
+			Domain: cfg.DiscoveryDNSDomain,
+			TTL:    time.Duration(cfg.DiscoveryDNSTTL) * time.Second,
+		})
+		if err != nil {
+			log.Fatal("Failed to initialize service registry DNS:", err)
+		}
+		go func() {
+			if err := dnsServer.ListenAndServe(ctx); err != nil {
+				logger.Error("Service registry DNS server stopped", "error", err)
+			}
+		}()
+		logger.Info("Service registry DNS enabled", "addr", cfg.DiscoveryDNSAddr, "domain", cfg.DiscoveryDNSDomain)
+	}
+
+	// Ordered audit log with webhook delivery to SOC pipelines
+	auditLog := audit.NewLog(sharedStore, time.Duration(cfg.AuditRetention)*time.Second, structLogger, metricsCollector)
+	if cfg.AuditEndpointsFile != "" {
+		endpoints, err := audit.LoadEndpoints(cfg.AuditEndpointsFile)
+		if err != nil {
+			log.Fatal("Failed to load audit endpoints:", err)
+		}
+		audit.NewDispatcher(audit.DispatcherConfig{Endpoints: endpoints}, auditLog, sharedStore, structLogger, metricsCollector).Start(ctx)
+		logger.Info("Audit webhook delivery enabled", "endpoints", len(endpoints))
+	}
+
+	// Initialize request authorization for the sidecar proxy and ext_authz
+	var tokenValidator authz.TokenValidator
+	switch cfg.AuthzTokenValidation {
+	case "jwks":
+		jwksURL := cfg.AuthzJWKSURL
+		if jwksURL == "" {
+			jwksURL = authz.KeycloakJWKSURL(cfg.KeycloakBaseURL, cfg.KeycloakRealm)
+		}
+		issuerURL := cfg.AuthzIssuer
+		if issuerURL == "" {
+			issuerURL = authz.KeycloakRealmURL(cfg.KeycloakBaseURL, cfg.KeycloakRealm)
+		}
+		jwksClient := auth.NewJWKSClient(auth.JWKSConfig{
+			URL:             jwksURL,
+			RefreshInterval: time.Duration(cfg.AuthzJWKSRefresh) * time.Second,
+		}, structLogger, metricsCollector)
+		jwksClient.Start(ctx)
+		jwtValidator := authz.NewJWTValidator(jwksClient, issuerURL, cfg.AuthzAudience)
+		jwtValidator.DefaultTrustLevel = cfg.AuthzDefaultTrustLevel
+		tokenValidator = jwtValidator
+	case "introspection":
+		introspectionURL := cfg.AuthzIntrospectionURL
+		if introspectionURL == "" {
+			introspectionURL = authz.KeycloakIntrospectionURL(cfg.KeycloakBaseURL, cfg.KeycloakRealm)
+		}
+		introspectionValidator := authz.NewIntrospectionValidator(introspectionURL, cfg.KeycloakClientID, cfg.KeycloakClientSecret)
+		introspectionValidator.DefaultTrustLevel = cfg.AuthzDefaultTrustLevel
+		tokenValidator = introspectionValidator
+	default:
+		log.Fatal("Unknown AUTHZ_TOKEN_VALIDATION mode:", cfg.AuthzTokenValidation)
+	}
+
+	var authzRules []authz.Rule
+	if cfg.AuthzRulesFile != "" {
+		if authzRules, err = authz.LoadRules(cfg.AuthzRulesFile); err != nil {
+			log.Fatal("Failed to load authorization rules:", err)
+		}
+	}
+
+	// Places callers for trust factors and policy conditions on country
+	var geo trust.GeoLocator
+	switch {
+	case cfg.GeoIPFile != "" && cfg.GeoIPMMDB != "":
+		log.Fatal("Set only one of GEOIP_FILE and GEOIP_MMDB")
+	case cfg.GeoIPFile != "":
+		locator, err := trust.LoadGeoIP(cfg.GeoIPFile)
+		if err != nil {
+			log.Fatal("Failed to load GeoIP file:", err)
+		}
+		geo = locator
+	case cfg.GeoIPMMDB != "":
+		locator, err := trust.OpenMMDB(cfg.GeoIPMMDB, cfg.GeoIPASNMMDB)
+		if err != nil {
+			log.Fatal("Failed to load MaxMind database:", err)
+		}
+		geo = trust.NewCachedLocator(locator, cfg.GeoIPCacheSize)
+	}
+
+	// The sidecar and ext_authz decide by the same policies as the API
+	policyEngine := policy.NewEngine(policy.Config{}, sharedStore)
+	authorizer, err := authz.NewAuthorizer(authz.Config{
+		MinTrustLevel: cfg.AuthzMinTrustLevel,
+		Rules:         authzRules,
+		Validator:     tokenValidator,
+		Policies: policyEngine.DecisionPoint(policy.PDPConfig{
+			Defaults: defaultPolicies(cfg),
+			Geo:      geo,
+		}),
+	}, structLogger, metricsCollector)
+	if err != nil {
+		log.Fatal("Failed to initialize authorizer:", err)
+	}
+
+	// Rate limits: the global limit and a stricter one for the login path
+	globalLimiter, err := middleware.NewLimiter(sharedStore, middleware.LimitDefinition{
+		Algorithm: cfg.RateLimitAlgorithm,
+		Limit:     cfg.RateLimitRPM,
+		Window:    time.Minute,
+		Burst:     cfg.RateLimitBurst,
+	})
+	if err != nil {
+		log.Fatal("Invalid rate limit configuration:", err)
+	}
+	loginLimiter, err := middleware.NewLimiter(sharedStore, middleware.LimitDefinition{
+		Name:      "login",
+		Algorithm: cfg.LoginRateLimitAlgorithm,
+		Limit:     cfg.LoginRateLimitRPM,
+		Window:    time.Minute,
+		Burst:     cfg.LoginRateLimitBurst,
+	})
+	if err != nil {
+		log.Fatal("Invalid login rate limit configuration:", err)
+	}
+	var proxyRanges []string
+	for _, proxy := range strings.Split(cfg.TrustedProxies, ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxyRanges = append(proxyRanges, proxy)
+		}
+	}
+	trustedProxies, err := middleware.ParseNetworks(proxyRanges)
+	if err != nil {
+		log.Fatal("Invalid TRUSTED_PROXIES:", err)
+	}
+	networkACL := middleware.NewNetworkACL(middleware.AdminNetworkRules(adminManager), trustedProxies,
+		time.Duration(cfg.NetworkRulesCacheTTL)*time.Second, structLogger, metricsCollector)
+	killSwitches := middleware.NewKillSwitches(middleware.AdminKillSwitches(adminManager), []string{"/health", "/metrics", "/api/v1/admin"},
+		time.Duration(cfg.KillSwitchCacheTTL)*time.Second, structLogger, metricsCollector)
+	rateLimitPolicies := middleware.NewRateLimitPolicies(sharedStore, middleware.AdminRateLimitPolicies(adminManager),
+		time.Duration(cfg.RateLimitPolicyCacheTTL)*time.Second, structLogger, metricsCollector)
 
 	// Setup Gin router
 	r := gin.Default()
+	// c.ClientIP() keys IP blocks and rate limits, so like ForwardedClientIP
+	// it believes X-Forwarded-For only from TRUSTED_PROXIES; gin's default
+	// trusts every peer, which lets clients pick their own address
+	if err := r.SetTrustedProxies(proxyRanges); err != nil {
+		log.Fatal("Invalid TRUSTED_PROXIES:", err)
+	}
 
 	// Initialize middleware with enhanced security
 	allowedOrigins := strings.Split(cfg.CORSOrigins, ",")
@@ -189,12 +964,13 @@ func main() {
 	// Security middleware (order is important)
 	r.Use(authManager.HTTPSRedirectMiddleware())
 	r.Use(inputValidator.ValidateRequestMiddleware())
+	r.Use(inputValidator.BodyLimitMiddleware())
 	r.Use(middleware.SecurityHeadersMiddleware())
 	r.Use(authManager.SecurityAuditMiddleware())
 	r.Use(authManager.InputSanitizationMiddleware())
 	
 	// Performance middleware
-	r.Use(performance.RequestTracingMiddleware())
+	r.Use(tracing.Middleware())
 	r.Use(performanceManager.PerformanceMiddleware())
 	r.Use(performance.ResourceMonitoringMiddleware(performanceManager))
 	r.Use(performance.CompressionMiddleware())
@@ -205,41 +981,565 @@ func main() {
 	// Enhanced middleware using framework
 	r.Use(middleware.EnhancedCORSMiddleware(metricsCollector, structLogger))
 	r.Use(middleware.RequestIDMiddleware())
+	r.Use(middleware.LocaleMiddleware())
 	r.Use(middleware.ResponseTimeMiddleware())
 	r.Use(middleware.EnhancedLoggingMiddleware(structLogger))
 	r.Use(middleware.EnhancedMetricsMiddleware(metricsCollector))
+	r.Use(middleware.StatusMetricsMiddleware(metricsCollector))
 	r.Use(middleware.EnhancedZeroTrustMiddleware(metricsCollector))
-	r.Use(middleware.RateLimitMiddleware(structLogger, metricsCollector))
+	r.Use(killSwitches.Middleware())
+	r.Use(networkACL.Middleware())
+	r.Use(middleware.RateLimitMiddleware(middleware.RateLimitConfig{
+		RequestsPerMinute: cfg.RateLimitRPM,
+		RetryAfter:        time.Duration(cfg.RateLimitRetryAfter) * time.Second,
+		Limiter:           globalLimiter,
+	}, structLogger, metricsCollector))
 	r.Use(middleware.EnhancedRecoveryMiddleware(metricsCollector, structLogger))
+	if failStatic != nil {
+		r.Use(middleware.ReadOnlyMiddleware(failStatic, nil, cfg.HealthInterval, structLogger, metricsCollector))
+	}
+	r.Use(revocations.Middleware())
+
+	// Threat intelligence, blocking known-bad sources when configured
+	var threatSources []threatintel.Source
+	for _, location := range strings.Split(cfg.ThreatIntelLists, ",") {
+		if location = strings.TrimSpace(location); location != "" {
+			threatSources = append(threatSources, threatintel.NewListSource(location, 1, nil))
+		}
+	}
+	if cfg.ThreatIntelAPIURL != "" {
+		threatSources = append(threatSources, threatintel.NewAPISource(cfg.ThreatIntelAPIURL, cfg.ThreatIntelAPIKey, nil))
+	}
+	var threatIntel *threatintel.Service
+	if len(threatSources) > 0 {
+		threatIntel = threatintel.NewService(threatintel.Config{
+			CacheTTL:        time.Duration(cfg.ThreatIntelCacheTTL) * time.Second,
+			RefreshInterval: time.Duration(cfg.ThreatIntelRefresh) * time.Second,
+			BlockScore:      cfg.ThreatIntelBlockScore,
+		}, threatSources, sharedStore, structLogger, metricsCollector)
+		threatIntel.Start(ctx)
+		r.Use(threatIntel.Middleware())
+	}
+	apiKeyManager := apikeys.NewManager(apikeys.Config{
+		DefaultRateLimit: cfg.APIKeyDefaultRateLimit,
+		MaxRateLimit:     cfg.APIKeyMaxRateLimit,
+	}, sharedStore, structLogger, metricsCollector)
+	r.Use(apiKeyManager.Middleware(sharedStore))
+	var signedRoutes []string
+	for _, route := range strings.Split(cfg.SignedRoutes, ",") {
+		if route = strings.TrimSpace(route); route != "" {
+			signedRoutes = append(signedRoutes, route)
+		}
+	}
+	if len(signedRoutes) > 0 && cfg.APIKeysFile == "" {
+		log.Fatal("SIGNED_ROUTES requires API_KEYS_FILE")
+	}
+	if cfg.APIKeysFile != "" {
+		apiKeys, err := middleware.LoadAPIKeys(cfg.APIKeysFile)
+		if err != nil {
+			log.Fatal("Failed to load API keys:", err)
+		}
+		r.Use(middleware.SignedRequestMiddleware(middleware.SignatureConfig{
+			Keys:   apiKeys,
+			Window: time.Duration(cfg.SignatureWindow) * time.Second,
+			Routes: signedRoutes,
+		}, sharedStore, structLogger, metricsCollector))
+		logger.Info("Signed machine requests enabled", "keys", len(apiKeys), "required_on", signedRoutes)
+	}
+	// Policies for routes and machine clients; those for users apply once
+	// authMiddleware identifies them
+	r.Use(rateLimitPolicies.Middleware())
+	applyRateLimitPolicies := rateLimitPolicies.Middleware()
+
+	// Signing keys for issued tokens; access tokens authenticate requests
+	tokenIssuer, err := newTokenIssuer(cfg, structLogger)
+	if err != nil {
+		log.Fatal("Failed to initialize token issuer:", err)
+	}
 
-	// Mock authentication middleware for demo
+	// Authenticates users by their session or a bearer access token
 	authMiddleware := func(c *gin.Context) {
-		c.Set("user", &interfaces.UserInfo{
-			ID:       cfg.DemoUserID,
-			Username: cfg.DemoUsername,
-			Email:    cfg.DemoEmail,
-			Roles:    []string{cfg.DemoRole},
-		})
+		// Signed machine requests are already authenticated
+		if _, ok := c.Get("user"); ok {
+			c.Next()
+			return
+		}
+		if sessions != nil {
+			sess, err := sessions.Get(c)
+			if err == nil {
+				c.Set(session.ContextKey, sess)
+				c.Set("user", &sess.User)
+				applyRateLimitPolicies(c)
+				c.Next()
+				return
+			}
+			if errors.Is(err, session.ErrReauthRequired) {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+					"error": i18n.Message(c, "REAUTH_REQUIRED"),
+					"code":  "REAUTH_REQUIRED",
+				})
+				return
+			}
+		}
+		user := revocations.AuthenticateBearer(c, tokenIssuer)
+		if user == nil {
+			return
+		}
+		c.Set("user", user)
+		applyRateLimitPolicies(c)
 		c.Next()
 	}
 
+	// Sidecar mode: enforce and forward everything except the health endpoint
+	// to the legacy upstream instead of serving the local API
+	if cfg.ProxyUpstream != "" {
+		enforcer, err := proxy.New(proxy.Config{
+			Upstream:             cfg.ProxyUpstream,
+			LocalPaths:           []string{"/health", "/health/detailed"},
+			ForwardAuthorization: cfg.ProxyForwardAuthorization,
+			Authorizer:           authorizer,
+		}, structLogger, metricsCollector)
+		if err != nil {
+			log.Fatal("Failed to initialize sidecar proxy:", err)
+		}
+		r.Use(enforcer.Middleware())
+		logger.Info("Sidecar proxy mode enabled", "upstream", cfg.ProxyUpstream, "min_trust_level", cfg.AuthzMinTrustLevel)
+	}
+
 	// Root endpoint with service information
 	r.GET("/", handleRoot)
 	
 	// System endpoints with performance monitoring
-	r.GET("/health", performance.HealthCheckMiddleware(performanceManager), handleEnhancedHealth(healthChecker))
+	r.GET("/health", performance.HealthCheckMiddleware(performanceManager), handleEnhancedHealth(healthChecker, failStatic))
 	r.GET("/health/detailed", handleDetailedHealth(healthChecker))
 	r.GET("/info", handleInfo)
+	if replicator != nil {
+		// Authenticated by the replication secret instead of user credentials
+		r.POST(replication.Path, replicator.Handler())
+	}
+	if registrySync != nil {
+		// Authenticated by the sync secret instead of user credentials
+		r.POST(discovery.SyncPath, gin.WrapF(registrySync.Handler()))
+	}
+	if cfg.GatewayEnabled {
+		// Authenticated by the authorizer, like the sidecar proxy
+		gateway, err := proxy.NewGateway(proxy.GatewayConfig{
+			Registry:             serviceRegistry,
+			Authorizer:           authorizer,
+			ForwardAuthorization: cfg.ProxyForwardAuthorization,
+			Breaker:              circuitBreakerManager,
+		}, structLogger, metricsCollector)
+		if err != nil {
+			log.Fatal("Failed to initialize gateway:", err)
+		}
+		circuitBreakerManager.OnStateChange(gateway.BreakerStateChanged)
+		r.Any(proxy.GatewayPrefix+"/:service/*path", gateway.Handler())
+		logger.Info("Gateway mode enabled", "prefix", proxy.GatewayPrefix)
+	}
 	r.GET("/metrics", handleMetrics(performanceManager))
 	
 	// API documentation
 	if cfg.SwaggerEnabled {
 		r.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
 		r.GET("/api-docs", handleAPIDocs)
+		r.GET("/api-docs/postman", api.PostmanHandler(func() ([]byte, error) {
+			doc, err := swag.ReadDoc()
+			return []byte(doc), err
+		}))
+	}
+
+	// Signing keys for issued tokens, published for downstream validation
+	r.GET("/.well-known/jwks.json", handleJWKS(tokenIssuer))
+
+	// Trust scores from the factor providers, lowered after impossible travel
+	allowedASNs, err := trust.ParseASNs(cfg.LocationAllowedASNs)
+	if err != nil {
+		log.Fatal("Invalid LOCATION_ALLOWED_ASNS:", err)
+	}
+	locationPolicy := trust.LocationPolicy{
+		AllowedCountries: trust.ParseCountries(cfg.LocationAllowedCountries),
+		AllowedASNs:      allowedASNs,
+	}
+	trustWeights, err := trust.ParseWeights(cfg.TrustWeights)
+	if err != nil {
+		log.Fatal("Invalid TRUST_WEIGHTS:", err)
+	}
+	behaviorProfiles := trust.NewBehaviorProfiles(trust.BehaviorConfig{
+		ConsistentAfter: cfg.BehaviorConsistentAfter,
+		MaxValues:       cfg.BehaviorMaxValues,
+		TTL:             time.Duration(cfg.BehaviorProfileTTL) * time.Second,
+	}, sharedStore, structLogger)
+	enabledDetectors, err := risk.ParseDetectors(cfg.RiskDetectors)
+	if err != nil {
+		log.Fatal("Invalid RISK_DETECTORS:", err)
+	}
+	workLocation, err := time.LoadLocation(cfg.RiskTimezone)
+	if err != nil {
+		log.Fatal("Invalid RISK_TIMEZONE:", err)
+	}
+	var detectors []risk.Detector
+	if enabledDetectors[risk.DetectorVelocity] {
+		detectors = append(detectors, risk.NewVelocityDetector(risk.VelocityConfig{
+			Limit:  cfg.RiskVelocityLimit,
+			Window: time.Duration(cfg.RiskVelocityWindow) * time.Second,
+		}, sharedStore))
+	}
+	if enabledDetectors[risk.DetectorNewGeo] {
+		if geo != nil {
+			detectors = append(detectors, risk.NewGeoDetector(risk.HistoryConfig{}, geo, sharedStore))
+		} else {
+			structLogger.Warn("Risk detector new_geo needs GEOIP_FILE or GEOIP_MMDB; disabled")
+		}
+	}
+	if enabledDetectors[risk.DetectorNewDevice] {
+		detectors = append(detectors, risk.NewDeviceDetector(risk.HistoryConfig{}, sharedStore))
+	}
+	if enabledDetectors[risk.DetectorPrivilegeEscalation] {
+		detectors = append(detectors, risk.NewEscalationDetector(risk.EscalationConfig{
+			Threshold: cfg.RiskEscalationThreshold,
+			Window:    time.Duration(cfg.RiskEscalationWindow) * time.Second,
+		}, sharedStore))
+	}
+	if enabledDetectors[risk.DetectorOffHours] {
+		detectors = append(detectors, risk.NewOffHoursDetector(risk.OffHoursConfig{
+			Location: workLocation,
+			Start:    cfg.RiskWorkStart,
+			End:      cfg.RiskWorkEnd,
+			Weekends: cfg.RiskWorkWeekends,
+		}))
+	}
+	if enabledDetectors[risk.DetectorIPReputation] {
+		if threatIntel != nil {
+			detectors = append(detectors, risk.NewReputationDetector(threatIntel))
+		} else {
+			structLogger.Warn("Risk detector ip_reputation needs THREAT_INTEL_LISTS or THREAT_INTEL_API_URL; disabled")
+		}
+	}
+	var baselines *risk.Baselines
+	if enabledDetectors[risk.DetectorBaseline] {
+		baselines = risk.NewBaselines(risk.BaselineConfig{
+			MinRequests: int64(cfg.RiskBaselineMinRequests),
+			Location:    workLocation,
+			TTL:         time.Duration(cfg.RiskBaselineTTL) * time.Second,
+		}, sharedStore, structLogger)
+		detectors = append(detectors, baselines)
+	}
+	riskEngine := risk.NewEngine(detectors, structLogger, metricsCollector)
+	// Registered on the router so denied admin requests count as well
+	r.Use(riskEngine.Middleware())
+	webhooks := webhook.NewNotifier(webhook.Config{
+		MaxAttempts: cfg.WebhookMaxAttempts,
+		Timeout:     time.Duration(cfg.WebhookTimeout) * time.Second,
+	}, sharedStore, webhook.AdminSource(adminManager), structLogger, metricsCollector)
+	attestationChallenges := attestation.NewChallenges(sharedStore, time.Duration(cfg.AttestationNonceTTL)*time.Second, structLogger)
+	attestor, err := newAttestor(cfg, attestationChallenges, structLogger, metricsCollector)
+	if err != nil {
+		log.Fatal("Failed to initialize device attestation:", err)
+	}
+	deviceMailer, err := email.New(email.Config{
+		Addr:     cfg.SMTPAddr,
+		Username: cfg.SMTPUsername,
+		Password: cfg.SMTPPassword,
+		From:     cfg.SMTPFrom,
+	}, structLogger)
+	if err != nil {
+		log.Fatal("Failed to initialize device verification email:", err)
+	}
+	deviceRegistry := device.NewRegistry(device.Config{
+		Attestor:        attestor,
+		RPID:            cfg.DeviceWebAuthnRPID,
+		StaleAfter:      time.Duration(cfg.DeviceStaleAfter) * 24 * time.Hour,
+		QuarantineAfter: time.Duration(cfg.DeviceQuarantineAfter) * 24 * time.Hour,
+		OnTransition: func(ctx context.Context, info *interfaces.DeviceInfo, from string) {
+			if _, err := auditLog.Record(ctx, cfg.AuditDefaultTenant, "device."+info.State, info.OwnerID, map[string]interface{}{
+				"device_id": info.ID,
+				"from":      from,
+				"reason":    info.StateReason,
+			}); err != nil {
+				slog.Error("Failed to audit device state change", "device_id", info.ID, "error", err)
+			}
+			if info.State != device.StateQuarantined && info.State != device.StateBlocked {
+				return
+			}
+			// Sessions from the device re-authenticate, or end when it is blocked
+			if sessions != nil {
+				if n, err := sessions.EndDevice(ctx, info.ID, info.State == device.StateBlocked); err != nil {
+					slog.Error("Failed to end device sessions", "device_id", info.ID, "error", err)
+				} else if n > 0 {
+					slog.Info("Device sessions ended", "device_id", info.ID, "state", info.State, "sessions", n)
+				}
+			}
+			if err := webhooks.NotifyDevice(ctx, "device."+info.State, info); err != nil {
+				slog.Error("Failed to notify device webhooks", "device_id", info.ID, "error", err)
+			}
+		},
+		Mailer:                  deviceMailer,
+		VerificationTTL:         time.Duration(cfg.DeviceVerificationTTL) * time.Second,
+		MaxVerificationAttempts: cfg.DeviceVerificationMaxAttempts,
+		OnVerification: func(ctx context.Context, v *device.Verification) {
+			if _, err := auditLog.Record(ctx, cfg.AuditDefaultTenant, "device.verification."+v.Status, v.OwnerID, map[string]interface{}{
+				"device_id":    v.DeviceID,
+				"verification": v.ID,
+				"method":       v.Method,
+				"attempts":     v.Attempts,
+				"decided_by":   v.DecidedBy,
+			}); err != nil {
+				slog.Error("Failed to audit device verification", "device_id", v.DeviceID, "error", err)
+			}
+		},
+		UnknownDeviceTTL: time.Duration(cfg.DeviceUnknownTTL) * 24 * time.Hour,
+		OnUnknownDevice: func(ctx context.Context, sighting *device.Sighting) {
+			if _, err := auditLog.Record(ctx, cfg.AuditDefaultTenant, "security.unknown_device", sighting.OwnerID, map[string]interface{}{
+				"sighting":   sighting.ID,
+				"ip":         sighting.IP,
+				"user_agent": sighting.UserAgent,
+				"method":     sighting.Method,
+			}); err != nil {
+				slog.Error("Failed to audit unknown device", "user_id", sighting.OwnerID, "error", err)
+			}
+			if err := webhooks.NotifyUnknownDevice(ctx, sighting.OwnerID, sighting.ID, sighting.IP, sighting.Method); err != nil {
+				slog.Error("Failed to notify device webhooks", "user_id", sighting.OwnerID, "error", err)
+			}
+		},
+		OnDeviceConfirmed: func(ctx context.Context, sighting *device.Sighting, info *interfaces.DeviceInfo) {
+			if _, err := auditLog.Record(ctx, cfg.AuditDefaultTenant, "device.confirmed", info.OwnerID, map[string]interface{}{
+				"device_id": info.ID,
+				"sighting":  sighting.ID,
+				"logins":    sighting.Logins,
+			}); err != nil {
+				slog.Error("Failed to audit device confirmation", "device_id", info.ID, "error", err)
+			}
+			if sessions != nil {
+				if _, err := sessions.ConfirmDevice(ctx, info.OwnerID, sighting.ID); err != nil {
+					slog.Error("Failed to lift session trust caps", "device_id", info.ID, "error", err)
+				}
+			}
+		},
+	}, sharedStore)
+	if cfg.DeviceDecayInterval > 0 {
+		deviceRegistry.StartDecay(ctx, time.Duration(cfg.DeviceDecayInterval)*time.Second, structLogger)
+	}
+	mdmConnectors, err := newMDMConnectors(cfg)
+	if err != nil {
+		log.Fatal("Failed to initialize MDM connectors:", err)
+	}
+	var mdmSync *mdm.Service
+	if len(mdmConnectors) > 0 {
+		mdmSync = mdm.NewService(mdm.Config{
+			Interval: time.Duration(cfg.MDMSyncInterval) * time.Second,
+		}, mdmConnectors, deviceRegistry, sharedStore, structLogger, metricsCollector)
+		mdmSync.Start(ctx)
+		logger.Info("MDM compliance sync enabled", "connectors", len(mdmConnectors))
+	}
+	minOSVersions, err := posture.ParseMinOSVersions(cfg.PostureMinOSVersions)
+	if err != nil {
+		log.Fatal("Invalid POSTURE_MIN_OS_VERSIONS:", err)
+	}
+	postures := posture.NewService(posture.Policy{
+		MinOSVersions:         minOSVersions,
+		RequireDiskEncryption: cfg.PostureRequireDiskEncryption,
+		MaxPatchAge:           time.Duration(cfg.PostureMaxPatchAge) * 24 * time.Hour,
+		RequireEDR:            cfg.PostureRequireEDR,
+		MaxReportAge:          time.Duration(cfg.PostureMaxReportAge) * time.Second,
+	}, deviceRegistry, sharedStore, structLogger, metricsCollector)
+	factorProviders := trust.DefaultProviders(trust.ProviderConfig{
+		Geo:       geo,
+		Locations: locationPolicy,
+		Behavior:  behaviorProfiles,
+		Risk:      riskEngine.Factor(),
+		Device:    postures.Factor(),
+	})
+	for _, p := range trust.RegisteredFactors() {
+		factorProviders = append(factorProviders, trust.Guard(p, trust.GuardOptions{
+			Timeout: time.Duration(cfg.TrustFactorTimeout) * time.Second,
+			Breaker: circuitBreakerManager,
+		}))
+	}
+	scoreEngine, err := trust.NewScoreEngine(trust.EngineConfig{Weights: trustWeights}, factorProviders, structLogger, metricsCollector)
+	if err != nil {
+		log.Fatal("Failed to initialize trust scoring:", err)
+	}
+	var trustScorer trust.Scorer = scoreEngine
+	var travel *trust.TravelDetector
+	if geo != nil {
+		travel = trust.NewTravelDetector(trust.TravelConfig{
+			MaxSpeedKMH:   cfg.TravelMaxSpeedKMH,
+			MinDistanceKM: cfg.TravelMinDistanceKM,
+			Deny:          cfg.TravelDeny,
+			FlagTTL:       time.Duration(cfg.TravelFlagTTL) * time.Second,
+		}, sharedStore, geo, structLogger, metricsCollector)
+		trustScorer = travel.Scorer(trustScorer)
+		logger.Info("Impossible-travel detection enabled", "deny", cfg.TravelDeny)
+	}
+	accessLevels := trust.NewAccessPolicy(trust.AdminThresholds(adminManager), time.Duration(cfg.AccessPolicyCacheTTL)*time.Second, structLogger)
+	trustScorer = webhooks.Scorer(trustScorer)
+
+	// Continuous verification of SSO sessions
+	if sessions != nil && cfg.VerificationInterval > 0 {
+		trust.NewSessionVerifier(trust.VerificationConfig{
+			Interval:       time.Duration(cfg.VerificationInterval) * time.Second,
+			DowngradeBelow: cfg.VerificationDowngradeBelow,
+			ReauthBelow:    cfg.VerificationReauthBelow,
+			TerminateBelow: cfg.VerificationTerminateBelow,
+			OnAction: func(ctx context.Context, sess *session.Session, action string, score *interfaces.TrustScore) {
+				if _, err := auditLog.Record(ctx, cfg.AuditDefaultTenant, "session."+action, sess.User.ID, map[string]interface{}{
+					"trust_score": score.Overall,
+					"ip":          sess.IP,
+				}); err != nil {
+					slog.Error("Failed to audit session verification", "user_id", sess.User.ID, "error", err)
+				}
+			},
+		}, sessions, trustScorer, sharedStore, structLogger, metricsCollector).Start(ctx)
+		logger.Info("Continuous session verification enabled", "interval", cfg.VerificationInterval)
+	}
+
+	// Every form of password login is rate limited and refused to blocked
+	// addresses
+	loginRateLimit := middleware.RateLimitMiddleware(middleware.RateLimitConfig{
+		RequestsPerMinute: cfg.LoginRateLimitRPM,
+		Limiter:           loginLimiter,
+	}, structLogger, metricsCollector)
+	loginGuards := []gin.HandlerFunc{loginRateLimit}
+	if bruteForce != nil {
+		loginGuards = append(loginGuards, bruteForce.Middleware())
+	}
+
+	// OpenID Connect provider endpoints for internal relying parties
+	if cfg.OIDCIssuer != "" {
+		oidcProvider, err := newOIDCProvider(cfg, tokenIssuer, sharedStore, sessions, trustScorer, accessLevels, lockout, bruteForce, structLogger)
+		if err != nil {
+			log.Fatal("Failed to initialize OIDC provider:", err)
+		}
+		oidcProvider.RegisterRoutes(r, loginGuards...)
+		logger.Info("OIDC provider enabled", "issuer", cfg.OIDCIssuer)
 	}
 
 	// Initialize Zero Trust API handlers
-	handlers := &api.Handlers{}
+	verifier, err := auth.NewCredentialVerifier(auth.VerifierConfig{
+		Backend:              cfg.AuthBackend,
+		KeycloakTokenURL:     authz.KeycloakTokenURL(cfg.KeycloakBaseURL, cfg.KeycloakRealm),
+		KeycloakClientID:     cfg.KeycloakClientID,
+		KeycloakClientSecret: cfg.KeycloakClientSecret,
+		LocalUsersFile:       cfg.AuthLocalUsersFile,
+		LDAP:                 ldapConfig(cfg),
+	})
+	if err != nil {
+		log.Fatal("Failed to initialize credential verifier:", err)
+	}
+	logger.Info("Credential verification configured", "backend", cfg.AuthBackend)
+	r.Use(deviceRegistry.AssertionMiddleware(device.AssertionConfig{
+		Window: time.Duration(cfg.DeviceAssertionWindow) * time.Second,
+	}, structLogger, metricsCollector))
+	// Time-bound role assignments are reaped once they lapse
+	roles := rbac.NewManager(rbac.Config{}, sharedStore)
+	roles.Start(ctx, structLogger)
+	groupSources, err := newGroupSources(cfg)
+	if err != nil {
+		log.Fatal("Failed to initialize group sync:", err)
+	}
+	var provisioning *scim.Service
+	if cfg.SCIMEnabled {
+		provisioning, err = scim.NewService(scim.Config{Subject: cfg.SCIMSubject}, sharedStore, roles, structLogger)
+		if err != nil {
+			log.Fatal("Failed to initialize SCIM provisioning:", err)
+		}
+		// Provisioned groups are mapped to roles like the IdP's own
+		groupSources = append(groupSources, provisioning)
+	}
+	var groupSync *groupsync.Service
+	if len(groupSources) > 0 {
+		groupSync = groupsync.NewService(groupsync.Config{
+			Interval: time.Duration(cfg.GroupSyncInterval) * time.Second,
+		}, groupSources, roles, sharedStore, structLogger, metricsCollector)
+		groupSync.Start(ctx)
+		logger.Info("IdP group sync enabled", "sources", len(groupSources))
+	}
+	if provisioning != nil {
+		provisioning.OnGroupsChanged(func(ctx context.Context) {
+			if _, err := groupSync.Sync(ctx, provisioning.Name()); err != nil {
+				structLogger.Error("Failed to sync provisioned groups", "error", err)
+			}
+		})
+	}
+	handlers := api.NewHandlersWithVerifier(verifier).
+		WithScorer(trustScorer).
+		WithDevices(deviceRegistry).
+		WithSessions(sessions).
+		WithPolicies(policyEngine).
+		WithRBAC(roles)
+
+	var relyingParty *auth.RelyingParty
+	if cfg.OIDCRPRedirectURL != "" {
+		if sessions == nil {
+			log.Fatal("OIDC_RP_REDIRECT_URL requires SESSION_SECRET")
+		}
+		if relyingParty, err = newRelyingParty(ctx, cfg, sharedStore, sessions, travel, deviceRegistry, auditLog, structLogger, metricsCollector); err != nil {
+			log.Fatal("Failed to initialize OIDC relying party:", err)
+		}
+		logger.Info("OIDC relying party enabled", "redirect_url", cfg.OIDCRPRedirectURL)
+	}
+	var magicLinks *auth.MagicLinks
+	if cfg.MagicLinkVerifyURL != "" {
+		if magicLinks, err = newMagicLinks(cfg, tokenIssuer, sharedStore, sessions, travel, deviceRegistry, auditLog, structLogger, metricsCollector); err != nil {
+			log.Fatal("Failed to initialize email login:", err)
+		}
+		logger.Info("Email login enabled", "verify_url", cfg.MagicLinkVerifyURL, "smtp", cfg.SMTPAddr != "")
+	}
+	var stepUpFactors []trust.Factor
+	if cfg.StepUpTOTPSecretsFile != "" {
+		secrets, err := auth.LoadTOTPSecrets(cfg.StepUpTOTPSecretsFile)
+		if err != nil {
+			log.Fatal("Failed to load step-up TOTP secrets:", err)
+		}
+		stepUpFactors = append(stepUpFactors, auth.NewTOTP(secrets, sharedStore))
+		logger.Info("Step-up TOTP enabled", "users", len(secrets))
+	}
+	stepUp := trust.NewStepUp(trust.StepUpConfig{
+		ChallengeTTL: time.Duration(cfg.StepUpChallengeTTL) * time.Second,
+		ElevationTTL: time.Duration(cfg.StepUpElevationTTL) * time.Second,
+		MaxAttempts:  cfg.StepUpMaxAttempts,
+		LockoutTime:  time.Duration(cfg.StepUpLockoutTime) * time.Second,
+	}, sharedStore, trustScorer, stepUpFactors, structLogger, metricsCollector)
+
+	// Every protected request is decided by the policy engine. Stored
+	// policies add to defaults that let anyone authenticated in except to
+	// administrative routes. Policies can oblige callers to step up, have
+	// fields of the response masked or the request audited; sensitive
+	// fields are masked for callers below their trust level regardless.
+	var sensitiveFields []string
+	for _, field := range strings.Split(cfg.SensitiveFields, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			sensitiveFields = append(sensitiveFields, field)
+		}
+	}
+	pdp := policyEngine.Middleware(policy.PDPConfig{
+		Defaults:            defaultPolicies(cfg),
+		Trust:               stepUp,
+		Geo:                 geo,
+		SensitiveFields:     sensitiveFields,
+		SensitiveTrustLevel: cfg.SensitiveTrustLevel,
+		Obligations: map[string]policy.Obligation{
+			policy.ObligationStepUp: {
+				Before: func(c *gin.Context, _ []string) bool {
+					middleware.UseTrustSource(stepUp)(c)
+					return middleware.CheckTrustLevel(c, cfg.StepUpProtectedLevel)
+				},
+			},
+			policy.ObligationMask: policy.MaskFields(),
+			policy.ObligationAudit: policy.AuditRequests(auditLog, func(*gin.Context) string {
+				return cfg.AuditDefaultTenant
+			}, structLogger),
+		},
+	}, structLogger, metricsCollector)
+
+	// SCIM provisioning by identity providers, with API keys only
+	if provisioning != nil {
+		scimGroup := r.Group("/scim/v2", apikeys.RequireKey("scim"), auditLog.Middleware(func(*gin.Context) string {
+			return cfg.AuditDefaultTenant
+		}))
+		provisioning.RegisterRoutes(scimGroup)
+		logger.Info("SCIM provisioning enabled", "subject", cfg.SCIMSubject)
+	}
 
 	// API v1 routes
 	v1 := r.Group("/api/v1")
@@ -247,65 +1547,215 @@ func main() {
 		// Public endpoints
 		auth := v1.Group("/auth")
 		{
-			auth.POST("/login", handleLogin(cfg))
-			auth.POST("/logout", authMiddleware, handleLogout)
-			auth.POST("/refresh", handleRefreshToken)
+			auth.POST("/login", append(loginGuards, handleLogin(cfg, verifier, lockout, bruteForce, travel, deviceRegistry, tokenIssuer, trustScorer, sessions, auditLog))...)
+			if magicLinks != nil {
+				magicLinks.RegisterRoutes(auth.Group("", loginGuards...))
+			}
+			auth.POST("/logout", authMiddleware, handleLogout(cfg, sessions, revocations, auditLog))
+			auth.GET("/session", handleSession(sessions))
+			if relyingParty != nil {
+				auth.GET("/authorize", relyingParty.Authorize)
+				auth.GET("/callback", relyingParty.Callback)
+			}
+			auth.POST("/refresh", handleRefreshToken(cfg, tokenIssuer, revocations))
+			stepUp.RegisterRoutes(auth.Group("", authMiddleware))
 			auth.GET("/validate", authMiddleware, handleValidateToken)
+
+			// Revoking someone else's token is an admin action
+			tokenControls := auth.Group("")
+			tokenControls.Use(authMiddleware, pdp, auditLog.Middleware(func(*gin.Context) string {
+				return cfg.AuditDefaultTenant
+			}))
+			revocations.RegisterRoutes(tokenControls)
 		}
 
-		// Service discovery (public for demo)
+		// Service discovery; reading is public, changes need an
+		// authenticated caller allowed by policy, who owns the services
+		// they register
 		discoveryGroup := v1.Group("/discovery")
 		{
 			discoveryHandler := discovery.NewServiceDiscoveryHandler(serviceRegistry)
 			discoveryGroup.GET("/services", gin.WrapF(discoveryHandler.HandleListServices))
+			discoveryGroup.GET("/watch", gin.WrapF(discoveryHandler.HandleWatch))
+			discoveryGroup.GET("/resolve/:name", gin.WrapF(discoveryHandler.HandleResolve))
 			discoveryGroup.GET("/services/:name", gin.WrapF(discoveryHandler.HandleGetService))
-			discoveryGroup.POST("/services", gin.WrapF(discoveryHandler.HandleRegisterService))
+			discoveryGroup.GET("/services/:name/health-history", gin.WrapF(discoveryHandler.HandleHealthHistory))
+
+			discoveryChanges := discoveryGroup.Group("")
+			discoveryChanges.Use(authMiddleware, apikeys.RequireScope("discovery"), pdp, discoveryCaller(cfg.AdminRole))
+			discoveryChanges.POST("/services", gin.WrapF(discoveryHandler.HandleRegisterService))
+			discoveryChanges.DELETE("/services/:name", gin.WrapF(discoveryHandler.HandleDeregisterService))
+			discoveryChanges.PUT("/services/:name/heartbeat", gin.WrapF(discoveryHandler.HandleHeartbeat))
 		}
 
 		// RBAC endpoints (protected)
-		rbac := v1.Group("/rbac")
-		rbac.Use(authMiddleware)
+		rbacGroup := v1.Group("/rbac")
+		rbacGroup.Use(authMiddleware, apikeys.RequireScope("rbac"), pdp)
 		{
-			rbac.GET("/roles", handlers.GetRoles)
-			rbac.POST("/roles", handlers.CreateRole)
-			rbac.GET("/roles/:id", handlers.GetRole)
-			rbac.GET("/permissions", handlers.GetPermissions)
-			rbac.POST("/assign", handlers.AssignRole)
-			rbac.GET("/users/:id/roles", handlers.GetUserRoles)
-			rbac.GET("/users/:id/permissions", handlers.GetUserPermissions)
+			// Role changes are audited
+			audited := auditLog.Middleware(func(*gin.Context) string {
+				return cfg.AuditDefaultTenant
+			})
+			rbacGroup.GET("/roles", handlers.GetRoles)
+			rbacGroup.POST("/roles", audited, handlers.CreateRole)
+			rbacGroup.GET("/roles/:id", handlers.GetRole)
+			rbacGroup.PUT("/roles/:id", audited, handlers.UpdateRole)
+			rbacGroup.DELETE("/roles/:id", audited, handlers.DeleteRole)
+			rbacGroup.GET("/permissions", handlers.GetPermissions)
+			rbacGroup.POST("/permissions", audited, handlers.CreatePermission)
+			rbacGroup.DELETE("/permissions/:name", audited, handlers.DeletePermission)
+			rbacGroup.POST("/assign", audited, handlers.AssignRole)
+			rbacGroup.GET("/users/:id/roles", handlers.GetUserRoles)
+			rbacGroup.DELETE("/users/:id/roles/:role", audited, handlers.UnassignRole)
+			rbacGroup.GET("/users/:id/permissions", handlers.GetUserPermissions)
+			rbacGroup.POST("/check", handlers.CheckPermission)
+			rbacGroup.POST("/elevations", audited, handlers.RequestElevation)
+			rbacGroup.GET("/elevations", handlers.GetElevations)
+			rbacGroup.GET("/elevations/:id", handlers.GetElevation)
+			rbacGroup.POST("/elevations/:id/approve", audited, handlers.ApproveElevation)
+			rbacGroup.POST("/elevations/:id/deny", audited, handlers.DenyElevation)
+			rbacGroup.GET("/constraints", handlers.GetConstraints)
+			rbacGroup.POST("/constraints", audited, handlers.CreateConstraint)
+			rbacGroup.GET("/constraints/violations", handlers.GetViolations)
+			rbacGroup.DELETE("/constraints/:id", audited, handlers.DeleteConstraint)
+			rbacGroup.GET("/audit", handlers.GetRBACAudit)
+			if groupSync != nil {
+				groupSync.RegisterRoutes(rbacGroup.Group("", audited))
+			}
 		}
 
 		// Device management endpoints (protected)
 		devices := v1.Group("/devices")
-		devices.Use(authMiddleware)
+		devices.Use(authMiddleware, apikeys.RequireScope("devices"), pdp)
 		{
 			devices.GET("", handlers.GetDevices)
 			devices.POST("/register", handlers.RegisterDevice)
+			devices.GET("/approvals", handlers.GetPendingApprovals)
+			devices.POST("/import", handlers.ImportDevices)
+			devices.GET("/export", handlers.ExportDevices)
 			devices.GET("/:id", handlers.GetDevice)
 			devices.PUT("/:id", handlers.UpdateDevice)
 			devices.DELETE("/:id", handlers.DeleteDevice)
 			devices.POST("/:id/verify", handlers.VerifyDevice)
+			devices.POST("/:id/verify/challenge", handlers.StartDeviceVerification)
+			devices.GET("/:id/verifications", handlers.GetDeviceVerifications)
+			devices.POST("/:id/verifications/:vid/decision", handlers.DecideDeviceVerification)
+			devices.POST("/:id/quarantine", handlers.QuarantineDevice)
+			devices.POST("/:id/block", handlers.BlockDevice)
+			devices.GET("/:id/sessions", handlers.GetDeviceSessions)
+			devices.DELETE("/:id/sessions", auditLog.Middleware(func(*gin.Context) string {
+				return cfg.AuditDefaultTenant
+			}), handlers.TerminateDeviceSessions)
 			devices.GET("/:id/trust-score", handlers.GetDeviceTrustScore)
+			devices.POST("/:id/bind/challenge", handlers.BindChallenge)
+			devices.POST("/:id/bind", handlers.BindDevice)
+			attestationChallenges.RegisterRoutes(devices)
+			postures.RegisterRoutes(devices)
 		}
 
 		// Policy management endpoints (protected)
 		policies := v1.Group("/policies")
-		policies.Use(authMiddleware)
+		policies.Use(authMiddleware, apikeys.RequireScope("policies"), pdp)
 		{
+			// Policy changes are audited
+			audited := auditLog.Middleware(func(*gin.Context) string {
+				return cfg.AuditDefaultTenant
+			})
 			policies.GET("", handlers.GetPolicies)
-			policies.POST("", handlers.CreatePolicy)
+			policies.POST("", audited, handlers.CreatePolicy)
 			policies.GET("/:id", handlers.GetPolicy)
-			policies.PUT("/:id", handlers.UpdatePolicy)
-			policies.DELETE("/:id", handlers.DeletePolicy)
+			policies.PUT("/:id", audited, handlers.UpdatePolicy)
+			policies.DELETE("/:id", audited, handlers.DeletePolicy)
+			policies.GET("/:id/versions", handlers.GetPolicyVersions)
+			policies.POST("/:id/rollback/:version", audited, handlers.RollbackPolicy)
 			policies.POST("/evaluate", handlers.EvaluatePolicy)
+			policies.GET("/schema", handlers.GetPolicySchema)
+			policies.GET("/export", handlers.ExportPolicies)
+			policies.POST("/import", audited, handlers.ImportPolicies)
+			policies.POST("/lint", handlers.LintPolicies)
+			policies.GET("/resources", handlers.GetPolicyResources)
+			policies.POST("/resources", audited, handlers.CreatePolicyResource)
+			policies.GET("/resources/:id", handlers.GetPolicyResource)
+			policies.PUT("/resources/:id", audited, handlers.UpdatePolicyResource)
+			policies.DELETE("/resources/:id", audited, handlers.DeletePolicyResource)
+		}
+
+		// API key management for machine clients
+		apiKeyAdmin := v1.Group("")
+		apiKeyAdmin.Use(authMiddleware, pdp, auditLog.Middleware(func(*gin.Context) string {
+			return cfg.AuditDefaultTenant
+		}))
+		apiKeyManager.RegisterRoutes(apiKeyAdmin)
+
+		// Declarative admin resources for infrastructure-as-code tooling
+		adminGroup := v1.Group("/admin")
+		adminGroup.Use(authMiddleware, pdp, auditLog.Middleware(func(*gin.Context) string {
+			return cfg.AuditDefaultTenant
+		}))
+		{
+			adminManager.RegisterRoutes(adminGroup)
+			auditLog.RegisterRoutes(adminGroup)
+			if lockout != nil {
+				lockout.RegisterRoutes(adminGroup)
+			}
+			if bruteForce != nil {
+				bruteForce.RegisterRoutes(adminGroup)
+			}
+			adminGroup.GET("/observability/rules", observability.RulesHandler(observability.Thresholds{
+				Job:                     cfg.PrometheusJob,
+				AvailabilityTarget:      cfg.SLOAvailabilityTarget,
+				AuthFailureRate:         cfg.AlertAuthFailureRate,
+				HealthFlapChanges:       cfg.AlertHealthFlapChanges,
+				HealthInterval:          time.Duration(cfg.HealthInterval) * time.Second,
+				ReplicationMaxStaleness: replicationConfig.MaxStaleness,
+			}, healthChecker))
+			if replicator != nil {
+				adminGroup.GET("/replication", replicator.StatusHandler())
+			}
+			if registrySync != nil {
+				adminGroup.GET("/discovery/sync", gin.WrapF(registrySync.StatusHandler()))
+			}
+			if mdmSync != nil {
+				mdmSync.RegisterRoutes(adminGroup)
+			}
+			adminGroup.GET("/devices/verifications", handlers.GetAdminApprovals)
+			adminGroup.POST("/devices/:id/verifications/:vid/decision", handlers.DecideAdminVerification)
+		}
+
+		// Trust score simulation for tuning weights before deploying them
+		simulation := v1.Group("/")
+		simulation.Use(authMiddleware, pdp)
+		trust.NewSimulator(scoreEngine, accessLevels, structLogger).RegisterRoutes(simulation)
+
+		// What risk detection has learned about users
+		if baselines != nil {
+			riskGroup := v1.Group("/risk")
+			riskGroup.Use(authMiddleware, pdp)
+			baselines.RegisterRoutes(riskGroup)
+		}
+
+		// Audit search and export for investigations
+		auditGroup := v1.Group("/audit")
+		auditGroup.Use(authMiddleware, pdp)
+		{
+			auditGroup.GET("/search", auditLog.SearchHandler(func(*gin.Context) string {
+				return cfg.AuditDefaultTenant
+			}))
 		}
 
 		// Security monitoring endpoints (admin only in production)
 		security := v1.Group("/security")
 		{
 			security.GET("/circuit-breakers", handleCircuitBreakerStats(circuitBreakerManager))
-			security.GET("/auth-stats", handleAuthStats(authManager))
+			security.GET("/auth-stats", handleAuthStats(authManager, bruteForce))
 			security.GET("/validation-stats", handleValidationStats)
+
+			// Manual breaker controls for incident response
+			breakerControls := security.Group("")
+			breakerControls.Use(authMiddleware, pdp, auditLog.Middleware(func(*gin.Context) string {
+				return cfg.AuditDefaultTenant
+			}))
+			circuitBreakerManager.RegisterRoutes(breakerControls)
 		}
 
 		// Performance monitoring endpoints  
@@ -319,11 +1769,12 @@ func main() {
 
 		// Protected endpoints
 		protected := v1.Group("/")
-		protected.Use(authMiddleware)
+		protected.Use(authMiddleware, apikeys.RequireScope("trust"), middleware.UseTrustSource(stepUp), behaviorProfiles.Middleware(), pdp)
 		{
-			protected.GET("/trust-score", handleTrustScore)
-			protected.GET("/user/profile", handleUserProfile)
-			protected.GET("/protected", handleProtectedResource)
+			protected.GET("/trust-score", handleTrustScore(trustScorer, accessLevels))
+			trust.NewEvaluator(trustScorer, accessLevels, structLogger, metricsCollector).RegisterRoutes(protected)
+			protected.GET("/user/profile", handleUserProfile(trustScorer, accessLevels))
+			protected.GET("/protected", middleware.RequireTrustLevel(cfg.StepUpProtectedLevel), handleProtectedResource)
 		}
 	}
 
@@ -351,6 +1802,17 @@ func main() {
 		}
 	}()
 
+	// Start Envoy ext_authz gRPC server
+	var extAuthzServer *grpc.Server
+	if cfg.ExtAuthzPort != 0 {
+		lis, err := net.Listen("tcp", fmt.Sprintf("%s:%d", cfg.Host, cfg.ExtAuthzPort))
+		if err != nil {
+			log.Fatal("Failed to listen for ext_authz:", err)
+		}
+		extAuthzServer = extauthz.NewServer(authorizer, structLogger).Serve(lis)
+		logger.Info("Starting ext_authz gRPC server", "addr", lis.Addr().String())
+	}
+
 	// Wait for interrupt signal
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
@@ -361,13 +1823,23 @@ func main() {
 	ctx, cancel = context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout)*time.Second)
 	defer cancel()
 
+	if extAuthzServer != nil {
+		extAuthzServer.GracefulStop()
+	}
 	if err := srv.Shutdown(ctx); err != nil {
 		logger.Error("Server shutdown failed", "error", err, "timeout", cfg.ShutdownTimeout)
 		return
 	}
 	logger.Info("Server shutdown completed successfully")
+	webhooks.Close()
 
 	// Cleanup resources
+	if err := sharedStore.Close(); err != nil {
+		logger.Error("Failed to close shared state store", "error", err)
+	}
+	if err := shutdownTracing(ctx); err != nil {
+		logger.Error("Failed to flush traces", "error", err)
+	}
 	if cacheManager != nil {
 		if err := cacheManager.Close(); err != nil {
 			logger.Error("Failed to close cache manager", "error", err)
@@ -382,6 +1854,304 @@ func main() {
 	logger.Info("Server stopped")
 }
 
+// newTokenIssuer loads the signing key schedule, falling back to a single
+// key. The issuer URL defaults to the OIDC issuer so both share one JWKS.
+func newTokenIssuer(cfg *Config, logger interfaces.Logger) (*auth.Issuer, error) {
+	issuerURL := cfg.JWTIssuer
+	if issuerURL == "" {
+		issuerURL = cfg.OIDCIssuer
+	}
+	if issuerURL == "" {
+		issuerURL = "impl-zamaz"
+	}
+	rotation := auth.Rotation{
+		PrePublish: time.Duration(cfg.JWTKeyPrePublish) * time.Second,
+		Overlap:    time.Duration(cfg.JWTKeyOverlap) * time.Second,
+	}
+
+	var keys []auth.ScheduledKey
+	switch {
+	case cfg.JWTSigningKeysFile != "":
+		schedule, err := auth.LoadKeySchedule(cfg.JWTSigningKeysFile)
+		if err != nil {
+			return nil, err
+		}
+		keys = schedule
+	case cfg.OIDCSigningKeyFile != "":
+		key, err := auth.LoadSigningKey(cfg.OIDCSigningKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		keys = []auth.ScheduledKey{{Key: key}}
+	default:
+		logger.Warn("JWT_SIGNING_KEYS_FILE not set; using an ephemeral key that is not shared between replicas or restarts")
+		key, err := auth.GenerateSigningKey(cfg.JWTSigningAlgorithm)
+		if err != nil {
+			return nil, err
+		}
+		keys = []auth.ScheduledKey{{Key: key}}
+	}
+	return auth.NewRotatingIssuer(issuerURL, keys, rotation)
+}
+
+// newMDMConnectors returns the connectors of the configured MDMs
+// ldapConfig is the directory LDAP logins and group sync use
+func ldapConfig(cfg *Config) auth.LDAPConfig {
+	return auth.LDAPConfig{
+		URL:              cfg.LDAPURL,
+		UserDNTemplate:   cfg.LDAPUserDNTemplate,
+		BindDN:           cfg.LDAPBindDN,
+		BindPassword:     cfg.LDAPBindPassword,
+		BaseDN:           cfg.LDAPBaseDN,
+		UserAttribute:    cfg.LDAPUserAttribute,
+		GroupAttribute:   cfg.LDAPGroupAttribute,
+		GroupBaseDN:      cfg.LDAPGroupBaseDN,
+		GroupObjectClass: cfg.LDAPGroupObjectClass,
+		MemberAttribute:  cfg.LDAPMemberAttribute,
+	}
+}
+
+func newGroupSources(cfg *Config) ([]groupsync.Source, error) {
+	var sources []groupsync.Source
+	if cfg.GroupSyncKeycloak {
+		keycloak, err := groupsync.NewKeycloak(groupsync.KeycloakConfig{
+			BaseURL:      cfg.KeycloakBaseURL,
+			Realm:        cfg.KeycloakRealm,
+			ClientID:     cfg.KeycloakClientID,
+			ClientSecret: cfg.KeycloakClientSecret,
+		})
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, keycloak)
+	}
+	if cfg.GroupSyncLDAP {
+		verifier, err := auth.NewLDAPVerifier(ldapConfig(cfg))
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, groupsync.NewLDAP(verifier))
+	}
+	return sources, nil
+}
+
+func newMDMConnectors(cfg *Config) ([]mdm.Connector, error) {
+	var connectors []mdm.Connector
+	if cfg.IntuneTenantID != "" {
+		intune, err := mdm.NewIntune(mdm.IntuneConfig{
+			TenantID:     cfg.IntuneTenantID,
+			ClientID:     cfg.IntuneClientID,
+			ClientSecret: cfg.IntuneClientSecret,
+		})
+		if err != nil {
+			return nil, err
+		}
+		connectors = append(connectors, intune)
+	}
+	if cfg.JamfURL != "" {
+		jamf, err := mdm.NewJamf(mdm.JamfConfig{
+			URL:               cfg.JamfURL,
+			ClientID:          cfg.JamfClientID,
+			ClientSecret:      cfg.JamfClientSecret,
+			ComplianceGroupID: cfg.JamfComplianceGroupID,
+		})
+		if err != nil {
+			return nil, err
+		}
+		connectors = append(connectors, jamf)
+	}
+	return connectors, nil
+}
+
+// newAttestor verifies Android and iOS devices with platform attestation
+// where it is configured
+func newAttestor(cfg *Config, challenges *attestation.Challenges, logger interfaces.Logger, metrics interfaces.MetricsCollector) (device.Attestor, error) {
+	verifiers := make(map[string]attestation.Verifier)
+	if cfg.PlayIntegrityPackageName != "" {
+		decryptionKey, verificationKey, err := attestation.ParsePlayIntegrityKeys(cfg.PlayIntegrityDecryptionKey, cfg.PlayIntegrityVerificationKey)
+		if err != nil {
+			return nil, err
+		}
+		var digests []string
+		for _, digest := range strings.Split(cfg.PlayIntegrityCertDigests, ",") {
+			if digest = strings.TrimSpace(digest); digest != "" {
+				digests = append(digests, digest)
+			}
+		}
+		playIntegrity, err := attestation.NewPlayIntegrity(attestation.PlayIntegrityConfig{
+			PackageName:        cfg.PlayIntegrityPackageName,
+			DecryptionKey:      decryptionKey,
+			VerificationKey:    verificationKey,
+			CertificateDigests: digests,
+		})
+		if err != nil {
+			return nil, err
+		}
+		verifiers["android"] = playIntegrity
+	}
+	if cfg.DeviceCheckTeamID != "" {
+		key, err := attestation.LoadDeviceCheckKey(cfg.DeviceCheckKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		url := attestation.DeviceCheckURL
+		if cfg.DeviceCheckDevelopment {
+			url = attestation.DeviceCheckDevelopmentURL
+		}
+		deviceCheck, err := attestation.NewDeviceCheck(attestation.DeviceCheckConfig{
+			TeamID:     cfg.DeviceCheckTeamID,
+			KeyID:      cfg.DeviceCheckKeyID,
+			PrivateKey: key,
+			URL:        url,
+		})
+		if err != nil {
+			return nil, err
+		}
+		verifiers["ios"] = deviceCheck
+	}
+	for platform := range verifiers {
+		logger.Info("Device attestation configured", "platform", platform)
+	}
+	return attestation.NewAttestor(verifiers, challenges, device.FingerprintAttestor{}, logger, metrics), nil
+}
+
+// newRelyingParty logs browsers in through the Keycloak realm and ends each
+// login in an SSO session
+func newRelyingParty(ctx context.Context, cfg *Config, s store.Store, sessions *session.Manager, travel *trust.TravelDetector, devices *device.Registry, auditLog *audit.Log, logger interfaces.Logger, metrics interfaces.MetricsCollector) (*auth.RelyingParty, error) {
+	keys := auth.NewJWKSClient(auth.JWKSConfig{
+		URL: authz.KeycloakJWKSURL(cfg.KeycloakBaseURL, cfg.KeycloakRealm),
+	}, logger, metrics)
+	keys.Start(ctx)
+	return auth.NewRelyingParty(auth.RelyingPartyConfig{
+		Issuer:          authz.KeycloakRealmURL(cfg.KeycloakBaseURL, cfg.KeycloakRealm),
+		AuthorizeURL:    authz.KeycloakAuthURL(cfg.KeycloakBaseURL, cfg.KeycloakRealm),
+		TokenURL:        authz.KeycloakTokenURL(cfg.KeycloakBaseURL, cfg.KeycloakRealm),
+		ClientID:        cfg.KeycloakClientID,
+		ClientSecret:    cfg.KeycloakClientSecret,
+		RedirectURL:     cfg.OIDCRPRedirectURL,
+		StateTTL:        time.Duration(cfg.OIDCRPStateTTL) * time.Second,
+		DefaultReturnTo: cfg.OIDCRPReturnTo,
+		CookieSecure:    cfg.SessionCookieSecure,
+		Leeway:          30 * time.Second,
+		Complete: func(c *gin.Context, user interfaces.UserInfo) error {
+			if checkTravel(c, cfg, travel, auditLog, user, "oidc") {
+				return auth.ErrLoginDenied
+			}
+			sess, err := sessions.Create(c, user)
+			if err != nil {
+				return err
+			}
+			checkDevice(c, cfg, devices, sessions, sess, user, "oidc")
+			if _, err := auditLog.Record(c.Request.Context(), cfg.AuditDefaultTenant, "auth.login", user.ID, map[string]interface{}{
+				"ip":     c.ClientIP(),
+				"method": "oidc",
+			}); err != nil {
+				slog.Error("Failed to record audit event", "error", err)
+			}
+			slog.Info("User logged in", "username", user.Username, "ip", c.ClientIP(), "method", "oidc")
+			return nil
+		},
+	}, s, keys, logger, metrics)
+}
+
+// newMagicLinks sets up email login against the local users file or the
+// allowed domains, ending in an SSO session when sessions are enabled
+func newMagicLinks(cfg *Config, issuer *auth.Issuer, s store.Store, sessions *session.Manager, travel *trust.TravelDetector, devices *device.Registry, auditLog *audit.Log, logger interfaces.Logger, metrics interfaces.MetricsCollector) (*auth.MagicLinks, error) {
+	var lookup func(ctx context.Context, address string) (*interfaces.UserInfo, error)
+	switch {
+	case cfg.AuthLocalUsersFile != "":
+		users, err := auth.LoadLocalUsers(cfg.AuthLocalUsersFile)
+		if err != nil {
+			return nil, err
+		}
+		lookup = users.LookupEmail
+	case cfg.MagicLinkAllowedDomains != "":
+		domains := strings.Split(strings.ToLower(cfg.MagicLinkAllowedDomains), ",")
+		lookup = func(_ context.Context, address string) (*interfaces.UserInfo, error) {
+			_, domain, _ := strings.Cut(address, "@")
+			for _, allowed := range domains {
+				if domain == strings.TrimSpace(allowed) {
+					return &interfaces.UserInfo{ID: "email:" + address, Username: address, Email: address, Roles: []string{cfg.DemoRole}}, nil
+				}
+			}
+			return nil, auth.ErrInvalidCredentials
+		}
+	default:
+		return nil, fmt.Errorf("MAGIC_LINK_VERIFY_URL requires AUTH_LOCAL_USERS_FILE or MAGIC_LINK_ALLOWED_DOMAINS")
+	}
+	sender, err := email.New(email.Config{
+		Addr:     cfg.SMTPAddr,
+		Username: cfg.SMTPUsername,
+		Password: cfg.SMTPPassword,
+		From:     cfg.SMTPFrom,
+	}, logger)
+	if err != nil {
+		return nil, err
+	}
+	return auth.NewMagicLinks(auth.MagicLinkConfig{
+		VerifyURL:       cfg.MagicLinkVerifyURL,
+		TTL:             time.Duration(cfg.MagicLinkTTL) * time.Second,
+		DefaultReturnTo: cfg.OIDCRPReturnTo,
+		AccessTokenTTL:  time.Duration(cfg.JWTAccessTokenTTL) * time.Second,
+		RefreshTokenTTL: time.Duration(cfg.JWTRefreshTokenTTL) * time.Second,
+		Lookup:          lookup,
+		Complete: func(c *gin.Context, user interfaces.UserInfo) error {
+			if checkTravel(c, cfg, travel, auditLog, user, "magic_link") {
+				return auth.ErrLoginDenied
+			}
+			var sess *session.Session
+			if sessions != nil {
+				var err error
+				if sess, err = sessions.Create(c, user); err != nil {
+					return err
+				}
+			}
+			checkDevice(c, cfg, devices, sessions, sess, user, "magic_link")
+			if _, err := auditLog.Record(c.Request.Context(), cfg.AuditDefaultTenant, "auth.login", user.ID, map[string]interface{}{
+				"ip":     c.ClientIP(),
+				"method": "magic_link",
+			}); err != nil {
+				slog.Error("Failed to record audit event", "error", err)
+			}
+			slog.Info("User logged in", "username", user.Username, "ip", c.ClientIP(), "method", "magic_link")
+			return nil
+		},
+	}, issuer, sender, s, logger, metrics)
+}
+
+// newOIDCProvider loads the clients and users for provider mode
+func newOIDCProvider(cfg *Config, issuer *auth.Issuer, s store.Store, sessions *session.Manager, scorer trust.Scorer, levels trust.AccessLevels, lockout *security.Lockout, bruteForce *security.BruteForce, logger interfaces.Logger) (*oidc.Provider, error) {
+	if cfg.OIDCClientsFile == "" || cfg.OIDCUsersFile == "" {
+		return nil, fmt.Errorf("OIDC_CLIENTS_FILE and OIDC_USERS_FILE are required")
+	}
+	clients, err := oidc.LoadClients(cfg.OIDCClientsFile)
+	if err != nil {
+		return nil, err
+	}
+	users, err := oidc.LoadStaticUsers(cfg.OIDCUsersFile)
+	if err != nil {
+		return nil, err
+	}
+	var claimMapping *oidc.ClaimMapping
+	if cfg.OIDCClaimMappingFile != "" {
+		if claimMapping, err = oidc.LoadClaimMapping(cfg.OIDCClaimMappingFile); err != nil {
+			return nil, err
+		}
+	}
+
+	return oidc.NewProvider(oidc.Config{
+		Clients:        clients,
+		CodeTTL:        time.Duration(cfg.OIDCAuthCodeTTL) * time.Second,
+		AccessTokenTTL: time.Duration(cfg.OIDCAccessTokenTTL) * time.Second,
+		Sessions:       sessions,
+		ClaimMapping:   claimMapping,
+		Trust:          scorer,
+		AccessLevels:   levels,
+		Lockout:        lockout,
+		BruteForce:     bruteForce,
+	}, issuer, s, users, logger), nil
+}
+
 // handleRoot handles the root endpoint with service information
 func handleRoot(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{
@@ -413,10 +2183,12 @@ func handleRoot(c *gin.Context) {
 	})
 }
 
-// handleEnhancedHealth handles the enhanced health check endpoint using framework
-func handleEnhancedHealth(healthChecker *frameworkHealth.HealthChecker) gin.HandlerFunc {
+// handleEnhancedHealth reports the status from the latest background checks.
+// A degraded service still answers 200 so load balancers keep routing to it;
+// mode is read-only while the shared store is down and writes are refused.
+func handleEnhancedHealth(healthChecker *health.Checker, failStatic *store.FailStaticStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		status := healthChecker.GetStatus()
+		status := healthChecker.Last()
 		
 		// Maintain backward compatibility with existing health format
 		response := gin.H{
@@ -435,10 +2207,16 @@ func handleEnhancedHealth(healthChecker *frameworkHealth.HealthChecker) gin.Hand
 			}
 			response["checks"] = checks
 		}
+		if failStatic != nil {
+			if since, _ := failStatic.DegradedSince(); !since.IsZero() {
+				response["mode"] = "read-only"
+				response["degraded_since"] = since.UTC()
+			}
+		}
 		
 		// Set appropriate HTTP status
 		httpStatus := http.StatusOK
-		if status.Overall != frameworkHealth.HealthyStatus {
+		if status.Overall == health.StatusUnhealthy {
 			httpStatus = http.StatusServiceUnavailable
 		}
 		
@@ -446,17 +2224,17 @@ func handleEnhancedHealth(healthChecker *frameworkHealth.HealthChecker) gin.Hand
 	}
 }
 
-// handleDetailedHealth handles the detailed health check endpoint
-func handleDetailedHealth(healthChecker *frameworkHealth.HealthChecker) gin.HandlerFunc {
+// handleDetailedHealth runs every dependency check now and reports each result
+func handleDetailedHealth(healthChecker *health.Checker) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		ctx, cancel := context.WithTimeout(c.Request.Context(), 10*time.Second)
 		defer cancel()
 		
-		status := healthChecker.RunChecks(ctx)
+		status := healthChecker.Run(ctx)
 		
 		// Set appropriate HTTP status
 		httpStatus := http.StatusOK
-		if status.Overall != frameworkHealth.HealthyStatus {
+		if status.Overall == health.StatusUnhealthy {
 			httpStatus = http.StatusServiceUnavailable
 		}
 		
@@ -493,14 +2271,90 @@ func handleInfo(c *gin.Context) {
 func handleAPIDocs(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{
 		"swagger":     "/swagger/index.html",
+		"postman":     "/api-docs/postman",
 		"title":       "impl-zamaz Zero Trust API",
 		"version":     "1.0.0",
 		"description": "Zero Trust authentication with comprehensive security features",
 	})
 }
 
-// handleLogin handles user authentication
-func handleLogin(cfg *Config) gin.HandlerFunc {
+// defaultPolicies let authenticated users in except to administrative
+// routes, which are kept to cfg.AdminRole. Policy management is too, but
+// anyone may evaluate a policy.
+func defaultPolicies(cfg *Config) []*policy.Policy {
+	notAdmin := policy.Condition{Attribute: policy.AttributeRoles, Operator: policy.OpNotContains, Values: []string{cfg.AdminRole}}
+	return []*policy.Policy{
+		{
+			ID:        "default-allow",
+			Name:      "Authenticated users",
+			Subjects:  []string{"*"},
+			Resources: []string{"*"},
+			Actions:   []string{"*"},
+			Effect:    policy.EffectAllow,
+		},
+		{
+			ID:       "default-admin-routes",
+			Name:     "Administrative routes",
+			Subjects: []string{"*"},
+			Resources: []string{
+				"admin/*", "apikeys", "apikeys/*", "auth/tokens/*", "audit/*", "risk/*",
+				"trust-score/simulate", "security/circuit-breakers/*",
+				"devices/import", "devices/export", "devices/*/quarantine", "devices/*/block", "devices/*/sessions",
+			},
+			Actions:    []string{"*"},
+			Conditions: []policy.Condition{notAdmin},
+			Effect:     policy.EffectDeny,
+		},
+		{
+			ID:        "default-policy-management",
+			Name:      "Policy management",
+			Subjects:  []string{"*"},
+			Resources: []string{"policies", "policies/*"},
+			Actions:   []string{policy.ActionWrite, policy.ActionDelete},
+			Conditions: []policy.Condition{
+				notAdmin,
+				{Attribute: policy.AttributeRoute, Operator: policy.OpIn, Values: []string{"policies", "policies/:id", "policies/:id/rollback/:version", "policies/import", "policies/resources", "policies/resources/:id"}},
+			},
+			Effect: policy.EffectDeny,
+		},
+		{
+			ID:        "default-rbac-management",
+			Name:      "Role management",
+			Subjects:  []string{"*"},
+			Resources: []string{"rbac/*"},
+			Actions:   []string{policy.ActionWrite, policy.ActionDelete},
+			Conditions: []policy.Condition{
+				notAdmin,
+				// Anyone may check permissions and ask for an elevation;
+				// approving it is management
+				{Attribute: policy.AttributeRoute, Operator: policy.OpNotIn, Values: []string{"rbac/check", "rbac/elevations"}},
+			},
+			Effect: policy.EffectDeny,
+		},
+	}
+}
+
+// discoveryCaller makes registry changes as the authenticated user, an admin
+// when they have adminRole; without one they are anonymous
+func discoveryCaller(adminRole string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var caller discovery.Caller
+		value, _ := c.Get("user")
+		if user, ok := value.(*interfaces.UserInfo); ok {
+			caller.Owner = user.ID
+			for _, role := range user.Roles {
+				caller.Admin = caller.Admin || role == adminRole
+			}
+		}
+		c.Request = c.Request.WithContext(discovery.WithCaller(c.Request.Context(), caller))
+	}
+}
+
+// handleLogin verifies credentials with the configured backend, starting an
+// SSO session when sessions are enabled. Backends that return only the user
+// get tokens from issuer. Failures are audited so credential stuffing shows
+// up in audit search.
+func handleLogin(cfg *Config, verifier interfaces.CredentialVerifier, lockout *security.Lockout, bruteForce *security.BruteForce, travel *trust.TravelDetector, devices *device.Registry, issuer *auth.Issuer, scorer trust.Scorer, sessions *session.Manager, auditLog *audit.Log) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req struct {
 			Username string `json:"username" binding:"required"`
@@ -510,81 +2364,337 @@ func handleLogin(cfg *Config) gin.HandlerFunc {
 		if err := c.ShouldBindJSON(&req); err != nil {
 			slog.Warn("Invalid login request format", "error", err, "ip", c.ClientIP())
 			c.JSON(http.StatusBadRequest, gin.H{
-				"error": "Invalid request format",
+				"error": i18n.Message(c, "VALIDATION_ERROR"),
 				"code":  "VALIDATION_ERROR",
 			})
 			return
 		}
 
-		// Validate credentials (demo implementation)
-		if req.Username == "" || req.Password == "" {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": "Username and password are required",
-				"code":  "MISSING_CREDENTIALS",
+		if lockout != nil {
+			lock, err := lockout.Status(c.Request.Context(), req.Username)
+			if err != nil {
+				slog.Error("Failed to check account lockout", "error", err)
+				c.JSON(http.StatusServiceUnavailable, gin.H{
+					"error": i18n.Message(c, "INTERNAL_ERROR"),
+					"code":  "INTERNAL_ERROR",
+				})
+				return
+			}
+			if lock != nil {
+				slog.Warn("Login rejected", "username", req.Username, "code", "ACCOUNT_LOCKED", "ip", c.ClientIP())
+				c.Header("Retry-After", strconv.Itoa(int(time.Until(lock.Until).Seconds())+1))
+				c.JSON(http.StatusLocked, gin.H{
+					"error": i18n.Message(c, "ACCOUNT_LOCKED"),
+					"code":  "ACCOUNT_LOCKED",
+				})
+				return
+			}
+		}
+
+		response, err := verifier.Authenticate(c.Request.Context(), req.Username, req.Password)
+		if err != nil {
+			status, code := auth.LoginError(err)
+			if lockout != nil && errors.Is(err, auth.ErrInvalidCredentials) {
+				if lock, err := lockout.Failure(c.Request.Context(), req.Username); err != nil {
+					slog.Error("Failed to record failed login", "error", err)
+				} else if lock != nil {
+					status, code = http.StatusLocked, "ACCOUNT_LOCKED"
+				}
+			}
+			if bruteForce != nil && errors.Is(err, auth.ErrInvalidCredentials) {
+				blocks, err := bruteForce.Failure(c.Request.Context(), c.ClientIP(), req.Username)
+				if err != nil {
+					slog.Error("Failed to record distributed login failure", "error", err)
+				}
+				for _, block := range blocks {
+					if block.IP == c.ClientIP() {
+						status, code = http.StatusTooManyRequests, "IP_BLOCKED"
+					}
+					if _, err := auditLog.Record(c.Request.Context(), cfg.AuditDefaultTenant, "auth.ip_blocked", req.Username, map[string]interface{}{
+						"ip":     block.IP,
+						"reason": block.Reason,
+						"until":  block.Until,
+					}); err != nil {
+						slog.Error("Failed to record audit event", "error", err)
+					}
+				}
+			}
+			if status >= http.StatusInternalServerError {
+				slog.Error("Login failed at identity provider", "error", err, "ip", c.ClientIP())
+			} else {
+				slog.Warn("Login rejected", "username", req.Username, "code", code, "ip", c.ClientIP())
+			}
+			if _, err := auditLog.Record(c.Request.Context(), cfg.AuditDefaultTenant, "auth.login", req.Username, map[string]interface{}{
+				"ip":     c.ClientIP(),
+				"result": audit.ResultFailure,
+				"reason": code,
+			}); err != nil {
+				slog.Error("Failed to record audit event", "error", err)
+			}
+			c.JSON(status, gin.H{
+				"error": i18n.Message(c, code),
+				"code":  code,
 			})
 			return
 		}
 
-		// Mock authentication for demo
-		response := &interfaces.LoginResponse{
-			AccessToken:  "demo-jwt-token-" + req.Username + "-" + fmt.Sprintf("%d", time.Now().Unix()),
-			RefreshToken: "demo-refresh-token-" + req.Username,
-			ExpiresIn:    300,
-			TokenType:    "Bearer",
-			User: interfaces.UserInfo{
-				ID:       "demo-" + req.Username,
-				Username: req.Username,
-				Email:    req.Username + "@example.com",
-				Roles:    []string{"user"},
-			},
-			TrustScore: 88,
+		if response.AccessToken == "" {
+			tokens, err := issuer.IssueTokens(auth.UserClaims(response.User), time.Duration(cfg.JWTAccessTokenTTL)*time.Second, time.Duration(cfg.JWTRefreshTokenTTL)*time.Second)
+			if err != nil {
+				slog.Error("Failed to issue tokens", "error", err)
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"error": i18n.Message(c, "INTERNAL_ERROR"),
+					"code":  "INTERNAL_ERROR",
+				})
+				return
+			}
+			response.AccessToken = tokens.AccessToken
+			response.RefreshToken = tokens.RefreshToken
+			response.ExpiresIn = tokens.ExpiresIn
+			response.TokenType = tokens.TokenType
+		}
+
+		if lockout != nil {
+			if err := lockout.Success(c.Request.Context(), req.Username); err != nil {
+				slog.Warn("Failed to reset login failures", "error", err)
+			}
+		}
+
+		if checkTravel(c, cfg, travel, auditLog, response.User, "password") {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error": i18n.Message(c, "LOGIN_DENIED"),
+				"code":  "LOGIN_DENIED",
+			})
+			return
+		}
+
+		signals := trust.RequestContext(c)
+		signals["auth_method"] = "password"
+		if score, err := scorer.Score(c.Request.Context(), trust.Input{
+			Subject: response.User.ID,
+			Context: signals,
+		}); err == nil {
+			response.TrustScore = score.Overall
+		} else {
+			slog.Warn("Failed to calculate trust score", "user_id", response.User.ID, "error", err)
+		}
+
+		var sess *session.Session
+		if sessions != nil {
+			if sess, err = sessions.Create(c, response.User); err != nil {
+				slog.Error("Failed to create SSO session", "error", err)
+			}
+		}
+		if checkDevice(c, cfg, devices, sessions, sess, response.User, "password") && cfg.DeviceUnknownTrustCap > 0 && response.TrustScore > cfg.DeviceUnknownTrustCap {
+			response.TrustScore = cfg.DeviceUnknownTrustCap
+		}
+
+		if _, err := auditLog.Record(c.Request.Context(), cfg.AuditDefaultTenant, "auth.login", response.User.ID, map[string]interface{}{"ip": c.ClientIP()}); err != nil {
+			slog.Error("Failed to record audit event", "error", err)
 		}
 
-		slog.Info("User logged in", "username", req.Username, "ip", c.ClientIP())
+		slog.Info("User logged in", "username", response.User.Username, "ip", c.ClientIP())
 		c.JSON(http.StatusOK, response)
 	}
 }
 
-// handleLogout handles user logout
-func handleLogout(c *gin.Context) {
-	user, exists := c.Get("user")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{
-			"error": "No authenticated user found",
-			"code":  "UNAUTHORIZED",
-		})
-		return
+// checkTravel compares the location of a login with the user's previous one
+// and audits impossible travel. It reports whether the login must be refused.
+// Detection is a heuristic, so a failing store lets the login through.
+func checkTravel(c *gin.Context, cfg *Config, travel *trust.TravelDetector, auditLog *audit.Log, user interfaces.UserInfo, method string) bool {
+	if travel == nil {
+		return false
+	}
+	result, err := travel.Check(c.Request.Context(), user.ID, c.ClientIP())
+	if err != nil {
+		slog.Error("Impossible-travel check failed", "user_id", user.ID, "error", err)
+		return false
+	}
+	if !result.Impossible {
+		return false
+	}
+	auditResult := audit.ResultSuccess
+	if result.Denied {
+		auditResult = audit.ResultFailure
+	}
+	if _, err := auditLog.Record(c.Request.Context(), cfg.AuditDefaultTenant, "security.impossible_travel", user.ID, map[string]interface{}{
+		"ip":          c.ClientIP(),
+		"method":      method,
+		"result":      auditResult,
+		"from":        result.Previous,
+		"to":          result.Current,
+		"distance_km": math.Round(result.DistanceKM),
+		"speed_kmh":   math.Round(result.SpeedKMH),
+		"denied":      result.Denied,
+	}); err != nil {
+		slog.Error("Failed to record audit event", "error", err)
 	}
+	return result.Denied
+}
 
-	authUser := user.(*interfaces.UserInfo)
-	slog.Info("User logged out", "username", authUser.Username, "ip", c.ClientIP())
-	
-	c.JSON(http.StatusOK, gin.H{
-		"message": "Successfully logged out",
-		"timestamp": time.Now().UTC(),
+// checkDevice reports a login from a device its user has not registered,
+// as the device's X-Device-Fingerprint says, and with
+// DEVICE_UNKNOWN_TRUST_CAP caps sess, if any, until the device is verified.
+// It reports whether the device is unknown. Detection is best effort, so a
+// failing store lets the login through.
+func checkDevice(c *gin.Context, cfg *Config, devices *device.Registry, sessions *session.Manager, sess *session.Session, user interfaces.UserInfo, method string) bool {
+	sighting, err := devices.ObserveLogin(c.Request.Context(), device.Login{
+		Owner:       user.ID,
+		Email:       user.Email,
+		Fingerprint: c.GetHeader(device.HeaderDeviceFingerprint),
+		IP:          c.ClientIP(),
+		UserAgent:   c.Request.UserAgent(),
+		Method:      method,
 	})
+	if err != nil {
+		slog.Error("Unknown-device check failed", "user_id", user.ID, "error", err)
+		return false
+	}
+	if sighting == nil {
+		return false
+	}
+	slog.Warn("Login from unknown device", "user_id", user.ID, "sighting", sighting.ID, "logins", sighting.Logins, "ip", c.ClientIP(), "method", method)
+	if sess != nil && cfg.DeviceUnknownTrustCap > 0 {
+		if err := sessions.HoldUnconfirmed(c.Request.Context(), sess.ID, sighting.ID, cfg.DeviceUnknownTrustCap); err != nil {
+			slog.Error("Failed to cap session of unknown device", "user_id", user.ID, "error", err)
+		}
+	}
+	return true
 }
 
-// handleRefreshToken handles token refresh requests
-func handleRefreshToken(c *gin.Context) {
-	var req struct {
-		RefreshToken string `json:"refresh_token" binding:"required"`
+// handleLogout handles user logout, ending the SSO session for every app and
+// revoking the bearer token the request was made with
+func handleLogout(cfg *Config, sessions *session.Manager, revocations *security.RevocationStore, auditLog *audit.Log) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, exists := c.Get("user")
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": i18n.Message(c, "UNAUTHORIZED"),
+				"code":  "UNAUTHORIZED",
+			})
+			return
+		}
+
+		if sessions != nil {
+			if err := sessions.Destroy(c); err != nil {
+				slog.Error("Failed to destroy SSO session", "error", err)
+			}
+		}
+
+		authUser := user.(*interfaces.UserInfo)
+		if token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+			if err := revocations.RevokeToken(c.Request.Context(), strings.TrimSpace(token), authUser.ID, "logout"); err != nil && !errors.Is(err, security.ErrInvalidJTI) {
+				slog.Error("Failed to revoke token on logout", "error", err)
+			}
+		}
+		if _, err := auditLog.Record(c.Request.Context(), cfg.AuditDefaultTenant, "auth.logout", authUser.ID, map[string]interface{}{"ip": c.ClientIP()}); err != nil {
+			slog.Error("Failed to record audit event", "error", err)
+		}
+		slog.Info("User logged out", "username", authUser.Username, "ip", c.ClientIP())
+
+		c.JSON(http.StatusOK, gin.H{
+			"message":   "Successfully logged out",
+			"timestamp": time.Now().UTC(),
+		})
 	}
+}
 
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "Invalid request format",
-			"code":  "VALIDATION_ERROR",
+// handleSession reports the current SSO session so first-party apps can
+// detect an existing login
+func handleSession(sessions *session.Manager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if sessions == nil {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": i18n.Message(c, "SESSIONS_DISABLED"),
+				"code":  "SESSIONS_DISABLED",
+			})
+			return
+		}
+		sess, err := sessions.Get(c)
+		if errors.Is(err, session.ErrReauthRequired) {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": i18n.Message(c, "REAUTH_REQUIRED"),
+				"code":  "REAUTH_REQUIRED",
+			})
+			return
+		}
+		if err != nil {
+			if !errors.Is(err, session.ErrNoSession) {
+				slog.Error("Failed to load SSO session", "error", err)
+			}
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": i18n.Message(c, "UNAUTHORIZED"),
+				"code":  "UNAUTHORIZED",
+			})
+			return
+		}
+		c.Header("Cache-Control", "no-store")
+		c.JSON(http.StatusOK, gin.H{
+			"user":       sess.User,
+			"created_at": sess.CreatedAt,
+			"expires_at": sess.ExpiresAt,
 		})
-		return
 	}
+}
 
-	// Mock token refresh for demo
-	c.JSON(http.StatusOK, gin.H{
-		"access_token": "new-demo-jwt-token-" + fmt.Sprintf("%d", time.Now().Unix()),
-		"expires_in":   300,
-		"token_type":   "Bearer",
-	})
+// handleRefreshToken exchanges a refresh token signed by the issuer for a new
+// token pair, including a new refresh token. Each refresh token is single
+// use: it is revoked once exchanged.
+func handleRefreshToken(cfg *Config, issuer *auth.Issuer, revocations *security.RevocationStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			RefreshToken string `json:"refresh_token" binding:"required"`
+		}
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": i18n.Message(c, "VALIDATION_ERROR"),
+				"code":  "VALIDATION_ERROR",
+			})
+			return
+		}
+
+		tokens, err := issuer.Refresh(req.RefreshToken,
+			time.Duration(cfg.JWTAccessTokenTTL)*time.Second, time.Duration(cfg.JWTRefreshTokenTTL)*time.Second)
+		if err != nil {
+			slog.Warn("Rejected refresh token", "error", err, "ip", c.ClientIP())
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": i18n.Message(c, "UNAUTHORIZED"),
+				"code":  "UNAUTHORIZED",
+			})
+			return
+		}
+
+		// The signature is verified, so the jti is the issuer's own
+		consumed, err := revocations.ConsumeToken(c.Request.Context(), req.RefreshToken, "", "refreshed")
+		if err != nil {
+			slog.Error("Failed to revoke exchanged refresh token", "error", err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"error": i18n.Message(c, "INTERNAL_ERROR"),
+				"code":  "INTERNAL_ERROR",
+			})
+			return
+		}
+		if !consumed {
+			slog.Warn("Rejected revoked refresh token", "ip", c.ClientIP())
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": i18n.Message(c, "TOKEN_REVOKED"),
+				"code":  "TOKEN_REVOKED",
+			})
+			return
+		}
+		c.JSON(http.StatusOK, tokens)
+	}
+}
+
+// handleJWKS publishes the issuer's current, upcoming and recently retired
+// keys. The cache lifetime stays well below the pre-publish window so
+// relying parties see a new key before it signs.
+func handleJWKS(issuer *auth.Issuer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Cache-Control", "public, max-age=300")
+		c.JSON(http.StatusOK, issuer.JWKS())
+	}
 }
 
 // handleValidateToken validates the current token
@@ -592,7 +2702,7 @@ func handleValidateToken(c *gin.Context) {
 	user, exists := c.Get("user")
 	if !exists {
 		c.JSON(http.StatusUnauthorized, gin.H{
-			"error": "No authenticated user found",
+			"error": i18n.Message(c, "UNAUTHORIZED"),
 			"code":  "UNAUTHORIZED",
 		})
 		return
@@ -607,71 +2717,88 @@ func handleValidateToken(c *gin.Context) {
 }
 
 // handleTrustScore returns the current user's trust score
-func handleTrustScore(c *gin.Context) {
-	user, exists := c.Get("user")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{
-			"error": "No authenticated user found",
-			"code":  "UNAUTHORIZED",
-		})
-		return
-	}
+func handleTrustScore(scorer trust.Scorer, levels trust.AccessLevels) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, exists := c.Get("user")
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": i18n.Message(c, "UNAUTHORIZED"),
+				"code":  "UNAUTHORIZED",
+			})
+			return
+		}
 
-	authUser := user.(*interfaces.UserInfo)
+		authUser := user.(*interfaces.UserInfo)
+		trustScore, err := scorer.Score(c.Request.Context(), trust.Input{
+			Subject: authUser.ID,
+			Context: trust.RequestContext(c),
+		})
+		if err != nil {
+			slog.Error("Failed to calculate trust score", "user_id", authUser.ID, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": i18n.Message(c, "INTERNAL_ERROR"),
+				"code":  "INTERNAL_ERROR",
+			})
+			return
+		}
+		level, access := trust.AccessLevel(trustScore.Overall, levels.Thresholds(c.Request.Context()))
 
-	// Calculate trust score (demo implementation)
-	trustScore := &interfaces.TrustScore{
-		UserID:  authUser.ID,
-		Overall: 88,
-		Factors: interfaces.TrustFactors{
-			Identity: 30,
-			Device:   20,
-			Behavior: 18,
-			Location: 12,
-			Risk:     8,
-		},
-		Timestamp: time.Now().UTC(),
-		Context:   "demo_calculation",
-	}
+		response := gin.H{
+			"user_id":    trustScore.UserID,
+			"overall":    trustScore.Overall,
+			"factors":    trustScore.Factors,
+			"explanations": trustScore.Explanations,
+			"timestamp":  trustScore.Timestamp,
+			"context":    trustScore.Context,
+			"next_check": time.Now().Add(5 * time.Minute).UTC(),
+			"level":      "moderate", // Based on score
+			"access_level": level,
+			"access":       access,
+		}
 
-	response := gin.H{
-		"user_id":    trustScore.UserID,
-		"overall":    trustScore.Overall,
-		"factors":    trustScore.Factors,
-		"timestamp":  trustScore.Timestamp,
-		"context":    trustScore.Context,
-		"next_check": time.Now().Add(5 * time.Minute).UTC(),
-		"level":      "moderate", // Based on score
+		c.JSON(http.StatusOK, response)
 	}
-
-	c.JSON(http.StatusOK, response)
 }
 
 // handleUserProfile returns the authenticated user's profile information
-func handleUserProfile(c *gin.Context) {
-	user, exists := c.Get("user")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{
-			"error": "No authenticated user found",
-			"code":  "UNAUTHORIZED",
+func handleUserProfile(scorer trust.Scorer, levels trust.AccessLevels) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, exists := c.Get("user")
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": i18n.Message(c, "UNAUTHORIZED"),
+				"code":  "UNAUTHORIZED",
+			})
+			return
+		}
+
+		authUser := user.(*interfaces.UserInfo)
+		trustScore, err := scorer.Score(c.Request.Context(), trust.Input{
+			Subject: authUser.ID,
+			Context: trust.RequestContext(c),
 		})
-		return
-	}
+		if err != nil {
+			slog.Error("Failed to calculate trust score", "user_id", authUser.ID, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": i18n.Message(c, "INTERNAL_ERROR"),
+				"code":  "INTERNAL_ERROR",
+			})
+			return
+		}
 
-	authUser := user.(*interfaces.UserInfo)
+		profile := gin.H{
+			"id":              authUser.ID,
+			"username":        authUser.Username,
+			"email":           authUser.Email,
+			"roles":           authUser.Roles,
+			"last_login":      time.Now().Add(-2 * time.Hour).UTC(),
+			"trust_level":     trustScore.Overall,
+			"status":          "active",
+			"profile_updated": time.Now().Add(-24 * time.Hour).UTC(),
+		}
 
-	profile := gin.H{
-		"id":         authUser.ID,
-		"username":   authUser.Username,
-		"email":      authUser.Email,
-		"roles":      authUser.Roles,
-		"last_login": time.Now().Add(-2 * time.Hour).UTC(),
-		"trust_level": 88,
-		"status":     "active",
-		"profile_updated": time.Now().Add(-24 * time.Hour).UTC(),
+		c.JSON(http.StatusOK, profile)
 	}
-
-	c.JSON(http.StatusOK, profile)
 }
 
 // handleProtectedResource provides access to a protected resource
@@ -679,22 +2806,25 @@ func handleProtectedResource(c *gin.Context) {
 	user, exists := c.Get("user")
 	if !exists {
 		c.JSON(http.StatusUnauthorized, gin.H{
-			"error": "No authenticated user found",
+			"error": i18n.Message(c, "UNAUTHORIZED"),
 			"code":  "UNAUTHORIZED",
 		})
 		return
 	}
 
 	authUser := user.(*interfaces.UserInfo)
+	required, _ := middleware.RequiredTrustLevel(c)
 
 	response := gin.H{
-		"message":     "Access granted to protected resource",
-		"accessed_by": authUser.Username,
-		"user_id":     authUser.ID,
-		"endpoint":    c.FullPath(),
-		"method":      c.Request.Method,
-		"timestamp":   time.Now().UTC(),
-		"requirement": "Valid authentication and sufficient trust level",
+		"message":              "Access granted to protected resource",
+		"accessed_by":          authUser.Username,
+		"user_id":              authUser.ID,
+		"endpoint":             c.FullPath(),
+		"method":               c.Request.Method,
+		"timestamp":            time.Now().UTC(),
+		"requirement":          "Valid authentication and sufficient trust level",
+		"trust_level_required": required,
+		"your_trust_level":     c.GetInt(middleware.TrustLevelKey),
 		"data": gin.H{
 			"resource_id": "protected-resource-001",
 			"type":        "sensitive_data",
@@ -749,8 +2879,8 @@ func (l *structuredLogger) With(keysAndValues ...interface{}) interfaces.Logger
 // handleCircuitBreakerStats returns circuit breaker statistics
 func handleCircuitBreakerStats(cbm *security.CircuitBreakerManager) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		stats := cbm.GetAllStats()
-		health := cbm.HealthCheck()
+		stats := cbm.GetAllStats(c.Request.Context())
+		health := cbm.HealthCheck(c.Request.Context())
 		
 		response := gin.H{
 			"circuit_breakers": stats,
@@ -762,8 +2892,9 @@ func handleCircuitBreakerStats(cbm *security.CircuitBreakerManager) gin.HandlerF
 	}
 }
 
-// handleAuthStats returns authentication statistics
-func handleAuthStats(am *security.AuthManager) gin.HandlerFunc {
+// handleAuthStats returns authentication statistics, including the
+// addresses blocked after distributed login failures
+func handleAuthStats(am *security.AuthManager, bruteForce *security.BruteForce) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		stats := am.GetSessionStats()
 		
@@ -771,6 +2902,13 @@ func handleAuthStats(am *security.AuthManager) gin.HandlerFunc {
 			"session_stats": stats,
 			"timestamp":     time.Now().UTC(),
 		}
+		if bruteForce != nil {
+			blocks, err := bruteForce.List(c.Request.Context())
+			if err != nil {
+				slog.Warn("Failed to list IP blocks", "error", err)
+			}
+			response["ip_blocks"] = blocks
+		}
 		
 		c.JSON(http.StatusOK, response)
 	}
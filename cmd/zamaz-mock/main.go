@@ -0,0 +1,49 @@
+// Package main provides zamaz-mock, an offline stand-in for the impl-zamaz API
+// that serves deterministic fixtures for consumer contract testing
+package main
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/caarlos0/env/v9"
+	"github.com/gin-gonic/gin"
+
+	"github.com/lsendel/impl-zamaz/pkg/mockserver"
+)
+
+// Config holds mock server configuration
+type Config struct {
+	Port     int    `env:"MOCK_PORT" envDefault:"8090"`
+	Host     string `env:"HOST" envDefault:"0.0.0.0"`
+	Scenario string `env:"MOCK_SCENARIO" envDefault:"default"`
+}
+
+func main() {
+	cfg := &Config{}
+	if err := env.Parse(cfg); err != nil {
+		log.Fatal("Failed to parse config:", err)
+	}
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	slog.SetDefault(logger)
+
+	gin.SetMode(gin.ReleaseMode)
+	server := mockserver.NewServer(cfg.Scenario)
+
+	srv := &http.Server{
+		Addr:              fmt.Sprintf("%s:%d", cfg.Host, cfg.Port),
+		Handler:           server.Router(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	logger.Info("Starting mock server", "addr", srv.Addr, "scenario", cfg.Scenario)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.Error("Mock server failed", "error", err)
+		os.Exit(1)
+	}
+}
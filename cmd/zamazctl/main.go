@@ -0,0 +1,201 @@
+// Package main provides zamazctl, the operator CLI for impl-zamaz
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/lsendel/impl-zamaz/pkg/admin"
+	"github.com/lsendel/impl-zamaz/pkg/loadtest"
+)
+
+const usage = `zamazctl - impl-zamaz operator CLI
+
+Usage:
+  zamazctl <command> [flags]
+
+Commands:
+  apply      Apply a bundle of roles, policies, services and tenants from files
+  loadtest   Drive a login/validate/policy mix against a target and report latencies
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "apply":
+		err = runApply(os.Args[2:])
+	case "loadtest":
+		err = runLoadTest(os.Args[2:])
+	case "-h", "--help", "help":
+		fmt.Print(usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
+
+func runLoadTest(args []string) error {
+	fs := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	target := fs.String("target", "http://localhost:8080", "base URL of the impl-zamaz instance")
+	duration := fs.Duration("duration", 30*time.Second, "how long to generate load")
+	concurrency := fs.Int("concurrency", 10, "number of concurrent workers")
+	rate := fs.Int("rate", 0, "maximum total requests per second (0 = unlimited)")
+	mix := fs.String("mix", "login=20,validate=60,policy=20", "weighted operation mix")
+	username := fs.String("username", "demo", "login username")
+	password := fs.String("password", "demo", "login password")
+	timeout := fs.Duration("timeout", 10*time.Second, "per-request timeout")
+	jsonOutput := fs.Bool("json", false, "print the report as JSON")
+	maxErrorRate := fs.Float64("max-error-rate", -1, "exit non-zero when the error ratio exceeds this value (0-1)")
+	fs.Parse(args)
+
+	weights, err := loadtest.ParseMix(*mix)
+	if err != nil {
+		return err
+	}
+
+	runner, err := loadtest.NewRunner(loadtest.Config{
+		Target:      *target,
+		Duration:    *duration,
+		Concurrency: *concurrency,
+		Rate:        *rate,
+		Mix:         weights,
+		Username:    *username,
+		Password:    *password,
+		Timeout:     *timeout,
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	fmt.Fprintf(os.Stderr, "Running load test against %s for %s with %d workers...\n", *target, *duration, *concurrency)
+	report := runner.Run(ctx)
+
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		report.WriteText(os.Stdout)
+	}
+
+	if *maxErrorRate >= 0 && report.Requests > 0 {
+		if ratio := float64(report.Errors) / float64(report.Requests); ratio > *maxErrorRate {
+			return fmt.Errorf("error rate %.2f%% exceeds threshold %.2f%%", ratio*100, *maxErrorRate*100)
+		}
+	}
+	return nil
+}
+
+func runApply(args []string) error {
+	fs := flag.NewFlagSet("apply", flag.ExitOnError)
+	path := fs.String("f", "", "bundle file or directory of *.json files")
+	target := fs.String("target", "http://localhost:8080", "base URL of the impl-zamaz instance")
+	token := fs.String("token", os.Getenv("ZAMAZ_TOKEN"), "bearer token (defaults to $ZAMAZ_TOKEN)")
+	dryRun := fs.Bool("dry-run", false, "show the diff without applying it")
+	prune := fs.Bool("prune", false, "delete resources of the bundle's kinds that the bundle does not declare")
+	timeout := fs.Duration("timeout", 30*time.Second, "request timeout")
+	jsonOutput := fs.Bool("json", false, "print the result as JSON")
+	fs.Parse(args)
+
+	if *path == "" {
+		return fmt.Errorf("-f is required")
+	}
+	bundle, err := admin.LoadBundle(*path)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(bundle)
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	if *dryRun {
+		query.Set("dry_run", "true")
+	}
+	if *prune {
+		query.Set("prune", "true")
+	}
+	endpoint := strings.TrimRight(*target, "/") + "/api/v1/admin/apply?" + query.Encode()
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+
+	resp, err := (&http.Client{Timeout: *timeout}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("apply rejected (%s): %s", resp.Status, strings.TrimSpace(string(respBody)))
+	}
+
+	var result admin.ApplyResult
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return fmt.Errorf("unexpected response: %w", err)
+	}
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(result)
+	}
+	writeApplyResult(os.Stdout, &result)
+	return nil
+}
+
+// writeApplyResult prints a diff in the style of terraform plan
+func writeApplyResult(w io.Writer, result *admin.ApplyResult) {
+	symbols := map[string]string{
+		admin.ActionCreate:    "+",
+		admin.ActionUpdate:    "~",
+		admin.ActionDelete:    "-",
+		admin.ActionUnchanged: "=",
+	}
+	for _, change := range result.Changes {
+		fmt.Fprintf(w, "%s %s/%s\n", symbols[change.Action], change.Kind, change.Name)
+	}
+
+	format := "\nApplied: %d created, %d updated, %d deleted, %d unchanged\n"
+	if result.DryRun {
+		format = "\nDry run: %d to create, %d to update, %d to delete, %d unchanged\n"
+	}
+	fmt.Fprintf(w, format,
+		result.Summary[admin.ActionCreate], result.Summary[admin.ActionUpdate],
+		result.Summary[admin.ActionDelete], result.Summary[admin.ActionUnchanged])
+}
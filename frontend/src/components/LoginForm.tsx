@@ -103,6 +103,13 @@ const LoginForm: React.FC<LoginFormProps> = ({ onLogin, loading, error }) => {
           </button>
         </form>
 
+        <a
+          href="http://localhost:8080/api/v1/auth/authorize"
+          className="login-button sso-button"
+        >
+          Sign in with SSO
+        </a>
+
         <div className="demo-info">
           <h4>Demo Credentials:</h4>
           <div className="credential-options">
@@ -0,0 +1,394 @@
+// Package admin manages admin resources (roles, policies, services, tenants,
+// webhooks, access policies) declaratively so infrastructure-as-code tools
+// such as Terraform and Pulumi can own them.
+//
+// Resources are addressed by kind and name. PUT creates or replaces a
+// resource and is idempotent: applying the same spec again changes nothing
+// and returns the same ID and ETag. IDs are assigned on creation and never
+// change. ETags are derived from the ID and the canonical spec, so every
+// replica computes the same value. If-Match and If-None-Match: * guard
+// against lost updates.
+package admin
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+// Errors returned by Manager
+var (
+	ErrUnknownKind        = errors.New("unknown resource kind")
+	ErrNotFound           = errors.New("resource not found")
+	ErrInvalidName        = errors.New("invalid resource name")
+	ErrInvalidSpec        = errors.New("invalid resource spec")
+	ErrPreconditionFailed = errors.New("precondition failed")
+	// ErrConflict is returned when another replica is changing the same
+	// resource; the request can be retried
+	ErrConflict = errors.New("resource is being modified concurrently")
+)
+
+const (
+	keyPrefix     = "admin:"
+	lockKeyPrefix = "admin-lock:"
+	// lockTTL bounds how long a crashed writer can block a resource
+	lockTTL = 10 * time.Second
+)
+
+// validName matches DNS-label-like names, which are safe in URLs and as
+// Terraform resource identifiers
+var validName = regexp.MustCompile(`^[a-z0-9]([a-z0-9._-]{0,61}[a-z0-9])?$`)
+
+// Resource is a stored admin resource
+type Resource struct {
+	ID         string          `json:"id"`
+	Kind       string          `json:"kind"`
+	Name       string          `json:"name"`
+	Spec       json.RawMessage `json:"spec"`
+	Generation int64           `json:"generation"`
+	CreatedAt  time.Time       `json:"created_at"`
+	UpdatedAt  time.Time       `json:"updated_at"`
+}
+
+// ETag returns the strong entity tag of the resource
+func (r *Resource) ETag() string {
+	sum := sha256.Sum256(append([]byte(r.ID+"\n"), r.Spec...))
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// Kind describes a resource type
+type Kind struct {
+	// Name is the singular kind, e.g. "role"
+	Name string
+	// Plural is the URL segment, e.g. "roles"
+	Plural string
+	// Validate rejects malformed specs
+	Validate func(spec json.RawMessage) error
+	// Apply and Remove propagate changes to the component enforcing the
+	// resource; both are optional and must be idempotent
+	Apply  func(ctx context.Context, r *Resource) error
+	Remove func(ctx context.Context, name string) error
+}
+
+// Preconditions carries the conditional request headers
+type Preconditions struct {
+	IfMatch     string
+	IfNoneMatch string
+}
+
+// Manager stores admin resources in the shared store
+type Manager struct {
+	store   store.Store
+	kinds   map[string]Kind
+	logger  interfaces.Logger
+	metrics interfaces.MetricsCollector
+	now     func() time.Time
+}
+
+// NewManager creates a manager for kinds; metrics may be nil
+func NewManager(s store.Store, logger interfaces.Logger, metrics interfaces.MetricsCollector, kinds ...Kind) *Manager {
+	m := &Manager{
+		store:   s,
+		kinds:   make(map[string]Kind, len(kinds)),
+		logger:  logger,
+		metrics: metrics,
+		now:     time.Now,
+	}
+	for _, kind := range kinds {
+		m.kinds[kind.Name] = kind
+	}
+	return m
+}
+
+// Kinds returns the registered kinds sorted by name
+func (m *Manager) Kinds() []Kind {
+	kinds := make([]Kind, 0, len(m.kinds))
+	for _, kind := range m.kinds {
+		kinds = append(kinds, kind)
+	}
+	sort.Slice(kinds, func(i, j int) bool { return kinds[i].Name < kinds[j].Name })
+	return kinds
+}
+
+// Get returns the named resource
+func (m *Manager) Get(ctx context.Context, kind, name string) (*Resource, error) {
+	if _, ok := m.kinds[kind]; !ok {
+		return nil, ErrUnknownKind
+	}
+	return m.load(ctx, kind, name)
+}
+
+// List returns all resources of kind sorted by name
+func (m *Manager) List(ctx context.Context, kind string) ([]*Resource, error) {
+	if _, ok := m.kinds[kind]; !ok {
+		return nil, ErrUnknownKind
+	}
+	prefix := resourceKey(kind, "")
+	keys, err := m.store.Keys(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	resources := make([]*Resource, 0, len(keys))
+	for _, key := range keys {
+		res, err := m.load(ctx, kind, strings.TrimPrefix(key, prefix))
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		resources = append(resources, res)
+	}
+	sort.Slice(resources, func(i, j int) bool { return resources[i].Name < resources[j].Name })
+	return resources, nil
+}
+
+// Put creates or replaces the named resource. created reports whether the
+// resource did not exist before; an unchanged spec is a no-op.
+func (m *Manager) Put(ctx context.Context, kind, name string, spec json.RawMessage, pre Preconditions) (res *Resource, created bool, err error) {
+	k, canonical, err := m.prepare(kind, name, spec)
+	if err != nil {
+		return nil, false, err
+	}
+
+	unlock, err := m.lock(ctx, kind, name)
+	if err != nil {
+		return nil, false, err
+	}
+	defer unlock()
+
+	existing, err := m.load(ctx, kind, name)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, false, err
+	}
+	if err := checkPreconditions(existing, pre); err != nil {
+		return nil, false, err
+	}
+	if existing != nil && bytes.Equal(existing.Spec, canonical) {
+		m.record(kind, "unchanged")
+		return existing, false, nil
+	}
+
+	res, err = m.next(existing, kind, name, canonical)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := m.write(ctx, k, res); err != nil {
+		return nil, false, err
+	}
+
+	created = existing == nil
+	if created {
+		m.record(kind, "created")
+	} else {
+		m.record(kind, "updated")
+	}
+	m.logger.Info("Admin resource applied", "kind", kind, "name", name, "generation", res.Generation)
+	return res, created, nil
+}
+
+// Delete removes the named resource
+func (m *Manager) Delete(ctx context.Context, kind, name string, pre Preconditions) error {
+	k, ok := m.kinds[kind]
+	if !ok {
+		return ErrUnknownKind
+	}
+
+	unlock, err := m.lock(ctx, kind, name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	existing, err := m.load(ctx, kind, name)
+	if err != nil {
+		return err
+	}
+	if err := checkPreconditions(existing, pre); err != nil {
+		return err
+	}
+	if err := m.remove(ctx, k, name); err != nil {
+		return err
+	}
+
+	m.record(kind, "deleted")
+	m.logger.Info("Admin resource deleted", "kind", kind, "name", name)
+	return nil
+}
+
+// prepare checks the kind and name and returns the validated canonical spec
+func (m *Manager) prepare(kind, name string, spec json.RawMessage) (Kind, json.RawMessage, error) {
+	k, ok := m.kinds[kind]
+	if !ok {
+		return Kind{}, nil, ErrUnknownKind
+	}
+	if !validName.MatchString(name) {
+		return Kind{}, nil, ErrInvalidName
+	}
+	canonical, err := canonicalJSON(spec)
+	if err != nil {
+		return Kind{}, nil, fmt.Errorf("%w: %v", ErrInvalidSpec, err)
+	}
+	if k.Validate != nil {
+		if err := k.Validate(canonical); err != nil {
+			return Kind{}, nil, fmt.Errorf("%w: %v", ErrInvalidSpec, err)
+		}
+	}
+	return k, canonical, nil
+}
+
+// next builds the successor of existing (which may be nil) with spec,
+// keeping its ID and creation time
+func (m *Manager) next(existing *Resource, kind, name string, spec json.RawMessage) (*Resource, error) {
+	now := m.now().UTC()
+	res := &Resource{Kind: kind, Name: name, Spec: spec, Generation: 1, CreatedAt: now, UpdatedAt: now}
+	if existing != nil {
+		res.ID = existing.ID
+		res.Generation = existing.Generation + 1
+		res.CreatedAt = existing.CreatedAt
+		return res, nil
+	}
+	var err error
+	res.ID, err = newID()
+	return res, err
+}
+
+// write runs the kind's Apply hook and stores res
+func (m *Manager) write(ctx context.Context, k Kind, res *Resource) error {
+	if k.Apply != nil {
+		if err := k.Apply(ctx, res); err != nil {
+			return fmt.Errorf("failed to apply %s %s: %w", res.Kind, res.Name, err)
+		}
+	}
+	return m.save(ctx, res)
+}
+
+// remove runs the kind's Remove hook and deletes the stored resource
+func (m *Manager) remove(ctx context.Context, k Kind, name string) error {
+	if k.Remove != nil {
+		if err := k.Remove(ctx, name); err != nil {
+			return fmt.Errorf("failed to remove %s %s: %w", k.Name, name, err)
+		}
+	}
+	return m.store.Delete(ctx, resourceKey(k.Name, name))
+}
+
+func checkPreconditions(existing *Resource, pre Preconditions) error {
+	if pre.IfNoneMatch == "*" && existing != nil {
+		return ErrPreconditionFailed
+	}
+	if pre.IfMatch != "" {
+		if existing == nil {
+			return ErrPreconditionFailed
+		}
+		if pre.IfMatch != "*" && !etagListContains(pre.IfMatch, existing.ETag()) {
+			return ErrPreconditionFailed
+		}
+	}
+	return nil
+}
+
+// etagListContains checks a comma-separated If-Match list; weak tags never
+// match because If-Match uses strong comparison
+func etagListContains(list, etag string) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		if strings.TrimSpace(candidate) == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// lock serializes writers of one resource across replicas using an atomic
+// counter in the shared store
+func (m *Manager) lock(ctx context.Context, kind, name string) (func(), error) {
+	key := lockKeyPrefix + kind + ":" + name
+	n, _, err := m.store.Incr(ctx, key, lockTTL)
+	if err != nil {
+		return nil, err
+	}
+	if n != 1 {
+		return nil, ErrConflict
+	}
+	return func() {
+		if err := m.store.Delete(context.Background(), key); err != nil {
+			m.logger.Warn("Failed to release admin resource lock", "key", key, "error", err)
+		}
+	}, nil
+}
+
+func (m *Manager) load(ctx context.Context, kind, name string) (*Resource, error) {
+	data, err := m.store.Get(ctx, resourceKey(kind, name))
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var res Resource
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, fmt.Errorf("corrupt %s %s: %w", kind, name, err)
+	}
+	return &res, nil
+}
+
+func (m *Manager) save(ctx context.Context, res *Resource) error {
+	data, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	return m.store.Set(ctx, resourceKey(res.Kind, res.Name), data, 0)
+}
+
+func (m *Manager) record(kind, result string) {
+	if m.metrics != nil {
+		m.metrics.IncrementCounter("admin_resource_writes_total", map[string]string{"kind": kind, "result": result})
+	}
+}
+
+func resourceKey(kind, name string) string {
+	return keyPrefix + kind + ":" + name
+}
+
+// canonicalJSON normalizes whitespace and object key order so semantically
+// equal specs compare (and hash) equal
+func canonicalJSON(raw json.RawMessage) (json.RawMessage, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, errors.New("trailing data after JSON value")
+	}
+	if _, ok := v.(map[string]interface{}); !ok {
+		return nil, errors.New("spec must be a JSON object")
+	}
+	return json.Marshal(v)
+}
+
+// newID returns a random RFC 4122 version 4 UUID
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	h := hex.EncodeToString(b)
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:], nil
+}
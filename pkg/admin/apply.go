@@ -0,0 +1,334 @@
+package admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Change actions reported by Apply
+const (
+	ActionCreate    = "create"
+	ActionUpdate    = "update"
+	ActionDelete    = "delete"
+	ActionUnchanged = "unchanged"
+)
+
+// writeResults maps actions to the result label of admin_resource_writes_total
+var writeResults = map[string]string{
+	ActionCreate: "created",
+	ActionUpdate: "updated",
+	ActionDelete: "deleted",
+}
+
+// ErrApplyFailed is returned when a change could not be applied; changes
+// made before the failure have been rolled back
+var ErrApplyFailed = errors.New("apply failed")
+
+// BundleResource is one desired resource in a bundle
+type BundleResource struct {
+	Kind string          `json:"kind"`
+	Name string          `json:"name"`
+	Spec json.RawMessage `json:"spec"`
+}
+
+// Bundle is the desired state of a set of resources
+type Bundle struct {
+	Resources []BundleResource `json:"resources"`
+}
+
+// ApplyOptions controls Apply
+type ApplyOptions struct {
+	// DryRun computes the diff without changing anything
+	DryRun bool
+	// Prune deletes existing resources missing from the bundle, limited to
+	// the kinds the bundle contains so a partial bundle cannot wipe others
+	Prune bool
+}
+
+// Change is one entry of an apply diff
+type Change struct {
+	Action     string `json:"action"`
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	ID         string `json:"id,omitempty"`
+	Generation int64  `json:"generation,omitempty"`
+}
+
+// ApplyResult reports the diff and whether it was applied
+type ApplyResult struct {
+	DryRun  bool           `json:"dry_run"`
+	Changes []Change       `json:"changes"`
+	Summary map[string]int `json:"summary"`
+}
+
+// BundleError lists every problem found while validating a bundle
+type BundleError struct {
+	Problems []string
+}
+
+func (e *BundleError) Error() string {
+	return "invalid bundle: " + strings.Join(e.Problems, "; ")
+}
+
+// Unwrap lets errors.Is match ErrInvalidSpec
+func (e *BundleError) Unwrap() error {
+	return ErrInvalidSpec
+}
+
+// plannedChange is a change with the state needed to apply and undo it
+type plannedChange struct {
+	Change
+	kind     Kind
+	previous *Resource
+	desired  *Resource
+}
+
+// Apply makes the stored state match bundle. All resources are validated and
+// locked before anything changes; if a change fails, the changes already made
+// are reverted in reverse order.
+func (m *Manager) Apply(ctx context.Context, bundle Bundle, opts ApplyOptions) (*ApplyResult, error) {
+	desired, err := m.validateBundle(bundle)
+	if err != nil {
+		return nil, err
+	}
+
+	targets := make(map[string]bool, len(desired))
+	kinds := make(map[string]bool)
+	for key, res := range desired {
+		targets[key] = true
+		kinds[res.Kind] = true
+	}
+	if opts.Prune {
+		for kind := range kinds {
+			existing, err := m.List(ctx, kind)
+			if err != nil {
+				return nil, err
+			}
+			for _, res := range existing {
+				targets[res.Kind+"/"+res.Name] = true
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(targets))
+	for key := range targets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	if !opts.DryRun {
+		unlock, err := m.lockAll(ctx, keys)
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+	}
+
+	plan := make([]plannedChange, 0, len(keys))
+	for _, key := range keys {
+		kind, name, _ := strings.Cut(key, "/")
+		existing, err := m.load(ctx, kind, name)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+		if existing == nil && desired[key].Kind == "" {
+			// Pruned concurrently since it was listed
+			continue
+		}
+		change, err := m.planChange(m.kinds[kind], existing, desired[key], kind, name)
+		if err != nil {
+			return nil, err
+		}
+		plan = append(plan, change)
+	}
+
+	if !opts.DryRun {
+		if err := m.execute(ctx, plan); err != nil {
+			return nil, err
+		}
+	}
+
+	result := &ApplyResult{DryRun: opts.DryRun, Changes: make([]Change, 0, len(plan)), Summary: make(map[string]int)}
+	for _, change := range plan {
+		result.Changes = append(result.Changes, change.Change)
+		result.Summary[change.Action]++
+		if !opts.DryRun && change.Action != ActionUnchanged {
+			m.record(change.Kind, writeResults[change.Action])
+		}
+	}
+	if !opts.DryRun {
+		m.logger.Info("Admin bundle applied", "create", result.Summary[ActionCreate],
+			"update", result.Summary[ActionUpdate], "delete", result.Summary[ActionDelete])
+	}
+	return result, nil
+}
+
+// validateBundle canonicalizes every resource, collecting all problems
+func (m *Manager) validateBundle(bundle Bundle) (map[string]BundleResource, error) {
+	var problems []string
+	desired := make(map[string]BundleResource, len(bundle.Resources))
+	for i, res := range bundle.Resources {
+		key := res.Kind + "/" + res.Name
+		_, canonical, err := m.prepare(res.Kind, res.Name, res.Spec)
+		switch {
+		case err != nil:
+			problems = append(problems, fmt.Sprintf("resources[%d] %s: %v", i, key, err))
+		case desired[key].Kind != "":
+			problems = append(problems, fmt.Sprintf("resources[%d] %s: declared more than once", i, key))
+		default:
+			res.Spec = canonical
+			desired[key] = res
+		}
+	}
+	if len(problems) > 0 {
+		return nil, &BundleError{Problems: problems}
+	}
+	return desired, nil
+}
+
+func (m *Manager) planChange(k Kind, existing *Resource, want BundleResource, kind, name string) (plannedChange, error) {
+	change := plannedChange{Change: Change{Kind: kind, Name: name}, kind: k, previous: existing}
+	switch {
+	case want.Kind == "":
+		change.Action = ActionDelete
+		change.ID = existing.ID
+		return change, nil
+	case existing != nil && bytes.Equal(existing.Spec, want.Spec):
+		change.Action = ActionUnchanged
+		change.desired = existing
+	default:
+		desired, err := m.next(existing, kind, name, want.Spec)
+		if err != nil {
+			return change, err
+		}
+		change.desired = desired
+		change.Action = ActionUpdate
+		if existing == nil {
+			change.Action = ActionCreate
+		}
+	}
+	change.ID = change.desired.ID
+	change.Generation = change.desired.Generation
+	return change, nil
+}
+
+// execute applies the plan, reverting completed changes on failure
+func (m *Manager) execute(ctx context.Context, plan []plannedChange) error {
+	for i, change := range plan {
+		var err error
+		switch change.Action {
+		case ActionCreate, ActionUpdate:
+			err = m.write(ctx, change.kind, change.desired)
+		case ActionDelete:
+			err = m.remove(ctx, change.kind, change.Name)
+		}
+		if err == nil {
+			continue
+		}
+
+		m.logger.Error("Admin bundle apply failed; rolling back", "kind", change.Kind, "name", change.Name, "error", err)
+		for j := i - 1; j >= 0; j-- {
+			m.revert(ctx, plan[j])
+		}
+		return fmt.Errorf("%w: %s %s: %v", ErrApplyFailed, change.Kind, change.Name, err)
+	}
+	return nil
+}
+
+// revert restores the state a change replaced. Rollback failures are logged
+// because there is no further fallback.
+func (m *Manager) revert(ctx context.Context, change plannedChange) {
+	var err error
+	switch change.Action {
+	case ActionCreate:
+		err = m.remove(ctx, change.kind, change.Name)
+	case ActionUpdate, ActionDelete:
+		err = m.write(ctx, change.kind, change.previous)
+	}
+	if err != nil {
+		m.logger.Error("Failed to roll back admin resource", "kind", change.Kind, "name", change.Name, "error", err)
+	}
+}
+
+// lockAll takes the write lock of every resource, releasing them all if any
+// is held by another writer
+func (m *Manager) lockAll(ctx context.Context, keys []string) (func(), error) {
+	unlocks := make([]func(), 0, len(keys))
+	release := func() {
+		for _, unlock := range unlocks {
+			unlock()
+		}
+	}
+	for _, key := range keys {
+		kind, name, _ := strings.Cut(key, "/")
+		unlock, err := m.lock(ctx, kind, name)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		unlocks = append(unlocks, unlock)
+	}
+	return release, nil
+}
+
+// LoadBundle reads a bundle from a JSON file or from every *.json file in a
+// directory, in lexical order. Each file holds a bundle, a list of resources
+// or a single resource.
+func LoadBundle(path string) (Bundle, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return Bundle{}, err
+	}
+	files := []string{path}
+	if info.IsDir() {
+		if files, err = filepath.Glob(filepath.Join(path, "*.json")); err != nil {
+			return Bundle{}, err
+		}
+		sort.Strings(files)
+	}
+
+	var bundle Bundle
+	for _, file := range files {
+		resources, err := readBundleFile(file)
+		if err != nil {
+			return Bundle{}, err
+		}
+		bundle.Resources = append(bundle.Resources, resources...)
+	}
+	return bundle, nil
+}
+
+func readBundleFile(path string) ([]BundleResource, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimSpace(data)
+
+	if bytes.HasPrefix(data, []byte("[")) {
+		var resources []BundleResource
+		if err := json.Unmarshal(data, &resources); err != nil {
+			return nil, fmt.Errorf("invalid JSON in %s: %w", path, err)
+		}
+		return resources, nil
+	}
+
+	var doc struct {
+		Bundle
+		BundleResource
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid JSON in %s: %w", path, err)
+	}
+	if doc.Kind != "" {
+		return []BundleResource{doc.BundleResource}, nil
+	}
+	return doc.Resources, nil
+}
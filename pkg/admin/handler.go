@@ -0,0 +1,156 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lsendel/impl-zamaz/pkg/i18n"
+)
+
+// Request body limits
+const (
+	maxSpecSize   = 1 << 20
+	maxBundleSize = 16 << 20
+)
+
+// RegisterRoutes mounts POST /apply and GET, PUT and DELETE endpoints for
+// every kind under /<plural> and /<plural>/:name
+func (m *Manager) RegisterRoutes(r gin.IRoutes) {
+	r.POST("/apply", m.handleApply)
+	for _, kind := range m.Kinds() {
+		name := kind.Name
+		r.GET("/"+kind.Plural, func(c *gin.Context) { m.handleList(c, name) })
+		r.GET("/"+kind.Plural+"/:name", func(c *gin.Context) { m.handleGet(c, name) })
+		r.PUT("/"+kind.Plural+"/:name", func(c *gin.Context) { m.handlePut(c, name) })
+		r.DELETE("/"+kind.Plural+"/:name", func(c *gin.Context) { m.handleDelete(c, name) })
+	}
+}
+
+func (m *Manager) handleList(c *gin.Context, kind string) {
+	resources, err := m.List(c.Request.Context(), kind)
+	if err != nil {
+		m.writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"items": resources, "count": len(resources)})
+}
+
+func (m *Manager) handleGet(c *gin.Context, kind string) {
+	res, err := m.Get(c.Request.Context(), kind, c.Param("name"))
+	if err != nil {
+		m.writeError(c, err)
+		return
+	}
+	etag := res.ETag()
+	c.Header("ETag", etag)
+	if c.GetHeader("If-None-Match") == etag {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// handlePut answers 201 when the resource is created and 200 when it is
+// updated or already up to date
+func (m *Manager) handlePut(c *gin.Context, kind string) {
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxSpecSize+1))
+	if err != nil || len(body) > maxSpecSize {
+		m.writeError(c, ErrInvalidSpec)
+		return
+	}
+
+	res, created, err := m.Put(c.Request.Context(), kind, c.Param("name"), json.RawMessage(body), preconditions(c))
+	if err != nil {
+		m.writeError(c, err)
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+		c.Header("Location", c.Request.URL.Path)
+	}
+	c.Header("ETag", res.ETag())
+	c.JSON(status, res)
+}
+
+// handleDelete is idempotent: deleting a missing resource succeeds unless the
+// client made the request conditional
+func (m *Manager) handleDelete(c *gin.Context, kind string) {
+	pre := preconditions(c)
+	err := m.Delete(c.Request.Context(), kind, c.Param("name"), pre)
+	if errors.Is(err, ErrNotFound) && pre.IfMatch == "" {
+		err = nil
+	}
+	if err != nil {
+		m.writeError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// handleApply applies a bundle; ?dry_run=true only reports the diff and
+// ?prune=true deletes resources missing from the bundle
+func (m *Manager) handleApply(c *gin.Context) {
+	var bundle Bundle
+	if err := json.NewDecoder(io.LimitReader(c.Request.Body, maxBundleSize)).Decode(&bundle); err != nil {
+		m.writeError(c, fmt.Errorf("%w: %v", ErrInvalidSpec, err))
+		return
+	}
+
+	result, err := m.Apply(c.Request.Context(), bundle, ApplyOptions{
+		DryRun: c.Query("dry_run") == "true",
+		Prune:  c.Query("prune") == "true",
+	})
+	if err != nil {
+		m.writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+func preconditions(c *gin.Context) Preconditions {
+	return Preconditions{
+		IfMatch:     c.GetHeader("If-Match"),
+		IfNoneMatch: c.GetHeader("If-None-Match"),
+	}
+}
+
+func (m *Manager) writeError(c *gin.Context, err error) {
+	var status int
+	var code string
+	switch {
+	case errors.Is(err, ErrUnknownKind), errors.Is(err, ErrNotFound):
+		status, code = http.StatusNotFound, "RESOURCE_NOT_FOUND"
+	case errors.Is(err, ErrInvalidName):
+		status, code = http.StatusBadRequest, "INVALID_RESOURCE_NAME"
+	case errors.Is(err, ErrInvalidSpec):
+		status, code = http.StatusBadRequest, "INVALID_RESOURCE_SPEC"
+	case errors.Is(err, ErrPreconditionFailed):
+		status, code = http.StatusPreconditionFailed, "PRECONDITION_FAILED"
+	case errors.Is(err, ErrApplyFailed):
+		m.logger.Error("Admin bundle apply rolled back", "error", err)
+		status, code = http.StatusInternalServerError, "APPLY_FAILED"
+	case errors.Is(err, ErrConflict):
+		status, code = http.StatusConflict, "RESOURCE_CONFLICT"
+		c.Header("Retry-After", "1")
+	default:
+		m.logger.Error("Admin resource request failed", "path", c.Request.URL.Path, "error", err)
+		status, code = http.StatusInternalServerError, "INTERNAL_ERROR"
+	}
+
+	body := gin.H{"error": i18n.Message(c, code), "code": code}
+	var bundleErr *BundleError
+	switch {
+	case errors.As(err, &bundleErr):
+		body["details"] = bundleErr.Problems
+	case code == "INVALID_RESOURCE_SPEC", code == "APPLY_FAILED":
+		body["details"] = err.Error()
+	}
+	c.JSON(status, body)
+}
@@ -0,0 +1,362 @@
+package admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/lsendel/impl-zamaz/pkg/discovery"
+)
+
+// RoleSpec is the desired state of a role
+type RoleSpec struct {
+	Description string   `json:"description,omitempty"`
+	Permissions []string `json:"permissions"`
+}
+
+// PolicySpec is the desired state of an access policy
+type PolicySpec struct {
+	Description   string   `json:"description,omitempty"`
+	Effect        string   `json:"effect"`
+	Resources     []string `json:"resources"`
+	Actions       []string `json:"actions"`
+	Roles         []string `json:"roles,omitempty"`
+	MinTrustLevel int      `json:"min_trust_level,omitempty"`
+}
+
+// TenantSpec is the desired state of a tenant
+type TenantSpec struct {
+	DisplayName string   `json:"display_name"`
+	Domains     []string `json:"domains,omitempty"`
+}
+
+// ServiceSpec is the desired state of a service registration
+type ServiceSpec struct {
+	URL        string                   `json:"url"`
+	TrustLevel int                      `json:"trust_level_required,omitempty"`
+	Endpoints  []discovery.EndpointInfo `json:"endpoints,omitempty"`
+	Metadata   map[string]string        `json:"metadata,omitempty"`
+	Tags       []string                 `json:"tags,omitempty"`
+	// HealthCheck overrides how the service is checked
+	HealthCheck   *discovery.HealthCheckConfig `json:"health_check,omitempty"`
+	Instances     []discovery.Instance         `json:"instances,omitempty"`
+	LoadBalancing string                       `json:"load_balancing,omitempty"`
+	// OpenAPI fills in the endpoints from the service's OpenAPI document
+	OpenAPI *discovery.OpenAPIConfig `json:"openapi,omitempty"`
+}
+
+// WebhookSpec is the desired state of a trust level webhook
+type WebhookSpec struct {
+	URL string `json:"url"`
+	// Secret signs deliveries; it is returned to admins like the rest of
+	// the spec
+	Secret     string `json:"secret"`
+	Thresholds []int  `json:"thresholds"`
+	// Direction is "below", "above" or empty for both
+	Direction string `json:"direction,omitempty"`
+	// Events subscribes the webhook to device events as well, e.g.
+	// "device.blocked"
+	Events []string `json:"events,omitempty"`
+}
+
+// AccessPolicySpec is the desired state of the mapping from trust scores to
+// access levels
+type AccessPolicySpec struct {
+	Description string `json:"description,omitempty"`
+	// Levels lists each access level with the minimum score granting it,
+	// in increasing order
+	Levels []AccessLevelSpec `json:"levels"`
+}
+
+// AccessLevelSpec is one access level of an access policy
+type AccessLevelSpec struct {
+	Level    string `json:"level"`
+	MinScore int    `json:"min_score"`
+}
+
+// RateLimitPolicySpec is the desired state of a rate limit policy, applied
+// on top of the global limit to the requests matching every selector it
+// sets: users by ID, API keys by ID, any of roles and path prefixes
+type RateLimitPolicySpec struct {
+	Description string   `json:"description,omitempty"`
+	Users       []string `json:"users,omitempty"`
+	APIKeys     []string `json:"api_keys,omitempty"`
+	Roles       []string `json:"roles,omitempty"`
+	Routes      []string `json:"routes,omitempty"`
+	// Priority picks among matching policies, highest first; ties go to
+	// the most specific
+	Priority  int    `json:"priority,omitempty"`
+	Algorithm string `json:"algorithm,omitempty"`
+	Limit     int    `json:"limit"`
+	// Window is in seconds; 0 is a minute
+	Window int `json:"window,omitempty"`
+	Burst  int `json:"burst,omitempty"`
+}
+
+// NetworkRuleSpec is the desired state of a network rule, allowing or
+// denying client addresses on the routes under the path prefixes in Routes,
+// or on all routes without any
+type NetworkRuleSpec struct {
+	Description string `json:"description,omitempty"`
+	// Action is "allow" or "deny"
+	Action string `json:"action"`
+	// CIDRs are ranges such as 10.0.0.0/8, or single addresses
+	CIDRs  []string `json:"cidrs"`
+	Routes []string `json:"routes,omitempty"`
+}
+
+// KillSwitchSpec is the desired state of a kill switch, answering the
+// routes under the path prefixes in Routes, or every route but health and
+// administration without any, with 503 while it exists
+type KillSwitchSpec struct {
+	Description string   `json:"description,omitempty"`
+	Routes      []string `json:"routes,omitempty"`
+	// Message is returned to callers, e.g. where to follow the incident
+	Message string `json:"message,omitempty"`
+	// RetryAfter is in seconds
+	RetryAfter int `json:"retry_after,omitempty"`
+}
+
+// minWebhookSecret is the shortest accepted signing secret
+const minWebhookSecret = 16
+
+// RoleKind manages roles
+func RoleKind() Kind {
+	return Kind{Name: "role", Plural: "roles", Validate: func(spec json.RawMessage) error {
+		var role RoleSpec
+		if err := decodeStrict(spec, &role); err != nil {
+			return err
+		}
+		if len(role.Permissions) == 0 {
+			return errors.New("permissions must not be empty")
+		}
+		return nil
+	}}
+}
+
+// PolicyKind manages access policies
+func PolicyKind() Kind {
+	return Kind{Name: "policy", Plural: "policies", Validate: func(spec json.RawMessage) error {
+		var policy PolicySpec
+		if err := decodeStrict(spec, &policy); err != nil {
+			return err
+		}
+		switch {
+		case policy.Effect != "allow" && policy.Effect != "deny":
+			return errors.New(`effect must be "allow" or "deny"`)
+		case len(policy.Resources) == 0 || len(policy.Actions) == 0:
+			return errors.New("resources and actions must not be empty")
+		case policy.MinTrustLevel < 0 || policy.MinTrustLevel > 100:
+			return errors.New("min_trust_level must be between 0 and 100")
+		}
+		return nil
+	}}
+}
+
+// TenantKind manages tenants
+func TenantKind() Kind {
+	return Kind{Name: "tenant", Plural: "tenants", Validate: func(spec json.RawMessage) error {
+		var tenant TenantSpec
+		if err := decodeStrict(spec, &tenant); err != nil {
+			return err
+		}
+		if tenant.DisplayName == "" {
+			return errors.New("display_name is required")
+		}
+		return nil
+	}}
+}
+
+// ServiceKind manages service registrations, keeping the discovery registry
+// in sync with the declared services
+func ServiceKind(registry *discovery.ServiceRegistry) Kind {
+	return Kind{
+		Name:   "service",
+		Plural: "services",
+		Validate: func(spec json.RawMessage) error {
+			var service ServiceSpec
+			if err := decodeStrict(spec, &service); err != nil {
+				return err
+			}
+			u, err := url.Parse(service.URL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return errors.New("url must be an absolute http(s) URL")
+			}
+			if err := service.OpenAPI.Validate(); err != nil {
+				return err
+			}
+			return service.HealthCheck.Validate()
+		},
+		Apply: func(ctx context.Context, r *Resource) error {
+			var service ServiceSpec
+			if err := json.Unmarshal(r.Spec, &service); err != nil {
+				return err
+			}
+			return registry.RegisterService(&discovery.ServiceInfo{
+				Name:          r.Name,
+				URL:           service.URL,
+				Status:        "unknown",
+				TrustLevel:    service.TrustLevel,
+				Endpoints:     service.Endpoints,
+				Metadata:      service.Metadata,
+				Tags:          service.Tags,
+				HealthCheck:   service.HealthCheck,
+				Instances:     service.Instances,
+				LoadBalancing: service.LoadBalancing,
+				OpenAPI:       service.OpenAPI,
+			})
+		},
+		Remove: func(ctx context.Context, name string) error {
+			return registry.DeregisterService(name)
+		},
+	}
+}
+
+// WebhookKind manages webhooks notified when trust scores cross thresholds
+// and of device events
+func WebhookKind() Kind {
+	return Kind{Name: "webhook", Plural: "webhooks", Validate: func(spec json.RawMessage) error {
+		var webhook WebhookSpec
+		if err := decodeStrict(spec, &webhook); err != nil {
+			return err
+		}
+		u, err := url.Parse(webhook.URL)
+		switch {
+		case err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "":
+			return errors.New("url must be an absolute http(s) URL")
+		case len(webhook.Secret) < minWebhookSecret:
+			return fmt.Errorf("secret must be at least %d characters", minWebhookSecret)
+		case len(webhook.Thresholds) == 0 && len(webhook.Events) == 0:
+			return errors.New("thresholds or events must not be empty")
+		case webhook.Direction != "" && webhook.Direction != "below" && webhook.Direction != "above":
+			return errors.New(`direction must be "below" or "above"`)
+		}
+		for _, threshold := range webhook.Thresholds {
+			if threshold < 1 || threshold > 100 {
+				return errors.New("thresholds must be between 1 and 100")
+			}
+		}
+		for _, event := range webhook.Events {
+			if event != "device.quarantined" && event != "device.blocked" && event != "device.unknown" {
+				return errors.New(`events must be "device.quarantined", "device.blocked" or "device.unknown"`)
+			}
+		}
+		return nil
+	}}
+}
+
+// AccessPolicyKind manages access policies mapping trust scores to access
+// levels. The one named "default" is in force.
+func AccessPolicyKind() Kind {
+	return Kind{Name: "access-policy", Plural: "access-policies", Validate: func(spec json.RawMessage) error {
+		var policy AccessPolicySpec
+		if err := decodeStrict(spec, &policy); err != nil {
+			return err
+		}
+		if len(policy.Levels) == 0 {
+			return errors.New("levels must not be empty")
+		}
+		seen := make(map[string]bool, len(policy.Levels))
+		for i, level := range policy.Levels {
+			switch {
+			case level.Level == "" || level.Level == "none":
+				return errors.New(`levels must be named and not "none"`)
+			case seen[level.Level]:
+				return fmt.Errorf("level %q is listed twice", level.Level)
+			case level.MinScore < 0 || level.MinScore > 100:
+				return errors.New("min_score must be between 0 and 100")
+			case i > 0 && level.MinScore <= policy.Levels[i-1].MinScore:
+				return errors.New("levels must be in increasing order of min_score")
+			}
+			seen[level.Level] = true
+		}
+		return nil
+	}}
+}
+
+// RateLimitPolicyKind manages rate limit policies per user, API key, role
+// and route
+func RateLimitPolicyKind() Kind {
+	return Kind{Name: "rate-limit-policy", Plural: "rate-limit-policies", Validate: func(spec json.RawMessage) error {
+		var policy RateLimitPolicySpec
+		if err := decodeStrict(spec, &policy); err != nil {
+			return err
+		}
+		switch policy.Algorithm {
+		case "", "fixed-window", "token-bucket", "sliding-window-log", "leaky-bucket":
+		default:
+			return errors.New(`algorithm must be "fixed-window", "token-bucket", "sliding-window-log" or "leaky-bucket"`)
+		}
+		switch {
+		case policy.Limit <= 0:
+			return errors.New("limit must be positive")
+		case policy.Window < 0 || policy.Burst < 0:
+			return errors.New("window and burst must not be negative")
+		}
+		for _, route := range policy.Routes {
+			if !strings.HasPrefix(route, "/") {
+				return fmt.Errorf("route %q must start with /", route)
+			}
+		}
+		return nil
+	}}
+}
+
+// NetworkRuleKind manages the rules allowing and denying client addresses
+func NetworkRuleKind() Kind {
+	return Kind{Name: "network-rule", Plural: "network-rules", Validate: func(spec json.RawMessage) error {
+		var rule NetworkRuleSpec
+		if err := decodeStrict(spec, &rule); err != nil {
+			return err
+		}
+		switch {
+		case rule.Action != "allow" && rule.Action != "deny":
+			return errors.New(`action must be "allow" or "deny"`)
+		case len(rule.CIDRs) == 0:
+			return errors.New("cidrs must not be empty")
+		}
+		for _, cidr := range rule.CIDRs {
+			if _, _, err := net.ParseCIDR(cidr); err != nil && net.ParseIP(cidr) == nil {
+				return fmt.Errorf("%q is not a CIDR range or an address", cidr)
+			}
+		}
+		for _, route := range rule.Routes {
+			if !strings.HasPrefix(route, "/") {
+				return fmt.Errorf("route %q must start with /", route)
+			}
+		}
+		return nil
+	}}
+}
+
+// KillSwitchKind manages kill switches, turning off the whole service for
+// maintenance or some of its routes during an incident
+func KillSwitchKind() Kind {
+	return Kind{Name: "kill-switch", Plural: "kill-switches", Validate: func(spec json.RawMessage) error {
+		var kill KillSwitchSpec
+		if err := decodeStrict(spec, &kill); err != nil {
+			return err
+		}
+		if kill.RetryAfter < 0 {
+			return errors.New("retry_after must not be negative")
+		}
+		for _, route := range kill.Routes {
+			if !strings.HasPrefix(route, "/") {
+				return fmt.Errorf("route %q must start with /", route)
+			}
+		}
+		return nil
+	}}
+}
+
+// decodeStrict rejects unknown fields so typos in IaC configs fail loudly
+func decodeStrict(spec json.RawMessage, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(spec))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
@@ -0,0 +1,91 @@
+// Package attestation verifies the platform attestation tokens devices
+// submit when they register: Google Play Integrity tokens from Android
+// devices and Apple DeviceCheck tokens from iOS devices. A verified token
+// proves the device is genuine and unmodified, which the device trust factor
+// scores instead of what the device says about itself.
+package attestation
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/lsendel/impl-zamaz/pkg/device"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+)
+
+// Verifier checks one platform's attestation tokens. A token that is
+// rejected is a Verdict that is not Verified; errors mean the platform's
+// service could not be asked.
+type Verifier interface {
+	Verify(ctx context.Context, token, nonce string) (device.Verdict, error)
+}
+
+// Attestor is a device.Attestor that verifies each platform's devices with
+// its Verifier. Devices of platforms without one are left to a fallback
+// attestor.
+type Attestor struct {
+	verifiers  map[string]Verifier
+	challenges *Challenges
+	fallback   device.Attestor
+	logger     interfaces.Logger
+	metrics    interfaces.MetricsCollector
+}
+
+// NewAttestor creates an attestor with verifiers by platform, e.g.
+// "android", taking nonces from challenges; fallback may be nil to reject
+// other platforms, and metrics may be nil
+func NewAttestor(verifiers map[string]Verifier, challenges *Challenges, fallback device.Attestor, logger interfaces.Logger, metrics interfaces.MetricsCollector) *Attestor {
+	return &Attestor{verifiers: verifiers, challenges: challenges, fallback: fallback, logger: logger, metrics: metrics}
+}
+
+// Attest implements device.Attestor. Evidence must present the device's
+// fingerprint and, on platforms with a verifier, an attestation token with
+// the nonce from challenges it was requested with. The nonce is used up
+// whether or not the token verifies.
+func (a *Attestor) Attest(ctx context.Context, info *interfaces.DeviceInfo, evidence device.Evidence) (device.Verdict, error) {
+	verifier, ok := a.verifiers[info.Platform]
+	if !ok {
+		if a.fallback == nil {
+			return a.reject(info, "no attestation available for platform "+info.Platform), nil
+		}
+		return a.fallback.Attest(ctx, info, evidence)
+	}
+	if !device.MatchFingerprint(info, evidence) {
+		return a.reject(info, "fingerprint mismatch"), nil
+	}
+	if evidence.Attestation == "" {
+		return a.reject(info, "attestation token required"), nil
+	}
+	fresh, err := a.challenges.Consume(ctx, evidence.Nonce)
+	if err != nil {
+		a.logger.Error("Failed to consume attestation nonce", "platform", info.Platform, "device_id", info.ID, "error", err)
+		a.count("attestation_errors_total", info.Platform)
+		return device.Verdict{}, fmt.Errorf("%w: %v", device.ErrAttestationUnavailable, err)
+	}
+	if !fresh {
+		return a.reject(info, "attestation nonce is unknown, expired or already used"), nil
+	}
+	verdict, err := verifier.Verify(ctx, evidence.Attestation, evidence.Nonce)
+	if err != nil {
+		a.logger.Error("Device attestation failed", "platform", info.Platform, "device_id", info.ID, "error", err)
+		a.count("attestation_errors_total", info.Platform)
+		return device.Verdict{}, fmt.Errorf("%w: %v", device.ErrAttestationUnavailable, err)
+	}
+	if !verdict.Verified {
+		return a.reject(info, verdict.Reason), nil
+	}
+	a.count("attestation_verified_total", info.Platform)
+	return verdict, nil
+}
+
+func (a *Attestor) reject(info *interfaces.DeviceInfo, reason string) device.Verdict {
+	a.logger.Warn("Device attestation rejected", "platform", info.Platform, "device_id", info.ID, "reason", reason)
+	a.count("attestation_rejected_total", info.Platform)
+	return device.Verdict{Reason: reason}
+}
+
+func (a *Attestor) count(name, platform string) {
+	if a.metrics != nil {
+		a.metrics.IncrementCounter(name, map[string]string{"platform": platform})
+	}
+}
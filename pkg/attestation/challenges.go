@@ -0,0 +1,92 @@
+package attestation
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lsendel/impl-zamaz/pkg/i18n"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+// noncePrefix keys issued nonces in the shared store
+const noncePrefix = "attestation:nonce:"
+
+// maxNonceLength bounds the nonces accepted from devices
+const maxNonceLength = 64
+
+// Values of a nonce while it can be used, and once it has been
+var (
+	nonceIssued = []byte("issued")
+	nonceUsed   = []byte("used")
+)
+
+// Challenges issues the nonces devices bind their attestations to. Each is
+// random and can be used once within its TTL, so an attestation captured
+// from one device cannot be replayed for it or another. Nonces are kept in
+// the shared store, so any replica can take them.
+type Challenges struct {
+	store  store.Store
+	ttl    time.Duration
+	logger interfaces.Logger
+}
+
+// NewChallenges creates challenges on s; ttl defaults to five minutes
+func NewChallenges(s store.Store, ttl time.Duration, logger interfaces.Logger) *Challenges {
+	if ttl <= 0 {
+		ttl = 5 * time.Minute
+	}
+	return &Challenges{store: s, ttl: ttl, logger: logger}
+}
+
+// Issue returns a new base64url nonce
+func (c *Challenges) Issue(ctx context.Context) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(b)
+	if err := c.store.Set(ctx, noncePrefix+nonce, nonceIssued, c.ttl); err != nil {
+		return "", err
+	}
+	return nonce, nil
+}
+
+// Consume uses nonce up, reporting whether it had been issued and was
+// neither expired nor used. Concurrent requests on any replica consume a
+// nonce once.
+func (c *Challenges) Consume(ctx context.Context, nonce string) (bool, error) {
+	if nonce == "" || len(nonce) > maxNonceLength {
+		return false, nil
+	}
+	return c.store.CompareAndSwap(ctx, noncePrefix+nonce, nonceIssued, nonceUsed, c.ttl)
+}
+
+// RegisterRoutes mounts the challenge endpoint devices ask for a nonce
+// before requesting an attestation:
+//
+//	POST /attestation/challenges
+func (c *Challenges) RegisterRoutes(rg gin.IRoutes) {
+	rg.POST("/attestation/challenges", c.handleIssue)
+}
+
+func (c *Challenges) handleIssue(ctx *gin.Context) {
+	nonce, err := c.Issue(ctx.Request.Context())
+	if err != nil {
+		c.logger.Error("Failed to issue attestation nonce", "error", err)
+		ctx.JSON(http.StatusServiceUnavailable, gin.H{
+			"error": i18n.Message(ctx, "INTERNAL_ERROR"),
+			"code":  "INTERNAL_ERROR",
+		})
+		return
+	}
+	ctx.JSON(http.StatusCreated, gin.H{
+		"nonce":      nonce,
+		"expires_in": int(c.ttl.Seconds()),
+	})
+}
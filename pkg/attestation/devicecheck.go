@@ -0,0 +1,145 @@
+package attestation
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lsendel/impl-zamaz/pkg/auth"
+	"github.com/lsendel/impl-zamaz/pkg/device"
+)
+
+// DeviceCheck endpoints
+const (
+	DeviceCheckURL            = "https://api.devicecheck.apple.com/v1/validate_device_token"
+	DeviceCheckDevelopmentURL = "https://api.development.devicecheck.apple.com/v1/validate_device_token"
+)
+
+// DeviceCheckConfig configures Apple DeviceCheck verification
+type DeviceCheckConfig struct {
+	// TeamID and KeyID identify the DeviceCheck key in the Apple developer
+	// account
+	TeamID string
+	KeyID  string
+	// PrivateKey is the DeviceCheck key, see LoadDeviceCheckKey
+	PrivateKey *ecdsa.PrivateKey
+	// URL defaults to DeviceCheckURL; apps built for development use
+	// DeviceCheckDevelopmentURL
+	URL    string
+	Client *http.Client
+}
+
+// DeviceCheck verifies Apple DeviceCheck tokens with Apple's validation
+// API. DeviceCheck proves a token comes from a genuine Apple device running
+// the app; it carries no nonce.
+type DeviceCheck struct {
+	config DeviceCheckConfig
+	now    func() time.Time
+}
+
+// NewDeviceCheck creates a DeviceCheck verifier
+func NewDeviceCheck(cfg DeviceCheckConfig) (*DeviceCheck, error) {
+	if cfg.TeamID == "" || cfg.KeyID == "" || cfg.PrivateKey == nil {
+		return nil, errors.New("devicecheck needs a team ID, key ID and private key")
+	}
+	if cfg.URL == "" {
+		cfg.URL = DeviceCheckURL
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &DeviceCheck{config: cfg, now: time.Now}, nil
+}
+
+// LoadDeviceCheckKey reads the .p8 key downloaded from the Apple developer
+// account
+func LoadDeviceCheckKey(path string) (*ecdsa.PrivateKey, error) {
+	key, err := auth.LoadSigningKey(path)
+	if err != nil {
+		return nil, err
+	}
+	ecKey, ok := key.Private.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("devicecheck key in %s must be a P-256 key", path)
+	}
+	return ecKey, nil
+}
+
+// Verify implements Verifier; the nonce is not used
+func (d *DeviceCheck) Verify(ctx context.Context, token, _ string) (device.Verdict, error) {
+	jwt, err := d.authToken()
+	if err != nil {
+		return device.Verdict{}, err
+	}
+	transactionID := make([]byte, 16)
+	if _, err := rand.Read(transactionID); err != nil {
+		return device.Verdict{}, err
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"device_token":   token,
+		"transaction_id": hex.EncodeToString(transactionID),
+		"timestamp":      d.now().UnixMilli(),
+	})
+	if err != nil {
+		return device.Verdict{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return device.Verdict{}, err
+	}
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := d.config.Client.Do(req)
+	if err != nil {
+		return device.Verdict{}, fmt.Errorf("devicecheck request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return device.Verdict{Verified: true, Integrity: device.IntegrityDevice}, nil
+	case http.StatusBadRequest:
+		// Apple explains what is wrong with the token in plain text
+		reason := strings.TrimSpace(string(message))
+		if reason == "" {
+			reason = "invalid device token"
+		}
+		return device.Verdict{Reason: reason}, nil
+	default:
+		return device.Verdict{}, fmt.Errorf("devicecheck returned status %d", resp.StatusCode)
+	}
+}
+
+// authToken signs the ES256 JWT DeviceCheck authenticates requests with
+func (d *DeviceCheck) authToken() (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "ES256", "kid": d.config.KeyID})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{"iss": d.config.TeamID, "iat": d.now().Unix()})
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, d.config.PrivateKey, digest[:])
+	if err != nil {
+		return "", err
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
@@ -0,0 +1,281 @@
+package attestation
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lsendel/impl-zamaz/pkg/device"
+)
+
+// Play Integrity device recognition verdicts
+const (
+	meetsStrongIntegrity = "MEETS_STRONG_INTEGRITY"
+	meetsDeviceIntegrity = "MEETS_DEVICE_INTEGRITY"
+	meetsBasicIntegrity  = "MEETS_BASIC_INTEGRITY"
+)
+
+// PlayIntegrityConfig configures Play Integrity verification with the
+// response encryption keys downloaded from the Play Console, so tokens are
+// decrypted and verified locally without calling Google
+type PlayIntegrityConfig struct {
+	// PackageName is the Android app requesting the tokens
+	PackageName string
+	// DecryptionKey is the AES-256 key tokens are encrypted with
+	DecryptionKey []byte
+	// VerificationKey is the P-256 key tokens are signed with
+	VerificationKey *ecdsa.PublicKey
+	// CertificateDigests, when set, are the SHA-256 digests of the app
+	// signing certificates accepted, base64url encoded as in the verdict
+	CertificateDigests []string
+	// MaxAge is how old a token may be; defaults to 5m
+	MaxAge time.Duration
+}
+
+// PlayIntegrity verifies Google Play Integrity tokens
+type PlayIntegrity struct {
+	config PlayIntegrityConfig
+	now    func() time.Time
+}
+
+// NewPlayIntegrity creates a Play Integrity verifier
+func NewPlayIntegrity(cfg PlayIntegrityConfig) (*PlayIntegrity, error) {
+	if cfg.PackageName == "" {
+		return nil, errors.New("play integrity needs the app's package name")
+	}
+	if len(cfg.DecryptionKey) != 32 {
+		return nil, fmt.Errorf("play integrity decryption key must be 32 bytes, got %d", len(cfg.DecryptionKey))
+	}
+	if cfg.VerificationKey == nil {
+		return nil, errors.New("play integrity needs a verification key")
+	}
+	if cfg.MaxAge <= 0 {
+		cfg.MaxAge = 5 * time.Minute
+	}
+	return &PlayIntegrity{config: cfg, now: time.Now}, nil
+}
+
+// ParsePlayIntegrityKeys reads the base64 decryption and verification keys
+// as the Play Console shows them
+func ParsePlayIntegrityKeys(decryptionKey, verificationKey string) ([]byte, *ecdsa.PublicKey, error) {
+	aesKey, err := base64.StdEncoding.DecodeString(decryptionKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid play integrity decryption key: %w", err)
+	}
+	der, err := base64.StdEncoding.DecodeString(verificationKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid play integrity verification key: %w", err)
+	}
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid play integrity verification key: %w", err)
+	}
+	ecKey, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, nil, fmt.Errorf("play integrity verification key must be an EC key, got %T", pub)
+	}
+	return aesKey, ecKey, nil
+}
+
+// integrityVerdict is the payload of a Play Integrity token
+type integrityVerdict struct {
+	RequestDetails struct {
+		RequestPackageName string `json:"requestPackageName"`
+		Nonce              string `json:"nonce"`
+		TimestampMillis    string `json:"timestampMillis"`
+	} `json:"requestDetails"`
+	AppIntegrity struct {
+		AppRecognitionVerdict   string   `json:"appRecognitionVerdict"`
+		PackageName             string   `json:"packageName"`
+		CertificateSha256Digest []string `json:"certificateSha256Digest"`
+	} `json:"appIntegrity"`
+	DeviceIntegrity struct {
+		DeviceRecognitionVerdict []string `json:"deviceRecognitionVerdict"`
+	} `json:"deviceIntegrity"`
+}
+
+// Verify implements Verifier. The token must be for the app and nonce,
+// recent, from an app Google Play recognizes and from a device meeting at
+// least basic integrity.
+func (p *PlayIntegrity) Verify(_ context.Context, token, nonce string) (device.Verdict, error) {
+	payload, err := p.open(token)
+	if err != nil {
+		return device.Verdict{Reason: "invalid integrity token: " + err.Error()}, nil
+	}
+	var verdict integrityVerdict
+	if err := json.Unmarshal(payload, &verdict); err != nil {
+		return device.Verdict{Reason: "invalid integrity verdict"}, nil
+	}
+
+	request := verdict.RequestDetails
+	millis, err := strconv.ParseInt(request.TimestampMillis, 10, 64)
+	switch {
+	case request.RequestPackageName != p.config.PackageName:
+		return device.Verdict{Reason: "token requested by another app"}, nil
+	case subtle.ConstantTimeCompare([]byte(request.Nonce), []byte(nonce)) != 1:
+		return device.Verdict{Reason: "nonce mismatch"}, nil
+	case err != nil || p.now().Sub(time.UnixMilli(millis)) > p.config.MaxAge:
+		return device.Verdict{Reason: "token expired"}, nil
+	}
+
+	app := verdict.AppIntegrity
+	if app.AppRecognitionVerdict != "PLAY_RECOGNIZED" || app.PackageName != p.config.PackageName {
+		return device.Verdict{Reason: "app not recognized by Google Play"}, nil
+	}
+	if len(p.config.CertificateDigests) > 0 && !anyOf(app.CertificateSha256Digest, p.config.CertificateDigests) {
+		return device.Verdict{Reason: "app signed with an unknown certificate"}, nil
+	}
+
+	labels := verdict.DeviceIntegrity.DeviceRecognitionVerdict
+	switch {
+	case anyOf(labels, []string{meetsStrongIntegrity}):
+		return device.Verdict{Verified: true, Integrity: device.IntegrityStrong}, nil
+	case anyOf(labels, []string{meetsDeviceIntegrity}):
+		return device.Verdict{Verified: true, Integrity: device.IntegrityDevice}, nil
+	case anyOf(labels, []string{meetsBasicIntegrity}):
+		return device.Verdict{Verified: true, Integrity: device.IntegrityBasic}, nil
+	default:
+		return device.Verdict{Reason: "device fails integrity checks"}, nil
+	}
+}
+
+// open decrypts the token, a compact JWE with A256KW and A256GCM, and
+// verifies the ES256 JWS inside, returning its payload
+func (p *PlayIntegrity) open(token string) ([]byte, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 5 {
+		return nil, errors.New("not a compact JWE")
+	}
+	var header struct {
+		Algorithm  string `json:"alg"`
+		Encryption string `json:"enc"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if header.Algorithm != "A256KW" || header.Encryption != "A256GCM" {
+		return nil, fmt.Errorf("unsupported encryption %s/%s", header.Algorithm, header.Encryption)
+	}
+	segments := make([][]byte, 4)
+	for i, part := range parts[1:] {
+		b, err := base64.RawURLEncoding.DecodeString(part)
+		if err != nil {
+			return nil, errors.New("malformed JWE")
+		}
+		segments[i] = b
+	}
+	encryptedKey, iv, ciphertext, tag := segments[0], segments[1], segments[2], segments[3]
+
+	key, err := unwrapKey(p.config.DecryptionKey, encryptedKey)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != gcm.NonceSize() {
+		return nil, errors.New("malformed JWE")
+	}
+	jws, err := gcm.Open(nil, iv, append(ciphertext, tag...), []byte(parts[0]))
+	if err != nil {
+		return nil, errors.New("decryption failed")
+	}
+	return verifyES256(string(jws), p.config.VerificationKey)
+}
+
+// verifyES256 checks a compact JWS signed with key and returns its payload
+func verifyES256(jws string, key *ecdsa.PublicKey) ([]byte, error) {
+	parts := strings.Split(jws, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("not a compact JWS")
+	}
+	var header struct {
+		Algorithm string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if header.Algorithm != "ES256" {
+		return nil, fmt.Errorf("unsupported signature algorithm %q", header.Algorithm)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(signature) != 64 {
+		return nil, errors.New("malformed signature")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+	if !ecdsa.Verify(key, digest[:], r, s) {
+		return nil, errors.New("signature verification failed")
+	}
+	return base64.RawURLEncoding.DecodeString(parts[1])
+}
+
+// unwrapKey is the RFC 3394 AES key unwrap used by A256KW
+func unwrapKey(kek, wrapped []byte) ([]byte, error) {
+	if len(wrapped) < 24 || len(wrapped)%8 != 0 {
+		return nil, errors.New("malformed wrapped key")
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	n := len(wrapped)/8 - 1
+	a := binary.BigEndian.Uint64(wrapped[:8])
+	r := make([]byte, n*8)
+	copy(r, wrapped[8:])
+	b := make([]byte, 16)
+	for j := 5; j >= 0; j-- {
+		for i := n; i >= 1; i-- {
+			binary.BigEndian.PutUint64(b[:8], a^uint64(n*j+i))
+			copy(b[8:], r[(i-1)*8:i*8])
+			block.Decrypt(b, b)
+			a = binary.BigEndian.Uint64(b[:8])
+			copy(r[(i-1)*8:i*8], b[8:])
+		}
+	}
+	if a != 0xA6A6A6A6A6A6A6A6 {
+		return nil, errors.New("key unwrap failed")
+	}
+	return r, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return errors.New("malformed header")
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return errors.New("malformed header")
+	}
+	return nil
+}
+
+// anyOf reports whether values and wanted share an element
+func anyOf(values, wanted []string) bool {
+	for _, v := range values {
+		for _, w := range wanted {
+			if v == w {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,344 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+// Webhook headers
+const (
+	HeaderSignature = "X-Zamaz-Signature"
+	HeaderTenant    = "X-Zamaz-Audit-Tenant"
+)
+
+const leaseKeyPrefix = "audit:lease:"
+
+// Endpoint is a tenant's audit webhook
+type Endpoint struct {
+	Tenant string `json:"tenant"`
+	URL    string `json:"url"`
+	// Secret signs each body as HeaderSignature: sha256=<hex hmac>
+	Secret string `json:"secret"`
+}
+
+// Batch is the webhook request body. The endpoint acknowledges by answering
+// 2xx with {"ack_seq": N}, which may be lower than LastSeq to acknowledge part
+// of the batch; a 2xx without ack_seq acknowledges LastSeq. Anything else is
+// a failed delivery and the batch is retried.
+type Batch struct {
+	Tenant   string   `json:"tenant"`
+	FirstSeq int64    `json:"first_seq"`
+	LastSeq  int64    `json:"last_seq"`
+	Events   []*Event `json:"events"`
+}
+
+type ackResponse struct {
+	AckSeq *int64 `json:"ack_seq"`
+}
+
+// DispatcherConfig configures delivery
+type DispatcherConfig struct {
+	Endpoints    []Endpoint
+	BatchSize    int
+	PollInterval time.Duration
+	// MaxBackoff caps the retry delay after failed deliveries
+	MaxBackoff time.Duration
+	// GapTimeout is how long a missing sequence (a failed write or an event
+	// past retention) blocks delivery before it is skipped
+	GapTimeout time.Duration
+	HTTPClient *http.Client
+}
+
+// Dispatcher delivers each tenant's events to its endpoint in order. Only one
+// replica delivers a tenant at a time, coordinated by a lease in the store.
+type Dispatcher struct {
+	config  DispatcherConfig
+	log     *Log
+	store   store.Store
+	logger  interfaces.Logger
+	metrics interfaces.MetricsCollector
+
+	mu    sync.Mutex
+	state map[string]*tenantState
+}
+
+type tenantState struct {
+	failures int
+	nextTry  time.Time
+	gapSeq   int64
+	gapSince time.Time
+}
+
+// NewDispatcher creates a dispatcher; metrics may be nil
+func NewDispatcher(cfg DispatcherConfig, log *Log, s store.Store, logger interfaces.Logger, metrics interfaces.MetricsCollector) *Dispatcher {
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 100
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = time.Second
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = time.Minute
+	}
+	if cfg.GapTimeout <= 0 {
+		cfg.GapTimeout = 30 * time.Second
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &Dispatcher{
+		config:  cfg,
+		log:     log,
+		store:   s,
+		logger:  logger,
+		metrics: metrics,
+		state:   make(map[string]*tenantState),
+	}
+}
+
+// LoadEndpoints reads a JSON array of endpoints from path
+func LoadEndpoints(path string) ([]Endpoint, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var endpoints []Endpoint
+	if err := json.Unmarshal(data, &endpoints); err != nil {
+		return nil, fmt.Errorf("invalid JSON in %s: %w", path, err)
+	}
+	for _, endpoint := range endpoints {
+		if !validTenant.MatchString(endpoint.Tenant) || endpoint.URL == "" {
+			return nil, fmt.Errorf("audit endpoint for tenant %q needs a valid tenant and url", endpoint.Tenant)
+		}
+	}
+	return endpoints, nil
+}
+
+// Start delivers pending events every PollInterval until ctx is cancelled
+func (d *Dispatcher) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(d.config.PollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				d.DeliverAll(ctx)
+			}
+		}
+	}()
+}
+
+// DeliverAll runs one delivery round for every endpoint
+func (d *Dispatcher) DeliverAll(ctx context.Context) {
+	for _, endpoint := range d.config.Endpoints {
+		if err := d.Deliver(ctx, endpoint); err != nil {
+			d.logger.Warn("Audit delivery failed", "tenant", endpoint.Tenant, "error", err)
+		}
+	}
+}
+
+// Deliver sends the tenant's pending events until the endpoint is caught up,
+// fails or the lease is held elsewhere
+func (d *Dispatcher) Deliver(ctx context.Context, endpoint Endpoint) error {
+	st := d.tenant(endpoint.Tenant)
+	if time.Now().Before(st.nextTry) {
+		return nil
+	}
+
+	release, ok, err := d.acquireLease(ctx, endpoint.Tenant)
+	if err != nil || !ok {
+		return err
+	}
+	defer release()
+
+	for {
+		sent, err := d.deliverBatch(ctx, endpoint, st)
+		if err != nil {
+			d.backoff(st)
+			d.record(endpoint.Tenant, "error")
+			return err
+		}
+		st.failures = 0
+		if !sent {
+			return nil
+		}
+		d.record(endpoint.Tenant, "success")
+	}
+}
+
+// deliverBatch sends the next batch and reports whether there was one
+func (d *Dispatcher) deliverBatch(ctx context.Context, endpoint Endpoint, st *tenantState) (bool, error) {
+	cursor, err := d.log.Cursor(ctx, endpoint.Tenant)
+	if err != nil {
+		return false, err
+	}
+	events, err := d.log.Events(ctx, endpoint.Tenant, cursor, d.config.BatchSize)
+	if err != nil {
+		return false, err
+	}
+	if len(events) == 0 {
+		return d.skipGap(ctx, endpoint.Tenant, cursor, st)
+	}
+	st.gapSeq = 0
+
+	batch := Batch{
+		Tenant:   endpoint.Tenant,
+		FirstSeq: events[0].Seq,
+		LastSeq:  events[len(events)-1].Seq,
+		Events:   events,
+	}
+	ack, err := d.post(ctx, endpoint, batch)
+	if err != nil {
+		return false, err
+	}
+	if ack < batch.FirstSeq {
+		return false, fmt.Errorf("endpoint acknowledged %d, expected at least %d", ack, batch.FirstSeq)
+	}
+	if ack > batch.LastSeq {
+		ack = batch.LastSeq
+	}
+	if err := d.log.Ack(ctx, endpoint.Tenant, cursor, ack); err != nil {
+		if errors.Is(err, ErrCursorMoved) {
+			return true, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// skipGap advances past sequences that are missing for GapTimeout, either
+// because their write failed or because they outlived the retention while
+// the endpoint was down, so a gap cannot block the tenant forever
+func (d *Dispatcher) skipGap(ctx context.Context, tenant string, cursor int64, st *tenantState) (bool, error) {
+	head, err := d.log.Head(ctx, tenant)
+	if err != nil || head <= cursor {
+		return false, err
+	}
+
+	missing := cursor + 1
+	if st.gapSeq != missing {
+		st.gapSeq, st.gapSince = missing, time.Now()
+		return false, nil
+	}
+	if time.Since(st.gapSince) < d.config.GapTimeout {
+		return false, nil
+	}
+
+	// Resume at the oldest stored event after the gap
+	next, err := d.log.oldestAfter(ctx, tenant, cursor)
+	if err != nil {
+		return false, err
+	}
+	skipTo := head
+	if next > 0 {
+		skipTo = next - 1
+	}
+
+	d.logger.Error("Skipping missing audit events", "tenant", tenant, "from_seq", missing, "to_seq", skipTo)
+	if d.metrics != nil {
+		d.metrics.IncrementCounter("audit_gaps_skipped_total", map[string]string{"tenant": tenant})
+	}
+	st.gapSeq = 0
+	if err := d.log.Ack(ctx, tenant, cursor, skipTo); err != nil && !errors.Is(err, ErrCursorMoved) {
+		return false, err
+	}
+	return true, nil
+}
+
+func (d *Dispatcher) post(ctx context.Context, endpoint Endpoint, batch Batch) (int64, error) {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderTenant, endpoint.Tenant)
+	if endpoint.Secret != "" {
+		req.Header.Set(HeaderSignature, Sign([]byte(endpoint.Secret), body))
+	}
+
+	resp, err := d.config.HTTPClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return 0, fmt.Errorf("endpoint returned status %d", resp.StatusCode)
+	}
+
+	var ack ackResponse
+	if len(bytes.TrimSpace(respBody)) > 0 && json.Unmarshal(respBody, &ack) == nil && ack.AckSeq != nil {
+		return *ack.AckSeq, nil
+	}
+	return batch.LastSeq, nil
+}
+
+// Sign returns the HeaderSignature value for body
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// acquireLease makes this replica the tenant's only deliverer for one round
+func (d *Dispatcher) acquireLease(ctx context.Context, tenant string) (func(), bool, error) {
+	key := leaseKeyPrefix + tenant
+	n, _, err := d.store.Incr(ctx, key, d.config.PollInterval+d.config.HTTPClient.Timeout)
+	if err != nil {
+		return nil, false, err
+	}
+	if n != 1 {
+		return nil, false, nil
+	}
+	return func() {
+		if err := d.store.Delete(context.Background(), key); err != nil {
+			d.logger.Warn("Failed to release audit delivery lease", "tenant", tenant, "error", err)
+		}
+	}, true, nil
+}
+
+func (d *Dispatcher) tenant(name string) *tenantState {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	st, ok := d.state[name]
+	if !ok {
+		st = &tenantState{}
+		d.state[name] = st
+	}
+	return st
+}
+
+func (d *Dispatcher) backoff(st *tenantState) {
+	st.failures++
+	delay := d.config.PollInterval << uint(min(st.failures, 16))
+	if delay > d.config.MaxBackoff || delay <= 0 {
+		delay = d.config.MaxBackoff
+	}
+	st.nextTry = time.Now().Add(delay)
+}
+
+func (d *Dispatcher) record(tenant, result string) {
+	if d.metrics != nil {
+		d.metrics.IncrementCounter("audit_deliveries_total", map[string]string{"tenant": tenant, "result": result})
+	}
+}
@@ -0,0 +1,210 @@
+package audit
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lsendel/impl-zamaz/pkg/i18n"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+)
+
+// maxPageSize bounds GET /audit/:tenant/events
+const maxPageSize = 1000
+
+// RegisterRoutes mounts the audit endpoints:
+//
+//	GET  /audit/:tenant         head, cursor and lag
+//	GET  /audit/:tenant/events  pull events with ?after=<seq>&limit=<n>
+//	POST /audit/:tenant/replay  redeliver from {"from_seq": n}
+func (l *Log) RegisterRoutes(r gin.IRoutes) {
+	r.GET("/audit/:tenant", l.handleStatus)
+	r.GET("/audit/:tenant/events", l.handleEvents)
+	r.POST("/audit/:tenant/replay", l.handleReplay)
+}
+
+// Middleware records an admin.request event for every mutating request once
+// it completes. tenant picks the audit stream for the request.
+func (l *Log) Middleware(tenant func(*gin.Context) string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		if c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead || c.Request.Method == http.MethodOptions {
+			return
+		}
+		var actor string
+		if user, ok := c.Get("user"); ok {
+			if info, ok := user.(*interfaces.UserInfo); ok {
+				actor = info.ID
+			}
+		}
+		_, err := l.Record(c.Request.Context(), tenant(c), "admin.request", actor, map[string]interface{}{
+			"method": c.Request.Method,
+			"path":   c.Request.URL.Path,
+			"status": c.Writer.Status(),
+			"ip":     c.ClientIP(),
+		})
+		if err != nil {
+			l.logger.Error("Failed to record audit event", "path", c.Request.URL.Path, "error", err)
+		}
+	}
+}
+
+// SearchHandler serves GET /audit/search with these query parameters:
+//
+//	q           query terms, see ParseQuery
+//	tenant      audit stream; defaults to tenant(c)
+//	limit       page size, at most 1000
+//	before_seq  continue below the next_before_seq of the previous page
+//	format      json (default), csv or ndjson
+func (l *Log) SearchHandler(tenant func(*gin.Context) string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		query, err := ParseQuery(c.Query("q"), l.now())
+		if err != nil {
+			l.writeError(c, err)
+			return
+		}
+		before, err := strconv.ParseInt(c.DefaultQuery("before_seq", "0"), 10, 64)
+		if err != nil || before < 0 {
+			l.writeError(c, ErrInvalidSequence)
+			return
+		}
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+		if err != nil || limit < 1 || limit > maxPageSize {
+			l.writeError(c, ErrInvalidSequence)
+			return
+		}
+		t := c.DefaultQuery("tenant", tenant(c))
+
+		events, next, err := l.Search(c.Request.Context(), t, query, before, limit)
+		if err != nil {
+			l.writeError(c, err)
+			return
+		}
+		if next > 0 {
+			c.Header("X-Next-Before-Seq", strconv.FormatInt(next, 10))
+		}
+
+		switch format := c.DefaultQuery("format", "json"); format {
+		case "csv":
+			c.Header("Content-Type", "text/csv; charset=utf-8")
+			c.Header("Content-Disposition", `attachment; filename="audit-`+t+`.csv"`)
+			c.Status(http.StatusOK)
+			w := csv.NewWriter(c.Writer)
+			w.Write([]string{"seq", "time", "tenant", "action", "actor", "resource", "result", "data"})
+			for _, e := range events {
+				data, _ := json.Marshal(e.Data)
+				w.Write([]string{strconv.FormatInt(e.Seq, 10), e.Time.Format(time.RFC3339Nano), e.Tenant, e.Type, e.Actor, e.Resource(), e.Result(), string(data)})
+			}
+			w.Flush()
+		case "ndjson":
+			c.Header("Content-Type", "application/x-ndjson")
+			c.Header("Content-Disposition", `attachment; filename="audit-`+t+`.ndjson"`)
+			c.Status(http.StatusOK)
+			enc := json.NewEncoder(c.Writer)
+			for _, e := range events {
+				enc.Encode(e)
+			}
+		case "json":
+			c.JSON(http.StatusOK, gin.H{"tenant": t, "events": events, "count": len(events), "next_before_seq": next})
+		default:
+			l.writeError(c, ErrInvalidQuery)
+		}
+	}
+}
+
+func (l *Log) handleStatus(c *gin.Context) {
+	tenant := c.Param("tenant")
+	if !validTenant.MatchString(tenant) {
+		l.writeError(c, ErrInvalidTenant)
+		return
+	}
+	head, err := l.Head(c.Request.Context(), tenant)
+	if err != nil {
+		l.writeError(c, err)
+		return
+	}
+	cursor, err := l.Cursor(c.Request.Context(), tenant)
+	if err != nil {
+		l.writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"tenant":    tenant,
+		"head_seq":  head,
+		"acked_seq": cursor,
+		"lag":       head - cursor,
+	})
+}
+
+func (l *Log) handleEvents(c *gin.Context) {
+	tenant := c.Param("tenant")
+	if !validTenant.MatchString(tenant) {
+		l.writeError(c, ErrInvalidTenant)
+		return
+	}
+	after, err := strconv.ParseInt(c.DefaultQuery("after", "0"), 10, 64)
+	if err != nil || after < 0 {
+		l.writeError(c, ErrInvalidSequence)
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit < 1 || limit > maxPageSize {
+		l.writeError(c, ErrInvalidSequence)
+		return
+	}
+
+	events, err := l.Events(c.Request.Context(), tenant, after, limit)
+	if err != nil {
+		l.writeError(c, err)
+		return
+	}
+	next := after
+	if len(events) > 0 {
+		next = events[len(events)-1].Seq
+	}
+	c.JSON(http.StatusOK, gin.H{"tenant": tenant, "events": events, "next_after": next})
+}
+
+func (l *Log) handleReplay(c *gin.Context) {
+	var req struct {
+		FromSeq int64 `json:"from_seq" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": i18n.Message(c, "VALIDATION_ERROR"),
+			"code":  "VALIDATION_ERROR",
+		})
+		return
+	}
+	if err := l.Replay(c.Request.Context(), c.Param("tenant"), req.FromSeq); err != nil {
+		l.writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"tenant": c.Param("tenant"), "from_seq": req.FromSeq})
+}
+
+func (l *Log) writeError(c *gin.Context, err error) {
+	var status int
+	var code string
+	switch {
+	case errors.Is(err, ErrInvalidTenant), errors.Is(err, ErrInvalidSequence):
+		status, code = http.StatusBadRequest, "INVALID_AUDIT_SEQUENCE"
+		if errors.Is(err, ErrInvalidTenant) {
+			code = "INVALID_TENANT"
+		}
+	case errors.Is(err, ErrInvalidQuery):
+		status, code = http.StatusBadRequest, "INVALID_AUDIT_QUERY"
+	case errors.Is(err, ErrSequenceExpired):
+		status, code = http.StatusGone, "AUDIT_SEQUENCE_EXPIRED"
+	default:
+		l.logger.Error("Audit request failed", "path", c.Request.URL.Path, "error", err)
+		status, code = http.StatusInternalServerError, "INTERNAL_ERROR"
+	}
+	c.JSON(status, gin.H{"error": i18n.Message(c, code), "code": code})
+}
@@ -0,0 +1,249 @@
+// Package audit records security-relevant events in a per-tenant, strictly
+// ordered log and delivers them to SOC ingestion pipelines.
+//
+// Every event gets the next sequence number of its tenant. Webhook delivery
+// is at-least-once and in sequence order: a batch is retried until the
+// endpoint acknowledges it, and the tenant's cursor only advances to the
+// acknowledged sequence. Receivers deduplicate by sequence number. Replay
+// moves the cursor back so retained events are delivered again.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+// Errors returned by Log
+var (
+	ErrInvalidTenant = errors.New("invalid tenant")
+	// ErrSequenceExpired is returned when a replay starts before the oldest
+	// retained event
+	ErrSequenceExpired = errors.New("sequence no longer retained")
+	ErrInvalidSequence = errors.New("sequence out of range")
+	ErrCursorMoved     = errors.New("cursor moved since the batch was read")
+)
+
+// DefaultTenant receives events that are not attributed to a tenant
+const DefaultTenant = "default"
+
+const (
+	seqKeyPrefix    = "audit:seq:"
+	eventKeyPrefix  = "audit:event:"
+	cursorKeyPrefix = "audit:cursor:"
+)
+
+var validTenant = regexp.MustCompile(`^[a-z0-9]([a-z0-9._-]{0,61}[a-z0-9])?$`)
+
+// Event is one audit record
+type Event struct {
+	Seq    int64                  `json:"seq"`
+	Tenant string                 `json:"tenant"`
+	Type   string                 `json:"type"`
+	Actor  string                 `json:"actor,omitempty"`
+	Time   time.Time              `json:"time"`
+	Data   map[string]interface{} `json:"data,omitempty"`
+}
+
+// Log is the append-only audit log kept in the shared store
+type Log struct {
+	store     store.Store
+	retention time.Duration
+	logger    interfaces.Logger
+	metrics   interfaces.MetricsCollector
+	now       func() time.Time
+}
+
+// NewLog creates a log keeping events for retention; metrics may be nil
+func NewLog(s store.Store, retention time.Duration, logger interfaces.Logger, metrics interfaces.MetricsCollector) *Log {
+	if retention <= 0 {
+		retention = 7 * 24 * time.Hour
+	}
+	return &Log{store: s, retention: retention, logger: logger, metrics: metrics, now: time.Now}
+}
+
+// Record appends an event to the tenant's log and returns it with its
+// sequence number
+func (l *Log) Record(ctx context.Context, tenant, eventType, actor string, data map[string]interface{}) (*Event, error) {
+	if tenant == "" {
+		tenant = DefaultTenant
+	}
+	if !validTenant.MatchString(tenant) {
+		return nil, ErrInvalidTenant
+	}
+
+	seq, _, err := l.store.Incr(ctx, seqKeyPrefix+tenant, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to allocate audit sequence: %w", err)
+	}
+	event := &Event{Seq: seq, Tenant: tenant, Type: eventType, Actor: actor, Time: l.now().UTC(), Data: data}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.store.Set(ctx, eventKey(tenant, seq), payload, l.retention); err != nil {
+		// The sequence is burned; delivery skips the gap after a grace period
+		return nil, fmt.Errorf("failed to store audit event: %w", err)
+	}
+	if err := l.index(ctx, event); err != nil {
+		// The event is still delivered; it is only missing from searches
+		l.logger.Warn("Failed to index audit event", "tenant", tenant, "seq", seq, "error", err)
+	}
+
+	if l.metrics != nil {
+		l.metrics.IncrementCounter("audit_events_total", map[string]string{"type": eventType})
+	}
+	return event, nil
+}
+
+// Head returns the last sequence number allocated for tenant
+func (l *Log) Head(ctx context.Context, tenant string) (int64, error) {
+	return l.readInt(ctx, seqKeyPrefix+tenant)
+}
+
+// Cursor returns the last sequence number acknowledged by tenant's endpoint
+func (l *Log) Cursor(ctx context.Context, tenant string) (int64, error) {
+	return l.readInt(ctx, cursorKeyPrefix+tenant)
+}
+
+// Event returns one event; store.ErrNotFound means it was never written or
+// has expired
+func (l *Log) Event(ctx context.Context, tenant string, seq int64) (*Event, error) {
+	data, err := l.store.Get(ctx, eventKey(tenant, seq))
+	if err != nil {
+		return nil, err
+	}
+	var event Event
+	if err := json.Unmarshal(data, &event); err != nil {
+		return nil, fmt.Errorf("corrupt audit event %s/%d: %w", tenant, seq, err)
+	}
+	return &event, nil
+}
+
+// Events returns up to limit consecutive events after seq. It stops at the
+// first missing sequence so callers never skip over an event.
+func (l *Log) Events(ctx context.Context, tenant string, after int64, limit int) ([]*Event, error) {
+	head, err := l.Head(ctx, tenant)
+	if err != nil {
+		return nil, err
+	}
+	events := make([]*Event, 0)
+	for seq := after + 1; seq <= head && len(events) < limit; seq++ {
+		event, err := l.Event(ctx, tenant, seq)
+		if errors.Is(err, store.ErrNotFound) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// Ack advances tenant's cursor from the value the batch was read at to seq.
+// If the cursor moved meanwhile (a replay), the acknowledgment is dropped with
+// ErrCursorMoved so the replay is not undone.
+func (l *Log) Ack(ctx context.Context, tenant string, from, seq int64) error {
+	key := cursorKeyPrefix + tenant
+	old, err := l.store.Get(ctx, key)
+	if errors.Is(err, store.ErrNotFound) {
+		old, err = nil, nil
+	}
+	if err != nil {
+		return err
+	}
+	var cursor int64
+	if old != nil {
+		if cursor, err = strconv.ParseInt(string(old), 10, 64); err != nil {
+			return err
+		}
+	}
+	if cursor != from {
+		return ErrCursorMoved
+	}
+	if seq <= cursor {
+		return nil
+	}
+	// Swapped only from the value just read, so a concurrent Ack or Replay
+	// is never overwritten
+	swapped, err := l.store.CompareAndSwap(ctx, key, old, []byte(strconv.FormatInt(seq, 10)), 0)
+	if err != nil {
+		return err
+	}
+	if !swapped {
+		return ErrCursorMoved
+	}
+	return nil
+}
+
+// Replay moves tenant's cursor so delivery resumes at fromSeq
+func (l *Log) Replay(ctx context.Context, tenant string, fromSeq int64) error {
+	if !validTenant.MatchString(tenant) {
+		return ErrInvalidTenant
+	}
+	head, err := l.Head(ctx, tenant)
+	if err != nil {
+		return err
+	}
+	if fromSeq < 1 || fromSeq > head+1 {
+		return ErrInvalidSequence
+	}
+	if fromSeq <= head {
+		if _, err := l.Event(ctx, tenant, fromSeq); errors.Is(err, store.ErrNotFound) {
+			return ErrSequenceExpired
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if err := l.store.Set(ctx, cursorKeyPrefix+tenant, []byte(strconv.FormatInt(fromSeq-1, 10)), 0); err != nil {
+		return err
+	}
+	l.logger.Info("Audit replay requested", "tenant", tenant, "from_seq", fromSeq)
+	return nil
+}
+
+// oldestAfter returns the smallest stored sequence after seq, or 0
+func (l *Log) oldestAfter(ctx context.Context, tenant string, seq int64) (int64, error) {
+	prefix := eventKeyPrefix + tenant + ":"
+	keys, err := l.store.Keys(ctx, prefix)
+	if err != nil {
+		return 0, err
+	}
+	var oldest int64
+	for _, key := range keys {
+		n, err := strconv.ParseInt(strings.TrimPrefix(key, prefix), 10, 64)
+		if err != nil || n <= seq {
+			continue
+		}
+		if oldest == 0 || n < oldest {
+			oldest = n
+		}
+	}
+	return oldest, nil
+}
+
+func (l *Log) readInt(ctx context.Context, key string) (int64, error) {
+	data, err := l.store.Get(ctx, key)
+	if errors.Is(err, store.ErrNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(data), 10, 64)
+}
+
+// eventKey zero-pads the sequence so keys sort in sequence order
+func eventKey(tenant string, seq int64) string {
+	return fmt.Sprintf("%s%s:%020d", eventKeyPrefix, tenant, seq)
+}
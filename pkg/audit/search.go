@@ -0,0 +1,327 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+// ErrInvalidQuery is returned for a search query that does not parse
+var ErrInvalidQuery = errors.New("invalid audit query")
+
+// indexKeyPrefix holds one key per indexed field of every event, so searches
+// list matching sequences by key prefix instead of reading every event
+const indexKeyPrefix = "audit:idx:"
+
+// Indexed event fields, also the query field names
+const (
+	FieldActor    = "actor"
+	FieldAction   = "action"
+	FieldResource = "resource"
+	FieldResult   = "result"
+)
+
+// Event results derived from the HTTP status when an event has no result
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+)
+
+// Query selects audit events. Every set field must match; Resource may end
+// in * to match a prefix.
+type Query struct {
+	Actor    string
+	Action   string
+	Resource string
+	Result   string
+	Since    time.Time
+	Until    time.Time
+}
+
+// ParseQuery parses space-separated field:value terms:
+//
+//	actor:alice action:admin.request resource:/api/v1/admin/* result:failure
+//	since:24h until:2026-01-02T00:00:00Z
+//
+// Values containing spaces are double-quoted. since and until take an
+// RFC 3339 time or a duration before now.
+func ParseQuery(q string, now time.Time) (Query, error) {
+	var query Query
+	terms, err := splitTerms(q)
+	if err != nil {
+		return Query{}, err
+	}
+	seen := make(map[string]bool, len(terms))
+	for _, term := range terms {
+		field, value, ok := strings.Cut(term, ":")
+		if !ok || value == "" {
+			return Query{}, fmt.Errorf("%w: term %q is not field:value", ErrInvalidQuery, term)
+		}
+		if seen[field] {
+			return Query{}, fmt.Errorf("%w: %s is repeated", ErrInvalidQuery, field)
+		}
+		seen[field] = true
+
+		switch field {
+		case FieldActor:
+			query.Actor = value
+		case FieldAction:
+			query.Action = value
+		case FieldResource:
+			query.Resource = value
+		case FieldResult:
+			query.Result = value
+		case "since", "until":
+			t, err := parseQueryTime(value, now)
+			if err != nil {
+				return Query{}, fmt.Errorf("%w: %s: %v", ErrInvalidQuery, field, err)
+			}
+			if field == "since" {
+				query.Since = t
+			} else {
+				query.Until = t
+			}
+		default:
+			return Query{}, fmt.Errorf("%w: unknown field %q", ErrInvalidQuery, field)
+		}
+	}
+	if !query.Since.IsZero() && !query.Until.IsZero() && query.Until.Before(query.Since) {
+		return Query{}, fmt.Errorf("%w: until is before since", ErrInvalidQuery)
+	}
+	return query, nil
+}
+
+func splitTerms(q string) ([]string, error) {
+	var terms []string
+	var term strings.Builder
+	quoted := false
+	for _, r := range q {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case (r == ' ' || r == '\t') && !quoted:
+			if term.Len() > 0 {
+				terms = append(terms, term.String())
+				term.Reset()
+			}
+		default:
+			term.WriteRune(r)
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("%w: unterminated quote", ErrInvalidQuery)
+	}
+	if term.Len() > 0 {
+		terms = append(terms, term.String())
+	}
+	return terms, nil
+}
+
+func parseQueryTime(value string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// Resource is the resource the event acted on: data.resource, else data.path
+func (e *Event) Resource() string {
+	if r, ok := e.Data["resource"].(string); ok {
+		return r
+	}
+	path, _ := e.Data["path"].(string)
+	return path
+}
+
+// Result is data.result, else success or failure from data.status
+func (e *Event) Result() string {
+	if r, ok := e.Data["result"].(string); ok {
+		return r
+	}
+	var status float64
+	switch s := e.Data["status"].(type) {
+	case int:
+		status = float64(s)
+	case float64:
+		status = s
+	case json.Number:
+		status, _ = s.Float64()
+	default:
+		return ""
+	}
+	if status >= 400 {
+		return ResultFailure
+	}
+	return ResultSuccess
+}
+
+func (e *Event) field(name string) string {
+	switch name {
+	case FieldActor:
+		return e.Actor
+	case FieldAction:
+		return e.Type
+	case FieldResource:
+		return e.Resource()
+	case FieldResult:
+		return e.Result()
+	}
+	return ""
+}
+
+// Matches reports whether event satisfies q
+func (q Query) Matches(e *Event) bool {
+	for field, want := range q.terms() {
+		got := e.field(field)
+		if prefix, ok := strings.CutSuffix(want, "*"); ok && field == FieldResource {
+			if !strings.HasPrefix(got, prefix) {
+				return false
+			}
+		} else if got != want {
+			return false
+		}
+	}
+	return (q.Since.IsZero() || !e.Time.Before(q.Since)) && (q.Until.IsZero() || e.Time.Before(q.Until))
+}
+
+func (q Query) terms() map[string]string {
+	terms := make(map[string]string, 4)
+	for field, value := range map[string]string{FieldActor: q.Actor, FieldAction: q.Action, FieldResource: q.Resource, FieldResult: q.Result} {
+		if value != "" {
+			terms[field] = value
+		}
+	}
+	return terms
+}
+
+// index writes the index keys of event with the event's retention
+func (l *Log) index(ctx context.Context, event *Event) error {
+	for _, field := range []string{FieldActor, FieldAction, FieldResource, FieldResult} {
+		value := event.field(field)
+		if value == "" {
+			continue
+		}
+		key := fmt.Sprintf("%s%020d", indexPrefix(event.Tenant, field, value)+":", event.Seq)
+		if err := l.store.Set(ctx, key, nil, l.retention); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexPrefix escapes value so it cannot contain the ':' separator
+func indexPrefix(tenant, field, value string) string {
+	return indexKeyPrefix + tenant + ":" + field + ":" + url.QueryEscape(value)
+}
+
+// Search returns up to limit events of tenant matching q, newest first and
+// below beforeSeq when it is positive. next is the beforeSeq of the next
+// page, or 0 when there are no more events.
+func (l *Log) Search(ctx context.Context, tenant string, q Query, beforeSeq int64, limit int) (events []*Event, next int64, err error) {
+	if !validTenant.MatchString(tenant) {
+		return nil, 0, ErrInvalidTenant
+	}
+	seqs, indexed, err := l.candidates(ctx, tenant, q)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	events = make([]*Event, 0, limit)
+	visit := func(seq int64) (bool, error) {
+		event, err := l.Event(ctx, tenant, seq)
+		if errors.Is(err, store.ErrNotFound) {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		// Sequences follow time, so nothing older can match
+		if !q.Since.IsZero() && event.Time.Before(q.Since) {
+			return false, nil
+		}
+		if q.Matches(event) {
+			events = append(events, event)
+		}
+		return len(events) < limit, nil
+	}
+
+	if indexed {
+		for _, seq := range seqs {
+			if beforeSeq > 0 && seq >= beforeSeq {
+				continue
+			}
+			if more, err := visit(seq); err != nil || !more {
+				return events, nextSeq(events, limit), err
+			}
+		}
+		return events, 0, nil
+	}
+
+	// No indexed term: walk back from the head to the oldest retained event
+	head, err := l.Head(ctx, tenant)
+	if err != nil {
+		return nil, 0, err
+	}
+	oldest, err := l.oldestAfter(ctx, tenant, 0)
+	if err != nil || oldest == 0 {
+		return events, 0, err
+	}
+	start := head
+	if beforeSeq > 0 && beforeSeq-1 < start {
+		start = beforeSeq - 1
+	}
+	for seq := start; seq >= oldest; seq-- {
+		if more, err := visit(seq); err != nil || !more {
+			return events, nextSeq(events, limit), err
+		}
+	}
+	return events, 0, nil
+}
+
+func nextSeq(events []*Event, limit int) int64 {
+	if len(events) < limit {
+		return 0
+	}
+	return events[len(events)-1].Seq
+}
+
+// candidates returns the sequences, newest first, present in the index of
+// every indexed term of q; indexed is false when q has no indexed term
+func (l *Log) candidates(ctx context.Context, tenant string, q Query) (seqs []int64, indexed bool, err error) {
+	var matched map[int64]bool
+	for field, value := range q.terms() {
+		prefix := indexPrefix(tenant, field, value) + ":"
+		if p, ok := strings.CutSuffix(value, "*"); ok && field == FieldResource {
+			prefix = indexPrefix(tenant, field, p)
+		}
+		keys, err := l.store.Keys(ctx, prefix)
+		if err != nil {
+			return nil, false, err
+		}
+		found := make(map[int64]bool, len(keys))
+		for _, key := range keys {
+			sep := strings.LastIndexByte(key, ':')
+			if seq, err := strconv.ParseInt(key[sep+1:], 10, 64); err == nil && (matched == nil || matched[seq]) {
+				found[seq] = true
+			}
+		}
+		matched = found
+	}
+	if matched == nil {
+		return nil, false, nil
+	}
+	seqs = make([]int64, 0, len(matched))
+	for seq := range matched {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] > seqs[j] })
+	return seqs, true, nil
+}
@@ -0,0 +1,427 @@
+// Package apikeys manages long-lived API keys for machine clients. Keys are
+// created, listed, rotated and revoked through the admin API and presented
+// in the X-API-Key header as "zmz_<id>.<secret>".
+//
+// Only a SHA-256 hash of each secret is stored. The secret is 256 random bits,
+// so a fast hash is enough: there is nothing to brute force. Every key has its
+// own scopes and rate limit; both live with the key in the shared store, so
+// all replicas agree on them.
+package apikeys
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+// TokenPrefix starts every key, so leaked keys are easy to scan for
+const TokenPrefix = "zmz_"
+
+// keyPrefix namespaces key records in the shared store
+const keyPrefix = "apikeys:key:"
+
+// updateAttempts bounds optimistic retries when replicas update one key
+const updateAttempts = 5
+
+// Limits on key metadata
+const (
+	maxNameLength = 64
+	maxScopes     = 32
+)
+
+// scopePattern matches scopes such as "devices:read" or "policies:write"
+var scopePattern = regexp.MustCompile(`^[a-z][a-z0-9_-]*(:[a-z][a-z0-9_-]*)?$`)
+
+// Key errors
+var (
+	ErrNotFound   = errors.New("API key not found")
+	ErrInvalidKey = errors.New("API key is invalid")
+	ErrRevoked    = errors.New("API key has been revoked")
+	ErrExpired    = errors.New("API key has expired")
+	ErrContention = errors.New("API key is being modified concurrently")
+)
+
+// ValidationError reports an invalid key request
+type ValidationError struct {
+	Field  string
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", e.Field, e.Reason)
+}
+
+// Key is the stored record of an API key; the secret itself is never kept
+type Key struct {
+	ID     string   `json:"id"`
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// RateLimit is the number of requests per minute; zero uses the
+	// manager's default
+	RateLimit int        `json:"rate_limit"`
+	CreatedAt time.Time  `json:"created_at"`
+	CreatedBy string     `json:"created_by,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	RotatedAt *time.Time `json:"rotated_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	RevokedBy string     `json:"revoked_by,omitempty"`
+
+	Hash string `json:"hash"`
+	// PreviousHash stays valid until PreviousExpiresAt after a rotation with
+	// a grace period, so clients can switch over without downtime
+	PreviousHash      string     `json:"previous_hash,omitempty"`
+	PreviousExpiresAt *time.Time `json:"previous_expires_at,omitempty"`
+}
+
+// Public returns a copy of k without the secret hashes
+func (k Key) Public() Key {
+	k.Hash, k.PreviousHash = "", ""
+	return k
+}
+
+// HasScope reports whether k grants scope. A resource's write scope implies
+// its read scope.
+func (k *Key) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+		if resource, ok := strings.CutSuffix(scope, ":read"); ok && s == resource+":write" {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateRequest describes a new key
+type CreateRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	RateLimit int        `json:"rate_limit"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// Config configures a Manager
+type Config struct {
+	// DefaultRateLimit applies to keys without their own, in requests per
+	// minute
+	DefaultRateLimit int
+	// MaxRateLimit caps the limit a key may be given; zero means no cap
+	MaxRateLimit int
+	// MaxRotationGrace caps how long a rotated-out secret stays valid
+	MaxRotationGrace time.Duration
+}
+
+// Manager stores and authenticates API keys
+type Manager struct {
+	config  Config
+	store   store.Store
+	logger  interfaces.Logger
+	metrics interfaces.MetricsCollector
+	now     func() time.Time
+}
+
+// NewManager creates a manager on s; metrics may be nil
+func NewManager(cfg Config, s store.Store, logger interfaces.Logger, metrics interfaces.MetricsCollector) *Manager {
+	if cfg.DefaultRateLimit <= 0 {
+		cfg.DefaultRateLimit = 600
+	}
+	if cfg.MaxRotationGrace <= 0 {
+		cfg.MaxRotationGrace = 7 * 24 * time.Hour
+	}
+	return &Manager{config: cfg, store: s, logger: logger, metrics: metrics, now: time.Now}
+}
+
+// RateLimit returns the effective requests per minute of k
+func (m *Manager) RateLimit(k *Key) int {
+	if k.RateLimit > 0 {
+		return k.RateLimit
+	}
+	return m.config.DefaultRateLimit
+}
+
+// Create stores a new key and returns it with the token to hand to the
+// client; the token cannot be recovered later
+func (m *Manager) Create(ctx context.Context, req CreateRequest, actor string) (*Key, string, error) {
+	if err := m.validate(req); err != nil {
+		return nil, "", err
+	}
+	id, err := newKeyID()
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := newSecret()
+	if err != nil {
+		return nil, "", err
+	}
+	scopes := append([]string(nil), req.Scopes...)
+	sort.Strings(scopes)
+	key := &Key{
+		ID:        id,
+		Name:      req.Name,
+		Scopes:    scopes,
+		RateLimit: req.RateLimit,
+		CreatedAt: m.now().UTC(),
+		CreatedBy: actor,
+		ExpiresAt: req.ExpiresAt,
+		Hash:      hashSecret(secret),
+	}
+	data, err := json.Marshal(key)
+	if err != nil {
+		return nil, "", err
+	}
+	created, err := m.store.CompareAndSwap(ctx, keyPrefix+id, nil, data, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	if !created {
+		return nil, "", ErrContention
+	}
+	m.count("created")
+	return key, token(id, secret), nil
+}
+
+// Get returns the key with id
+func (m *Manager) Get(ctx context.Context, id string) (*Key, error) {
+	key, _, err := m.load(ctx, id)
+	return key, err
+}
+
+// List returns every key, revoked ones included, ordered by creation
+func (m *Manager) List(ctx context.Context) ([]*Key, error) {
+	names, err := m.store.Keys(ctx, keyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]*Key, 0, len(names))
+	for _, name := range names {
+		key, _, err := m.load(ctx, strings.TrimPrefix(name, keyPrefix))
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+		}
+		return keys[i].ID < keys[j].ID
+	})
+	return keys, nil
+}
+
+// Rotate replaces the secret of a key and returns the new token. With a
+// positive grace the old secret keeps working for that long.
+func (m *Manager) Rotate(ctx context.Context, id string, grace time.Duration) (*Key, string, error) {
+	if grace < 0 || grace > m.config.MaxRotationGrace {
+		return nil, "", &ValidationError{Field: "grace_period", Reason: fmt.Sprintf("must be between 0 and %s", m.config.MaxRotationGrace)}
+	}
+	secret, err := newSecret()
+	if err != nil {
+		return nil, "", err
+	}
+	key, err := m.update(ctx, id, func(k *Key) error {
+		if k.RevokedAt != nil {
+			return ErrRevoked
+		}
+		now := m.now().UTC()
+		k.PreviousHash, k.PreviousExpiresAt = "", nil
+		if grace > 0 {
+			until := now.Add(grace)
+			k.PreviousHash, k.PreviousExpiresAt = k.Hash, &until
+		}
+		k.Hash = hashSecret(secret)
+		k.RotatedAt = &now
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	m.count("rotated")
+	return key, token(id, secret), nil
+}
+
+// Revoke disables a key for good. The record is kept so the key still shows
+// up in listings and audits.
+func (m *Manager) Revoke(ctx context.Context, id, actor string) (*Key, error) {
+	key, err := m.update(ctx, id, func(k *Key) error {
+		if k.RevokedAt == nil {
+			now := m.now().UTC()
+			k.RevokedAt, k.RevokedBy = &now, actor
+		}
+		k.PreviousHash, k.PreviousExpiresAt = "", nil
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	m.count("revoked")
+	return key, nil
+}
+
+// Authenticate returns the key a token belongs to. Unknown, malformed and
+// wrong secrets are all ErrInvalidKey so callers cannot probe key IDs.
+func (m *Manager) Authenticate(ctx context.Context, raw string) (*Key, error) {
+	id, secret, ok := parseToken(raw)
+	if !ok {
+		return nil, ErrInvalidKey
+	}
+	key, _, err := m.load(ctx, id)
+	if errors.Is(err, ErrNotFound) {
+		return nil, ErrInvalidKey
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := m.now()
+	hash := hashSecret(secret)
+	valid := subtle.ConstantTimeCompare([]byte(hash), []byte(key.Hash)) == 1
+	if !valid && key.PreviousHash != "" && key.PreviousExpiresAt != nil && now.Before(*key.PreviousExpiresAt) {
+		valid = subtle.ConstantTimeCompare([]byte(hash), []byte(key.PreviousHash)) == 1
+	}
+	switch {
+	case !valid:
+		return nil, ErrInvalidKey
+	case key.RevokedAt != nil:
+		return nil, ErrRevoked
+	case key.ExpiresAt != nil && !now.Before(*key.ExpiresAt):
+		return nil, ErrExpired
+	}
+	return key, nil
+}
+
+// IsManagedToken reports whether raw has the format of a managed key, as
+// opposed to the key IDs of signed requests
+func IsManagedToken(raw string) bool {
+	return strings.HasPrefix(raw, TokenPrefix)
+}
+
+func (m *Manager) validate(req CreateRequest) error {
+	switch {
+	case strings.TrimSpace(req.Name) == "" || len(req.Name) > maxNameLength:
+		return &ValidationError{Field: "name", Reason: fmt.Sprintf("must be 1 to %d characters", maxNameLength)}
+	case len(req.Scopes) == 0 || len(req.Scopes) > maxScopes:
+		return &ValidationError{Field: "scopes", Reason: fmt.Sprintf("must list 1 to %d scopes", maxScopes)}
+	case req.RateLimit < 0:
+		return &ValidationError{Field: "rate_limit", Reason: "must not be negative"}
+	case m.config.MaxRateLimit > 0 && req.RateLimit > m.config.MaxRateLimit:
+		return &ValidationError{Field: "rate_limit", Reason: fmt.Sprintf("must be at most %d", m.config.MaxRateLimit)}
+	case req.ExpiresAt != nil && !req.ExpiresAt.After(m.now()):
+		return &ValidationError{Field: "expires_at", Reason: "must be in the future"}
+	}
+	for _, scope := range req.Scopes {
+		if !scopePattern.MatchString(scope) {
+			return &ValidationError{Field: "scopes", Reason: fmt.Sprintf("%q is not a valid scope", scope)}
+		}
+	}
+	return nil
+}
+
+// load returns the key with id and its raw value for CompareAndSwap
+func (m *Manager) load(ctx context.Context, id string) (*Key, []byte, error) {
+	if !validKeyID(id) {
+		return nil, nil, ErrNotFound
+	}
+	data, err := m.store.Get(ctx, keyPrefix+id)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var key Key
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, nil, fmt.Errorf("corrupt API key %s: %w", id, err)
+	}
+	return &key, data, nil
+}
+
+// update applies fn to a key with compare-and-swap retries
+func (m *Manager) update(ctx context.Context, id string, fn func(*Key) error) (*Key, error) {
+	for attempt := 0; attempt < updateAttempts; attempt++ {
+		key, old, err := m.load(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if err := fn(key); err != nil {
+			return nil, err
+		}
+		data, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		swapped, err := m.store.CompareAndSwap(ctx, keyPrefix+id, old, data, 0)
+		if err != nil {
+			return nil, err
+		}
+		if swapped {
+			return key, nil
+		}
+	}
+	return nil, ErrContention
+}
+
+func (m *Manager) count(event string) {
+	if m.metrics != nil {
+		m.metrics.IncrementCounter("api_key_events_total", map[string]string{"event": event})
+	}
+}
+
+func token(id, secret string) string {
+	return TokenPrefix + id + "." + secret
+}
+
+func parseToken(raw string) (id, secret string, ok bool) {
+	rest, ok := strings.CutPrefix(raw, TokenPrefix)
+	if !ok {
+		return "", "", false
+	}
+	id, secret, ok = strings.Cut(rest, ".")
+	return id, secret, ok && validKeyID(id) && secret != ""
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func newKeyID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func validKeyID(id string) bool {
+	if len(id) != 16 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+func newSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
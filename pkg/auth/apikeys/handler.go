@@ -0,0 +1,247 @@
+package apikeys
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lsendel/impl-zamaz/pkg/i18n"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/middleware"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+// ContextKey holds the authenticated *Key in the Gin context
+const ContextKey = "api_key"
+
+// Middleware authenticates requests whose X-API-Key header carries a managed
+// key, or whose Authorization header carries one as a Bearer token as SCIM
+// clients send it, and enforces the key's rate limit with state in s.
+// Requests without one are passed through to Bearer and the other
+// authentication methods.
+func (m *Manager) Middleware(s store.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		raw := c.GetHeader(middleware.HeaderAPIKey)
+		if raw == "" {
+			raw, _ = strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		}
+		if !IsManagedToken(raw) {
+			c.Next()
+			return
+		}
+		key, err := m.Authenticate(c.Request.Context(), raw)
+		if err != nil {
+			if errors.Is(err, ErrInvalidKey) || errors.Is(err, ErrRevoked) || errors.Is(err, ErrExpired) {
+				m.logger.Warn("API key rejected", "error", err, "path", c.Request.URL.Path, "ip", c.ClientIP())
+				m.count("rejected")
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+					"error": i18n.Message(c, "API_KEY_INVALID"),
+					"code":  "API_KEY_INVALID",
+				})
+				return
+			}
+			m.logger.Error("API key lookup failed", "error", err)
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+				"error": i18n.Message(c, "INTERNAL_ERROR"),
+				"code":  "INTERNAL_ERROR",
+			})
+			return
+		}
+
+		limiter, err := middleware.NewLimiter(s, middleware.LimitDefinition{
+			Name:   "apikey:" + key.ID,
+			Limit:  m.RateLimit(key),
+			Window: time.Minute,
+		})
+		if err == nil {
+			var decision middleware.RateLimitDecision
+			if decision, err = limiter.Allow(c.Request.Context(), key.ID); err == nil {
+				middleware.SetRateLimitHeaders(c, decision)
+				if !decision.Allowed {
+					m.count("rate_limited")
+					c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+						"error":       i18n.Message(c, "RATE_LIMIT_EXCEEDED"),
+						"code":        "RATE_LIMIT_EXCEEDED",
+						"retry_after": int(decision.RetryAfter.Seconds()),
+					})
+					return
+				}
+			}
+		}
+		if err != nil {
+			// Fail open like the global limiter
+			m.logger.Warn("API key rate limiter unavailable, allowing request", "api_key", key.ID, "error", err)
+		}
+
+		c.Set(ContextKey, key)
+		c.Set("user", &interfaces.UserInfo{ID: "apikey:" + key.ID, Username: key.Name, Roles: []string{}})
+		c.Next()
+	}
+}
+
+// RequireScope limits API key callers to keys with resource:read for safe
+// methods and resource:write otherwise. Users authenticated any other way
+// are left to the role checks.
+func RequireScope(resource string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		value, ok := c.Get(ContextKey)
+		if !ok {
+			c.Next()
+			return
+		}
+		scope := resource + ":write"
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			scope = resource + ":read"
+		}
+		if !value.(*Key).HasScope(scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"error": i18n.Message(c, "INSUFFICIENT_SCOPE"),
+				"code":  "INSUFFICIENT_SCOPE",
+				"scope": scope,
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireKey is RequireScope for routes only API keys may call, such as
+// SCIM provisioning; other callers get 401
+func RequireKey(resource string) gin.HandlerFunc {
+	scope := RequireScope(resource)
+	return func(c *gin.Context) {
+		if _, ok := c.Get(ContextKey); !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error": i18n.Message(c, "API_KEY_INVALID"),
+				"code":  "API_KEY_INVALID",
+			})
+			return
+		}
+		scope(c)
+	}
+}
+
+// RegisterRoutes mounts key management:
+//
+//	POST   /apikeys              {"name", "scopes", "rate_limit", "expires_at"}
+//	GET    /apikeys
+//	GET    /apikeys/:id
+//	POST   /apikeys/:id/rotate   {"grace_period": "24h"}
+//	DELETE /apikeys/:id
+//
+// Create and rotate are the only responses that include the key itself.
+func (m *Manager) RegisterRoutes(r gin.IRoutes) {
+	r.POST("/apikeys", m.handleCreate)
+	r.GET("/apikeys", m.handleList)
+	r.GET("/apikeys/:id", m.handleGet)
+	r.POST("/apikeys/:id/rotate", m.handleRotate)
+	r.DELETE("/apikeys/:id", m.handleRevoke)
+}
+
+func (m *Manager) handleCreate(c *gin.Context) {
+	var req CreateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		writeError(c, m, &ValidationError{Field: "body", Reason: "must be a JSON key request"})
+		return
+	}
+	key, token, err := m.Create(c.Request.Context(), req, actor(c))
+	if err != nil {
+		writeError(c, m, err)
+		return
+	}
+	m.logger.Info("API key created", "api_key", key.ID, "name", key.Name, "scopes", key.Scopes, "actor", actor(c))
+	c.JSON(http.StatusCreated, gin.H{"key": key.Public(), "api_key": token})
+}
+
+func (m *Manager) handleList(c *gin.Context) {
+	keys, err := m.List(c.Request.Context())
+	if err != nil {
+		writeError(c, m, err)
+		return
+	}
+	public := make([]Key, 0, len(keys))
+	for _, k := range keys {
+		public = append(public, k.Public())
+	}
+	c.JSON(http.StatusOK, gin.H{"keys": public, "count": len(public)})
+}
+
+func (m *Manager) handleGet(c *gin.Context) {
+	key, err := m.Get(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		writeError(c, m, err)
+		return
+	}
+	c.JSON(http.StatusOK, key.Public())
+}
+
+func (m *Manager) handleRotate(c *gin.Context) {
+	var req struct {
+		GracePeriod string `json:"grace_period"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			writeError(c, m, &ValidationError{Field: "body", Reason: "must be a JSON rotate request"})
+			return
+		}
+	}
+	var grace time.Duration
+	if req.GracePeriod != "" {
+		var err error
+		if grace, err = time.ParseDuration(req.GracePeriod); err != nil {
+			writeError(c, m, &ValidationError{Field: "grace_period", Reason: "must be a duration such as 24h"})
+			return
+		}
+	}
+	key, token, err := m.Rotate(c.Request.Context(), c.Param("id"), grace)
+	if err != nil {
+		writeError(c, m, err)
+		return
+	}
+	m.logger.Info("API key rotated", "api_key", key.ID, "grace_period", grace, "actor", actor(c))
+	c.JSON(http.StatusOK, gin.H{"key": key.Public(), "api_key": token})
+}
+
+func (m *Manager) handleRevoke(c *gin.Context) {
+	key, err := m.Revoke(c.Request.Context(), c.Param("id"), actor(c))
+	if err != nil {
+		writeError(c, m, err)
+		return
+	}
+	m.logger.Warn("API key revoked", "api_key", key.ID, "actor", actor(c))
+	c.JSON(http.StatusOK, key.Public())
+}
+
+func writeError(c *gin.Context, m *Manager, err error) {
+	var validation *ValidationError
+	switch {
+	case errors.As(err, &validation):
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   i18n.Message(c, "VALIDATION_ERROR"),
+			"code":    "VALIDATION_ERROR",
+			"details": validation.Error(),
+		})
+	case errors.Is(err, ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": i18n.Message(c, "RESOURCE_NOT_FOUND"), "code": "RESOURCE_NOT_FOUND"})
+	case errors.Is(err, ErrRevoked):
+		c.JSON(http.StatusConflict, gin.H{"error": i18n.Message(c, "API_KEY_INVALID"), "code": "API_KEY_INVALID"})
+	case errors.Is(err, ErrContention):
+		c.JSON(http.StatusConflict, gin.H{"error": i18n.Message(c, "RESOURCE_CONFLICT"), "code": "RESOURCE_CONFLICT"})
+	default:
+		m.logger.Error("API key operation failed", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": i18n.Message(c, "INTERNAL_ERROR"), "code": "INTERNAL_ERROR"})
+	}
+}
+
+func actor(c *gin.Context) string {
+	if user, ok := c.Get("user"); ok {
+		if info, ok := user.(*interfaces.UserInfo); ok {
+			return info.ID
+		}
+	}
+	return ""
+}
@@ -0,0 +1,416 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+)
+
+// Token verification errors
+var (
+	ErrTokenSignature = errors.New("token signature is invalid")
+	ErrTokenExpired   = errors.New("token has expired")
+	ErrTokenIssuer    = errors.New("token issuer does not match")
+	ErrTokenAudience  = errors.New("token audience does not match")
+)
+
+// JSONWebKey is the public half of a signing key in JWK form (RFC 7517)
+type JSONWebKey struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	// RSA keys
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// EC keys
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+	Y     string `json:"y,omitempty"`
+}
+
+// JSONWebKeySet is the document served from the JWKS endpoint
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// Rotation controls how long keys are published around their active period
+type Rotation struct {
+	// PrePublish publishes a scheduled key this long before it becomes
+	// active, so relying parties have cached it by the time it signs
+	PrePublish time.Duration
+	// Overlap keeps a superseded key published and verifiable this long
+	// after rotation; it must exceed the longest token lifetime plus the
+	// JWKS cache time of relying parties
+	Overlap time.Duration
+}
+
+// DefaultRotation is used for zero Rotation fields
+var DefaultRotation = Rotation{PrePublish: time.Hour, Overlap: 24 * time.Hour}
+
+// Issuer signs and verifies JWTs for a single issuer URL with a rotating set
+// of RS256 and ES256 keys
+type Issuer struct {
+	issuer   string
+	rotation Rotation
+	now      func() time.Time
+
+	mu   sync.RWMutex
+	keys []ScheduledKey // ordered by ActiveFrom
+}
+
+// NewIssuer creates an issuer signing with a single RSA key
+func NewIssuer(issuerURL string, key *rsa.PrivateKey) *Issuer {
+	return &Issuer{
+		issuer:   issuerURL,
+		rotation: DefaultRotation,
+		keys:     []ScheduledKey{{Key: &SigningKey{ID: thumbprint(&key.PublicKey), Algorithm: AlgRS256, Private: key}}},
+		now:      time.Now,
+	}
+}
+
+// NewRotatingIssuer creates an issuer from a key schedule. At least one key
+// must already be active.
+func NewRotatingIssuer(issuerURL string, keys []ScheduledKey, rotation Rotation) (*Issuer, error) {
+	if rotation.PrePublish <= 0 {
+		rotation.PrePublish = DefaultRotation.PrePublish
+	}
+	if rotation.Overlap <= 0 {
+		rotation.Overlap = DefaultRotation.Overlap
+	}
+	i := &Issuer{issuer: issuerURL, rotation: rotation, now: time.Now}
+	for _, k := range keys {
+		i.AddKey(k.Key, k.ActiveFrom)
+	}
+	if i.active(i.now()) == nil {
+		return nil, errors.New("key schedule has no active signing key")
+	}
+	return i, nil
+}
+
+// AddKey schedules key to become active at activeFrom; a zero or past time
+// rotates to it immediately. Keys whose overlap has ended are dropped.
+func (i *Issuer) AddKey(key *SigningKey, activeFrom time.Time) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	keys := append(i.keys, ScheduledKey{Key: key, ActiveFrom: activeFrom})
+	sort.SliceStable(keys, func(a, b int) bool { return keys[a].ActiveFrom.Before(keys[b].ActiveFrom) })
+	now := i.now()
+	i.keys = keys[:0]
+	for n, k := range keys {
+		if n+1 < len(keys) && !now.Before(keys[n+1].ActiveFrom.Add(i.rotation.Overlap)) {
+			continue
+		}
+		i.keys = append(i.keys, k)
+	}
+}
+
+// Rotate makes key the active signing key now; the previous key stays
+// published for the overlap window
+func (i *Issuer) Rotate(key *SigningKey) {
+	i.AddKey(key, i.now())
+}
+
+// active returns the signing key at now
+func (i *Issuer) active(now time.Time) *SigningKey {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	var key *SigningKey
+	for _, k := range i.keys {
+		if now.Before(k.ActiveFrom) {
+			break
+		}
+		key = k.Key
+	}
+	return key
+}
+
+// published returns the keys relying parties should trust at now: the
+// active one, the next ones within PrePublish and the previous ones within
+// Overlap
+func (i *Issuer) published(now time.Time) []*SigningKey {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	var keys []*SigningKey
+	for n, k := range i.keys {
+		if now.Before(k.ActiveFrom.Add(-i.rotation.PrePublish)) {
+			break
+		}
+		if n+1 < len(i.keys) && !now.Before(i.keys[n+1].ActiveFrom.Add(i.rotation.Overlap)) {
+			continue
+		}
+		keys = append(keys, k.Key)
+	}
+	return keys
+}
+
+// GenerateKey creates a new 2048-bit RSA signing key
+func GenerateKey() (*rsa.PrivateKey, error) {
+	return rsa.GenerateKey(rand.Reader, 2048)
+}
+
+// LoadPrivateKey reads a PEM encoded PKCS#1 or PKCS#8 RSA private key
+func LoadPrivateKey(path string) (*rsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key in %s: %w", path, err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key in %s is not an RSA key", path)
+	}
+	return key, nil
+}
+
+// URL returns the issuer identifier placed in the iss claim
+func (i *Issuer) URL() string {
+	return i.issuer
+}
+
+// KeyID returns the kid of the active signing key
+func (i *Issuer) KeyID() string {
+	if key := i.active(i.now()); key != nil {
+		return key.ID
+	}
+	return ""
+}
+
+// JWKS returns the published public keys
+func (i *Issuer) JWKS() JSONWebKeySet {
+	set := JSONWebKeySet{Keys: []JSONWebKey{}}
+	for _, key := range i.published(i.now()) {
+		set.Keys = append(set.Keys, key.JWK())
+	}
+	return set
+}
+
+// Sign issues a JWT with the given claims using the active key. The iss and
+// iat claims are set when absent; ttl sets exp when positive.
+func (i *Issuer) Sign(claims map[string]interface{}, ttl time.Duration) (string, error) {
+	now := i.now()
+	key := i.active(now)
+	if key == nil {
+		return "", errors.New("no active signing key")
+	}
+	body := make(map[string]interface{}, len(claims)+3)
+	for k, v := range claims {
+		body[k] = v
+	}
+	if _, ok := body["iss"]; !ok {
+		body["iss"] = i.issuer
+	}
+	if _, ok := body["iat"]; !ok {
+		body["iat"] = now.Unix()
+	}
+	if ttl > 0 {
+		body["exp"] = now.Add(ttl).Unix()
+	}
+
+	header, err := json.Marshal(map[string]string{"alg": key.Algorithm, "typ": "JWT", "kid": key.ID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := rawURL.EncodeToString(header) + "." + rawURL.EncodeToString(payload)
+	signature, err := key.sign(signingInput)
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + rawURL.EncodeToString(signature), nil
+}
+
+// Verify checks the signature, issuer and expiry of a token issued by i with
+// any published key and returns its claims
+func (i *Issuer) Verify(raw string) (map[string]interface{}, error) {
+	token, err := ParseToken(raw)
+	if err != nil {
+		return nil, err
+	}
+	if token.Format != FormatJWT {
+		return nil, ErrTokenSignature
+	}
+	now := i.now()
+	key := i.active(now)
+	if kid, ok := token.Header["kid"]; ok {
+		key = nil
+		for _, k := range i.published(now) {
+			if k.ID == kid {
+				key = k
+			}
+		}
+	}
+	if key == nil || token.Header["alg"] != key.Algorithm {
+		return nil, ErrTokenSignature
+	}
+	if err := verifySignature(key.Algorithm, key.Private.Public(), token.SigningInput, token.Signature); err != nil {
+		return nil, ErrTokenSignature
+	}
+
+	if iss, _ := token.Claims["iss"].(string); iss != i.issuer {
+		return nil, ErrTokenIssuer
+	}
+	exp, ok := token.Claims["exp"].(json.Number)
+	if !ok {
+		return nil, ErrTokenExpired
+	}
+	if expiry, err := exp.Int64(); err != nil || now.Unix() >= expiry {
+		return nil, ErrTokenExpired
+	}
+	return token.Claims, nil
+}
+
+// Token uses carried in the token_use claim
+const (
+	TokenUseAccess    = "access"
+	TokenUseRefresh   = "refresh"
+	TokenUseMagicLink = "magic_link"
+)
+
+// APIAudience is the audience of the tokens IssueTokens signs for this API.
+// The issuer also signs tokens for OIDC clients, which carry the client's ID
+// as audience and must not be accepted as API bearer tokens.
+const APIAudience = "impl-zamaz-api"
+
+// ErrTokenUse is returned when a token is presented for the wrong purpose
+var ErrTokenUse = errors.New("token is not valid for this use")
+
+// registeredClaims are set per token and not copied when refreshing
+var registeredClaims = []string{"iss", "aud", "iat", "exp", "nbf", "jti", "token_use"}
+
+// TokenPair is an access token and the refresh token that renews it
+type TokenPair struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	TokenType    string `json:"token_type"`
+}
+
+// IssueTokens signs an access and a refresh token for APIAudience carrying
+// claims, each with its own jti so either can be revoked
+func (i *Issuer) IssueTokens(claims map[string]interface{}, accessTTL, refreshTTL time.Duration) (*TokenPair, error) {
+	sign := func(use string, ttl time.Duration) (string, error) {
+		body := make(map[string]interface{}, len(claims)+3)
+		for k, v := range claims {
+			body[k] = v
+		}
+		body["aud"] = APIAudience
+		body["token_use"] = use
+		body["jti"] = newTokenID()
+		return i.Sign(body, ttl)
+	}
+	access, err := sign(TokenUseAccess, accessTTL)
+	if err != nil {
+		return nil, err
+	}
+	refresh, err := sign(TokenUseRefresh, refreshTTL)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenPair{AccessToken: access, RefreshToken: refresh, ExpiresIn: int(accessTTL.Seconds()), TokenType: "Bearer"}, nil
+}
+
+// UserClaims returns the claims IssueTokens needs to describe user
+func UserClaims(user interfaces.UserInfo) map[string]interface{} {
+	return map[string]interface{}{
+		"sub":                user.ID,
+		"preferred_username": user.Username,
+		"email":              user.Email,
+		"roles":              user.Roles,
+	}
+}
+
+// ClaimsUser returns the user described by claims, the inverse of UserClaims
+func ClaimsUser(claims map[string]interface{}) *interfaces.UserInfo {
+	user := &interfaces.UserInfo{}
+	user.ID, _ = claims["sub"].(string)
+	user.Username, _ = claims["preferred_username"].(string)
+	user.Email, _ = claims["email"].(string)
+	switch roles := claims["roles"].(type) {
+	case []string:
+		user.Roles = roles
+	case []interface{}:
+		for _, role := range roles {
+			if name, ok := role.(string); ok {
+				user.Roles = append(user.Roles, name)
+			}
+		}
+	}
+	return user
+}
+
+// VerifyAccess verifies an access token issued by i for APIAudience and
+// returns its claims. Refresh, login link and other tokens are refused with
+// ErrTokenUse, and access tokens issued to OIDC clients with
+// ErrTokenAudience.
+func (i *Issuer) VerifyAccess(raw string) (map[string]interface{}, error) {
+	return i.verifyAPI(raw, TokenUseAccess)
+}
+
+// Refresh verifies a refresh token and issues a new pair with its claims
+func (i *Issuer) Refresh(refreshToken string, accessTTL, refreshTTL time.Duration) (*TokenPair, error) {
+	claims, err := i.verifyAPI(refreshToken, TokenUseRefresh)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range registeredClaims {
+		delete(claims, name)
+	}
+	return i.IssueTokens(claims, accessTTL, refreshTTL)
+}
+
+// verifyAPI verifies a token IssueTokens signed for use
+func (i *Issuer) verifyAPI(raw, use string) (map[string]interface{}, error) {
+	claims, err := i.Verify(raw)
+	if err != nil {
+		return nil, err
+	}
+	if claims["token_use"] != use {
+		return nil, ErrTokenUse
+	}
+	if _, ok := claims["client_id"]; ok || claims["aud"] != APIAudience {
+		return nil, ErrTokenAudience
+	}
+	return claims, nil
+}
+
+func newTokenID() string {
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	return rawURL.EncodeToString(id)
+}
+
+// thumbprint computes the RFC 7638 JWK thumbprint used as the key ID
+func thumbprint(pub *rsa.PublicKey) string {
+	canonical := fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`,
+		rawURL.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		rawURL.EncodeToString(pub.N.Bytes()))
+	sum := sha256.Sum256([]byte(canonical))
+	return rawURL.EncodeToString(sum[:])
+}
@@ -0,0 +1,380 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha512" // registers SHA-384 and SHA-512 for RS/PS/ES384 and 512
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+)
+
+// ErrKeyNotFound is returned when no published key matches a token's kid
+var ErrKeyNotFound = errors.New("signing key not found in JWKS")
+
+// maxJWKSSize bounds the JWKS document read from the network
+const maxJWKSSize = 1 << 20
+
+// JWKSConfig configures a JWKS client
+type JWKSConfig struct {
+	URL string
+	// RefreshInterval is how often keys are refreshed in the background
+	RefreshInterval time.Duration
+	// MinRefetchInterval rate limits refetches triggered by unknown kids, so
+	// tokens with random kids cannot be used to hammer the IdP
+	MinRefetchInterval time.Duration
+	HTTPClient         *http.Client
+}
+
+// JWKSClient fetches and caches an IdP's signing keys. Refreshes use ETag
+// revalidation, keep the last good key set on failure, and are triggered on
+// demand when a token references a kid that is not cached yet (key rollover).
+type JWKSClient struct {
+	config  JWKSConfig
+	logger  interfaces.Logger
+	metrics interfaces.MetricsCollector
+	now     func() time.Time
+
+	mu          sync.RWMutex
+	keys        map[string]crypto.PublicKey
+	etag        string
+	lastRefetch time.Time
+
+	// fetchMu serializes network fetches
+	fetchMu sync.Mutex
+}
+
+// NewJWKSClient creates a client; metrics may be nil. Keys are fetched lazily
+// or by Start.
+func NewJWKSClient(cfg JWKSConfig, logger interfaces.Logger, metrics interfaces.MetricsCollector) *JWKSClient {
+	if cfg.RefreshInterval <= 0 {
+		cfg.RefreshInterval = 15 * time.Minute
+	}
+	if cfg.MinRefetchInterval <= 0 {
+		cfg.MinRefetchInterval = 30 * time.Second
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &JWKSClient{
+		config:  cfg,
+		logger:  logger,
+		metrics: metrics,
+		now:     time.Now,
+		keys:    make(map[string]crypto.PublicKey),
+	}
+}
+
+// Start refreshes the keys immediately and then every RefreshInterval until
+// ctx is cancelled
+func (c *JWKSClient) Start(ctx context.Context) {
+	if err := c.Refresh(ctx); err != nil {
+		c.logger.Warn("Initial JWKS fetch failed", "url", c.config.URL, "error", err)
+	}
+
+	go func() {
+		ticker := time.NewTicker(c.config.RefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := c.Refresh(ctx); err != nil {
+					c.logger.Warn("JWKS refresh failed; keeping cached keys", "url", c.config.URL, "error", err)
+				}
+			}
+		}
+	}()
+}
+
+// Refresh fetches the key set, revalidating with If-None-Match
+func (c *JWKSClient) Refresh(ctx context.Context) error {
+	c.fetchMu.Lock()
+	defer c.fetchMu.Unlock()
+	return c.fetch(ctx)
+}
+
+func (c *JWKSClient) fetch(ctx context.Context) error {
+	start := c.now()
+	result := "error"
+	defer func() {
+		if c.metrics != nil {
+			c.metrics.IncrementCounter("jwks_fetch_total", map[string]string{"result": result})
+			c.metrics.ObserveHistogram("jwks_fetch_duration_seconds", c.now().Sub(start).Seconds(), nil)
+		}
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.config.URL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	c.mu.RLock()
+	if c.etag != "" {
+		req.Header.Set("If-None-Match", c.etag)
+	}
+	c.mu.RUnlock()
+
+	resp, err := c.config.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("JWKS request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		result = "not_modified"
+		return nil
+	case http.StatusOK:
+	default:
+		return fmt.Errorf("JWKS endpoint returned status %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxJWKSSize)).Decode(&set); err != nil {
+		return fmt.Errorf("invalid JWKS document: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, raw := range set.Keys {
+		kid, key, err := parseJWK(raw)
+		if err != nil {
+			c.logger.Debug("Skipping unusable JWK", "url", c.config.URL, "error", err)
+			continue
+		}
+		keys[kid] = key
+	}
+	if len(keys) == 0 {
+		return errors.New("JWKS document contains no usable signing keys")
+	}
+
+	c.mu.Lock()
+	c.keys = keys
+	c.etag = resp.Header.Get("ETag")
+	c.mu.Unlock()
+
+	result = "success"
+	if c.metrics != nil {
+		c.metrics.SetGauge("jwks_keys", float64(len(keys)), nil)
+	}
+	return nil
+}
+
+// Key returns the public key for kid, refetching the key set at most once per
+// MinRefetchInterval when kid is unknown
+func (c *JWKSClient) Key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	if key, ok := c.cached(kid); ok {
+		return key, nil
+	}
+
+	c.fetchMu.Lock()
+	defer c.fetchMu.Unlock()
+
+	// Another request may have fetched the key while we waited
+	if key, ok := c.cached(kid); ok {
+		return key, nil
+	}
+
+	c.mu.Lock()
+	if !c.lastRefetch.IsZero() && c.now().Sub(c.lastRefetch) < c.config.MinRefetchInterval {
+		c.mu.Unlock()
+		if c.metrics != nil {
+			c.metrics.IncrementCounter("jwks_refetch_throttled_total", nil)
+		}
+		return nil, ErrKeyNotFound
+	}
+	c.lastRefetch = c.now()
+	c.mu.Unlock()
+
+	if err := c.fetch(ctx); err != nil {
+		c.logger.Warn("JWKS refetch for unknown kid failed", "url", c.config.URL, "kid", kid, "error", err)
+	}
+	if key, ok := c.cached(kid); ok {
+		return key, nil
+	}
+	return nil, ErrKeyNotFound
+}
+
+// cached looks up kid; tokens without a kid match a single published key
+func (c *JWKSClient) cached(kid string) (crypto.PublicKey, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if kid == "" && len(c.keys) == 1 {
+		for _, key := range c.keys {
+			return key, true
+		}
+	}
+	key, ok := c.keys[kid]
+	return key, ok
+}
+
+// Verify checks the signature of a JWT against the published keys and returns
+// the parsed token. Callers must still validate iss, aud and expiry.
+func (c *JWKSClient) Verify(ctx context.Context, raw string) (*ParsedToken, error) {
+	token, err := ParseToken(raw)
+	if err != nil {
+		return nil, err
+	}
+	if token.Format != FormatJWT {
+		return nil, ErrTokenMalformed
+	}
+	kid, _ := token.Header["kid"].(string)
+	alg, _ := token.Header["alg"].(string)
+
+	key, err := c.Key(ctx, kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(alg, key, token.SigningInput, token.Signature); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// verifySignature supports the RS, PS and ES families; the algorithm must
+// match the key type so an RSA key can never verify an HMAC token
+func verifySignature(alg string, key crypto.PublicKey, signingInput string, signature []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "PS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "PS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "PS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return ErrTokenSignature
+	}
+	h := hash.New()
+	h.Write([]byte(signingInput))
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			if rsa.VerifyPKCS1v15(k, hash, digest, signature) == nil {
+				return nil
+			}
+		case "PS":
+			if rsa.VerifyPSS(k, hash, digest, signature, nil) == nil {
+				return nil
+			}
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if alg[:2] == "ES" && len(signature) == 2*size {
+			r := new(big.Int).SetBytes(signature[:size])
+			s := new(big.Int).SetBytes(signature[size:])
+			if ecdsa.Verify(k, digest, r, s) {
+				return nil
+			}
+		}
+	}
+	return ErrTokenSignature
+}
+
+// parseJWK decodes an RSA or EC signing key
+func parseJWK(raw json.RawMessage) (string, crypto.PublicKey, error) {
+	var jwk struct {
+		KeyType string `json:"kty"`
+		Use     string `json:"use"`
+		KeyID   string `json:"kid"`
+		N       string `json:"n"`
+		E       string `json:"e"`
+		Curve   string `json:"crv"`
+		X       string `json:"x"`
+		Y       string `json:"y"`
+	}
+	if err := json.Unmarshal(raw, &jwk); err != nil {
+		return "", nil, err
+	}
+	if jwk.Use != "" && jwk.Use != "sig" {
+		return "", nil, fmt.Errorf("key %q is not a signing key", jwk.KeyID)
+	}
+
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64URLLenient(s)
+		if err != nil || len(b) == 0 {
+			return nil, fmt.Errorf("key %q has an invalid parameter", jwk.KeyID)
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+
+	switch jwk.KeyType {
+	case "RSA":
+		n, err := decode(jwk.N)
+		if err != nil {
+			return "", nil, err
+		}
+		e, err := decode(jwk.E)
+		if err != nil {
+			return "", nil, err
+		}
+		if n.BitLen() < 2048 || !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return "", nil, fmt.Errorf("key %q is too weak", jwk.KeyID)
+		}
+		return jwk.KeyID, &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		var check ecdh.Curve
+		switch jwk.Curve {
+		case "P-256":
+			curve, check = elliptic.P256(), ecdh.P256()
+		case "P-384":
+			curve, check = elliptic.P384(), ecdh.P384()
+		case "P-521":
+			curve, check = elliptic.P521(), ecdh.P521()
+		default:
+			return "", nil, fmt.Errorf("key %q uses unsupported curve %q", jwk.KeyID, jwk.Curve)
+		}
+		x, err := decode(jwk.X)
+		if err != nil {
+			return "", nil, err
+		}
+		y, err := decode(jwk.Y)
+		if err != nil {
+			return "", nil, err
+		}
+		if !validECPoint(check, (curve.Params().BitSize+7)/8, x, y) {
+			return "", nil, fmt.Errorf("key %q is not on curve %s", jwk.KeyID, jwk.Curve)
+		}
+		return jwk.KeyID, &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return "", nil, fmt.Errorf("key %q has unsupported type %q", jwk.KeyID, jwk.KeyType)
+	}
+}
+
+// base64URLLenient accepts the padded form some IdPs publish in JWKS
+func base64URLLenient(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// validECPoint rejects points that are not on the curve
+func validECPoint(curve ecdh.Curve, size int, x, y *big.Int) bool {
+	if x.BitLen() > size*8 || y.BitLen() > size*8 {
+		return false
+	}
+	point := make([]byte, 1+2*size)
+	point[0] = 4
+	x.FillBytes(point[1 : 1+size])
+	y.FillBytes(point[1+size:])
+	_, err := curve.NewPublicKey(point)
+	return err == nil
+}
@@ -0,0 +1,190 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Signing algorithms supported by the issuer
+const (
+	AlgRS256 = "RS256"
+	AlgES256 = "ES256"
+)
+
+// SigningKey is a private key and the JWS algorithm it signs with
+type SigningKey struct {
+	ID        string
+	Algorithm string
+	Private   crypto.Signer
+}
+
+// NewSigningKey wraps an RSA key for RS256 or a P-256 key for ES256; the ID
+// is the RFC 7638 thumbprint of the public key
+func NewSigningKey(private crypto.Signer) (*SigningKey, error) {
+	switch k := private.(type) {
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("RSA signing keys need at least 2048 bits, got %d", k.N.BitLen())
+		}
+		return &SigningKey{ID: thumbprint(&k.PublicKey), Algorithm: AlgRS256, Private: k}, nil
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("EC signing keys must use P-256, got %s", k.Curve.Params().Name)
+		}
+		return &SigningKey{ID: ecThumbprint(&k.PublicKey), Algorithm: AlgES256, Private: k}, nil
+	default:
+		return nil, fmt.Errorf("unsupported signing key type %T", private)
+	}
+}
+
+// GenerateSigningKey creates a new key for alg
+func GenerateSigningKey(alg string) (*SigningKey, error) {
+	switch alg {
+	case AlgRS256:
+		key, err := GenerateKey()
+		if err != nil {
+			return nil, err
+		}
+		return NewSigningKey(key)
+	case AlgES256:
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return NewSigningKey(key)
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+}
+
+// LoadSigningKey reads a PEM encoded PKCS#1, PKCS#8 or SEC 1 private key;
+// RSA keys sign with RS256 and P-256 keys with ES256
+func LoadSigningKey(path string) (*SigningKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+	var key interface{}
+	if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+		if key, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+			if key, err = x509.ParsePKCS8PrivateKey(block.Bytes); err != nil {
+				return nil, fmt.Errorf("failed to parse private key in %s: %w", path, err)
+			}
+		}
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("private key in %s cannot sign", path)
+	}
+	sk, err := NewSigningKey(signer)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return sk, nil
+}
+
+// ScheduledKey is a signing key and when it becomes the active one
+type ScheduledKey struct {
+	Key        *SigningKey
+	ActiveFrom time.Time
+}
+
+// LoadKeySchedule reads a JSON array of keys and their activation times:
+//
+//	[
+//	  {"path": "keys/2026-01.pem", "active_from": "2026-01-01T00:00:00Z"},
+//	  {"path": "keys/2026-04.pem", "active_from": "2026-04-01T00:00:00Z"}
+//	]
+//
+// Relative paths are resolved against the schedule's directory. Every
+// replica loading the same schedule signs with the same key at any time, so
+// rotation needs no coordination beyond deploying the file ahead of time.
+func LoadKeySchedule(path string) ([]ScheduledKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []struct {
+		Path       string    `json:"path"`
+		ActiveFrom time.Time `json:"active_from"`
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("invalid key schedule in %s: %w", path, err)
+	}
+	keys := make([]ScheduledKey, 0, len(entries))
+	for _, e := range entries {
+		keyPath := e.Path
+		if !filepath.IsAbs(keyPath) {
+			keyPath = filepath.Join(filepath.Dir(path), keyPath)
+		}
+		key, err := LoadSigningKey(keyPath)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, ScheduledKey{Key: key, ActiveFrom: e.ActiveFrom})
+	}
+	return keys, nil
+}
+
+// JWK returns the public half of k
+func (k *SigningKey) JWK() JSONWebKey {
+	jwk := JSONWebKey{Use: "sig", Algorithm: k.Algorithm, KeyID: k.ID}
+	switch pub := k.Private.Public().(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = rawURL.EncodeToString(pub.N.Bytes())
+		jwk.E = rawURL.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		jwk.KeyType = "EC"
+		jwk.Curve = "P-256"
+		jwk.X = rawURL.EncodeToString(pub.X.FillBytes(make([]byte, 32)))
+		jwk.Y = rawURL.EncodeToString(pub.Y.FillBytes(make([]byte, 32)))
+	}
+	return jwk
+}
+
+// sign returns the JWS signature of signingInput
+func (k *SigningKey) sign(signingInput string) ([]byte, error) {
+	digest := sha256.Sum256([]byte(signingInput))
+	switch priv := k.Private.(type) {
+	case *rsa.PrivateKey:
+		return rsa.SignPKCS1v15(rand.Reader, priv, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		// JWS uses the fixed-size R || S encoding instead of ASN.1
+		r, s, err := ecdsa.Sign(rand.Reader, priv, digest[:])
+		if err != nil {
+			return nil, err
+		}
+		signature := make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+		return signature, nil
+	default:
+		return nil, fmt.Errorf("unsupported signing key type %T", priv)
+	}
+}
+
+// ecThumbprint computes the RFC 7638 thumbprint of a P-256 key
+func ecThumbprint(pub *ecdsa.PublicKey) string {
+	canonical := fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`,
+		rawURL.EncodeToString(pub.X.FillBytes(make([]byte, 32))),
+		rawURL.EncodeToString(pub.Y.FillBytes(make([]byte, 32))))
+	sum := sha256.Sum256([]byte(canonical))
+	return rawURL.EncodeToString(sum[:])
+}
@@ -0,0 +1,599 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+)
+
+// LDAPConfig configures simple bind verification against a directory
+type LDAPConfig struct {
+	// URL is ldap://host[:389] or ldaps://host[:636]
+	URL string
+	// UserDNTemplate binds as fmt.Sprintf(UserDNTemplate, username), such as
+	// "uid=%s,ou=people,dc=example,dc=com". Without it the user is searched
+	// for under BaseDN by UserAttribute, as BindDN when one is set.
+	UserDNTemplate string
+	BindDN         string
+	BindPassword   string
+	BaseDN         string
+	UserAttribute  string
+	EmailAttribute string
+	// GroupAttribute lists the user's group DNs; their CNs become roles
+	GroupAttribute string
+	// GroupBaseDN is where Groups searches for groups of GroupObjectClass,
+	// defaulting to BaseDN, and MemberAttribute lists their members' DNs
+	GroupBaseDN      string
+	GroupObjectClass string
+	MemberAttribute  string
+	Timeout          time.Duration
+	TLSConfig        *tls.Config
+}
+
+// LDAPVerifier verifies credentials with an LDAPv3 simple bind. It returns
+// the user without tokens, leaving issuance to the caller.
+type LDAPVerifier struct {
+	cfg  LDAPConfig
+	addr string
+	tls  bool
+}
+
+// NewLDAPVerifier validates cfg and fills in defaults
+func NewLDAPVerifier(cfg LDAPConfig) (*LDAPVerifier, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid LDAP URL %q", cfg.URL)
+	}
+	v := &LDAPVerifier{addr: u.Host}
+	switch u.Scheme {
+	case "ldap":
+		if u.Port() == "" {
+			v.addr = net.JoinHostPort(u.Hostname(), "389")
+		}
+	case "ldaps":
+		v.tls = true
+		if u.Port() == "" {
+			v.addr = net.JoinHostPort(u.Hostname(), "636")
+		}
+	default:
+		return nil, fmt.Errorf("LDAP URL %q must use ldap:// or ldaps://", cfg.URL)
+	}
+	if cfg.UserDNTemplate != "" && strings.Count(cfg.UserDNTemplate, "%s") != 1 {
+		return nil, errors.New("LDAP user DN template must contain exactly one %s")
+	}
+	if cfg.UserDNTemplate == "" && cfg.BaseDN == "" {
+		return nil, errors.New("LDAP needs a base DN or a user DN template")
+	}
+	if cfg.UserAttribute == "" {
+		cfg.UserAttribute = "uid"
+	}
+	if cfg.EmailAttribute == "" {
+		cfg.EmailAttribute = "mail"
+	}
+	if cfg.GroupAttribute == "" {
+		cfg.GroupAttribute = "memberOf"
+	}
+	if cfg.GroupBaseDN == "" {
+		cfg.GroupBaseDN = cfg.BaseDN
+	}
+	if cfg.GroupObjectClass == "" {
+		cfg.GroupObjectClass = "groupOfNames"
+	}
+	if cfg.MemberAttribute == "" {
+		cfg.MemberAttribute = "member"
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	v.cfg = cfg
+	return v, nil
+}
+
+// Authenticate implements interfaces.CredentialVerifier
+func (v *LDAPVerifier) Authenticate(ctx context.Context, username, password string) (*interfaces.LoginResponse, error) {
+	// A simple bind with an empty password is an anonymous bind, which
+	// most directories accept for any DN
+	if username == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+	conn, err := v.dial(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrIdPUnavailable, err)
+	}
+	defer conn.close()
+
+	attributes := []string{v.cfg.EmailAttribute, v.cfg.GroupAttribute}
+	var entry *ldapEntry
+	if v.cfg.UserDNTemplate != "" {
+		dn := fmt.Sprintf(v.cfg.UserDNTemplate, escapeDN(username))
+		if err := conn.bind(dn, password); err != nil {
+			return nil, err
+		}
+		// Users who may not read their own entry still log in, without roles
+		if entry, err = conn.searchOne(dn, ldapScopeBase, ldapPresent("objectClass"), attributes); err != nil || entry == nil {
+			entry = &ldapEntry{dn: dn}
+		}
+	} else {
+		if v.cfg.BindDN != "" {
+			if err := conn.bind(v.cfg.BindDN, v.cfg.BindPassword); err != nil {
+				return nil, fmt.Errorf("%w: service account bind: %v", ErrIdPUnavailable, err)
+			}
+		}
+		if entry, err = conn.searchOne(v.cfg.BaseDN, ldapScopeSubtree, ldapEquals(v.cfg.UserAttribute, username), attributes); err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			return nil, ErrInvalidCredentials
+		}
+		if err := conn.bind(entry.dn, password); err != nil {
+			return nil, err
+		}
+	}
+
+	user := interfaces.UserInfo{
+		ID:       entry.dn,
+		Username: username,
+		Email:    entry.first(v.cfg.EmailAttribute),
+		Roles:    []string{},
+	}
+	for _, group := range entry.attrs[strings.ToLower(v.cfg.GroupAttribute)] {
+		if cn, ok := groupCN(group); ok {
+			user.Roles = append(user.Roles, cn)
+		}
+	}
+	return &interfaces.LoginResponse{User: user}, nil
+}
+
+// Groups returns the member DNs of every group under GroupBaseDN by group
+// CN, binding as BindDN when one is set. Member DNs are the IDs of the
+// users Authenticate returns.
+func (v *LDAPVerifier) Groups(ctx context.Context) (map[string][]string, error) {
+	if v.cfg.GroupBaseDN == "" {
+		return nil, errors.New("LDAP groups need a group base DN")
+	}
+	conn, err := v.dial(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrIdPUnavailable, err)
+	}
+	defer conn.close()
+	if v.cfg.BindDN != "" {
+		if err := conn.bind(v.cfg.BindDN, v.cfg.BindPassword); err != nil {
+			return nil, fmt.Errorf("%w: service account bind: %v", ErrIdPUnavailable, err)
+		}
+	}
+	entries, err := conn.search(v.cfg.GroupBaseDN, ldapScopeSubtree, 0,
+		ldapEquals("objectClass", v.cfg.GroupObjectClass), []string{v.cfg.MemberAttribute})
+	if err != nil {
+		return nil, err
+	}
+	groups := make(map[string][]string, len(entries))
+	for _, entry := range entries {
+		if cn, ok := groupCN(entry.dn); ok {
+			groups[cn] = append(groups[cn], entry.attrs[strings.ToLower(v.cfg.MemberAttribute)]...)
+		}
+	}
+	return groups, nil
+}
+
+func (v *LDAPVerifier) dial(ctx context.Context) (*ldapConn, error) {
+	dialer := &net.Dialer{Timeout: v.cfg.Timeout}
+	var conn net.Conn
+	var err error
+	if v.tls {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: v.cfg.TLSConfig}).DialContext(ctx, "tcp", v.addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", v.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(v.cfg.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &ldapConn{conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// LDAP result codes from RFC 4511
+const (
+	ldapSuccess            = 0
+	ldapSizeLimitExceeded  = 4
+	ldapNoSuchObject       = 32
+	ldapInvalidCredentials = 49
+)
+
+type ldapError struct {
+	Code    int
+	Message string
+}
+
+func (e *ldapError) Error() string {
+	return fmt.Sprintf("LDAP result %d: %s", e.Code, e.Message)
+}
+
+// bindError maps a failed bind. Active Directory answers invalidCredentials
+// for every account problem and tells them apart by a "data" code in the
+// diagnostic message.
+func bindError(err *ldapError) error {
+	if err.Code != ldapInvalidCredentials {
+		return err
+	}
+	message := strings.ToLower(err.Message)
+	switch {
+	case strings.Contains(message, "data 530"), strings.Contains(message, "data 533"),
+		strings.Contains(message, "data 701"), strings.Contains(message, "data 775"):
+		return ErrAccountLocked
+	case strings.Contains(message, "data 532"), strings.Contains(message, "data 773"):
+		return ErrAccountNotReady
+	default:
+		return ErrInvalidCredentials
+	}
+}
+
+// BER tags of the LDAP messages used here
+const (
+	berBoolean     = 0x01
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berEnumerated  = 0x0a
+	berSequence    = 0x30
+	berSet         = 0x31
+
+	ldapBindRequest     = 0x60
+	ldapBindResponse    = 0x61
+	ldapUnbindRequest   = 0x42
+	ldapSearchRequest   = 0x63
+	ldapSearchEntry     = 0x64
+	ldapSearchDone      = 0x65
+	ldapSearchReference = 0x73
+	ldapAuthSimple      = 0x80
+	ldapFilterEquals    = 0xa3
+	ldapFilterPresent   = 0x87
+
+	ldapScopeBase    = 0
+	ldapScopeSubtree = 2
+
+	maxLDAPMessage = 1 << 20
+)
+
+var errLDAPMalformed = fmt.Errorf("%w: malformed LDAP response", ErrIdPUnavailable)
+
+type berValue struct {
+	tag     byte
+	content []byte
+}
+
+type berReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+func berEncode(tag byte, parts ...[]byte) []byte {
+	n := 0
+	for _, p := range parts {
+		n += len(p)
+	}
+	out := []byte{tag}
+	if n < 0x80 {
+		out = append(out, byte(n))
+	} else {
+		var length []byte
+		for l := n; l > 0; l >>= 8 {
+			length = append([]byte{byte(l)}, length...)
+		}
+		out = append(out, 0x80|byte(len(length)))
+		out = append(out, length...)
+	}
+	for _, p := range parts {
+		out = append(out, p...)
+	}
+	return out
+}
+
+func berInt(tag byte, v int) []byte {
+	var b []byte
+	for {
+		b = append([]byte{byte(v)}, b...)
+		if v >>= 8; v == 0 {
+			break
+		}
+	}
+	if b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return berEncode(tag, b)
+}
+
+func berString(tag byte, s string) []byte {
+	return berEncode(tag, []byte(s))
+}
+
+func berIntValue(content []byte) int {
+	v := 0
+	for _, b := range content {
+		v = v<<8 | int(b)
+	}
+	return v
+}
+
+// readBER reads one element, accepting the non-minimal lengths some
+// directories send
+func readBER(r berReader) (berValue, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return berValue{}, err
+	}
+	first, err := r.ReadByte()
+	if err != nil {
+		return berValue{}, err
+	}
+	length := int(first)
+	if first&0x80 != 0 {
+		n := int(first & 0x7f)
+		if n == 0 || n > 4 {
+			return berValue{}, errLDAPMalformed
+		}
+		length = 0
+		for i := 0; i < n; i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return berValue{}, err
+			}
+			length = length<<8 | int(b)
+		}
+	}
+	if length > maxLDAPMessage {
+		return berValue{}, errLDAPMalformed
+	}
+	content := make([]byte, length)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return berValue{}, err
+	}
+	return berValue{tag: tag, content: content}, nil
+}
+
+func berChildren(content []byte) ([]berValue, error) {
+	r := bytes.NewReader(content)
+	var children []berValue
+	for r.Len() > 0 {
+		v, err := readBER(r)
+		if err != nil {
+			return nil, errLDAPMalformed
+		}
+		children = append(children, v)
+	}
+	return children, nil
+}
+
+func ldapEquals(attribute, value string) []byte {
+	return berEncode(ldapFilterEquals, berString(berOctetString, attribute), berString(berOctetString, value))
+}
+
+func ldapPresent(attribute string) []byte {
+	return berString(ldapFilterPresent, attribute)
+}
+
+// ldapResult returns the error of an LDAPResult, if any
+func ldapResult(op berValue) error {
+	parts, err := berChildren(op.content)
+	if err != nil || len(parts) < 3 {
+		return errLDAPMalformed
+	}
+	if code := berIntValue(parts[0].content); code != ldapSuccess {
+		return &ldapError{Code: code, Message: string(parts[2].content)}
+	}
+	return nil
+}
+
+type ldapConn struct {
+	conn   net.Conn
+	r      *bufio.Reader
+	nextID int
+}
+
+func (c *ldapConn) send(op []byte) (int, error) {
+	c.nextID++
+	if _, err := c.conn.Write(berEncode(berSequence, berInt(berInteger, c.nextID), op)); err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrIdPUnavailable, err)
+	}
+	return c.nextID, nil
+}
+
+// receive returns the protocol op of the next response to id
+func (c *ldapConn) receive(id int) (berValue, error) {
+	for {
+		msg, err := readBER(c.r)
+		if err != nil {
+			return berValue{}, fmt.Errorf("%w: %v", ErrIdPUnavailable, err)
+		}
+		parts, err := berChildren(msg.content)
+		if err != nil || msg.tag != berSequence || len(parts) < 2 {
+			return berValue{}, errLDAPMalformed
+		}
+		if berIntValue(parts[0].content) == id {
+			return parts[1], nil
+		}
+	}
+}
+
+func (c *ldapConn) bind(dn, password string) error {
+	id, err := c.send(berEncode(ldapBindRequest,
+		berInt(berInteger, 3), berString(berOctetString, dn), berString(ldapAuthSimple, password)))
+	if err != nil {
+		return err
+	}
+	op, err := c.receive(id)
+	if err != nil {
+		return err
+	}
+	if op.tag != ldapBindResponse {
+		return errLDAPMalformed
+	}
+	var result *ldapError
+	if err := ldapResult(op); errors.As(err, &result) {
+		return bindError(result)
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+type ldapEntry struct {
+	dn    string
+	attrs map[string][]string
+}
+
+func (e *ldapEntry) first(name string) string {
+	if values := e.attrs[strings.ToLower(name)]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// searchOne returns the only entry matching filter, or nil when there is
+// none or more than one
+func (c *ldapConn) searchOne(base string, scope int, filter []byte, attributes []string) (*ldapEntry, error) {
+	entries, err := c.search(base, scope, 2, filter, attributes)
+	if err != nil || len(entries) != 1 {
+		return nil, err
+	}
+	return entries[0], nil
+}
+
+// search returns up to sizeLimit entries matching filter, or every one when
+// sizeLimit is 0. A missing base matches nothing.
+func (c *ldapConn) search(base string, scope, sizeLimit int, filter []byte, attributes []string) ([]*ldapEntry, error) {
+	attrs := make([][]byte, len(attributes))
+	for i, a := range attributes {
+		attrs[i] = berString(berOctetString, a)
+	}
+	id, err := c.send(berEncode(ldapSearchRequest,
+		berString(berOctetString, base),
+		berInt(berEnumerated, scope),
+		berInt(berEnumerated, 0),
+		berInt(berInteger, sizeLimit),
+		berInt(berInteger, 0),
+		berEncode(berBoolean, []byte{0}),
+		filter,
+		berEncode(berSequence, attrs...)))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*ldapEntry
+	for {
+		op, err := c.receive(id)
+		if err != nil {
+			return nil, err
+		}
+		switch op.tag {
+		case ldapSearchEntry:
+			entry, err := parseEntry(op.content)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		case ldapSearchReference:
+		case ldapSearchDone:
+			var result *ldapError
+			if err := ldapResult(op); errors.As(err, &result) {
+				if result.Code != ldapSizeLimitExceeded && result.Code != ldapNoSuchObject {
+					return nil, result
+				}
+			} else if err != nil {
+				return nil, err
+			}
+			return entries, nil
+		default:
+			return nil, errLDAPMalformed
+		}
+	}
+}
+
+func parseEntry(content []byte) (*ldapEntry, error) {
+	parts, err := berChildren(content)
+	if err != nil || len(parts) < 2 {
+		return nil, errLDAPMalformed
+	}
+	entry := &ldapEntry{dn: string(parts[0].content), attrs: map[string][]string{}}
+	attributes, err := berChildren(parts[1].content)
+	if err != nil {
+		return nil, err
+	}
+	for _, attribute := range attributes {
+		fields, err := berChildren(attribute.content)
+		if err != nil || len(fields) < 2 || fields[1].tag != berSet {
+			return nil, errLDAPMalformed
+		}
+		values, err := berChildren(fields[1].content)
+		if err != nil {
+			return nil, err
+		}
+		name := strings.ToLower(string(fields[0].content))
+		for _, value := range values {
+			entry.attrs[name] = append(entry.attrs[name], string(value.content))
+		}
+	}
+	return entry, nil
+}
+
+func (c *ldapConn) close() {
+	_, _ = c.send(berEncode(ldapUnbindRequest))
+	c.conn.Close()
+}
+
+// escapeDN escapes an attribute value for use in a DN (RFC 4514)
+func escapeDN(value string) string {
+	var b strings.Builder
+	for i, r := range value {
+		switch {
+		case strings.ContainsRune(`,+"\<>;=`, r),
+			r == ' ' && (i == 0 || i == len(value)-1),
+			r == '#' && i == 0:
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == 0:
+			b.WriteString(`\00`)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// groupCN returns the value of a group DN's leading cn RDN
+func groupCN(dn string) (string, bool) {
+	name, rest, ok := strings.Cut(dn, "=")
+	if !ok || !strings.EqualFold(strings.TrimSpace(name), "cn") {
+		return "", false
+	}
+	var b strings.Builder
+	for i := 0; i < len(rest); i++ {
+		switch rest[i] {
+		case '\\':
+			if i+1 < len(rest) {
+				i++
+				b.WriteByte(rest[i])
+			}
+		case ',', '+':
+			return b.String(), b.Len() > 0
+		default:
+			b.WriteByte(rest[i])
+		}
+	}
+	return b.String(), b.Len() > 0
+}
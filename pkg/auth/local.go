@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+)
+
+// LocalUser is an entry in a local users file
+type LocalUser struct {
+	interfaces.UserInfo
+	// PasswordHash is a bcrypt hash
+	PasswordHash string `json:"password_hash"`
+}
+
+// LocalUsers verifies credentials against a fixed set of users with bcrypt
+// password hashes, for deployments without an external identity provider
+type LocalUsers struct {
+	users map[string]LocalUser
+	// dummyHash keeps the response time of unknown users close to known ones
+	dummyHash []byte
+}
+
+// NewLocalUsers creates a verifier for users
+func NewLocalUsers(users []LocalUser) *LocalUsers {
+	byName := make(map[string]LocalUser, len(users))
+	for _, u := range users {
+		byName[u.Username] = u
+	}
+	dummy, _ := bcrypt.GenerateFromPassword([]byte("impl-zamaz"), bcrypt.DefaultCost)
+	return &LocalUsers{users: byName, dummyHash: dummy}
+}
+
+// LoadLocalUsers reads a JSON array of users from path
+func LoadLocalUsers(path string) (*LocalUsers, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var users []LocalUser
+	if err := json.Unmarshal(data, &users); err != nil {
+		return nil, fmt.Errorf("invalid users in %s: %w", path, err)
+	}
+	for _, u := range users {
+		if u.Username == "" || u.PasswordHash == "" {
+			return nil, fmt.Errorf("user %q in %s needs a username and a password_hash", u.ID, path)
+		}
+	}
+	return NewLocalUsers(users), nil
+}
+
+// Verify returns the user with username if password matches
+func (l *LocalUsers) Verify(username, password string) (*interfaces.UserInfo, error) {
+	u, ok := l.users[username]
+	if !ok {
+		bcrypt.CompareHashAndPassword(l.dummyHash, []byte(password))
+		return nil, ErrInvalidCredentials
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	user := u.UserInfo
+	return &user, nil
+}
+
+// Authenticate implements interfaces.CredentialVerifier. The response carries
+// no tokens; the caller issues its own.
+func (l *LocalUsers) Authenticate(_ context.Context, username, password string) (*interfaces.LoginResponse, error) {
+	user, err := l.Verify(username, password)
+	if err != nil {
+		return nil, err
+	}
+	return &interfaces.LoginResponse{User: *user}, nil
+}
+
+// LookupEmail returns the user with email, ignoring case, for login
+// channels that identify users by address
+func (l *LocalUsers) LookupEmail(_ context.Context, email string) (*interfaces.UserInfo, error) {
+	for _, u := range l.users {
+		if u.Email != "" && strings.EqualFold(u.Email, email) {
+			user := u.UserInfo
+			return &user, nil
+		}
+	}
+	return nil, ErrInvalidCredentials
+}
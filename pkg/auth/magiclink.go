@@ -0,0 +1,434 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lsendel/impl-zamaz/pkg/i18n"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+// Store keys of the email login channel, all keyed by a hash of the address
+// or the link's jti so addresses are not stored in key names
+const (
+	magicPendingPrefix  = "magiclink:pending:"
+	magicSendsPrefix    = "magiclink:sends:"
+	magicAttemptsPrefix = "magiclink:attempts:"
+	magicUsedPrefix     = "magiclink:used:"
+)
+
+// ErrMagicLinkInvalid is returned for unknown, expired, superseded or used
+// links and codes
+var ErrMagicLinkInvalid = errors.New("login link or code is invalid, expired or already used")
+
+// MagicLinkConfig configures the email login channel
+type MagicLinkConfig struct {
+	// VerifyURL is the absolute URL of GET /auth/magic-link/verify that
+	// emailed links point to
+	VerifyURL string
+	// TTL bounds how long a link and its code can be used
+	TTL time.Duration
+	// MaxSends bounds the emails sent to one address per TTL
+	MaxSends int
+	// MaxAttempts wrong codes invalidate the pending login
+	MaxAttempts int
+	// DefaultReturnTo is where browsers land when the request names no
+	// return_to path
+	DefaultReturnTo string
+	// AccessTokenTTL and RefreshTokenTTL apply to the tokens returned by
+	// POST /auth/magic-link/verify
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+	// Lookup resolves an address to a user, returning ErrInvalidCredentials
+	// for unknown addresses
+	Lookup func(ctx context.Context, email string) (*interfaces.UserInfo, error)
+	// Complete starts the application session for the verified user, as in
+	// RelyingPartyConfig
+	Complete func(c *gin.Context, user interfaces.UserInfo) error
+}
+
+// pendingMagicLink is the latest link sent to an address. Only its jti and
+// a hash of its code are accepted, so each new request supersedes the last.
+type pendingMagicLink struct {
+	JTI      string `json:"jti"`
+	CodeHash string `json:"code_hash"`
+	ReturnTo string `json:"return_to"`
+}
+
+// MagicLinks logs users in with a short-lived link or one-time code sent by
+// email. Links are signed by the token issuer with token_use magic_link, and
+// both link and code are single use across replicas.
+type MagicLinks struct {
+	config  MagicLinkConfig
+	issuer  *Issuer
+	sender  interfaces.EmailSender
+	store   store.Store
+	logger  interfaces.Logger
+	metrics interfaces.MetricsCollector
+}
+
+// NewMagicLinks creates the email login channel; metrics may be nil
+func NewMagicLinks(cfg MagicLinkConfig, issuer *Issuer, sender interfaces.EmailSender, s store.Store, logger interfaces.Logger, metrics interfaces.MetricsCollector) (*MagicLinks, error) {
+	verify, err := url.Parse(cfg.VerifyURL)
+	if err != nil || !verify.IsAbs() {
+		return nil, fmt.Errorf("magic link verify URL must be absolute: %q", cfg.VerifyURL)
+	}
+	if cfg.Lookup == nil || cfg.Complete == nil {
+		return nil, errors.New("magic links need Lookup and Complete functions")
+	}
+	if cfg.TTL <= 0 {
+		cfg.TTL = 10 * time.Minute
+	}
+	if cfg.MaxSends <= 0 {
+		cfg.MaxSends = 5
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 5
+	}
+	if cfg.DefaultReturnTo == "" {
+		cfg.DefaultReturnTo = "/"
+	}
+	if cfg.AccessTokenTTL <= 0 {
+		cfg.AccessTokenTTL = 15 * time.Minute
+	}
+	if cfg.RefreshTokenTTL <= 0 {
+		cfg.RefreshTokenTTL = 24 * time.Hour
+	}
+	return &MagicLinks{config: cfg, issuer: issuer, sender: sender, store: s, logger: logger, metrics: metrics}, nil
+}
+
+// RegisterRoutes mounts the channel:
+//
+//	POST /magic-link          {"email", "return_to"}  always 202
+//	GET  /magic-link/verify   ?token=  starts a session and redirects
+//	POST /magic-link/verify   {"token"} or {"email", "code"}  returns tokens
+func (m *MagicLinks) RegisterRoutes(r gin.IRoutes) {
+	r.POST("/magic-link", m.handleRequest)
+	r.GET("/magic-link/verify", m.handleLink)
+	r.POST("/magic-link/verify", m.handleVerify)
+}
+
+func (m *MagicLinks) handleRequest(c *gin.Context) {
+	var req struct {
+		Email    string `json:"email" binding:"required"`
+		ReturnTo string `json:"return_to"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		m.fail(c, http.StatusBadRequest, "VALIDATION_ERROR")
+		return
+	}
+	email, ok := normalizeEmail(req.Email)
+	if !ok {
+		m.fail(c, http.StatusBadRequest, "VALIDATION_ERROR")
+		return
+	}
+
+	// The response never says whether the address belongs to a user
+	accepted := func() {
+		c.JSON(http.StatusAccepted, gin.H{
+			"message":    "If the address belongs to an account, a sign-in link is on its way",
+			"expires_in": int(m.config.TTL.Seconds()),
+		})
+	}
+	ctx := c.Request.Context()
+	sends, _, err := m.store.Incr(ctx, magicSendsPrefix+emailKey(email), m.config.TTL)
+	if err != nil {
+		m.unavailable(c, "Failed to count login emails", err)
+		return
+	}
+	if sends > int64(m.config.MaxSends) {
+		m.logger.Warn("Login email limit reached", "ip", c.ClientIP())
+		m.count("throttled")
+		accepted()
+		return
+	}
+	user, err := m.config.Lookup(ctx, email)
+	if errors.Is(err, ErrInvalidCredentials) {
+		m.count("unknown")
+		accepted()
+		return
+	}
+	if err != nil {
+		m.unavailable(c, "Failed to look up login email", err)
+		return
+	}
+
+	pending := pendingMagicLink{JTI: newTokenID(), ReturnTo: returnToPath(req.ReturnTo, m.config.DefaultReturnTo)}
+	code, err := newLoginCode()
+	if err != nil {
+		m.unavailable(c, "Failed to generate login code", err)
+		return
+	}
+	pending.CodeHash = hashLoginCode(pending.JTI, code)
+	token, err := m.issuer.Sign(map[string]interface{}{
+		"sub":       user.ID,
+		"email":     email,
+		"jti":       pending.JTI,
+		"token_use": TokenUseMagicLink,
+	}, m.config.TTL)
+	if err != nil {
+		m.unavailable(c, "Failed to sign login link", err)
+		return
+	}
+	data, err := json.Marshal(pending)
+	if err == nil {
+		err = m.store.Set(ctx, magicPendingPrefix+emailKey(email), data, m.config.TTL)
+	}
+	if err != nil {
+		m.unavailable(c, "Failed to store login link", err)
+		return
+	}
+
+	link := m.config.VerifyURL + "?" + url.Values{"token": {token}}.Encode()
+	body := fmt.Sprintf("Sign in by opening this link:\n\n%s\n\nor enter the code %s.\n\nBoth expire in %d minutes and work once. If you did not ask to sign in, ignore this email.\n",
+		link, code, int(m.config.TTL.Minutes()))
+	// Sending in the background keeps response times the same for unknown
+	// addresses
+	go m.send(user.ID, email, body)
+	m.logger.Info("Login link requested", "user_id", user.ID, "ip", c.ClientIP())
+	accepted()
+}
+
+func (m *MagicLinks) send(userID, email, body string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := m.sender.Send(ctx, email, "Your sign-in link", body); err != nil {
+		m.logger.Error("Failed to send login email", "user_id", userID, "error", err)
+		m.count("send_failed")
+		return
+	}
+	m.count("sent")
+}
+
+// handleLink finishes a browser login from the emailed link
+func (m *MagicLinks) handleLink(c *gin.Context) {
+	user, pending, err := m.redeemLink(c.Request.Context(), c.Query("token"))
+	if err != nil {
+		m.verifyFailed(c, err)
+		return
+	}
+	if err := m.config.Complete(c, *user); err != nil {
+		m.completeFailed(c, err)
+		return
+	}
+	m.count("succeeded")
+	c.Redirect(http.StatusFound, pending.ReturnTo)
+}
+
+// handleVerify finishes a login with the link token or the emailed code and
+// returns tokens, for clients that cannot follow the link
+func (m *MagicLinks) handleVerify(c *gin.Context) {
+	var req struct {
+		Token string `json:"token"`
+		Email string `json:"email"`
+		Code  string `json:"code"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || (req.Token == "") == (req.Code == "") {
+		m.fail(c, http.StatusBadRequest, "VALIDATION_ERROR")
+		return
+	}
+	var user *interfaces.UserInfo
+	var err error
+	if req.Token != "" {
+		user, _, err = m.redeemLink(c.Request.Context(), req.Token)
+	} else {
+		user, err = m.redeemCode(c.Request.Context(), req.Email, req.Code)
+	}
+	if err != nil {
+		m.verifyFailed(c, err)
+		return
+	}
+
+	tokens, err := m.issuer.IssueTokens(UserClaims(*user), m.config.AccessTokenTTL, m.config.RefreshTokenTTL)
+	if err != nil {
+		m.unavailable(c, "Failed to issue tokens", err)
+		return
+	}
+	if err := m.config.Complete(c, *user); err != nil {
+		m.completeFailed(c, err)
+		return
+	}
+	m.count("succeeded")
+	c.JSON(http.StatusOK, interfaces.LoginResponse{
+		AccessToken:  tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
+		ExpiresIn:    tokens.ExpiresIn,
+		TokenType:    tokens.TokenType,
+		User:         *user,
+	})
+}
+
+// redeemLink verifies a link token and consumes its pending login
+func (m *MagicLinks) redeemLink(ctx context.Context, token string) (*interfaces.UserInfo, *pendingMagicLink, error) {
+	if token == "" {
+		return nil, nil, ErrMagicLinkInvalid
+	}
+	claims, err := m.issuer.Verify(token)
+	if err != nil || claims["token_use"] != TokenUseMagicLink {
+		return nil, nil, ErrMagicLinkInvalid
+	}
+	email, _ := claims["email"].(string)
+	jti, _ := claims["jti"].(string)
+	pending, err := m.pending(ctx, email)
+	if err != nil {
+		return nil, nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(pending.JTI), []byte(jti)) != 1 {
+		return nil, nil, ErrMagicLinkInvalid
+	}
+	user, err := m.consume(ctx, email, pending)
+	return user, pending, err
+}
+
+// redeemCode checks an emailed code against the pending login for email
+func (m *MagicLinks) redeemCode(ctx context.Context, email, code string) (*interfaces.UserInfo, error) {
+	email, ok := normalizeEmail(email)
+	if !ok {
+		return nil, ErrMagicLinkInvalid
+	}
+	pending, err := m.pending(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+	attempts, _, err := m.store.Incr(ctx, magicAttemptsPrefix+pending.JTI, m.config.TTL)
+	if err != nil {
+		return nil, err
+	}
+	if attempts > int64(m.config.MaxAttempts) {
+		if err := m.store.Delete(ctx, magicPendingPrefix+emailKey(email)); err != nil {
+			m.logger.Warn("Failed to delete pending login", "error", err)
+		}
+		return nil, ErrMagicLinkInvalid
+	}
+	if subtle.ConstantTimeCompare([]byte(pending.CodeHash), []byte(hashLoginCode(pending.JTI, code))) != 1 {
+		return nil, ErrMagicLinkInvalid
+	}
+	return m.consume(ctx, email, pending)
+}
+
+func (m *MagicLinks) pending(ctx context.Context, email string) (*pendingMagicLink, error) {
+	data, err := m.store.Get(ctx, magicPendingPrefix+emailKey(email))
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, ErrMagicLinkInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	var pending pendingMagicLink
+	if err := json.Unmarshal(data, &pending); err != nil {
+		return nil, err
+	}
+	return &pending, nil
+}
+
+// consume marks the pending login used exactly once and resolves its user
+// again, so users removed since the email cannot log in
+func (m *MagicLinks) consume(ctx context.Context, email string, pending *pendingMagicLink) (*interfaces.UserInfo, error) {
+	uses, _, err := m.store.Incr(ctx, magicUsedPrefix+pending.JTI, m.config.TTL)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.store.Delete(ctx, magicPendingPrefix+emailKey(email)); err != nil {
+		m.logger.Warn("Failed to delete used login link", "error", err)
+	}
+	if uses > 1 {
+		return nil, ErrMagicLinkInvalid
+	}
+	user, err := m.config.Lookup(ctx, email)
+	if errors.Is(err, ErrInvalidCredentials) {
+		return nil, ErrMagicLinkInvalid
+	}
+	return user, err
+}
+
+func (m *MagicLinks) verifyFailed(c *gin.Context, err error) {
+	if errors.Is(err, ErrMagicLinkInvalid) {
+		m.logger.Warn("Email login rejected", "ip", c.ClientIP())
+		m.fail(c, http.StatusUnauthorized, "MAGIC_LINK_INVALID")
+		return
+	}
+	m.unavailable(c, "Failed to verify email login", err)
+}
+
+// completeFailed reports an error from Complete; policy denials keep their
+// own response
+func (m *MagicLinks) completeFailed(c *gin.Context, err error) {
+	if errors.Is(err, ErrLoginDenied) {
+		status, code := LoginError(err)
+		m.fail(c, status, code)
+		return
+	}
+	m.unavailable(c, "Failed to start session after email login", err)
+}
+
+func (m *MagicLinks) unavailable(c *gin.Context, msg string, err error) {
+	m.logger.Error(msg, "error", err)
+	m.fail(c, http.StatusServiceUnavailable, "INTERNAL_ERROR")
+}
+
+func (m *MagicLinks) fail(c *gin.Context, status int, code string) {
+	if status != http.StatusBadRequest {
+		m.count("failed")
+	}
+	c.JSON(status, gin.H{"error": i18n.Message(c, code), "code": code})
+}
+
+func (m *MagicLinks) count(result string) {
+	if m.metrics != nil {
+		m.metrics.IncrementCounter("magic_link_logins_total", map[string]string{"result": result})
+	}
+}
+
+// normalizeEmail accepts a bare address and lower-cases it
+func normalizeEmail(email string) (string, bool) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || len(email) > 254 {
+		return "", false
+	}
+	return email, true
+}
+
+func emailKey(email string) string {
+	sum := sha256.Sum256([]byte(email))
+	return hex.EncodeToString(sum[:])
+}
+
+// newLoginCode returns a uniformly random six digit code
+func newLoginCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+// hashLoginCode salts the code with its link's jti
+func hashLoginCode(jti, code string) string {
+	sum := sha256.Sum256([]byte(jti + ":" + code))
+	return hex.EncodeToString(sum[:])
+}
+
+// returnToPath only accepts local paths so login flows cannot be used as
+// open redirects
+func returnToPath(path, fallback string) string {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.ContainsAny(path, "\\\r\n") {
+		return fallback
+	}
+	return path
+}
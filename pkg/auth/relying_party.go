@@ -0,0 +1,399 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lsendel/impl-zamaz/pkg/i18n"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+// Store keys of pending authorizations; the used marker makes every state
+// single use across replicas
+const (
+	rpStateKeyPrefix     = "oidc-rp:state:"
+	rpStateUsedKeyPrefix = "oidc-rp:state-used:"
+)
+
+// DefaultStateCookie binds an authorization request to the browser that
+// started it
+const DefaultStateCookie = "zamaz_oidc_state"
+
+// Authorization code flow errors
+var (
+	ErrStateInvalid   = errors.New("authorization state is unknown, expired or already used")
+	ErrNonceMismatch  = errors.New("ID token nonce does not match the authorization request")
+	ErrIDTokenInvalid = errors.New("ID token is invalid")
+)
+
+// RelyingPartyConfig configures the authorization code flow against an
+// external OpenID Connect provider such as a Keycloak realm
+type RelyingPartyConfig struct {
+	// Issuer is the iss every ID token must carry
+	Issuer       string
+	AuthorizeURL string
+	TokenURL     string
+	ClientID     string
+	// ClientSecret is empty for public clients, which rely on PKCE alone
+	ClientSecret string
+	// RedirectURL is the absolute URL of the callback endpoint registered
+	// with the provider
+	RedirectURL string
+	// Scopes defaults to openid, profile and email
+	Scopes []string
+	// StateTTL bounds how long a user may take at the provider's login page
+	StateTTL time.Duration
+	// DefaultReturnTo is where users land when the authorize request names
+	// no return_to path
+	DefaultReturnTo string
+	StateCookie     string
+	CookieSecure    bool
+	// Leeway tolerates clock skew when checking ID token expiry
+	Leeway time.Duration
+	// Complete starts the application session for the verified user, for
+	// example by creating the SSO session cookie. Returning ErrLoginDenied
+	// rejects the login with 403 LOGIN_DENIED.
+	Complete   func(c *gin.Context, user interfaces.UserInfo) error
+	HTTPClient *http.Client
+}
+
+// pendingAuthorization is what the callback needs to finish a login
+type pendingAuthorization struct {
+	Nonce        string `json:"nonce"`
+	CodeVerifier string `json:"code_verifier"`
+	ReturnTo     string `json:"return_to"`
+}
+
+// RelyingParty logs browsers in with the authorization code flow. PKCE
+// (S256) is always used and the code verifier never leaves the server, so
+// SPAs get a session cookie without ever handling passwords or tokens.
+type RelyingParty struct {
+	config  RelyingPartyConfig
+	store   store.Store
+	keys    *JWKSClient
+	logger  interfaces.Logger
+	metrics interfaces.MetricsCollector
+	now     func() time.Time
+}
+
+// NewRelyingParty creates a relying party that keeps pending authorizations
+// in s and verifies ID tokens against keys; metrics may be nil
+func NewRelyingParty(cfg RelyingPartyConfig, s store.Store, keys *JWKSClient, logger interfaces.Logger, metrics interfaces.MetricsCollector) (*RelyingParty, error) {
+	switch {
+	case cfg.Issuer == "", cfg.AuthorizeURL == "", cfg.TokenURL == "":
+		return nil, fmt.Errorf("issuer, authorize URL and token URL are required")
+	case cfg.ClientID == "":
+		return nil, fmt.Errorf("client ID is required")
+	case cfg.Complete == nil:
+		return nil, fmt.Errorf("a Complete function is required")
+	}
+	redirect, err := url.Parse(cfg.RedirectURL)
+	if err != nil || !redirect.IsAbs() {
+		return nil, fmt.Errorf("redirect URL must be absolute: %q", cfg.RedirectURL)
+	}
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "profile", "email"}
+	}
+	if cfg.StateTTL <= 0 {
+		cfg.StateTTL = 10 * time.Minute
+	}
+	if cfg.DefaultReturnTo == "" {
+		cfg.DefaultReturnTo = "/"
+	}
+	if cfg.StateCookie == "" {
+		cfg.StateCookie = DefaultStateCookie
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &RelyingParty{config: cfg, store: s, keys: keys, logger: logger, metrics: metrics, now: time.Now}, nil
+}
+
+// Authorize handles GET /auth/authorize?return_to=/path by redirecting the
+// browser to the provider with a fresh state, nonce and PKCE challenge
+func (rp *RelyingParty) Authorize(c *gin.Context) {
+	pending := pendingAuthorization{
+		Nonce:        randomValue(),
+		CodeVerifier: randomValue(),
+		ReturnTo:     rp.returnTo(c.Query("return_to")),
+	}
+	state := randomValue()
+	data, err := json.Marshal(pending)
+	if err == nil {
+		err = rp.store.Set(c.Request.Context(), rpStateKeyPrefix+state, data, rp.config.StateTTL)
+	}
+	if err != nil {
+		rp.logger.Error("Failed to store authorization state", "error", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error": i18n.Message(c, "INTERNAL_ERROR"),
+			"code":  "INTERNAL_ERROR",
+		})
+		return
+	}
+
+	rp.setStateCookie(c, state, int(rp.config.StateTTL.Seconds()))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {rp.config.ClientID},
+		"redirect_uri":          {rp.config.RedirectURL},
+		"scope":                 {strings.Join(rp.config.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {pending.Nonce},
+		"code_challenge":        {pkceChallenge(pending.CodeVerifier)},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(rp.config.AuthorizeURL, "?") {
+		separator = "&"
+	}
+	rp.count("started")
+	c.Redirect(http.StatusFound, rp.config.AuthorizeURL+separator+query.Encode())
+}
+
+// Callback handles the provider's redirect: it checks the state against the
+// browser's cookie, redeems the code with the PKCE verifier, validates the ID
+// token and nonce, and hands the user to Complete
+func (rp *RelyingParty) Callback(c *gin.Context) {
+	cookie, _ := c.Cookie(rp.config.StateCookie)
+	rp.setStateCookie(c, "", -1)
+
+	if providerError := c.Query("error"); providerError != "" {
+		rp.logger.Warn("Provider rejected authorization", "error", providerError, "description", c.Query("error_description"))
+		rp.fail(c, http.StatusUnauthorized, "OIDC_LOGIN_FAILED")
+		return
+	}
+	state := c.Query("state")
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(cookie)) != 1 {
+		rp.fail(c, http.StatusBadRequest, "OIDC_STATE_INVALID")
+		return
+	}
+	pending, err := rp.consumeState(c.Request.Context(), state)
+	if err != nil {
+		if errors.Is(err, ErrStateInvalid) {
+			rp.fail(c, http.StatusBadRequest, "OIDC_STATE_INVALID")
+			return
+		}
+		rp.logger.Error("Failed to load authorization state", "error", err)
+		rp.fail(c, http.StatusServiceUnavailable, "INTERNAL_ERROR")
+		return
+	}
+
+	user, err := rp.exchange(c.Request.Context(), c.Query("code"), pending)
+	if err != nil {
+		rp.logger.Warn("Authorization code login failed", "error", err, "ip", c.ClientIP())
+		if errors.Is(err, ErrIdPUnavailable) {
+			rp.fail(c, http.StatusServiceUnavailable, "IDP_UNAVAILABLE")
+			return
+		}
+		rp.fail(c, http.StatusUnauthorized, "OIDC_LOGIN_FAILED")
+		return
+	}
+	if err := rp.config.Complete(c, user); err != nil {
+		if errors.Is(err, ErrLoginDenied) {
+			status, code := LoginError(err)
+			rp.fail(c, status, code)
+			return
+		}
+		rp.logger.Error("Failed to start session after login", "user_id", user.ID, "error", err)
+		rp.fail(c, http.StatusInternalServerError, "INTERNAL_ERROR")
+		return
+	}
+	rp.count("succeeded")
+	c.Redirect(http.StatusFound, pending.ReturnTo)
+}
+
+// consumeState loads and deletes a pending authorization exactly once
+func (rp *RelyingParty) consumeState(ctx context.Context, state string) (*pendingAuthorization, error) {
+	uses, _, err := rp.store.Incr(ctx, rpStateUsedKeyPrefix+state, rp.config.StateTTL)
+	if err != nil {
+		return nil, err
+	}
+	data, err := rp.store.Get(ctx, rpStateKeyPrefix+state)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, ErrStateInvalid
+	} else if err != nil {
+		return nil, err
+	}
+	if err := rp.store.Delete(ctx, rpStateKeyPrefix+state); err != nil {
+		rp.logger.Warn("Failed to delete used authorization state", "error", err)
+	}
+	if uses > 1 {
+		return nil, ErrStateInvalid
+	}
+	var pending pendingAuthorization
+	if err := json.Unmarshal(data, &pending); err != nil {
+		return nil, err
+	}
+	return &pending, nil
+}
+
+type codeTokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// exchange redeems code and returns the user of the validated ID token
+func (rp *RelyingParty) exchange(ctx context.Context, code string, pending *pendingAuthorization) (interfaces.UserInfo, error) {
+	if code == "" {
+		return interfaces.UserInfo{}, errors.New("callback has no authorization code")
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {rp.config.RedirectURL},
+		"code_verifier": {pending.CodeVerifier},
+	}
+	if rp.config.ClientSecret == "" {
+		form.Set("client_id", rp.config.ClientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, rp.config.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return interfaces.UserInfo{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if rp.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(rp.config.ClientID), url.QueryEscape(rp.config.ClientSecret))
+	}
+
+	resp, err := rp.config.HTTPClient.Do(req)
+	if err != nil {
+		return interfaces.UserInfo{}, fmt.Errorf("%w: %v", ErrIdPUnavailable, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return interfaces.UserInfo{}, fmt.Errorf("%w: token endpoint returned status %d", ErrIdPUnavailable, resp.StatusCode)
+	}
+	var body codeTokenResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return interfaces.UserInfo{}, fmt.Errorf("%w: invalid token response: %v", ErrIdPUnavailable, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return interfaces.UserInfo{}, fmt.Errorf("token endpoint returned %d %s: %s", resp.StatusCode, body.Error, body.ErrorDescription)
+	}
+
+	claims, err := rp.verify(ctx, body.IDToken)
+	if err != nil {
+		return interfaces.UserInfo{}, err
+	}
+	nonce, _ := claims["nonce"].(string)
+	if subtle.ConstantTimeCompare([]byte(nonce), []byte(pending.Nonce)) != 1 {
+		return interfaces.UserInfo{}, ErrNonceMismatch
+	}
+
+	user := keycloakUser(claims)
+	if len(user.Roles) == 0 && body.AccessToken != "" {
+		// Keycloak puts realm roles in the access token only
+		if access, err := rp.keys.Verify(ctx, body.AccessToken); err == nil && access.Claims["iss"] == rp.config.Issuer {
+			user.Roles = keycloakUser(access.Claims).Roles
+		}
+	}
+	return user, nil
+}
+
+// verify checks the signature, issuer, audience and expiry of an ID token
+func (rp *RelyingParty) verify(ctx context.Context, idToken string) (map[string]interface{}, error) {
+	if idToken == "" {
+		return nil, fmt.Errorf("%w: token response has no id_token", ErrIDTokenInvalid)
+	}
+	token, err := rp.keys.Verify(ctx, idToken)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrIDTokenInvalid, err)
+	}
+	claims := token.Claims
+	if iss, _ := claims["iss"].(string); iss != rp.config.Issuer {
+		return nil, fmt.Errorf("%w: unexpected issuer %q", ErrIDTokenInvalid, iss)
+	}
+	if !audienceContains(claims["aud"], rp.config.ClientID) {
+		return nil, fmt.Errorf("%w: audience does not include %s", ErrIDTokenInvalid, rp.config.ClientID)
+	}
+	if azp, ok := claims["azp"].(string); ok && azp != rp.config.ClientID {
+		return nil, fmt.Errorf("%w: issued to another client", ErrIDTokenInvalid)
+	}
+	exp, ok := claims["exp"].(json.Number)
+	if !ok {
+		return nil, fmt.Errorf("%w: missing exp", ErrIDTokenInvalid)
+	}
+	if expiry, err := exp.Int64(); err != nil || rp.now().After(time.Unix(expiry, 0).Add(rp.config.Leeway)) {
+		return nil, fmt.Errorf("%w: token expired", ErrIDTokenInvalid)
+	}
+	return claims, nil
+}
+
+// returnTo only accepts local paths so the callback cannot be used as an
+// open redirect
+func (rp *RelyingParty) returnTo(path string) string {
+	return returnToPath(path, rp.config.DefaultReturnTo)
+}
+
+// setStateCookie scopes the cookie to the callback. SameSite=Lax is required
+// because the provider redirects back with a top-level cross-site GET.
+func (rp *RelyingParty) setStateCookie(c *gin.Context, value string, maxAge int) {
+	path := "/"
+	if redirect, err := url.Parse(rp.config.RedirectURL); err == nil && redirect.Path != "" {
+		path = redirect.Path
+	}
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     rp.config.StateCookie,
+		Value:    value,
+		Path:     path,
+		MaxAge:   maxAge,
+		Secure:   rp.config.CookieSecure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (rp *RelyingParty) fail(c *gin.Context, status int, code string) {
+	rp.count("failed")
+	c.JSON(status, gin.H{"error": i18n.Message(c, code), "code": code})
+}
+
+func (rp *RelyingParty) count(result string) {
+	if rp.metrics != nil {
+		rp.metrics.IncrementCounter("oidc_rp_logins_total", map[string]string{"result": result})
+	}
+}
+
+func audienceContains(aud interface{}, want string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == want
+	case []interface{}:
+		for _, item := range a {
+			if item == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// pkceChallenge derives the S256 code challenge of verifier
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return rawURL.EncodeToString(sum[:])
+}
+
+// randomValue returns 256 random bits, URL safe; long enough for a PKCE
+// verifier
+func randomValue() string {
+	b := make([]byte, 32)
+	_, _ = rand.Read(b)
+	return rawURL.EncodeToString(b)
+}
@@ -0,0 +1,184 @@
+// Package auth provides token handling for impl-zamaz
+package auth
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// MaxTokenLength bounds the size of tokens accepted by ParseToken
+const MaxTokenLength = 8192
+
+// TokenFormat identifies the wire format of a bearer token
+type TokenFormat string
+
+const (
+	FormatJWT    TokenFormat = "jwt"
+	FormatPASETO TokenFormat = "paseto"
+)
+
+// Token parsing errors
+var (
+	ErrTokenEmpty     = errors.New("token is empty")
+	ErrTokenTooLarge  = errors.New("token exceeds maximum length")
+	ErrTokenMalformed = errors.New("token is malformed")
+)
+
+// ParsedToken is the structural decoding of a token. Parsing never verifies
+// signatures; callers must verify SigningInput/Signature before trusting Claims.
+type ParsedToken struct {
+	Format TokenFormat
+	Raw    string
+
+	// JWT fields
+	Header       map[string]interface{}
+	SigningInput string
+
+	// PASETO fields
+	Version string
+	Purpose string
+	Footer  []byte
+
+	Claims    map[string]interface{}
+	Payload   []byte
+	Signature []byte
+}
+
+// rawURL is strict so every token has exactly one accepted encoding
+var rawURL = base64.RawURLEncoding.Strict()
+
+// pasetoSignatureSizes maps PASETO public versions to signature lengths
+var pasetoSignatureSizes = map[string]int{
+	"v1": 256,
+	"v2": 64,
+	"v3": 96,
+	"v4": 64,
+}
+
+// ParseToken decodes a JWT (JWS compact serialization) or PASETO token
+func ParseToken(raw string) (*ParsedToken, error) {
+	if raw == "" {
+		return nil, ErrTokenEmpty
+	}
+	if len(raw) > MaxTokenLength {
+		return nil, ErrTokenTooLarge
+	}
+
+	if strings.HasPrefix(raw, "v") && strings.Count(raw, ".") >= 2 {
+		if _, known := pasetoSignatureSizes[raw[:strings.Index(raw, ".")]]; known {
+			return parsePASETO(raw)
+		}
+	}
+	return parseJWT(raw)
+}
+
+func parseJWT(raw string) (*ParsedToken, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: expected 3 segments, got %d", ErrTokenMalformed, len(parts))
+	}
+
+	headerBytes, err := rawURL.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("%w: header: %v", ErrTokenMalformed, err)
+	}
+	payload, err := rawURL.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("%w: payload: %v", ErrTokenMalformed, err)
+	}
+	signature, err := rawURL.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature: %v", ErrTokenMalformed, err)
+	}
+
+	header, err := decodeJSONObject(headerBytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: header: %v", ErrTokenMalformed, err)
+	}
+	alg, _ := header["alg"].(string)
+	if alg == "" {
+		return nil, fmt.Errorf("%w: header has no alg", ErrTokenMalformed)
+	}
+
+	claims, err := decodeJSONObject(payload)
+	if err != nil {
+		return nil, fmt.Errorf("%w: claims: %v", ErrTokenMalformed, err)
+	}
+
+	return &ParsedToken{
+		Format:       FormatJWT,
+		Raw:          raw,
+		Header:       header,
+		SigningInput: parts[0] + "." + parts[1],
+		Claims:       claims,
+		Payload:      payload,
+		Signature:    signature,
+	}, nil
+}
+
+func parsePASETO(raw string) (*ParsedToken, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 && len(parts) != 4 {
+		return nil, fmt.Errorf("%w: expected 3 or 4 segments, got %d", ErrTokenMalformed, len(parts))
+	}
+
+	token := &ParsedToken{
+		Format:  FormatPASETO,
+		Raw:     raw,
+		Version: parts[0],
+		Purpose: parts[1],
+	}
+
+	body, err := rawURL.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: payload: %v", ErrTokenMalformed, err)
+	}
+	if len(parts) == 4 {
+		if token.Footer, err = rawURL.DecodeString(parts[3]); err != nil {
+			return nil, fmt.Errorf("%w: footer: %v", ErrTokenMalformed, err)
+		}
+	}
+
+	switch token.Purpose {
+	case "local":
+		// Encrypted payload; claims are only available after decryption
+		token.Payload = body
+	case "public":
+		sigSize := pasetoSignatureSizes[token.Version]
+		if len(body) < sigSize {
+			return nil, fmt.Errorf("%w: payload shorter than %s signature", ErrTokenMalformed, token.Version)
+		}
+		token.Payload = body[:len(body)-sigSize]
+		token.Signature = body[len(body)-sigSize:]
+		if token.Claims, err = decodeJSONObject(token.Payload); err != nil {
+			return nil, fmt.Errorf("%w: claims: %v", ErrTokenMalformed, err)
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown purpose %q", ErrTokenMalformed, token.Purpose)
+	}
+
+	return token, nil
+}
+
+// decodeJSONObject decodes exactly one JSON object with no trailing data
+func decodeJSONObject(data []byte) (map[string]interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var obj map[string]interface{}
+	if err := dec.Decode(&obj); err != nil {
+		return nil, err
+	}
+	if obj == nil {
+		return nil, errors.New("not a JSON object")
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("trailing data after JSON object")
+	}
+	return obj, nil
+}
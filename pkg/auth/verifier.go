@@ -0,0 +1,47 @@
+package auth
+
+import (
+	"fmt"
+
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+)
+
+// Credential verification backends
+const (
+	BackendKeycloak = "keycloak"
+	BackendLocal    = "local"
+	BackendLDAP     = "ldap"
+)
+
+// VerifierConfig selects the backend that verifies login credentials
+type VerifierConfig struct {
+	// Backend is keycloak, local or ldap; empty means keycloak
+	Backend string
+
+	KeycloakTokenURL     string
+	KeycloakClientID     string
+	KeycloakClientSecret string
+
+	// LocalUsersFile is a JSON array of users with bcrypt password hashes
+	LocalUsersFile string
+
+	LDAP LDAPConfig
+}
+
+// NewCredentialVerifier creates the verifier for cfg.Backend. Only the
+// keycloak backend returns tokens; the others leave issuance to the caller.
+func NewCredentialVerifier(cfg VerifierConfig) (interfaces.CredentialVerifier, error) {
+	switch cfg.Backend {
+	case "", BackendKeycloak:
+		return NewKeycloakClient(cfg.KeycloakTokenURL, cfg.KeycloakClientID, cfg.KeycloakClientSecret), nil
+	case BackendLocal:
+		if cfg.LocalUsersFile == "" {
+			return nil, fmt.Errorf("the %s backend needs a users file", BackendLocal)
+		}
+		return LoadLocalUsers(cfg.LocalUsersFile)
+	case BackendLDAP:
+		return NewLDAPVerifier(cfg.LDAP)
+	default:
+		return nil, fmt.Errorf("unknown authentication backend %q", cfg.Backend)
+	}
+}
@@ -0,0 +1,308 @@
+// Package authz makes per-request authorization decisions independent of the
+// transport, so the sidecar proxy and the Envoy ext_authz server agree. With
+// a policy decision point they also share the policies of the HTTP API.
+package authz
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lsendel/impl-zamaz/pkg/auth"
+	"github.com/lsendel/impl-zamaz/pkg/i18n"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/policy"
+	"github.com/lsendel/impl-zamaz/pkg/trust"
+)
+
+// Identity headers injected into every authorized upstream request. Inbound
+// copies are always removed so clients cannot spoof them.
+const (
+	HeaderUserID     = "X-Zamaz-User-Id"
+	HeaderUsername   = "X-Zamaz-Username"
+	HeaderEmail      = "X-Zamaz-Email"
+	HeaderRoles      = "X-Zamaz-Roles"
+	HeaderTrustLevel = "X-Zamaz-Trust-Level"
+)
+
+// IdentityHeaderPrefix matches every header owned by impl-zamaz
+const IdentityHeaderPrefix = "X-Zamaz-"
+
+// ErrInvalidToken is returned by validators for inactive or unknown tokens
+var ErrInvalidToken = errors.New("authz: invalid token")
+
+// Identity is the validated caller of a request
+type Identity struct {
+	User       interfaces.UserInfo
+	TrustLevel int
+}
+
+// TokenValidator resolves a bearer token to an identity
+type TokenValidator interface {
+	ValidateToken(ctx context.Context, token string) (*Identity, error)
+}
+
+// Rule raises the requirements for requests under PathPrefix. The longest
+// matching prefix wins.
+type Rule struct {
+	PathPrefix string `json:"path_prefix"`
+	// Methods limits the rule to these HTTP methods; empty matches all
+	Methods       []string `json:"methods,omitempty"`
+	MinTrustLevel int      `json:"min_trust_level"`
+	// Roles requires the caller to hold at least one of these roles
+	Roles []string `json:"roles,omitempty"`
+	// Public skips authentication entirely
+	Public bool `json:"public,omitempty"`
+}
+
+// Config configures the authorizer
+type Config struct {
+	// MinTrustLevel applies to requests that match no rule
+	MinTrustLevel int
+	Rules         []Rule
+	Validator     TokenValidator
+	// Policies, when set, decides requests that pass the rules. A denial
+	// is 403 POLICY_DENIED, and so is a decision with an obligation, as
+	// obligations are fulfilled only by the HTTP middleware.
+	Policies *policy.DecisionPoint
+}
+
+// Request is the transport-neutral view of a request to authorize
+type Request struct {
+	Method string
+	Path   string
+	// Headers uses lower-case keys, as Envoy does
+	Headers map[string]string
+	// ClientIP is the caller's address, for policy conditions on ip and
+	// country; optional
+	ClientIP string
+}
+
+// Decision is the outcome of a check
+type Decision struct {
+	Allowed bool
+	// Status is the HTTP status to return to the client when denied
+	Status int
+	Code   string
+	// Message is localized from the request's Accept-Language
+	Message string
+	// Headers are set on the upstream request when allowed
+	Headers map[string]string
+	// RemoveHeaders are stripped from the upstream request when allowed
+	RemoveHeaders []string
+	// TrustLevel is the caller's, when authenticated
+	TrustLevel int
+}
+
+// Authorizer validates tokens and applies trust and role rules
+type Authorizer struct {
+	config  Config
+	logger  interfaces.Logger
+	metrics interfaces.MetricsCollector
+}
+
+// NewAuthorizer creates an authorizer; metrics may be nil
+func NewAuthorizer(cfg Config, logger interfaces.Logger, metrics interfaces.MetricsCollector) (*Authorizer, error) {
+	if cfg.Validator == nil {
+		return nil, errors.New("authz: a token validator is required")
+	}
+	return &Authorizer{config: cfg, logger: logger, metrics: metrics}, nil
+}
+
+// Check authorizes a single request
+func (a *Authorizer) Check(ctx context.Context, req Request) Decision {
+	path := req.Path
+	if i := strings.IndexAny(path, "?#"); i >= 0 {
+		path = path[:i]
+	}
+	lang := i18n.Negotiate(req.Headers["accept-language"])
+	rule := a.match(req.Method, path)
+	spoofed := identityHeaders(req.Headers)
+
+	if rule.Public {
+		a.count("allowed")
+		return Decision{Allowed: true, Status: http.StatusOK, RemoveHeaders: spoofed}
+	}
+
+	token, ok := bearerToken(req.Headers["authorization"])
+	if !ok {
+		return a.deny(lang, http.StatusUnauthorized, "UNAUTHORIZED")
+	}
+	if len(token) > auth.MaxTokenLength {
+		return a.deny(lang, http.StatusUnauthorized, "AUTH_001")
+	}
+
+	identity, err := a.config.Validator.ValidateToken(ctx, token)
+	if err != nil {
+		if !errors.Is(err, ErrInvalidToken) {
+			a.logger.Warn("Token validation failed", "error", err, "path", path)
+		}
+		return a.deny(lang, http.StatusUnauthorized, "AUTH_001")
+	}
+
+	if identity.TrustLevel < rule.MinTrustLevel {
+		a.logger.Info("Request denied for insufficient trust",
+			"user_id", identity.User.ID,
+			"path", path,
+			"trust_level", identity.TrustLevel,
+			"required", rule.MinTrustLevel)
+		return a.deny(lang, http.StatusForbidden, "INSUFFICIENT_TRUST")
+	}
+	if len(rule.Roles) > 0 && !hasAnyRole(identity.User.Roles, rule.Roles) {
+		a.logger.Info("Request denied for missing role",
+			"user_id", identity.User.ID,
+			"path", path,
+			"required_roles", rule.Roles)
+		return a.deny(lang, http.StatusForbidden, "INSUFFICIENT_ROLE")
+	}
+	if a.config.Policies != nil {
+		decision, err := a.config.Policies.Decide(ctx, a.policyRequest(req, path, identity))
+		if err != nil {
+			a.logger.Error("Failed to decide request by policy", "user_id", identity.User.ID, "path", path, "error", err)
+			return a.deny(lang, http.StatusServiceUnavailable, "INTERNAL_ERROR")
+		}
+		if !decision.Allowed {
+			a.logger.Info("Request denied by policy",
+				"user_id", identity.User.ID,
+				"path", path,
+				"policies", decision.Policies,
+				"reason", decision.Reason)
+			return a.deny(lang, http.StatusForbidden, "POLICY_DENIED")
+		}
+	}
+
+	a.count("allowed")
+	return Decision{
+		Allowed: true,
+		Status:  http.StatusOK,
+		Headers: map[string]string{
+			HeaderUserID:     identity.User.ID,
+			HeaderUsername:   identity.User.Username,
+			HeaderEmail:      identity.User.Email,
+			HeaderRoles:      strings.Join(identity.User.Roles, ","),
+			HeaderTrustLevel: strconv.Itoa(identity.TrustLevel),
+		},
+		RemoveHeaders: spoofed,
+		TrustLevel:    identity.TrustLevel,
+	}
+}
+
+// policyRequest is the document the policies decide for req: the caller's
+// roles, address, time and trust level, and the behavior signals of its
+// headers
+func (a *Authorizer) policyRequest(req Request, path string, identity *Identity) policy.Request {
+	attributes := map[string]string{
+		policy.AttributeRoles:      strings.Join(identity.User.Roles, ","),
+		policy.AttributeTime:       time.Now().UTC().Format(time.RFC3339),
+		policy.AttributeTrustScore: strconv.Itoa(identity.TrustLevel),
+	}
+	if req.ClientIP != "" {
+		attributes[policy.AttributeIP] = req.ClientIP
+	}
+	for signal, header := range map[string]string{
+		trust.SignalUserAgent:      "user-agent",
+		trust.SignalAcceptLanguage: "accept-language",
+	} {
+		if value := req.Headers[header]; value != "" {
+			attributes[signal] = value
+		}
+	}
+	return policy.Request{
+		Subject:  identity.User.ID,
+		Roles:    identity.User.Roles,
+		Resource: a.config.Policies.Resource(path),
+		Action:   policy.MethodAction(req.Method),
+		Context:  attributes,
+	}
+}
+
+// match returns the most specific rule for the request, or the default
+func (a *Authorizer) match(method, path string) Rule {
+	best := Rule{MinTrustLevel: a.config.MinTrustLevel}
+	bestLen := -1
+	for _, rule := range a.config.Rules {
+		if !strings.HasPrefix(path, rule.PathPrefix) || len(rule.PathPrefix) <= bestLen {
+			continue
+		}
+		if len(rule.Methods) > 0 && !containsFold(rule.Methods, method) {
+			continue
+		}
+		best, bestLen = rule, len(rule.PathPrefix)
+	}
+	return best
+}
+
+func (a *Authorizer) deny(lang string, status int, code string) Decision {
+	a.count("denied")
+	return Decision{
+		Status:  status,
+		Code:    code,
+		Message: i18n.Translate(lang, code),
+	}
+}
+
+func (a *Authorizer) count(outcome string) {
+	if a.metrics != nil {
+		a.metrics.IncrementCounter("authz_decisions_total", map[string]string{"outcome": outcome})
+	}
+}
+
+// identityHeaders lists inbound headers in the impl-zamaz namespace, which must
+// never reach the upstream from the client
+func identityHeaders(headers map[string]string) []string {
+	var names []string
+	for name := range headers {
+		if strings.HasPrefix(http.CanonicalHeaderKey(name), IdentityHeaderPrefix) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func bearerToken(header string) (string, bool) {
+	const prefix = "Bearer "
+	if len(header) <= len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", false
+	}
+	token := strings.TrimSpace(header[len(prefix):])
+	return token, token != ""
+}
+
+func hasAnyRole(have, want []string) bool {
+	for _, w := range want {
+		for _, h := range have {
+			if h == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadRules reads a JSON array of rules from path
+func LoadRules(path string) ([]Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []Rule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("invalid authorization rules in %s: %w", path, err)
+	}
+	return rules, nil
+}
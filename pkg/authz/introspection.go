@@ -0,0 +1,130 @@
+package authz
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+)
+
+// IntrospectionValidator validates tokens against an OAuth 2.0 token
+// introspection endpoint (RFC 7662), such as Keycloak's
+type IntrospectionValidator struct {
+	URL          string
+	ClientID     string
+	ClientSecret string
+	// TrustClaim names the introspection field holding the trust level
+	TrustClaim string
+	// DefaultTrustLevel is used when the response has no trust claim
+	DefaultTrustLevel int
+	Client            *http.Client
+}
+
+// NewIntrospectionValidator creates a validator with a bounded HTTP client
+func NewIntrospectionValidator(introspectionURL, clientID, clientSecret string) *IntrospectionValidator {
+	return &IntrospectionValidator{
+		URL:          introspectionURL,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		TrustClaim:   "trust_level",
+		Client:       &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// KeycloakIntrospectionURL returns the introspection endpoint of a Keycloak realm
+func KeycloakIntrospectionURL(baseURL, realm string) string {
+	return KeycloakRealmURL(baseURL, realm) + "/protocol/openid-connect/token/introspect"
+}
+
+// KeycloakAuthURL returns the authorization endpoint of a Keycloak realm
+func KeycloakAuthURL(baseURL, realm string) string {
+	return KeycloakRealmURL(baseURL, realm) + "/protocol/openid-connect/auth"
+}
+
+// KeycloakTokenURL returns the token endpoint of a Keycloak realm
+func KeycloakTokenURL(baseURL, realm string) string {
+	return KeycloakRealmURL(baseURL, realm) + "/protocol/openid-connect/token"
+}
+
+// KeycloakRealmURL returns the base URL of a Keycloak realm, which is also
+// its issuer identifier
+func KeycloakRealmURL(baseURL, realm string) string {
+	return strings.TrimRight(baseURL, "/") + "/realms/" + url.PathEscape(realm)
+}
+
+type introspectionResponse struct {
+	Active            bool   `json:"active"`
+	Subject           string `json:"sub"`
+	Username          string `json:"username"`
+	PreferredUsername string `json:"preferred_username"`
+	Email             string `json:"email"`
+	RealmAccess       struct {
+		Roles []string `json:"roles"`
+	} `json:"realm_access"`
+}
+
+// ValidateToken implements TokenValidator
+func (v *IntrospectionValidator) ValidateToken(ctx context.Context, token string) (*Identity, error) {
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(v.ClientID), url.QueryEscape(v.ClientSecret))
+
+	resp, err := v.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("introspection request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("introspection endpoint returned status %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read introspection response: %w", err)
+	}
+	var body introspectionResponse
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &body); err != nil {
+		return nil, fmt.Errorf("invalid introspection response: %w", err)
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("invalid introspection response: %w", err)
+	}
+	if !body.Active {
+		return nil, ErrInvalidToken
+	}
+
+	username := body.PreferredUsername
+	if username == "" {
+		username = body.Username
+	}
+	identity := &Identity{
+		User: interfaces.UserInfo{
+			ID:       body.Subject,
+			Username: username,
+			Email:    body.Email,
+			Roles:    body.RealmAccess.Roles,
+		},
+		TrustLevel: v.DefaultTrustLevel,
+	}
+	if claim, ok := raw[v.TrustClaim]; ok && v.TrustClaim != "" {
+		var level float64
+		if err := json.Unmarshal(claim, &level); err != nil {
+			return nil, fmt.Errorf("invalid %s claim: %w", v.TrustClaim, err)
+		}
+		identity.TrustLevel = int(level)
+	}
+	return identity, nil
+}
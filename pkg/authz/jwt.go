@@ -0,0 +1,131 @@
+package authz
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/lsendel/impl-zamaz/pkg/auth"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+)
+
+// JWTValidator validates IdP-issued JWTs locally against the IdP's published
+// keys, avoiding a network round trip per request
+type JWTValidator struct {
+	Keys   *auth.JWKSClient
+	Issuer string
+	// Audience is checked when set
+	Audience string
+	// TrustClaim names the claim holding the trust level
+	TrustClaim string
+	// DefaultTrustLevel is used when the token has no trust claim
+	DefaultTrustLevel int
+	// Leeway tolerates clock skew on exp and nbf
+	Leeway time.Duration
+	now    func() time.Time
+}
+
+// NewJWTValidator creates a validator for tokens from issuer
+func NewJWTValidator(keys *auth.JWKSClient, issuer, audience string) *JWTValidator {
+	return &JWTValidator{
+		Keys:       keys,
+		Issuer:     issuer,
+		Audience:   audience,
+		TrustClaim: "trust_level",
+		Leeway:     30 * time.Second,
+		now:        time.Now,
+	}
+}
+
+// KeycloakJWKSURL returns the JWKS endpoint of a Keycloak realm
+func KeycloakJWKSURL(baseURL, realm string) string {
+	return KeycloakRealmURL(baseURL, realm) + "/protocol/openid-connect/certs"
+}
+
+// ValidateToken implements TokenValidator
+func (v *JWTValidator) ValidateToken(ctx context.Context, token string) (*Identity, error) {
+	parsed, err := v.Keys.Verify(ctx, token)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	claims := parsed.Claims
+
+	if iss, _ := claims["iss"].(string); iss != v.Issuer {
+		return nil, fmt.Errorf("%w: unexpected issuer %q", ErrInvalidToken, iss)
+	}
+	if v.Audience != "" && !hasAudience(claims["aud"], v.Audience) {
+		return nil, fmt.Errorf("%w: audience mismatch", ErrInvalidToken)
+	}
+
+	now := v.now()
+	exp, ok := numericClaim(claims["exp"])
+	if !ok || now.After(time.Unix(exp, 0).Add(v.Leeway)) {
+		return nil, fmt.Errorf("%w: token expired", ErrInvalidToken)
+	}
+	if nbf, ok := numericClaim(claims["nbf"]); ok && now.Add(v.Leeway).Before(time.Unix(nbf, 0)) {
+		return nil, fmt.Errorf("%w: token not yet valid", ErrInvalidToken)
+	}
+
+	identity := &Identity{
+		User: interfaces.UserInfo{
+			ID:       stringClaim(claims["sub"]),
+			Username: stringClaim(claims["preferred_username"]),
+			Email:    stringClaim(claims["email"]),
+			Roles:    realmRoles(claims),
+		},
+		TrustLevel: v.DefaultTrustLevel,
+	}
+	if level, ok := numericClaim(claims[v.TrustClaim]); ok && v.TrustClaim != "" {
+		identity.TrustLevel = int(level)
+	}
+	return identity, nil
+}
+
+func numericClaim(v interface{}) (int64, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	if i, err := n.Int64(); err == nil {
+		return i, true
+	}
+	f, err := n.Float64()
+	return int64(f), err == nil
+}
+
+func stringClaim(v interface{}) string {
+	s, _ := v.(string)
+	return s
+}
+
+func hasAudience(aud interface{}, want string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == want
+	case []interface{}:
+		for _, item := range a {
+			if item == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// realmRoles reads Keycloak's realm_access.roles, falling back to a flat
+// roles claim
+func realmRoles(claims map[string]interface{}) []string {
+	source := claims["roles"]
+	if access, ok := claims["realm_access"].(map[string]interface{}); ok {
+		source = access["roles"]
+	}
+	list, _ := source.([]interface{})
+	roles := make([]string, 0, len(list))
+	for _, item := range list {
+		if role, ok := item.(string); ok {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
@@ -0,0 +1,334 @@
+package device
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lsendel/impl-zamaz/pkg/i18n"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+	"github.com/lsendel/impl-zamaz/pkg/trust"
+)
+
+// HeaderDeviceAssertion carries a request's device assertion: a base64url
+// JSON Assertion signed by the device's bound key
+const HeaderDeviceAssertion = "X-Device-Assertion"
+
+// Store keys of pending binding challenges by device, and of assertion
+// challenges already answered
+const (
+	challengePrefix = "device:challenge:"
+	assertionPrefix = "device:assertion:"
+)
+
+// challengeTTL is how long a binding challenge can be answered
+const challengeTTL = 5 * time.Minute
+
+// ErrInvalidProof is returned when a device fails to prove it holds a key
+var ErrInvalidProof = errors.New("invalid proof of key possession")
+
+// Proof is a signature over a challenge by a device key. Keys in a TPM,
+// such as a Windows CNG or Linux tpm2 key, sign the challenge's bytes
+// directly; platform authenticators sign a WebAuthn assertion whose client
+// data carries the challenge. Values are base64url.
+type Proof struct {
+	Signature string `json:"signature"`
+	// AuthenticatorData and ClientDataJSON are set for WebAuthn assertions
+	AuthenticatorData string `json:"authenticator_data,omitempty"`
+	ClientDataJSON    string `json:"client_data_json,omitempty"`
+}
+
+// Binding binds a device to a hardware-backed key, proving the device holds
+// it by signing the challenge from Challenge
+type Binding struct {
+	// PublicKey is the key's base64 DER SubjectPublicKeyInfo, as WebAuthn's
+	// getPublicKey() returns it; P-256 and RSA keys are supported
+	PublicKey string `json:"public_key"`
+	Proof
+}
+
+// Assertion is what a bound device sends with each request, proving the
+// request comes from it. Its proof signs AssertionChallenge.
+type Assertion struct {
+	DeviceID string `json:"device_id"`
+	// Timestamp is when the assertion was made, in Unix seconds
+	Timestamp int64 `json:"timestamp"`
+	Proof
+}
+
+// AssertionChallenge is the challenge a device signs to assert a request:
+// the base64url SHA-256 of
+//
+//	METHOD \n PATH?QUERY \n DEVICE_ID \n TIMESTAMP
+func AssertionChallenge(method, uri, deviceID string, timestamp int64) string {
+	sum := sha256.Sum256([]byte(method + "\n" + uri + "\n" + deviceID + "\n" + strconv.FormatInt(timestamp, 10)))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Challenge starts binding owner's device id to a key, returning the
+// base64url challenge the key must sign within five minutes
+func (r *Registry) Challenge(ctx context.Context, owner, id string) (string, error) {
+	if _, err := r.Get(ctx, owner, id); err != nil {
+		return "", err
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	challenge := base64.RawURLEncoding.EncodeToString(b)
+	if err := r.store.Set(ctx, challengePrefix+id, []byte(challenge), challengeTTL); err != nil {
+		return "", err
+	}
+	return challenge, nil
+}
+
+// Bind binds owner's device id to the binding's key once it proves holding
+// it. Each challenge can be answered once.
+func (r *Registry) Bind(ctx context.Context, owner, id string, binding Binding) (*interfaces.DeviceInfo, error) {
+	der, err := decodeBase64(binding.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: public key is not base64", ErrInvalid)
+	}
+	key, err := parsePublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	if _, err := r.Get(ctx, owner, id); err != nil {
+		return nil, err
+	}
+	challenge, err := r.store.Get(ctx, challengePrefix+id)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, fmt.Errorf("%w: no pending challenge", ErrInvalidProof)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := r.store.Delete(ctx, challengePrefix+id); err != nil {
+		return nil, err
+	}
+	if err := verifyProof(key, string(challenge), binding.Proof, r.config.RPID); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidProof, err)
+	}
+	return r.update(ctx, owner, id, func(device *interfaces.DeviceInfo) {
+		now := r.now().UTC()
+		device.PublicKey, device.BoundAt = base64.StdEncoding.EncodeToString(der), &now
+	})
+}
+
+// AssertionConfig configures AssertionMiddleware
+type AssertionConfig struct {
+	// Window is the accepted clock skew either side of the server time;
+	// assertions are remembered for twice as long. Defaults to 1m.
+	Window time.Duration
+}
+
+// AssertionMiddleware checks the device assertion of requests carrying
+// X-Device-Assertion and rejects invalid, stale and replayed ones with 401,
+// and those of blocked devices with 403.
+// A valid assertion is left under trust.BoundDeviceKey, so trust scores
+// count the request as coming from a hardware-bound device of its owner.
+// Requests without the header are passed through.
+func (r *Registry) AssertionMiddleware(cfg AssertionConfig, logger interfaces.Logger, metrics interfaces.MetricsCollector) gin.HandlerFunc {
+	if cfg.Window <= 0 {
+		cfg.Window = time.Minute
+	}
+	reject := func(c *gin.Context, deviceID, code string) {
+		logger.Warn("Device assertion rejected", "device_id", deviceID, "code", code, "path", c.Request.URL.Path, "ip", c.ClientIP())
+		if metrics != nil {
+			metrics.IncrementCounter("device_assertions_rejected_total", map[string]string{"code": code})
+		}
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+			"error": i18n.Message(c, code),
+			"code":  code,
+		})
+	}
+
+	return func(c *gin.Context) {
+		header := c.GetHeader(HeaderDeviceAssertion)
+		if header == "" {
+			c.Next()
+			return
+		}
+		var assertion Assertion
+		raw, err := decodeBase64(header)
+		if err != nil || json.Unmarshal(raw, &assertion) != nil || assertion.DeviceID == "" {
+			reject(c, "", "DEVICE_ASSERTION_INVALID")
+			return
+		}
+		ctx := c.Request.Context()
+		info, _, err := r.read(ctx, assertion.DeviceID)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			// The assertion only adds trust, so the request goes on without it
+			logger.Error("Failed to load device for assertion", "device_id", assertion.DeviceID, "error", err)
+			c.Next()
+			return
+		}
+		if err != nil || info.PublicKey == "" {
+			reject(c, assertion.DeviceID, "DEVICE_ASSERTION_INVALID")
+			return
+		}
+		der, err := decodeBase64(info.PublicKey)
+		if err != nil {
+			reject(c, info.ID, "DEVICE_ASSERTION_INVALID")
+			return
+		}
+		key, err := parsePublicKey(der)
+		if err != nil {
+			reject(c, info.ID, "DEVICE_ASSERTION_INVALID")
+			return
+		}
+		challenge := AssertionChallenge(c.Request.Method, c.Request.URL.RequestURI(), info.ID, assertion.Timestamp)
+		if err := verifyProof(key, challenge, assertion.Proof, r.config.RPID); err != nil {
+			reject(c, info.ID, "DEVICE_ASSERTION_INVALID")
+			return
+		}
+
+		// Check freshness only after the signature so the timestamp is trusted
+		if skew := time.Since(time.Unix(assertion.Timestamp, 0)); skew > cfg.Window || skew < -cfg.Window {
+			reject(c, info.ID, "REQUEST_EXPIRED")
+			return
+		}
+		// Remember the challenge rather than the signature, which a replay
+		// could alter without invalidating it
+		fresh, err := r.store.CompareAndSwap(ctx, assertionPrefix+challenge, nil, []byte(info.ID), 2*cfg.Window)
+		if err != nil {
+			logger.Error("Device assertion cache unavailable", "device_id", info.ID, "error", err)
+			c.Next()
+			return
+		}
+		if !fresh {
+			reject(c, info.ID, "REQUEST_REPLAYED")
+			return
+		}
+
+		if info.State == StateBlocked {
+			logger.Warn("Blocked device asserted a request", "device_id", info.ID, "path", c.Request.URL.Path, "ip", c.ClientIP())
+			if metrics != nil {
+				metrics.IncrementCounter("device_assertions_rejected_total", map[string]string{"code": "DEVICE_BLOCKED"})
+			}
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"error": i18n.Message(c, "DEVICE_BLOCKED"),
+				"code":  "DEVICE_BLOCKED",
+			})
+			return
+		}
+		if metrics != nil {
+			metrics.IncrementCounter("device_assertions_verified_total", nil)
+		}
+		if seen, err := r.touch(ctx, info); err == nil {
+			info = seen
+		} else {
+			logger.Warn("Failed to record device as seen", "device_id", info.ID, "error", err)
+		}
+		c.Set(trust.BoundDeviceKey, info)
+		c.Next()
+	}
+}
+
+// verifyProof checks that key signed challenge, directly or in a WebAuthn
+// assertion scoped to rpID when it is set
+func verifyProof(key crypto.PublicKey, challenge string, proof Proof, rpID string) error {
+	signature, err := decodeBase64(proof.Signature)
+	if err != nil {
+		return errors.New("signature is not base64")
+	}
+	signed, err := base64.RawURLEncoding.DecodeString(challenge)
+	if err != nil {
+		return errors.New("malformed challenge")
+	}
+	if proof.ClientDataJSON != "" {
+		clientDataJSON, err := decodeBase64(proof.ClientDataJSON)
+		if err != nil {
+			return errors.New("client data is not base64")
+		}
+		authenticatorData, err := decodeBase64(proof.AuthenticatorData)
+		if err != nil || len(authenticatorData) < 37 {
+			return errors.New("malformed authenticator data")
+		}
+		var clientData struct {
+			Type      string `json:"type"`
+			Challenge string `json:"challenge"`
+		}
+		if err := json.Unmarshal(clientDataJSON, &clientData); err != nil {
+			return errors.New("malformed client data")
+		}
+		if clientData.Type != "webauthn.get" || strings.TrimRight(clientData.Challenge, "=") != challenge {
+			return errors.New("client data is not an assertion of the challenge")
+		}
+		if rpID != "" {
+			rpIDHash := sha256.Sum256([]byte(rpID))
+			if !bytes.Equal(authenticatorData[:32], rpIDHash[:]) {
+				return errors.New("key scoped to another relying party")
+			}
+		}
+		clientDataHash := sha256.Sum256(clientDataJSON)
+		signed = append(authenticatorData, clientDataHash[:]...)
+	}
+
+	digest := sha256.Sum256(signed)
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		// TPMs and CNG produce R || S; WebAuthn produces ASN.1
+		if len(signature) == 64 {
+			r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+			if ecdsa.Verify(k, digest[:], r, s) {
+				return nil
+			}
+		} else if ecdsa.VerifyASN1(k, digest[:], signature) {
+			return nil
+		}
+	case *rsa.PublicKey:
+		if rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], signature) == nil {
+			return nil
+		}
+	}
+	return errors.New("signature verification failed")
+}
+
+// parsePublicKey reads a DER SubjectPublicKeyInfo of a P-256 or RSA key
+func parsePublicKey(der []byte) (crypto.PublicKey, error) {
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, errors.New("public key is not a DER SubjectPublicKeyInfo")
+	}
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return nil, errors.New("EC keys must use P-256")
+		}
+	case *rsa.PublicKey:
+		if k.N.BitLen() < 2048 {
+			return nil, errors.New("RSA keys need at least 2048 bits")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	return key, nil
+}
+
+// decodeBase64 accepts standard and URL-safe base64, padded or not
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.TrimRight(s, "=")
+	if strings.ContainsAny(s, "+/") {
+		return base64.RawStdEncoding.DecodeString(s)
+	}
+	return base64.RawURLEncoding.DecodeString(s)
+}
@@ -0,0 +1,69 @@
+package device
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+// Filter selects devices to export; empty fields match every device
+type Filter struct {
+	OwnerID           string
+	Platform          string
+	AttestationStatus string
+	State             string
+	Compliance        string
+}
+
+// Matches reports whether device passes the filter
+func (f Filter) Matches(device *interfaces.DeviceInfo) bool {
+	return (f.OwnerID == "" || device.OwnerID == f.OwnerID) &&
+		(f.Platform == "" || strings.EqualFold(device.Platform, f.Platform)) &&
+		(f.AttestationStatus == "" || device.AttestationStatus == f.AttestationStatus) &&
+		(f.State == "" || stateOf(device.State) == f.State) &&
+		(f.Compliance == "" || device.Compliance == f.Compliance)
+}
+
+// Export returns every device passing filter, whoever owns it, oldest
+// first. It is meant for administrators taking inventory snapshots.
+func (r *Registry) Export(ctx context.Context, filter Filter) ([]*interfaces.DeviceInfo, error) {
+	keys, err := r.store.Keys(ctx, devicePrefix)
+	if err != nil {
+		return nil, err
+	}
+	devices := make([]*interfaces.DeviceInfo, 0, len(keys))
+	for _, key := range keys {
+		device, _, err := r.read(ctx, strings.TrimPrefix(key, devicePrefix))
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if filter.Matches(device) {
+			devices = append(devices, device)
+		}
+	}
+	sortDevices(devices)
+	return devices, nil
+}
+
+// Check reports whether Register would accept reg for owner, without
+// registering it
+func (r *Registry) Check(ctx context.Context, owner string, reg Registration) error {
+	if err := reg.Validate(); err != nil {
+		return err
+	}
+	_, err := r.store.Get(ctx, fingerprintKey(owner, reg.Fingerprint))
+	switch {
+	case err == nil:
+		return ErrDuplicate
+	case errors.Is(err, store.ErrNotFound):
+		return nil
+	default:
+		return err
+	}
+}
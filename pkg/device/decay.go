@@ -0,0 +1,174 @@
+package device
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+)
+
+// Device states. Devices lose trust while stale; quarantined devices have
+// none until they pass Verify again, and blocked devices none for good.
+const (
+	StateActive      = "active"
+	StateStale       = "stale"
+	StateQuarantined = "quarantined"
+	StateBlocked     = "blocked"
+)
+
+// decayLease makes one replica sweep the devices per round
+const decayLease = "device:decay:lease"
+
+// touchInterval bounds how often Touch records an active device as seen
+const touchInterval = time.Minute
+
+// Touch records that owner's device id was seen, e.g. when its agent
+// reports in, making a stale device active again. Quarantined devices stay
+// quarantined until verified.
+func (r *Registry) Touch(ctx context.Context, owner, id string) (*interfaces.DeviceInfo, error) {
+	device, err := r.Get(ctx, owner, id)
+	if err != nil {
+		return nil, err
+	}
+	return r.touch(ctx, device)
+}
+
+// touch records device as seen unless it was seen moments ago
+func (r *Registry) touch(ctx context.Context, device *interfaces.DeviceInfo) (*interfaces.DeviceInfo, error) {
+	now := r.now().UTC()
+	if stateOf(device.State) == StateActive && device.LastSeenAt != nil && now.Sub(*device.LastSeenAt) < touchInterval {
+		return device, nil
+	}
+	var from string
+	device, err := r.update(ctx, device.OwnerID, device.ID, func(device *interfaces.DeviceInfo) {
+		from = device.State
+		device.LastSeenAt = &now
+		if stateOf(device.State) == StateStale {
+			device.State = StateActive
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	r.transitioned(ctx, device, from)
+	return device, nil
+}
+
+// Decay makes devices unseen for StaleAfter stale and those unseen for
+// QuarantineAfter quarantined, returning how many changed state. Stale
+// devices keep half their last trust score and quarantined ones none.
+func (r *Registry) Decay(ctx context.Context) (int, error) {
+	keys, err := r.store.Keys(ctx, devicePrefix)
+	if err != nil {
+		return 0, err
+	}
+	changed := 0
+	var errs []error
+	for _, key := range keys {
+		device, _, err := r.read(ctx, strings.TrimPrefix(key, devicePrefix))
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if r.decayedState(device) == stateOf(device.State) {
+			continue
+		}
+		var from string
+		device, err = r.update(ctx, device.OwnerID, device.ID, func(device *interfaces.DeviceInfo) {
+			from = device.State
+			switch device.State = r.decayedState(device); device.State {
+			case StateQuarantined:
+				device.TrustScore = 0
+			case StateStale:
+				device.TrustScore /= 2
+			}
+		})
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if r.transitioned(ctx, device, from) {
+			changed++
+		}
+	}
+	return changed, errors.Join(errs...)
+}
+
+// StartDecay runs Decay every interval until ctx is cancelled. Only one
+// replica runs each round.
+func (r *Registry) StartDecay(ctx context.Context, interval time.Duration, logger interfaces.Logger) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				n, _, err := r.store.Incr(ctx, decayLease, interval*9/10)
+				if err != nil {
+					logger.Warn("Failed to acquire device decay lease", "error", err)
+					continue
+				}
+				if n != 1 {
+					continue
+				}
+				changed, err := r.Decay(ctx)
+				if err != nil {
+					logger.Warn("Device decay failed", "error", err)
+				}
+				if changed > 0 {
+					logger.Info("Devices decayed", "changed", changed)
+				}
+			}
+		}
+	}()
+}
+
+// decayedState is the state device is due for; decay never makes a device
+// more trusted
+func (r *Registry) decayedState(device *interfaces.DeviceInfo) string {
+	seen := device.RegisteredAt
+	if device.LastSeenAt != nil {
+		seen = *device.LastSeenAt
+	}
+	idle, state := r.now().Sub(seen), stateOf(device.State)
+	switch {
+	case state == StateBlocked:
+		return StateBlocked
+	case state == StateQuarantined || idle >= r.config.QuarantineAfter:
+		return StateQuarantined
+	case idle >= r.config.StaleAfter:
+		return StateStale
+	}
+	return state
+}
+
+// transitioned reports whether device changed state from from, calling
+// OnTransition if so
+func (r *Registry) transitioned(ctx context.Context, device *interfaces.DeviceInfo, from string) bool {
+	if from = stateOf(from); stateOf(device.State) == from {
+		return false
+	}
+	if r.config.OnTransition != nil {
+		r.config.OnTransition(ctx, device, from)
+	}
+	return true
+}
+
+// stateOf normalizes a device's state; devices registered before states
+// were kept are active
+func stateOf(state string) string {
+	if state == "" {
+		return StateActive
+	}
+	return state
+}
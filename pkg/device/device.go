@@ -0,0 +1,559 @@
+// Package device keeps the registry of user devices: what each device is,
+// who owns it and whether it passed attestation. Devices live in the shared
+// store, so every replica sees the same registry and it survives restarts
+// with a persistent backend such as Redis.
+package device
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+// Errors returned by Registry
+var (
+	ErrNotFound = errors.New("device not found")
+	// ErrDuplicate is returned when the owner already registered a device
+	// with the same fingerprint
+	ErrDuplicate = errors.New("device already registered")
+	ErrInvalid   = errors.New("invalid device")
+	// ErrConflict is returned when another replica is changing the same
+	// device; the request can be retried
+	ErrConflict = errors.New("device is being modified concurrently")
+	// ErrBlocked is returned when acting on a blocked device, which can
+	// neither be verified nor quarantined
+	ErrBlocked = errors.New("device is blocked")
+	// ErrAttestationUnavailable is returned when the attestation service
+	// cannot be reached; the device can be verified again later
+	ErrAttestationUnavailable = errors.New("attestation unavailable")
+)
+
+// Attestation statuses
+const (
+	AttestationPending  = "pending"
+	AttestationVerified = "verified"
+	AttestationFailed   = "failed"
+)
+
+// Integrity levels platform attestation vouches for, strongest first
+const (
+	// IntegrityStrong is hardware-backed proof of an unmodified device
+	IntegrityStrong = "strong"
+	// IntegrityDevice is a genuine, unmodified device
+	IntegrityDevice = "device"
+	// IntegrityBasic is a device that may be rooted or emulated
+	IntegrityBasic = "basic"
+)
+
+// Compliance statuses reported by MDM
+const (
+	ComplianceCompliant    = "compliant"
+	ComplianceNoncompliant = "noncompliant"
+	ComplianceUnknown      = "unknown"
+)
+
+// Platforms lists the platforms devices may be registered with
+var Platforms = []string{"android", "ios", "linux", "macos", "windows"}
+
+// Store keys: the device by ID, an index of each owner's devices and the
+// owner's fingerprints, which keeps them unique per owner. Owners and
+// fingerprints are hashed to bound the keys.
+const (
+	devicePrefix      = "device:id:"
+	ownerPrefix       = "device:owner:"
+	fingerprintPrefix = "device:fingerprint:"
+)
+
+// updateAttempts bounds optimistic retries when replicas update a device
+const updateAttempts = 3
+
+// Limits on registered values
+const (
+	maxNameLength        = 128
+	maxFingerprintLength = 512
+)
+
+// Config configures the registry
+type Config struct {
+	// Attestor checks attestation evidence; defaults to FingerprintAttestor
+	Attestor Attestor
+	// MaxPageSize bounds List pages; defaults to 100
+	MaxPageSize int
+	// RPID, when set, is the WebAuthn relying party ID device keys must be
+	// scoped to, e.g. "example.com"
+	RPID string
+	// StaleAfter and QuarantineAfter are how long a device may go unseen
+	// before Decay makes it stale or quarantines it; default to 30 and 90
+	// days
+	StaleAfter      time.Duration
+	QuarantineAfter time.Duration
+	// OnTransition, when set, is called when a device changes State, e.g.
+	// to record it in the audit log
+	OnTransition func(ctx context.Context, device *interfaces.DeviceInfo, from string)
+	// Mailer sends the codes of email verifications, which are unavailable
+	// without one
+	Mailer interfaces.EmailSender
+	// VerificationTTL bounds how long a verification can be answered;
+	// defaults to 10m
+	VerificationTTL time.Duration
+	// MaxVerificationAttempts wrong codes fail an email verification;
+	// defaults to 5
+	MaxVerificationAttempts int
+	// OnVerification, when set, is called when a verification is started
+	// and when it is decided, e.g. to record it in the audit log
+	OnVerification func(ctx context.Context, v *Verification)
+	// UnknownDeviceTTL is how long a sighting of an unknown device is kept
+	// after its last login, during which it is not reported again;
+	// defaults to 30 days
+	UnknownDeviceTTL time.Duration
+	// OnUnknownDevice, when set, is called on the first login from an
+	// unknown device, e.g. to alert the security team
+	OnUnknownDevice func(ctx context.Context, sighting *Sighting)
+	// OnDeviceConfirmed, when set, is called when a device is verified
+	// that logins came from while it was unknown
+	OnDeviceConfirmed func(ctx context.Context, sighting *Sighting, device *interfaces.DeviceInfo)
+}
+
+// Registration describes a device being registered or updated
+type Registration struct {
+	Name        string `json:"name"`
+	Platform    string `json:"platform"`
+	Fingerprint string `json:"fingerprint"`
+	// Attestation, when set, is a platform attestation token verified
+	// right after registering, requested with Nonce
+	Attestation string `json:"attestation,omitempty"`
+	Nonce       string `json:"nonce,omitempty"`
+}
+
+// Validate checks the registration, normalizing the platform
+func (r *Registration) Validate() error {
+	r.Name = strings.TrimSpace(r.Name)
+	r.Platform = strings.ToLower(strings.TrimSpace(r.Platform))
+	switch {
+	case len(r.Name) > maxNameLength:
+		return fmt.Errorf("%w: name longer than %d characters", ErrInvalid, maxNameLength)
+	case !contains(Platforms, r.Platform):
+		return fmt.Errorf("%w: platform must be one of %s", ErrInvalid, strings.Join(Platforms, ", "))
+	case r.Fingerprint == "":
+		return fmt.Errorf("%w: fingerprint is required", ErrInvalid)
+	case len(r.Fingerprint) > maxFingerprintLength:
+		return fmt.Errorf("%w: fingerprint longer than %d characters", ErrInvalid, maxFingerprintLength)
+	}
+	return nil
+}
+
+// Evidence is what a device presents to be verified
+type Evidence struct {
+	Fingerprint string `json:"fingerprint"`
+	// Attestation is a platform attestation, such as a TPM quote or an
+	// Android key attestation, for attestors that check one
+	Attestation string `json:"attestation,omitempty"`
+	// Nonce is the server challenge the attestation was requested with
+	Nonce string `json:"nonce,omitempty"`
+}
+
+// Verdict is an Attestor's decision
+type Verdict struct {
+	Verified bool
+	// Integrity is one of the Integrity levels, or empty when the evidence
+	// says nothing about the device's integrity
+	Integrity string
+	// Reason says why evidence was rejected
+	Reason string
+}
+
+// Attestor decides whether evidence proves a device is the one registered.
+// Evidence that fails is a Verdict that is not Verified; errors are for
+// attestation being unavailable.
+type Attestor interface {
+	Attest(ctx context.Context, device *interfaces.DeviceInfo, evidence Evidence) (Verdict, error)
+}
+
+// FingerprintAttestor verifies devices that present their registered
+// fingerprint. It stands in for platform attestation until one is
+// configured.
+type FingerprintAttestor struct{}
+
+// Attest implements Attestor
+func (FingerprintAttestor) Attest(_ context.Context, device *interfaces.DeviceInfo, evidence Evidence) (Verdict, error) {
+	if !MatchFingerprint(device, evidence) {
+		return Verdict{Reason: "fingerprint mismatch"}, nil
+	}
+	return Verdict{Verified: true}, nil
+}
+
+// MatchFingerprint reports whether evidence presents device's fingerprint
+func MatchFingerprint(device *interfaces.DeviceInfo, evidence Evidence) bool {
+	return subtle.ConstantTimeCompare([]byte(device.Fingerprint), []byte(evidence.Fingerprint)) == 1
+}
+
+// Registry stores devices. Every operation is bound to the owner, so users
+// only ever see their own devices.
+type Registry struct {
+	config Config
+	store  store.Store
+	now    func() time.Time
+}
+
+// NewRegistry creates a registry on s
+func NewRegistry(cfg Config, s store.Store) *Registry {
+	if cfg.Attestor == nil {
+		cfg.Attestor = FingerprintAttestor{}
+	}
+	if cfg.MaxPageSize <= 0 {
+		cfg.MaxPageSize = 100
+	}
+	if cfg.StaleAfter <= 0 {
+		cfg.StaleAfter = 30 * 24 * time.Hour
+	}
+	if cfg.QuarantineAfter <= 0 {
+		cfg.QuarantineAfter = 90 * 24 * time.Hour
+	}
+	if cfg.VerificationTTL <= 0 {
+		cfg.VerificationTTL = 10 * time.Minute
+	}
+	if cfg.MaxVerificationAttempts <= 0 {
+		cfg.MaxVerificationAttempts = 5
+	}
+	if cfg.UnknownDeviceTTL <= 0 {
+		cfg.UnknownDeviceTTL = 30 * 24 * time.Hour
+	}
+	return &Registry{config: cfg, store: s, now: time.Now}
+}
+
+// Register adds a device for owner. Its attestation is pending until
+// Verify, which runs right away when the registration carries an
+// attestation; the device then stays pending if attestation is unavailable,
+// so it can be verified later.
+func (r *Registry) Register(ctx context.Context, owner string, reg Registration) (*interfaces.DeviceInfo, error) {
+	if err := reg.Validate(); err != nil {
+		return nil, err
+	}
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.claimFingerprint(ctx, owner, reg.Fingerprint, id); err != nil {
+		return nil, err
+	}
+	now := r.now().UTC()
+	device := &interfaces.DeviceInfo{
+		ID:                id,
+		OwnerID:           owner,
+		Name:              reg.Name,
+		Platform:          reg.Platform,
+		Fingerprint:       reg.Fingerprint,
+		AttestationStatus: AttestationPending,
+		RegisteredAt:      now,
+		UpdatedAt:         now,
+		State:             StateActive,
+		LastSeenAt:        &now,
+	}
+	data, err := json.Marshal(device)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.store.Set(ctx, devicePrefix+id, data, 0); err != nil {
+		return nil, err
+	}
+	if err := r.store.Set(ctx, ownerPrefix+hashKey(owner)+":"+id, []byte(id), 0); err != nil {
+		return nil, err
+	}
+	if reg.Attestation != "" {
+		if verified, err := r.Verify(ctx, owner, id, Evidence{Fingerprint: reg.Fingerprint, Attestation: reg.Attestation, Nonce: reg.Nonce}); err == nil {
+			return verified, nil
+		}
+	}
+	return device, nil
+}
+
+// Get returns owner's device id, or ErrNotFound
+func (r *Registry) Get(ctx context.Context, owner, id string) (*interfaces.DeviceInfo, error) {
+	device, _, err := r.load(ctx, owner, id)
+	return device, err
+}
+
+// Lookup returns device id whoever owns it. It is meant for administrators.
+func (r *Registry) Lookup(ctx context.Context, id string) (*interfaces.DeviceInfo, error) {
+	device, _, err := r.read(ctx, id)
+	return device, err
+}
+
+// List returns a page of owner's devices, oldest first, and how many the
+// owner has. Pages start at 1.
+func (r *Registry) List(ctx context.Context, owner string, page, pageSize int) ([]*interfaces.DeviceInfo, int, error) {
+	if page < 1 || pageSize < 1 || pageSize > r.config.MaxPageSize {
+		return nil, 0, fmt.Errorf("%w: page must be at least 1 and page_size between 1 and %d", ErrInvalid, r.config.MaxPageSize)
+	}
+	devices, err := r.ownerDevices(ctx, owner)
+	if err != nil {
+		return nil, 0, err
+	}
+	total := len(devices)
+	start := (page - 1) * pageSize
+	if start >= total {
+		return []*interfaces.DeviceInfo{}, total, nil
+	}
+	end := start + pageSize
+	if end > total {
+		end = total
+	}
+	return devices[start:end], total, nil
+}
+
+// ownerDevices returns every device of owner, oldest first
+func (r *Registry) ownerDevices(ctx context.Context, owner string) ([]*interfaces.DeviceInfo, error) {
+	prefix := ownerPrefix + hashKey(owner) + ":"
+	keys, err := r.store.Keys(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	devices := make([]*interfaces.DeviceInfo, 0, len(keys))
+	for _, key := range keys {
+		device, err := r.Get(ctx, owner, strings.TrimPrefix(key, prefix))
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+	sortDevices(devices)
+	return devices, nil
+}
+
+// Update replaces the name, platform and fingerprint of owner's device id.
+// A new fingerprint makes the device pending attestation again.
+func (r *Registry) Update(ctx context.Context, owner, id string, reg Registration) (*interfaces.DeviceInfo, error) {
+	if err := reg.Validate(); err != nil {
+		return nil, err
+	}
+	current, err := r.Get(ctx, owner, id)
+	if err != nil {
+		return nil, err
+	}
+	changed := current.Fingerprint != reg.Fingerprint
+	if changed {
+		if err := r.claimFingerprint(ctx, owner, reg.Fingerprint, id); err != nil {
+			return nil, err
+		}
+	}
+	device, err := r.update(ctx, owner, id, func(device *interfaces.DeviceInfo) {
+		device.Name, device.Platform = reg.Name, reg.Platform
+		if device.Fingerprint != reg.Fingerprint {
+			device.Fingerprint = reg.Fingerprint
+			device.AttestationStatus, device.Integrity, device.VerifiedAt, device.VerifiedBy, device.TrustScore = AttestationPending, "", nil, "", 0
+			device.PublicKey, device.BoundAt = "", nil
+		}
+	})
+	if err != nil {
+		if changed {
+			r.releaseFingerprint(ctx, owner, reg.Fingerprint)
+		}
+		return nil, err
+	}
+	if changed {
+		r.releaseFingerprint(ctx, owner, current.Fingerprint)
+	}
+	return device, nil
+}
+
+// Delete removes owner's device id
+func (r *Registry) Delete(ctx context.Context, owner, id string) error {
+	device, err := r.Get(ctx, owner, id)
+	if err != nil {
+		return err
+	}
+	if err := r.store.Delete(ctx, devicePrefix+id); err != nil {
+		return err
+	}
+	if err := r.store.Delete(ctx, ownerPrefix+hashKey(owner)+":"+id); err != nil {
+		return err
+	}
+	r.releaseFingerprint(ctx, owner, device.Fingerprint)
+	return nil
+}
+
+// Verify checks evidence with the Attestor and records the outcome. A
+// device that passes is active again, even when quarantined; blocked
+// devices return ErrBlocked.
+func (r *Registry) Verify(ctx context.Context, owner, id string, evidence Evidence) (*interfaces.DeviceInfo, error) {
+	current, err := r.Get(ctx, owner, id)
+	if err != nil {
+		return nil, err
+	}
+	if current.State == StateBlocked {
+		return nil, ErrBlocked
+	}
+	verdict, err := r.config.Attestor.Attest(ctx, current, evidence)
+	if err != nil {
+		return nil, err
+	}
+	var from string
+	device, err := r.update(ctx, owner, id, func(device *interfaces.DeviceInfo) {
+		from = device.State
+		switch {
+		case device.State == StateBlocked:
+			// Blocked while being attested
+		case verdict.Verified:
+			now := r.now().UTC()
+			device.AttestationStatus, device.Integrity, device.VerifiedAt, device.VerifiedBy = AttestationVerified, verdict.Integrity, &now, VerifiedByAttestation
+			device.State, device.StateReason, device.LastSeenAt = StateActive, "", &now
+		default:
+			device.AttestationStatus, device.Integrity, device.VerifiedAt, device.VerifiedBy = AttestationFailed, "", nil, ""
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	r.transitioned(ctx, device, from)
+	if verdict.Verified && device.State != StateBlocked {
+		r.confirmed(ctx, device)
+	}
+	return device, nil
+}
+
+// SetCompliance records the compliance status the MDM source reports for
+// device id, whoever owns it; an empty status marks the device unmanaged
+func (r *Registry) SetCompliance(ctx context.Context, id, source, status string) (*interfaces.DeviceInfo, error) {
+	device, _, err := r.read(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return r.update(ctx, device.OwnerID, id, func(device *interfaces.DeviceInfo) {
+		if status == "" {
+			device.Compliance, device.ComplianceSource, device.ComplianceCheckedAt = "", "", nil
+			return
+		}
+		now := r.now().UTC()
+		device.Compliance, device.ComplianceSource, device.ComplianceCheckedAt = status, source, &now
+	})
+}
+
+// SetTrustScore records the latest trust score of owner's device id
+func (r *Registry) SetTrustScore(ctx context.Context, owner, id string, score int) (*interfaces.DeviceInfo, error) {
+	return r.update(ctx, owner, id, func(device *interfaces.DeviceInfo) {
+		device.TrustScore = score
+	})
+}
+
+// update applies change to owner's device id with compare-and-swap
+func (r *Registry) update(ctx context.Context, owner, id string, change func(*interfaces.DeviceInfo)) (*interfaces.DeviceInfo, error) {
+	for attempt := 0; attempt < updateAttempts; attempt++ {
+		device, old, err := r.load(ctx, owner, id)
+		if err != nil {
+			return nil, err
+		}
+		change(device)
+		device.UpdatedAt = r.now().UTC()
+		data, err := json.Marshal(device)
+		if err != nil {
+			return nil, err
+		}
+		swapped, err := r.store.CompareAndSwap(ctx, devicePrefix+id, old, data, 0)
+		if err != nil {
+			return nil, err
+		}
+		if swapped {
+			return device, nil
+		}
+	}
+	return nil, ErrConflict
+}
+
+// load returns owner's device id and its stored form. Devices of other
+// owners are not found, so their IDs cannot be probed.
+func (r *Registry) load(ctx context.Context, owner, id string) (*interfaces.DeviceInfo, []byte, error) {
+	device, data, err := r.read(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if device.OwnerID != owner {
+		return nil, nil, ErrNotFound
+	}
+	return device, data, nil
+}
+
+// read returns device id, whoever owns it, and its stored form
+func (r *Registry) read(ctx context.Context, id string) (*interfaces.DeviceInfo, []byte, error) {
+	data, err := r.store.Get(ctx, devicePrefix+id)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var device interfaces.DeviceInfo
+	if err := json.Unmarshal(data, &device); err != nil {
+		return nil, nil, err
+	}
+	return &device, data, nil
+}
+
+// claimFingerprint reserves fingerprint among owner's devices for id
+func (r *Registry) claimFingerprint(ctx context.Context, owner, fingerprint, id string) error {
+	claimed, err := r.store.CompareAndSwap(ctx, fingerprintKey(owner, fingerprint), nil, []byte(id), 0)
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		return ErrDuplicate
+	}
+	return nil
+}
+
+func (r *Registry) releaseFingerprint(ctx context.Context, owner, fingerprint string) {
+	// A stale claim only blocks registering the fingerprint again, so
+	// failures are not reported
+	_ = r.store.Delete(ctx, fingerprintKey(owner, fingerprint))
+}
+
+func fingerprintKey(owner, fingerprint string) string {
+	return fingerprintPrefix + hashKey(owner) + ":" + hashKey(fingerprint)
+}
+
+func hashKey(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:16])
+}
+
+// sortDevices orders devices oldest first
+func sortDevices(devices []*interfaces.DeviceInfo) {
+	sort.Slice(devices, func(i, j int) bool {
+		a, b := devices[i], devices[j]
+		return a.RegisteredAt.Before(b.RegisteredAt) || (a.RegisteredAt.Equal(b.RegisteredAt) && a.ID < b.ID)
+	})
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// newID returns a random RFC 4122 version 4 UUID
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	h := hex.EncodeToString(b)
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:], nil
+}
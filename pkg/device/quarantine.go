@@ -0,0 +1,53 @@
+package device
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+)
+
+// maxReasonLength bounds the reason given for quarantining or blocking
+const maxReasonLength = 512
+
+// Quarantine quarantines device id, whoever owns it, until it passes
+// Verify. It is for administrators responding to a suspected compromise;
+// OnTransition sees the change as for decay.
+func (r *Registry) Quarantine(ctx context.Context, id, reason string) (*interfaces.DeviceInfo, error) {
+	return r.restrict(ctx, id, StateQuarantined, reason)
+}
+
+// Block blocks device id, whoever owns it, for good: it has no trust, its
+// assertions are refused and it can no longer be verified
+func (r *Registry) Block(ctx context.Context, id, reason string) (*interfaces.DeviceInfo, error) {
+	return r.restrict(ctx, id, StateBlocked, reason)
+}
+
+// restrict moves device id to state, recording reason
+func (r *Registry) restrict(ctx context.Context, id, state, reason string) (*interfaces.DeviceInfo, error) {
+	if len(reason) > maxReasonLength {
+		return nil, fmt.Errorf("%w: reason must be at most %d characters", ErrInvalid, maxReasonLength)
+	}
+	current, _, err := r.read(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if current.State == StateBlocked {
+		if state == StateBlocked {
+			return current, nil
+		}
+		return nil, ErrBlocked
+	}
+	var from string
+	device, err := r.update(ctx, current.OwnerID, id, func(device *interfaces.DeviceInfo) {
+		if from = device.State; from == StateBlocked {
+			return
+		}
+		device.State, device.StateReason, device.TrustScore = state, reason, 0
+	})
+	if err != nil {
+		return nil, err
+	}
+	r.transitioned(ctx, device, from)
+	return device, nil
+}
@@ -0,0 +1,135 @@
+package device
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+// HeaderDeviceFingerprint carries the fingerprint of the device a login
+// comes from, as its client reports it
+const HeaderDeviceFingerprint = "X-Device-Fingerprint"
+
+// unknownPrefix keys the sightings of each owner's unknown devices
+const unknownPrefix = "device:unknown:"
+
+// Login describes a login to check for an unknown device
+type Login struct {
+	Owner string
+	// Email, when set, is told of the first login from an unknown device
+	Email       string
+	Fingerprint string
+	IP          string
+	UserAgent   string
+	// Method is how the user logged in, e.g. "password"
+	Method string
+}
+
+// Sighting records logins from a fingerprint none of the owner's devices
+// have. It lasts until a device with the fingerprint is verified or
+// UnknownDeviceTTL passes without another login from it.
+type Sighting struct {
+	// ID identifies the fingerprint without revealing it
+	ID        string    `json:"id"`
+	OwnerID   string    `json:"owner_id"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Method    string    `json:"method"`
+	Logins    int       `json:"logins"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// ObserveLogin checks the device of login against its owner's registered
+// devices, returning the sighting of an unknown one or nil. The first login
+// from an unknown device is mailed to login.Email and passed to
+// OnUnknownDevice; later ones only update the sighting.
+func (r *Registry) ObserveLogin(ctx context.Context, login Login) (*Sighting, error) {
+	if login.Fingerprint == "" || len(login.Fingerprint) > maxFingerprintLength {
+		return nil, nil
+	}
+	if _, err := r.store.Get(ctx, fingerprintKey(login.Owner, login.Fingerprint)); err == nil {
+		return nil, nil
+	} else if !errors.Is(err, store.ErrNotFound) {
+		return nil, err
+	}
+
+	key := unknownKey(login.Owner, login.Fingerprint)
+	now := r.now().UTC()
+	for attempt := 0; attempt < updateAttempts; attempt++ {
+		sighting := &Sighting{ID: hashKey(login.Fingerprint), OwnerID: login.Owner, FirstSeen: now}
+		old, err := r.store.Get(ctx, key)
+		switch {
+		case errors.Is(err, store.ErrNotFound):
+			old = nil
+		case err != nil:
+			return nil, err
+		default:
+			if err := json.Unmarshal(old, sighting); err != nil {
+				return nil, err
+			}
+		}
+		sighting.IP, sighting.UserAgent, sighting.Method = login.IP, login.UserAgent, login.Method
+		sighting.Logins++
+		sighting.LastSeen = now
+		data, err := json.Marshal(sighting)
+		if err != nil {
+			return nil, err
+		}
+		swapped, err := r.store.CompareAndSwap(ctx, key, old, data, r.config.UnknownDeviceTTL)
+		if err != nil {
+			return nil, err
+		}
+		if !swapped {
+			continue
+		}
+		if old == nil {
+			r.sighted(ctx, login, sighting)
+		}
+		return sighting, nil
+	}
+	return nil, ErrConflict
+}
+
+// sighted tells the owner and OnUnknownDevice of a new sighting
+func (r *Registry) sighted(ctx context.Context, login Login, sighting *Sighting) {
+	if r.config.Mailer != nil && login.Email != "" {
+		body := fmt.Sprintf("Someone signed in to your account from a device you have not registered, at %s from %s.\n\nIf it was you, register and verify the device. If not, change your password and sign out of your other sessions.",
+			sighting.FirstSeen.Format(time.RFC1123), sighting.IP)
+		// The login goes on when the mail cannot be sent; OnUnknownDevice
+		// still reports the sighting
+		_ = r.config.Mailer.Send(ctx, login.Email, "New sign-in from an unknown device", body)
+	}
+	if r.config.OnUnknownDevice != nil {
+		r.config.OnUnknownDevice(ctx, sighting)
+	}
+}
+
+// confirmed ends the sighting of verified device's fingerprint, calling
+// OnDeviceConfirmed if there was one
+func (r *Registry) confirmed(ctx context.Context, device *interfaces.DeviceInfo) {
+	key := unknownKey(device.OwnerID, device.Fingerprint)
+	data, err := r.store.Get(ctx, key)
+	if err != nil {
+		return
+	}
+	var sighting Sighting
+	if json.Unmarshal(data, &sighting) != nil {
+		return
+	}
+	if err := r.store.Delete(ctx, key); err != nil {
+		return
+	}
+	if r.config.OnDeviceConfirmed != nil {
+		r.config.OnDeviceConfirmed(ctx, &sighting, device)
+	}
+}
+
+func unknownKey(owner, fingerprint string) string {
+	return unknownPrefix + hashKey(owner) + ":" + hashKey(fingerprint)
+}
@@ -0,0 +1,449 @@
+package device
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+// Verification methods: the owner enters a code emailed to them, approves
+// from another of their verified, hardware-bound devices, or waits for an
+// administrator to approve
+const (
+	MethodEmail = "email"
+	MethodPush  = "push"
+	MethodAdmin = "admin"
+)
+
+// VerifiedByAttestation is VerifiedBy for devices that passed the Attestor
+const VerifiedByAttestation = "attestation"
+
+// Verification statuses. Email verifications fail after too many wrong
+// codes; pending verifications expire unanswered.
+const (
+	VerificationPending  = "pending"
+	VerificationApproved = "approved"
+	VerificationDenied   = "denied"
+	VerificationFailed   = "failed"
+	VerificationExpired  = "expired"
+)
+
+// Store keys of verifications by device, and of the hashed codes of email
+// verifications
+const (
+	verificationPrefix = "device:verification:"
+	codePrefix         = "device:verification-code:"
+)
+
+// verificationRetention is how long verifications are kept for their
+// history
+const verificationRetention = 30 * 24 * time.Hour
+
+// Errors returned by the verification workflow
+var (
+	// ErrVerificationClosed is returned when answering a verification
+	// that is no longer pending
+	ErrVerificationClosed = errors.New("verification is no longer pending")
+	// ErrWrongCode is returned for a wrong emailed code
+	ErrWrongCode = errors.New("wrong verification code")
+	// ErrApproverInvalid is returned when the approver may not decide the
+	// verification
+	ErrApproverInvalid = errors.New("approver may not decide this verification")
+)
+
+// Verification is a challenge the owner of a device answers to verify it,
+// kept with its outcome after it is decided
+type Verification struct {
+	ID       string `json:"id"`
+	DeviceID string `json:"device_id"`
+	OwnerID  string `json:"owner_id"`
+	Method   string `json:"method"`
+	Status   string `json:"status"`
+	// Attempts counts wrong codes
+	Attempts  int        `json:"attempts"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	DecidedAt *time.Time `json:"decided_at,omitempty"`
+	// DecidedBy is the administrator or "device:<id>" that decided it
+	DecidedBy string `json:"decided_by,omitempty"`
+}
+
+// StartVerification challenges the owner of device id to verify it with
+// method. Email codes go to address. Push verifications need another of
+// the owner's devices able to approve them.
+func (r *Registry) StartVerification(ctx context.Context, owner, id, method, address string) (*Verification, error) {
+	device, err := r.Get(ctx, owner, id)
+	if err != nil {
+		return nil, err
+	}
+	if device.State == StateBlocked {
+		return nil, ErrBlocked
+	}
+	switch method {
+	case MethodEmail:
+		if r.config.Mailer == nil || address == "" {
+			return nil, fmt.Errorf("%w: email verification is unavailable", ErrInvalid)
+		}
+	case MethodPush:
+		devices, err := r.ownerDevices(ctx, owner)
+		if err != nil {
+			return nil, err
+		}
+		approver := false
+		for _, other := range devices {
+			approver = approver || canApprove(other, device)
+		}
+		if !approver {
+			return nil, fmt.Errorf("%w: no other verified, bound device can approve", ErrInvalid)
+		}
+	case MethodAdmin:
+	default:
+		return nil, fmt.Errorf("%w: method must be %s, %s or %s", ErrInvalid, MethodEmail, MethodPush, MethodAdmin)
+	}
+
+	vid, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	now := r.now().UTC()
+	v := &Verification{
+		ID:        vid,
+		DeviceID:  id,
+		OwnerID:   owner,
+		Method:    method,
+		Status:    VerificationPending,
+		CreatedAt: now,
+		ExpiresAt: now.Add(r.config.VerificationTTL),
+	}
+	if method == MethodEmail {
+		code, err := newCode()
+		if err != nil {
+			return nil, err
+		}
+		if err := r.store.Set(ctx, codePrefix+vid, hashCode(vid, code), r.config.VerificationTTL); err != nil {
+			return nil, err
+		}
+		body := fmt.Sprintf("Your code to verify the device %q is %s. It expires in %d minutes.\n\nIf you did not ask for it, someone may be trying to register a device as you.",
+			deviceName(device), code, int(r.config.VerificationTTL.Minutes()))
+		if err := r.config.Mailer.Send(ctx, address, "Verify your device", body); err != nil {
+			return nil, fmt.Errorf("failed to send verification code: %w", err)
+		}
+	}
+	if err := r.saveVerification(ctx, nil, v); err != nil {
+		return nil, err
+	}
+	r.verificationChanged(ctx, v)
+	return v, nil
+}
+
+// CompleteVerification answers owner's email verification vid of device id
+// with code, verifying the device when it is right
+func (r *Registry) CompleteVerification(ctx context.Context, owner, id, vid, code string) (*interfaces.DeviceInfo, error) {
+	v, _, err := r.verification(ctx, id, vid)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case v.OwnerID != owner:
+		return nil, ErrNotFound
+	case v.Method != MethodEmail:
+		return nil, fmt.Errorf("%w: %s verifications are approved, not answered", ErrInvalid, v.Method)
+	}
+	hash, err := r.store.Get(ctx, codePrefix+vid)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return nil, err
+	}
+	right := err == nil && subtle.ConstantTimeCompare(hash, hashCode(vid, code)) == 1
+	v, err = r.updateVerification(ctx, id, vid, func(v *Verification) {
+		if right {
+			r.decided(v, VerificationApproved, MethodEmail)
+			return
+		}
+		if v.Attempts++; v.Attempts >= r.config.MaxVerificationAttempts {
+			r.decided(v, VerificationFailed, "")
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if v.Status != VerificationPending {
+		_ = r.store.Delete(ctx, codePrefix+vid)
+	}
+	return r.concluded(ctx, v, right)
+}
+
+// ApproveFromDevice decides owner's push verification vid of device id
+// from approver, another of the owner's verified devices that has just
+// proven it holds its bound key
+func (r *Registry) ApproveFromDevice(ctx context.Context, owner string, approver *interfaces.DeviceInfo, id, vid string, approve bool) (*interfaces.DeviceInfo, error) {
+	v, _, err := r.verification(ctx, id, vid)
+	if err != nil {
+		return nil, err
+	}
+	if v.OwnerID != owner {
+		return nil, ErrNotFound
+	}
+	device, err := r.Get(ctx, owner, id)
+	if err != nil {
+		return nil, err
+	}
+	if v.Method != MethodPush || approver == nil || !canApprove(approver, device) {
+		return nil, ErrApproverInvalid
+	}
+	return r.decide(ctx, id, vid, "device:"+approver.ID, approve)
+}
+
+// Decide is an administrator's decision on the admin verification vid of
+// device id, whoever owns it
+func (r *Registry) Decide(ctx context.Context, id, vid, admin string, approve bool) (*interfaces.DeviceInfo, error) {
+	v, _, err := r.verification(ctx, id, vid)
+	if err != nil {
+		return nil, err
+	}
+	if v.Method != MethodAdmin {
+		return nil, ErrApproverInvalid
+	}
+	return r.decide(ctx, id, vid, admin, approve)
+}
+
+// Verifications returns the verifications of owner's device id, newest
+// first
+func (r *Registry) Verifications(ctx context.Context, owner, id string) ([]*Verification, error) {
+	if _, err := r.Get(ctx, owner, id); err != nil {
+		return nil, err
+	}
+	return r.verifications(ctx, verificationPrefix+id+":", nil)
+}
+
+// PendingApprovals returns the push verifications of owner's devices
+// waiting for approval from another of them
+func (r *Registry) PendingApprovals(ctx context.Context, owner string) ([]*Verification, error) {
+	devices, err := r.ownerDevices(ctx, owner)
+	if err != nil {
+		return nil, err
+	}
+	pending := []*Verification{}
+	for _, device := range devices {
+		found, err := r.verifications(ctx, verificationPrefix+device.ID+":", func(v *Verification) bool {
+			return v.Method == MethodPush && v.Status == VerificationPending
+		})
+		if err != nil {
+			return nil, err
+		}
+		pending = append(pending, found...)
+	}
+	sortVerifications(pending)
+	return pending, nil
+}
+
+// PendingAdminApprovals returns the admin verifications of every device
+// waiting for an administrator
+func (r *Registry) PendingAdminApprovals(ctx context.Context) ([]*Verification, error) {
+	return r.verifications(ctx, verificationPrefix, func(v *Verification) bool {
+		return v.Method == MethodAdmin && v.Status == VerificationPending
+	})
+}
+
+// decide approves or denies pending verification vid of device id
+func (r *Registry) decide(ctx context.Context, id, vid, by string, approve bool) (*interfaces.DeviceInfo, error) {
+	status := VerificationDenied
+	if approve {
+		status = VerificationApproved
+	}
+	v, err := r.updateVerification(ctx, id, vid, func(v *Verification) {
+		r.decided(v, status, by)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r.concluded(ctx, v, approve)
+}
+
+// decided records status on pending v
+func (r *Registry) decided(v *Verification, status, by string) {
+	now := r.now().UTC()
+	v.Status, v.DecidedAt, v.DecidedBy = status, &now, by
+}
+
+// concluded reports the outcome of v and, when it was approved, verifies
+// its device. A wrong code that leaves v pending is ErrWrongCode.
+func (r *Registry) concluded(ctx context.Context, v *Verification, approved bool) (*interfaces.DeviceInfo, error) {
+	if v.Status != VerificationPending {
+		r.verificationChanged(ctx, v)
+	}
+	switch {
+	case v.Status == VerificationFailed:
+		return nil, fmt.Errorf("%w: too many wrong codes", ErrVerificationClosed)
+	case !approved && v.Method == MethodEmail:
+		return nil, ErrWrongCode
+	case !approved:
+		return r.Get(ctx, v.OwnerID, v.DeviceID)
+	}
+	var from string
+	device, err := r.update(ctx, v.OwnerID, v.DeviceID, func(device *interfaces.DeviceInfo) {
+		if from = device.State; device.State == StateBlocked {
+			return
+		}
+		now := r.now().UTC()
+		device.AttestationStatus, device.VerifiedAt, device.VerifiedBy = AttestationVerified, &now, v.Method
+		device.State, device.StateReason, device.LastSeenAt = StateActive, "", &now
+	})
+	if err != nil {
+		return nil, err
+	}
+	if device.State == StateBlocked {
+		return nil, ErrBlocked
+	}
+	r.transitioned(ctx, device, from)
+	r.confirmed(ctx, device)
+	return device, nil
+}
+
+// updateVerification applies change to pending verification vid of device
+// id with compare-and-swap
+func (r *Registry) updateVerification(ctx context.Context, id, vid string, change func(*Verification)) (*Verification, error) {
+	for attempt := 0; attempt < updateAttempts; attempt++ {
+		v, old, err := r.verification(ctx, id, vid)
+		if err != nil {
+			return nil, err
+		}
+		if v.Status != VerificationPending {
+			return nil, ErrVerificationClosed
+		}
+		change(v)
+		err = r.saveVerification(ctx, old, v)
+		if errors.Is(err, ErrConflict) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return v, nil
+	}
+	return nil, ErrConflict
+}
+
+// saveVerification stores v in place of its stored form old, nil when new
+func (r *Registry) saveVerification(ctx context.Context, old []byte, v *Verification) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	swapped, err := r.store.CompareAndSwap(ctx, verificationKey(v.DeviceID, v.ID), old, data, verificationRetention)
+	if err != nil {
+		return err
+	}
+	if !swapped {
+		return ErrConflict
+	}
+	return nil
+}
+
+// verification returns verification vid of device id and its stored form.
+// Pending verifications past their expiry are reported expired.
+func (r *Registry) verification(ctx context.Context, id, vid string) (*Verification, []byte, error) {
+	data, err := r.store.Get(ctx, verificationKey(id, vid))
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var v Verification
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, nil, err
+	}
+	if v.Status == VerificationPending && !r.now().Before(v.ExpiresAt) {
+		v.Status = VerificationExpired
+	}
+	return &v, data, nil
+}
+
+// verifications returns the verifications under prefix passing keep,
+// newest first
+func (r *Registry) verifications(ctx context.Context, prefix string, keep func(*Verification) bool) ([]*Verification, error) {
+	keys, err := r.store.Keys(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	found := make([]*Verification, 0, len(keys))
+	for _, key := range keys {
+		id, vid, _ := strings.Cut(strings.TrimPrefix(key, verificationPrefix), ":")
+		v, _, err := r.verification(ctx, id, vid)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if keep == nil || keep(v) {
+			found = append(found, v)
+		}
+	}
+	sortVerifications(found)
+	return found, nil
+}
+
+// verificationChanged calls OnVerification
+func (r *Registry) verificationChanged(ctx context.Context, v *Verification) {
+	if r.config.OnVerification != nil {
+		r.config.OnVerification(ctx, v)
+	}
+}
+
+// canApprove reports whether approver may approve a push verification of
+// device: another device of the same owner, verified, bound to a key and
+// neither quarantined nor blocked
+func canApprove(approver, device *interfaces.DeviceInfo) bool {
+	state := stateOf(approver.State)
+	return approver.ID != device.ID && approver.OwnerID == device.OwnerID &&
+		approver.PublicKey != "" && approver.AttestationStatus == AttestationVerified &&
+		state != StateQuarantined && state != StateBlocked
+}
+
+func verificationKey(id, vid string) string {
+	return verificationPrefix + id + ":" + vid
+}
+
+// hashCode binds a code to its verification, so stored hashes cannot be
+// reversed by tabulating the few possible codes once
+func hashCode(vid, code string) []byte {
+	sum := sha256.Sum256([]byte(vid + ":" + code))
+	return []byte(hex.EncodeToString(sum[:]))
+}
+
+// newCode returns a random six-digit code
+func newCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1_000_000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+func deviceName(device *interfaces.DeviceInfo) string {
+	if device.Name != "" {
+		return device.Name
+	}
+	return device.Platform + " device"
+}
+
+// sortVerifications orders verifications newest first
+func sortVerifications(verifications []*Verification) {
+	sort.Slice(verifications, func(i, j int) bool {
+		a, b := verifications[i], verifications[j]
+		return a.CreatedAt.After(b.CreatedAt) || (a.CreatedAt.Equal(b.CreatedAt) && a.ID < b.ID)
+	})
+}
@@ -0,0 +1,191 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+// Registry backends
+const (
+	BackendStore      = "store"
+	BackendConsul     = "consul"
+	BackendEtcd       = "etcd"
+	BackendKubernetes = "kubernetes"
+)
+
+// DefaultPrefix is where the Consul and etcd backends keep services
+const DefaultPrefix = "zamaz/services/"
+
+// backendTimeout bounds requests to Consul, etcd and Kubernetes
+const backendTimeout = 10 * time.Second
+
+// ErrReadOnly is returned when registering or removing services in a
+// backend the registry only reads, such as Kubernetes
+var ErrReadOnly = errors.New("registry backend is read-only")
+
+// Backend keeps the registered services outside the process, so they
+// survive restarts and every replica sees the same services
+type Backend interface {
+	// Put stores service under its name, dropping it after ttl when
+	// positive
+	Put(ctx context.Context, service *ServiceInfo, ttl time.Duration) error
+	// Delete removes a service; removing an unknown service is not an error
+	Delete(ctx context.Context, name string) error
+	// List returns every stored service
+	List(ctx context.Context) ([]*ServiceInfo, error)
+}
+
+// BackendConfig selects and configures a backend
+type BackendConfig struct {
+	// Kind is one of the Backend constants; empty is BackendStore
+	Kind string
+	// Prefix namespaces the services of the store, Consul and etcd
+	// backends; defaults to "discovery:services:" in the store and
+	// DefaultPrefix elsewhere
+	Prefix     string
+	Consul     ConsulConfig
+	Etcd       EtcdConfig
+	Kubernetes KubernetesConfig
+}
+
+// NewBackend creates the backend cfg selects. The store backend keeps
+// services in s.
+func NewBackend(cfg BackendConfig, s store.Store) (Backend, error) {
+	switch cfg.Kind {
+	case "", BackendStore:
+		if s == nil {
+			return nil, errors.New("store registry backend needs a store")
+		}
+		if cfg.Prefix == "" {
+			cfg.Prefix = storeKeyPrefix
+		}
+		return NewStoreBackend(s, cfg.Prefix), nil
+	}
+	if cfg.Prefix == "" {
+		cfg.Prefix = DefaultPrefix
+	}
+	switch cfg.Kind {
+	case BackendConsul:
+		if cfg.Consul.Prefix == "" {
+			cfg.Consul.Prefix = cfg.Prefix
+		}
+		return NewConsul(cfg.Consul)
+	case BackendEtcd:
+		if cfg.Etcd.Prefix == "" {
+			cfg.Etcd.Prefix = cfg.Prefix
+		}
+		return NewEtcd(cfg.Etcd)
+	case BackendKubernetes:
+		return NewKubernetes(cfg.Kubernetes)
+	default:
+		return nil, fmt.Errorf("unknown registry backend %q", cfg.Kind)
+	}
+}
+
+// StoreBackend keeps services in a store.Store: in memory, or in Redis to
+// share them between replicas
+type StoreBackend struct {
+	store  store.Store
+	prefix string
+}
+
+// NewStoreBackend creates a backend keeping services in s under prefix
+func NewStoreBackend(s store.Store, prefix string) *StoreBackend {
+	return &StoreBackend{store: s, prefix: prefix}
+}
+
+// Put implements Backend
+func (b *StoreBackend) Put(ctx context.Context, service *ServiceInfo, ttl time.Duration) error {
+	data, err := json.Marshal(service)
+	if err != nil {
+		return err
+	}
+	return b.store.Set(ctx, b.prefix+service.Name, data, ttl)
+}
+
+// Delete implements Backend
+func (b *StoreBackend) Delete(ctx context.Context, name string) error {
+	return b.store.Delete(ctx, b.prefix+name)
+}
+
+// List implements Backend
+func (b *StoreBackend) List(ctx context.Context) ([]*ServiceInfo, error) {
+	keys, err := b.store.Keys(ctx, b.prefix)
+	if err != nil {
+		return nil, err
+	}
+	services := make([]*ServiceInfo, 0, len(keys))
+	for _, key := range keys {
+		data, err := b.store.Get(ctx, key)
+		if errors.Is(err, store.ErrNotFound) {
+			// Removed or expired since listed
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if service := decodeService(key, data); service != nil {
+			services = append(services, service)
+		}
+	}
+	return services, nil
+}
+
+// decodeService decodes a stored service, or returns nil for a corrupt
+// entry
+func decodeService(key string, data []byte) *ServiceInfo {
+	var service ServiceInfo
+	if err := json.Unmarshal(data, &service); err != nil || service.Name == "" {
+		slog.Warn("Ignoring corrupt shared service entry", "key", key, "error", err)
+		return nil
+	}
+	return &service
+}
+
+// doJSON sends in, when not nil, as JSON to location and decodes the
+// response into out, when not nil. Statuses other than 200 are errors,
+// but their code is returned so callers can handle 404 or 401.
+func doJSON(ctx context.Context, client *http.Client, method, location string, header http.Header, in, out interface{}) (int, error) {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return 0, err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, location, body)
+	if err != nil {
+		return 0, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return resp.StatusCode, fmt.Errorf("%s %s returned status %d: %s", method, req.URL.Path, resp.StatusCode, strings.TrimSpace(string(detail)))
+	}
+	if out == nil {
+		_, err = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+		return resp.StatusCode, err
+	}
+	return resp.StatusCode, json.NewDecoder(io.LimitReader(resp.Body, 32<<20)).Decode(out)
+}
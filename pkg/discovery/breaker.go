@@ -0,0 +1,95 @@
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+// StatusDegraded is a service whose circuit breaker is open or probing. It
+// returns to the status its health checks give once the breaker closes.
+const StatusDegraded = "degraded"
+
+// Circuit breaker states a service can be given, as
+// security.CircuitBreakerManager names them
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// ErrCircuitOpen is returned when resolving a service whose circuit breaker
+// is open
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// withBreaker is status, unless the service's breaker degrades it
+func (s *ServiceInfo) withBreaker(status string) string {
+	if s.Breaker != "" && status != StatusExpired {
+		return StatusDegraded
+	}
+	return status
+}
+
+// checkedStatus is the status the health checks give a service, whatever
+// its breaker. The registry must be locked.
+func (sr *ServiceRegistry) checkedStatus(name string, service *ServiceInfo) string {
+	if service.Status != StatusDegraded {
+		return service.Status
+	}
+	if len(service.Instances) > 0 {
+		return aggregateStatus(service.Instances)
+	}
+	state := sr.health[name]
+	switch {
+	case state == nil || state.settled == "":
+		return StatusUnknown
+	case state.flapping():
+		return StatusFlapping
+	default:
+		return state.settled
+	}
+}
+
+// SetBreakerState records the state of a service's circuit breaker. While
+// open, the service is degraded and not resolved; while half-open, it stays
+// degraded but is resolved so probes reach it; once closed, it is restored.
+func (sr *ServiceRegistry) SetBreakerState(name, state string) error {
+	switch state {
+	case BreakerClosed, BreakerOpen, BreakerHalfOpen:
+	default:
+		return fmt.Errorf("unknown circuit breaker state %q", state)
+	}
+	if state == BreakerClosed {
+		state = ""
+	}
+
+	sr.mu.Lock()
+	service, exists := sr.services[name]
+	if !exists {
+		sr.mu.Unlock()
+		return fmt.Errorf("service %s %w", name, ErrServiceNotFound)
+	}
+	if service.Breaker == state {
+		sr.mu.Unlock()
+		return nil
+	}
+	previous := service.Status
+	checked := sr.checkedStatus(name, service)
+	service.Breaker = state
+	service.Status = service.withBreaker(checked)
+	if service.Status != previous {
+		sr.publish(EventStatusChanged, service, previous)
+	}
+	snapshot := service.snapshot()
+	sr.mu.Unlock()
+
+	if state == "" {
+		slog.Info("Service restored as its circuit breaker closed", "service", name, "status", snapshot.Status)
+	} else {
+		slog.Warn("Service degraded by its circuit breaker", "service", name, "breaker", state)
+	}
+	if err := sr.persist(&snapshot); err != nil && !errors.Is(err, ErrReadOnly) {
+		slog.Warn("Failed to share service breaker state", "service", name, "error", err)
+	}
+	return nil
+}
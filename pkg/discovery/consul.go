@@ -0,0 +1,118 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ConsulConfig configures the Consul backend
+type ConsulConfig struct {
+	// Address is the HTTP API of a Consul agent, e.g.
+	// "http://localhost:8500"
+	Address string
+	// Token is an ACL token with key write access to Prefix
+	Token      string
+	Datacenter string
+	// Prefix is the KV folder of the services, ending in "/"
+	Prefix string
+	Client *http.Client
+}
+
+// Consul keeps services as JSON in the Consul KV store, one key per
+// service under a prefix. Consul keys do not expire, so services that stop
+// sending heartbeats are removed by the registry.
+type Consul struct {
+	config ConsulConfig
+}
+
+// NewConsul creates a Consul backend
+func NewConsul(cfg ConsulConfig) (*Consul, error) {
+	if cfg.Address == "" {
+		return nil, errors.New("consul registry backend needs an address")
+	}
+	cfg.Address = strings.TrimRight(cfg.Address, "/")
+	if cfg.Prefix == "" {
+		cfg.Prefix = DefaultPrefix
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: backendTimeout}
+	}
+	return &Consul{config: cfg}, nil
+}
+
+// Put implements Backend. Consul has no TTL on keys, so ttl is left to
+// the registry.
+func (c *Consul) Put(ctx context.Context, service *ServiceInfo, ttl time.Duration) error {
+	_, err := doJSON(ctx, c.config.Client, http.MethodPut, c.location(service.Name, nil), c.header(), service, nil)
+	return err
+}
+
+// Delete implements Backend
+func (c *Consul) Delete(ctx context.Context, name string) error {
+	_, err := doJSON(ctx, c.config.Client, http.MethodDelete, c.location(name, nil), c.header(), nil, nil)
+	return err
+}
+
+// List implements Backend
+func (c *Consul) List(ctx context.Context) ([]*ServiceInfo, error) {
+	var pairs []struct {
+		Key   string `json:"Key"`
+		Value []byte `json:"Value"`
+	}
+	status, err := doJSON(ctx, c.config.Client, http.MethodGet, c.location("", url.Values{"recurse": {"true"}}), c.header(), nil, &pairs)
+	if status == http.StatusNotFound {
+		// No key under the prefix yet
+		return []*ServiceInfo{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	services := make([]*ServiceInfo, 0, len(pairs))
+	for _, pair := range pairs {
+		// Folders have no value
+		if len(pair.Value) == 0 {
+			continue
+		}
+		if service := decodeService(pair.Key, pair.Value); service != nil {
+			services = append(services, service)
+		}
+	}
+	return services, nil
+}
+
+// location is the KV endpoint of the service name, or of the prefix when
+// name is empty
+func (c *Consul) location(name string, query url.Values) string {
+	if c.config.Datacenter != "" {
+		if query == nil {
+			query = url.Values{}
+		}
+		query.Set("dc", c.config.Datacenter)
+	}
+	location := c.config.Address + "/v1/kv/" + escapeKey(c.config.Prefix+name)
+	if len(query) > 0 {
+		location += "?" + query.Encode()
+	}
+	return location
+}
+
+func (c *Consul) header() http.Header {
+	header := http.Header{}
+	if c.config.Token != "" {
+		header.Set("X-Consul-Token", c.config.Token)
+	}
+	return header
+}
+
+// escapeKey escapes each segment of a KV key, keeping its slashes
+func escapeKey(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,659 @@
+package discovery
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DNS defaults, applied to the fields of DNSConfig left unset
+const (
+	DefaultDNSDomain = "zt.local"
+	DefaultDNSTTL    = 5 * time.Second
+)
+
+const (
+	// udpMessageSize is the size of UDP answers to queries without EDNS
+	udpMessageSize = 512
+	// maxUDPMessageSize bounds the UDP size EDNS queries may ask for
+	maxUDPMessageSize = 4096
+	// dnsIdleTimeout closes idle TCP connections
+	dnsIdleTimeout = 10 * time.Second
+)
+
+// DNSConfig configures the DNS interface of the registry
+type DNSConfig struct {
+	// Addr is the host:port served over UDP and TCP, such as :8053
+	Addr string
+	// Domain is the zone services are answered in; user-service is
+	// user-service.zt.local by default
+	Domain string
+	// TTL is how long answers may be cached; short, as health changes
+	TTL time.Duration
+}
+
+// DNSServer answers DNS queries for registered services, so clients can
+// discover them without the HTTP API. Under its domain it answers:
+//
+//	<name>                       A or AAAA of the healthy instances, or a
+//	                             CNAME to the host they are named by; SRV
+//	_<name>._tcp                 SRV of the healthy instances
+//	_services._dns-sd._udp       PTR to the service types, for DNS-SD
+//	_http._tcp, _https._tcp      PTR to the healthy services of the type
+//	<name>._http._tcp            SRV and TXT of a DNS-SD service instance
+//
+// Instances addressed by IP are SRV targets <ip>.<name>, with dashes for
+// the dots or colons of the IP. Only healthy services are answered.
+type DNSServer struct {
+	registry *ServiceRegistry
+	config   DNSConfig
+	domain   dnsmessage.Name
+}
+
+// NewDNSServer creates a DNS server for registry
+func NewDNSServer(registry *ServiceRegistry, cfg DNSConfig) (*DNSServer, error) {
+	if cfg.Domain == "" {
+		cfg.Domain = DefaultDNSDomain
+	}
+	if cfg.TTL <= 0 {
+		cfg.TTL = DefaultDNSTTL
+	}
+	cfg.Domain = strings.ToLower(strings.Trim(cfg.Domain, "."))
+	for _, label := range strings.Split(cfg.Domain, ".") {
+		if !validDNSLabel(label) {
+			return nil, fmt.Errorf("invalid DNS domain %q", cfg.Domain)
+		}
+	}
+	domain, err := dnsmessage.NewName(cfg.Domain + ".")
+	if err != nil {
+		return nil, fmt.Errorf("invalid DNS domain %q: %w", cfg.Domain, err)
+	}
+	return &DNSServer{registry: registry, config: cfg, domain: domain}, nil
+}
+
+// ListenAndServe serves DNS over UDP and TCP on the configured address
+// until ctx is done
+func (d *DNSServer) ListenAndServe(ctx context.Context) error {
+	pc, err := net.ListenPacket("udp", d.config.Addr)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", d.config.Addr)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+	return d.Serve(ctx, pc, l)
+}
+
+// Serve answers queries received on pc and, when not nil, l until ctx is
+// done, closing both then
+func (d *DNSServer) Serve(ctx context.Context, pc net.PacketConn, l net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		pc.Close()
+		if l != nil {
+			l.Close()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		errs[0] = d.servePackets(ctx, pc)
+	}()
+	if l != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[1] = d.serveStreams(ctx, l)
+		}()
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return nil
+	}
+	return errors.Join(errs...)
+}
+
+func (d *DNSServer) servePackets(ctx context.Context, pc net.PacketConn) error {
+	for {
+		buf := make([]byte, maxUDPMessageSize)
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			if answer := d.answer(buf[:n], true); answer != nil {
+				pc.WriteTo(answer, addr)
+			}
+		}()
+	}
+}
+
+func (d *DNSServer) serveStreams(ctx context.Context, l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go d.serveStream(conn)
+	}
+}
+
+// serveStream answers the length-prefixed queries of a TCP connection
+func (d *DNSServer) serveStream(conn net.Conn) {
+	defer conn.Close()
+	for {
+		conn.SetDeadline(time.Now().Add(dnsIdleTimeout))
+		var size [2]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		answer := d.answer(query, false)
+		if answer == nil {
+			return
+		}
+		binary.BigEndian.PutUint16(size[:], uint16(len(answer)))
+		if _, err := conn.Write(append(size[:], answer...)); err != nil {
+			return
+		}
+	}
+}
+
+// answer builds the response to query, truncated to fit a UDP message
+// when overUDP. Queries too malformed to answer return nil.
+func (d *DNSServer) answer(query []byte, overUDP bool) []byte {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil || header.Response {
+		return nil
+	}
+	response := dnsmessage.Header{
+		ID:               header.ID,
+		Response:         true,
+		OpCode:           header.OpCode,
+		Authoritative:    true,
+		RecursionDesired: header.RecursionDesired,
+	}
+	question, err := p.Question()
+	if err != nil {
+		response.RCode = dnsmessage.RCodeFormatError
+		return d.build(response, nil, nil, nil, 0, udpMessageSize, overUDP)
+	}
+	p.SkipAllQuestions()
+	p.SkipAllAnswers()
+	p.SkipAllAuthorities()
+	var edns uint16
+	for {
+		h, err := p.AdditionalHeader()
+		if err != nil {
+			break
+		}
+		if h.Type == dnsmessage.TypeOPT {
+			edns = uint16(h.Class)
+		}
+		p.SkipAdditional()
+	}
+	size := udpMessageSize
+	if int(edns) > size {
+		size = int(edns)
+		if size > maxUDPMessageSize {
+			size = maxUDPMessageSize
+		}
+	}
+
+	var answers, additionals []dnsmessage.Resource
+	switch {
+	case header.OpCode != 0:
+		response.RCode = dnsmessage.RCodeNotImplemented
+	case question.Class != dnsmessage.ClassINET && question.Class != dnsmessage.ClassANY:
+		response.RCode = dnsmessage.RCodeRefused
+	case !d.inZone(question.Name):
+		// Not a resolver for other zones
+		response.RCode, response.Authoritative = dnsmessage.RCodeRefused, false
+	default:
+		var found bool
+		if answers, additionals, found = d.resolve(question); !found {
+			response.RCode = dnsmessage.RCodeNameError
+		}
+	}
+	return d.build(response, &question, answers, additionals, edns, size, overUDP)
+}
+
+// build encodes a response, dropping the records when they do not fit a
+// UDP message of size and marking it truncated so the client retries over
+// TCP
+func (d *DNSServer) build(header dnsmessage.Header, question *dnsmessage.Question, answers, additionals []dnsmessage.Resource, edns uint16, size int, overUDP bool) []byte {
+	encode := func(header dnsmessage.Header, answers, additionals []dnsmessage.Resource) ([]byte, error) {
+		b := dnsmessage.NewBuilder(make([]byte, 0, 512), header)
+		b.EnableCompression()
+		if question != nil {
+			if err := b.StartQuestions(); err != nil {
+				return nil, err
+			}
+			if err := b.Question(*question); err != nil {
+				return nil, err
+			}
+		}
+		if err := b.StartAnswers(); err != nil {
+			return nil, err
+		}
+		for _, r := range answers {
+			if err := addResource(&b, r); err != nil {
+				return nil, err
+			}
+		}
+		if err := b.StartAuthorities(); err != nil {
+			return nil, err
+		}
+		if len(answers) == 0 && (header.RCode == dnsmessage.RCodeSuccess || header.RCode == dnsmessage.RCodeNameError) && question != nil {
+			// Negative answers are cached for the TTL
+			if err := addResource(&b, d.soa()); err != nil {
+				return nil, err
+			}
+		}
+		if err := b.StartAdditionals(); err != nil {
+			return nil, err
+		}
+		for _, r := range additionals {
+			if err := addResource(&b, r); err != nil {
+				return nil, err
+			}
+		}
+		if edns != 0 {
+			var opt dnsmessage.ResourceHeader
+			if err := opt.SetEDNS0(maxUDPMessageSize, dnsmessage.RCodeSuccess, false); err != nil {
+				return nil, err
+			}
+			if err := b.OPTResource(opt, dnsmessage.OPTResource{}); err != nil {
+				return nil, err
+			}
+		}
+		return b.Finish()
+	}
+
+	msg, err := encode(header, answers, additionals)
+	if err == nil && overUDP && len(msg) > size {
+		if msg, err = encode(header, answers, nil); err == nil && len(msg) > size {
+			header.Truncated = true
+			msg, err = encode(header, nil, nil)
+		}
+	}
+	if err != nil {
+		slog.Warn("Failed to encode DNS response", "error", err)
+		return nil
+	}
+	return msg
+}
+
+func addResource(b *dnsmessage.Builder, r dnsmessage.Resource) error {
+	switch body := r.Body.(type) {
+	case *dnsmessage.AResource:
+		return b.AResource(r.Header, *body)
+	case *dnsmessage.AAAAResource:
+		return b.AAAAResource(r.Header, *body)
+	case *dnsmessage.CNAMEResource:
+		return b.CNAMEResource(r.Header, *body)
+	case *dnsmessage.SRVResource:
+		return b.SRVResource(r.Header, *body)
+	case *dnsmessage.PTRResource:
+		return b.PTRResource(r.Header, *body)
+	case *dnsmessage.TXTResource:
+		return b.TXTResource(r.Header, *body)
+	case *dnsmessage.SOAResource:
+		return b.SOAResource(r.Header, *body)
+	default:
+		return fmt.Errorf("unsupported DNS record %T", r.Body)
+	}
+}
+
+func (d *DNSServer) inZone(name dnsmessage.Name) bool {
+	_, ok := d.relative(name)
+	return ok
+}
+
+// relative returns name without the domain, lowercased, and whether it is
+// within the domain
+func (d *DNSServer) relative(name dnsmessage.Name) (string, bool) {
+	full := strings.ToLower(name.String())
+	zone := d.domain.String()
+	if full == zone {
+		return "", true
+	}
+	rel, ok := strings.CutSuffix(full, "."+zone)
+	return rel, ok
+}
+
+// name returns the fully qualified name of rel within the domain
+func (d *DNSServer) name(rel string) dnsmessage.Name {
+	name, err := dnsmessage.NewName(rel + "." + d.domain.String())
+	if err != nil {
+		return d.domain
+	}
+	return name
+}
+
+func (d *DNSServer) soa() dnsmessage.Resource {
+	ttl := d.ttl()
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: d.domain, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: ttl},
+		Body: &dnsmessage.SOAResource{
+			NS:      d.name("ns"),
+			MBox:    d.name("hostmaster"),
+			Serial:  uint32(time.Now().Unix()),
+			Refresh: 3600,
+			Retry:   600,
+			Expire:  86400,
+			MinTTL:  ttl,
+		},
+	}
+}
+
+func (d *DNSServer) ttl() uint32 {
+	return uint32(d.config.TTL / time.Second)
+}
+
+// dnsTarget is where a healthy instance of a service is reached
+type dnsTarget struct {
+	host   string
+	ip     netip.Addr
+	port   uint16
+	weight uint16
+}
+
+// label is the SRV target label of an instance addressed by IP
+func (t dnsTarget) label() string {
+	return strings.NewReplacer(".", "-", ":", "-").Replace(t.ip.String())
+}
+
+// dnsTargets returns the healthy instances of service, or the service
+// itself when it has none
+func dnsTargets(service *ServiceInfo) []dnsTarget {
+	if service.Status != StatusHealthy {
+		return nil
+	}
+	instances := service.Instances
+	if len(instances) == 0 {
+		instances = []Instance{{URL: service.URL, Status: service.Status}}
+	}
+	var targets []dnsTarget
+	for _, inst := range instances {
+		if inst.Status != StatusHealthy {
+			continue
+		}
+		u, err := url.Parse(inst.URL)
+		if err != nil || u.Hostname() == "" {
+			continue
+		}
+		port := 80
+		if u.Scheme == "https" {
+			port = 443
+		}
+		if p := u.Port(); p != "" {
+			if port, err = strconv.Atoi(p); err != nil {
+				continue
+			}
+		}
+		target := dnsTarget{host: strings.ToLower(u.Hostname()), port: uint16(port), weight: uint16(inst.weight())}
+		if ip, err := netip.ParseAddr(target.host); err == nil {
+			target.ip = ip.Unmap()
+		}
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+// resolve returns the records answering question, and whether its name
+// exists
+func (d *DNSServer) resolve(question dnsmessage.Question) (answers, additionals []dnsmessage.Resource, found bool) {
+	rel, ok := d.relative(question.Name)
+	if !ok {
+		return nil, nil, false
+	}
+	if rel == "" {
+		if question.Type == dnsmessage.TypeSOA || question.Type == dnsmessage.TypeALL {
+			answers = append(answers, d.soa())
+		}
+		return answers, nil, true
+	}
+
+	services := d.registry.snapshots()
+	byName := make(map[string]*ServiceInfo, len(services))
+	for i := range services {
+		byName[strings.ToLower(services[i].Name)] = &services[i]
+	}
+	wants := func(t dnsmessage.Type) bool {
+		return question.Type == t || question.Type == dnsmessage.TypeALL
+	}
+
+	switch {
+	case rel == "_services._dns-sd._udp":
+		if wants(dnsmessage.TypePTR) {
+			for _, scheme := range []string{"http", "https"} {
+				if len(d.browse(services, scheme)) > 0 {
+					answers = append(answers, d.ptr(question.Name, d.name("_"+scheme+"._tcp")))
+				}
+			}
+		}
+		return answers, nil, true
+
+	case rel == "_http._tcp" || rel == "_https._tcp":
+		scheme := strings.TrimSuffix(strings.TrimPrefix(rel, "_"), "._tcp")
+		if wants(dnsmessage.TypePTR) {
+			for _, name := range d.browse(services, scheme) {
+				answers = append(answers, d.ptr(question.Name, d.name(name+"._"+scheme+"._tcp")))
+			}
+		}
+		return answers, nil, true
+
+	case strings.HasSuffix(rel, "._http._tcp") || strings.HasSuffix(rel, "._https._tcp"):
+		// A DNS-SD service instance
+		name, scheme, _ := strings.Cut(rel, "._")
+		scheme = strings.TrimSuffix(scheme, "._tcp")
+		service := byName[name]
+		if service == nil || serviceScheme(service) != scheme || len(dnsTargets(service)) == 0 {
+			return nil, nil, false
+		}
+		if wants(dnsmessage.TypeSRV) {
+			srv, extra := d.srv(question.Name, service)
+			answers, additionals = append(answers, srv...), append(additionals, extra...)
+		}
+		if wants(dnsmessage.TypeTXT) {
+			answers = append(answers, d.txt(question.Name, service))
+		}
+		return answers, additionals, true
+
+	case strings.HasPrefix(rel, "_") && strings.HasSuffix(rel, "._tcp"):
+		service := byName[strings.TrimSuffix(strings.TrimPrefix(rel, "_"), "._tcp")]
+		if service == nil {
+			return nil, nil, false
+		}
+		if wants(dnsmessage.TypeSRV) {
+			answers, additionals = d.srv(question.Name, service)
+		}
+		return answers, additionals, true
+	}
+
+	if service := byName[rel]; service != nil {
+		targets := dnsTargets(service)
+		if wants(dnsmessage.TypeSRV) {
+			srv, extra := d.srv(question.Name, service)
+			answers, additionals = append(answers, srv...), append(additionals, extra...)
+		}
+		if question.Type != dnsmessage.TypeSRV {
+			answers = append(answers, d.addresses(question, targets)...)
+		}
+		return answers, additionals, true
+	}
+
+	// The SRV target of an instance addressed by IP
+	label, name, ok := strings.Cut(rel, ".")
+	if service := byName[name]; ok && service != nil {
+		for _, target := range dnsTargets(service) {
+			if target.ip.IsValid() && target.label() == label {
+				return d.addresses(question, []dnsTarget{target}), nil, true
+			}
+		}
+	}
+	return nil, nil, false
+}
+
+// browse returns the names of the healthy services reached over scheme
+// that can be named in DNS, sorted
+func (d *DNSServer) browse(services []ServiceInfo, scheme string) []string {
+	var names []string
+	for i := range services {
+		service := &services[i]
+		if serviceScheme(service) != scheme || len(dnsTargets(service)) == 0 {
+			continue
+		}
+		if name := strings.ToLower(service.Name); validDNSLabel(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// validDNSLabel reports whether label is a hostname label: 1 to 63
+// letters, digits or hyphens
+func validDNSLabel(label string) bool {
+	if label == "" || len(label) > 63 {
+		return false
+	}
+	for _, c := range label {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+func serviceScheme(service *ServiceInfo) string {
+	u, err := url.Parse(service.URL)
+	if err != nil {
+		return ""
+	}
+	return u.Scheme
+}
+
+// addresses answers an address query for targets: A or AAAA records of
+// those addressed by IP, and a CNAME to the first named by host
+func (d *DNSServer) addresses(question dnsmessage.Question, targets []dnsTarget) []dnsmessage.Resource {
+	var answers []dnsmessage.Resource
+	seen := make(map[netip.Addr]bool)
+	for _, target := range targets {
+		if !target.ip.IsValid() || seen[target.ip] {
+			continue
+		}
+		seen[target.ip] = true
+		if r, ok := d.address(question.Name, question.Type, target.ip); ok {
+			answers = append(answers, r)
+		}
+	}
+	if len(answers) == 0 && len(seen) == 0 {
+		for _, target := range targets {
+			if !target.ip.IsValid() {
+				if host, err := dnsmessage.NewName(target.host + "."); err == nil {
+					answers = append(answers, dnsmessage.Resource{
+						Header: d.header(question.Name, dnsmessage.TypeCNAME),
+						Body:   &dnsmessage.CNAMEResource{CNAME: host},
+					})
+				}
+				break
+			}
+		}
+	}
+	return answers
+}
+
+// address returns the A or AAAA record of ip, when of the type asked for
+func (d *DNSServer) address(name dnsmessage.Name, qtype dnsmessage.Type, ip netip.Addr) (dnsmessage.Resource, bool) {
+	switch {
+	case ip.Is4() && (qtype == dnsmessage.TypeA || qtype == dnsmessage.TypeALL):
+		return dnsmessage.Resource{Header: d.header(name, dnsmessage.TypeA), Body: &dnsmessage.AResource{A: ip.As4()}}, true
+	case ip.Is6() && (qtype == dnsmessage.TypeAAAA || qtype == dnsmessage.TypeALL):
+		return dnsmessage.Resource{Header: d.header(name, dnsmessage.TypeAAAA), Body: &dnsmessage.AAAAResource{AAAA: ip.As16()}}, true
+	}
+	return dnsmessage.Resource{}, false
+}
+
+// srv returns the SRV records of the healthy instances of service, with
+// the addresses of targets addressed by IP as additional records
+func (d *DNSServer) srv(name dnsmessage.Name, service *ServiceInfo) (answers, additionals []dnsmessage.Resource) {
+	for _, target := range dnsTargets(service) {
+		var host dnsmessage.Name
+		if target.ip.IsValid() {
+			host = d.name(target.label() + "." + strings.ToLower(service.Name))
+			if r, ok := d.address(host, dnsmessage.TypeALL, target.ip); ok {
+				additionals = append(additionals, r)
+			}
+		} else {
+			var err error
+			if host, err = dnsmessage.NewName(target.host + "."); err != nil {
+				continue
+			}
+		}
+		answers = append(answers, dnsmessage.Resource{
+			Header: d.header(name, dnsmessage.TypeSRV),
+			Body:   &dnsmessage.SRVResource{Priority: 0, Weight: target.weight, Port: target.port, Target: host},
+		})
+	}
+	return answers, additionals
+}
+
+// txt returns the DNS-SD TXT record of service: its path, trust level and
+// metadata as key=value strings
+func (d *DNSServer) txt(name dnsmessage.Name, service *ServiceInfo) dnsmessage.Resource {
+	path := "/"
+	if u, err := url.Parse(service.URL); err == nil && u.Path != "" {
+		path = u.Path
+	}
+	txt := []string{"path=" + path, "trust_level=" + strconv.Itoa(service.TrustLevel), "trust_score=" + strconv.Itoa(service.TrustScore)}
+	keys := make([]string, 0, len(service.Metadata))
+	for key := range service.Metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		// Each string is at most 255 bytes
+		if entry := key + "=" + service.Metadata[key]; len(entry) <= 255 && !strings.Contains(key, "=") {
+			txt = append(txt, entry)
+		}
+	}
+	return dnsmessage.Resource{Header: d.header(name, dnsmessage.TypeTXT), Body: &dnsmessage.TXTResource{TXT: txt}}
+}
+
+func (d *DNSServer) ptr(name, target dnsmessage.Name) dnsmessage.Resource {
+	return dnsmessage.Resource{Header: d.header(name, dnsmessage.TypePTR), Body: &dnsmessage.PTRResource{PTR: target}}
+}
+
+func (d *DNSServer) header(name dnsmessage.Name, t dnsmessage.Type) dnsmessage.ResourceHeader {
+	return dnsmessage.ResourceHeader{Name: name, Type: t, Class: dnsmessage.ClassINET, TTL: d.ttl()}
+}
@@ -0,0 +1,159 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EtcdConfig configures the etcd backend
+type EtcdConfig struct {
+	// Endpoint is the client URL of an etcd v3 member, e.g.
+	// "http://localhost:2379"
+	Endpoint string
+	// Username and Password authenticate when etcd has auth enabled
+	Username string
+	Password string
+	// Prefix is the key prefix of the services
+	Prefix string
+	Client *http.Client
+}
+
+// Etcd keeps services as JSON in etcd through its v3 JSON gateway, one key
+// per service under a prefix. Services with a TTL are attached to a lease
+// so etcd drops them even when no replica is running.
+type Etcd struct {
+	config EtcdConfig
+
+	mu    sync.Mutex
+	token string
+}
+
+// NewEtcd creates an etcd backend
+func NewEtcd(cfg EtcdConfig) (*Etcd, error) {
+	if cfg.Endpoint == "" {
+		return nil, errors.New("etcd registry backend needs an endpoint")
+	}
+	cfg.Endpoint = strings.TrimRight(cfg.Endpoint, "/")
+	if cfg.Prefix == "" {
+		cfg.Prefix = DefaultPrefix
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: backendTimeout}
+	}
+	return &Etcd{config: cfg}, nil
+}
+
+// etcdKeyValue is a key and value of the gateway, both base64 encoded as
+// []byte is
+type etcdKeyValue struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value,omitempty"`
+	// Lease is an int64, which the gateway writes as a string
+	Lease string `json:"lease,omitempty"`
+}
+
+// Put implements Backend
+func (e *Etcd) Put(ctx context.Context, service *ServiceInfo, ttl time.Duration) error {
+	value, err := json.Marshal(service)
+	if err != nil {
+		return err
+	}
+	kv := etcdKeyValue{Key: []byte(e.config.Prefix + service.Name), Value: value}
+	if ttl > 0 {
+		var lease struct {
+			ID string `json:"ID"`
+		}
+		// Leases are granted in whole seconds
+		seconds := int64((ttl + time.Second - 1) / time.Second)
+		if err := e.call(ctx, "/v3/lease/grant", map[string]int64{"TTL": seconds}, &lease); err != nil {
+			return fmt.Errorf("failed to grant lease: %w", err)
+		}
+		kv.Lease = lease.ID
+	}
+	return e.call(ctx, "/v3/kv/put", kv, nil)
+}
+
+// Delete implements Backend
+func (e *Etcd) Delete(ctx context.Context, name string) error {
+	return e.call(ctx, "/v3/kv/deleterange", etcdKeyValue{Key: []byte(e.config.Prefix + name)}, nil)
+}
+
+// List implements Backend
+func (e *Etcd) List(ctx context.Context) ([]*ServiceInfo, error) {
+	var resp struct {
+		KVs []etcdKeyValue `json:"kvs"`
+	}
+	prefix := []byte(e.config.Prefix)
+	err := e.call(ctx, "/v3/kv/range", map[string][]byte{"key": prefix, "range_end": prefixEnd(prefix)}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	services := make([]*ServiceInfo, 0, len(resp.KVs))
+	for _, kv := range resp.KVs {
+		if service := decodeService(string(kv.Key), kv.Value); service != nil {
+			services = append(services, service)
+		}
+	}
+	return services, nil
+}
+
+// call posts in to a gateway endpoint, authenticating first when auth is
+// configured and again once when the token was rejected
+func (e *Etcd) call(ctx context.Context, path string, in, out interface{}) error {
+	for attempt := 0; ; attempt++ {
+		header := http.Header{}
+		if e.config.Username != "" {
+			token, err := e.authenticate(ctx)
+			if err != nil {
+				return err
+			}
+			header.Set("Authorization", token)
+		}
+		status, err := doJSON(ctx, e.config.Client, http.MethodPost, e.config.Endpoint+path, header, in, out)
+		if status == http.StatusUnauthorized && e.config.Username != "" && attempt == 0 {
+			// Tokens expire; fetch a new one
+			e.mu.Lock()
+			e.token = ""
+			e.mu.Unlock()
+			continue
+		}
+		return err
+	}
+}
+
+// authenticate returns the current token, fetching one when there is none
+func (e *Etcd) authenticate(ctx context.Context) (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.token != "" {
+		return e.token, nil
+	}
+	var resp struct {
+		Token string `json:"token"`
+	}
+	credentials := map[string]string{"name": e.config.Username, "password": e.config.Password}
+	if _, err := doJSON(ctx, e.config.Client, http.MethodPost, e.config.Endpoint+"/v3/auth/authenticate", nil, credentials, &resp); err != nil {
+		return "", fmt.Errorf("etcd authentication failed: %w", err)
+	}
+	e.token = resp.Token
+	return e.token, nil
+}
+
+// prefixEnd is the range end covering every key starting with prefix
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	// Every key
+	return []byte{0}
+}
@@ -0,0 +1,239 @@
+package discovery
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Health check defaults, applied to the fields a service leaves unset
+const (
+	defaultHealthMethod  = http.MethodGet
+	defaultHealthPath    = "/health"
+	defaultHealthTimeout = 5 * time.Second
+	// maxHealthTimeout bounds how long one check may take
+	maxHealthTimeout = time.Minute
+	// maxHealthBody bounds how much of a response body is searched
+	maxHealthBody = 64 << 10
+)
+
+// HealthCheckConfig defines how a service is checked. Unset, a service is
+// checked with GET {url}/health expecting 200, at the registry's interval.
+type HealthCheckConfig struct {
+	Method string `json:"method,omitempty"`
+	// Path is appended to the service URL
+	Path string `json:"path,omitempty"`
+	// ExpectedStatus lists the healthy status codes; defaults to 200
+	ExpectedStatus []int             `json:"expected_status,omitempty"`
+	Headers        map[string]string `json:"headers,omitempty"`
+	// BodyContains, when set, must appear in the first 64 KiB of the
+	// response body
+	BodyContains string `json:"body_contains,omitempty"`
+	// Interval and Timeout are in seconds; 0 uses the registry's interval
+	// and 5 seconds
+	Interval int             `json:"interval,omitempty"`
+	Timeout  int             `json:"timeout,omitempty"`
+	TLS      *HealthCheckTLS `json:"tls,omitempty"`
+	// HealthyThreshold and UnhealthyThreshold are how many consecutive
+	// passing or failing checks it takes to change status; default 2
+	HealthyThreshold   int `json:"healthy_threshold,omitempty"`
+	UnhealthyThreshold int `json:"unhealthy_threshold,omitempty"`
+}
+
+// HealthCheckTLS configures how an HTTPS service's certificate is verified
+type HealthCheckTLS struct {
+	// CACert is a PEM bundle trusted in place of the system roots
+	CACert     string `json:"ca_cert,omitempty"`
+	ServerName string `json:"server_name,omitempty"`
+	// InsecureSkipVerify accepts any certificate; for development only
+	InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty"`
+	// MutualTLS presents the registry's client certificate when the
+	// service asks for one
+	MutualTLS bool `json:"mutual_tls,omitempty"`
+}
+
+// Validate checks the fields of a health check definition
+func (hc *HealthCheckConfig) Validate() error {
+	if hc == nil {
+		return nil
+	}
+	if hc.Method != "" {
+		switch strings.ToUpper(hc.Method) {
+		case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodOptions:
+		default:
+			return fmt.Errorf("health check method %q is not GET, HEAD, POST or OPTIONS", hc.Method)
+		}
+	}
+	if hc.Path != "" && !strings.HasPrefix(hc.Path, "/") {
+		return fmt.Errorf("health check path %q must start with /", hc.Path)
+	}
+	for _, code := range hc.ExpectedStatus {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("health check status %d is not an HTTP status", code)
+		}
+	}
+	for name := range hc.Headers {
+		if name == "" || strings.ContainsAny(name, " :\r\n") {
+			return fmt.Errorf("health check header %q is invalid", name)
+		}
+	}
+	if hc.Interval < 0 || hc.Timeout < 0 {
+		return fmt.Errorf("health check interval and timeout must not be negative")
+	}
+	if hc.HealthyThreshold < 0 || hc.UnhealthyThreshold < 0 || hc.HealthyThreshold > healthHistorySize || hc.UnhealthyThreshold > healthHistorySize {
+		return fmt.Errorf("health check thresholds must be between 0 and %d", healthHistorySize)
+	}
+	if time.Duration(hc.Timeout)*time.Second > maxHealthTimeout {
+		return fmt.Errorf("health check timeout must be at most %s", maxHealthTimeout)
+	}
+	if hc.TLS != nil && hc.TLS.CACert != "" {
+		if !x509.NewCertPool().AppendCertsFromPEM([]byte(hc.TLS.CACert)) {
+			return fmt.Errorf("health check CA certificate is not PEM")
+		}
+	}
+	return nil
+}
+
+// interval returns how often the service is checked, fallback when unset
+func (hc *HealthCheckConfig) interval(fallback time.Duration) time.Duration {
+	if hc == nil || hc.Interval == 0 {
+		return fallback
+	}
+	return time.Duration(hc.Interval) * time.Second
+}
+
+// check runs the health check of service, returning its status, the
+// certificate it was served over HTTPS and, when unhealthy, why
+func (hc *HealthChecker) check(ctx context.Context, service *ServiceInfo) (string, *CertificateStatus, error) {
+	cfg := service.HealthCheck
+	if cfg == nil {
+		cfg = &HealthCheckConfig{}
+	}
+	method, path, timeout := defaultHealthMethod, defaultHealthPath, hc.timeout
+	if cfg.Method != "" {
+		method = strings.ToUpper(cfg.Method)
+	}
+	if cfg.Path != "" {
+		path = cfg.Path
+	}
+	if cfg.Timeout > 0 {
+		timeout = time.Duration(cfg.Timeout) * time.Second
+	}
+
+	ctx, span := otel.Tracer("github.com/lsendel/impl-zamaz/pkg/discovery").Start(ctx, "discovery.health_check "+service.Name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("discovery.service", service.Name), semconv.HTTPRequestMethodKey.String(method)))
+	defer span.End()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	status, cert, err := hc.do(ctx, service, cfg, method, path)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return status, cert, err
+}
+
+// do sends a health check request
+func (hc *HealthChecker) do(ctx context.Context, service *ServiceInfo, cfg *HealthCheckConfig, method, path string) (string, *CertificateStatus, error) {
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(service.URL, "/")+path, nil)
+	if err != nil {
+		return StatusUnhealthy, nil, err
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	for name, value := range cfg.Headers {
+		if strings.EqualFold(name, "Host") {
+			req.Host = value
+			continue
+		}
+		req.Header.Set(name, value)
+	}
+
+	client, verified := hc.client, true
+	var mutual atomic.Bool
+	if cfg.TLS != nil {
+		if cfg.TLS.MutualTLS && hc.clientCert == nil {
+			return StatusUnhealthy, nil, errNoClientCertificate
+		}
+		if client, err = tlsClient(cfg.TLS, hc.clientCert, &mutual); err != nil {
+			return StatusUnhealthy, nil, err
+		}
+		defer client.CloseIdleConnections()
+		verified = !cfg.TLS.InsecureSkipVerify
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return StatusUnhealthy, nil, err
+	}
+	defer resp.Body.Close()
+	trace.SpanFromContext(ctx).SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+	cert := certificateStatus(resp.TLS, verified, mutual.Load(), time.Now())
+
+	if !expectedStatus(cfg.ExpectedStatus, resp.StatusCode) {
+		return StatusUnhealthy, cert, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	if cfg.BodyContains != "" {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxHealthBody))
+		if err != nil {
+			return StatusUnhealthy, cert, err
+		}
+		if !strings.Contains(string(body), cfg.BodyContains) {
+			return StatusUnhealthy, cert, fmt.Errorf("response body does not contain %q", cfg.BodyContains)
+		}
+	}
+	return StatusHealthy, cert, nil
+}
+
+func expectedStatus(expected []int, code int) bool {
+	if len(expected) == 0 {
+		return code == http.StatusOK
+	}
+	for _, e := range expected {
+		if e == code {
+			return true
+		}
+	}
+	return false
+}
+
+// tlsClient creates a client verifying certificates as cfg says. With
+// mutual TLS it presents the certificate of clientCert, setting mutual when
+// the service asks for it.
+func tlsClient(cfg *HealthCheckTLS, clientCert *certLoader, mutual *atomic.Bool) (*http.Client, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if cfg.MutualTLS {
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := clientCert.get()
+			if err == nil {
+				mutual.Store(true)
+			}
+			return cert, err
+		}
+	}
+	if cfg.CACert != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(cfg.CACert)) {
+			return nil, fmt.Errorf("health check CA certificate is not PEM")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport}, nil
+}
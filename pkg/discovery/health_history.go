@@ -0,0 +1,154 @@
+package discovery
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// StatusFlapping is a service whose checks keep alternating between
+// passing and failing. It is not healthy, and returns to its settled
+// status once its recent checks agree.
+const StatusFlapping = "flapping"
+
+const (
+	// healthHistorySize is how many results are kept per service
+	healthHistorySize = 20
+	// A service is flapping when its result changed flapChanges times
+	// within its last flapWindow results
+	flapWindow  = 10
+	flapChanges = 4
+	// defaultThreshold is how many consecutive results it takes to change
+	// a service's status
+	defaultThreshold = 2
+)
+
+// HealthResult is the outcome of one health check
+type HealthResult struct {
+	Time time.Time `json:"time"`
+	// Status is healthy or unhealthy
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+	// Instance is the ID of the instance checked, for services with
+	// instances
+	Instance string `json:"instance,omitempty"`
+}
+
+// healthState is what the registry remembers of a service's checks. It is
+// kept by each replica, which checks every service itself.
+type healthState struct {
+	// results are the latest results, oldest first
+	results []HealthResult
+	// settled is the status after thresholds, before flap detection
+	settled string
+	// streak counts the latest results agreeing with the last
+	streak int
+}
+
+// record adds result and returns the status the service now has. A
+// service with an unknown status takes the first result; otherwise it
+// changes only after its threshold of consecutive results.
+func (h *healthState) record(result HealthResult, current string, hc *HealthCheckConfig) string {
+	h.add(result)
+	switch {
+	case current == StatusUnknown || h.settled == "":
+		h.settled = result.Status
+	case result.Status != h.settled && h.streak >= hc.threshold(result.Status):
+		h.settled = result.Status
+	}
+	if h.flapping() {
+		return StatusFlapping
+	}
+	return h.settled
+}
+
+// add adds result to the history
+func (h *healthState) add(result HealthResult) {
+	if n := len(h.results); n > 0 && h.results[n-1].Status == result.Status {
+		h.streak++
+	} else {
+		h.streak = 1
+	}
+	h.results = append(h.results, result)
+	if len(h.results) > healthHistorySize {
+		h.results = append(h.results[:0:0], h.results[len(h.results)-healthHistorySize:]...)
+	}
+}
+
+// healthState returns the health state kept under key, creating it. The
+// registry must be locked.
+func (sr *ServiceRegistry) healthState(key string) *healthState {
+	state := sr.health[key]
+	if state == nil {
+		state = &healthState{}
+		sr.health[key] = state
+	}
+	return state
+}
+
+// forgetService drops what the registry keeps locally about a service. The
+// registry must be locked.
+func (sr *ServiceRegistry) forgetService(name string) {
+	delete(sr.nextCheck, name)
+	delete(sr.nextCatalog, name)
+	delete(sr.balancers, name)
+	for key := range sr.health {
+		if key == name || strings.HasPrefix(key, name+"\x00") {
+			delete(sr.health, key)
+		}
+	}
+}
+
+// flapping reports whether the latest results changed too often
+func (h *healthState) flapping() bool {
+	window := h.results
+	if len(window) > flapWindow {
+		window = window[len(window)-flapWindow:]
+	}
+	changes := 0
+	for i := 1; i < len(window); i++ {
+		if window[i].Status != window[i-1].Status {
+			changes++
+		}
+	}
+	return changes >= flapChanges
+}
+
+// threshold returns how many consecutive results of status it takes to
+// change to it
+func (hc *HealthCheckConfig) threshold(status string) int {
+	n := 0
+	if hc != nil {
+		if status == StatusHealthy {
+			n = hc.HealthyThreshold
+		} else {
+			n = hc.UnhealthyThreshold
+		}
+	}
+	if n <= 0 {
+		return defaultThreshold
+	}
+	return n
+}
+
+// HealthHistory returns the latest health results of a service, newest
+// first. For services with instances, they are the results of every
+// instance.
+func (sr *ServiceRegistry) HealthHistory(name string) ([]HealthResult, error) {
+	sr.refresh()
+
+	sr.mu.RLock()
+	defer sr.mu.RUnlock()
+	if _, exists := sr.services[name]; !exists {
+		return nil, fmt.Errorf("service %s %w", name, ErrServiceNotFound)
+	}
+	state := sr.health[name]
+	history := make([]HealthResult, 0, healthHistorySize)
+	if state != nil {
+		for i := len(state.results) - 1; i >= 0; i-- {
+			history = append(history, state.results[i])
+		}
+	}
+	return history, nil
+}
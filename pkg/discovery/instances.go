@@ -0,0 +1,360 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Load balancing strategies for resolving a service to an instance
+const (
+	StrategyRoundRobin       = "round_robin"
+	StrategyLeastConnections = "least_connections"
+	// StrategyWeighted spreads requests in proportion to instance weights
+	StrategyWeighted = "weighted"
+)
+
+// maxInstanceWeight bounds the weight of an instance
+const maxInstanceWeight = 1000
+
+var (
+	// ErrNoHealthyInstance is returned when resolving a service without a
+	// healthy instance
+	ErrNoHealthyInstance = errors.New("no healthy instance")
+	// ErrUnknownStrategy is returned for a load balancing strategy that
+	// does not exist
+	ErrUnknownStrategy = errors.New("unknown load balancing strategy")
+)
+
+// Instance is one of the processes serving a service, checked on its own
+type Instance struct {
+	// ID defaults to Address
+	ID string `json:"id"`
+	// Address is the host:port of the instance
+	Address string `json:"address"`
+	// URL is the service URL with the instance's address
+	URL string `json:"url"`
+	// Weight is the instance's share under the weighted strategy; 0 is 1
+	Weight      int               `json:"weight,omitempty"`
+	Status      string            `json:"status"`
+	LastChecked time.Time         `json:"last_checked,omitempty"`
+	LastError   string            `json:"last_error,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	// TrustScore and Certificate rate the instance as for a service
+	TrustScore  int                `json:"trust_score"`
+	Certificate *CertificateStatus `json:"certificate,omitempty"`
+}
+
+func (i *Instance) weight() int {
+	if i.Weight == 0 {
+		return 1
+	}
+	return i.Weight
+}
+
+// prepareInstances validates the instances and load balancing strategy of
+// service and fills in their defaults
+func prepareInstances(service *ServiceInfo) error {
+	if err := validStrategy(service.LoadBalancing); err != nil {
+		return err
+	}
+	base, err := url.Parse(service.URL)
+	if err != nil {
+		return fmt.Errorf("invalid service URL: %w", err)
+	}
+	seen := make(map[string]bool, len(service.Instances))
+	for i := range service.Instances {
+		inst := &service.Instances[i]
+		host, port, err := net.SplitHostPort(inst.Address)
+		if err != nil || host == "" {
+			return fmt.Errorf("instance address %q is not host:port", inst.Address)
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("instance address %q has an invalid port", inst.Address)
+		}
+		if inst.Weight < 0 || inst.Weight > maxInstanceWeight {
+			return fmt.Errorf("instance weight must be between 0 and %d", maxInstanceWeight)
+		}
+		if inst.ID == "" {
+			inst.ID = inst.Address
+		}
+		if seen[inst.ID] {
+			return fmt.Errorf("instance %q is listed twice", inst.ID)
+		}
+		seen[inst.ID] = true
+		u := *base
+		u.Host = inst.Address
+		inst.URL = u.String()
+		if inst.Status == "" || inst.Status == StatusExpired {
+			inst.Status = StatusUnknown
+		}
+	}
+	return nil
+}
+
+func validStrategy(strategy string) error {
+	switch strategy {
+	case "", StrategyRoundRobin, StrategyLeastConnections, StrategyWeighted:
+		return nil
+	default:
+		return fmt.Errorf("%w %q", ErrUnknownStrategy, strategy)
+	}
+}
+
+// aggregateStatus is healthy while any instance is, unknown until one has
+// been checked, and otherwise unhealthy
+func aggregateStatus(instances []Instance) string {
+	status := StatusUnknown
+	for _, inst := range instances {
+		switch inst.Status {
+		case StatusHealthy:
+			return StatusHealthy
+		case StatusUnknown:
+		default:
+			status = StatusUnhealthy
+		}
+	}
+	return status
+}
+
+// instanceKey is the key of an instance's health state
+func instanceKey(service, id string) string {
+	return service + "\x00" + id
+}
+
+// checkInstances checks every instance of a service, settling each
+// instance's status on its own and the service's from theirs
+func (sr *ServiceRegistry) checkInstances(service *ServiceInfo, snapshot ServiceInfo) {
+	results := make([]HealthResult, len(snapshot.Instances))
+	certs := make(map[string]*CertificateStatus, len(snapshot.Instances))
+	var certsMu sync.Mutex
+	var wg sync.WaitGroup
+	for i, inst := range snapshot.Instances {
+		wg.Add(1)
+		go func(i int, inst Instance) {
+			defer wg.Done()
+			target := snapshot
+			target.URL = inst.URL
+			started := time.Now()
+			status, cert, err := sr.checker.check(context.Background(), &target)
+			certsMu.Lock()
+			certs[inst.ID] = cert
+			certsMu.Unlock()
+			results[i] = HealthResult{Time: started, Status: status, DurationMs: time.Since(started).Milliseconds(), Instance: inst.ID}
+			if err != nil {
+				results[i].Error = err.Error()
+			}
+		}(i, inst)
+	}
+	wg.Wait()
+
+	name := snapshot.Name
+	sr.mu.Lock()
+	if sr.services[name] != service || service.Status == StatusExpired {
+		// Deregistered or expired while the checks were running
+		sr.mu.Unlock()
+		return
+	}
+	history := sr.healthState(name)
+	byID := make(map[string]HealthResult, len(results))
+	for _, result := range results {
+		byID[result.Instance] = result
+		history.add(result)
+	}
+	unhealthy, lowest := 0, -1
+	for i := range service.Instances {
+		inst := &service.Instances[i]
+		result, ok := byID[inst.ID]
+		if !ok {
+			// Added since the checks started
+			continue
+		}
+		inst.Status = sr.healthState(instanceKey(name, inst.ID)).record(result, inst.Status, service.HealthCheck)
+		inst.LastChecked = result.Time
+		inst.LastError = result.Error
+		noteRotation(certs[inst.ID], inst.Certificate, result.Time)
+		inst.Certificate = certs[inst.ID]
+		inst.TrustScore = trustScore(inst.URL, inst.Certificate)
+		if lowest < 0 || inst.TrustScore < lowest {
+			lowest = inst.TrustScore
+		}
+		if inst.Status != StatusHealthy {
+			unhealthy++
+		}
+	}
+	if lowest >= 0 {
+		service.TrustScore = lowest
+	}
+	previous := service.Status
+	service.LastChecked = time.Now()
+	service.Status = service.withBreaker(aggregateStatus(service.Instances))
+	service.LastError = ""
+	if unhealthy > 0 {
+		service.LastError = fmt.Sprintf("%d of %d instances not healthy", unhealthy, len(service.Instances))
+	}
+	if service.Status != previous {
+		sr.publish(EventStatusChanged, service, previous)
+	}
+	snapshot = *service
+	snapshot.Instances = append([]Instance(nil), service.Instances...)
+	sr.mu.Unlock()
+
+	if err := sr.persist(&snapshot); err != nil && !errors.Is(err, ErrReadOnly) {
+		slog.Warn("Failed to share service health", "service", name, "error", err)
+	}
+}
+
+// balancer keeps the load balancing state of a service
+type balancer struct {
+	next uint64
+	// current are the smooth weighted round-robin weights by instance
+	current map[string]int
+	// active counts the connections to each instance not yet released
+	active map[string]int
+}
+
+// Resolve picks a healthy instance of a service with strategy, or the
+// service's own strategy when empty, round-robin by default. A service
+// without instances resolves to itself. A service whose circuit breaker is
+// open is not resolved. Calling release when done with the
+// instance ends the connection least-connections counts.
+func (sr *ServiceRegistry) Resolve(name, strategy string) (*Instance, func(), error) {
+	service, err := sr.GetService(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	if strategy == "" {
+		strategy = service.LoadBalancing
+	}
+	if err := validStrategy(strategy); err != nil {
+		return nil, nil, err
+	}
+	if service.Breaker == BreakerOpen {
+		return nil, nil, fmt.Errorf("service %s has its %w", name, ErrCircuitOpen)
+	}
+	instances := service.Instances
+	if len(instances) == 0 {
+		instances = []Instance{{ID: service.Name, URL: service.URL, Status: sr.checkedStatus(name, service)}}
+		if u, err := url.Parse(service.URL); err == nil {
+			instances[0].Address = u.Host
+		}
+	}
+	var healthy []*Instance
+	for i := range instances {
+		if instances[i].Status == StatusHealthy {
+			healthy = append(healthy, &instances[i])
+		}
+	}
+	if len(healthy) == 0 || service.Status == StatusExpired {
+		return nil, nil, fmt.Errorf("service %s has %w", name, ErrNoHealthyInstance)
+	}
+
+	b := sr.balancers[name]
+	if b == nil {
+		b = &balancer{current: make(map[string]int), active: make(map[string]int)}
+		sr.balancers[name] = b
+	}
+	var picked *Instance
+	switch strategy {
+	case StrategyLeastConnections:
+		// Ties go round-robin
+		start := int(b.next % uint64(len(healthy)))
+		b.next++
+		for i := range healthy {
+			inst := healthy[(start+i)%len(healthy)]
+			if picked == nil || b.active[inst.ID] < b.active[picked.ID] {
+				picked = inst
+			}
+		}
+	case StrategyWeighted:
+		// Smooth weighted round-robin: spread out, yet in proportion
+		total := 0
+		for _, inst := range healthy {
+			b.current[inst.ID] += inst.weight()
+			total += inst.weight()
+			if picked == nil || b.current[inst.ID] > b.current[picked.ID] {
+				picked = inst
+			}
+		}
+		b.current[picked.ID] -= total
+	default:
+		picked = healthy[b.next%uint64(len(healthy))]
+		b.next++
+	}
+
+	chosen := *picked
+	b.active[chosen.ID]++
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			sr.mu.Lock()
+			defer sr.mu.Unlock()
+			if b.active[chosen.ID]--; b.active[chosen.ID] <= 0 {
+				delete(b.active, chosen.ID)
+			}
+		})
+	}
+	return &chosen, release, nil
+}
+
+// HandleResolve returns a healthy instance of a service, chosen by the
+// strategy query parameter or else the service's own. The instance is not
+// counted as a connection, as HTTP clients do not report when they finish.
+func (h *ServiceDiscoveryHandler) HandleResolve(w http.ResponseWriter, r *http.Request) {
+	serviceName := resolveName(r)
+	if serviceName == "" {
+		http.Error(w, "service name required", http.StatusBadRequest)
+		return
+	}
+
+	strategy := r.URL.Query().Get("strategy")
+	instance, release, err := h.registry.Resolve(serviceName, strategy)
+	switch {
+	case errors.Is(err, ErrServiceNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, ErrUnknownStrategy):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, ErrNoHealthyInstance), errors.Is(err, ErrCircuitOpen):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	release()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"name":     serviceName,
+		"instance": instance,
+	})
+}
+
+// resolveName is the name query parameter, or else the path segment after
+// "resolve"
+func resolveName(r *http.Request) string {
+	if name := r.URL.Query().Get("name"); name != "" {
+		return name
+	}
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	for i := len(segments) - 2; i >= 0; i-- {
+		if segments[i] == "resolve" {
+			return segments[i+1]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,165 @@
+package discovery
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// serviceAccountDir holds the credentials Kubernetes mounts into pods
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount/"
+
+// TrustLevelLabel is the label of a Kubernetes Service, copied to its
+// Endpoints, giving the trust level its service requires
+const TrustLevelLabel = "zamaz.io/trust-level"
+
+// KubernetesConfig configures the Kubernetes backend. Left empty, the API
+// server, token, CA and namespace are those of the pod's service account.
+type KubernetesConfig struct {
+	// APIServer is the URL of the API server
+	APIServer string
+	// Token is a bearer token allowed to list endpoints in Namespace
+	Token string
+	// CAFile verifies the API server certificate
+	CAFile    string
+	Namespace string
+	// LabelSelector limits the services listed, e.g. "zamaz.io/discover=true"
+	LabelSelector string
+	Client        *http.Client
+}
+
+// Kubernetes lists services from the Endpoints of a namespace. Kubernetes
+// is the source of truth for them, so the backend is read-only: services
+// are registered by deploying them, and are healthy while they have ready
+// addresses.
+type Kubernetes struct {
+	config KubernetesConfig
+}
+
+// NewKubernetes creates a Kubernetes backend
+func NewKubernetes(cfg KubernetesConfig) (*Kubernetes, error) {
+	if cfg.APIServer == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, errors.New("kubernetes registry backend needs an API server outside a cluster")
+		}
+		cfg.APIServer = "https://" + net.JoinHostPort(host, port)
+	}
+	cfg.APIServer = strings.TrimRight(cfg.APIServer, "/")
+	if cfg.Token == "" {
+		token, err := os.ReadFile(serviceAccountDir + "token")
+		if err != nil {
+			return nil, fmt.Errorf("failed to read service account token: %w", err)
+		}
+		cfg.Token = strings.TrimSpace(string(token))
+	}
+	if cfg.Namespace == "" {
+		namespace, err := os.ReadFile(serviceAccountDir + "namespace")
+		if err != nil {
+			return nil, fmt.Errorf("failed to read service account namespace: %w", err)
+		}
+		cfg.Namespace = strings.TrimSpace(string(namespace))
+	}
+	if cfg.Client == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		if cfg.CAFile == "" {
+			if _, err := os.Stat(serviceAccountDir + "ca.crt"); err == nil {
+				cfg.CAFile = serviceAccountDir + "ca.crt"
+			}
+		}
+		if cfg.CAFile != "" {
+			pem, err := os.ReadFile(cfg.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read kubernetes CA: %w", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates in %s", cfg.CAFile)
+			}
+			transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+		}
+		cfg.Client = &http.Client{Timeout: backendTimeout, Transport: transport}
+	}
+	return &Kubernetes{config: cfg}, nil
+}
+
+// Put implements Backend; services are registered by deploying them
+func (k *Kubernetes) Put(ctx context.Context, service *ServiceInfo, ttl time.Duration) error {
+	return fmt.Errorf("%w: deploy service %s to namespace %s instead", ErrReadOnly, service.Name, k.config.Namespace)
+}
+
+// Delete implements Backend; services are removed by deleting them
+func (k *Kubernetes) Delete(ctx context.Context, name string) error {
+	return fmt.Errorf("%w: delete service %s from namespace %s instead", ErrReadOnly, name, k.config.Namespace)
+}
+
+// List implements Backend. Each Endpoints object is a service reached
+// through its cluster DNS name on its first port, over HTTPS when the port
+// is named "https" or is 443.
+func (k *Kubernetes) List(ctx context.Context) ([]*ServiceInfo, error) {
+	var list struct {
+		Items []struct {
+			Metadata struct {
+				Name   string            `json:"name"`
+				Labels map[string]string `json:"labels"`
+			} `json:"metadata"`
+			Subsets []struct {
+				Addresses         []struct{} `json:"addresses"`
+				NotReadyAddresses []struct{} `json:"notReadyAddresses"`
+				Ports             []struct {
+					Name string `json:"name"`
+					Port int    `json:"port"`
+				} `json:"ports"`
+			} `json:"subsets"`
+		} `json:"items"`
+	}
+	location := k.config.APIServer + "/api/v1/namespaces/" + url.PathEscape(k.config.Namespace) + "/endpoints"
+	if k.config.LabelSelector != "" {
+		location += "?" + url.Values{"labelSelector": {k.config.LabelSelector}}.Encode()
+	}
+	header := http.Header{"Authorization": {"Bearer " + k.config.Token}}
+	if _, err := doJSON(ctx, k.config.Client, http.MethodGet, location, header, nil, &list); err != nil {
+		return nil, err
+	}
+
+	services := make([]*ServiceInfo, 0, len(list.Items))
+	for _, item := range list.Items {
+		port, scheme, ready := 0, "http", false
+		for _, subset := range item.Subsets {
+			if len(subset.Ports) > 0 && port == 0 {
+				port = subset.Ports[0].Port
+				if subset.Ports[0].Name == "https" || port == 443 {
+					scheme = "https"
+				}
+			}
+			ready = ready || len(subset.Addresses) > 0
+		}
+		if port == 0 {
+			// Nothing to reach, e.g. a headless service without ports
+			continue
+		}
+		service := &ServiceInfo{
+			Name:     item.Metadata.Name,
+			URL:      fmt.Sprintf("%s://%s.%s.svc:%d", scheme, item.Metadata.Name, k.config.Namespace, port),
+			Status:   StatusUnhealthy,
+			Metadata: item.Metadata.Labels,
+		}
+		if ready {
+			service.Status = StatusHealthy
+		}
+		if level, err := strconv.Atoi(item.Metadata.Labels[TrustLevelLabel]); err == nil {
+			service.TrustLevel = level
+		}
+		services = append(services, service)
+	}
+	return services, nil
+}
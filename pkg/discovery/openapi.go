@@ -0,0 +1,340 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// OpenAPI catalog defaults, applied to the fields a service leaves unset
+const (
+	defaultOpenAPIPath    = "/openapi.json"
+	defaultOpenAPIRefresh = 5 * time.Minute
+	openAPITimeout        = 10 * time.Second
+	// maxOpenAPIBody bounds the size of a document
+	maxOpenAPIBody = 4 << 20
+	// maxOpenAPIEndpoints bounds how many endpoints a document adds
+	maxOpenAPIEndpoints = 1000
+	// maxEndpointDescription bounds the description taken from a document
+	maxEndpointDescription = 200
+)
+
+// EndpointSourceOpenAPI marks the endpoints read from a service's OpenAPI
+// document, replaced whenever it is read again
+const EndpointSourceOpenAPI = "openapi"
+
+// openAPIMethods are the operations of an OpenAPI path item
+var openAPIMethods = []string{"get", "put", "post", "delete", "options", "head", "patch", "trace"}
+
+// OpenAPIConfig has the registry read a service's endpoints from its OpenAPI
+// document, JSON or YAML, OpenAPI 3 or Swagger 2. Paths are taken as
+// written, relative to the service URL. An operation's summary describes
+// its endpoint, its security requirements give the scopes and an
+// x-trust-level extension the trust level it requires. Endpoints
+// registered with the service take precedence over those read.
+type OpenAPIConfig struct {
+	// Path of the document, appended to the service URL; defaults to
+	// /openapi.json. It is fetched with the health check's TLS settings.
+	Path string `json:"path,omitempty"`
+	// Refresh, in seconds, is how often the document is read again; 0 is
+	// every 5 minutes
+	Refresh int `json:"refresh,omitempty"`
+	// LastSynced is when the document was last read, LastError why it
+	// could not be since
+	LastSynced time.Time `json:"last_synced,omitempty"`
+	LastError  string    `json:"last_error,omitempty"`
+}
+
+// Validate checks the fields of an OpenAPI catalog definition
+func (oc *OpenAPIConfig) Validate() error {
+	if oc == nil {
+		return nil
+	}
+	if oc.Path != "" && !strings.HasPrefix(oc.Path, "/") {
+		return fmt.Errorf("OpenAPI path %q must start with /", oc.Path)
+	}
+	if oc.Refresh < 0 {
+		return fmt.Errorf("OpenAPI refresh must not be negative")
+	}
+	return nil
+}
+
+// refresh returns how often the document is read
+func (oc *OpenAPIConfig) refresh() time.Duration {
+	if oc.Refresh == 0 {
+		return defaultOpenAPIRefresh
+	}
+	return time.Duration(oc.Refresh) * time.Second
+}
+
+// refreshDueCatalogs reads again, in the background, the OpenAPI documents
+// whose refresh interval has passed
+func (sr *ServiceRegistry) refreshDueCatalogs() {
+	now := time.Now()
+	var due []string
+	sr.mu.Lock()
+	for name, service := range sr.services {
+		if service.OpenAPI == nil || service.Status == StatusExpired || now.Before(sr.nextCatalog[name]) {
+			continue
+		}
+		sr.nextCatalog[name] = now.Add(service.OpenAPI.refresh())
+		due = append(due, name)
+	}
+	sr.mu.Unlock()
+
+	for _, name := range due {
+		go sr.RefreshCatalog(name)
+	}
+}
+
+// RefreshCatalog reads a service's OpenAPI document now, replacing the
+// endpoints read before. A service without one is left as is.
+func (sr *ServiceRegistry) RefreshCatalog(name string) error {
+	sr.mu.RLock()
+	service, exists := sr.services[name]
+	var snapshot ServiceInfo
+	if exists {
+		snapshot = service.snapshot()
+	}
+	sr.mu.RUnlock()
+	if !exists {
+		return fmt.Errorf("service %s %w", name, ErrServiceNotFound)
+	}
+	if snapshot.OpenAPI == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), openAPITimeout)
+	defer cancel()
+	discovered, fetchErr := sr.fetchOpenAPI(ctx, &snapshot)
+
+	sr.mu.Lock()
+	if sr.services[name] != service || service.OpenAPI == nil {
+		// Deregistered or registered again while the document was read
+		sr.mu.Unlock()
+		return fetchErr
+	}
+	catalog := *service.OpenAPI
+	if fetchErr != nil {
+		catalog.LastError = fetchErr.Error()
+	} else {
+		catalog.LastSynced, catalog.LastError = time.Now(), ""
+		service.Endpoints = mergeEndpoints(service.Endpoints, discovered)
+	}
+	// Replaced rather than updated, as snapshots share it
+	service.OpenAPI = &catalog
+	snapshot = service.snapshot()
+	sr.mu.Unlock()
+
+	if fetchErr != nil {
+		slog.Warn("Failed to read service OpenAPI document", "service", name, "error", fetchErr)
+		return fetchErr
+	}
+	if err := sr.persist(&snapshot); err != nil && !errors.Is(err, ErrReadOnly) {
+		slog.Warn("Failed to share service endpoints", "service", name, "error", err)
+	}
+	return nil
+}
+
+// mergeEndpoints replaces the endpoints read before with discovered, unless
+// an endpoint registered with the service has the same method and path
+func mergeEndpoints(current, discovered []EndpointInfo) []EndpointInfo {
+	merged := make([]EndpointInfo, 0, len(current)+len(discovered))
+	declared := make(map[string]bool, len(current))
+	for _, endpoint := range current {
+		if endpoint.Source == EndpointSourceOpenAPI {
+			continue
+		}
+		merged = append(merged, endpoint)
+		declared[strings.ToUpper(endpoint.Method)+" "+endpoint.Path] = true
+	}
+	for _, endpoint := range discovered {
+		if !declared[endpoint.Method+" "+endpoint.Path] {
+			merged = append(merged, endpoint)
+		}
+	}
+	return merged
+}
+
+// fetchOpenAPI reads the endpoints of a service's OpenAPI document, from a
+// healthy instance when it has instances
+func (sr *ServiceRegistry) fetchOpenAPI(ctx context.Context, service *ServiceInfo) ([]EndpointInfo, error) {
+	base := service.URL
+	if len(service.Instances) > 0 {
+		base = ""
+		for _, inst := range service.Instances {
+			if inst.Status == StatusHealthy {
+				base = inst.URL
+				break
+			}
+		}
+		if base == "" {
+			return nil, fmt.Errorf("service %s has %w", service.Name, ErrNoHealthyInstance)
+		}
+	}
+	path := service.OpenAPI.Path
+	if path == "" {
+		path = defaultOpenAPIPath
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(base, "/")+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json, application/yaml;q=0.9, */*;q=0.5")
+	client := sr.checker.client
+	if hc := service.HealthCheck; hc != nil && hc.TLS != nil {
+		if hc.TLS.MutualTLS && sr.checker.clientCert == nil {
+			return nil, errNoClientCertificate
+		}
+		var mutual atomic.Bool
+		if client, err = tlsClient(hc.TLS, sr.checker.clientCert, &mutual); err != nil {
+			return nil, err
+		}
+		defer client.CloseIdleConnections()
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxOpenAPIBody+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxOpenAPIBody {
+		return nil, fmt.Errorf("OpenAPI document exceeds %d bytes", maxOpenAPIBody)
+	}
+	return parseOpenAPI(body)
+}
+
+// parseOpenAPI reads the endpoints of an OpenAPI document, sorted by path
+// and method
+func parseOpenAPI(data []byte) ([]EndpointInfo, error) {
+	var doc map[string]interface{}
+	var err error
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		err = json.Unmarshal(trimmed, &doc)
+	} else {
+		err = yaml.Unmarshal(data, &doc)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid OpenAPI document: %w", err)
+	}
+	if _, ok := doc["openapi"]; !ok {
+		if _, ok := doc["swagger"]; !ok {
+			return nil, errors.New("invalid OpenAPI document: no openapi or swagger version")
+		}
+	}
+	paths, _ := doc["paths"].(map[string]interface{})
+	defaultScopes := securityScopes(doc["security"])
+
+	var endpoints []EndpointInfo
+	for path, item := range paths {
+		operations, ok := item.(map[string]interface{})
+		if !ok || !strings.HasPrefix(path, "/") {
+			continue
+		}
+		for _, method := range openAPIMethods {
+			operation, ok := operations[method].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if len(endpoints) == maxOpenAPIEndpoints {
+				return nil, fmt.Errorf("OpenAPI document has more than %d operations", maxOpenAPIEndpoints)
+			}
+			endpoint := EndpointInfo{
+				Path:        path,
+				Method:      strings.ToUpper(method),
+				Description: operationDescription(operation),
+				Scopes:      defaultScopes,
+				Source:      EndpointSourceOpenAPI,
+			}
+			if security, ok := operation["security"]; ok {
+				endpoint.Scopes = securityScopes(security)
+			}
+			if level, ok := operation["x-trust-level"]; ok {
+				if endpoint.TrustLevel, ok = trustLevelExtension(level); !ok {
+					return nil, fmt.Errorf("x-trust-level of %s %s must be between 0 and 100", endpoint.Method, path)
+				}
+			}
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+
+	sort.Slice(endpoints, func(i, j int) bool {
+		if endpoints[i].Path != endpoints[j].Path {
+			return endpoints[i].Path < endpoints[j].Path
+		}
+		return endpoints[i].Method < endpoints[j].Method
+	})
+	return endpoints, nil
+}
+
+// operationDescription is an operation's summary, or else the first line of
+// its description
+func operationDescription(operation map[string]interface{}) string {
+	text, _ := operation["summary"].(string)
+	if strings.TrimSpace(text) == "" {
+		text, _ = operation["description"].(string)
+	}
+	text, _, _ = strings.Cut(strings.TrimSpace(text), "\n")
+	if runes := []rune(text); len(runes) > maxEndpointDescription {
+		text = string(runes[:maxEndpointDescription])
+	}
+	return strings.TrimSpace(text)
+}
+
+// securityScopes collects the scopes of a list of security requirements,
+// sorted and without repeats
+func securityScopes(security interface{}) []string {
+	requirements, _ := security.([]interface{})
+	seen := make(map[string]bool)
+	var scopes []string
+	for _, requirement := range requirements {
+		schemes, _ := requirement.(map[string]interface{})
+		for _, list := range schemes {
+			values, _ := list.([]interface{})
+			for _, value := range values {
+				if scope, ok := value.(string); ok && scope != "" && !seen[scope] {
+					seen[scope] = true
+					scopes = append(scopes, scope)
+				}
+			}
+		}
+	}
+	sort.Strings(scopes)
+	return scopes
+}
+
+// trustLevelExtension reads an x-trust-level value, decoded from JSON or
+// YAML
+func trustLevelExtension(value interface{}) (int, bool) {
+	var level int
+	switch v := value.(type) {
+	case int:
+		level = v
+	case float64:
+		if v != float64(int(v)) {
+			return 0, false
+		}
+		level = int(v)
+	default:
+		return 0, false
+	}
+	return level, level >= 0 && level <= 100
+}
@@ -0,0 +1,217 @@
+package discovery
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// defaultQueryLimit is the page size of queries that do not set one
+	defaultQueryLimit = 100
+	// maxQueryLimit bounds the page size
+	maxQueryLimit = 1000
+)
+
+// Sort orders of service queries. Prefixed with "-", they are descending.
+const (
+	SortByName       = "name"
+	SortByStatus     = "status"
+	SortByTrustLevel = "trust_level"
+	SortByTrustScore = "trust_score"
+	SortByLastCheck  = "last_checked"
+)
+
+// ServiceQuery selects, orders and pages services. Its zero value matches
+// every service.
+type ServiceQuery struct {
+	// Statuses match services with any of them
+	Statuses []string
+	// Tags match services with all of them
+	Tags []string
+	// Metadata matches services with all of its entries
+	Metadata map[string]string
+	// MinTrust and MaxTrust bound the trust level a service requires;
+	// MaxTrust, when set, is usually the caller's, listing the services it
+	// may call
+	MinTrust int
+	MaxTrust *int
+	// MinTrustScore is the lowest trust score matched
+	MinTrustScore int
+	// Sort is one of the sort orders; the default is by name
+	Sort   string
+	Offset int
+	// Limit is the page size; 0 is defaultQueryLimit
+	Limit int
+}
+
+// ParseServiceQuery reads a query from the parameters:
+//
+//	status=healthy,unknown  any of the statuses; repeatable
+//	tag=pii                 every tag; repeatable
+//	metadata.type=api       the metadata entry; one per key
+//	minTrust, maxTrust      bounds of the required trust level
+//	minTrustScore           the lowest trust score
+//	sort=-trust_score       the order, descending with "-"
+//	offset, limit           the page
+func ParseServiceQuery(values url.Values) (ServiceQuery, error) {
+	var q ServiceQuery
+	for _, value := range values["status"] {
+		for _, status := range strings.Split(value, ",") {
+			if status = strings.TrimSpace(status); status != "" {
+				q.Statuses = append(q.Statuses, status)
+			}
+		}
+	}
+	for _, tag := range values["tag"] {
+		if tag != "" {
+			q.Tags = append(q.Tags, tag)
+		}
+	}
+	for key, value := range values {
+		name, ok := strings.CutPrefix(key, "metadata.")
+		if !ok {
+			continue
+		}
+		if name == "" || len(value) != 1 {
+			return q, fmt.Errorf("metadata filter %q must name one key with one value", key)
+		}
+		if q.Metadata == nil {
+			q.Metadata = make(map[string]string)
+		}
+		q.Metadata[name] = value[0]
+	}
+
+	ints := []struct {
+		name string
+		into *int
+	}{
+		{"minTrust", &q.MinTrust},
+		{"minTrustScore", &q.MinTrustScore},
+		{"offset", &q.Offset},
+		{"limit", &q.Limit},
+	}
+	for _, param := range ints {
+		if raw := values.Get(param.name); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n < 0 {
+				return q, fmt.Errorf("%s must be a non-negative integer", param.name)
+			}
+			*param.into = n
+		}
+	}
+	if raw := values.Get("maxTrust"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			return q, fmt.Errorf("maxTrust must be a non-negative integer")
+		}
+		q.MaxTrust = &n
+	}
+	if q.Limit > maxQueryLimit {
+		return q, fmt.Errorf("limit must be at most %d", maxQueryLimit)
+	}
+
+	q.Sort = values.Get("sort")
+	if q.less() == nil {
+		return q, fmt.Errorf("unknown sort order %q", q.Sort)
+	}
+	if q.Limit == 0 {
+		q.Limit = defaultQueryLimit
+	}
+	return q, nil
+}
+
+// matches reports whether service is selected by the query
+func (q *ServiceQuery) matches(service *ServiceInfo) bool {
+	if len(q.Statuses) > 0 && !contains(q.Statuses, service.Status) {
+		return false
+	}
+	for _, tag := range q.Tags {
+		if !contains(service.Tags, tag) {
+			return false
+		}
+	}
+	for key, value := range q.Metadata {
+		if v, ok := service.Metadata[key]; !ok || v != value {
+			return false
+		}
+	}
+	if service.TrustLevel < q.MinTrust || (q.MaxTrust != nil && service.TrustLevel > *q.MaxTrust) {
+		return false
+	}
+	return service.TrustScore >= q.MinTrustScore
+}
+
+// less returns how the query orders services, ties broken by name, or nil
+// for an unknown order
+func (q *ServiceQuery) less() func(a, b *ServiceInfo) bool {
+	order, descending := strings.CutPrefix(q.Sort, "-")
+	var compare func(a, b *ServiceInfo) int
+	switch order {
+	case "", SortByName:
+		compare = func(a, b *ServiceInfo) int { return strings.Compare(a.Name, b.Name) }
+	case SortByStatus:
+		compare = func(a, b *ServiceInfo) int { return strings.Compare(a.Status, b.Status) }
+	case SortByTrustLevel:
+		compare = func(a, b *ServiceInfo) int { return a.TrustLevel - b.TrustLevel }
+	case SortByTrustScore:
+		compare = func(a, b *ServiceInfo) int { return a.TrustScore - b.TrustScore }
+	case SortByLastCheck:
+		compare = func(a, b *ServiceInfo) int { return a.LastChecked.Compare(b.LastChecked) }
+	default:
+		return nil
+	}
+	return func(a, b *ServiceInfo) bool {
+		c := compare(a, b)
+		if descending {
+			c = -c
+		}
+		if c == 0 {
+			return a.Name < b.Name
+		}
+		return c < 0
+	}
+}
+
+// QueryServices returns copies of the page of services matching q, and how
+// many match in all
+func (sr *ServiceRegistry) QueryServices(q ServiceQuery) ([]*ServiceInfo, int) {
+	less := q.less()
+	if less == nil {
+		less = (&ServiceQuery{}).less()
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultQueryLimit
+	}
+
+	services := sr.snapshots()
+	matched := make([]*ServiceInfo, 0, len(services))
+	for i := range services {
+		if q.matches(&services[i]) {
+			matched = append(matched, &services[i])
+		}
+	}
+
+	sort.Slice(matched, func(i, j int) bool { return less(matched[i], matched[j]) })
+	total := len(matched)
+	if q.Offset >= total {
+		return []*ServiceInfo{}, total
+	}
+	end := q.Offset + limit
+	if end > total {
+		end = total
+	}
+	return matched[q.Offset:end], total
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
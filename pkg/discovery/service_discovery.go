@@ -3,21 +3,109 @@ package discovery
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+// storeKeyPrefix namespaces registry entries in the shared store
+const storeKeyPrefix = "discovery:services:"
+
+// storeTimeout bounds each round trip to the backend
+const storeTimeout = 5 * time.Second
+
+// Service statuses
+const (
+	StatusHealthy   = "healthy"
+	StatusUnhealthy = "unhealthy"
+	StatusUnknown   = "unknown"
+	// StatusExpired is a service that did not renew its registration
+	// within its TTL. It is no longer checked, and is removed once another
+	// TTL passes without a heartbeat.
+	StatusExpired = "expired"
 )
 
+// ErrServiceNotFound is returned for a service that is not registered
+var ErrServiceNotFound = errors.New("not found")
+
+// ErrNotOwner is returned for changes to a service registered by another
+// owner
+var ErrNotOwner = errors.New("is registered by another owner")
+
 // ServiceInfo represents a discovered service
 type ServiceInfo struct {
 	Name        string            `json:"name"`
 	URL         string            `json:"url"`
-	Status      string            `json:"status"` // healthy, unhealthy, unknown
+	Status      string            `json:"status"` // healthy, unhealthy, flapping, unknown, expired, degraded
 	TrustLevel  int               `json:"trust_level_required"`
 	Endpoints   []EndpointInfo    `json:"endpoints"`
 	LastChecked time.Time         `json:"last_checked"`
 	Metadata    map[string]string `json:"metadata"`
+	// Tags label the service for discovery queries, such as pii
+	Tags []string `json:"tags,omitempty"`
+	// TTL, in seconds, makes the registration lapse unless renewed by a
+	// heartbeat within it; 0 keeps the service until deregistered
+	TTL           int       `json:"ttl,omitempty"`
+	LastHeartbeat time.Time `json:"last_heartbeat,omitempty"`
+	// HealthCheck overrides how the service is checked
+	HealthCheck *HealthCheckConfig `json:"health_check,omitempty"`
+	// LastError is why the last check found the service unhealthy
+	LastError string `json:"last_error,omitempty"`
+	// Instances serve the service, each checked on its own; the service
+	// is healthy while any is. Without instances the service URL is
+	// checked.
+	Instances []Instance `json:"instances,omitempty"`
+	// LoadBalancing is the default strategy for resolving an instance
+	LoadBalancing string `json:"load_balancing,omitempty"`
+	// TrustScore, from 0 to 100, is how far the service can be trusted to
+	// be who it claims, from how its health check connected and the
+	// certificate it was served. Unlike TrustLevel, it rates the service
+	// rather than its callers. With instances, it is the lowest of theirs.
+	TrustScore int `json:"trust_score"`
+	// Certificate is the certificate served to the last HTTPS check
+	Certificate *CertificateStatus `json:"certificate,omitempty"`
+	// RegisteredAt is when the service was last registered; between
+	// replicas, the latest registration wins
+	RegisteredAt time.Time `json:"registered_at"`
+	// OpenAPI, when set, fills in the endpoints from the service's OpenAPI
+	// document
+	OpenAPI *OpenAPIConfig `json:"openapi,omitempty"`
+	// Breaker is the state of the service's circuit breaker while it is
+	// not closed, degrading the service
+	Breaker string `json:"breaker,omitempty"`
+	// Owner is who registered the service over HTTP; only they or an admin
+	// may register it again, renew or remove it
+	Owner string `json:"owner,omitempty"`
+}
+
+// ttl returns the TTL as a duration
+func (s *ServiceInfo) ttl() time.Duration {
+	return time.Duration(s.TTL) * time.Second
+}
+
+// expired reports whether the service missed its heartbeat at now
+func (s *ServiceInfo) expired(now time.Time) bool {
+	return s.TTL > 0 && now.Sub(s.LastHeartbeat) >= s.ttl()
+}
+
+// lapsed reports whether the service has been expired for another TTL, so
+// it is removed
+func (s *ServiceInfo) lapsed(now time.Time) bool {
+	return s.TTL > 0 && now.Sub(s.LastHeartbeat) >= 2*s.ttl()
+}
+
+// snapshot copies the service, apart from the instances health checks
+// update in place
+func (s *ServiceInfo) snapshot() ServiceInfo {
+	snapshot := *s
+	snapshot.Instances = append([]Instance(nil), s.Instances...)
+	return snapshot
 }
 
 // EndpointInfo represents a service endpoint
@@ -27,6 +115,9 @@ type EndpointInfo struct {
 	Description string   `json:"description"`
 	TrustLevel  int      `json:"trust_level_required"`
 	Scopes      []string `json:"scopes,omitempty"`
+	// Source is EndpointSourceOpenAPI for endpoints read from the
+	// service's OpenAPI document, and empty for those registered
+	Source string `json:"source,omitempty"`
 }
 
 // ServiceRegistry manages service discovery
@@ -34,52 +125,241 @@ type ServiceRegistry struct {
 	services map[string]*ServiceInfo
 	mu       sync.RWMutex
 	checker  *HealthChecker
+	// nextCheck is when each service is next due a health check
+	nextCheck map[string]time.Time
+	// health holds each service's recent check results
+	health map[string]*healthState
+	// watchers are sent the changes to services
+	watchers watchers
+	// balancers hold each service's load balancing state
+	balancers map[string]*balancer
+	// backend shares registrations between replicas; nil keeps them local
+	backend Backend
+	// tombstones are when services were deregistered, so replicas syncing
+	// do not bring them back
+	tombstones map[string]time.Time
+	// nextCatalog is when each service's OpenAPI document is next read
+	nextCatalog map[string]time.Time
+	// changes serializes registrations, removals and heartbeats, so an
+	// ownership check holds until the change it allowed is made
+	changes sync.Mutex
 }
 
 // HealthChecker performs health checks on services
 type HealthChecker struct {
 	client  *http.Client
 	timeout time.Duration
+	// clientCert is presented by mutual TLS checks
+	clientCert *certLoader
 }
 
 // NewServiceRegistry creates a new service registry
 func NewServiceRegistry() *ServiceRegistry {
 	return &ServiceRegistry{
-		services: make(map[string]*ServiceInfo),
+		services:    make(map[string]*ServiceInfo),
+		nextCheck:   make(map[string]time.Time),
+		health:      make(map[string]*healthState),
+		balancers:   make(map[string]*balancer),
+		tombstones:  make(map[string]time.Time),
+		nextCatalog: make(map[string]time.Time),
 		checker: &HealthChecker{
-			client: &http.Client{
-				Timeout: 5 * time.Second,
-			},
-			timeout: 5 * time.Second,
+			// Checks are bounded by their own timeout
+			client:  &http.Client{},
+			timeout: defaultHealthTimeout,
 		},
 	}
 }
 
-// RegisterService registers a new service
+// NewServiceRegistryWithStore creates a registry whose entries are persisted
+// in a shared store so every replica sees the same services
+func NewServiceRegistryWithStore(s store.Store) *ServiceRegistry {
+	return NewServiceRegistryWithBackend(NewStoreBackend(s, storeKeyPrefix))
+}
+
+// NewServiceRegistryWithBackend creates a registry whose entries are kept
+// in backend, so they survive restarts and every replica sees the same
+// services
+func NewServiceRegistryWithBackend(backend Backend) *ServiceRegistry {
+	sr := NewServiceRegistry()
+	sr.backend = backend
+	return sr
+}
+
+// RegisterService registers a new service, or replaces the registration
+// of one with the same name. A registration with a TTL counts as its first
+// heartbeat.
 func (sr *ServiceRegistry) RegisterService(service *ServiceInfo) error {
-	sr.mu.Lock()
-	defer sr.mu.Unlock()
+	sr.changes.Lock()
+	defer sr.changes.Unlock()
+	return sr.register(service)
+}
 
+// RegisterServiceAs registers service owned by caller, returning
+// ErrNotOwner if caller may not change the service it replaces
+func (sr *ServiceRegistry) RegisterServiceAs(service *ServiceInfo, caller Caller) error {
+	sr.changes.Lock()
+	defer sr.changes.Unlock()
+	if err := sr.checkOwner(service.Name, caller); err != nil {
+		return err
+	}
+	service.Owner = caller.Owner
+	return sr.register(service)
+}
+
+func (sr *ServiceRegistry) register(service *ServiceInfo) error {
 	if service.Name == "" || service.URL == "" {
 		return fmt.Errorf("service name and URL are required")
 	}
+	if service.TTL < 0 {
+		return fmt.Errorf("service TTL must not be negative")
+	}
+	if err := service.HealthCheck.Validate(); err != nil {
+		return err
+	}
+	if hc := service.HealthCheck; hc != nil && hc.TLS != nil && hc.TLS.MutualTLS && sr.checker.clientCert == nil {
+		return errNoClientCertificate
+	}
+	if err := service.OpenAPI.Validate(); err != nil {
+		return err
+	}
+	if err := prepareInstances(service); err != nil {
+		return err
+	}
+	if service.TTL > 0 {
+		service.LastHeartbeat = time.Now()
+	}
+	if service.Status == "" || service.Status == StatusExpired {
+		service.Status = StatusUnknown
+	}
+	service.RegisteredAt = time.Now()
+
+	if err := sr.persist(service); err != nil {
+		return fmt.Errorf("failed to persist service %s: %w", service.Name, err)
+	}
+
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
 
+	if old, exists := sr.services[service.Name]; exists && service.Breaker == "" {
+		// Registering again does not close the breaker
+		service.Breaker = old.Breaker
+		service.Status = service.withBreaker(service.Status)
+	}
 	sr.services[service.Name] = service
+	delete(sr.tombstones, service.Name)
+	sr.publish(EventRegistered, service, "")
 
-	// Perform initial health check
-	go sr.checkServiceHealth(service.Name)
+	if service.OpenAPI == nil {
+		// Perform initial health check
+		go sr.checkServiceHealth(service.Name)
+		return nil
+	}
+	// Read the document once the service has been checked, as a service
+	// with instances is read from a healthy one
+	sr.nextCatalog[service.Name] = time.Now().Add(service.OpenAPI.refresh())
+	go func(name string) {
+		sr.checkServiceHealth(name)
+		sr.RefreshCatalog(name)
+	}(service.Name)
 
 	return nil
 }
 
+// DeregisterService removes a service; removing an unknown service is not an
+// error
+func (sr *ServiceRegistry) DeregisterService(name string) error {
+	sr.changes.Lock()
+	defer sr.changes.Unlock()
+	return sr.deregister(name)
+}
+
+// DeregisterServiceAs removes a service as caller, returning ErrNotOwner
+// if caller may not change it
+func (sr *ServiceRegistry) DeregisterServiceAs(name string, caller Caller) error {
+	sr.changes.Lock()
+	defer sr.changes.Unlock()
+	if err := sr.checkOwner(name, caller); err != nil {
+		return err
+	}
+	return sr.deregister(name)
+}
+
+func (sr *ServiceRegistry) deregister(name string) error {
+	if sr.backend != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		defer cancel()
+		if err := sr.backend.Delete(ctx, name); err != nil {
+			return fmt.Errorf("failed to remove service %s: %w", name, err)
+		}
+	}
+
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	if service, exists := sr.services[name]; exists {
+		sr.publish(EventDeregistered, service, "")
+	}
+	delete(sr.services, name)
+	sr.forgetService(name)
+	sr.tombstones[name] = time.Now()
+	return nil
+}
+
+// Heartbeat renews the registration of a service with a TTL. An expired
+// service is checked again.
+func (sr *ServiceRegistry) Heartbeat(name string) (*ServiceInfo, error) {
+	sr.changes.Lock()
+	defer sr.changes.Unlock()
+	return sr.heartbeat(name)
+}
+
+// HeartbeatAs renews a registration as caller, returning ErrNotOwner if
+// caller may not change the service
+func (sr *ServiceRegistry) HeartbeatAs(name string, caller Caller) (*ServiceInfo, error) {
+	sr.changes.Lock()
+	defer sr.changes.Unlock()
+	if err := sr.checkOwner(name, caller); err != nil {
+		return nil, err
+	}
+	return sr.heartbeat(name)
+}
+
+func (sr *ServiceRegistry) heartbeat(name string) (*ServiceInfo, error) {
+	sr.refresh()
+
+	sr.mu.Lock()
+	service, exists := sr.services[name]
+	if !exists {
+		sr.mu.Unlock()
+		return nil, fmt.Errorf("service %s %w", name, ErrServiceNotFound)
+	}
+	service.LastHeartbeat = time.Now()
+	revived := service.Status == StatusExpired
+	if revived {
+		service.Status = service.withBreaker(StatusUnknown)
+		sr.publish(EventStatusChanged, service, StatusExpired)
+	}
+	snapshot := *service
+	sr.mu.Unlock()
+
+	if err := sr.persist(&snapshot); err != nil {
+		return nil, fmt.Errorf("failed to persist service %s: %w", name, err)
+	}
+	if revived {
+		go sr.checkServiceHealth(name)
+	}
+	return &snapshot, nil
+}
+
 // GetService retrieves a service by name
 func (sr *ServiceRegistry) GetService(name string) (*ServiceInfo, error) {
+	sr.refresh()
+
 	sr.mu.RLock()
 	defer sr.mu.RUnlock()
 
 	service, exists := sr.services[name]
 	if !exists {
-		return nil, fmt.Errorf("service %s not found", name)
+		return nil, fmt.Errorf("service %s %w", name, ErrServiceNotFound)
 	}
 
 	return service, nil
@@ -87,6 +367,8 @@ func (sr *ServiceRegistry) GetService(name string) (*ServiceInfo, error) {
 
 // ListServices returns all registered services
 func (sr *ServiceRegistry) ListServices() []*ServiceInfo {
+	sr.refresh()
+
 	sr.mu.RLock()
 	defer sr.mu.RUnlock()
 
@@ -98,14 +380,29 @@ func (sr *ServiceRegistry) ListServices() []*ServiceInfo {
 	return services
 }
 
+// snapshots returns copies of every service, refreshed from the backend
+func (sr *ServiceRegistry) snapshots() []ServiceInfo {
+	sr.refresh()
+
+	sr.mu.RLock()
+	defer sr.mu.RUnlock()
+	services := make([]ServiceInfo, 0, len(sr.services))
+	for _, service := range sr.services {
+		services = append(services, service.snapshot())
+	}
+	return services
+}
+
 // ListHealthyServices returns only healthy services
 func (sr *ServiceRegistry) ListHealthyServices() []*ServiceInfo {
+	sr.refresh()
+
 	sr.mu.RLock()
 	defer sr.mu.RUnlock()
 
 	services := make([]*ServiceInfo, 0)
 	for _, service := range sr.services {
-		if service.Status == "healthy" {
+		if service.Status == StatusHealthy {
 			services = append(services, service)
 		}
 	}
@@ -115,6 +412,8 @@ func (sr *ServiceRegistry) ListHealthyServices() []*ServiceInfo {
 
 // ListServicesByTrustLevel returns services accessible at given trust level
 func (sr *ServiceRegistry) ListServicesByTrustLevel(trustLevel int) []*ServiceInfo {
+	sr.refresh()
+
 	sr.mu.RLock()
 	defer sr.mu.RUnlock()
 
@@ -128,29 +427,108 @@ func (sr *ServiceRegistry) ListServicesByTrustLevel(trustLevel int) []*ServiceIn
 	return services
 }
 
-// StartHealthChecks starts periodic health checks
+// StartHealthChecks starts periodic health checks, expiring services that
+// missed their heartbeat first. Services are checked every interval unless
+// their health check sets its own. OpenAPI documents are read again as
+// their refresh falls due.
 func (sr *ServiceRegistry) StartHealthChecks(ctx context.Context, interval time.Duration) {
-	ticker := time.NewTicker(interval)
+	// Tick often enough for services with a shorter interval
+	tick := interval
+	if tick > time.Second {
+		tick = time.Second
+	}
+	ticker := time.NewTicker(tick)
 	defer ticker.Stop()
 
+	lastExpired := time.Now()
 	for {
 		select {
 		case <-ticker.C:
-			sr.checkAllServices()
+			if time.Since(lastExpired) >= interval {
+				sr.ExpireServices()
+				lastExpired = time.Now()
+			}
+			sr.checkDueServices(interval)
+			sr.refreshDueCatalogs()
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
+// ExpireServices marks the services that missed their heartbeat expired
+// and removes those expired for another TTL
+func (sr *ServiceRegistry) ExpireServices() {
+	sr.refresh()
+
+	now := time.Now()
+	var expired []ServiceInfo
+	var removed []string
+	sr.mu.Lock()
+	for name, service := range sr.services {
+		switch {
+		case service.lapsed(now):
+			removed = append(removed, name)
+		case service.expired(now) && service.Status != StatusExpired:
+			previous := service.Status
+			service.Status = StatusExpired
+			sr.publish(EventStatusChanged, service, previous)
+			expired = append(expired, *service)
+		}
+	}
+	sr.mu.Unlock()
+
+	for i := range expired {
+		slog.Warn("Service registration expired", "service", expired[i].Name, "last_heartbeat", expired[i].LastHeartbeat)
+		if err := sr.persist(&expired[i]); err != nil && !errors.Is(err, ErrReadOnly) {
+			slog.Warn("Failed to share service expiry", "service", expired[i].Name, "error", err)
+		}
+	}
+	for _, name := range removed {
+		slog.Info("Removing expired service", "service", name)
+		if err := sr.DeregisterService(name); err != nil {
+			slog.Warn("Failed to remove expired service", "service", name, "error", err)
+		}
+	}
+}
+
 // checkAllServices checks health of all registered services
 func (sr *ServiceRegistry) checkAllServices() {
-	sr.mu.RLock()
+	sr.checkServices(func(string, *ServiceInfo) bool { return true })
+}
+
+// checkDueServices checks the services whose interval has passed since
+// their last check, fallback being the interval of those without their own
+func (sr *ServiceRegistry) checkDueServices(fallback time.Duration) {
+	now := time.Now()
+	sr.checkServices(func(name string, service *ServiceInfo) bool {
+		if now.Before(sr.nextCheck[name]) {
+			return false
+		}
+		sr.nextCheck[name] = now.Add(service.HealthCheck.interval(fallback))
+		return true
+	})
+}
+
+// checkServices checks the services due says to, in parallel. due is
+// called with the registry locked.
+func (sr *ServiceRegistry) checkServices(due func(name string, service *ServiceInfo) bool) {
+	sr.refresh()
+
+	sr.mu.Lock()
 	serviceNames := make([]string, 0, len(sr.services))
-	for name := range sr.services {
-		serviceNames = append(serviceNames, name)
+	for name, service := range sr.services {
+		// Expired services are not checked until they renew
+		if service.Status != StatusExpired && due(name, service) {
+			serviceNames = append(serviceNames, name)
+		}
 	}
-	sr.mu.RUnlock()
+	for name := range sr.nextCheck {
+		if _, ok := sr.services[name]; !ok {
+			sr.forgetService(name)
+		}
+	}
+	sr.mu.Unlock()
 
 	var wg sync.WaitGroup
 	for _, name := range serviceNames {
@@ -167,34 +545,161 @@ func (sr *ServiceRegistry) checkAllServices() {
 func (sr *ServiceRegistry) checkServiceHealth(name string) {
 	sr.mu.RLock()
 	service, exists := sr.services[name]
+	var snapshot ServiceInfo
+	if exists {
+		snapshot = *service
+	}
 	sr.mu.RUnlock()
 
 	if !exists {
 		return
 	}
+	if len(snapshot.Instances) > 0 {
+		snapshot.Instances = append([]Instance(nil), snapshot.Instances...)
+		sr.checkInstances(service, snapshot)
+		return
+	}
 
-	healthURL := fmt.Sprintf("%s/health", service.URL)
-	resp, err := sr.checker.client.Get(healthURL)
+	started := time.Now()
+	status, cert, err := sr.checker.check(context.Background(), &snapshot)
+	result := HealthResult{Time: started, Status: status, DurationMs: time.Since(started).Milliseconds()}
+	if err != nil {
+		result.Error = err.Error()
+	}
 
 	sr.mu.Lock()
-	defer sr.mu.Unlock()
-
+	if sr.services[name] != service || service.Status == StatusExpired {
+		// Deregistered or expired while the check was running; do not
+		// resurrect it
+		sr.mu.Unlock()
+		return
+	}
+	state := sr.healthState(name)
+	previous := service.Status
 	service.LastChecked = time.Now()
+	service.Status = service.withBreaker(state.record(result, service.Status, service.HealthCheck))
+	service.LastError = result.Error
+	noteRotation(cert, service.Certificate, result.Time)
+	service.Certificate = cert
+	service.TrustScore = trustScore(service.URL, cert)
+	if service.Status != previous {
+		sr.publish(EventStatusChanged, service, previous)
+	}
+	snapshot = *service
+	sr.mu.Unlock()
 
+	// A read-only backend keeps its own view of health
+	if err := sr.persist(&snapshot); err != nil && !errors.Is(err, ErrReadOnly) {
+		slog.Warn("Failed to share service health", "service", name, "error", err)
+	}
+}
+
+// persist writes a service to the backend. Services with a TTL are kept
+// until they would be removed, so the backend drops them even when no
+// replica is expiring services.
+func (sr *ServiceRegistry) persist(service *ServiceInfo) error {
+	if sr.backend == nil {
+		return nil
+	}
+
+	var ttl time.Duration
+	if service.TTL > 0 {
+		if ttl = time.Until(service.LastHeartbeat.Add(2 * service.ttl())); ttl <= 0 {
+			return nil
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	return sr.backend.Put(ctx, service, ttl)
+}
+
+// refresh merges registrations made by other replicas into the local view.
+// On backend errors the last known local state keeps serving reads.
+func (sr *ServiceRegistry) refresh() {
+	if sr.backend == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	listed, err := sr.backend.List(ctx)
 	if err != nil {
-		service.Status = "unhealthy"
+		slog.Warn("Failed to load shared service registry", "error", err)
 		return
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode == http.StatusOK {
-		service.Status = "healthy"
-	} else {
-		service.Status = "unhealthy"
+	shared := make(map[string]*ServiceInfo, len(listed))
+	for _, service := range listed {
+		shared[service.Name] = service
+	}
+
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	// Every local registration is persisted, so one missing from the
+	// backend was deregistered by another replica
+	for name, local := range sr.services {
+		if _, ok := shared[name]; !ok {
+			delete(sr.services, name)
+			sr.publish(EventDeregistered, local, "")
+		}
+	}
+	for name, service := range shared {
+		if local, ok := sr.services[name]; ok {
+			previous := local.Status
+			// Update in place so pointers handed out earlier stay current
+			*local = *service
+			if local.Status != previous {
+				sr.publish(EventStatusChanged, local, previous)
+			}
+			continue
+		}
+		sr.services[name] = service
+		sr.publish(EventRegistered, service, "")
+	}
+}
+
+// Caller is who changes the registry through ServiceDiscoveryHandler
+type Caller struct {
+	// Owner identifies the caller, such as a user ID; empty is anonymous
+	Owner string
+	// Admin may change services of any owner
+	Admin bool
+}
+
+type callerKey struct{}
+
+// WithCaller returns a copy of ctx carrying the caller of a request to the
+// handler; requests without one are anonymous
+func WithCaller(ctx context.Context, caller Caller) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller)
+}
+
+// CallerFrom returns the caller carried by ctx
+func CallerFrom(ctx context.Context) Caller {
+	caller, _ := ctx.Value(callerKey{}).(Caller)
+	return caller
+}
+
+// checkOwner returns ErrNotOwner unless caller may change the service
+// registered as name. Services without an owner, including those
+// registered anonymously or by configuration, are changed by admins only.
+// Callers hold sr.changes until they have made the change.
+func (sr *ServiceRegistry) checkOwner(name string, caller Caller) error {
+	sr.refresh()
+
+	sr.mu.RLock()
+	defer sr.mu.RUnlock()
+	service, exists := sr.services[name]
+	if !exists || caller.Admin || (service.Owner != "" && service.Owner == caller.Owner) {
+		return nil
 	}
+	return fmt.Errorf("service %s %w", name, ErrNotOwner)
 }
 
-// ServiceDiscoveryHandler provides HTTP endpoints for service discovery
+// ServiceDiscoveryHandler provides HTTP endpoints for service discovery.
+// Changes are made as the Caller in the request context.
 type ServiceDiscoveryHandler struct {
 	registry *ServiceRegistry
 }
@@ -206,21 +711,34 @@ func NewServiceDiscoveryHandler(registry *ServiceRegistry) *ServiceDiscoveryHand
 	}
 }
 
-// HandleListServices returns all services
+// HandleListServices returns the services matching the query parameters,
+// a page at a time. See ParseServiceQuery for the parameters.
 func (h *ServiceDiscoveryHandler) HandleListServices(w http.ResponseWriter, r *http.Request) {
-	services := h.registry.ListServices()
+	query, err := ParseServiceQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	services, total := h.registry.QueryServices(query)
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
+	response := map[string]interface{}{
 		"services":  services,
 		"count":     len(services),
+		"total":     total,
+		"offset":    query.Offset,
+		"limit":     query.Limit,
 		"timestamp": time.Now(),
-	})
+	}
+	if next := query.Offset + len(services); next < total {
+		response["next_offset"] = next
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
 }
 
 // HandleGetService returns a specific service
 func (h *ServiceDiscoveryHandler) HandleGetService(w http.ResponseWriter, r *http.Request) {
-	serviceName := r.URL.Query().Get("name")
+	serviceName := serviceName(r)
 	if serviceName == "" {
 		http.Error(w, "service name required", http.StatusBadRequest)
 		return
@@ -236,7 +754,8 @@ func (h *ServiceDiscoveryHandler) HandleGetService(w http.ResponseWriter, r *htt
 	json.NewEncoder(w).Encode(service)
 }
 
-// HandleRegisterService registers a new service
+// HandleRegisterService registers a new service owned by the caller, or
+// registers again one the caller owns
 func (h *ServiceDiscoveryHandler) HandleRegisterService(w http.ResponseWriter, r *http.Request) {
 	var service ServiceInfo
 	if err := json.NewDecoder(r.Body).Decode(&service); err != nil {
@@ -244,8 +763,8 @@ func (h *ServiceDiscoveryHandler) HandleRegisterService(w http.ResponseWriter, r
 		return
 	}
 
-	if err := h.registry.RegisterService(&service); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if err := h.registry.RegisterServiceAs(&service, CallerFrom(r.Context())); err != nil {
+		http.Error(w, err.Error(), registryErrorStatus(err, http.StatusBadRequest))
 		return
 	}
 
@@ -257,6 +776,102 @@ func (h *ServiceDiscoveryHandler) HandleRegisterService(w http.ResponseWriter, r
 	})
 }
 
+// HandleDeregisterService removes a service. Removing an unknown service
+// succeeds, so retries are safe.
+func (h *ServiceDiscoveryHandler) HandleDeregisterService(w http.ResponseWriter, r *http.Request) {
+	serviceName := serviceName(r)
+	if serviceName == "" {
+		http.Error(w, "service name required", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.registry.DeregisterServiceAs(serviceName, CallerFrom(r.Context())); err != nil {
+		http.Error(w, err.Error(), registryErrorStatus(err, http.StatusServiceUnavailable))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleHeartbeat renews the registration of a service with a TTL
+func (h *ServiceDiscoveryHandler) HandleHeartbeat(w http.ResponseWriter, r *http.Request) {
+	serviceName := serviceName(r)
+	if serviceName == "" {
+		http.Error(w, "service name required", http.StatusBadRequest)
+		return
+	}
+
+	service, err := h.registry.HeartbeatAs(serviceName, CallerFrom(r.Context()))
+	if errors.Is(err, ErrServiceNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), registryErrorStatus(err, http.StatusServiceUnavailable))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(service)
+}
+
+// HandleHealthHistory returns the latest health check results of a service,
+// newest first
+func (h *ServiceDiscoveryHandler) HandleHealthHistory(w http.ResponseWriter, r *http.Request) {
+	serviceName := serviceName(r)
+	if serviceName == "" {
+		http.Error(w, "service name required", http.StatusBadRequest)
+		return
+	}
+
+	history, err := h.registry.HealthHistory(serviceName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	service, err := h.registry.GetService(serviceName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"name":        serviceName,
+		"status":      service.Status,
+		"trust_score": service.TrustScore,
+		"history":     history,
+		"count":       len(history),
+	})
+}
+
+// registryErrorStatus is 405 for changes a read-only backend refuses, 403
+// for changes to services of another owner, and otherwise status
+func registryErrorStatus(err error, status int) int {
+	if errors.Is(err, ErrReadOnly) {
+		return http.StatusMethodNotAllowed
+	}
+	if errors.Is(err, ErrNotOwner) {
+		return http.StatusForbidden
+	}
+	return status
+}
+
+// serviceName is the name query parameter, or else the path segment after
+// "services", as in /services/{name}/heartbeat
+func serviceName(r *http.Request) string {
+	if name := r.URL.Query().Get("name"); name != "" {
+		return name
+	}
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	for i := len(segments) - 2; i >= 0; i-- {
+		if segments[i] == "services" {
+			return segments[i+1]
+		}
+	}
+	return ""
+}
+
 // InitializeDefaultServices registers default services
 func InitializeDefaultServices(registry *ServiceRegistry) {
 	defaultServices := []*ServiceInfo{
@@ -0,0 +1,191 @@
+package discovery
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// Certificate states, from the certificate a health check was served
+const (
+	CertificateValid = "valid"
+	// CertificateRotationDue is past two thirds of its lifetime
+	CertificateRotationDue = "rotation_due"
+	// CertificateExpiring expires within certificateExpiringWithin
+	CertificateExpiring = "expiring"
+	CertificateExpired  = "expired"
+)
+
+const (
+	certificateExpiringWithin = 14 * 24 * time.Hour
+	// maxCertificateLifetime is the longest lifetime publicly trusted
+	// certificates may have; longer ones are rotated too rarely
+	maxCertificateLifetime = 398 * 24 * time.Hour
+)
+
+// Trust scores of a service by how its health check connected, before
+// certificate deductions
+const (
+	trustPlaintext  = 20
+	trustUnverified = 40
+	trustVerified   = 70
+	trustMutual     = 90
+)
+
+// CertificateStatus describes the certificate a service presented to its
+// last health check
+type CertificateStatus struct {
+	Subject      string    `json:"subject"`
+	Issuer       string    `json:"issuer"`
+	SerialNumber string    `json:"serial_number"`
+	Fingerprint  string    `json:"fingerprint_sha256"`
+	NotBefore    time.Time `json:"not_before"`
+	NotAfter     time.Time `json:"not_after"`
+	State        string    `json:"state"`
+	// Verified is whether the chain was verified, which checks skipping
+	// verification do not
+	Verified bool `json:"verified"`
+	// Mutual is whether the service asked for, and was presented, the
+	// registry's client certificate
+	Mutual bool `json:"mutual"`
+	// RotatedAt is when a check first saw this certificate replace another
+	RotatedAt time.Time `json:"rotated_at,omitempty"`
+}
+
+// certificateStatus describes the leaf certificate of state at now
+func certificateStatus(state *tls.ConnectionState, verified, mutual bool, now time.Time) *CertificateStatus {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	leaf := state.PeerCertificates[0]
+	sum := sha256.Sum256(leaf.Raw)
+	cert := &CertificateStatus{
+		Subject:      leaf.Subject.String(),
+		Issuer:       leaf.Issuer.String(),
+		SerialNumber: leaf.SerialNumber.String(),
+		Fingerprint:  hex.EncodeToString(sum[:]),
+		NotBefore:    leaf.NotBefore,
+		NotAfter:     leaf.NotAfter,
+		Verified:     verified,
+		Mutual:       mutual,
+	}
+	lifetime := leaf.NotAfter.Sub(leaf.NotBefore)
+	switch {
+	case !now.Before(leaf.NotAfter):
+		cert.State = CertificateExpired
+	case leaf.NotAfter.Sub(now) <= certificateExpiringWithin:
+		cert.State = CertificateExpiring
+	case now.Sub(leaf.NotBefore) >= lifetime*2/3:
+		cert.State = CertificateRotationDue
+	default:
+		cert.State = CertificateValid
+	}
+	return cert
+}
+
+// noteRotation carries over or sets when cert replaced previous
+func noteRotation(cert, previous *CertificateStatus, now time.Time) {
+	if cert == nil || previous == nil {
+		return
+	}
+	if cert.Fingerprint == previous.Fingerprint {
+		cert.RotatedAt = previous.RotatedAt
+	} else {
+		cert.RotatedAt = now
+	}
+}
+
+// trustScore rates from 0 to 100 how far a service at serviceURL can be
+// trusted to be who it claims, from the certificate its last check was
+// served. HTTPS services whose certificate was not seen score 0.
+func trustScore(serviceURL string, cert *CertificateStatus) int {
+	if u, err := url.Parse(serviceURL); err == nil && u.Scheme == "http" {
+		return trustPlaintext
+	}
+	if cert == nil || cert.State == CertificateExpired {
+		return 0
+	}
+	score := trustUnverified
+	switch {
+	case cert.Verified && cert.Mutual:
+		score = trustMutual
+	case cert.Verified:
+		score = trustVerified
+	}
+	switch cert.State {
+	case CertificateExpiring:
+		score -= 30
+	case CertificateRotationDue:
+		score -= 10
+	}
+	if cert.NotAfter.Sub(cert.NotBefore) > maxCertificateLifetime {
+		score -= 10
+	}
+	if score < 0 {
+		return 0
+	}
+	return score
+}
+
+// certLoader loads a client certificate and key from files, reloading them
+// once either changes so rotated certificates are picked up
+type certLoader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// get returns the certificate, reloading it when its files changed. A
+// failed reload keeps the last certificate.
+func (l *certLoader) get() (*tls.Certificate, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var modTime time.Time
+	for _, file := range []string{l.certFile, l.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			if l.cert != nil {
+				return l.cert, nil
+			}
+			return nil, err
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	if l.cert != nil && !modTime.After(l.modTime) {
+		return l.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		if l.cert != nil {
+			return l.cert, nil
+		}
+		return nil, fmt.Errorf("failed to load health check client certificate: %w", err)
+	}
+	l.cert, l.modTime = &cert, modTime
+	return l.cert, nil
+}
+
+// errNoClientCertificate is returned for mutual TLS checks by a registry
+// without a client certificate
+var errNoClientCertificate = errors.New("no health check client certificate configured")
+
+// SetClientCertificate makes health checks with mutual TLS present the
+// certificate and key in certFile and keyFile, reloaded when they change
+func (sr *ServiceRegistry) SetClientCertificate(certFile, keyFile string) error {
+	loader := &certLoader{certFile: certFile, keyFile: keyFile}
+	if _, err := loader.get(); err != nil {
+		return err
+	}
+	sr.checker.clientCert = loader
+	return nil
+}
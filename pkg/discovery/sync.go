@@ -0,0 +1,393 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SyncPath is where replicas exchange their registries
+const SyncPath = "/internal/discovery/sync"
+
+// Headers of a signed sync exchange, sent both ways
+const (
+	HeaderSyncReplica   = "X-Discovery-Replica"
+	HeaderSyncTimestamp = "X-Discovery-Timestamp"
+	HeaderSyncSignature = "X-Discovery-Signature"
+)
+
+const (
+	// DefaultSyncInterval is how often replicas sync when unset
+	DefaultSyncInterval = 30 * time.Second
+	// tombstoneTTL is how long deregistrations are remembered; a replica
+	// out of reach for longer may bring a deregistered service back
+	tombstoneTTL = 24 * time.Hour
+	// syncWindow bounds the clock skew accepted on a signed exchange
+	syncWindow = 5 * time.Minute
+	// maxSyncBytes bounds the registry state of one exchange
+	maxSyncBytes = 16 << 20
+)
+
+// ErrInvalidSyncSignature is returned for an exchange not signed with the
+// shared secret or outside the accepted time window
+var ErrInvalidSyncSignature = errors.New("invalid discovery sync signature")
+
+// SyncState is what a replica knows of the registry
+type SyncState struct {
+	Services []*ServiceInfo `json:"services"`
+	// Deregistered is when each recently removed service was removed
+	Deregistered map[string]time.Time `json:"deregistered,omitempty"`
+}
+
+// syncState returns a copy of the registry's state, pruning old tombstones
+func (sr *ServiceRegistry) syncState() SyncState {
+	sr.refresh()
+
+	now := time.Now()
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	state := SyncState{
+		Services:     make([]*ServiceInfo, 0, len(sr.services)),
+		Deregistered: make(map[string]time.Time, len(sr.tombstones)),
+	}
+	for _, service := range sr.services {
+		snapshot := service.snapshot()
+		state.Services = append(state.Services, &snapshot)
+	}
+	for name, at := range sr.tombstones {
+		if now.Sub(at) > tombstoneTTL {
+			delete(sr.tombstones, name)
+			continue
+		}
+		state.Deregistered[name] = at
+	}
+	return state
+}
+
+// mergeSyncState merges what another replica knows into the registry and
+// returns how many services changed. The latest registration of a service
+// wins, and a deregistration wins over the registrations before it. Of the
+// same registration, the latest heartbeat is kept; health is left to each
+// replica's own checks.
+func (sr *ServiceRegistry) mergeSyncState(state SyncState) int {
+	now := time.Now()
+	var changed []ServiceInfo
+	var removed, check []string
+
+	sr.mu.Lock()
+	for name, at := range state.Deregistered {
+		if now.Sub(at) > tombstoneTTL {
+			continue
+		}
+		if at.After(sr.tombstones[name]) {
+			sr.tombstones[name] = at
+		}
+		local, exists := sr.services[name]
+		if !exists || local.RegisteredAt.After(at) {
+			continue
+		}
+		delete(sr.services, name)
+		sr.forgetService(name)
+		sr.publish(EventDeregistered, local, "")
+		removed = append(removed, name)
+	}
+	for _, remote := range state.Services {
+		if remote == nil || remote.Name == "" || remote.URL == "" {
+			continue
+		}
+		name := remote.Name
+		if at, ok := sr.tombstones[name]; ok && !remote.RegisteredAt.After(at) {
+			continue
+		}
+		local, exists := sr.services[name]
+		switch {
+		case !exists || remote.RegisteredAt.After(local.RegisteredAt):
+			if err := remote.HealthCheck.Validate(); err != nil {
+				slog.Warn("Ignoring invalid synced service", "service", name, "error", err)
+				continue
+			}
+			if err := prepareInstances(remote); err != nil {
+				slog.Warn("Ignoring invalid synced service", "service", name, "error", err)
+				continue
+			}
+			if exists {
+				// A newer registration; its health starts over
+				sr.forgetService(name)
+				*local = *remote
+			} else {
+				local = remote
+				sr.services[name] = local
+			}
+			sr.publish(EventRegistered, local, "")
+			check = append(check, name)
+		case remote.RegisteredAt.Equal(local.RegisteredAt) && remote.LastHeartbeat.After(local.LastHeartbeat):
+			local.LastHeartbeat = remote.LastHeartbeat
+			if local.Status == StatusExpired && !local.expired(now) {
+				local.Status = StatusUnknown
+				sr.publish(EventStatusChanged, local, StatusExpired)
+				check = append(check, name)
+			}
+		default:
+			continue
+		}
+		changed = append(changed, local.snapshot())
+	}
+	sr.mu.Unlock()
+
+	for i := range changed {
+		if err := sr.persist(&changed[i]); err != nil && !errors.Is(err, ErrReadOnly) {
+			slog.Warn("Failed to share synced service", "service", changed[i].Name, "error", err)
+		}
+	}
+	if sr.backend != nil {
+		for _, name := range removed {
+			ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+			if err := sr.backend.Delete(ctx, name); err != nil && !errors.Is(err, ErrReadOnly) {
+				slog.Warn("Failed to remove synced service", "service", name, "error", err)
+			}
+			cancel()
+		}
+	}
+	for _, name := range check {
+		go sr.checkServiceHealth(name)
+	}
+	return len(changed) + len(removed)
+}
+
+// SyncConfig configures anti-entropy between the replicas of a registry
+type SyncConfig struct {
+	// Replica names this replica to its peers
+	Replica string
+	// Secret signs exchanges; every replica must share it
+	Secret string
+	// Peers are the base URLs of the other replicas
+	Peers    []string
+	Interval time.Duration
+	Client   *http.Client
+}
+
+// Syncer keeps the registries of replicas converging when they do not
+// share a backend, or to repair what a shared one lost. Every interval it
+// sends its state to each peer, which merges it and answers with its own.
+type Syncer struct {
+	registry *ServiceRegistry
+	config   SyncConfig
+
+	mu     sync.Mutex
+	status map[string]*PeerSyncStatus
+}
+
+// PeerSyncStatus is the sync state towards one peer
+type PeerSyncStatus struct {
+	Peer     string    `json:"peer"`
+	LastSync time.Time `json:"last_sync,omitempty"`
+	// Changed is how many services the last exchange changed locally
+	Changed   int    `json:"changed"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// NewSyncer creates a syncer of registry with its peers
+func NewSyncer(registry *ServiceRegistry, cfg SyncConfig) (*Syncer, error) {
+	if cfg.Replica == "" || strings.ContainsAny(cfg.Replica, " \n") {
+		return nil, fmt.Errorf("discovery sync needs a replica name, got %q", cfg.Replica)
+	}
+	if len(cfg.Secret) < 32 {
+		return nil, errors.New("discovery sync secret must be at least 32 characters")
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultSyncInterval
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	s := &Syncer{registry: registry, config: cfg, status: make(map[string]*PeerSyncStatus)}
+	for _, peer := range cfg.Peers {
+		if !strings.HasPrefix(peer, "http://") && !strings.HasPrefix(peer, "https://") {
+			return nil, fmt.Errorf("discovery sync peer %q is not an HTTP URL", peer)
+		}
+		s.status[peer] = &PeerSyncStatus{Peer: peer}
+	}
+	return s, nil
+}
+
+// Start syncs with every peer each interval until ctx is done
+func (s *Syncer) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(s.config.Interval)
+		defer ticker.Stop()
+		for {
+			s.Sync(ctx)
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Sync exchanges state with every peer once, returning the failures
+func (s *Syncer) Sync(ctx context.Context) error {
+	errs := make([]error, len(s.config.Peers))
+	var wg sync.WaitGroup
+	for i, peer := range s.config.Peers {
+		wg.Add(1)
+		go func(i int, peer string) {
+			defer wg.Done()
+			changed, err := s.exchange(ctx, peer)
+			s.mu.Lock()
+			status := s.status[peer]
+			if err != nil {
+				status.LastError = err.Error()
+				errs[i] = fmt.Errorf("peer %s: %w", peer, err)
+			} else {
+				status.LastSync, status.Changed, status.LastError = time.Now(), changed, ""
+			}
+			s.mu.Unlock()
+			if err != nil {
+				slog.Warn("Discovery sync failed", "peer", peer, "error", err)
+			}
+		}(i, peer)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// exchange sends the local state to peer and merges its answer
+func (s *Syncer) exchange(ctx context.Context, peer string) (int, error) {
+	body, err := json.Marshal(s.registry.syncState())
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(peer, "/")+SyncPath, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	s.sign(req.Header, body)
+
+	resp, err := s.config.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("peer answered %d", resp.StatusCode)
+	}
+	answer, err := io.ReadAll(io.LimitReader(resp.Body, maxSyncBytes))
+	if err != nil {
+		return 0, err
+	}
+	if err := s.verify(resp.Header, answer, time.Now()); err != nil {
+		return 0, err
+	}
+	var state SyncState
+	if err := json.Unmarshal(answer, &state); err != nil {
+		return 0, err
+	}
+	return s.registry.mergeSyncState(state), nil
+}
+
+// Handler merges the state a peer sends at SyncPath and answers with the
+// local state. It is authenticated by the shared secret, so it is mounted
+// outside the user authentication.
+func (s *Syncer) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxSyncBytes))
+		if err != nil {
+			http.Error(w, "invalid body", http.StatusBadRequest)
+			return
+		}
+		if err := s.verify(r.Header, body, time.Now()); err != nil {
+			slog.Warn("Rejected discovery sync", "replica", r.Header.Get(HeaderSyncReplica), "remote_addr", r.RemoteAddr)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		var state SyncState
+		if err := json.Unmarshal(body, &state); err != nil {
+			http.Error(w, "invalid sync state", http.StatusBadRequest)
+			return
+		}
+		s.registry.mergeSyncState(state)
+
+		answer, err := json.Marshal(s.registry.syncState())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		s.sign(w.Header(), answer)
+		w.Write(answer)
+	}
+}
+
+// Status reports the sync state towards every peer, in configured order
+func (s *Syncer) Status() []PeerSyncStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses := make([]PeerSyncStatus, 0, len(s.config.Peers))
+	for _, peer := range s.config.Peers {
+		statuses = append(statuses, *s.status[peer])
+	}
+	return statuses
+}
+
+// StatusHandler reports the local replica and the sync state towards every
+// peer
+func (s *Syncer) StatusHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"replica": s.config.Replica,
+			"peers":   s.Status(),
+		})
+	}
+}
+
+// SignSync returns the hex HMAC-SHA256 of replica \n timestamp \n body
+func SignSync(secret, replica, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n", replica, timestamp)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Syncer) sign(header http.Header, body []byte) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	header.Set(HeaderSyncReplica, s.config.Replica)
+	header.Set(HeaderSyncTimestamp, timestamp)
+	header.Set(HeaderSyncSignature, SignSync(s.config.Secret, s.config.Replica, timestamp, body))
+}
+
+// verify checks the signature of an exchange and its timestamp
+func (s *Syncer) verify(header http.Header, body []byte, now time.Time) error {
+	replica, timestamp := header.Get(HeaderSyncReplica), header.Get(HeaderSyncTimestamp)
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || replica == "" {
+		return ErrInvalidSyncSignature
+	}
+	if skew := now.Sub(time.Unix(unix, 0)); skew > syncWindow || skew < -syncWindow {
+		return ErrInvalidSyncSignature
+	}
+	expected := SignSync(s.config.Secret, replica, timestamp, body)
+	if !hmac.Equal([]byte(header.Get(HeaderSyncSignature)), []byte(expected)) {
+		return ErrInvalidSyncSignature
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Service event types
+const (
+	EventRegistered    = "registered"
+	EventDeregistered  = "deregistered"
+	EventStatusChanged = "status_changed"
+)
+
+const (
+	// watchBacklog is how many events are kept for watchers resuming
+	// after a disconnect
+	watchBacklog = 256
+	// watchBuffer is how many events a watcher may fall behind before it
+	// is dropped, to resume from its last event
+	watchBuffer = 64
+	// watchKeepAlive is how often an idle stream sends a comment so
+	// proxies keep it open
+	watchKeepAlive = 15 * time.Second
+)
+
+// Event is a change to a service. Changes made through other replicas are
+// seen when the registry next refreshes from its backend.
+type Event struct {
+	// ID increases with each event of the replica
+	ID      uint64       `json:"id"`
+	Type    string       `json:"type"`
+	Time    time.Time    `json:"time"`
+	Service *ServiceInfo `json:"service"`
+	// PreviousStatus is the status before a status change
+	PreviousStatus string `json:"previous_status,omitempty"`
+}
+
+// watchers fans events out to subscribers
+type watchers struct {
+	mu      sync.Mutex
+	lastID  uint64
+	backlog []Event
+	subs    map[chan Event]struct{}
+}
+
+// publish sends an event about a copy of service to every watcher
+func (sr *ServiceRegistry) publish(eventType string, service *ServiceInfo, previous string) {
+	snapshot := *service
+	w := &sr.watchers
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.lastID++
+	event := Event{ID: w.lastID, Type: eventType, Time: time.Now(), Service: &snapshot, PreviousStatus: previous}
+	w.backlog = append(w.backlog, event)
+	if len(w.backlog) > watchBacklog {
+		w.backlog = append(w.backlog[:0:0], w.backlog[len(w.backlog)-watchBacklog:]...)
+	}
+	for ch := range w.subs {
+		select {
+		case ch <- event:
+		default:
+			// Too far behind; it resumes from its last event
+			delete(w.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Watch returns the events after the one with ID since, still in the
+// backlog, followed by new events until ctx is done. The channel is closed
+// then, or when the watcher falls too far behind.
+func (sr *ServiceRegistry) Watch(ctx context.Context, since uint64) <-chan Event {
+	w := &sr.watchers
+	w.mu.Lock()
+	var missed []Event
+	for _, event := range w.backlog {
+		if event.ID > since {
+			missed = append(missed, event)
+		}
+	}
+	ch := make(chan Event, watchBuffer+len(missed))
+	for _, event := range missed {
+		ch <- event
+	}
+	if w.subs == nil {
+		w.subs = make(map[chan Event]struct{})
+	}
+	w.subs[ch] = struct{}{}
+	w.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if _, ok := w.subs[ch]; ok {
+			delete(w.subs, ch)
+			close(ch)
+		}
+	}()
+	return ch
+}
+
+// HandleWatch streams service events as Server-Sent Events. The name query
+// parameter limits them to one service. Reconnecting clients resume after
+// their Last-Event-ID, or the since query parameter.
+func (h *ServiceDiscoveryHandler) HandleWatch(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	since := r.Header.Get("Last-Event-ID")
+	if since == "" {
+		since = r.URL.Query().Get("since")
+	}
+	var after uint64
+	if since != "" {
+		var err error
+		if after, err = strconv.ParseUint(since, 10, 64); err != nil {
+			http.Error(w, "invalid event ID", http.StatusBadRequest)
+			return
+		}
+	}
+	name := r.URL.Query().Get("name")
+
+	// Pick up changes made through other replicas
+	h.registry.refresh()
+	events := h.registry.Watch(r.Context(), after)
+
+	// The stream outlives the server's write timeout
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": watching services\n\n")
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(watchKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				// Closed by the client leaving or falling behind
+				return
+			}
+			if name != "" && event.Service.Name != name {
+				continue
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+			flusher.Flush()
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,83 @@
+// Package email provides interfaces.EmailSender implementations: SMTP for
+// real deployments and a logging sender for demos and development
+package email
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+)
+
+// Config configures outgoing mail. An empty Addr selects the log sender.
+type Config struct {
+	// Addr is the SMTP server host:port; STARTTLS is used when offered
+	Addr     string
+	Username string
+	Password string
+	From     string
+}
+
+// New returns an SMTP sender for cfg.Addr, or a LogSender without one
+func New(cfg Config, logger interfaces.Logger) (interfaces.EmailSender, error) {
+	if cfg.Addr == "" {
+		return &LogSender{Logger: logger}, nil
+	}
+	return NewSMTPSender(cfg)
+}
+
+// LogSender writes messages to the log instead of sending them. Messages
+// may hold login links, so it is only for demos and development.
+type LogSender struct {
+	Logger interfaces.Logger
+}
+
+// Send implements interfaces.EmailSender
+func (s *LogSender) Send(_ context.Context, to, subject, body string) error {
+	s.Logger.Info("Email not sent, no SMTP server configured", "to", to, "subject", subject, "body", body)
+	return nil
+}
+
+// SMTPSender sends mail through an SMTP relay
+type SMTPSender struct {
+	config Config
+	host   string
+}
+
+// NewSMTPSender validates cfg
+func NewSMTPSender(cfg Config) (*SMTPSender, error) {
+	host, _, err := net.SplitHostPort(cfg.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP address %q: %w", cfg.Addr, err)
+	}
+	if cfg.From == "" {
+		return nil, errors.New("SMTP sender needs a From address")
+	}
+	return &SMTPSender{config: cfg, host: host}, nil
+}
+
+// Send implements interfaces.EmailSender
+func (s *SMTPSender) Send(_ context.Context, to, subject, body string) error {
+	// Header injection: neither address nor subject may span lines
+	if strings.ContainsAny(to+subject, "\r\n") {
+		return errors.New("email header values must not contain line breaks")
+	}
+	var auth smtp.Auth
+	if s.config.Username != "" {
+		auth = smtp.PlainAuth("", s.config.Username, s.config.Password, s.host)
+	}
+	msg := "From: " + s.config.From + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Date: " + time.Now().UTC().Format(time.RFC1123Z) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" +
+		strings.ReplaceAll(body, "\n", "\r\n")
+	return smtp.SendMail(s.config.Addr, auth, s.config.From, []string{to}, []byte(msg))
+}
@@ -0,0 +1,132 @@
+// Package extauthz implements the Envoy External Authorization gRPC API so
+// Istio and Envoy sidecars can delegate per-request decisions to impl-zamaz,
+// including the access policies the HTTP API enforces.
+//
+// Envoy is configured with the envoy.filters.http.ext_authz filter pointing at
+// this server's gRPC cluster, for example:
+//
+//	http_filters:
+//	- name: envoy.filters.http.ext_authz
+//	  typed_config:
+//	    "@type": type.googleapis.com/envoy.extensions.filters.http.ext_authz.v3.ExtAuthz
+//	    transport_api_version: V3
+//	    grpc_service:
+//	      envoy_grpc:
+//	        cluster_name: zamaz-ext-authz
+package extauthz
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"github.com/lsendel/impl-zamaz/pkg/authz"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+)
+
+// Server implements envoy.service.auth.v3.Authorization
+type Server struct {
+	authv3.UnimplementedAuthorizationServer
+	authorizer *authz.Authorizer
+	logger     interfaces.Logger
+}
+
+// NewServer creates an ext_authz server backed by authorizer
+func NewServer(authorizer *authz.Authorizer, logger interfaces.Logger) *Server {
+	return &Server{authorizer: authorizer, logger: logger}
+}
+
+// Register adds the Authorization service to a gRPC server
+func (s *Server) Register(grpcServer *grpc.Server) {
+	authv3.RegisterAuthorizationServer(grpcServer, s)
+}
+
+// Serve registers the service on a new gRPC server and serves lis until the
+// returned server is stopped
+func (s *Server) Serve(lis net.Listener, opts ...grpc.ServerOption) *grpc.Server {
+	grpcServer := grpc.NewServer(opts...)
+	s.Register(grpcServer)
+	go func() {
+		if err := grpcServer.Serve(lis); err != nil {
+			s.logger.Error("ext_authz gRPC server stopped", "error", err)
+		}
+	}()
+	return grpcServer
+}
+
+// Check implements authv3.AuthorizationServer
+func (s *Server) Check(ctx context.Context, req *authv3.CheckRequest) (*authv3.CheckResponse, error) {
+	httpReq := req.GetAttributes().GetRequest().GetHttp()
+	decision := s.authorizer.Check(ctx, authz.Request{
+		Method:   httpReq.GetMethod(),
+		Path:     httpReq.GetPath(),
+		Headers:  httpReq.GetHeaders(),
+		ClientIP: req.GetAttributes().GetSource().GetAddress().GetSocketAddress().GetAddress(),
+	})
+
+	if decision.Allowed {
+		return allowResponse(decision), nil
+	}
+	return denyResponse(decision), nil
+}
+
+func allowResponse(decision authz.Decision) *authv3.CheckResponse {
+	names := make([]string, 0, len(decision.Headers))
+	for name := range decision.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	headers := make([]*corev3.HeaderValueOption, 0, len(names))
+	for _, name := range names {
+		headers = append(headers, &corev3.HeaderValueOption{
+			Header:       &corev3.HeaderValue{Key: name, Value: decision.Headers[name]},
+			AppendAction: corev3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD,
+		})
+	}
+
+	return &authv3.CheckResponse{
+		Status: &rpcstatus.Status{Code: int32(codes.OK)},
+		HttpResponse: &authv3.CheckResponse_OkResponse{
+			OkResponse: &authv3.OkHttpResponse{
+				Headers:         headers,
+				HeadersToRemove: decision.RemoveHeaders,
+			},
+		},
+	}
+}
+
+func denyResponse(decision authz.Decision) *authv3.CheckResponse {
+	code := codes.PermissionDenied
+	if decision.Status == http.StatusUnauthorized {
+		code = codes.Unauthenticated
+	}
+
+	body, _ := json.Marshal(map[string]string{
+		"error": decision.Message,
+		"code":  decision.Code,
+	})
+
+	return &authv3.CheckResponse{
+		Status: &rpcstatus.Status{Code: int32(code), Message: decision.Code},
+		HttpResponse: &authv3.CheckResponse_DeniedResponse{
+			DeniedResponse: &authv3.DeniedHttpResponse{
+				Status: &typev3.HttpStatus{Code: typev3.StatusCode(decision.Status)},
+				Headers: []*corev3.HeaderValueOption{{
+					Header:       &corev3.HeaderValue{Key: "content-type", Value: "application/json"},
+					AppendAction: corev3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD,
+				}},
+				Body: string(body),
+			},
+		},
+	}
+}
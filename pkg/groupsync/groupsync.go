@@ -0,0 +1,421 @@
+// Package groupsync keeps role assignments in step with the groups of
+// identity providers such as Keycloak and LDAP directories. Mappings give
+// the members of a provider group a role; every sync assigns the role to
+// members who lack it and takes it back from users the sync gave it to who
+// have since left the group. Assignments made by hand are left alone.
+package groupsync
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lsendel/impl-zamaz/pkg/i18n"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/rbac"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+// Store keys of mappings by ID, and of the sync lease
+const (
+	mappingPrefix = "groupsync:mapping:"
+	syncLease     = "groupsync:sync:lease"
+)
+
+// AssignedByPrefix marks the assignments a sync made, followed by the
+// source's name
+const AssignedByPrefix = "group-sync:"
+
+// defaultTimeout bounds requests to identity providers
+const defaultTimeout = 30 * time.Second
+
+// maxGroupLength bounds group names in mappings
+const maxGroupLength = 256
+
+// Errors returned by Service
+var (
+	ErrUnknownSource = errors.New("unknown group source")
+	ErrNotMapped     = errors.New("group mapping not found")
+	ErrInvalid       = errors.New("invalid group mapping")
+	ErrExists        = errors.New("group mapping already exists")
+)
+
+// Source lists the groups of an identity provider
+type Source interface {
+	// Name identifies the source in mappings, e.g. "keycloak"
+	Name() string
+	// Groups returns the IDs of the members of every group by group name.
+	// Member IDs are those the provider's logins give users.
+	Groups(ctx context.Context) (map[string][]string, error)
+}
+
+// Roles assigns roles, e.g. an rbac.Manager
+type Roles interface {
+	Role(ctx context.Context, id string) (*rbac.Role, error)
+	Assign(ctx context.Context, a rbac.Assignment) (*rbac.Assignment, error)
+	Unassign(ctx context.Context, user, id string) error
+	Assignments(ctx context.Context, id string) ([]*rbac.Assignment, error)
+}
+
+// Config configures syncing
+type Config struct {
+	// Interval between syncs; defaults to 15m
+	Interval time.Duration
+}
+
+// Mapping gives the members of a source's group a role
+type Mapping struct {
+	ID     string `json:"id"`
+	Source string `json:"source"`
+	// Group is the source's name for the group: a Keycloak group path such
+	// as "/engineering/sre", or an LDAP group CN
+	Group     string    `json:"group"`
+	RoleID    string    `json:"role_id"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// SyncResult counts what a sync of one source did
+type SyncResult struct {
+	Source string `json:"source"`
+	// Groups is how many groups the source reported
+	Groups   int    `json:"groups"`
+	Assigned int    `json:"assigned"`
+	Removed  int    `json:"removed"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Service syncs role assignments from sources
+type Service struct {
+	config  Config
+	sources map[string]Source
+	roles   Roles
+	store   store.Store
+	logger  interfaces.Logger
+	metrics interfaces.MetricsCollector
+	now     func() time.Time
+}
+
+// NewService creates a service syncing sources into roles; metrics may be
+// nil
+func NewService(cfg Config, sources []Source, roles Roles, s store.Store, logger interfaces.Logger, metrics interfaces.MetricsCollector) *Service {
+	if cfg.Interval <= 0 {
+		cfg.Interval = 15 * time.Minute
+	}
+	byName := make(map[string]Source, len(sources))
+	for _, source := range sources {
+		byName[source.Name()] = source
+	}
+	return &Service{config: cfg, sources: byName, roles: roles, store: s, logger: logger, metrics: metrics, now: time.Now}
+}
+
+// Start syncs every Interval until ctx is cancelled. Only one replica runs
+// each sync.
+func (s *Service) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(s.config.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				n, _, err := s.store.Incr(ctx, syncLease, s.config.Interval*9/10)
+				if err != nil {
+					s.logger.Warn("Failed to acquire group sync lease", "error", err)
+					continue
+				}
+				if n == 1 {
+					s.SyncAll(ctx)
+				}
+			}
+		}
+	}()
+}
+
+// SyncAll syncs every source; a source failing does not stop the others
+func (s *Service) SyncAll(ctx context.Context) []SyncResult {
+	names := make([]string, 0, len(s.sources))
+	for name := range s.sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	results := make([]SyncResult, 0, len(names))
+	for _, name := range names {
+		result, err := s.Sync(ctx, name)
+		if err != nil {
+			s.logger.Error("Group sync failed", "source", name, "error", err)
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// Sync assigns the roles the source's mappings give to the members of its
+// groups, and takes them back from users the source's syncs gave them to
+// who are no longer members, or whose mapping was deleted. Nothing changes
+// when the source cannot be listed.
+func (s *Service) Sync(ctx context.Context, name string) (SyncResult, error) {
+	result := SyncResult{Source: name}
+	source, ok := s.sources[name]
+	if !ok {
+		return result, ErrUnknownSource
+	}
+	groups, err := source.Groups(ctx)
+	if err != nil {
+		s.count("group_sync_errors_total", name)
+		return result, err
+	}
+	result.Groups = len(groups)
+	mappings, err := s.Mappings(ctx, name)
+	if err != nil {
+		return result, err
+	}
+	// Users who should have each role
+	want := make(map[string]map[string]bool)
+	for _, m := range mappings {
+		if want[m.RoleID] == nil {
+			want[m.RoleID] = make(map[string]bool)
+		}
+		for _, user := range groups[m.Group] {
+			want[m.RoleID][user] = true
+		}
+	}
+
+	assignments, err := s.roles.Assignments(ctx, "")
+	if err != nil {
+		return result, err
+	}
+	marker := AssignedByPrefix + name
+	var errs []error
+	for _, a := range assignments {
+		if a.AssignedBy != marker || want[a.RoleID][a.UserID] {
+			continue
+		}
+		err := s.roles.Unassign(ctx, a.UserID, a.RoleID)
+		if errors.Is(err, rbac.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		result.Removed++
+	}
+
+	roleIDs := make([]string, 0, len(want))
+	for id := range want {
+		roleIDs = append(roleIDs, id)
+	}
+	sort.Strings(roleIDs)
+	for _, id := range roleIDs {
+		if _, err := s.roles.Role(ctx, id); err != nil {
+			if errors.Is(err, rbac.ErrNotFound) {
+				s.logger.Warn("Group mapping names a deleted role", "source", name, "role_id", id)
+			}
+			errs = append(errs, err)
+			continue
+		}
+		users := make([]string, 0, len(want[id]))
+		for user := range want[id] {
+			users = append(users, user)
+		}
+		sort.Strings(users)
+		for _, user := range users {
+			_, err := s.roles.Assign(ctx, rbac.Assignment{UserID: user, RoleID: id, AssignedBy: marker})
+			switch {
+			case errors.Is(err, rbac.ErrExists):
+				// Already synced, or assigned by hand
+			case err != nil:
+				errs = append(errs, err)
+			default:
+				result.Assigned++
+			}
+		}
+	}
+	s.count("group_syncs_total", name)
+	return result, errors.Join(errs...)
+}
+
+// Map stores m, giving the members of its group its role from the next
+// sync
+func (s *Service) Map(ctx context.Context, m Mapping) (*Mapping, error) {
+	m.Source = strings.TrimSpace(m.Source)
+	m.Group = strings.TrimSpace(m.Group)
+	if _, ok := s.sources[m.Source]; !ok {
+		return nil, ErrUnknownSource
+	}
+	if m.Group == "" || len(m.Group) > maxGroupLength {
+		return nil, fmt.Errorf("%w: group must be 1 to %d characters", ErrInvalid, maxGroupLength)
+	}
+	if _, err := s.roles.Role(ctx, m.RoleID); err != nil {
+		return nil, err
+	}
+	m.ID = mappingID(m.Source, m.Group, m.RoleID)
+	m.CreatedAt = s.now().UTC()
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	created, err := s.store.CompareAndSwap(ctx, mappingPrefix+m.ID, nil, data, 0)
+	if err != nil {
+		return nil, err
+	}
+	if !created {
+		return nil, ErrExists
+	}
+	return &m, nil
+}
+
+// Unmap deletes mapping id. The next sync takes back the roles it gave.
+func (s *Service) Unmap(ctx context.Context, id string) error {
+	if _, err := s.store.Get(ctx, mappingPrefix+id); errors.Is(err, store.ErrNotFound) {
+		return ErrNotMapped
+	} else if err != nil {
+		return err
+	}
+	return s.store.Delete(ctx, mappingPrefix+id)
+}
+
+// Mappings returns the mappings of source name, or of every source when
+// name is empty, by source and group
+func (s *Service) Mappings(ctx context.Context, name string) ([]Mapping, error) {
+	keys, err := s.store.Keys(ctx, mappingPrefix)
+	if err != nil {
+		return nil, err
+	}
+	mappings := make([]Mapping, 0, len(keys))
+	for _, key := range keys {
+		data, err := s.store.Get(ctx, key)
+		if errors.Is(err, store.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var m Mapping
+		if err := json.Unmarshal(data, &m); err != nil {
+			s.logger.Warn("Skipping unreadable group mapping", "key", key, "error", err)
+			continue
+		}
+		if name == "" || m.Source == name {
+			mappings = append(mappings, m)
+		}
+	}
+	sort.Slice(mappings, func(i, j int) bool {
+		if mappings[i].Source != mappings[j].Source {
+			return mappings[i].Source < mappings[j].Source
+		}
+		if mappings[i].Group != mappings[j].Group {
+			return mappings[i].Group < mappings[j].Group
+		}
+		return mappings[i].RoleID < mappings[j].RoleID
+	})
+	return mappings, nil
+}
+
+// RegisterRoutes mounts the mapping API, and the sync endpoints identity
+// providers' webhooks call when groups change, e.g. on the /rbac group
+func (s *Service) RegisterRoutes(r gin.IRoutes) {
+	r.GET("/group-mappings", s.handleMappings)
+	r.POST("/group-mappings", s.handleMap)
+	r.DELETE("/group-mappings/:id", s.handleUnmap)
+	r.POST("/group-sync", s.handleSyncAll)
+	r.POST("/group-sync/:source", s.handleSync)
+}
+
+func (s *Service) handleMappings(c *gin.Context) {
+	mappings, err := s.Mappings(c.Request.Context(), c.Query("source"))
+	if err != nil {
+		s.respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"mappings": mappings})
+}
+
+func (s *Service) handleMap(c *gin.Context) {
+	var req struct {
+		Source string `json:"source" binding:"required"`
+		Group  string `json:"group" binding:"required"`
+		RoleID string `json:"role_id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": i18n.Message(c, "VALIDATION_ERROR"), "code": "VALIDATION_ERROR"})
+		return
+	}
+	m := Mapping{Source: req.Source, Group: req.Group, RoleID: req.RoleID}
+	if user, ok := c.Get("user"); ok {
+		if info, ok := user.(*interfaces.UserInfo); ok && info != nil {
+			m.CreatedBy = info.ID
+		}
+	}
+	mapping, err := s.Map(c.Request.Context(), m)
+	if err != nil {
+		s.respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, mapping)
+}
+
+func (s *Service) handleUnmap(c *gin.Context) {
+	if err := s.Unmap(c.Request.Context(), c.Param("id")); err != nil {
+		s.respondError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (s *Service) handleSyncAll(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"results": s.SyncAll(c.Request.Context())})
+}
+
+func (s *Service) handleSync(c *gin.Context) {
+	name := c.Param("source")
+	result, err := s.Sync(c.Request.Context(), name)
+	if errors.Is(err, ErrUnknownSource) {
+		s.respondError(c, err)
+		return
+	}
+	if err != nil {
+		s.logger.Error("Group sync failed", "source", name, "error", err)
+		result.Error = err.Error()
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+func (s *Service) respondError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, ErrInvalid):
+		c.JSON(http.StatusBadRequest, gin.H{"error": i18n.Message(c, "VALIDATION_ERROR"), "code": "VALIDATION_ERROR"})
+	case errors.Is(err, ErrUnknownSource), errors.Is(err, ErrNotMapped), errors.Is(err, rbac.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": i18n.Message(c, "RESOURCE_NOT_FOUND"), "code": "RESOURCE_NOT_FOUND"})
+	case errors.Is(err, ErrExists):
+		c.JSON(http.StatusConflict, gin.H{"error": i18n.Message(c, "RESOURCE_CONFLICT"), "code": "RESOURCE_CONFLICT"})
+	default:
+		s.logger.Error("Group sync request failed", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": i18n.Message(c, "INTERNAL_ERROR"), "code": "INTERNAL_ERROR"})
+	}
+}
+
+func (s *Service) count(name, source string) {
+	if s.metrics != nil {
+		s.metrics.IncrementCounter(name, map[string]string{"source": source})
+	}
+}
+
+// mappingID derives the ID from what the mapping maps, so a group is
+// mapped to a role once
+func mappingID(source, group, roleID string) string {
+	sum := sha256.Sum256([]byte(source + "\x00" + group + "\x00" + roleID))
+	return hex.EncodeToString(sum[:16])
+}
@@ -0,0 +1,127 @@
+package groupsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/lsendel/impl-zamaz/pkg/authz"
+	"github.com/lsendel/impl-zamaz/pkg/oauthclient"
+)
+
+// keycloakPageSize is how many groups or members each admin API request
+// lists
+const keycloakPageSize = 100
+
+// KeycloakConfig configures the Keycloak source. The client's service
+// account needs the realm-management roles query-groups and view-users.
+type KeycloakConfig struct {
+	BaseURL      string
+	Realm        string
+	ClientID     string
+	ClientSecret string
+	Client       *http.Client
+}
+
+// Keycloak lists the groups of a Keycloak realm and their members from the
+// admin REST API. Groups are named by path, e.g. "/engineering/sre", and
+// members by user ID, the subject of the realm's tokens.
+type Keycloak struct {
+	adminURL string
+	token    *oauthclient.ClientCredentials
+}
+
+// NewKeycloak creates a Keycloak source
+func NewKeycloak(cfg KeycloakConfig) (*Keycloak, error) {
+	if cfg.BaseURL == "" || cfg.Realm == "" || cfg.ClientID == "" || cfg.ClientSecret == "" {
+		return nil, errors.New("keycloak group sync needs a base URL, realm, client ID and client secret")
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: defaultTimeout}
+	}
+	return &Keycloak{
+		adminURL: strings.TrimRight(cfg.BaseURL, "/") + "/admin/realms/" + url.PathEscape(cfg.Realm),
+		token: oauthclient.NewClientCredentials(authz.KeycloakTokenURL(cfg.BaseURL, cfg.Realm), url.Values{
+			"grant_type":    {"client_credentials"},
+			"client_id":     {cfg.ClientID},
+			"client_secret": {cfg.ClientSecret},
+		}, cfg.Client),
+	}, nil
+}
+
+// Name implements Source
+func (k *Keycloak) Name() string { return "keycloak" }
+
+// keycloakGroup is a group as the admin API represents it. Keycloak 23 and
+// later leave out subgroups, which are listed as children instead.
+type keycloakGroup struct {
+	ID            string          `json:"id"`
+	Path          string          `json:"path"`
+	SubGroupCount int             `json:"subGroupCount"`
+	SubGroups     []keycloakGroup `json:"subGroups"`
+}
+
+// Groups implements Source, walking subgroups
+func (k *Keycloak) Groups(ctx context.Context) (map[string][]string, error) {
+	top, err := k.pages(ctx, k.adminURL+"/groups?briefRepresentation=true")
+	if err != nil {
+		return nil, err
+	}
+	groups := make(map[string][]string)
+	pending := top
+	for len(pending) > 0 {
+		g := pending[0]
+		pending = pending[1:]
+		members, err := k.members(ctx, g.ID)
+		if err != nil {
+			return nil, err
+		}
+		groups[g.Path] = members
+		children := g.SubGroups
+		if len(children) == 0 && g.SubGroupCount > 0 {
+			if children, err = k.pages(ctx, k.adminURL+"/groups/"+url.PathEscape(g.ID)+"/children?briefRepresentation=true"); err != nil {
+				return nil, err
+			}
+		}
+		pending = append(pending, children...)
+	}
+	return groups, nil
+}
+
+// pages lists the groups at location, following pages
+func (k *Keycloak) pages(ctx context.Context, location string) ([]keycloakGroup, error) {
+	var groups []keycloakGroup
+	for first := 0; ; first += keycloakPageSize {
+		var page []keycloakGroup
+		if err := k.token.GetJSON(ctx, fmt.Sprintf("%s&first=%d&max=%d", location, first, keycloakPageSize), &page); err != nil {
+			return nil, err
+		}
+		groups = append(groups, page...)
+		if len(page) < keycloakPageSize {
+			return groups, nil
+		}
+	}
+}
+
+// members lists the user IDs of the direct members of group id
+func (k *Keycloak) members(ctx context.Context, id string) ([]string, error) {
+	var members []string
+	for first := 0; ; first += keycloakPageSize {
+		var page []struct {
+			ID string `json:"id"`
+		}
+		location := fmt.Sprintf("%s/groups/%s/members?briefRepresentation=true&first=%d&max=%d", k.adminURL, url.PathEscape(id), first, keycloakPageSize)
+		if err := k.token.GetJSON(ctx, location, &page); err != nil {
+			return nil, err
+		}
+		for _, user := range page {
+			members = append(members, user.ID)
+		}
+		if len(page) < keycloakPageSize {
+			return members, nil
+		}
+	}
+}
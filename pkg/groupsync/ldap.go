@@ -0,0 +1,26 @@
+package groupsync
+
+import (
+	"context"
+
+	"github.com/lsendel/impl-zamaz/pkg/auth"
+)
+
+// LDAP lists the groups of the directory users log in with. Groups are
+// named by CN and members by DN, the ID of users LDAP logins return.
+type LDAP struct {
+	verifier *auth.LDAPVerifier
+}
+
+// NewLDAP creates an LDAP source from the verifier's directory
+func NewLDAP(verifier *auth.LDAPVerifier) *LDAP {
+	return &LDAP{verifier: verifier}
+}
+
+// Name implements Source
+func (l *LDAP) Name() string { return "ldap" }
+
+// Groups implements Source
+func (l *LDAP) Groups(ctx context.Context) (map[string][]string, error) {
+	return l.verifier.Groups(ctx)
+}
@@ -0,0 +1,234 @@
+package health
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+)
+
+// PostgresCheck verifies that a PostgreSQL server answers at Addr
+// (host:port). Without a driver it sends an SSLRequest, which every server
+// answers with a single 'S' or 'N' before authentication.
+type PostgresCheck struct {
+	Addr string
+}
+
+// postgresSSLRequestCode is the protocol code of an SSLRequest message
+const postgresSSLRequestCode = 80877103
+
+// Check implements Check
+func (p *PostgresCheck) Check(ctx context.Context) error {
+	conn, err := dial(ctx, p.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint32(msg[0:4], 8)
+	binary.BigEndian.PutUint32(msg[4:8], postgresSSLRequestCode)
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+	reply := make([]byte, 1)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("no reply from postgres: %w", err)
+	}
+	if reply[0] != 'S' && reply[0] != 'N' {
+		return fmt.Errorf("unexpected postgres reply %q", reply[0])
+	}
+	return nil
+}
+
+// KafkaCheck verifies that at least one of Brokers (host:port) answers a
+// Kafka ApiVersions request
+type KafkaCheck struct {
+	Brokers []string
+}
+
+// Check implements Check
+func (k *KafkaCheck) Check(ctx context.Context) error {
+	if len(k.Brokers) == 0 {
+		return errors.New("no kafka brokers configured")
+	}
+	var errs []error
+	for _, broker := range k.Brokers {
+		err := kafkaAPIVersions(ctx, broker)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", broker, err))
+	}
+	return errors.Join(errs...)
+}
+
+// kafkaAPIVersions sends ApiVersions v0 and checks the response's
+// correlation id and error code
+func kafkaAPIVersions(ctx context.Context, broker string) error {
+	conn, err := dial(ctx, broker)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	const correlationID = 0x7a6d7a
+	clientID := "impl-zamaz-health"
+	var req bytes.Buffer
+	_ = binary.Write(&req, binary.BigEndian, int16(18)) // ApiVersions
+	_ = binary.Write(&req, binary.BigEndian, int16(0))
+	_ = binary.Write(&req, binary.BigEndian, int32(correlationID))
+	_ = binary.Write(&req, binary.BigEndian, int16(len(clientID)))
+	req.WriteString(clientID)
+
+	frame := make([]byte, 4, 4+req.Len())
+	binary.BigEndian.PutUint32(frame, uint32(req.Len()))
+	if _, err := conn.Write(append(frame, req.Bytes()...)); err != nil {
+		return err
+	}
+
+	header := make([]byte, 10) // size, correlation id, error code
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return fmt.Errorf("no reply from kafka: %w", err)
+	}
+	if got := binary.BigEndian.Uint32(header[4:8]); got != correlationID {
+		return fmt.Errorf("unexpected kafka correlation id %d", got)
+	}
+	if code := int16(binary.BigEndian.Uint16(header[8:10])); code != 0 {
+		return fmt.Errorf("kafka error code %d", code)
+	}
+	return nil
+}
+
+// NATSCheck verifies that a NATS server at URL (nats://host:port or
+// host:port) sends its INFO greeting
+type NATSCheck struct {
+	URL string
+}
+
+// Check implements Check
+func (n *NATSCheck) Check(ctx context.Context) error {
+	addr := n.URL
+	if u, err := url.Parse(n.URL); err == nil && u.Host != "" {
+		addr = u.Host
+	}
+	conn, err := dial(ctx, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("no greeting from nats: %w", err)
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		return fmt.Errorf("unexpected nats greeting %q", strings.TrimSpace(line))
+	}
+	return nil
+}
+
+// SMTPCheck verifies that an SMTP server at Addr (host:port) sends a 220
+// greeting; it quits without sending mail
+type SMTPCheck struct {
+	Addr string
+}
+
+// Check implements Check
+func (s *SMTPCheck) Check(ctx context.Context) error {
+	conn, err := dial(ctx, s.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	tp := textproto.NewConn(conn)
+	if _, _, err := tp.ReadResponse(220); err != nil {
+		return fmt.Errorf("unexpected smtp greeting: %w", err)
+	}
+	_ = tp.PrintfLine("QUIT")
+	return nil
+}
+
+// URLCheck verifies that a GET of URL answers with ExpectedStatus, or any
+// status below 400 when ExpectedStatus is zero
+type URLCheck struct {
+	URL            string
+	ExpectedStatus int
+	Client         *http.Client
+}
+
+// Check implements Check
+func (u *URLCheck) Check(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.URL, nil)
+	if err != nil {
+		return err
+	}
+	client := u.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if u.ExpectedStatus != 0 {
+		if resp.StatusCode != u.ExpectedStatus {
+			return fmt.Errorf("status %d, expected %d", resp.StatusCode, u.ExpectedStatus)
+		}
+		return nil
+	}
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// DiskCheck verifies that the filesystem holding Path has at least
+// MinFreeBytes available and, when set, MinFreePercent of its capacity
+type DiskCheck struct {
+	Path           string
+	MinFreeBytes   uint64
+	MinFreePercent float64
+}
+
+// Check implements Check
+func (d *DiskCheck) Check(context.Context) error {
+	free, total, err := diskSpace(d.Path)
+	if err != nil {
+		return err
+	}
+	if free < d.MinFreeBytes {
+		return fmt.Errorf("%d bytes free on %s, need %d", free, d.Path, d.MinFreeBytes)
+	}
+	if d.MinFreePercent > 0 && total > 0 {
+		if pct := float64(free) / float64(total) * 100; pct < d.MinFreePercent {
+			return fmt.Errorf("%.1f%% free on %s, need %.1f%%", pct, d.Path, d.MinFreePercent)
+		}
+	}
+	return nil
+}
+
+// dial opens a TCP connection bounded by ctx for the whole exchange
+func dial(ctx context.Context, addr string) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	return conn, nil
+}
@@ -0,0 +1,98 @@
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Check types accepted in a checks file
+const (
+	TypePostgres = "postgres"
+	TypeKafka    = "kafka"
+	TypeNATS     = "nats"
+	TypeSMTP     = "smtp"
+	TypeURL      = "url"
+	TypeDisk     = "disk"
+)
+
+// CheckConfig declares one dependency in a checks file:
+//
+//	[
+//	  {"name": "db", "type": "postgres", "target": "postgres:5432", "timeout": "2s", "critical": true},
+//	  {"name": "events", "type": "kafka", "brokers": ["kafka-1:9092", "kafka-2:9092"]},
+//	  {"name": "mail", "type": "smtp", "target": "smtp:25"},
+//	  {"name": "geoip", "type": "url", "target": "https://geo.example.com/health", "expected_status": 204},
+//	  {"name": "data", "type": "disk", "target": "/var/lib/zamaz", "min_free_mb": 512, "min_free_percent": 5}
+//	]
+type CheckConfig struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Target   string `json:"target"`
+	Timeout  string `json:"timeout"`
+	Critical bool   `json:"critical"`
+
+	Brokers        []string `json:"brokers,omitempty"`
+	ExpectedStatus int      `json:"expected_status,omitempty"`
+	MinFreeMB      uint64   `json:"min_free_mb,omitempty"`
+	MinFreePercent float64  `json:"min_free_percent,omitempty"`
+}
+
+// Dependency builds the dependency described by cfg
+func (cfg CheckConfig) Dependency() (Dependency, error) {
+	dep := Dependency{Name: cfg.Name, Critical: cfg.Critical}
+	if cfg.Timeout != "" {
+		timeout, err := time.ParseDuration(cfg.Timeout)
+		if err != nil || timeout <= 0 {
+			return Dependency{}, fmt.Errorf("health check %q has an invalid timeout %q", cfg.Name, cfg.Timeout)
+		}
+		dep.Timeout = timeout
+	}
+
+	switch cfg.Type {
+	case TypePostgres:
+		dep.Check = &PostgresCheck{Addr: cfg.Target}
+	case TypeKafka:
+		brokers := cfg.Brokers
+		if len(brokers) == 0 && cfg.Target != "" {
+			brokers = []string{cfg.Target}
+		}
+		dep.Check = &KafkaCheck{Brokers: brokers}
+	case TypeNATS:
+		dep.Check = &NATSCheck{URL: cfg.Target}
+	case TypeSMTP:
+		dep.Check = &SMTPCheck{Addr: cfg.Target}
+	case TypeURL:
+		dep.Check = &URLCheck{URL: cfg.Target, ExpectedStatus: cfg.ExpectedStatus}
+	case TypeDisk:
+		dep.Check = &DiskCheck{Path: cfg.Target, MinFreeBytes: cfg.MinFreeMB << 20, MinFreePercent: cfg.MinFreePercent}
+	default:
+		return Dependency{}, fmt.Errorf("health check %q has unknown type %q", cfg.Name, cfg.Type)
+	}
+	if cfg.Name == "" || (cfg.Target == "" && len(cfg.Brokers) == 0) {
+		return Dependency{}, fmt.Errorf("health check of type %q needs a name and a target", cfg.Type)
+	}
+	return dep, nil
+}
+
+// LoadChecks reads a JSON array of CheckConfig from path
+func LoadChecks(path string) ([]Dependency, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var configs []CheckConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("invalid health checks in %s: %w", path, err)
+	}
+	deps := make([]Dependency, 0, len(configs))
+	for _, cfg := range configs {
+		dep, err := cfg.Dependency()
+		if err != nil {
+			return nil, err
+		}
+		deps = append(deps, dep)
+	}
+	return deps, nil
+}
@@ -0,0 +1,238 @@
+// Package health checks the dependencies impl-zamaz relies on and rolls them
+// up into an overall service status.
+//
+// Each dependency has its own timeout and criticality: a failing critical
+// dependency makes the service unhealthy, a failing non-critical one only
+// degrades it.
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+)
+
+// Status is the health of a dependency or of the whole service
+type Status string
+
+// Statuses in increasing order of severity
+const (
+	StatusHealthy   Status = "healthy"
+	StatusDegraded  Status = "degraded"
+	StatusUnhealthy Status = "unhealthy"
+	// StatusUnknown is reported before a dependency's first check
+	StatusUnknown Status = "unknown"
+)
+
+// DefaultTimeout bounds a check registered without a timeout
+const DefaultTimeout = 5 * time.Second
+
+// Check probes one dependency and returns nil when it is usable
+type Check interface {
+	Check(ctx context.Context) error
+}
+
+// CheckFunc adapts a function, such as store.Store.Ping, to Check
+type CheckFunc func(ctx context.Context) error
+
+// Check implements Check
+func (f CheckFunc) Check(ctx context.Context) error { return f(ctx) }
+
+// Dependency is a registered check
+type Dependency struct {
+	Name    string
+	Check   Check
+	Timeout time.Duration
+	// Critical dependencies make the service unhealthy when they fail;
+	// the others only degrade it
+	Critical bool
+}
+
+// DependencyStatus is the result of a dependency's latest check
+type DependencyStatus struct {
+	Status    Status    `json:"status"`
+	Critical  bool      `json:"critical"`
+	Error     string    `json:"error,omitempty"`
+	LatencyMS int64     `json:"latency_ms"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// Report is the overall status and the status of every dependency
+type Report struct {
+	Overall      Status                      `json:"overall"`
+	Dependencies map[string]DependencyStatus `json:"dependencies"`
+	Timestamp    time.Time                   `json:"timestamp"`
+}
+
+// Checker runs registered dependency checks
+type Checker struct {
+	logger  interfaces.Logger
+	metrics interfaces.MetricsCollector
+
+	mu   sync.RWMutex
+	deps map[string]Dependency
+	last map[string]DependencyStatus
+}
+
+// NewChecker creates a checker without dependencies; metrics may be nil
+func NewChecker(logger interfaces.Logger, metrics interfaces.MetricsCollector) *Checker {
+	return &Checker{
+		logger:  logger,
+		metrics: metrics,
+		deps:    make(map[string]Dependency),
+		last:    make(map[string]DependencyStatus),
+	}
+}
+
+// Register adds dependency, replacing one with the same name
+func (c *Checker) Register(dep Dependency) error {
+	if dep.Name == "" || dep.Check == nil {
+		return errors.New("health dependency needs a name and a check")
+	}
+	if dep.Timeout <= 0 {
+		dep.Timeout = DefaultTimeout
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deps[dep.Name] = dep
+	c.last[dep.Name] = DependencyStatus{Status: StatusUnknown, Critical: dep.Critical}
+	return nil
+}
+
+// Run checks every dependency concurrently and returns the fresh report
+func (c *Checker) Run(ctx context.Context) Report {
+	c.mu.RLock()
+	deps := make([]Dependency, 0, len(c.deps))
+	for _, dep := range c.deps {
+		deps = append(deps, dep)
+	}
+	c.mu.RUnlock()
+
+	results := make([]DependencyStatus, len(deps))
+	var wg sync.WaitGroup
+	for i, dep := range deps {
+		wg.Add(1)
+		go func(i int, dep Dependency) {
+			defer wg.Done()
+			results[i] = c.check(ctx, dep)
+		}(i, dep)
+	}
+	wg.Wait()
+
+	c.mu.Lock()
+	for i, dep := range deps {
+		// Skip dependencies replaced while the check ran
+		if _, ok := c.deps[dep.Name]; ok {
+			c.last[dep.Name] = results[i]
+		}
+	}
+	c.mu.Unlock()
+	return c.Last()
+}
+
+// Last returns the report from the most recent checks without probing
+func (c *Checker) Last() Report {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	report := Report{
+		Overall:      StatusHealthy,
+		Dependencies: make(map[string]DependencyStatus, len(c.last)),
+		Timestamp:    time.Now().UTC(),
+	}
+	for name, st := range c.last {
+		report.Dependencies[name] = st
+		report.Overall = worse(report.Overall, st.Status)
+	}
+	return report
+}
+
+// Start runs the checks every interval until ctx is cancelled
+func (c *Checker) Start(ctx context.Context, interval time.Duration) {
+	go func() {
+		c.Run(ctx)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				c.Run(ctx)
+			}
+		}
+	}()
+}
+
+func (c *Checker) check(ctx context.Context, dep Dependency) DependencyStatus {
+	ctx, span := otel.Tracer("github.com/lsendel/impl-zamaz/pkg/health").Start(ctx, "health.check "+dep.Name)
+	defer span.End()
+	span.SetAttributes(attribute.String("health.dependency", dep.Name), attribute.Bool("health.critical", dep.Critical))
+	ctx, cancel := context.WithTimeout(ctx, dep.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := runCheck(ctx, dep.Check)
+	st := DependencyStatus{
+		Status:    StatusHealthy,
+		Critical:  dep.Critical,
+		LatencyMS: time.Since(start).Milliseconds(),
+		CheckedAt: start.UTC(),
+	}
+	if err != nil {
+		st.Status = StatusDegraded
+		if dep.Critical {
+			st.Status = StatusUnhealthy
+		}
+		st.Error = err.Error()
+		span.SetStatus(codes.Error, st.Error)
+		c.logger.Warn("Health dependency check failed", "dependency", dep.Name, "critical", dep.Critical, "error", err)
+	}
+
+	if c.metrics != nil {
+		value := 0.0
+		if err == nil {
+			value = 1
+		}
+		c.metrics.SetGauge("health_dependency_up", value, map[string]string{"dependency": dep.Name})
+		c.metrics.ObserveHistogram("health_check_duration_seconds", time.Since(start).Seconds(), map[string]string{"dependency": dep.Name})
+	}
+	return st
+}
+
+// runCheck returns when check does or when ctx expires, so a check that
+// ignores its context cannot hold up the report
+func runCheck(ctx context.Context, check Check) error {
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- fmt.Errorf("check panicked: %v", r)
+			}
+		}()
+		done <- check.Check(ctx)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("check timed out: %w", ctx.Err())
+	}
+}
+
+func worse(a, b Status) Status {
+	rank := map[Status]int{StatusHealthy: 0, StatusUnknown: 0, StatusDegraded: 1, StatusUnhealthy: 2}
+	if rank[b] > rank[a] {
+		return b
+	}
+	return a
+}
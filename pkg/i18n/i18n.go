@@ -0,0 +1,129 @@
+// Package i18n provides localized user-facing messages keyed by stable error codes
+package i18n
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultLanguage is used when no supported language can be negotiated
+const DefaultLanguage = "en"
+
+// ContextKey is the gin context key holding the negotiated language
+const ContextKey = "locale"
+
+//go:embed locales/*.json
+var localeFiles embed.FS
+
+// catalogs maps a language tag to its code -> message catalog
+var catalogs = mustLoadCatalogs()
+
+func mustLoadCatalogs() map[string]map[string]string {
+	entries, err := localeFiles.ReadDir("locales")
+	if err != nil {
+		panic(fmt.Sprintf("i18n: failed to read locales: %v", err))
+	}
+
+	result := make(map[string]map[string]string, len(entries))
+	for _, entry := range entries {
+		data, err := localeFiles.ReadFile(path.Join("locales", entry.Name()))
+		if err != nil {
+			panic(fmt.Sprintf("i18n: failed to read %s: %v", entry.Name(), err))
+		}
+		catalog := make(map[string]string)
+		if err := json.Unmarshal(data, &catalog); err != nil {
+			panic(fmt.Sprintf("i18n: invalid catalog %s: %v", entry.Name(), err))
+		}
+		result[strings.TrimSuffix(entry.Name(), ".json")] = catalog
+	}
+
+	return result
+}
+
+// Supported returns the available languages in sorted order
+func Supported() []string {
+	langs := make([]string, 0, len(catalogs))
+	for lang := range catalogs {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	return langs
+}
+
+// Negotiate picks the best supported language for an Accept-Language header
+func Negotiate(acceptLanguage string) string {
+	type candidate struct {
+		lang string
+		q    float64
+	}
+
+	var candidates []candidate
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		tag, q := part, 1.0
+		if i := strings.Index(part, ";"); i >= 0 {
+			tag = strings.TrimSpace(part[:i])
+			if params := strings.TrimSpace(part[i+1:]); strings.HasPrefix(params, "q=") {
+				parsed, err := strconv.ParseFloat(strings.TrimPrefix(params, "q="), 64)
+				if err != nil {
+					continue
+				}
+				q = parsed
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+
+		// Match on the primary subtag so pt-BR and es-419 resolve to pt and es
+		base := strings.ToLower(strings.SplitN(tag, "-", 2)[0])
+		if _, ok := catalogs[base]; ok {
+			candidates = append(candidates, candidate{lang: base, q: q})
+		}
+	}
+
+	if len(candidates) == 0 {
+		return DefaultLanguage
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].q > candidates[j].q
+	})
+	return candidates[0].lang
+}
+
+// Translate returns the message for code in lang, falling back to the default
+// language and finally to the code itself
+func Translate(lang, code string) string {
+	if msg, ok := catalogs[lang][code]; ok {
+		return msg
+	}
+	if msg, ok := catalogs[DefaultLanguage][code]; ok {
+		return msg
+	}
+	return code
+}
+
+// Language returns the negotiated language for a request
+func Language(c *gin.Context) string {
+	if lang := c.GetString(ContextKey); lang != "" {
+		return lang
+	}
+	return Negotiate(c.GetHeader("Accept-Language"))
+}
+
+// Message returns the localized message for code in the request's language
+func Message(c *gin.Context, code string) string {
+	return Translate(Language(c), code)
+}
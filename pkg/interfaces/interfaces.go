@@ -0,0 +1,131 @@
+// Package interfaces defines the shared contracts and data types used across impl-zamaz packages
+package interfaces
+
+import (
+	"context"
+	"time"
+)
+
+// Logger is the structured logger used by middleware and security components
+type Logger interface {
+	Debug(msg string, keysAndValues ...interface{})
+	Info(msg string, keysAndValues ...interface{})
+	Warn(msg string, keysAndValues ...interface{})
+	Error(msg string, keysAndValues ...interface{})
+	With(keysAndValues ...interface{}) Logger
+}
+
+// MetricsCollector records application metrics
+type MetricsCollector interface {
+	IncrementCounter(name string, labels map[string]string)
+	ObserveHistogram(name string, value float64, labels map[string]string)
+	SetGauge(name string, value float64, labels map[string]string)
+}
+
+// UserInfo represents an authenticated user
+type UserInfo struct {
+	ID       string   `json:"id"`
+	Username string   `json:"username"`
+	Email    string   `json:"email"`
+	Roles    []string `json:"roles"`
+	// TenantID and Attributes are optional directory data that claim
+	// mappings can copy into issued tokens
+	TenantID   string            `json:"tenant_id,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// DeviceInfo is a device registered to a user
+type DeviceInfo struct {
+	ID      string `json:"id"`
+	OwnerID string `json:"owner_id"`
+	Name    string `json:"name"`
+	// Platform is one of "android", "ios", "linux", "macos" or "windows"
+	Platform string `json:"platform"`
+	// Fingerprint identifies the device's hardware or keys, as reported by
+	// its agent
+	Fingerprint string `json:"fingerprint"`
+	// AttestationStatus is "pending", "verified" or "failed"
+	AttestationStatus string `json:"attestation_status"`
+	// Integrity is the integrity platform attestation vouched for:
+	// "strong", "device" or "basic"; empty without platform attestation
+	Integrity string `json:"integrity,omitempty"`
+	// PublicKey is the device's hardware-backed key, base64 DER, once the
+	// device is bound to it
+	PublicKey    string     `json:"public_key,omitempty"`
+	BoundAt      *time.Time `json:"bound_at,omitempty"`
+	TrustScore   int        `json:"trust_score"`
+	RegisteredAt time.Time  `json:"registered_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+	VerifiedAt   *time.Time `json:"verified_at,omitempty"`
+	// VerifiedBy is how the device was last verified: "attestation", or
+	// the "email", "push" or "admin" verification its owner completed
+	VerifiedBy string `json:"verified_by,omitempty"`
+	// State is "active", "stale" once unseen for a while, "quarantined"
+	// after longer or by an administrator until verified again, or
+	// "blocked" by an administrator for good
+	State string `json:"state,omitempty"`
+	// StateReason is why an administrator quarantined or blocked the device
+	StateReason string     `json:"state_reason,omitempty"`
+	LastSeenAt  *time.Time `json:"last_seen_at,omitempty"`
+	// Compliance is what the MDM managing the device, ComplianceSource,
+	// last reported: "compliant", "noncompliant" or "unknown"; empty for
+	// unmanaged devices
+	Compliance          string     `json:"compliance,omitempty"`
+	ComplianceSource    string     `json:"compliance_source,omitempty"`
+	ComplianceCheckedAt *time.Time `json:"compliance_checked_at,omitempty"`
+}
+
+// LoginResponse represents a successful authentication
+type LoginResponse struct {
+	AccessToken  string   `json:"access_token"`
+	RefreshToken string   `json:"refresh_token"`
+	ExpiresIn    int      `json:"expires_in"`
+	TokenType    string   `json:"token_type"`
+	User         UserInfo `json:"user"`
+	TrustScore   int      `json:"trust_score"`
+}
+
+// CredentialVerifier checks a username and password against an identity
+// backend such as Keycloak, a local user file or LDAP. Backends that issue
+// their own tokens return them in the response; the others return only the
+// user and leave token issuance to the caller.
+type CredentialVerifier interface {
+	Authenticate(ctx context.Context, username, password string) (*LoginResponse, error)
+}
+
+// EmailSender delivers plain-text email, such as login links
+type EmailSender interface {
+	Send(ctx context.Context, to, subject, body string) error
+}
+
+// TrustFactors holds the individual components of a trust score
+type TrustFactors struct {
+	Identity int `json:"identity"`
+	Device   int `json:"device"`
+	Behavior int `json:"behavior"`
+	Location int `json:"location"`
+	Risk     int `json:"risk"`
+}
+
+// FactorExplanation says how one factor contributed to a trust score
+type FactorExplanation struct {
+	Factor string `json:"factor"`
+	// Weight is the most points the factor can contribute
+	Weight int `json:"weight"`
+	// Score is the factor's assessment from 0 to 1
+	Score  float64 `json:"score"`
+	Points int     `json:"points"`
+	Reason string  `json:"reason"`
+	// Evidence holds the facts the provider based its score on
+	Evidence map[string]string `json:"evidence,omitempty"`
+}
+
+// TrustScore represents a calculated trust score for a user
+type TrustScore struct {
+	UserID       string              `json:"user_id"`
+	Overall      int                 `json:"overall"`
+	Factors      TrustFactors        `json:"factors"`
+	Explanations []FactorExplanation `json:"explanations,omitempty"`
+	Timestamp    time.Time           `json:"timestamp"`
+	Context      string              `json:"context"`
+}
@@ -0,0 +1,378 @@
+// Package loadtest drives configurable request mixes against an impl-zamaz
+// instance and reports latency percentiles and error breakdowns
+package loadtest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Operation names accepted in a mix
+const (
+	OpLogin    = "login"
+	OpValidate = "validate"
+	OpPolicy   = "policy"
+)
+
+// Config describes a load test run
+type Config struct {
+	Target      string
+	Duration    time.Duration
+	Concurrency int
+	// Rate caps total requests per second across workers; 0 means unlimited
+	Rate     int
+	Mix      map[string]int
+	Username string
+	Password string
+	Timeout  time.Duration
+}
+
+// ParseMix parses "login=20,validate=60,policy=20" into operation weights
+func ParseMix(s string) (map[string]int, error) {
+	mix := make(map[string]int)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, weightStr, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid mix entry %q, expected op=weight", part)
+		}
+		switch name {
+		case OpLogin, OpValidate, OpPolicy:
+		default:
+			return nil, fmt.Errorf("unknown operation %q", name)
+		}
+		weight, err := strconv.Atoi(weightStr)
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("invalid weight for %s: %q", name, weightStr)
+		}
+		mix[name] = weight
+	}
+	if len(mix) == 0 {
+		return nil, errors.New("mix must contain at least one operation")
+	}
+	return mix, nil
+}
+
+// OperationStats summarizes one operation
+type OperationStats struct {
+	Requests int            `json:"requests"`
+	Errors   int            `json:"errors"`
+	P50      time.Duration  `json:"p50"`
+	P90      time.Duration  `json:"p90"`
+	P95      time.Duration  `json:"p95"`
+	P99      time.Duration  `json:"p99"`
+	Max      time.Duration  `json:"max"`
+	ErrorsBy map[string]int `json:"errors_by,omitempty"`
+
+	latencies []time.Duration
+}
+
+// Report is the result of a load test run
+type Report struct {
+	Target     string                     `json:"target"`
+	Duration   time.Duration              `json:"duration"`
+	Requests   int                        `json:"requests"`
+	Errors     int                        `json:"errors"`
+	Throughput float64                    `json:"throughput_rps"`
+	Operations map[string]*OperationStats `json:"operations"`
+}
+
+// Runner executes load tests
+type Runner struct {
+	config Config
+	client *http.Client
+	picker []string
+
+	mu     sync.Mutex
+	report *Report
+	token  string
+}
+
+// NewRunner validates cfg and creates a runner
+func NewRunner(cfg Config) (*Runner, error) {
+	if cfg.Target == "" {
+		return nil, errors.New("target is required")
+	}
+	if cfg.Duration <= 0 {
+		return nil, errors.New("duration must be positive")
+	}
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = 1
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+
+	// Expand weights into a lookup table so picking is a single random index
+	var picker []string
+	for _, op := range []string{OpLogin, OpValidate, OpPolicy} {
+		for i := 0; i < cfg.Mix[op]; i++ {
+			picker = append(picker, op)
+		}
+	}
+	if len(picker) == 0 {
+		return nil, errors.New("mix has no positive weights")
+	}
+
+	return &Runner{
+		config: cfg,
+		client: &http.Client{
+			Timeout: cfg.Timeout,
+			Transport: &http.Transport{
+				MaxIdleConns:        cfg.Concurrency,
+				MaxIdleConnsPerHost: cfg.Concurrency,
+			},
+		},
+		picker: picker,
+		report: &Report{
+			Target:     cfg.Target,
+			Operations: make(map[string]*OperationStats),
+		},
+	}, nil
+}
+
+// Run drives load until the configured duration elapses or ctx is cancelled
+func (r *Runner) Run(ctx context.Context) *Report {
+	ctx, cancel := context.WithTimeout(ctx, r.config.Duration)
+	defer cancel()
+
+	var ticks <-chan time.Time
+	if r.config.Rate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(r.config.Rate))
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < r.config.Concurrency; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(seed))
+			for {
+				if ticks != nil {
+					select {
+					case <-ticks:
+					case <-ctx.Done():
+						return
+					}
+				}
+				if ctx.Err() != nil {
+					return
+				}
+				op := r.picker[rng.Intn(len(r.picker))]
+				r.execute(ctx, op)
+			}
+		}(time.Now().UnixNano() + int64(i))
+	}
+	wg.Wait()
+
+	return r.finalize(time.Since(start))
+}
+
+func (r *Runner) execute(ctx context.Context, op string) {
+	var req *http.Request
+	var err error
+
+	switch op {
+	case OpLogin:
+		req, err = r.jsonRequest(ctx, http.MethodPost, "/api/v1/auth/login", map[string]string{
+			"username": r.config.Username,
+			"password": r.config.Password,
+		})
+	case OpValidate:
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, r.config.Target+"/api/v1/auth/validate", nil)
+	case OpPolicy:
+		req, err = r.jsonRequest(ctx, http.MethodPost, "/api/v1/policies/evaluate", map[string]interface{}{
+			"subject":  r.config.Username,
+			"resource": "/api/v1/protected",
+			"action":   "read",
+		})
+	}
+	if err != nil {
+		r.record(op, 0, "request_build")
+		return
+	}
+	if op != OpLogin {
+		if token := r.currentToken(); token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+
+	start := time.Now()
+	resp, err := r.client.Do(req)
+	latency := time.Since(start)
+	if err != nil {
+		// Requests cut off by the end of the run are not failures
+		if ctx.Err() != nil {
+			return
+		}
+		r.record(op, latency, classifyError(err))
+		return
+	}
+	defer resp.Body.Close()
+
+	if op == OpLogin && resp.StatusCode == http.StatusOK {
+		var body struct {
+			AccessToken string `json:"access_token"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&body) == nil && body.AccessToken != "" {
+			r.setToken(body.AccessToken)
+		}
+	}
+	io.Copy(io.Discard, resp.Body)
+
+	errorKind := ""
+	if resp.StatusCode >= 400 {
+		errorKind = "status_" + strconv.Itoa(resp.StatusCode)
+	}
+	r.record(op, latency, errorKind)
+}
+
+func (r *Runner) jsonRequest(ctx context.Context, method, path string, body interface{}) (*http.Request, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, r.config.Target+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+func (r *Runner) currentToken() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.token
+}
+
+func (r *Runner) setToken(token string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.token = token
+}
+
+func (r *Runner) record(op string, latency time.Duration, errorKind string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats, ok := r.report.Operations[op]
+	if !ok {
+		stats = &OperationStats{ErrorsBy: make(map[string]int)}
+		r.report.Operations[op] = stats
+	}
+	stats.Requests++
+	if latency > 0 {
+		stats.latencies = append(stats.latencies, latency)
+	}
+	if errorKind != "" {
+		stats.Errors++
+		stats.ErrorsBy[errorKind]++
+	}
+}
+
+func (r *Runner) finalize(elapsed time.Duration) *Report {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	report := r.report
+	report.Duration = elapsed
+	for _, stats := range report.Operations {
+		report.Requests += stats.Requests
+		report.Errors += stats.Errors
+
+		sort.Slice(stats.latencies, func(i, j int) bool { return stats.latencies[i] < stats.latencies[j] })
+		stats.P50 = percentile(stats.latencies, 50)
+		stats.P90 = percentile(stats.latencies, 90)
+		stats.P95 = percentile(stats.latencies, 95)
+		stats.P99 = percentile(stats.latencies, 99)
+		if n := len(stats.latencies); n > 0 {
+			stats.Max = stats.latencies[n-1]
+		}
+	}
+	if elapsed > 0 {
+		report.Throughput = float64(report.Requests) / elapsed.Seconds()
+	}
+	return report
+}
+
+// percentile uses the nearest-rank method on sorted latencies
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func classifyError(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case strings.Contains(err.Error(), "connection refused"):
+		return "connection_refused"
+	case strings.Contains(err.Error(), "connection reset"):
+		return "connection_reset"
+	default:
+		return "network"
+	}
+}
+
+// WriteText renders the report as a human-readable table
+func (rep *Report) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "Target:     %s\n", rep.Target)
+	fmt.Fprintf(w, "Duration:   %s\n", rep.Duration.Round(time.Millisecond))
+	fmt.Fprintf(w, "Requests:   %d (%.1f req/s)\n", rep.Requests, rep.Throughput)
+	fmt.Fprintf(w, "Errors:     %d\n\n", rep.Errors)
+
+	fmt.Fprintf(w, "%-10s %8s %7s %10s %10s %10s %10s %10s\n", "OPERATION", "REQS", "ERRS", "P50", "P90", "P95", "P99", "MAX")
+	ops := make([]string, 0, len(rep.Operations))
+	for op := range rep.Operations {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	for _, op := range ops {
+		s := rep.Operations[op]
+		fmt.Fprintf(w, "%-10s %8d %7d %10s %10s %10s %10s %10s\n", op, s.Requests, s.Errors,
+			s.P50.Round(time.Microsecond), s.P90.Round(time.Microsecond), s.P95.Round(time.Microsecond),
+			s.P99.Round(time.Microsecond), s.Max.Round(time.Microsecond))
+	}
+
+	for _, op := range ops {
+		s := rep.Operations[op]
+		if len(s.ErrorsBy) == 0 {
+			continue
+		}
+		kinds := make([]string, 0, len(s.ErrorsBy))
+		for kind := range s.ErrorsBy {
+			kinds = append(kinds, kind)
+		}
+		sort.Strings(kinds)
+		fmt.Fprintf(w, "\nErrors for %s:\n", op)
+		for _, kind := range kinds {
+			fmt.Fprintf(w, "  %-20s %d\n", kind, s.ErrorsBy[kind])
+		}
+	}
+}
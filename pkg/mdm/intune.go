@@ -0,0 +1,94 @@
+package mdm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/lsendel/impl-zamaz/pkg/oauthclient"
+)
+
+// Microsoft endpoints Intune is reached through
+const (
+	IntuneTokenURL = "https://login.microsoftonline.com/%s/oauth2/v2.0/token"
+	IntuneGraphURL = "https://graph.microsoft.com/v1.0"
+)
+
+// IntuneConfig configures the Intune connector. The app registration needs
+// the DeviceManagementManagedDevices.Read.All application permission.
+type IntuneConfig struct {
+	TenantID     string
+	ClientID     string
+	ClientSecret string
+	// TokenURL and GraphURL default to Microsoft's global cloud
+	TokenURL string
+	GraphURL string
+	Client   *http.Client
+}
+
+// Intune lists the managed devices of a Microsoft Intune tenant from
+// Microsoft Graph. Devices in their grace period count as compliant, as
+// Intune's conditional access treats them.
+type Intune struct {
+	config IntuneConfig
+	token  *oauthclient.ClientCredentials
+}
+
+// NewIntune creates an Intune connector
+func NewIntune(cfg IntuneConfig) (*Intune, error) {
+	if cfg.TenantID == "" || cfg.ClientID == "" || cfg.ClientSecret == "" {
+		return nil, errors.New("intune needs a tenant ID, client ID and client secret")
+	}
+	if cfg.TokenURL == "" {
+		cfg.TokenURL = fmt.Sprintf(IntuneTokenURL, url.PathEscape(cfg.TenantID))
+	}
+	if cfg.GraphURL == "" {
+		cfg.GraphURL = IntuneGraphURL
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: defaultTimeout}
+	}
+	return &Intune{config: cfg, token: oauthclient.NewClientCredentials(cfg.TokenURL, url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {cfg.ClientID},
+		"client_secret": {cfg.ClientSecret},
+		"scope":         {"https://graph.microsoft.com/.default"},
+	}, cfg.Client)}, nil
+}
+
+// Name implements Connector
+func (i *Intune) Name() string { return "intune" }
+
+// Devices implements Connector, following Graph's pages
+func (i *Intune) Devices(ctx context.Context) ([]Record, error) {
+	next := i.config.GraphURL + "/deviceManagement/managedDevices?$select=id,deviceName,complianceState,lastSyncDateTime"
+	var records []Record
+	for next != "" {
+		var page struct {
+			Value []struct {
+				ID               string    `json:"id"`
+				DeviceName       string    `json:"deviceName"`
+				ComplianceState  string    `json:"complianceState"`
+				LastSyncDateTime time.Time `json:"lastSyncDateTime"`
+			} `json:"value"`
+			NextLink string `json:"@odata.nextLink"`
+		}
+		if err := i.token.GetJSON(ctx, next, &page); err != nil {
+			return nil, err
+		}
+		for _, d := range page.Value {
+			records = append(records, Record{
+				ID:          d.ID,
+				Name:        d.DeviceName,
+				Compliant:   d.ComplianceState == "compliant" || d.ComplianceState == "inGracePeriod",
+				State:       d.ComplianceState,
+				LastCheckIn: d.LastSyncDateTime,
+			})
+		}
+		next = page.NextLink
+	}
+	return records, nil
+}
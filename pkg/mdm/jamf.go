@@ -0,0 +1,131 @@
+package mdm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lsendel/impl-zamaz/pkg/oauthclient"
+)
+
+// jamfPageSize is how many computers each inventory request returns
+const jamfPageSize = 200
+
+// JamfConfig configures the Jamf Pro connector. The API client needs the
+// Read Computers and Read Smart Computer Groups privileges.
+type JamfConfig struct {
+	// URL is the Jamf Pro server, e.g. "https://example.jamfcloud.com"
+	URL          string
+	ClientID     string
+	ClientSecret string
+	// ComplianceGroupID, when set, is the smart computer group whose
+	// members are compliant; otherwise every managed computer is
+	ComplianceGroupID int
+	Client            *http.Client
+}
+
+// Jamf lists the computers a Jamf Pro server manages. Jamf has no
+// compliance state of its own, so compliance is membership of a smart
+// group encoding the organization's policy.
+type Jamf struct {
+	config JamfConfig
+	token  *oauthclient.ClientCredentials
+}
+
+// NewJamf creates a Jamf Pro connector
+func NewJamf(cfg JamfConfig) (*Jamf, error) {
+	if cfg.URL == "" || cfg.ClientID == "" || cfg.ClientSecret == "" {
+		return nil, errors.New("jamf needs a server URL, client ID and client secret")
+	}
+	cfg.URL = strings.TrimRight(cfg.URL, "/")
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: defaultTimeout}
+	}
+	return &Jamf{config: cfg, token: oauthclient.NewClientCredentials(cfg.URL+"/api/oauth/token", url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {cfg.ClientID},
+		"client_secret": {cfg.ClientSecret},
+	}, cfg.Client)}, nil
+}
+
+// Name implements Connector
+func (j *Jamf) Name() string { return "jamf" }
+
+// Devices implements Connector
+func (j *Jamf) Devices(ctx context.Context) ([]Record, error) {
+	var members map[string]bool
+	if j.config.ComplianceGroupID != 0 {
+		var err error
+		if members, err = j.groupMembers(ctx, j.config.ComplianceGroupID); err != nil {
+			return nil, err
+		}
+	}
+
+	var records []Record
+	for page := 0; ; page++ {
+		var inventory struct {
+			TotalCount int `json:"totalCount"`
+			Results    []struct {
+				ID      string `json:"id"`
+				General struct {
+					Name             string    `json:"name"`
+					LastContactTime  time.Time `json:"lastContactTime"`
+					RemoteManagement struct {
+						Managed bool `json:"managed"`
+					} `json:"remoteManagement"`
+				} `json:"general"`
+			} `json:"results"`
+		}
+		location := fmt.Sprintf("%s/api/v1/computers-inventory?section=GENERAL&page=%d&page-size=%d", j.config.URL, page, jamfPageSize)
+		if err := j.token.GetJSON(ctx, location, &inventory); err != nil {
+			return nil, err
+		}
+		for _, c := range inventory.Results {
+			managed := c.General.RemoteManagement.Managed
+			compliant, state := managed, "managed"
+			if !managed {
+				state = "unmanaged"
+			} else if members != nil {
+				compliant = members[c.ID]
+				if !compliant {
+					state = "not_in_compliance_group"
+				}
+			}
+			records = append(records, Record{
+				ID:          c.ID,
+				Name:        c.General.Name,
+				Compliant:   compliant,
+				State:       state,
+				LastCheckIn: c.General.LastContactTime,
+			})
+		}
+		if len(inventory.Results) == 0 || len(records) >= inventory.TotalCount {
+			return records, nil
+		}
+	}
+}
+
+// groupMembers returns the IDs of the computers in a computer group, from
+// the Classic API
+func (j *Jamf) groupMembers(ctx context.Context, id int) (map[string]bool, error) {
+	var group struct {
+		ComputerGroup struct {
+			Computers []struct {
+				ID int `json:"id"`
+			} `json:"computers"`
+		} `json:"computer_group"`
+	}
+	if err := j.token.GetJSON(ctx, j.config.URL+"/JSSResource/computergroups/id/"+strconv.Itoa(id), &group); err != nil {
+		return nil, err
+	}
+	members := make(map[string]bool, len(group.ComputerGroup.Computers))
+	for _, c := range group.ComputerGroup.Computers {
+		members[strconv.Itoa(c.ID)] = true
+	}
+	return members, nil
+}
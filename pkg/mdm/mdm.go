@@ -0,0 +1,384 @@
+// Package mdm syncs device compliance from mobile device management
+// systems such as Microsoft Intune and Jamf Pro. Connectors list the
+// devices an MDM manages; administrators link MDM device IDs to registered
+// devices, and every sync records the linked devices' compliance in the
+// device registry, where it feeds the device trust factor.
+package mdm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lsendel/impl-zamaz/pkg/device"
+	"github.com/lsendel/impl-zamaz/pkg/i18n"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+// Store keys of links by connector and MDM device ID, and of the sync lease
+const (
+	linkPrefix = "mdm:link:"
+	syncLease  = "mdm:sync:lease"
+)
+
+// defaultTimeout bounds requests to MDM APIs
+const defaultTimeout = 30 * time.Second
+
+// Errors returned by Service
+var (
+	ErrUnknownConnector = errors.New("unknown MDM connector")
+	ErrNotLinked        = errors.New("MDM device not linked")
+)
+
+// Record is a device as an MDM reports it
+type Record struct {
+	// ID is the MDM's device ID
+	ID   string
+	Name string
+	// Compliant is whether the device meets the MDM's compliance policy
+	Compliant bool
+	// State is the MDM's own compliance state, e.g. Intune's
+	// "inGracePeriod"
+	State       string
+	LastCheckIn time.Time
+}
+
+// Connector lists the devices an MDM manages
+type Connector interface {
+	// Name identifies the connector in links, e.g. "intune"
+	Name() string
+	Devices(ctx context.Context) ([]Record, error)
+}
+
+// Devices records compliance on registered devices, e.g. a device.Registry
+type Devices interface {
+	SetCompliance(ctx context.Context, id, source, status string) (*interfaces.DeviceInfo, error)
+}
+
+// Config configures syncing
+type Config struct {
+	// Interval between syncs; defaults to 15m
+	Interval time.Duration
+}
+
+// Link maps an MDM device to a registered device
+type Link struct {
+	Connector string    `json:"connector"`
+	MDMID     string    `json:"mdm_id"`
+	DeviceID  string    `json:"device_id"`
+	LinkedAt  time.Time `json:"linked_at"`
+	// SyncedAt and State are set once a sync has seen the MDM device
+	SyncedAt *time.Time `json:"synced_at,omitempty"`
+	State    string     `json:"state,omitempty"`
+}
+
+// SyncResult counts what a sync of one connector did
+type SyncResult struct {
+	Connector string `json:"connector"`
+	// Devices is how many devices the MDM reported, and Linked how many of
+	// them are linked to registered devices
+	Devices int    `json:"devices"`
+	Linked  int    `json:"linked"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Service syncs compliance from connectors into the device registry
+type Service struct {
+	config     Config
+	connectors map[string]Connector
+	devices    Devices
+	store      store.Store
+	logger     interfaces.Logger
+	metrics    interfaces.MetricsCollector
+	now        func() time.Time
+}
+
+// NewService creates a service syncing connectors; metrics may be nil
+func NewService(cfg Config, connectors []Connector, devices Devices, s store.Store, logger interfaces.Logger, metrics interfaces.MetricsCollector) *Service {
+	if cfg.Interval <= 0 {
+		cfg.Interval = 15 * time.Minute
+	}
+	byName := make(map[string]Connector, len(connectors))
+	for _, c := range connectors {
+		byName[c.Name()] = c
+	}
+	return &Service{config: cfg, connectors: byName, devices: devices, store: s, logger: logger, metrics: metrics, now: time.Now}
+}
+
+// Start syncs every Interval until ctx is cancelled. Only one replica runs
+// each sync.
+func (s *Service) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(s.config.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				n, _, err := s.store.Incr(ctx, syncLease, s.config.Interval*9/10)
+				if err != nil {
+					s.logger.Warn("Failed to acquire MDM sync lease", "error", err)
+					continue
+				}
+				if n == 1 {
+					s.SyncAll(ctx)
+				}
+			}
+		}
+	}()
+}
+
+// SyncAll syncs every connector; a connector failing does not stop the
+// others
+func (s *Service) SyncAll(ctx context.Context) []SyncResult {
+	names := make([]string, 0, len(s.connectors))
+	for name := range s.connectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	results := make([]SyncResult, 0, len(names))
+	for _, name := range names {
+		result, err := s.Sync(ctx, name)
+		if err != nil {
+			s.logger.Warn("MDM sync failed", "connector", name, "error", err)
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// Sync records the compliance the connector reports on every linked
+// device. Linked devices the MDM no longer reports become "unknown", and
+// links to devices since deleted are removed.
+func (s *Service) Sync(ctx context.Context, name string) (SyncResult, error) {
+	result := SyncResult{Connector: name}
+	connector, ok := s.connectors[name]
+	if !ok {
+		return result, ErrUnknownConnector
+	}
+	records, err := connector.Devices(ctx)
+	if err != nil {
+		s.count("mdm_sync_errors_total", name)
+		return result, err
+	}
+	result.Devices = len(records)
+	reported := make(map[string]Record, len(records))
+	for _, record := range records {
+		reported[record.ID] = record
+	}
+
+	links, err := s.links(ctx, name)
+	if err != nil {
+		return result, err
+	}
+	var errs []error
+	for _, link := range links {
+		status, state := device.ComplianceUnknown, ""
+		if record, ok := reported[link.MDMID]; ok {
+			result.Linked++
+			status, state = device.ComplianceNoncompliant, record.State
+			if record.Compliant {
+				status = device.ComplianceCompliant
+			}
+		}
+		_, err := s.devices.SetCompliance(ctx, link.DeviceID, name, status)
+		if errors.Is(err, device.ErrNotFound) {
+			s.logger.Info("Removing MDM link to deleted device", "connector", name, "mdm_id", link.MDMID, "device_id", link.DeviceID)
+			errs = append(errs, s.store.Delete(ctx, linkKey(name, link.MDMID)))
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		now := s.now().UTC()
+		link.SyncedAt, link.State = &now, state
+		errs = append(errs, s.saveLink(ctx, link))
+	}
+	s.count("mdm_syncs_total", name)
+	return result, errors.Join(errs...)
+}
+
+// Link maps the connector's MDM device mdmID to the registered device
+// deviceID. The device's compliance is unknown until the next sync.
+func (s *Service) Link(ctx context.Context, name, mdmID, deviceID string) (*Link, error) {
+	if _, ok := s.connectors[name]; !ok {
+		return nil, ErrUnknownConnector
+	}
+	if mdmID == "" || deviceID == "" {
+		return nil, fmt.Errorf("%w: mdm_id and device_id are required", device.ErrInvalid)
+	}
+	if previous, err := s.link(ctx, name, mdmID); err == nil && previous.DeviceID != deviceID {
+		if _, err := s.devices.SetCompliance(ctx, previous.DeviceID, "", ""); err != nil && !errors.Is(err, device.ErrNotFound) {
+			return nil, err
+		}
+	} else if err != nil && !errors.Is(err, ErrNotLinked) {
+		return nil, err
+	}
+	if _, err := s.devices.SetCompliance(ctx, deviceID, name, device.ComplianceUnknown); err != nil {
+		return nil, err
+	}
+	link := Link{Connector: name, MDMID: mdmID, DeviceID: deviceID, LinkedAt: s.now().UTC()}
+	if err := s.saveLink(ctx, link); err != nil {
+		return nil, err
+	}
+	return &link, nil
+}
+
+// Unlink removes the link of the connector's MDM device mdmID, marking the
+// device unmanaged
+func (s *Service) Unlink(ctx context.Context, name, mdmID string) error {
+	link, err := s.link(ctx, name, mdmID)
+	if err != nil {
+		return err
+	}
+	if _, err := s.devices.SetCompliance(ctx, link.DeviceID, "", ""); err != nil && !errors.Is(err, device.ErrNotFound) {
+		return err
+	}
+	return s.store.Delete(ctx, linkKey(name, mdmID))
+}
+
+// Links returns every link, by connector and MDM device ID
+func (s *Service) Links(ctx context.Context) ([]Link, error) {
+	links, err := s.links(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(links, func(i, j int) bool {
+		a, b := links[i], links[j]
+		return a.Connector < b.Connector || (a.Connector == b.Connector && a.MDMID < b.MDMID)
+	})
+	return links, nil
+}
+
+// RegisterRoutes mounts link management and manual syncs on an admin route
+// group
+func (s *Service) RegisterRoutes(r gin.IRoutes) {
+	r.GET("/mdm/links", s.handleLinks)
+	r.PUT("/mdm/links/:connector/:mdmID", s.handleLink)
+	r.DELETE("/mdm/links/:connector/:mdmID", s.handleUnlink)
+	r.POST("/mdm/sync", s.handleSync)
+}
+
+func (s *Service) handleLinks(c *gin.Context) {
+	links, err := s.Links(c.Request.Context())
+	if err != nil {
+		s.respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"links": links})
+}
+
+func (s *Service) handleLink(c *gin.Context) {
+	var req struct {
+		DeviceID string `json:"device_id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": i18n.Message(c, "VALIDATION_ERROR"), "code": "VALIDATION_ERROR"})
+		return
+	}
+	link, err := s.Link(c.Request.Context(), c.Param("connector"), c.Param("mdmID"), req.DeviceID)
+	if err != nil {
+		s.respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, link)
+}
+
+func (s *Service) handleUnlink(c *gin.Context) {
+	if err := s.Unlink(c.Request.Context(), c.Param("connector"), c.Param("mdmID")); err != nil {
+		s.respondError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (s *Service) handleSync(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"results": s.SyncAll(c.Request.Context())})
+}
+
+func (s *Service) respondError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, device.ErrInvalid):
+		c.JSON(http.StatusBadRequest, gin.H{"error": i18n.Message(c, "VALIDATION_ERROR"), "code": "VALIDATION_ERROR"})
+	case errors.Is(err, ErrUnknownConnector), errors.Is(err, ErrNotLinked), errors.Is(err, device.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": i18n.Message(c, "RESOURCE_NOT_FOUND"), "code": "RESOURCE_NOT_FOUND"})
+	case errors.Is(err, device.ErrConflict):
+		c.JSON(http.StatusConflict, gin.H{"error": i18n.Message(c, "RESOURCE_CONFLICT"), "code": "RESOURCE_CONFLICT"})
+	default:
+		s.logger.Error("MDM request failed", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": i18n.Message(c, "INTERNAL_ERROR"), "code": "INTERNAL_ERROR"})
+	}
+}
+
+// links returns the links of connector name, or of every connector when
+// name is empty
+func (s *Service) links(ctx context.Context, name string) ([]Link, error) {
+	prefix := linkPrefix
+	if name != "" {
+		prefix += name + ":"
+	}
+	keys, err := s.store.Keys(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	links := make([]Link, 0, len(keys))
+	for _, key := range keys {
+		data, err := s.store.Get(ctx, key)
+		if errors.Is(err, store.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var link Link
+		if err := json.Unmarshal(data, &link); err != nil {
+			s.logger.Warn("Skipping unreadable MDM link", "key", key, "error", err)
+			continue
+		}
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+func (s *Service) link(ctx context.Context, name, mdmID string) (*Link, error) {
+	data, err := s.store.Get(ctx, linkKey(name, mdmID))
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, ErrNotLinked
+	}
+	if err != nil {
+		return nil, err
+	}
+	var link Link
+	if err := json.Unmarshal(data, &link); err != nil {
+		return nil, err
+	}
+	return &link, nil
+}
+
+func (s *Service) saveLink(ctx context.Context, link Link) error {
+	data, err := json.Marshal(link)
+	if err != nil {
+		return err
+	}
+	return s.store.Set(ctx, linkKey(link.Connector, link.MDMID), data, 0)
+}
+
+func (s *Service) count(name, connector string) {
+	if s.metrics != nil {
+		s.metrics.IncrementCounter(name, map[string]string{"connector": connector})
+	}
+}
+
+func linkKey(name, mdmID string) string {
+	return linkPrefix + name + ":" + mdmID
+}
@@ -0,0 +1,60 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lsendel/impl-zamaz/pkg/i18n"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+)
+
+// HeaderServiceMode is set to "read-only" on every response while degraded,
+// and to "maintenance" on the requests a kill switch refuses
+const HeaderServiceMode = "X-Service-Mode"
+
+// Degradation reports whether the service must refuse mutations, e.g.
+// store.FailStaticStore while the shared store is down
+type Degradation interface {
+	Degraded() bool
+}
+
+// ReadOnlyMiddleware refuses mutating requests with 503 SERVICE_DEGRADED
+// while d is degraded, so clients get a clear retryable error instead of a
+// failure deep inside a handler. Paths starting with an exempt prefix are
+// let through. Reads proceed and are served from local state.
+func ReadOnlyMiddleware(d Degradation, exempt []string, retryAfter int, logger interfaces.Logger, metrics interfaces.MetricsCollector) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !d.Degraded() {
+			c.Next()
+			return
+		}
+		c.Header(HeaderServiceMode, "read-only")
+
+		method := c.Request.Method
+		if method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions {
+			c.Next()
+			return
+		}
+		for _, prefix := range exempt {
+			if strings.HasPrefix(c.Request.URL.Path, prefix) {
+				c.Next()
+				return
+			}
+		}
+
+		logger.Warn("Mutation refused in read-only mode", "method", method, "path", c.Request.URL.Path)
+		if metrics != nil {
+			metrics.IncrementCounter("degraded_rejections_total", map[string]string{"method": method})
+		}
+		if retryAfter > 0 {
+			c.Header(HeaderRetryAfter, strconv.Itoa(retryAfter))
+		}
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+			"error": i18n.Message(c, "SERVICE_DEGRADED"),
+			"code":  "SERVICE_DEGRADED",
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lsendel/impl-zamaz/pkg/admin"
+	"github.com/lsendel/impl-zamaz/pkg/i18n"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+)
+
+// KillSwitch turns off the routes under Routes, or every route without any
+type KillSwitch struct {
+	Name       string
+	Routes     []string
+	Message    string
+	RetryAfter time.Duration
+}
+
+// KillSwitchSource loads the switches turned on
+type KillSwitchSource func(ctx context.Context) ([]KillSwitch, error)
+
+// AdminKillSwitches reads the kill switches from m
+func AdminKillSwitches(m *admin.Manager) KillSwitchSource {
+	return func(ctx context.Context) ([]KillSwitch, error) {
+		resources, err := m.List(ctx, admin.KillSwitchKind().Name)
+		if err != nil {
+			return nil, err
+		}
+		switches := make([]KillSwitch, 0, len(resources))
+		for _, res := range resources {
+			var spec admin.KillSwitchSpec
+			if err := json.Unmarshal(res.Spec, &spec); err != nil {
+				return nil, err
+			}
+			switches = append(switches, KillSwitch{
+				Name:       res.Name,
+				Routes:     spec.Routes,
+				Message:    spec.Message,
+				RetryAfter: time.Duration(spec.RetryAfter) * time.Second,
+			})
+		}
+		return switches, nil
+	}
+}
+
+// KillSwitches answers the requests to switched off routes with 503
+// MAINTENANCE, so operators can take the service or parts of it out of use
+// during maintenance or an incident without a restart. Switches are
+// reloaded from a source at most every cacheTTL, and the last ones loaded
+// are kept while it fails. Paths starting with an exempt prefix, such as
+// health checks and the administration routes turning switches off, are
+// never switched off.
+type KillSwitches struct {
+	source   KillSwitchSource
+	exempt   []string
+	cacheTTL time.Duration
+	logger   interfaces.Logger
+	metrics  interfaces.MetricsCollector
+	now      func() time.Time
+
+	mu       sync.Mutex
+	switches []KillSwitch
+	loadedAt time.Time
+}
+
+// NewKillSwitches creates kill switches over source; cacheTTL defaults to
+// 10s and metrics may be nil
+func NewKillSwitches(source KillSwitchSource, exempt []string, cacheTTL time.Duration, logger interfaces.Logger, metrics interfaces.MetricsCollector) *KillSwitches {
+	if cacheTTL <= 0 {
+		cacheTTL = 10 * time.Second
+	}
+	return &KillSwitches{source: source, exempt: exempt, cacheTTL: cacheTTL, logger: logger, metrics: metrics, now: time.Now}
+}
+
+// load returns the switches, reloading them when the cache expired
+func (k *KillSwitches) load(ctx context.Context) []KillSwitch {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if !k.loadedAt.IsZero() && k.now().Sub(k.loadedAt) < k.cacheTTL {
+		return k.switches
+	}
+	switches, err := k.source(ctx)
+	if err != nil {
+		k.logger.Warn("Failed to load kill switches", "error", err)
+		return k.switches
+	}
+	k.switches, k.loadedAt = switches, k.now()
+	return switches
+}
+
+// Middleware rejects the requests to switched off routes
+func (k *KillSwitches) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switches := k.load(c.Request.Context())
+		if len(switches) == 0 {
+			return
+		}
+		path := c.Request.URL.Path
+		if underRoutes(k.exempt, path) {
+			return
+		}
+		for _, kill := range switches {
+			if len(kill.Routes) == 0 || underRoutes(kill.Routes, path) {
+				k.reject(c, kill)
+				return
+			}
+		}
+	}
+}
+
+// reject answers a request to a route kill switched off
+func (k *KillSwitches) reject(c *gin.Context, kill KillSwitch) {
+	k.logger.Debug("Request refused by kill switch", "switch", kill.Name, "method", c.Request.Method, "path", c.Request.URL.Path)
+	if k.metrics != nil {
+		k.metrics.IncrementCounter("kill_switch_rejections_total", map[string]string{"switch": kill.Name})
+	}
+	c.Header(HeaderServiceMode, "maintenance")
+	body := gin.H{
+		"error":  i18n.Message(c, "MAINTENANCE"),
+		"code":   "MAINTENANCE",
+		"switch": kill.Name,
+	}
+	if kill.Message != "" {
+		body["message"] = kill.Message
+	}
+	if seconds := int(kill.RetryAfter / time.Second); seconds > 0 {
+		c.Header(HeaderRetryAfter, strconv.Itoa(seconds))
+		body["retry_after"] = seconds
+	}
+	c.AbortWithStatusJSON(http.StatusServiceUnavailable, body)
+}
@@ -0,0 +1,214 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lsendel/impl-zamaz/pkg/admin"
+	"github.com/lsendel/impl-zamaz/pkg/i18n"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+)
+
+// Network rule actions
+const (
+	NetworkAllow = "allow"
+	NetworkDeny  = "deny"
+)
+
+// NetworkRule allows or denies the client addresses in Networks on the
+// routes under Routes, or on every route without any
+type NetworkRule struct {
+	Name     string
+	Action   string
+	Networks []*net.IPNet
+	Routes   []string
+}
+
+// NetworkRuleSource loads the configured rules
+type NetworkRuleSource func(ctx context.Context) ([]NetworkRule, error)
+
+// ParseNetworks parses CIDR ranges and single addresses
+func ParseNetworks(values []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", value)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR range %q", value)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// AdminNetworkRules reads the network rules from m
+func AdminNetworkRules(m *admin.Manager) NetworkRuleSource {
+	return func(ctx context.Context) ([]NetworkRule, error) {
+		resources, err := m.List(ctx, admin.NetworkRuleKind().Name)
+		if err != nil {
+			return nil, err
+		}
+		rules := make([]NetworkRule, 0, len(resources))
+		for _, res := range resources {
+			var spec admin.NetworkRuleSpec
+			if err := json.Unmarshal(res.Spec, &spec); err != nil {
+				return nil, err
+			}
+			networks, err := ParseNetworks(spec.CIDRs)
+			if err != nil {
+				return nil, fmt.Errorf("network rule %s: %w", res.Name, err)
+			}
+			rules = append(rules, NetworkRule{Name: res.Name, Action: spec.Action, Networks: networks, Routes: spec.Routes})
+		}
+		return rules, nil
+	}
+}
+
+// NetworkACL allows or denies requests by client address with rules from a
+// source, which is reloaded at most every cacheTTL so changes apply on every
+// replica without a restart. A deny rule matching the client wins; where any
+// allow rule covers the route, the client must match one of them. The last
+// rules loaded are kept while the source fails.
+//
+// The client address is the peer's, unless the peer is a trusted proxy: then
+// X-Forwarded-For is read from the right, skipping the trusted proxies, so
+// clients cannot pick their address by sending the header themselves.
+type NetworkACL struct {
+	source         NetworkRuleSource
+	trustedProxies []*net.IPNet
+	cacheTTL       time.Duration
+	logger         interfaces.Logger
+	metrics        interfaces.MetricsCollector
+	now            func() time.Time
+
+	mu       sync.Mutex
+	rules    []NetworkRule
+	loadedAt time.Time
+}
+
+// NewNetworkACL creates an ACL over source; cacheTTL defaults to 10s and
+// metrics may be nil
+func NewNetworkACL(source NetworkRuleSource, trustedProxies []*net.IPNet, cacheTTL time.Duration, logger interfaces.Logger, metrics interfaces.MetricsCollector) *NetworkACL {
+	if cacheTTL <= 0 {
+		cacheTTL = 10 * time.Second
+	}
+	return &NetworkACL{source: source, trustedProxies: trustedProxies, cacheTTL: cacheTTL, logger: logger, metrics: metrics, now: time.Now}
+}
+
+// load returns the rules, reloading them when the cache expired
+func (a *NetworkACL) load(ctx context.Context) []NetworkRule {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.loadedAt.IsZero() && a.now().Sub(a.loadedAt) < a.cacheTTL {
+		return a.rules
+	}
+	rules, err := a.source(ctx)
+	if err != nil {
+		a.logger.Warn("Failed to load network rules", "error", err)
+		return a.rules
+	}
+	a.rules, a.loadedAt = rules, a.now()
+	return rules
+}
+
+// Middleware rejects requests the rules do not allow with 403
+func (a *NetworkACL) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		rules := a.load(c.Request.Context())
+		if len(rules) == 0 {
+			return
+		}
+		ip := ForwardedClientIP(c.Request, a.trustedProxies)
+		path := c.Request.URL.Path
+
+		allowListed, allowed := false, false
+		for _, rule := range rules {
+			if len(rule.Routes) > 0 && !underRoutes(rule.Routes, path) {
+				continue
+			}
+			matched := ip != nil && containsIP(rule.Networks, ip)
+			switch rule.Action {
+			case NetworkDeny:
+				if matched {
+					a.block(c, ip, rule.Name)
+					return
+				}
+			case NetworkAllow:
+				allowListed = true
+				allowed = allowed || matched
+			}
+		}
+		if allowListed && !allowed {
+			a.block(c, ip, "")
+		}
+	}
+}
+
+// block rejects a request denied by rule, or missing from the allow rules
+// when rule is empty
+func (a *NetworkACL) block(c *gin.Context, ip net.IP, rule string) {
+	a.logger.Warn("Request blocked by network rules", "ip", ip.String(), "rule", rule, "path", c.Request.URL.Path)
+	if a.metrics != nil {
+		a.metrics.IncrementCounter("network_acl_blocks_total", map[string]string{"rule": rule})
+	}
+	c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+		"error": i18n.Message(c, "SOURCE_BLOCKED"),
+		"code":  "SOURCE_BLOCKED",
+	})
+}
+
+// ForwardedClientIP returns the address of the client that sent r, believing
+// X-Forwarded-For only as far as it was appended by trustedProxies. It is
+// nil when the peer address cannot be parsed.
+func ForwardedClientIP(r *http.Request, trustedProxies []*net.IPNet) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !containsIP(trustedProxies, ip) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			// Nothing left of a malformed entry can be believed
+			break
+		}
+		ip = hop
+		if !containsIP(trustedProxies, hop) {
+			break
+		}
+	}
+	return ip
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,273 @@
+// Package middleware provides the Gin middleware chain for impl-zamaz
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lsendel/impl-zamaz/pkg/i18n"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+// Rate limit response headers
+const (
+	HeaderRateLimitLimit     = "X-RateLimit-Limit"
+	HeaderRateLimitRemaining = "X-RateLimit-Remaining"
+	HeaderRateLimitReset     = "X-RateLimit-Reset"
+	HeaderRetryAfter         = "Retry-After"
+)
+
+// Standard rate limit response headers, from the IETF RateLimit header
+// fields draft. Unlike X-RateLimit-Reset, RateLimit-Reset is in seconds from
+// now.
+const (
+	HeaderStdRateLimitLimit     = "RateLimit-Limit"
+	HeaderStdRateLimitRemaining = "RateLimit-Remaining"
+	HeaderStdRateLimitReset     = "RateLimit-Reset"
+	HeaderStdRateLimitPolicy    = "RateLimit-Policy"
+)
+
+// RateLimitConfig configures the rate limiting middleware
+type RateLimitConfig struct {
+	RequestsPerMinute int
+	// RetryAfter is the minimum back-off advertised to rejected clients
+	RetryAfter time.Duration
+	// KeyFunc identifies the caller; defaults to the client IP
+	KeyFunc func(c *gin.Context) string
+	// Limiter overrides the default in-memory limiter
+	Limiter Limiter
+}
+
+// RateLimitDecision is the outcome of a single limiter check
+type RateLimitDecision struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	ResetAt    time.Time
+	RetryAfter time.Duration
+	// Delay is how long an allowed request must wait to keep an even rate
+	Delay time.Duration
+	// Window is the span the limit applies to, advertised in
+	// RateLimit-Policy when set
+	Window time.Duration
+}
+
+// Limiter decides whether a request identified by key may proceed
+type Limiter interface {
+	Allow(ctx context.Context, key string) (RateLimitDecision, error)
+}
+
+// RateLimitMiddleware enforces request limits and always reports the limiter
+// state through the X-RateLimit-* headers so clients can back off adaptively
+func RateLimitMiddleware(cfg RateLimitConfig, logger interfaces.Logger, metrics interfaces.MetricsCollector) gin.HandlerFunc {
+	if cfg.RequestsPerMinute <= 0 {
+		cfg.RequestsPerMinute = 100
+	}
+	if cfg.KeyFunc == nil {
+		cfg.KeyFunc = func(c *gin.Context) string { return c.ClientIP() }
+	}
+	limiter := cfg.Limiter
+	if limiter == nil {
+		limiter = NewFixedWindowLimiter(cfg.RequestsPerMinute, time.Minute)
+	}
+
+	return func(c *gin.Context) {
+		key := cfg.KeyFunc(c)
+		decision, err := limiter.Allow(c.Request.Context(), key)
+		if err != nil {
+			// Fail open: an unavailable limiter must not take the API down
+			logger.Warn("Rate limiter unavailable, allowing request", "error", err, "key", key)
+			c.Next()
+			return
+		}
+
+		if !decision.Allowed && decision.RetryAfter < cfg.RetryAfter {
+			decision.RetryAfter = cfg.RetryAfter
+		}
+		if !decision.Allowed {
+			logger.Warn("Rate limit exceeded", "key", key, "path", c.FullPath(), "limit", decision.Limit)
+			if metrics != nil {
+				metrics.IncrementCounter("rate_limit_exceeded_total", map[string]string{"path": c.FullPath()})
+			}
+		}
+		if !enforceDecision(c, decision) {
+			return
+		}
+		c.Next()
+	}
+}
+
+// enforceDecision sends the rate limit headers, then rejects the request or
+// waits out its delay. It reports whether the request may proceed.
+func enforceDecision(c *gin.Context, decision RateLimitDecision) bool {
+	SetRateLimitHeaders(c, decision)
+	if !decision.Allowed {
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+			"error":       i18n.Message(c, "RATE_LIMIT_EXCEEDED"),
+			"code":        "RATE_LIMIT_EXCEEDED",
+			"retry_after": int(decision.RetryAfter.Seconds()),
+		})
+		return false
+	}
+	if decision.Delay > 0 {
+		timer := time.NewTimer(decision.Delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-c.Request.Context().Done():
+			c.Abort()
+			return false
+		}
+	}
+	return true
+}
+
+// SetRateLimitHeaders writes the rate limit headers for a decision, both the
+// X-RateLimit-* ones and the standard RateLimit-* ones. X-RateLimit-Reset is
+// the Unix time in seconds at which the window resets; Retry-After is only
+// sent when the request was rejected.
+func SetRateLimitHeaders(c *gin.Context, d RateLimitDecision) {
+	remaining := d.Remaining
+	if remaining < 0 {
+		remaining = 0
+	}
+	c.Header(HeaderRateLimitLimit, strconv.Itoa(d.Limit))
+	c.Header(HeaderRateLimitRemaining, strconv.Itoa(remaining))
+	c.Header(HeaderRateLimitReset, strconv.FormatInt(d.ResetAt.Unix(), 10))
+	c.Header(HeaderStdRateLimitLimit, strconv.Itoa(d.Limit))
+	c.Header(HeaderStdRateLimitRemaining, strconv.Itoa(remaining))
+	reset := time.Until(d.ResetAt)
+	if reset < 0 {
+		reset = 0
+	}
+	c.Header(HeaderStdRateLimitReset, strconv.Itoa(int((reset+time.Second-1)/time.Second)))
+	if d.Window > 0 {
+		c.Header(HeaderStdRateLimitPolicy, fmt.Sprintf("%d;w=%d", d.Limit, int(d.Window.Seconds())))
+	}
+	if !d.Allowed {
+		c.Header(HeaderRetryAfter, strconv.Itoa(retryAfterSeconds(d.RetryAfter)))
+	}
+}
+
+// retryAfterSeconds rounds up so clients never retry before the window opens
+func retryAfterSeconds(d time.Duration) int {
+	secs := int((d + time.Second - 1) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	return secs
+}
+
+// FixedWindowLimiter is a per-instance fixed window counter
+type FixedWindowLimiter struct {
+	limit     int
+	window    time.Duration
+	mu        sync.Mutex
+	windows   map[string]*rateWindow
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+// NewFixedWindowLimiter creates a limiter allowing limit requests per window
+func NewFixedWindowLimiter(limit int, window time.Duration) *FixedWindowLimiter {
+	return &FixedWindowLimiter{
+		limit:   limit,
+		window:  window,
+		windows: make(map[string]*rateWindow),
+		now:     time.Now,
+	}
+}
+
+// Allow implements Limiter
+func (l *FixedWindowLimiter) Allow(_ context.Context, key string) (RateLimitDecision, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	w, exists := l.windows[key]
+	if !exists || now.Sub(w.start) >= l.window {
+		w = &rateWindow{start: now}
+		l.windows[key] = w
+		if now.Sub(l.lastSweep) >= l.window {
+			l.evictExpired(now)
+			l.lastSweep = now
+		}
+	}
+
+	resetAt := w.start.Add(l.window)
+	decision := RateLimitDecision{
+		Limit:   l.limit,
+		Window:  l.window,
+		ResetAt: resetAt,
+	}
+
+	if w.count >= l.limit {
+		decision.RetryAfter = resetAt.Sub(now)
+		return decision, nil
+	}
+
+	w.count++
+	decision.Allowed = true
+	decision.Remaining = l.limit - w.count
+	return decision, nil
+}
+
+// evictExpired drops windows that can no longer affect a decision
+func (l *FixedWindowLimiter) evictExpired(now time.Time) {
+	for key, w := range l.windows {
+		if now.Sub(w.start) >= l.window {
+			delete(l.windows, key)
+		}
+	}
+}
+
+// StoreLimiter is a fixed window limiter whose counters live in a shared
+// store, so every replica enforces the same budget for a caller
+type StoreLimiter struct {
+	store  store.Store
+	prefix string
+	limit  int
+	window time.Duration
+}
+
+// NewStoreLimiter creates a limiter allowing limit requests per window
+func NewStoreLimiter(s store.Store, limit int, window time.Duration) *StoreLimiter {
+	return &StoreLimiter{
+		store:  s,
+		prefix: "ratelimit:",
+		limit:  limit,
+		window: window,
+	}
+}
+
+// Allow implements Limiter
+func (l *StoreLimiter) Allow(ctx context.Context, key string) (RateLimitDecision, error) {
+	count, ttl, err := l.store.Incr(ctx, l.prefix+key, l.window)
+	if err != nil {
+		return RateLimitDecision{}, err
+	}
+
+	decision := RateLimitDecision{
+		Allowed:   count <= int64(l.limit),
+		Limit:     l.limit,
+		Remaining: l.limit - int(count),
+		ResetAt:   time.Now().Add(ttl),
+		Window:    l.window,
+	}
+	if !decision.Allowed {
+		decision.RetryAfter = ttl
+	}
+	return decision, nil
+}
@@ -0,0 +1,267 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+// Rate limiting algorithms selectable per LimitDefinition
+const (
+	// AlgorithmFixedWindow counts requests in consecutive windows
+	AlgorithmFixedWindow = "fixed-window"
+	// AlgorithmTokenBucket allows Burst requests at once and refills at
+	// Limit per Window; use it where bursts must be strictly bounded
+	AlgorithmTokenBucket = "token-bucket"
+	// AlgorithmSlidingWindowLog allows Limit requests in any Window-long
+	// span, so there is no double burst at window boundaries
+	AlgorithmSlidingWindowLog = "sliding-window-log"
+	// AlgorithmLeakyBucket spaces requests evenly at Limit per Window,
+	// delaying up to Burst queued requests instead of rejecting them
+	AlgorithmLeakyBucket = "leaky-bucket"
+)
+
+// casAttempts bounds optimistic retries when replicas update the same key
+const casAttempts = 5
+
+// ErrLimiterContention is returned when a limiter state could not be updated
+// because other requests kept changing it
+var ErrLimiterContention = errors.New("rate limiter state contended")
+
+// LimitDefinition describes one rate limit
+type LimitDefinition struct {
+	// Name namespaces the limiter's keys, e.g. "login"
+	Name      string
+	Algorithm string
+	Limit     int
+	Window    time.Duration
+	// Burst is the token bucket capacity or the leaky bucket queue length;
+	// zero means Limit. The window algorithms ignore it.
+	Burst int
+}
+
+// NewLimiter creates the limiter for def with its state kept in s, so every
+// replica enforces the same budget. On a store that runs scripts, such as
+// Redis, each request updates the state in one atomic round trip.
+func NewLimiter(s store.Store, def LimitDefinition) (Limiter, error) {
+	if def.Limit <= 0 || def.Window <= 0 {
+		return nil, fmt.Errorf("rate limit %q needs a positive limit and window", def.Name)
+	}
+	if def.Burst < 0 {
+		return nil, fmt.Errorf("rate limit %q has a negative burst", def.Name)
+	}
+	if def.Burst == 0 {
+		def.Burst = def.Limit
+	}
+	prefix := "ratelimit:"
+	if def.Name != "" {
+		prefix += def.Name + ":"
+	}
+	scripts, _ := store.ScriptsOf(s)
+
+	switch def.Algorithm {
+	case "", AlgorithmFixedWindow:
+		// Incr is atomic already
+		l := NewStoreLimiter(s, def.Limit, def.Window)
+		l.prefix = prefix
+		return l, nil
+	case AlgorithmTokenBucket:
+		return &TokenBucketLimiter{store: s, scripts: scripts, prefix: prefix + "tb:", def: def, now: time.Now}, nil
+	case AlgorithmSlidingWindowLog:
+		return &SlidingWindowLogLimiter{store: s, scripts: scripts, prefix: prefix + "swl:", def: def, now: time.Now}, nil
+	case AlgorithmLeakyBucket:
+		return &LeakyBucketLimiter{store: s, scripts: scripts, prefix: prefix + "lb:", def: def, now: time.Now}, nil
+	default:
+		return nil, fmt.Errorf("rate limit %q has unknown algorithm %q", def.Name, def.Algorithm)
+	}
+}
+
+// update applies fn to the state at key with compare-and-swap retries. fn
+// returns the new state, or nil to leave the key unchanged.
+func update(ctx context.Context, s store.Store, key string, ttl time.Duration, fn func(old []byte) []byte) error {
+	for i := 0; i < casAttempts; i++ {
+		old, err := s.Get(ctx, key)
+		if errors.Is(err, store.ErrNotFound) {
+			old = nil
+		} else if err != nil {
+			return err
+		}
+		next := fn(old)
+		if next == nil {
+			return nil
+		}
+		swapped, err := s.CompareAndSwap(ctx, key, old, next, ttl)
+		if err != nil {
+			return err
+		}
+		if swapped {
+			return nil
+		}
+	}
+	return ErrLimiterContention
+}
+
+// TokenBucketLimiter implements AlgorithmTokenBucket. The state is the token
+// count and the time it was last refilled.
+type TokenBucketLimiter struct {
+	store store.Store
+	// scripts, when set, updates the state instead of swaps
+	scripts store.Scripter
+	prefix  string
+	def     LimitDefinition
+	now     func() time.Time
+}
+
+// Allow implements Limiter
+func (l *TokenBucketLimiter) Allow(ctx context.Context, key string) (RateLimitDecision, error) {
+	capacity := float64(l.def.Burst)
+	perToken := l.def.Window / time.Duration(l.def.Limit)
+	ttl := time.Duration(capacity)*perToken + time.Second
+	if l.scripts != nil {
+		return l.allowScript(ctx, key, perToken, ttl)
+	}
+	var decision RateLimitDecision
+
+	err := update(ctx, l.store, l.prefix+key, ttl, func(old []byte) []byte {
+		now := l.now()
+		tokens, last := capacity, now
+		if old != nil {
+			if t, at, ok := parseState(old); ok {
+				tokens, last = t, time.Unix(0, at)
+			}
+		}
+		if elapsed := now.Sub(last); elapsed > 0 {
+			tokens = math.Min(capacity, tokens+float64(elapsed)/float64(perToken))
+		}
+
+		decision = RateLimitDecision{Limit: l.def.Burst, Window: l.def.Window}
+		if tokens >= 1 {
+			tokens--
+			decision.Allowed = true
+		} else {
+			decision.RetryAfter = time.Duration((1 - tokens) * float64(perToken))
+		}
+		decision.Remaining = int(tokens)
+		decision.ResetAt = now.Add(time.Duration((capacity - tokens) * float64(perToken)))
+		return formatState(tokens, now.UnixNano())
+	})
+	return decision, err
+}
+
+// SlidingWindowLogLimiter implements AlgorithmSlidingWindowLog. The state is
+// the timestamps of the accepted requests still inside the window.
+type SlidingWindowLogLimiter struct {
+	store store.Store
+	// scripts, when set, updates the state instead of swaps
+	scripts store.Scripter
+	prefix  string
+	def     LimitDefinition
+	now     func() time.Time
+}
+
+// Allow implements Limiter
+func (l *SlidingWindowLogLimiter) Allow(ctx context.Context, key string) (RateLimitDecision, error) {
+	if l.scripts != nil {
+		return l.allowScript(ctx, key)
+	}
+	var decision RateLimitDecision
+
+	err := update(ctx, l.store, l.prefix+key, l.def.Window, func(old []byte) []byte {
+		now := l.now()
+		cutoff := now.Add(-l.def.Window).UnixNano()
+		log := make([]int64, 0, l.def.Limit)
+		for _, field := range strings.Split(string(old), ",") {
+			if ts, err := strconv.ParseInt(field, 36, 64); err == nil && ts > cutoff {
+				log = append(log, ts)
+			}
+		}
+
+		decision = RateLimitDecision{Limit: l.def.Limit, Window: l.def.Window, ResetAt: now.Add(l.def.Window)}
+		if len(log) > 0 {
+			decision.ResetAt = time.Unix(0, log[0]).Add(l.def.Window)
+		}
+		if len(log) >= l.def.Limit {
+			decision.RetryAfter = decision.ResetAt.Sub(now)
+			return nil
+		}
+		log = append(log, now.UnixNano())
+		decision.Allowed = true
+		decision.Remaining = l.def.Limit - len(log)
+
+		fields := make([]string, len(log))
+		for i, ts := range log {
+			fields[i] = strconv.FormatInt(ts, 36)
+		}
+		return []byte(strings.Join(fields, ","))
+	})
+	return decision, err
+}
+
+// LeakyBucketLimiter implements AlgorithmLeakyBucket as a queue: the state
+// is the time the queue drains, and each request is scheduled one interval
+// after the previous one. A request that would wait longer than Burst
+// intervals is rejected; the others are allowed with a Delay.
+type LeakyBucketLimiter struct {
+	store store.Store
+	// scripts, when set, updates the state instead of swaps
+	scripts store.Scripter
+	prefix  string
+	def     LimitDefinition
+	now     func() time.Time
+}
+
+// Allow implements Limiter
+func (l *LeakyBucketLimiter) Allow(ctx context.Context, key string) (RateLimitDecision, error) {
+	interval := l.def.Window / time.Duration(l.def.Limit)
+	maxDelay := time.Duration(l.def.Burst) * interval
+	ttl := maxDelay + interval + time.Second
+	if l.scripts != nil {
+		return l.allowScript(ctx, key, interval, maxDelay, ttl)
+	}
+	var decision RateLimitDecision
+
+	err := update(ctx, l.store, l.prefix+key, ttl, func(old []byte) []byte {
+		now := l.now()
+		drainAt := now
+		if old != nil {
+			if _, at, ok := parseState(old); ok && time.Unix(0, at).After(now) {
+				drainAt = time.Unix(0, at)
+			}
+		}
+
+		delay := drainAt.Sub(now)
+		decision = RateLimitDecision{Limit: l.def.Burst, Window: l.def.Window, ResetAt: drainAt}
+		if delay > maxDelay {
+			decision.RetryAfter = delay - maxDelay
+			return nil
+		}
+		drainAt = drainAt.Add(interval)
+		decision.Allowed = true
+		decision.Delay = delay
+		decision.Remaining = int((maxDelay - delay) / interval)
+		decision.ResetAt = drainAt
+		return formatState(0, drainAt.UnixNano())
+	})
+	return decision, err
+}
+
+// formatState encodes a bucket level and a timestamp
+func formatState(level float64, at int64) []byte {
+	return []byte(strconv.FormatFloat(level, 'f', 6, 64) + "|" + strconv.FormatInt(at, 10))
+}
+
+func parseState(data []byte) (float64, int64, bool) {
+	level, at, ok := strings.Cut(string(data), "|")
+	if !ok {
+		return 0, 0, false
+	}
+	l, err1 := strconv.ParseFloat(level, 64)
+	a, err2 := strconv.ParseInt(at, 10, 64)
+	return l, a, err1 == nil && err2 == nil
+}
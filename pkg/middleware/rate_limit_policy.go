@@ -0,0 +1,251 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lsendel/impl-zamaz/pkg/admin"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+// rateLimitPolicyKey holds the name of the policy a request was counted
+// against, so running the middleware again after authentication does not
+// count it twice
+const rateLimitPolicyKey = "rate_limit_policy"
+
+// RateLimitPolicy limits the requests it matches, on top of the global
+// limit. Users, APIKeys and Roles match the authenticated caller by user ID,
+// API key ID or any of its roles; Routes match path prefixes such as
+// /api/v1/auth/login. A policy matches the requests meeting every selector
+// it sets, so one without selectors matches all of them.
+type RateLimitPolicy struct {
+	Name    string
+	Users   []string
+	APIKeys []string
+	Roles   []string
+	Routes  []string
+	// Priority picks among the matching policies, highest first; ties go
+	// to the most specific, a user before an API key, a role and a route
+	Priority int
+	Limit    LimitDefinition
+}
+
+// RateLimitPolicySource loads the configured policies
+type RateLimitPolicySource func(ctx context.Context) ([]RateLimitPolicy, error)
+
+// AdminRateLimitPolicies reads the rate limit policies from m
+func AdminRateLimitPolicies(m *admin.Manager) RateLimitPolicySource {
+	return func(ctx context.Context) ([]RateLimitPolicy, error) {
+		resources, err := m.List(ctx, admin.RateLimitPolicyKind().Name)
+		if err != nil {
+			return nil, err
+		}
+		policies := make([]RateLimitPolicy, 0, len(resources))
+		for _, res := range resources {
+			var spec admin.RateLimitPolicySpec
+			if err := json.Unmarshal(res.Spec, &spec); err != nil {
+				return nil, err
+			}
+			window := time.Duration(spec.Window) * time.Second
+			if window == 0 {
+				window = time.Minute
+			}
+			policies = append(policies, RateLimitPolicy{
+				Name:     res.Name,
+				Users:    spec.Users,
+				APIKeys:  spec.APIKeys,
+				Roles:    spec.Roles,
+				Routes:   spec.Routes,
+				Priority: spec.Priority,
+				Limit: LimitDefinition{
+					Algorithm: spec.Algorithm,
+					Limit:     spec.Limit,
+					Window:    window,
+					Burst:     spec.Burst,
+				},
+			})
+		}
+		return policies, nil
+	}
+}
+
+// RateLimitPolicies enforces the policies from a source, which is reloaded
+// at most every cacheTTL so changes apply on every replica without a
+// restart. Each caller has its own budget under a policy: its user ID once
+// authenticated, else its client IP. The last policies loaded are kept
+// while the source fails.
+type RateLimitPolicies struct {
+	store    store.Store
+	source   RateLimitPolicySource
+	cacheTTL time.Duration
+	logger   interfaces.Logger
+	metrics  interfaces.MetricsCollector
+	now      func() time.Time
+
+	mu       sync.Mutex
+	policies []rateLimitPolicy
+	loaded   bool
+	loadedAt time.Time
+}
+
+// rateLimitPolicy is a policy with its limiter
+type rateLimitPolicy struct {
+	RateLimitPolicy
+	limiter Limiter
+}
+
+// NewRateLimitPolicies creates the policies from source, keeping their
+// state in s; cacheTTL defaults to 10s and metrics may be nil
+func NewRateLimitPolicies(s store.Store, source RateLimitPolicySource, cacheTTL time.Duration, logger interfaces.Logger, metrics interfaces.MetricsCollector) *RateLimitPolicies {
+	if cacheTTL <= 0 {
+		cacheTTL = 10 * time.Second
+	}
+	return &RateLimitPolicies{store: s, source: source, cacheTTL: cacheTTL, logger: logger, metrics: metrics, now: time.Now}
+}
+
+// load returns the policies, reloading them when the cache expired
+func (p *RateLimitPolicies) load(ctx context.Context) []rateLimitPolicy {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.loaded && p.now().Sub(p.loadedAt) < p.cacheTTL {
+		return p.policies
+	}
+	configured, err := p.source(ctx)
+	if err != nil {
+		p.logger.Warn("Failed to load rate limit policies", "error", err)
+		return p.policies
+	}
+
+	policies := make([]rateLimitPolicy, 0, len(configured))
+	for _, policy := range configured {
+		def := policy.Limit
+		def.Name = "policy:" + policy.Name
+		limiter, err := NewLimiter(p.store, def)
+		if err != nil {
+			p.logger.Warn("Skipping invalid rate limit policy", "policy", policy.Name, "error", err)
+			continue
+		}
+		policies = append(policies, rateLimitPolicy{RateLimitPolicy: policy, limiter: limiter})
+	}
+	p.policies, p.loaded, p.loadedAt = policies, true, p.now()
+	return policies
+}
+
+// Middleware counts each request against the policy matching it, if any.
+// Use it after the middleware identifying machine clients, and again after
+// authenticating users so the policies for them apply.
+func (p *RateLimitPolicies) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var user *interfaces.UserInfo
+		if value, ok := c.Get("user"); ok {
+			user, _ = value.(*interfaces.UserInfo)
+		}
+		policy := matchRateLimitPolicy(p.load(c.Request.Context()), user, c.Request.URL.Path)
+		if policy == nil {
+			return
+		}
+		if applied, _ := c.Get(rateLimitPolicyKey); applied == policy.Name {
+			return
+		}
+		c.Set(rateLimitPolicyKey, policy.Name)
+
+		key := "ip:" + c.ClientIP()
+		if user != nil && user.ID != "" {
+			key = "user:" + user.ID
+		}
+		decision, err := policy.limiter.Allow(c.Request.Context(), key)
+		if err != nil {
+			// Fail open like the global limit
+			p.logger.Warn("Rate limiter unavailable, allowing request", "error", err, "policy", policy.Name, "key", key)
+			return
+		}
+		if !decision.Allowed {
+			p.logger.Warn("Rate limit exceeded", "policy", policy.Name, "key", key, "path", c.FullPath(), "limit", decision.Limit)
+			if p.metrics != nil {
+				p.metrics.IncrementCounter("rate_limit_policy_exceeded_total", map[string]string{"policy": policy.Name})
+			}
+		}
+		enforceDecision(c, decision)
+	}
+}
+
+// matchRateLimitPolicy picks the policy applying to a request; user is nil
+// until the caller is authenticated
+func matchRateLimitPolicy(policies []rateLimitPolicy, user *interfaces.UserInfo, path string) *rateLimitPolicy {
+	var best *rateLimitPolicy
+	var bestRank, bestRoute int
+	for i := range policies {
+		policy := &policies[i]
+		rank, route, ok := policy.match(user, path)
+		if !ok {
+			continue
+		}
+		if best == nil || policy.Priority > best.Priority ||
+			(policy.Priority == best.Priority && (rank > bestRank || (rank == bestRank && route > bestRoute))) {
+			best, bestRank, bestRoute = policy, rank, route
+		}
+	}
+	return best
+}
+
+// match reports whether the policy matches a request, ranking it by the
+// selectors it sets and the length of the route it matched
+func (p *RateLimitPolicy) match(user *interfaces.UserInfo, path string) (rank, route int, ok bool) {
+	if len(p.Users)+len(p.APIKeys)+len(p.Roles) > 0 && user == nil {
+		return 0, 0, false
+	}
+	if len(p.Users) > 0 {
+		if !containsString(p.Users, user.ID) {
+			return 0, 0, false
+		}
+		rank |= 8
+	}
+	if len(p.APIKeys) > 0 {
+		id, isKey := strings.CutPrefix(user.ID, "apikey:")
+		if !isKey || !containsString(p.APIKeys, id) {
+			return 0, 0, false
+		}
+		rank |= 4
+	}
+	if len(p.Roles) > 0 {
+		matched := false
+		for _, role := range user.Roles {
+			if containsString(p.Roles, role) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return 0, 0, false
+		}
+		rank |= 2
+	}
+	if len(p.Routes) > 0 {
+		for _, prefix := range p.Routes {
+			trimmed := strings.TrimSuffix(prefix, "/")
+			if (path == trimmed || strings.HasPrefix(path, trimmed+"/")) && len(trimmed) >= route {
+				route = len(trimmed) + 1
+			}
+		}
+		if route == 0 {
+			return 0, 0, false
+		}
+		rank |= 1
+	}
+	return rank, route, true
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
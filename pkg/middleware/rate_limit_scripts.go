@@ -0,0 +1,197 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// The scripts below update limiter state in one atomic round trip on stores
+// that run scripts, such as Redis. They keep the state in the same format
+// as the compare-and-swap updates, so replicas using either agree.
+
+// tokenBucketScript refills and takes a token. ARGV: now in nanoseconds,
+// capacity, nanoseconds per token, ttl in milliseconds. It returns whether
+// a token was taken and the tokens left.
+const tokenBucketScript = `
+local now = tonumber(ARGV[1])
+local capacity = tonumber(ARGV[2])
+local per_token = tonumber(ARGV[3])
+local tokens, last = capacity, now
+local state = redis.call('GET', KEYS[1])
+if state then
+  local t, at = string.match(state, '^([^|]+)|(%-?%d+)$')
+  if t then tokens, last = tonumber(t), tonumber(at) end
+end
+if now > last then
+  tokens = math.min(capacity, tokens + (now - last) / per_token)
+end
+local allowed = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+end
+redis.call('SET', KEYS[1], string.format('%.6f|%.0f', tokens, now), 'PX', ARGV[4])
+return {allowed, string.format('%.6f', tokens)}
+`
+
+// slidingWindowLogScript drops the requests older than the window and logs
+// this one unless the log is full. ARGV: the cutoff in nanoseconds, the
+// limit, now in base 36 nanoseconds, ttl in milliseconds. It returns
+// whether the request was logged, the log length and its oldest entry.
+const slidingWindowLogScript = `
+local cutoff = tonumber(ARGV[1])
+local limit = tonumber(ARGV[2])
+local log = {}
+local state = redis.call('GET', KEYS[1])
+if state then
+  for field in string.gmatch(state, '[^,]+') do
+    local ts = tonumber(field, 36)
+    if ts and ts > cutoff then log[#log + 1] = field end
+  end
+end
+if #log >= limit then
+  return {0, #log, log[1]}
+end
+log[#log + 1] = ARGV[3]
+redis.call('SET', KEYS[1], table.concat(log, ','), 'PX', ARGV[4])
+return {1, #log, log[1]}
+`
+
+// leakyBucketScript schedules a request after the queue. ARGV: now, the
+// interval and the longest delay in nanoseconds, ttl in milliseconds. It
+// returns whether the request was queued and when the queue drains.
+const leakyBucketScript = `
+local now = tonumber(ARGV[1])
+local interval = tonumber(ARGV[2])
+local drain = now
+local state = redis.call('GET', KEYS[1])
+if state then
+  local at = tonumber(string.match(state, '|(%-?%d+)$'))
+  if at and at > now then drain = at end
+end
+if drain - now > tonumber(ARGV[3]) then
+  return {0, string.format('%.0f', drain)}
+end
+drain = drain + interval
+redis.call('SET', KEYS[1], string.format('0.000000|%.0f', drain), 'PX', ARGV[4])
+return {1, string.format('%.0f', drain)}
+`
+
+// allowScript implements Allow for TokenBucketLimiter with a script
+func (l *TokenBucketLimiter) allowScript(ctx context.Context, key string, perToken, ttl time.Duration) (RateLimitDecision, error) {
+	now := l.now()
+	reply, err := l.scripts.Eval(ctx, tokenBucketScript, []string{l.prefix + key},
+		strconv.FormatInt(now.UnixNano(), 10),
+		strconv.Itoa(l.def.Burst),
+		strconv.FormatInt(int64(perToken), 10),
+		strconv.FormatInt(ttl.Milliseconds(), 10))
+	if err != nil {
+		return RateLimitDecision{}, err
+	}
+	items, err := scriptReply(reply, 2)
+	if err != nil {
+		return RateLimitDecision{}, err
+	}
+	tokens, err := strconv.ParseFloat(string(replyBytes(items[1])), 64)
+	if err != nil {
+		return RateLimitDecision{}, fmt.Errorf("token bucket script: %w", err)
+	}
+
+	decision := RateLimitDecision{Allowed: replyInt(items[0]) == 1, Limit: l.def.Burst, Window: l.def.Window}
+	if !decision.Allowed {
+		decision.RetryAfter = time.Duration((1 - tokens) * float64(perToken))
+	}
+	decision.Remaining = int(tokens)
+	decision.ResetAt = now.Add(time.Duration((float64(l.def.Burst) - tokens) * float64(perToken)))
+	return decision, nil
+}
+
+// allowScript implements Allow for SlidingWindowLogLimiter with a script
+func (l *SlidingWindowLogLimiter) allowScript(ctx context.Context, key string) (RateLimitDecision, error) {
+	now := l.now()
+	reply, err := l.scripts.Eval(ctx, slidingWindowLogScript, []string{l.prefix + key},
+		strconv.FormatInt(now.Add(-l.def.Window).UnixNano(), 10),
+		strconv.Itoa(l.def.Limit),
+		strconv.FormatInt(now.UnixNano(), 36),
+		strconv.FormatInt(l.def.Window.Milliseconds(), 10))
+	if err != nil {
+		return RateLimitDecision{}, err
+	}
+	items, err := scriptReply(reply, 3)
+	if err != nil {
+		return RateLimitDecision{}, err
+	}
+
+	decision := RateLimitDecision{
+		Allowed: replyInt(items[0]) == 1,
+		Limit:   l.def.Limit,
+		Window:  l.def.Window,
+		ResetAt: now.Add(l.def.Window),
+	}
+	if oldest, err := strconv.ParseInt(string(replyBytes(items[2])), 36, 64); err == nil {
+		decision.ResetAt = time.Unix(0, oldest).Add(l.def.Window)
+	}
+	if decision.Allowed {
+		decision.Remaining = l.def.Limit - int(replyInt(items[1]))
+	} else {
+		decision.RetryAfter = decision.ResetAt.Sub(now)
+	}
+	return decision, nil
+}
+
+// allowScript implements Allow for LeakyBucketLimiter with a script
+func (l *LeakyBucketLimiter) allowScript(ctx context.Context, key string, interval, maxDelay, ttl time.Duration) (RateLimitDecision, error) {
+	now := l.now()
+	reply, err := l.scripts.Eval(ctx, leakyBucketScript, []string{l.prefix + key},
+		strconv.FormatInt(now.UnixNano(), 10),
+		strconv.FormatInt(int64(interval), 10),
+		strconv.FormatInt(int64(maxDelay), 10),
+		strconv.FormatInt(ttl.Milliseconds(), 10))
+	if err != nil {
+		return RateLimitDecision{}, err
+	}
+	items, err := scriptReply(reply, 2)
+	if err != nil {
+		return RateLimitDecision{}, err
+	}
+	at, err := strconv.ParseInt(string(replyBytes(items[1])), 10, 64)
+	if err != nil {
+		return RateLimitDecision{}, fmt.Errorf("leaky bucket script: %w", err)
+	}
+
+	drainAt := time.Unix(0, at)
+	decision := RateLimitDecision{Limit: l.def.Burst, Window: l.def.Window, ResetAt: drainAt}
+	if replyInt(items[0]) != 1 {
+		decision.RetryAfter = drainAt.Sub(now) - maxDelay
+		return decision, nil
+	}
+	delay := drainAt.Add(-interval).Sub(now)
+	if delay < 0 {
+		delay = 0
+	}
+	decision.Allowed = true
+	decision.Delay = delay
+	decision.Remaining = int((maxDelay - delay) / interval)
+	return decision, nil
+}
+
+// scriptReply checks a script returned a table of n items
+func scriptReply(reply interface{}, n int) ([]interface{}, error) {
+	items, ok := reply.([]interface{})
+	if !ok || len(items) != n {
+		return nil, fmt.Errorf("unexpected rate limit script reply %v", reply)
+	}
+	return items, nil
+}
+
+func replyInt(v interface{}) int64 {
+	n, _ := v.(int64)
+	return n
+}
+
+func replyBytes(v interface{}) []byte {
+	b, _ := v.([]byte)
+	return b
+}
@@ -0,0 +1,19 @@
+package middleware
+
+import (
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+)
+
+// StatusMetricsMiddleware counts responses by status class ("2xx" .. "5xx")
+// as http_responses_total, the basis of the availability SLO rules
+func StatusMetricsMiddleware(metrics interfaces.MetricsCollector) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+		class := strconv.Itoa(c.Writer.Status()/100) + "xx"
+		metrics.IncrementCounter("http_responses_total", map[string]string{"class": class})
+	}
+}
@@ -0,0 +1,268 @@
+// Package mockserver serves the documented impl-zamaz API with deterministic,
+// scenario-driven fixtures for consumer contract testing
+package mockserver
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lsendel/impl-zamaz/api"
+	"github.com/lsendel/impl-zamaz/pkg/i18n"
+)
+
+// ScenarioHeader selects a scenario for a single request
+const ScenarioHeader = "X-Mock-Scenario"
+
+// FixedTime is the timestamp used in every fixture so responses are reproducible
+var FixedTime = time.Date(2025, time.June, 22, 12, 0, 0, 0, time.UTC)
+
+// Scenario describes the behaviour of the mock for one client situation
+type Scenario struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	TrustScore  int    `json:"trust_score"`
+	// LoginStatus and LoginCode override a successful login when set
+	LoginStatus int    `json:"login_status,omitempty"`
+	LoginCode   string `json:"login_code,omitempty"`
+	// Authenticated controls whether Bearer-protected endpoints accept requests
+	Authenticated bool `json:"authenticated"`
+}
+
+// Scenarios are the built-in fixtures
+var Scenarios = map[string]Scenario{
+	"default": {
+		Name:          "default",
+		Description:   "Successful login with a high trust score",
+		TrustScore:    88,
+		Authenticated: true,
+	},
+	"low_trust": {
+		Name:          "low_trust",
+		Description:   "Login succeeds but the trust score is below the protected resource requirement",
+		TrustScore:    35,
+		Authenticated: true,
+	},
+	"lockout": {
+		Name:        "lockout",
+		Description: "Account is locked after too many failed attempts",
+		LoginStatus: http.StatusLocked,
+		LoginCode:   "ACCOUNT_LOCKED",
+	},
+	"mfa_required": {
+		Name:        "mfa_required",
+		Description: "Password accepted but a second factor is required",
+		TrustScore:  60,
+		LoginStatus: http.StatusUnauthorized,
+		LoginCode:   "MFA_REQUIRED",
+	},
+	"unauthenticated": {
+		Name:        "unauthenticated",
+		Description: "Every Bearer-protected endpoint rejects the token",
+		LoginStatus: http.StatusUnauthorized,
+		LoginCode:   "AUTH_001",
+	},
+}
+
+// protectedTrustLevel mirrors the trust level documented for /protected
+const protectedTrustLevel = 50
+
+// Server resolves scenarios and serves fixtures
+type Server struct {
+	defaultScenario string
+}
+
+// NewServer creates a mock server using defaultScenario when a request does
+// not select one via ScenarioHeader
+func NewServer(defaultScenario string) *Server {
+	if _, ok := Scenarios[defaultScenario]; !ok {
+		defaultScenario = "default"
+	}
+	return &Server{defaultScenario: defaultScenario}
+}
+
+// Router builds a gin engine exposing the mocked API
+func (s *Server) Router() *gin.Engine {
+	r := gin.New()
+	r.Use(gin.Recovery())
+
+	r.GET("/health", s.handleHealth)
+	r.GET("/mock/scenarios", s.handleListScenarios)
+
+	v1 := r.Group("/api/v1")
+	{
+		v1.POST("/auth/login", s.handleLogin)
+		v1.GET("/trust-score", s.requireBearer, s.handleTrustScore)
+		v1.GET("/protected", s.requireBearer, s.handleProtected)
+	}
+
+	return r
+}
+
+// scenario returns the scenario selected for the request
+func (s *Server) scenario(c *gin.Context) Scenario {
+	if name := c.GetHeader(ScenarioHeader); name != "" {
+		if sc, ok := Scenarios[name]; ok {
+			return sc
+		}
+	}
+	return Scenarios[s.defaultScenario]
+}
+
+func (s *Server) handleHealth(c *gin.Context) {
+	c.JSON(http.StatusOK, api.HealthResponse{
+		Status:    "healthy",
+		Service:   "impl-zamaz-mock",
+		Version:   "1.0.0",
+		Timestamp: FixedTime.Format(time.RFC3339),
+	})
+}
+
+func (s *Server) handleListScenarios(c *gin.Context) {
+	names := make([]string, 0, len(Scenarios))
+	for name := range Scenarios {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	list := make([]Scenario, 0, len(names))
+	for _, name := range names {
+		list = append(list, Scenarios[name])
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"default":   s.defaultScenario,
+		"header":    ScenarioHeader,
+		"scenarios": list,
+	})
+}
+
+func (s *Server) handleLogin(c *gin.Context) {
+	var req api.LoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, api.ErrorResponse{
+			Error:   "Bad Request",
+			Code:    "REQ_001",
+			Message: i18n.Message(c, "REQ_001"),
+		})
+		return
+	}
+
+	sc := s.scenario(c)
+	switch sc.LoginCode {
+	case "":
+	case "ACCOUNT_LOCKED":
+		c.Header("Retry-After", "1800")
+		c.JSON(sc.LoginStatus, gin.H{
+			"error":        http.StatusText(sc.LoginStatus),
+			"code":         sc.LoginCode,
+			"message":      i18n.Message(c, sc.LoginCode),
+			"locked_until": FixedTime.Add(30 * time.Minute).Format(time.RFC3339),
+		})
+		return
+	case "MFA_REQUIRED":
+		c.JSON(sc.LoginStatus, gin.H{
+			"error":        http.StatusText(sc.LoginStatus),
+			"code":         sc.LoginCode,
+			"message":      i18n.Message(c, sc.LoginCode),
+			"challenge_id": "mock-challenge-" + req.Username,
+			"methods":      []string{"totp", "webauthn"},
+			"trust_score":  sc.TrustScore,
+		})
+		return
+	default:
+		c.JSON(sc.LoginStatus, api.ErrorResponse{
+			Error:   http.StatusText(sc.LoginStatus),
+			Code:    sc.LoginCode,
+			Message: i18n.Message(c, sc.LoginCode),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, api.LoginResponse{
+		AccessToken:  "mock-access-token-" + sc.Name,
+		RefreshToken: "mock-refresh-token-" + sc.Name,
+		ExpiresIn:    300,
+		TokenType:    "Bearer",
+		User:         mockUser(req.Username),
+		TrustScore:   sc.TrustScore,
+	})
+}
+
+// requireBearer rejects requests without a Bearer token or in scenarios that
+// model an invalid session
+func (s *Server) requireBearer(c *gin.Context) {
+	header := c.GetHeader("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") || !s.scenario(c).Authenticated {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, api.ErrorResponse{
+			Error:   "Unauthorized",
+			Code:    "AUTH_001",
+			Message: i18n.Message(c, "AUTH_001"),
+		})
+		return
+	}
+	c.Next()
+}
+
+func (s *Server) handleTrustScore(c *gin.Context) {
+	sc := s.scenario(c)
+	c.JSON(http.StatusOK, api.TrustScoreResponse{
+		UserID:    mockUser("testuser").ID,
+		Overall:   sc.TrustScore,
+		Factors:   mockFactors(sc.TrustScore),
+		Timestamp: FixedTime.Format(time.RFC3339),
+		NextCheck: FixedTime.Add(5 * time.Minute).Format(time.RFC3339),
+	})
+}
+
+func (s *Server) handleProtected(c *gin.Context) {
+	sc := s.scenario(c)
+	if sc.TrustScore < protectedTrustLevel {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error":                "Forbidden",
+			"code":                 "INSUFFICIENT_TRUST",
+			"message":              i18n.Message(c, "INSUFFICIENT_TRUST"),
+			"trust_level_required": protectedTrustLevel,
+			"your_trust_level":     sc.TrustScore,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":                 "This is protected data",
+		"accessed_at":          FixedTime.Format(time.RFC3339),
+		"trust_level_required": protectedTrustLevel,
+		"your_trust_level":     sc.TrustScore,
+	})
+}
+
+func mockUser(username string) api.UserInfo {
+	if username == "" {
+		username = "testuser"
+	}
+	return api.UserInfo{
+		ID:       "550e8400-e29b-41d4-a716-446655440000",
+		Username: username,
+		Email:    username + "@example.com",
+		Roles:    []string{"user"},
+	}
+}
+
+// mockFactors splits an overall score across factors using the same
+// proportions as the demo calculation (30/20/18/12/8 of 88)
+func mockFactors(overall int) map[string]int {
+	identity := overall * 30 / 88
+	device := overall * 20 / 88
+	behavior := overall * 18 / 88
+	location := overall * 12 / 88
+	return map[string]int{
+		"identity": identity,
+		"device":   device,
+		"behavior": behavior,
+		"location": location,
+		"risk":     overall - identity - device - behavior - location,
+	}
+}
@@ -0,0 +1,102 @@
+// Package oauthclient calls APIs that accept OAuth 2.0 client credentials
+// tokens, as Microsoft Graph, Jamf Pro and the Keycloak admin API do.
+package oauthclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// refreshMargin is how long before a token expires it is replaced
+const refreshMargin = time.Minute
+
+// ClientCredentials fetches and caches client credentials tokens
+type ClientCredentials struct {
+	url    string
+	form   url.Values
+	client *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// NewClientCredentials creates a token source posting form, which holds
+// grant_type, client_id, client_secret and any scope, to tokenURL
+func NewClientCredentials(tokenURL string, form url.Values, client *http.Client) *ClientCredentials {
+	return &ClientCredentials{url: tokenURL, form: form, client: client}
+}
+
+// Token returns a cached token, fetching a new one shortly before it
+// expires: a minute before, or halfway through shorter lifetimes
+func (cc *ClientCredentials) Token(ctx context.Context) (string, error) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.token != "" && time.Now().Before(cc.expires) {
+		return cc.token, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cc.url, strings.NewReader(cc.form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := cc.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("token request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint returned status %d", resp.StatusCode)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&token); err != nil || token.AccessToken == "" {
+		return "", errors.New("token endpoint returned no access token")
+	}
+	lifetime := time.Duration(token.ExpiresIn) * time.Second
+	margin := refreshMargin
+	if lifetime < 2*margin {
+		margin = lifetime / 2
+	}
+	cc.token, cc.expires = token.AccessToken, time.Now().Add(lifetime-margin)
+	return cc.token, nil
+}
+
+// GetJSON decodes the JSON at location, authenticated with a token from cc
+func (cc *ClientCredentials) GetJSON(ctx context.Context, location string, out interface{}) error {
+	token, err := cc.Token(ctx)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "application/json")
+	resp, err := cc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		if resp.StatusCode == http.StatusUnauthorized {
+			// Revoked early; fetch a new token next time
+			cc.mu.Lock()
+			cc.token = ""
+			cc.mu.Unlock()
+		}
+		return fmt.Errorf("%s returned status %d", req.URL.Path, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 32<<20)).Decode(out)
+}
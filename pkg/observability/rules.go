@@ -0,0 +1,269 @@
+// Package observability generates the Prometheus alerting and recording rules
+// recommended for impl-zamaz from the metrics it exports and the thresholds
+// it is configured with
+package observability
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+
+	"github.com/lsendel/impl-zamaz/pkg/health"
+	"github.com/lsendel/impl-zamaz/pkg/i18n"
+)
+
+// Thresholds configures the generated rules
+type Thresholds struct {
+	// Job is the Prometheus job label of the scraped replicas
+	Job string
+	// AvailabilityTarget is the SLO for non-5xx responses, e.g. 0.999
+	AvailabilityTarget float64
+	// AuthFailureRate is the rejected authentications per second, across
+	// replicas, that counts as a spike
+	AuthFailureRate float64
+	// HealthFlapChanges is how many times a dependency may change state
+	// within FlapWindow before it is flapping
+	HealthFlapChanges int
+	FlapWindow        time.Duration
+	// HealthInterval is how often dependencies are checked; a dependency
+	// alerts after two failed checks
+	HealthInterval time.Duration
+	// ReplicationMaxStaleness is the replication lag to a peer region
+	// above which its state is considered diverging
+	ReplicationMaxStaleness time.Duration
+}
+
+// DefaultThresholds are used for zero Thresholds fields
+var DefaultThresholds = Thresholds{
+	Job:                     "impl-zamaz",
+	AvailabilityTarget:      0.999,
+	AuthFailureRate:         1,
+	HealthFlapChanges:       4,
+	FlapWindow:              15 * time.Minute,
+	HealthInterval:          30 * time.Second,
+	ReplicationMaxStaleness: 30 * time.Second,
+}
+
+// RuleFile is a Prometheus rule file
+type RuleFile struct {
+	Groups []RuleGroup `yaml:"groups" json:"groups"`
+}
+
+// RuleGroup is a named group of rules evaluated together
+type RuleGroup struct {
+	Name  string `yaml:"name" json:"name"`
+	Rules []Rule `yaml:"rules" json:"rules"`
+}
+
+// Rule is an alerting rule when Alert is set and a recording rule otherwise
+type Rule struct {
+	Record      string            `yaml:"record,omitempty" json:"record,omitempty"`
+	Alert       string            `yaml:"alert,omitempty" json:"alert,omitempty"`
+	Expr        string            `yaml:"expr" json:"expr"`
+	For         string            `yaml:"for,omitempty" json:"for,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty" json:"labels,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty" json:"annotations,omitempty"`
+}
+
+// sloWindows are the error ratio windows of the multiwindow burn-rate alerts
+var sloWindows = []string{"5m", "30m", "1h", "6h"}
+
+// Rules generates the rule file for t and the registered health
+// dependencies; critical dependencies page, the others warn
+func Rules(t Thresholds, deps map[string]health.DependencyStatus) RuleFile {
+	t = withDefaults(t)
+	sel := fmt.Sprintf(`job=%q`, t.Job)
+	budget := 1 - t.AvailabilityTarget
+
+	recording := RuleGroup{Name: "impl-zamaz.recording"}
+	for _, w := range sloWindows {
+		recording.Rules = append(recording.Rules, Rule{
+			Record: "zamaz:http_errors:ratio_rate" + w,
+			Expr: fmt.Sprintf(`sum(rate(http_responses_total{%s,class="5xx"}[%s])) / sum(rate(http_responses_total{%s}[%s]))`,
+				sel, w, sel, w),
+		})
+	}
+	recording.Rules = append(recording.Rules, Rule{
+		Record: "zamaz:auth_failures:rate5m",
+		Expr: fmt.Sprintf(`(sum(rate(authz_decisions_total{%s,outcome="denied"}[5m])) or vector(0)) + (sum(rate(signed_requests_rejected_total{%s}[5m])) or vector(0))`,
+			sel, sel),
+	})
+
+	alerts := RuleGroup{Name: "impl-zamaz.alerts"}
+	alerts.Rules = append(alerts.Rules,
+		Rule{
+			Alert:  "ZamazAuthFailureSpike",
+			Expr:   "zamaz:auth_failures:rate5m > " + number(t.AuthFailureRate),
+			For:    "5m",
+			Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{
+				"summary":     "Authentication failures are spiking",
+				"description": fmt.Sprintf("More than %s rejected authentications per second for 5 minutes; check for credential stuffing or a broken client.", number(t.AuthFailureRate)),
+			},
+		},
+		Rule{
+			Alert:  "ZamazCircuitBreakerOpen",
+			Expr:   fmt.Sprintf(`sum by (breaker) (increase(circuit_breaker_events_total{%s,event="open"}[5m])) > 0`, sel),
+			Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{
+				"summary":     "Circuit breaker {{ $labels.breaker }} opened",
+				"description": "Calls to {{ $labels.breaker }} are being rejected; see /api/v1/security/circuit-breakers.",
+			},
+		},
+		Rule{
+			Alert:  "ZamazHealthFlapping",
+			Expr:   fmt.Sprintf(`max by (dependency) (changes(health_dependency_up{%s}[%s])) > %d`, sel, duration(t.FlapWindow), t.HealthFlapChanges),
+			Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{
+				"summary":     "Dependency {{ $labels.dependency }} is flapping",
+				"description": fmt.Sprintf("{{ $labels.dependency }} changed state more than %d times in %s.", t.HealthFlapChanges, duration(t.FlapWindow)),
+			},
+		},
+		Rule{
+			Alert:  "ZamazReadOnlyMode",
+			Expr:   fmt.Sprintf(`max(store_degraded{%s}) > 0`, sel),
+			For:    "1m",
+			Labels: map[string]string{"severity": "critical"},
+			Annotations: map[string]string{
+				"summary":     "Serving read-only from local state",
+				"description": "The shared store is unreachable; mutations are rejected with 503 until it recovers.",
+			},
+		},
+		Rule{
+			Alert:  "ZamazReplicationStale",
+			Expr:   fmt.Sprintf(`max by (region) (replication_staleness_seconds{%s}) > %s`, sel, number(t.ReplicationMaxStaleness.Seconds())),
+			For:    "2m",
+			Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{
+				"summary":     "Replication to {{ $labels.region }} is behind",
+				"description": fmt.Sprintf("Changes have waited more than %s to reach {{ $labels.region }}; the regions are serving diverging state.", duration(t.ReplicationMaxStaleness)),
+			},
+		},
+		burnRateAlert("ZamazErrorBudgetFastBurn", "critical", 14.4, budget, "1h", "5m", "2m"),
+		burnRateAlert("ZamazErrorBudgetSlowBurn", "warning", 6, budget, "6h", "30m", "15m"),
+	)
+	alerts.Rules = append(alerts.Rules, dependencyAlerts(t, sel, deps)...)
+
+	return RuleFile{Groups: []RuleGroup{recording, alerts}}
+}
+
+// burnRateAlert fires when the error budget burns factor times too fast over
+// both a long and a short window
+func burnRateAlert(name, severity string, factor, budget float64, long, short, forDuration string) Rule {
+	threshold := number(factor * budget)
+	return Rule{
+		Alert: name,
+		Expr: fmt.Sprintf("zamaz:http_errors:ratio_rate%s > %s and zamaz:http_errors:ratio_rate%s > %s",
+			long, threshold, short, threshold),
+		For:    forDuration,
+		Labels: map[string]string{"severity": severity},
+		Annotations: map[string]string{
+			"summary":     "Availability SLO error budget is burning",
+			"description": fmt.Sprintf("The 5xx ratio is above %s (%sx the error budget) over %s and %s.", threshold, number(factor), long, short),
+		},
+	}
+}
+
+func dependencyAlerts(t Thresholds, sel string, deps map[string]health.DependencyStatus) []Rule {
+	forDuration := duration(2 * t.HealthInterval)
+	if len(deps) == 0 {
+		return []Rule{{
+			Alert:       "ZamazDependencyDown",
+			Expr:        fmt.Sprintf(`health_dependency_up{%s} == 0`, sel),
+			For:         forDuration,
+			Labels:      map[string]string{"severity": "warning"},
+			Annotations: map[string]string{"summary": "Dependency {{ $labels.dependency }} is down"},
+		}}
+	}
+
+	names := make([]string, 0, len(deps))
+	for name := range deps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	rules := make([]Rule, 0, len(names))
+	for _, name := range names {
+		severity, impact := "warning", "degraded"
+		if deps[name].Critical {
+			severity, impact = "critical", "unhealthy"
+		}
+		rules = append(rules, Rule{
+			Alert:  "ZamazDependencyDown",
+			Expr:   fmt.Sprintf(`health_dependency_up{%s,dependency=%q} == 0`, sel, name),
+			For:    forDuration,
+			Labels: map[string]string{"severity": severity, "dependency": name},
+			Annotations: map[string]string{
+				"summary":     fmt.Sprintf("Dependency %s is down", name),
+				"description": fmt.Sprintf("%s failed its health checks for %s; the service is %s.", name, forDuration, impact),
+			},
+		})
+	}
+	return rules
+}
+
+// RulesHandler serves the rule file as YAML, or JSON with ?format=json
+func RulesHandler(t Thresholds, checker *health.Checker) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		rules := Rules(t, checker.Last().Dependencies)
+		if c.Query("format") == "json" {
+			c.JSON(http.StatusOK, rules)
+			return
+		}
+		out, err := yaml.Marshal(rules)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": i18n.Message(c, "INTERNAL_ERROR"),
+				"code":  "INTERNAL_ERROR",
+			})
+			return
+		}
+		c.Header("Content-Disposition", `attachment; filename="impl-zamaz-rules.yml"`)
+		c.Data(http.StatusOK, "application/yaml", out)
+	}
+}
+
+func withDefaults(t Thresholds) Thresholds {
+	if t.Job == "" {
+		t.Job = DefaultThresholds.Job
+	}
+	if t.AvailabilityTarget <= 0 || t.AvailabilityTarget >= 1 {
+		t.AvailabilityTarget = DefaultThresholds.AvailabilityTarget
+	}
+	if t.AuthFailureRate <= 0 {
+		t.AuthFailureRate = DefaultThresholds.AuthFailureRate
+	}
+	if t.HealthFlapChanges <= 0 {
+		t.HealthFlapChanges = DefaultThresholds.HealthFlapChanges
+	}
+	if t.FlapWindow <= 0 {
+		t.FlapWindow = DefaultThresholds.FlapWindow
+	}
+	if t.HealthInterval <= 0 {
+		t.HealthInterval = DefaultThresholds.HealthInterval
+	}
+	if t.ReplicationMaxStaleness <= 0 {
+		t.ReplicationMaxStaleness = DefaultThresholds.ReplicationMaxStaleness
+	}
+	return t
+}
+
+func number(v float64) string {
+	return strconv.FormatFloat(v, 'g', 6, 64)
+}
+
+// duration formats d as a Prometheus duration such as 1m or 90s
+func duration(d time.Duration) string {
+	switch {
+	case d%time.Hour == 0:
+		return strconv.Itoa(int(d/time.Hour)) + "h"
+	case d%time.Minute == 0:
+		return strconv.Itoa(int(d/time.Minute)) + "m"
+	default:
+		return strconv.Itoa(int((d+time.Second-1)/time.Second)) + "s"
+	}
+}
@@ -0,0 +1,257 @@
+package oidc
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/trust"
+)
+
+// Token types a claim rule can target
+const (
+	TokenAccess = "access"
+	TokenID     = "id"
+)
+
+// reservedClaims are set by the provider and cannot be mapped, renamed or
+// removed, since relying parties validate tokens with them
+var reservedClaims = map[string]bool{
+	"iss": true, "sub": true, "aud": true, "exp": true, "iat": true, "nbf": true,
+	"jti": true, "azp": true, "nonce": true, "at_hash": true, "auth_time": true,
+	"token_use": true, "client_id": true, "scope": true,
+}
+
+// Sources a claim rule can copy with its type preserved
+var claimSources = map[string]func(ClaimData) (interface{}, bool){
+	"user.id":       func(d ClaimData) (interface{}, bool) { return d.User.ID, d.User.ID != "" },
+	"user.username": func(d ClaimData) (interface{}, bool) { return d.User.Username, d.User.Username != "" },
+	"user.email":    func(d ClaimData) (interface{}, bool) { return d.User.Email, d.User.Email != "" },
+	"user.roles":    func(d ClaimData) (interface{}, bool) { return d.User.Roles, d.User.Roles != nil },
+	"user.tenant":   func(d ClaimData) (interface{}, bool) { return d.User.TenantID, d.User.TenantID != "" },
+	"client.id":     func(d ClaimData) (interface{}, bool) { return d.ClientID, true },
+	"trust.score": func(d ClaimData) (interface{}, bool) {
+		if d.Trust == nil {
+			return nil, false
+		}
+		return d.Trust.Score, true
+	},
+	"trust.level": func(d ClaimData) (interface{}, bool) {
+		if d.Trust == nil {
+			return nil, false
+		}
+		return d.Trust.Level, true
+	},
+	"trust.access": func(d ClaimData) (interface{}, bool) {
+		if d.Trust == nil {
+			return nil, false
+		}
+		return d.Trust.Access, true
+	},
+}
+
+// attributeSource prefixes a source that reads one user attribute
+const attributeSource = "user.attributes."
+
+// ClaimMapping controls the claims added to issued tokens beyond the
+// standard ones:
+//
+//	{
+//	  "namespace": "https://zamaz.example.com/",
+//	  "rename": {"roles": "groups"},
+//	  "remove": ["preferred_username"],
+//	  "claims": [
+//	    {"name": "tenant", "source": "user.tenant"},
+//	    {"name": "trust", "source": "trust.score", "tokens": ["access"]},
+//	    {"name": "department", "source": "user.attributes.department", "scopes": ["profile"]},
+//	    {"name": "display", "value": "{{.User.Username}} <{{.User.Email}}>", "namespaced": false}
+//	  ]
+//	}
+type ClaimMapping struct {
+	// Namespace prefixes mapped claim names, e.g. a URL owned by the
+	// deployment so claims never collide with registered ones
+	Namespace string `json:"namespace"`
+	// Rename moves standard claims such as roles or email to another name
+	Rename map[string]string `json:"rename"`
+	// Remove drops standard claims downstream services must not see
+	Remove []string    `json:"remove"`
+	Claims []ClaimRule `json:"claims"`
+
+	templates []*template.Template
+}
+
+// ClaimRule adds one claim from either a typed Source or a string Value
+// template executed against ClaimData
+type ClaimRule struct {
+	Name   string `json:"name"`
+	Source string `json:"source,omitempty"`
+	Value  string `json:"value,omitempty"`
+	// Tokens limits the rule to "access" or "id" tokens; empty means both
+	Tokens []string `json:"tokens,omitempty"`
+	// Scopes limits the rule to grants with at least one of these scopes
+	Scopes []string `json:"scopes,omitempty"`
+	// Namespaced defaults to true; set false to use Name as is
+	Namespaced *bool `json:"namespaced,omitempty"`
+}
+
+// ClaimData is what claim rules read
+type ClaimData struct {
+	User     interfaces.UserInfo
+	ClientID string
+	Scopes   []string
+	Trust    *TrustClaims
+}
+
+// TrustClaims is the trust evaluation at token issuance
+type TrustClaims struct {
+	Score  int
+	Level  string
+	Access []string
+}
+
+// LoadClaimMapping reads and validates a ClaimMapping from path
+func LoadClaimMapping(path string) (*ClaimMapping, error) {
+	var m ClaimMapping
+	if err := readJSONFile(path, &m); err != nil {
+		return nil, err
+	}
+	if err := m.Compile(); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// Compile validates the mapping and parses its templates; it must be called
+// before Apply
+func (m *ClaimMapping) Compile() error {
+	for from, to := range m.Rename {
+		if reservedClaims[from] || reservedClaims[to] || to == "" {
+			return fmt.Errorf("claim mapping cannot rename %q to %q", from, to)
+		}
+	}
+	for _, name := range m.Remove {
+		if reservedClaims[name] {
+			return fmt.Errorf("claim mapping cannot remove %q", name)
+		}
+	}
+
+	m.templates = make([]*template.Template, len(m.Claims))
+	for i, rule := range m.Claims {
+		name := m.claimName(rule)
+		switch {
+		case rule.Name == "" || reservedClaims[name]:
+			return fmt.Errorf("claim rule %d has an invalid name %q", i, rule.Name)
+		case (rule.Source == "") == (rule.Value == ""):
+			return fmt.Errorf("claim %q needs exactly one of source and value", rule.Name)
+		}
+		for _, token := range rule.Tokens {
+			if token != TokenAccess && token != TokenID {
+				return fmt.Errorf("claim %q has unknown token type %q", rule.Name, token)
+			}
+		}
+		if rule.Source != "" {
+			if _, ok := claimSources[rule.Source]; !ok && !strings.HasPrefix(rule.Source, attributeSource) {
+				return fmt.Errorf("claim %q has unknown source %q", rule.Name, rule.Source)
+			}
+			continue
+		}
+		tmpl, err := template.New(rule.Name).Option("missingkey=zero").Parse(rule.Value)
+		if err != nil {
+			return fmt.Errorf("claim %q has an invalid template: %w", rule.Name, err)
+		}
+		m.templates[i] = tmpl
+	}
+	return nil
+}
+
+// NeedsTrust reports whether any rule reads trust data, so the score is only
+// calculated when a token will carry it
+func (m *ClaimMapping) NeedsTrust() bool {
+	for _, rule := range m.Claims {
+		if strings.HasPrefix(rule.Source, "trust.") || strings.Contains(rule.Value, ".Trust") {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply renames and removes standard claims and adds the mapped ones to
+// claims, a token of type tokenUse
+func (m *ClaimMapping) Apply(tokenUse string, claims map[string]interface{}, data ClaimData) error {
+	for _, name := range m.Remove {
+		delete(claims, name)
+	}
+	for from, to := range m.Rename {
+		if value, ok := claims[from]; ok {
+			delete(claims, from)
+			claims[to] = value
+		}
+	}
+
+	for i, rule := range m.Claims {
+		if len(rule.Tokens) > 0 && !contains(rule.Tokens, tokenUse) {
+			continue
+		}
+		if len(rule.Scopes) > 0 && !containsAny(data.Scopes, rule.Scopes) {
+			continue
+		}
+
+		var value interface{}
+		if tmpl := m.templates[i]; tmpl != nil {
+			var sb strings.Builder
+			if err := tmpl.Execute(&sb, data); err != nil {
+				return fmt.Errorf("claim %q: %w", rule.Name, err)
+			}
+			if sb.Len() == 0 {
+				continue
+			}
+			value = sb.String()
+		} else if attr, ok := strings.CutPrefix(rule.Source, attributeSource); ok {
+			v, ok := data.User.Attributes[attr]
+			if !ok {
+				continue
+			}
+			value = v
+		} else {
+			v, ok := claimSources[rule.Source](data)
+			if !ok {
+				continue
+			}
+			value = v
+		}
+		claims[m.claimName(rule)] = value
+	}
+	return nil
+}
+
+func (m *ClaimMapping) claimName(rule ClaimRule) string {
+	if rule.Namespaced != nil && !*rule.Namespaced {
+		return rule.Name
+	}
+	return m.Namespace + rule.Name
+}
+
+// trustClaims scores user with scorer for the claim data
+func trustClaims(ctx context.Context, scorer trust.Scorer, levels trust.AccessLevels, user interfaces.UserInfo) (*TrustClaims, error) {
+	score, err := scorer.Score(ctx, trust.Input{Subject: user.ID})
+	if err != nil {
+		return nil, err
+	}
+	thresholds := trust.DefaultThresholds
+	if levels != nil {
+		thresholds = levels.Thresholds(ctx)
+	}
+	level, access := trust.AccessLevel(score.Overall, thresholds)
+	return &TrustClaims{Score: score.Overall, Level: level, Access: access}, nil
+}
+
+func containsAny(values, wanted []string) bool {
+	for _, w := range wanted {
+		if contains(values, w) {
+			return true
+		}
+	}
+	return false
+}
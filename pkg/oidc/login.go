@@ -0,0 +1,100 @@
+package oidc
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lsendel/impl-zamaz/pkg/i18n"
+)
+
+var loginTemplate = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html lang="{{.Lang}}">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Sign in to {{.ClientName}}</title>
+</head>
+<body>
+<main>
+<h1>Sign in to {{.ClientName}}</h1>
+{{if .Error}}<p role="alert">{{.Error}}</p>{{end}}
+<form method="post" action="{{.Action}}">
+<input type="hidden" name="client_id" value="{{.Request.ClientID}}">
+<input type="hidden" name="redirect_uri" value="{{.Request.RedirectURI}}">
+<input type="hidden" name="response_type" value="{{.Request.ResponseType}}">
+<input type="hidden" name="scope" value="{{.Request.Scope}}">
+<input type="hidden" name="state" value="{{.Request.State}}">
+<input type="hidden" name="nonce" value="{{.Request.Nonce}}">
+<input type="hidden" name="code_challenge" value="{{.Request.CodeChallenge}}">
+<input type="hidden" name="code_challenge_method" value="{{.Request.CodeChallengeMethod}}">
+<label>Username <input name="username" autocomplete="username" required autofocus></label>
+<label>Password <input name="password" type="password" autocomplete="current-password" required></label>
+<button type="submit">Sign in</button>
+</form>
+</main>
+</body>
+</html>
+`))
+
+var errorTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Authorization error</title></head>
+<body>
+<main>
+<h1>Authorization error</h1>
+<p><code>{{.Code}}</code>: {{.Description}}</p>
+</main>
+</body>
+</html>
+`))
+
+func (p *Provider) renderLogin(c *gin.Context, status int, client Client, req authorizeRequest, errMsg string) {
+	name := client.Name
+	if name == "" {
+		name = client.ID
+	}
+	p.render(c, status, loginTemplate, map[string]interface{}{
+		"Lang":       i18n.Language(c),
+		"ClientName": name,
+		"Action":     p.endpoint(AuthorizePath),
+		"Request":    req,
+		"Error":      errMsg,
+	})
+}
+
+// renderError shows an error to the user without redirecting, used when the
+// client or redirect URI cannot be trusted
+func (p *Provider) renderError(c *gin.Context, code, description string) {
+	p.render(c, http.StatusBadRequest, errorTemplate, map[string]string{
+		"Code":        code,
+		"Description": description,
+	})
+}
+
+func (p *Provider) render(c *gin.Context, status int, tmpl *template.Template, data interface{}) {
+	c.Header("Cache-Control", "no-store")
+	c.Header("X-Frame-Options", "DENY")
+	c.Header("Content-Security-Policy", "default-src 'none'; frame-ancestors 'none'")
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Status(status)
+	if err := tmpl.Execute(c.Writer, data); err != nil {
+		p.logger.Error("Failed to render OIDC page", "error", err)
+	}
+	c.Abort()
+}
+
+func readJSONFile(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("invalid JSON in %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,590 @@
+// Package oidc lets impl-zamaz act as a small OpenID Connect provider for
+// internal applications: discovery, authorization code flow with PKCE, ID
+// token issuance and userinfo.
+//
+// Error responses from the OAuth endpoints use the RFC 6749 shape
+// ({"error", "error_description"}) rather than the API's error format, since
+// OAuth client libraries depend on it.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lsendel/impl-zamaz/pkg/auth"
+	"github.com/lsendel/impl-zamaz/pkg/i18n"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/security"
+	"github.com/lsendel/impl-zamaz/pkg/session"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+	"github.com/lsendel/impl-zamaz/pkg/trust"
+)
+
+// Endpoint paths, relative to the issuer URL
+const (
+	DiscoveryPath = "/.well-known/openid-configuration"
+	JWKSPath      = "/oauth2/jwks"
+	AuthorizePath = "/oauth2/authorize"
+	TokenPath     = "/oauth2/token"
+	UserInfoPath  = "/oauth2/userinfo"
+)
+
+// Store key prefixes for authorization codes
+const (
+	codeKeyPrefix     = "oidc:code:"
+	codeUsedKeyPrefix = "oidc:code-used:"
+)
+
+// Client is a registered relying party
+type Client struct {
+	ID string `json:"client_id"`
+	// Secret is empty for public clients, which must rely on PKCE alone
+	Secret       string   `json:"client_secret,omitempty"`
+	Name         string   `json:"name"`
+	RedirectURIs []string `json:"redirect_uris"`
+}
+
+// Config configures the provider
+type Config struct {
+	Clients        []Client
+	CodeTTL        time.Duration
+	AccessTokenTTL time.Duration
+	IDTokenTTL     time.Duration
+	// Sessions, when set, lets an existing browser session satisfy the
+	// authorization endpoint without showing the login form (SSO)
+	Sessions *session.Manager
+	// ClaimMapping, when set, controls the custom claims in issued tokens;
+	// it must be compiled
+	ClaimMapping *ClaimMapping
+	// Trust scores users for mapped trust.* claims
+	Trust trust.Scorer
+	// AccessLevels maps their scores to trust.level and trust.access;
+	// defaults to trust.DefaultThresholds
+	AccessLevels trust.AccessLevels
+	// Lockout, when set, refuses locked accounts at the login form and
+	// counts its failed logins towards locking them, as the login API does
+	Lockout *security.Lockout
+	// BruteForce, when set, counts failed logins at the login form towards
+	// blocking the addresses they come from
+	BruteForce *security.BruteForce
+}
+
+// Provider serves the OpenID Connect endpoints
+type Provider struct {
+	config  Config
+	clients map[string]Client
+	issuer  *auth.Issuer
+	store   store.Store
+	users   UserAuthenticator
+	logger  interfaces.Logger
+}
+
+// authorizationGrant is what an authorization code stands for
+type authorizationGrant struct {
+	ClientID      string              `json:"client_id"`
+	RedirectURI   string              `json:"redirect_uri"`
+	Scope         string              `json:"scope"`
+	Nonce         string              `json:"nonce,omitempty"`
+	CodeChallenge string              `json:"code_challenge"`
+	User          interfaces.UserInfo `json:"user"`
+	AuthTime      int64               `json:"auth_time"`
+}
+
+// NewProvider creates a provider. Authorization codes live in s so any
+// replica can redeem them.
+func NewProvider(cfg Config, issuer *auth.Issuer, s store.Store, users UserAuthenticator, logger interfaces.Logger) *Provider {
+	if cfg.CodeTTL <= 0 {
+		cfg.CodeTTL = time.Minute
+	}
+	if cfg.AccessTokenTTL <= 0 {
+		cfg.AccessTokenTTL = 15 * time.Minute
+	}
+	if cfg.IDTokenTTL <= 0 {
+		cfg.IDTokenTTL = cfg.AccessTokenTTL
+	}
+
+	clients := make(map[string]Client, len(cfg.Clients))
+	for _, client := range cfg.Clients {
+		clients[client.ID] = client
+	}
+	return &Provider{
+		config:  cfg,
+		clients: clients,
+		issuer:  issuer,
+		store:   s,
+		users:   users,
+		logger:  logger,
+	}
+}
+
+// LoadClients reads a JSON array of clients from path
+func LoadClients(path string) ([]Client, error) {
+	var clients []Client
+	if err := readJSONFile(path, &clients); err != nil {
+		return nil, err
+	}
+	return clients, nil
+}
+
+// RegisterRoutes mounts the provider endpoints. loginGuards, such as the
+// login rate limit, run before the login form is checked.
+func (p *Provider) RegisterRoutes(r gin.IRoutes, loginGuards ...gin.HandlerFunc) {
+	r.GET(DiscoveryPath, p.handleDiscovery)
+	r.GET(JWKSPath, p.handleJWKS)
+	r.GET(AuthorizePath, p.handleAuthorize)
+	r.POST(AuthorizePath, append(append([]gin.HandlerFunc{}, loginGuards...), p.handleAuthorize)...)
+	r.POST(TokenPath, p.handleToken)
+	r.GET(UserInfoPath, p.handleUserInfo)
+}
+
+func (p *Provider) endpoint(path string) string {
+	return strings.TrimRight(p.issuer.URL(), "/") + path
+}
+
+func (p *Provider) handleDiscovery(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=3600")
+	c.JSON(http.StatusOK, gin.H{
+		"issuer":                                         p.issuer.URL(),
+		"authorization_endpoint":                         p.endpoint(AuthorizePath),
+		"token_endpoint":                                 p.endpoint(TokenPath),
+		"userinfo_endpoint":                              p.endpoint(UserInfoPath),
+		"jwks_uri":                                       p.endpoint(JWKSPath),
+		"response_types_supported":                       []string{"code"},
+		"grant_types_supported":                          []string{"authorization_code"},
+		"subject_types_supported":                        []string{"public"},
+		"id_token_signing_alg_values_supported":          []string{"RS256"},
+		"scopes_supported":                               []string{"openid", "profile", "email"},
+		"token_endpoint_auth_methods_supported":          []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":               []string{"S256"},
+		"claims_supported":                               []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "preferred_username", "email", "roles"},
+		"authorization_response_iss_parameter_supported": true,
+	})
+}
+
+func (p *Provider) handleJWKS(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=3600")
+	c.JSON(http.StatusOK, p.issuer.JWKS())
+}
+
+// authorizeRequest holds the authorization request parameters, read from the
+// query string on GET and from the login form on POST
+type authorizeRequest struct {
+	ClientID            string `form:"client_id"`
+	RedirectURI         string `form:"redirect_uri"`
+	ResponseType        string `form:"response_type"`
+	Scope               string `form:"scope"`
+	State               string `form:"state"`
+	Nonce               string `form:"nonce"`
+	CodeChallenge       string `form:"code_challenge"`
+	CodeChallengeMethod string `form:"code_challenge_method"`
+}
+
+func (p *Provider) handleAuthorize(c *gin.Context) {
+	var req authorizeRequest
+	if err := c.ShouldBind(&req); err != nil {
+		p.renderError(c, "invalid_request", "malformed authorization request")
+		return
+	}
+
+	// Until the client and redirect URI are known to be valid, errors must
+	// not redirect anywhere
+	client, ok := p.clients[req.ClientID]
+	if !ok {
+		p.renderError(c, "invalid_request", "unknown client_id")
+		return
+	}
+	if !contains(client.RedirectURIs, req.RedirectURI) {
+		p.renderError(c, "invalid_request", "redirect_uri is not registered for this client")
+		return
+	}
+
+	switch {
+	case req.ResponseType != "code":
+		p.redirectError(c, req, "unsupported_response_type", "only the code response type is supported")
+		return
+	case !contains(strings.Fields(req.Scope), "openid"):
+		p.redirectError(c, req, "invalid_scope", "the openid scope is required")
+		return
+	case req.CodeChallengeMethod != "S256":
+		p.redirectError(c, req, "invalid_request", "PKCE with code_challenge_method=S256 is required")
+		return
+	case !validPKCEValue(req.CodeChallenge):
+		p.redirectError(c, req, "invalid_request", "code_challenge is invalid")
+		return
+	}
+
+	if p.config.Sessions != nil {
+		if sess, err := p.config.Sessions.Get(c); err == nil {
+			p.issueCode(c, client, req, sess.User, sess.CreatedAt)
+			return
+		}
+	}
+
+	if c.Request.Method == http.MethodGet {
+		p.renderLogin(c, http.StatusOK, client, req, "")
+		return
+	}
+
+	username := c.PostForm("username")
+	if p.config.Lockout != nil {
+		lock, err := p.config.Lockout.Status(c.Request.Context(), username)
+		if err != nil {
+			p.logger.Error("Failed to check account lockout", "error", err)
+			p.renderLogin(c, http.StatusServiceUnavailable, client, req, i18n.Message(c, "INTERNAL_ERROR"))
+			return
+		}
+		if lock != nil {
+			p.logger.Warn("OIDC login rejected", "client_id", client.ID, "code", "ACCOUNT_LOCKED", "ip", c.ClientIP())
+			c.Header("Retry-After", strconv.Itoa(int(time.Until(lock.Until).Seconds())+1))
+			p.renderLogin(c, http.StatusLocked, client, req, i18n.Message(c, "ACCOUNT_LOCKED"))
+			return
+		}
+	}
+
+	user, err := p.users.Authenticate(c.Request.Context(), username, c.PostForm("password"))
+	if err != nil {
+		status, code := http.StatusUnauthorized, "INVALID_CREDENTIALS"
+		if errors.Is(err, ErrInvalidCredentials) {
+			status, code = p.loginFailed(c, username, status, code)
+		} else {
+			p.logger.Error("OIDC user authentication failed", "error", err)
+		}
+		p.logger.Warn("OIDC login rejected", "client_id", client.ID, "code", code, "ip", c.ClientIP())
+		p.renderLogin(c, status, client, req, i18n.Message(c, code))
+		return
+	}
+	if p.config.Lockout != nil {
+		if err := p.config.Lockout.Success(c.Request.Context(), username); err != nil {
+			p.logger.Warn("Failed to reset login failures", "error", err)
+		}
+	}
+
+	if p.config.Sessions != nil {
+		if _, err := p.config.Sessions.Create(c, *user); err != nil {
+			p.logger.Error("Failed to create SSO session", "error", err)
+		}
+	}
+	p.issueCode(c, client, req, *user, time.Now())
+}
+
+// loginFailed counts a wrong password for username towards lockout and IP
+// blocking, returning the status and code to answer with: those of the
+// lock or block when this failure caused one, and otherwise status and code
+func (p *Provider) loginFailed(c *gin.Context, username string, status int, code string) (int, string) {
+	if p.config.Lockout != nil {
+		if lock, err := p.config.Lockout.Failure(c.Request.Context(), username); err != nil {
+			p.logger.Error("Failed to record failed login", "error", err)
+		} else if lock != nil {
+			status, code = http.StatusLocked, "ACCOUNT_LOCKED"
+		}
+	}
+	if p.config.BruteForce != nil {
+		blocks, err := p.config.BruteForce.Failure(c.Request.Context(), c.ClientIP(), username)
+		if err != nil {
+			p.logger.Error("Failed to record distributed login failure", "error", err)
+		}
+		for _, block := range blocks {
+			if block.IP == c.ClientIP() {
+				status, code = http.StatusTooManyRequests, "IP_BLOCKED"
+			}
+		}
+	}
+	return status, code
+}
+
+// issueCode stores an authorization grant for user and redirects to the client
+func (p *Provider) issueCode(c *gin.Context, client Client, req authorizeRequest, user interfaces.UserInfo, authTime time.Time) {
+	code, err := randomToken()
+	if err != nil {
+		p.redirectError(c, req, "server_error", "failed to issue authorization code")
+		return
+	}
+	grant, _ := json.Marshal(authorizationGrant{
+		ClientID:      client.ID,
+		RedirectURI:   req.RedirectURI,
+		Scope:         req.Scope,
+		Nonce:         req.Nonce,
+		CodeChallenge: req.CodeChallenge,
+		User:          user,
+		AuthTime:      authTime.Unix(),
+	})
+	if err := p.store.Set(c.Request.Context(), codeKeyPrefix+code, grant, p.config.CodeTTL); err != nil {
+		p.logger.Error("Failed to store authorization code", "error", err)
+		p.redirectError(c, req, "server_error", "failed to issue authorization code")
+		return
+	}
+
+	p.logger.Info("OIDC authorization code issued", "client_id", client.ID, "user_id", user.ID)
+	p.redirect(c, req, url.Values{"code": {code}})
+}
+
+func (p *Provider) handleToken(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	c.Header("Pragma", "no-cache")
+
+	client, ok := p.authenticateClient(c)
+	if !ok {
+		return
+	}
+	if grantType := c.PostForm("grant_type"); grantType != "authorization_code" {
+		p.tokenError(c, http.StatusBadRequest, "unsupported_grant_type", "only authorization_code is supported")
+		return
+	}
+
+	grant, err := p.redeemCode(c.Request.Context(), c.PostForm("code"))
+	if err != nil {
+		p.tokenError(c, http.StatusBadRequest, "invalid_grant", "authorization code is invalid, expired or already used")
+		return
+	}
+	if grant.ClientID != client.ID || grant.RedirectURI != c.PostForm("redirect_uri") {
+		p.tokenError(c, http.StatusBadRequest, "invalid_grant", "authorization code was issued to another client or redirect_uri")
+		return
+	}
+	if !verifyPKCE(c.PostForm("code_verifier"), grant.CodeChallenge) {
+		p.tokenError(c, http.StatusBadRequest, "invalid_grant", "code_verifier does not match code_challenge")
+		return
+	}
+
+	accessToken, idToken, err := p.issueTokens(c.Request.Context(), client, grant)
+	if err != nil {
+		p.logger.Error("Failed to sign OIDC tokens", "error", err)
+		p.tokenError(c, http.StatusInternalServerError, "server_error", "failed to issue tokens")
+		return
+	}
+
+	p.logger.Info("OIDC tokens issued", "client_id", client.ID, "user_id", grant.User.ID)
+	c.JSON(http.StatusOK, gin.H{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(p.config.AccessTokenTTL.Seconds()),
+		"id_token":     idToken,
+		"scope":        grant.Scope,
+	})
+}
+
+// authenticateClient supports client_secret_basic, client_secret_post and
+// public clients; it writes the error response itself
+func (p *Provider) authenticateClient(c *gin.Context) (Client, bool) {
+	clientID, secret, basic := c.Request.BasicAuth()
+	if basic {
+		// RFC 6749 section 2.3.1 form-encodes credentials before Basic encoding
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID, secret = c.PostForm("client_id"), c.PostForm("client_secret")
+	}
+
+	client, ok := p.clients[clientID]
+	if ok && client.Secret == "" && secret == "" {
+		return client, true
+	}
+	if !ok || client.Secret == "" || subtle.ConstantTimeCompare([]byte(client.Secret), []byte(secret)) != 1 {
+		if basic {
+			c.Header("WWW-Authenticate", `Basic realm="oauth2"`)
+		}
+		p.tokenError(c, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return Client{}, false
+	}
+	return client, true
+}
+
+// redeemCode consumes an authorization code exactly once across replicas
+func (p *Provider) redeemCode(ctx context.Context, code string) (*authorizationGrant, error) {
+	if code == "" {
+		return nil, store.ErrNotFound
+	}
+	uses, _, err := p.store.Incr(ctx, codeUsedKeyPrefix+code, p.config.CodeTTL)
+	if err != nil {
+		return nil, err
+	}
+	data, err := p.store.Get(ctx, codeKeyPrefix+code)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.store.Delete(ctx, codeKeyPrefix+code); err != nil {
+		p.logger.Warn("Failed to delete redeemed authorization code", "error", err)
+	}
+	if uses > 1 {
+		return nil, errors.New("authorization code replayed")
+	}
+
+	var grant authorizationGrant
+	if err := json.Unmarshal(data, &grant); err != nil {
+		return nil, err
+	}
+	return &grant, nil
+}
+
+func (p *Provider) issueTokens(ctx context.Context, client Client, grant *authorizationGrant) (string, string, error) {
+	jti, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+	scopes := strings.Fields(grant.Scope)
+
+	mapping := p.config.ClaimMapping
+	data := ClaimData{User: grant.User, ClientID: client.ID, Scopes: scopes}
+	if mapping != nil && mapping.NeedsTrust() && p.config.Trust != nil {
+		if data.Trust, err = trustClaims(ctx, p.config.Trust, p.config.AccessLevels, grant.User); err != nil {
+			return "", "", err
+		}
+	}
+
+	access := map[string]interface{}{
+		"sub":                grant.User.ID,
+		"aud":                client.ID,
+		"client_id":          client.ID,
+		"scope":              grant.Scope,
+		"jti":                jti,
+		"token_use":          "access",
+		"preferred_username": grant.User.Username,
+		"roles":              grant.User.Roles,
+	}
+	if contains(scopes, "email") {
+		access["email"] = grant.User.Email
+	}
+	if mapping != nil {
+		if err := mapping.Apply(TokenAccess, access, data); err != nil {
+			return "", "", err
+		}
+	}
+	accessToken, err := p.issuer.Sign(access, p.config.AccessTokenTTL)
+	if err != nil {
+		return "", "", err
+	}
+
+	atHash := sha256.Sum256([]byte(accessToken))
+	id := map[string]interface{}{
+		"sub":       grant.User.ID,
+		"aud":       client.ID,
+		"azp":       client.ID,
+		"auth_time": grant.AuthTime,
+		"at_hash":   base64.RawURLEncoding.EncodeToString(atHash[:16]),
+		"token_use": "id",
+	}
+	if grant.Nonce != "" {
+		id["nonce"] = grant.Nonce
+	}
+	if contains(scopes, "profile") {
+		id["preferred_username"] = grant.User.Username
+		id["roles"] = grant.User.Roles
+	}
+	if contains(scopes, "email") {
+		id["email"] = grant.User.Email
+	}
+	if mapping != nil {
+		if err := mapping.Apply(TokenID, id, data); err != nil {
+			return "", "", err
+		}
+	}
+	idToken, err := p.issuer.Sign(id, p.config.IDTokenTTL)
+	if err != nil {
+		return "", "", err
+	}
+	return accessToken, idToken, nil
+}
+
+func (p *Provider) handleUserInfo(c *gin.Context) {
+	header := c.GetHeader("Authorization")
+	token := strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	claims, err := p.issuer.Verify(token)
+	if err != nil || !strings.HasPrefix(header, "Bearer ") || claims["token_use"] != "access" {
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		p.tokenError(c, http.StatusUnauthorized, "invalid_token", "access token is invalid or expired")
+		return
+	}
+
+	info := gin.H{"sub": claims["sub"]}
+	for _, claim := range []string{"preferred_username", "email", "roles"} {
+		if value, ok := claims[claim]; ok {
+			info[claim] = value
+		}
+	}
+	c.JSON(http.StatusOK, info)
+}
+
+// redirect sends the user agent back to the client with params, state and iss
+func (p *Provider) redirect(c *gin.Context, req authorizeRequest, params url.Values) {
+	target, err := url.Parse(req.RedirectURI)
+	if err != nil {
+		p.renderError(c, "invalid_request", "redirect_uri is invalid")
+		return
+	}
+	query := target.Query()
+	for k, v := range params {
+		query[k] = v
+	}
+	if req.State != "" {
+		query.Set("state", req.State)
+	}
+	query.Set("iss", p.issuer.URL())
+	target.RawQuery = query.Encode()
+	c.Redirect(http.StatusFound, target.String())
+}
+
+func (p *Provider) redirectError(c *gin.Context, req authorizeRequest, code, description string) {
+	p.redirect(c, req, url.Values{"error": {code}, "error_description": {description}})
+}
+
+func (p *Provider) tokenError(c *gin.Context, status int, code, description string) {
+	c.AbortWithStatusJSON(status, gin.H{
+		"error":             code,
+		"error_description": description,
+	})
+}
+
+// verifyPKCE checks an S256 code verifier against the stored challenge
+func verifyPKCE(verifier, challenge string) bool {
+	if !validPKCEValue(verifier) {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	computed := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) == 1
+}
+
+// validPKCEValue checks the RFC 7636 length and character set, which is the
+// same for verifiers and S256 challenges
+func validPKCEValue(s string) bool {
+	if len(s) < 43 || len(s) > 128 {
+		return false
+	}
+	for _, r := range s {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+		case r == '-', r == '.', r == '_', r == '~':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,48 @@
+package oidc
+
+import (
+	"context"
+	"errors"
+
+	"github.com/lsendel/impl-zamaz/pkg/auth"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+)
+
+// ErrInvalidCredentials is returned when a username or password is wrong
+var ErrInvalidCredentials = errors.New("oidc: invalid credentials")
+
+// UserAuthenticator verifies end-user credentials at the authorization endpoint
+type UserAuthenticator interface {
+	Authenticate(ctx context.Context, username, password string) (*interfaces.UserInfo, error)
+}
+
+// StaticUser is an entry in a users file
+type StaticUser = auth.LocalUser
+
+// StaticUsers authenticates against a fixed set of users
+type StaticUsers struct {
+	local *auth.LocalUsers
+}
+
+// NewStaticUsers creates an authenticator from users
+func NewStaticUsers(users []StaticUser) *StaticUsers {
+	return &StaticUsers{local: auth.NewLocalUsers(users)}
+}
+
+// LoadStaticUsers reads a JSON array of users from path
+func LoadStaticUsers(path string) (*StaticUsers, error) {
+	local, err := auth.LoadLocalUsers(path)
+	if err != nil {
+		return nil, err
+	}
+	return &StaticUsers{local: local}, nil
+}
+
+// Authenticate implements UserAuthenticator
+func (s *StaticUsers) Authenticate(_ context.Context, username, password string) (*interfaces.UserInfo, error) {
+	user, err := s.local.Verify(username, password)
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	return user, nil
+}
@@ -0,0 +1,204 @@
+package policy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Bundle is a set of policies exported or imported together, such as a
+// file kept in git
+type Bundle struct {
+	Policies []Policy `json:"policies" yaml:"policies"`
+}
+
+// What importing a bundle does to each policy
+const (
+	ImportCreate    = "create"
+	ImportUpdate    = "update"
+	ImportUnchanged = "unchanged"
+	ImportDelete    = "delete"
+	ImportReject    = "reject"
+)
+
+// ImportOptions configures Import
+type ImportOptions struct {
+	// DryRun plans the import without changing any policy
+	DryRun bool
+	// Prune deletes the policies the bundle does not have, so the bundle
+	// becomes the whole set
+	Prune bool
+}
+
+// ImportChange is what an import does, or would do, to a policy
+type ImportChange struct {
+	// Policy is the position of the policy in the bundle from 1, or 0 for
+	// one pruned
+	Policy int    `json:"policy,omitempty"`
+	ID     string `json:"id,omitempty"`
+	Name   string `json:"name"`
+	Action string `json:"action"`
+	// Error is why the policy was rejected
+	Error string `json:"error,omitempty"`
+}
+
+// ImportResult reports an import. Nothing is changed when it is a dry run
+// or any policy is rejected.
+type ImportResult struct {
+	DryRun    bool           `json:"dry_run"`
+	Applied   bool           `json:"applied"`
+	Created   int            `json:"created"`
+	Updated   int            `json:"updated"`
+	Unchanged int            `json:"unchanged"`
+	Deleted   int            `json:"deleted"`
+	Rejected  int            `json:"rejected"`
+	Changes   []ImportChange `json:"changes"`
+}
+
+// Export returns every policy as a bundle
+func (e *Engine) Export(ctx context.Context) (*Bundle, error) {
+	policies, err := e.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	bundle := &Bundle{Policies: make([]Policy, 0, len(policies))}
+	for _, p := range policies {
+		bundle.Policies = append(bundle.Policies, *p)
+	}
+	return bundle, nil
+}
+
+// Import makes the stored policies match bundle. A policy in the bundle
+// replaces the stored one with its ID or, failing that, the only one with
+// its name; others are created. Versions and times in the bundle are
+// ignored. With Prune, stored policies the bundle does not replace are
+// deleted.
+//
+// Every policy is checked before any is changed, so an import with a
+// rejected policy changes nothing. An import that fails while applying
+// returns the changes made so far with the error.
+func (e *Engine) Import(ctx context.Context, bundle Bundle, opts ImportOptions) (*ImportResult, error) {
+	if len(bundle.Policies) == 0 {
+		return nil, fmt.Errorf("%w: bundle has no policies", ErrInvalid)
+	}
+	stored, err := e.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]*Policy, len(stored))
+	byName := make(map[string][]*Policy, len(stored))
+	for _, p := range stored {
+		byID[p.ID] = p
+		byName[p.Name] = append(byName[p.Name], p)
+	}
+
+	result := &ImportResult{DryRun: opts.DryRun, Changes: make([]ImportChange, 0, len(bundle.Policies))}
+	planned := make([]Policy, len(bundle.Policies))
+	claimed := make(map[string]int, len(bundle.Policies))
+	names := make(map[string]int, len(bundle.Policies))
+	for i, p := range bundle.Policies {
+		change := ImportChange{Policy: i + 1}
+		target, err := plan(&p, byID, byName)
+		switch {
+		case err != nil:
+		case target != nil && claimed[target.ID] > 0:
+			err = fmt.Errorf("replaces the same policy as policy %d", claimed[target.ID])
+		case names[p.Name] > 0:
+			err = fmt.Errorf("has the same name as policy %d", names[p.Name])
+		}
+		change.Name = p.Name
+		switch {
+		case err != nil:
+			change.Action, change.Error = ImportReject, err.Error()
+			result.Rejected++
+		case target == nil:
+			change.Action = ImportCreate
+			result.Created++
+		default:
+			claimed[target.ID] = i + 1
+			change.ID = target.ID
+			if sameContent(*target, p) {
+				change.Action = ImportUnchanged
+				result.Unchanged++
+			} else {
+				change.Action = ImportUpdate
+				result.Updated++
+			}
+		}
+		if err == nil {
+			names[p.Name] = i + 1
+		}
+		planned[i] = p
+		result.Changes = append(result.Changes, change)
+	}
+	if opts.Prune {
+		for _, p := range stored {
+			if claimed[p.ID] == 0 {
+				result.Changes = append(result.Changes, ImportChange{ID: p.ID, Name: p.Name, Action: ImportDelete})
+				result.Deleted++
+			}
+		}
+	}
+	if result.Rejected > 0 || opts.DryRun {
+		return result, nil
+	}
+	if total := len(stored) - result.Deleted + result.Created; total > e.config.MaxPolicies {
+		return nil, fmt.Errorf("%w: at most %d", ErrLimit, e.config.MaxPolicies)
+	}
+
+	// Deletions go first to make room for creations
+	for _, action := range []string{ImportDelete, ImportUpdate, ImportCreate} {
+		for i := range result.Changes {
+			change := &result.Changes[i]
+			if change.Action != action {
+				continue
+			}
+			switch action {
+			case ImportDelete:
+				err = e.Delete(ctx, change.ID)
+			case ImportUpdate:
+				_, err = e.Update(ctx, change.ID, planned[change.Policy-1])
+			case ImportCreate:
+				var created *Policy
+				if created, err = e.Create(ctx, planned[change.Policy-1]); err == nil {
+					change.ID = created.ID
+				}
+			}
+			if err != nil {
+				return result, fmt.Errorf("policy %q: %w", change.Name, err)
+			}
+		}
+	}
+	result.Applied = true
+	return result, nil
+}
+
+// plan validates p and finds the stored policy it replaces, if any
+func plan(p *Policy, byID map[string]*Policy, byName map[string][]*Policy) (*Policy, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	if target, ok := byID[p.ID]; ok {
+		return target, nil
+	}
+	switch named := byName[p.Name]; len(named) {
+	case 0:
+		return nil, nil
+	case 1:
+		return named[0], nil
+	default:
+		return nil, fmt.Errorf("%d policies are named %q; give the id of the one to replace", len(named), p.Name)
+	}
+}
+
+// sameContent reports whether a and b differ only in ID, version and times
+func sameContent(a, b Policy) bool {
+	for _, p := range []*Policy{&a, &b} {
+		p.ID, p.Version, p.CreatedAt, p.UpdatedAt = "", 0, time.Time{}, time.Time{}
+	}
+	x, errA := json.Marshal(a)
+	y, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(x, y)
+}
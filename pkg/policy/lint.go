@@ -0,0 +1,384 @@
+package policy
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Lint rules
+const (
+	// LintInvalid is a policy that fails validation
+	LintInvalid = "invalid"
+	// LintUnreachable is a policy that never decides a request: its
+	// conditions contradict each other, or it allows only what a deny
+	// without conditions always denies
+	LintUnreachable = "unreachable"
+	// LintConflict is an allow and a deny that apply to some of the same
+	// requests; the deny wins where both hold
+	LintConflict = "conflict"
+	// LintBroadWildcard is an allow matching every subject and resource,
+	// or a resource pattern starting with a wildcard
+	LintBroadWildcard = "broad_wildcard"
+	// LintDuplicate is a policy that differs from another only in name
+	LintDuplicate = "duplicate"
+)
+
+// Severities of lint findings
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+	SeverityInfo    = "info"
+)
+
+// severityOrder sorts findings, most severe first
+var severityOrder = map[string]int{SeverityError: 0, SeverityWarning: 1, SeverityInfo: 2}
+
+// LintRef names a linted policy: by ID when it is stored and by its
+// position in the bundle when it comes from one
+type LintRef struct {
+	ID     string `json:"id,omitempty"`
+	Name   string `json:"name"`
+	Policy int    `json:"policy,omitempty"`
+}
+
+// Finding is a likely mistake in the policies
+type Finding struct {
+	Rule     string    `json:"rule"`
+	Severity string    `json:"severity"`
+	Policies []LintRef `json:"policies"`
+	Message  string    `json:"message"`
+}
+
+// LintResult lists the findings, most severe first
+type LintResult struct {
+	Findings []Finding `json:"findings"`
+	Errors   int       `json:"errors"`
+	Warnings int       `json:"warnings"`
+}
+
+// linted is a policy under lint
+type linted struct {
+	ref LintRef
+	p   *Policy
+}
+
+// Lint checks the policies bundle would leave, as Import would apply it,
+// for mistakes. With Prune it checks the bundle alone; an empty bundle
+// checks the stored policies.
+func (e *Engine) Lint(ctx context.Context, bundle Bundle, opts ImportOptions) (*LintResult, error) {
+	stored, err := e.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]*Policy, len(stored))
+	byName := make(map[string][]*Policy, len(stored))
+	for _, p := range stored {
+		byID[p.ID] = p
+		byName[p.Name] = append(byName[p.Name], p)
+	}
+
+	var findings []Finding
+	policies := make([]linted, 0, len(bundle.Policies)+len(stored))
+	replaced := make(map[string]bool, len(bundle.Policies))
+	for i := range bundle.Policies {
+		p := bundle.Policies[i]
+		target, err := plan(&p, byID, byName)
+		ref := LintRef{Name: p.Name, Policy: i + 1}
+		if err != nil {
+			findings = append(findings, Finding{Rule: LintInvalid, Severity: SeverityError, Policies: []LintRef{ref}, Message: err.Error()})
+			continue
+		}
+		if target != nil {
+			ref.ID = target.ID
+			replaced[target.ID] = true
+		}
+		policies = append(policies, linted{ref: ref, p: &p})
+	}
+	if !opts.Prune || len(bundle.Policies) == 0 {
+		for _, p := range stored {
+			if !replaced[p.ID] {
+				policies = append(policies, linted{ref: LintRef{ID: p.ID, Name: p.Name}, p: p})
+			}
+		}
+	}
+	return lint(policies, findings), nil
+}
+
+func lint(policies []linted, findings []Finding) *LintResult {
+	unreachable := make(map[int]bool)
+	for i, l := range policies {
+		if reason := unsatisfiable(l.p.Conditions); reason != "" {
+			unreachable[i] = true
+			findings = append(findings, Finding{
+				Rule: LintUnreachable, Severity: SeverityError, Policies: []LintRef{l.ref},
+				Message: "its conditions never hold: " + reason,
+			})
+		}
+		findings = append(findings, broad(l)...)
+	}
+
+	for i, a := range policies {
+		for j := i + 1; j < len(policies); j++ {
+			b := policies[j]
+			if sameRules(a.p, b.p) {
+				findings = append(findings, Finding{
+					Rule: LintDuplicate, Severity: SeverityInfo, Policies: []LintRef{a.ref, b.ref},
+					Message: fmt.Sprintf("%q and %q differ only in name", a.ref.Name, b.ref.Name),
+				})
+				continue
+			}
+			allow, deny := a, b
+			if allow.p.Effect == deny.p.Effect || unreachable[i] || unreachable[j] {
+				continue
+			}
+			if allow.p.Effect == EffectDeny {
+				allow, deny = deny, allow
+			}
+			switch {
+			case len(deny.p.Conditions) == 0 && covers(deny.p, allow.p):
+				findings = append(findings, Finding{
+					Rule: LintUnreachable, Severity: SeverityError, Policies: []LintRef{allow.ref, deny.ref},
+					Message: fmt.Sprintf("%q allows only requests %q always denies", allow.ref.Name, deny.ref.Name),
+				})
+			case overlaps(allow.p, deny.p):
+				findings = append(findings, Finding{
+					Rule: LintConflict, Severity: SeverityWarning, Policies: []LintRef{allow.ref, deny.ref},
+					Message: fmt.Sprintf("%q denies some requests %q allows, where the conditions of both hold", deny.ref.Name, allow.ref.Name),
+				})
+			}
+		}
+	}
+
+	sort.SliceStable(findings, func(i, j int) bool {
+		return severityOrder[findings[i].Severity] < severityOrder[findings[j].Severity]
+	})
+	result := &LintResult{Findings: findings}
+	if result.Findings == nil {
+		result.Findings = []Finding{}
+	}
+	for _, f := range findings {
+		switch f.Severity {
+		case SeverityError:
+			result.Errors++
+		case SeverityWarning:
+			result.Warnings++
+		}
+	}
+	return result
+}
+
+// broad reports the wildcards of l that match more than likely meant
+func broad(l linted) []Finding {
+	var findings []Finding
+	if l.p.Effect == EffectAllow && len(l.p.Conditions) == 0 && contains(l.p.Subjects, "*") && contains(l.p.Resources, "*") {
+		findings = append(findings, Finding{
+			Rule: LintBroadWildcard, Severity: SeverityWarning, Policies: []LintRef{l.ref},
+			Message: "it allows every subject on every resource without conditions",
+		})
+	}
+	for _, resource := range l.p.Resources {
+		if resource != "*" && strings.HasPrefix(resource, "*") {
+			findings = append(findings, Finding{
+				Rule: LintBroadWildcard, Severity: SeverityInfo, Policies: []LintRef{l.ref},
+				Message: fmt.Sprintf("resource %q starts with a wildcard, so it matches under any path", resource),
+			})
+		}
+	}
+	return findings
+}
+
+// covers reports whether outer's subjects, resources and actions match
+// every request inner's do. It may miss some coverage by wildcards, but
+// never reports coverage there is not.
+func covers(outer, inner *Policy) bool {
+	return coversAll(outer.Subjects, inner.Subjects) && coversAll(outer.Resources, inner.Resources) && coversAll(outer.Actions, inner.Actions)
+}
+
+func coversAll(outer, inner []string) bool {
+	for _, in := range inner {
+		covered := false
+		for _, out := range outer {
+			if coversPattern(out, in) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			return false
+		}
+	}
+	return true
+}
+
+// coversPattern reports whether outer matches whatever inner does, for
+// outer patterns that are literal or end with their only wildcard
+func coversPattern(outer, inner string) bool {
+	if outer == "*" || outer == inner {
+		return true
+	}
+	if _, _, ok := selector(inner); ok {
+		// Only a selector of the same tag covers a selector
+		if key, _, ok := selector(outer); !ok || !strings.HasPrefix(inner, ResourceSelector+key+"=") {
+			return false
+		}
+	}
+	i := strings.Index(outer, "*")
+	if i != len(outer)-1 {
+		return false
+	}
+	literal := inner
+	if j := strings.Index(inner, "*"); j >= 0 {
+		literal = inner[:j]
+	}
+	return strings.HasPrefix(literal, outer[:i])
+}
+
+// overlaps reports whether some request matches both a and b, leaving
+// their conditions aside
+func overlaps(a, b *Policy) bool {
+	subjects := false
+	for _, x := range a.Subjects {
+		for _, y := range b.Subjects {
+			// A user may have any role, so only distinct users never meet
+			if x == "*" || y == "*" || x == y || !strings.HasPrefix(x, SubjectUser) || !strings.HasPrefix(y, SubjectUser) {
+				subjects = true
+			}
+		}
+	}
+	return subjects && resourcesOverlap(a.Resources, b.Resources) && patternsOverlap(a.Actions, b.Actions)
+}
+
+// resourcesOverlap is patternsOverlap for resources, where a tag selector
+// may select a resource of any name or with any other tag
+func resourcesOverlap(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			xKey, xValue, xTag := selector(x)
+			yKey, yValue, yTag := selector(y)
+			switch {
+			case xTag && yTag && xKey == yKey:
+				if intersect(xValue, yValue) {
+					return true
+				}
+			case xTag || yTag, intersect(x, y):
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func patternsOverlap(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if intersect(x, y) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// intersect reports whether some value matches both patterns
+func intersect(a, b string) bool {
+	seen := make(map[[2]int]bool)
+	var step func(i, j int) bool
+	step = func(i, j int) bool {
+		if i == len(a) && j == len(b) {
+			return true
+		}
+		key := [2]int{i, j}
+		if seen[key] {
+			return false
+		}
+		seen[key] = true
+		if i < len(a) && a[i] == '*' && (step(i+1, j) || j < len(b) && step(i, j+1)) {
+			return true
+		}
+		if j < len(b) && b[j] == '*' && (step(i, j+1) || i < len(a) && step(i+1, j)) {
+			return true
+		}
+		return i < len(a) && j < len(b) && a[i] != '*' && b[j] != '*' && a[i] == b[j] && step(i+1, j+1)
+	}
+	return step(0, 0)
+}
+
+// unsatisfiable explains why conditions can never all hold, or returns ""
+// when they may. Values an attribute must equal and numeric ranges are
+// checked; other contradictions are not found.
+func unsatisfiable(conditions []Condition) string {
+	// bounds are what conditions leave of an attribute: the values it may
+	// equal and the range it may be in
+	type bounds struct {
+		allowed, excluded []string
+		low, high         float64
+		openLow, openHigh bool
+	}
+	attributes := make(map[string]*bounds)
+	var order []string
+	for _, cond := range conditions {
+		b, ok := attributes[cond.Attribute]
+		if !ok {
+			b = &bounds{low: math.Inf(-1), high: math.Inf(1)}
+			attributes[cond.Attribute] = b
+			order = append(order, cond.Attribute)
+		}
+		switch cond.Operator {
+		case OpEquals, OpIn:
+			if b.allowed == nil {
+				b.allowed = append([]string{}, cond.Values...)
+				continue
+			}
+			kept := b.allowed[:0]
+			for _, v := range b.allowed {
+				if contains(cond.Values, v) {
+					kept = append(kept, v)
+				}
+			}
+			b.allowed = kept
+		case OpNotEquals, OpNotIn:
+			b.excluded = append(b.excluded, cond.Values...)
+		case OpGreaterThan, OpGreaterOrEqual:
+			v, err := strconv.ParseFloat(cond.Values[0], 64)
+			if err == nil && (v > b.low || v == b.low && cond.Operator == OpGreaterThan) {
+				b.low, b.openLow = v, cond.Operator == OpGreaterThan
+			}
+		case OpLessThan, OpLessOrEqual:
+			v, err := strconv.ParseFloat(cond.Values[0], 64)
+			if err == nil && (v < b.high || v == b.high && cond.Operator == OpLessThan) {
+				b.high, b.openHigh = v, cond.Operator == OpLessThan
+			}
+		}
+	}
+	for _, attribute := range order {
+		b := attributes[attribute]
+		if b.allowed != nil {
+			possible := 0
+			for _, v := range b.allowed {
+				if !contains(b.excluded, v) {
+					possible++
+				}
+			}
+			if possible == 0 {
+				return fmt.Sprintf("no value of %s passes them all", attribute)
+			}
+		}
+		if b.low > b.high || b.low == b.high && (b.openLow || b.openHigh) {
+			return fmt.Sprintf("no number is in the range they give %s", attribute)
+		}
+	}
+	return ""
+}
+
+// sameRules reports whether a and b differ only in name, ID, version and
+// times
+func sameRules(a, b *Policy) bool {
+	x, y := *a, *b
+	x.Name, y.Name = "", ""
+	x.Description, y.Description = "", ""
+	return sameContent(x, y)
+}
@@ -0,0 +1,242 @@
+package policy
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lsendel/impl-zamaz/pkg/audit"
+	"github.com/lsendel/impl-zamaz/pkg/i18n"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+)
+
+// Obligations the server fulfils, see PDPConfig
+const (
+	// ObligationStepUp requires the caller to have stepped up
+	ObligationStepUp = "step_up"
+	// ObligationMask masks fields of the response, e.g. "mask:email"
+	ObligationMask = "mask"
+	// ObligationAudit records the request and its outcome in the audit
+	// log, e.g. "audit:pii-access"
+	ObligationAudit = "audit"
+)
+
+// MaskedValue replaces the masked fields of responses
+const MaskedValue = "***"
+
+// ObligationName is the name of obligation, without its argument
+func ObligationName(obligation string) string {
+	name, _, _ := strings.Cut(obligation, ":")
+	return name
+}
+
+// groupObligations lists the names of obligations in the order they first
+// appear, with the arguments given to each
+func groupObligations(obligations []string) ([]string, map[string][]string) {
+	var names []string
+	args := make(map[string][]string)
+	for _, obligation := range obligations {
+		name, arg, ok := strings.Cut(obligation, ":")
+		if _, seen := args[name]; !seen {
+			names = append(names, name)
+			args[name] = nil
+		}
+		if ok && !contains(args[name], arg) {
+			args[name] = append(args[name], arg)
+		}
+	}
+	return names, args
+}
+
+// MaskFields fulfils the mask obligation. Its arguments are the fields of
+// JSON responses to replace with MaskedValue: a name masks the field
+// wherever it is, and a dotted path from the top, where "*" is any field
+// or element, masks only there, e.g. "devices.*.serial". NDJSON responses
+// are masked line by line, and other content types, such as CSV exports,
+// pass through unchanged. A JSON response that cannot be parsed is
+// replaced with 500 INTERNAL_ERROR.
+func MaskFields() Obligation {
+	return Obligation{
+		Before: func(c *gin.Context, _ []string) bool {
+			c.Writer = &maskWriter{ResponseWriter: c.Writer}
+			return true
+		},
+		After: func(c *gin.Context, args []string) {
+			w, ok := c.Writer.(*maskWriter)
+			if !ok {
+				return
+			}
+			c.Writer = w.ResponseWriter
+			body := w.body.Bytes()
+			mask := maskerFor(w.Header().Get("Content-Type"))
+			if mask != nil && len(bytes.TrimSpace(body)) > 0 {
+				var err error
+				if body, err = mask(body, args); err != nil {
+					c.Header("Content-Type", "application/json; charset=utf-8")
+					c.Status(http.StatusInternalServerError)
+					body, _ = json.Marshal(gin.H{
+						"error": i18n.Message(c, "INTERNAL_ERROR"),
+						"code":  "INTERNAL_ERROR",
+					})
+				}
+			}
+			c.Writer.Header().Del("Content-Length")
+			c.Writer.WriteHeaderNow()
+			_, _ = c.Writer.Write(body)
+		},
+	}
+}
+
+// AuditRequests fulfils the audit obligation, recording a policy.audit
+// event in log once each request is answered: its method, path, status,
+// address and user agent, the policies that decided it and, as reasons,
+// the obligation's arguments. tenant picks the audit stream.
+func AuditRequests(log *audit.Log, tenant func(*gin.Context) string, logger interfaces.Logger) Obligation {
+	return Obligation{
+		After: func(c *gin.Context, args []string) {
+			var actor string
+			if user, ok := c.Get("user"); ok {
+				if info, ok := user.(*interfaces.UserInfo); ok {
+					actor = info.ID
+				}
+			}
+			data := map[string]interface{}{
+				"method":     c.Request.Method,
+				"path":       c.Request.URL.Path,
+				"status":     c.Writer.Status(),
+				"ip":         c.ClientIP(),
+				"user_agent": c.Request.UserAgent(),
+			}
+			if decision, ok := c.Get(DecisionKey); ok {
+				if d, ok := decision.(*Decision); ok {
+					data["policies"] = versioned(d)
+				}
+			}
+			if len(args) > 0 {
+				data["reasons"] = args
+			}
+			if _, err := log.Record(c.Request.Context(), tenant(c), "policy.audit", actor, data); err != nil {
+				logger.Error("Failed to record audit event", "path", c.Request.URL.Path, "error", err)
+			}
+		},
+	}
+}
+
+// maskWriter holds back the body of a response until its fields are
+// masked. The status passes through, as gin sends it only with the body.
+type maskWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *maskWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+func (w *maskWriter) WriteString(s string) (int, error) {
+	return w.body.WriteString(s)
+}
+
+// WriteHeaderNow waits for the body, which is sent with the header
+func (w *maskWriter) WriteHeaderNow() {}
+
+// Flush waits for the body too
+func (w *maskWriter) Flush() {}
+
+// maskerFor returns the function masking responses of contentType, or nil
+// for content types that are not masked
+func maskerFor(contentType string) func([]byte, []string) ([]byte, error) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil
+	}
+	switch mediaType {
+	case "application/json":
+		return maskJSON
+	case "application/x-ndjson":
+		return maskNDJSON
+	}
+	return nil
+}
+
+// maskNDJSON masks each line of body as a JSON document
+func maskNDJSON(body []byte, fields []string) ([]byte, error) {
+	var out bytes.Buffer
+	for _, line := range bytes.SplitAfter(body, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			out.Write(line)
+			continue
+		}
+		masked, err := maskJSON(line, fields)
+		if err != nil {
+			return nil, err
+		}
+		out.Write(masked)
+		if bytes.HasSuffix(line, []byte("\n")) {
+			out.WriteByte('\n')
+		}
+	}
+	return out.Bytes(), nil
+}
+
+func maskJSON(body []byte, fields []string) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+	paths := make([][]string, len(fields))
+	for i, field := range fields {
+		paths[i] = strings.Split(field, ".")
+	}
+	return json.Marshal(maskValue(doc, nil, paths))
+}
+
+func maskValue(v interface{}, path []string, fields [][]string) interface{} {
+	if len(path) > 0 && masked(path, fields) {
+		return MaskedValue
+	}
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for key, value := range t {
+			t[key] = maskValue(value, append(path[:len(path):len(path)], key), fields)
+		}
+	case []interface{}:
+		for i, value := range t {
+			t[i] = maskValue(value, append(path[:len(path):len(path)], strconv.Itoa(i)), fields)
+		}
+	}
+	return v
+}
+
+// masked reports whether the value at path is one of fields
+func masked(path []string, fields [][]string) bool {
+	for _, field := range fields {
+		if len(field) == 1 {
+			if path[len(path)-1] == field[0] {
+				return true
+			}
+			continue
+		}
+		if len(field) != len(path) {
+			continue
+		}
+		same := true
+		for i := range field {
+			if field[i] != "*" && field[i] != path[i] {
+				same = false
+				break
+			}
+		}
+		if same {
+			return true
+		}
+	}
+	return false
+}
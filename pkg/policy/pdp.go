@@ -0,0 +1,334 @@
+package policy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lsendel/impl-zamaz/pkg/i18n"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/middleware"
+	"github.com/lsendel/impl-zamaz/pkg/trust"
+)
+
+// Actions of requests by method
+const (
+	ActionRead   = "read"
+	ActionWrite  = "write"
+	ActionDelete = "delete"
+)
+
+// Attributes the decision point adds to the context of a request, on top of
+// trust.RequestContext
+const (
+	// AttributeRoles is the caller's roles, comma-separated
+	AttributeRoles = "roles"
+	// AttributeRoute is the route template below Prefix, e.g.
+	// "devices/:id"
+	AttributeRoute = "route"
+	// AttributeTrustScore is the caller's trust score, rated only when a
+	// policy has a condition on it
+	AttributeTrustScore = "trust_score"
+)
+
+// DecisionKey is the gin context key holding the *Decision of a request
+const DecisionKey = "policy_decision"
+
+// Obligation fulfils an obligation of decisions, with the arguments the
+// deciding policies gave it: "mask:email" and "mask:phone" are the mask
+// obligation with email and phone. Either func may be nil.
+type Obligation struct {
+	// Before runs before the route, reporting whether the request may go
+	// on and answering it itself when not
+	Before func(c *gin.Context, args []string) bool
+	// After runs once the route has answered, e.g. to change or record the
+	// response
+	After func(c *gin.Context, args []string)
+}
+
+// PDPConfig configures the policy decision point
+type PDPConfig struct {
+	// Prefix is trimmed from request paths to name resources, so
+	// /api/v1/devices/42 is "devices/42"; defaults to "/api/v1/"
+	Prefix string
+	// Defaults are decided along with the stored policies, e.g. to keep
+	// administrative routes to administrators
+	Defaults []*Policy
+	// Trust, when set, rates callers for conditions on trust_score
+	Trust middleware.TrustSource
+	// Geo, when set, places callers' addresses for conditions on country
+	Geo trust.GeoLocator
+	// Obligations fulfil the obligations of decisions by name. A request
+	// whose decision has an obligation missing here is denied.
+	Obligations map[string]Obligation
+	// SensitiveFields are masked, as by the mask obligation, in the
+	// responses to callers Trust rates below SensitiveTrustLevel or cannot
+	// rate at all, e.g. "email" or "devices.*.serial". The mask obligation
+	// defaults to MaskFields.
+	SensitiveFields     []string
+	SensitiveTrustLevel int
+	// CacheTTL is how long stored policies are reused, so changes reach
+	// every replica within it; defaults to 10s
+	CacheTTL time.Duration
+}
+
+// DecisionPoint decides requests against the defaults and the stored
+// policies, for callers outside gin such as the Envoy ext_authz server
+type DecisionPoint struct {
+	config PDPConfig
+	engine *Engine
+
+	mu        sync.Mutex
+	policies  []*Policy
+	resources []*Resource
+	loaded    time.Time
+}
+
+// DecisionPoint creates a decision point. Trust is not used: callers add
+// the trust score to requests themselves.
+func (e *Engine) DecisionPoint(cfg PDPConfig) *DecisionPoint {
+	if cfg.Prefix == "" {
+		cfg.Prefix = "/api/v1/"
+	}
+	if cfg.CacheTTL <= 0 {
+		cfg.CacheTTL = 10 * time.Second
+	}
+	return &DecisionPoint{config: cfg, engine: e}
+}
+
+// Decide decides req, placing its ip for conditions on country and
+// tagging it as its resource is registered. A decision with an obligation
+// missing from Obligations is a deny.
+func (d *DecisionPoint) Decide(ctx context.Context, req Request) (*Decision, error) {
+	policies, resources, err := d.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return d.decide(policies, resources, req), nil
+}
+
+// Resource names the resource at path, e.g. "devices/42" for
+// /api/v1/devices/42
+func (d *DecisionPoint) Resource(path string) string {
+	return strings.Trim(strings.TrimPrefix(path, d.config.Prefix), "/")
+}
+
+func (d *DecisionPoint) decide(policies []*Policy, resources []*Resource, req Request) *Decision {
+	if req.Tags == nil {
+		req.Tags = ResourceTags(resources, req.Resource, req.Action)
+	}
+	if d.config.Geo != nil && req.Context[AttributeCountry] == "" {
+		if location, ok := d.config.Geo.Locate(net.ParseIP(req.Context[AttributeIP])); ok && location.Country != "" {
+			if req.Context == nil {
+				req.Context = make(map[string]string)
+			}
+			req.Context[AttributeCountry] = location.Country
+		}
+	}
+	decision := Decide(policies, req)
+	for _, obligation := range decision.Obligations {
+		if _, ok := d.config.Obligations[ObligationName(obligation)]; !ok && decision.Allowed {
+			decision.Allowed, decision.Effect = false, EffectDeny
+			decision.Reason = "obligation " + strconv.Quote(obligation) + " cannot be fulfilled"
+		}
+	}
+	return decision
+}
+
+// load returns the defaults and the stored policies, and the registered
+// resources, reloading these once CacheTTL has passed
+func (d *DecisionPoint) load(ctx context.Context) ([]*Policy, []*Resource, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.policies == nil || time.Since(d.loaded) >= d.config.CacheTTL {
+		stored, err := d.engine.List(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		resources, err := d.engine.ListResources(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		d.policies = append(append([]*Policy{}, d.config.Defaults...), stored...)
+		d.resources = resources
+		d.loaded = time.Now()
+	}
+	return d.policies, d.resources, nil
+}
+
+// pdp enforces the decisions of a decision point on gin requests
+type pdp struct {
+	point   *DecisionPoint
+	logger  interfaces.Logger
+	metrics interfaces.MetricsCollector
+}
+
+// Middleware is a policy decision point for the authenticated routes after
+// it. It decides whether the user may take the request's action on its
+// resource, answering 403 POLICY_DENIED when not, and fulfils the
+// decision's obligations, masking the sensitive fields for callers below
+// their trust level. It must run after authentication.
+func (e *Engine) Middleware(cfg PDPConfig, logger interfaces.Logger, metrics interfaces.MetricsCollector) gin.HandlerFunc {
+	if _, ok := cfg.Obligations[ObligationMask]; !ok && len(cfg.SensitiveFields) > 0 {
+		obligations := map[string]Obligation{ObligationMask: MaskFields()}
+		for name, obligation := range cfg.Obligations {
+			obligations[name] = obligation
+		}
+		cfg.Obligations = obligations
+	}
+	p := &pdp{point: e.DecisionPoint(cfg), logger: logger, metrics: metrics}
+	return p.handle
+}
+
+func (p *pdp) handle(c *gin.Context) {
+	user, _ := c.Get("user")
+	info, ok := user.(*interfaces.UserInfo)
+	if !ok || info == nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+			"error": i18n.Message(c, "UNAUTHORIZED"),
+			"code":  "UNAUTHORIZED",
+		})
+		return
+	}
+	policies, resources, err := p.point.load(c.Request.Context())
+	if err != nil {
+		p.logger.Error("Failed to load policies", "path", c.Request.URL.Path, "error", err)
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+			"error": i18n.Message(c, "INTERNAL_ERROR"),
+			"code":  "INTERNAL_ERROR",
+		})
+		return
+	}
+
+	req := p.input(c, info, policies)
+	decision := p.point.decide(policies, resources, req)
+	c.Set(DecisionKey, decision)
+	if p.metrics != nil {
+		p.metrics.IncrementCounter("policy_decisions_total", map[string]string{"effect": decision.Effect})
+	}
+	if !decision.Allowed {
+		p.logger.Warn("Request denied by policy", "user_id", info.ID, "resource", req.Resource, "action", req.Action, "policies", versioned(decision), "reason", decision.Reason)
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+			"error":    i18n.Message(c, "POLICY_DENIED"),
+			"code":     "POLICY_DENIED",
+			"policies": decision.Policies,
+		})
+		return
+	}
+	p.logger.Debug("Request allowed by policy", "user_id", info.ID, "resource", req.Resource, "action", req.Action, "policies", versioned(decision))
+	p.maskSensitive(decision, req, info)
+	names, args := groupObligations(decision.Obligations)
+	begun := 0
+	for ; begun < len(names); begun++ {
+		before := p.point.config.Obligations[names[begun]].Before
+		if before != nil && !before(c, args[names[begun]]) {
+			break
+		}
+	}
+	if begun == len(names) {
+		c.Next()
+	} else if !c.IsAborted() {
+		c.Abort()
+	}
+	// Like deferred calls, in reverse, and also when a later obligation
+	// stopped the request
+	for i := begun - 1; i >= 0; i-- {
+		if after := p.point.config.Obligations[names[i]].After; after != nil {
+			after(c, args[names[i]])
+		}
+	}
+}
+
+// maskSensitive obliges decision to mask the sensitive fields when the
+// caller is rated below their trust level, or could not be rated
+func (p *pdp) maskSensitive(decision *Decision, req Request, user *interfaces.UserInfo) {
+	config := p.point.config
+	if len(config.SensitiveFields) == 0 {
+		return
+	}
+	reason := "unrated"
+	if value, ok := req.Context[AttributeTrustScore]; ok {
+		if score, err := strconv.Atoi(value); err == nil {
+			if score >= config.SensitiveTrustLevel {
+				return
+			}
+			reason = "low_trust"
+		}
+	}
+	for _, field := range config.SensitiveFields {
+		if obligation := ObligationMask + ":" + field; !contains(decision.Obligations, obligation) {
+			decision.Obligations = append(decision.Obligations, obligation)
+		}
+	}
+	p.logger.Debug("Masking sensitive fields", "user_id", user.ID, "resource", req.Resource, "reason", reason)
+	if p.metrics != nil {
+		p.metrics.IncrementCounter("policy_sensitive_fields_masked_total", map[string]string{"reason": reason})
+	}
+}
+
+// input is the document decided for a request: the user and roles, the
+// resource and action, and the request's time, trust signals, route,
+// device and, when policies test it or sensitive fields depend on it, trust
+// score
+func (p *pdp) input(c *gin.Context, user *interfaces.UserInfo, policies []*Policy) Request {
+	attributes := trust.RequestContext(c)
+	attributes[AttributeRoles] = strings.Join(user.Roles, ",")
+	attributes[AttributeTime] = time.Now().UTC().Format(time.RFC3339)
+	if route := c.FullPath(); route != "" {
+		attributes[AttributeRoute] = strings.Trim(strings.TrimPrefix(route, p.point.config.Prefix), "/")
+	}
+	if p.point.config.Trust != nil && (testsTrust(policies) || len(p.point.config.SensitiveFields) > 0) {
+		if score, err := p.point.config.Trust.CurrentTrust(c); err == nil {
+			attributes[AttributeTrustScore] = strconv.Itoa(score.Overall)
+		} else {
+			// Conditions on the score do not hold without it
+			p.logger.Warn("Failed to rate caller for policy decision", "user_id", user.ID, "error", err)
+		}
+	}
+	return Request{
+		Subject:  user.ID,
+		Roles:    user.Roles,
+		Resource: p.point.Resource(c.Request.URL.Path),
+		Action:   MethodAction(c.Request.Method),
+		Context:  attributes,
+	}
+}
+
+// versioned lists the policies that made decision with their versions, e.g.
+// "default-allow@0,4f1c...@3"
+func versioned(decision *Decision) string {
+	policies := make([]string, len(decision.Policies))
+	for i, id := range decision.Policies {
+		policies[i] = id + "@" + strconv.Itoa(decision.Versions[id])
+	}
+	return strings.Join(policies, ",")
+}
+
+func testsTrust(policies []*Policy) bool {
+	for _, p := range policies {
+		for _, cond := range p.Conditions {
+			if cond.Attribute == AttributeTrustScore {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// MethodAction is the action of a request by its method
+func MethodAction(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return ActionRead
+	case http.MethodDelete:
+		return ActionDelete
+	default:
+		return ActionWrite
+	}
+}
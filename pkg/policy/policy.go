@@ -0,0 +1,835 @@
+// Package policy keeps attribute-based access policies and evaluates
+// requests against them. A policy grants or denies its actions on its
+// resources to its subjects when all of its conditions hold. Denials win
+// over grants, and a request no policy grants is denied.
+//
+// Policies live in the shared store, so every replica evaluates the same
+// set and it survives restarts with a persistent backend such as Redis.
+// Every change makes a new version of a policy; earlier versions are kept
+// unchanged so a policy can be rolled back to one of them. Policies may
+// select resources by the tags they are registered with instead of by name.
+package policy
+
+import (
+	"context"
+	"crypto/rand"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lsendel/impl-zamaz/pkg/store"
+	"github.com/lsendel/impl-zamaz/pkg/trust"
+)
+
+// Effects of a policy
+const (
+	EffectAllow = "allow"
+	EffectDeny  = "deny"
+)
+
+// Condition operators. Numeric comparisons hold only for numeric values;
+// cidr holds when the attribute is an IP address in one of the networks.
+// contains holds when the attribute, a comma-separated list such as roles,
+// has one of the values. in_window holds when the attribute, an RFC 3339
+// time such as the request's, falls in the condition's Window. The negated
+// operators hold when the attribute is missing.
+const (
+	OpEquals         = "equals"
+	OpNotEquals      = "not_equals"
+	OpIn             = "in"
+	OpNotIn          = "not_in"
+	OpGreaterThan    = "greater_than"
+	OpGreaterOrEqual = "greater_or_equal"
+	OpLessThan       = "less_than"
+	OpLessOrEqual    = "less_or_equal"
+	OpCIDR           = "cidr"
+	OpNotCIDR        = "not_cidr"
+	OpContains       = "contains"
+	OpNotContains    = "not_contains"
+	OpInWindow       = "in_window"
+	OpNotInWindow    = "not_in_window"
+)
+
+// operators lists every operator, for errors
+var operators = []string{
+	OpEquals, OpNotEquals, OpIn, OpNotIn, OpGreaterThan, OpGreaterOrEqual, OpLessThan, OpLessOrEqual,
+	OpCIDR, OpNotCIDR, OpContains, OpNotContains, OpInWindow, OpNotInWindow,
+}
+
+// Attributes of requests, as the decision point and Evaluate set them.
+// Device attributes are set for requests signed by a bound device, see
+// trust.RequestContext.
+const (
+	AttributeIP               = "ip"
+	AttributeTime             = trust.ContextTime
+	AttributeCountry          = "country"
+	AttributeDeviceCompliance = trust.ContextDeviceCompliance
+)
+
+// days names the days of a TimeWindow
+var days = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// Subject prefixes. "*" matches every subject.
+const (
+	SubjectUser = "user:"
+	SubjectRole = "role:"
+)
+
+// keyPrefix keys policies by ID
+const keyPrefix = "policy:id:"
+
+// versionPrefix keys the earlier versions of each policy
+const versionPrefix = "policy:version:"
+
+// updateAttempts bounds optimistic retries when replicas update a policy
+const updateAttempts = 3
+
+// Limits on policies
+const (
+	maxNameLength        = 128
+	maxDescriptionLength = 1024
+	maxEntries           = 32
+)
+
+// schema is the JSON Schema of policies
+//
+//go:embed schema.json
+var schema []byte
+
+// Schema returns the JSON Schema policies are created and replaced with
+func Schema() []byte {
+	return append([]byte(nil), schema...)
+}
+
+// Errors returned by Engine
+var (
+	ErrNotFound = errors.New("policy not found")
+	ErrInvalid  = errors.New("invalid policy")
+	// ErrConflict is returned when another replica is changing the same
+	// policy; the request can be retried
+	ErrConflict = errors.New("policy is being modified concurrently")
+	// ErrLimit is returned when creating more than MaxPolicies policies
+	ErrLimit = errors.New("too many policies")
+)
+
+// Condition is a test on an attribute of the request's context, such as
+// its trust_score or ip
+type Condition struct {
+	Attribute string `json:"attribute" yaml:"attribute"`
+	Operator  string `json:"operator" yaml:"operator"`
+	// Values holds one value for the comparisons and any number for the
+	// list operators; the window operators take none
+	Values []string `json:"values,omitempty" yaml:"values,omitempty"`
+	// Window is the time window of in_window and not_in_window
+	Window *TimeWindow `json:"window,omitempty" yaml:"window,omitempty"`
+}
+
+// TimeWindow is a daily span of time on some days of the week, such as
+// business hours
+type TimeWindow struct {
+	// Days are "mon" to "sun"; every day when empty
+	Days []string `json:"days,omitempty" yaml:"days,omitempty"`
+	// Start and End are "15:04" times. The window includes Start but not
+	// End, and runs past midnight when End is before Start.
+	Start string `json:"start" yaml:"start"`
+	End   string `json:"end" yaml:"end"`
+	// Timezone is the IANA time zone of the window; defaults to UTC
+	Timezone string `json:"timezone,omitempty" yaml:"timezone,omitempty"`
+}
+
+// Policy grants or denies Actions on Resources to Subjects. Subjects are
+// "user:<id>", "role:<name>" or "*"; resources and actions may use "*" to
+// match any run of characters, e.g. "devices/*", and resources may be tag
+// selectors, see ResourceSelector. Obligations name what a request the
+// policy decides must go through, such as "audit", optionally with an
+// argument, such as "mask:email".
+type Policy struct {
+	ID          string      `json:"id" yaml:"id"`
+	Name        string      `json:"name" yaml:"name"`
+	Description string      `json:"description,omitempty" yaml:"description,omitempty"`
+	Subjects    []string    `json:"subjects" yaml:"subjects"`
+	Resources   []string    `json:"resources" yaml:"resources"`
+	Actions     []string    `json:"actions" yaml:"actions"`
+	Conditions  []Condition `json:"conditions,omitempty" yaml:"conditions,omitempty"`
+	Effect      string      `json:"effect" yaml:"effect"`
+	Obligations []string    `json:"obligations,omitempty" yaml:"obligations,omitempty"`
+	// Version counts the policy's changes from 1; each version is kept as
+	// it was made
+	Version   int       `json:"version" yaml:"version"`
+	CreatedAt time.Time `json:"created_at" yaml:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" yaml:"updated_at"`
+}
+
+// Validate checks the policy, trimming its name and description
+func (p *Policy) Validate() error {
+	p.Name = strings.TrimSpace(p.Name)
+	p.Description = strings.TrimSpace(p.Description)
+	switch {
+	case p.Name == "":
+		return fmt.Errorf("%w: name is required", ErrInvalid)
+	case len(p.Name) > maxNameLength:
+		return fmt.Errorf("%w: name longer than %d characters", ErrInvalid, maxNameLength)
+	case len(p.Description) > maxDescriptionLength:
+		return fmt.Errorf("%w: description longer than %d characters", ErrInvalid, maxDescriptionLength)
+	case p.Effect != EffectAllow && p.Effect != EffectDeny:
+		return fmt.Errorf("%w: effect must be %q or %q", ErrInvalid, EffectAllow, EffectDeny)
+	}
+	for field, entries := range map[string][]string{"subjects": p.Subjects, "resources": p.Resources, "actions": p.Actions} {
+		if len(entries) == 0 || len(entries) > maxEntries {
+			return fmt.Errorf("%w: %s must list between 1 and %d entries", ErrInvalid, field, maxEntries)
+		}
+		for _, entry := range entries {
+			if strings.TrimSpace(entry) == "" {
+				return fmt.Errorf("%w: %s may not be empty", ErrInvalid, field)
+			}
+		}
+	}
+	for _, resource := range p.Resources {
+		if key, value, ok := selector(resource); ok && (strings.TrimSpace(key) == "" || strings.Contains(key, "*") || value == "") {
+			return fmt.Errorf("%w: resource %q must select a tag as tag:<name>=<value>", ErrInvalid, resource)
+		}
+	}
+	for _, subject := range p.Subjects {
+		if subject != "*" && !strings.HasPrefix(subject, SubjectUser) && !strings.HasPrefix(subject, SubjectRole) {
+			return fmt.Errorf("%w: subject %q must be %q, user:<id> or role:<name>", ErrInvalid, subject, "*")
+		}
+	}
+	if len(p.Conditions) > maxEntries || len(p.Obligations) > maxEntries {
+		return fmt.Errorf("%w: at most %d conditions and obligations", ErrInvalid, maxEntries)
+	}
+	for _, obligation := range p.Obligations {
+		name, arg, hasArg := strings.Cut(obligation, ":")
+		if strings.TrimSpace(name) == "" || hasArg && strings.TrimSpace(arg) == "" {
+			return fmt.Errorf("%w: obligation %q must be a name, or name:argument", ErrInvalid, obligation)
+		}
+	}
+	for i := range p.Conditions {
+		if err := p.Conditions[i].Validate(); err != nil {
+			return fmt.Errorf("%w: condition %d: %s", ErrInvalid, i+1, err)
+		}
+	}
+	return nil
+}
+
+// Validate checks the condition on its own, trimming its attribute
+func (cond *Condition) Validate() error {
+	if cond.Attribute = strings.TrimSpace(cond.Attribute); cond.Attribute == "" {
+		return errors.New("attribute is required")
+	}
+	switch cond.Operator {
+	case OpEquals, OpNotEquals, OpGreaterThan, OpGreaterOrEqual, OpLessThan, OpLessOrEqual:
+		if len(cond.Values) != 1 {
+			return fmt.Errorf("%s takes one value", cond.Operator)
+		}
+	case OpIn, OpNotIn, OpCIDR, OpNotCIDR, OpContains, OpNotContains:
+		if len(cond.Values) == 0 || len(cond.Values) > maxEntries {
+			return fmt.Errorf("%s takes between 1 and %d values", cond.Operator, maxEntries)
+		}
+	case OpInWindow, OpNotInWindow:
+		if len(cond.Values) > 0 || cond.Window == nil {
+			return fmt.Errorf("%s takes a window and no values", cond.Operator)
+		}
+		return cond.Window.validate()
+	default:
+		return fmt.Errorf("operator must be one of %s", strings.Join(operators, ", "))
+	}
+	if cond.Window != nil {
+		return fmt.Errorf("%s takes no window", cond.Operator)
+	}
+	switch cond.Operator {
+	case OpGreaterThan, OpGreaterOrEqual, OpLessThan, OpLessOrEqual:
+		if _, err := strconv.ParseFloat(cond.Values[0], 64); err != nil {
+			return fmt.Errorf("%s takes a number", cond.Operator)
+		}
+	case OpCIDR, OpNotCIDR:
+		for _, value := range cond.Values {
+			if _, _, err := net.ParseCIDR(value); err != nil {
+				return fmt.Errorf("%q is not a network", value)
+			}
+		}
+	}
+	return nil
+}
+
+func (w *TimeWindow) validate() error {
+	if len(w.Days) > len(days) {
+		return fmt.Errorf("window has at most %d days", len(days))
+	}
+	for i, day := range w.Days {
+		w.Days[i] = strings.ToLower(strings.TrimSpace(day))
+		if _, ok := days[w.Days[i]]; !ok {
+			return fmt.Errorf("%q is not a day; days are mon to sun", day)
+		}
+	}
+	for _, clock := range []string{w.Start, w.End} {
+		if _, err := time.Parse("15:04", clock); err != nil {
+			return fmt.Errorf("window start and end must be times such as 09:00, not %q", clock)
+		}
+	}
+	if w.Start == w.End {
+		return errors.New("window start and end must differ")
+	}
+	if _, err := location(w.Timezone); err != nil {
+		return fmt.Errorf("%q is not a time zone", w.Timezone)
+	}
+	return nil
+}
+
+// Contains reports whether t falls in the window
+func (w *TimeWindow) Contains(t time.Time) bool {
+	loc, err := location(w.Timezone)
+	if err != nil {
+		return false
+	}
+	t = t.In(loc)
+	// Times are "15:04", so they compare as strings
+	clock := t.Format("15:04")
+	day := t.Weekday()
+	if w.End < w.Start {
+		// Past midnight: the part after it belongs to the day before
+		if clock >= w.End && clock < w.Start {
+			return false
+		}
+		if clock < w.End {
+			day = (day + 6) % 7
+		}
+	} else if clock < w.Start || clock >= w.End {
+		return false
+	}
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, name := range w.Days {
+		if d, ok := days[strings.ToLower(strings.TrimSpace(name))]; ok && d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// locations caches time zones by name, as loading one reads the zone
+// database
+var locations sync.Map
+
+func location(name string) (*time.Location, error) {
+	if name == "" {
+		return time.UTC, nil
+	}
+	if loc, ok := locations.Load(name); ok {
+		return loc.(*time.Location), nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	locations.Store(name, loc)
+	return loc, nil
+}
+
+// Request is what is evaluated: whether Subject, with Roles, may take
+// Action on Resource. Context holds the attributes conditions test and Tags
+// the tags of the resource, see ResourceTags.
+type Request struct {
+	Subject  string            `json:"subject"`
+	Roles    []string          `json:"roles,omitempty"`
+	Resource string            `json:"resource"`
+	Action   string            `json:"action"`
+	Context  map[string]string `json:"context,omitempty"`
+	Tags     map[string]string `json:"tags,omitempty"`
+}
+
+// Decision is the outcome of evaluating a request
+type Decision struct {
+	Allowed bool   `json:"allowed"`
+	Effect  string `json:"effect"`
+	// Policies lists the IDs of the policies that decided the request:
+	// the denying ones when it is denied, else the granting ones
+	Policies []string `json:"policies"`
+	// Versions holds the version of each of Policies that was decided
+	Versions map[string]int `json:"versions"`
+	// Obligations are those of the policies that decided the request
+	Obligations []string `json:"obligations"`
+	Reason      string   `json:"reason"`
+}
+
+// Config configures an Engine
+type Config struct {
+	// MaxPolicies bounds how many policies may be stored; defaults to 1000
+	MaxPolicies int
+	// MaxVersions bounds how many versions of a policy are kept, counting
+	// the current one; older ones are dropped. Defaults to 50.
+	MaxVersions int
+	// MaxResources bounds how many resources may be registered; defaults
+	// to 1000
+	MaxResources int
+}
+
+// Engine stores policies and evaluates requests against them
+type Engine struct {
+	config Config
+	store  store.Store
+	now    func() time.Time
+}
+
+// NewEngine creates an engine on s
+func NewEngine(cfg Config, s store.Store) *Engine {
+	if cfg.MaxPolicies <= 0 {
+		cfg.MaxPolicies = 1000
+	}
+	if cfg.MaxVersions <= 0 {
+		cfg.MaxVersions = 50
+	}
+	if cfg.MaxResources <= 0 {
+		cfg.MaxResources = 1000
+	}
+	return &Engine{config: cfg, store: s, now: time.Now}
+}
+
+// Create validates and stores p under a new ID
+func (e *Engine) Create(ctx context.Context, p Policy) (*Policy, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	keys, err := e.store.Keys(ctx, keyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) >= e.config.MaxPolicies {
+		return nil, fmt.Errorf("%w: at most %d", ErrLimit, e.config.MaxPolicies)
+	}
+	if p.ID, err = newID(); err != nil {
+		return nil, err
+	}
+	p.Version = 1
+	p.CreatedAt = e.now().UTC()
+	p.UpdatedAt = p.CreatedAt
+	data, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.store.Set(ctx, keyPrefix+p.ID, data, 0); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Get returns policy id, or ErrNotFound
+func (e *Engine) Get(ctx context.Context, id string) (*Policy, error) {
+	p, _, err := e.load(ctx, id)
+	return p, err
+}
+
+// List returns every policy by name
+func (e *Engine) List(ctx context.Context) ([]*Policy, error) {
+	keys, err := e.store.Keys(ctx, keyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	policies := make([]*Policy, 0, len(keys))
+	for _, key := range keys {
+		p, _, err := e.load(ctx, strings.TrimPrefix(key, keyPrefix))
+		if errors.Is(err, ErrNotFound) {
+			// Deleted since listed
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, p)
+	}
+	sort.Slice(policies, func(i, j int) bool {
+		if policies[i].Name != policies[j].Name {
+			return policies[i].Name < policies[j].Name
+		}
+		return policies[i].ID < policies[j].ID
+	})
+	return policies, nil
+}
+
+// Update replaces policy id with p as its next version, keeping its ID and
+// creation time
+func (e *Engine) Update(ctx context.Context, id string, p Policy) (*Policy, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	for attempt := 0; attempt < updateAttempts; attempt++ {
+		current, old, err := e.load(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		// The current version is kept before it is replaced. Whichever
+		// replica replaces it, it is kept the same.
+		if err := e.store.Set(ctx, versionKey(id, current.Version), old, 0); err != nil {
+			return nil, err
+		}
+		p.ID, p.Version = current.ID, current.Version+1
+		p.CreatedAt, p.UpdatedAt = current.CreatedAt, e.now().UTC()
+		data, err := json.Marshal(p)
+		if err != nil {
+			return nil, err
+		}
+		swapped, err := e.store.CompareAndSwap(ctx, keyPrefix+id, old, data, 0)
+		if err != nil {
+			return nil, err
+		}
+		if swapped {
+			if dropped := p.Version - e.config.MaxVersions; dropped > 0 {
+				// Dropping is best effort; a version left behind is dropped
+				// by the next Delete
+				_ = e.store.Delete(ctx, versionKey(id, dropped))
+			}
+			return &p, nil
+		}
+	}
+	return nil, ErrConflict
+}
+
+// Versions returns the kept versions of policy id, newest first
+func (e *Engine) Versions(ctx context.Context, id string) ([]*Policy, error) {
+	current, _, err := e.load(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := e.store.Keys(ctx, versionPrefix+id+":")
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]*Policy, 0, len(keys)+1)
+	versions = append(versions, current)
+	for _, key := range keys {
+		p, err := e.loadVersion(ctx, key)
+		if errors.Is(err, ErrNotFound) {
+			// Dropped since listed
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		// A version kept by an update that lost its race is not one
+		if p.Version < current.Version {
+			versions = append(versions, p)
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Version > versions[j].Version })
+	return versions, nil
+}
+
+// Rollback makes version of policy id its next version, returning it. The
+// versions after the one rolled back to are kept.
+func (e *Engine) Rollback(ctx context.Context, id string, version int) (*Policy, error) {
+	current, _, err := e.load(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	target := current
+	if version != current.Version {
+		if version < 1 || version > current.Version {
+			return nil, fmt.Errorf("%w: version %d", ErrNotFound, version)
+		}
+		if target, err = e.loadVersion(ctx, versionKey(id, version)); err != nil {
+			if errors.Is(err, ErrNotFound) {
+				return nil, fmt.Errorf("%w: version %d", ErrNotFound, version)
+			}
+			return nil, err
+		}
+	}
+	return e.Update(ctx, id, *target)
+}
+
+// Delete removes policy id and its versions
+func (e *Engine) Delete(ctx context.Context, id string) error {
+	if _, _, err := e.load(ctx, id); err != nil {
+		return err
+	}
+	if err := e.store.Delete(ctx, keyPrefix+id); err != nil {
+		return err
+	}
+	keys, err := e.store.Keys(ctx, versionPrefix+id+":")
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := e.store.Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Evaluate decides req against every policy. Without Tags, req has those
+// of its resource in the registry.
+func (e *Engine) Evaluate(ctx context.Context, req Request) (*Decision, error) {
+	if req.Subject == "" || req.Resource == "" || req.Action == "" {
+		return nil, fmt.Errorf("%w: subject, resource and action are required", ErrInvalid)
+	}
+	if _, ok := req.Context[AttributeTime]; !ok {
+		attributes := map[string]string{AttributeTime: e.now().UTC().Format(time.RFC3339)}
+		for attribute, value := range req.Context {
+			attributes[attribute] = value
+		}
+		req.Context = attributes
+	}
+	if req.Tags == nil {
+		resources, err := e.ListResources(ctx)
+		if err != nil {
+			return nil, err
+		}
+		req.Tags = ResourceTags(resources, req.Resource, req.Action)
+	}
+	policies, err := e.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return Decide(policies, req), nil
+}
+
+// Decide decides req against policies: denials win over grants, and a
+// request no policy grants is denied
+func Decide(policies []*Policy, req Request) *Decision {
+	var allowed, denied []*Policy
+	for _, p := range policies {
+		if !p.Matches(req) {
+			continue
+		}
+		if p.Effect == EffectDeny {
+			denied = append(denied, p)
+		} else {
+			allowed = append(allowed, p)
+		}
+	}
+	switch {
+	case len(denied) > 0:
+		return decision(false, denied, "denied by policy")
+	case len(allowed) > 0:
+		return decision(true, allowed, "allowed by policy")
+	default:
+		return decision(false, nil, "no policy allows the request")
+	}
+}
+
+func decision(allowed bool, deciding []*Policy, reason string) *Decision {
+	d := &Decision{Allowed: allowed, Effect: EffectDeny, Policies: []string{}, Versions: map[string]int{}, Obligations: []string{}, Reason: reason}
+	if allowed {
+		d.Effect = EffectAllow
+	}
+	for _, p := range deciding {
+		d.Policies = append(d.Policies, p.ID)
+		d.Versions[p.ID] = p.Version
+		for _, obligation := range p.Obligations {
+			if !contains(d.Obligations, obligation) {
+				d.Obligations = append(d.Obligations, obligation)
+			}
+		}
+	}
+	return d
+}
+
+// Matches reports whether p applies to req: it names req's subject or one
+// of its roles, its resource or one of its tags, and its action, and all
+// its conditions hold
+func (p *Policy) Matches(req Request) bool {
+	if !p.matchesSubject(req) || !p.matchesResource(req) || !matchAny(p.Actions, req.Action) {
+		return false
+	}
+	for _, cond := range p.Conditions {
+		if !cond.Holds(req.Context) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *Policy) matchesResource(req Request) bool {
+	for _, resource := range p.Resources {
+		if key, value, ok := selector(resource); ok {
+			if have, tagged := req.Tags[key]; tagged && match(value, have) {
+				return true
+			}
+		} else if match(resource, req.Resource) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Policy) matchesSubject(req Request) bool {
+	for _, subject := range p.Subjects {
+		switch {
+		case subject == "*", subject == SubjectUser+req.Subject:
+			return true
+		case strings.HasPrefix(subject, SubjectRole):
+			for _, role := range req.Roles {
+				if subject == SubjectRole+role {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Holds reports whether cond holds for attributes. A missing attribute
+// only satisfies not_equals, not_in and not_contains.
+func (cond Condition) Holds(attributes map[string]string) bool {
+	value, ok := attributes[cond.Attribute]
+	switch cond.Operator {
+	case OpEquals:
+		return ok && value == cond.Values[0]
+	case OpNotEquals:
+		return !ok || value != cond.Values[0]
+	case OpIn:
+		return ok && contains(cond.Values, value)
+	case OpNotIn:
+		return !ok || !contains(cond.Values, value)
+	case OpGreaterThan, OpGreaterOrEqual, OpLessThan, OpLessOrEqual:
+		have, err := strconv.ParseFloat(value, 64)
+		if !ok || err != nil {
+			return false
+		}
+		want, err := strconv.ParseFloat(cond.Values[0], 64)
+		if err != nil {
+			return false
+		}
+		switch cond.Operator {
+		case OpGreaterThan:
+			return have > want
+		case OpGreaterOrEqual:
+			return have >= want
+		case OpLessThan:
+			return have < want
+		default:
+			return have <= want
+		}
+	case OpContains, OpNotContains:
+		found := false
+		if ok {
+			for _, item := range strings.Split(value, ",") {
+				if contains(cond.Values, strings.TrimSpace(item)) {
+					found = true
+					break
+				}
+			}
+		}
+		return found == (cond.Operator == OpContains)
+	case OpCIDR, OpNotCIDR:
+		found := false
+		if ip := net.ParseIP(value); ok && ip != nil {
+			for _, cidr := range cond.Values {
+				if _, network, err := net.ParseCIDR(cidr); err == nil && network.Contains(ip) {
+					found = true
+					break
+				}
+			}
+		}
+		return found == (cond.Operator == OpCIDR)
+	case OpInWindow, OpNotInWindow:
+		found := false
+		if at, err := time.Parse(time.RFC3339, value); ok && err == nil && cond.Window != nil {
+			found = cond.Window.Contains(at)
+		}
+		return found == (cond.Operator == OpInWindow)
+	}
+	return false
+}
+
+func (e *Engine) load(ctx context.Context, id string) (*Policy, []byte, error) {
+	data, err := e.store.Get(ctx, keyPrefix+id)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var p Policy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, nil, err
+	}
+	if p.Version == 0 {
+		// Stored before policies were versioned
+		p.Version = 1
+	}
+	return &p, data, nil
+}
+
+func (e *Engine) loadVersion(ctx context.Context, key string) (*Policy, error) {
+	data, err := e.store.Get(ctx, key)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var p Policy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, err
+	}
+	if p.Version == 0 {
+		p.Version = 1
+	}
+	return &p, nil
+}
+
+func versionKey(id string, version int) string {
+	return versionPrefix + id + ":" + strconv.Itoa(version)
+}
+
+func matchAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if match(pattern, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// match reports whether value matches pattern, where "*" matches any run
+// of characters
+func match(pattern, value string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == value
+	}
+	if !strings.HasPrefix(value, parts[0]) {
+		return false
+	}
+	value = value[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(value, part)
+		if i < 0 {
+			return false
+		}
+		value = value[i+len(part):]
+	}
+	return strings.HasSuffix(value, parts[len(parts)-1])
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	h := hex.EncodeToString(b)
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:], nil
+}
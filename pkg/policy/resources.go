@@ -0,0 +1,312 @@
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+// ResourceSelector starts the entries of a policy's resources that select
+// registered resources by tag instead of naming them, e.g.
+// "tag:data-classification=pii". The value may use "*".
+const ResourceSelector = "tag:"
+
+// resourcePrefix keys registered resources by ID
+const resourcePrefix = "policy:resource:"
+
+// maxResourceDepth bounds how many resources may be above one another
+const maxResourceDepth = 8
+
+// Errors returned by the resource registry
+var (
+	ErrResourceNotFound = errors.New("resource not found")
+	// ErrResourceInUse is returned when deleting a resource others are
+	// registered under
+	ErrResourceInUse = errors.New("resource has resources under it")
+)
+
+// Resource is an API, or a part of one, registered with tags so policies
+// can select it by them instead of by path. Resources form a hierarchy,
+// such as a service above its resources: each has the tags of those above
+// it, overriding them with its own, and may tag some of its actions.
+type Resource struct {
+	ID          string `json:"id" yaml:"id"`
+	Name        string `json:"name" yaml:"name"`
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+	// Parent is the ID of the resource this one is under, such as its
+	// service
+	Parent string `json:"parent,omitempty" yaml:"parent,omitempty"`
+	// Patterns are the resource names of the requests it covers, e.g.
+	// "devices" and "devices/*". A request is of the resource with the
+	// longest pattern matching it.
+	Patterns []string          `json:"patterns,omitempty" yaml:"patterns,omitempty"`
+	Tags     map[string]string `json:"tags,omitempty" yaml:"tags,omitempty"`
+	// Actions tags the requests for some actions, by action pattern, e.g.
+	// "delete": {"impact": "high"}
+	Actions   map[string]map[string]string `json:"actions,omitempty" yaml:"actions,omitempty"`
+	CreatedAt time.Time                    `json:"created_at" yaml:"created_at"`
+	UpdatedAt time.Time                    `json:"updated_at" yaml:"updated_at"`
+}
+
+// Validate checks the resource on its own, trimming its name and
+// description
+func (r *Resource) Validate() error {
+	r.Name = strings.TrimSpace(r.Name)
+	r.Description = strings.TrimSpace(r.Description)
+	switch {
+	case r.Name == "":
+		return fmt.Errorf("%w: name is required", ErrInvalid)
+	case len(r.Name) > maxNameLength:
+		return fmt.Errorf("%w: name longer than %d characters", ErrInvalid, maxNameLength)
+	case len(r.Description) > maxDescriptionLength:
+		return fmt.Errorf("%w: description longer than %d characters", ErrInvalid, maxDescriptionLength)
+	case len(r.Patterns) > maxEntries || len(r.Tags) > maxEntries || len(r.Actions) > maxEntries:
+		return fmt.Errorf("%w: at most %d patterns, tags and actions", ErrInvalid, maxEntries)
+	}
+	for _, pattern := range r.Patterns {
+		if strings.TrimSpace(pattern) == "" || strings.HasPrefix(pattern, ResourceSelector) {
+			return fmt.Errorf("%w: pattern %q must be a resource name", ErrInvalid, pattern)
+		}
+	}
+	if err := validateTags(r.Tags); err != nil {
+		return err
+	}
+	for action, tags := range r.Actions {
+		if strings.TrimSpace(action) == "" {
+			return fmt.Errorf("%w: actions may not be empty", ErrInvalid)
+		}
+		if len(tags) == 0 || len(tags) > maxEntries {
+			return fmt.Errorf("%w: action %q must have between 1 and %d tags", ErrInvalid, action, maxEntries)
+		}
+		if err := validateTags(tags); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateTags(tags map[string]string) error {
+	for key, value := range tags {
+		if strings.TrimSpace(key) == "" || strings.ContainsAny(key, "=*") {
+			return fmt.Errorf("%w: tag %q must be a name without = or *", ErrInvalid, key)
+		}
+		if strings.TrimSpace(value) == "" {
+			return fmt.Errorf("%w: tag %q needs a value", ErrInvalid, key)
+		}
+	}
+	return nil
+}
+
+// selector splits a tag selector, reporting whether resource is one
+func selector(resource string) (key, value string, ok bool) {
+	rest, ok := strings.CutPrefix(resource, ResourceSelector)
+	if !ok {
+		return "", "", false
+	}
+	key, value, _ = strings.Cut(rest, "=")
+	return key, value, true
+}
+
+// ResourceTags returns the tags of a request for action on resource: those
+// of the registered resource with the longest pattern matching resource and
+// of the resources above it, and those they give action. It is nil when no
+// resource matches.
+func ResourceTags(resources []*Resource, resource, action string) map[string]string {
+	byID := make(map[string]*Resource, len(resources))
+	var best *Resource
+	bestLen := -1
+	for _, r := range resources {
+		byID[r.ID] = r
+		for _, pattern := range r.Patterns {
+			if len(pattern) > bestLen && match(pattern, resource) {
+				best, bestLen = r, len(pattern)
+			}
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	chain := []*Resource{best}
+	for r := byID[best.Parent]; r != nil && len(chain) < maxResourceDepth; r = byID[r.Parent] {
+		chain = append(chain, r)
+	}
+	tags := make(map[string]string)
+	for i := len(chain) - 1; i >= 0; i-- {
+		for key, value := range chain[i].Tags {
+			tags[key] = value
+		}
+		// Sorted so overlapping action patterns tag the same way every time
+		patterns := make([]string, 0, len(chain[i].Actions))
+		for pattern := range chain[i].Actions {
+			patterns = append(patterns, pattern)
+		}
+		sort.Strings(patterns)
+		for _, pattern := range patterns {
+			if match(pattern, action) {
+				for key, value := range chain[i].Actions[pattern] {
+					tags[key] = value
+				}
+			}
+		}
+	}
+	return tags
+}
+
+// CreateResource validates and registers r under a new ID
+func (e *Engine) CreateResource(ctx context.Context, r Resource) (*Resource, error) {
+	if err := r.Validate(); err != nil {
+		return nil, err
+	}
+	resources, err := e.ListResources(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(resources) >= e.config.MaxResources {
+		return nil, fmt.Errorf("%w: at most %d resources", ErrLimit, e.config.MaxResources)
+	}
+	if r.ID, err = newID(); err != nil {
+		return nil, err
+	}
+	if err := checkParent(&r, resources); err != nil {
+		return nil, err
+	}
+	r.CreatedAt = e.now().UTC()
+	r.UpdatedAt = r.CreatedAt
+	data, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.store.Set(ctx, resourcePrefix+r.ID, data, 0); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// GetResource returns resource id, or ErrResourceNotFound
+func (e *Engine) GetResource(ctx context.Context, id string) (*Resource, error) {
+	r, _, err := e.loadResource(ctx, id)
+	return r, err
+}
+
+// ListResources returns every registered resource by name
+func (e *Engine) ListResources(ctx context.Context) ([]*Resource, error) {
+	keys, err := e.store.Keys(ctx, resourcePrefix)
+	if err != nil {
+		return nil, err
+	}
+	resources := make([]*Resource, 0, len(keys))
+	for _, key := range keys {
+		r, _, err := e.loadResource(ctx, strings.TrimPrefix(key, resourcePrefix))
+		if errors.Is(err, ErrResourceNotFound) {
+			// Deleted since listed
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		resources = append(resources, r)
+	}
+	sort.Slice(resources, func(i, j int) bool {
+		if resources[i].Name != resources[j].Name {
+			return resources[i].Name < resources[j].Name
+		}
+		return resources[i].ID < resources[j].ID
+	})
+	return resources, nil
+}
+
+// UpdateResource replaces resource id with r, keeping its ID and creation
+// time
+func (e *Engine) UpdateResource(ctx context.Context, id string, r Resource) (*Resource, error) {
+	if err := r.Validate(); err != nil {
+		return nil, err
+	}
+	current, old, err := e.loadResource(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	resources, err := e.ListResources(ctx)
+	if err != nil {
+		return nil, err
+	}
+	r.ID = current.ID
+	if err := checkParent(&r, resources); err != nil {
+		return nil, err
+	}
+	r.CreatedAt, r.UpdatedAt = current.CreatedAt, e.now().UTC()
+	data, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	swapped, err := e.store.CompareAndSwap(ctx, resourcePrefix+id, old, data, 0)
+	if err != nil {
+		return nil, err
+	}
+	if !swapped {
+		return nil, ErrConflict
+	}
+	return &r, nil
+}
+
+// DeleteResource removes resource id, which no other may be under
+func (e *Engine) DeleteResource(ctx context.Context, id string) error {
+	if _, _, err := e.loadResource(ctx, id); err != nil {
+		return err
+	}
+	resources, err := e.ListResources(ctx)
+	if err != nil {
+		return err
+	}
+	for _, r := range resources {
+		if r.Parent == id {
+			return fmt.Errorf("%w: %q is under it", ErrResourceInUse, r.Name)
+		}
+	}
+	return e.store.Delete(ctx, resourcePrefix+id)
+}
+
+// checkParent checks that r's parent is registered and that the hierarchy
+// above r has no loop and is at most maxResourceDepth deep
+func checkParent(r *Resource, resources []*Resource) error {
+	if r.Parent == "" {
+		return nil
+	}
+	byID := make(map[string]*Resource, len(resources))
+	for _, other := range resources {
+		byID[other.ID] = other
+	}
+	depth := 1
+	for id := r.Parent; id != ""; id = byID[id].Parent {
+		switch {
+		case id == r.ID:
+			return fmt.Errorf("%w: a resource cannot be under itself", ErrInvalid)
+		case byID[id] == nil:
+			return fmt.Errorf("%w: parent %q is not registered", ErrInvalid, id)
+		case depth >= maxResourceDepth:
+			return fmt.Errorf("%w: resources nest at most %d deep", ErrInvalid, maxResourceDepth)
+		}
+		depth++
+	}
+	return nil
+}
+
+func (e *Engine) loadResource(ctx context.Context, id string) (*Resource, []byte, error) {
+	data, err := e.store.Get(ctx, resourcePrefix+id)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, nil, ErrResourceNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var r Resource
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, nil, err
+	}
+	return &r, data, nil
+}
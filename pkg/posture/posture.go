@@ -0,0 +1,426 @@
+// Package posture keeps what endpoint agents report about their devices'
+// security posture, such as OS version, disk encryption, patch level and
+// EDR, and evaluates it against the posture policy. The outcome lowers the
+// device trust factor of non-compliant devices and gives routes compliance
+// flags to require.
+package posture
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lsendel/impl-zamaz/pkg/device"
+	"github.com/lsendel/impl-zamaz/pkg/i18n"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+	"github.com/lsendel/impl-zamaz/pkg/trust"
+)
+
+// keyPrefix holds each device's latest report
+const keyPrefix = "posture:"
+
+// reportTTL is how long a report is kept without a new one
+const reportTTL = 30 * 24 * time.Hour
+
+// Compliance flags raised by Evaluate
+const (
+	FlagOSOutdated      = "os_outdated"
+	FlagDiskUnencrypted = "disk_unencrypted"
+	FlagPatchStale      = "patch_stale"
+	FlagEDRMissing      = "edr_missing"
+	FlagReportStale     = "report_stale"
+)
+
+// flagPenalties is how much each flag lowers a device's posture score
+var flagPenalties = map[string]float64{
+	FlagOSOutdated:      0.3,
+	FlagDiskUnencrypted: 0.4,
+	FlagPatchStale:      0.2,
+	FlagEDRMissing:      0.3,
+	FlagReportStale:     0.5,
+}
+
+// Errors returned by Service
+var (
+	ErrNoReport = errors.New("no posture reported")
+	ErrInvalid  = errors.New("invalid posture report")
+)
+
+// Report is what an endpoint agent reports about its device
+type Report struct {
+	OSVersion     string `json:"os_version"`
+	DiskEncrypted bool   `json:"disk_encrypted"`
+	// PatchLevel is the date of the latest security patch installed, as
+	// YYYY-MM-DD, like Android's security patch level
+	PatchLevel string `json:"patch_level"`
+	EDRPresent bool   `json:"edr_present"`
+	EDRName    string `json:"edr_name,omitempty"`
+}
+
+// Validate checks the report's formats
+func (r Report) Validate() error {
+	if _, err := parseVersion(r.OSVersion); err != nil {
+		return fmt.Errorf("%w: os_version: %v", ErrInvalid, err)
+	}
+	if _, err := time.Parse(time.DateOnly, r.PatchLevel); err != nil {
+		return fmt.Errorf("%w: patch_level must be YYYY-MM-DD", ErrInvalid)
+	}
+	return nil
+}
+
+// Policy is the posture devices must have to be compliant
+type Policy struct {
+	// MinOSVersions is the oldest OS version allowed by platform, e.g.
+	// "windows": "10.0.19045"; platforms not listed accept any version
+	MinOSVersions map[string]string
+	// RequireDiskEncryption flags devices without full-disk encryption
+	RequireDiskEncryption bool
+	// MaxPatchAge flags devices whose latest patch is older; 0 disables it
+	MaxPatchAge time.Duration
+	// RequireEDR flags devices without an EDR agent
+	RequireEDR bool
+	// MaxReportAge flags devices that stopped reporting; defaults to 24h
+	MaxReportAge time.Duration
+}
+
+// ParseMinOSVersions reads versions such as "windows=10.0.19045,macos=14"
+func ParseMinOSVersions(value string) (map[string]string, error) {
+	versions := make(map[string]string)
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		platform, version, ok := strings.Cut(part, "=")
+		platform, version = strings.ToLower(strings.TrimSpace(platform)), strings.TrimSpace(version)
+		if _, err := parseVersion(version); !ok || err != nil {
+			return nil, fmt.Errorf("invalid minimum OS version %q", part)
+		}
+		versions[platform] = version
+	}
+	return versions, nil
+}
+
+// Assessment is how a device's posture measures up to the policy
+type Assessment struct {
+	// Score is from 0 to 1; each flag lowers it
+	Score     float64  `json:"score"`
+	Compliant bool     `json:"compliant"`
+	Flags     []string `json:"flags"`
+}
+
+// Evaluate assesses report, made at reportedAt by a device of platform
+func (p Policy) Evaluate(platform string, report Report, reportedAt, now time.Time) Assessment {
+	flags := []string{}
+	if min, ok := p.MinOSVersions[platform]; ok && compareVersions(report.OSVersion, min) < 0 {
+		flags = append(flags, FlagOSOutdated)
+	}
+	if p.RequireDiskEncryption && !report.DiskEncrypted {
+		flags = append(flags, FlagDiskUnencrypted)
+	}
+	if patched, err := time.Parse(time.DateOnly, report.PatchLevel); p.MaxPatchAge > 0 && (err != nil || now.Sub(patched) > p.MaxPatchAge) {
+		flags = append(flags, FlagPatchStale)
+	}
+	if p.RequireEDR && !report.EDRPresent {
+		flags = append(flags, FlagEDRMissing)
+	}
+	maxAge := p.MaxReportAge
+	if maxAge <= 0 {
+		maxAge = 24 * time.Hour
+	}
+	if now.Sub(reportedAt) > maxAge {
+		flags = append(flags, FlagReportStale)
+	}
+
+	score := 1.0
+	for _, flag := range flags {
+		score -= flagPenalties[flag]
+	}
+	if score < 0 {
+		score = 0
+	}
+	return Assessment{Score: score, Compliant: len(flags) == 0, Flags: flags}
+}
+
+// Status is a device's latest report and its assessment under the current
+// policy
+type Status struct {
+	DeviceID   string     `json:"device_id"`
+	Platform   string     `json:"platform"`
+	Report     Report     `json:"report"`
+	ReportedAt time.Time  `json:"reported_at"`
+	Assessment Assessment `json:"assessment"`
+}
+
+// Devices looks up owners' devices, e.g. a device.Registry
+type Devices interface {
+	Get(ctx context.Context, owner, id string) (*interfaces.DeviceInfo, error)
+	// Touch records that the device was seen, returning it
+	Touch(ctx context.Context, owner, id string) (*interfaces.DeviceInfo, error)
+}
+
+// Service records posture reports and assesses devices. Reports live in the
+// shared store and are assessed when read, so policy changes and stale
+// reports take effect without new reports.
+type Service struct {
+	policy  Policy
+	devices Devices
+	store   store.Store
+	logger  interfaces.Logger
+	metrics interfaces.MetricsCollector
+	now     func() time.Time
+}
+
+// NewService creates a posture service; metrics may be nil
+func NewService(policy Policy, devices Devices, s store.Store, logger interfaces.Logger, metrics interfaces.MetricsCollector) *Service {
+	return &Service{policy: policy, devices: devices, store: s, logger: logger, metrics: metrics, now: time.Now}
+}
+
+// Report records the posture of owner's device id, which counts as seeing
+// the device
+func (s *Service) Report(ctx context.Context, owner, id string, report Report) (*Status, error) {
+	if err := report.Validate(); err != nil {
+		return nil, err
+	}
+	info, err := s.devices.Touch(ctx, owner, id)
+	if err != nil {
+		return nil, err
+	}
+	status := &Status{DeviceID: info.ID, Platform: info.Platform, Report: report, ReportedAt: s.now().UTC()}
+	data, err := json.Marshal(status)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.store.Set(ctx, keyPrefix+info.ID, data, reportTTL); err != nil {
+		return nil, err
+	}
+	status.Assessment = s.policy.Evaluate(status.Platform, report, status.ReportedAt, s.now())
+	if s.metrics != nil {
+		s.metrics.IncrementCounter("posture_reports_total", map[string]string{"compliant": strconv.FormatBool(status.Assessment.Compliant)})
+	}
+	return status, nil
+}
+
+// Status returns the assessed posture of owner's device id, or ErrNoReport
+func (s *Service) Status(ctx context.Context, owner, id string) (*Status, error) {
+	if _, err := s.devices.Get(ctx, owner, id); err != nil {
+		return nil, err
+	}
+	return s.assess(ctx, id)
+}
+
+// assess returns the assessed posture of device id, whoever owns it
+func (s *Service) assess(ctx context.Context, id string) (*Status, error) {
+	data, err := s.store.Get(ctx, keyPrefix+id)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, ErrNoReport
+	}
+	if err != nil {
+		return nil, err
+	}
+	var status Status
+	if err := json.Unmarshal(data, &status); err != nil {
+		return nil, err
+	}
+	status.Assessment = s.policy.Evaluate(status.Platform, status.Report, status.ReportedAt, s.now())
+	return &status, nil
+}
+
+// Factor scores the device factor like trust.DeviceFactor, scaled by the
+// posture score of the device scored or else the bound device the request
+// came from. Devices without a report score as trust.DeviceFactor does.
+func (s *Service) Factor() trust.FactorProvider {
+	base := trust.DeviceFactor()
+	return trust.FactorFunc(trust.FactorDevice, func(ctx context.Context, in trust.Input) (trust.FactorResult, error) {
+		result, err := base.Evaluate(ctx, in)
+		if err != nil {
+			return result, err
+		}
+		id := in.Device
+		if id == "" {
+			id = in.Context[trust.ContextDeviceID]
+		}
+		if id == "" {
+			return result, nil
+		}
+		status, err := s.assess(ctx, id)
+		if errors.Is(err, ErrNoReport) {
+			return result, nil
+		}
+		if err != nil {
+			return trust.FactorResult{}, err
+		}
+		if result.Evidence == nil {
+			result.Evidence = make(map[string]string)
+		}
+		result.Score *= status.Assessment.Score
+		if status.Assessment.Compliant {
+			result.Evidence["posture"] = "compliant"
+		} else {
+			result.Evidence["posture"] = "noncompliant"
+			result.Evidence["posture_flags"] = strings.Join(status.Assessment.Flags, ",")
+			result.Reason += "; non-compliant posture (" + strings.Join(status.Assessment.Flags, ", ") + ")"
+		}
+		return result, nil
+	})
+}
+
+// RequireCompliance rejects requests with 403 unless they come from a bound
+// device (see device.Registry.AssertionMiddleware) of the authenticated user
+// whose posture raises none of flags, or none at all when flags is empty.
+// It must run after authentication.
+func (s *Service) RequireCompliance(flags ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		signals := trust.RequestContext(c)
+		id := signals[trust.ContextDeviceID]
+		var raised []string
+		if id == "" {
+			raised = []string{"device_unbound"}
+		} else if status, err := s.assess(c.Request.Context(), id); errors.Is(err, ErrNoReport) {
+			raised = []string{"posture_unknown"}
+		} else if err != nil {
+			s.logger.Error("Failed to assess device posture", "device_id", id, "error", err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": i18n.Message(c, "INTERNAL_ERROR"), "code": "INTERNAL_ERROR"})
+			return
+		} else {
+			raised = relevant(status.Assessment.Flags, flags)
+		}
+		if len(raised) == 0 {
+			c.Next()
+			return
+		}
+		s.logger.Info("Request denied for device posture", "device_id", id, "flags", raised, "path", c.Request.URL.Path)
+		if s.metrics != nil {
+			s.metrics.IncrementCounter("posture_denials_total", nil)
+		}
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+			"error": i18n.Message(c, "DEVICE_NONCOMPLIANT"),
+			"code":  "DEVICE_NONCOMPLIANT",
+			"flags": raised,
+		})
+	}
+}
+
+// RegisterRoutes mounts the agent's report and the posture status under a
+// device route group: POST and GET /:id/posture
+func (s *Service) RegisterRoutes(r gin.IRoutes) {
+	r.POST("/:id/posture", s.handleReport)
+	r.GET("/:id/posture", s.handleStatus)
+}
+
+func (s *Service) handleReport(c *gin.Context) {
+	var report Report
+	if err := c.ShouldBindJSON(&report); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": i18n.Message(c, "VALIDATION_ERROR"), "code": "VALIDATION_ERROR"})
+		return
+	}
+	status, err := s.Report(c.Request.Context(), owner(c), c.Param("id"), report)
+	if err != nil {
+		s.respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+func (s *Service) handleStatus(c *gin.Context) {
+	status, err := s.Status(c.Request.Context(), owner(c), c.Param("id"))
+	if err != nil {
+		s.respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+func (s *Service) respondError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, ErrInvalid):
+		c.JSON(http.StatusBadRequest, gin.H{"error": i18n.Message(c, "VALIDATION_ERROR"), "code": "VALIDATION_ERROR"})
+	case errors.Is(err, device.ErrNotFound), errors.Is(err, ErrNoReport):
+		c.JSON(http.StatusNotFound, gin.H{"error": i18n.Message(c, "RESOURCE_NOT_FOUND"), "code": "RESOURCE_NOT_FOUND"})
+	default:
+		s.logger.Error("Device posture request failed", "device_id", c.Param("id"), "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": i18n.Message(c, "INTERNAL_ERROR"), "code": "INTERNAL_ERROR"})
+	}
+}
+
+// owner is the authenticated user's ID
+func owner(c *gin.Context) string {
+	if user, ok := c.Get("user"); ok {
+		if info, ok := user.(*interfaces.UserInfo); ok {
+			return info.ID
+		}
+	}
+	return ""
+}
+
+// relevant returns the flags of raised that are in wanted, or all of them
+// when wanted is empty
+func relevant(raised, wanted []string) []string {
+	if len(wanted) == 0 {
+		return raised
+	}
+	var out []string
+	for _, flag := range raised {
+		for _, w := range wanted {
+			if flag == w {
+				out = append(out, flag)
+			}
+		}
+	}
+	return out
+}
+
+// parseVersion reads a dotted numeric version such as "10.0.19045"
+func parseVersion(version string) ([]int, error) {
+	if version == "" {
+		return nil, errors.New("version is empty")
+	}
+	parts := strings.Split(version, ".")
+	numbers := make([]int, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("version %q is not dotted numbers", version)
+		}
+		numbers[i] = n
+	}
+	return numbers, nil
+}
+
+// compareVersions orders dotted versions, missing components counting as
+// 0; unparsable versions are older than any other
+func compareVersions(a, b string) int {
+	va, errA := parseVersion(a)
+	vb, errB := parseVersion(b)
+	switch {
+	case errA != nil && errB != nil:
+		return 0
+	case errA != nil:
+		return -1
+	case errB != nil:
+		return 1
+	}
+	for i := 0; i < len(va) || i < len(vb); i++ {
+		var x, y int
+		if i < len(va) {
+			x = va[i]
+		}
+		if i < len(vb) {
+			y = vb[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,309 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	pathpkg "path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lsendel/impl-zamaz/pkg/authz"
+	"github.com/lsendel/impl-zamaz/pkg/discovery"
+	"github.com/lsendel/impl-zamaz/pkg/i18n"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+)
+
+// GatewayPrefix is where the gateway serves registered services, as
+// /proxy/:service/*path
+const GatewayPrefix = "/proxy"
+
+// GatewayBreakerPrefix names the circuit breaker of each service the
+// gateway forwards to, as "service:<name>"
+const GatewayBreakerPrefix = "service:"
+
+// errUpstreamFailed counts a forwarded request against the service's
+// breaker
+var errUpstreamFailed = errors.New("upstream failed")
+
+// Breaker runs calls through a circuit breaker, returning an error without
+// calling fn while it is open; security.CircuitBreakerManager implements it
+type Breaker interface {
+	Execute(ctx context.Context, name string, fn func(ctx context.Context) error) error
+}
+
+// GatewayConfig configures the gateway to registered services
+type GatewayConfig struct {
+	Registry   *discovery.ServiceRegistry
+	Authorizer *authz.Authorizer
+	// ForwardAuthorization keeps the Authorization header on forwarded requests
+	ForwardAuthorization bool
+	// Breaker, when set, stops forwarding to a service after repeated
+	// server errors. Pass its state changes to BreakerStateChanged so the
+	// registry degrades the service meanwhile.
+	Breaker Breaker
+}
+
+// Gateway routes requests to the healthy instances of registered services,
+// enforcing the trust level each service and endpoint requires on top of
+// the authorizer's rules
+type Gateway struct {
+	config  GatewayConfig
+	reverse *httputil.ReverseProxy
+	logger  interfaces.Logger
+	metrics interfaces.MetricsCollector
+}
+
+// gatewayTarget is where a request is forwarded
+type gatewayTarget struct {
+	service  string
+	instance *url.URL
+	path     string
+	prefix   string
+	decision authz.Decision
+	// status is the upstream's response status, 0 when it was not reached
+	status int
+}
+
+type targetKey struct{}
+
+// NewGateway creates a gateway; metrics may be nil
+func NewGateway(cfg GatewayConfig, logger interfaces.Logger, metrics interfaces.MetricsCollector) (*Gateway, error) {
+	if cfg.Registry == nil || cfg.Authorizer == nil {
+		return nil, errors.New("gateway: a registry and an authorizer are required")
+	}
+	g := &Gateway{config: cfg, logger: logger, metrics: metrics}
+	g.reverse = &httputil.ReverseProxy{
+		Rewrite:        g.rewrite,
+		ModifyResponse: g.inspectResponse,
+		ErrorHandler:   g.handleUpstreamError,
+	}
+	return g, nil
+}
+
+// rewrite points the request at the resolved instance, replaces identity
+// headers with the validated ones and passes on the request's trace
+func (g *Gateway) rewrite(pr *httputil.ProxyRequest) {
+	target := pr.In.Context().Value(targetKey{}).(*gatewayTarget)
+	pr.Out.URL.Path, pr.Out.URL.RawPath = target.path, ""
+	pr.SetURL(target.instance)
+	pr.SetXForwarded()
+	pr.Out.Header.Set("X-Forwarded-Prefix", target.prefix)
+
+	stripIdentityHeaders(pr.Out.Header)
+	propagateTrace(pr.Out.Context(), pr.Out.Header)
+	if !g.config.ForwardAuthorization {
+		pr.Out.Header.Del("Authorization")
+	}
+	for name, value := range target.decision.Headers {
+		pr.Out.Header.Set(name, value)
+	}
+}
+
+// Handler serves GatewayPrefix/:service/*path. Endpoint paths are matched
+// against the path after the service name, as the service sees it.
+func (g *Gateway) Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := c.Param("service")
+		// Cleaned so dot segments cannot dodge an endpoint's trust level
+		path := pathpkg.Clean("/" + c.Param("path"))
+		if strings.HasSuffix(c.Param("path"), "/") && path != "/" {
+			path += "/"
+		}
+
+		headers := make(map[string]string, len(c.Request.Header))
+		for header, values := range c.Request.Header {
+			if len(values) > 0 {
+				headers[strings.ToLower(header)] = values[0]
+			}
+		}
+		decision := g.config.Authorizer.Check(c.Request.Context(), authz.Request{
+			Method:   c.Request.Method,
+			Path:     c.Request.URL.Path,
+			Headers:  headers,
+			ClientIP: c.ClientIP(),
+		})
+		if !decision.Allowed {
+			c.AbortWithStatusJSON(decision.Status, gin.H{
+				"error": decision.Message,
+				"code":  decision.Code,
+			})
+			g.count("", "denied")
+			return
+		}
+
+		service, err := g.config.Registry.GetService(name)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+				"error": i18n.Message(c, "SERVICE_NOT_FOUND"),
+				"code":  "SERVICE_NOT_FOUND",
+			})
+			g.count("", "not_found")
+			return
+		}
+		if required := requiredTrustLevel(service, c.Request.Method, path); decision.TrustLevel < required {
+			g.logger.Info("Gateway request denied for insufficient trust",
+				"service", name,
+				"path", path,
+				"trust_level", decision.TrustLevel,
+				"required", required)
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"error":                i18n.Message(c, "INSUFFICIENT_TRUST"),
+				"code":                 "INSUFFICIENT_TRUST",
+				"required_trust_level": required,
+				"current_trust_level":  decision.TrustLevel,
+				"deficit":              required - decision.TrustLevel,
+			})
+			g.count(name, "insufficient_trust")
+			return
+		}
+
+		if g.config.Breaker == nil {
+			g.forward(c, name, path, decision)
+			return
+		}
+		called := false
+		err = g.config.Breaker.Execute(c.Request.Context(), GatewayBreakerPrefix+name, func(ctx context.Context) error {
+			called = true
+			return g.forward(c, name, path, decision)
+		})
+		if !called {
+			// The breaker rejected the request, or failed
+			g.logger.Debug("Gateway request rejected by circuit breaker", "service", name, "error", err)
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+				"error": i18n.Message(c, "SERVICE_UNAVAILABLE"),
+				"code":  "SERVICE_UNAVAILABLE",
+			})
+			g.count(name, "circuit_open")
+		}
+	}
+}
+
+// forward resolves an instance of the service and forwards the request to
+// it, returning errUpstreamFailed when it fails as the breaker counts it
+func (g *Gateway) forward(c *gin.Context, name, path string, decision authz.Decision) error {
+	instance, release, err := g.config.Registry.Resolve(name, "")
+	if errors.Is(err, discovery.ErrCircuitOpen) && g.config.Breaker != nil {
+		// The breaker let the request through, so the registry's view of
+		// it lapsed along with the breaker's state
+		g.config.Registry.SetBreakerState(name, discovery.BreakerClosed)
+		instance, release, err = g.config.Registry.Resolve(name, "")
+	}
+	if err != nil {
+		if !errors.Is(err, discovery.ErrNoHealthyInstance) && !errors.Is(err, discovery.ErrCircuitOpen) {
+			g.logger.Error("Failed to resolve service", "service", name, "error", err)
+		}
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+			"error": i18n.Message(c, "SERVICE_UNAVAILABLE"),
+			"code":  "SERVICE_UNAVAILABLE",
+		})
+		g.count(name, "unavailable")
+		return errUpstreamFailed
+	}
+	defer release()
+	instanceURL, err := url.Parse(instance.URL)
+	if err != nil {
+		g.logger.Error("Registered instance has an invalid URL", "service", name, "url", instance.URL)
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+			"error": i18n.Message(c, "SERVICE_UNAVAILABLE"),
+			"code":  "SERVICE_UNAVAILABLE",
+		})
+		g.count(name, "unavailable")
+		return errUpstreamFailed
+	}
+
+	target := &gatewayTarget{
+		service:  name,
+		instance: instanceURL,
+		path:     path,
+		prefix:   fmt.Sprintf("%s/%s", GatewayPrefix, name),
+		decision: decision,
+	}
+	g.reverse.ServeHTTP(c.Writer, c.Request.WithContext(context.WithValue(c.Request.Context(), targetKey{}, target)))
+	if target.status == 0 {
+		return errUpstreamFailed
+	}
+	g.count(name, "forwarded")
+	if target.status >= http.StatusInternalServerError {
+		return errUpstreamFailed
+	}
+	return nil
+}
+
+// BreakerStateChanged degrades or restores the service whose breaker
+// changed state in the registry; pass it to the breaker's OnStateChange
+func (g *Gateway) BreakerStateChanged(breaker, _, to string) {
+	name, ok := strings.CutPrefix(breaker, GatewayBreakerPrefix)
+	if !ok {
+		return
+	}
+	if err := g.config.Registry.SetBreakerState(name, to); err != nil {
+		if !errors.Is(err, discovery.ErrServiceNotFound) {
+			g.logger.Warn("Failed to record service breaker state", "service", name, "error", err)
+		}
+		return
+	}
+	if g.metrics != nil {
+		g.metrics.IncrementCounter("gateway_breaker_events_total", map[string]string{"service": name, "state": to})
+	}
+}
+
+// requiredTrustLevel is the higher of the service's trust level and that
+// of the most demanding endpoint matching the request
+func requiredTrustLevel(service *discovery.ServiceInfo, method, path string) int {
+	required := service.TrustLevel
+	for _, endpoint := range service.Endpoints {
+		if endpoint.TrustLevel > required && (endpoint.Method == "" || strings.EqualFold(endpoint.Method, method)) && matchEndpoint(endpoint.Path, path) {
+			required = endpoint.TrustLevel
+		}
+	}
+	return required
+}
+
+// matchEndpoint reports whether path matches pattern, whose {param}
+// segments match any one segment
+func matchEndpoint(pattern, path string) bool {
+	want := strings.Split(strings.Trim(pattern, "/"), "/")
+	got := strings.Split(strings.Trim(path, "/"), "/")
+	if len(want) != len(got) {
+		return false
+	}
+	for i, segment := range want {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			if got[i] == "" {
+				return false
+			}
+			continue
+		}
+		if segment != got[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// inspectResponse notes the upstream's status for the breaker
+func (g *Gateway) inspectResponse(resp *http.Response) error {
+	target := resp.Request.Context().Value(targetKey{}).(*gatewayTarget)
+	target.status = resp.StatusCode
+	return nil
+}
+
+func (g *Gateway) handleUpstreamError(w http.ResponseWriter, r *http.Request, err error) {
+	target := r.Context().Value(targetKey{}).(*gatewayTarget)
+	g.logger.Error("Service request failed", "service", target.service, "error", err, "path", r.URL.Path)
+	g.count(target.service, "upstream_error")
+	writeUpstreamError(w, r)
+}
+
+// count counts a request by outcome and service, left empty until the name
+// is known to be registered as callers choose it freely
+func (g *Gateway) count(service, outcome string) {
+	if g.metrics != nil {
+		g.metrics.IncrementCounter("gateway_requests_total", map[string]string{"service": service, "outcome": outcome})
+	}
+}
@@ -0,0 +1,167 @@
+// Package proxy runs impl-zamaz as a sidecar in front of a legacy application,
+// enforcing token validation and trust checks before forwarding requests
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+
+	"github.com/lsendel/impl-zamaz/pkg/authz"
+	"github.com/lsendel/impl-zamaz/pkg/i18n"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+)
+
+// Config configures the enforcement proxy
+type Config struct {
+	// Upstream is the base URL of the protected application
+	Upstream string
+	// LocalPaths are served by impl-zamaz itself instead of being proxied
+	LocalPaths []string
+	// ForwardAuthorization keeps the Authorization header on forwarded requests
+	ForwardAuthorization bool
+	Authorizer           *authz.Authorizer
+}
+
+// Proxy validates requests and forwards them to the upstream
+type Proxy struct {
+	config  Config
+	reverse *httputil.ReverseProxy
+	logger  interfaces.Logger
+	metrics interfaces.MetricsCollector
+}
+
+type decisionKey struct{}
+
+// New creates an enforcement proxy; metrics may be nil
+func New(cfg Config, logger interfaces.Logger, metrics interfaces.MetricsCollector) (*Proxy, error) {
+	if cfg.Authorizer == nil {
+		return nil, errors.New("proxy: an authorizer is required")
+	}
+	upstream, err := url.Parse(cfg.Upstream)
+	if err != nil || upstream.Scheme == "" || upstream.Host == "" {
+		return nil, fmt.Errorf("proxy: invalid upstream URL %q", cfg.Upstream)
+	}
+
+	p := &Proxy{config: cfg, logger: logger, metrics: metrics}
+	p.reverse = &httputil.ReverseProxy{
+		Director:     p.director(httputil.NewSingleHostReverseProxy(upstream).Director),
+		ErrorHandler: p.handleUpstreamError,
+	}
+	return p, nil
+}
+
+// director wraps the default director to replace identity headers with the
+// validated ones and pass on the request's trace
+func (p *Proxy) director(base func(*http.Request)) func(*http.Request) {
+	return func(req *http.Request) {
+		base(req)
+		stripIdentityHeaders(req.Header)
+		propagateTrace(req.Context(), req.Header)
+		if !p.config.ForwardAuthorization {
+			req.Header.Del("Authorization")
+		}
+
+		decision, ok := req.Context().Value(decisionKey{}).(authz.Decision)
+		if !ok {
+			return
+		}
+		for name, value := range decision.Headers {
+			req.Header.Set(name, value)
+		}
+	}
+}
+
+// propagateTrace replaces the caller's traceparent with the span serving the
+// request, so the upstream's spans are its children
+func propagateTrace(ctx context.Context, h http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(h))
+}
+
+func stripIdentityHeaders(h http.Header) {
+	for name := range h {
+		if strings.HasPrefix(http.CanonicalHeaderKey(name), authz.IdentityHeaderPrefix) {
+			delete(h, name)
+		}
+	}
+}
+
+// Middleware enforces and proxies every request except LocalPaths, which
+// continue down the local gin chain
+func (p *Proxy) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		for _, path := range p.config.LocalPaths {
+			if c.Request.URL.Path == path {
+				c.Next()
+				return
+			}
+		}
+		p.serve(c)
+		c.Abort()
+	}
+}
+
+// Handler enforces and proxies a single request
+func (p *Proxy) Handler() gin.HandlerFunc {
+	return p.serve
+}
+
+func (p *Proxy) serve(c *gin.Context) {
+	headers := make(map[string]string, len(c.Request.Header))
+	for name, values := range c.Request.Header {
+		if len(values) > 0 {
+			headers[strings.ToLower(name)] = values[0]
+		}
+	}
+
+	decision := p.config.Authorizer.Check(c.Request.Context(), authz.Request{
+		Method:   c.Request.Method,
+		Path:     c.Request.URL.Path,
+		Headers:  headers,
+		ClientIP: c.ClientIP(),
+	})
+	if !decision.Allowed {
+		c.AbortWithStatusJSON(decision.Status, gin.H{
+			"error": decision.Message,
+			"code":  decision.Code,
+		})
+		p.count("denied")
+		return
+	}
+
+	ctx := context.WithValue(c.Request.Context(), decisionKey{}, decision)
+	p.reverse.ServeHTTP(c.Writer, c.Request.WithContext(ctx))
+	p.count("forwarded")
+}
+
+func (p *Proxy) handleUpstreamError(w http.ResponseWriter, r *http.Request, err error) {
+	p.logger.Error("Upstream request failed", "error", err, "path", r.URL.Path)
+	p.count("upstream_error")
+	writeUpstreamError(w, r)
+}
+
+// writeUpstreamError answers 502 UPSTREAM_UNAVAILABLE in the request's language
+func writeUpstreamError(w http.ResponseWriter, r *http.Request) {
+	lang := i18n.Negotiate(r.Header.Get("Accept-Language"))
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusBadGateway)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error": i18n.Translate(lang, "UPSTREAM_UNAVAILABLE"),
+		"code":  "UPSTREAM_UNAVAILABLE",
+	})
+}
+
+func (p *Proxy) count(outcome string) {
+	if p.metrics != nil {
+		p.metrics.IncrementCounter("proxy_requests_total", map[string]string{"outcome": outcome})
+	}
+}
@@ -0,0 +1,262 @@
+package rbac
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Store keys of recorded changes by sequence, and of the last sequence
+const (
+	changePrefix = "rbac:change:"
+	changeSeqKey = "rbac:change-seq"
+)
+
+// Change actions
+const (
+	ActionPermissionCreate = "permission.create"
+	ActionPermissionDelete = "permission.delete"
+	ActionRoleCreate       = "role.create"
+	ActionRoleUpdate       = "role.update"
+	ActionRoleDelete       = "role.delete"
+	ActionAssign           = "assignment.create"
+	ActionUnassign         = "assignment.delete"
+	// ActionExpire is an assignment removed once lapsed
+	ActionExpire           = "assignment.expire"
+	ActionConstraintCreate = "constraint.create"
+	ActionConstraintDelete = "constraint.delete"
+)
+
+// maxChangePage bounds a page of Changes
+const maxChangePage = 1000
+
+// Change records a mutation of a role, permission, assignment or
+// constraint, with what it was before and after
+type Change struct {
+	Seq    int64     `json:"seq"`
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	// Target is the role ID, permission name or constraint ID changed, or
+	// "<user>/<role ID>" for assignments
+	Target string `json:"target"`
+	Actor  string `json:"actor,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	// Before is absent for creations and After for deletions
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+	Diff   []FieldChange   `json:"diff"`
+}
+
+// FieldChange is a field that differs between Before and After. Added and
+// Removed list the entries a list of strings gained and lost.
+type FieldChange struct {
+	Field   string      `json:"field"`
+	Before  interface{} `json:"before,omitempty"`
+	After   interface{} `json:"after,omitempty"`
+	Added   []string    `json:"added,omitempty"`
+	Removed []string    `json:"removed,omitempty"`
+}
+
+// ChangeQuery selects changes. Every set field must match.
+type ChangeQuery struct {
+	Actor  string
+	Action string
+	Target string
+	Since  time.Time
+	Until  time.Time
+	// BeforeSeq, when positive, continues below the next of a previous
+	// page
+	BeforeSeq int64
+	// Limit is the page size, at most 1000; defaults to 100
+	Limit int
+}
+
+type changeKey struct{}
+
+type changeInfo struct {
+	actor, reason string
+}
+
+// WithChange attributes the changes made with the returned context to
+// actor, for reason
+func WithChange(ctx context.Context, actor, reason string) context.Context {
+	return context.WithValue(ctx, changeKey{}, changeInfo{actor: actor, reason: strings.TrimSpace(reason)})
+}
+
+// Changes returns the recorded changes matching q, newest first. next is
+// the BeforeSeq of the next page, or 0 when there are no more.
+func (m *Manager) Changes(ctx context.Context, q ChangeQuery) (changes []*Change, next int64, err error) {
+	if q.Limit <= 0 {
+		q.Limit = 100
+	}
+	if q.Limit > maxChangePage {
+		return nil, 0, fmt.Errorf("%w: at most %d changes a page", ErrInvalid, maxChangePage)
+	}
+	keys, err := m.store.Keys(ctx, changePrefix)
+	if err != nil {
+		return nil, 0, err
+	}
+	// Keys are zero-padded, so they sort by sequence
+	sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+	changes = make([]*Change, 0, q.Limit)
+	for _, key := range keys {
+		seq, err := strconv.ParseInt(strings.TrimPrefix(key, changePrefix), 10, 64)
+		if err != nil || (q.BeforeSeq > 0 && seq >= q.BeforeSeq) {
+			continue
+		}
+		var c Change
+		if err := m.get(ctx, key, &c); errors.Is(err, ErrNotFound) {
+			// Expired since listed
+			continue
+		} else if err != nil {
+			return nil, 0, err
+		}
+		// Sequences follow time, so nothing older can match
+		if !q.Since.IsZero() && c.Time.Before(q.Since) {
+			break
+		}
+		if !q.matches(&c) {
+			continue
+		}
+		changes = append(changes, &c)
+		if len(changes) == q.Limit {
+			return changes, c.Seq, nil
+		}
+	}
+	return changes, 0, nil
+}
+
+func (q ChangeQuery) matches(c *Change) bool {
+	return (q.Actor == "" || c.Actor == q.Actor) &&
+		(q.Action == "" || c.Action == q.Action) &&
+		(q.Target == "" || c.Target == q.Target) &&
+		(q.Until.IsZero() || c.Time.Before(q.Until))
+}
+
+// record stores a change of target from before to after, either of which
+// may be nil, attributed as WithChange attributed ctx or else to actor
+func (m *Manager) record(ctx context.Context, action, target, actor string, before, after interface{}) error {
+	info, _ := ctx.Value(changeKey{}).(changeInfo)
+	if info.actor != "" {
+		actor = info.actor
+	}
+	c := Change{Time: m.now().UTC(), Action: action, Target: target, Actor: actor, Reason: info.reason}
+	var err error
+	if c.Before, err = marshalState(before); err != nil {
+		return err
+	}
+	if c.After, err = marshalState(after); err != nil {
+		return err
+	}
+	if c.Diff, err = diff(c.Before, c.After); err != nil {
+		return err
+	}
+	if c.Seq, _, err = m.store.Incr(ctx, changeSeqKey, 0); err != nil {
+		return fmt.Errorf("failed to record %s of %q: %w", action, target, err)
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if err := m.store.Set(ctx, fmt.Sprintf("%s%020d", changePrefix, c.Seq), data, m.config.ChangeRetention); err != nil {
+		return fmt.Errorf("failed to record %s of %q: %w", action, target, err)
+	}
+	return nil
+}
+
+func marshalState(v interface{}) (json.RawMessage, error) {
+	if v == nil || reflect.ValueOf(v).IsNil() {
+		return nil, nil
+	}
+	return json.Marshal(v)
+}
+
+// diff compares the fields of before and after, leaving out when they were
+// last updated
+func diff(before, after json.RawMessage) ([]FieldChange, error) {
+	var b, a map[string]interface{}
+	if before != nil {
+		if err := json.Unmarshal(before, &b); err != nil {
+			return nil, err
+		}
+	}
+	if after != nil {
+		if err := json.Unmarshal(after, &a); err != nil {
+			return nil, err
+		}
+	}
+	fields := make([]string, 0, len(a)+len(b))
+	for field := range b {
+		fields = append(fields, field)
+	}
+	for field := range a {
+		if _, ok := b[field]; !ok {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+	changes := []FieldChange{}
+	for _, field := range fields {
+		if field == "updated_at" || reflect.DeepEqual(b[field], a[field]) {
+			continue
+		}
+		change := FieldChange{Field: field, Before: b[field], After: a[field]}
+		if bs, as, ok := stringLists(b[field], a[field]); ok {
+			change.Added, change.Removed = missing(bs, as), missing(as, bs)
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// stringLists returns before and after as lists of strings, when both are
+// lists of strings or absent
+func stringLists(before, after interface{}) ([]string, []string, bool) {
+	bs, ok := stringList(before)
+	if !ok {
+		return nil, nil, false
+	}
+	as, ok := stringList(after)
+	return bs, as, ok
+}
+
+func stringList(v interface{}) ([]string, bool) {
+	if v == nil {
+		return nil, true
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, false
+	}
+	strs := make([]string, 0, len(list))
+	for _, item := range list {
+		s, ok := item.(string)
+		if !ok {
+			return nil, false
+		}
+		strs = append(strs, s)
+	}
+	return strs, true
+}
+
+// missing returns the entries of to not in from
+func missing(from, to []string) []string {
+	var out []string
+	for _, s := range to {
+		if !contains(from, s) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// assignmentTarget is the Target of changes of an assignment
+func assignmentTarget(user, id string) string {
+	return user + "/" + id
+}
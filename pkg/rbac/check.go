@@ -0,0 +1,199 @@
+package rbac
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lsendel/impl-zamaz/pkg/i18n"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/middleware"
+	"github.com/lsendel/impl-zamaz/pkg/policy"
+	"github.com/lsendel/impl-zamaz/pkg/trust"
+)
+
+// Attributes Require adds to a check, on top of trust.RequestContext and
+// the user's directory attributes such as department
+const (
+	// AttributeTenant is the user's tenant
+	AttributeTenant = "tenant"
+	// AttributeTrustScore is the user's trust score, rated only when Require
+	// has a trust source
+	AttributeTrustScore = policy.AttributeTrustScore
+)
+
+// CheckRequest asks whether User has Permission. Conditions of assignments
+// and grants are tested on Attributes.
+type CheckRequest struct {
+	User       string
+	Permission string
+	Attributes map[string]string
+}
+
+// Grant is a role granting a permission
+type Grant struct {
+	RoleID string `json:"role_id"`
+	Role   string `json:"role"`
+	// Permission is the permission or the pattern that matched
+	Permission string `json:"permission"`
+}
+
+// Decision answers a CheckRequest
+type Decision struct {
+	Allowed bool `json:"allowed"`
+	// Grant is what allowed the request
+	Grant *Grant `json:"grant,omitempty"`
+	// Denial is the role that withheld the permission
+	Denial *Grant `json:"denial,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// Checker decides whether users have permissions
+type Checker interface {
+	Check(ctx context.Context, req CheckRequest) (*Decision, error)
+}
+
+// Check decides req: the user has the permission when a role assigned to
+// them, or one it inherits, grants it, and the conditions of both the
+// assignment and the grant hold. A role of theirs denying it overrides
+// every grant. Of several grants, the most specific pattern is used.
+func (m *Manager) Check(ctx context.Context, req CheckRequest) (*Decision, error) {
+	assignments, err := m.userAssignments(ctx, req.User)
+	if err != nil {
+		return nil, err
+	}
+	byID, err := m.rolesByID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var held []*Role
+	for _, a := range assignments {
+		if role := byID[a.RoleID]; role != nil && holds(a.Conditions, req.Attributes) {
+			held = append(held, role)
+		}
+	}
+	// Roles are in name order, so the same grant is used every time when
+	// several would do
+	grants, denials := make(map[string][]*Role), make(map[string][]*Role)
+	allow, deny := NewMatcher(), NewMatcher()
+	for _, r := range effectiveRoles(byID, held) {
+		for _, permission := range r.Permissions {
+			grants[permission] = append(grants[permission], r)
+			allow.Add(permission)
+		}
+		for _, permission := range r.Deny {
+			denials[permission] = append(denials[permission], r)
+			deny.Add(permission)
+		}
+	}
+	if matched := deny.Match(req.Permission); len(matched) > 0 {
+		r := denials[matched[0]][0]
+		return &Decision{
+			Denial: &Grant{RoleID: r.ID, Role: r.Name, Permission: matched[0]},
+			Reason: "denied by role",
+		}, nil
+	}
+	matched := allow.Match(req.Permission)
+	for _, permission := range matched {
+		for _, r := range grants[permission] {
+			if holds(r.Conditions[permission], req.Attributes) {
+				return &Decision{
+					Allowed: true,
+					Grant:   &Grant{RoleID: r.ID, Role: r.Name, Permission: permission},
+					Reason:  "granted by role",
+				}, nil
+			}
+		}
+	}
+	if len(matched) > 0 {
+		return &Decision{Reason: "conditions of the grant do not hold"}, nil
+	}
+	return &Decision{Reason: "no role grants the permission"}, nil
+}
+
+func holds(conditions []policy.Condition, attributes map[string]string) bool {
+	for _, cond := range conditions {
+		if !cond.Holds(attributes) {
+			return false
+		}
+	}
+	return true
+}
+
+// RequireConfig configures Require
+type RequireConfig struct {
+	// Trust, when set, rates users for conditions on trust_score
+	Trust middleware.TrustSource
+}
+
+// Require lets through the routes after it only users checker finds have
+// permission, answering 403 PERMISSION_DENIED otherwise. Conditions are
+// tested on the request's trust signals, its time, the user's directory
+// attributes and tenant and, with a trust source, trust_score. It must run
+// after authentication.
+func Require(checker Checker, permission string, cfg RequireConfig, logger interfaces.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, _ := c.Get("user")
+		info, ok := user.(*interfaces.UserInfo)
+		if !ok || info == nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error": i18n.Message(c, "UNAUTHORIZED"),
+				"code":  "UNAUTHORIZED",
+			})
+			return
+		}
+		decision, err := checker.Check(c.Request.Context(), CheckRequest{
+			User:       info.ID,
+			Permission: permission,
+			Attributes: attributes(c, info, cfg.Trust, logger),
+		})
+		if err != nil {
+			logger.Error("Failed to check permission", "user_id", info.ID, "permission", permission, "error", err)
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+				"error": i18n.Message(c, "INTERNAL_ERROR"),
+				"code":  "INTERNAL_ERROR",
+			})
+			return
+		}
+		if !decision.Allowed {
+			logger.Warn("Request denied by RBAC", "user_id", info.ID, "permission", permission, "reason", decision.Reason)
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"error":      i18n.Message(c, "PERMISSION_DENIED"),
+				"code":       "PERMISSION_DENIED",
+				"permission": permission,
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// attributes are those a request's checks test. The request's own override
+// the user's directory attributes of the same name.
+func attributes(c *gin.Context, user *interfaces.UserInfo, source middleware.TrustSource, logger interfaces.Logger) map[string]string {
+	attributes := make(map[string]string, len(user.Attributes)+8)
+	for name, value := range user.Attributes {
+		attributes[name] = value
+	}
+	for name, value := range trust.RequestContext(c) {
+		attributes[name] = value
+	}
+	attributes[policy.AttributeRoles] = strings.Join(user.Roles, ",")
+	attributes[policy.AttributeTime] = time.Now().UTC().Format(time.RFC3339)
+	if user.TenantID != "" {
+		attributes[AttributeTenant] = user.TenantID
+	}
+	if source != nil {
+		if score, err := source.CurrentTrust(c); err == nil {
+			attributes[AttributeTrustScore] = strconv.Itoa(score.Overall)
+		} else {
+			// Conditions on the score do not hold without it
+			logger.Warn("Failed to rate user for permission check", "user_id", user.ID, "error", err)
+		}
+	}
+	return attributes
+}
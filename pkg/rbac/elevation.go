@@ -0,0 +1,284 @@
+package rbac
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+// Elevation statuses
+const (
+	ElevationPending  = "pending"
+	ElevationApproved = "approved"
+	ElevationDenied   = "denied"
+)
+
+// Store keys of elevations by ID, and of the lease only one replica reaps
+// under
+const (
+	elevationPrefix = "rbac:elevation:"
+	reapLease       = "rbac:reap-lease"
+)
+
+// Errors returned by elevations
+var (
+	// ErrForbidden is returned when deciding an elevation the caller may
+	// not: their own, or one naming another approver
+	ErrForbidden = errors.New("not allowed to decide the elevation")
+	// ErrClosed is returned when deciding an elevation already decided
+	ErrClosed = errors.New("elevation already decided")
+)
+
+// Elevation asks for a user to be given a role once someone approves it,
+// for just-in-time access. Undecided elevations lapse after ElevationTTL.
+type Elevation struct {
+	ID     string `json:"id"`
+	UserID string `json:"user_id"`
+	RoleID string `json:"role_id"`
+	Reason string `json:"reason,omitempty"`
+	// Duration is how long the role lasts once approved, e.g. "1h"
+	Duration string `json:"duration,omitempty"`
+	// ExpiresAt is when the role lapses, instead of Duration. Without
+	// either the role is kept until unassigned.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// Approver, when set, is the only user who may decide the elevation
+	Approver    string     `json:"approver,omitempty"`
+	Status      string     `json:"status"`
+	RequestedBy string     `json:"requested_by"`
+	RequestedAt time.Time  `json:"requested_at"`
+	DecidedBy   string     `json:"decided_by,omitempty"`
+	DecidedAt   *time.Time `json:"decided_at,omitempty"`
+}
+
+// RequestElevation validates and stores e as pending under a new ID
+func (m *Manager) RequestElevation(ctx context.Context, e Elevation) (*Elevation, error) {
+	e.UserID = strings.TrimSpace(e.UserID)
+	e.Reason = strings.TrimSpace(e.Reason)
+	now := m.now().UTC()
+	switch {
+	case e.UserID == "":
+		return nil, fmt.Errorf("%w: user is required", ErrInvalid)
+	case len(e.Reason) > maxDescriptionLength:
+		return nil, fmt.Errorf("%w: reason longer than %d characters", ErrInvalid, maxDescriptionLength)
+	case e.Duration != "" && e.ExpiresAt != nil:
+		return nil, fmt.Errorf("%w: give a duration or an expiry, not both", ErrInvalid)
+	case e.ExpiresAt != nil && !e.ExpiresAt.After(now):
+		return nil, fmt.Errorf("%w: expiry must be in the future", ErrInvalid)
+	case e.ExpiresAt != nil && e.ExpiresAt.Sub(now) > m.config.MaxElevation:
+		return nil, fmt.Errorf("%w: elevations last at most %s", ErrInvalid, m.config.MaxElevation)
+	}
+	if e.Duration != "" {
+		d, err := time.ParseDuration(e.Duration)
+		if err != nil || d <= 0 || d > m.config.MaxElevation {
+			return nil, fmt.Errorf("%w: duration must be positive and at most %s", ErrInvalid, m.config.MaxElevation)
+		}
+	}
+	if _, _, err := m.loadRole(ctx, e.RoleID); err != nil {
+		return nil, err
+	}
+	// Approving would fail just the same
+	if err := m.checkSeparation(ctx, e.UserID, e.RoleID); err != nil {
+		return nil, err
+	}
+	var err error
+	if e.ID, err = newID(); err != nil {
+		return nil, err
+	}
+	e.Status, e.RequestedAt, e.DecidedBy, e.DecidedAt = ElevationPending, now, "", nil
+	data, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.store.Set(ctx, elevationPrefix+e.ID, data, m.config.ElevationTTL); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// Elevation returns elevation id, or ErrNotFound
+func (m *Manager) Elevation(ctx context.Context, id string) (*Elevation, error) {
+	e, _, err := m.loadElevation(ctx, id)
+	return e, err
+}
+
+// Elevations returns the elevations with status, or all when it is empty,
+// oldest first
+func (m *Manager) Elevations(ctx context.Context, status string) ([]*Elevation, error) {
+	keys, err := m.store.Keys(ctx, elevationPrefix)
+	if err != nil {
+		return nil, err
+	}
+	elevations := make([]*Elevation, 0, len(keys))
+	for _, key := range keys {
+		e, _, err := m.loadElevation(ctx, strings.TrimPrefix(key, elevationPrefix))
+		if errors.Is(err, ErrNotFound) {
+			// Lapsed since listed
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if status == "" || e.Status == status {
+			elevations = append(elevations, e)
+		}
+	}
+	sort.Slice(elevations, func(i, j int) bool { return elevations[i].RequestedAt.Before(elevations[j].RequestedAt) })
+	return elevations, nil
+}
+
+// ApproveElevation approves elevation id on behalf of approver, assigning
+// its role until it expires
+func (m *Manager) ApproveElevation(ctx context.Context, id, approver string) (*Assignment, error) {
+	e, old, err := m.decidable(ctx, id, approver)
+	if err != nil {
+		return nil, err
+	}
+	a := Assignment{UserID: e.UserID, RoleID: e.RoleID, AssignedBy: e.RequestedBy, ApprovedBy: approver, ExpiresAt: e.ExpiresAt}
+	if e.Duration != "" {
+		d, _ := time.ParseDuration(e.Duration)
+		expires := m.now().UTC().Add(d)
+		a.ExpiresAt = &expires
+	}
+	// The change is the approver's, for the reason given when requested
+	assignment, err := m.Assign(WithChange(ctx, approver, e.Reason), a)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.decide(ctx, e, old, ElevationApproved, approver); err != nil {
+		// Another approver or a denial won
+		_ = m.Unassign(ctx, e.UserID, e.RoleID)
+		return nil, err
+	}
+	return assignment, nil
+}
+
+// DenyElevation denies elevation id on behalf of approver
+func (m *Manager) DenyElevation(ctx context.Context, id, approver string) (*Elevation, error) {
+	e, old, err := m.decidable(ctx, id, approver)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.decide(ctx, e, old, ElevationDenied, approver); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Reap removes the assignments that have lapsed, returning how many
+func (m *Manager) Reap(ctx context.Context) (int, error) {
+	keys, err := m.store.Keys(ctx, assignmentPrefix)
+	if err != nil {
+		return 0, err
+	}
+	now := m.now()
+	reaped := 0
+	for _, key := range keys {
+		data, err := m.store.Get(ctx, key)
+		if errors.Is(err, store.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return reaped, err
+		}
+		var a Assignment
+		if err := json.Unmarshal(data, &a); err != nil || !a.expired(now) {
+			continue
+		}
+		if err := m.store.Delete(ctx, key); err != nil {
+			return reaped, err
+		}
+		reaped++
+		if err := m.record(ctx, ActionExpire, assignmentTarget(a.UserID, a.RoleID), "", &a, nil); err != nil {
+			return reaped, err
+		}
+	}
+	return reaped, nil
+}
+
+// Start reaps lapsed assignments every ReapInterval until ctx is
+// cancelled. Only one replica reaps each time.
+func (m *Manager) Start(ctx context.Context, logger interfaces.Logger) {
+	go func() {
+		ticker := time.NewTicker(m.config.ReapInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				n, _, err := m.store.Incr(ctx, reapLease, m.config.ReapInterval*9/10)
+				if err != nil {
+					logger.Warn("Failed to acquire RBAC reap lease", "error", err)
+					continue
+				}
+				if n != 1 {
+					continue
+				}
+				reaped, err := m.Reap(ctx)
+				if err != nil {
+					logger.Error("Failed to reap lapsed role assignments", "error", err)
+				}
+				if reaped > 0 {
+					logger.Info("Reaped lapsed role assignments", "count", reaped)
+				}
+			}
+		}
+	}()
+}
+
+// decidable loads elevation id, checking approver may decide it
+func (m *Manager) decidable(ctx context.Context, id, approver string) (*Elevation, []byte, error) {
+	e, old, err := m.loadElevation(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch {
+	case e.Status != ElevationPending:
+		return nil, nil, fmt.Errorf("%w: %s", ErrClosed, e.Status)
+	case approver == e.UserID || approver == e.RequestedBy:
+		return nil, nil, fmt.Errorf("%w: users cannot approve their own elevation", ErrForbidden)
+	case e.Approver != "" && approver != e.Approver:
+		return nil, nil, fmt.Errorf("%w: only %q may decide it", ErrForbidden, e.Approver)
+	}
+	return e, old, nil
+}
+
+// decide records approver's decision on e, which must be unchanged from old
+func (m *Manager) decide(ctx context.Context, e *Elevation, old []byte, status, approver string) error {
+	now := m.now().UTC()
+	e.Status, e.DecidedBy, e.DecidedAt = status, approver, &now
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	swapped, err := m.store.CompareAndSwap(ctx, elevationPrefix+e.ID, old, data, m.config.ElevationTTL)
+	if err != nil {
+		return err
+	}
+	if !swapped {
+		return ErrClosed
+	}
+	return nil
+}
+
+func (m *Manager) loadElevation(ctx context.Context, id string) (*Elevation, []byte, error) {
+	data, err := m.store.Get(ctx, elevationPrefix+id)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, nil, fmt.Errorf("elevation %q: %w", id, ErrNotFound)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var e Elevation
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, nil, err
+	}
+	return &e, data, nil
+}
@@ -0,0 +1,118 @@
+package rbac
+
+import (
+	"sort"
+	"strings"
+)
+
+// Wildcard stands for any segment of a permission. Trailing, it also
+// stands for any segments after it, so "billing:*" matches
+// "billing:invoices:read".
+const Wildcard = "*"
+
+// Matcher finds the permission patterns a permission matches. Patterns are
+// kept in a trie by segment, so matching costs the permission's length
+// rather than the number of patterns.
+type Matcher struct {
+	root *trieNode
+}
+
+type trieNode struct {
+	children map[string]*trieNode
+	// pattern ends at the node, matching what reaches it exactly
+	pattern string
+	// rest is a pattern ending in a wildcard at the node, matching any
+	// number of further segments
+	rest string
+}
+
+// NewMatcher creates a matcher of patterns
+func NewMatcher(patterns ...string) *Matcher {
+	m := &Matcher{root: &trieNode{}}
+	for _, pattern := range patterns {
+		m.Add(pattern)
+	}
+	return m
+}
+
+// Add adds pattern, "<service>:<resource>:<action>" or
+// "<resource>:<action>" with any segment a wildcard
+func (m *Matcher) Add(pattern string) {
+	node := m.root
+	segments := strings.Split(pattern, ":")
+	for _, segment := range segments {
+		child := node.children[segment]
+		if child == nil {
+			if node.children == nil {
+				node.children = make(map[string]*trieNode)
+			}
+			child = &trieNode{}
+			node.children[segment] = child
+		}
+		node = child
+	}
+	node.pattern = pattern
+	if segments[len(segments)-1] == Wildcard {
+		node.rest = pattern
+	}
+}
+
+// Match returns the patterns permission matches, most specific first:
+// those naming a segment come before those with a wildcard in its place
+func (m *Matcher) Match(permission string) []string {
+	var matched []string
+	seen := make(map[string]bool)
+	add := func(pattern string) {
+		if pattern != "" && !seen[pattern] {
+			seen[pattern] = true
+			matched = append(matched, pattern)
+		}
+	}
+	segments := strings.Split(permission, ":")
+	var walk func(node *trieNode, i int)
+	walk = func(node *trieNode, i int) {
+		if i == len(segments) {
+			add(node.pattern)
+			return
+		}
+		if child := node.children[segments[i]]; child != nil && segments[i] != Wildcard {
+			walk(child, i+1)
+		}
+		if child := node.children[Wildcard]; child != nil {
+			// Still further segments for the wildcard to take
+			if i+1 < len(segments) {
+				add(child.rest)
+			}
+			walk(child, i+1)
+		}
+	}
+	walk(m.root, 0)
+	sort.SliceStable(matched, func(i, j int) bool { return moreSpecific(matched[i], matched[j]) })
+	return matched
+}
+
+// MatchPermission reports whether permission matches pattern
+func MatchPermission(pattern, permission string) bool {
+	return len(NewMatcher(pattern).Match(permission)) > 0
+}
+
+// moreSpecific reports whether pattern a names a segment where b has a
+// wildcard, comparing from the left, or else is the longer of the two
+func moreSpecific(a, b string) bool {
+	as, bs := strings.Split(a, ":"), strings.Split(b, ":")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if aw, bw := as[i] == Wildcard, bs[i] == Wildcard; aw != bw {
+			return bw
+		}
+	}
+	return len(as) > len(bs)
+}
+
+func isPattern(permission string) bool {
+	for _, segment := range strings.Split(permission, ":") {
+		if segment == Wildcard {
+			return true
+		}
+	}
+	return false
+}
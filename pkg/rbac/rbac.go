@@ -0,0 +1,797 @@
+// Package rbac keeps roles, the permissions they grant and the users they
+// are assigned to. Roles may inherit others, so an admin role grants what
+// the user role does. Everything lives in the shared store, so every
+// replica sees the same roles and they survive restarts with a persistent
+// backend such as Redis. Every change is recorded with who made it, why and
+// what it changed; see Changes.
+package rbac
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lsendel/impl-zamaz/pkg/policy"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+// Errors returned by Manager
+var (
+	ErrNotFound = errors.New("not found")
+	ErrInvalid  = errors.New("invalid rbac request")
+	// ErrExists is returned when creating a role or permission whose name
+	// is taken, or assigning a role the user already has
+	ErrExists = errors.New("already exists")
+	// ErrInUse is returned when deleting a permission a role grants, or a
+	// role assigned to users, inherited by another role or kept apart from
+	// another by a constraint
+	ErrInUse = errors.New("still in use")
+	// ErrConflict is returned when another replica is changing the same
+	// role; the request can be retried
+	ErrConflict = errors.New("role is being modified concurrently")
+	// ErrLimit is returned when creating more roles or permissions than
+	// the configured maximum
+	ErrLimit = errors.New("too many roles or permissions")
+)
+
+// Store keys: roles by ID and by name, which keeps names unique,
+// permissions by name and assignments by hashed user and role
+const (
+	rolePrefix       = "rbac:role:"
+	roleNamePrefix   = "rbac:role-name:"
+	permissionPrefix = "rbac:permission:"
+	assignmentPrefix = "rbac:assignment:"
+)
+
+// Limits on roles and permissions
+const (
+	maxDescriptionLength = 1024
+	maxPermissions       = 256
+	maxInherits          = 16
+	maxConditions        = 32
+)
+
+var (
+	// Role names are like "support-agent"
+	validName = regexp.MustCompile(`^[a-z0-9]([a-z0-9._-]{0,62}[a-z0-9])?$`)
+	// Permissions are "[<service>:]<resource>:<action>", like
+	// "devices:read" or "billing:invoices:approve"
+	validPermission = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,63}(:[a-z0-9][a-z0-9._-]{0,63}){1,2}$`)
+	// Roles may grant and deny patterns of them, with wildcards for
+	// segments, like "billing:*:read"
+	validPattern = regexp.MustCompile(`^([a-z0-9][a-z0-9._-]{0,63}|\*)(:([a-z0-9][a-z0-9._-]{0,63}|\*)){1,2}$`)
+)
+
+// Permission is an action on a resource roles can grant, named
+// "<resource>:<action>" or, scoped to a service,
+// "<service>:<resource>:<action>"
+type Permission struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Role grants its permissions to the users it is assigned to.
+// Permissions and Deny hold registered permissions or patterns of them
+// with wildcards, like "billing:invoices:*".
+type Role struct {
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Permissions []string `json:"permissions"`
+	// Deny withholds permissions from the role's users whatever grants
+	// them, even another role or a more specific pattern
+	Deny []string `json:"deny,omitempty"`
+	// Inherits are the IDs of the roles whose permissions this one also
+	// grants, and so on up
+	Inherits []string `json:"inherits,omitempty"`
+	// Conditions limit the grant of some permissions, by permission, to
+	// checks whose attributes they hold for, e.g. a department
+	Conditions map[string][]policy.Condition `json:"conditions,omitempty"`
+	CreatedAt  time.Time                     `json:"created_at"`
+	UpdatedAt  time.Time                     `json:"updated_at"`
+}
+
+// Assignment gives a user a role
+type Assignment struct {
+	UserID string `json:"user_id"`
+	RoleID string `json:"role_id"`
+	// Conditions limit the assignment to checks whose attributes they hold
+	// for, e.g. a tenant or a minimum trust_score
+	Conditions []policy.Condition `json:"conditions,omitempty"`
+	AssignedBy string             `json:"assigned_by,omitempty"`
+	// ApprovedBy is who approved the elevation that made the assignment
+	ApprovedBy string    `json:"approved_by,omitempty"`
+	AssignedAt time.Time `json:"assigned_at"`
+	// ExpiresAt, when set, is when the assignment lapses
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// expired reports whether a has lapsed at now
+func (a *Assignment) expired(now time.Time) bool {
+	return a.ExpiresAt != nil && !now.Before(*a.ExpiresAt)
+}
+
+// Config configures a Manager
+type Config struct {
+	// MaxRoles bounds how many roles may exist; defaults to 1000
+	MaxRoles int
+	// MaxPermissions bounds how many permissions may exist; defaults to
+	// 1000
+	MaxPermissions int
+	// MaxElevation bounds how long elevations with an expiry last;
+	// defaults to 8h
+	MaxElevation time.Duration
+	// ElevationTTL is how long elevations are kept, so undecided ones
+	// lapse; defaults to 24h
+	ElevationTTL time.Duration
+	// ReapInterval is how often Start removes lapsed assignments; defaults
+	// to 1m
+	ReapInterval time.Duration
+	// ChangeRetention is how long recorded changes are kept; defaults to
+	// 90 days
+	ChangeRetention time.Duration
+}
+
+// Manager keeps roles, permissions and assignments
+type Manager struct {
+	config Config
+	store  store.Store
+	now    func() time.Time
+}
+
+// NewManager creates a manager on s
+func NewManager(cfg Config, s store.Store) *Manager {
+	if cfg.MaxRoles <= 0 {
+		cfg.MaxRoles = 1000
+	}
+	if cfg.MaxPermissions <= 0 {
+		cfg.MaxPermissions = 1000
+	}
+	if cfg.MaxElevation <= 0 {
+		cfg.MaxElevation = 8 * time.Hour
+	}
+	if cfg.ElevationTTL <= 0 {
+		cfg.ElevationTTL = 24 * time.Hour
+	}
+	if cfg.ReapInterval <= 0 {
+		cfg.ReapInterval = time.Minute
+	}
+	if cfg.ChangeRetention <= 0 {
+		cfg.ChangeRetention = 90 * 24 * time.Hour
+	}
+	return &Manager{config: cfg, store: s, now: time.Now}
+}
+
+// CreatePermission registers p so roles can grant it
+func (m *Manager) CreatePermission(ctx context.Context, p Permission) (*Permission, error) {
+	p.Name = strings.TrimSpace(p.Name)
+	p.Description = strings.TrimSpace(p.Description)
+	switch {
+	case !validPermission.MatchString(p.Name):
+		return nil, fmt.Errorf("%w: permission %q must be [<service>:]<resource>:<action> in lower case", ErrInvalid, p.Name)
+	case len(p.Description) > maxDescriptionLength:
+		return nil, fmt.Errorf("%w: description longer than %d characters", ErrInvalid, maxDescriptionLength)
+	}
+	keys, err := m.store.Keys(ctx, permissionPrefix)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) >= m.config.MaxPermissions {
+		return nil, fmt.Errorf("%w: at most %d permissions", ErrLimit, m.config.MaxPermissions)
+	}
+	p.CreatedAt = m.now().UTC()
+	data, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	created, err := m.store.CompareAndSwap(ctx, permissionPrefix+p.Name, nil, data, 0)
+	if err != nil {
+		return nil, err
+	}
+	if !created {
+		return nil, fmt.Errorf("%w: permission %q", ErrExists, p.Name)
+	}
+	if err := m.record(ctx, ActionPermissionCreate, p.Name, "", nil, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Permissions returns every permission by name
+func (m *Manager) Permissions(ctx context.Context) ([]*Permission, error) {
+	keys, err := m.store.Keys(ctx, permissionPrefix)
+	if err != nil {
+		return nil, err
+	}
+	permissions := make([]*Permission, 0, len(keys))
+	for _, key := range keys {
+		var p Permission
+		if err := m.get(ctx, key, &p); errors.Is(err, ErrNotFound) {
+			// Deleted since listed
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, &p)
+	}
+	sort.Slice(permissions, func(i, j int) bool { return permissions[i].Name < permissions[j].Name })
+	return permissions, nil
+}
+
+// DeletePermission removes permission name, which no role may grant or
+// deny by name
+func (m *Manager) DeletePermission(ctx context.Context, name string) error {
+	var p Permission
+	if err := m.get(ctx, permissionPrefix+name, &p); err != nil {
+		return fmt.Errorf("permission %q: %w", name, err)
+	}
+	roles, err := m.Roles(ctx)
+	if err != nil {
+		return err
+	}
+	for _, role := range roles {
+		if contains(role.Permissions, name) || contains(role.Deny, name) {
+			return fmt.Errorf("%w: role %q names %q", ErrInUse, role.Name, name)
+		}
+	}
+	if err := m.store.Delete(ctx, permissionPrefix+name); err != nil {
+		return err
+	}
+	return m.record(ctx, ActionPermissionDelete, name, "", &p, nil)
+}
+
+// CreateRole validates and stores role under a new ID. Its name must be
+// free and its permissions and the roles it inherits registered.
+func (m *Manager) CreateRole(ctx context.Context, role Role) (*Role, error) {
+	if err := m.validateRole(ctx, &role); err != nil {
+		return nil, err
+	}
+	if err := m.checkInherits(ctx, "", role.Inherits); err != nil {
+		return nil, err
+	}
+	keys, err := m.store.Keys(ctx, rolePrefix)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) >= m.config.MaxRoles {
+		return nil, fmt.Errorf("%w: at most %d roles", ErrLimit, m.config.MaxRoles)
+	}
+	if role.ID, err = newID(); err != nil {
+		return nil, err
+	}
+	if err := m.claimName(ctx, role.Name, role.ID); err != nil {
+		return nil, err
+	}
+	role.CreatedAt = m.now().UTC()
+	role.UpdatedAt = role.CreatedAt
+	data, err := json.Marshal(role)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.store.Set(ctx, rolePrefix+role.ID, data, 0); err != nil {
+		_ = m.store.Delete(ctx, roleNamePrefix+role.Name)
+		return nil, err
+	}
+	if err := m.record(ctx, ActionRoleCreate, role.ID, "", nil, &role); err != nil {
+		return nil, err
+	}
+	return &role, nil
+}
+
+// Role returns role id, or ErrNotFound
+func (m *Manager) Role(ctx context.Context, id string) (*Role, error) {
+	role, _, err := m.loadRole(ctx, id)
+	return role, err
+}
+
+// Roles returns every role by name
+func (m *Manager) Roles(ctx context.Context) ([]*Role, error) {
+	keys, err := m.store.Keys(ctx, rolePrefix)
+	if err != nil {
+		return nil, err
+	}
+	roles := make([]*Role, 0, len(keys))
+	for _, key := range keys {
+		role, _, err := m.loadRole(ctx, strings.TrimPrefix(key, rolePrefix))
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i].Name < roles[j].Name })
+	return roles, nil
+}
+
+// UpdateRole replaces role id with role, keeping its ID and creation time.
+// A new name must be free, and the role may not end up inheriting itself.
+func (m *Manager) UpdateRole(ctx context.Context, id string, role Role) (*Role, error) {
+	if err := m.validateRole(ctx, &role); err != nil {
+		return nil, err
+	}
+	if err := m.checkInherits(ctx, id, role.Inherits); err != nil {
+		return nil, err
+	}
+	current, old, err := m.loadRole(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	renamed := role.Name != current.Name
+	if renamed {
+		if err := m.claimName(ctx, role.Name, id); err != nil {
+			return nil, err
+		}
+	}
+	role.ID, role.CreatedAt, role.UpdatedAt = id, current.CreatedAt, m.now().UTC()
+	data, err := json.Marshal(role)
+	if err != nil {
+		return nil, err
+	}
+	swapped, err := m.store.CompareAndSwap(ctx, rolePrefix+id, old, data, 0)
+	if err == nil && !swapped {
+		err = ErrConflict
+	}
+	if err != nil {
+		if renamed {
+			_ = m.store.Delete(ctx, roleNamePrefix+role.Name)
+		}
+		return nil, err
+	}
+	if renamed {
+		_ = m.store.Delete(ctx, roleNamePrefix+current.Name)
+	}
+	if err := m.record(ctx, ActionRoleUpdate, id, "", current, &role); err != nil {
+		return nil, err
+	}
+	return &role, nil
+}
+
+// DeleteRole removes role id, which may not be assigned to anyone,
+// inherited by another role or named by a constraint
+func (m *Manager) DeleteRole(ctx context.Context, id string) error {
+	role, _, err := m.loadRole(ctx, id)
+	if err != nil {
+		return err
+	}
+	roles, err := m.Roles(ctx)
+	if err != nil {
+		return err
+	}
+	for _, other := range roles {
+		if contains(other.Inherits, id) {
+			return fmt.Errorf("%w: role %q inherits %q", ErrInUse, other.Name, role.Name)
+		}
+	}
+	constraints, err := m.Constraints(ctx)
+	if err != nil {
+		return err
+	}
+	for _, c := range constraints {
+		if c.Roles[0] == id || c.Roles[1] == id {
+			return fmt.Errorf("%w: constraint %q names %q", ErrInUse, c.ID, role.Name)
+		}
+	}
+	assignments, err := m.roleAssignments(ctx, id)
+	if err != nil {
+		return err
+	}
+	if len(assignments) > 0 {
+		return fmt.Errorf("%w: role %q is assigned to %d users", ErrInUse, role.Name, len(assignments))
+	}
+	if err := m.store.Delete(ctx, rolePrefix+id); err != nil {
+		return err
+	}
+	if err := m.store.Delete(ctx, roleNamePrefix+role.Name); err != nil {
+		return err
+	}
+	return m.record(ctx, ActionRoleDelete, id, "", role, nil)
+}
+
+// Assign stores a, giving its user its role until it expires
+func (m *Manager) Assign(ctx context.Context, a Assignment) (*Assignment, error) {
+	if a.UserID = strings.TrimSpace(a.UserID); a.UserID == "" {
+		return nil, fmt.Errorf("%w: user is required", ErrInvalid)
+	}
+	now := m.now().UTC()
+	if a.ExpiresAt != nil && !a.ExpiresAt.After(now) {
+		return nil, fmt.Errorf("%w: expiry must be in the future", ErrInvalid)
+	}
+	if err := validateConditions(a.Conditions); err != nil {
+		return nil, err
+	}
+	if _, _, err := m.loadRole(ctx, a.RoleID); err != nil {
+		return nil, err
+	}
+	if err := m.checkSeparation(ctx, a.UserID, a.RoleID); err != nil {
+		return nil, err
+	}
+	a.AssignedAt = now
+	data, err := json.Marshal(a)
+	if err != nil {
+		return nil, err
+	}
+	key := assignmentKey(a.UserID, a.RoleID)
+	created, err := m.store.CompareAndSwap(ctx, key, nil, data, 0)
+	if err != nil {
+		return nil, err
+	}
+	if !created {
+		// A lapsed assignment the reaper has not removed yet is replaced
+		old, err := m.store.Get(ctx, key)
+		var current Assignment
+		if err == nil && json.Unmarshal(old, &current) == nil && current.expired(now) {
+			created, err = m.store.CompareAndSwap(ctx, key, old, data, 0)
+		}
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			return nil, err
+		}
+	}
+	if !created {
+		return nil, fmt.Errorf("%w: user already has the role", ErrExists)
+	}
+	if err := m.record(ctx, ActionAssign, assignmentTarget(a.UserID, a.RoleID), a.AssignedBy, nil, &a); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// Unassign takes role id from user
+func (m *Manager) Unassign(ctx context.Context, user, id string) error {
+	var a Assignment
+	if err := m.get(ctx, assignmentKey(user, id), &a); err != nil {
+		return fmt.Errorf("assignment: %w", err)
+	}
+	if err := m.store.Delete(ctx, assignmentKey(user, id)); err != nil {
+		return err
+	}
+	return m.record(ctx, ActionUnassign, assignmentTarget(user, id), "", &a, nil)
+}
+
+// Assignments returns the assignments of role id, or every assignment when
+// id is empty, that have not lapsed
+func (m *Manager) Assignments(ctx context.Context, id string) ([]*Assignment, error) {
+	keys, err := m.store.Keys(ctx, assignmentPrefix)
+	if err != nil {
+		return nil, err
+	}
+	now := m.now()
+	assignments := make([]*Assignment, 0, len(keys))
+	for _, key := range keys {
+		if id != "" && !strings.HasSuffix(key, ":"+id) {
+			continue
+		}
+		var a Assignment
+		if err := m.get(ctx, key, &a); errors.Is(err, ErrNotFound) {
+			// Unassigned since listed
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if !a.expired(now) {
+			assignments = append(assignments, &a)
+		}
+	}
+	return assignments, nil
+}
+
+// UserRoles returns the roles assigned to user by name, whatever the
+// conditions of the assignments
+func (m *Manager) UserRoles(ctx context.Context, user string) ([]*Role, error) {
+	assignments, err := m.userAssignments(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	roles := make([]*Role, 0, len(assignments))
+	for _, a := range assignments {
+		role, _, err := m.loadRole(ctx, a.RoleID)
+		if errors.Is(err, ErrNotFound) {
+			// Deleted since assigned
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i].Name < roles[j].Name })
+	return roles, nil
+}
+
+// UserPermissions returns the permissions the roles of user grant, by name,
+// whatever the conditions of the grants. Unless effective, those of the
+// roles they inherit are left out.
+func (m *Manager) UserPermissions(ctx context.Context, user string, effective bool) ([]string, error) {
+	roles, err := m.UserRoles(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	if effective {
+		if roles, err = m.EffectiveRoles(ctx, roles); err != nil {
+			return nil, err
+		}
+	}
+	permissions := []string{}
+	for _, role := range roles {
+		for _, permission := range role.Permissions {
+			if !contains(permissions, permission) {
+				permissions = append(permissions, permission)
+			}
+		}
+	}
+	sort.Strings(permissions)
+	return permissions, nil
+}
+
+// EffectiveRoles returns roles and every role they inherit, directly or
+// not, by name. A loop of roles inheriting one another is followed once
+// round, and inherited roles deleted since are skipped.
+func (m *Manager) EffectiveRoles(ctx context.Context, roles []*Role) ([]*Role, error) {
+	byID, err := m.rolesByID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return effectiveRoles(byID, roles), nil
+}
+
+func (m *Manager) rolesByID(ctx context.Context) (map[string]*Role, error) {
+	all, err := m.Roles(ctx)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]*Role, len(all))
+	for _, role := range all {
+		byID[role.ID] = role
+	}
+	return byID, nil
+}
+
+func effectiveRoles(byID map[string]*Role, roles []*Role) []*Role {
+	seen := make(map[string]bool)
+	var effective []*Role
+	queue := roles
+	for len(queue) > 0 {
+		role := queue[0]
+		queue = queue[1:]
+		if seen[role.ID] {
+			continue
+		}
+		seen[role.ID] = true
+		effective = append(effective, role)
+		for _, id := range role.Inherits {
+			if parent := byID[id]; parent != nil && !seen[id] {
+				queue = append(queue, parent)
+			}
+		}
+	}
+	sort.Slice(effective, func(i, j int) bool { return effective[i].Name < effective[j].Name })
+	return effective
+}
+
+// checkInherits checks that the roles in inherits exist and that none of
+// them inherits role id, which would be a loop
+func (m *Manager) checkInherits(ctx context.Context, id string, inherits []string) error {
+	if len(inherits) == 0 {
+		return nil
+	}
+	direct := make([]*Role, 0, len(inherits))
+	for _, parent := range inherits {
+		if parent == id {
+			return fmt.Errorf("%w: a role cannot inherit itself", ErrInvalid)
+		}
+		role, _, err := m.loadRole(ctx, parent)
+		if errors.Is(err, ErrNotFound) {
+			return fmt.Errorf("%w: inherited role %q does not exist", ErrInvalid, parent)
+		}
+		if err != nil {
+			return err
+		}
+		direct = append(direct, role)
+	}
+	effective, err := m.EffectiveRoles(ctx, direct)
+	if err != nil {
+		return err
+	}
+	for _, role := range effective {
+		if role.ID == id {
+			return fmt.Errorf("%w: the roles it inherits already inherit it", ErrInvalid)
+		}
+	}
+	return nil
+}
+
+// validateRole checks role, trimming its name and description and sorting
+// its permissions and the roles it inherits
+func (m *Manager) validateRole(ctx context.Context, role *Role) error {
+	role.Name = strings.TrimSpace(role.Name)
+	role.Description = strings.TrimSpace(role.Description)
+	switch {
+	case !validName.MatchString(role.Name):
+		return fmt.Errorf("%w: name %q must be lower case letters, digits, '.', '_' or '-'", ErrInvalid, role.Name)
+	case len(role.Description) > maxDescriptionLength:
+		return fmt.Errorf("%w: description longer than %d characters", ErrInvalid, maxDescriptionLength)
+	case len(role.Permissions) > maxPermissions, len(role.Deny) > maxPermissions:
+		return fmt.Errorf("%w: at most %d permissions", ErrInvalid, maxPermissions)
+	case len(role.Inherits) > maxInherits:
+		return fmt.Errorf("%w: at most %d inherited roles", ErrInvalid, maxInherits)
+	}
+	inherits := make([]string, 0, len(role.Inherits))
+	for _, id := range role.Inherits {
+		if !contains(inherits, id) {
+			inherits = append(inherits, id)
+		}
+	}
+	sort.Strings(inherits)
+	role.Inherits = inherits
+	for permission, conditions := range role.Conditions {
+		if !contains(role.Permissions, permission) {
+			return fmt.Errorf("%w: conditions of %q, which the role does not grant", ErrInvalid, permission)
+		}
+		if err := validateConditions(conditions); err != nil {
+			return err
+		}
+	}
+	var err error
+	if role.Permissions, err = m.validatePermissions(ctx, role.Permissions); err != nil {
+		return err
+	}
+	if role.Deny, err = m.validatePermissions(ctx, role.Deny); err != nil {
+		return err
+	}
+	return nil
+}
+
+// validatePermissions checks that permissions are registered or patterns,
+// returning them sorted without duplicates
+func (m *Manager) validatePermissions(ctx context.Context, permissions []string) ([]string, error) {
+	valid := make([]string, 0, len(permissions))
+	for _, name := range permissions {
+		if contains(valid, name) {
+			continue
+		}
+		if isPattern(name) {
+			if !validPattern.MatchString(name) {
+				return nil, fmt.Errorf("%w: pattern %q must be [<service>:]<resource>:<action> with '*' for any segment", ErrInvalid, name)
+			}
+			valid = append(valid, name)
+			continue
+		}
+		var p Permission
+		if err := m.get(ctx, permissionPrefix+name, &p); errors.Is(err, ErrNotFound) {
+			return nil, fmt.Errorf("%w: permission %q is not registered", ErrInvalid, name)
+		} else if err != nil {
+			return nil, err
+		}
+		valid = append(valid, name)
+	}
+	sort.Strings(valid)
+	return valid, nil
+}
+
+func validateConditions(conditions []policy.Condition) error {
+	if len(conditions) > maxConditions {
+		return fmt.Errorf("%w: at most %d conditions", ErrInvalid, maxConditions)
+	}
+	for i := range conditions {
+		if err := conditions[i].Validate(); err != nil {
+			return fmt.Errorf("%w: condition %d: %s", ErrInvalid, i+1, err)
+		}
+	}
+	return nil
+}
+
+// claimName reserves name for role id
+func (m *Manager) claimName(ctx context.Context, name, id string) error {
+	claimed, err := m.store.CompareAndSwap(ctx, roleNamePrefix+name, nil, []byte(id), 0)
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		return fmt.Errorf("%w: role %q", ErrExists, name)
+	}
+	return nil
+}
+
+func (m *Manager) roleAssignments(ctx context.Context, id string) ([]string, error) {
+	keys, err := m.store.Keys(ctx, assignmentPrefix)
+	if err != nil {
+		return nil, err
+	}
+	var assigned []string
+	for _, key := range keys {
+		if strings.HasSuffix(key, ":"+id) {
+			assigned = append(assigned, key)
+		}
+	}
+	return assigned, nil
+}
+
+// userAssignments returns the assignments of user that have not lapsed
+func (m *Manager) userAssignments(ctx context.Context, user string) ([]*Assignment, error) {
+	keys, err := m.store.Keys(ctx, assignmentPrefix+hashUser(user)+":")
+	if err != nil {
+		return nil, err
+	}
+	now := m.now()
+	assignments := make([]*Assignment, 0, len(keys))
+	for _, key := range keys {
+		var a Assignment
+		if err := m.get(ctx, key, &a); errors.Is(err, ErrNotFound) {
+			// Unassigned since listed
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if a.expired(now) {
+			continue
+		}
+		assignments = append(assignments, &a)
+	}
+	return assignments, nil
+}
+
+func (m *Manager) loadRole(ctx context.Context, id string) (*Role, []byte, error) {
+	data, err := m.store.Get(ctx, rolePrefix+id)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, nil, fmt.Errorf("role %q: %w", id, ErrNotFound)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var role Role
+	if err := json.Unmarshal(data, &role); err != nil {
+		return nil, nil, err
+	}
+	return &role, data, nil
+}
+
+func (m *Manager) get(ctx context.Context, key string, v interface{}) error {
+	data, err := m.store.Get(ctx, key)
+	if errors.Is(err, store.ErrNotFound) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// assignmentKey hashes the user to bound the key
+func assignmentKey(user, id string) string {
+	return assignmentPrefix + hashUser(user) + ":" + id
+}
+
+func hashUser(user string) string {
+	sum := sha256.Sum256([]byte(user))
+	return hex.EncodeToString(sum[:16])
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	h := hex.EncodeToString(b)
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:], nil
+}
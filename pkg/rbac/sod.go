@@ -0,0 +1,236 @@
+package rbac
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Store keys of separation-of-duties constraints by ID
+const constraintPrefix = "rbac:sod:"
+
+// maxConstraints bounds how many constraints may exist
+const maxConstraints = 256
+
+// ErrSeparation is returned when an assignment would give a user both roles
+// of a separation-of-duties constraint
+var ErrSeparation = errors.New("separation of duties violated")
+
+// Constraint keeps two roles apart: no user may hold both, directly or
+// through the roles they inherit, e.g. an approver and a requester
+type Constraint struct {
+	ID          string `json:"id"`
+	Description string `json:"description,omitempty"`
+	// Roles are the IDs of the mutually exclusive roles
+	Roles     [2]string `json:"roles"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Violation is a user holding both roles of a constraint, made before the
+// constraint or through a role since made to inherit another
+type Violation struct {
+	UserID     string      `json:"user_id"`
+	Constraint *Constraint `json:"constraint"`
+	// Roles are the names of the roles the user holds
+	Roles [2]string `json:"roles"`
+}
+
+// CreateConstraint validates and stores c under a new ID. Users already
+// holding both roles are left alone and reported by Violations.
+func (m *Manager) CreateConstraint(ctx context.Context, c Constraint) (*Constraint, error) {
+	c.Description = strings.TrimSpace(c.Description)
+	switch {
+	case c.Roles[0] == "" || c.Roles[1] == "":
+		return nil, fmt.Errorf("%w: two roles are required", ErrInvalid)
+	case c.Roles[0] == c.Roles[1]:
+		return nil, fmt.Errorf("%w: a role cannot exclude itself", ErrInvalid)
+	case len(c.Description) > maxDescriptionLength:
+		return nil, fmt.Errorf("%w: description longer than %d characters", ErrInvalid, maxDescriptionLength)
+	}
+	for _, id := range c.Roles {
+		if _, _, err := m.loadRole(ctx, id); errors.Is(err, ErrNotFound) {
+			return nil, fmt.Errorf("%w: role %q does not exist", ErrInvalid, id)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	// The same pair either way round
+	if c.Roles[0] > c.Roles[1] {
+		c.Roles[0], c.Roles[1] = c.Roles[1], c.Roles[0]
+	}
+	constraints, err := m.Constraints(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(constraints) >= maxConstraints {
+		return nil, fmt.Errorf("%w: at most %d constraints", ErrLimit, maxConstraints)
+	}
+	for _, other := range constraints {
+		if other.Roles == c.Roles {
+			return nil, fmt.Errorf("%w: constraint %q keeps the roles apart", ErrExists, other.ID)
+		}
+	}
+	if c.ID, err = newID(); err != nil {
+		return nil, err
+	}
+	c.CreatedAt = m.now().UTC()
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.store.Set(ctx, constraintPrefix+c.ID, data, 0); err != nil {
+		return nil, err
+	}
+	if err := m.record(ctx, ActionConstraintCreate, c.ID, c.CreatedBy, nil, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Constraints returns every constraint, oldest first
+func (m *Manager) Constraints(ctx context.Context) ([]*Constraint, error) {
+	keys, err := m.store.Keys(ctx, constraintPrefix)
+	if err != nil {
+		return nil, err
+	}
+	constraints := make([]*Constraint, 0, len(keys))
+	for _, key := range keys {
+		var c Constraint
+		if err := m.get(ctx, key, &c); errors.Is(err, ErrNotFound) {
+			// Deleted since listed
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		constraints = append(constraints, &c)
+	}
+	sort.Slice(constraints, func(i, j int) bool { return constraints[i].CreatedAt.Before(constraints[j].CreatedAt) })
+	return constraints, nil
+}
+
+// DeleteConstraint removes constraint id
+func (m *Manager) DeleteConstraint(ctx context.Context, id string) error {
+	var c Constraint
+	if err := m.get(ctx, constraintPrefix+id, &c); err != nil {
+		return fmt.Errorf("constraint %q: %w", id, err)
+	}
+	if err := m.store.Delete(ctx, constraintPrefix+id); err != nil {
+		return err
+	}
+	return m.record(ctx, ActionConstraintDelete, id, "", &c, nil)
+}
+
+// Violations returns the users holding both roles of a constraint, by user
+func (m *Manager) Violations(ctx context.Context) ([]*Violation, error) {
+	constraints, err := m.Constraints(ctx)
+	if err != nil {
+		return nil, err
+	}
+	violations := []*Violation{}
+	if len(constraints) == 0 {
+		return violations, nil
+	}
+	assignments, err := m.Assignments(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	byID, err := m.rolesByID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	held := make(map[string][]*Role)
+	for _, a := range assignments {
+		if role := byID[a.RoleID]; role != nil {
+			held[a.UserID] = append(held[a.UserID], role)
+		}
+	}
+	users := make([]string, 0, len(held))
+	for user := range held {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	for _, user := range users {
+		effective := effectiveRoles(byID, held[user])
+		for _, c := range violated(constraints, effective) {
+			violations = append(violations, &Violation{UserID: user, Constraint: c, Roles: roleNames(byID, c)})
+		}
+	}
+	return violations, nil
+}
+
+// checkSeparation returns ErrSeparation when giving user role id would
+// have them hold both roles of a constraint
+func (m *Manager) checkSeparation(ctx context.Context, user, id string) error {
+	constraints, err := m.Constraints(ctx)
+	if err != nil || len(constraints) == 0 {
+		return err
+	}
+	assignments, err := m.userAssignments(ctx, user)
+	if err != nil {
+		return err
+	}
+	byID, err := m.rolesByID(ctx)
+	if err != nil {
+		return err
+	}
+	var before, after []*Role
+	for _, a := range assignments {
+		if role := byID[a.RoleID]; role != nil {
+			before = append(before, role)
+		}
+	}
+	if role := byID[id]; role != nil {
+		after = append(after, role)
+	}
+	after = append(after, before...)
+	// Only constraints the new role breaks; those the user already
+	// violates are for the report
+	existing := violated(constraints, effectiveRoles(byID, before))
+	for _, c := range violated(constraints, effectiveRoles(byID, after)) {
+		if !containsConstraint(existing, c) {
+			names := roleNames(byID, c)
+			return fmt.Errorf("%w: roles %q and %q are mutually exclusive", ErrSeparation, names[0], names[1])
+		}
+	}
+	return nil
+}
+
+// violated returns the constraints whose roles are both among roles
+func violated(constraints []*Constraint, roles []*Role) []*Constraint {
+	ids := make(map[string]bool, len(roles))
+	for _, role := range roles {
+		ids[role.ID] = true
+	}
+	var broken []*Constraint
+	for _, c := range constraints {
+		if ids[c.Roles[0]] && ids[c.Roles[1]] {
+			broken = append(broken, c)
+		}
+	}
+	return broken
+}
+
+func containsConstraint(list []*Constraint, c *Constraint) bool {
+	for _, other := range list {
+		if other.ID == c.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// roleNames names the roles of c, falling back to their IDs
+func roleNames(byID map[string]*Role, c *Constraint) [2]string {
+	names := c.Roles
+	for i, id := range c.Roles {
+		if role := byID[id]; role != nil {
+			names[i] = role.Name
+		}
+	}
+	return names
+}
@@ -0,0 +1,56 @@
+package replication
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lsendel/impl-zamaz/pkg/i18n"
+)
+
+// maxPushBytes bounds the body of one push
+const maxPushBytes = 32 << 20
+
+// Handler receives pushes from peer regions at Path. It is authenticated by
+// the shared secret, so it is mounted outside the user authentication.
+func (r *Replicator) Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxPushBytes))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": i18n.Message(c, "INVALID_INPUT"), "code": "INVALID_INPUT"})
+			return
+		}
+		region := c.GetHeader(HeaderRegion)
+		if err := r.verify(region, c.GetHeader(HeaderTimestamp), c.GetHeader(HeaderSignature), body, time.Now()); err != nil {
+			r.logger.Warn("Rejected replication push", "region", region, "ip", c.ClientIP())
+			c.JSON(http.StatusUnauthorized, gin.H{"error": i18n.Message(c, "SIGNATURE_INVALID"), "code": "SIGNATURE_INVALID"})
+			return
+		}
+		var changes []Change
+		if err := json.Unmarshal(body, &changes); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": i18n.Message(c, "INVALID_INPUT"), "code": "INVALID_INPUT"})
+			return
+		}
+
+		applied, conflicts, err := r.Apply(c.Request.Context(), region, changes)
+		if err != nil {
+			r.logger.Error("Failed to apply replicated changes", "region", region, "error", err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": i18n.Message(c, "INTERNAL_ERROR"), "code": "INTERNAL_ERROR"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"applied": applied, "conflicts": conflicts})
+	}
+}
+
+// StatusHandler reports the local region and the state towards every peer
+func (r *Replicator) StatusHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"region": r.config.Region,
+			"peers":  r.Status(),
+		})
+	}
+}
@@ -0,0 +1,709 @@
+// Package replication converges selected shared state, such as sessions and
+// registry entries, between regions so impl-zamaz can run active-active.
+//
+// Each region keeps its own store. Writes to replicated prefixes are stamped
+// with a hybrid logical clock version and pushed asynchronously to every peer
+// region, which merges them last-writer-wins per key: the higher version
+// applies, ties go to the higher region name, and deletes leave tombstones so
+// they win over older writes arriving late. Merging is idempotent, so batches
+// are simply retried and a periodic resync repairs anything lost in between.
+// Regions therefore converge, but a write may be invisible in another region
+// for up to the replication lag; Status and the health check report when
+// that lag exceeds MaxStaleness.
+//
+// Counters and compare-and-swap sequences are not linearizable across
+// regions, so only state where the latest write may win should be replicated.
+package replication
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+// Path is where peers receive replicated changes
+const Path = "/internal/replication"
+
+// Headers of a replication push
+const (
+	HeaderRegion    = "X-Replication-Region"
+	HeaderTimestamp = "X-Replication-Timestamp"
+	HeaderSignature = "X-Replication-Signature"
+)
+
+// metaPrefix holds the version of every replicated key
+const metaPrefix = "replication:meta:"
+
+// DefaultPrefixes are replicated when Config.Prefixes is empty: SSO sessions,
+// token revocations and service registry entries
+var DefaultPrefixes = []string{"session:", "revoked:", "discovery:services:"}
+
+// Defaults for zero Config fields
+const (
+	DefaultMaxStaleness   = 30 * time.Second
+	DefaultFlushInterval  = time.Second
+	DefaultResyncInterval = 10 * time.Minute
+	DefaultTombstoneTTL   = 24 * time.Hour
+	DefaultQueueSize      = 10000
+	DefaultBatchSize      = 500
+)
+
+// pushWindow bounds the clock skew accepted on a signed push
+const pushWindow = 5 * time.Minute
+
+// ErrInvalidSignature is returned for a push that is not signed with the
+// shared secret or is outside the accepted time window
+var ErrInvalidSignature = errors.New("invalid replication signature")
+
+// Peer is another region
+type Peer struct {
+	Region string `json:"region"`
+	// URL is the base URL of the region's load balancer
+	URL string `json:"url"`
+}
+
+// Config configures replication for the local region
+type Config struct {
+	Region string
+	// Secret signs pushes; every region must share it
+	Secret   string
+	Peers    []Peer
+	Prefixes []string
+	// MaxStaleness is the replication lag above which a peer is reported
+	// stale and the health check fails
+	MaxStaleness   time.Duration
+	FlushInterval  time.Duration
+	ResyncInterval time.Duration
+	// TombstoneTTL is how long deletes are remembered; it must exceed the
+	// longest expected partition between regions
+	TombstoneTTL time.Duration
+	QueueSize    int
+	BatchSize    int
+	Client       *http.Client
+}
+
+// fileConfig is the JSON form of Config read by LoadConfig
+type fileConfig struct {
+	Region         string   `json:"region"`
+	Secret         string   `json:"secret"`
+	Peers          []Peer   `json:"peers"`
+	Prefixes       []string `json:"prefixes"`
+	MaxStaleness   string   `json:"max_staleness"`
+	ResyncInterval string   `json:"resync_interval"`
+	TombstoneTTL   string   `json:"tombstone_ttl"`
+}
+
+// LoadConfig reads a replication config from path:
+//
+//	{
+//	  "region": "eu-west",
+//	  "secret": "at least 32 characters shared by all regions",
+//	  "peers": [{"region": "us-east", "url": "https://us-east.zamaz.example.com"}],
+//	  "max_staleness": "30s"
+//	}
+func LoadConfig(path string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+	var fc fileConfig
+	if err := json.Unmarshal(data, &fc); err != nil {
+		return Config{}, fmt.Errorf("invalid replication config in %s: %w", path, err)
+	}
+	cfg := Config{Region: fc.Region, Secret: fc.Secret, Peers: fc.Peers, Prefixes: fc.Prefixes}
+	for _, d := range []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{
+		{"max_staleness", fc.MaxStaleness, &cfg.MaxStaleness},
+		{"resync_interval", fc.ResyncInterval, &cfg.ResyncInterval},
+		{"tombstone_ttl", fc.TombstoneTTL, &cfg.TombstoneTTL},
+	} {
+		if d.value == "" {
+			continue
+		}
+		if *d.dst, err = time.ParseDuration(d.value); err != nil || *d.dst <= 0 {
+			return Config{}, fmt.Errorf("replication config has an invalid %s %q", d.name, d.value)
+		}
+	}
+	return cfg, nil
+}
+
+// Change is one replicated write or delete
+type Change struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value,omitempty"`
+	version
+}
+
+// version orders the writes of a key across regions
+type version struct {
+	// Version is a hybrid logical clock in Unix nanoseconds
+	Version int64  `json:"version"`
+	Region  string `json:"region"`
+	Deleted bool   `json:"deleted,omitempty"`
+	// ExpiresAt is the value's expiry in Unix nanoseconds, zero for none
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+}
+
+// newer reports whether v wins over other
+func (v version) newer(other version) bool {
+	if v.Version != other.Version {
+		return v.Version > other.Version
+	}
+	return v.Region > other.Region
+}
+
+// PeerStatus is the replication state towards one peer region
+type PeerStatus struct {
+	Region string `json:"region"`
+	// Pending changes not yet acknowledged by the peer
+	Pending      int       `json:"pending"`
+	LastPush     time.Time `json:"last_push,omitempty"`
+	LastReceived time.Time `json:"last_received,omitempty"`
+	LastError    string    `json:"last_error,omitempty"`
+	// Staleness is how long the oldest pending change has waited
+	Staleness time.Duration `json:"staleness_ns"`
+	Stale     bool          `json:"stale"`
+}
+
+type peerState struct {
+	Peer
+	queue chan Change
+
+	mu           sync.Mutex
+	pending      []Change
+	oldest       time.Time
+	lastPush     time.Time
+	lastReceived time.Time
+	lastError    string
+	resync       bool
+}
+
+// Replicator is a store.Store that replicates writes to its prefixes to the
+// peer regions and applies the changes they push
+type Replicator struct {
+	local   store.Store
+	config  Config
+	logger  interfaces.Logger
+	metrics interfaces.MetricsCollector
+
+	clockMu sync.Mutex
+	clock   int64
+
+	peers map[string]*peerState
+}
+
+// New wraps local, the region's shared store; metrics may be nil
+func New(local store.Store, cfg Config, logger interfaces.Logger, metrics interfaces.MetricsCollector) (*Replicator, error) {
+	if cfg.Region == "" || strings.ContainsAny(cfg.Region, " \n") {
+		return nil, fmt.Errorf("replication needs a region name, got %q", cfg.Region)
+	}
+	if len(cfg.Secret) < 32 {
+		return nil, errors.New("replication secret must be at least 32 characters")
+	}
+	if len(cfg.Prefixes) == 0 {
+		cfg.Prefixes = DefaultPrefixes
+	}
+	if cfg.MaxStaleness <= 0 {
+		cfg.MaxStaleness = DefaultMaxStaleness
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = DefaultFlushInterval
+	}
+	if cfg.ResyncInterval <= 0 {
+		cfg.ResyncInterval = DefaultResyncInterval
+	}
+	if cfg.TombstoneTTL <= 0 {
+		cfg.TombstoneTTL = DefaultTombstoneTTL
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = DefaultQueueSize
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = DefaultBatchSize
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	r := &Replicator{local: local, config: cfg, logger: logger, metrics: metrics, peers: make(map[string]*peerState)}
+	for _, p := range cfg.Peers {
+		if p.Region == "" || p.Region == cfg.Region || p.URL == "" || r.peers[p.Region] != nil {
+			return nil, fmt.Errorf("invalid replication peer %q", p.Region)
+		}
+		r.peers[p.Region] = &peerState{Peer: p, queue: make(chan Change, cfg.QueueSize)}
+	}
+	return r, nil
+}
+
+// Region is the local region name
+func (r *Replicator) Region() string { return r.config.Region }
+
+func (r *Replicator) replicated(key string) bool {
+	for _, prefix := range r.config.Prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// tick returns a version above every version seen so far
+func (r *Replicator) tick() int64 {
+	r.clockMu.Lock()
+	defer r.clockMu.Unlock()
+	now := time.Now().UnixNano()
+	if now <= r.clock {
+		now = r.clock + 1
+	}
+	r.clock = now
+	return now
+}
+
+// observe advances the clock past a remote version
+func (r *Replicator) observe(v int64) {
+	r.clockMu.Lock()
+	if v > r.clock {
+		r.clock = v
+	}
+	r.clockMu.Unlock()
+}
+
+// record versions a local change and queues it for every peer
+func (r *Replicator) record(ctx context.Context, c Change) {
+	c.Version, c.Region = r.tick(), r.config.Region
+	if err := r.writeMeta(ctx, c.Key, c.version); err != nil {
+		r.logger.Warn("Failed to record replication version", "key", c.Key, "error", err)
+	}
+	for _, p := range r.peers {
+		select {
+		case p.queue <- c:
+		default:
+			// The resync sends the latest version of every key, this one included
+			p.mu.Lock()
+			p.resync = true
+			p.mu.Unlock()
+			r.count("replication_dropped_total", p.Region)
+		}
+	}
+}
+
+func (r *Replicator) writeMeta(ctx context.Context, key string, v version) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return r.local.Set(ctx, metaPrefix+key, data, r.metaTTL(v))
+}
+
+// metaTTL keeps a version as long as its value, and tombstones for TombstoneTTL
+func (r *Replicator) metaTTL(v version) time.Duration {
+	if v.Deleted {
+		return r.config.TombstoneTTL
+	}
+	if v.ExpiresAt == 0 {
+		return 0
+	}
+	return time.Until(time.Unix(0, v.ExpiresAt))
+}
+
+func (r *Replicator) readMeta(ctx context.Context, key string) (version, []byte, error) {
+	data, err := r.local.Get(ctx, metaPrefix+key)
+	if err != nil {
+		return version{}, nil, err
+	}
+	var v version
+	if err := json.Unmarshal(data, &v); err != nil {
+		return version{}, nil, err
+	}
+	return v, data, nil
+}
+
+func expiresAt(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return time.Now().Add(ttl).UnixNano()
+}
+
+// Get implements store.Store
+func (r *Replicator) Get(ctx context.Context, key string) ([]byte, error) {
+	return r.local.Get(ctx, key)
+}
+
+// Set implements store.Store
+func (r *Replicator) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if err := r.local.Set(ctx, key, value, ttl); err != nil || !r.replicated(key) {
+		return err
+	}
+	r.record(ctx, Change{Key: key, Value: value, version: version{ExpiresAt: expiresAt(ttl)}})
+	return nil
+}
+
+// Delete implements store.Store
+func (r *Replicator) Delete(ctx context.Context, key string) error {
+	if err := r.local.Delete(ctx, key); err != nil || !r.replicated(key) {
+		return err
+	}
+	r.record(ctx, Change{Key: key, version: version{Deleted: true}})
+	return nil
+}
+
+// Incr implements store.Store; counters stay regional
+func (r *Replicator) Incr(ctx context.Context, key string, ttl time.Duration) (int64, time.Duration, error) {
+	return r.local.Incr(ctx, key, ttl)
+}
+
+// CompareAndSwap implements store.Store. The swap is atomic within the
+// region only; the result replicates like any other write.
+func (r *Replicator) CompareAndSwap(ctx context.Context, key string, old, value []byte, ttl time.Duration) (bool, error) {
+	swapped, err := r.local.CompareAndSwap(ctx, key, old, value, ttl)
+	if err != nil || !swapped || !r.replicated(key) {
+		return swapped, err
+	}
+	r.record(ctx, Change{Key: key, Value: value, version: version{ExpiresAt: expiresAt(ttl)}})
+	return true, nil
+}
+
+// Scripts implements store.Scripter when the local store runs scripts
+func (r *Replicator) Scripts() bool {
+	_, ok := store.ScriptsOf(r.local)
+	return ok
+}
+
+// Eval implements store.Scripter; like counters, script state stays
+// regional
+func (r *Replicator) Eval(ctx context.Context, script string, keys []string, args ...string) (interface{}, error) {
+	scripter, ok := store.ScriptsOf(r.local)
+	if !ok {
+		return nil, store.ErrScriptsUnsupported
+	}
+	return scripter.Eval(ctx, script, keys, args...)
+}
+
+// Keys implements store.Store
+func (r *Replicator) Keys(ctx context.Context, prefix string) ([]string, error) {
+	return r.local.Keys(ctx, prefix)
+}
+
+// Ping implements store.Store
+func (r *Replicator) Ping(ctx context.Context) error {
+	return r.local.Ping(ctx)
+}
+
+// Close implements store.Store
+func (r *Replicator) Close() error {
+	return r.local.Close()
+}
+
+// Apply merges changes pushed by region and returns how many applied and how
+// many lost to a newer local version. Changes already applied are skipped, so
+// a batch may be delivered more than once.
+func (r *Replicator) Apply(ctx context.Context, region string, changes []Change) (applied, conflicts int, err error) {
+	now := time.Now()
+	for _, c := range changes {
+		if !r.replicated(c.Key) {
+			continue
+		}
+		r.observe(c.Version)
+		won, conflict, err := r.merge(ctx, c)
+		if err != nil {
+			return applied, conflicts, err
+		}
+		switch {
+		case won:
+			applied++
+		case conflict:
+			conflicts++
+			r.count("replication_conflicts_total", region)
+		}
+		if r.metrics != nil {
+			lag := now.Sub(time.Unix(0, c.Version)).Seconds()
+			r.metrics.ObserveHistogram("replication_lag_seconds", lag, map[string]string{"region": region})
+		}
+	}
+	if p := r.peers[region]; p != nil {
+		p.mu.Lock()
+		p.lastReceived = now
+		p.mu.Unlock()
+	}
+	if r.metrics != nil && applied > 0 {
+		r.metrics.IncrementCounter("replication_applied_total", map[string]string{"region": region})
+	}
+	return applied, conflicts, nil
+}
+
+// merge applies c when it is newer than the local version. conflict is set
+// when c lost to a write from another region.
+func (r *Replicator) merge(ctx context.Context, c Change) (won, conflict bool, err error) {
+	if c.ExpiresAt != 0 && c.ExpiresAt <= time.Now().UnixNano() && !c.Deleted {
+		return false, false, nil
+	}
+	data, err := json.Marshal(c.version)
+	if err != nil {
+		return false, false, err
+	}
+	for attempt := 0; attempt < 5; attempt++ {
+		current, old, err := r.readMeta(ctx, c.Key)
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			return false, false, err
+		}
+		if old != nil && !c.version.newer(current) {
+			return false, current.Region != c.Region, nil
+		}
+		swapped, err := r.local.CompareAndSwap(ctx, metaPrefix+c.Key, old, data, r.metaTTL(c.version))
+		if err != nil {
+			return false, false, err
+		}
+		if !swapped {
+			continue
+		}
+		if c.Deleted {
+			return true, false, r.local.Delete(ctx, c.Key)
+		}
+		ttl := time.Duration(0)
+		if c.ExpiresAt != 0 {
+			ttl = time.Until(time.Unix(0, c.ExpiresAt))
+		}
+		return true, false, r.local.Set(ctx, c.Key, c.Value, ttl)
+	}
+	return false, false, fmt.Errorf("replication version of %q kept changing", c.Key)
+}
+
+// Start pushes queued changes to every peer until ctx is done
+func (r *Replicator) Start(ctx context.Context) {
+	for _, p := range r.peers {
+		go r.run(ctx, p)
+	}
+}
+
+func (r *Replicator) run(ctx context.Context, p *peerState) {
+	flush := time.NewTicker(r.config.FlushInterval)
+	defer flush.Stop()
+	resync := time.NewTicker(r.config.ResyncInterval)
+	defer resync.Stop()
+
+	// A region that was down missed whatever was written meanwhile
+	p.mu.Lock()
+	p.resync = true
+	p.mu.Unlock()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-resync.C:
+			p.mu.Lock()
+			p.resync = true
+			p.mu.Unlock()
+		case <-flush.C:
+			r.flush(ctx, p)
+		}
+	}
+}
+
+// flush sends one batch to p, taking a full snapshot first when a resync is due
+func (r *Replicator) flush(ctx context.Context, p *peerState) {
+	p.mu.Lock()
+	if p.resync && len(p.pending) == 0 {
+		p.resync = false
+		// Queued changes are versioned before they are queued, so the
+		// snapshot covers them
+		for len(p.queue) > 0 {
+			<-p.queue
+		}
+		p.mu.Unlock()
+		snapshot, err := r.snapshot(ctx)
+		p.mu.Lock()
+		if err != nil {
+			p.resync = true
+			r.logger.Warn("Failed to read replication snapshot", "peer", p.Region, "error", err)
+		} else {
+			p.pending = append(p.pending, snapshot...)
+		}
+	}
+drain:
+	for len(p.pending) < r.config.BatchSize {
+		select {
+		case c := <-p.queue:
+			p.pending = append(p.pending, c)
+		default:
+			break drain
+		}
+	}
+	if len(p.pending) > 0 && p.oldest.IsZero() {
+		p.oldest = time.Now()
+	}
+	n := len(p.pending)
+	if n > r.config.BatchSize {
+		n = r.config.BatchSize
+	}
+	batch := p.pending[:n]
+	p.mu.Unlock()
+
+	if n > 0 {
+		err := r.push(ctx, p.Peer, batch)
+		p.mu.Lock()
+		if err != nil {
+			p.lastError = err.Error()
+			r.count("replication_push_failures_total", p.Region)
+		} else {
+			p.pending = append([]Change(nil), p.pending[n:]...)
+			p.lastPush, p.lastError = time.Now(), ""
+			if len(p.pending) == 0 && len(p.queue) == 0 {
+				p.oldest = time.Time{}
+			} else {
+				p.oldest = time.Now()
+			}
+		}
+		p.mu.Unlock()
+		if err != nil {
+			r.logger.Warn("Replication push failed", "peer", p.Region, "changes", n, "error", err)
+		}
+	}
+
+	if r.metrics != nil {
+		status := r.peerStatus(p)
+		labels := map[string]string{"region": p.Region}
+		r.metrics.SetGauge("replication_pending", float64(status.Pending), labels)
+		r.metrics.SetGauge("replication_staleness_seconds", status.Staleness.Seconds(), labels)
+	}
+}
+
+// snapshot returns the current version of every replicated key
+func (r *Replicator) snapshot(ctx context.Context) ([]Change, error) {
+	keys, err := r.local.Keys(ctx, metaPrefix)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	changes := make([]Change, 0, len(keys))
+	for _, metaKey := range keys {
+		key := strings.TrimPrefix(metaKey, metaPrefix)
+		v, _, err := r.readMeta(ctx, key)
+		if err != nil || v.Region == "" {
+			continue
+		}
+		c := Change{Key: key, version: v}
+		if !v.Deleted {
+			if c.Value, err = r.local.Get(ctx, key); err != nil {
+				continue
+			}
+		}
+		changes = append(changes, c)
+	}
+	return changes, nil
+}
+
+// Sign returns the hex HMAC-SHA256 of region \n timestamp \n body
+func Sign(secret, region, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n", region, timestamp)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verify checks a push signature and its timestamp
+func (r *Replicator) verify(region, timestamp, signature string, body []byte, now time.Time) error {
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if skew := now.Sub(time.Unix(unix, 0)); skew > pushWindow || skew < -pushWindow {
+		return ErrInvalidSignature
+	}
+	if r.peers[region] == nil || !hmac.Equal([]byte(signature), []byte(Sign(r.config.Secret, region, timestamp, body))) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+func (r *Replicator) push(ctx context.Context, p Peer, changes []Change) error {
+	body, err := json.Marshal(changes)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(p.URL, "/")+Path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderRegion, r.config.Region)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderSignature, Sign(r.config.Secret, r.config.Region, timestamp, body))
+
+	resp, err := r.config.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("peer %s answered %d", p.Region, resp.StatusCode)
+	}
+	return nil
+}
+
+func (r *Replicator) peerStatus(p *peerState) PeerStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status := PeerStatus{
+		Region:       p.Region,
+		Pending:      len(p.pending) + len(p.queue),
+		LastPush:     p.lastPush,
+		LastReceived: p.lastReceived,
+		LastError:    p.lastError,
+	}
+	if !p.oldest.IsZero() {
+		status.Staleness = time.Since(p.oldest)
+	}
+	status.Stale = status.Staleness > r.config.MaxStaleness
+	return status
+}
+
+// Status reports every peer, sorted by region
+func (r *Replicator) Status() []PeerStatus {
+	statuses := make([]PeerStatus, 0, len(r.peers))
+	for _, p := range r.peers {
+		statuses = append(statuses, r.peerStatus(p))
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Region < statuses[j].Region })
+	return statuses
+}
+
+// HealthCheck fails while any peer is behind by more than MaxStaleness; it
+// suits a non-critical health.Dependency
+func (r *Replicator) HealthCheck(ctx context.Context) error {
+	var stale []string
+	for _, status := range r.Status() {
+		if status.Stale {
+			stale = append(stale, fmt.Sprintf("%s (%s behind)", status.Region, status.Staleness.Round(time.Second)))
+		}
+	}
+	if len(stale) > 0 {
+		return fmt.Errorf("replication is stale for %s", strings.Join(stale, ", "))
+	}
+	return nil
+}
+
+func (r *Replicator) count(name, region string) {
+	if r.metrics != nil {
+		r.metrics.IncrementCounter(name, map[string]string{"region": region})
+	}
+}
@@ -0,0 +1,295 @@
+package risk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lsendel/impl-zamaz/pkg/i18n"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+	"github.com/lsendel/impl-zamaz/pkg/trust"
+)
+
+// ErrNoBaseline is returned for subjects nothing has been learned about
+var ErrNoBaseline = errors.New("risk: no baseline")
+
+// baselinePrefix holds each subject's baseline
+const baselinePrefix = keyPrefix + "baseline:"
+
+// Risk of each kind of deviation from a baseline; a request rate at twice
+// the usual limit earns the full rate risk
+const (
+	unusualHourRisk     = 0.3
+	unusualEndpointRisk = 0.3
+	unusualRateRisk     = 0.6
+)
+
+// BaselineConfig configures baseline learning
+type BaselineConfig struct {
+	// MinRequests is how many requests are learned from before deviations
+	// are scored; defaults to 50
+	MinRequests int64
+	// RareShare is the share of requests below which an hour or endpoint
+	// is unusual; defaults to 0.02
+	RareShare float64
+	// RateFactor is how many times the usual hourly rate is unusual;
+	// defaults to 3
+	RateFactor float64
+	// MaxEndpoints bounds the endpoints remembered, forgetting the least
+	// used; defaults to 50
+	MaxEndpoints int
+	// Location hours of the day are counted in; defaults to UTC
+	Location *time.Location
+	// TTL is how long a baseline is kept after its last update; defaults
+	// to 90 days
+	TTL time.Duration
+}
+
+// Baseline is what has been learned about a subject's requests
+type Baseline struct {
+	Requests  int64            `json:"requests"`
+	Hours     [24]int64        `json:"hours"`
+	Endpoints map[string]int64 `json:"endpoints"`
+	// HourlyRate averages the requests of recent hours with any, weighting
+	// the latest most
+	HourlyRate float64 `json:"hourly_rate"`
+	// Hour is the start of the hour HourCount counts requests in
+	Hour      time.Time `json:"hour"`
+	HourCount int64     `json:"hour_count"`
+	FirstSeen time.Time `json:"first_seen"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// EndpointUsage is how often a subject requested an endpoint
+type EndpointUsage struct {
+	Endpoint string `json:"endpoint"`
+	Requests int64  `json:"requests"`
+	Typical  bool   `json:"typical"`
+}
+
+// BaselineSummary presents a baseline to administrators
+type BaselineSummary struct {
+	UserID string `json:"user_id"`
+	// Learning is true until deviations are scored
+	Learning     bool            `json:"learning"`
+	Requests     int64           `json:"requests"`
+	Timezone     string          `json:"timezone"`
+	TypicalHours []int           `json:"typical_hours"`
+	Hours        [24]int64       `json:"hours"`
+	Endpoints    []EndpointUsage `json:"endpoints"`
+	HourlyRate   float64         `json:"hourly_rate"`
+	FirstSeen    time.Time       `json:"first_seen"`
+	UpdatedAt    time.Time       `json:"updated_at"`
+}
+
+// Baselines learns when, where and how fast each subject usually makes
+// requests, and detects requests that deviate: at an hour or to an
+// endpoint the subject rarely uses, or faster than usual. Subjects are
+// only scored once MinRequests have been learned from.
+type Baselines struct {
+	config BaselineConfig
+	store  store.Store
+	logger interfaces.Logger
+	now    func() time.Time
+}
+
+// NewBaselines creates baseline learning backed by s
+func NewBaselines(cfg BaselineConfig, s store.Store, logger interfaces.Logger) *Baselines {
+	if cfg.MinRequests <= 0 {
+		cfg.MinRequests = 50
+	}
+	if cfg.RareShare <= 0 {
+		cfg.RareShare = 0.02
+	}
+	if cfg.RateFactor <= 0 {
+		cfg.RateFactor = 3
+	}
+	if cfg.MaxEndpoints <= 0 {
+		cfg.MaxEndpoints = 50
+	}
+	if cfg.Location == nil {
+		cfg.Location = time.UTC
+	}
+	if cfg.TTL <= 0 {
+		cfg.TTL = 90 * 24 * time.Hour
+	}
+	return &Baselines{config: cfg, store: s, logger: logger, now: time.Now}
+}
+
+// Name implements Detector
+func (b *Baselines) Name() string { return DetectorBaseline }
+
+// Detect implements Detector
+func (b *Baselines) Detect(ctx context.Context, in trust.Input) (float64, error) {
+	if in.Subject == "" {
+		return 0, nil
+	}
+	baseline, _, err := b.load(ctx, in.Subject)
+	if err != nil || baseline == nil || baseline.Requests < b.config.MinRequests {
+		return 0, err
+	}
+	at := trust.InputTime(in)
+	safe := 1.0
+	if b.rare(baseline.Hours[at.In(b.config.Location).Hour()], baseline) {
+		safe *= 1 - unusualHourRisk
+	}
+	if endpoint := in.Context[trust.ContextEndpoint]; endpoint != "" && b.rare(baseline.Endpoints[endpoint], baseline) {
+		safe *= 1 - unusualEndpointRisk
+	}
+	count := int64(1)
+	if baseline.Hour.Equal(at.Truncate(time.Hour)) {
+		count += baseline.HourCount
+	}
+	if limit := b.config.RateFactor * baseline.HourlyRate; limit > 0 && float64(count) > limit {
+		safe *= 1 - unusualRateRisk*math.Min(1, (float64(count)-limit)/limit)
+	}
+	return 1 - safe, nil
+}
+
+// Record implements Recorder, learning from a handled request
+func (b *Baselines) Record(ctx context.Context, in trust.Input, _ int) error {
+	for attempt := 0; attempt < casAttempts; attempt++ {
+		baseline, old, err := b.load(ctx, in.Subject)
+		if err != nil {
+			return err
+		}
+		if baseline == nil {
+			baseline = &Baseline{}
+		}
+		b.learn(baseline, in.Context[trust.ContextEndpoint], b.now())
+		data, err := json.Marshal(baseline)
+		if err != nil {
+			return err
+		}
+		swapped, err := b.store.CompareAndSwap(ctx, baselinePrefix+in.Subject, old, data, b.config.TTL)
+		if err != nil || swapped {
+			return err
+		}
+	}
+	return fmt.Errorf("baseline of %q is being updated concurrently", in.Subject)
+}
+
+// Summary returns what has been learned about subject, or ErrNoBaseline
+func (b *Baselines) Summary(ctx context.Context, subject string) (*BaselineSummary, error) {
+	baseline, _, err := b.load(ctx, subject)
+	if err != nil {
+		return nil, err
+	}
+	if baseline == nil {
+		return nil, ErrNoBaseline
+	}
+	summary := &BaselineSummary{
+		UserID:       subject,
+		Learning:     baseline.Requests < b.config.MinRequests,
+		Requests:     baseline.Requests,
+		Timezone:     b.config.Location.String(),
+		TypicalHours: []int{},
+		Hours:        baseline.Hours,
+		Endpoints:    make([]EndpointUsage, 0, len(baseline.Endpoints)),
+		HourlyRate:   baseline.HourlyRate,
+		FirstSeen:    baseline.FirstSeen,
+		UpdatedAt:    baseline.UpdatedAt,
+	}
+	for hour, count := range baseline.Hours {
+		if count > 0 && !b.rare(count, baseline) {
+			summary.TypicalHours = append(summary.TypicalHours, hour)
+		}
+	}
+	for endpoint, count := range baseline.Endpoints {
+		summary.Endpoints = append(summary.Endpoints, EndpointUsage{Endpoint: endpoint, Requests: count, Typical: !b.rare(count, baseline)})
+	}
+	sort.Slice(summary.Endpoints, func(i, j int) bool {
+		a, c := summary.Endpoints[i], summary.Endpoints[j]
+		return a.Requests > c.Requests || (a.Requests == c.Requests && a.Endpoint < c.Endpoint)
+	})
+	return summary, nil
+}
+
+// RegisterRoutes mounts GET /baseline/:userID, which reports what has been
+// learned about a user
+func (b *Baselines) RegisterRoutes(r gin.IRoutes) {
+	r.GET("/baseline/:userID", b.handleBaseline)
+}
+
+func (b *Baselines) handleBaseline(c *gin.Context) {
+	summary, err := b.Summary(c.Request.Context(), c.Param("userID"))
+	if errors.Is(err, ErrNoBaseline) {
+		c.JSON(http.StatusNotFound, gin.H{"error": i18n.Message(c, "RESOURCE_NOT_FOUND"), "code": "RESOURCE_NOT_FOUND"})
+		return
+	}
+	if err != nil {
+		b.logger.Error("Failed to load baseline", "user_id", c.Param("userID"), "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": i18n.Message(c, "INTERNAL_ERROR"), "code": "INTERNAL_ERROR"})
+		return
+	}
+	c.JSON(http.StatusOK, summary)
+}
+
+// learn counts one request to endpoint at now
+func (b *Baselines) learn(baseline *Baseline, endpoint string, now time.Time) {
+	if hour := now.Truncate(time.Hour); !baseline.Hour.Equal(hour) {
+		// Fold the finished hour into the usual rate
+		if baseline.HourCount > 0 {
+			if baseline.HourlyRate == 0 {
+				baseline.HourlyRate = float64(baseline.HourCount)
+			} else {
+				baseline.HourlyRate = 0.8*baseline.HourlyRate + 0.2*float64(baseline.HourCount)
+			}
+		}
+		baseline.Hour, baseline.HourCount = hour, 0
+	}
+	baseline.HourCount++
+	baseline.Requests++
+	baseline.Hours[now.In(b.config.Location).Hour()]++
+	if endpoint != "" {
+		if baseline.Endpoints == nil {
+			baseline.Endpoints = make(map[string]int64)
+		}
+		if _, ok := baseline.Endpoints[endpoint]; !ok && len(baseline.Endpoints) >= b.config.MaxEndpoints {
+			delete(baseline.Endpoints, leastUsed(baseline.Endpoints))
+		}
+		baseline.Endpoints[endpoint]++
+	}
+	if baseline.FirstSeen.IsZero() {
+		baseline.FirstSeen = now.UTC()
+	}
+	baseline.UpdatedAt = now.UTC()
+}
+
+// rare reports whether count is below RareShare of baseline's requests
+func (b *Baselines) rare(count int64, baseline *Baseline) bool {
+	return float64(count) < b.config.RareShare*float64(baseline.Requests)
+}
+
+func (b *Baselines) load(ctx context.Context, subject string) (*Baseline, []byte, error) {
+	data, err := b.store.Get(ctx, baselinePrefix+subject)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var baseline Baseline
+	if err := json.Unmarshal(data, &baseline); err != nil {
+		return nil, nil, err
+	}
+	return &baseline, data, nil
+}
+
+func leastUsed(endpoints map[string]int64) string {
+	least := ""
+	for endpoint, count := range endpoints {
+		if least == "" || count < endpoints[least] || (count == endpoints[least] && endpoint < least) {
+			least = endpoint
+		}
+	}
+	return least
+}
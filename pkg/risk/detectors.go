@@ -0,0 +1,368 @@
+package risk
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lsendel/impl-zamaz/pkg/store"
+	"github.com/lsendel/impl-zamaz/pkg/trust"
+)
+
+// casAttempts bounds retries of concurrent history updates
+const casAttempts = 5
+
+// VelocityConfig configures the velocity detector
+type VelocityConfig struct {
+	// Limit is the number of requests per Window considered normal;
+	// defaults to 120
+	Limit int
+	// Window defaults to 1m
+	Window time.Duration
+}
+
+// VelocityDetector flags subjects making requests faster than Limit per
+// Window. Risk grows from 0 at Limit to 1 at twice Limit.
+type VelocityDetector struct {
+	config VelocityConfig
+	store  store.Store
+	now    func() time.Time
+}
+
+// NewVelocityDetector creates a velocity detector
+func NewVelocityDetector(cfg VelocityConfig, s store.Store) *VelocityDetector {
+	if cfg.Limit <= 0 {
+		cfg.Limit = 120
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = time.Minute
+	}
+	return &VelocityDetector{config: cfg, store: s, now: time.Now}
+}
+
+// Name implements Detector
+func (d *VelocityDetector) Name() string { return DetectorVelocity }
+
+// Detect implements Detector
+func (d *VelocityDetector) Detect(ctx context.Context, in trust.Input) (float64, error) {
+	if in.Subject == "" {
+		return 0, nil
+	}
+	count, err := readCount(ctx, d.store, d.key(in.Subject))
+	if err != nil || count <= int64(d.config.Limit) {
+		return 0, err
+	}
+	return math.Min(1, float64(count-int64(d.config.Limit))/float64(d.config.Limit)), nil
+}
+
+// Record implements Recorder
+func (d *VelocityDetector) Record(ctx context.Context, in trust.Input, _ int) error {
+	_, _, err := d.store.Incr(ctx, d.key(in.Subject), d.config.Window)
+	return err
+}
+
+// key counts the requests of subject in the current window
+func (d *VelocityDetector) key(subject string) string {
+	window := d.now().UnixNano() / int64(d.config.Window)
+	return keyPrefix + "velocity:" + subject + ":" + strconv.FormatInt(window, 10)
+}
+
+// HistoryConfig configures detectors remembering what a subject used before
+type HistoryConfig struct {
+	// Risk of a value the subject has not used before; defaults to 0.6 for
+	// countries and 0.5 for devices
+	Risk float64
+	// MaxValues is how many recent values are remembered; defaults to 10
+	MaxValues int
+	// TTL is how long history is kept after its last update; defaults to
+	// 90 days
+	TTL time.Duration
+}
+
+// history remembers the recent values of one attribute per subject. Risk
+// is only assessed once a subject has history, so first logins are not
+// flagged.
+type history struct {
+	name   string
+	config HistoryConfig
+	store  store.Store
+	// value extracts the attribute from a request, returning "" when absent
+	value func(in trust.Input) string
+}
+
+func newHistory(name string, cfg HistoryConfig, defaultRisk float64, s store.Store, value func(in trust.Input) string) history {
+	if cfg.Risk <= 0 {
+		cfg.Risk = defaultRisk
+	}
+	if cfg.MaxValues <= 0 {
+		cfg.MaxValues = 10
+	}
+	if cfg.TTL <= 0 {
+		cfg.TTL = 90 * 24 * time.Hour
+	}
+	return history{name: name, config: cfg, store: s, value: value}
+}
+
+// Name implements Detector
+func (h history) Name() string { return h.name }
+
+// Detect implements Detector
+func (h history) Detect(ctx context.Context, in trust.Input) (float64, error) {
+	value := h.value(in)
+	if in.Subject == "" || value == "" {
+		return 0, nil
+	}
+	known, _, err := h.load(ctx, in.Subject)
+	if err != nil || len(known) == 0 || containsValue(known, value) {
+		return 0, err
+	}
+	return h.config.Risk, nil
+}
+
+// Record implements Recorder, keeping the most recently used value first
+func (h history) Record(ctx context.Context, in trust.Input, _ int) error {
+	value := h.value(in)
+	if value == "" {
+		return nil
+	}
+	for attempt := 0; attempt < casAttempts; attempt++ {
+		known, old, err := h.load(ctx, in.Subject)
+		if err != nil {
+			return err
+		}
+		if len(known) > 0 && known[0] == value {
+			return nil
+		}
+		updated := []string{value}
+		for _, v := range known {
+			if v != value && len(updated) < h.config.MaxValues {
+				updated = append(updated, v)
+			}
+		}
+		data, err := json.Marshal(updated)
+		if err != nil {
+			return err
+		}
+		swapped, err := h.store.CompareAndSwap(ctx, h.key(in.Subject), old, data, h.config.TTL)
+		if err != nil || swapped {
+			return err
+		}
+	}
+	return fmt.Errorf("%s history of %q is being updated concurrently", h.name, in.Subject)
+}
+
+func (h history) key(subject string) string {
+	return keyPrefix + h.name + ":" + subject
+}
+
+func (h history) load(ctx context.Context, subject string) ([]string, []byte, error) {
+	data, err := h.store.Get(ctx, h.key(subject))
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var known []string
+	if err := json.Unmarshal(data, &known); err != nil {
+		return nil, nil, err
+	}
+	return known, data, nil
+}
+
+// NewGeoDetector flags requests from a country the subject has not
+// recently used
+func NewGeoDetector(cfg HistoryConfig, geo trust.GeoLocator, s store.Store) Detector {
+	return newHistory(DetectorNewGeo, cfg, 0.6, s, func(in trust.Input) string {
+		ip := net.ParseIP(in.Context["ip"])
+		if ip == nil {
+			return ""
+		}
+		location, ok := geo.Locate(ip)
+		if !ok {
+			return ""
+		}
+		return location.Country
+	})
+}
+
+// NewDeviceDetector flags requests from a device the subject has not
+// recently used. Without a device ID the device is recognized by its user
+// agent and TLS fingerprint, which are stored hashed.
+func NewDeviceDetector(cfg HistoryConfig, s store.Store) Detector {
+	return newHistory(DetectorNewDevice, cfg, 0.5, s, func(in trust.Input) string {
+		if in.Device != "" {
+			return hashValue("device:" + in.Device)
+		}
+		agent, fingerprint := in.Context[trust.SignalUserAgent], in.Context[trust.SignalTLSFingerprint]
+		if agent == "" && fingerprint == "" {
+			return ""
+		}
+		return hashValue("client:" + agent + "\n" + fingerprint)
+	})
+}
+
+// EscalationConfig configures the privilege escalation detector
+type EscalationConfig struct {
+	// Threshold is the number of denied requests per Window that is
+	// suspicious; defaults to 3
+	Threshold int
+	// Window defaults to 10m
+	Window time.Duration
+}
+
+// EscalationDetector flags subjects repeatedly denied access, which
+// suggests they are probing for privileges they do not have. Risk is 0.5
+// at Threshold denials and reaches 1 at twice Threshold.
+type EscalationDetector struct {
+	config EscalationConfig
+	store  store.Store
+}
+
+// NewEscalationDetector creates a privilege escalation detector
+func NewEscalationDetector(cfg EscalationConfig, s store.Store) *EscalationDetector {
+	if cfg.Threshold <= 0 {
+		cfg.Threshold = 3
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = 10 * time.Minute
+	}
+	return &EscalationDetector{config: cfg, store: s}
+}
+
+// Name implements Detector
+func (d *EscalationDetector) Name() string { return DetectorPrivilegeEscalation }
+
+// Detect implements Detector
+func (d *EscalationDetector) Detect(ctx context.Context, in trust.Input) (float64, error) {
+	if in.Subject == "" {
+		return 0, nil
+	}
+	count, err := readCount(ctx, d.store, d.key(in.Subject))
+	if err != nil || count < int64(d.config.Threshold) {
+		return 0, err
+	}
+	return math.Min(1, 0.5*float64(count)/float64(d.config.Threshold)), nil
+}
+
+// Record implements Recorder, counting forbidden responses
+func (d *EscalationDetector) Record(ctx context.Context, in trust.Input, status int) error {
+	if status != http.StatusForbidden {
+		return nil
+	}
+	_, _, err := d.store.Incr(ctx, d.key(in.Subject), d.config.Window)
+	return err
+}
+
+func (d *EscalationDetector) key(subject string) string {
+	return keyPrefix + "denied:" + subject
+}
+
+// OffHoursConfig configures the off-hours detector
+type OffHoursConfig struct {
+	// Location working hours are in; defaults to UTC
+	Location *time.Location
+	// Start and End are the first and last hour after working hours;
+	// default to 7 and 19
+	Start, End int
+	// Weekends, when true, counts Saturday and Sunday as working days
+	Weekends bool
+	// Risk of off-hours access; defaults to 0.4
+	Risk float64
+}
+
+// OffHoursDetector flags access outside working hours
+type OffHoursDetector struct {
+	config OffHoursConfig
+}
+
+// NewOffHoursDetector creates an off-hours detector
+func NewOffHoursDetector(cfg OffHoursConfig) *OffHoursDetector {
+	if cfg.Location == nil {
+		cfg.Location = time.UTC
+	}
+	if cfg.Start == 0 && cfg.End == 0 {
+		cfg.Start, cfg.End = 7, 19
+	}
+	if cfg.Risk <= 0 {
+		cfg.Risk = 0.4
+	}
+	return &OffHoursDetector{config: cfg}
+}
+
+// Name implements Detector
+func (d *OffHoursDetector) Name() string { return DetectorOffHours }
+
+// Detect implements Detector
+func (d *OffHoursDetector) Detect(_ context.Context, in trust.Input) (float64, error) {
+	at := trust.InputTime(in).In(d.config.Location)
+	weekend := at.Weekday() == time.Saturday || at.Weekday() == time.Sunday
+	if (weekend && !d.config.Weekends) || at.Hour() < d.config.Start || at.Hour() >= d.config.End {
+		return d.config.Risk, nil
+	}
+	return 0, nil
+}
+
+// Reputation scores client addresses from 0 (no reports) to 1 (known
+// bad), e.g. a threatintel.Service
+type Reputation interface {
+	Score(ctx context.Context, ip string) (float64, error)
+}
+
+// ReputationDetector flags requests from addresses threat intelligence
+// reports, scoring them as the reputation does
+type ReputationDetector struct {
+	reputation Reputation
+}
+
+// NewReputationDetector creates an IP reputation detector
+func NewReputationDetector(reputation Reputation) *ReputationDetector {
+	return &ReputationDetector{reputation: reputation}
+}
+
+// Name implements Detector
+func (d *ReputationDetector) Name() string { return DetectorIPReputation }
+
+// Detect implements Detector
+func (d *ReputationDetector) Detect(ctx context.Context, in trust.Input) (float64, error) {
+	ip := in.Context["ip"]
+	if ip == "" {
+		return 0, nil
+	}
+	return d.reputation.Score(ctx, ip)
+}
+
+// readCount reads a counter kept with Incr, which is 0 once expired
+func readCount(ctx context.Context, s store.Store, key string) (int64, error) {
+	data, err := s.Get(ctx, key)
+	if errors.Is(err, store.ErrNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(data), 10, 64)
+}
+
+func containsValue(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// hashValue keeps raw device identifiers out of the store
+func hashValue(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:16])
+}
@@ -0,0 +1,168 @@
+// Package risk detects anomalies in how a subject uses the service, such as
+// bursts of requests, new countries or devices, repeated denied requests,
+// access outside working hours, departures from a subject's learned baseline
+// and addresses with a bad reputation, and turns them into the trust
+// engine's risk factor.
+//
+// Detectors score a request from 0 (nothing unusual) to 1 (certain anomaly).
+// Their scores are combined as independent signals, so several weak
+// anomalies add up to a strong one. What detectors remember about subjects
+// lives in the shared store under "risk:", so every replica sees the same
+// history.
+package risk
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/trust"
+)
+
+// Detector names
+const (
+	DetectorVelocity            = "velocity"
+	DetectorNewGeo              = "new_geo"
+	DetectorNewDevice           = "new_device"
+	DetectorPrivilegeEscalation = "privilege_escalation"
+	DetectorOffHours            = "off_hours"
+	DetectorBaseline            = "baseline"
+	DetectorIPReputation        = "ip_reputation"
+)
+
+// Detectors lists the built-in detectors in the order they are reported
+var Detectors = []string{DetectorVelocity, DetectorNewGeo, DetectorNewDevice, DetectorPrivilegeEscalation, DetectorOffHours, DetectorBaseline, DetectorIPReputation}
+
+// keyPrefix holds everything detectors remember
+const keyPrefix = "risk:"
+
+// Detector scores one kind of anomaly
+type Detector interface {
+	Name() string
+	// Detect scores in from 0 to 1 without changing what is remembered
+	Detect(ctx context.Context, in trust.Input) (float64, error)
+}
+
+// Recorder is implemented by detectors that learn from handled requests.
+// Status is the response status code.
+type Recorder interface {
+	Record(ctx context.Context, in trust.Input, status int) error
+}
+
+// Engine combines detectors into the risk factor
+type Engine struct {
+	detectors []Detector
+	logger    interfaces.Logger
+	metrics   interfaces.MetricsCollector
+}
+
+// NewEngine creates an engine over detectors; metrics may be nil
+func NewEngine(detectors []Detector, logger interfaces.Logger, metrics interfaces.MetricsCollector) *Engine {
+	return &Engine{detectors: detectors, logger: logger, metrics: metrics}
+}
+
+// ParseDetectors reads a comma-separated list of detector names, such as
+// "velocity,new_geo", into enable flags
+func ParseDetectors(value string) (map[string]bool, error) {
+	enabled := make(map[string]bool)
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		known := false
+		for _, d := range Detectors {
+			known = known || d == name
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown risk detector %q", name)
+		}
+		enabled[name] = true
+	}
+	return enabled, nil
+}
+
+// Assess runs every detector and returns the combined risk with the score
+// of each detector that found something. A failing detector is skipped.
+func (e *Engine) Assess(ctx context.Context, in trust.Input) (float64, map[string]float64) {
+	safe := 1.0
+	findings := make(map[string]float64)
+	for _, d := range e.detectors {
+		score, err := d.Detect(ctx, in)
+		if err != nil {
+			e.logger.Warn("Risk detector unavailable", "detector", d.Name(), "subject", in.Subject, "error", err)
+			e.count("risk_detector_errors_total", d.Name())
+			continue
+		}
+		if score <= 0 {
+			continue
+		}
+		if score > 1 {
+			score = 1
+		}
+		findings[d.Name()] = score
+		safe *= 1 - score
+		e.count("risk_detections_total", d.Name())
+	}
+	return 1 - safe, findings
+}
+
+// Factor returns the risk factor provider, scoring 1 minus the combined risk
+func (e *Engine) Factor() trust.FactorProvider {
+	return trust.FactorFunc(trust.FactorRisk, func(ctx context.Context, in trust.Input) (trust.FactorResult, error) {
+		risk, findings := e.Assess(ctx, in)
+		if len(findings) == 0 {
+			return trust.FactorResult{Score: 1, Reason: "no risk signals"}, nil
+		}
+		names := make([]string, 0, len(findings))
+		evidence := make(map[string]string, len(findings))
+		for name, score := range findings {
+			names = append(names, name)
+			evidence[name] = strconv.FormatFloat(score, 'f', 2, 64)
+		}
+		sort.Strings(names)
+		return trust.FactorResult{
+			Score:    1 - risk,
+			Reason:   "anomalies: " + strings.Join(names, ", "),
+			Evidence: evidence,
+		}, nil
+	})
+}
+
+// Record lets every Recorder learn from a handled request
+func (e *Engine) Record(ctx context.Context, in trust.Input, status int) {
+	for _, d := range e.detectors {
+		r, ok := d.(Recorder)
+		if !ok {
+			continue
+		}
+		if err := r.Record(ctx, in, status); err != nil {
+			e.logger.Warn("Failed to record request for risk detection", "detector", d.Name(), "subject", in.Subject, "error", err)
+		}
+	}
+}
+
+// Middleware records authenticated requests once they have been handled, so
+// a request is scored against the history before it
+func (e *Engine) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+		value, ok := c.Get("user")
+		user, _ := value.(*interfaces.UserInfo)
+		if !ok || user == nil || user.ID == "" {
+			return
+		}
+		in := trust.Input{Subject: user.ID, Context: trust.RequestContext(c)}
+		e.Record(c.Request.Context(), in, c.Writer.Status())
+	}
+}
+
+func (e *Engine) count(name, detector string) {
+	if e.metrics != nil {
+		e.metrics.IncrementCounter(name, map[string]string{"detector": detector})
+	}
+}
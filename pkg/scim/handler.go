@@ -0,0 +1,325 @@
+package scim
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ContentType is the media type of SCIM requests and responses
+const ContentType = "application/scim+json"
+
+// maxBodyBytes bounds request bodies, enough for a group of maxMembers
+const maxBodyBytes = 4 << 20
+
+// ListResponse is a page of resources
+type ListResponse struct {
+	Schemas      []string    `json:"schemas"`
+	TotalResults int         `json:"totalResults"`
+	StartIndex   int         `json:"startIndex"`
+	ItemsPerPage int         `json:"itemsPerPage"`
+	Resources    interface{} `json:"Resources"`
+}
+
+// RegisterRoutes mounts the SCIM endpoints, e.g. on /scim/v2
+func (s *Service) RegisterRoutes(r gin.IRoutes) {
+	r.GET("/ServiceProviderConfig", s.handleServiceProviderConfig)
+	r.GET("/ResourceTypes", s.handleResourceTypes)
+	r.GET("/Users", s.handleListUsers)
+	r.POST("/Users", s.handleCreateUser)
+	r.GET("/Users/:id", s.handleGetUser)
+	r.PUT("/Users/:id", s.handleReplaceUser)
+	r.PATCH("/Users/:id", s.handlePatchUser)
+	r.DELETE("/Users/:id", s.handleDeleteUser)
+	r.GET("/Groups", s.handleListGroups)
+	r.POST("/Groups", s.handleCreateGroup)
+	r.GET("/Groups/:id", s.handleGetGroup)
+	r.PUT("/Groups/:id", s.handleReplaceGroup)
+	r.PATCH("/Groups/:id", s.handlePatchGroup)
+	r.DELETE("/Groups/:id", s.handleDeleteGroup)
+}
+
+func (s *Service) handleServiceProviderConfig(c *gin.Context) {
+	supported := func(ok bool) gin.H { return gin.H{"supported": ok} }
+	s.respond(c, http.StatusOK, gin.H{
+		"schemas":        []string{SchemaServiceProviderConfig},
+		"patch":          supported(true),
+		"bulk":           gin.H{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         gin.H{"supported": true, "maxResults": s.config.MaxResults},
+		"changePassword": supported(false),
+		"sort":           supported(false),
+		"etag":           supported(false),
+		"authenticationSchemes": []gin.H{{
+			"type":        "oauthbearertoken",
+			"name":        "API key",
+			"description": "A managed API key with the scim:write scope, as a Bearer token",
+			"primary":     true,
+		}},
+		"meta": gin.H{"resourceType": "ServiceProviderConfig", "location": s.location(c, "/ServiceProviderConfig")},
+	})
+}
+
+func (s *Service) handleResourceTypes(c *gin.Context) {
+	types := []gin.H{
+		{"schemas": []string{SchemaResourceType}, "id": "User", "name": "User", "endpoint": "/Users", "schema": SchemaUser,
+			"meta": gin.H{"resourceType": "ResourceType", "location": s.location(c, "/ResourceTypes/User")}},
+		{"schemas": []string{SchemaResourceType}, "id": "Group", "name": "Group", "endpoint": "/Groups", "schema": SchemaGroup,
+			"meta": gin.H{"resourceType": "ResourceType", "location": s.location(c, "/ResourceTypes/Group")}},
+	}
+	s.respond(c, http.StatusOK, ListResponse{
+		Schemas: []string{SchemaListResponse}, TotalResults: len(types), StartIndex: 1, ItemsPerPage: len(types), Resources: types,
+	})
+}
+
+func (s *Service) handleListUsers(c *gin.Context) {
+	users, err := s.ListUsers(c.Request.Context(), c.Query("filter"))
+	if err != nil {
+		s.respondError(c, err)
+		return
+	}
+	start, count := s.page(c, len(users))
+	for _, u := range users[start:count] {
+		s.locate(c, u)
+	}
+	s.list(c, len(users), start, users[start:count])
+}
+
+func (s *Service) handleCreateUser(c *gin.Context) {
+	u := User{Active: true}
+	if !s.bind(c, &u) {
+		return
+	}
+	created, err := s.CreateUser(c.Request.Context(), u)
+	if err != nil {
+		s.respondError(c, err)
+		return
+	}
+	s.respond(c, http.StatusCreated, s.locate(c, created))
+}
+
+func (s *Service) handleGetUser(c *gin.Context) {
+	u, err := s.User(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		s.respondError(c, err)
+		return
+	}
+	s.respond(c, http.StatusOK, s.locate(c, u))
+}
+
+func (s *Service) handleReplaceUser(c *gin.Context) {
+	u := User{Active: true}
+	if !s.bind(c, &u) {
+		return
+	}
+	replaced, err := s.ReplaceUser(c.Request.Context(), c.Param("id"), u)
+	if err != nil {
+		s.respondError(c, err)
+		return
+	}
+	s.respond(c, http.StatusOK, s.locate(c, replaced))
+}
+
+func (s *Service) handlePatchUser(c *gin.Context) {
+	var req PatchRequest
+	if !s.bind(c, &req) {
+		return
+	}
+	patched, err := s.PatchUser(c.Request.Context(), c.Param("id"), req.Operations)
+	if err != nil {
+		s.respondError(c, err)
+		return
+	}
+	s.respond(c, http.StatusOK, s.locate(c, patched))
+}
+
+func (s *Service) handleDeleteUser(c *gin.Context) {
+	if err := s.DeleteUser(c.Request.Context(), c.Param("id")); err != nil {
+		s.respondError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (s *Service) handleListGroups(c *gin.Context) {
+	groups, err := s.ListGroups(c.Request.Context(), c.Query("filter"))
+	if err != nil {
+		s.respondError(c, err)
+		return
+	}
+	// Entra ID checks a group exists without wanting its members
+	excluded := strings.EqualFold(c.Query("excludedAttributes"), "members")
+	start, count := s.page(c, len(groups))
+	for _, g := range groups[start:count] {
+		s.locateGroup(c, g)
+		if excluded {
+			g.Members = nil
+		}
+	}
+	s.list(c, len(groups), start, groups[start:count])
+}
+
+func (s *Service) handleCreateGroup(c *gin.Context) {
+	var g Group
+	if !s.bind(c, &g) {
+		return
+	}
+	created, err := s.CreateGroup(c.Request.Context(), g)
+	if err != nil {
+		s.respondError(c, err)
+		return
+	}
+	s.respond(c, http.StatusCreated, s.locateGroup(c, created))
+}
+
+func (s *Service) handleGetGroup(c *gin.Context) {
+	g, err := s.Group(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		s.respondError(c, err)
+		return
+	}
+	s.respond(c, http.StatusOK, s.locateGroup(c, g))
+}
+
+func (s *Service) handleReplaceGroup(c *gin.Context) {
+	var g Group
+	if !s.bind(c, &g) {
+		return
+	}
+	replaced, err := s.ReplaceGroup(c.Request.Context(), c.Param("id"), g)
+	if err != nil {
+		s.respondError(c, err)
+		return
+	}
+	s.respond(c, http.StatusOK, s.locateGroup(c, replaced))
+}
+
+func (s *Service) handlePatchGroup(c *gin.Context) {
+	var req PatchRequest
+	if !s.bind(c, &req) {
+		return
+	}
+	patched, err := s.PatchGroup(c.Request.Context(), c.Param("id"), req.Operations)
+	if err != nil {
+		s.respondError(c, err)
+		return
+	}
+	s.respond(c, http.StatusOK, s.locateGroup(c, patched))
+}
+
+func (s *Service) handleDeleteGroup(c *gin.Context) {
+	if err := s.DeleteGroup(c.Request.Context(), c.Param("id")); err != nil {
+		s.respondError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// bind decodes the request body into v, answering 400 when it cannot
+func (s *Service) bind(c *gin.Context, v interface{}) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(c.Writer, c.Request.Body, maxBodyBytes)).Decode(v); err != nil {
+		s.respondError(c, invalidSyntax("request body is not valid JSON"))
+		return false
+	}
+	return true
+}
+
+// page returns the slice bounds of the page the startIndex and count
+// parameters ask for, which are 1-based
+func (s *Service) page(c *gin.Context, total int) (int, int) {
+	start, err := strconv.Atoi(c.DefaultQuery("startIndex", "1"))
+	if err != nil || start < 1 {
+		start = 1
+	}
+	count, err := strconv.Atoi(c.DefaultQuery("count", strconv.Itoa(s.config.MaxResults)))
+	if err != nil || count < 0 || count > s.config.MaxResults {
+		count = s.config.MaxResults
+	}
+	from := start - 1
+	if from > total {
+		from = total
+	}
+	to := from + count
+	if to > total {
+		to = total
+	}
+	return from, to
+}
+
+func (s *Service) list(c *gin.Context, total, start int, resources interface{}) {
+	items := 0
+	switch r := resources.(type) {
+	case []*User:
+		items = len(r)
+	case []*Group:
+		items = len(r)
+	}
+	s.respond(c, http.StatusOK, ListResponse{
+		Schemas:      []string{SchemaListResponse},
+		TotalResults: total,
+		StartIndex:   start + 1,
+		ItemsPerPage: items,
+		Resources:    resources,
+	})
+}
+
+func (s *Service) locate(c *gin.Context, u *User) *User {
+	u.Meta.Location = s.location(c, "/Users/"+u.ID)
+	return u
+}
+
+func (s *Service) locateGroup(c *gin.Context, g *Group) *Group {
+	g.Meta.Location = s.location(c, "/Groups/"+g.ID)
+	return g
+}
+
+// location is the URL of resource under the SCIM base the request came in
+// on
+func (s *Service) location(c *gin.Context, resource string) string {
+	scheme := "https"
+	if c.Request.TLS == nil && c.GetHeader("X-Forwarded-Proto") != "https" {
+		scheme = "http"
+	}
+	base := c.Request.URL.Path
+	for _, suffix := range []string{"/Users", "/Groups", "/ServiceProviderConfig", "/ResourceTypes"} {
+		if i := strings.Index(base, suffix); i >= 0 {
+			base = base[:i]
+			break
+		}
+	}
+	return scheme + "://" + c.Request.Host + base + resource
+}
+
+func (s *Service) respond(c *gin.Context, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		s.respondError(c, err)
+		return
+	}
+	c.Data(status, ContentType, data)
+}
+
+func (s *Service) respondError(c *gin.Context, err error) {
+	var scimErr *Error
+	switch {
+	case errors.As(err, &scimErr):
+	case errors.Is(err, ErrConflict):
+		scimErr = &Error{Status: http.StatusConflict, Detail: err.Error()}
+	default:
+		s.logger.Error("SCIM request failed", "path", c.Request.URL.Path, "error", err)
+		scimErr = &Error{Status: http.StatusInternalServerError, Detail: "internal error"}
+	}
+	body := gin.H{
+		"schemas": []string{SchemaError},
+		"status":  strconv.Itoa(scimErr.Status),
+		"detail":  scimErr.Detail,
+	}
+	if scimErr.ScimType != "" {
+		body["scimType"] = scimErr.ScimType
+	}
+	data, _ := json.Marshal(body)
+	c.Data(scimErr.Status, ContentType, data)
+}
@@ -0,0 +1,374 @@
+package scim
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Operation is an operation of a PatchOp request
+type Operation struct {
+	// Op is add, replace or remove, in any case as Entra ID sends them
+	Op    string          `json:"op"`
+	Path  string          `json:"path,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// PatchRequest is a PatchOp request
+type PatchRequest struct {
+	Schemas    []string    `json:"schemas"`
+	Operations []Operation `json:"Operations"`
+}
+
+func invalidSyntax(format string, args ...interface{}) *Error {
+	return &Error{Status: http.StatusBadRequest, ScimType: "invalidSyntax", Detail: fmt.Sprintf(format, args...)}
+}
+
+// path is a parsed PatchOp path: attr[filter].sub
+type path struct {
+	attr   string
+	filter *filter
+	sub    string
+}
+
+// parsePath parses p, dropping a schema URN prefix. Attribute names are
+// case-insensitive, so they are lowered.
+func parsePath(p, schema string) (*path, error) {
+	if len(p) > len(schema) && strings.EqualFold(p[:len(schema)+1], schema+":") {
+		p = p[len(schema)+1:]
+	}
+	parsed := &path{}
+	if open := strings.IndexByte(p, '['); open >= 0 {
+		end := strings.LastIndexByte(p, ']')
+		if end < open {
+			return nil, invalidSyntax("unterminated filter in path %q", p)
+		}
+		f, err := parseFilter(p[open+1:end], "value", "type", "display")
+		if err != nil {
+			return nil, err
+		}
+		parsed.filter = f
+		parsed.sub = strings.TrimPrefix(p[end+1:], ".")
+		p = p[:open]
+	} else if attr, sub, ok := strings.Cut(p, "."); ok {
+		p, parsed.sub = attr, sub
+	}
+	parsed.attr = strings.ToLower(p)
+	parsed.sub = strings.ToLower(parsed.sub)
+	return parsed, nil
+}
+
+// patchUser applies op to u. Attributes the service does not keep, such as
+// enterprise extension attributes, are ignored.
+func patchUser(u *User, op Operation) error {
+	kind := strings.ToLower(op.Op)
+	if kind != "add" && kind != "replace" && kind != "remove" {
+		return invalidSyntax("unknown op %q", op.Op)
+	}
+	if op.Path == "" {
+		if kind == "remove" {
+			return &Error{Status: http.StatusBadRequest, ScimType: "noTarget", Detail: "remove needs a path"}
+		}
+		var values map[string]json.RawMessage
+		if err := json.Unmarshal(op.Value, &values); err != nil {
+			return invalidSyntax("value must be an object without a path")
+		}
+		for name, value := range values {
+			p, err := parsePath(name, SchemaUser)
+			if err != nil {
+				return err
+			}
+			if err := setUser(u, kind, p, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	p, err := parsePath(op.Path, SchemaUser)
+	if err != nil {
+		return err
+	}
+	if kind == "remove" {
+		return removeUser(u, p, op.Value)
+	}
+	return setUser(u, kind, p, op.Value)
+}
+
+func setUser(u *User, kind string, p *path, value json.RawMessage) error {
+	switch {
+	case p.filter != nil && (p.attr == "emails" || p.attr == "roles"):
+		values := &u.Emails
+		if p.attr == "roles" {
+			values = &u.Roles
+		}
+		return setFiltered(values, p, value)
+	case p.attr == "username":
+		return decodeString(value, &u.UserName)
+	case p.attr == "externalid":
+		return decodeString(value, &u.ExternalID)
+	case p.attr == "displayname":
+		return decodeString(value, &u.DisplayName)
+	case p.attr == "active":
+		return decodeBool(value, &u.Active)
+	case p.attr == "name" && p.sub == "":
+		var name Name
+		if err := json.Unmarshal(value, &name); err != nil {
+			return invalidValue("name must be an object")
+		}
+		u.Name = &name
+	case p.attr == "name":
+		if u.Name == nil {
+			u.Name = &Name{}
+		}
+		switch p.sub {
+		case "givenname":
+			return decodeString(value, &u.Name.GivenName)
+		case "familyname":
+			return decodeString(value, &u.Name.FamilyName)
+		case "formatted":
+			return decodeString(value, &u.Name.Formatted)
+		}
+	case p.attr == "emails":
+		return setValues(&u.Emails, kind, value)
+	case p.attr == "roles":
+		return setValues(&u.Roles, kind, value)
+	}
+	return nil
+}
+
+func removeUser(u *User, p *path, value json.RawMessage) error {
+	switch p.attr {
+	case "externalid":
+		u.ExternalID = ""
+	case "displayname":
+		u.DisplayName = ""
+	case "name":
+		switch p.sub {
+		case "":
+			u.Name = nil
+		case "givenname", "familyname", "formatted":
+			if u.Name != nil {
+				return setUser(u, "replace", p, json.RawMessage(`""`))
+			}
+		}
+	case "emails":
+		u.Emails = removeValues(u.Emails, p.filter, value)
+	case "roles":
+		u.Roles = removeValues(u.Roles, p.filter, value)
+	case "username", "active":
+		return invalidValue("%s cannot be removed", p.attr)
+	}
+	return nil
+}
+
+// patchGroup applies op to g
+func patchGroup(g *Group, op Operation) error {
+	kind := strings.ToLower(op.Op)
+	if kind != "add" && kind != "replace" && kind != "remove" {
+		return invalidSyntax("unknown op %q", op.Op)
+	}
+	if op.Path == "" {
+		if kind == "remove" {
+			return &Error{Status: http.StatusBadRequest, ScimType: "noTarget", Detail: "remove needs a path"}
+		}
+		var values map[string]json.RawMessage
+		if err := json.Unmarshal(op.Value, &values); err != nil {
+			return invalidSyntax("value must be an object without a path")
+		}
+		for name, value := range values {
+			p, err := parsePath(name, SchemaGroup)
+			if err != nil {
+				return err
+			}
+			if err := setGroup(g, kind, p, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	p, err := parsePath(op.Path, SchemaGroup)
+	if err != nil {
+		return err
+	}
+	if kind != "remove" {
+		return setGroup(g, kind, p, op.Value)
+	}
+	switch p.attr {
+	case "members":
+		g.Members = removeValues(g.Members, p.filter, op.Value)
+	case "externalid":
+		g.ExternalID = ""
+	case "displayname":
+		return invalidValue("displayName cannot be removed")
+	}
+	return nil
+}
+
+func setGroup(g *Group, kind string, p *path, value json.RawMessage) error {
+	switch p.attr {
+	case "displayname":
+		return decodeString(value, &g.DisplayName)
+	case "externalid":
+		return decodeString(value, &g.ExternalID)
+	case "members":
+		if p.filter != nil {
+			return invalidSyntax("members can only be removed by filter")
+		}
+		return setValues(&g.Members, kind, value)
+	}
+	return nil
+}
+
+// setValues adds value, one or a list of values, to values or replaces them
+func setValues(values *[]MultiValue, kind string, value json.RawMessage) error {
+	var list []MultiValue
+	if err := json.Unmarshal(value, &list); err != nil {
+		var one MultiValue
+		if err := json.Unmarshal(value, &one); err != nil {
+			return invalidValue("expected a list of values")
+		}
+		list = []MultiValue{one}
+	}
+	if kind == "replace" {
+		*values = nil
+	}
+	for _, v := range list {
+		*values = append(removeValue(*values, v.Value), v)
+	}
+	return nil
+}
+
+// setFiltered sets the sub-attribute of the values p's filter matches, e.g.
+// emails[type eq "work"].value, adding one when none does
+func setFiltered(values *[]MultiValue, p *path, value json.RawMessage) error {
+	var s string
+	if err := decodeString(value, &s); err != nil {
+		return err
+	}
+	matched := false
+	for i := range *values {
+		if p.filter.matches(multiValueAttributes((*values)[i])) {
+			matched = true
+			setSub(&(*values)[i], p.sub, s)
+		}
+	}
+	if !matched {
+		v := MultiValue{}
+		setSub(&v, p.filter.attr, p.filter.value)
+		setSub(&v, p.sub, s)
+		*values = append(*values, v)
+	}
+	return nil
+}
+
+func setSub(v *MultiValue, sub, s string) {
+	switch strings.ToLower(sub) {
+	case "value", "":
+		v.Value = s
+	case "type":
+		v.Type = s
+	case "display":
+		v.Display = s
+	case "primary":
+		v.Primary, _ = strconv.ParseBool(s)
+	}
+}
+
+// removeValues removes the values f matches, or those listed in value, or
+// every value when there is neither
+func removeValues(values []MultiValue, f *filter, value json.RawMessage) []MultiValue {
+	if f == nil && len(value) > 0 {
+		var list []MultiValue
+		if json.Unmarshal(value, &list) == nil {
+			for _, v := range list {
+				values = removeValue(values, v.Value)
+			}
+			return values
+		}
+	}
+	if f == nil {
+		return nil
+	}
+	kept := values[:0]
+	for _, v := range values {
+		if !f.matches(multiValueAttributes(v)) {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
+func multiValueAttributes(v MultiValue) map[string]string {
+	return map[string]string{"value": v.Value, "type": v.Type, "display": v.Display}
+}
+
+func decodeString(value json.RawMessage, s *string) error {
+	if err := json.Unmarshal(value, s); err != nil {
+		return invalidValue("expected a string")
+	}
+	return nil
+}
+
+// decodeBool accepts booleans and, as Entra ID sends them, "True" and
+// "False"
+func decodeBool(value json.RawMessage, b *bool) error {
+	if json.Unmarshal(value, b) == nil {
+		return nil
+	}
+	var s string
+	if json.Unmarshal(value, &s) == nil {
+		if parsed, err := strconv.ParseBool(strings.ToLower(s)); err == nil {
+			*b = parsed
+			return nil
+		}
+	}
+	return invalidValue("expected a boolean")
+}
+
+// filter is an "attr eq value" filter, the only kind identity providers
+// send when provisioning
+type filter struct {
+	attr  string
+	value string
+}
+
+// parseFilter parses expression, allowing attributes in allowed. An empty
+// expression is a nil filter, which matches everything.
+func parseFilter(expression string, allowed ...string) (*filter, error) {
+	expression = strings.TrimSpace(expression)
+	if expression == "" {
+		return nil, nil
+	}
+	parts := strings.SplitN(expression, " ", 3)
+	if len(parts) != 3 || !strings.EqualFold(parts[1], "eq") {
+		return nil, &Error{Status: http.StatusBadRequest, ScimType: "invalidFilter", Detail: "only \"attribute eq value\" filters are supported"}
+	}
+	f := &filter{}
+	for _, attr := range allowed {
+		if strings.EqualFold(attr, parts[0]) {
+			f.attr = attr
+		}
+	}
+	if f.attr == "" {
+		return nil, &Error{Status: http.StatusBadRequest, ScimType: "invalidFilter", Detail: fmt.Sprintf("cannot filter on %q", parts[0])}
+	}
+	if err := json.Unmarshal([]byte(strings.TrimSpace(parts[2])), &f.value); err != nil {
+		return nil, &Error{Status: http.StatusBadRequest, ScimType: "invalidFilter", Detail: "filter values must be quoted strings"}
+	}
+	return f, nil
+}
+
+// matches tests the filter on attributes. A nil filter matches everything;
+// names and types compare case-insensitively, as their schemas define.
+func (f *filter) matches(attributes map[string]string) bool {
+	if f == nil {
+		return true
+	}
+	switch f.attr {
+	case "userName", "displayName", "type":
+		return strings.EqualFold(attributes[f.attr], f.value)
+	}
+	return attributes[f.attr] == f.value
+}
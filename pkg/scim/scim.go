@@ -0,0 +1,769 @@
+// Package scim serves SCIM 2.0 (RFC 7643, RFC 7644) Users and Groups, so
+// enterprise identity providers such as Okta and Microsoft Entra ID can
+// provision and deprovision users directly. The roles of provisioned users
+// are assigned in RBAC, and their groups can be mapped to roles by group
+// sync, with the service as its "scim" source. Deactivating or deleting a
+// user takes back every role provisioning gave them.
+package scim
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/rbac"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+// Schema URNs
+const (
+	SchemaUser                  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	SchemaGroup                 = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	SchemaListResponse          = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	SchemaPatchOp               = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	SchemaError                 = "urn:ietf:params:scim:api:messages:2.0:Error"
+	SchemaServiceProviderConfig = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	SchemaResourceType          = "urn:ietf:params:scim:schemas:core:2.0:ResourceType"
+)
+
+// Subjects, the attribute of users that is their ID in RBAC
+const (
+	SubjectUserName   = "userName"
+	SubjectExternalID = "externalId"
+)
+
+// AssignedBy marks the role assignments provisioning made
+const AssignedBy = "scim"
+
+// Store keys of users and groups by ID, and of the claims that keep user
+// names and group display names unique
+const (
+	userPrefix      = "scim:user:"
+	userNamePrefix  = "scim:user-name:"
+	groupPrefix     = "scim:group:"
+	groupNamePrefix = "scim:group-name:"
+)
+
+// Limits on resources
+const (
+	maxValueLength = 256
+	maxMultiValues = 100
+	maxMembers     = 10000
+	maxUpdateTries = 5
+)
+
+// Error is a SCIM error, answered as urn:ietf:params:scim:api:messages:2.0:Error
+type Error struct {
+	Status int
+	// ScimType is the RFC 7644 error type, e.g. "uniqueness"
+	ScimType string
+	Detail   string
+}
+
+func (e *Error) Error() string {
+	if e.ScimType != "" {
+		return fmt.Sprintf("scim %d %s: %s", e.Status, e.ScimType, e.Detail)
+	}
+	return fmt.Sprintf("scim %d: %s", e.Status, e.Detail)
+}
+
+// ErrConflict is returned when a resource keeps changing under an update
+var ErrConflict = errors.New("scim resource is being modified concurrently")
+
+func invalidValue(format string, args ...interface{}) *Error {
+	return &Error{Status: http.StatusBadRequest, ScimType: "invalidValue", Detail: fmt.Sprintf(format, args...)}
+}
+
+func notFound(kind, id string) *Error {
+	return &Error{Status: http.StatusNotFound, Detail: fmt.Sprintf("%s %q not found", kind, id)}
+}
+
+// Name is a user's name
+type Name struct {
+	Formatted  string `json:"formatted,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+	GivenName  string `json:"givenName,omitempty"`
+}
+
+// MultiValue is a value of a multi-valued attribute such as emails, roles
+// or members
+type MultiValue struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+	Ref     string `json:"$ref,omitempty"`
+}
+
+// Meta describes a resource
+type Meta struct {
+	ResourceType string    `json:"resourceType"`
+	Created      time.Time `json:"created"`
+	LastModified time.Time `json:"lastModified"`
+	Location     string    `json:"location,omitempty"`
+}
+
+// User is a provisioned user. Roles are RBAC role names; Groups is
+// read-only and lists the groups the user is a member of.
+type User struct {
+	Schemas     []string     `json:"schemas"`
+	ID          string       `json:"id"`
+	ExternalID  string       `json:"externalId,omitempty"`
+	UserName    string       `json:"userName"`
+	Name        *Name        `json:"name,omitempty"`
+	DisplayName string       `json:"displayName,omitempty"`
+	Emails      []MultiValue `json:"emails,omitempty"`
+	Active      bool         `json:"active"`
+	Roles       []MultiValue `json:"roles,omitempty"`
+	Groups      []MultiValue `json:"groups,omitempty"`
+	Meta        Meta         `json:"meta"`
+}
+
+// Group is a provisioned group; members are user IDs
+type Group struct {
+	Schemas     []string     `json:"schemas"`
+	ID          string       `json:"id"`
+	ExternalID  string       `json:"externalId,omitempty"`
+	DisplayName string       `json:"displayName"`
+	Members     []MultiValue `json:"members,omitempty"`
+	Meta        Meta         `json:"meta"`
+}
+
+// Roles assigns roles, e.g. an rbac.Manager
+type Roles interface {
+	Roles(ctx context.Context) ([]*rbac.Role, error)
+	Assign(ctx context.Context, a rbac.Assignment) (*rbac.Assignment, error)
+	Unassign(ctx context.Context, user, id string) error
+	Assignments(ctx context.Context, id string) ([]*rbac.Assignment, error)
+}
+
+// Config configures the service
+type Config struct {
+	// Subject is the user attribute that is their ID in RBAC, the ID their
+	// logins give them: userName (the default) or externalId
+	Subject string
+	// MaxResults bounds the resources a list returns; defaults to 200
+	MaxResults int
+}
+
+// Service keeps provisioned users and groups
+type Service struct {
+	config  Config
+	store   store.Store
+	roles   Roles
+	logger  interfaces.Logger
+	changed []func(ctx context.Context)
+	now     func() time.Time
+}
+
+// NewService creates a service on s assigning roles in roles
+func NewService(cfg Config, s store.Store, roles Roles, logger interfaces.Logger) (*Service, error) {
+	switch cfg.Subject {
+	case "":
+		cfg.Subject = SubjectUserName
+	case SubjectUserName, SubjectExternalID:
+	default:
+		return nil, fmt.Errorf("scim subject must be %s or %s", SubjectUserName, SubjectExternalID)
+	}
+	if cfg.MaxResults <= 0 {
+		cfg.MaxResults = 200
+	}
+	return &Service{config: cfg, store: s, roles: roles, logger: logger, now: time.Now}, nil
+}
+
+// OnGroupsChanged calls fn after groups, or the users in them, change, e.g.
+// to sync the roles mapped to them right away
+func (s *Service) OnGroupsChanged(fn func(ctx context.Context)) {
+	s.changed = append(s.changed, fn)
+}
+
+// Name implements groupsync.Source
+func (s *Service) Name() string { return "scim" }
+
+// Groups implements groupsync.Source: the subjects of the active members of
+// every group, by display name
+func (s *Service) Groups(ctx context.Context) (map[string][]string, error) {
+	groups, err := s.listGroups(ctx)
+	if err != nil {
+		return nil, err
+	}
+	users, err := s.listUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]*User, len(users))
+	for _, u := range users {
+		byID[u.ID] = u
+	}
+	members := make(map[string][]string, len(groups))
+	for _, g := range groups {
+		subjects := []string{}
+		for _, m := range g.Members {
+			if u := byID[m.Value]; u != nil && u.Active && s.subject(u) != "" {
+				subjects = append(subjects, s.subject(u))
+			}
+		}
+		members[g.DisplayName] = subjects
+	}
+	return members, nil
+}
+
+// CreateUser provisions u under a new ID, assigning its roles when active
+func (s *Service) CreateUser(ctx context.Context, u User) (*User, error) {
+	if err := s.validateUser(ctx, &u); err != nil {
+		return nil, err
+	}
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	now := s.now().UTC()
+	u.ID, u.Meta = id, Meta{ResourceType: "User", Created: now, LastModified: now}
+	if err := s.claim(ctx, userNamePrefix, u.UserName, id, "userName"); err != nil {
+		return nil, err
+	}
+	if err := s.put(ctx, userPrefix+id, nil, u); err != nil {
+		_ = s.store.Delete(ctx, userNamePrefix+strings.ToLower(u.UserName))
+		return nil, err
+	}
+	if err := s.reconcileRoles(ctx, nil, &u); err != nil {
+		return nil, err
+	}
+	return s.withGroups(ctx, &u)
+}
+
+// User returns user id with the groups they are a member of
+func (s *Service) User(ctx context.Context, id string) (*User, error) {
+	u, _, err := s.loadUser(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return s.withGroups(ctx, u)
+}
+
+// ListUsers returns the users filter matches, or every user without one,
+// by userName
+func (s *Service) ListUsers(ctx context.Context, filter string) ([]*User, error) {
+	f, err := parseFilter(filter, "id", "userName", "externalId", "displayName")
+	if err != nil {
+		return nil, err
+	}
+	users, err := s.listUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	matched := users[:0]
+	for _, u := range users {
+		if f.matches(map[string]string{"id": u.ID, "userName": u.UserName, "externalId": u.ExternalID, "displayName": u.DisplayName}) {
+			matched = append(matched, u)
+		}
+	}
+	return matched, nil
+}
+
+// ReplaceUser replaces user id with u, reconciling their roles
+func (s *Service) ReplaceUser(ctx context.Context, id string, u User) (*User, error) {
+	return s.updateUser(ctx, id, func(current *User) error {
+		u.ID, u.Meta = current.ID, current.Meta
+		*current = u
+		return nil
+	})
+}
+
+// PatchUser applies the PatchOp operations to user id
+func (s *Service) PatchUser(ctx context.Context, id string, ops []Operation) (*User, error) {
+	return s.updateUser(ctx, id, func(u *User) error {
+		for _, op := range ops {
+			if err := patchUser(u, op); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteUser deprovisions user id, taking back their roles and removing
+// them from their groups
+func (s *Service) DeleteUser(ctx context.Context, id string) error {
+	u, _, err := s.loadUser(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := s.reconcileRoles(ctx, u, nil); err != nil {
+		return err
+	}
+	groups, err := s.listGroups(ctx)
+	if err != nil {
+		return err
+	}
+	for _, g := range groups {
+		if !hasMember(g, id) {
+			continue
+		}
+		if _, err := s.updateGroup(ctx, g.ID, func(g *Group) error {
+			g.Members = removeValue(g.Members, id)
+			return nil
+		}, false); err != nil {
+			return err
+		}
+	}
+	if err := s.store.Delete(ctx, userPrefix+id); err != nil {
+		return err
+	}
+	if err := s.store.Delete(ctx, userNamePrefix+strings.ToLower(u.UserName)); err != nil {
+		return err
+	}
+	s.groupsChanged(ctx)
+	return nil
+}
+
+// CreateGroup provisions g under a new ID
+func (s *Service) CreateGroup(ctx context.Context, g Group) (*Group, error) {
+	if err := s.validateGroup(ctx, &g); err != nil {
+		return nil, err
+	}
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	now := s.now().UTC()
+	g.ID, g.Meta = id, Meta{ResourceType: "Group", Created: now, LastModified: now}
+	if err := s.claim(ctx, groupNamePrefix, g.DisplayName, id, "displayName"); err != nil {
+		return nil, err
+	}
+	if err := s.put(ctx, groupPrefix+id, nil, g); err != nil {
+		_ = s.store.Delete(ctx, groupNamePrefix+strings.ToLower(g.DisplayName))
+		return nil, err
+	}
+	if len(g.Members) > 0 {
+		s.groupsChanged(ctx)
+	}
+	return &g, nil
+}
+
+// Group returns group id
+func (s *Service) Group(ctx context.Context, id string) (*Group, error) {
+	g, _, err := s.loadGroup(ctx, id)
+	return g, err
+}
+
+// ListGroups returns the groups filter matches, or every group without
+// one, by display name
+func (s *Service) ListGroups(ctx context.Context, filter string) ([]*Group, error) {
+	f, err := parseFilter(filter, "id", "displayName", "externalId")
+	if err != nil {
+		return nil, err
+	}
+	groups, err := s.listGroups(ctx)
+	if err != nil {
+		return nil, err
+	}
+	matched := groups[:0]
+	for _, g := range groups {
+		if f.matches(map[string]string{"id": g.ID, "displayName": g.DisplayName, "externalId": g.ExternalID}) {
+			matched = append(matched, g)
+		}
+	}
+	return matched, nil
+}
+
+// ReplaceGroup replaces group id with g
+func (s *Service) ReplaceGroup(ctx context.Context, id string, g Group) (*Group, error) {
+	return s.updateGroup(ctx, id, func(current *Group) error {
+		g.ID, g.Meta = current.ID, current.Meta
+		*current = g
+		return nil
+	}, true)
+}
+
+// PatchGroup applies the PatchOp operations to group id
+func (s *Service) PatchGroup(ctx context.Context, id string, ops []Operation) (*Group, error) {
+	return s.updateGroup(ctx, id, func(g *Group) error {
+		for _, op := range ops {
+			if err := patchGroup(g, op); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, true)
+}
+
+// DeleteGroup deletes group id; its members lose the roles mapped to it
+func (s *Service) DeleteGroup(ctx context.Context, id string) error {
+	g, _, err := s.loadGroup(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := s.store.Delete(ctx, groupPrefix+id); err != nil {
+		return err
+	}
+	if err := s.store.Delete(ctx, groupNamePrefix+strings.ToLower(g.DisplayName)); err != nil {
+		return err
+	}
+	s.groupsChanged(ctx)
+	return nil
+}
+
+// updateUser applies fn to user id until it is stored unchanged by others,
+// then reconciles their roles
+func (s *Service) updateUser(ctx context.Context, id string, fn func(*User) error) (*User, error) {
+	for try := 0; try < maxUpdateTries; try++ {
+		current, old, err := s.loadUser(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		before := *current
+		if err := fn(current); err != nil {
+			return nil, err
+		}
+		if err := s.validateUser(ctx, current); err != nil {
+			return nil, err
+		}
+		current.ID, current.Meta.LastModified = id, s.now().UTC()
+		renamed := !strings.EqualFold(before.UserName, current.UserName)
+		if renamed {
+			if err := s.claim(ctx, userNamePrefix, current.UserName, id, "userName"); err != nil {
+				return nil, err
+			}
+		}
+		if err := s.put(ctx, userPrefix+id, old, current); errors.Is(err, ErrConflict) {
+			if renamed {
+				_ = s.store.Delete(ctx, userNamePrefix+strings.ToLower(current.UserName))
+			}
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if renamed {
+			_ = s.store.Delete(ctx, userNamePrefix+strings.ToLower(before.UserName))
+		}
+		if err := s.reconcileRoles(ctx, &before, current); err != nil {
+			return nil, err
+		}
+		if before.Active != current.Active || s.subject(&before) != s.subject(current) {
+			s.groupsChanged(ctx)
+		}
+		return s.withGroups(ctx, current)
+	}
+	return nil, ErrConflict
+}
+
+// updateGroup applies fn to group id until it is stored unchanged by
+// others, validating the result when validate is set
+func (s *Service) updateGroup(ctx context.Context, id string, fn func(*Group) error, validate bool) (*Group, error) {
+	for try := 0; try < maxUpdateTries; try++ {
+		current, old, err := s.loadGroup(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		before := current.DisplayName
+		if err := fn(current); err != nil {
+			return nil, err
+		}
+		if validate {
+			if err := s.validateGroup(ctx, current); err != nil {
+				return nil, err
+			}
+		}
+		current.ID, current.Meta.LastModified = id, s.now().UTC()
+		renamed := !strings.EqualFold(before, current.DisplayName)
+		if renamed {
+			if err := s.claim(ctx, groupNamePrefix, current.DisplayName, id, "displayName"); err != nil {
+				return nil, err
+			}
+		}
+		if err := s.put(ctx, groupPrefix+id, old, current); errors.Is(err, ErrConflict) {
+			if renamed {
+				_ = s.store.Delete(ctx, groupNamePrefix+strings.ToLower(current.DisplayName))
+			}
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if renamed {
+			_ = s.store.Delete(ctx, groupNamePrefix+strings.ToLower(before))
+		}
+		if validate {
+			s.groupsChanged(ctx)
+		}
+		return current, nil
+	}
+	return nil, ErrConflict
+}
+
+// reconcileRoles assigns the roles of after, when active, that provisioning
+// has not, and takes back those it gave before that after no longer has.
+// Either may be nil.
+func (s *Service) reconcileRoles(ctx context.Context, before, after *User) error {
+	want := map[string]bool{}
+	subject := ""
+	if after != nil {
+		subject = s.subject(after)
+		if after.Active {
+			ids, err := s.roleIDs(ctx, after.Roles)
+			if err != nil {
+				return err
+			}
+			for _, id := range ids {
+				want[id] = true
+			}
+		}
+	}
+	if before != nil && s.subject(before) != "" {
+		old := s.subject(before)
+		assignments, err := s.roles.Assignments(ctx, "")
+		if err != nil {
+			return err
+		}
+		for _, a := range assignments {
+			if a.UserID != old || a.AssignedBy != AssignedBy || (old == subject && want[a.RoleID]) {
+				continue
+			}
+			if err := s.roles.Unassign(ctx, a.UserID, a.RoleID); err != nil && !errors.Is(err, rbac.ErrNotFound) {
+				return err
+			}
+		}
+	}
+	for id := range want {
+		_, err := s.roles.Assign(ctx, rbac.Assignment{UserID: subject, RoleID: id, AssignedBy: AssignedBy})
+		if err != nil && !errors.Is(err, rbac.ErrExists) {
+			return err
+		}
+	}
+	return nil
+}
+
+// roleIDs resolves role names to IDs
+func (s *Service) roleIDs(ctx context.Context, values []MultiValue) ([]string, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	roles, err := s.roles.Roles(ctx)
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]string, len(roles))
+	for _, role := range roles {
+		byName[role.Name] = role.ID
+	}
+	ids := make([]string, 0, len(values))
+	for _, v := range values {
+		id, ok := byName[v.Value]
+		if !ok {
+			return nil, invalidValue("role %q does not exist", v.Value)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (s *Service) validateUser(ctx context.Context, u *User) error {
+	u.Schemas = []string{SchemaUser}
+	u.UserName = strings.TrimSpace(u.UserName)
+	u.ExternalID = strings.TrimSpace(u.ExternalID)
+	u.Groups = nil
+	switch {
+	case u.UserName == "" || len(u.UserName) > maxValueLength:
+		return invalidValue("userName must be 1 to %d characters", maxValueLength)
+	case len(u.ExternalID) > maxValueLength || len(u.DisplayName) > maxValueLength:
+		return invalidValue("values are at most %d characters", maxValueLength)
+	case len(u.Emails) > maxMultiValues || len(u.Roles) > maxMultiValues:
+		return invalidValue("at most %d emails and roles", maxMultiValues)
+	case s.config.Subject == SubjectExternalID && u.ExternalID == "":
+		return invalidValue("externalId is required")
+	}
+	_, err := s.roleIDs(ctx, u.Roles)
+	return err
+}
+
+func (s *Service) validateGroup(ctx context.Context, g *Group) error {
+	g.Schemas = []string{SchemaGroup}
+	g.DisplayName = strings.TrimSpace(g.DisplayName)
+	g.ExternalID = strings.TrimSpace(g.ExternalID)
+	switch {
+	case g.DisplayName == "" || len(g.DisplayName) > maxValueLength:
+		return invalidValue("displayName must be 1 to %d characters", maxValueLength)
+	case len(g.ExternalID) > maxValueLength:
+		return invalidValue("externalId is at most %d characters", maxValueLength)
+	case len(g.Members) > maxMembers:
+		return invalidValue("at most %d members", maxMembers)
+	}
+	seen := make(map[string]bool, len(g.Members))
+	members := g.Members[:0]
+	for _, m := range g.Members {
+		if seen[m.Value] {
+			continue
+		}
+		seen[m.Value] = true
+		if _, _, err := s.loadUser(ctx, m.Value); err != nil {
+			var scimErr *Error
+			if errors.As(err, &scimErr) {
+				return invalidValue("member %q is not a user", m.Value)
+			}
+			return err
+		}
+		members = append(members, MultiValue{Value: m.Value, Display: m.Display})
+	}
+	g.Members = members
+	return nil
+}
+
+// withGroups returns u listing the groups they are a member of
+func (s *Service) withGroups(ctx context.Context, u *User) (*User, error) {
+	groups, err := s.listGroups(ctx)
+	if err != nil {
+		return nil, err
+	}
+	u.Groups = nil
+	for _, g := range groups {
+		if hasMember(g, u.ID) {
+			u.Groups = append(u.Groups, MultiValue{Value: g.ID, Display: g.DisplayName})
+		}
+	}
+	return u, nil
+}
+
+func (s *Service) subject(u *User) string {
+	if s.config.Subject == SubjectExternalID {
+		return u.ExternalID
+	}
+	return u.UserName
+}
+
+func (s *Service) groupsChanged(ctx context.Context) {
+	for _, fn := range s.changed {
+		fn(ctx)
+	}
+}
+
+// claim reserves the case-insensitive value of attribute for id
+func (s *Service) claim(ctx context.Context, prefix, value, id, attribute string) error {
+	claimed, err := s.store.CompareAndSwap(ctx, prefix+strings.ToLower(value), nil, []byte(id), 0)
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		return &Error{Status: http.StatusConflict, ScimType: "uniqueness", Detail: fmt.Sprintf("%s %q is taken", attribute, value)}
+	}
+	return nil
+}
+
+// put stores v at key if it still holds old, or is absent when old is nil
+func (s *Service) put(ctx context.Context, key string, old []byte, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	swapped, err := s.store.CompareAndSwap(ctx, key, old, data, 0)
+	if err != nil {
+		return err
+	}
+	if !swapped {
+		return ErrConflict
+	}
+	return nil
+}
+
+func (s *Service) loadUser(ctx context.Context, id string) (*User, []byte, error) {
+	var u User
+	data, err := s.load(ctx, userPrefix+id, &u)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, nil, notFound("user", id)
+	}
+	return &u, data, err
+}
+
+func (s *Service) loadGroup(ctx context.Context, id string) (*Group, []byte, error) {
+	var g Group
+	data, err := s.load(ctx, groupPrefix+id, &g)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, nil, notFound("group", id)
+	}
+	return &g, data, err
+}
+
+func (s *Service) load(ctx context.Context, key string, v interface{}) ([]byte, error) {
+	data, err := s.store.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return data, json.Unmarshal(data, v)
+}
+
+func (s *Service) listUsers(ctx context.Context) ([]*User, error) {
+	keys, err := s.store.Keys(ctx, userPrefix)
+	if err != nil {
+		return nil, err
+	}
+	users := make([]*User, 0, len(keys))
+	for _, key := range keys {
+		u, _, err := s.loadUser(ctx, strings.TrimPrefix(key, userPrefix))
+		var scimErr *Error
+		if errors.As(err, &scimErr) {
+			// Deleted since listed
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].UserName < users[j].UserName })
+	return users, nil
+}
+
+func (s *Service) listGroups(ctx context.Context) ([]*Group, error) {
+	keys, err := s.store.Keys(ctx, groupPrefix)
+	if err != nil {
+		return nil, err
+	}
+	groups := make([]*Group, 0, len(keys))
+	for _, key := range keys {
+		g, _, err := s.loadGroup(ctx, strings.TrimPrefix(key, groupPrefix))
+		var scimErr *Error
+		if errors.As(err, &scimErr) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].DisplayName < groups[j].DisplayName })
+	return groups, nil
+}
+
+func hasMember(g *Group, id string) bool {
+	for _, m := range g.Members {
+		if m.Value == id {
+			return true
+		}
+	}
+	return false
+}
+
+func removeValue(values []MultiValue, value string) []MultiValue {
+	kept := values[:0]
+	for _, v := range values {
+		if v.Value != value {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
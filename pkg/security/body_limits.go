@@ -0,0 +1,185 @@
+package security
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lsendel/impl-zamaz/pkg/i18n"
+)
+
+// BodyLimitMiddleware enforces MaxRequestSize and MaxJSONDepth on request
+// bodies. A declared Content-Length over the limit is refused with 413
+// REQUEST_TOO_LARGE before anything is read. JSON bodies are read up to the
+// limit, so at most MaxRequestSize is held in memory, and refused with 413
+// when they go past it or 400 JSON_TOO_DEEP when their arrays and objects
+// nest deeper than MaxJSONDepth; handlers get the body read again. Since
+// handlers binding JSON parse bodies whatever their Content-Type, bodies
+// opening with an object or array count as JSON too. Other bodies are
+// streamed to the handler and stop with *http.MaxBytesError at the limit,
+// which is answered with 413 when the handler has not answered.
+func (v *InputValidator) BodyLimitMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit := v.config.MaxRequestSize
+		if c.Request.Body == nil || c.Request.Body == http.NoBody {
+			c.Next()
+			return
+		}
+		if limit > 0 && c.Request.ContentLength > limit {
+			v.rejectBody(c, http.StatusRequestEntityTooLarge, "body_too_large", "REQUEST_TOO_LARGE")
+			return
+		}
+
+		checkJSON := isJSON(c.ContentType())
+		if !checkJSON && v.config.MaxJSONDepth > 0 {
+			body, looksJSON, err := sniffJSON(c.Request.Body, limit)
+			if err != nil {
+				v.logger.Warn("Failed to read request body", "path", c.Request.URL.Path, "error", err)
+				v.rejectBody(c, http.StatusBadRequest, "body_unreadable", "REQ_001")
+				return
+			}
+			c.Request.Body, checkJSON = body, looksJSON
+		}
+
+		if checkJSON && (limit > 0 || v.config.MaxJSONDepth > 0) {
+			body := io.Reader(c.Request.Body)
+			if limit > 0 {
+				body = io.LimitReader(body, limit+1)
+			}
+			data, err := io.ReadAll(body)
+			c.Request.Body.Close()
+			if err != nil {
+				v.logger.Warn("Failed to read request body", "path", c.Request.URL.Path, "error", err)
+				v.rejectBody(c, http.StatusBadRequest, "body_unreadable", "REQ_001")
+				return
+			}
+			if limit > 0 && int64(len(data)) > limit {
+				v.rejectBody(c, http.StatusRequestEntityTooLarge, "body_too_large", "REQUEST_TOO_LARGE")
+				return
+			}
+			if v.config.MaxJSONDepth > 0 && jsonDepthExceeds(data, v.config.MaxJSONDepth) {
+				v.rejectBody(c, http.StatusBadRequest, "json_too_deep", "JSON_TOO_DEEP")
+				return
+			}
+			c.Request.Body = io.NopCloser(bytes.NewReader(data))
+			c.Request.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(data)), nil }
+			c.Next()
+			return
+		}
+
+		if limit <= 0 {
+			c.Next()
+			return
+		}
+		body := &limitedBody{ReadCloser: http.MaxBytesReader(c.Writer, c.Request.Body, limit)}
+		c.Request.Body = body
+		c.Next()
+		if body.exceeded {
+			v.logger.Warn("Request body exceeded the size limit", "path", c.Request.URL.Path, "limit", limit)
+			if v.metrics != nil {
+				v.metrics.IncrementCounter("request_body_rejections_total", map[string]string{"check": "body_too_large"})
+			}
+			if !c.Writer.Written() {
+				c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{
+					"error": i18n.Message(c, "REQUEST_TOO_LARGE"),
+					"code":  "REQUEST_TOO_LARGE",
+				})
+			}
+		}
+	}
+}
+
+func (v *InputValidator) rejectBody(c *gin.Context, status int, check, code string) {
+	v.logger.Warn("Request body rejected", "check", check, "path", c.Request.URL.Path, "ip", c.ClientIP())
+	if v.metrics != nil {
+		v.metrics.IncrementCounter("request_body_rejections_total", map[string]string{"check": check})
+	}
+	c.AbortWithStatusJSON(status, gin.H{
+		"error": i18n.Message(c, code),
+		"code":  code,
+	})
+}
+
+// limitedBody notes when the body it wraps went past its limit
+type limitedBody struct {
+	io.ReadCloser
+	exceeded bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		b.exceeded = true
+	}
+	return n, err
+}
+
+// isJSON reports whether contentType is JSON, e.g. application/json or
+// application/merge-patch+json
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = contentType
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// sniffJSON reports whether body, past any leading whitespace, opens a JSON
+// object or array, returning a body that reads again from the start. After
+// more than max bytes of whitespace, for a positive max, it gives up.
+func sniffJSON(body io.ReadCloser, max int64) (io.ReadCloser, bool, error) {
+	br := bufio.NewReader(body)
+	var space []byte
+	restored := func() io.ReadCloser {
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(space), br), body}
+	}
+	for max <= 0 || int64(len(space)) <= max {
+		b, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			space = append(space, b)
+			continue
+		}
+		_ = br.UnreadByte()
+		return restored(), b == '{' || b == '[', nil
+	}
+	return restored(), false, nil
+}
+
+// jsonDepthExceeds reports whether arrays and objects nest deeper than max
+// in data. Malformed JSON is left to the handler to reject.
+func jsonDepthExceeds(data []byte, max int) bool {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	depth := 0
+	for {
+		token, err := dec.Token()
+		if err != nil {
+			return false
+		}
+		switch token {
+		case json.Delim('{'), json.Delim('['):
+			if depth++; depth > max {
+				return true
+			}
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package security
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lsendel/impl-zamaz/pkg/i18n"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+// Login failures spread across accounts and addresses are tracked in the
+// shared store, so attacks rotating between replicas are seen as one.
+// Accounts are kept as username hashes.
+const (
+	bruteForceAccountsPrefix = "bruteforce:accounts:"
+	bruteForceIPsPrefix      = "bruteforce:ips:"
+	bruteForceBlockedPrefix  = "bruteforce:blocked:"
+)
+
+// Reasons an address is blocked
+const (
+	// BlockManyAccounts: failed logins to many accounts from the address,
+	// as in password spraying and credential stuffing
+	BlockManyAccounts = "many_accounts"
+	// BlockManyIPs: the address is one of many failing logins to the same
+	// account, as in distributed brute force
+	BlockManyIPs = "many_ips"
+)
+
+// bruteForceAttempts bounds optimistic retries when replicas record
+// failures concurrently
+const bruteForceAttempts = 5
+
+// BruteForceConfig configures distributed login failure detection
+type BruteForceConfig struct {
+	// MaxAccountsPerIP is the number of accounts failing logins from one
+	// address within Window that blocks it; 0 disables the check
+	MaxAccountsPerIP int
+	// MaxIPsPerAccount is the number of addresses failing logins to one
+	// account within Window that blocks them all; 0 disables the check
+	MaxIPsPerAccount int
+	// Window is how long failures are remembered after the last new
+	// account or address; defaults to 15m
+	Window time.Duration
+	// BlockTime is how long an address stays blocked; defaults to 1h
+	BlockTime time.Duration
+}
+
+// IPBlock describes a blocked address
+type IPBlock struct {
+	IP        string    `json:"ip"`
+	Reason    string    `json:"reason"`
+	BlockedAt time.Time `json:"blocked_at"`
+	Until     time.Time `json:"until"`
+	// Distinct is the number of accounts or addresses that triggered it
+	Distinct int `json:"distinct"`
+}
+
+// BruteForce detects login failures distributed across accounts or
+// addresses, which per-account lockout misses, and temporarily blocks the
+// addresses involved
+type BruteForce struct {
+	config  BruteForceConfig
+	store   store.Store
+	logger  interfaces.Logger
+	metrics interfaces.MetricsCollector
+	now     func() time.Time
+}
+
+// NewBruteForce creates distributed login failure detection on s
+func NewBruteForce(cfg BruteForceConfig, s store.Store, logger interfaces.Logger, metrics interfaces.MetricsCollector) *BruteForce {
+	if cfg.Window <= 0 {
+		cfg.Window = 15 * time.Minute
+	}
+	if cfg.BlockTime <= 0 {
+		cfg.BlockTime = time.Hour
+	}
+	return &BruteForce{config: cfg, store: s, logger: logger, metrics: metrics, now: time.Now}
+}
+
+// Blocked returns the block on ip, or nil when it may log in
+func (b *BruteForce) Blocked(ctx context.Context, ip string) (*IPBlock, error) {
+	data, err := b.store.Get(ctx, bruteForceBlockedPrefix+ip)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var block IPBlock
+	if err := json.Unmarshal(data, &block); err != nil {
+		return nil, err
+	}
+	if !b.now().Before(block.Until) {
+		return nil, nil
+	}
+	return &block, nil
+}
+
+// Failure records a failed login to username from ip and returns the
+// blocks it caused
+func (b *BruteForce) Failure(ctx context.Context, ip, username string) ([]IPBlock, error) {
+	if net.ParseIP(ip) == nil {
+		return nil, nil
+	}
+	account := accountKey(username)
+	var blocks []IPBlock
+	if b.config.MaxAccountsPerIP > 0 {
+		accounts, err := b.observe(ctx, bruteForceAccountsPrefix+ip, account, b.config.MaxAccountsPerIP)
+		if err != nil {
+			return nil, err
+		}
+		if len(accounts) >= b.config.MaxAccountsPerIP {
+			block, err := b.block(ctx, ip, BlockManyAccounts, len(accounts))
+			if err != nil {
+				return nil, err
+			}
+			if block != nil {
+				blocks = append(blocks, *block)
+			}
+		}
+	}
+	if b.config.MaxIPsPerAccount > 0 {
+		ips, err := b.observe(ctx, bruteForceIPsPrefix+account, ip, b.config.MaxIPsPerAccount)
+		if err != nil {
+			return nil, err
+		}
+		if len(ips) >= b.config.MaxIPsPerAccount {
+			for _, addr := range ips {
+				block, err := b.block(ctx, addr, BlockManyIPs, len(ips))
+				if err != nil {
+					return nil, err
+				}
+				if block != nil {
+					blocks = append(blocks, *block)
+				}
+			}
+		}
+	}
+	return blocks, nil
+}
+
+// Unblock lifts the block on ip and forgets its failures. It reports
+// whether the address was blocked.
+func (b *BruteForce) Unblock(ctx context.Context, ip string) (bool, error) {
+	block, err := b.Blocked(ctx, ip)
+	if err != nil {
+		return false, err
+	}
+	if err := b.store.Delete(ctx, bruteForceBlockedPrefix+ip); err != nil {
+		return false, err
+	}
+	if err := b.store.Delete(ctx, bruteForceAccountsPrefix+ip); err != nil {
+		return false, err
+	}
+	return block != nil, nil
+}
+
+// List returns the blocked addresses, soonest to unblock first
+func (b *BruteForce) List(ctx context.Context) ([]IPBlock, error) {
+	keys, err := b.store.Keys(ctx, bruteForceBlockedPrefix)
+	if err != nil {
+		return nil, err
+	}
+	now := b.now()
+	blocks := make([]IPBlock, 0, len(keys))
+	for _, key := range keys {
+		data, err := b.store.Get(ctx, key)
+		if errors.Is(err, store.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var block IPBlock
+		if err := json.Unmarshal(data, &block); err != nil || !now.Before(block.Until) {
+			continue
+		}
+		blocks = append(blocks, block)
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].Until.Before(blocks[j].Until) })
+	return blocks, nil
+}
+
+// Middleware rejects requests from blocked addresses with 429. It guards
+// the login routes; a failing store lets requests through, since per-account
+// lockout still applies.
+func (b *BruteForce) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		block, err := b.Blocked(c.Request.Context(), c.ClientIP())
+		if err != nil {
+			b.logger.Warn("Failed to check IP block", "ip", c.ClientIP(), "error", err)
+		}
+		if block == nil {
+			c.Next()
+			return
+		}
+		b.count("ip_blocks_rejected_total", block.Reason)
+		c.Header("Retry-After", strconv.Itoa(int(block.Until.Sub(b.now()).Seconds())+1))
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+			"error": i18n.Message(c, "IP_BLOCKED"),
+			"code":  "IP_BLOCKED",
+		})
+	}
+}
+
+// RegisterRoutes mounts the admin controls:
+//
+//	GET    /ip-blocks
+//	DELETE /ip-blocks/:ip
+func (b *BruteForce) RegisterRoutes(rg gin.IRoutes) {
+	rg.GET("/ip-blocks", b.handleList)
+	rg.DELETE("/ip-blocks/:ip", b.handleUnblock)
+}
+
+func (b *BruteForce) handleList(c *gin.Context) {
+	blocks, err := b.List(c.Request.Context())
+	if err != nil {
+		b.writeError(c, "Failed to list IP blocks", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ip_blocks": blocks})
+}
+
+func (b *BruteForce) handleUnblock(c *gin.Context) {
+	ip := c.Param("ip")
+	unblocked, err := b.Unblock(c.Request.Context(), ip)
+	if err != nil {
+		b.writeError(c, "Failed to unblock IP", err)
+		return
+	}
+	if unblocked {
+		b.logger.Warn("IP unblocked manually", "ip", ip, "actor", actor(c))
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// observe adds member to the set at key, keeping the limit most recent
+// members, and returns the set
+func (b *BruteForce) observe(ctx context.Context, key, member string, limit int) ([]string, error) {
+	for attempt := 0; attempt < bruteForceAttempts; attempt++ {
+		var members []string
+		old, err := b.store.Get(ctx, key)
+		if errors.Is(err, store.ErrNotFound) {
+			old = nil
+		} else if err != nil {
+			return nil, err
+		} else if err := json.Unmarshal(old, &members); err != nil {
+			return nil, err
+		}
+		for _, m := range members {
+			if m == member {
+				return members, nil
+			}
+		}
+		members = append(members, member)
+		if len(members) > limit {
+			members = members[len(members)-limit:]
+		}
+		data, err := json.Marshal(members)
+		if err != nil {
+			return nil, err
+		}
+		swapped, err := b.store.CompareAndSwap(ctx, key, old, data, b.config.Window)
+		if err != nil {
+			return nil, err
+		}
+		if swapped {
+			return members, nil
+		}
+	}
+	return nil, fmt.Errorf("login failures at %q are being recorded concurrently", key)
+}
+
+// block blocks ip unless it already is, returning the new block
+func (b *BruteForce) block(ctx context.Context, ip, reason string, distinct int) (*IPBlock, error) {
+	now := b.now().UTC()
+	block := IPBlock{
+		IP:        ip,
+		Reason:    reason,
+		BlockedAt: now,
+		Until:     now.Add(b.config.BlockTime),
+		Distinct:  distinct,
+	}
+	data, err := json.Marshal(block)
+	if err != nil {
+		return nil, err
+	}
+	blocked, err := b.store.CompareAndSwap(ctx, bruteForceBlockedPrefix+ip, nil, data, b.config.BlockTime)
+	if err != nil || !blocked {
+		return nil, err
+	}
+	b.count("ip_blocks_total", reason)
+	b.logger.Warn("IP blocked after distributed login failures", "ip", ip, "reason", reason, "distinct", distinct, "until", block.Until)
+	return &block, nil
+}
+
+func (b *BruteForce) writeError(c *gin.Context, msg string, err error) {
+	b.logger.Error(msg, "error", err)
+	c.JSON(http.StatusServiceUnavailable, gin.H{
+		"error": i18n.Message(c, "INTERNAL_ERROR"),
+		"code":  "INTERNAL_ERROR",
+	})
+}
+
+func (b *BruteForce) count(name, reason string) {
+	if b.metrics != nil {
+		b.metrics.IncrementCounter(name, map[string]string{"reason": reason})
+	}
+}
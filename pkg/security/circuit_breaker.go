@@ -0,0 +1,564 @@
+package security
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lsendel/impl-zamaz/pkg/i18n"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+// Circuit breaker states
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// breakerPrefix namespaces breaker state in the shared store
+const breakerPrefix = "circuitbreaker:"
+
+// breakerAttempts bounds optimistic retries when replicas update a breaker
+const breakerAttempts = 5
+
+var (
+	// ErrCircuitOpen is returned when a breaker rejects a call
+	ErrCircuitOpen = errors.New("circuit breaker is open")
+	// ErrUnknownBreaker is returned for a breaker that was never configured
+	ErrUnknownBreaker = errors.New("unknown circuit breaker")
+	// ErrBreakerContention is returned when a breaker could not be updated
+	// because other requests kept changing it
+	ErrBreakerContention = errors.New("circuit breaker state contended")
+)
+
+// BreakerConfig holds the thresholds of one dependency's breaker
+type BreakerConfig struct {
+	// FailureRatio of calls in Window that opens the breaker
+	FailureRatio float64
+	// MinRequests in Window before FailureRatio is evaluated
+	MinRequests int
+	Window      time.Duration
+	// OpenTimeout is how long the breaker stays open before probing
+	OpenTimeout time.Duration
+	// HalfOpenProbes is the number of calls let through while half-open;
+	// the breaker closes when all of them succeed
+	HalfOpenProbes int
+}
+
+// DefaultBreakerConfig is used for dependencies without their own thresholds
+var DefaultBreakerConfig = BreakerConfig{
+	FailureRatio:   0.5,
+	MinRequests:    10,
+	Window:         time.Minute,
+	OpenTimeout:    30 * time.Second,
+	HalfOpenProbes: 3,
+}
+
+// breakerState is the shared state of one breaker
+type breakerState struct {
+	State          string    `json:"state"`
+	Forced         bool      `json:"forced,omitempty"`
+	Reason         string    `json:"reason,omitempty"`
+	ChangedBy      string    `json:"changed_by,omitempty"`
+	OpenedAt       time.Time `json:"opened_at,omitempty"`
+	WindowStart    time.Time `json:"window_start"`
+	Requests       int       `json:"requests"`
+	Failures       int       `json:"failures"`
+	Probes         int       `json:"probes,omitempty"`
+	ProbeSuccesses int       `json:"probe_successes,omitempty"`
+}
+
+// BreakerStats is the view of one breaker returned by GetAllStats
+type BreakerStats struct {
+	Name           string    `json:"name"`
+	State          string    `json:"state"`
+	Forced         bool      `json:"forced"`
+	Reason         string    `json:"reason,omitempty"`
+	ChangedBy      string    `json:"changed_by,omitempty"`
+	OpenedAt       time.Time `json:"opened_at,omitempty"`
+	Requests       int       `json:"requests"`
+	Failures       int       `json:"failures"`
+	FailureRatio   float64   `json:"failure_ratio"`
+	MinRequests    int       `json:"min_requests"`
+	Window         string    `json:"window"`
+	OpenTimeout    string    `json:"open_timeout"`
+	HalfOpenProbes int       `json:"half_open_probes"`
+}
+
+// CircuitBreakerManager keeps one breaker per dependency. Breaker state lives
+// in the shared store so every replica opens and closes together.
+type CircuitBreakerManager struct {
+	store   store.Store
+	logger  interfaces.Logger
+	metrics interfaces.MetricsCollector
+	now     func() time.Time
+
+	mu      sync.RWMutex
+	configs map[string]BreakerConfig
+	// listeners are told of state changes stored by this replica
+	listeners []func(name, from, to string)
+}
+
+// NewCircuitBreakerManager creates a manager without breakers; metrics may be nil
+func NewCircuitBreakerManager(s store.Store, logger interfaces.Logger, metrics interfaces.MetricsCollector) *CircuitBreakerManager {
+	return &CircuitBreakerManager{
+		store:   s,
+		logger:  logger,
+		metrics: metrics,
+		now:     time.Now,
+		configs: make(map[string]BreakerConfig),
+	}
+}
+
+// Configure sets the thresholds of the named breaker; zero fields fall back
+// to DefaultBreakerConfig
+func (m *CircuitBreakerManager) Configure(name string, cfg BreakerConfig) error {
+	if name == "" {
+		return errors.New("circuit breaker needs a name")
+	}
+	if cfg.FailureRatio < 0 || cfg.FailureRatio > 1 {
+		return fmt.Errorf("circuit breaker %q failure ratio must be between 0 and 1", name)
+	}
+	if cfg.FailureRatio == 0 {
+		cfg.FailureRatio = DefaultBreakerConfig.FailureRatio
+	}
+	if cfg.MinRequests <= 0 {
+		cfg.MinRequests = DefaultBreakerConfig.MinRequests
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = DefaultBreakerConfig.Window
+	}
+	if cfg.OpenTimeout <= 0 {
+		cfg.OpenTimeout = DefaultBreakerConfig.OpenTimeout
+	}
+	if cfg.HalfOpenProbes <= 0 {
+		cfg.HalfOpenProbes = DefaultBreakerConfig.HalfOpenProbes
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.configs[name] = cfg
+	return nil
+}
+
+// OnStateChange calls fn after this replica changes the state of a breaker,
+// including from open to half-open when probing starts. fn must not block.
+func (m *CircuitBreakerManager) OnStateChange(fn func(name, from, to string)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.listeners = append(m.listeners, fn)
+}
+
+// Config returns the thresholds of the named breaker
+func (m *CircuitBreakerManager) Config(name string) (BreakerConfig, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	cfg, ok := m.configs[name]
+	return cfg, ok
+}
+
+// Execute runs fn through the named breaker, returning ErrCircuitOpen
+// without calling fn when the breaker rejects it. Unconfigured breakers use
+// DefaultBreakerConfig.
+func (m *CircuitBreakerManager) Execute(ctx context.Context, name string, fn func(ctx context.Context) error) error {
+	if _, ok := m.Config(name); !ok {
+		if err := m.Configure(name, DefaultBreakerConfig); err != nil {
+			return err
+		}
+	}
+	done, err := m.Allow(ctx, name)
+	if err != nil {
+		return err
+	}
+	err = fn(ctx)
+	done(err)
+	return err
+}
+
+// Allow reserves a call through the named breaker. The caller must report
+// the outcome of the call through done.
+func (m *CircuitBreakerManager) Allow(ctx context.Context, name string) (func(error), error) {
+	cfg, ok := m.Config(name)
+	if !ok {
+		return nil, ErrUnknownBreaker
+	}
+
+	var probe, allowed bool
+	err := m.update(ctx, name, cfg, func(st *breakerState) bool {
+		now := m.now()
+		probe, allowed = false, true
+		switch st.State {
+		case BreakerOpen:
+			if st.Forced || now.Sub(st.OpenedAt) < cfg.OpenTimeout {
+				allowed = false
+				return false
+			}
+			st.State = BreakerHalfOpen
+			st.Probes, st.ProbeSuccesses = 0, 0
+			fallthrough
+		case BreakerHalfOpen:
+			if st.Probes >= cfg.HalfOpenProbes {
+				allowed = false
+				return false
+			}
+			st.Probes++
+			probe = true
+			return true
+		default:
+			return false
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !allowed {
+		m.count(name, "rejected")
+		return nil, ErrCircuitOpen
+	}
+
+	return func(callErr error) {
+		err := m.update(context.WithoutCancel(ctx), name, cfg, func(st *breakerState) bool {
+			return m.record(name, cfg, st, probe, callErr == nil)
+		})
+		if err != nil {
+			m.logger.Error("Failed to record circuit breaker outcome", "breaker", name, "error", err)
+		}
+	}, nil
+}
+
+// record applies one call outcome to st and reports whether it changed
+func (m *CircuitBreakerManager) record(name string, cfg BreakerConfig, st *breakerState, probe, success bool) bool {
+	now := m.now()
+	if st.Forced {
+		return false
+	}
+	if probe {
+		if st.State != BreakerHalfOpen {
+			return false
+		}
+		if !success {
+			m.transition(name, st, BreakerOpen, "half-open probe failed", "")
+			return true
+		}
+		st.ProbeSuccesses++
+		if st.ProbeSuccesses >= cfg.HalfOpenProbes {
+			m.transition(name, st, BreakerClosed, "half-open probes succeeded", "")
+		}
+		return true
+	}
+	if st.State != BreakerClosed {
+		return false
+	}
+
+	if now.Sub(st.WindowStart) >= cfg.Window {
+		st.WindowStart, st.Requests, st.Failures = now, 0, 0
+	}
+	st.Requests++
+	if !success {
+		st.Failures++
+	}
+	if st.Requests >= cfg.MinRequests && float64(st.Failures)/float64(st.Requests) >= cfg.FailureRatio {
+		m.transition(name, st, BreakerOpen, "failure ratio exceeded", "")
+	}
+	return true
+}
+
+// Trip forces the named breaker open until Reset, e.g. during an incident
+func (m *CircuitBreakerManager) Trip(ctx context.Context, name, reason, actor string) error {
+	cfg, ok := m.Config(name)
+	if !ok {
+		return ErrUnknownBreaker
+	}
+	return m.update(ctx, name, cfg, func(st *breakerState) bool {
+		m.transition(name, st, BreakerOpen, reason, actor)
+		st.Forced = true
+		return true
+	})
+}
+
+// Reset closes the named breaker and clears its counters, including after
+// a manual Trip
+func (m *CircuitBreakerManager) Reset(ctx context.Context, name, actor string) error {
+	cfg, ok := m.Config(name)
+	if !ok {
+		return ErrUnknownBreaker
+	}
+	return m.update(ctx, name, cfg, func(st *breakerState) bool {
+		m.transition(name, st, BreakerClosed, "manual reset", actor)
+		return true
+	})
+}
+
+// GetAllStats returns every configured breaker sorted by name
+func (m *CircuitBreakerManager) GetAllStats(ctx context.Context) []BreakerStats {
+	m.mu.RLock()
+	names := make([]string, 0, len(m.configs))
+	for name := range m.configs {
+		names = append(names, name)
+	}
+	m.mu.RUnlock()
+	sort.Strings(names)
+
+	stats := make([]BreakerStats, 0, len(names))
+	for _, name := range names {
+		cfg, _ := m.Config(name)
+		st, _, err := m.load(ctx, name)
+		if err != nil {
+			m.logger.Warn("Failed to read circuit breaker state", "breaker", name, "error", err)
+		}
+		stats = append(stats, BreakerStats{
+			Name:           name,
+			State:          st.State,
+			Forced:         st.Forced,
+			Reason:         st.Reason,
+			ChangedBy:      st.ChangedBy,
+			OpenedAt:       st.OpenedAt,
+			Requests:       st.Requests,
+			Failures:       st.Failures,
+			FailureRatio:   cfg.FailureRatio,
+			MinRequests:    cfg.MinRequests,
+			Window:         cfg.Window.String(),
+			OpenTimeout:    cfg.OpenTimeout.String(),
+			HalfOpenProbes: cfg.HalfOpenProbes,
+		})
+	}
+	return stats
+}
+
+// HealthCheck summarises the breakers: healthy is false while any is open
+func (m *CircuitBreakerManager) HealthCheck(ctx context.Context) gin.H {
+	open := []string{}
+	stats := m.GetAllStats(ctx)
+	for _, st := range stats {
+		if st.State != BreakerClosed {
+			open = append(open, st.Name)
+		}
+	}
+	return gin.H{
+		"healthy": len(open) == 0,
+		"total":   len(stats),
+		"open":    open,
+	}
+}
+
+// RegisterRoutes mounts the manual controls:
+//
+//	POST /circuit-breakers/:name/trip   {"reason": "..."}
+//	POST /circuit-breakers/:name/reset
+func (m *CircuitBreakerManager) RegisterRoutes(r gin.IRoutes) {
+	r.POST("/circuit-breakers/:name/trip", m.handleTrip)
+	r.POST("/circuit-breakers/:name/reset", m.handleReset)
+}
+
+func (m *CircuitBreakerManager) handleTrip(c *gin.Context) {
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": i18n.Message(c, "VALIDATION_ERROR"),
+				"code":  "VALIDATION_ERROR",
+			})
+			return
+		}
+	}
+	if req.Reason == "" {
+		req.Reason = "manual trip"
+	}
+	name := c.Param("name")
+	if err := m.Trip(c.Request.Context(), name, req.Reason, actor(c)); err != nil {
+		m.writeError(c, err)
+		return
+	}
+	m.logger.Warn("Circuit breaker tripped manually", "breaker", name, "reason", req.Reason, "actor", actor(c))
+	m.writeBreaker(c, name)
+}
+
+func (m *CircuitBreakerManager) handleReset(c *gin.Context) {
+	name := c.Param("name")
+	if err := m.Reset(c.Request.Context(), name, actor(c)); err != nil {
+		m.writeError(c, err)
+		return
+	}
+	m.logger.Info("Circuit breaker reset manually", "breaker", name, "actor", actor(c))
+	m.writeBreaker(c, name)
+}
+
+func (m *CircuitBreakerManager) writeBreaker(c *gin.Context, name string) {
+	for _, st := range m.GetAllStats(c.Request.Context()) {
+		if st.Name == name {
+			c.JSON(http.StatusOK, st)
+			return
+		}
+	}
+	m.writeError(c, ErrUnknownBreaker)
+}
+
+func (m *CircuitBreakerManager) writeError(c *gin.Context, err error) {
+	status, code := http.StatusInternalServerError, "INTERNAL_ERROR"
+	switch {
+	case errors.Is(err, ErrUnknownBreaker):
+		status, code = http.StatusNotFound, "RESOURCE_NOT_FOUND"
+	case errors.Is(err, ErrBreakerContention):
+		status, code = http.StatusConflict, "RESOURCE_CONFLICT"
+	default:
+		m.logger.Error("Circuit breaker update failed", "breaker", c.Param("name"), "error", err)
+	}
+	c.JSON(status, gin.H{"error": i18n.Message(c, code), "code": code})
+}
+
+func actor(c *gin.Context) string {
+	if user, ok := c.Get("user"); ok {
+		if info, ok := user.(*interfaces.UserInfo); ok {
+			return info.ID
+		}
+	}
+	return ""
+}
+
+func (m *CircuitBreakerManager) transition(name string, st *breakerState, state, reason, actor string) {
+	from := st.State
+	now := m.now()
+	*st = breakerState{State: state, Reason: reason, ChangedBy: actor, WindowStart: now}
+	if state == BreakerOpen {
+		st.OpenedAt = now
+	}
+	if from != state {
+		m.logger.Info("Circuit breaker state changed", "breaker", name, "from", from, "to", state, "reason", reason)
+		m.count(name, state)
+	}
+}
+
+func (m *CircuitBreakerManager) count(name, event string) {
+	if m.metrics != nil {
+		m.metrics.IncrementCounter("circuit_breaker_events_total", map[string]string{"breaker": name, "event": event})
+	}
+}
+
+// load returns the stored state of the named breaker, a closed breaker
+// when there is none, and the raw value for CompareAndSwap
+func (m *CircuitBreakerManager) load(ctx context.Context, name string) (breakerState, []byte, error) {
+	st := breakerState{State: BreakerClosed, WindowStart: m.now()}
+	raw, err := m.store.Get(ctx, breakerPrefix+name)
+	if errors.Is(err, store.ErrNotFound) {
+		return st, nil, nil
+	}
+	if err != nil {
+		return st, nil, err
+	}
+	if err := json.Unmarshal(raw, &st); err != nil {
+		m.logger.Warn("Discarding corrupt circuit breaker state", "breaker", name, "error", err)
+		st = breakerState{State: BreakerClosed, WindowStart: m.now()}
+	}
+	return st, raw, nil
+}
+
+// update applies fn to the named breaker with compare-and-swap retries; fn
+// reports whether it changed the state
+func (m *CircuitBreakerManager) update(ctx context.Context, name string, cfg BreakerConfig, fn func(*breakerState) bool) error {
+	for i := 0; i < breakerAttempts; i++ {
+		st, raw, err := m.load(ctx, name)
+		if err != nil {
+			return err
+		}
+		from := st.State
+		if !fn(&st) {
+			return nil
+		}
+		next, err := json.Marshal(st)
+		if err != nil {
+			return err
+		}
+		// A forced trip lasts until Reset; other state may expire once
+		// neither the window nor the open timeout needs it
+		var ttl time.Duration
+		if !st.Forced {
+			ttl = cfg.Window + cfg.OpenTimeout
+		}
+		swapped, err := m.store.CompareAndSwap(ctx, breakerPrefix+name, raw, next, ttl)
+		if err != nil {
+			return err
+		}
+		if swapped {
+			if st.State != from {
+				m.notify(name, from, st.State)
+			}
+			return nil
+		}
+	}
+	return ErrBreakerContention
+}
+
+// notify tells the listeners of a stored state change
+func (m *CircuitBreakerManager) notify(name, from, to string) {
+	m.mu.RLock()
+	listeners := m.listeners
+	m.mu.RUnlock()
+	for _, fn := range listeners {
+		fn(name, from, to)
+	}
+}
+
+// BreakerFileConfig declares one breaker in a breakers file:
+//
+//	[
+//	  {"name": "keycloak", "failure_ratio": 0.5, "min_requests": 20, "window": "30s", "open_timeout": "15s", "half_open_probes": 2},
+//	  {"name": "upstream", "window": "1m"}
+//	]
+type BreakerFileConfig struct {
+	Name           string  `json:"name"`
+	FailureRatio   float64 `json:"failure_ratio"`
+	MinRequests    int     `json:"min_requests"`
+	Window         string  `json:"window"`
+	OpenTimeout    string  `json:"open_timeout"`
+	HalfOpenProbes int     `json:"half_open_probes"`
+}
+
+// LoadBreakers reads a JSON array of BreakerFileConfig from path and
+// configures a breaker for each entry
+func (m *CircuitBreakerManager) LoadBreakers(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var configs []BreakerFileConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return fmt.Errorf("invalid circuit breakers in %s: %w", path, err)
+	}
+	for _, fc := range configs {
+		cfg := BreakerConfig{FailureRatio: fc.FailureRatio, MinRequests: fc.MinRequests, HalfOpenProbes: fc.HalfOpenProbes}
+		if cfg.Window, err = parseDuration(fc.Name, fc.Window); err != nil {
+			return err
+		}
+		if cfg.OpenTimeout, err = parseDuration(fc.Name, fc.OpenTimeout); err != nil {
+			return err
+		}
+		if err := m.Configure(fc.Name, cfg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseDuration parses an optional duration from a breakers file
+func parseDuration(name, value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("circuit breaker %q has an invalid duration %q", name, value)
+	}
+	return d, nil
+}
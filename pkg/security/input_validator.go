@@ -0,0 +1,313 @@
+// Package security provides request validation and protection components
+package security
+
+import (
+	"html"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lsendel/impl-zamaz/pkg/i18n"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+)
+
+// ValidationConfig configures the input validator
+type ValidationConfig struct {
+	MaxRequestSize    int64
+	MaxHeaderSize     int
+	MaxQueryParams    int
+	MaxJSONDepth      int
+	EnableSQLCheck    bool
+	EnableXSSCheck    bool
+	EnablePathCheck   bool
+	EnableCMDCheck    bool
+	EnableLDAPCheck   bool
+	EnableXPathCheck  bool
+	AllowedFileTypes  []string
+	MaxFilenameLength int
+}
+
+// InputValidator inspects incoming requests for injection payloads
+type InputValidator struct {
+	config  *ValidationConfig
+	logger  interfaces.Logger
+	metrics interfaces.MetricsCollector
+}
+
+// NewInputValidator creates a new input validator
+func NewInputValidator(config *ValidationConfig, logger interfaces.Logger, metrics interfaces.MetricsCollector) *InputValidator {
+	return &InputValidator{
+		config:  config,
+		logger:  logger,
+		metrics: metrics,
+	}
+}
+
+// maxDecodePasses bounds repeated URL decoding of nested encodings
+const maxDecodePasses = 8
+
+var (
+	sqlPatterns = []*regexp.Regexp{
+		regexp.MustCompile(`\bunion\b[\s(]*(all\s+|distinct\s+)?[\s(]*select\b`),
+		regexp.MustCompile(`['"]\s*\)*\s*\b(or|and|xor)\b\s*\(*\s*['"]?[\w-]*['"]?\s*(=|<|>|like\b|is\b)`),
+		regexp.MustCompile(`\b(or|and)\b\s+\(*\s*(\d+)\s*=\s*(\d+)\b`),
+		regexp.MustCompile(`['"]\s*\)*\s*(--|#|/\*|;)`),
+		regexp.MustCompile(`;\s*(drop|delete|insert|update|alter|create|truncate|exec|execute|shutdown|declare)\b`),
+		regexp.MustCompile(`\b(sleep|benchmark|pg_sleep|extractvalue|updatexml|load_file)\s*\(`),
+		regexp.MustCompile(`\bwaitfor\s+delay\b`),
+		regexp.MustCompile(`\b(information_schema|xp_cmdshell|sysobjects|pg_catalog)\b`),
+	}
+
+	xssPatterns = []*regexp.Regexp{
+		regexp.MustCompile(`<\s*/?\s*script\b`),
+		regexp.MustCompile(`<[^>]*[\s/"'](on[a-z]+)\s*=`),
+		regexp.MustCompile(`<\s*(iframe|object|embed|applet|meta|base|frameset|svg|math)\b`),
+		regexp.MustCompile(`\bsrcdoc\s*=`),
+		regexp.MustCompile(`\bexpression\s*\(`),
+	}
+
+	// xssSchemePattern runs on input with tabs and newlines removed because
+	// browsers ignore them inside URL schemes
+	xssSchemePattern = regexp.MustCompile(`(javascript|vbscript|livescript)\s*:|data\s*:\s*text/html`)
+
+	pathPatterns = []*regexp.Regexp{
+		regexp.MustCompile(`(^|/)\.\.(/|$)`),
+		regexp.MustCompile(`^/(etc|proc|sys|root|var/log)/`),
+		regexp.MustCompile(`^[a-z]:/(windows|boot\.ini|inetpub)`),
+	}
+
+	cmdPatterns = []*regexp.Regexp{
+		regexp.MustCompile("[;&|`]\\s*(cat|ls|rm|wget|curl|nc|ncat|bash|sh|zsh|whoami|id|uname|ping|nslookup|powershell|cmd)\\b"),
+		regexp.MustCompile(`\$\(\s*[a-z]`),
+		regexp.MustCompile("`[^`]*`"),
+		regexp.MustCompile(`\$\{ifs\}`),
+	}
+
+	ldapPatterns = []*regexp.Regexp{
+		regexp.MustCompile(`\)\s*\(\s*[|&!]`),
+		regexp.MustCompile(`\*\s*\)\s*\(`),
+		regexp.MustCompile(`\(\s*[|&]\s*\(`),
+	}
+
+	xpathPatterns = []*regexp.Regexp{
+		regexp.MustCompile(`['"]\s*\b(or|and)\b\s*['"]?[\w-]*['"]?\s*=`),
+		regexp.MustCompile(`\b(count|name|string-length|substring)\s*\(\s*/`),
+		regexp.MustCompile(`//\*|/\*\[`),
+	}
+
+	sqlCommentPattern = regexp.MustCompile(`/\*.*?\*/`)
+)
+
+// Normalize canonicalizes input before pattern matching: nested form/URL
+// encodings and HTML entities are decoded, overlong UTF-8 dot/slash
+// sequences are folded, backslashes become slashes, NUL bytes are dropped,
+// inline SQL comments become whitespace and ASCII letters are lower-cased
+func Normalize(input string) string {
+	return canonicalize(decodeLayers(input))
+}
+
+// decodeLayers strips nested URL encodings and HTML entities
+func decodeLayers(input string) string {
+	s := input
+	for i := 0; i < maxDecodePasses; i++ {
+		decoded := percentDecode(s)
+		if decoded == s {
+			break
+		}
+		s = decoded
+	}
+	return html.UnescapeString(s)
+}
+
+// percentDecode applies form decoding ('+' is a space) to valid %XX escapes
+// and leaves malformed ones intact; url.QueryUnescape rejects the whole
+// string on a single stray '%', which would let attackers skip decoding
+func percentDecode(s string) string {
+	if !strings.ContainsAny(s, "%+") {
+		return s
+	}
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]) {
+			b.WriteByte(unhex(s[i+1])<<4 | unhex(s[i+2]))
+			i += 2
+			continue
+		}
+		if s[i] == '+' {
+			b.WriteByte(' ')
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func isHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
+
+func canonicalize(s string) string {
+	s = strings.NewReplacer(
+		"\xc0\xae", ".",
+		"\xc0\xaf", "/",
+		"\xc1\x9c", "/",
+		"\\", "/",
+		"\x00", "",
+	).Replace(s)
+	s = sqlCommentPattern.ReplaceAllString(s, " ")
+
+	return asciiLower(s)
+}
+
+// asciiLower lower-cases ASCII letters only so multi-byte sequences are
+// never rewritten into ASCII that would change what the patterns see
+func asciiLower(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if c >= 'A' && c <= 'Z' {
+			b[i] = c + ('a' - 'A')
+		}
+	}
+	return string(b)
+}
+
+func matchAny(patterns []*regexp.Regexp, s string) bool {
+	for _, p := range patterns {
+		if p.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// DetectSQLInjection reports whether input looks like a SQL injection payload
+func DetectSQLInjection(input string) bool {
+	return matchAny(sqlPatterns, Normalize(input))
+}
+
+// DetectXSS reports whether input looks like a cross-site scripting payload
+func DetectXSS(input string) bool {
+	n := Normalize(input)
+	if matchAny(xssPatterns, n) {
+		return true
+	}
+	compact := strings.NewReplacer("\t", "", "\n", "", "\r", "").Replace(n)
+	return xssSchemePattern.MatchString(compact)
+}
+
+// DetectPathTraversal reports whether input tries to escape a base path
+func DetectPathTraversal(input string) bool {
+	decoded := decodeLayers(input)
+	if strings.Contains(decoded, "\x00") {
+		return true
+	}
+	return matchAny(pathPatterns, canonicalize(decoded))
+}
+
+// DetectCommandInjection reports whether input looks like a shell injection payload
+func DetectCommandInjection(input string) bool {
+	return matchAny(cmdPatterns, Normalize(input))
+}
+
+// DetectLDAPInjection reports whether input looks like an LDAP filter injection
+func DetectLDAPInjection(input string) bool {
+	return matchAny(ldapPatterns, Normalize(input))
+}
+
+// DetectXPathInjection reports whether input looks like an XPath injection
+func DetectXPathInjection(input string) bool {
+	return matchAny(xpathPatterns, Normalize(input))
+}
+
+// Validate runs all enabled checks and returns the name of the first one
+// that matched, or an empty string when the input is clean
+func (v *InputValidator) Validate(input string) string {
+	switch {
+	case v.config.EnableSQLCheck && DetectSQLInjection(input):
+		return "sql_injection"
+	case v.config.EnableXSSCheck && DetectXSS(input):
+		return "xss"
+	case v.config.EnablePathCheck && DetectPathTraversal(input):
+		return "path_traversal"
+	case v.config.EnableCMDCheck && DetectCommandInjection(input):
+		return "command_injection"
+	case v.config.EnableLDAPCheck && DetectLDAPInjection(input):
+		return "ldap_injection"
+	case v.config.EnableXPathCheck && DetectXPathInjection(input):
+		return "xpath_injection"
+	}
+	return ""
+}
+
+// ValidateRequestMiddleware rejects requests whose path, query string or
+// headers exceed configured limits or contain injection payloads
+func (v *InputValidator) ValidateRequestMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		query := c.Request.URL.Query()
+		if v.config.MaxQueryParams > 0 && len(query) > v.config.MaxQueryParams {
+			v.reject(c, "too_many_query_params")
+			return
+		}
+
+		if v.config.MaxHeaderSize > 0 && headerSize(c.Request.Header) > v.config.MaxHeaderSize {
+			v.reject(c, "header_too_large")
+			return
+		}
+
+		if check := v.Validate(c.Request.URL.EscapedPath()); check != "" {
+			v.reject(c, check)
+			return
+		}
+
+		for key, values := range query {
+			if check := v.Validate(key); check != "" {
+				v.reject(c, check)
+				return
+			}
+			for _, value := range values {
+				if check := v.Validate(value); check != "" {
+					v.reject(c, check)
+					return
+				}
+			}
+		}
+
+		c.Next()
+	}
+}
+
+func (v *InputValidator) reject(c *gin.Context, check string) {
+	v.logger.Warn("Request rejected by input validation",
+		"check", check, "path", c.Request.URL.Path, "ip", c.ClientIP())
+	if v.metrics != nil {
+		v.metrics.IncrementCounter("input_validation_rejections_total", map[string]string{"check": check})
+	}
+	c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+		"error": i18n.Message(c, "INVALID_INPUT"),
+		"code":  "INVALID_INPUT",
+	})
+}
+
+func headerSize(h http.Header) int {
+	size := 0
+	for key, values := range h {
+		for _, value := range values {
+			size += len(key) + len(value)
+		}
+	}
+	return size
+}
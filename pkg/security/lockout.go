@@ -0,0 +1,257 @@
+package security
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lsendel/impl-zamaz/pkg/i18n"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+// Lockout state lives in the shared store so it survives restarts and is
+// enforced by every replica. Keys hold a hash of the username.
+const (
+	lockoutFailuresPrefix = "lockout:failures:"
+	lockoutLockedPrefix   = "lockout:locked:"
+)
+
+// maxLockedUsername bounds the username kept in a lock record
+const maxLockedUsername = 256
+
+// LockoutConfig configures account lockout
+type LockoutConfig struct {
+	// MaxAttempts is the number of failed logins that locks an account
+	MaxAttempts int
+	// LockoutTime is how long a locked account stays locked
+	LockoutTime time.Duration
+	// Window is how long failures are remembered; defaults to LockoutTime
+	Window time.Duration
+}
+
+// Lock describes a locked account
+type Lock struct {
+	Username string    `json:"username"`
+	LockedAt time.Time `json:"locked_at"`
+	Until    time.Time `json:"until"`
+	Failures int64     `json:"failures"`
+}
+
+// Lockout locks accounts after repeated failed logins. Unknown usernames
+// are counted and locked like real ones so the lock does not reveal which
+// accounts exist.
+type Lockout struct {
+	config  LockoutConfig
+	store   store.Store
+	logger  interfaces.Logger
+	metrics interfaces.MetricsCollector
+	now     func() time.Time
+}
+
+// NewLockout creates account lockout on s
+func NewLockout(cfg LockoutConfig, s store.Store, logger interfaces.Logger, metrics interfaces.MetricsCollector) *Lockout {
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 5
+	}
+	if cfg.LockoutTime <= 0 {
+		cfg.LockoutTime = 30 * time.Minute
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = cfg.LockoutTime
+	}
+	return &Lockout{config: cfg, store: s, logger: logger, metrics: metrics, now: time.Now}
+}
+
+// Status returns the lock on username, or nil when it may log in
+func (l *Lockout) Status(ctx context.Context, username string) (*Lock, error) {
+	data, err := l.store.Get(ctx, lockoutLockedPrefix+accountKey(username))
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var lock Lock
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return nil, err
+	}
+	if !l.now().Before(lock.Until) {
+		return nil, nil
+	}
+	return &lock, nil
+}
+
+// Failure records a failed login and returns the lock when this failure
+// locked the account
+func (l *Lockout) Failure(ctx context.Context, username string) (*Lock, error) {
+	key := accountKey(username)
+	failures, _, err := l.store.Incr(ctx, lockoutFailuresPrefix+key, l.config.Window)
+	if err != nil || failures < int64(l.config.MaxAttempts) {
+		return nil, err
+	}
+	now := l.now().UTC()
+	name := normalizeUsername(username)
+	if len(name) > maxLockedUsername {
+		name = name[:maxLockedUsername]
+	}
+	lock := Lock{
+		Username: name,
+		LockedAt: now,
+		Until:    now.Add(l.config.LockoutTime),
+		Failures: failures,
+	}
+	data, err := json.Marshal(lock)
+	if err != nil {
+		return nil, err
+	}
+	// Concurrent failures on other replicas may race to lock; only the
+	// first one sets the expiry
+	locked, err := l.store.CompareAndSwap(ctx, lockoutLockedPrefix+key, nil, data, l.config.LockoutTime)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.store.Delete(ctx, lockoutFailuresPrefix+key); err != nil {
+		l.logger.Warn("Failed to reset login failures", "error", err)
+	}
+	if !locked {
+		return l.Status(ctx, username)
+	}
+	l.count("account_lockouts_total")
+	l.logger.Warn("Account locked after failed logins", "username", lock.Username, "failures", failures, "until", lock.Until)
+	return &lock, nil
+}
+
+// Success forgets the failed logins of username
+func (l *Lockout) Success(ctx context.Context, username string) error {
+	return l.store.Delete(ctx, lockoutFailuresPrefix+accountKey(username))
+}
+
+// Unlock lifts the lock on username and forgets its failures. It reports
+// whether the account was locked.
+func (l *Lockout) Unlock(ctx context.Context, username string) (bool, error) {
+	lock, err := l.Status(ctx, username)
+	if err != nil {
+		return false, err
+	}
+	key := accountKey(username)
+	if err := l.store.Delete(ctx, lockoutLockedPrefix+key); err != nil {
+		return false, err
+	}
+	if err := l.store.Delete(ctx, lockoutFailuresPrefix+key); err != nil {
+		return false, err
+	}
+	if lock != nil {
+		l.count("account_unlocks_total")
+	}
+	return lock != nil, nil
+}
+
+// List returns the locked accounts, soonest to unlock first
+func (l *Lockout) List(ctx context.Context) ([]Lock, error) {
+	keys, err := l.store.Keys(ctx, lockoutLockedPrefix)
+	if err != nil {
+		return nil, err
+	}
+	now := l.now()
+	locks := make([]Lock, 0, len(keys))
+	for _, key := range keys {
+		data, err := l.store.Get(ctx, key)
+		if errors.Is(err, store.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var lock Lock
+		if err := json.Unmarshal(data, &lock); err != nil || !now.Before(lock.Until) {
+			continue
+		}
+		locks = append(locks, lock)
+	}
+	sort.Slice(locks, func(i, j int) bool { return locks[i].Until.Before(locks[j].Until) })
+	return locks, nil
+}
+
+// RegisterRoutes mounts the admin controls:
+//
+//	GET    /lockouts
+//	GET    /lockouts/:username
+//	DELETE /lockouts/:username
+func (l *Lockout) RegisterRoutes(rg gin.IRoutes) {
+	rg.GET("/lockouts", l.handleList)
+	rg.GET("/lockouts/:username", l.handleStatus)
+	rg.DELETE("/lockouts/:username", l.handleUnlock)
+}
+
+func (l *Lockout) handleList(c *gin.Context) {
+	locks, err := l.List(c.Request.Context())
+	if err != nil {
+		l.writeError(c, "Failed to list account lockouts", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"lockouts": locks})
+}
+
+func (l *Lockout) handleStatus(c *gin.Context) {
+	lock, err := l.Status(c.Request.Context(), c.Param("username"))
+	if err != nil {
+		l.writeError(c, "Failed to read account lockout", err)
+		return
+	}
+	if lock == nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": i18n.Message(c, "RESOURCE_NOT_FOUND"),
+			"code":  "RESOURCE_NOT_FOUND",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, lock)
+}
+
+func (l *Lockout) handleUnlock(c *gin.Context) {
+	username := c.Param("username")
+	unlocked, err := l.Unlock(c.Request.Context(), username)
+	if err != nil {
+		l.writeError(c, "Failed to unlock account", err)
+		return
+	}
+	if unlocked {
+		l.logger.Warn("Account unlocked manually", "username", normalizeUsername(username), "actor", actor(c))
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (l *Lockout) writeError(c *gin.Context, msg string, err error) {
+	l.logger.Error(msg, "error", err)
+	c.JSON(http.StatusServiceUnavailable, gin.H{
+		"error": i18n.Message(c, "INTERNAL_ERROR"),
+		"code":  "INTERNAL_ERROR",
+	})
+}
+
+func (l *Lockout) count(name string) {
+	if l.metrics != nil {
+		l.metrics.IncrementCounter(name, nil)
+	}
+}
+
+// normalizeUsername makes "Alice" and "alice " share one counter, matching
+// identity providers that compare usernames case-insensitively
+func normalizeUsername(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+// accountKey bounds the store key for any username an attacker submits
+func accountKey(username string) string {
+	sum := sha256.Sum256([]byte(normalizeUsername(username)))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,289 @@
+package security
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lsendel/impl-zamaz/pkg/auth"
+	"github.com/lsendel/impl-zamaz/pkg/i18n"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+// revokedPrefix namespaces revoked token IDs in the shared store; it is
+// replicated across regions by default
+const revokedPrefix = "revoked:"
+
+// maxJTILength bounds the token IDs accepted from requests
+const maxJTILength = 128
+
+// ErrInvalidJTI is returned for an empty or oversized token ID
+var ErrInvalidJTI = errors.New("invalid token id")
+
+// revocation is the stored record of one revoked token
+type revocation struct {
+	RevokedAt time.Time `json:"revoked_at"`
+	RevokedBy string    `json:"revoked_by,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+}
+
+// RevocationStore records revoked token IDs (jti) until the tokens would
+// have expired anyway, so the blacklist never outgrows the live tokens
+type RevocationStore struct {
+	store   store.Store
+	maxTTL  time.Duration
+	logger  interfaces.Logger
+	metrics interfaces.MetricsCollector
+	now     func() time.Time
+}
+
+// NewRevocationStore creates a revocation store on s. maxTTL is how long a
+// revocation is kept when the token's expiry is unknown; it should be at
+// least the longest token lifetime.
+func NewRevocationStore(s store.Store, maxTTL time.Duration, logger interfaces.Logger, metrics interfaces.MetricsCollector) *RevocationStore {
+	return &RevocationStore{store: s, maxTTL: maxTTL, logger: logger, metrics: metrics, now: time.Now}
+}
+
+// Revoke blacklists jti until expiresAt; a zero expiresAt keeps it for
+// maxTTL. Revoking an already expired token is a no-op.
+func (r *RevocationStore) Revoke(ctx context.Context, jti string, expiresAt time.Time, actor, reason string) error {
+	_, err := r.revoke(ctx, jti, expiresAt, actor, reason, false)
+	return err
+}
+
+// RevokeToken blacklists the jti of a raw token until its exp claim. It does
+// not verify the token; revoking a forged one only blocks an ID nobody holds.
+func (r *RevocationStore) RevokeToken(ctx context.Context, raw, actor, reason string) error {
+	jti, expiresAt, err := tokenID(raw)
+	if err != nil {
+		return err
+	}
+	return r.Revoke(ctx, jti, expiresAt, actor, reason)
+}
+
+// ConsumeToken revokes a single-use token and reports whether this call did
+// so; it returns false when the token was already revoked, including by a
+// concurrent request on another replica. The token must have been verified.
+func (r *RevocationStore) ConsumeToken(ctx context.Context, raw, actor, reason string) (bool, error) {
+	jti, expiresAt, err := tokenID(raw)
+	if err != nil {
+		return false, err
+	}
+	return r.revoke(ctx, jti, expiresAt, actor, reason, true)
+}
+
+func (r *RevocationStore) revoke(ctx context.Context, jti string, expiresAt time.Time, actor, reason string, once bool) (bool, error) {
+	if jti == "" || len(jti) > maxJTILength {
+		return false, ErrInvalidJTI
+	}
+	now := r.now()
+	ttl := r.maxTTL
+	if !expiresAt.IsZero() {
+		if ttl = expiresAt.Sub(now); ttl <= 0 {
+			return !once, nil
+		}
+	}
+	data, err := json.Marshal(revocation{RevokedAt: now.UTC(), RevokedBy: actor, Reason: reason})
+	if err != nil {
+		return false, err
+	}
+	if once {
+		swapped, err := r.store.CompareAndSwap(ctx, revokedPrefix+jti, nil, data, ttl)
+		if err != nil || !swapped {
+			return false, err
+		}
+	} else if err := r.store.Set(ctx, revokedPrefix+jti, data, ttl); err != nil {
+		return false, err
+	}
+	r.count("tokens_revoked_total")
+	return true, nil
+}
+
+// IsRevoked reports whether jti has been revoked
+func (r *RevocationStore) IsRevoked(ctx context.Context, jti string) (bool, error) {
+	_, err := r.store.Get(ctx, revokedPrefix+jti)
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, store.ErrNotFound):
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// Middleware rejects requests whose bearer token has been revoked. Requests
+// without a bearer token or with one without a jti pass through for the
+// authentication layer, AuthenticateBearer, to judge. The check fails
+// closed: when the store cannot answer, the request is refused.
+func (r *RevocationStore) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		raw, ok := bearer(c.GetHeader("Authorization"))
+		if !ok {
+			c.Next()
+			return
+		}
+		jti, _, err := tokenID(raw)
+		if err != nil {
+			c.Next()
+			return
+		}
+		revoked, err := r.IsRevoked(c.Request.Context(), jti)
+		if err != nil {
+			r.logger.Error("Token revocation check failed", "error", err)
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+				"error": i18n.Message(c, "INTERNAL_ERROR"),
+				"code":  "INTERNAL_ERROR",
+			})
+			return
+		}
+		if revoked {
+			r.count("revoked_token_rejections_total")
+			c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error": i18n.Message(c, "TOKEN_REVOKED"),
+				"code":  "TOKEN_REVOKED",
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// AuthenticateBearer authenticates c by the access token from issuer in its
+// Authorization header and returns the user it was issued to. Requests
+// without a bearer token, or with one that is invalid, expired, not an
+// access token, without a jti or revoked, are refused with 401; like
+// Middleware, the check fails closed with 503 when the store cannot answer.
+// On refusal the request is aborted and nil is returned.
+func (r *RevocationStore) AuthenticateBearer(c *gin.Context, issuer *auth.Issuer) *interfaces.UserInfo {
+	raw, ok := bearer(c.GetHeader("Authorization"))
+	if !ok {
+		c.Header("WWW-Authenticate", "Bearer")
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+			"error": i18n.Message(c, "UNAUTHORIZED"),
+			"code":  "UNAUTHORIZED",
+		})
+		return nil
+	}
+	claims, err := issuer.VerifyAccess(raw)
+	jti, _ := claims["jti"].(string)
+	if err == nil && (jti == "" || len(jti) > maxJTILength) {
+		err = ErrInvalidJTI
+	}
+	if err != nil {
+		r.logger.Debug("Bearer token refused", "error", err)
+		r.count("invalid_token_rejections_total")
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+			"error": i18n.Message(c, "AUTH_001"),
+			"code":  "AUTH_001",
+		})
+		return nil
+	}
+	revoked, err := r.IsRevoked(c.Request.Context(), jti)
+	if err != nil {
+		r.logger.Error("Token revocation check failed", "error", err)
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+			"error": i18n.Message(c, "INTERNAL_ERROR"),
+			"code":  "INTERNAL_ERROR",
+		})
+		return nil
+	}
+	if revoked {
+		r.count("revoked_token_rejections_total")
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+			"error": i18n.Message(c, "TOKEN_REVOKED"),
+			"code":  "TOKEN_REVOKED",
+		})
+		return nil
+	}
+	return auth.ClaimsUser(claims)
+}
+
+// RegisterRoutes mounts the admin control:
+//
+//	DELETE /tokens/:jti   {"expires_at": "2026-01-01T00:00:00Z", "reason": "..."}
+//
+// The body is optional; without expires_at the revocation is kept for maxTTL.
+func (r *RevocationStore) RegisterRoutes(rg gin.IRoutes) {
+	rg.DELETE("/tokens/:jti", r.handleRevoke)
+}
+
+func (r *RevocationStore) handleRevoke(c *gin.Context) {
+	var req struct {
+		ExpiresAt time.Time `json:"expires_at"`
+		Reason    string    `json:"reason"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": i18n.Message(c, "VALIDATION_ERROR"),
+				"code":  "VALIDATION_ERROR",
+			})
+			return
+		}
+	}
+	if req.Reason == "" {
+		req.Reason = "admin"
+	}
+	jti := c.Param("jti")
+	if err := r.Revoke(c.Request.Context(), jti, req.ExpiresAt, actor(c), req.Reason); err != nil {
+		if errors.Is(err, ErrInvalidJTI) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": i18n.Message(c, "VALIDATION_ERROR"),
+				"code":  "VALIDATION_ERROR",
+			})
+			return
+		}
+		r.logger.Error("Token revocation failed", "jti", jti, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": i18n.Message(c, "INTERNAL_ERROR"),
+			"code":  "INTERNAL_ERROR",
+		})
+		return
+	}
+	r.logger.Warn("Token revoked manually", "jti", jti, "reason", req.Reason, "actor", actor(c))
+	c.Status(http.StatusNoContent)
+}
+
+func (r *RevocationStore) count(name string) {
+	if r.metrics != nil {
+		r.metrics.IncrementCounter(name, nil)
+	}
+}
+
+// tokenID returns the jti and exp claims of a raw token
+func tokenID(raw string) (string, time.Time, error) {
+	token, err := auth.ParseToken(raw)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	jti, _ := token.Claims["jti"].(string)
+	if jti == "" || len(jti) > maxJTILength {
+		return "", time.Time{}, ErrInvalidJTI
+	}
+	var expiresAt time.Time
+	if exp, ok := token.Claims["exp"].(json.Number); ok {
+		if seconds, err := exp.Int64(); err == nil {
+			expiresAt = time.Unix(seconds, 0)
+		}
+	}
+	return jti, expiresAt, nil
+}
+
+func bearer(header string) (string, bool) {
+	const prefix = "Bearer "
+	if len(header) <= len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", false
+	}
+	token := strings.TrimSpace(header[len(prefix):])
+	return token, token != ""
+}
@@ -0,0 +1,538 @@
+// Package session provides an optional browser session cookie shared by the
+// dashboard and other first-party apps. The cookie can be scoped to a parent
+// domain so one login covers every subdomain.
+//
+// The cookie only carries a signed session ID; the session itself lives in
+// the shared store, so logging out (or revoking) on any app ends the session
+// everywhere and replicas agree on who is logged in.
+//
+// Sessions end after an absolute lifetime (TTL) and, optionally, after a
+// period without requests (IdleTimeout). Last activity is tracked in the
+// store too, so an idle session expires on every replica at once.
+//
+// Continuous verification may also act on a live session: Downgrade caps
+// the trust level of its requests, RequireReauth ends it at its next use
+// with ErrReauthRequired, and Terminate ends it at once. EndDevice does
+// either to every session created from a device. HoldUnconfirmed caps a
+// session created from an unknown device until ConfirmDevice lifts it.
+package session
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+// Errors returned by Manager
+var (
+	// ErrNoSession is returned when the request carries no valid session
+	ErrNoSession = errors.New("no valid session")
+	// ErrReauthRequired is returned, once, for a session ended by
+	// RequireReauth; the user has to log in again
+	ErrReauthRequired = errors.New("session requires re-authentication")
+)
+
+// Context keys set by Middleware
+const (
+	ContextKey     = "session"
+	UserContextKey = "user"
+)
+
+const keyPrefix = "session:"
+
+// activityPrefix holds the last-activity time of each session; it sits
+// under keyPrefix so it is replicated with the sessions
+const activityPrefix = keyPrefix + "activity:"
+
+// Reasons a session expired, used as the metric label
+const (
+	ExpiredIdle     = "idle"
+	ExpiredAbsolute = "absolute"
+	ExpiredReauth   = "reauth"
+)
+
+// updateAttempts bounds optimistic retries when replicas update a session
+const updateAttempts = 3
+
+// minSecretLength is the minimum HMAC key size accepted for cookie signing
+const minSecretLength = 32
+
+// Config configures the session cookie
+type Config struct {
+	CookieName string
+	// Domain scopes the cookie, e.g. ".example.com" to span subdomains;
+	// empty means host-only
+	Domain   string
+	Path     string
+	Secure   bool
+	SameSite http.SameSite
+	// TTL is the absolute lifetime of a session
+	TTL time.Duration
+	// IdleTimeout ends sessions without requests for that long; 0 disables it
+	IdleTimeout time.Duration
+	// Secret signs session IDs; it must be shared by all replicas
+	Secret []byte
+	// Device, when set, returns the ID of the device a login request comes
+	// from, or empty, so the session can be ended along with the device
+	Device func(c *gin.Context) string
+}
+
+// Session is the server-side record of a browser login
+type Session struct {
+	ID        string              `json:"id"`
+	User      interfaces.UserInfo `json:"user"`
+	CreatedAt time.Time           `json:"created_at"`
+	ExpiresAt time.Time           `json:"expires_at"`
+	// UserAgentHash binds the session to the browser that created it, so a
+	// stolen cookie replayed from another client is rejected
+	UserAgentHash string `json:"user_agent_hash"`
+	// IP is the client address the session was created from
+	IP string `json:"ip,omitempty"`
+	// DeviceID is the registered device the session was created from
+	DeviceID string `json:"device_id,omitempty"`
+	// TrustCap, when set, is the highest trust level requests made with the
+	// session are given; see Downgrade
+	TrustCap int `json:"trust_cap,omitempty"`
+	// ReauthRequired ends the session at its next use; see RequireReauth
+	ReauthRequired bool `json:"reauth_required,omitempty"`
+	// UnconfirmedDevice identifies the unknown device the session was
+	// created from until it is confirmed; see HoldUnconfirmed
+	UnconfirmedDevice string `json:"unconfirmed_device,omitempty"`
+}
+
+// Manager creates, loads and destroys sessions
+type Manager struct {
+	config  Config
+	store   store.Store
+	logger  interfaces.Logger
+	metrics interfaces.MetricsCollector
+	now     func() time.Time
+}
+
+// NewManager creates a session manager backed by s
+func NewManager(cfg Config, s store.Store, logger interfaces.Logger, metrics interfaces.MetricsCollector) (*Manager, error) {
+	if len(cfg.Secret) < minSecretLength {
+		return nil, fmt.Errorf("session secret must be at least %d bytes", minSecretLength)
+	}
+	if cfg.SameSite == http.SameSiteNoneMode && !cfg.Secure {
+		return nil, errors.New("SameSite=None session cookies must be Secure")
+	}
+	if cfg.CookieName == "" {
+		cfg.CookieName = "zamaz_session"
+	}
+	if cfg.Path == "" {
+		cfg.Path = "/"
+	}
+	if cfg.SameSite == 0 {
+		cfg.SameSite = http.SameSiteLaxMode
+	}
+	if cfg.TTL <= 0 {
+		cfg.TTL = 8 * time.Hour
+	}
+	if cfg.IdleTimeout < 0 {
+		cfg.IdleTimeout = 0
+	}
+	return &Manager{config: cfg, store: s, logger: logger, metrics: metrics, now: time.Now}, nil
+}
+
+// ParseSameSite converts "lax", "strict" or "none" to an http.SameSite
+func ParseSameSite(value string) (http.SameSite, error) {
+	switch strings.ToLower(value) {
+	case "", "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	default:
+		return 0, fmt.Errorf("invalid SameSite value %q", value)
+	}
+}
+
+// Create starts a session for user and sets the cookie on the response
+func (m *Manager) Create(c *gin.Context, user interfaces.UserInfo) (*Session, error) {
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	now := m.now()
+	sess := &Session{
+		ID:            id,
+		User:          user,
+		CreatedAt:     now,
+		ExpiresAt:     now.Add(m.config.TTL),
+		UserAgentHash: hashUserAgent(c.Request.UserAgent()),
+		IP:            c.ClientIP(),
+	}
+	if m.config.Device != nil {
+		sess.DeviceID = m.config.Device(c)
+	}
+	data, err := json.Marshal(sess)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.store.Set(c.Request.Context(), keyPrefix+id, data, m.config.TTL); err != nil {
+		return nil, fmt.Errorf("failed to store session: %w", err)
+	}
+	if err := m.touch(c.Request.Context(), id, now); err != nil {
+		return nil, fmt.Errorf("failed to store session: %w", err)
+	}
+
+	m.setCookie(c, m.sign(id), int(m.config.TTL.Seconds()))
+	m.logger.Info("Session created", "user_id", user.ID, "ip", c.ClientIP())
+	return sess, nil
+}
+
+// Get loads the session referenced by the request cookie and records the
+// request as activity. Sessions past their lifetime or idle timeout are
+// destroyed and reported as ErrNoSession, and those marked by RequireReauth
+// as ErrReauthRequired.
+func (m *Manager) Get(c *gin.Context) (*Session, error) {
+	cookie, err := c.Request.Cookie(m.config.CookieName)
+	if err != nil {
+		return nil, ErrNoSession
+	}
+	id, ok := m.verify(cookie.Value)
+	if !ok {
+		return nil, ErrNoSession
+	}
+	sess, err := m.load(c.Request.Context(), id)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal([]byte(sess.UserAgentHash), []byte(hashUserAgent(c.Request.UserAgent()))) {
+		m.logger.Warn("Session presented by a different user agent", "user_id", sess.User.ID, "ip", c.ClientIP())
+		return nil, ErrNoSession
+	}
+
+	now := m.now()
+	if !now.Before(sess.ExpiresAt) {
+		return nil, m.expire(c, sess, ExpiredAbsolute)
+	}
+	if sess.ReauthRequired {
+		m.expire(c, sess, ExpiredReauth)
+		return nil, ErrReauthRequired
+	}
+	if m.config.IdleTimeout > 0 {
+		last, err := m.lastActivity(c.Request.Context(), sess, now)
+		if err != nil {
+			return nil, err
+		}
+		if now.Sub(last) >= m.config.IdleTimeout {
+			return nil, m.expire(c, sess, ExpiredIdle)
+		}
+		// Writing on every request would make each one a store write; the
+		// timeout may run late by a tenth of itself instead
+		if now.Sub(last) >= m.config.IdleTimeout/10 {
+			if err := m.touch(c.Request.Context(), id, now); err != nil {
+				m.logger.Warn("Failed to record session activity", "error", err)
+			}
+		}
+	}
+	return sess, nil
+}
+
+// Destroy ends the request's session, if any, and clears the cookie
+func (m *Manager) Destroy(c *gin.Context) error {
+	defer m.setCookie(c, "", -1)
+
+	cookie, err := c.Request.Cookie(m.config.CookieName)
+	if err != nil {
+		return nil
+	}
+	id, ok := m.verify(cookie.Value)
+	if !ok {
+		return nil
+	}
+	return m.delete(c.Request.Context(), id)
+}
+
+// Middleware loads a valid session into the context under ContextKey and the
+// session user under UserContextKey. Requests without one pass through.
+func (m *Manager) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if sess, err := m.Get(c); err == nil {
+			c.Set(ContextKey, sess)
+			c.Set(UserContextKey, &sess.User)
+		}
+		c.Next()
+	}
+}
+
+// List returns every live session
+func (m *Manager) List(ctx context.Context) ([]*Session, error) {
+	keys, err := m.store.Keys(ctx, keyPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %w", err)
+	}
+	sessions := make([]*Session, 0, len(keys))
+	for _, key := range keys {
+		if strings.HasPrefix(key, activityPrefix) {
+			continue
+		}
+		sess, err := m.load(ctx, strings.TrimPrefix(key, keyPrefix))
+		if errors.Is(err, ErrNoSession) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, sess)
+	}
+	return sessions, nil
+}
+
+// Downgrade caps the trust level of requests made with session id at
+// level; 0 lifts the cap
+func (m *Manager) Downgrade(ctx context.Context, id string, level int) error {
+	return m.update(ctx, id, func(sess *Session) { sess.TrustCap = level })
+}
+
+// RequireReauth makes the next use of session id end it with
+// ErrReauthRequired
+func (m *Manager) RequireReauth(ctx context.Context, id string) error {
+	return m.update(ctx, id, func(sess *Session) { sess.ReauthRequired = true })
+}
+
+// Terminate ends session id immediately
+func (m *Manager) Terminate(ctx context.Context, id string) error {
+	return m.delete(ctx, id)
+}
+
+// ForDevice returns the live sessions created from device id, oldest first
+func (m *Manager) ForDevice(ctx context.Context, id string) ([]*Session, error) {
+	sessions, err := m.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var matching []*Session
+	for _, sess := range sessions {
+		if sess.DeviceID == id {
+			matching = append(matching, sess)
+		}
+	}
+	sort.Slice(matching, func(i, j int) bool { return matching[i].CreatedAt.Before(matching[j].CreatedAt) })
+	return matching, nil
+}
+
+// EndDevice ends the sessions created from device id, returning how many:
+// with RequireReauth or, when terminate is set, at once
+func (m *Manager) EndDevice(ctx context.Context, id string, terminate bool) (int, error) {
+	sessions, err := m.ForDevice(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	ended := 0
+	var errs []error
+	for _, sess := range sessions {
+		if terminate {
+			err = m.Terminate(ctx, sess.ID)
+		} else {
+			err = m.RequireReauth(ctx, sess.ID)
+		}
+		switch {
+		case errors.Is(err, ErrNoSession):
+		case err != nil:
+			errs = append(errs, err)
+		default:
+			ended++
+		}
+	}
+	return ended, errors.Join(errs...)
+}
+
+// HoldUnconfirmed caps the trust level of session id at level until
+// ConfirmDevice confirms device, the unknown device it was created from.
+// Continuous verification may lower the cap but not lift it.
+func (m *Manager) HoldUnconfirmed(ctx context.Context, id, device string, level int) error {
+	return m.update(ctx, id, func(sess *Session) {
+		sess.UnconfirmedDevice = device
+		if sess.TrustCap == 0 || level < sess.TrustCap {
+			sess.TrustCap = level
+		}
+	})
+}
+
+// ConfirmDevice lifts the caps HoldUnconfirmed put on user's sessions
+// created from device, returning how many were lifted
+func (m *Manager) ConfirmDevice(ctx context.Context, user, device string) (int, error) {
+	sessions, err := m.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+	lifted := 0
+	var errs []error
+	for _, sess := range sessions {
+		if sess.User.ID != user || sess.UnconfirmedDevice != device {
+			continue
+		}
+		err := m.update(ctx, sess.ID, func(sess *Session) { sess.UnconfirmedDevice, sess.TrustCap = "", 0 })
+		switch {
+		case errors.Is(err, ErrNoSession):
+		case err != nil:
+			errs = append(errs, err)
+		default:
+			lifted++
+		}
+	}
+	return lifted, errors.Join(errs...)
+}
+
+// update applies fn to session id, retrying when another replica changes
+// it concurrently
+func (m *Manager) update(ctx context.Context, id string, fn func(*Session)) error {
+	for attempt := 0; attempt < updateAttempts; attempt++ {
+		old, err := m.store.Get(ctx, keyPrefix+id)
+		if errors.Is(err, store.ErrNotFound) {
+			return ErrNoSession
+		}
+		if err != nil {
+			return fmt.Errorf("failed to load session: %w", err)
+		}
+		var sess Session
+		if err := json.Unmarshal(old, &sess); err != nil {
+			return fmt.Errorf("corrupt session record: %w", err)
+		}
+		fn(&sess)
+		data, err := json.Marshal(&sess)
+		if err != nil {
+			return err
+		}
+		ttl := sess.ExpiresAt.Sub(m.now())
+		if ttl <= 0 {
+			return ErrNoSession
+		}
+		swapped, err := m.store.CompareAndSwap(ctx, keyPrefix+id, old, data, ttl)
+		if err != nil {
+			return fmt.Errorf("failed to store session: %w", err)
+		}
+		if swapped {
+			return nil
+		}
+	}
+	return errors.New("session is being updated concurrently")
+}
+
+// expire destroys a timed-out session and returns ErrNoSession
+func (m *Manager) expire(c *gin.Context, sess *Session, reason string) error {
+	if err := m.delete(c.Request.Context(), sess.ID); err != nil {
+		m.logger.Warn("Failed to delete expired session", "error", err)
+	}
+	m.setCookie(c, "", -1)
+	if m.metrics != nil {
+		m.metrics.IncrementCounter("sessions_expired_total", map[string]string{"reason": reason})
+	}
+	m.logger.Info("Session expired", "user_id", sess.User.ID, "reason", reason, "ip", c.ClientIP())
+	return ErrNoSession
+}
+
+func (m *Manager) delete(ctx context.Context, id string) error {
+	if err := m.store.Delete(ctx, keyPrefix+id); err != nil {
+		return err
+	}
+	return m.store.Delete(ctx, activityPrefix+id)
+}
+
+// touch records now as the last activity of session id
+func (m *Manager) touch(ctx context.Context, id string, now time.Time) error {
+	if m.config.IdleTimeout <= 0 {
+		return nil
+	}
+	return m.store.Set(ctx, activityPrefix+id, []byte(strconv.FormatInt(now.UnixNano(), 10)), m.config.IdleTimeout)
+}
+
+// lastActivity returns when sess was last used. A missing record means the
+// session has been idle for at least IdleTimeout, unless it predates idle
+// tracking, in which case its creation time is used.
+func (m *Manager) lastActivity(ctx context.Context, sess *Session, now time.Time) (time.Time, error) {
+	data, err := m.store.Get(ctx, activityPrefix+sess.ID)
+	if errors.Is(err, store.ErrNotFound) {
+		if last := now.Add(-m.config.IdleTimeout); sess.CreatedAt.Before(last) {
+			return last, nil
+		}
+		return sess.CreatedAt, nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to load session activity: %w", err)
+	}
+	nanos, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("corrupt session activity: %w", err)
+	}
+	return time.Unix(0, nanos), nil
+}
+
+func (m *Manager) load(ctx context.Context, id string) (*Session, error) {
+	data, err := m.store.Get(ctx, keyPrefix+id)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, ErrNoSession
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load session: %w", err)
+	}
+	var sess Session
+	if err := json.Unmarshal(data, &sess); err != nil {
+		return nil, fmt.Errorf("corrupt session record: %w", err)
+	}
+	return &sess, nil
+}
+
+func (m *Manager) setCookie(c *gin.Context, value string, maxAge int) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     m.config.CookieName,
+		Value:    value,
+		Domain:   m.config.Domain,
+		Path:     m.config.Path,
+		MaxAge:   maxAge,
+		Secure:   m.config.Secure,
+		HttpOnly: true,
+		SameSite: m.config.SameSite,
+	})
+}
+
+// sign returns "<id>.<mac>" so forged IDs are rejected before a store lookup
+func (m *Manager) sign(id string) string {
+	return id + "." + m.mac(id)
+}
+
+func (m *Manager) verify(value string) (string, bool) {
+	id, mac, ok := strings.Cut(value, ".")
+	if !ok || id == "" {
+		return "", false
+	}
+	return id, hmac.Equal([]byte(mac), []byte(m.mac(id)))
+}
+
+func (m *Manager) mac(id string) string {
+	h := hmac.New(sha256.New, m.config.Secret)
+	h.Write([]byte(id))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+func newID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashUserAgent(ua string) string {
+	sum := sha256.Sum256([]byte(ua))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
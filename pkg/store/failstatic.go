@@ -0,0 +1,206 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+)
+
+// ErrDegraded is returned for writes while the primary store is unreachable
+var ErrDegraded = errors.New("store: primary unavailable, read-only")
+
+// DefaultMaxStale bounds how old a fallback value may be
+const DefaultMaxStale = 5 * time.Minute
+
+// FailStaticStore wraps the shared store so that an outage degrades the
+// service instead of failing it unpredictably. Values read or written
+// through it are copied to a process-local fallback for up to maxStale;
+// once the primary fails, reads are served from that copy and writes fail
+// fast with ErrDegraded. Ping always probes the primary and clears the
+// degradation once it answers, so the periodic health check is the prober.
+//
+// The fallback is per replica and possibly stale, which is the point: it
+// keeps sessions and policies answering during the outage, while every
+// mutation is refused until the shared state is back.
+type FailStaticStore struct {
+	primary  Store
+	fallback *MemoryStore
+	maxStale time.Duration
+	logger   interfaces.Logger
+	metrics  interfaces.MetricsCollector
+
+	mu    sync.RWMutex
+	since time.Time
+	cause error
+}
+
+// NewFailStaticStore wraps primary; metrics may be nil
+func NewFailStaticStore(primary Store, maxStale time.Duration, logger interfaces.Logger, metrics interfaces.MetricsCollector) *FailStaticStore {
+	if maxStale <= 0 {
+		maxStale = DefaultMaxStale
+	}
+	return &FailStaticStore{
+		primary:  primary,
+		fallback: NewMemoryStore(),
+		maxStale: maxStale,
+		logger:   logger,
+		metrics:  metrics,
+	}
+}
+
+// Degraded reports whether the primary store is unavailable
+func (f *FailStaticStore) Degraded() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return !f.since.IsZero()
+}
+
+// DegradedSince returns when the outage began and what caused it, or a zero
+// time while the primary is available
+func (f *FailStaticStore) DegradedSince() (time.Time, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.since, f.cause
+}
+
+// observe records the outcome of a primary call and returns err. A call
+// cancelled by its caller says nothing about the primary.
+func (f *FailStaticStore) observe(err error) error {
+	if errors.Is(err, context.Canceled) {
+		return err
+	}
+	failed := err != nil && !errors.Is(err, ErrNotFound)
+	f.mu.Lock()
+	changed := failed == f.since.IsZero()
+	if failed && changed {
+		f.since, f.cause = time.Now(), err
+	} else if !failed && changed {
+		f.since, f.cause = time.Time{}, nil
+	}
+	f.mu.Unlock()
+
+	if changed {
+		value := 0.0
+		if failed {
+			value = 1
+			f.logger.Error("Shared store unavailable, serving read-only from local state", "error", err)
+		} else {
+			f.logger.Info("Shared store recovered, leaving read-only mode")
+		}
+		if f.metrics != nil {
+			f.metrics.SetGauge("store_degraded", value, nil)
+		}
+	}
+	return err
+}
+
+func (f *FailStaticStore) staleTTL(ttl time.Duration) time.Duration {
+	if ttl > 0 && ttl < f.maxStale {
+		return ttl
+	}
+	return f.maxStale
+}
+
+// Get implements Store
+func (f *FailStaticStore) Get(ctx context.Context, key string) ([]byte, error) {
+	if !f.Degraded() {
+		value, err := f.primary.Get(ctx, key)
+		switch {
+		case err == nil:
+			_ = f.fallback.Set(ctx, key, value, f.maxStale)
+			return value, f.observe(nil)
+		case errors.Is(err, ErrNotFound):
+			_ = f.fallback.Delete(ctx, key)
+			return nil, f.observe(err)
+		}
+		f.observe(err)
+	}
+	return f.fallback.Get(ctx, key)
+}
+
+// Set implements Store
+func (f *FailStaticStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if f.Degraded() {
+		return ErrDegraded
+	}
+	if err := f.observe(f.primary.Set(ctx, key, value, ttl)); err != nil {
+		return err
+	}
+	return f.fallback.Set(ctx, key, value, f.staleTTL(ttl))
+}
+
+// Delete implements Store
+func (f *FailStaticStore) Delete(ctx context.Context, key string) error {
+	if f.Degraded() {
+		return ErrDegraded
+	}
+	if err := f.observe(f.primary.Delete(ctx, key)); err != nil {
+		return err
+	}
+	return f.fallback.Delete(ctx, key)
+}
+
+// Incr implements Store; counters are not kept in the fallback
+func (f *FailStaticStore) Incr(ctx context.Context, key string, ttl time.Duration) (int64, time.Duration, error) {
+	if f.Degraded() {
+		return 0, 0, ErrDegraded
+	}
+	n, remaining, err := f.primary.Incr(ctx, key, ttl)
+	return n, remaining, f.observe(err)
+}
+
+// CompareAndSwap implements Store
+func (f *FailStaticStore) CompareAndSwap(ctx context.Context, key string, old, value []byte, ttl time.Duration) (bool, error) {
+	if f.Degraded() {
+		return false, ErrDegraded
+	}
+	swapped, err := f.primary.CompareAndSwap(ctx, key, old, value, ttl)
+	if f.observe(err) != nil || !swapped {
+		return swapped, err
+	}
+	return true, f.fallback.Set(ctx, key, value, f.staleTTL(ttl))
+}
+
+// Scripts implements Scripter when the primary runs scripts
+func (f *FailStaticStore) Scripts() bool {
+	_, ok := ScriptsOf(f.primary)
+	return ok
+}
+
+// Eval implements Scripter; like counters, script state is not kept in the
+// fallback
+func (f *FailStaticStore) Eval(ctx context.Context, script string, keys []string, args ...string) (interface{}, error) {
+	scripter, ok := ScriptsOf(f.primary)
+	if !ok {
+		return nil, ErrScriptsUnsupported
+	}
+	if f.Degraded() {
+		return nil, ErrDegraded
+	}
+	reply, err := scripter.Eval(ctx, script, keys, args...)
+	return reply, f.observe(err)
+}
+
+// Keys implements Store
+func (f *FailStaticStore) Keys(ctx context.Context, prefix string) ([]string, error) {
+	if !f.Degraded() {
+		keys, err := f.primary.Keys(ctx, prefix)
+		if f.observe(err) == nil {
+			return keys, nil
+		}
+	}
+	return f.fallback.Keys(ctx, prefix)
+}
+
+// Ping probes the primary even while degraded
+func (f *FailStaticStore) Ping(ctx context.Context) error {
+	return f.observe(f.primary.Ping(ctx))
+}
+
+// Close implements Store
+func (f *FailStaticStore) Close() error {
+	return f.primary.Close()
+}
@@ -0,0 +1,153 @@
+package store
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a process-local Store. It is the default for single-instance
+// deployments and tests; replicas using it do not share state.
+type MemoryStore struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+	now     func() time.Time
+}
+
+type memoryEntry struct {
+	value     []byte
+	expiresAt time.Time
+}
+
+func (e memoryEntry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && !now.Before(e.expiresAt)
+}
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		entries: make(map[string]memoryEntry),
+		now:     time.Now,
+	}
+}
+
+// lookup returns a live entry, lazily evicting an expired one
+func (m *MemoryStore) lookup(key string) (memoryEntry, bool) {
+	e, ok := m.entries[key]
+	if ok && e.expired(m.now()) {
+		delete(m.entries, key)
+		return memoryEntry{}, false
+	}
+	return e, ok
+}
+
+func (m *MemoryStore) expiry(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return m.now().Add(ttl)
+}
+
+// Get implements Store
+func (m *MemoryStore) Get(_ context.Context, key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.lookup(key)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]byte(nil), e.value...), nil
+}
+
+// Set implements Store
+func (m *MemoryStore) Set(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.entries[key] = memoryEntry{
+		value:     append([]byte(nil), value...),
+		expiresAt: m.expiry(ttl),
+	}
+	return nil
+}
+
+// Delete implements Store
+func (m *MemoryStore) Delete(_ context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.entries, key)
+	return nil
+}
+
+// Incr implements Store
+func (m *MemoryStore) Incr(_ context.Context, key string, ttl time.Duration) (int64, time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.lookup(key)
+	var count int64
+	if ok {
+		parsed, err := strconv.ParseInt(string(e.value), 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+		count = parsed
+	} else {
+		e.expiresAt = m.expiry(ttl)
+	}
+
+	count++
+	e.value = []byte(strconv.FormatInt(count, 10))
+	m.entries[key] = e
+
+	var remaining time.Duration
+	if !e.expiresAt.IsZero() {
+		remaining = e.expiresAt.Sub(m.now())
+	}
+	return count, remaining, nil
+}
+
+// CompareAndSwap implements Store
+func (m *MemoryStore) CompareAndSwap(_ context.Context, key string, old, value []byte, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.lookup(key)
+	if ok != (old != nil) || (ok && string(e.value) != string(old)) {
+		return false, nil
+	}
+	m.entries[key] = memoryEntry{
+		value:     append([]byte(nil), value...),
+		expiresAt: m.expiry(ttl),
+	}
+	return true, nil
+}
+
+// Keys implements Store
+func (m *MemoryStore) Keys(_ context.Context, prefix string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	keys := make([]string, 0)
+	for key, e := range m.entries {
+		if e.expired(now) {
+			delete(m.entries, key)
+			continue
+		}
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// Ping implements Store
+func (m *MemoryStore) Ping(context.Context) error { return nil }
+
+// Close implements Store
+func (m *MemoryStore) Close() error { return nil }
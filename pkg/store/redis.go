@@ -0,0 +1,371 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RedisConfig configures the Redis-backed store
+type RedisConfig struct {
+	Address     string
+	Password    string
+	DB          int
+	Prefix      string
+	PoolSize    int
+	DialTimeout time.Duration
+	IOTimeout   time.Duration
+}
+
+// RedisConfigFromURL builds a config from redis://[:password@]host:port[/db]
+func RedisConfigFromURL(u *url.URL) RedisConfig {
+	cfg := RedisConfig{
+		Address: u.Host,
+		Prefix:  "zt:",
+	}
+	if u.User != nil {
+		if password, ok := u.User.Password(); ok {
+			cfg.Password = password
+		} else {
+			cfg.Password = u.User.Username()
+		}
+	}
+	if db, err := strconv.Atoi(strings.TrimPrefix(u.Path, "/")); err == nil {
+		cfg.DB = db
+	}
+	return cfg
+}
+
+// RedisStore implements Store on top of Redis using a small RESP2 client
+type RedisStore struct {
+	config RedisConfig
+	pool   chan *redisConn
+}
+
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// redisError is an error reply from the server
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// incrScript increments a counter, starts its ttl on first use and returns
+// the count together with the remaining ttl in milliseconds
+const incrScript = `
+local v = redis.call('INCR', KEYS[1])
+if v == 1 and tonumber(ARGV[1]) > 0 then
+  redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return {v, redis.call('PTTL', KEYS[1])}
+`
+
+// casScript replaces a value only if it still holds ARGV[2], or is absent
+// when ARGV[1] is 0, and returns 1 when it did
+const casScript = `
+local cur = redis.call('GET', KEYS[1])
+if ARGV[1] == '0' then
+  if cur then return 0 end
+elseif cur ~= ARGV[2] then
+  return 0
+end
+if tonumber(ARGV[4]) > 0 then
+  redis.call('SET', KEYS[1], ARGV[3], 'PX', ARGV[4])
+else
+  redis.call('SET', KEYS[1], ARGV[3])
+end
+return 1
+`
+
+// NewRedisStore connects to Redis and verifies the connection
+func NewRedisStore(cfg RedisConfig) (*RedisStore, error) {
+	if cfg.Address == "" {
+		cfg.Address = "localhost:6379"
+	}
+	if cfg.PoolSize <= 0 {
+		cfg.PoolSize = 10
+	}
+	if cfg.DialTimeout <= 0 {
+		cfg.DialTimeout = 3 * time.Second
+	}
+	if cfg.IOTimeout <= 0 {
+		cfg.IOTimeout = 3 * time.Second
+	}
+
+	s := &RedisStore{
+		config: cfg,
+		pool:   make(chan *redisConn, cfg.PoolSize),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.DialTimeout)
+	defer cancel()
+	if err := s.Ping(ctx); err != nil {
+		return nil, fmt.Errorf("failed to connect to redis at %s: %w", cfg.Address, err)
+	}
+	return s, nil
+}
+
+func (s *RedisStore) key(k string) string {
+	return s.config.Prefix + k
+}
+
+func (s *RedisStore) dial(ctx context.Context) (*redisConn, error) {
+	dialer := net.Dialer{Timeout: s.config.DialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", s.config.Address)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+
+	if s.config.Password != "" {
+		if _, err := c.do(s.deadline(ctx), "AUTH", s.config.Password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if s.config.DB != 0 {
+		if _, err := c.do(s.deadline(ctx), "SELECT", strconv.Itoa(s.config.DB)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (s *RedisStore) deadline(ctx context.Context) time.Time {
+	deadline := time.Now().Add(s.config.IOTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	return deadline
+}
+
+// do runs a single command on a pooled connection
+func (s *RedisStore) do(ctx context.Context, args ...string) (interface{}, error) {
+	var c *redisConn
+	select {
+	case c = <-s.pool:
+	default:
+		var err error
+		if c, err = s.dial(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := c.do(s.deadline(ctx), args...)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		// The connection state is unknown after an I/O error
+		c.conn.Close()
+		return nil, err
+	}
+
+	select {
+	case s.pool <- c:
+	default:
+		c.conn.Close()
+	}
+	return reply, err
+}
+
+func (c *redisConn) do(deadline time.Time, args ...string) (interface{}, error) {
+	if err := c.conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(c.w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	return readReply(c.r)
+}
+
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	payload := line[1 : len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return payload, nil
+	case '-':
+		return nil, redisError(payload)
+	case ':':
+		return strconv.ParseInt(payload, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unknown reply type %q", line[0])
+	}
+}
+
+// Get implements Store
+func (s *RedisStore) Get(ctx context.Context, key string) ([]byte, error) {
+	reply, err := s.do(ctx, "GET", s.key(key))
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, ErrNotFound
+	}
+	value, ok := reply.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("redis: unexpected GET reply %T", reply)
+	}
+	return value, nil
+}
+
+// Set implements Store
+func (s *RedisStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	args := []string{"SET", s.key(key), string(value)}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	}
+	_, err := s.do(ctx, args...)
+	return err
+}
+
+// Delete implements Store
+func (s *RedisStore) Delete(ctx context.Context, key string) error {
+	_, err := s.do(ctx, "DEL", s.key(key))
+	return err
+}
+
+// Incr implements Store
+func (s *RedisStore) Incr(ctx context.Context, key string, ttl time.Duration) (int64, time.Duration, error) {
+	reply, err := s.do(ctx, "EVAL", incrScript, "1", s.key(key), strconv.FormatInt(ttl.Milliseconds(), 10))
+	if err != nil {
+		return 0, 0, err
+	}
+	items, ok := reply.([]interface{})
+	if !ok || len(items) != 2 {
+		return 0, 0, fmt.Errorf("redis: unexpected INCR reply %v", reply)
+	}
+	count, _ := items[0].(int64)
+	pttl, _ := items[1].(int64)
+	if pttl < 0 {
+		pttl = 0
+	}
+	return count, time.Duration(pttl) * time.Millisecond, nil
+}
+
+// CompareAndSwap implements Store
+func (s *RedisStore) CompareAndSwap(ctx context.Context, key string, old, value []byte, ttl time.Duration) (bool, error) {
+	exists := "1"
+	if old == nil {
+		exists = "0"
+	}
+	reply, err := s.do(ctx, "EVAL", casScript, "1", s.key(key), exists, string(old), string(value), strconv.FormatInt(ttl.Milliseconds(), 10))
+	if err != nil {
+		return false, err
+	}
+	swapped, _ := reply.(int64)
+	return swapped == 1, nil
+}
+
+// Scripts implements Scripter
+func (s *RedisStore) Scripts() bool { return true }
+
+// Eval implements Scripter
+func (s *RedisStore) Eval(ctx context.Context, script string, keys []string, args ...string) (interface{}, error) {
+	cmd := make([]string, 0, 3+len(keys)+len(args))
+	cmd = append(cmd, "EVAL", script, strconv.Itoa(len(keys)))
+	for _, key := range keys {
+		cmd = append(cmd, s.key(key))
+	}
+	return s.do(ctx, append(cmd, args...)...)
+}
+
+// Keys implements Store using SCAN so large keyspaces are not blocked
+func (s *RedisStore) Keys(ctx context.Context, prefix string) ([]string, error) {
+	pattern := escapeGlob(s.key(prefix)) + "*"
+	keys := make([]string, 0)
+	cursor := "0"
+	for {
+		reply, err := s.do(ctx, "SCAN", cursor, "MATCH", pattern, "COUNT", "200")
+		if err != nil {
+			return nil, err
+		}
+		items, ok := reply.([]interface{})
+		if !ok || len(items) != 2 {
+			return nil, fmt.Errorf("redis: unexpected SCAN reply %v", reply)
+		}
+		next, _ := items[0].([]byte)
+		batch, _ := items[1].([]interface{})
+		for _, item := range batch {
+			if k, ok := item.([]byte); ok {
+				keys = append(keys, strings.TrimPrefix(string(k), s.config.Prefix))
+			}
+		}
+		cursor = string(next)
+		if cursor == "0" || cursor == "" {
+			return keys, nil
+		}
+	}
+}
+
+// Ping implements Store
+func (s *RedisStore) Ping(ctx context.Context) error {
+	_, err := s.do(ctx, "PING")
+	return err
+}
+
+// Close implements Store
+func (s *RedisStore) Close() error {
+	for {
+		select {
+		case c := <-s.pool:
+			c.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+func escapeGlob(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`).Replace(s)
+}
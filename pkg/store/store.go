@@ -0,0 +1,85 @@
+// Package store provides the shared key-value state used by every replica of
+// impl-zamaz so that instances behind a round-robin load balancer agree
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned when a key does not exist or has expired
+	ErrNotFound = errors.New("store: key not found")
+	// ErrScriptsUnsupported is returned by Eval when the store underneath
+	// does not run scripts
+	ErrScriptsUnsupported = errors.New("store: scripts not supported")
+)
+
+// Store is a TTL-aware key-value store shared between replicas
+type Store interface {
+	// Get returns the value stored at key or ErrNotFound
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Set stores value at key; a zero ttl means no expiry
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// Delete removes key; deleting a missing key is not an error
+	Delete(ctx context.Context, key string) error
+	// Incr atomically increments the counter at key, starting the ttl on the
+	// first increment, and returns the new value and the remaining ttl
+	Incr(ctx context.Context, key string, ttl time.Duration) (int64, time.Duration, error)
+	// CompareAndSwap sets key to value with ttl only if it currently holds
+	// old, or does not exist when old is nil, and reports whether it did
+	CompareAndSwap(ctx context.Context, key string, old, value []byte, ttl time.Duration) (bool, error)
+	// Keys returns all keys beginning with prefix
+	Keys(ctx context.Context, prefix string) ([]string, error)
+	// Ping checks connectivity
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// Backend names accepted by New
+const (
+	BackendMemory = "memory"
+	BackendRedis  = "redis"
+)
+
+// New creates a store for the named backend. The Redis backend takes a
+// redis://[:password@]host:port[/db] URL.
+func New(backend, redisURL string) (Store, error) {
+	switch backend {
+	case "", BackendMemory:
+		return NewMemoryStore(), nil
+	case BackendRedis:
+		u, err := url.Parse(redisURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis URL: %w", err)
+		}
+		return NewRedisStore(RedisConfigFromURL(u))
+	default:
+		return nil, fmt.Errorf("unknown state backend %q", backend)
+	}
+}
+
+// Scripter is a store that runs Lua scripts atomically, as Redis does, so
+// read-modify-write state takes one round trip instead of retried swaps
+type Scripter interface {
+	Store
+	// Scripts reports whether Eval is available, which for a store
+	// wrapping another depends on the one it wraps
+	Scripts() bool
+	// Eval runs script with keys, namespaced like the store's own, and
+	// args, returning its reply: integers as int64, strings as []byte and
+	// tables as []interface{}
+	Eval(ctx context.Context, script string, keys []string, args ...string) (interface{}, error)
+}
+
+// ScriptsOf returns s as a Scripter when it can run scripts
+func ScriptsOf(s Store) (Scripter, bool) {
+	scripter, ok := s.(Scripter)
+	if !ok || !scripter.Scripts() {
+		return nil, false
+	}
+	return scripter, true
+}
@@ -0,0 +1,126 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracedStore runs every call to the store underneath in an OpenTelemetry
+// client span. Spans name the key's prefix, up to its first colon, rather
+// than the key, which may hold user IDs and nonces.
+type TracedStore struct {
+	store  Store
+	tracer trace.Tracer
+}
+
+// NewTracedStore traces the calls to s with the global tracer provider
+func NewTracedStore(s Store) *TracedStore {
+	return &TracedStore{store: s, tracer: otel.Tracer("github.com/lsendel/impl-zamaz/pkg/store")}
+}
+
+// start begins the span of an operation on key
+func (t *TracedStore) start(ctx context.Context, operation, key string) (context.Context, trace.Span) {
+	prefix, _, _ := strings.Cut(key, ":")
+	return t.tracer.Start(ctx, "store."+operation, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("db.operation.name", operation), attribute.String("store.key_prefix", prefix)))
+}
+
+// end ends a span, recording err unless it is ErrNotFound
+func end(span trace.Span, err error) {
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Get implements Store
+func (t *TracedStore) Get(ctx context.Context, key string) ([]byte, error) {
+	ctx, span := t.start(ctx, "Get", key)
+	value, err := t.store.Get(ctx, key)
+	end(span, err)
+	return value, err
+}
+
+// Set implements Store
+func (t *TracedStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	ctx, span := t.start(ctx, "Set", key)
+	err := t.store.Set(ctx, key, value, ttl)
+	end(span, err)
+	return err
+}
+
+// Delete implements Store
+func (t *TracedStore) Delete(ctx context.Context, key string) error {
+	ctx, span := t.start(ctx, "Delete", key)
+	err := t.store.Delete(ctx, key)
+	end(span, err)
+	return err
+}
+
+// Incr implements Store
+func (t *TracedStore) Incr(ctx context.Context, key string, ttl time.Duration) (int64, time.Duration, error) {
+	ctx, span := t.start(ctx, "Incr", key)
+	count, remaining, err := t.store.Incr(ctx, key, ttl)
+	end(span, err)
+	return count, remaining, err
+}
+
+// CompareAndSwap implements Store
+func (t *TracedStore) CompareAndSwap(ctx context.Context, key string, old, value []byte, ttl time.Duration) (bool, error) {
+	ctx, span := t.start(ctx, "CompareAndSwap", key)
+	swapped, err := t.store.CompareAndSwap(ctx, key, old, value, ttl)
+	span.SetAttributes(attribute.Bool("store.swapped", swapped))
+	end(span, err)
+	return swapped, err
+}
+
+// Keys implements Store
+func (t *TracedStore) Keys(ctx context.Context, prefix string) ([]string, error) {
+	ctx, span := t.start(ctx, "Keys", prefix)
+	keys, err := t.store.Keys(ctx, prefix)
+	end(span, err)
+	return keys, err
+}
+
+// Ping implements Store
+func (t *TracedStore) Ping(ctx context.Context) error {
+	ctx, span := t.start(ctx, "Ping", "")
+	err := t.store.Ping(ctx)
+	end(span, err)
+	return err
+}
+
+// Close implements Store
+func (t *TracedStore) Close() error {
+	return t.store.Close()
+}
+
+// Scripts implements Scripter, reporting whether the store underneath runs
+// scripts
+func (t *TracedStore) Scripts() bool {
+	_, ok := ScriptsOf(t.store)
+	return ok
+}
+
+// Eval implements Scripter
+func (t *TracedStore) Eval(ctx context.Context, script string, keys []string, args ...string) (interface{}, error) {
+	scripter, ok := ScriptsOf(t.store)
+	if !ok {
+		return nil, ErrScriptsUnsupported
+	}
+	var key string
+	if len(keys) > 0 {
+		key = keys[0]
+	}
+	ctx, span := t.start(ctx, "Eval", key)
+	reply, err := scripter.Eval(ctx, script, keys, args...)
+	end(span, err)
+	return reply, err
+}
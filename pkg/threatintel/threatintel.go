@@ -0,0 +1,191 @@
+// Package threatintel scores client addresses against threat intelligence:
+// block lists loaded from files or HTTP feeds, and AbuseIPDB-style
+// reputation APIs. Verdicts are cached in the shared store so every replica
+// asks the API about an address once per cache period. They feed the risk
+// factor and, optionally, block known-bad sources outright.
+package threatintel
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lsendel/impl-zamaz/pkg/i18n"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+// verdictPrefix holds cached verdicts by address
+const verdictPrefix = "threatintel:"
+
+// defaultTimeout bounds feed downloads and API lookups
+const defaultTimeout = 10 * time.Second
+
+// Config configures threat intelligence
+type Config struct {
+	// CacheTTL is how long verdicts are cached; defaults to 1h
+	CacheTTL time.Duration
+	// RefreshInterval is how often lists are reloaded; defaults to 1h
+	RefreshInterval time.Duration
+	// BlockScore, when above 0, makes Middleware reject addresses scoring
+	// at least this much
+	BlockScore float64
+}
+
+// Verdict is what threat intelligence says about an address
+type Verdict struct {
+	IP string `json:"ip"`
+	// Score is the highest score any source gave, from 0 to 1
+	Score float64 `json:"score"`
+	// Sources lists the sources reporting the address
+	Sources   []string  `json:"sources,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// Service combines sources into cached verdicts
+type Service struct {
+	config  Config
+	sources []Source
+	store   store.Store
+	logger  interfaces.Logger
+	metrics interfaces.MetricsCollector
+	now     func() time.Time
+}
+
+// NewService creates threat intelligence over sources; metrics may be nil
+func NewService(cfg Config, sources []Source, s store.Store, logger interfaces.Logger, metrics interfaces.MetricsCollector) *Service {
+	if cfg.CacheTTL <= 0 {
+		cfg.CacheTTL = time.Hour
+	}
+	if cfg.RefreshInterval <= 0 {
+		cfg.RefreshInterval = time.Hour
+	}
+	return &Service{config: cfg, sources: sources, store: s, logger: logger, metrics: metrics, now: time.Now}
+}
+
+// Start loads the lists immediately and then every RefreshInterval until
+// ctx is cancelled
+func (s *Service) Start(ctx context.Context) {
+	s.Refresh(ctx)
+	go func() {
+		ticker := time.NewTicker(s.config.RefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.Refresh(ctx)
+			}
+		}
+	}()
+}
+
+// Refresh reloads every list, keeping the previous entries of lists that
+// fail to load
+func (s *Service) Refresh(ctx context.Context) {
+	for _, source := range s.sources {
+		r, ok := source.(Refresher)
+		if !ok {
+			continue
+		}
+		if err := r.Refresh(ctx); err != nil {
+			s.logger.Warn("Failed to load threat intelligence list; keeping previous entries", "source", source.Name(), "error", err)
+			s.count("threat_intel_source_errors_total", source.Name())
+		}
+	}
+}
+
+// Check returns the verdict on ip. A source failing is skipped and the
+// verdict is then not cached, so the address is checked again next time.
+func (s *Service) Check(ctx context.Context, ip string) (*Verdict, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return &Verdict{IP: ip, CheckedAt: s.now().UTC()}, nil
+	}
+	ip = addr.String()
+	data, err := s.store.Get(ctx, verdictPrefix+ip)
+	if err == nil {
+		var verdict Verdict
+		if err := json.Unmarshal(data, &verdict); err == nil {
+			return &verdict, nil
+		}
+	} else if !errors.Is(err, store.ErrNotFound) {
+		s.logger.Warn("Failed to read cached threat intelligence verdict", "ip", ip, "error", err)
+	}
+
+	verdict := &Verdict{IP: ip, CheckedAt: s.now().UTC()}
+	complete := true
+	for _, source := range s.sources {
+		score, err := source.Lookup(ctx, addr)
+		if err != nil {
+			s.logger.Warn("Threat intelligence lookup failed", "source", source.Name(), "ip", ip, "error", err)
+			s.count("threat_intel_source_errors_total", source.Name())
+			complete = false
+			continue
+		}
+		if score <= 0 {
+			continue
+		}
+		verdict.Sources = append(verdict.Sources, source.Name())
+		if score > verdict.Score {
+			verdict.Score = score
+		}
+	}
+	if complete {
+		if data, err := json.Marshal(verdict); err == nil {
+			if err := s.store.Set(ctx, verdictPrefix+ip, data, s.config.CacheTTL); err != nil {
+				s.logger.Warn("Failed to cache threat intelligence verdict", "ip", ip, "error", err)
+			}
+		}
+	}
+	return verdict, nil
+}
+
+// Score returns how likely ip is malicious, from 0 to 1. It implements
+// risk.Reputation.
+func (s *Service) Score(ctx context.Context, ip string) (float64, error) {
+	verdict, err := s.Check(ctx, ip)
+	if err != nil {
+		return 0, err
+	}
+	return verdict.Score, nil
+}
+
+// Middleware rejects requests from addresses scoring at least BlockScore
+// with 403; without a BlockScore it lets every request through
+func (s *Service) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if s.config.BlockScore <= 0 {
+			c.Next()
+			return
+		}
+		verdict, err := s.Check(c.Request.Context(), c.ClientIP())
+		if err != nil || verdict.Score < s.config.BlockScore {
+			c.Next()
+			return
+		}
+		s.logger.Warn("Request from known-bad source blocked", "ip", verdict.IP, "score", verdict.Score, "sources", verdict.Sources)
+		s.count("threat_intel_blocks_total", "")
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+			"error": i18n.Message(c, "SOURCE_BLOCKED"),
+			"code":  "SOURCE_BLOCKED",
+		})
+	}
+}
+
+func (s *Service) count(name, source string) {
+	if s.metrics == nil {
+		return
+	}
+	var labels map[string]string
+	if source != "" {
+		labels = map[string]string{"source": source}
+	}
+	s.metrics.IncrementCounter(name, labels)
+}
@@ -0,0 +1,110 @@
+// Package tracing traces requests with OpenTelemetry. It accepts the W3C
+// traceparent and baggage headers of incoming requests, answers with the
+// traceparent of the request's span and passes it on downstream.
+//
+// Spans are exported over OTLP/HTTP when OTEL_EXPORTER_OTLP_ENDPOINT or
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT is set; the other OTEL_* variables,
+// such as OTEL_EXPORTER_OTLP_HEADERS, OTEL_SERVICE_NAME,
+// OTEL_RESOURCE_ATTRIBUTES and OTEL_TRACES_SAMPLER, apply as the
+// OpenTelemetry specification describes.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentation names the tracer of the spans created here
+const instrumentation = "github.com/lsendel/impl-zamaz/pkg/tracing"
+
+// Setup installs the global tracer provider and propagators. serviceName
+// and version describe the service unless OTEL_SERVICE_NAME or
+// OTEL_RESOURCE_ATTRIBUTES do. Call shutdown to flush the spans not yet
+// exported before exiting.
+func Setup(ctx context.Context, serviceName, version string) (shutdown func(context.Context) error, exporting bool, err error) {
+	res, err := resource.Merge(
+		resource.NewSchemaless(semconv.ServiceName(serviceName), semconv.ServiceVersion(version)),
+		// Detected last so the environment takes precedence
+		resource.Default(),
+	)
+	if err != nil {
+		return nil, false, fmt.Errorf("tracing resource: %w", err)
+	}
+
+	options := []sdktrace.TracerProviderOption{sdktrace.WithResource(res)}
+	if exporterConfigured() {
+		exporter, err := otlptracehttp.New(ctx)
+		if err != nil {
+			return nil, false, fmt.Errorf("OTLP trace exporter: %w", err)
+		}
+		options = append(options, sdktrace.WithBatcher(exporter))
+		exporting = true
+	}
+	// Without an exporter spans are still created, so traceparent headers
+	// carry this service's span IDs and logs can refer to them
+	provider := sdktrace.NewTracerProvider(options...)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, exporting, nil
+}
+
+// exporterConfigured reports whether the environment names an OTLP endpoint
+func exporterConfigured() bool {
+	if os.Getenv("OTEL_TRACES_EXPORTER") == "none" {
+		return false
+	}
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+// Middleware runs each request in a server span, continuing the trace of
+// an incoming traceparent header, and returns the span's traceparent in the
+// response
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		propagator := otel.GetTextMapPropagator()
+		ctx := propagator.Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+
+		route := c.FullPath()
+		name := c.Request.Method + " " + route
+		if route == "" {
+			name = c.Request.Method
+		}
+		ctx, span := otel.Tracer(instrumentation).Start(ctx, name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(c.Request.Method),
+				semconv.URLPath(c.Request.URL.Path),
+				semconv.ClientAddress(c.ClientIP()),
+				semconv.UserAgentOriginal(c.Request.UserAgent()),
+			))
+		defer span.End()
+		if route != "" {
+			span.SetAttributes(semconv.HTTPRoute(route))
+		}
+
+		propagator.Inject(ctx, propagation.HeaderCarrier(c.Writer.Header()))
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if len(c.Errors) > 0 {
+			span.SetAttributes(attribute.String("error.message", c.Errors.String()))
+		}
+		if status >= 500 {
+			span.SetStatus(codes.Error, fmt.Sprintf("status %d", status))
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package trust
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+// HeaderTLSFingerprint carries the client's TLS fingerprint, such as a JA3
+// or JA4 hash, set by the proxy terminating TLS. The proxy must drop the
+// header from client requests.
+const HeaderTLSFingerprint = "X-TLS-Fingerprint"
+
+// Client signals read from Input.Context, in the order they are reported
+const (
+	SignalUserAgent      = "user_agent"
+	SignalAcceptLanguage = "accept_language"
+	SignalTLSFingerprint = "tls_fingerprint"
+)
+
+var behaviorSignals = []string{SignalUserAgent, SignalAcceptLanguage, SignalTLSFingerprint}
+
+// behaviorPrefix holds each subject's client profile
+const behaviorPrefix = "behavior:"
+
+// behaviorAttempts bounds optimistic retries when replicas update a profile
+const behaviorAttempts = 3
+
+// BehaviorConfig configures client profiles
+type BehaviorConfig struct {
+	// ConsistentAfter is how many sightings make a signal fully trusted;
+	// defaults to 10
+	ConsistentAfter int
+	// MaxValues is how many values of each signal are remembered, e.g. one
+	// per browser; defaults to 3
+	MaxValues int
+	// TTL is how long an unused profile is kept; defaults to 90 days
+	TTL time.Duration
+}
+
+// signalValue is a remembered signal value; only its hash is stored
+type signalValue struct {
+	Hash     string    `json:"hash"`
+	Count    int       `json:"count"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// BehaviorProfiles remembers the clients each subject uses and scores how
+// consistent a request is with them. Profiles live in the shared store, so
+// every replica scores against the same history.
+type BehaviorProfiles struct {
+	config BehaviorConfig
+	store  store.Store
+	logger interfaces.Logger
+	now    func() time.Time
+}
+
+// NewBehaviorProfiles creates profiles kept in s
+func NewBehaviorProfiles(cfg BehaviorConfig, s store.Store, logger interfaces.Logger) *BehaviorProfiles {
+	if cfg.ConsistentAfter <= 0 {
+		cfg.ConsistentAfter = 10
+	}
+	if cfg.MaxValues <= 0 {
+		cfg.MaxValues = 3
+	}
+	if cfg.TTL <= 0 {
+		cfg.TTL = 90 * 24 * time.Hour
+	}
+	return &BehaviorProfiles{config: cfg, store: s, logger: logger, now: time.Now}
+}
+
+// RequestContext returns the Input.Context of a request: the client address,
+// the route requested, the signals BehaviorProfiles compares and whether the
+// request came from a hardware-bound device of the authenticated user
+func RequestContext(c *gin.Context) map[string]string {
+	ctx := map[string]string{"ip": c.ClientIP()}
+	if route := c.FullPath(); route != "" {
+		ctx[ContextEndpoint] = c.Request.Method + " " + route
+	}
+	if bound, ok := c.Get(BoundDeviceKey); ok {
+		device, _ := bound.(*interfaces.DeviceInfo)
+		user, _ := c.Get("user")
+		if info, ok := user.(*interfaces.UserInfo); ok && device != nil && device.OwnerID == info.ID {
+			ctx[ContextDeviceBound] = "true"
+			ctx[ContextDeviceID] = device.ID
+			if device.State != "" {
+				ctx[ContextDeviceState] = device.State
+			}
+			if device.Compliance != "" {
+				ctx[ContextDeviceCompliance] = device.Compliance
+			}
+		}
+	}
+	for signal, value := range map[string]string{
+		SignalUserAgent:      c.Request.UserAgent(),
+		SignalAcceptLanguage: c.GetHeader("Accept-Language"),
+		SignalTLSFingerprint: c.GetHeader(HeaderTLSFingerprint),
+	} {
+		if value != "" {
+			ctx[signal] = value
+		}
+	}
+	return ctx
+}
+
+// Factor scores the behavior factor from the request's signals. Each
+// signal earns more the more often it has been seen; a value never seen
+// before earns nothing. Scoring never changes the profile, see Record.
+func (p *BehaviorProfiles) Factor() FactorProvider {
+	return FactorFunc(FactorBehavior, func(ctx context.Context, in Input) (FactorResult, error) {
+		profile, _, err := p.load(ctx, in.Subject)
+		if err != nil {
+			return FactorResult{}, err
+		}
+		if len(profile) == 0 {
+			return FactorResult{Score: 0.8, Reason: "no client history"}, nil
+		}
+
+		var total float64
+		var compared int
+		var changed []string
+		evidence := make(map[string]string)
+		for _, signal := range behaviorSignals {
+			value, known := in.Context[signal], profile[signal]
+			if value == "" || len(known) == 0 {
+				continue
+			}
+			compared++
+			count := 0
+			if i := findSignal(known, hashSignal(value)); i >= 0 {
+				count = known[i].Count
+			}
+			if count == 0 {
+				changed = append(changed, strings.ReplaceAll(signal, "_", " "))
+				evidence[signal] = "new"
+				continue
+			}
+			total += 0.4 + 0.6*math.Min(1, float64(count)/float64(p.config.ConsistentAfter))
+			evidence[signal] = "seen " + strconv.Itoa(count) + " times"
+		}
+		switch {
+		case compared == 0:
+			return FactorResult{Score: 0.8, Reason: "no client signals"}, nil
+		case len(changed) > 0:
+			return FactorResult{Score: total / float64(compared), Reason: "new " + strings.Join(changed, ", "), Evidence: evidence}, nil
+		default:
+			return FactorResult{Score: total / float64(compared), Reason: "consistent client", Evidence: evidence}, nil
+		}
+	})
+}
+
+// Record adds signals to subject's profile
+func (p *BehaviorProfiles) Record(ctx context.Context, subject string, signals map[string]string) error {
+	for attempt := 0; attempt < behaviorAttempts; attempt++ {
+		profile, old, err := p.load(ctx, subject)
+		if err != nil {
+			return err
+		}
+		now := p.now().UTC()
+		for _, signal := range behaviorSignals {
+			if value := signals[signal]; value != "" {
+				profile[signal] = p.observe(profile[signal], hashSignal(value), now)
+			}
+		}
+		data, err := json.Marshal(profile)
+		if err != nil {
+			return err
+		}
+		swapped, err := p.store.CompareAndSwap(ctx, behaviorPrefix+subject, old, data, p.config.TTL)
+		if err != nil || swapped {
+			return err
+		}
+	}
+	return fmt.Errorf("client profile of %q is being updated concurrently", subject)
+}
+
+// Middleware records the signals of authenticated requests once they have
+// been handled, so a request is scored against the history before it
+func (p *BehaviorProfiles) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+		user, ok := currentUser(c)
+		if !ok || user.ID == "" {
+			return
+		}
+		if err := p.Record(c.Request.Context(), user.ID, RequestContext(c)); err != nil {
+			p.logger.Warn("Failed to record client signals", "user_id", user.ID, "error", err)
+		}
+	}
+}
+
+// observe counts one sighting of hash, forgetting the least recently seen
+// value when more than MaxValues are known
+func (p *BehaviorProfiles) observe(known []signalValue, hash string, now time.Time) []signalValue {
+	if i := findSignal(known, hash); i >= 0 {
+		known[i].Count++
+		known[i].LastSeen = now
+	} else {
+		known = append(known, signalValue{Hash: hash, Count: 1, LastSeen: now})
+	}
+	sort.SliceStable(known, func(i, j int) bool { return known[i].LastSeen.After(known[j].LastSeen) })
+	if len(known) > p.config.MaxValues {
+		known = known[:p.config.MaxValues]
+	}
+	return known
+}
+
+func (p *BehaviorProfiles) load(ctx context.Context, subject string) (map[string][]signalValue, []byte, error) {
+	profile := make(map[string][]signalValue)
+	data, err := p.store.Get(ctx, behaviorPrefix+subject)
+	if errors.Is(err, store.ErrNotFound) {
+		return profile, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := json.Unmarshal(data, &profile); err != nil {
+		return nil, nil, err
+	}
+	return profile, data, nil
+}
+
+func findSignal(known []signalValue, hash string) int {
+	for i, v := range known {
+		if v.Hash == hash {
+			return i
+		}
+	}
+	return -1
+}
+
+// hashSignal keeps raw user agents and fingerprints out of the store
+func hashSignal(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:16])
+}
@@ -0,0 +1,155 @@
+package trust
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/session"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+// Actions continuous verification takes on a session
+const (
+	ActionNone      = "none"
+	ActionDowngrade = "downgrade"
+	ActionRestore   = "restore"
+	ActionReauth    = "reauth"
+	ActionTerminate = "terminate"
+)
+
+// verificationLease makes one replica verify all sessions per round
+const verificationLease = "verification:lease"
+
+// VerificationConfig configures continuous verification. A session whose
+// user scores below a level gets the action for the lowest level crossed.
+type VerificationConfig struct {
+	// Interval between rounds; defaults to 1m
+	Interval time.Duration
+	// DowngradeBelow caps the session at the user's score, so sensitive
+	// routes require step-up; defaults to 50
+	DowngradeBelow int
+	// ReauthBelow ends the session at its next use; defaults to 25
+	ReauthBelow int
+	// TerminateBelow ends the session at once; 0 disables it
+	TerminateBelow int
+	// OnAction, when set, is called for every action other than
+	// ActionNone, e.g. to record it in the audit log
+	OnAction func(ctx context.Context, sess *session.Session, action string, score *interfaces.TrustScore)
+}
+
+// SessionVerifier periodically re-scores the users of active sessions and
+// downgrades, forces re-authentication of or terminates the sessions whose
+// risk has grown since login
+type SessionVerifier struct {
+	config   VerificationConfig
+	sessions *session.Manager
+	scorer   Scorer
+	store    store.Store
+	logger   interfaces.Logger
+	metrics  interfaces.MetricsCollector
+}
+
+// NewSessionVerifier creates a verifier; metrics may be nil
+func NewSessionVerifier(cfg VerificationConfig, sessions *session.Manager, scorer Scorer, s store.Store, logger interfaces.Logger, metrics interfaces.MetricsCollector) *SessionVerifier {
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Minute
+	}
+	if cfg.DowngradeBelow <= 0 {
+		cfg.DowngradeBelow = 50
+	}
+	if cfg.ReauthBelow <= 0 {
+		cfg.ReauthBelow = 25
+	}
+	return &SessionVerifier{config: cfg, sessions: sessions, scorer: scorer, store: s, logger: logger, metrics: metrics}
+}
+
+// Start verifies every Interval until ctx is cancelled. Only one replica
+// runs each round.
+func (v *SessionVerifier) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(v.config.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				// The lease lapses just before the next tick so a round is
+				// rarely skipped
+				n, _, err := v.store.Incr(ctx, verificationLease, v.config.Interval*9/10)
+				if err != nil {
+					v.logger.Warn("Failed to acquire verification lease", "error", err)
+					continue
+				}
+				if n == 1 {
+					if err := v.VerifyAll(ctx); err != nil {
+						v.logger.Warn("Session verification failed", "error", err)
+					}
+				}
+			}
+		}
+	}()
+}
+
+// VerifyAll verifies every live session once
+func (v *SessionVerifier) VerifyAll(ctx context.Context) error {
+	sessions, err := v.sessions.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, sess := range sessions {
+		if _, err := v.Verify(ctx, sess); err != nil {
+			v.logger.Warn("Failed to verify session", "user_id", sess.User.ID, "error", err)
+		}
+	}
+	return nil
+}
+
+// Verify re-scores the user of sess and acts on the session, returning the
+// action taken
+func (v *SessionVerifier) Verify(ctx context.Context, sess *session.Session) (string, error) {
+	in := Input{Subject: sess.User.ID, Context: map[string]string{}}
+	if sess.IP != "" {
+		in.Context["ip"] = sess.IP
+	}
+	score, err := v.scorer.Score(ctx, in)
+	if err != nil {
+		return ActionNone, err
+	}
+
+	action := ActionNone
+	switch level := score.Overall; {
+	case level < v.config.TerminateBelow:
+		action, err = ActionTerminate, v.sessions.Terminate(ctx, sess.ID)
+	case level < v.config.ReauthBelow:
+		if !sess.ReauthRequired {
+			action, err = ActionReauth, v.sessions.RequireReauth(ctx, sess.ID)
+		}
+	case level < v.config.DowngradeBelow:
+		if sess.TrustCap == 0 || level < sess.TrustCap {
+			action, err = ActionDowngrade, v.sessions.Downgrade(ctx, sess.ID, level)
+		}
+	case sess.TrustCap != 0 && sess.UnconfirmedDevice == "":
+		action, err = ActionRestore, v.sessions.Downgrade(ctx, sess.ID, 0)
+	}
+	if errors.Is(err, session.ErrNoSession) {
+		// Ended while being verified
+		return ActionNone, nil
+	}
+	if err != nil {
+		return ActionNone, err
+	}
+
+	if v.metrics != nil {
+		v.metrics.IncrementCounter("session_verifications_total", map[string]string{"action": action})
+	}
+	if action != ActionNone {
+		v.logger.Info("Session verification acted", "user_id", sess.User.ID, "action", action, "score", score.Overall)
+		if v.config.OnAction != nil {
+			v.config.OnAction(ctx, sess, action, score)
+		}
+	}
+	return action, nil
+}
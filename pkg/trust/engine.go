@@ -0,0 +1,230 @@
+package trust
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+)
+
+// Built-in trust score factors, in the order they are reported. Custom
+// factors follow them in name order.
+const (
+	FactorIdentity = "identity"
+	FactorDevice   = "device"
+	FactorBehavior = "behavior"
+	FactorLocation = "location"
+	FactorRisk     = "risk"
+)
+
+var factorNames = []string{FactorIdentity, FactorDevice, FactorBehavior, FactorLocation, FactorRisk}
+
+// DefaultWeights are the points each factor contributes at full confidence
+var DefaultWeights = map[string]int{
+	FactorIdentity: 30,
+	FactorDevice:   25,
+	FactorBehavior: 20,
+	FactorLocation: 15,
+	FactorRisk:     10,
+}
+
+// validFactorName matches custom factor names, which appear in
+// TRUST_WEIGHTS and metric labels
+var validFactorName = regexp.MustCompile(`^[a-z][a-z0-9_]{0,31}$`)
+
+// FactorResult is one provider's assessment: Score from 0 (no trust) to 1
+// (full trust), the reason for it and optionally the evidence it used
+type FactorResult struct {
+	Score    float64
+	Reason   string
+	Evidence map[string]string
+}
+
+// FactorProvider assesses one trust factor of an input
+type FactorProvider interface {
+	// Name is one of the Factor constants or a custom factor such as
+	// "clearance"
+	Name() string
+	Evaluate(ctx context.Context, in Input) (FactorResult, error)
+}
+
+// EngineConfig configures the score engine
+type EngineConfig struct {
+	// Weights maps factors to their points; they must add up to 100.
+	// Defaults to DefaultWeights, which leaves custom factors unweighted.
+	Weights map[string]int
+}
+
+// ScoreEngine computes trust scores from factor providers. Each factor
+// contributes its weight times the provider's score, and the result
+// explains every contribution.
+type ScoreEngine struct {
+	weights   map[string]int
+	providers map[string]FactorProvider
+	order     []string
+	logger    interfaces.Logger
+	metrics   interfaces.MetricsCollector
+}
+
+// NewScoreEngine creates an engine with one provider per weighted factor
+func NewScoreEngine(cfg EngineConfig, providers []FactorProvider, logger interfaces.Logger, metrics interfaces.MetricsCollector) (*ScoreEngine, error) {
+	weights := cfg.Weights
+	if len(weights) == 0 {
+		weights = DefaultWeights
+	}
+	total := 0
+	for name, weight := range weights {
+		if weight < 0 {
+			return nil, fmt.Errorf("trust factor %q has a negative weight", name)
+		}
+		total += weight
+	}
+	if total != 100 {
+		return nil, fmt.Errorf("trust factor weights must add up to 100, not %d", total)
+	}
+
+	e := &ScoreEngine{weights: weights, providers: make(map[string]FactorProvider), logger: logger, metrics: metrics}
+	var custom []string
+	for _, p := range providers {
+		name := p.Name()
+		if !validFactorName.MatchString(name) {
+			return nil, fmt.Errorf("invalid trust factor name %q", name)
+		}
+		if _, dup := e.providers[name]; dup {
+			return nil, fmt.Errorf("trust factor %q has more than one provider", name)
+		}
+		e.providers[name] = p
+		if !builtinFactor(name) {
+			custom = append(custom, name)
+		}
+	}
+	for name, weight := range weights {
+		if _, ok := e.providers[name]; ok {
+			continue
+		}
+		if !builtinFactor(name) {
+			return nil, fmt.Errorf("unknown trust factor %q", name)
+		}
+		if weight > 0 {
+			return nil, fmt.Errorf("no provider for trust factor %q", name)
+		}
+	}
+	sort.Strings(custom)
+	for _, name := range factorNames {
+		if _, ok := e.providers[name]; ok {
+			e.order = append(e.order, name)
+		}
+	}
+	e.order = append(e.order, custom...)
+	return e, nil
+}
+
+// ParseWeights reads weights such as "identity=30,device=25,behavior=20,
+// location=15,risk=10"; factors left out weigh nothing
+func ParseWeights(value string) (map[string]int, error) {
+	weights := make(map[string]int)
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		name, weight, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid trust weight %q", part)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(weight))
+		if err != nil {
+			return nil, fmt.Errorf("invalid trust weight %q", part)
+		}
+		weights[strings.TrimSpace(name)] = n
+	}
+	return weights, nil
+}
+
+// Score implements Scorer. A failing provider scores its factor as zero
+// rather than failing the whole score, so an outage lowers trust.
+func (e *ScoreEngine) Score(ctx context.Context, in Input) (*interfaces.TrustScore, error) {
+	score := &interfaces.TrustScore{
+		UserID:       in.Subject,
+		Timestamp:    time.Now().UTC(),
+		Context:      "score_engine",
+		Explanations: make([]interfaces.FactorExplanation, 0, len(e.order)),
+	}
+	for _, name := range e.order {
+		weight := e.weights[name]
+		result, err := e.providers[name].Evaluate(ctx, in)
+		if err != nil {
+			e.logger.Warn("Trust factor unavailable", "factor", name, "subject", in.Subject, "error", err)
+			if e.metrics != nil {
+				e.metrics.IncrementCounter("trust_factor_errors_total", map[string]string{"factor": name})
+			}
+			result = FactorResult{Reason: "unavailable"}
+		}
+		result.Score = math.Max(0, math.Min(1, result.Score))
+		points := int(math.Round(float64(weight) * result.Score))
+		setFactor(&score.Factors, name, points)
+		score.Overall += points
+		score.Explanations = append(score.Explanations, interfaces.FactorExplanation{
+			Factor:   name,
+			Weight:   weight,
+			Score:    result.Score,
+			Points:   points,
+			Reason:   result.Reason,
+			Evidence: result.Evidence,
+		})
+	}
+	return score, nil
+}
+
+// StaticFactor always returns score for factor name, for factors without a
+// signal source yet
+func StaticFactor(name string, score float64, reason string) FactorProvider {
+	return FactorFunc(name, func(context.Context, Input) (FactorResult, error) {
+		return FactorResult{Score: score, Reason: reason}, nil
+	})
+}
+
+// FactorFunc adapts fn to a FactorProvider for factor name
+func FactorFunc(name string, fn func(ctx context.Context, in Input) (FactorResult, error)) FactorProvider {
+	return &factorFunc{name: name, fn: fn}
+}
+
+type factorFunc struct {
+	name string
+	fn   func(ctx context.Context, in Input) (FactorResult, error)
+}
+
+func (f *factorFunc) Name() string { return f.name }
+
+func (f *factorFunc) Evaluate(ctx context.Context, in Input) (FactorResult, error) {
+	return f.fn(ctx, in)
+}
+
+func builtinFactor(name string) bool {
+	for _, known := range factorNames {
+		if name == known {
+			return true
+		}
+	}
+	return false
+}
+
+func setFactor(f *interfaces.TrustFactors, name string, points int) {
+	switch name {
+	case FactorIdentity:
+		f.Identity = points
+	case FactorDevice:
+		f.Device = points
+	case FactorBehavior:
+		f.Behavior = points
+	case FactorLocation:
+		f.Location = points
+	case FactorRisk:
+		f.Risk = points
+	}
+}
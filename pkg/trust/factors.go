@@ -0,0 +1,208 @@
+package trust
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Built-in factor providers. They read the input's Device and these
+// Context keys:
+//
+//	ip               client address
+//	auth_method      how the subject authenticated, e.g. "password"
+//	mfa              "true" when a second factor was used
+//	device_verified  "true" when the device passed attestation
+//	device_integrity the integrity platform attestation vouched for:
+//	                 "strong", "device" or "basic"
+//	device_bound     "true" when the request was signed by the subject's
+//	                 device with its hardware-bound key
+//	user_agent, accept_language, tls_fingerprint
+//	                 client signals, see RequestContext
+//	time             when the request is made, see InputTime
+//	endpoint         the route requested, see RequestContext
+
+// ProviderConfig holds the signal sources of the built-in providers; any
+// of them may be left unset
+type ProviderConfig struct {
+	Geo       GeoLocator
+	Locations LocationPolicy
+	// Behavior scores the behavior factor from client history
+	Behavior *BehaviorProfiles
+	// Risk scores the risk factor, e.g. a risk.Engine's Factor
+	Risk FactorProvider
+	// Device scores the device factor, e.g. a posture.Service's Factor;
+	// defaults to DeviceFactor
+	Device FactorProvider
+}
+
+// DefaultProviders returns the built-in providers. Factors without a source
+// get a fixed score.
+func DefaultProviders(cfg ProviderConfig) []FactorProvider {
+	behaviorFactor := StaticFactor(FactorBehavior, 0.9, "no behavioral anomalies recorded")
+	if cfg.Behavior != nil {
+		behaviorFactor = cfg.Behavior.Factor()
+	}
+	riskFactor := cfg.Risk
+	if riskFactor == nil {
+		riskFactor = StaticFactor(FactorRisk, 0.8, "no risk signals")
+	}
+	deviceFactor := cfg.Device
+	if deviceFactor == nil {
+		deviceFactor = DeviceFactor()
+	}
+	return []FactorProvider{
+		IdentityFactor(),
+		deviceFactor,
+		behaviorFactor,
+		LocationFactor(cfg.Geo, cfg.Locations),
+		riskFactor,
+	}
+}
+
+// IdentityFactor scores how strongly the subject authenticated
+func IdentityFactor() FactorProvider {
+	return FactorFunc(FactorIdentity, func(_ context.Context, in Input) (FactorResult, error) {
+		switch {
+		case in.Subject == "":
+			return FactorResult{Score: 0, Reason: "anonymous"}, nil
+		case in.Context["mfa"] == "true":
+			return FactorResult{Score: 1, Reason: "multi-factor authentication"}, nil
+		case in.Context["auth_method"] != "":
+			return FactorResult{Score: 0.8, Reason: "single-factor authentication (" + in.Context["auth_method"] + ")"}, nil
+		default:
+			return FactorResult{Score: 0.8, Reason: "single-factor authentication"}, nil
+		}
+	})
+}
+
+// DeviceFactor scores what is known about the device
+func DeviceFactor() FactorProvider {
+	return FactorFunc(FactorDevice, func(_ context.Context, in Input) (FactorResult, error) {
+		switch {
+		case in.Context[ContextDeviceState] == "blocked":
+			return FactorResult{Score: 0, Reason: "blocked device"}, nil
+		case in.Context[ContextDeviceState] == "quarantined":
+			return FactorResult{Score: 0, Reason: "quarantined device; it must be verified again"}, nil
+		case in.Context[ContextDeviceState] == "stale":
+			return FactorResult{Score: 0.4, Reason: "device not seen recently"}, nil
+		case in.Context[ContextDeviceCompliance] == "noncompliant":
+			return FactorResult{Score: 0.2, Reason: "device fails its MDM compliance policy"}, nil
+		case in.Context[ContextDeviceBound] == "true":
+			return FactorResult{Score: 1, Reason: "hardware-bound device", Evidence: map[string]string{"device": in.Context[ContextDeviceID]}}, nil
+		case in.Device == "":
+			return FactorResult{Score: 0.4, Reason: "unidentified device"}, nil
+		case in.Context["device_verified"] != "true":
+			return FactorResult{Score: 0.8, Reason: "identified device"}, nil
+		}
+		switch in.Context["device_integrity"] {
+		case "strong":
+			return FactorResult{Score: 1, Reason: "hardware-backed device integrity"}, nil
+		case "device":
+			return FactorResult{Score: 1, Reason: "genuine device"}, nil
+		case "basic":
+			return FactorResult{Score: 0.6, Reason: "basic integrity only; the device may be rooted or emulated"}, nil
+		default:
+			return FactorResult{Score: 1, Reason: "verified device"}, nil
+		}
+	})
+}
+
+// LocationPolicy restricts where callers are trusted from. Empty lists
+// allow everything.
+type LocationPolicy struct {
+	// AllowedCountries are ISO 3166 codes such as "US"
+	AllowedCountries []string
+	// AllowedASNs are the autonomous systems of, e.g., corporate networks
+	// and VPN providers
+	AllowedASNs []uint32
+}
+
+// ParseCountries reads a comma-separated list of country codes
+func ParseCountries(value string) []string {
+	var countries []string
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.ToUpper(strings.TrimSpace(part)); part != "" {
+			countries = append(countries, part)
+		}
+	}
+	return countries
+}
+
+// ParseASNs reads a comma-separated list of AS numbers, with or without the
+// "AS" prefix
+func ParseASNs(value string) ([]uint32, error) {
+	var asns []uint32
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(part)), "AS")
+		if part == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ASN %q", part)
+		}
+		asns = append(asns, uint32(n))
+	}
+	return asns, nil
+}
+
+// LocationFactor scores the client address: internal networks are trusted
+// most, then addresses geo places inside the policy. Addresses outside the
+// allowed countries score nothing; outside the allowed ASNs, little.
+func LocationFactor(geo GeoLocator, policy LocationPolicy) FactorProvider {
+	return FactorFunc(FactorLocation, func(_ context.Context, in Input) (FactorResult, error) {
+		ip := net.ParseIP(in.Context["ip"])
+		switch {
+		case ip == nil:
+			return FactorResult{Score: 0.5, Reason: "unknown address"}, nil
+		case ip.IsLoopback() || ip.IsPrivate():
+			return FactorResult{Score: 1, Reason: "internal network"}, nil
+		}
+		var location *Location
+		if geo != nil {
+			location, _ = geo.Locate(ip)
+		}
+		if location == nil {
+			return FactorResult{Score: 0.5, Reason: "unknown location"}, nil
+		}
+
+		evidence := map[string]string{"country": location.Country}
+		if location.City != "" {
+			evidence["city"] = location.City
+		}
+		if location.ASN != 0 {
+			evidence["asn"] = strconv.FormatUint(uint64(location.ASN), 10)
+		}
+		switch {
+		case len(policy.AllowedCountries) > 0 && !containsString(policy.AllowedCountries, location.Country):
+			return FactorResult{Score: 0, Reason: "located in " + location.Country + ", outside the allowed countries", Evidence: evidence}, nil
+		case len(policy.AllowedASNs) > 0 && !containsASN(policy.AllowedASNs, location.ASN):
+			return FactorResult{Score: 0.3, Reason: "network outside the allowed ASNs", Evidence: evidence}, nil
+		case len(policy.AllowedCountries) > 0 || len(policy.AllowedASNs) > 0:
+			return FactorResult{Score: 1, Reason: "located in " + location.Country + ", an allowed location", Evidence: evidence}, nil
+		default:
+			return FactorResult{Score: 0.8, Reason: "located in " + location.Country, Evidence: evidence}, nil
+		}
+	})
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsASN(list []uint32, asn uint32) bool {
+	for _, v := range list {
+		if v == asn {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,148 @@
+package trust
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Location is where an IP address is registered, and optionally the
+// autonomous system announcing it
+type Location struct {
+	Country      string  `json:"country,omitempty"`
+	City         string  `json:"city,omitempty"`
+	Latitude     float64 `json:"latitude"`
+	Longitude    float64 `json:"longitude"`
+	ASN          uint32  `json:"asn,omitempty"`
+	Organization string  `json:"organization,omitempty"`
+}
+
+// GeoLocator resolves IP addresses to locations. Addresses it cannot place,
+// such as private ranges, return false.
+type GeoLocator interface {
+	Locate(ip net.IP) (*Location, bool)
+}
+
+// GeoIPRange maps a network to a location in a GeoIP file
+type GeoIPRange struct {
+	CIDR string `json:"cidr"`
+	Location
+}
+
+// CIDRLocator is a GeoLocator over a static table of networks, for demos
+// and for exports of commercial GeoIP databases
+type CIDRLocator struct {
+	ranges []cidrLocation
+}
+
+type cidrLocation struct {
+	network  *net.IPNet
+	location Location
+}
+
+// NewCIDRLocator indexes ranges; the most specific network wins
+func NewCIDRLocator(ranges []GeoIPRange) (*CIDRLocator, error) {
+	l := &CIDRLocator{ranges: make([]cidrLocation, 0, len(ranges))}
+	for _, r := range ranges {
+		_, network, err := net.ParseCIDR(r.CIDR)
+		if err != nil {
+			return nil, fmt.Errorf("invalid GeoIP range %q: %w", r.CIDR, err)
+		}
+		if r.Latitude < -90 || r.Latitude > 90 || r.Longitude < -180 || r.Longitude > 180 {
+			return nil, fmt.Errorf("invalid coordinates for GeoIP range %q", r.CIDR)
+		}
+		l.ranges = append(l.ranges, cidrLocation{network: network, location: r.Location})
+	}
+	sort.SliceStable(l.ranges, func(i, j int) bool {
+		a, _ := l.ranges[i].network.Mask.Size()
+		b, _ := l.ranges[j].network.Mask.Size()
+		return a > b
+	})
+	return l, nil
+}
+
+// LoadGeoIP reads a JSON array of GeoIPRange from path
+func LoadGeoIP(path string) (*CIDRLocator, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read GeoIP file: %w", err)
+	}
+	var ranges []GeoIPRange
+	if err := json.Unmarshal(data, &ranges); err != nil {
+		return nil, fmt.Errorf("failed to parse GeoIP file: %w", err)
+	}
+	return NewCIDRLocator(ranges)
+}
+
+// Locate implements GeoLocator
+func (l *CIDRLocator) Locate(ip net.IP) (*Location, bool) {
+	for _, r := range l.ranges {
+		if r.network.Contains(ip) {
+			location := r.location
+			return &location, true
+		}
+	}
+	return nil, false
+}
+
+// CachedLocator remembers the most recent lookups of a slower GeoLocator,
+// such as MMDBLocator, including addresses it could not place
+type CachedLocator struct {
+	geo     GeoLocator
+	size    int
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type cachedLocation struct {
+	ip       string
+	location *Location
+	found    bool
+}
+
+// NewCachedLocator caches up to size lookups of geo, evicting the least
+// recently used
+func NewCachedLocator(geo GeoLocator, size int) *CachedLocator {
+	return &CachedLocator{geo: geo, size: size, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// Locate implements GeoLocator
+func (l *CachedLocator) Locate(ip net.IP) (*Location, bool) {
+	key := ip.String()
+	l.mu.Lock()
+	if e, ok := l.entries[key]; ok {
+		l.order.MoveToFront(e)
+		entry := e.Value.(*cachedLocation)
+		l.mu.Unlock()
+		return copyLocation(entry.location), entry.found
+	}
+	l.mu.Unlock()
+
+	location, found := l.geo.Locate(ip)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.entries[key]; !ok && l.size > 0 {
+		l.entries[key] = l.order.PushFront(&cachedLocation{ip: key, location: copyLocation(location), found: found})
+		if l.order.Len() > l.size {
+			oldest := l.order.Back()
+			l.order.Remove(oldest)
+			delete(l.entries, oldest.Value.(*cachedLocation).ip)
+		}
+	}
+	return location, found
+}
+
+// copyLocation keeps callers from modifying cached locations
+func copyLocation(location *Location) *Location {
+	if location == nil {
+		return nil
+	}
+	c := *location
+	return &c
+}
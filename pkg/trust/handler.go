@@ -0,0 +1,108 @@
+package trust
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lsendel/impl-zamaz/pkg/i18n"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+)
+
+// MaxBatchSize bounds the tuples in one POST /trust-score/evaluate
+const MaxBatchSize = 100
+
+// Evaluator scores batches of inputs for resource servers
+type Evaluator struct {
+	scorer  Scorer
+	levels  AccessLevels
+	logger  interfaces.Logger
+	metrics interfaces.MetricsCollector
+}
+
+// NewEvaluator creates an evaluator; levels defaults to DefaultThresholds
+// and metrics may be nil
+func NewEvaluator(scorer Scorer, levels AccessLevels, logger interfaces.Logger, metrics interfaces.MetricsCollector) *Evaluator {
+	return &Evaluator{scorer: scorer, levels: levelsOrDefault(levels), logger: logger, metrics: metrics}
+}
+
+// Result is the evaluation of one input. Errors are reported per input so
+// one bad tuple does not fail the batch.
+type Result struct {
+	Index        int                            `json:"index"`
+	Subject      string                         `json:"subject"`
+	Device       string                         `json:"device,omitempty"`
+	Score        int                            `json:"score"`
+	Factors      *interfaces.TrustFactors       `json:"factors,omitempty"`
+	Explanations []interfaces.FactorExplanation `json:"explanations,omitempty"`
+	AccessLevel  string                         `json:"access_level"`
+	Access       []string                       `json:"access"`
+	Error        string                         `json:"error,omitempty"`
+	Code         string                         `json:"code,omitempty"`
+}
+
+// RegisterRoutes mounts POST /trust-score/evaluate
+func (e *Evaluator) RegisterRoutes(r gin.IRoutes) {
+	r.POST("/trust-score/evaluate", e.handleEvaluate)
+}
+
+func (e *Evaluator) handleEvaluate(c *gin.Context) {
+	var req struct {
+		Evaluations []Input `json:"evaluations" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.Evaluations) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": i18n.Message(c, "VALIDATION_ERROR"),
+			"code":  "VALIDATION_ERROR",
+		})
+		return
+	}
+	if len(req.Evaluations) > MaxBatchSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"error":    i18n.Message(c, "BATCH_TOO_LARGE"),
+			"code":     "BATCH_TOO_LARGE",
+			"max_size": MaxBatchSize,
+		})
+		return
+	}
+
+	start := time.Now()
+	thresholds := e.levels.Thresholds(c.Request.Context())
+	results := make([]Result, len(req.Evaluations))
+	for i, in := range req.Evaluations {
+		results[i] = e.evaluate(c, i, in, thresholds)
+	}
+
+	if e.metrics != nil {
+		e.metrics.ObserveHistogram("trust_batch_size", float64(len(results)), nil)
+		e.metrics.ObserveHistogram("trust_batch_duration_seconds", time.Since(start).Seconds(), nil)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"results":      results,
+		"count":        len(results),
+		"evaluated_at": time.Now().UTC(),
+	})
+}
+
+func (e *Evaluator) evaluate(c *gin.Context, index int, in Input, thresholds []Threshold) Result {
+	result := Result{Index: index, Subject: in.Subject, Device: in.Device, AccessLevel: AccessNone, Access: []string{}}
+	if in.Subject == "" {
+		result.Code = "VALIDATION_ERROR"
+		result.Error = i18n.Message(c, result.Code)
+		return result
+	}
+
+	score, err := e.scorer.Score(c.Request.Context(), in)
+	if err != nil {
+		e.logger.Error("Trust evaluation failed", "subject", in.Subject, "error", err)
+		result.Code = "INTERNAL_ERROR"
+		result.Error = i18n.Message(c, result.Code)
+		return result
+	}
+	result.Score = score.Overall
+	result.Factors = &score.Factors
+	result.Explanations = score.Explanations
+	result.AccessLevel, result.Access = AccessLevel(score.Overall, thresholds)
+	return result
+}
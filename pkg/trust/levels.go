@@ -0,0 +1,102 @@
+package trust
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/lsendel/impl-zamaz/pkg/admin"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+)
+
+// AccessLevels supplies the thresholds mapping scores to access levels
+type AccessLevels interface {
+	Thresholds(ctx context.Context) []Threshold
+}
+
+// StaticLevels are fixed thresholds sorted by MinScore
+type StaticLevels []Threshold
+
+// Thresholds implements AccessLevels
+func (l StaticLevels) Thresholds(context.Context) []Threshold { return l }
+
+// ThresholdSource loads the configured thresholds, returning none when
+// nothing is configured
+type ThresholdSource func(ctx context.Context) ([]Threshold, error)
+
+// AdminThresholds reads the access policy named "default" from m
+func AdminThresholds(m *admin.Manager) ThresholdSource {
+	return func(ctx context.Context) ([]Threshold, error) {
+		res, err := m.Get(ctx, admin.AccessPolicyKind().Name, "default")
+		if errors.Is(err, admin.ErrNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var spec admin.AccessPolicySpec
+		if err := json.Unmarshal(res.Spec, &spec); err != nil {
+			return nil, err
+		}
+		thresholds := make([]Threshold, len(spec.Levels))
+		for i, level := range spec.Levels {
+			thresholds[i] = Threshold{Level: level.Level, MinScore: level.MinScore}
+		}
+		return thresholds, nil
+	}
+}
+
+// AccessPolicy serves the thresholds from a source, which is reloaded at
+// most every cacheTTL so changes apply on every replica without a restart.
+// It falls back to DefaultThresholds while nothing is configured and keeps
+// the last thresholds it loaded while the source fails.
+type AccessPolicy struct {
+	source   ThresholdSource
+	cacheTTL time.Duration
+	logger   interfaces.Logger
+	now      func() time.Time
+
+	mu         sync.Mutex
+	thresholds []Threshold
+	loadedAt   time.Time
+}
+
+// NewAccessPolicy creates a policy over source; cacheTTL defaults to 10s
+func NewAccessPolicy(source ThresholdSource, cacheTTL time.Duration, logger interfaces.Logger) *AccessPolicy {
+	if cacheTTL <= 0 {
+		cacheTTL = 10 * time.Second
+	}
+	return &AccessPolicy{source: source, cacheTTL: cacheTTL, logger: logger, now: time.Now}
+}
+
+// Thresholds implements AccessLevels
+func (p *AccessPolicy) Thresholds(ctx context.Context) []Threshold {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.thresholds != nil && p.now().Sub(p.loadedAt) < p.cacheTTL {
+		return p.thresholds
+	}
+	thresholds, err := p.source(ctx)
+	if err != nil {
+		p.logger.Warn("Failed to load access levels", "error", err)
+		if p.thresholds == nil {
+			return DefaultThresholds
+		}
+		return p.thresholds
+	}
+	if len(thresholds) == 0 {
+		thresholds = DefaultThresholds
+	}
+	p.thresholds, p.loadedAt = thresholds, p.now()
+	return thresholds
+}
+
+// levelsOrDefault returns levels, or DefaultThresholds when it is nil
+func levelsOrDefault(levels AccessLevels) AccessLevels {
+	if levels == nil {
+		return StaticLevels(DefaultThresholds)
+	}
+	return levels
+}
@@ -0,0 +1,377 @@
+package trust
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+)
+
+// mmdbMetadataMarker precedes the metadata at the end of a MaxMind DB file
+var mmdbMetadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+// mmdbDataSeparator is the run of zero bytes between tree and data section
+const mmdbDataSeparator = 16
+
+// errMMDBCorrupt is returned for databases that do not follow the format
+var errMMDBCorrupt = errors.New("corrupt MaxMind database")
+
+// MMDBLocator is a GeoLocator over MaxMind DB files (GeoIP2/GeoLite2 City or
+// Country, optionally with an ASN database), read with a built-in decoder
+// so no C library or extra module is needed.
+type MMDBLocator struct {
+	location *mmdbReader
+	asn      *mmdbReader
+}
+
+// OpenMMDB loads the City or Country database at path and, unless asnPath is
+// empty, the ASN database at asnPath
+func OpenMMDB(path, asnPath string) (*MMDBLocator, error) {
+	l := &MMDBLocator{}
+	var err error
+	if l.location, err = openMMDBReader(path); err != nil {
+		return nil, err
+	}
+	if asnPath != "" {
+		if l.asn, err = openMMDBReader(asnPath); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// Locate implements GeoLocator
+func (l *MMDBLocator) Locate(ip net.IP) (*Location, bool) {
+	record, ok := l.location.lookup(ip)
+	if !ok {
+		return nil, false
+	}
+	location := &Location{
+		Country:   mmdbString(record, "country", "iso_code"),
+		City:      mmdbString(record, "city", "names", "en"),
+		Latitude:  mmdbFloat(record, "location", "latitude"),
+		Longitude: mmdbFloat(record, "location", "longitude"),
+	}
+	if location.Country == "" {
+		location.Country = mmdbString(record, "registered_country", "iso_code")
+	}
+	if l.asn != nil {
+		if record, ok := l.asn.lookup(ip); ok {
+			location.ASN = uint32(mmdbFloat(record, "autonomous_system_number"))
+			location.Organization = mmdbString(record, "autonomous_system_organization")
+		}
+	}
+	return location, true
+}
+
+// mmdbReader searches one MaxMind DB file held in memory
+type mmdbReader struct {
+	tree       []byte
+	section    []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	// ipv4Start is the node reached after the 96 zero bits that prefix
+	// IPv4 addresses in an IPv6 tree
+	ipv4Start uint
+}
+
+func openMMDBReader(path string) (*mmdbReader, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read MaxMind database: %w", err)
+	}
+	r, err := newMMDBReader(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return r, nil
+}
+
+func newMMDBReader(data []byte) (*mmdbReader, error) {
+	start := bytes.LastIndex(data, mmdbMetadataMarker)
+	if start < 0 {
+		return nil, errMMDBCorrupt
+	}
+	start += len(mmdbMetadataMarker)
+	value, _, err := (&mmdbDecoder{buf: data[start:]}).decode(0)
+	if err != nil {
+		return nil, err
+	}
+	meta, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errMMDBCorrupt
+	}
+	r := &mmdbReader{
+		nodeCount:  uint(mmdbFloat(meta, "node_count")),
+		recordSize: uint(mmdbFloat(meta, "record_size")),
+		ipVersion:  uint(mmdbFloat(meta, "ip_version")),
+	}
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported MaxMind record size %d", r.recordSize)
+	}
+	if r.ipVersion != 4 && r.ipVersion != 6 {
+		return nil, fmt.Errorf("unsupported MaxMind IP version %d", r.ipVersion)
+	}
+	treeSize := r.nodeCount * r.recordSize / 4
+	if treeSize+mmdbDataSeparator > uint(start) {
+		return nil, errMMDBCorrupt
+	}
+	r.tree = data[:treeSize]
+	r.section = data[treeSize+mmdbDataSeparator : start-len(mmdbMetadataMarker)]
+
+	if r.ipVersion == 6 {
+		for i := 0; i < 96 && r.ipv4Start < r.nodeCount; i++ {
+			r.ipv4Start = r.record(r.ipv4Start, 0)
+		}
+	}
+	return r, nil
+}
+
+// lookup returns the record for ip, or false when the database has none
+func (r *mmdbReader) lookup(ip net.IP) (map[string]interface{}, bool) {
+	node, bits := uint(0), ip.To4()
+	switch {
+	case bits != nil && r.ipVersion == 6:
+		node = r.ipv4Start
+	case bits == nil && r.ipVersion == 4:
+		return nil, false
+	case bits == nil:
+		if bits = ip.To16(); bits == nil {
+			return nil, false
+		}
+	}
+	for i := 0; i < len(bits)*8 && node < r.nodeCount; i++ {
+		bit := uint(bits[i/8]>>(7-uint(i%8))) & 1
+		node = r.record(node, bit)
+	}
+	if node <= r.nodeCount {
+		return nil, false
+	}
+	offset := node - r.nodeCount - mmdbDataSeparator
+	value, _, err := (&mmdbDecoder{buf: r.section}).decode(offset)
+	record, ok := value.(map[string]interface{})
+	return record, err == nil && ok
+}
+
+// record reads the left (bit 0) or right (bit 1) record of node
+func (r *mmdbReader) record(node, bit uint) uint {
+	b := r.tree[node*r.recordSize/4:]
+	switch r.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// MaxMind DB data types
+const (
+	mmdbTypeExtended = iota
+	mmdbTypePointer
+	mmdbTypeString
+	mmdbTypeDouble
+	mmdbTypeBytes
+	mmdbTypeUint16
+	mmdbTypeUint32
+	mmdbTypeMap
+	mmdbTypeInt32
+	mmdbTypeUint64
+	mmdbTypeUint128
+	mmdbTypeArray
+	mmdbTypeContainer
+	mmdbTypeEndMarker
+	mmdbTypeBool
+	mmdbTypeFloat
+)
+
+// mmdbDecoder decodes the data section format. Numbers decode to float64
+// and strings, maps and arrays to their Go equivalents; 128-bit integers
+// and raw bytes decode to []byte.
+type mmdbDecoder struct {
+	buf   []byte
+	depth int
+}
+
+// mmdbMaxDepth bounds nesting so crafted files cannot loop through pointers
+const mmdbMaxDepth = 32
+
+// decode returns the value at offset and the offset after it
+func (d *mmdbDecoder) decode(offset uint) (interface{}, uint, error) {
+	if d.depth++; d.depth > mmdbMaxDepth {
+		return nil, 0, errMMDBCorrupt
+	}
+	defer func() { d.depth-- }()
+	typ, size, offset, err := d.control(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	if typ == mmdbTypePointer {
+		target, next, err := d.pointer(size, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		value, _, err := d.decode(target)
+		return value, next, err
+	}
+	return d.value(typ, size, offset)
+}
+
+// control reads a control byte and any extended type and size bytes
+func (d *mmdbDecoder) control(offset uint) (typ, size, next uint, err error) {
+	if offset >= uint(len(d.buf)) {
+		return 0, 0, 0, errMMDBCorrupt
+	}
+	ctrl := d.buf[offset]
+	offset++
+	typ = uint(ctrl >> 5)
+	if typ == mmdbTypeExtended {
+		if offset >= uint(len(d.buf)) {
+			return 0, 0, 0, errMMDBCorrupt
+		}
+		typ = 7 + uint(d.buf[offset])
+		offset++
+	}
+	if typ == mmdbTypePointer {
+		return typ, uint(ctrl & 0x1F), offset, nil
+	}
+	size = uint(ctrl & 0x1F)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > uint(len(d.buf)) {
+			return 0, 0, 0, errMMDBCorrupt
+		}
+		extra := uintFromBytes(d.buf[offset : offset+n])
+		offset += n
+		switch size {
+		case 29:
+			size = 29 + extra
+		case 30:
+			size = 285 + extra
+		default:
+			size = 65821 + extra
+		}
+	}
+	return typ, size, offset, nil
+}
+
+// pointer resolves a pointer whose control bits were bits
+func (d *mmdbDecoder) pointer(bits, offset uint) (target, next uint, err error) {
+	n := (bits>>3)&0x3 + 1
+	if offset+n > uint(len(d.buf)) {
+		return 0, 0, errMMDBCorrupt
+	}
+	value := uintFromBytes(d.buf[offset : offset+n])
+	switch n {
+	case 1:
+		value |= (bits & 0x7) << 8
+	case 2:
+		value = (bits&0x7)<<16 | value + 2048
+	case 3:
+		value = (bits&0x7)<<24 | value + 526336
+	}
+	return value, offset + n, nil
+}
+
+func (d *mmdbDecoder) value(typ, size, offset uint) (interface{}, uint, error) {
+	if typ != mmdbTypeMap && typ != mmdbTypeArray && typ != mmdbTypeBool && offset+size > uint(len(d.buf)) {
+		return nil, 0, errMMDBCorrupt
+	}
+	end := offset + size
+	switch typ {
+	case mmdbTypeString:
+		return string(d.buf[offset:end]), end, nil
+	case mmdbTypeDouble:
+		if size != 8 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(d.buf[offset:end])), end, nil
+	case mmdbTypeFloat:
+		if size != 4 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(d.buf[offset:end]))), end, nil
+	case mmdbTypeUint16, mmdbTypeUint32, mmdbTypeUint64:
+		if size > 8 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return float64(uintFromBytes(d.buf[offset:end])), end, nil
+	case mmdbTypeInt32:
+		if size > 4 {
+			return nil, 0, errMMDBCorrupt
+		}
+		// Shortened int32s are zero padded, so only four bytes can be negative
+		return float64(int32(uint32(uintFromBytes(d.buf[offset:end])))), end, nil
+	case mmdbTypeBytes, mmdbTypeUint128:
+		return d.buf[offset:end], end, nil
+	case mmdbTypeBool:
+		return size != 0, offset, nil
+	case mmdbTypeMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			key, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, errMMDBCorrupt
+			}
+			if m[name], offset, err = d.decode(next); err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, offset, nil
+	case mmdbTypeArray:
+		a := make([]interface{}, size)
+		for i := range a {
+			var err error
+			if a[i], offset, err = d.decode(offset); err != nil {
+				return nil, 0, err
+			}
+		}
+		return a, offset, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported MaxMind data type %d", typ)
+	}
+}
+
+func uintFromBytes(b []byte) uint {
+	var v uint
+	for _, c := range b {
+		v = v<<8 | uint(c)
+	}
+	return v
+}
+
+// mmdbValue follows path through nested maps
+func mmdbValue(record map[string]interface{}, path ...string) interface{} {
+	var value interface{} = record
+	for _, key := range path {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = m[key]
+	}
+	return value
+}
+
+func mmdbString(record map[string]interface{}, path ...string) string {
+	s, _ := mmdbValue(record, path...).(string)
+	return s
+}
+
+func mmdbFloat(record map[string]interface{}, path ...string) float64 {
+	f, _ := mmdbValue(record, path...).(float64)
+	return f
+}
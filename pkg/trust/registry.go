@@ -0,0 +1,111 @@
+package trust
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// registry holds the custom factor providers registered by RegisterFactor
+var registry = struct {
+	sync.Mutex
+	providers map[string]FactorProvider
+}{providers: make(map[string]FactorProvider)}
+
+// RegisterFactor makes a custom provider, such as an HR status or clearance
+// check, available through RegisteredFactors. It is meant to be called from
+// the init function of the package defining the provider, and panics when
+// the name is invalid, built in or already registered. The factor counts
+// once it is given a weight, e.g. in TRUST_WEIGHTS.
+func RegisterFactor(p FactorProvider) {
+	registry.Lock()
+	defer registry.Unlock()
+	name := p.Name()
+	if !validFactorName.MatchString(name) || builtinFactor(name) {
+		panic(fmt.Sprintf("trust: invalid custom factor name %q", name))
+	}
+	if _, dup := registry.providers[name]; dup {
+		panic(fmt.Sprintf("trust: factor %q registered twice", name))
+	}
+	registry.providers[name] = p
+}
+
+// RegisteredFactors returns the registered custom providers sorted by name
+func RegisteredFactors() []FactorProvider {
+	registry.Lock()
+	defer registry.Unlock()
+	providers := make([]FactorProvider, 0, len(registry.providers))
+	for _, p := range registry.providers {
+		providers = append(providers, p)
+	}
+	sort.Slice(providers, func(i, j int) bool { return providers[i].Name() < providers[j].Name() })
+	return providers
+}
+
+// Breaker runs calls through a circuit breaker, returning an error without
+// calling fn while it is open; security.CircuitBreakerManager implements it
+type Breaker interface {
+	Execute(ctx context.Context, name string, fn func(ctx context.Context) error) error
+}
+
+// GuardOptions protect the engine from a slow or failing provider
+type GuardOptions struct {
+	// Timeout bounds each evaluation; zero leaves it unbounded
+	Timeout time.Duration
+	// Breaker, when set, stops calling the provider after repeated failures.
+	// Its breaker is named "trust_factor:<name>".
+	Breaker Breaker
+}
+
+// Guard wraps p with opts. An evaluation that overruns the timeout fails
+// even if p ignores its context, so the factor scores zero instead of
+// stalling the score.
+func Guard(p FactorProvider, opts GuardOptions) FactorProvider {
+	return &guardedFactor{provider: p, opts: opts}
+}
+
+type guardedFactor struct {
+	provider FactorProvider
+	opts     GuardOptions
+}
+
+func (g *guardedFactor) Name() string { return g.provider.Name() }
+
+func (g *guardedFactor) Evaluate(ctx context.Context, in Input) (FactorResult, error) {
+	if g.opts.Breaker == nil {
+		return g.evaluate(ctx, in)
+	}
+	var result FactorResult
+	err := g.opts.Breaker.Execute(ctx, "trust_factor:"+g.provider.Name(), func(ctx context.Context) error {
+		var err error
+		result, err = g.evaluate(ctx, in)
+		return err
+	})
+	return result, err
+}
+
+func (g *guardedFactor) evaluate(ctx context.Context, in Input) (FactorResult, error) {
+	if g.opts.Timeout <= 0 {
+		return g.provider.Evaluate(ctx, in)
+	}
+	ctx, cancel := context.WithTimeout(ctx, g.opts.Timeout)
+	defer cancel()
+
+	type outcome struct {
+		result FactorResult
+		err    error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		result, err := g.provider.Evaluate(ctx, in)
+		done <- outcome{result, err}
+	}()
+	select {
+	case o := <-done:
+		return o.result, o.err
+	case <-ctx.Done():
+		return FactorResult{}, fmt.Errorf("trust factor %q: %w", g.provider.Name(), ctx.Err())
+	}
+}
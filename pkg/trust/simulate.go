@@ -0,0 +1,138 @@
+package trust
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lsendel/impl-zamaz/pkg/i18n"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+)
+
+// Weights returns a copy of the points each factor contributes
+func (e *ScoreEngine) Weights() map[string]int {
+	weights := make(map[string]int, len(e.weights))
+	for name, weight := range e.weights {
+		weights[name] = weight
+	}
+	return weights
+}
+
+// Simulate scores in as the engine would with weights, or the engine's own
+// when weights is empty, and with the factors in fixed given those scores
+// instead of asking their providers. It fails when the weights or fixed
+// factors are invalid.
+func (e *ScoreEngine) Simulate(ctx context.Context, in Input, weights map[string]int, fixed map[string]float64) (*interfaces.TrustScore, error) {
+	if len(weights) == 0 {
+		weights = e.weights
+	}
+	for name, score := range fixed {
+		if _, ok := e.providers[name]; !ok {
+			return nil, fmt.Errorf("unknown trust factor %q", name)
+		}
+		if score < 0 || score > 1 {
+			return nil, fmt.Errorf("trust factor %q must score between 0 and 1", name)
+		}
+	}
+	providers := make([]FactorProvider, 0, len(e.order))
+	for _, name := range e.order {
+		if score, ok := fixed[name]; ok {
+			providers = append(providers, StaticFactor(name, score, "simulated"))
+		} else {
+			providers = append(providers, e.providers[name])
+		}
+	}
+	engine, err := NewScoreEngine(EngineConfig{Weights: weights}, providers, e.logger, nil)
+	if err != nil {
+		return nil, err
+	}
+	score, err := engine.Score(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	score.Timestamp = InputTime(in).UTC()
+	score.Context = "simulation"
+	return score, nil
+}
+
+// Simulator lets administrators try hypothetical inputs and weights
+// against the live factor providers before deploying them
+type Simulator struct {
+	engine *ScoreEngine
+	levels AccessLevels
+	logger interfaces.Logger
+}
+
+// NewSimulator creates a simulator for engine; levels defaults to
+// DefaultThresholds
+func NewSimulator(engine *ScoreEngine, levels AccessLevels, logger interfaces.Logger) *Simulator {
+	return &Simulator{engine: engine, levels: levelsOrDefault(levels), logger: logger}
+}
+
+// SimulationRequest is a hypothetical request. Context takes the keys the
+// providers read, e.g. "ip" for the location or "device_verified" for the
+// device status.
+type SimulationRequest struct {
+	Subject string            `json:"subject"`
+	Device  string            `json:"device"`
+	Context map[string]string `json:"context"`
+	// Time scores the request as if made then; defaults to now
+	Time *time.Time `json:"time"`
+	// Factors fixes factor scores from 0 to 1 instead of evaluating them
+	Factors map[string]float64 `json:"factors"`
+	// Weights replaces the configured weights; they must add up to 100
+	Weights map[string]int `json:"weights"`
+}
+
+// RegisterRoutes mounts POST /trust-score/simulate
+func (s *Simulator) RegisterRoutes(r gin.IRoutes) {
+	r.POST("/trust-score/simulate", s.handleSimulate)
+}
+
+func (s *Simulator) handleSimulate(c *gin.Context) {
+	var req SimulationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": i18n.Message(c, "VALIDATION_ERROR"),
+			"code":  "VALIDATION_ERROR",
+		})
+		return
+	}
+	in := Input{Subject: req.Subject, Device: req.Device, Context: make(map[string]string, len(req.Context)+1)}
+	for k, v := range req.Context {
+		in.Context[k] = v
+	}
+	if req.Time != nil {
+		in.Context[ContextTime] = req.Time.UTC().Format(time.RFC3339)
+	}
+
+	score, err := s.engine.Simulate(c.Request.Context(), in, req.Weights, req.Factors)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   i18n.Message(c, "VALIDATION_ERROR"),
+			"code":    "VALIDATION_ERROR",
+			"details": err.Error(),
+		})
+		return
+	}
+	weights := req.Weights
+	if len(weights) == 0 {
+		weights = s.engine.Weights()
+	}
+	thresholds := s.levels.Thresholds(c.Request.Context())
+	level, access := AccessLevel(score.Overall, thresholds)
+	s.logger.Info("Trust score simulated", "score", score.Overall, "access_level", level)
+	c.JSON(http.StatusOK, gin.H{
+		"score":        score.Overall,
+		"factors":      score.Factors,
+		"explanations": score.Explanations,
+		"weights":      weights,
+		"access_level": level,
+		"access":       access,
+		"thresholds":   thresholds,
+		"simulated_at": score.Timestamp,
+	})
+}
@@ -0,0 +1,428 @@
+package trust
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lsendel/impl-zamaz/pkg/auth"
+	"github.com/lsendel/impl-zamaz/pkg/i18n"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/middleware"
+	"github.com/lsendel/impl-zamaz/pkg/session"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+// Store key prefixes for step-up state
+const (
+	challengePrefix = "stepup:challenge:"
+	attemptsPrefix  = "stepup:attempts:"
+	elevationPrefix = "stepup:elevation:"
+)
+
+// ErrChallengeInvalid is returned for unknown, expired or foreign challenges
+var ErrChallengeInvalid = errors.New("step-up challenge is unknown, expired or belongs to another session")
+
+// Factor is a verification a caller can complete to raise their trust level,
+// such as auth.TOTP
+type Factor interface {
+	// Name identifies the factor in challenges and step-up requests
+	Name() string
+	// Enrolled reports whether userID can use the factor
+	Enrolled(ctx context.Context, userID string) bool
+	// Verify checks response for userID, returning auth.ErrInvalidCredentials
+	// when it is wrong
+	Verify(ctx context.Context, userID, response string) error
+}
+
+// StepUpConfig configures step-up authentication
+type StepUpConfig struct {
+	// ChallengeTTL bounds how long a challenge can be answered
+	ChallengeTTL time.Duration
+	// ElevationTTL is how long a completed step-up raises the trust level
+	ElevationTTL time.Duration
+	// MaxAttempts wrong responses, counted per user across challenges, burn
+	// the challenge and lock the user out of step-up
+	MaxAttempts int
+	// LockoutTime is how long after the first wrong response attempts are
+	// counted, and so how long a lockout lasts at most
+	LockoutTime time.Duration
+}
+
+// Challenge is an outstanding request to step up. Binding ties it to the
+// session or token it was issued to.
+type Challenge struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	Binding   string    `json:"binding"`
+	Required  int       `json:"required_trust_level"`
+	Methods   []string  `json:"methods"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Elevation raises the trust level of one session until ExpiresAt
+type Elevation struct {
+	Level     int       `json:"level"`
+	Method    string    `json:"method"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// StepUp enforces minimum trust levels and lets callers below one satisfy a
+// challenge to be elevated for a while. Challenges and elevations live in
+// the shared store, so any replica can answer them.
+type StepUp struct {
+	config  StepUpConfig
+	store   store.Store
+	scorer  Scorer
+	factors []Factor
+	logger  interfaces.Logger
+	metrics interfaces.MetricsCollector
+}
+
+// NewStepUp creates step-up enforcement over factors; metrics may be nil
+func NewStepUp(cfg StepUpConfig, s store.Store, scorer Scorer, factors []Factor, logger interfaces.Logger, metrics interfaces.MetricsCollector) *StepUp {
+	if cfg.ChallengeTTL <= 0 {
+		cfg.ChallengeTTL = 5 * time.Minute
+	}
+	if cfg.ElevationTTL <= 0 {
+		cfg.ElevationTTL = 15 * time.Minute
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 5
+	}
+	if cfg.LockoutTime <= 0 {
+		cfg.LockoutTime = 15 * time.Minute
+	}
+	return &StepUp{config: cfg, store: s, scorer: scorer, factors: factors, logger: logger, metrics: metrics}
+}
+
+// TrustLevel returns the caller's score, raised by any active elevation
+func (s *StepUp) TrustLevel(c *gin.Context, user *interfaces.UserInfo) (int, error) {
+	score, err := s.trust(c, user)
+	if err != nil {
+		return 0, err
+	}
+	return score.Overall, nil
+}
+
+// CurrentTrust implements middleware.TrustSource, raising the score to any
+// active elevation
+func (s *StepUp) CurrentTrust(c *gin.Context) (*interfaces.TrustScore, error) {
+	user, ok := currentUser(c)
+	if !ok {
+		return nil, errors.New("no authenticated user")
+	}
+	return s.trust(c, user)
+}
+
+func (s *StepUp) trust(c *gin.Context, user *interfaces.UserInfo) (*interfaces.TrustScore, error) {
+	score, err := s.scorer.Score(c.Request.Context(), Input{
+		Subject: user.ID,
+		Context: RequestContext(c),
+	})
+	if err != nil {
+		return nil, err
+	}
+	// A session downgraded by continuous verification caps the score until
+	// the user steps up
+	if value, ok := c.Get(session.ContextKey); ok {
+		if sess, ok := value.(*session.Session); ok && sess.TrustCap > 0 && score.Overall > sess.TrustCap {
+			score.Overall = sess.TrustCap
+			score.Context = "session_downgraded"
+		}
+	}
+	data, err := s.store.Get(c.Request.Context(), elevationPrefix+binding(c, user))
+	if errors.Is(err, store.ErrNotFound) {
+		return score, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var elevation Elevation
+	if err := json.Unmarshal(data, &elevation); err == nil && time.Now().Before(elevation.ExpiresAt) && elevation.Level > score.Overall {
+		score.Overall = elevation.Level
+		score.Context = "step_up:" + elevation.Method
+	}
+	return score, nil
+}
+
+// RequireTrust is middleware.RequireTrustLevel with s as the trust source.
+// Callers enrolled in a factor get 403 STEP_UP_REQUIRED with a challenge to
+// answer at POST /auth/step-up; others get 403 INSUFFICIENT_TRUST.
+func (s *StepUp) RequireTrust(level int) gin.HandlerFunc {
+	use, require := middleware.UseTrustSource(s), middleware.RequireTrustLevel(level)
+	return func(c *gin.Context) {
+		use(c)
+		require(c)
+	}
+}
+
+// HandleShortfall implements middleware.ShortfallHandler by challenging
+// callers enrolled in a factor to step up
+func (s *StepUp) HandleShortfall(c *gin.Context, level int, score *interfaces.TrustScore) bool {
+	user, ok := currentUser(c)
+	if !ok {
+		return false
+	}
+	var methods []string
+	for _, f := range s.factors {
+		if f.Enrolled(c.Request.Context(), user.ID) {
+			methods = append(methods, f.Name())
+		}
+	}
+	if len(methods) == 0 {
+		s.count("denied")
+		return false
+	}
+
+	challenge := Challenge{
+		ID:        newChallengeID(),
+		UserID:    user.ID,
+		Binding:   binding(c, user),
+		Required:  level,
+		Methods:   methods,
+		ExpiresAt: time.Now().Add(s.config.ChallengeTTL).UTC(),
+	}
+	data, err := json.Marshal(challenge)
+	if err == nil {
+		err = s.store.Set(c.Request.Context(), challengePrefix+challenge.ID, data, s.config.ChallengeTTL)
+	}
+	if err != nil {
+		s.logger.Error("Failed to store step-up challenge", "error", err)
+		s.abortUnavailable(c)
+		return true
+	}
+	s.count("challenged")
+	s.logger.Info("Step-up required", "user_id", user.ID, "path", c.Request.URL.Path, "trust_level", score.Overall, "required", level)
+	c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+		"error":                i18n.Message(c, "STEP_UP_REQUIRED"),
+		"code":                 "STEP_UP_REQUIRED",
+		"challenge_id":         challenge.ID,
+		"methods":              challenge.Methods,
+		"required_trust_level": level,
+		"current_trust_level":  score.Overall,
+		"expires_at":           challenge.ExpiresAt,
+	})
+	return true
+}
+
+// RegisterRoutes mounts POST /step-up with body
+// {"challenge_id", "method", "response"}. It must be called with the same
+// session or token the challenge was issued to.
+func (s *StepUp) RegisterRoutes(r gin.IRoutes) {
+	r.POST("/step-up", s.handleStepUp)
+}
+
+func (s *StepUp) handleStepUp(c *gin.Context) {
+	var req struct {
+		ChallengeID string `json:"challenge_id" binding:"required"`
+		Method      string `json:"method" binding:"required"`
+		Response    string `json:"response" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": i18n.Message(c, "VALIDATION_ERROR"),
+			"code":  "VALIDATION_ERROR",
+		})
+		return
+	}
+	user, ok := currentUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": i18n.Message(c, "UNAUTHORIZED"),
+			"code":  "UNAUTHORIZED",
+		})
+		return
+	}
+	ctx := c.Request.Context()
+
+	challenge, err := s.challenge(ctx, req.ChallengeID)
+	if err == nil && (challenge.UserID != user.ID || challenge.Binding != binding(c, user)) {
+		err = ErrChallengeInvalid
+	}
+	if err != nil {
+		s.writeError(c, err)
+		return
+	}
+	factor := s.factor(challenge, req.Method)
+	if factor == nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   i18n.Message(c, "VALIDATION_ERROR"),
+			"code":    "VALIDATION_ERROR",
+			"methods": challenge.Methods,
+		})
+		return
+	}
+
+	// Attempts are counted per user rather than per challenge; every
+	// shortfall issues a new challenge, which must not buy more guesses
+	attempts, remaining, err := s.store.Incr(ctx, attemptsPrefix+user.ID, s.config.LockoutTime)
+	if err != nil {
+		s.writeError(c, err)
+		return
+	}
+	if attempts > int64(s.config.MaxAttempts) {
+		if err := s.store.Delete(ctx, challengePrefix+challenge.ID); err != nil {
+			s.logger.Warn("Failed to delete step-up challenge", "error", err)
+		}
+		s.count("locked")
+		s.logger.Warn("Step-up locked after failed attempts", "user_id", user.ID, "ip", c.ClientIP())
+		c.Header("Retry-After", strconv.Itoa(int(remaining.Seconds())+1))
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"error": i18n.Message(c, "STEP_UP_LOCKED"),
+			"code":  "STEP_UP_LOCKED",
+		})
+		return
+	}
+
+	if err := factor.Verify(ctx, user.ID, req.Response); err != nil {
+		if !errors.Is(err, auth.ErrInvalidCredentials) {
+			s.writeError(c, err)
+			return
+		}
+		s.count("failed")
+		s.logger.Warn("Step-up verification failed", "user_id", user.ID, "method", factor.Name(), "ip", c.ClientIP())
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error":              i18n.Message(c, "STEP_UP_FAILED"),
+			"code":               "STEP_UP_FAILED",
+			"attempts_remaining": int64(s.config.MaxAttempts) - attempts,
+		})
+		return
+	}
+
+	// Challenges are single-use
+	if err := s.store.Delete(ctx, challengePrefix+challenge.ID); err != nil {
+		s.writeError(c, err)
+		return
+	}
+	if err := s.store.Delete(ctx, attemptsPrefix+user.ID); err != nil {
+		s.logger.Warn("Failed to reset step-up attempts", "user_id", user.ID, "error", err)
+	}
+	elevation := Elevation{
+		Level:     challenge.Required,
+		Method:    factor.Name(),
+		ExpiresAt: time.Now().Add(s.config.ElevationTTL).UTC(),
+	}
+	key := elevationPrefix + challenge.Binding
+	if data, err := s.store.Get(ctx, key); err == nil {
+		var existing Elevation
+		if json.Unmarshal(data, &existing) == nil && existing.Level > elevation.Level {
+			elevation.Level = existing.Level
+		}
+	}
+	data, err := json.Marshal(elevation)
+	if err == nil {
+		err = s.store.Set(ctx, key, data, s.config.ElevationTTL)
+	}
+	if err != nil {
+		s.writeError(c, err)
+		return
+	}
+
+	s.count("elevated")
+	s.logger.Info("Step-up completed", "user_id", user.ID, "method", elevation.Method, "trust_level", elevation.Level)
+	c.JSON(http.StatusOK, gin.H{
+		"trust_level": elevation.Level,
+		"method":      elevation.Method,
+		"expires_at":  elevation.ExpiresAt,
+	})
+}
+
+func (s *StepUp) challenge(ctx context.Context, id string) (*Challenge, error) {
+	data, err := s.store.Get(ctx, challengePrefix+id)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, ErrChallengeInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	var challenge Challenge
+	if err := json.Unmarshal(data, &challenge); err != nil {
+		return nil, err
+	}
+	return &challenge, nil
+}
+
+// factor returns the factor named method if the challenge offered it
+func (s *StepUp) factor(challenge *Challenge, method string) Factor {
+	for _, offered := range challenge.Methods {
+		if offered != method {
+			continue
+		}
+		for _, f := range s.factors {
+			if f.Name() == method {
+				return f
+			}
+		}
+	}
+	return nil
+}
+
+func (s *StepUp) writeError(c *gin.Context, err error) {
+	if errors.Is(err, ErrChallengeInvalid) {
+		s.count("invalid")
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": i18n.Message(c, "STEP_UP_INVALID"),
+			"code":  "STEP_UP_INVALID",
+		})
+		return
+	}
+	s.logger.Error("Step-up failed", "error", err)
+	c.JSON(http.StatusServiceUnavailable, gin.H{
+		"error": i18n.Message(c, "INTERNAL_ERROR"),
+		"code":  "INTERNAL_ERROR",
+	})
+}
+
+func (s *StepUp) abortUnavailable(c *gin.Context) {
+	c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+		"error": i18n.Message(c, "INTERNAL_ERROR"),
+		"code":  "INTERNAL_ERROR",
+	})
+}
+
+func (s *StepUp) count(result string) {
+	if s.metrics != nil {
+		s.metrics.IncrementCounter("step_up_total", map[string]string{"result": result})
+	}
+}
+
+func currentUser(c *gin.Context) (*interfaces.UserInfo, bool) {
+	value, ok := c.Get("user")
+	if !ok {
+		return nil, false
+	}
+	user, ok := value.(*interfaces.UserInfo)
+	return user, ok && user != nil
+}
+
+// binding identifies the credential a request was made with, so stepping up
+// elevates one session or token rather than every login of the user
+func binding(c *gin.Context, user *interfaces.UserInfo) string {
+	if value, ok := c.Get(session.ContextKey); ok {
+		if sess, ok := value.(*session.Session); ok {
+			return "session:" + sess.ID
+		}
+	}
+	if token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok && strings.TrimSpace(token) != "" {
+		sum := sha256.Sum256([]byte(strings.TrimSpace(token)))
+		return "token:" + hex.EncodeToString(sum[:])
+	}
+	return "user:" + user.ID
+}
+
+func newChallengeID() string {
+	b := make([]byte, 32)
+	_, _ = rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
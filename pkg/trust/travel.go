@@ -0,0 +1,214 @@
+package trust
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net"
+	"time"
+
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+// Travel state in the shared store: the last login location of each
+// subject, and a flag while a subject is suspected of impossible travel
+const (
+	travelLastPrefix = "travel:last:"
+	travelFlagPrefix = "travel:flag:"
+)
+
+// earthRadiusKM is the mean radius used for great-circle distances
+const earthRadiusKM = 6371.0
+
+// TravelConfig configures impossible-travel detection
+type TravelConfig struct {
+	// MaxSpeedKMH is the fastest plausible travel between logins; defaults
+	// to 1000, a little faster than an airliner
+	MaxSpeedKMH float64
+	// MinDistanceKM ignores hops shorter than this, which are within the
+	// error of GeoIP data; defaults to 500
+	MinDistanceKM float64
+	// Deny rejects impossible logins instead of only flagging them
+	Deny bool
+	// FlagTTL is how long a flagged subject scores as risky; defaults to 24h
+	FlagTTL time.Duration
+	// HistoryTTL is how long the last login location is remembered;
+	// defaults to 30 days
+	HistoryTTL time.Duration
+}
+
+// LoginLocation is where and when a subject logged in
+type LoginLocation struct {
+	IP string `json:"ip"`
+	Location
+	At time.Time `json:"at"`
+}
+
+// TravelCheck is the outcome of comparing a login with the previous one.
+// Current is nil when the address could not be located.
+type TravelCheck struct {
+	Current    *LoginLocation `json:"current,omitempty"`
+	Previous   *LoginLocation `json:"previous,omitempty"`
+	DistanceKM float64        `json:"distance_km"`
+	SpeedKMH   float64        `json:"speed_kmh"`
+	Impossible bool           `json:"impossible"`
+	Denied     bool           `json:"denied"`
+}
+
+// TravelDetector flags logins that imply travelling faster than is
+// possible since the subject's previous login. History lives in the shared
+// store so every replica compares against the same previous login.
+type TravelDetector struct {
+	config  TravelConfig
+	store   store.Store
+	geo     GeoLocator
+	logger  interfaces.Logger
+	metrics interfaces.MetricsCollector
+	now     func() time.Time
+}
+
+// NewTravelDetector creates a detector locating addresses with geo
+func NewTravelDetector(cfg TravelConfig, s store.Store, geo GeoLocator, logger interfaces.Logger, metrics interfaces.MetricsCollector) *TravelDetector {
+	if cfg.MaxSpeedKMH <= 0 {
+		cfg.MaxSpeedKMH = 1000
+	}
+	if cfg.MinDistanceKM <= 0 {
+		cfg.MinDistanceKM = 500
+	}
+	if cfg.FlagTTL <= 0 {
+		cfg.FlagTTL = 24 * time.Hour
+	}
+	if cfg.HistoryTTL <= 0 {
+		cfg.HistoryTTL = 30 * 24 * time.Hour
+	}
+	return &TravelDetector{config: cfg, store: s, geo: geo, logger: logger, metrics: metrics, now: time.Now}
+}
+
+// Check compares a login by subject from ip with the previous one and
+// records it. Impossible logins flag the subject; with Deny they are
+// rejected and not recorded, so the previous location stays the reference.
+func (d *TravelDetector) Check(ctx context.Context, subject, ip string) (*TravelCheck, error) {
+	result := &TravelCheck{}
+	location, ok := d.geo.Locate(net.ParseIP(ip))
+	if !ok {
+		return result, nil
+	}
+	result.Current = &LoginLocation{IP: ip, Location: *location, At: d.now().UTC()}
+
+	previous, err := d.previous(ctx, subject)
+	if err != nil {
+		return nil, err
+	}
+	if previous != nil {
+		result.Previous = previous
+		result.DistanceKM = distanceKM(previous.Location, *location)
+		// Logins in the same second count as one second apart
+		hours := math.Max(result.Current.At.Sub(previous.At).Hours(), 1.0/3600)
+		result.SpeedKMH = result.DistanceKM / hours
+		result.Impossible = result.DistanceKM >= d.config.MinDistanceKM && result.SpeedKMH > d.config.MaxSpeedKMH
+	}
+
+	if result.Impossible {
+		result.Denied = d.config.Deny
+		if err := d.store.Set(ctx, travelFlagPrefix+subject, []byte("1"), d.config.FlagTTL); err != nil {
+			return nil, err
+		}
+		action := "flagged"
+		if result.Denied {
+			action = "denied"
+		}
+		if d.metrics != nil {
+			d.metrics.IncrementCounter("impossible_travel_total", map[string]string{"action": action})
+		}
+		d.logger.Warn("Impossible travel between logins", "subject", subject,
+			"from", previous.Country, "to", location.Country,
+			"distance_km", math.Round(result.DistanceKM), "action", action)
+		if result.Denied {
+			return result, nil
+		}
+	}
+
+	data, err := json.Marshal(result.Current)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.store.Set(ctx, travelLastPrefix+subject, data, d.config.HistoryTTL); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Flagged reports whether subject is suspected of impossible travel
+func (d *TravelDetector) Flagged(ctx context.Context, subject string) (bool, error) {
+	_, err := d.store.Get(ctx, travelFlagPrefix+subject)
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, store.ErrNotFound):
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// Scorer wraps base so flagged subjects lose their location and risk
+// factors
+func (d *TravelDetector) Scorer(base Scorer) Scorer {
+	return &travelScorer{base: base, detector: d}
+}
+
+type travelScorer struct {
+	base     Scorer
+	detector *TravelDetector
+}
+
+// Score implements Scorer
+func (s *travelScorer) Score(ctx context.Context, in Input) (*interfaces.TrustScore, error) {
+	score, err := s.base.Score(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	flagged, err := s.detector.Flagged(ctx, in.Subject)
+	if err != nil || !flagged {
+		return score, err
+	}
+	score.Overall -= score.Factors.Location + score.Factors.Risk
+	score.Factors.Location = 0
+	score.Factors.Risk = 0
+	for i, e := range score.Explanations {
+		if e.Factor == FactorLocation || e.Factor == FactorRisk {
+			score.Explanations[i].Score = 0
+			score.Explanations[i].Points = 0
+			score.Explanations[i].Reason = "impossible travel since the previous login"
+		}
+	}
+	score.Context = "impossible_travel"
+	return score, nil
+}
+
+func (d *TravelDetector) previous(ctx context.Context, subject string) (*LoginLocation, error) {
+	data, err := d.store.Get(ctx, travelLastPrefix+subject)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var previous LoginLocation
+	if err := json.Unmarshal(data, &previous); err != nil {
+		return nil, err
+	}
+	return &previous, nil
+}
+
+// distanceKM is the great-circle (haversine) distance between a and b
+func distanceKM(a, b Location) float64 {
+	const rad = math.Pi / 180
+	dLat := (b.Latitude - a.Latitude) * rad
+	dLon := (b.Longitude - a.Longitude) * rad
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(a.Latitude*rad)*math.Cos(b.Latitude*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKM * math.Asin(math.Min(1, math.Sqrt(h)))
+}
@@ -0,0 +1,114 @@
+// Package trust scores how much a request can be trusted and maps the score
+// to the access levels it unlocks
+package trust
+
+import (
+	"context"
+	"time"
+
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+)
+
+// Access levels in increasing order of the trust they require
+const (
+	AccessNone   = "none"
+	AccessRead   = "read"
+	AccessWrite  = "write"
+	AccessAdmin  = "admin"
+	AccessDelete = "delete"
+)
+
+// Threshold is the minimum score for an access level
+type Threshold struct {
+	Level    string `json:"level"`
+	MinScore int    `json:"min_score"`
+}
+
+// DefaultThresholds are the documented trust levels per action
+var DefaultThresholds = []Threshold{
+	{Level: AccessRead, MinScore: 25},
+	{Level: AccessWrite, MinScore: 50},
+	{Level: AccessAdmin, MinScore: 75},
+	{Level: AccessDelete, MinScore: 90},
+}
+
+// Input is one (subject, device, context) tuple to score
+type Input struct {
+	Subject string            `json:"subject"`
+	Device  string            `json:"device,omitempty"`
+	Context map[string]string `json:"context,omitempty"`
+}
+
+// Scorer calculates a trust score
+type Scorer interface {
+	Score(ctx context.Context, in Input) (*interfaces.TrustScore, error)
+}
+
+// DemoScorer returns the fixed demo factors for every input. It stands in
+// for ScoreEngine in mocks and tests that need a predictable score.
+type DemoScorer struct{}
+
+// Score implements Scorer
+func (DemoScorer) Score(_ context.Context, in Input) (*interfaces.TrustScore, error) {
+	factors := interfaces.TrustFactors{
+		Identity: 30,
+		Device:   20,
+		Behavior: 18,
+		Location: 12,
+		Risk:     8,
+	}
+	return &interfaces.TrustScore{
+		UserID:    in.Subject,
+		Overall:   factors.Identity + factors.Device + factors.Behavior + factors.Location + factors.Risk,
+		Factors:   factors,
+		Timestamp: time.Now().UTC(),
+		Context:   "demo_calculation",
+	}, nil
+}
+
+// AccessLevel returns the highest level score reaches and every level it
+// grants, using thresholds sorted by MinScore
+func AccessLevel(score int, thresholds []Threshold) (string, []string) {
+	level := AccessNone
+	granted := make([]string, 0, len(thresholds))
+	for _, t := range thresholds {
+		if score < t.MinScore {
+			break
+		}
+		level = t.Level
+		granted = append(granted, t.Level)
+	}
+	return level, granted
+}
+
+// ContextTime is the Input.Context key holding when the request is made, in
+// RFC 3339; simulations set it to score a hypothetical time
+const ContextTime = "time"
+
+// ContextEndpoint is the Input.Context key holding the route requested, as
+// its method and path template, e.g. "GET /api/v1/devices/:id"
+const ContextEndpoint = "endpoint"
+
+// BoundDeviceKey is the gin context key holding the *interfaces.DeviceInfo
+// of a device whose bound key signed the request
+const BoundDeviceKey = "bound_device"
+
+// Input.Context keys set for requests from a hardware-bound device of the
+// subject, see RequestContext. ContextDeviceState is set for devices that
+// are stale or quarantined, and ContextDeviceCompliance for devices an MDM
+// manages.
+const (
+	ContextDeviceBound      = "device_bound"
+	ContextDeviceID         = "device_id"
+	ContextDeviceState      = "device_state"
+	ContextDeviceCompliance = "device_compliance"
+)
+
+// InputTime returns the time in's Context gives, or the current time, for
+// providers that depend on when a request is made, such as working hours
+func InputTime(in Input) time.Time {
+	if t, err := time.Parse(time.RFC3339, in.Context[ContextTime]); err == nil {
+		return t
+	}
+	return time.Now()
+}
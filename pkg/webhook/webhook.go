@@ -0,0 +1,478 @@
+// Package webhook notifies operator-registered endpoints when a subject's
+// trust score crosses one of their thresholds, and of the device events
+// they subscribe to.
+//
+// Each subject's last score lives in the shared store and is advanced with
+// compare-and-swap, so exactly one replica sees a given transition and
+// sends its events. Events are JSON POSTs signed with HMAC-SHA256 over
+// "<timestamp>.<body>" using the endpoint's secret; failed deliveries are
+// retried with exponential backoff.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lsendel/impl-zamaz/pkg/admin"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+	"github.com/lsendel/impl-zamaz/pkg/trust"
+)
+
+// Delivery headers. Receivers verify HeaderSignature with Sign and reject
+// stale HeaderTimestamp values to stop replays.
+const (
+	HeaderEventID   = "X-Webhook-ID"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	HeaderSignature = "X-Webhook-Signature"
+)
+
+// Event types
+const (
+	// EventTrustCrossed is the type of threshold crossing events
+	EventTrustCrossed = "trust_level.crossed"
+	// EventDeviceQuarantined and EventDeviceBlocked are sent when a device
+	// is quarantined or blocked
+	EventDeviceQuarantined = "device.quarantined"
+	EventDeviceBlocked     = "device.blocked"
+	// EventDeviceUnknown is sent on the first login from a device its user
+	// has not registered
+	EventDeviceUnknown = "device.unknown"
+)
+
+// Directions of a crossing
+const (
+	// Below means the score dropped under the threshold
+	Below = "below"
+	// Above means the score rose to the threshold or more
+	Above = "above"
+)
+
+// stateKeyPrefix holds the last score of each subject
+const stateKeyPrefix = "webhook:trust:"
+
+// Endpoint is a registered webhook
+type Endpoint struct {
+	Name       string
+	URL        string
+	Secret     string
+	Thresholds []int
+	// Direction limits events to Below or Above crossings; empty means both
+	Direction string
+	// Events lists the device event types the endpoint subscribes to
+	Events []string
+}
+
+// Source returns the registered endpoints
+type Source func(ctx context.Context) ([]Endpoint, error)
+
+// AdminSource returns the webhooks declared as admin resources of
+// admin.WebhookKind
+func AdminSource(m *admin.Manager) Source {
+	return func(ctx context.Context) ([]Endpoint, error) {
+		resources, err := m.List(ctx, admin.WebhookKind().Name)
+		if err != nil {
+			return nil, err
+		}
+		endpoints := make([]Endpoint, 0, len(resources))
+		for _, r := range resources {
+			var spec admin.WebhookSpec
+			if err := json.Unmarshal(r.Spec, &spec); err != nil {
+				return nil, err
+			}
+			endpoints = append(endpoints, Endpoint{
+				Name:       r.Name,
+				URL:        spec.URL,
+				Secret:     spec.Secret,
+				Thresholds: spec.Thresholds,
+				Direction:  spec.Direction,
+				Events:     spec.Events,
+			})
+		}
+		return endpoints, nil
+	}
+}
+
+// Event is the JSON body of a delivery
+type Event struct {
+	ID            string    `json:"id"`
+	Type          string    `json:"type"`
+	Webhook       string    `json:"webhook"`
+	Subject       string    `json:"subject"`
+	Threshold     int       `json:"threshold"`
+	Direction     string    `json:"direction"`
+	PreviousScore int       `json:"previous_score"`
+	Score         int       `json:"score"`
+	OccurredAt    time.Time `json:"occurred_at"`
+}
+
+// DeviceEvent is the JSON body of a device event delivery
+type DeviceEvent struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	Webhook string `json:"webhook"`
+	// Subject owns the device
+	Subject    string    `json:"subject"`
+	DeviceID   string    `json:"device_id"`
+	Platform   string    `json:"platform"`
+	Reason     string    `json:"reason,omitempty"`
+	OccurredAt time.Time `json:"occurred_at"`
+}
+
+// UnknownDeviceEvent is the JSON body of a device.unknown delivery
+type UnknownDeviceEvent struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	Webhook string `json:"webhook"`
+	// Subject is the user who logged in
+	Subject string `json:"subject"`
+	// Sighting identifies the unknown device without revealing its
+	// fingerprint
+	Sighting   string    `json:"sighting"`
+	IP         string    `json:"ip"`
+	Method     string    `json:"method"`
+	OccurredAt time.Time `json:"occurred_at"`
+}
+
+// Config configures a Notifier
+type Config struct {
+	// MaxAttempts bounds deliveries per event; defaults to 5
+	MaxAttempts int
+	// InitialBackoff is the wait before the first retry, doubling after
+	// each failure up to MaxBackoff; defaults to 1s and 1m
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Timeout bounds each delivery; defaults to 10s
+	Timeout time.Duration
+	// StateTTL is how long a subject's last score is remembered; defaults
+	// to 30 days
+	StateTTL time.Duration
+	// CacheTTL is how long the endpoint list is reused; defaults to 10s
+	CacheTTL time.Duration
+}
+
+// Notifier detects trust threshold crossings and delivers webhook events
+type Notifier struct {
+	config  Config
+	store   store.Store
+	source  Source
+	client  *http.Client
+	logger  interfaces.Logger
+	metrics interfaces.MetricsCollector
+	now     func() time.Time
+
+	mu        sync.Mutex
+	endpoints []Endpoint
+	loadedAt  time.Time
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	pending sync.WaitGroup
+}
+
+// NewNotifier creates a notifier for the endpoints from source; metrics
+// may be nil
+func NewNotifier(cfg Config, s store.Store, source Source, logger interfaces.Logger, metrics interfaces.MetricsCollector) *Notifier {
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 5
+	}
+	if cfg.InitialBackoff <= 0 {
+		cfg.InitialBackoff = time.Second
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = time.Minute
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	if cfg.StateTTL <= 0 {
+		cfg.StateTTL = 30 * 24 * time.Hour
+	}
+	if cfg.CacheTTL <= 0 {
+		cfg.CacheTTL = 10 * time.Second
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Notifier{
+		config:  cfg,
+		store:   s,
+		source:  source,
+		client:  &http.Client{Timeout: cfg.Timeout},
+		logger:  logger,
+		metrics: metrics,
+		now:     time.Now,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+// Scorer wraps base so every score it computes is checked for crossings.
+// Notification problems are logged and never fail the score.
+func (n *Notifier) Scorer(base trust.Scorer) trust.Scorer {
+	return &notifyingScorer{base: base, notifier: n}
+}
+
+type notifyingScorer struct {
+	base     trust.Scorer
+	notifier *Notifier
+}
+
+// Score implements trust.Scorer
+func (s *notifyingScorer) Score(ctx context.Context, in trust.Input) (*interfaces.TrustScore, error) {
+	score, err := s.base.Score(ctx, in)
+	if err != nil || in.Subject == "" {
+		return score, err
+	}
+	if err := s.notifier.Observe(ctx, in.Subject, score.Overall); err != nil {
+		s.notifier.logger.Warn("Failed to check trust score transition", "subject", in.Subject, "error", err)
+	}
+	return score, nil
+}
+
+// Observe records score as subject's current score and sends events for
+// the thresholds crossed since the previous one. The first score of a
+// subject only sets the baseline.
+func (n *Notifier) Observe(ctx context.Context, subject string, score int) error {
+	key := stateKeyPrefix + subject
+	current := []byte(strconv.Itoa(score))
+	old, err := n.store.Get(ctx, key)
+	if errors.Is(err, store.ErrNotFound) {
+		_, err = n.store.CompareAndSwap(ctx, key, nil, current, n.config.StateTTL)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	previous, err := strconv.Atoi(string(old))
+	if err != nil {
+		return fmt.Errorf("corrupt trust state for %q: %w", subject, err)
+	}
+	if previous == score {
+		return nil
+	}
+	swapped, err := n.store.CompareAndSwap(ctx, key, old, current, n.config.StateTTL)
+	if err != nil || !swapped {
+		// A concurrent score owns this transition
+		return err
+	}
+
+	endpoints, err := n.load(ctx)
+	if err != nil {
+		return err
+	}
+	for _, endpoint := range endpoints {
+		for _, threshold := range endpoint.Thresholds {
+			direction := crossing(previous, score, threshold)
+			if direction == "" || (endpoint.Direction != "" && endpoint.Direction != direction) {
+				continue
+			}
+			id, err := newEventID()
+			if err != nil {
+				return err
+			}
+			n.send(endpoint, id, Event{
+				ID:            id,
+				Type:          EventTrustCrossed,
+				Webhook:       endpoint.Name,
+				Subject:       subject,
+				Threshold:     threshold,
+				Direction:     direction,
+				PreviousScore: previous,
+				Score:         score,
+				OccurredAt:    n.now().UTC(),
+			})
+		}
+	}
+	return nil
+}
+
+// NotifyDevice sends eventType for device to the endpoints subscribed to it
+func (n *Notifier) NotifyDevice(ctx context.Context, eventType string, device *interfaces.DeviceInfo) error {
+	return n.notify(ctx, eventType, func(endpoint Endpoint, id string) interface{} {
+		return DeviceEvent{
+			ID:         id,
+			Type:       eventType,
+			Webhook:    endpoint.Name,
+			Subject:    device.OwnerID,
+			DeviceID:   device.ID,
+			Platform:   device.Platform,
+			Reason:     device.StateReason,
+			OccurredAt: n.now().UTC(),
+		}
+	})
+}
+
+// NotifyUnknownDevice sends a device.unknown event for subject's login from
+// ip by method to the endpoints subscribed to it
+func (n *Notifier) NotifyUnknownDevice(ctx context.Context, subject, sighting, ip, method string) error {
+	return n.notify(ctx, EventDeviceUnknown, func(endpoint Endpoint, id string) interface{} {
+		return UnknownDeviceEvent{
+			ID:         id,
+			Type:       EventDeviceUnknown,
+			Webhook:    endpoint.Name,
+			Subject:    subject,
+			Sighting:   sighting,
+			IP:         ip,
+			Method:     method,
+			OccurredAt: n.now().UTC(),
+		}
+	})
+}
+
+// notify sends the event built for each endpoint subscribed to eventType
+func (n *Notifier) notify(ctx context.Context, eventType string, event func(endpoint Endpoint, id string) interface{}) error {
+	endpoints, err := n.load(ctx)
+	if err != nil {
+		return err
+	}
+	for _, endpoint := range endpoints {
+		if !subscribed(endpoint, eventType) {
+			continue
+		}
+		id, err := newEventID()
+		if err != nil {
+			return err
+		}
+		n.send(endpoint, id, event(endpoint, id))
+	}
+	return nil
+}
+
+// Close abandons pending retries and waits for deliveries in flight
+func (n *Notifier) Close() {
+	n.cancel()
+	n.pending.Wait()
+}
+
+// Sign returns the signature of body sent at timestamp (unix seconds)
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func crossing(previous, score, threshold int) string {
+	switch {
+	case previous >= threshold && score < threshold:
+		return Below
+	case previous < threshold && score >= threshold:
+		return Above
+	default:
+		return ""
+	}
+}
+
+func subscribed(endpoint Endpoint, eventType string) bool {
+	for _, event := range endpoint.Events {
+		if event == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *Notifier) load(ctx context.Context) ([]Endpoint, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.endpoints != nil && n.now().Sub(n.loadedAt) < n.config.CacheTTL {
+		return n.endpoints, nil
+	}
+	endpoints, err := n.source(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if endpoints == nil {
+		endpoints = []Endpoint{}
+	}
+	n.endpoints, n.loadedAt = endpoints, n.now()
+	return endpoints, nil
+}
+
+// send delivers event id in the background, retrying with backoff
+func (n *Notifier) send(endpoint Endpoint, id string, event interface{}) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		n.logger.Error("Failed to encode webhook event", "webhook", endpoint.Name, "error", err)
+		return
+	}
+	n.pending.Add(1)
+	go func() {
+		defer n.pending.Done()
+		backoff := n.config.InitialBackoff
+		for attempt := 1; ; attempt++ {
+			retry, err := n.deliver(endpoint, id, body)
+			if err == nil {
+				n.record("delivered")
+				return
+			}
+			if !retry || attempt >= n.config.MaxAttempts {
+				n.record("failed")
+				n.logger.Error("Webhook delivery failed", "webhook", endpoint.Name, "event", id, "attempts", attempt, "error", err)
+				return
+			}
+			n.record("retried")
+			n.logger.Warn("Webhook delivery failed, retrying", "webhook", endpoint.Name, "event", id, "attempt", attempt, "backoff", backoff, "error", err)
+			select {
+			case <-n.ctx.Done():
+				n.record("abandoned")
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > n.config.MaxBackoff {
+				backoff = n.config.MaxBackoff
+			}
+		}
+	}()
+}
+
+// deliver makes one attempt; retry reports whether a failure is transient
+func (n *Notifier) deliver(endpoint Endpoint, id string, body []byte) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, endpoint.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	timestamp := strconv.FormatInt(n.now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEventID, id)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderSignature, Sign(endpoint.Secret, timestamp, body))
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("endpoint returned %d", resp.StatusCode)
+	default:
+		return false, fmt.Errorf("endpoint returned %d", resp.StatusCode)
+	}
+}
+
+func (n *Notifier) record(result string) {
+	if n.metrics != nil {
+		n.metrics.IncrementCounter("webhook_deliveries_total", map[string]string{"result": result})
+	}
+}
+
+func newEventID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -15,6 +15,8 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/lsendel/impl-zamaz/pkg/trust"
+
 	// Import zero trust components from root-zamaz
 	ztMiddleware "github.com/lsendel/root-zamaz/libraries/go-keycloak-zerotrust/middleware/gin"
 	ztClient "github.com/lsendel/root-zamaz/libraries/go-keycloak-zerotrust/pkg/client"
@@ -212,6 +214,13 @@ func TestZeroTrustAuthenticationSecurity(t *testing.T) {
 	}
 }
 
+// accessPolicy maps scores the way the tests below expect
+var accessPolicy = trust.StaticLevels{
+	{Level: "read_only", MinScore: 50},
+	{Level: "user", MinScore: 70},
+	{Level: "admin", MinScore: 90},
+}
+
 func TestTrustScoreCalculation(t *testing.T) {
 	tests := []struct {
 		name                string
@@ -261,7 +270,7 @@ func TestTrustScoreCalculation(t *testing.T) {
 			locationFactor:      2,
 			riskFactor:          25,
 			expectedTrustScore:  47,
-			expectedAccessLevel: "denied",
+			expectedAccessLevel: trust.AccessNone,
 		},
 	}
 
@@ -274,18 +283,7 @@ func TestTrustScoreCalculation(t *testing.T) {
 			assert.Equal(t, tt.expectedTrustScore, totalScore)
 
 			// Verify access level mapping
-			var accessLevel string
-			switch {
-			case totalScore >= 90:
-				accessLevel = "admin"
-			case totalScore >= 70:
-				accessLevel = "user"
-			case totalScore >= 50:
-				accessLevel = "read_only"
-			default:
-				accessLevel = "denied"
-			}
-
+			accessLevel, _ := trust.AccessLevel(totalScore, accessPolicy.Thresholds(context.Background()))
 			assert.Equal(t, tt.expectedAccessLevel, accessLevel)
 		})
 	}
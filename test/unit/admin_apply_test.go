@@ -0,0 +1,178 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/pkg/admin"
+	"github.com/lsendel/impl-zamaz/pkg/discovery"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+func bundleOf(resources ...admin.BundleResource) admin.Bundle {
+	return admin.Bundle{Resources: resources}
+}
+
+func bundleResource(kind, name, spec string) admin.BundleResource {
+	return admin.BundleResource{Kind: kind, Name: name, Spec: json.RawMessage(spec)}
+}
+
+func newApplyManager(s store.Store, kinds ...admin.Kind) *admin.Manager {
+	if len(kinds) == 0 {
+		kinds = []admin.Kind{admin.RoleKind(), admin.PolicyKind(), admin.TenantKind(), admin.ServiceKind(discovery.NewServiceRegistry())}
+	}
+	return admin.NewManager(s, &testLogger{}, nil, kinds...)
+}
+
+func TestAdminApplyDiffAndDryRun(t *testing.T) {
+	ctx := context.Background()
+	m := newApplyManager(store.NewMemoryStore())
+	_, _, err := m.Put(ctx, "role", "viewer", json.RawMessage(`{"permissions":["devices:read"]}`), admin.Preconditions{})
+	require.NoError(t, err)
+	_, _, err = m.Put(ctx, "role", "legacy", json.RawMessage(`{"permissions":["all"]}`), admin.Preconditions{})
+	require.NoError(t, err)
+	_, _, err = m.Put(ctx, "tenant", "acme", json.RawMessage(`{"display_name":"Acme"}`), admin.Preconditions{})
+	require.NoError(t, err)
+
+	bundle := bundleOf(
+		bundleResource("role", "viewer", `{"permissions":["devices:read"]}`),
+		bundleResource("role", "editor", `{"permissions":["devices:write"]}`),
+		bundleResource("policy", "devices", `{"effect":"allow","resources":["devices"],"actions":["read"]}`),
+	)
+
+	result, err := m.Apply(ctx, bundle, admin.ApplyOptions{DryRun: true, Prune: true})
+	require.NoError(t, err)
+	assert.True(t, result.DryRun)
+	assert.Equal(t, map[string]int{"create": 2, "delete": 1, "unchanged": 1}, result.Summary)
+	actions := make(map[string]string)
+	for _, change := range result.Changes {
+		actions[change.Kind+"/"+change.Name] = change.Action
+	}
+	assert.Equal(t, map[string]string{
+		"policy/devices": admin.ActionCreate,
+		"role/editor":    admin.ActionCreate,
+		"role/legacy":    admin.ActionDelete,
+		"role/viewer":    admin.ActionUnchanged,
+	}, actions, "tenants are not in the bundle and must not be pruned")
+
+	// Nothing changed during the dry run
+	_, err = m.Get(ctx, "role", "editor")
+	assert.ErrorIs(t, err, admin.ErrNotFound)
+
+	result, err = m.Apply(ctx, bundle, admin.ApplyOptions{Prune: true})
+	require.NoError(t, err)
+	assert.False(t, result.DryRun)
+	_, err = m.Get(ctx, "role", "editor")
+	assert.NoError(t, err)
+	_, err = m.Get(ctx, "role", "legacy")
+	assert.ErrorIs(t, err, admin.ErrNotFound)
+	_, err = m.Get(ctx, "tenant", "acme")
+	assert.NoError(t, err)
+
+	// Applying again is a no-op
+	result, err = m.Apply(ctx, bundle, admin.ApplyOptions{Prune: true})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"unchanged": 3}, result.Summary)
+}
+
+func TestAdminApplyRejectsInvalidBundle(t *testing.T) {
+	ctx := context.Background()
+	m := newApplyManager(store.NewMemoryStore())
+
+	_, err := m.Apply(ctx, bundleOf(
+		bundleResource("role", "ok", `{"permissions":["a"]}`),
+		bundleResource("role", "ok", `{"permissions":["b"]}`),
+		bundleResource("widget", "x", `{}`),
+		bundleResource("tenant", "t", `{"display_name":""}`),
+	), admin.ApplyOptions{})
+	var bundleErr *admin.BundleError
+	require.True(t, errors.As(err, &bundleErr))
+	assert.Len(t, bundleErr.Problems, 3)
+	assert.ErrorIs(t, err, admin.ErrInvalidSpec)
+
+	// Validation happens before any change
+	_, err = m.Get(ctx, "role", "ok")
+	assert.ErrorIs(t, err, admin.ErrNotFound)
+}
+
+func TestAdminApplyRollsBackOnFailure(t *testing.T) {
+	ctx := context.Background()
+	failing := admin.Kind{
+		Name:   "tenant",
+		Plural: "tenants",
+		Apply: func(ctx context.Context, r *admin.Resource) error {
+			if r.Name == "broken" {
+				return errors.New("downstream unavailable")
+			}
+			return nil
+		},
+	}
+	m := newApplyManager(store.NewMemoryStore(), admin.RoleKind(), failing)
+	_, _, err := m.Put(ctx, "role", "viewer", json.RawMessage(`{"permissions":["v1"]}`), admin.Preconditions{})
+	require.NoError(t, err)
+
+	_, err = m.Apply(ctx, bundleOf(
+		bundleResource("role", "viewer", `{"permissions":["v2"]}`),
+		bundleResource("role", "editor", `{"permissions":["e"]}`),
+		bundleResource("tenant", "broken", `{"display_name":"x"}`),
+	), admin.ApplyOptions{})
+	assert.ErrorIs(t, err, admin.ErrApplyFailed)
+
+	viewer, err := m.Get(ctx, "role", "viewer")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"permissions":["v1"]}`, string(viewer.Spec))
+	assert.Equal(t, int64(1), viewer.Generation)
+	_, err = m.Get(ctx, "role", "editor")
+	assert.ErrorIs(t, err, admin.ErrNotFound)
+}
+
+func TestAdminApplyEndpoint(t *testing.T) {
+	r := newAdminRouter(store.NewMemoryStore(), discovery.NewServiceRegistry())
+	body := `{"resources":[{"kind":"tenant","name":"acme","spec":{"display_name":"Acme"}}]}`
+
+	w := adminRequest(r, http.MethodPost, "/admin/apply?dry_run=true", body, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), `"dry_run":true`)
+	assert.Equal(t, http.StatusNotFound, adminRequest(r, http.MethodGet, "/admin/tenants/acme", "", nil).Code)
+
+	w = adminRequest(r, http.MethodPost, "/admin/apply", body, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, http.StatusOK, adminRequest(r, http.MethodGet, "/admin/tenants/acme", "", nil).Code)
+
+	w = adminRequest(r, http.MethodPost, "/admin/apply", `{"resources":[{"kind":"tenant","name":"BAD","spec":{}}]}`, nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), `"details":["resources[0] tenant/BAD`)
+}
+
+func TestLoadBundleFromDirectory(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"10-roles.json":   `[{"kind":"role","name":"viewer","spec":{"permissions":["a"]}}]`,
+		"20-tenant.json":  `{"kind":"tenant","name":"acme","spec":{"display_name":"Acme"}}`,
+		"30-bundle.json":  `{"resources":[{"kind":"policy","name":"p","spec":{"effect":"allow","resources":["r"],"actions":["a"]}}]}`,
+		"ignored.txt":     `not json`,
+		"40-service.json": `{"kind":"service","name":"billing","spec":{"url":"http://billing:8080"}}`,
+	}
+	for name, content := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600))
+	}
+
+	bundle, err := admin.LoadBundle(dir)
+	require.NoError(t, err)
+	require.Len(t, bundle.Resources, 4)
+	assert.Equal(t, "viewer", bundle.Resources[0].Name)
+	assert.Equal(t, "acme", bundle.Resources[1].Name)
+	assert.Equal(t, "p", bundle.Resources[2].Name)
+	assert.Equal(t, "billing", bundle.Resources[3].Name)
+
+	_, err = admin.LoadBundle(filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,188 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/pkg/admin"
+	"github.com/lsendel/impl-zamaz/pkg/discovery"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+func newAdminRouter(s store.Store, registry *discovery.ServiceRegistry) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	admin.NewManager(s, &testLogger{}, nil,
+		admin.RoleKind(),
+		admin.PolicyKind(),
+		admin.TenantKind(),
+		admin.ServiceKind(registry),
+	).RegisterRoutes(r.Group("/admin"))
+	return r
+}
+
+func adminRequest(r http.Handler, method, path, body string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func decodeResource(t *testing.T, w *httptest.ResponseRecorder) admin.Resource {
+	var res admin.Resource
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	return res
+}
+
+func TestAdminPutIsIdempotent(t *testing.T) {
+	r := newAdminRouter(store.NewMemoryStore(), discovery.NewServiceRegistry())
+	spec := `{"permissions": ["devices:read"], "description": "Read only"}`
+
+	w := adminRequest(r, http.MethodPut, "/admin/roles/viewer", spec, nil)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	created := decodeResource(t, w)
+	etag := w.Header().Get("ETag")
+	assert.NotEmpty(t, created.ID)
+	assert.Equal(t, "/admin/roles/viewer", w.Header().Get("Location"))
+
+	// Same spec with different key order and whitespace is a no-op
+	w = adminRequest(r, http.MethodPut, "/admin/roles/viewer", `{"description":"Read only","permissions":["devices:read"]}`, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	again := decodeResource(t, w)
+	assert.Equal(t, created.ID, again.ID)
+	assert.Equal(t, int64(1), again.Generation)
+	assert.Equal(t, etag, w.Header().Get("ETag"))
+
+	w = adminRequest(r, http.MethodPut, "/admin/roles/viewer", `{"permissions":["devices:read","policies:read"]}`, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	updated := decodeResource(t, w)
+	assert.Equal(t, created.ID, updated.ID)
+	assert.Equal(t, int64(2), updated.Generation)
+	assert.NotEqual(t, etag, w.Header().Get("ETag"))
+
+	w = adminRequest(r, http.MethodGet, "/admin/roles/viewer", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, updated.ID, decodeResource(t, w).ID)
+	assert.Equal(t, http.StatusNotModified, adminRequest(r, http.MethodGet, "/admin/roles/viewer", "", map[string]string{
+		"If-None-Match": w.Header().Get("ETag"),
+	}).Code)
+}
+
+func TestAdminConditionalRequests(t *testing.T) {
+	r := newAdminRouter(store.NewMemoryStore(), discovery.NewServiceRegistry())
+	spec := `{"display_name":"Acme"}`
+
+	w := adminRequest(r, http.MethodPut, "/admin/tenants/acme", spec, map[string]string{"If-None-Match": "*"})
+	require.Equal(t, http.StatusCreated, w.Code)
+	etag := w.Header().Get("ETag")
+
+	// Create-only requests fail once the resource exists
+	w = adminRequest(r, http.MethodPut, "/admin/tenants/acme", spec, map[string]string{"If-None-Match": "*"})
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+
+	w = adminRequest(r, http.MethodPut, "/admin/tenants/acme", `{"display_name":"Acme Corp"}`, map[string]string{"If-Match": `"stale"`})
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+	assert.Contains(t, w.Body.String(), "PRECONDITION_FAILED")
+
+	w = adminRequest(r, http.MethodPut, "/admin/tenants/acme", `{"display_name":"Acme Corp"}`, map[string]string{"If-Match": etag})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	assert.Equal(t, http.StatusPreconditionFailed, adminRequest(r, http.MethodDelete, "/admin/tenants/acme", "", map[string]string{"If-Match": etag}).Code)
+}
+
+func TestAdminDeleteIsIdempotent(t *testing.T) {
+	r := newAdminRouter(store.NewMemoryStore(), discovery.NewServiceRegistry())
+	require.Equal(t, http.StatusCreated, adminRequest(r, http.MethodPut, "/admin/policies/devices-read",
+		`{"effect":"allow","resources":["devices"],"actions":["read"],"min_trust_level":50}`, nil).Code)
+
+	assert.Equal(t, http.StatusNoContent, adminRequest(r, http.MethodDelete, "/admin/policies/devices-read", "", nil).Code)
+	assert.Equal(t, http.StatusNoContent, adminRequest(r, http.MethodDelete, "/admin/policies/devices-read", "", nil).Code)
+	assert.Equal(t, http.StatusNotFound, adminRequest(r, http.MethodGet, "/admin/policies/devices-read", "", nil).Code)
+
+	// Recreating a deleted resource assigns a new ID
+	w := adminRequest(r, http.MethodPut, "/admin/policies/devices-read", `{"effect":"deny","resources":["devices"],"actions":["read"]}`, nil)
+	assert.Equal(t, http.StatusCreated, w.Code)
+}
+
+func TestAdminValidation(t *testing.T) {
+	r := newAdminRouter(store.NewMemoryStore(), discovery.NewServiceRegistry())
+
+	cases := map[string]string{
+		"/admin/roles/Bad_Name":     `{"permissions":["a"]}`,
+		"/admin/roles/empty":        `{"permissions":[]}`,
+		"/admin/roles/typo":         `{"permisions":["a"]}`,
+		"/admin/roles/not-object":   `["a"]`,
+		"/admin/policies/bad":       `{"effect":"maybe","resources":["a"],"actions":["b"]}`,
+		"/admin/services/bad-url":   `{"url":"not a url"}`,
+		"/admin/tenants/no-display": `{}`,
+	}
+	for path, body := range cases {
+		w := adminRequest(r, http.MethodPut, path, body, nil)
+		assert.Equal(t, http.StatusBadRequest, w.Code, path)
+	}
+	assert.Equal(t, http.StatusNotFound, adminRequest(r, http.MethodGet, "/admin/widgets", "", nil).Code)
+}
+
+func TestAdminListIsSortedAndShared(t *testing.T) {
+	shared := store.NewMemoryStore()
+	replicaA := newAdminRouter(shared, discovery.NewServiceRegistry())
+	replicaB := newAdminRouter(shared, discovery.NewServiceRegistry())
+
+	for _, name := range []string{"ops", "dev"} {
+		require.Equal(t, http.StatusCreated, adminRequest(replicaA, http.MethodPut, "/admin/tenants/"+name, `{"display_name":"`+name+`"}`, nil).Code)
+	}
+	// Another replica applying the same spec sees the existing resource
+	w := adminRequest(replicaB, http.MethodPut, "/admin/tenants/dev", `{"display_name":"dev"}`, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = adminRequest(replicaB, http.MethodGet, "/admin/tenants", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var list struct {
+		Items []admin.Resource `json:"items"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	require.Len(t, list.Items, 2)
+	assert.Equal(t, "dev", list.Items[0].Name)
+	assert.Equal(t, "ops", list.Items[1].Name)
+}
+
+func TestAdminServicesSyncRegistry(t *testing.T) {
+	shared := store.NewMemoryStore()
+	registryA := discovery.NewServiceRegistryWithStore(shared)
+	registryB := discovery.NewServiceRegistryWithStore(shared)
+	r := newAdminRouter(shared, registryA)
+
+	require.Equal(t, http.StatusCreated, adminRequest(r, http.MethodPut, "/admin/services/billing",
+		`{"url":"http://billing.internal:8080","trust_level_required":60}`, nil).Code)
+	service, err := registryB.GetService("billing")
+	require.NoError(t, err)
+	assert.Equal(t, 60, service.TrustLevel)
+
+	require.Equal(t, http.StatusNoContent, adminRequest(r, http.MethodDelete, "/admin/services/billing", "", nil).Code)
+	_, err = registryB.GetService("billing")
+	assert.Error(t, err)
+}
+
+func TestAdminConcurrentWriterConflict(t *testing.T) {
+	shared := store.NewMemoryStore()
+	r := newAdminRouter(shared, discovery.NewServiceRegistry())
+
+	// Simulate another replica holding the write lock
+	_, _, err := shared.Incr(context.Background(), "admin-lock:role:ops", 0)
+	require.NoError(t, err)
+
+	w := adminRequest(r, http.MethodPut, "/admin/roles/ops", `{"permissions":["a"]}`, nil)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+}
@@ -0,0 +1,330 @@
+package unit
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/pkg/attestation"
+	"github.com/lsendel/impl-zamaz/pkg/device"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+	"github.com/lsendel/impl-zamaz/pkg/trust"
+)
+
+// playIntegrityKeys stand in for the response encryption keys of the Play
+// Console
+type playIntegrityKeys struct {
+	aesKey  []byte
+	signing *ecdsa.PrivateKey
+}
+
+func newPlayIntegrityKeys(t *testing.T) *playIntegrityKeys {
+	signing, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	aesKey := make([]byte, 32)
+	_, err = rand.Read(aesKey)
+	require.NoError(t, err)
+	return &playIntegrityKeys{aesKey: aesKey, signing: signing}
+}
+
+func (k *playIntegrityKeys) verifier(t *testing.T, digests ...string) *attestation.PlayIntegrity {
+	der, err := x509.MarshalPKIXPublicKey(&k.signing.PublicKey)
+	require.NoError(t, err)
+	aesKey, verificationKey, err := attestation.ParsePlayIntegrityKeys(base64.StdEncoding.EncodeToString(k.aesKey), base64.StdEncoding.EncodeToString(der))
+	require.NoError(t, err)
+	verifier, err := attestation.NewPlayIntegrity(attestation.PlayIntegrityConfig{
+		PackageName:        "com.example.app",
+		DecryptionKey:      aesKey,
+		VerificationKey:    verificationKey,
+		CertificateDigests: digests,
+	})
+	require.NoError(t, err)
+	return verifier
+}
+
+// token builds a Play Integrity token: an ES256 JWS of the verdict inside
+// an A256KW/A256GCM JWE
+func (k *playIntegrityKeys) token(t *testing.T, nonce string, issued time.Time, deviceVerdicts ...string) string {
+	verdict := map[string]interface{}{
+		"requestDetails": map[string]string{
+			"requestPackageName": "com.example.app",
+			"nonce":              nonce,
+			"timestampMillis":    fmt.Sprint(issued.UnixMilli()),
+		},
+		"appIntegrity": map[string]interface{}{
+			"appRecognitionVerdict":   "PLAY_RECOGNIZED",
+			"packageName":             "com.example.app",
+			"certificateSha256Digest": []string{"cert-digest"},
+		},
+		"deviceIntegrity": map[string]interface{}{"deviceRecognitionVerdict": deviceVerdicts},
+	}
+	payload, err := json.Marshal(verdict)
+	require.NoError(t, err)
+	signingInput := b64(`{"alg":"ES256"}`) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, k.signing, digest[:])
+	require.NoError(t, err)
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	jws := signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+
+	cek := make([]byte, 32)
+	iv := make([]byte, 12)
+	_, err = rand.Read(cek)
+	require.NoError(t, err)
+	_, err = rand.Read(iv)
+	require.NoError(t, err)
+	header := b64(`{"alg":"A256KW","enc":"A256GCM"}`)
+	block, err := aes.NewCipher(cek)
+	require.NoError(t, err)
+	gcm, err := cipher.NewGCM(block)
+	require.NoError(t, err)
+	sealed := gcm.Seal(nil, iv, []byte(jws), []byte(header))
+	ciphertext, tag := sealed[:len(sealed)-16], sealed[len(sealed)-16:]
+	return strings.Join([]string{
+		header,
+		base64.RawURLEncoding.EncodeToString(wrapKey(t, k.aesKey, cek)),
+		base64.RawURLEncoding.EncodeToString(iv),
+		base64.RawURLEncoding.EncodeToString(ciphertext),
+		base64.RawURLEncoding.EncodeToString(tag),
+	}, ".")
+}
+
+// wrapKey is the RFC 3394 AES key wrap
+func wrapKey(t *testing.T, kek, key []byte) []byte {
+	block, err := aes.NewCipher(kek)
+	require.NoError(t, err)
+	n := len(key) / 8
+	a := uint64(0xA6A6A6A6A6A6A6A6)
+	r := append([]byte(nil), key...)
+	b := make([]byte, 16)
+	for j := 0; j <= 5; j++ {
+		for i := 1; i <= n; i++ {
+			binary.BigEndian.PutUint64(b[:8], a)
+			copy(b[8:], r[(i-1)*8:i*8])
+			block.Encrypt(b, b)
+			a = binary.BigEndian.Uint64(b[:8]) ^ uint64(n*j+i)
+			copy(r[(i-1)*8:i*8], b[8:])
+		}
+	}
+	out := make([]byte, 8, 8+len(r))
+	binary.BigEndian.PutUint64(out, a)
+	return append(out, r...)
+}
+
+func b64(s string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+func TestPlayIntegrityVerdicts(t *testing.T) {
+	keys := newPlayIntegrityKeys(t)
+	verifier := keys.verifier(t)
+	nonce := "n-android"
+	now := time.Now()
+
+	for _, tc := range []struct {
+		verdicts  []string
+		integrity string
+	}{
+		{[]string{"MEETS_BASIC_INTEGRITY", "MEETS_DEVICE_INTEGRITY", "MEETS_STRONG_INTEGRITY"}, device.IntegrityStrong},
+		{[]string{"MEETS_BASIC_INTEGRITY", "MEETS_DEVICE_INTEGRITY"}, device.IntegrityDevice},
+		{[]string{"MEETS_BASIC_INTEGRITY"}, device.IntegrityBasic},
+	} {
+		verdict, err := verifier.Verify(context.Background(), keys.token(t, nonce, now, tc.verdicts...), nonce)
+		require.NoError(t, err)
+		assert.True(t, verdict.Verified, verdict.Reason)
+		assert.Equal(t, tc.integrity, verdict.Integrity)
+	}
+
+	reject := func(v *attestation.PlayIntegrity, token, reason string) {
+		verdict, err := v.Verify(context.Background(), token, nonce)
+		require.NoError(t, err)
+		assert.False(t, verdict.Verified)
+		assert.Contains(t, verdict.Reason, reason)
+	}
+	reject(verifier, keys.token(t, nonce, now), "integrity checks")
+	reject(verifier, keys.token(t, "n-other", now, "MEETS_DEVICE_INTEGRITY"), "nonce mismatch")
+	reject(verifier, keys.token(t, nonce, now.Add(-time.Hour), "MEETS_DEVICE_INTEGRITY"), "expired")
+	reject(verifier, "not.a.token", "invalid integrity token")
+	reject(newPlayIntegrityKeys(t).verifier(t), keys.token(t, nonce, now, "MEETS_DEVICE_INTEGRITY"), "invalid integrity token")
+	reject(keys.verifier(t, "pinned-digest"), keys.token(t, nonce, now, "MEETS_DEVICE_INTEGRITY"), "unknown certificate")
+
+	// Tokens signed with another key are rejected even when they decrypt
+	forged := &playIntegrityKeys{aesKey: keys.aesKey, signing: newPlayIntegrityKeys(t).signing}
+	reject(verifier, forged.token(t, nonce, now, "MEETS_DEVICE_INTEGRITY"), "signature verification failed")
+}
+
+func TestDeviceCheckValidatesTokens(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	var unavailable atomic.Bool
+	apple := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if unavailable.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		// The request is authenticated with an ES256 JWT from the team
+		parts := strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), ".")
+		require.Len(t, parts, 3)
+		signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+		require.NoError(t, err)
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if !ecdsa.Verify(&key.PublicKey, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		claims, err := base64.RawURLEncoding.DecodeString(parts[1])
+		require.NoError(t, err)
+		assert.Contains(t, string(claims), `"iss":"TEAM123"`)
+
+		var body struct {
+			DeviceToken   string `json:"device_token"`
+			TransactionID string `json:"transaction_id"`
+			Timestamp     int64  `json:"timestamp"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		assert.NotEmpty(t, body.TransactionID)
+		assert.NotZero(t, body.Timestamp)
+		if body.DeviceToken != "genuine" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, "Missing or badly formatted authorization token")
+			return
+		}
+	}))
+	defer apple.Close()
+	verifier, err := attestation.NewDeviceCheck(attestation.DeviceCheckConfig{TeamID: "TEAM123", KeyID: "KEY123", PrivateKey: key, URL: apple.URL})
+	require.NoError(t, err)
+
+	verdict, err := verifier.Verify(context.Background(), "genuine", "")
+	require.NoError(t, err)
+	assert.Equal(t, device.Verdict{Verified: true, Integrity: device.IntegrityDevice}, verdict)
+	verdict, err = verifier.Verify(context.Background(), "forged", "")
+	require.NoError(t, err)
+	assert.False(t, verdict.Verified)
+	assert.Contains(t, verdict.Reason, "badly formatted")
+	unavailable.Store(true)
+	_, err = verifier.Verify(context.Background(), "genuine", "")
+	assert.Error(t, err)
+}
+
+func TestAttestorVerifiesDevicesOnRegistration(t *testing.T) {
+	ctx := context.Background()
+	keys := newPlayIntegrityKeys(t)
+	metrics := &countingMetrics{}
+	challenges := attestation.NewChallenges(store.NewMemoryStore(), time.Minute, &testLogger{})
+	attestor := attestation.NewAttestor(map[string]attestation.Verifier{"android": keys.verifier(t)}, challenges, device.FingerprintAttestor{}, &testLogger{}, metrics)
+	registry := device.NewRegistry(device.Config{Attestor: attestor}, store.NewMemoryStore())
+
+	nonce, err := challenges.Issue(ctx)
+	require.NoError(t, err)
+	token := keys.token(t, nonce, time.Now(), "MEETS_DEVICE_INTEGRITY", "MEETS_STRONG_INTEGRITY")
+	pixel, err := registry.Register(ctx, "alice", device.Registration{Platform: "android", Fingerprint: "fp-pixel", Attestation: token, Nonce: nonce})
+	require.NoError(t, err)
+	assert.Equal(t, device.AttestationVerified, pixel.AttestationStatus)
+	assert.Equal(t, device.IntegrityStrong, pixel.Integrity)
+	assert.Equal(t, 1, metrics.count("attestation_verified_total,platform=android"))
+
+	// Android devices need a token; the fingerprint alone is self-reported
+	other, err := registry.Register(ctx, "alice", device.Registration{Platform: "android", Fingerprint: "fp-other"})
+	require.NoError(t, err)
+	assert.Equal(t, device.AttestationPending, other.AttestationStatus)
+	other, err = registry.Verify(ctx, "alice", other.ID, device.Evidence{Fingerprint: "fp-other"})
+	require.NoError(t, err)
+	assert.Equal(t, device.AttestationFailed, other.AttestationStatus)
+	// A token for another device does not verify this one
+	other, err = registry.Verify(ctx, "alice", other.ID, device.Evidence{Fingerprint: "fp-other", Attestation: token, Nonce: nonce})
+	require.NoError(t, err)
+	assert.Equal(t, device.AttestationFailed, other.AttestationStatus)
+	assert.Equal(t, 2, metrics.count("attestation_rejected_total,platform=android"))
+
+	// Platforms without a verifier fall back to the fingerprint
+	laptop, err := registry.Register(ctx, "alice", device.Registration{Platform: "linux", Fingerprint: "fp-laptop"})
+	require.NoError(t, err)
+	laptop, err = registry.Verify(ctx, "alice", laptop.ID, device.Evidence{Fingerprint: "fp-laptop"})
+	require.NoError(t, err)
+	assert.Equal(t, device.AttestationVerified, laptop.AttestationStatus)
+	assert.Empty(t, laptop.Integrity)
+}
+
+func TestAttestorRejectsReplayedAttestations(t *testing.T) {
+	ctx := context.Background()
+	keys := newPlayIntegrityKeys(t)
+	metrics := &countingMetrics{}
+	challenges := attestation.NewChallenges(store.NewMemoryStore(), time.Minute, &testLogger{})
+	attestor := attestation.NewAttestor(map[string]attestation.Verifier{"android": keys.verifier(t)}, challenges, nil, &testLogger{}, metrics)
+	registry := device.NewRegistry(device.Config{Attestor: attestor}, store.NewMemoryStore())
+	pixel, err := registry.Register(ctx, "alice", device.Registration{Platform: "android", Fingerprint: "fp-pixel"})
+	require.NoError(t, err)
+	verify := func(token, nonce string) *interfaces.DeviceInfo {
+		info, err := registry.Verify(ctx, "alice", pixel.ID, device.Evidence{Fingerprint: "fp-pixel", Attestation: token, Nonce: nonce})
+		require.NoError(t, err)
+		return info
+	}
+
+	// The nonce is the server's, not derived from the device
+	router := setupTestRouter()
+	challenges.RegisterRoutes(router)
+	w := adminRequest(router, http.MethodPost, "/attestation/challenges", "", nil)
+	require.Equal(t, http.StatusCreated, w.Code)
+	var challenge struct {
+		Nonce     string `json:"nonce"`
+		ExpiresIn int    `json:"expires_in"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &challenge))
+	assert.Equal(t, 60, challenge.ExpiresIn)
+	nonce := challenge.Nonce
+	token := keys.token(t, nonce, time.Now(), "MEETS_DEVICE_INTEGRITY")
+	assert.Equal(t, device.AttestationVerified, verify(token, nonce).AttestationStatus)
+
+	// A captured token and its nonce cannot be replayed
+	assert.Equal(t, device.AttestationFailed, verify(token, nonce).AttestationStatus)
+	forged := keys.token(t, "n-made-up", time.Now(), "MEETS_DEVICE_INTEGRITY")
+	assert.Equal(t, device.AttestationFailed, verify(forged, "n-made-up").AttestationStatus)
+	assert.Equal(t, 2, metrics.count("attestation_rejected_total,platform=android"))
+
+	// Nor used after it expires
+	short := attestation.NewChallenges(store.NewMemoryStore(), 50*time.Millisecond, &testLogger{})
+	expiring, err := short.Issue(ctx)
+	require.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+	used, err := short.Consume(ctx, expiring)
+	require.NoError(t, err)
+	assert.False(t, used)
+}
+
+func TestDeviceFactorScoresIntegrity(t *testing.T) {
+	factor := trust.DeviceFactor()
+	score := func(signals map[string]string) trust.FactorResult {
+		result, err := factor.Evaluate(context.Background(), trust.Input{Subject: "alice", Device: "d-1", Context: signals})
+		require.NoError(t, err)
+		return result
+	}
+	assert.Equal(t, 1.0, score(map[string]string{"device_verified": "true", "device_integrity": "strong"}).Score)
+	assert.Equal(t, 1.0, score(map[string]string{"device_verified": "true", "device_integrity": "device"}).Score)
+	basic := score(map[string]string{"device_verified": "true", "device_integrity": "basic"})
+	assert.Equal(t, 0.6, basic.Score)
+	assert.Contains(t, basic.Reason, "rooted")
+	// Integrity only counts for verified devices
+	assert.Equal(t, 0.8, score(map[string]string{"device_integrity": "strong"}).Score)
+}
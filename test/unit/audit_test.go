@@ -0,0 +1,349 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/pkg/audit"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+// auditReceiver is a SOC webhook that records batches and can fail or
+// acknowledge part of a batch on demand
+type auditReceiver struct {
+	mu      sync.Mutex
+	batches []audit.Batch
+	fail    bool
+	ackSeq  int64
+	sigs    []string
+}
+
+func (r *auditReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	body, _ := io.ReadAll(req.Body)
+	if r.fail {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	var batch audit.Batch
+	_ = json.Unmarshal(body, &batch)
+	r.batches = append(r.batches, batch)
+	r.sigs = append(r.sigs, req.Header.Get(audit.HeaderSignature))
+	if r.ackSeq > 0 {
+		_ = json.NewEncoder(w).Encode(map[string]int64{"ack_seq": r.ackSeq})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (r *auditReceiver) seqs() []int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var seqs []int64
+	for _, batch := range r.batches {
+		for _, event := range batch.Events {
+			seqs = append(seqs, event.Seq)
+		}
+	}
+	return seqs
+}
+
+func newTestDispatcher(s store.Store, log *audit.Log, endpoint audit.Endpoint) *audit.Dispatcher {
+	return audit.NewDispatcher(audit.DispatcherConfig{
+		Endpoints:    []audit.Endpoint{endpoint},
+		BatchSize:    2,
+		PollInterval: time.Millisecond,
+		MaxBackoff:   time.Millisecond,
+	}, log, s, &testLogger{}, nil)
+}
+
+func recordAuditEvents(t *testing.T, log *audit.Log, tenant string, n int) {
+	for i := 0; i < n; i++ {
+		_, err := log.Record(context.Background(), tenant, "test.event", "u-1", nil)
+		require.NoError(t, err)
+	}
+}
+
+func TestAuditSequencesArePerTenant(t *testing.T) {
+	log := audit.NewLog(store.NewMemoryStore(), time.Hour, &testLogger{}, nil)
+	ctx := context.Background()
+
+	a1, err := log.Record(ctx, "acme", "auth.login", "u-1", nil)
+	require.NoError(t, err)
+	b1, err := log.Record(ctx, "globex", "auth.login", "u-2", nil)
+	require.NoError(t, err)
+	a2, err := log.Record(ctx, "acme", "auth.logout", "u-1", nil)
+	require.NoError(t, err)
+
+	assert.Equal(t, int64(1), a1.Seq)
+	assert.Equal(t, int64(1), b1.Seq)
+	assert.Equal(t, int64(2), a2.Seq)
+
+	_, err = log.Record(ctx, "Bad Tenant", "auth.login", "", nil)
+	assert.ErrorIs(t, err, audit.ErrInvalidTenant)
+}
+
+func TestAuditDeliveryIsOrderedAndAcknowledged(t *testing.T) {
+	s := store.NewMemoryStore()
+	log := audit.NewLog(s, time.Hour, &testLogger{}, nil)
+	receiver := &auditReceiver{}
+	srv := httptest.NewServer(receiver)
+	defer srv.Close()
+
+	recordAuditEvents(t, log, "acme", 5)
+	endpoint := audit.Endpoint{Tenant: "acme", URL: srv.URL, Secret: "s3cret"}
+	d := newTestDispatcher(s, log, endpoint)
+	require.NoError(t, d.Deliver(context.Background(), endpoint))
+
+	assert.Equal(t, []int64{1, 2, 3, 4, 5}, receiver.seqs())
+	assert.Len(t, receiver.batches, 3)
+	assert.True(t, strings.HasPrefix(receiver.sigs[0], "sha256="))
+
+	cursor, err := log.Cursor(context.Background(), "acme")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), cursor)
+}
+
+func TestAuditFailedDeliveryIsRetried(t *testing.T) {
+	s := store.NewMemoryStore()
+	log := audit.NewLog(s, time.Hour, &testLogger{}, nil)
+	receiver := &auditReceiver{fail: true}
+	srv := httptest.NewServer(receiver)
+	defer srv.Close()
+	endpoint := audit.Endpoint{Tenant: "acme", URL: srv.URL}
+	d := newTestDispatcher(s, log, endpoint)
+
+	recordAuditEvents(t, log, "acme", 3)
+	assert.Error(t, d.Deliver(context.Background(), endpoint))
+	cursor, _ := log.Cursor(context.Background(), "acme")
+	assert.Equal(t, int64(0), cursor)
+
+	receiver.mu.Lock()
+	receiver.fail = false
+	receiver.mu.Unlock()
+	time.Sleep(5 * time.Millisecond)
+	require.NoError(t, d.Deliver(context.Background(), endpoint))
+
+	assert.Equal(t, []int64{1, 2, 3}, receiver.seqs())
+}
+
+func TestAuditPartialAckResendsRemainder(t *testing.T) {
+	s := store.NewMemoryStore()
+	log := audit.NewLog(s, time.Hour, &testLogger{}, nil)
+	receiver := &auditReceiver{ackSeq: 1}
+	srv := httptest.NewServer(receiver)
+	defer srv.Close()
+	endpoint := audit.Endpoint{Tenant: "acme", URL: srv.URL}
+	d := newTestDispatcher(s, log, endpoint)
+
+	recordAuditEvents(t, log, "acme", 2)
+	// The receiver only acknowledges seq 1, so seq 2 is sent again and the
+	// stale ack is rejected
+	assert.Error(t, d.Deliver(context.Background(), endpoint))
+
+	cursor, _ := log.Cursor(context.Background(), "acme")
+	assert.Equal(t, int64(1), cursor)
+	assert.Equal(t, []int64{1, 2, 2}, receiver.seqs())
+}
+
+func TestAuditReplayRedeliversFromSequence(t *testing.T) {
+	s := store.NewMemoryStore()
+	log := audit.NewLog(s, time.Hour, &testLogger{}, nil)
+	receiver := &auditReceiver{}
+	srv := httptest.NewServer(receiver)
+	defer srv.Close()
+	endpoint := audit.Endpoint{Tenant: "acme", URL: srv.URL}
+	d := newTestDispatcher(s, log, endpoint)
+	ctx := context.Background()
+
+	recordAuditEvents(t, log, "acme", 4)
+	require.NoError(t, d.Deliver(ctx, endpoint))
+
+	require.NoError(t, log.Replay(ctx, "acme", 3))
+	require.NoError(t, d.Deliver(ctx, endpoint))
+	assert.Equal(t, []int64{1, 2, 3, 4, 3, 4}, receiver.seqs())
+
+	assert.ErrorIs(t, log.Replay(ctx, "acme", 0), audit.ErrInvalidSequence)
+	assert.ErrorIs(t, log.Replay(ctx, "acme", 6), audit.ErrInvalidSequence)
+}
+
+// replayingStore runs replay once, right after the audit cursor is read,
+// as a replay on another replica could
+type replayingStore struct {
+	store.Store
+	replay func()
+}
+
+func (s *replayingStore) Get(ctx context.Context, key string) ([]byte, error) {
+	value, err := s.Store.Get(ctx, key)
+	if replay := s.replay; replay != nil && strings.HasPrefix(key, "audit:cursor:") {
+		s.replay = nil
+		replay()
+	}
+	return value, err
+}
+
+func TestAuditAckKeepsConcurrentReplay(t *testing.T) {
+	s := &replayingStore{Store: store.NewMemoryStore()}
+	log := audit.NewLog(s, time.Hour, &testLogger{}, nil)
+	ctx := context.Background()
+	recordAuditEvents(t, log, "acme", 4)
+	require.NoError(t, log.Ack(ctx, "acme", 0, 2))
+
+	s.replay = func() { require.NoError(t, log.Replay(ctx, "acme", 1)) }
+	assert.ErrorIs(t, log.Ack(ctx, "acme", 2, 4), audit.ErrCursorMoved)
+	cursor, err := log.Cursor(ctx, "acme")
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), cursor)
+}
+
+func TestAuditReplayOfExpiredEventIsGone(t *testing.T) {
+	s := store.NewMemoryStore()
+	log := audit.NewLog(s, time.Hour, &testLogger{}, nil)
+	recordAuditEvents(t, log, "acme", 2)
+	require.NoError(t, s.Delete(context.Background(), "audit:event:acme:00000000000000000001"))
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	log.RegisterRoutes(r)
+
+	w := adminRequest(r, http.MethodPost, "/audit/acme/replay", `{"from_seq": 1}`, nil)
+	assert.Equal(t, http.StatusGone, w.Code)
+	assert.Contains(t, w.Body.String(), "AUDIT_SEQUENCE_EXPIRED")
+
+	w = adminRequest(r, http.MethodPost, "/audit/acme/replay", `{"from_seq": 2}`, nil)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+
+	w = adminRequest(r, http.MethodGet, "/audit/acme", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var status struct {
+		Head   int64 `json:"head_seq"`
+		Cursor int64 `json:"acked_seq"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.Equal(t, int64(2), status.Head)
+	assert.Equal(t, int64(1), status.Cursor)
+}
+
+func TestAuditEventsPullStopsAtGap(t *testing.T) {
+	s := store.NewMemoryStore()
+	log := audit.NewLog(s, time.Hour, &testLogger{}, nil)
+	recordAuditEvents(t, log, "acme", 3)
+	require.NoError(t, s.Delete(context.Background(), "audit:event:acme:00000000000000000002"))
+
+	events, err := log.Events(context.Background(), "acme", 0, 10)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, int64(1), events[0].Seq)
+}
+
+// seedAuditSearch records a mix of admin requests and logins in tenant acme
+func seedAuditSearch(t *testing.T, l *audit.Log) {
+	ctx := context.Background()
+	for _, e := range []struct {
+		action, actor string
+		data          map[string]interface{}
+	}{
+		{"auth.login", "alice", map[string]interface{}{"ip": "10.0.0.1"}},
+		{"admin.request", "alice", map[string]interface{}{"method": "PUT", "path": "/api/v1/admin/roles/viewer", "status": 200}},
+		{"admin.request", "bob", map[string]interface{}{"method": "DELETE", "path": "/api/v1/admin/roles/viewer", "status": 403}},
+		{"admin.request", "alice", map[string]interface{}{"method": "PUT", "path": "/api/v1/admin/tenants/acme", "status": 500}},
+		{"auth.login", "bob", map[string]interface{}{"ip": "10.0.0.2", "result": "failure"}},
+	} {
+		_, err := l.Record(ctx, "acme", e.action, e.actor, e.data)
+		require.NoError(t, err)
+	}
+}
+
+func TestParseAuditQuery(t *testing.T) {
+	now := time.Date(2026, 1, 2, 12, 0, 0, 0, time.UTC)
+	q, err := audit.ParseQuery(`actor:"alice smith" resource:/api/* since:24h until:2026-01-02T06:00:00Z`, now)
+	require.NoError(t, err)
+	assert.Equal(t, "alice smith", q.Actor)
+	assert.Equal(t, "/api/*", q.Resource)
+	assert.Equal(t, now.Add(-24*time.Hour), q.Since)
+	assert.Equal(t, now.Add(-6*time.Hour), q.Until)
+
+	for _, bad := range []string{"user:alice", "actor:a actor:b", "actor", `actor:"open`, "since:yesterday", "since:1h until:2h"} {
+		_, err := audit.ParseQuery(bad, now)
+		assert.ErrorIs(t, err, audit.ErrInvalidQuery, bad)
+	}
+}
+
+func TestAuditSearchUsesIndexes(t *testing.T) {
+	l := audit.NewLog(store.NewMemoryStore(), time.Hour, &testLogger{}, nil)
+	seedAuditSearch(t, l)
+	ctx := context.Background()
+
+	q, _ := audit.ParseQuery("actor:alice action:admin.request", time.Now())
+	events, next, err := l.Search(ctx, "acme", q, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	assert.Equal(t, []int64{4, 2}, []int64{events[0].Seq, events[1].Seq}, "newest first")
+	assert.Zero(t, next)
+
+	q, _ = audit.ParseQuery("result:failure", time.Now())
+	events, _, err = l.Search(ctx, "acme", q, 0, 10)
+	require.NoError(t, err)
+	assert.Len(t, events, 3)
+
+	q, _ = audit.ParseQuery("resource:/api/v1/admin/roles/*", time.Now())
+	events, next, err = l.Search(ctx, "acme", q, 0, 1)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, int64(3), next)
+	events, _, err = l.Search(ctx, "acme", q, next, 1)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), events[0].Seq)
+
+	// A query without indexed terms walks the log
+	q, _ = audit.ParseQuery("since:1h", time.Now())
+	events, _, err = l.Search(ctx, "acme", q, 0, 10)
+	require.NoError(t, err)
+	assert.Len(t, events, 5)
+	q, _ = audit.ParseQuery("until:1h", time.Now())
+	events, _, err = l.Search(ctx, "acme", q, 0, 10)
+	require.NoError(t, err)
+	assert.Empty(t, events)
+}
+
+func TestAuditSearchExport(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	l := audit.NewLog(store.NewMemoryStore(), time.Hour, &testLogger{}, nil)
+	seedAuditSearch(t, l)
+	r := gin.New()
+	r.GET("/audit/search", l.SearchHandler(func(*gin.Context) string { return "acme" }))
+
+	w := adminRequest(r, http.MethodGet, "/audit/search?q=actor:bob&format=csv", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/csv; charset=utf-8", w.Header().Get("Content-Type"))
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	require.Len(t, lines, 3)
+	assert.Equal(t, "seq,time,tenant,action,actor,resource,result,data", lines[0])
+	assert.Contains(t, lines[1], ",auth.login,bob,,failure,")
+
+	w = adminRequest(r, http.MethodGet, "/audit/search?q=action:admin.request&format=ndjson&limit=2", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "3", w.Header().Get("X-Next-Before-Seq"))
+	lines = strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	require.Len(t, lines, 2)
+	var event audit.Event
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &event))
+	assert.Equal(t, int64(4), event.Seq)
+
+	w = adminRequest(r, http.MethodGet, "/audit/search?q=who:bob", "", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "INVALID_AUDIT_QUERY")
+}
@@ -0,0 +1,242 @@
+package unit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/pkg/authz"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/policy"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+type staticValidator map[string]*authz.Identity
+
+func (v staticValidator) ValidateToken(_ context.Context, token string) (*authz.Identity, error) {
+	if identity, ok := v[token]; ok {
+		return identity, nil
+	}
+	return nil, authz.ErrInvalidToken
+}
+
+// newTestAuthorizer accepts the tokens "good" (trust 80, user and admin
+// roles) and "weak" (trust 20, no roles)
+func newTestAuthorizer(t *testing.T, cfg authz.Config) *authz.Authorizer {
+	cfg.Validator = staticValidator{
+		"good": {User: interfaces.UserInfo{ID: "u-1", Username: "alice", Roles: []string{"user", "admin"}}, TrustLevel: 80},
+		"weak": {User: interfaces.UserInfo{ID: "u-2", Username: "bob"}, TrustLevel: 20},
+	}
+	a, err := authz.NewAuthorizer(cfg, &testLogger{}, nil)
+	require.NoError(t, err)
+	return a
+}
+
+func TestAuthorizerRules(t *testing.T) {
+	a := newTestAuthorizer(t, authz.Config{
+		MinTrustLevel: 10,
+		Rules: []authz.Rule{
+			{PathPrefix: "/public", Public: true},
+			{PathPrefix: "/admin", MinTrustLevel: 50, Roles: []string{"admin"}},
+			{PathPrefix: "/admin/reports", Methods: []string{"GET"}, MinTrustLevel: 0, Roles: []string{"admin"}},
+			{PathPrefix: "/payments", Methods: []string{"POST"}, MinTrustLevel: 90},
+		},
+	})
+
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		token   string
+		allowed bool
+		code    string
+	}{
+		{"public without token", "GET", "/public/logo.png", "", true, ""},
+		{"default rule", "GET", "/orders?page=2", "weak", true, ""},
+		{"missing token", "GET", "/orders", "", false, "UNAUTHORIZED"},
+		{"unknown token", "GET", "/orders", "forged", false, "AUTH_001"},
+		{"admin with role", "DELETE", "/admin/users/1", "good", true, ""},
+		{"admin without role", "GET", "/admin/users", "weak", false, "INSUFFICIENT_TRUST"},
+		{"longest prefix wins", "GET", "/admin/reports/q3", "good", true, ""},
+		{"method filter falls back", "POST", "/admin/reports/q3", "good", true, ""},
+		{"trust too low for method", "POST", "/payments", "good", false, "INSUFFICIENT_TRUST"},
+		{"other method uses default", "GET", "/payments", "good", true, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := map[string]string{}
+			if tt.token != "" {
+				headers["authorization"] = "Bearer " + tt.token
+			}
+			d := a.Check(context.Background(), authz.Request{Method: tt.method, Path: tt.path, Headers: headers})
+			assert.Equal(t, tt.allowed, d.Allowed)
+			assert.Equal(t, tt.code, d.Code)
+		})
+	}
+}
+
+func TestAuthorizerRoleDenial(t *testing.T) {
+	a := newTestAuthorizer(t, authz.Config{
+		Rules: []authz.Rule{{PathPrefix: "/finance", Roles: []string{"finance"}}},
+	})
+
+	d := a.Check(context.Background(), authz.Request{
+		Method:  "GET",
+		Path:    "/finance",
+		Headers: map[string]string{"authorization": "Bearer good", "accept-language": "es"},
+	})
+	assert.False(t, d.Allowed)
+	assert.Equal(t, http.StatusForbidden, d.Status)
+	assert.Equal(t, "INSUFFICIENT_ROLE", d.Code)
+	assert.Equal(t, "No tiene un rol que permita acceder a este recurso", d.Message)
+}
+
+func TestAuthorizerPolicies(t *testing.T) {
+	ctx := context.Background()
+	engine := policy.NewEngine(policy.Config{}, store.NewMemoryStore())
+	_, err := engine.Create(ctx, policy.Policy{
+		Name: "Reports from the office", Subjects: []string{"*"}, Resources: []string{"reports/*"}, Actions: []string{"*"}, Effect: policy.EffectDeny,
+		Conditions: []policy.Condition{{Attribute: policy.AttributeIP, Operator: policy.OpNotCIDR, Values: []string{"10.0.0.0/8"}}},
+	})
+	require.NoError(t, err)
+	_, err = engine.Create(ctx, policy.Policy{
+		Name: "Trusted payments", Subjects: []string{"*"}, Resources: []string{"payments"}, Actions: []string{policy.ActionWrite}, Effect: policy.EffectDeny,
+		Conditions: []policy.Condition{{Attribute: policy.AttributeTrustScore, Operator: policy.OpLessThan, Values: []string{"50"}}},
+	})
+	require.NoError(t, err)
+	_, err = engine.Create(ctx, policy.Policy{
+		Name: "Exports step up", Subjects: []string{"*"}, Resources: []string{"exports"}, Actions: []string{"*"}, Effect: policy.EffectAllow,
+		Obligations: []string{"step_up"},
+	})
+	require.NoError(t, err)
+
+	a := newTestAuthorizer(t, authz.Config{
+		Policies: engine.DecisionPoint(policy.PDPConfig{
+			Defaults: []*policy.Policy{{ID: "default-allow", Name: "Anyone", Subjects: []string{"*"}, Resources: []string{"*"}, Actions: []string{"*"}, Effect: policy.EffectAllow}},
+		}),
+	})
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		token    string
+		clientIP string
+		allowed  bool
+	}{
+		{"default allows", "GET", "/api/v1/devices", "weak", "", true},
+		{"inside the office", "GET", "/api/v1/reports/q3", "good", "10.1.2.3", true},
+		{"outside the office", "GET", "/reports/q3", "good", "198.51.100.7", false},
+		{"without an address", "GET", "/reports/q3", "good", "", false},
+		{"trusted payment", "POST", "/payments", "good", "", true},
+		{"untrusted payment", "POST", "/payments", "weak", "", false},
+		{"untrusted read", "GET", "/payments", "weak", "", true},
+		{"obligation", "GET", "/exports", "good", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := a.Check(ctx, authz.Request{
+				Method:   tt.method,
+				Path:     tt.path,
+				Headers:  map[string]string{"authorization": "Bearer " + tt.token},
+				ClientIP: tt.clientIP,
+			})
+			assert.Equal(t, tt.allowed, d.Allowed)
+			if !tt.allowed {
+				assert.Equal(t, http.StatusForbidden, d.Status)
+				assert.Equal(t, "POLICY_DENIED", d.Code)
+			}
+		})
+	}
+}
+
+func TestAuthorizerIdentityHeaders(t *testing.T) {
+	a := newTestAuthorizer(t, authz.Config{})
+
+	d := a.Check(context.Background(), authz.Request{
+		Method: "GET",
+		Path:   "/",
+		Headers: map[string]string{
+			"authorization":   "Bearer good",
+			"x-zamaz-user-id": "spoofed",
+			"x-zamaz-admin":   "true",
+		},
+	})
+	require.True(t, d.Allowed)
+	assert.Equal(t, "u-1", d.Headers[authz.HeaderUserID])
+	assert.Equal(t, "user,admin", d.Headers[authz.HeaderRoles])
+	assert.Equal(t, "80", d.Headers[authz.HeaderTrustLevel])
+	assert.ElementsMatch(t, []string{"x-zamaz-user-id", "x-zamaz-admin"}, d.RemoveHeaders)
+}
+
+func TestLoadRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	require.NoError(t, os.WriteFile(path, []byte(`[{"path_prefix":"/admin","min_trust_level":75,"roles":["admin"]}]`), 0o600))
+
+	rules, err := authz.LoadRules(path)
+	require.NoError(t, err)
+	require.Len(t, rules, 1)
+	assert.Equal(t, 75, rules[0].MinTrustLevel)
+	assert.Equal(t, []string{"admin"}, rules[0].Roles)
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"path_prefix":"/admin"}`), 0o600))
+	_, err = authz.LoadRules(path)
+	assert.Error(t, err)
+}
+
+func TestIntrospectionValidator(t *testing.T) {
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientID, secret, _ := r.BasicAuth()
+		if clientID != "zerotrust-client" || secret != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		require.NoError(t, r.ParseForm())
+		switch r.PostForm.Get("token") {
+		case "active":
+			w.Write([]byte(`{"active":true,"sub":"u-9","preferred_username":"carol","email":"carol@example.com","realm_access":{"roles":["user"]},"trust_level":72}`))
+		case "no-trust":
+			w.Write([]byte(`{"active":true,"sub":"u-10","username":"dave"}`))
+		default:
+			w.Write([]byte(`{"active":false}`))
+		}
+	}))
+	defer idp.Close()
+
+	v := authz.NewIntrospectionValidator(idp.URL, "zerotrust-client", "s3cret")
+	v.DefaultTrustLevel = 10
+	ctx := context.Background()
+
+	identity, err := v.ValidateToken(ctx, "active")
+	require.NoError(t, err)
+	assert.Equal(t, "u-9", identity.User.ID)
+	assert.Equal(t, "carol", identity.User.Username)
+	assert.Equal(t, []string{"user"}, identity.User.Roles)
+	assert.Equal(t, 72, identity.TrustLevel)
+
+	identity, err = v.ValidateToken(ctx, "no-trust")
+	require.NoError(t, err)
+	assert.Equal(t, "dave", identity.User.Username)
+	assert.Equal(t, 10, identity.TrustLevel)
+
+	_, err = v.ValidateToken(ctx, "revoked")
+	assert.ErrorIs(t, err, authz.ErrInvalidToken)
+
+	v.ClientSecret = "wrong"
+	_, err = v.ValidateToken(ctx, "active")
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, authz.ErrInvalidToken)
+}
+
+func TestKeycloakIntrospectionURL(t *testing.T) {
+	assert.Equal(t,
+		"http://keycloak:8080/realms/zerotrust-test/protocol/openid-connect/token/introspect",
+		authz.KeycloakIntrospectionURL("http://keycloak:8080/", "zerotrust-test"))
+}
@@ -0,0 +1,107 @@
+package unit
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+	"github.com/lsendel/impl-zamaz/pkg/trust"
+)
+
+var firefox = map[string]string{
+	trust.SignalUserAgent:      "Mozilla/5.0 Firefox/128.0",
+	trust.SignalAcceptLanguage: "en-US,en;q=0.5",
+	trust.SignalTLSFingerprint: "t13d1715h2_5b57614c22b0_3d5424432f57",
+}
+
+func TestBehaviorFactorRewardsConsistentClients(t *testing.T) {
+	ctx := context.Background()
+	profiles := trust.NewBehaviorProfiles(trust.BehaviorConfig{ConsistentAfter: 4}, store.NewMemoryStore(), &testLogger{})
+	factor := profiles.Factor()
+	score := func(signals map[string]string) trust.FactorResult {
+		result, err := factor.Evaluate(ctx, trust.Input{Subject: "alice", Context: signals})
+		require.NoError(t, err)
+		return result
+	}
+
+	assert.Equal(t, 0.8, score(firefox).Score)
+	require.NoError(t, profiles.Record(ctx, "alice", firefox))
+	first := score(firefox)
+	assert.InDelta(t, 0.55, first.Score, 1e-9)
+	assert.Equal(t, "seen 1 times", first.Evidence[trust.SignalUserAgent])
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, profiles.Record(ctx, "alice", firefox))
+	}
+	consistent := score(firefox)
+	assert.Equal(t, 1.0, consistent.Score)
+	assert.Equal(t, "consistent client", consistent.Reason)
+
+	// A new TLS stack and language under a familiar user agent
+	changed := map[string]string{
+		trust.SignalUserAgent:      firefox[trust.SignalUserAgent],
+		trust.SignalAcceptLanguage: "ru-RU",
+		trust.SignalTLSFingerprint: "t13d301000_01455d0db70d_5ac7197df9d2",
+	}
+	result := score(changed)
+	assert.InDelta(t, 1.0/3, result.Score, 1e-9)
+	assert.Equal(t, "new accept language, tls fingerprint", result.Reason)
+	assert.Equal(t, "new", result.Evidence[trust.SignalTLSFingerprint])
+
+	// Signals the profile has never carried are not compared
+	assert.Equal(t, 1.0, score(map[string]string{trust.SignalUserAgent: firefox[trust.SignalUserAgent], "ip": "10.0.0.1"}).Score)
+	assert.Equal(t, 0.8, score(map[string]string{"ip": "10.0.0.1"}).Score)
+}
+
+func TestBehaviorProfilesForgetOldClients(t *testing.T) {
+	ctx := context.Background()
+	profiles := trust.NewBehaviorProfiles(trust.BehaviorConfig{MaxValues: 2}, store.NewMemoryStore(), &testLogger{})
+	for _, ua := range []string{"curl/8.0", "Safari/17", "Chrome/126"} {
+		require.NoError(t, profiles.Record(ctx, "alice", map[string]string{trust.SignalUserAgent: ua}))
+	}
+	result, err := profiles.Factor().Evaluate(ctx, trust.Input{Subject: "alice", Context: map[string]string{trust.SignalUserAgent: "curl/8.0"}})
+	require.NoError(t, err)
+	assert.Equal(t, 0.0, result.Score)
+	result, err = profiles.Factor().Evaluate(ctx, trust.Input{Subject: "alice", Context: map[string]string{trust.SignalUserAgent: "Safari/17"}})
+	require.NoError(t, err)
+	assert.Greater(t, result.Score, 0.0)
+}
+
+func TestBehaviorMiddlewareRecordsAuthenticatedRequests(t *testing.T) {
+	s := store.NewMemoryStore()
+	profiles := trust.NewBehaviorProfiles(trust.BehaviorConfig{}, s, &testLogger{})
+	router := setupTestRouter()
+	router.Use(func(c *gin.Context) {
+		if c.GetHeader("X-Test-User") != "" {
+			c.Set("user", &interfaces.UserInfo{ID: c.GetHeader("X-Test-User")})
+		}
+	}, profiles.Middleware())
+	router.GET("/context", func(c *gin.Context) {
+		c.JSON(http.StatusOK, trust.RequestContext(c))
+	})
+
+	headers := map[string]string{
+		"User-Agent":               firefox[trust.SignalUserAgent],
+		"Accept-Language":          firefox[trust.SignalAcceptLanguage],
+		trust.HeaderTLSFingerprint: firefox[trust.SignalTLSFingerprint],
+	}
+	w := adminRequest(router, http.MethodGet, "/context", "", headers)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"tls_fingerprint":"t13d1715h2_5b57614c22b0_3d5424432f57"`)
+	assert.Contains(t, w.Body.String(), `"endpoint":"GET /context"`)
+	keys, err := s.Keys(context.Background(), "behavior:")
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+
+	headers["X-Test-User"] = "alice"
+	adminRequest(router, http.MethodGet, "/context", "", headers)
+	data, err := s.Get(context.Background(), "behavior:alice")
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "Firefox")
+}
@@ -0,0 +1,129 @@
+package unit
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lsendel/impl-zamaz/pkg/security"
+)
+
+func newBodyLimitRouter(maxSize int64, maxDepth int, metrics *countingMetrics) *gin.Engine {
+	validator := security.NewInputValidator(&security.ValidationConfig{MaxRequestSize: maxSize, MaxJSONDepth: maxDepth}, testLogger{}, metrics)
+	r := setupTestRouter()
+	r.Use(validator.BodyLimitMiddleware())
+	r.POST("/echo", func(c *gin.Context) {
+		var body map[string]interface{}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"code": "VALIDATION_ERROR"})
+			return
+		}
+		c.JSON(http.StatusOK, body)
+	})
+	r.POST("/upload", func(c *gin.Context) {
+		n, err := io.Copy(io.Discard, c.Request.Body)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"bytes": n})
+	})
+	return r
+}
+
+func TestBodyLimitsRefuseLargeBodies(t *testing.T) {
+	metrics := &countingMetrics{}
+	r := newBodyLimitRouter(64, 0, metrics)
+	post := func(path, contentType string, body io.Reader, chunked bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, body)
+		req.Header.Set("Content-Type", contentType)
+		if chunked {
+			req.ContentLength = -1
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := post("/echo", "application/json", strings.NewReader(`{"name":"ana"}`), true)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"name":"ana"}`, w.Body.String())
+
+	large := `{"name":"` + strings.Repeat("a", 64) + `"}`
+	w = post("/echo", "application/json", strings.NewReader(large), false)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Contains(t, w.Body.String(), "REQUEST_TOO_LARGE")
+
+	// Without a Content-Length the body is cut off while it is read
+	w = post("/echo", "application/merge-patch+json", strings.NewReader(large), true)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	w = post("/upload", "application/octet-stream", strings.NewReader(strings.Repeat("x", 65)), true)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Contains(t, w.Body.String(), "REQUEST_TOO_LARGE")
+	w = post("/upload", "application/octet-stream", strings.NewReader(strings.Repeat("x", 64)), true)
+	assert.JSONEq(t, `{"bytes":64}`, w.Body.String())
+
+	assert.Equal(t, 3, metrics.count("request_body_rejections_total,check=body_too_large"))
+}
+
+func TestBodyLimitsRefuseDeepJSON(t *testing.T) {
+	metrics := &countingMetrics{}
+	r := newBodyLimitRouter(1<<20, 3, metrics)
+	post := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/echo", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusOK, post(`{"a":{"b":[1,2,"]]]]"]}}`).Code)
+	w := post(`{"a":{"b":[[{"c":1}]]}}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "JSON_TOO_DEEP")
+	w = post(`{"a":[[[[[[[[`)
+	assert.Contains(t, w.Body.String(), "JSON_TOO_DEEP", "depth is checked before the JSON ends")
+
+	// Malformed JSON is the handler's to reject
+	w = post(`{"a":`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "VALIDATION_ERROR")
+	assert.Equal(t, 2, metrics.count("request_body_rejections_total,check=json_too_deep"))
+}
+
+func TestBodyLimitsCheckMislabelledJSON(t *testing.T) {
+	metrics := &countingMetrics{}
+	r := newBodyLimitRouter(1<<20, 3, metrics)
+	post := func(path, contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// ShouldBindJSON parses the body whatever its Content-Type
+	deep := `{"a":{"b":[[{"c":1}]]}}`
+	for _, contentType := range []string{"text/plain", "application/x-www-form-urlencoded", ""} {
+		w := post("/echo", contentType, deep)
+		assert.Equal(t, http.StatusBadRequest, w.Code, contentType)
+		assert.Contains(t, w.Body.String(), "JSON_TOO_DEEP", contentType)
+	}
+	w := post("/echo", "text/plain", " \r\n\t"+deep)
+	assert.Contains(t, w.Body.String(), "JSON_TOO_DEEP", "leading whitespace is skipped")
+	w = post("/echo", "text/plain", `{"name":"ana"}`)
+	assert.JSONEq(t, `{"name":"ana"}`, w.Body.String())
+
+	// Other bodies reach the handler untouched
+	w = post("/upload", "text/plain", "  plain [[[[ text")
+	assert.JSONEq(t, `{"bytes":17}`, w.Body.String())
+	w = post("/upload", "application/octet-stream", "\n\x00\x01")
+	assert.JSONEq(t, `{"bytes":3}`, w.Body.String())
+	assert.Equal(t, 4, metrics.count("request_body_rejections_total,check=json_too_deep"))
+}
@@ -0,0 +1,112 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/pkg/security"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+func TestBruteForceBlocksIPTryingManyAccounts(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	metrics := &countingMetrics{}
+	bruteForce := security.NewBruteForce(security.BruteForceConfig{MaxAccountsPerIP: 3, BlockTime: time.Hour}, s, &testLogger{}, metrics)
+
+	// Retrying one account is left to per-account lockout
+	for i := 0; i < 5; i++ {
+		blocks, err := bruteForce.Failure(ctx, "192.0.2.1", "alice")
+		require.NoError(t, err)
+		assert.Empty(t, blocks)
+	}
+	_, err := bruteForce.Failure(ctx, "192.0.2.1", "bob")
+	require.NoError(t, err)
+	blocks, err := bruteForce.Failure(ctx, "192.0.2.1", "carol")
+	require.NoError(t, err)
+	require.Len(t, blocks, 1)
+	assert.Equal(t, "192.0.2.1", blocks[0].IP)
+	assert.Equal(t, security.BlockManyAccounts, blocks[0].Reason)
+	assert.Equal(t, 3, blocks[0].Distinct)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), blocks[0].Until, time.Minute)
+
+	// Already blocked
+	blocks, err = bruteForce.Failure(ctx, "192.0.2.1", "dave")
+	require.NoError(t, err)
+	assert.Empty(t, blocks)
+	assert.Equal(t, 1, metrics.count("ip_blocks_total,reason=many_accounts"))
+
+	// The block is in the shared store, so a fresh instance sees it
+	restarted := security.NewBruteForce(security.BruteForceConfig{MaxAccountsPerIP: 3}, s, &testLogger{}, nil)
+	block, err := restarted.Blocked(ctx, "192.0.2.1")
+	require.NoError(t, err)
+	assert.NotNil(t, block)
+	block, err = restarted.Blocked(ctx, "192.0.2.2")
+	require.NoError(t, err)
+	assert.Nil(t, block)
+}
+
+func TestBruteForceBlocksIPsSharingAnAccount(t *testing.T) {
+	ctx := context.Background()
+	bruteForce := security.NewBruteForce(security.BruteForceConfig{MaxIPsPerAccount: 3}, store.NewMemoryStore(), &testLogger{}, nil)
+
+	for i := 1; i <= 2; i++ {
+		blocks, err := bruteForce.Failure(ctx, fmt.Sprintf("192.0.2.%d", i), "alice")
+		require.NoError(t, err)
+		assert.Empty(t, blocks)
+	}
+	// Usernames are compared case-insensitively
+	blocks, err := bruteForce.Failure(ctx, "2001:db8::1", " Alice")
+	require.NoError(t, err)
+	require.Len(t, blocks, 3)
+	for _, block := range blocks {
+		assert.Equal(t, security.BlockManyIPs, block.Reason)
+	}
+
+	// Joining the attack later still gets blocked
+	blocks, err = bruteForce.Failure(ctx, "192.0.2.9", "alice")
+	require.NoError(t, err)
+	require.Len(t, blocks, 1)
+	assert.Equal(t, "192.0.2.9", blocks[0].IP)
+
+	list, err := bruteForce.List(ctx)
+	require.NoError(t, err)
+	assert.Len(t, list, 4)
+}
+
+func TestBruteForceMiddlewareAndAdminRoutes(t *testing.T) {
+	ctx := context.Background()
+	bruteForce := security.NewBruteForce(security.BruteForceConfig{MaxAccountsPerIP: 1}, store.NewMemoryStore(), &testLogger{}, nil)
+	router := setupTestRouter()
+	router.POST("/login", bruteForce.Middleware(), func(c *gin.Context) { c.Status(http.StatusOK) })
+	bruteForce.RegisterRoutes(router.Group("/admin"))
+
+	// httptest requests come from 192.0.2.1
+	assert.Equal(t, http.StatusOK, adminRequest(router, http.MethodPost, "/login", "", nil).Code)
+	_, err := bruteForce.Failure(ctx, "192.0.2.1", "alice")
+	require.NoError(t, err)
+	w := adminRequest(router, http.MethodPost, "/login", "", nil)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Contains(t, w.Body.String(), "IP_BLOCKED")
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+
+	w = adminRequest(router, http.MethodGet, "/admin/ip-blocks", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var list struct {
+		IPBlocks []security.IPBlock `json:"ip_blocks"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	require.Len(t, list.IPBlocks, 1)
+	assert.Equal(t, "192.0.2.1", list.IPBlocks[0].IP)
+
+	assert.Equal(t, http.StatusNoContent, adminRequest(router, http.MethodDelete, "/admin/ip-blocks/192.0.2.1", "", nil).Code)
+	assert.Equal(t, http.StatusOK, adminRequest(router, http.MethodPost, "/login", "", nil).Code)
+}
@@ -0,0 +1,145 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/pkg/security"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+var errDependency = errors.New("dependency down")
+
+func callBreaker(m *security.CircuitBreakerManager, name string, err error) error {
+	return m.Execute(context.Background(), name, func(context.Context) error { return err })
+}
+
+func TestCircuitBreakerOpensAndRecovers(t *testing.T) {
+	m := security.NewCircuitBreakerManager(store.NewMemoryStore(), &testLogger{}, nil)
+	require.NoError(t, m.Configure("keycloak", security.BreakerConfig{
+		FailureRatio:   0.5,
+		MinRequests:    4,
+		Window:         time.Minute,
+		OpenTimeout:    30 * time.Millisecond,
+		HalfOpenProbes: 2,
+	}))
+
+	assert.NoError(t, callBreaker(m, "keycloak", nil))
+	assert.NoError(t, callBreaker(m, "keycloak", nil))
+	assert.Equal(t, errDependency, callBreaker(m, "keycloak", errDependency))
+	assert.Equal(t, errDependency, callBreaker(m, "keycloak", errDependency))
+	assert.ErrorIs(t, callBreaker(m, "keycloak", nil), security.ErrCircuitOpen)
+
+	// After the open timeout two probes are let through and close it
+	time.Sleep(40 * time.Millisecond)
+	done1, err := m.Allow(context.Background(), "keycloak")
+	require.NoError(t, err)
+	done2, err := m.Allow(context.Background(), "keycloak")
+	require.NoError(t, err)
+	_, err = m.Allow(context.Background(), "keycloak")
+	assert.ErrorIs(t, err, security.ErrCircuitOpen, "probes are bounded")
+	done1(nil)
+	done2(nil)
+	assert.Equal(t, security.BreakerClosed, m.GetAllStats(context.Background())[0].State)
+}
+
+func TestCircuitBreakerSharedAcrossReplicas(t *testing.T) {
+	shared := store.NewMemoryStore()
+	a := security.NewCircuitBreakerManager(shared, &testLogger{}, nil)
+	b := security.NewCircuitBreakerManager(shared, &testLogger{}, nil)
+	for _, m := range []*security.CircuitBreakerManager{a, b} {
+		require.NoError(t, m.Configure("upstream", security.BreakerConfig{}))
+	}
+
+	require.NoError(t, a.Trip(context.Background(), "upstream", "incident-42", "oncall"))
+	assert.ErrorIs(t, callBreaker(b, "upstream", nil), security.ErrCircuitOpen)
+
+	stats := b.GetAllStats(context.Background())
+	require.Len(t, stats, 1)
+	assert.True(t, stats[0].Forced)
+	assert.Equal(t, "incident-42", stats[0].Reason)
+	assert.Equal(t, security.DefaultBreakerConfig.HalfOpenProbes, stats[0].HalfOpenProbes)
+
+	require.NoError(t, b.Reset(context.Background(), "upstream", "oncall"))
+	assert.NoError(t, callBreaker(a, "upstream", nil))
+	assert.ErrorIs(t, a.Trip(context.Background(), "missing", "", ""), security.ErrUnknownBreaker)
+}
+
+func TestCircuitBreakerManualControlRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	m := security.NewCircuitBreakerManager(store.NewMemoryStore(), &testLogger{}, nil)
+	require.NoError(t, m.Configure("smtp", security.BreakerConfig{}))
+	r := gin.New()
+	m.RegisterRoutes(r)
+
+	w := adminRequest(r, http.MethodPost, "/circuit-breakers/smtp/trip", `{"reason": "provider outage"}`, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var st security.BreakerStats
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &st))
+	assert.Equal(t, security.BreakerOpen, st.State)
+	assert.Equal(t, "provider outage", st.Reason)
+
+	w = adminRequest(r, http.MethodPost, "/circuit-breakers/smtp/reset", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &st))
+	assert.Equal(t, security.BreakerClosed, st.State)
+	assert.False(t, st.Forced)
+
+	w = adminRequest(r, http.MethodPost, "/circuit-breakers/unknown/trip", "", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestLoadBreakers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "breakers.json")
+	require.NoError(t, os.WriteFile(path, []byte(`[
+		{"name": "keycloak", "failure_ratio": 0.25, "min_requests": 20, "window": "30s", "open_timeout": "15s", "half_open_probes": 1},
+		{"name": "upstream"}
+	]`), 0o600))
+	m := security.NewCircuitBreakerManager(store.NewMemoryStore(), &testLogger{}, nil)
+	require.NoError(t, m.LoadBreakers(path))
+
+	cfg, ok := m.Config("keycloak")
+	require.True(t, ok)
+	assert.Equal(t, security.BreakerConfig{FailureRatio: 0.25, MinRequests: 20, Window: 30 * time.Second, OpenTimeout: 15 * time.Second, HalfOpenProbes: 1}, cfg)
+	cfg, _ = m.Config("upstream")
+	assert.Equal(t, security.DefaultBreakerConfig, cfg)
+
+	require.NoError(t, os.WriteFile(path, []byte(`[{"name": "bad", "window": "soon"}]`), 0o600))
+	assert.Error(t, m.LoadBreakers(path))
+}
+
+func TestCircuitBreakerStateChangeListeners(t *testing.T) {
+	m := security.NewCircuitBreakerManager(store.NewMemoryStore(), &testLogger{}, nil)
+	require.NoError(t, m.Configure("billing", security.BreakerConfig{MinRequests: 1, OpenTimeout: 20 * time.Millisecond, HalfOpenProbes: 1}))
+	var changes []string
+	m.OnStateChange(func(name, from, to string) {
+		changes = append(changes, name+":"+from+">"+to)
+	})
+
+	assert.Equal(t, errDependency, callBreaker(m, "billing", errDependency))
+	assert.ErrorIs(t, callBreaker(m, "billing", nil), security.ErrCircuitOpen)
+	time.Sleep(30 * time.Millisecond)
+	assert.NoError(t, callBreaker(m, "billing", nil))
+	require.NoError(t, m.Trip(context.Background(), "billing", "", "oncall"))
+	// Tripping an open breaker again is not a change
+	require.NoError(t, m.Trip(context.Background(), "billing", "", "oncall"))
+	require.NoError(t, m.Reset(context.Background(), "billing", "oncall"))
+
+	assert.Equal(t, []string{
+		"billing:closed>open",
+		"billing:open>half-open",
+		"billing:half-open>closed",
+		"billing:closed>open",
+		"billing:open>closed",
+	}, changes)
+}
@@ -0,0 +1,303 @@
+package unit
+
+import (
+	"bufio"
+	"context"
+	"encoding/asn1"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/lsendel/impl-zamaz/pkg/auth"
+)
+
+// fakeDirectory is a minimal LDAP server: simple binds against passwords by
+// DN and equality searches, such as on uid
+type fakeDirectory struct {
+	passwords map[string]string
+	// failures answers binds for a DN with result 49 and a diagnostic message
+	failures map[string]string
+	entries  map[string]map[string][]string
+	listener net.Listener
+}
+
+func newFakeDirectory(t *testing.T) *fakeDirectory {
+	d := &fakeDirectory{
+		passwords: map[string]string{
+			"cn=svc,dc=example,dc=com":              "svc-secret",
+			"uid=alice,ou=people,dc=example,dc=com": "alice-secret",
+		},
+		failures: map[string]string{
+			"uid=locked,ou=people,dc=example,dc=com": "80090308: LdapErr: DSID-0C09042A, comment: AcceptSecurityContext error, data 775, v3839",
+		},
+		entries: map[string]map[string][]string{
+			"uid=alice,ou=people,dc=example,dc=com": {
+				"uid":      {"alice"},
+				"mail":     {"alice@example.com"},
+				"memberOf": {"cn=admin,ou=groups,dc=example,dc=com", "cn=ops\\, east,ou=groups,dc=example,dc=com"},
+			},
+			"uid=locked,ou=people,dc=example,dc=com": {"uid": {"locked"}},
+			"cn=admin,ou=groups,dc=example,dc=com": {
+				"objectClass": {"groupOfNames"},
+				"member":      {"uid=alice,ou=people,dc=example,dc=com"},
+			},
+			"cn=ops\\, east,ou=groups,dc=example,dc=com": {
+				"objectClass": {"groupOfNames"},
+				"member":      {"uid=alice,ou=people,dc=example,dc=com", "uid=locked,ou=people,dc=example,dc=com"},
+			},
+		},
+	}
+	var err error
+	d.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { d.listener.Close() })
+	go func() {
+		for {
+			conn, err := d.listener.Accept()
+			if err != nil {
+				return
+			}
+			go d.serve(conn)
+		}
+	}()
+	return d
+}
+
+func (d *fakeDirectory) URL() string {
+	return "ldap://" + d.listener.Addr().String()
+}
+
+func (d *fakeDirectory) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	var pending []byte
+	boundAs := ""
+	for {
+		var msg asn1.RawValue
+		rest, err := asn1.Unmarshal(pending, &msg)
+		if err != nil {
+			buf := make([]byte, 4096)
+			n, err := r.Read(buf)
+			if err != nil {
+				return
+			}
+			pending = append(pending, buf[:n]...)
+			continue
+		}
+		pending = rest
+
+		var id int
+		body, _ := asn1.Unmarshal(msg.Bytes, &id)
+		var op asn1.RawValue
+		asn1.Unmarshal(body, &op)
+		switch op.Tag {
+		case 0: // bind
+			var version int
+			var name []byte
+			var password asn1.RawValue
+			rest, _ := asn1.Unmarshal(op.Bytes, &version)
+			rest, _ = asn1.Unmarshal(rest, &name)
+			asn1.Unmarshal(rest, &password)
+			code, message := 49, ""
+			if diagnostic, ok := d.failures[string(name)]; ok {
+				message = diagnostic
+			} else if want, ok := d.passwords[string(name)]; ok && want == string(password.Bytes) {
+				code, boundAs = 0, string(name)
+			}
+			d.reply(conn, id, 1, ldapResultBytes(code, message))
+		case 2: // unbind
+			return
+		case 3: // search
+			var base []byte
+			var scope asn1.Enumerated
+			var filter asn1.RawValue
+			rest, _ := asn1.Unmarshal(op.Bytes, &base)
+			rest, _ = asn1.Unmarshal(rest, &scope)
+			for i := 0; i < 4; i++ {
+				var skip asn1.RawValue
+				rest, _ = asn1.Unmarshal(rest, &skip)
+			}
+			asn1.Unmarshal(rest, &filter)
+			if boundAs != "" {
+				for dn, attrs := range d.entries {
+					if d.matches(dn, attrs, string(base), int(scope), filter) {
+						d.reply(conn, id, 4, entryBytes(dn, attrs))
+					}
+				}
+			}
+			d.reply(conn, id, 5, ldapResultBytes(0, ""))
+		}
+	}
+}
+
+func (d *fakeDirectory) matches(dn string, attrs map[string][]string, base string, scope int, filter asn1.RawValue) bool {
+	if scope == 0 {
+		return dn == base
+	}
+	if !strings.HasSuffix(dn, base) || filter.Tag != 3 {
+		return false
+	}
+	var attr, value []byte
+	rest, _ := asn1.Unmarshal(filter.Bytes, &attr)
+	asn1.Unmarshal(rest, &value)
+	for _, v := range attrs[string(attr)] {
+		if v == string(value) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *fakeDirectory) reply(conn net.Conn, id, tag int, content []byte) {
+	msg, _ := asn1.Marshal(struct {
+		ID int
+		Op asn1.RawValue
+	}{id, asn1.RawValue{Class: asn1.ClassApplication, Tag: tag, IsCompound: true, Bytes: content}})
+	conn.Write(msg)
+}
+
+func ldapResultBytes(code int, message string) []byte {
+	a, _ := asn1.Marshal(asn1.Enumerated(code))
+	b, _ := asn1.Marshal([]byte(""))
+	c, _ := asn1.Marshal([]byte(message))
+	return append(append(a, b...), c...)
+}
+
+func entryBytes(dn string, attrs map[string][]string) []byte {
+	type attribute struct {
+		Type   []byte
+		Values [][]byte `asn1:"set"`
+	}
+	var list []attribute
+	for name, values := range attrs {
+		a := attribute{Type: []byte(name)}
+		for _, v := range values {
+			a.Values = append(a.Values, []byte(v))
+		}
+		list = append(list, a)
+	}
+	name, _ := asn1.Marshal([]byte(dn))
+	encoded, _ := asn1.Marshal(list)
+	return append(name, encoded...)
+}
+
+func TestLDAPVerifierSearchThenBind(t *testing.T) {
+	ctx := context.Background()
+	directory := newFakeDirectory(t)
+	verifier, err := auth.NewLDAPVerifier(auth.LDAPConfig{
+		URL:          directory.URL(),
+		BindDN:       "cn=svc,dc=example,dc=com",
+		BindPassword: "svc-secret",
+		BaseDN:       "ou=people,dc=example,dc=com",
+	})
+	require.NoError(t, err)
+
+	resp, err := verifier.Authenticate(ctx, "alice", "alice-secret")
+	require.NoError(t, err)
+	assert.Equal(t, "uid=alice,ou=people,dc=example,dc=com", resp.User.ID)
+	assert.Equal(t, "alice@example.com", resp.User.Email)
+	assert.Equal(t, []string{"admin", "ops, east"}, resp.User.Roles)
+	assert.Empty(t, resp.AccessToken, "tokens are left to the caller")
+
+	_, err = verifier.Authenticate(ctx, "alice", "wrong")
+	assert.ErrorIs(t, err, auth.ErrInvalidCredentials)
+	_, err = verifier.Authenticate(ctx, "nobody", "alice-secret")
+	assert.ErrorIs(t, err, auth.ErrInvalidCredentials)
+	// Empty passwords would be anonymous binds
+	_, err = verifier.Authenticate(ctx, "alice", "")
+	assert.ErrorIs(t, err, auth.ErrInvalidCredentials)
+	_, err = verifier.Authenticate(ctx, "locked", "anything")
+	assert.ErrorIs(t, err, auth.ErrAccountLocked)
+}
+
+func TestLDAPVerifierDNTemplate(t *testing.T) {
+	ctx := context.Background()
+	directory := newFakeDirectory(t)
+	verifier, err := auth.NewLDAPVerifier(auth.LDAPConfig{
+		URL:            directory.URL(),
+		UserDNTemplate: "uid=%s,ou=people,dc=example,dc=com",
+	})
+	require.NoError(t, err)
+
+	resp, err := verifier.Authenticate(ctx, "alice", "alice-secret")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"admin", "ops, east"}, resp.User.Roles)
+
+	// Usernames cannot add RDNs to the bind DN
+	_, err = verifier.Authenticate(ctx, "alice,ou=people", "alice-secret")
+	assert.ErrorIs(t, err, auth.ErrInvalidCredentials)
+
+	// An unreachable directory is an outage, not a bad password
+	unreachable, err := auth.NewLDAPVerifier(auth.LDAPConfig{URL: "ldap://127.0.0.1:1", UserDNTemplate: "uid=%s"})
+	require.NoError(t, err)
+	_, err = unreachable.Authenticate(ctx, "alice", "alice-secret")
+	assert.ErrorIs(t, err, auth.ErrIdPUnavailable)
+
+	for _, cfg := range []auth.LDAPConfig{
+		{URL: "http://ldap.example.com", BaseDN: "dc=example"},
+		{URL: "ldap://ldap.example.com"},
+		{URL: "ldap://ldap.example.com", UserDNTemplate: "uid=alice"},
+	} {
+		_, err := auth.NewLDAPVerifier(cfg)
+		assert.Error(t, err, cfg)
+	}
+}
+
+func TestLDAPVerifierGroups(t *testing.T) {
+	directory := newFakeDirectory(t)
+	verifier, err := auth.NewLDAPVerifier(auth.LDAPConfig{
+		URL:          directory.URL(),
+		BindDN:       "cn=svc,dc=example,dc=com",
+		BindPassword: "svc-secret",
+		BaseDN:       "ou=people,dc=example,dc=com",
+		GroupBaseDN:  "ou=groups,dc=example,dc=com",
+	})
+	require.NoError(t, err)
+
+	groups, err := verifier.Groups(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]string{
+		"admin":     {"uid=alice,ou=people,dc=example,dc=com"},
+		"ops, east": {"uid=alice,ou=people,dc=example,dc=com", "uid=locked,ou=people,dc=example,dc=com"},
+	}, groups)
+
+	// Without a service account the directory hides its groups
+	anonymous, err := auth.NewLDAPVerifier(auth.LDAPConfig{URL: directory.URL(), BaseDN: "dc=example,dc=com"})
+	require.NoError(t, err)
+	groups, err = anonymous.Groups(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, groups)
+}
+
+func TestCredentialVerifierBackends(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("bob-secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "users.json")
+	require.NoError(t, os.WriteFile(path, []byte(`[{"id": "u-bob", "username": "bob", "roles": ["user"], "password_hash": "`+string(hash)+`"}]`), 0o600))
+
+	verifier, err := auth.NewCredentialVerifier(auth.VerifierConfig{Backend: auth.BackendLocal, LocalUsersFile: path})
+	require.NoError(t, err)
+	resp, err := verifier.Authenticate(context.Background(), "bob", "bob-secret")
+	require.NoError(t, err)
+	assert.Equal(t, "u-bob", resp.User.ID)
+	assert.Equal(t, []string{"user"}, resp.User.Roles)
+	_, err = verifier.Authenticate(context.Background(), "bob", "wrong")
+	assert.ErrorIs(t, err, auth.ErrInvalidCredentials)
+	_, err = verifier.Authenticate(context.Background(), "eve", "bob-secret")
+	assert.ErrorIs(t, err, auth.ErrInvalidCredentials)
+
+	keycloak, err := auth.NewCredentialVerifier(auth.VerifierConfig{KeycloakTokenURL: "http://keycloak/token", KeycloakClientID: "app"})
+	require.NoError(t, err)
+	assert.IsType(t, &auth.KeycloakClient{}, keycloak)
+
+	_, err = auth.NewCredentialVerifier(auth.VerifierConfig{Backend: auth.BackendLocal})
+	assert.Error(t, err)
+	_, err = auth.NewCredentialVerifier(auth.VerifierConfig{Backend: "kerberos"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,194 @@
+package unit
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/pkg/device"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+	"github.com/lsendel/impl-zamaz/pkg/trust"
+)
+
+// tpmKey signs challenges directly, with R || S signatures as a TPM does
+type tpmKey struct{ *ecdsa.PrivateKey }
+
+func newTPMKey(t *testing.T) tpmKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	return tpmKey{key}
+}
+
+func (k tpmKey) publicKey(t *testing.T) string {
+	der, err := x509.MarshalPKIXPublicKey(&k.PublicKey)
+	require.NoError(t, err)
+	return base64.StdEncoding.EncodeToString(der)
+}
+
+func (k tpmKey) sign(t *testing.T, challenge string) device.Proof {
+	raw, err := base64.RawURLEncoding.DecodeString(challenge)
+	require.NoError(t, err)
+	digest := sha256.Sum256(raw)
+	r, s, err := ecdsa.Sign(rand.Reader, k.PrivateKey, digest[:])
+	require.NoError(t, err)
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return device.Proof{Signature: base64.RawURLEncoding.EncodeToString(signature)}
+}
+
+// webAuthn signs challenges in WebAuthn assertions scoped to rpID
+func (k tpmKey) webAuthn(t *testing.T, rpID, challenge string) device.Proof {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	authenticatorData := append(rpIDHash[:], 0x01, 0, 0, 0, 7)
+	clientDataJSON, err := json.Marshal(map[string]string{"type": "webauthn.get", "challenge": challenge, "origin": "https://" + rpID})
+	require.NoError(t, err)
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(append([]byte(nil), authenticatorData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, k.PrivateKey, digest[:])
+	require.NoError(t, err)
+	return device.Proof{
+		Signature:         base64.RawURLEncoding.EncodeToString(signature),
+		AuthenticatorData: base64.RawURLEncoding.EncodeToString(authenticatorData),
+		ClientDataJSON:    base64.RawURLEncoding.EncodeToString(clientDataJSON),
+	}
+}
+
+func assertionHeader(t *testing.T, key tpmKey, method, uri, deviceID string, at time.Time) string {
+	challenge := device.AssertionChallenge(method, uri, deviceID, at.Unix())
+	data, err := json.Marshal(device.Assertion{DeviceID: deviceID, Timestamp: at.Unix(), Proof: key.sign(t, challenge)})
+	require.NoError(t, err)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func TestDeviceBindingProvesKeyPossession(t *testing.T) {
+	ctx := context.Background()
+	registry := device.NewRegistry(device.Config{RPID: "example.com"}, store.NewMemoryStore())
+	workstation, err := registry.Register(ctx, "alice", device.Registration{Platform: "windows", Fingerprint: "fp-ws"})
+	require.NoError(t, err)
+	key := newTPMKey(t)
+
+	// Binding needs a pending challenge, answered once
+	_, err = registry.Bind(ctx, "alice", workstation.ID, device.Binding{PublicKey: key.publicKey(t), Proof: key.sign(t, "AAAA")})
+	assert.ErrorIs(t, err, device.ErrInvalidProof)
+	challenge, err := registry.Challenge(ctx, "alice", workstation.ID)
+	require.NoError(t, err)
+	_, err = registry.Bind(ctx, "alice", workstation.ID, device.Binding{PublicKey: key.publicKey(t), Proof: newTPMKey(t).sign(t, challenge)})
+	assert.ErrorIs(t, err, device.ErrInvalidProof)
+	_, err = registry.Bind(ctx, "alice", workstation.ID, device.Binding{PublicKey: key.publicKey(t), Proof: key.sign(t, challenge)})
+	assert.ErrorIs(t, err, device.ErrInvalidProof)
+
+	challenge, err = registry.Challenge(ctx, "alice", workstation.ID)
+	require.NoError(t, err)
+	bound, err := registry.Bind(ctx, "alice", workstation.ID, device.Binding{PublicKey: key.publicKey(t), Proof: key.sign(t, challenge)})
+	require.NoError(t, err)
+	assert.NotEmpty(t, bound.PublicKey)
+	assert.NotNil(t, bound.BoundAt)
+
+	// Other owners cannot bind the device
+	_, err = registry.Challenge(ctx, "bob", workstation.ID)
+	assert.ErrorIs(t, err, device.ErrNotFound)
+
+	// WebAuthn keys must be scoped to the relying party
+	laptop, err := registry.Register(ctx, "alice", device.Registration{Platform: "macos", Fingerprint: "fp-laptop"})
+	require.NoError(t, err)
+	passkey := newTPMKey(t)
+	challenge, err = registry.Challenge(ctx, "alice", laptop.ID)
+	require.NoError(t, err)
+	_, err = registry.Bind(ctx, "alice", laptop.ID, device.Binding{PublicKey: passkey.publicKey(t), Proof: passkey.webAuthn(t, "evil.example", challenge)})
+	assert.ErrorIs(t, err, device.ErrInvalidProof)
+	challenge, err = registry.Challenge(ctx, "alice", laptop.ID)
+	require.NoError(t, err)
+	_, err = registry.Bind(ctx, "alice", laptop.ID, device.Binding{PublicKey: passkey.publicKey(t), Proof: passkey.webAuthn(t, "example.com", challenge)})
+	require.NoError(t, err)
+
+	// Weak keys are refused
+	weak, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&weak.PublicKey)
+	require.NoError(t, err)
+	_, err = registry.Bind(ctx, "alice", laptop.ID, device.Binding{PublicKey: base64.StdEncoding.EncodeToString(der)})
+	assert.ErrorIs(t, err, device.ErrInvalid)
+}
+
+func TestDeviceAssertionMiddleware(t *testing.T) {
+	ctx := context.Background()
+	registry := device.NewRegistry(device.Config{}, store.NewMemoryStore())
+	workstation, err := registry.Register(ctx, "alice", device.Registration{Platform: "linux", Fingerprint: "fp-ws"})
+	require.NoError(t, err)
+	key := newTPMKey(t)
+	challenge, err := registry.Challenge(ctx, "alice", workstation.ID)
+	require.NoError(t, err)
+	_, err = registry.Bind(ctx, "alice", workstation.ID, device.Binding{PublicKey: key.publicKey(t), Proof: key.sign(t, challenge)})
+	require.NoError(t, err)
+
+	metrics := &countingMetrics{}
+	r := setupTestRouter()
+	r.Use(registry.AssertionMiddleware(device.AssertionConfig{}, &testLogger{}, metrics))
+	r.GET("/whoami", func(c *gin.Context) {
+		c.Set("user", &interfaces.UserInfo{ID: c.GetHeader("X-User")})
+		c.JSON(http.StatusOK, trust.RequestContext(c))
+	})
+	request := func(user, assertion string) (int, map[string]string) {
+		w := adminRequest(r, http.MethodGet, "/whoami?x=1", "", map[string]string{"X-User": user, device.HeaderDeviceAssertion: assertion})
+		var signals map[string]string
+		_ = json.Unmarshal(w.Body.Bytes(), &signals)
+		return w.Code, signals
+	}
+
+	header := assertionHeader(t, key, http.MethodGet, "/whoami?x=1", workstation.ID, time.Now())
+	code, signals := request("alice", header)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "true", signals[trust.ContextDeviceBound])
+	assert.Equal(t, workstation.ID, signals[trust.ContextDeviceID])
+	assert.Equal(t, 1, metrics.count("device_assertions_verified_total"))
+
+	code, _ = request("alice", header)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	assert.Equal(t, 1, metrics.count("device_assertions_rejected_total,code=REQUEST_REPLAYED"))
+
+	// Another user's request signed by alice's device earns nothing
+	code, signals = request("bob", assertionHeader(t, key, http.MethodGet, "/whoami?x=1", workstation.ID, time.Now().Add(-time.Second)))
+	require.Equal(t, http.StatusOK, code)
+	assert.Empty(t, signals[trust.ContextDeviceBound])
+
+	code, _ = request("alice", assertionHeader(t, key, http.MethodGet, "/other", workstation.ID, time.Now()))
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = request("alice", assertionHeader(t, newTPMKey(t), http.MethodGet, "/whoami?x=1", workstation.ID, time.Now()))
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = request("alice", assertionHeader(t, key, http.MethodGet, "/whoami?x=1", workstation.ID, time.Now().Add(-5*time.Minute)))
+	assert.Equal(t, http.StatusUnauthorized, code)
+	assert.Equal(t, 1, metrics.count("device_assertions_rejected_total,code=REQUEST_EXPIRED"))
+	code, _ = request("alice", "not-json")
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	// Requests without an assertion are not affected
+	code, signals = request("alice", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Empty(t, signals[trust.ContextDeviceBound])
+}
+
+func TestDeviceFactorTrustsBoundDevices(t *testing.T) {
+	result, err := trust.DeviceFactor().Evaluate(context.Background(), trust.Input{
+		Subject: "alice",
+		Context: map[string]string{trust.ContextDeviceBound: "true", trust.ContextDeviceID: "ws-1"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, result.Score)
+	assert.Equal(t, "hardware-bound device", result.Reason)
+	assert.Equal(t, "ws-1", result.Evidence["device"])
+}
@@ -0,0 +1,94 @@
+package unit
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/api"
+	"github.com/lsendel/impl-zamaz/pkg/device"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+func TestDeviceImportReportsEveryRow(t *testing.T) {
+	r := newDeviceRouter(device.NewRegistry(device.Config{}, store.NewMemoryStore()))
+	admin := map[string]string{"X-User": "admin"}
+	batch := `{"devices": [
+		{"owner_id": "alice", "name": "Laptop", "platform": "windows", "fingerprint": "fp-1"},
+		{"owner_id": "alice", "platform": "windows", "fingerprint": "fp-1"},
+		{"owner_id": "bob", "platform": "beos", "fingerprint": "fp-2"},
+		{"platform": "linux", "fingerprint": "fp-3"}
+	]}`
+	decode := func(body []byte) api.DeviceImportResponse {
+		var report api.DeviceImportResponse
+		require.NoError(t, json.Unmarshal(body, &report))
+		return report
+	}
+
+	// A dry run validates without registering
+	w := adminRequest(r, http.MethodPost, "/devices/import?dry_run=true", batch, admin)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	report := decode(w.Body.Bytes())
+	assert.True(t, report.DryRun)
+	assert.Equal(t, 2, report.Imported)
+	assert.Equal(t, 2, report.Rejected)
+	assert.Equal(t, "DEVICE_ALREADY_REGISTERED", report.Results[1].Code)
+	assert.Equal(t, "VALIDATION_ERROR", report.Results[2].Code)
+	assert.Empty(t, report.Results[0].DeviceID)
+	w = adminRequest(r, http.MethodGet, "/devices", "", map[string]string{"X-User": "alice"})
+	assert.Contains(t, w.Body.String(), `"total":0`)
+
+	w = adminRequest(r, http.MethodPost, "/devices/import", batch, admin)
+	require.Equal(t, http.StatusOK, w.Code)
+	report = decode(w.Body.Bytes())
+	assert.Equal(t, 2, report.Imported)
+	assert.NotEmpty(t, report.Results[0].DeviceID)
+	w = adminRequest(r, http.MethodGet, "/devices", "", map[string]string{"X-User": "alice"})
+	assert.Contains(t, w.Body.String(), `"total":1`)
+	w = adminRequest(r, http.MethodGet, "/devices", "", admin)
+	assert.Contains(t, w.Body.String(), `"total":1`, "rows without an owner belong to the importer")
+
+	// Importing again finds every device registered
+	w = adminRequest(r, http.MethodPost, "/devices/import?dry_run=true", batch, admin)
+	assert.Equal(t, 0, decode(w.Body.Bytes()).Imported)
+
+	w = adminRequest(r, http.MethodPost, "/devices/import", `{"devices": []}`, admin)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = adminRequest(r, http.MethodPost, "/devices/import", `not json`, admin)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestDeviceImportCSVAndExport(t *testing.T) {
+	r := newDeviceRouter(device.NewRegistry(device.Config{}, store.NewMemoryStore()))
+	csvBatch := "fingerprint,platform,owner_id\nfp-a,macos,alice\nfp-b,android,bob\nfp-c,ios,bob\n"
+	w := adminRequest(r, http.MethodPost, "/devices/import", csvBatch, map[string]string{"X-User": "admin", "Content-Type": "text/csv"})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), `"imported":3`)
+	w = adminRequest(r, http.MethodPost, "/devices/import", "name\nlaptop\n", map[string]string{"X-User": "admin", "Content-Type": "text/csv"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = adminRequest(r, http.MethodGet, "/devices/export?owner_id=bob", "", map[string]string{"X-User": "admin"})
+	require.Equal(t, http.StatusOK, w.Code)
+	var exported api.DeviceListResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &exported))
+	require.Len(t, exported.Devices, 2)
+	assert.Equal(t, "fp-b", exported.Devices[0].Fingerprint)
+
+	w = adminRequest(r, http.MethodGet, "/devices/export?format=csv&platform=macos", "", map[string]string{"X-User": "admin"})
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Disposition"), ".csv")
+	records, err := csv.NewReader(strings.NewReader(w.Body.String())).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, "id", records[0][0])
+	assert.Equal(t, "alice", records[1][1])
+	assert.Equal(t, "active", records[1][7])
+
+	w = adminRequest(r, http.MethodGet, "/devices/export?format=xml", "", map[string]string{"X-User": "admin"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
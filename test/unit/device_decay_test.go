@@ -0,0 +1,82 @@
+package unit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/pkg/device"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+	"github.com/lsendel/impl-zamaz/pkg/trust"
+)
+
+func TestDeviceDecayQuarantinesUnseenDevices(t *testing.T) {
+	ctx := context.Background()
+	var transitions []string
+	registry := device.NewRegistry(device.Config{
+		StaleAfter:      20 * time.Millisecond,
+		QuarantineAfter: 200 * time.Millisecond,
+		OnTransition: func(_ context.Context, info *interfaces.DeviceInfo, from string) {
+			transitions = append(transitions, from+"->"+info.State)
+		},
+	}, store.NewMemoryStore())
+	laptop, err := registry.Register(ctx, "alice", device.Registration{Platform: "macos", Fingerprint: "fp-laptop"})
+	require.NoError(t, err)
+	assert.Equal(t, device.StateActive, laptop.State)
+	require.NotNil(t, laptop.LastSeenAt)
+	_, err = registry.SetTrustScore(ctx, "alice", laptop.ID, 80)
+	require.NoError(t, err)
+
+	changed, err := registry.Decay(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, changed)
+
+	time.Sleep(30 * time.Millisecond)
+	changed, err = registry.Decay(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, changed)
+	laptop, err = registry.Get(ctx, "alice", laptop.ID)
+	require.NoError(t, err)
+	assert.Equal(t, device.StateStale, laptop.State)
+	assert.Equal(t, 40, laptop.TrustScore)
+
+	// Seeing the device again makes it active
+	laptop, err = registry.Touch(ctx, "alice", laptop.ID)
+	require.NoError(t, err)
+	assert.Equal(t, device.StateActive, laptop.State)
+
+	time.Sleep(250 * time.Millisecond)
+	changed, err = registry.Decay(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, changed)
+	laptop, err = registry.Touch(ctx, "alice", laptop.ID)
+	require.NoError(t, err)
+	assert.Equal(t, device.StateQuarantined, laptop.State, "only verification lifts quarantine")
+	assert.Equal(t, 0, laptop.TrustScore)
+
+	laptop, err = registry.Verify(ctx, "alice", laptop.ID, device.Evidence{Fingerprint: "fp-laptop"})
+	require.NoError(t, err)
+	assert.Equal(t, device.StateActive, laptop.State)
+	assert.Equal(t, []string{"active->stale", "stale->active", "active->quarantined", "quarantined->active"}, transitions)
+}
+
+func TestDeviceFactorDistrustsDecayedDevices(t *testing.T) {
+	result, err := trust.DeviceFactor().Evaluate(context.Background(), trust.Input{
+		Subject: "alice",
+		Device:  "ws-1",
+		Context: map[string]string{"device_verified": "true", trust.ContextDeviceState: device.StateStale},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 0.4, result.Score)
+
+	result, err = trust.DeviceFactor().Evaluate(context.Background(), trust.Input{
+		Subject: "alice",
+		Context: map[string]string{trust.ContextDeviceBound: "true", trust.ContextDeviceID: "ws-1", trust.ContextDeviceState: device.StateQuarantined},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 0.0, result.Score)
+}
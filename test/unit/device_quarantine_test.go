@@ -0,0 +1,175 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/pkg/admin"
+	"github.com/lsendel/impl-zamaz/pkg/device"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/session"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+	"github.com/lsendel/impl-zamaz/pkg/trust"
+	"github.com/lsendel/impl-zamaz/pkg/webhook"
+)
+
+func TestDeviceQuarantineAndBlockEndSessions(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	sessions, err := session.NewManager(session.Config{
+		Secret: []byte(testSessionSecret),
+		Device: func(c *gin.Context) string { return c.GetHeader("X-Device") },
+	}, s, &testLogger{}, nil)
+	require.NoError(t, err)
+	var transitions []string
+	registry := device.NewRegistry(device.Config{
+		OnTransition: func(ctx context.Context, info *interfaces.DeviceInfo, from string) {
+			transitions = append(transitions, from+">"+info.State)
+			_, err := sessions.EndDevice(ctx, info.ID, info.State == device.StateBlocked)
+			require.NoError(t, err)
+		},
+	}, s)
+	laptop, err := registry.Register(ctx, "alice", device.Registration{Platform: "macos", Fingerprint: "fp-laptop"})
+	require.NoError(t, err)
+	phone, err := registry.Register(ctx, "alice", device.Registration{Platform: "ios", Fingerprint: "fp-phone"})
+	require.NoError(t, err)
+
+	r := newDeviceRouter(registry)
+	r.POST("/login", func(c *gin.Context) {
+		if _, err := sessions.Create(c, interfaces.UserInfo{ID: "alice"}); err != nil {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+	r.GET("/me", func(c *gin.Context) {
+		_, err := sessions.Get(c)
+		switch {
+		case errors.Is(err, session.ErrReauthRequired):
+			c.Status(http.StatusUnauthorized)
+		case err != nil:
+			c.Status(http.StatusForbidden)
+		default:
+			c.Status(http.StatusOK)
+		}
+	})
+	login := func(deviceID string) *http.Cookie {
+		w := adminRequest(r, http.MethodPost, "/login", "", map[string]string{"X-Device": deviceID})
+		require.Equal(t, http.StatusNoContent, w.Code)
+		return sessionCookie(t, w)
+	}
+	me := func(cookie *http.Cookie) int {
+		return sessionRequest(r, http.MethodGet, "/me", cookie, "").Code
+	}
+	fromLaptop, fromPhone, elsewhere := login(laptop.ID), login(phone.ID), login("")
+	admin := map[string]string{"X-User": "admin"}
+
+	// Quarantine makes the device's sessions log in again
+	w := adminRequest(r, http.MethodPost, "/devices/"+laptop.ID+"/quarantine", `{"reason": "suspicious process"}`, admin)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	info := decodeDevice(t, w.Body.Bytes())
+	assert.Equal(t, device.StateQuarantined, info.State)
+	assert.Equal(t, "suspicious process", info.StateReason)
+	assert.Equal(t, http.StatusUnauthorized, me(fromLaptop))
+	assert.Equal(t, http.StatusOK, me(fromPhone))
+	assert.Equal(t, http.StatusOK, me(elsewhere))
+
+	w = adminRequest(r, http.MethodPost, "/devices/"+laptop.ID+"/verify", `{"fingerprint": "fp-laptop"}`, map[string]string{"X-User": "alice"})
+	require.Equal(t, http.StatusOK, w.Code)
+	info = decodeDevice(t, w.Body.Bytes())
+	assert.Equal(t, device.StateActive, info.State)
+	assert.Empty(t, info.StateReason)
+
+	// Block ends them at once, for good
+	w = adminRequest(r, http.MethodPost, "/devices/"+phone.ID+"/block", "", admin)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, http.StatusForbidden, me(fromPhone))
+	assert.Equal(t, http.StatusOK, me(elsewhere))
+	w = adminRequest(r, http.MethodPost, "/devices/"+phone.ID+"/verify", `{"fingerprint": "fp-phone"}`, map[string]string{"X-User": "alice"})
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), "DEVICE_BLOCKED")
+	w = adminRequest(r, http.MethodPost, "/devices/"+phone.ID+"/quarantine", "", admin)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	w = adminRequest(r, http.MethodPost, "/devices/"+phone.ID+"/block", "", admin)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = adminRequest(r, http.MethodPost, "/devices/missing/block", "", admin)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	assert.Equal(t, []string{"active>quarantined", "quarantined>active", "active>blocked"}, transitions)
+	result, err := trust.DeviceFactor().Evaluate(ctx, trust.Input{Subject: "alice", Device: phone.ID, Context: map[string]string{
+		"device_verified": "true", trust.ContextDeviceState: device.StateBlocked,
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, 0.0, result.Score)
+}
+
+func TestBlockedDeviceAssertionsAreRefused(t *testing.T) {
+	ctx := context.Background()
+	registry := device.NewRegistry(device.Config{}, store.NewMemoryStore())
+	workstation, err := registry.Register(ctx, "alice", device.Registration{Platform: "linux", Fingerprint: "fp-ws"})
+	require.NoError(t, err)
+	key := newTPMKey(t)
+	challenge, err := registry.Challenge(ctx, "alice", workstation.ID)
+	require.NoError(t, err)
+	_, err = registry.Bind(ctx, "alice", workstation.ID, device.Binding{PublicKey: key.publicKey(t), Proof: key.sign(t, challenge)})
+	require.NoError(t, err)
+	_, err = registry.Block(ctx, workstation.ID, "stolen")
+	require.NoError(t, err)
+
+	metrics := &countingMetrics{}
+	r := setupTestRouter()
+	r.Use(registry.AssertionMiddleware(device.AssertionConfig{}, &testLogger{}, metrics))
+	r.GET("/whoami", func(c *gin.Context) { c.Status(http.StatusOK) })
+	w := adminRequest(r, http.MethodGet, "/whoami", "", map[string]string{
+		device.HeaderDeviceAssertion: assertionHeader(t, key, http.MethodGet, "/whoami", workstation.ID, time.Now()),
+	})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, 1, metrics.count("device_assertions_rejected_total,code=DEVICE_BLOCKED"))
+
+	// Decay never lifts a block
+	_, err = registry.Decay(ctx)
+	require.NoError(t, err)
+	blocked, err := registry.Get(ctx, "alice", workstation.ID)
+	require.NoError(t, err)
+	assert.Equal(t, device.StateBlocked, blocked.State)
+	assert.Equal(t, 0, blocked.TrustScore)
+}
+
+func TestWebhookNotifiesSubscribedDeviceEvents(t *testing.T) {
+	subscribed, other := newWebhookReceiver(t), newWebhookReceiver(t)
+	notifier := newTestNotifier(&countingMetrics{},
+		webhook.Endpoint{Name: "soc", URL: subscribed.URL, Secret: testWebhookSecret, Events: []string{webhook.EventDeviceBlocked}},
+		webhook.Endpoint{Name: "trust", URL: other.URL, Secret: testWebhookSecret, Thresholds: []int{50}},
+	)
+	defer notifier.Close()
+
+	info := &interfaces.DeviceInfo{ID: "d-1", OwnerID: "alice", Platform: "ios", State: device.StateBlocked, StateReason: "stolen"}
+	require.NoError(t, notifier.NotifyDevice(context.Background(), webhook.EventDeviceQuarantined, info))
+	require.NoError(t, notifier.NotifyDevice(context.Background(), webhook.EventDeviceBlocked, info))
+	event := subscribed.next(t)
+	assert.Equal(t, webhook.EventDeviceBlocked, event.Type)
+	assert.Equal(t, "alice", event.Subject)
+	notifier.Close()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&subscribed.attempts))
+	assert.Zero(t, atomic.LoadInt32(&other.attempts))
+
+	kind := admin.WebhookKind()
+	spec := func(v map[string]interface{}) json.RawMessage {
+		v["url"], v["secret"] = "https://soc.example.com/hook", testWebhookSecret
+		data, err := json.Marshal(v)
+		require.NoError(t, err)
+		return data
+	}
+	assert.NoError(t, kind.Validate(spec(map[string]interface{}{"events": []string{"device.quarantined"}})))
+	assert.Error(t, kind.Validate(spec(map[string]interface{}{"events": []string{"device.stolen"}})))
+	assert.Error(t, kind.Validate(spec(map[string]interface{}{})))
+}
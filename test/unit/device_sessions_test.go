@@ -0,0 +1,80 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/api"
+	"github.com/lsendel/impl-zamaz/pkg/device"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/session"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+func TestDeviceSessionsListAndTerminate(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	sessions, err := session.NewManager(session.Config{
+		Secret: []byte(testSessionSecret),
+		Device: func(c *gin.Context) string { return c.GetHeader("X-Device") },
+	}, s, &testLogger{}, nil)
+	require.NoError(t, err)
+	registry := device.NewRegistry(device.Config{}, s)
+	laptop, err := registry.Register(ctx, "alice", device.Registration{Platform: "macos", Fingerprint: "fp-laptop"})
+	require.NoError(t, err)
+
+	handlers := api.NewHandlers().WithDevices(registry).WithSessions(sessions)
+	r := setupTestRouter()
+	r.POST("/login", func(c *gin.Context) {
+		if _, err := sessions.Create(c, interfaces.UserInfo{ID: c.GetHeader("X-User"), Username: c.GetHeader("X-User")}); err != nil {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+	r.GET("/devices/:id/sessions", handlers.GetDeviceSessions)
+	r.DELETE("/devices/:id/sessions", handlers.TerminateDeviceSessions)
+	for _, login := range []map[string]string{
+		{"X-User": "alice", "X-Device": laptop.ID},
+		{"X-User": "bob", "X-Device": laptop.ID},
+		{"X-User": "alice"},
+	} {
+		require.Equal(t, http.StatusNoContent, adminRequest(r, http.MethodPost, "/login", "", login).Code)
+	}
+
+	w := adminRequest(r, http.MethodGet, "/devices/"+laptop.ID+"/sessions", "", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var listed api.DeviceSessionsResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &listed))
+	assert.Equal(t, 2, listed.Total)
+	require.Len(t, listed.Sessions, 2)
+	assert.Equal(t, "alice", listed.Sessions[0].UserID)
+	assert.Equal(t, "bob", listed.Sessions[1].UserID)
+	assert.NotContains(t, w.Body.String(), `"id"`, "session IDs are not disclosed")
+
+	w = adminRequest(r, http.MethodDelete, "/devices/"+laptop.ID+"/sessions", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"terminated":2`)
+	remaining, err := sessions.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, remaining, 1)
+	assert.Empty(t, remaining[0].DeviceID)
+
+	w = adminRequest(r, http.MethodGet, "/devices/"+laptop.ID+"/sessions", "", nil)
+	assert.Contains(t, w.Body.String(), `"sessions":[]`)
+	w = adminRequest(r, http.MethodGet, "/devices/missing/sessions", "", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// Without SSO sessions there is nothing to list
+	r = setupTestRouter()
+	r.GET("/devices/:id/sessions", api.NewHandlers().WithDevices(registry).GetDeviceSessions)
+	w = adminRequest(r, http.MethodGet, "/devices/"+laptop.ID+"/sessions", "", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), "SESSIONS_DISABLED")
+}
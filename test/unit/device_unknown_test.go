@@ -0,0 +1,124 @@
+package unit
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/pkg/admin"
+	"github.com/lsendel/impl-zamaz/pkg/device"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+	"github.com/lsendel/impl-zamaz/pkg/trust"
+	"github.com/lsendel/impl-zamaz/pkg/webhook"
+)
+
+func TestUnknownDeviceLoginIsReportedOnce(t *testing.T) {
+	ctx := context.Background()
+	mail := make(outbox, 10)
+	var sightings []*device.Sighting
+	var confirmed []string
+	registry := device.NewRegistry(device.Config{
+		Mailer:          mail,
+		OnUnknownDevice: func(_ context.Context, s *device.Sighting) { sightings = append(sightings, s) },
+		OnDeviceConfirmed: func(_ context.Context, s *device.Sighting, info *interfaces.DeviceInfo) {
+			confirmed = append(confirmed, s.ID+"="+info.ID)
+		},
+	}, store.NewMemoryStore())
+	login := device.Login{Owner: "alice", Email: "alice@example.com", Fingerprint: "fp-new", IP: "203.0.113.7", UserAgent: "browser", Method: "password"}
+
+	sighting, err := registry.ObserveLogin(ctx, login)
+	require.NoError(t, err)
+	require.NotNil(t, sighting)
+	assert.Equal(t, 1, sighting.Logins)
+	assert.NotContains(t, sighting.ID, "fp-new")
+	assert.Contains(t, <-mail, "203.0.113.7")
+	require.Len(t, sightings, 1)
+
+	// Later logins update the sighting without reporting it again
+	login.IP = "203.0.113.8"
+	sighting, err = registry.ObserveLogin(ctx, login)
+	require.NoError(t, err)
+	assert.Equal(t, 2, sighting.Logins)
+	assert.Equal(t, "203.0.113.8", sighting.IP)
+	assert.Len(t, mail, 0)
+	assert.Len(t, sightings, 1)
+
+	// Other users, and logins without a fingerprint, are checked separately
+	sighting, err = registry.ObserveLogin(ctx, device.Login{Owner: "bob", Fingerprint: "fp-new"})
+	require.NoError(t, err)
+	assert.NotNil(t, sighting)
+	assert.Len(t, sightings, 2)
+	sighting, err = registry.ObserveLogin(ctx, device.Login{Owner: "alice"})
+	require.NoError(t, err)
+	assert.Nil(t, sighting)
+
+	// Registering the device makes it known; verifying it confirms it
+	laptop, err := registry.Register(ctx, "alice", device.Registration{Platform: "macos", Fingerprint: "fp-new"})
+	require.NoError(t, err)
+	sighting, err = registry.ObserveLogin(ctx, login)
+	require.NoError(t, err)
+	assert.Nil(t, sighting)
+	assert.Empty(t, confirmed)
+	_, err = registry.Verify(ctx, "alice", laptop.ID, device.Evidence{Fingerprint: "fp-new"})
+	require.NoError(t, err)
+	require.Len(t, confirmed, 1)
+	assert.Equal(t, sightings[0].ID+"="+laptop.ID, confirmed[0])
+	_, err = registry.Verify(ctx, "alice", laptop.ID, device.Evidence{Fingerprint: "fp-new"})
+	require.NoError(t, err)
+	assert.Len(t, confirmed, 1)
+}
+
+func TestUnconfirmedDeviceSessionKeepsItsCap(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	sessions := newTestSessions(t, s)
+	scorer := fixedScorer{"u-1": 80}
+	r := newVerifiedRouter(sessions, scorer, s)
+	verifier := trust.NewSessionVerifier(trust.VerificationConfig{}, sessions, scorer, s, &testLogger{}, nil)
+
+	cookie := sessionCookie(t, sessionRequest(r, http.MethodPost, "/login", nil, "browser"))
+	list, err := sessions.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	require.NoError(t, sessions.HoldUnconfirmed(ctx, list[0].ID, "sighting-1", 30))
+
+	// Continuous verification does not restore an unconfirmed device
+	list, err = sessions.List(ctx)
+	require.NoError(t, err)
+	action, err := verifier.Verify(ctx, list[0])
+	require.NoError(t, err)
+	assert.Equal(t, trust.ActionNone, action)
+	w := sessionRequest(r, http.MethodGet, "/trust", cookie, "browser")
+	assert.JSONEq(t, `{"trust_level": 30}`, w.Body.String())
+
+	n, err := sessions.ConfirmDevice(ctx, "u-2", "sighting-1")
+	require.NoError(t, err)
+	assert.Zero(t, n)
+	n, err = sessions.ConfirmDevice(ctx, "u-1", "sighting-1")
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	w = sessionRequest(r, http.MethodGet, "/trust", cookie, "browser")
+	assert.JSONEq(t, `{"trust_level": 80}`, w.Body.String())
+	list, err = sessions.List(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, list[0].UnconfirmedDevice)
+}
+
+func TestWebhookNotifiesUnknownDevices(t *testing.T) {
+	subscribed := newWebhookReceiver(t)
+	notifier := newTestNotifier(&countingMetrics{},
+		webhook.Endpoint{Name: "soc", URL: subscribed.URL, Secret: testWebhookSecret, Events: []string{webhook.EventDeviceUnknown}},
+	)
+	defer notifier.Close()
+
+	require.NoError(t, notifier.NotifyUnknownDevice(context.Background(), "alice", "sighting-1", "203.0.113.7", "password"))
+	event := subscribed.next(t)
+	assert.Equal(t, webhook.EventDeviceUnknown, event.Type)
+	assert.Equal(t, "alice", event.Subject)
+
+	assert.NoError(t, admin.WebhookKind().Validate([]byte(`{"url": "https://soc.example.com/hook", "secret": "`+testWebhookSecret+`", "events": ["device.unknown"]}`)))
+}
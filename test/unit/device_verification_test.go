@@ -0,0 +1,177 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/api"
+	"github.com/lsendel/impl-zamaz/pkg/device"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+var deviceCodePattern = regexp.MustCompile(`is (\d{6})\.`)
+
+// newVerificationRouter serves the device verification routes to the user
+// named by X-User, and the admin ones under /admin
+func newVerificationRouter(registry *device.Registry) *gin.Engine {
+	handlers := api.NewHandlers().WithDevices(registry)
+	r := setupTestRouter()
+	r.Use(registry.AssertionMiddleware(device.AssertionConfig{}, &testLogger{}, nil))
+	r.Use(func(c *gin.Context) {
+		c.Set("user", &interfaces.UserInfo{ID: c.GetHeader("X-User"), Email: c.GetHeader("X-User") + "@example.com"})
+	})
+	r.GET("/devices/approvals", handlers.GetPendingApprovals)
+	r.POST("/devices/:id/verify", handlers.VerifyDevice)
+	r.POST("/devices/:id/verify/challenge", handlers.StartDeviceVerification)
+	r.GET("/devices/:id/verifications", handlers.GetDeviceVerifications)
+	r.POST("/devices/:id/verifications/:vid/decision", handlers.DecideDeviceVerification)
+	r.GET("/admin/devices/verifications", handlers.GetAdminApprovals)
+	r.POST("/admin/devices/:id/verifications/:vid/decision", handlers.DecideAdminVerification)
+	return r
+}
+
+func startVerification(t *testing.T, r http.Handler, user, deviceID, method string) device.Verification {
+	w := adminRequest(r, http.MethodPost, "/devices/"+deviceID+"/verify/challenge", `{"method": "`+method+`"}`, map[string]string{"X-User": user})
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var v device.Verification
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &v))
+	return v
+}
+
+func TestDeviceEmailVerification(t *testing.T) {
+	ctx := context.Background()
+	mail := make(outbox, 10)
+	var outcomes []string
+	registry := device.NewRegistry(device.Config{
+		Mailer:                  mail,
+		MaxVerificationAttempts: 2,
+		OnVerification:          func(_ context.Context, v *device.Verification) { outcomes = append(outcomes, v.Status) },
+	}, store.NewMemoryStore())
+	laptop, err := registry.Register(ctx, "alice", device.Registration{Platform: "macos", Fingerprint: "fp-laptop"})
+	require.NoError(t, err)
+	_, err = registry.Quarantine(ctx, laptop.ID, "")
+	require.NoError(t, err)
+	r := newVerificationRouter(registry)
+	alice := map[string]string{"X-User": "alice"}
+
+	v := startVerification(t, r, "alice", laptop.ID, device.MethodEmail)
+	assert.Equal(t, device.VerificationPending, v.Status)
+	code := deviceCodePattern.FindStringSubmatch(<-mail)
+	require.Len(t, code, 2)
+
+	// Only the owner may answer, with the right code
+	w := adminRequest(r, http.MethodPost, "/devices/"+laptop.ID+"/verify", `{"verification_id": "`+v.ID+`", "code": "`+code[1]+`"}`, map[string]string{"X-User": "bob"})
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	wrong := "000000"
+	if code[1] == wrong {
+		wrong = "111111"
+	}
+	w = adminRequest(r, http.MethodPost, "/devices/"+laptop.ID+"/verify", `{"verification_id": "`+v.ID+`", "code": "`+wrong+`"}`, alice)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "VERIFICATION_CODE_INVALID")
+	w = adminRequest(r, http.MethodPost, "/devices/"+laptop.ID+"/verify", `{"verification_id": "`+v.ID+`", "code": "`+code[1]+`"}`, alice)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	info := decodeDevice(t, w.Body.Bytes())
+	assert.Equal(t, device.AttestationVerified, info.AttestationStatus)
+	assert.Equal(t, device.MethodEmail, info.VerifiedBy)
+	assert.Equal(t, device.StateActive, info.State)
+
+	// Codes are single use, and too many wrong ones fail a verification
+	w = adminRequest(r, http.MethodPost, "/devices/"+laptop.ID+"/verify", `{"verification_id": "`+v.ID+`", "code": "`+code[1]+`"}`, alice)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	v = startVerification(t, r, "alice", laptop.ID, device.MethodEmail)
+	<-mail
+	for i := 0; i < 2; i++ {
+		w = adminRequest(r, http.MethodPost, "/devices/"+laptop.ID+"/verify", `{"verification_id": "`+v.ID+`", "code": "abc"}`, alice)
+	}
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w = adminRequest(r, http.MethodGet, "/devices/"+laptop.ID+"/verifications", "", alice)
+	require.Equal(t, http.StatusOK, w.Code)
+	var history api.VerificationListResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &history))
+	require.Len(t, history.Verifications, 2)
+	assert.Equal(t, device.VerificationFailed, history.Verifications[0].Status)
+	assert.Equal(t, 2, history.Verifications[0].Attempts)
+	assert.Equal(t, device.VerificationApproved, history.Verifications[1].Status)
+	assert.Equal(t, []string{"pending", "approved", "pending", "failed"}, outcomes)
+
+	w = adminRequest(r, http.MethodPost, "/devices/"+laptop.ID+"/verify/challenge", `{"method": "carrier-pigeon"}`, alice)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = adminRequest(r, http.MethodPost, "/devices/"+laptop.ID+"/verify", `{}`, alice)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestDevicePushAndAdminVerification(t *testing.T) {
+	ctx := context.Background()
+	registry := device.NewRegistry(device.Config{}, store.NewMemoryStore())
+	r := newVerificationRouter(registry)
+	alice := map[string]string{"X-User": "alice"}
+	phone, err := registry.Register(ctx, "alice", device.Registration{Platform: "ios", Fingerprint: "fp-phone"})
+	require.NoError(t, err)
+	tablet, err := registry.Register(ctx, "alice", device.Registration{Platform: "android", Fingerprint: "fp-tablet"})
+	require.NoError(t, err)
+
+	// Push needs another verified, bound device to approve from
+	w := adminRequest(r, http.MethodPost, "/devices/"+phone.ID+"/verify/challenge", `{"method": "push"}`, alice)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	workstation, err := registry.Register(ctx, "alice", device.Registration{Platform: "linux", Fingerprint: "fp-ws"})
+	require.NoError(t, err)
+	_, err = registry.Verify(ctx, "alice", workstation.ID, device.Evidence{Fingerprint: "fp-ws"})
+	require.NoError(t, err)
+	key := newTPMKey(t)
+	challenge, err := registry.Challenge(ctx, "alice", workstation.ID)
+	require.NoError(t, err)
+	_, err = registry.Bind(ctx, "alice", workstation.ID, device.Binding{PublicKey: key.publicKey(t), Proof: key.sign(t, challenge)})
+	require.NoError(t, err)
+
+	v := startVerification(t, r, "alice", phone.ID, device.MethodPush)
+	w = adminRequest(r, http.MethodGet, "/devices/approvals", "", alice)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), v.ID)
+
+	decision := "/devices/" + phone.ID + "/verifications/" + v.ID + "/decision"
+	w = adminRequest(r, http.MethodPost, decision, `{"approve": true}`, alice)
+	assert.Equal(t, http.StatusForbidden, w.Code, "approval needs the assertion of another device")
+	w = adminRequest(r, http.MethodPost, decision, `{"approve": true}`, map[string]string{
+		"X-User":                     "alice",
+		device.HeaderDeviceAssertion: assertionHeader(t, key, http.MethodPost, decision, workstation.ID, time.Now()),
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	info := decodeDevice(t, w.Body.Bytes())
+	assert.Equal(t, device.MethodPush, info.VerifiedBy)
+	verifications, err := registry.Verifications(ctx, "alice", phone.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "device:"+workstation.ID, verifications[0].DecidedBy)
+
+	// Admin verifications wait for an administrator
+	v = startVerification(t, r, "alice", tablet.ID, device.MethodAdmin)
+	w = adminRequest(r, http.MethodGet, "/admin/devices/verifications", "", map[string]string{"X-User": "admin"})
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), v.ID)
+	w = adminRequest(r, http.MethodPost, "/devices/"+tablet.ID+"/verifications/"+v.ID+"/decision", `{"approve": true}`, map[string]string{
+		"X-User":                     "alice",
+		device.HeaderDeviceAssertion: assertionHeader(t, key, http.MethodPost, "/devices/"+tablet.ID+"/verifications/"+v.ID+"/decision", workstation.ID, time.Now()),
+	})
+	assert.Equal(t, http.StatusForbidden, w.Code, "owners cannot approve admin verifications")
+	w = adminRequest(r, http.MethodPost, "/admin/devices/"+tablet.ID+"/verifications/"+v.ID+"/decision", `{"approve": false}`, map[string]string{"X-User": "admin"})
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, device.AttestationPending, decodeDevice(t, w.Body.Bytes()).AttestationStatus)
+	verifications, err = registry.Verifications(ctx, "alice", tablet.ID)
+	require.NoError(t, err)
+	assert.Equal(t, device.VerificationDenied, verifications[0].Status)
+	assert.Equal(t, "admin", verifications[0].DecidedBy)
+	w = adminRequest(r, http.MethodPost, "/admin/devices/"+tablet.ID+"/verifications/"+v.ID+"/decision", `{"approve": true}`, map[string]string{"X-User": "admin"})
+	assert.Equal(t, http.StatusConflict, w.Code)
+	w = adminRequest(r, http.MethodGet, "/admin/devices/verifications", "", map[string]string{"X-User": "admin"})
+	assert.Contains(t, w.Body.String(), `"verifications":[]`)
+}
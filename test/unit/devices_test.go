@@ -0,0 +1,147 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/api"
+	"github.com/lsendel/impl-zamaz/pkg/device"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+// newDeviceRouter serves the device routes to the user named in X-User
+func newDeviceRouter(registry *device.Registry) *gin.Engine {
+	handlers := api.NewHandlers().WithScorer(fixedScorer{"alice": 91}).WithDevices(registry)
+	r := setupTestRouter()
+	devices := r.Group("/devices", func(c *gin.Context) {
+		c.Set("user", &interfaces.UserInfo{ID: c.GetHeader("X-User")})
+	})
+	devices.GET("", handlers.GetDevices)
+	devices.POST("/register", handlers.RegisterDevice)
+	devices.POST("/import", handlers.ImportDevices)
+	devices.GET("/export", handlers.ExportDevices)
+	devices.GET("/:id", handlers.GetDevice)
+	devices.PUT("/:id", handlers.UpdateDevice)
+	devices.DELETE("/:id", handlers.DeleteDevice)
+	devices.POST("/:id/verify", handlers.VerifyDevice)
+	devices.POST("/:id/quarantine", handlers.QuarantineDevice)
+	devices.POST("/:id/block", handlers.BlockDevice)
+	devices.GET("/:id/trust-score", handlers.GetDeviceTrustScore)
+	return r
+}
+
+func decodeDevice(t *testing.T, body []byte) interfaces.DeviceInfo {
+	var info interfaces.DeviceInfo
+	require.NoError(t, json.Unmarshal(body, &info))
+	return info
+}
+
+func TestDeviceRegistration(t *testing.T) {
+	r := newDeviceRouter(device.NewRegistry(device.Config{}, store.NewMemoryStore()))
+	alice := map[string]string{"X-User": "alice"}
+
+	w := adminRequest(r, http.MethodPost, "/devices/register", `{"name": "Laptop", "platform": "macOS", "fingerprint": "fp-1"}`, alice)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	registered := decodeDevice(t, w.Body.Bytes())
+	assert.NotEmpty(t, registered.ID)
+	assert.Equal(t, "alice", registered.OwnerID)
+	assert.Equal(t, "macos", registered.Platform)
+	assert.Equal(t, device.AttestationPending, registered.AttestationStatus)
+
+	// Fingerprints are unique per owner
+	w = adminRequest(r, http.MethodPost, "/devices/register", `{"name": "Again", "platform": "macos", "fingerprint": "fp-1"}`, alice)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), "DEVICE_ALREADY_REGISTERED")
+	w = adminRequest(r, http.MethodPost, "/devices/register", `{"platform": "macos", "fingerprint": "fp-1"}`, map[string]string{"X-User": "bob"})
+	assert.Equal(t, http.StatusCreated, w.Code)
+	w = adminRequest(r, http.MethodPost, "/devices/register", `{"platform": "beos", "fingerprint": "fp-2"}`, alice)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "VALIDATION_ERROR")
+
+	// Other owners cannot see, change or delete the device
+	path := "/devices/" + registered.ID
+	bob := map[string]string{"X-User": "bob"}
+	assert.Equal(t, http.StatusNotFound, adminRequest(r, http.MethodGet, path, "", bob).Code)
+	assert.Equal(t, http.StatusNotFound, adminRequest(r, http.MethodPut, path, `{"platform": "linux", "fingerprint": "x"}`, bob).Code)
+	assert.Equal(t, http.StatusNotFound, adminRequest(r, http.MethodDelete, path, "", bob).Code)
+	assert.Equal(t, http.StatusOK, adminRequest(r, http.MethodGet, path, "", alice).Code)
+
+	w = adminRequest(r, http.MethodPost, path+"/verify", `{"fingerprint": "wrong"}`, alice)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, device.AttestationFailed, decodeDevice(t, w.Body.Bytes()).AttestationStatus)
+	w = adminRequest(r, http.MethodPost, path+"/verify", `{"fingerprint": "fp-1"}`, alice)
+	require.Equal(t, http.StatusOK, w.Code)
+	verified := decodeDevice(t, w.Body.Bytes())
+	assert.Equal(t, device.AttestationVerified, verified.AttestationStatus)
+	assert.NotNil(t, verified.VerifiedAt)
+
+	w = adminRequest(r, http.MethodGet, path+"/trust-score", "", alice)
+	require.Equal(t, http.StatusOK, w.Code)
+	var score api.DeviceTrustScoreResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &score))
+	assert.Equal(t, 91, score.TrustScore)
+	assert.Equal(t, 91, decodeDevice(t, adminRequest(r, http.MethodGet, path, "", alice).Body.Bytes()).TrustScore)
+
+	// A new fingerprint needs attestation again
+	w = adminRequest(r, http.MethodPut, path, `{"name": "Work laptop", "platform": "macos", "fingerprint": "fp-3"}`, alice)
+	require.Equal(t, http.StatusOK, w.Code)
+	updated := decodeDevice(t, w.Body.Bytes())
+	assert.Equal(t, "Work laptop", updated.Name)
+	assert.Equal(t, device.AttestationPending, updated.AttestationStatus)
+	assert.Nil(t, updated.VerifiedAt)
+	w = adminRequest(r, http.MethodPost, "/devices/register", `{"platform": "ios", "fingerprint": "fp-1"}`, alice)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	assert.Equal(t, http.StatusNoContent, adminRequest(r, http.MethodDelete, path, "", alice).Code)
+	assert.Equal(t, http.StatusNotFound, adminRequest(r, http.MethodGet, path, "", alice).Code)
+	w = adminRequest(r, http.MethodPost, "/devices/register", `{"platform": "macos", "fingerprint": "fp-3"}`, alice)
+	assert.Equal(t, http.StatusCreated, w.Code)
+}
+
+func TestDeviceListPagination(t *testing.T) {
+	registry := device.NewRegistry(device.Config{}, store.NewMemoryStore())
+	for i := 0; i < 5; i++ {
+		_, err := registry.Register(context.Background(), "alice", device.Registration{Name: fmt.Sprint("device ", i), Platform: "linux", Fingerprint: fmt.Sprint("fp-", i)})
+		require.NoError(t, err)
+	}
+	_, err := registry.Register(context.Background(), "bob", device.Registration{Platform: "linux", Fingerprint: "fp-0"})
+	require.NoError(t, err)
+	r := newDeviceRouter(registry)
+	alice := map[string]string{"X-User": "alice"}
+
+	list := func(query string) api.DeviceListResponse {
+		w := adminRequest(r, http.MethodGet, "/devices"+query, "", alice)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var resp api.DeviceListResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp
+	}
+	first, second, last := list("?page_size=2"), list("?page=2&page_size=2"), list("?page=3&page_size=2")
+	assert.Equal(t, 5, first.Total)
+	assert.Equal(t, 3, first.TotalPages)
+	assert.Len(t, first.Devices, 2)
+	assert.Len(t, second.Devices, 2)
+	assert.Len(t, last.Devices, 1)
+	seen := map[string]bool{}
+	for _, page := range []api.DeviceListResponse{first, second, last} {
+		for _, d := range page.Devices {
+			assert.Equal(t, "alice", d.OwnerID)
+			seen[d.ID] = true
+		}
+	}
+	assert.Len(t, seen, 5)
+	assert.Empty(t, list("?page=4&page_size=2").Devices)
+	assert.Equal(t, 20, list("").PageSize)
+
+	for _, query := range []string{"?page=0", "?page_size=101", "?page=x"} {
+		assert.Equal(t, http.StatusBadRequest, adminRequest(r, http.MethodGet, "/devices"+query, "", alice).Code, query)
+	}
+}
@@ -1,18 +1,41 @@
 package unit
 
 import (
+	"bufio"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
 
+	"github.com/lsendel/impl-zamaz/pkg/auth"
 	"github.com/lsendel/impl-zamaz/pkg/discovery"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/policy"
+	"github.com/lsendel/impl-zamaz/pkg/security"
+	"github.com/lsendel/impl-zamaz/pkg/store"
 )
 
 func TestServiceRegistry(t *testing.T) {
@@ -294,6 +317,148 @@ func TestServiceDiscoveryHTTPHandlers(t *testing.T) {
 	})
 }
 
+func TestServiceDiscoveryOwnership(t *testing.T) {
+	registry := discovery.NewServiceRegistry()
+	handler := discovery.NewServiceDiscoveryHandler(registry)
+	request := func(method, path, body string, caller *discovery.Caller) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if caller != nil {
+			req = req.WithContext(discovery.WithCaller(req.Context(), *caller))
+		}
+		w := httptest.NewRecorder()
+		switch method {
+		case http.MethodPost:
+			handler.HandleRegisterService(w, req)
+		case http.MethodPut:
+			handler.HandleHeartbeat(w, req)
+		case http.MethodDelete:
+			handler.HandleDeregisterService(w, req)
+		}
+		return w.Code
+	}
+	billing := &discovery.Caller{Owner: "svc-billing"}
+	orders := &discovery.Caller{Owner: "svc-orders"}
+	admin := &discovery.Caller{Owner: "u-1", Admin: true}
+
+	assert.Equal(t, http.StatusCreated, request("POST", "/services", `{"name":"billing","url":"http://127.0.0.1:1","trust_level_required":75}`, billing))
+	service, err := registry.GetService("billing")
+	require.NoError(t, err)
+	assert.Equal(t, "svc-billing", service.Owner)
+
+	// Nobody else can take over the name, lowering its trust level or
+	// pointing the gateway elsewhere
+	hijack := `{"name":"billing","url":"http://attacker.example","trust_level_required":0}`
+	assert.Equal(t, http.StatusForbidden, request("POST", "/services", hijack, nil))
+	assert.Equal(t, http.StatusForbidden, request("POST", "/services", hijack, orders))
+	assert.Equal(t, http.StatusForbidden, request("PUT", "/services/billing/heartbeat", "", orders))
+	assert.Equal(t, http.StatusForbidden, request("DELETE", "/services/billing", "", nil))
+	service, err = registry.GetService("billing")
+	require.NoError(t, err)
+	assert.Equal(t, "http://127.0.0.1:1", service.URL)
+	assert.Equal(t, 75, service.TrustLevel)
+
+	assert.Equal(t, http.StatusCreated, request("POST", "/services", `{"name":"billing","url":"http://127.0.0.1:2","trust_level_required":75}`, billing))
+	assert.Equal(t, http.StatusOK, request("PUT", "/services/billing/heartbeat", "", billing))
+
+	// Services registered by configuration belong to admins
+	require.NoError(t, registry.RegisterService(&discovery.ServiceInfo{Name: "keycloak", URL: "http://127.0.0.1:1"}))
+	assert.Equal(t, http.StatusForbidden, request("POST", "/services", `{"name":"keycloak","url":"http://attacker.example"}`, orders))
+	assert.Equal(t, http.StatusNoContent, request("DELETE", "/services/keycloak", "", admin))
+	assert.Equal(t, http.StatusNoContent, request("DELETE", "/services/billing", "", admin))
+}
+
+func TestServiceDiscoveryConcurrentRegistrationHasOneOwner(t *testing.T) {
+	registry := discovery.NewServiceRegistryWithStore(store.NewMemoryStore())
+	const callers = 8
+	errs := make([]error, callers)
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = registry.RegisterServiceAs(&discovery.ServiceInfo{Name: "payments", URL: "http://127.0.0.1:" + strconv.Itoa(i+1)},
+				discovery.Caller{Owner: "svc-" + strconv.Itoa(i)})
+		}(i)
+	}
+	wg.Wait()
+
+	// The first registration takes the name; every later one is refused
+	winner := -1
+	for i, err := range errs {
+		if err == nil {
+			assert.Equal(t, -1, winner, "more than one caller registered the name")
+			winner = i
+			continue
+		}
+		assert.ErrorIs(t, err, discovery.ErrNotOwner)
+	}
+	require.NotEqual(t, -1, winner)
+	service, err := registry.GetService("payments")
+	require.NoError(t, err)
+	assert.Equal(t, "svc-"+strconv.Itoa(winner), service.Owner)
+	assert.Equal(t, "http://127.0.0.1:"+strconv.Itoa(winner+1), service.URL)
+}
+
+func TestServiceDiscoveryChangesRequireAuthentication(t *testing.T) {
+	issuer := newTestIssuer(t)
+	revocations := security.NewRevocationStore(store.NewMemoryStore(), time.Hour, testLogger{}, nil)
+	engine := policy.NewEngine(policy.Config{}, store.NewMemoryStore())
+	pdp := engine.Middleware(policy.PDPConfig{
+		Defaults: []*policy.Policy{
+			{ID: "default-allow", Subjects: []string{"*"}, Resources: []string{"*"}, Actions: []string{"*"}, Effect: policy.EffectAllow},
+			{
+				ID: "registrars", Subjects: []string{"*"}, Resources: []string{"discovery/*"}, Actions: []string{"*"}, Effect: policy.EffectDeny,
+				Conditions: []policy.Condition{{Attribute: policy.AttributeRoles, Operator: policy.OpNotContains, Values: []string{"registrar"}}},
+			},
+		},
+		CacheTTL: time.Nanosecond,
+	}, testLogger{}, nil)
+	registry := discovery.NewServiceRegistry()
+	require.NoError(t, registry.RegisterService(&discovery.ServiceInfo{Name: "billing", URL: "http://127.0.0.1:1"}))
+	handler := discovery.NewServiceDiscoveryHandler(registry)
+
+	// Wired as the server does: reads are public, changes are not
+	r := setupTestRouter()
+	group := r.Group("/api/v1/discovery")
+	group.GET("/services/:name", gin.WrapF(handler.HandleGetService))
+	changes := group.Group("", func(c *gin.Context) {
+		if user := revocations.AuthenticateBearer(c, issuer); user != nil {
+			c.Set("user", user)
+		}
+	}, pdp, func(c *gin.Context) {
+		user := c.MustGet("user").(*interfaces.UserInfo)
+		c.Request = c.Request.WithContext(discovery.WithCaller(c.Request.Context(), discovery.Caller{Owner: user.ID}))
+	})
+	changes.POST("/services", gin.WrapF(handler.HandleRegisterService))
+	changes.DELETE("/services/:name", gin.WrapF(handler.HandleDeregisterService))
+	changes.PUT("/services/:name/heartbeat", gin.WrapF(handler.HandleHeartbeat))
+	token := func(roles ...string) string {
+		pair, err := issuer.IssueTokens(auth.UserClaims(interfaces.UserInfo{ID: "u-1", Roles: roles}), time.Minute, time.Hour)
+		require.NoError(t, err)
+		return "Bearer " + pair.AccessToken
+	}
+	register := `{"name":"orders","url":"http://127.0.0.1:1"}`
+
+	for _, route := range [][2]string{{"POST", "/api/v1/discovery/services"}, {"DELETE", "/api/v1/discovery/services/billing"}, {"PUT", "/api/v1/discovery/services/billing/heartbeat"}} {
+		w := adminRequest(r, route[0], route[1], register, nil)
+		assert.Equal(t, http.StatusUnauthorized, w.Code, route)
+		assert.Contains(t, w.Body.String(), "UNAUTHORIZED")
+		w = adminRequest(r, route[0], route[1], register, map[string]string{"Authorization": "Bearer forged"})
+		assert.Equal(t, http.StatusUnauthorized, w.Code, route)
+
+		w = adminRequest(r, route[0], route[1], register, map[string]string{"Authorization": token("user")})
+		assert.Equal(t, http.StatusForbidden, w.Code, route)
+		assert.Contains(t, w.Body.String(), "POLICY_DENIED")
+	}
+	assert.Equal(t, http.StatusOK, adminRequest(r, "GET", "/api/v1/discovery/services/billing", "", nil).Code)
+
+	w := adminRequest(r, "POST", "/api/v1/discovery/services", register, map[string]string{"Authorization": token("registrar")})
+	assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	service, err := registry.GetService("orders")
+	require.NoError(t, err)
+	assert.Equal(t, "u-1", service.Owner)
+}
+
 func TestHealthChecks(t *testing.T) {
 	registry := discovery.NewServiceRegistry()
 
@@ -352,3 +517,1108 @@ func TestInitializeDefaultServices(t *testing.T) {
 		assert.True(t, serviceNames[expectedService], "Expected default service %s not found", expectedService)
 	}
 }
+
+func TestServiceDeregistrationAndExpiry(t *testing.T) {
+	registry := discovery.NewServiceRegistryWithStore(store.NewMemoryStore())
+	handler := discovery.NewServiceDiscoveryHandler(registry)
+	asAdmin := func(r *http.Request) *http.Request {
+		return r.WithContext(discovery.WithCaller(r.Context(), discovery.Caller{Admin: true}))
+	}
+
+	require.NoError(t, registry.RegisterService(&discovery.ServiceInfo{Name: "static", URL: "http://127.0.0.1:1"}))
+	require.NoError(t, registry.RegisterService(&discovery.ServiceInfo{Name: "leased", URL: "http://127.0.0.1:1", TTL: 1}))
+	assert.Error(t, registry.RegisterService(&discovery.ServiceInfo{Name: "bad", URL: "http://127.0.0.1:1", TTL: -1}))
+
+	// A heartbeat within the TTL keeps the service
+	time.Sleep(600 * time.Millisecond)
+	w := httptest.NewRecorder()
+	handler.HandleHeartbeat(w, asAdmin(httptest.NewRequest(http.MethodPut, "/api/v1/discovery/services/leased/heartbeat", nil)))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	time.Sleep(300 * time.Millisecond)
+	registry.ExpireServices()
+	service, err := registry.GetService("leased")
+	require.NoError(t, err)
+	assert.NotEqual(t, discovery.StatusExpired, service.Status)
+
+	// Missing it expires the service, then removes it
+	time.Sleep(900 * time.Millisecond)
+	registry.ExpireServices()
+	service, err = registry.GetService("leased")
+	require.NoError(t, err)
+	assert.Equal(t, discovery.StatusExpired, service.Status)
+	time.Sleep(time.Second)
+	registry.ExpireServices()
+	_, err = registry.GetService("leased")
+	assert.ErrorIs(t, err, discovery.ErrServiceNotFound)
+	w = httptest.NewRecorder()
+	handler.HandleHeartbeat(w, asAdmin(httptest.NewRequest(http.MethodPut, "/api/v1/discovery/services/leased/heartbeat", nil)))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// Services without a TTL stay until deregistered, and deregistering
+	// twice succeeds
+	_, err = registry.GetService("static")
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		w = httptest.NewRecorder()
+		handler.HandleDeregisterService(w, asAdmin(httptest.NewRequest(http.MethodDelete, "/api/v1/discovery/services/static", nil)))
+		assert.Equal(t, http.StatusNoContent, w.Code)
+	}
+	w = httptest.NewRecorder()
+	handler.HandleGetService(w, httptest.NewRequest(http.MethodGet, "/api/v1/discovery/services/static", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Empty(t, registry.ListServices())
+}
+
+func TestServiceRegistryBackends(t *testing.T) {
+	ctx := context.Background()
+
+	// Consul KV
+	consulKV := map[string][]byte{}
+	var consulMu sync.Mutex
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		consulMu.Lock()
+		defer consulMu.Unlock()
+		assert.Equal(t, "secret", r.Header.Get("X-Consul-Token"))
+		key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		switch r.Method {
+		case http.MethodPut:
+			consulKV[key], _ = io.ReadAll(r.Body)
+			w.Write([]byte("true"))
+		case http.MethodDelete:
+			delete(consulKV, key)
+			w.Write([]byte("true"))
+		case http.MethodGet:
+			require.Equal(t, "true", r.URL.Query().Get("recurse"))
+			var pairs []map[string]interface{}
+			for k, v := range consulKV {
+				if strings.HasPrefix(k, key) {
+					pairs = append(pairs, map[string]interface{}{"Key": k, "Value": v})
+				}
+			}
+			if len(pairs) == 0 {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(pairs)
+		}
+	}))
+	defer consul.Close()
+
+	// etcd v3 JSON gateway with auth
+	etcdKV := map[string][]byte{}
+	leases := map[string]int64{}
+	var etcdMu sync.Mutex
+	etcd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		etcdMu.Lock()
+		defer etcdMu.Unlock()
+		var body struct {
+			Name     string `json:"name"`
+			Key      []byte `json:"key"`
+			RangeEnd []byte `json:"range_end"`
+			Value    []byte `json:"value"`
+			Lease    string `json:"lease"`
+			TTL      int64  `json:"TTL"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		if r.URL.Path == "/v3/auth/authenticate" {
+			assert.Equal(t, "root", body.Name)
+			json.NewEncoder(w).Encode(map[string]string{"token": "etcd-token"})
+			return
+		}
+		if r.Header.Get("Authorization") != "etcd-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/v3/lease/grant":
+			id := strconv.Itoa(len(leases) + 1)
+			leases[id] = body.TTL
+			json.NewEncoder(w).Encode(map[string]string{"ID": id})
+		case "/v3/kv/put":
+			etcdKV[string(body.Key)] = body.Value
+			if body.Lease != "" {
+				assert.Contains(t, leases, body.Lease)
+			}
+			w.Write([]byte("{}"))
+		case "/v3/kv/deleterange":
+			delete(etcdKV, string(body.Key))
+			w.Write([]byte("{}"))
+		case "/v3/kv/range":
+			var kvs []map[string][]byte
+			for k, v := range etcdKV {
+				if k >= string(body.Key) && k < string(body.RangeEnd) {
+					kvs = append(kvs, map[string][]byte{"key": []byte(k), "value": v})
+				}
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"kvs": kvs})
+		}
+	}))
+	defer etcd.Close()
+
+	backends := map[string]discovery.BackendConfig{
+		discovery.BackendStore:  {},
+		discovery.BackendConsul: {Kind: discovery.BackendConsul, Consul: discovery.ConsulConfig{Address: consul.URL, Token: "secret"}},
+		discovery.BackendEtcd:   {Kind: discovery.BackendEtcd, Etcd: discovery.EtcdConfig{Endpoint: etcd.URL, Username: "root", Password: "pw"}},
+	}
+	for name, cfg := range backends {
+		t.Run(name, func(t *testing.T) {
+			backend, err := discovery.NewBackend(cfg, store.NewMemoryStore())
+			require.NoError(t, err)
+
+			// Registrations survive a restart and are seen by other replicas
+			first := discovery.NewServiceRegistryWithBackend(backend)
+			require.NoError(t, first.RegisterService(&discovery.ServiceInfo{Name: "billing", URL: "http://127.0.0.1:1", TrustLevel: 50}))
+			require.NoError(t, first.RegisterService(&discovery.ServiceInfo{Name: "leased", URL: "http://127.0.0.1:1", TTL: 30}))
+			second := discovery.NewServiceRegistryWithBackend(backend)
+			service, err := second.GetService("billing")
+			require.NoError(t, err)
+			assert.Equal(t, 50, service.TrustLevel)
+			assert.Len(t, second.ListServices(), 2)
+
+			require.NoError(t, second.DeregisterService("billing"))
+			_, err = first.GetService("billing")
+			assert.ErrorIs(t, err, discovery.ErrServiceNotFound)
+			services, err := backend.List(ctx)
+			require.NoError(t, err)
+			require.Len(t, services, 1)
+			assert.Equal(t, "leased", services[0].Name)
+		})
+	}
+	// Services with a TTL are leased until they would be removed
+	etcdMu.Lock()
+	require.NotEmpty(t, leases)
+	for _, ttl := range leases {
+		assert.Equal(t, int64(60), ttl)
+	}
+	etcdMu.Unlock()
+
+	// Kubernetes Endpoints are listed read-only
+	kube := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer kube-token", r.Header.Get("Authorization"))
+		assert.Equal(t, "/api/v1/namespaces/apps/endpoints", r.URL.Path)
+		assert.Equal(t, "zamaz.io/discover=true", r.URL.Query().Get("labelSelector"))
+		w.Write([]byte(`{"items": [
+			{"metadata": {"name": "orders", "labels": {"zamaz.io/trust-level": "25"}},
+			 "subsets": [{"addresses": [{"ip": "10.0.0.1"}], "ports": [{"name": "https", "port": 8443}]}]},
+			{"metadata": {"name": "draining"},
+			 "subsets": [{"notReadyAddresses": [{"ip": "10.0.0.2"}], "ports": [{"port": 8080}]}]},
+			{"metadata": {"name": "headless"}}
+		]}`))
+	}))
+	defer kube.Close()
+	backend, err := discovery.NewBackend(discovery.BackendConfig{
+		Kind: discovery.BackendKubernetes,
+		Kubernetes: discovery.KubernetesConfig{
+			APIServer:     kube.URL,
+			Token:         "kube-token",
+			Namespace:     "apps",
+			LabelSelector: "zamaz.io/discover=true",
+			Client:        kube.Client(),
+		},
+	}, nil)
+	require.NoError(t, err)
+	registry := discovery.NewServiceRegistryWithBackend(backend)
+	require.Len(t, registry.ListServices(), 2)
+	orders, err := registry.GetService("orders")
+	require.NoError(t, err)
+	assert.Equal(t, "https://orders.apps.svc:8443", orders.URL)
+	assert.Equal(t, discovery.StatusHealthy, orders.Status)
+	assert.Equal(t, 25, orders.TrustLevel)
+	draining, err := registry.GetService("draining")
+	require.NoError(t, err)
+	assert.Equal(t, "http://draining.apps.svc:8080", draining.URL)
+	assert.Equal(t, discovery.StatusUnhealthy, draining.Status)
+
+	assert.ErrorIs(t, registry.RegisterService(&discovery.ServiceInfo{Name: "manual", URL: "http://127.0.0.1:1"}), discovery.ErrReadOnly)
+	w := httptest.NewRecorder()
+	deregister := httptest.NewRequest(http.MethodDelete, "/api/v1/discovery/services/orders", nil)
+	discovery.NewServiceDiscoveryHandler(registry).HandleDeregisterService(w, deregister.WithContext(discovery.WithCaller(deregister.Context(), discovery.Caller{Admin: true})))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+	_, err = discovery.NewBackend(discovery.BackendConfig{Kind: "zookeeper"}, nil)
+	assert.Error(t, err)
+}
+
+func TestServiceHealthCheckConfig(t *testing.T) {
+	var hits sync.Map
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count, _ := hits.LoadOrStore(r.URL.Path, new(int64))
+		atomic.AddInt64(count.(*int64), 1)
+		switch r.URL.Path {
+		case "/ready":
+			if r.Method != http.MethodPost || r.Header.Get("X-Probe") != "zamaz" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusAccepted)
+			w.Write([]byte(`{"database": "up"}`))
+		case "/degraded":
+			w.Write([]byte(`{"database": "down"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(handler)
+	defer secure.Close()
+	ca := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: secure.Certificate().Raw}))
+
+	registry := discovery.NewServiceRegistry()
+	ready := &discovery.HealthCheckConfig{
+		Method:         "post",
+		Path:           "/ready",
+		ExpectedStatus: []int{http.StatusOK, http.StatusAccepted},
+		Headers:        map[string]string{"X-Probe": "zamaz"},
+		BodyContains:   `"database": "up"`,
+		Interval:       1,
+	}
+	services := []*discovery.ServiceInfo{
+		{Name: "ready", URL: plain.URL, HealthCheck: ready},
+		{Name: "degraded", URL: plain.URL, HealthCheck: &discovery.HealthCheckConfig{Path: "/degraded", BodyContains: `"database": "up"`}},
+		{Name: "default", URL: plain.URL},
+		{Name: "trusted", URL: secure.URL, HealthCheck: &discovery.HealthCheckConfig{Path: "/ready", Method: "POST", Headers: map[string]string{"X-Probe": "zamaz"}, ExpectedStatus: []int{202}, TLS: &discovery.HealthCheckTLS{CACert: ca, ServerName: "example.com"}}},
+		{Name: "untrusted", URL: secure.URL, HealthCheck: &discovery.HealthCheckConfig{Path: "/ready", Method: "POST", Headers: map[string]string{"X-Probe": "zamaz"}, ExpectedStatus: []int{202}}},
+	}
+	for _, service := range services {
+		require.NoError(t, registry.RegisterService(service))
+	}
+
+	invalid := []*discovery.HealthCheckConfig{
+		{Method: "DELETE"},
+		{Path: "health"},
+		{ExpectedStatus: []int{42}},
+		{Headers: map[string]string{"Bad Header": "x"}},
+		{Interval: -1},
+		{Timeout: 3600},
+		{TLS: &discovery.HealthCheckTLS{CACert: "not a certificate"}},
+	}
+	for _, hc := range invalid {
+		assert.Error(t, registry.RegisterService(&discovery.ServiceInfo{Name: "invalid", URL: plain.URL, HealthCheck: hc}), "%+v", hc)
+	}
+
+	// Each service is checked at its own interval: "ready" every second,
+	// the rest once, the registry's interval being an hour
+	ctx, cancel := context.WithTimeout(context.Background(), 3500*time.Millisecond)
+	defer cancel()
+	registry.StartHealthChecks(ctx, time.Hour)
+
+	statuses := map[string]string{}
+	for _, service := range registry.ListServices() {
+		statuses[service.Name] = service.Status
+	}
+	assert.Equal(t, map[string]string{
+		"ready":     discovery.StatusHealthy,
+		"degraded":  discovery.StatusUnhealthy,
+		"default":   discovery.StatusUnhealthy,
+		"trusted":   discovery.StatusHealthy,
+		"untrusted": discovery.StatusUnhealthy,
+	}, statuses)
+	degraded, err := registry.GetService("degraded")
+	require.NoError(t, err)
+	assert.Contains(t, degraded.LastError, "does not contain")
+	def, err := registry.GetService("default")
+	require.NoError(t, err)
+	assert.Contains(t, def.LastError, "unexpected status 404")
+
+	// Registration and the first tick check everything once; "ready" is
+	// checked again about every second. "trusted" shares its path.
+	count, _ := hits.Load("/degraded")
+	assert.EqualValues(t, 2, atomic.LoadInt64(count.(*int64)))
+	count, _ = hits.Load("/ready")
+	assert.GreaterOrEqual(t, atomic.LoadInt64(count.(*int64)), int64(5))
+}
+
+func TestServiceHealthHistory(t *testing.T) {
+	// Each check takes the next scripted result
+	results := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ok := <-results; !ok {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	defer close(results)
+
+	registry := discovery.NewServiceRegistry()
+	handler := discovery.NewServiceDiscoveryHandler(registry)
+	require.NoError(t, registry.RegisterService(&discovery.ServiceInfo{Name: "orders", URL: server.URL}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go registry.StartHealthChecks(ctx, 20*time.Millisecond)
+
+	checked := 0
+	check := func(ok bool) string {
+		t.Helper()
+		results <- ok
+		checked++
+		require.Eventually(t, func() bool {
+			history, err := registry.HealthHistory("orders")
+			require.NoError(t, err)
+			return len(history) == checked || len(history) == 20
+		}, 2*time.Second, 5*time.Millisecond)
+		service, err := registry.GetService("orders")
+		require.NoError(t, err)
+		return service.Status
+	}
+
+	// The first result settles an unknown status; changing it again takes
+	// two in a row
+	assert.Equal(t, discovery.StatusHealthy, check(true))
+	assert.Equal(t, discovery.StatusHealthy, check(true))
+	assert.Equal(t, discovery.StatusHealthy, check(false))
+	assert.Equal(t, discovery.StatusUnhealthy, check(false))
+
+	// Alternating results flag the service as flapping
+	assert.Equal(t, discovery.StatusUnhealthy, check(true))
+	assert.Equal(t, discovery.StatusUnhealthy, check(false))
+	assert.Equal(t, discovery.StatusFlapping, check(true))
+	assert.Equal(t, discovery.StatusFlapping, check(false))
+	assert.Empty(t, registry.ListHealthyServices())
+
+	// Until the recent results agree again
+	for i := 0; i < 7; i++ {
+		check(true)
+	}
+	assert.Equal(t, discovery.StatusHealthy, check(true))
+
+	// History is newest first and bounded
+	for i := 0; i < 6; i++ {
+		check(true)
+	}
+	w := httptest.NewRecorder()
+	handler.HandleHealthHistory(w, httptest.NewRequest(http.MethodGet, "/api/v1/discovery/services/orders/health-history", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var resp struct {
+		Status  string                   `json:"status"`
+		History []discovery.HealthResult `json:"history"`
+		Count   int                      `json:"count"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, discovery.StatusHealthy, resp.Status)
+	require.Equal(t, 20, resp.Count)
+	assert.False(t, resp.History[0].Time.Before(resp.History[19].Time))
+	// The oldest kept is the last failure
+	assert.Equal(t, discovery.StatusUnhealthy, resp.History[19].Status)
+	assert.Contains(t, resp.History[19].Error, "unexpected status 503")
+
+	w = httptest.NewRecorder()
+	handler.HandleHealthHistory(w, httptest.NewRequest(http.MethodGet, "/api/v1/discovery/services/missing/health-history", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestServiceWatch(t *testing.T) {
+	registry := discovery.NewServiceRegistry()
+	server := httptest.NewServer(http.HandlerFunc(discovery.NewServiceDiscoveryHandler(registry).HandleWatch))
+	defer server.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer healthy.Close()
+
+	// watch reads events from a stream until it has n
+	watch := func(query string, header http.Header, n int) []discovery.Event {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/api/v1/discovery/watch"+query, nil)
+		require.NoError(t, err)
+		req.Header = header
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+		var events []discovery.Event
+		scanner := bufio.NewScanner(resp.Body)
+		var eventType string
+		for len(events) < n && scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				eventType = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				var event discovery.Event
+				require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event))
+				assert.Equal(t, eventType, event.Type)
+				events = append(events, event)
+			}
+		}
+		require.Len(t, events, n, "stream ended early: %v", scanner.Err())
+		return events
+	}
+
+	done := make(chan []discovery.Event)
+	go func() { done <- watch("?name=orders", nil, 3) }()
+	// Let the watcher subscribe before changing anything
+	time.Sleep(200 * time.Millisecond)
+	require.NoError(t, registry.RegisterService(&discovery.ServiceInfo{Name: "billing", URL: healthy.URL}))
+	require.NoError(t, registry.RegisterService(&discovery.ServiceInfo{Name: "orders", URL: healthy.URL}))
+	require.Eventually(t, func() bool {
+		service, err := registry.GetService("orders")
+		return err == nil && service.Status == discovery.StatusHealthy
+	}, 2*time.Second, 10*time.Millisecond)
+	require.NoError(t, registry.DeregisterService("orders"))
+
+	events := <-done
+	assert.Equal(t, discovery.EventRegistered, events[0].Type)
+	assert.Equal(t, discovery.EventStatusChanged, events[1].Type)
+	assert.Equal(t, discovery.StatusUnknown, events[1].PreviousStatus)
+	assert.Equal(t, discovery.StatusHealthy, events[1].Service.Status)
+	assert.Equal(t, discovery.EventDeregistered, events[2].Type)
+	for _, event := range events {
+		assert.Equal(t, "orders", event.Service.Name)
+	}
+
+	// Reconnecting resumes after the last event seen
+	resumed := watch("?name=orders", http.Header{"Last-Event-Id": {strconv.FormatUint(events[1].ID, 10)}}, 1)
+	assert.Equal(t, events[2].ID, resumed[0].ID)
+
+	resp, err := http.Get(server.URL + "/api/v1/discovery/watch?since=latest")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestServiceInstances(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	first := httptest.NewServer(ok)
+	defer first.Close()
+	second := httptest.NewServer(ok)
+	defer second.Close()
+	dead := httptest.NewServer(ok)
+	dead.Close()
+	address := func(s *httptest.Server) string { return strings.TrimPrefix(s.URL, "http://") }
+
+	registry := discovery.NewServiceRegistry()
+	handler := discovery.NewServiceDiscoveryHandler(registry)
+	require.NoError(t, registry.RegisterService(&discovery.ServiceInfo{
+		Name: "orders",
+		URL:  "http://orders.internal/api",
+		Instances: []discovery.Instance{
+			{ID: "a", Address: address(first), Weight: 3},
+			{ID: "b", Address: address(second)},
+			{ID: "c", Address: address(dead)},
+		},
+	}))
+	require.NoError(t, registry.RegisterService(&discovery.ServiceInfo{Name: "single", URL: first.URL}))
+	require.NoError(t, registry.RegisterService(&discovery.ServiceInfo{Name: "down", URL: "http://down.internal", Instances: []discovery.Instance{{Address: address(dead)}}}))
+	require.Eventually(t, func() bool {
+		return len(registry.ListHealthyServices()) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	orders, err := registry.GetService("orders")
+	require.NoError(t, err)
+	statuses := map[string]string{}
+	for _, inst := range orders.Instances {
+		statuses[inst.ID] = inst.Status
+	}
+	assert.Equal(t, map[string]string{"a": discovery.StatusHealthy, "b": discovery.StatusHealthy, "c": discovery.StatusUnhealthy}, statuses)
+	assert.Equal(t, "http://"+address(first)+"/api", orders.Instances[0].URL)
+	assert.Equal(t, "1 of 3 instances not healthy", orders.LastError)
+	history, err := registry.HealthHistory("orders")
+	require.NoError(t, err)
+	require.Len(t, history, 3)
+	assert.ElementsMatch(t, []string{"a", "b", "c"}, []string{history[0].Instance, history[1].Instance, history[2].Instance})
+
+	pick := func(strategy string, n int) []string {
+		var ids []string
+		for i := 0; i < n; i++ {
+			inst, release, err := registry.Resolve("orders", strategy)
+			require.NoError(t, err)
+			release()
+			ids = append(ids, inst.ID)
+		}
+		return ids
+	}
+	// Round-robin alternates between the healthy instances
+	rr := pick(discovery.StrategyRoundRobin, 4)
+	assert.NotEqual(t, rr[0], rr[1])
+	assert.Equal(t, rr[:2], rr[2:])
+	// Weighted follows the weights, spread out
+	weighted := pick(discovery.StrategyWeighted, 8)
+	counts := map[string]int{}
+	for _, id := range weighted {
+		counts[id]++
+	}
+	assert.Equal(t, map[string]int{"a": 6, "b": 2}, counts)
+	assert.Equal(t, []string{"a", "a", "b", "a"}, weighted[:4])
+
+	// Least connections avoids instances still in use
+	held, release, err := registry.Resolve("orders", discovery.StrategyLeastConnections)
+	require.NoError(t, err)
+	other, releaseOther, err := registry.Resolve("orders", discovery.StrategyLeastConnections)
+	require.NoError(t, err)
+	assert.NotEqual(t, held.ID, other.ID)
+	// Releasing twice counts once
+	release()
+	release()
+	next, releaseNext, err := registry.Resolve("orders", discovery.StrategyLeastConnections)
+	require.NoError(t, err)
+	assert.Equal(t, held.ID, next.ID)
+	releaseOther()
+	releaseNext()
+
+	// A service without instances resolves to itself
+	single, release, err := registry.Resolve("single", "")
+	require.NoError(t, err)
+	release()
+	assert.Equal(t, first.URL, single.URL)
+
+	resolve := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.HandleResolve(w, httptest.NewRequest(http.MethodGet, "/api/v1/discovery/resolve/"+path, nil))
+		return w
+	}
+	w := resolve("orders?strategy=weighted")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp struct {
+		Instance discovery.Instance `json:"instance"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Contains(t, []string{"a", "b"}, resp.Instance.ID)
+	assert.Equal(t, http.StatusBadRequest, resolve("orders?strategy=random").Code)
+	assert.Equal(t, http.StatusNotFound, resolve("missing").Code)
+	assert.Equal(t, http.StatusServiceUnavailable, resolve("down").Code)
+
+	invalid := []*discovery.ServiceInfo{
+		{Name: "bad", URL: "http://bad", Instances: []discovery.Instance{{Address: "no-port"}}},
+		{Name: "bad", URL: "http://bad", Instances: []discovery.Instance{{Address: "10.0.0.1:99999"}}},
+		{Name: "bad", URL: "http://bad", Instances: []discovery.Instance{{Address: "10.0.0.1:80"}, {Address: "10.0.0.1:80"}}},
+		{Name: "bad", URL: "http://bad", Instances: []discovery.Instance{{Address: "10.0.0.1:80", Weight: -1}}},
+		{Name: "bad", URL: "http://bad", LoadBalancing: "random"},
+	}
+	for _, service := range invalid {
+		assert.Error(t, registry.RegisterService(service), "%+v", service)
+	}
+}
+
+// testCA issues certificates for health check tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns the PEM certificate and key of cn, valid between notBefore
+// and notAfter, for a server when client is false
+func (ca *testCA) issue(t *testing.T, cn string, notBefore, notAfter time.Time, client bool) (certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if client {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestServiceMutualTLSAndTrustScore(t *testing.T) {
+	ca := newTestCA(t)
+	now := time.Now()
+
+	// The service requires a client certificate from the CA, and its own
+	// certificate can be swapped
+	var current atomic.Value
+	setServerCert := func(notBefore, notAfter time.Time) {
+		certPEM, keyPEM := ca.issue(t, "orders", notBefore, notAfter, false)
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		require.NoError(t, err)
+		current.Store(&cert)
+	}
+	setServerCert(now.Add(-time.Hour), now.Add(90*24*time.Hour))
+	clients := x509.NewCertPool()
+	clients.AddCert(ca.cert)
+	var clientCN atomic.Value
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientCN.Store(r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	server.TLS = &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return &tls.Config{
+				ClientAuth:   tls.RequireAndVerifyClientCert,
+				ClientCAs:    clients,
+				Certificates: []tls.Certificate{*current.Load().(*tls.Certificate)},
+			}, nil
+		},
+	}
+	server.StartTLS()
+	defer server.Close()
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer plain.Close()
+
+	registry := discovery.NewServiceRegistry()
+	mutual := &discovery.HealthCheckConfig{TLS: &discovery.HealthCheckTLS{CACert: string(ca.pem), MutualTLS: true}}
+	assert.Error(t, registry.RegisterService(&discovery.ServiceInfo{Name: "orders", URL: server.URL, HealthCheck: mutual}), "no client certificate yet")
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	writeClientCert := func(cn string, modTime time.Time) {
+		certPEM, keyPEM := ca.issue(t, cn, now.Add(-time.Hour), now.Add(24*time.Hour), true)
+		require.NoError(t, os.WriteFile(certFile, certPEM, 0o600))
+		require.NoError(t, os.WriteFile(keyFile, keyPEM, 0o600))
+		require.NoError(t, os.Chtimes(certFile, modTime, modTime))
+		require.NoError(t, os.Chtimes(keyFile, modTime, modTime))
+	}
+	writeClientCert("registry", now.Add(-time.Minute))
+	require.NoError(t, registry.SetClientCertificate(certFile, keyFile))
+	assert.Error(t, registry.SetClientCertificate(filepath.Join(dir, "missing.crt"), keyFile))
+
+	watching, stopWatching := context.WithCancel(context.Background())
+	defer stopWatching()
+	events := registry.Watch(watching, 0)
+	require.NoError(t, registry.RegisterService(&discovery.ServiceInfo{Name: "orders", URL: server.URL, HealthCheck: mutual}))
+	require.NoError(t, registry.RegisterService(&discovery.ServiceInfo{Name: "one-way", URL: server.URL, HealthCheck: &discovery.HealthCheckConfig{TLS: &discovery.HealthCheckTLS{CACert: string(ca.pem)}}}))
+	require.NoError(t, registry.RegisterService(&discovery.ServiceInfo{Name: "plain", URL: plain.URL}))
+	// Events carry copies, safe to read while checks run
+	checked := map[string]*discovery.ServiceInfo{}
+	for len(checked) < 3 {
+		select {
+		case event := <-events:
+			if event.Type == discovery.EventStatusChanged {
+				checked[event.Service.Name] = event.Service
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("services not checked: %v", checked)
+		}
+	}
+
+	orders := checked["orders"]
+	assert.Equal(t, discovery.StatusHealthy, orders.Status, orders.LastError)
+	require.NotNil(t, orders.Certificate)
+	assert.True(t, orders.Certificate.Verified)
+	assert.True(t, orders.Certificate.Mutual)
+	assert.Equal(t, discovery.CertificateValid, orders.Certificate.State)
+	assert.Equal(t, "CN=orders", orders.Certificate.Subject)
+	assert.Equal(t, 90, orders.TrustScore)
+	assert.Equal(t, "registry", clientCN.Load())
+
+	// Without the client certificate the handshake fails
+	oneWay := checked["one-way"]
+	assert.Equal(t, discovery.StatusUnhealthy, oneWay.Status)
+	assert.Zero(t, oneWay.TrustScore)
+	assert.Equal(t, 20, checked["plain"].TrustScore)
+
+	// A certificate near expiry scores lower, and replacing it is noted
+	// as a rotation; the rotated client certificate is presented
+	firstFingerprint := orders.Certificate.Fingerprint
+	setServerCert(now.Add(-10*24*time.Hour), now.Add(5*24*time.Hour))
+	writeClientCert("registry-rotated", now)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		registry.StartHealthChecks(ctx, 50*time.Millisecond)
+		close(stopped)
+	}()
+	time.Sleep(500 * time.Millisecond)
+	cancel()
+	<-stopped
+	orders, err := registry.GetService("orders")
+	require.NoError(t, err)
+	require.NotNil(t, orders.Certificate)
+	assert.NotEqual(t, firstFingerprint, orders.Certificate.Fingerprint)
+	assert.Equal(t, discovery.CertificateExpiring, orders.Certificate.State)
+	assert.False(t, orders.Certificate.RotatedAt.IsZero())
+	assert.Equal(t, 60, orders.TrustScore)
+	assert.Equal(t, "registry-rotated", clientCN.Load())
+}
+
+func TestServiceQuery(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+
+	registry := discovery.NewServiceRegistry()
+	handler := discovery.NewServiceDiscoveryHandler(registry)
+	services := []*discovery.ServiceInfo{
+		{Name: "users", URL: up.URL, TrustLevel: 50, Tags: []string{"pii"}, Metadata: map[string]string{"type": "microservice"}},
+		{Name: "billing", URL: up.URL, TrustLevel: 75, Tags: []string{"pii", "payments"}, Metadata: map[string]string{"type": "microservice"}},
+		{Name: "search", URL: up.URL, TrustLevel: 25, Metadata: map[string]string{"type": "microservice"}},
+		{Name: "legacy", URL: down.URL, TrustLevel: 0, Tags: []string{"pii"}, Metadata: map[string]string{"type": "monolith"}},
+	}
+	for _, service := range services {
+		require.NoError(t, registry.RegisterService(service))
+	}
+	require.Eventually(t, func() bool {
+		return len(registry.ListHealthyServices()) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+
+	list := func(query string) (int, []string, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		handler.HandleListServices(w, httptest.NewRequest(http.MethodGet, "/api/v1/discovery/services?"+query, nil))
+		if w.Code != http.StatusOK {
+			return w.Code, nil, nil
+		}
+		var body struct {
+			Services []discovery.ServiceInfo `json:"services"`
+		}
+		var raw map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &raw))
+		names := []string{}
+		for _, service := range body.Services {
+			names = append(names, service.Name)
+		}
+		return w.Code, names, raw
+	}
+
+	_, names, raw := list("")
+	assert.Equal(t, []string{"billing", "legacy", "search", "users"}, names)
+	assert.Equal(t, float64(4), raw["total"])
+	assert.Nil(t, raw["next_offset"])
+
+	_, names, _ = list("status=healthy&metadata.type=microservice&maxTrust=50&tag=pii")
+	assert.Equal(t, []string{"users"}, names)
+	_, names, _ = list("tag=pii&tag=payments")
+	assert.Equal(t, []string{"billing"}, names)
+	_, names, _ = list("status=unhealthy,unknown")
+	assert.Equal(t, []string{"legacy"}, names)
+	_, names, _ = list("minTrust=25&maxTrust=75&sort=-trust_level")
+	assert.Equal(t, []string{"billing", "users", "search"}, names)
+	_, names, _ = list("metadata.type=monolith&metadata.owner=core")
+	assert.Empty(t, names)
+
+	// Pages follow the sort order
+	_, names, raw = list("sort=trust_level&limit=3")
+	assert.Equal(t, []string{"legacy", "search", "users"}, names)
+	assert.Equal(t, float64(3), raw["next_offset"])
+	_, names, raw = list("sort=trust_level&limit=3&offset=3")
+	assert.Equal(t, []string{"billing"}, names)
+	assert.Equal(t, float64(1), raw["count"])
+	assert.Nil(t, raw["next_offset"])
+	_, names, _ = list("offset=10")
+	assert.Empty(t, names)
+
+	for _, query := range []string{"limit=-1", "limit=5000", "offset=x", "maxTrust=high", "sort=age", "metadata.=x"} {
+		code, _, _ := list(query)
+		assert.Equal(t, http.StatusBadRequest, code, query)
+	}
+}
+
+func TestServiceRegistrySync(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+	const secret = "0123456789abcdef0123456789abcdef"
+
+	replica := func(name string, peers ...string) (*discovery.ServiceRegistry, *discovery.Syncer, *httptest.Server) {
+		registry := discovery.NewServiceRegistry()
+		mux := http.NewServeMux()
+		server := httptest.NewServer(mux)
+		syncer, err := discovery.NewSyncer(registry, discovery.SyncConfig{Replica: name, Secret: secret, Peers: peers})
+		require.NoError(t, err)
+		mux.Handle(discovery.SyncPath, syncer.Handler())
+		return registry, syncer, server
+	}
+	b, _, serverB := replica("b")
+	defer serverB.Close()
+	a, syncA, serverA := replica("a", serverB.URL)
+	defer serverA.Close()
+
+	urls := func(registry *discovery.ServiceRegistry) map[string]string {
+		services, _ := registry.QueryServices(discovery.ServiceQuery{})
+		byName := map[string]string{}
+		for _, service := range services {
+			byName[service.Name] = service.URL
+		}
+		return byName
+	}
+
+	// One exchange carries each replica's registrations to the other
+	require.NoError(t, a.RegisterService(&discovery.ServiceInfo{Name: "orders", URL: up.URL}))
+	require.NoError(t, b.RegisterService(&discovery.ServiceInfo{Name: "users", URL: up.URL}))
+	require.NoError(t, syncA.Sync(context.Background()))
+	assert.Equal(t, map[string]string{"orders": up.URL, "users": up.URL}, urls(a))
+	assert.Equal(t, urls(a), urls(b))
+	status := syncA.Status()
+	require.Len(t, status, 1)
+	assert.Equal(t, 1, status[0].Changed)
+	assert.Empty(t, status[0].LastError)
+
+	// The latest registration wins, whichever replica made it
+	require.NoError(t, b.RegisterService(&discovery.ServiceInfo{Name: "orders", URL: up.URL + "/v2"}))
+	require.NoError(t, a.RegisterService(&discovery.ServiceInfo{Name: "users", URL: up.URL + "/v2"}))
+	require.NoError(t, syncA.Sync(context.Background()))
+	assert.Equal(t, map[string]string{"orders": up.URL + "/v2", "users": up.URL + "/v2"}, urls(a))
+	assert.Equal(t, urls(a), urls(b))
+
+	// A deregistration wins over the registration before it, and is not
+	// undone by the replica that still had it
+	require.NoError(t, b.DeregisterService("users"))
+	require.NoError(t, syncA.Sync(context.Background()))
+	assert.Equal(t, map[string]string{"orders": up.URL + "/v2"}, urls(a))
+	assert.Equal(t, urls(a), urls(b))
+	// Registering again afterwards brings it back
+	require.NoError(t, a.RegisterService(&discovery.ServiceInfo{Name: "users", URL: up.URL}))
+	require.NoError(t, syncA.Sync(context.Background()))
+	assert.Equal(t, up.URL, urls(b)["users"])
+
+	// Exchanges must be signed with the shared secret
+	rogue, err := discovery.NewSyncer(discovery.NewServiceRegistry(), discovery.SyncConfig{Replica: "rogue", Secret: strings.Repeat("x", 32), Peers: []string{serverB.URL}})
+	require.NoError(t, err)
+	assert.Error(t, rogue.Sync(context.Background()))
+	assert.Contains(t, rogue.Status()[0].LastError, "401")
+	resp, err := http.Post(serverB.URL+discovery.SyncPath, "application/json", strings.NewReader(`{"services":[]}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	_, err = discovery.NewSyncer(a, discovery.SyncConfig{Replica: "a", Secret: "short"})
+	assert.Error(t, err)
+	_, err = discovery.NewSyncer(a, discovery.SyncConfig{Replica: "a", Secret: secret, Peers: []string{"zamaz-2:8080"}})
+	assert.Error(t, err)
+}
+
+func TestServiceDNS(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	first := httptest.NewServer(ok)
+	defer first.Close()
+	second := httptest.NewServer(ok)
+	defer second.Close()
+	dead := httptest.NewServer(ok)
+	dead.Close()
+	address := func(s *httptest.Server) string { return strings.TrimPrefix(s.URL, "http://") }
+	port := func(s *httptest.Server) uint16 {
+		p, err := strconv.Atoi(s.URL[strings.LastIndex(s.URL, ":")+1:])
+		require.NoError(t, err)
+		return uint16(p)
+	}
+
+	registry := discovery.NewServiceRegistry()
+	require.NoError(t, registry.RegisterService(&discovery.ServiceInfo{
+		Name:       "user-service",
+		URL:        "http://users.internal/api",
+		TrustLevel: 50,
+		Metadata:   map[string]string{"version": "2"},
+		Instances: []discovery.Instance{
+			{ID: "a", Address: address(first), Weight: 3},
+			{ID: "b", Address: address(second)},
+			{ID: "c", Address: address(dead)},
+		},
+	}))
+	require.NoError(t, registry.RegisterService(&discovery.ServiceInfo{Name: "legacy", URL: "http://localhost:" + strconv.Itoa(int(port(first)))}))
+	require.NoError(t, registry.RegisterService(&discovery.ServiceInfo{Name: "down", URL: dead.URL}))
+	require.Eventually(t, func() bool {
+		return len(registry.ListHealthyServices()) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	server, err := discovery.NewDNSServer(registry, discovery.DNSConfig{Domain: "ZT.local."})
+	require.NoError(t, err)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(ctx, pc, l) }()
+	defer func() {
+		cancel()
+		assert.NoError(t, <-served)
+	}()
+
+	query := func(network, name string, qtype dnsmessage.Type) (dnsmessage.Header, []dnsmessage.Resource, []dnsmessage.Resource) {
+		b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 7, RecursionDesired: true})
+		require.NoError(t, b.StartQuestions())
+		require.NoError(t, b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET}))
+		msg, err := b.Finish()
+		require.NoError(t, err)
+
+		addr := pc.LocalAddr().String()
+		if network == "tcp" {
+			addr = l.Addr().String()
+		}
+		conn, err := net.DialTimeout(network, addr, time.Second)
+		require.NoError(t, err)
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		reply := make([]byte, 65535)
+		var n int
+		if network == "tcp" {
+			_, err = conn.Write(append([]byte{byte(len(msg) >> 8), byte(len(msg))}, msg...))
+			require.NoError(t, err)
+			_, err = io.ReadFull(conn, reply[:2])
+			require.NoError(t, err)
+			n = int(reply[0])<<8 | int(reply[1])
+			_, err = io.ReadFull(conn, reply[:n])
+		} else {
+			_, err = conn.Write(msg)
+			require.NoError(t, err)
+			n, err = conn.Read(reply)
+		}
+		require.NoError(t, err)
+
+		var response dnsmessage.Message
+		require.NoError(t, response.Unpack(reply[:n]))
+		assert.Equal(t, uint16(7), response.Header.ID)
+		return response.Header, response.Answers, response.Additionals
+	}
+
+	// SRV targets instances addressed by IP by a name of their own, whose
+	// address is added
+	header, answers, additionals := query("udp", "_user-service._tcp.zt.local.", dnsmessage.TypeSRV)
+	assert.Equal(t, dnsmessage.RCodeSuccess, header.RCode)
+	assert.True(t, header.Authoritative)
+	ports := map[uint16]uint16{}
+	for _, answer := range answers {
+		srv := answer.Body.(*dnsmessage.SRVResource)
+		assert.Equal(t, "127-0-0-1.user-service.zt.local.", srv.Target.String())
+		ports[srv.Port] = srv.Weight
+	}
+	assert.Equal(t, map[uint16]uint16{port(first): 3, port(second): 1}, ports)
+	require.Len(t, additionals, 2)
+	assert.Equal(t, [4]byte{127, 0, 0, 1}, additionals[0].Body.(*dnsmessage.AResource).A)
+
+	_, answers, _ = query("udp", "127-0-0-1.user-service.zt.local.", dnsmessage.TypeA)
+	require.Len(t, answers, 1)
+	_, answers, _ = query("tcp", "User-Service.zt.local.", dnsmessage.TypeA)
+	require.Len(t, answers, 1)
+	assert.Equal(t, [4]byte{127, 0, 0, 1}, answers[0].Body.(*dnsmessage.AResource).A)
+	_, answers, _ = query("udp", "user-service.zt.local.", dnsmessage.TypeSRV)
+	assert.Len(t, answers, 2)
+
+	// Services named by host are aliases of it
+	_, answers, _ = query("udp", "legacy.zt.local.", dnsmessage.TypeA)
+	require.Len(t, answers, 1)
+	assert.Equal(t, "localhost.", answers[0].Body.(*dnsmessage.CNAMEResource).CNAME.String())
+	_, answers, _ = query("udp", "_legacy._tcp.zt.local.", dnsmessage.TypeSRV)
+	require.Len(t, answers, 1)
+	assert.Equal(t, "localhost.", answers[0].Body.(*dnsmessage.SRVResource).Target.String())
+
+	// DNS-SD browsing lists the healthy services
+	_, answers, _ = query("udp", "_services._dns-sd._udp.zt.local.", dnsmessage.TypePTR)
+	require.Len(t, answers, 1)
+	assert.Equal(t, "_http._tcp.zt.local.", answers[0].Body.(*dnsmessage.PTRResource).PTR.String())
+	_, answers, _ = query("udp", "_http._tcp.zt.local.", dnsmessage.TypePTR)
+	require.Len(t, answers, 2)
+	assert.Equal(t, "legacy._http._tcp.zt.local.", answers[0].Body.(*dnsmessage.PTRResource).PTR.String())
+	assert.Equal(t, "user-service._http._tcp.zt.local.", answers[1].Body.(*dnsmessage.PTRResource).PTR.String())
+	_, answers, _ = query("udp", "user-service._http._tcp.zt.local.", dnsmessage.TypeTXT)
+	require.Len(t, answers, 1)
+	assert.Equal(t, []string{"path=/api", "trust_level=50", "trust_score=20", "version=2"}, answers[0].Body.(*dnsmessage.TXTResource).TXT)
+
+	// Unhealthy services exist without addresses; unknown names do not
+	header, answers, _ = query("udp", "down.zt.local.", dnsmessage.TypeA)
+	assert.Equal(t, dnsmessage.RCodeSuccess, header.RCode)
+	assert.Empty(t, answers)
+	header, _, _ = query("udp", "nothing.zt.local.", dnsmessage.TypeA)
+	assert.Equal(t, dnsmessage.RCodeNameError, header.RCode)
+	header, _, _ = query("udp", "example.com.", dnsmessage.TypeA)
+	assert.Equal(t, dnsmessage.RCodeRefused, header.RCode)
+
+	_, err = discovery.NewDNSServer(registry, discovery.DNSConfig{Domain: "bad..domain"})
+	assert.Error(t, err)
+}
+
+func TestServiceOpenAPICatalog(t *testing.T) {
+	const yamlDoc = `openapi: 3.0.3
+info:
+  title: orders
+  version: "1"
+security:
+  - oauth: [orders:read]
+paths:
+  /orders:
+    parameters: []
+    get:
+      summary: List orders
+    post:
+      summary: Create an order
+      security:
+        - oauth: [orders:write, orders:read]
+  /orders/{id}:
+    delete:
+      description: |
+        Cancel an order.
+        Only pending orders can be cancelled.
+      x-trust-level: 75
+      security: []
+`
+	const jsonDoc = `{
+	"swagger": "2.0",
+	"paths": {
+		"/orders": {"get": {"summary": "List all orders"}},
+		"/refunds": {"post": {"summary": "Refund an order", "x-trust-level": 90}}
+	}
+}`
+	var doc atomic.Value
+	doc.Store(yamlDoc)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/spec" {
+			io.WriteString(w, doc.Load().(string))
+		}
+	}))
+	defer upstream.Close()
+
+	registry := discovery.NewServiceRegistry()
+	endpoints := func() []discovery.EndpointInfo {
+		services, _ := registry.QueryServices(discovery.ServiceQuery{})
+		require.Len(t, services, 1)
+		return services[0].Endpoints
+	}
+	require.NoError(t, registry.RegisterService(&discovery.ServiceInfo{
+		Name: "orders",
+		URL:  upstream.URL,
+		// Registered endpoints take precedence
+		Endpoints: []discovery.EndpointInfo{{Path: "/orders", Method: "post", Description: "Create", TrustLevel: 80}},
+		OpenAPI:   &discovery.OpenAPIConfig{Path: "/spec"},
+	}))
+	require.Eventually(t, func() bool { return len(endpoints()) == 3 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []discovery.EndpointInfo{
+		{Path: "/orders", Method: "post", Description: "Create", TrustLevel: 80},
+		{Path: "/orders", Method: "GET", Description: "List orders", Scopes: []string{"orders:read"}, Source: discovery.EndpointSourceOpenAPI},
+		{Path: "/orders/{id}", Method: "DELETE", Description: "Cancel an order.", TrustLevel: 75, Source: discovery.EndpointSourceOpenAPI},
+	}, endpoints())
+
+	// Refreshing replaces the endpoints read before
+	doc.Store(jsonDoc)
+	require.NoError(t, registry.RefreshCatalog("orders"))
+	assert.Equal(t, []discovery.EndpointInfo{
+		{Path: "/orders", Method: "post", Description: "Create", TrustLevel: 80},
+		{Path: "/orders", Method: "GET", Description: "List all orders", Source: discovery.EndpointSourceOpenAPI},
+		{Path: "/refunds", Method: "POST", Description: "Refund an order", TrustLevel: 90, Source: discovery.EndpointSourceOpenAPI},
+	}, endpoints())
+
+	// A document that cannot be read keeps the endpoints
+	for _, bad := range []string{`{"paths": {}}`, "openapi: [", `{"openapi": "3.0.0", "paths": {"/x": {"get": {"x-trust-level": 500}}}}`} {
+		doc.Store(bad)
+		assert.Error(t, registry.RefreshCatalog("orders"), bad)
+		assert.Len(t, endpoints(), 3)
+	}
+	services, _ := registry.QueryServices(discovery.ServiceQuery{})
+	assert.NotEmpty(t, services[0].OpenAPI.LastError)
+	assert.False(t, services[0].OpenAPI.LastSynced.IsZero())
+
+	assert.Error(t, registry.RegisterService(&discovery.ServiceInfo{Name: "bad", URL: upstream.URL, OpenAPI: &discovery.OpenAPIConfig{Path: "spec"}}))
+	assert.Error(t, registry.RegisterService(&discovery.ServiceInfo{Name: "bad", URL: upstream.URL, OpenAPI: &discovery.OpenAPIConfig{Refresh: -1}}))
+	assert.ErrorIs(t, registry.RefreshCatalog("missing"), discovery.ErrServiceNotFound)
+}
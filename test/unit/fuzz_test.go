@@ -0,0 +1,231 @@
+package unit
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/pkg/auth"
+	"github.com/lsendel/impl-zamaz/pkg/security"
+)
+
+// loadPayloads reads one attack payload per line, skipping comments
+func loadPayloads(tb testing.TB, name string) []string {
+	tb.Helper()
+
+	file, err := os.Open(filepath.Join("testdata", "payloads", name))
+	require.NoError(tb, err)
+	defer file.Close()
+
+	var payloads []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "# ") {
+			continue
+		}
+		payloads = append(payloads, line)
+	}
+	require.NoError(tb, scanner.Err())
+	return payloads
+}
+
+// flipASCIICase swaps the case of ASCII letters only
+func flipASCIICase(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		switch {
+		case c >= 'a' && c <= 'z':
+			b[i] = c - ('a' - 'A')
+		case c >= 'A' && c <= 'Z':
+			b[i] = c + ('a' - 'A')
+		}
+	}
+	return string(b)
+}
+
+func TestDetectorsCatchKnownPayloads(t *testing.T) {
+	detectors := map[string]func(string) bool{
+		"sqli.txt":      security.DetectSQLInjection,
+		"xss.txt":       security.DetectXSS,
+		"traversal.txt": security.DetectPathTraversal,
+	}
+
+	for file, detect := range detectors {
+		for _, payload := range loadPayloads(t, file) {
+			assert.True(t, detect(payload), "%s payload not detected: %q", file, payload)
+		}
+	}
+}
+
+func TestDetectorsAllowBenignInput(t *testing.T) {
+	benign := []string{
+		"john.doe@example.com",
+		"O'Brien",
+		"Select your preferred plan from the list",
+		"online=true",
+		"100% guaranteed",
+		"reports/2025/q1.pdf",
+		"a <b> tag",
+		"rock & roll",
+	}
+
+	for _, input := range benign {
+		assert.False(t, security.DetectSQLInjection(input), "false SQL positive: %q", input)
+		assert.False(t, security.DetectXSS(input), "false XSS positive: %q", input)
+		assert.False(t, security.DetectPathTraversal(input), "false traversal positive: %q", input)
+	}
+}
+
+// fuzzDetector checks that a detector never panics and that case changes or
+// an extra layer of URL encoding cannot turn a detected payload into a bypass
+func fuzzDetector(f *testing.F, payloadFile string, detect func(string) bool) {
+	for _, payload := range loadPayloads(f, payloadFile) {
+		f.Add(payload)
+	}
+
+	f.Fuzz(func(t *testing.T, input string) {
+		if !detect(input) {
+			return
+		}
+		if !detect(flipASCIICase(input)) {
+			t.Errorf("case variation bypasses detection: %q", flipASCIICase(input))
+		}
+		if escaped := url.QueryEscape(input); !detect(escaped) {
+			t.Errorf("URL encoding bypasses detection: %q", escaped)
+		}
+	})
+}
+
+func FuzzDetectSQLInjection(f *testing.F) {
+	fuzzDetector(f, "sqli.txt", security.DetectSQLInjection)
+}
+
+func FuzzDetectXSS(f *testing.F) {
+	fuzzDetector(f, "xss.txt", security.DetectXSS)
+}
+
+func FuzzDetectPathTraversal(f *testing.F) {
+	fuzzDetector(f, "traversal.txt", security.DetectPathTraversal)
+}
+
+func FuzzNormalizeIdempotent(f *testing.F) {
+	for _, file := range []string{"sqli.txt", "xss.txt", "traversal.txt"} {
+		for _, payload := range loadPayloads(f, file) {
+			f.Add(payload)
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, input string) {
+		once := security.Normalize(input)
+		if strings.ContainsAny(once, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") {
+			t.Errorf("normalized output contains upper-case ASCII: %q", once)
+		}
+		if strings.Contains(once, "\x00") {
+			t.Errorf("normalized output contains NUL: %q", once)
+		}
+	})
+}
+
+func encodeSegment(s string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+func tokenSeeds() []string {
+	return []string{
+		encodeSegment(`{"alg":"RS256","typ":"JWT"}`) + "." + encodeSegment(`{"sub":"demo","exp":1750593600}`) + "." + encodeSegment("sig"),
+		// alg=none downgrade attempt
+		encodeSegment(`{"alg":"none"}`) + "." + encodeSegment(`{"sub":"admin"}`) + ".",
+		// Duplicate claims and trailing garbage
+		encodeSegment(`{"alg":"HS256"}`) + "." + encodeSegment(`{"sub":"a","sub":"admin"}x`) + "." + encodeSegment("sig"),
+		// Padding and non-canonical base64 are rejected
+		encodeSegment(`{"alg":"HS256"}`) + "==." + encodeSegment(`{}`) + ".",
+		"eyJhbGciOiJSUzI1NiIsInR5cCI6IkpXVCJ9...",
+		"v4.public." + encodeSegment(`{"sub":"demo"}`+strings.Repeat("\x00", 64)),
+		"v2.local." + encodeSegment("nonce-and-ciphertext") + "." + encodeSegment(`{"kid":"k1"}`),
+		"v4.public.",
+		"v9.public.AAAA",
+		strings.Repeat("a.", 4096),
+	}
+}
+
+func TestParseTokenFormats(t *testing.T) {
+	seeds := tokenSeeds()
+
+	jwt, err := auth.ParseToken(seeds[0])
+	require.NoError(t, err)
+	assert.Equal(t, auth.FormatJWT, jwt.Format)
+	assert.Equal(t, "demo", jwt.Claims["sub"])
+	assert.Equal(t, "RS256", jwt.Header["alg"])
+
+	paseto, err := auth.ParseToken(seeds[5])
+	require.NoError(t, err)
+	assert.Equal(t, auth.FormatPASETO, paseto.Format)
+	assert.Equal(t, "v4", paseto.Version)
+	assert.Len(t, paseto.Signature, 64)
+	assert.Equal(t, "demo", paseto.Claims["sub"])
+
+	for _, malformed := range []string{seeds[2], seeds[3], seeds[4], seeds[7], strings.Repeat("a", auth.MaxTokenLength+1)} {
+		_, err := auth.ParseToken(malformed)
+		assert.Error(t, err, "expected %q to be rejected", malformed)
+	}
+}
+
+func FuzzParseToken(f *testing.F) {
+	for _, seed := range tokenSeeds() {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, raw string) {
+		token, err := auth.ParseToken(raw)
+		if err != nil {
+			if token != nil {
+				t.Errorf("token returned alongside error %v", err)
+			}
+			known := errors.Is(err, auth.ErrTokenEmpty) || errors.Is(err, auth.ErrTokenTooLarge) || errors.Is(err, auth.ErrTokenMalformed)
+			if !known {
+				t.Errorf("unexpected error type: %v", err)
+			}
+			return
+		}
+
+		if token.Raw != raw {
+			t.Errorf("raw token not preserved")
+		}
+		switch token.Format {
+		case auth.FormatJWT:
+			// Strict decoding means the segments must re-encode to the input
+			reencoded := encodeSegment(string(mustDecode(t, strings.SplitN(raw, ".", 2)[0]))) + "." +
+				base64.RawURLEncoding.EncodeToString(token.Payload) + "." +
+				base64.RawURLEncoding.EncodeToString(token.Signature)
+			if reencoded != raw {
+				t.Errorf("non-canonical JWT accepted: %q", raw)
+			}
+			if token.Header["alg"] == nil || token.Claims == nil {
+				t.Errorf("JWT parsed without alg or claims")
+			}
+		case auth.FormatPASETO:
+			if token.Purpose == "public" && token.Claims == nil {
+				t.Errorf("public PASETO parsed without claims")
+			}
+		default:
+			t.Errorf("unknown format %q", token.Format)
+		}
+	})
+}
+
+func mustDecode(t *testing.T, segment string) []byte {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		t.Fatalf("segment accepted by parser failed to decode: %v", err)
+	}
+	return data
+}
@@ -0,0 +1,188 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/pkg/groupsync"
+	"github.com/lsendel/impl-zamaz/pkg/rbac"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+// staticGroups is a group source reporting fixed groups, or failing
+type staticGroups struct {
+	name   string
+	groups map[string][]string
+	err    error
+}
+
+func (s *staticGroups) Name() string { return s.name }
+
+func (s *staticGroups) Groups(context.Context) (map[string][]string, error) { return s.groups, s.err }
+
+func TestKeycloakGroupSourceWalksSubgroups(t *testing.T) {
+	page := "briefRepresentation=true&first=0&max=100"
+	server := newMDMServer(t, map[string]interface{}{
+		"/admin/realms/test/groups?" + page: []map[string]interface{}{
+			{"id": "g-eng", "path": "/engineering", "subGroupCount": 1},
+			{"id": "g-ops", "path": "/ops", "subGroups": []map[string]interface{}{
+				{"id": "g-oncall", "path": "/ops/oncall"},
+			}},
+		},
+		"/admin/realms/test/groups/g-eng/children?" + page: []map[string]interface{}{
+			{"id": "g-sre", "path": "/engineering/sre"},
+		},
+		"/admin/realms/test/groups/g-eng/members?" + page:    []map[string]interface{}{{"id": "u-1"}, {"id": "u-2"}},
+		"/admin/realms/test/groups/g-sre/members?" + page:    []map[string]interface{}{{"id": "u-2"}},
+		"/admin/realms/test/groups/g-ops/members?" + page:    []map[string]interface{}{},
+		"/admin/realms/test/groups/g-oncall/members?" + page: []map[string]interface{}{{"id": "u-3"}},
+	})
+
+	keycloak, err := groupsync.NewKeycloak(groupsync.KeycloakConfig{
+		BaseURL: server.URL, Realm: "test", ClientID: "sync", ClientSecret: "secret",
+	})
+	require.NoError(t, err)
+	groups, err := keycloak.Groups(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]string{
+		"/engineering":     {"u-1", "u-2"},
+		"/engineering/sre": {"u-2"},
+		"/ops":             nil,
+		"/ops/oncall":      {"u-3"},
+	}, groups)
+
+	_, err = groupsync.NewKeycloak(groupsync.KeycloakConfig{BaseURL: server.URL, Realm: "test"})
+	assert.Error(t, err)
+}
+
+func TestGroupSyncKeepsAssignmentsInStep(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	roles := rbac.NewManager(rbac.Config{}, s)
+	engineer, err := roles.CreateRole(ctx, rbac.Role{Name: "engineer"})
+	require.NoError(t, err)
+	oncall, err := roles.CreateRole(ctx, rbac.Role{Name: "oncall"})
+	require.NoError(t, err)
+
+	source := &staticGroups{name: "keycloak", groups: map[string][]string{
+		"/engineering": {"u-1", "u-2"},
+		"/ops/oncall":  {"u-2"},
+	}}
+	sync := groupsync.NewService(groupsync.Config{}, []groupsync.Source{source}, roles, s, &testLogger{}, nil)
+
+	_, err = sync.Map(ctx, groupsync.Mapping{Source: "keycloak", Group: "/engineering", RoleID: engineer.ID})
+	require.NoError(t, err)
+	oncallMapping, err := sync.Map(ctx, groupsync.Mapping{Source: "keycloak", Group: "/ops/oncall", RoleID: oncall.ID})
+	require.NoError(t, err)
+	_, err = sync.Map(ctx, groupsync.Mapping{Source: "keycloak", Group: "/engineering", RoleID: engineer.ID})
+	assert.ErrorIs(t, err, groupsync.ErrExists)
+	_, err = sync.Map(ctx, groupsync.Mapping{Source: "ldap", Group: "admins", RoleID: engineer.ID})
+	assert.ErrorIs(t, err, groupsync.ErrUnknownSource)
+	_, err = sync.Map(ctx, groupsync.Mapping{Source: "keycloak", Group: "/x", RoleID: "missing"})
+	assert.ErrorIs(t, err, rbac.ErrNotFound)
+
+	// u-3 was given the engineer role by hand, which syncs leave alone
+	_, err = roles.Assign(ctx, rbac.Assignment{UserID: "u-3", RoleID: engineer.ID, AssignedBy: "admin"})
+	require.NoError(t, err)
+
+	result, err := sync.Sync(ctx, "keycloak")
+	require.NoError(t, err)
+	assert.Equal(t, groupsync.SyncResult{Source: "keycloak", Groups: 2, Assigned: 3}, result)
+	names := func(user string) []string {
+		assigned, err := roles.UserRoles(ctx, user)
+		require.NoError(t, err)
+		var names []string
+		for _, role := range assigned {
+			names = append(names, role.Name)
+		}
+		return names
+	}
+	assert.Equal(t, []string{"engineer"}, names("u-1"))
+	assert.Equal(t, []string{"engineer", "oncall"}, names("u-2"))
+
+	// Syncing again changes nothing
+	result, err = sync.Sync(ctx, "keycloak")
+	require.NoError(t, err)
+	assert.Equal(t, 0, result.Assigned+result.Removed)
+
+	// Leaving a group, or the group's mapping going, takes the role back
+	source.groups = map[string][]string{"/engineering": {"u-2"}, "/ops/oncall": {"u-2"}}
+	require.NoError(t, sync.Unmap(ctx, oncallMapping.ID))
+	assert.ErrorIs(t, sync.Unmap(ctx, oncallMapping.ID), groupsync.ErrNotMapped)
+	result, err = sync.Sync(ctx, "keycloak")
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.Removed)
+	assert.Empty(t, names("u-1"))
+	assert.Equal(t, []string{"engineer"}, names("u-2"))
+	assert.Equal(t, []string{"engineer"}, names("u-3"))
+
+	// An unreachable provider takes nothing back
+	source.err = errors.New("keycloak unavailable")
+	results := sync.SyncAll(ctx)
+	require.Len(t, results, 1)
+	assert.Equal(t, "keycloak unavailable", results[0].Error)
+	assert.Equal(t, []string{"engineer"}, names("u-2"))
+}
+
+func TestGroupSyncAPI(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	roles := rbac.NewManager(rbac.Config{}, s)
+	role, err := roles.CreateRole(ctx, rbac.Role{Name: "engineer"})
+	require.NoError(t, err)
+	source := &staticGroups{name: "ldap", groups: map[string][]string{"engineers": {"uid=alice,dc=example,dc=com"}}}
+	sync := groupsync.NewService(groupsync.Config{}, []groupsync.Source{source}, roles, s, &testLogger{}, nil)
+	r := gin.New()
+	sync.RegisterRoutes(r.Group("/rbac"))
+
+	do := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		var payload []byte
+		if body != nil {
+			payload, _ = json.Marshal(body)
+		}
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, bytes.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do(http.MethodPost, "/rbac/group-mappings", map[string]string{"source": "ldap", "group": "engineers", "role_id": role.ID})
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var mapping groupsync.Mapping
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &mapping))
+	assert.Equal(t, http.StatusConflict, do(http.MethodPost, "/rbac/group-mappings", map[string]string{"source": "ldap", "group": "engineers", "role_id": role.ID}).Code)
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/rbac/group-mappings", map[string]string{"source": "ldap"}).Code)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodPost, "/rbac/group-mappings", map[string]string{"source": "scim", "group": "x", "role_id": role.ID}).Code)
+
+	w = do(http.MethodGet, "/rbac/group-mappings?source=ldap", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var list struct {
+		Mappings []groupsync.Mapping `json:"mappings"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	require.Len(t, list.Mappings, 1)
+	assert.Equal(t, mapping.ID, list.Mappings[0].ID)
+
+	// Webhooks sync one source
+	w = do(http.MethodPost, "/rbac/group-sync/ldap", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var result groupsync.SyncResult
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	assert.Equal(t, 1, result.Assigned)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodPost, "/rbac/group-sync/scim", nil).Code)
+	assert.Equal(t, http.StatusOK, do(http.MethodPost, "/rbac/group-sync", nil).Code)
+
+	assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/rbac/group-mappings/"+mapping.ID, nil).Code)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodDelete, "/rbac/group-mappings/"+mapping.ID, nil).Code)
+}
@@ -2,6 +2,7 @@ package unit
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
@@ -12,8 +13,30 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/lsendel/impl-zamaz/api"
+	"github.com/lsendel/impl-zamaz/pkg/auth"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/middleware"
 )
 
+// stubVerifier accepts password123 and fails with err otherwise
+type stubVerifier struct {
+	err error
+}
+
+func (s stubVerifier) Authenticate(_ context.Context, username, password string) (*interfaces.LoginResponse, error) {
+	if password != "password123" {
+		return nil, s.err
+	}
+	return &interfaces.LoginResponse{
+		AccessToken:  "access-" + username,
+		RefreshToken: "refresh-" + username,
+		ExpiresIn:    300,
+		TokenType:    "Bearer",
+		User:         interfaces.UserInfo{ID: "id-" + username, Username: username, Roles: []string{"user"}},
+		TrustScore:   88,
+	}, nil
+}
+
 func setupTestRouter() *gin.Engine {
 	gin.SetMode(gin.TestMode)
 	router := gin.New()
@@ -44,7 +67,7 @@ func TestHandlersHealth(t *testing.T) {
 
 func TestHandlersLogin(t *testing.T) {
 	router := setupTestRouter()
-	handlers := api.NewHandlers()
+	handlers := api.NewHandlersWithVerifier(stubVerifier{err: auth.ErrInvalidCredentials})
 
 	router.POST("/login", handlers.Login)
 
@@ -63,6 +86,15 @@ func TestHandlersLogin(t *testing.T) {
 			expectedStatus: http.StatusOK,
 			expectError:    false,
 		},
+		{
+			name: "Wrong Password",
+			payload: api.LoginRequest{
+				Username: "testuser",
+				Password: "wrong",
+			},
+			expectedStatus: http.StatusUnauthorized,
+			expectError:    true,
+		},
 		{
 			name: "Missing Username",
 			payload: api.LoginRequest{
@@ -168,7 +200,9 @@ func TestHandlersGetProtectedResource(t *testing.T) {
 	router := setupTestRouter()
 	handlers := api.NewHandlers()
 
-	router.GET("/protected", handlers.GetProtectedResource)
+	router.GET("/protected", middleware.UseTrustSource(handlers), func(c *gin.Context) {
+		c.Set("user", &interfaces.UserInfo{ID: "u-alice"})
+	}, middleware.RequireTrustLevel(50), handlers.GetProtectedResource)
 
 	w := httptest.NewRecorder()
 	req := httptest.NewRequest("GET", "/protected", nil)
@@ -0,0 +1,175 @@
+package unit
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/pkg/health"
+)
+
+// serveTCP answers every connection on a local listener with respond
+func serveTCP(t *testing.T, respond func(net.Conn)) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { lis.Close() })
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				respond(conn)
+			}()
+		}
+	}()
+	return lis.Addr().String()
+}
+
+func TestHealthCriticalityDecidesOverallStatus(t *testing.T) {
+	checker := health.NewChecker(&testLogger{}, nil)
+	failing := health.CheckFunc(func(context.Context) error { return errors.New("down") })
+	passing := health.CheckFunc(func(context.Context) error { return nil })
+
+	require.NoError(t, checker.Register(health.Dependency{Name: "store", Check: passing, Critical: true}))
+	assert.Equal(t, health.StatusHealthy, checker.Run(context.Background()).Overall)
+
+	require.NoError(t, checker.Register(health.Dependency{Name: "mail", Check: failing}))
+	report := checker.Run(context.Background())
+	assert.Equal(t, health.StatusDegraded, report.Overall)
+	assert.Equal(t, health.StatusDegraded, report.Dependencies["mail"].Status)
+	assert.Equal(t, "down", report.Dependencies["mail"].Error)
+
+	require.NoError(t, checker.Register(health.Dependency{Name: "db", Check: failing, Critical: true}))
+	report = checker.Run(context.Background())
+	assert.Equal(t, health.StatusUnhealthy, report.Overall)
+	assert.Equal(t, report.Dependencies, checker.Last().Dependencies)
+}
+
+func TestHealthCheckTimeout(t *testing.T) {
+	checker := health.NewChecker(&testLogger{}, nil)
+	hang := health.CheckFunc(func(context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	})
+	require.NoError(t, checker.Register(health.Dependency{Name: "slow", Check: hang, Timeout: 20 * time.Millisecond, Critical: true}))
+
+	start := time.Now()
+	report := checker.Run(context.Background())
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+	assert.Equal(t, health.StatusUnhealthy, report.Dependencies["slow"].Status)
+	assert.Contains(t, report.Dependencies["slow"].Error, "timed out")
+}
+
+func TestHealthUnknownBeforeFirstRun(t *testing.T) {
+	checker := health.NewChecker(&testLogger{}, nil)
+	require.NoError(t, checker.Register(health.Dependency{Name: "db", Check: health.CheckFunc(func(context.Context) error { return nil })}))
+	assert.Equal(t, health.StatusUnknown, checker.Last().Dependencies["db"].Status)
+	assert.Error(t, checker.Register(health.Dependency{Name: "nameless"}))
+}
+
+func TestPostgresCheck(t *testing.T) {
+	addr := serveTCP(t, func(conn net.Conn) {
+		msg := make([]byte, 8)
+		if _, err := io.ReadFull(conn, msg); err == nil && binary.BigEndian.Uint32(msg[4:]) == 80877103 {
+			conn.Write([]byte("N"))
+		}
+	})
+	assert.NoError(t, (&health.PostgresCheck{Addr: addr}).Check(context.Background()))
+
+	notPostgres := serveTCP(t, func(conn net.Conn) { conn.Write([]byte("HTTP/1.1 400")) })
+	assert.Error(t, (&health.PostgresCheck{Addr: notPostgres}).Check(context.Background()))
+}
+
+func TestKafkaCheck(t *testing.T) {
+	addr := serveTCP(t, func(conn net.Conn) {
+		size := make([]byte, 4)
+		if _, err := io.ReadFull(conn, size); err != nil {
+			return
+		}
+		req := make([]byte, binary.BigEndian.Uint32(size))
+		if _, err := io.ReadFull(conn, req); err != nil {
+			return
+		}
+		resp := make([]byte, 10)
+		binary.BigEndian.PutUint32(resp[0:4], 6)
+		copy(resp[4:8], req[4:8]) // correlation id
+		conn.Write(resp)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, (&health.KafkaCheck{Brokers: []string{"127.0.0.1:1", addr}}).Check(ctx))
+	assert.Error(t, (&health.KafkaCheck{Brokers: []string{"127.0.0.1:1"}}).Check(ctx))
+}
+
+func TestNATSAndSMTPChecks(t *testing.T) {
+	nats := serveTCP(t, func(conn net.Conn) { conn.Write([]byte("INFO {\"server_id\":\"test\"}\r\n")) })
+	assert.NoError(t, (&health.NATSCheck{URL: "nats://" + nats}).Check(context.Background()))
+
+	smtp := serveTCP(t, func(conn net.Conn) {
+		conn.Write([]byte("220 mail.example.test ESMTP\r\n"))
+		io.ReadAll(conn)
+	})
+	assert.NoError(t, (&health.SMTPCheck{Addr: smtp}).Check(context.Background()))
+
+	busy := serveTCP(t, func(conn net.Conn) { conn.Write([]byte("421 try later\r\n")) })
+	assert.Error(t, (&health.SMTPCheck{Addr: busy}).Check(context.Background()))
+}
+
+func TestURLCheck(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/down" {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	assert.NoError(t, (&health.URLCheck{URL: srv.URL}).Check(context.Background()))
+	assert.NoError(t, (&health.URLCheck{URL: srv.URL, ExpectedStatus: http.StatusNoContent}).Check(context.Background()))
+	assert.Error(t, (&health.URLCheck{URL: srv.URL, ExpectedStatus: http.StatusOK}).Check(context.Background()))
+	assert.Error(t, (&health.URLCheck{URL: srv.URL + "/down"}).Check(context.Background()))
+}
+
+func TestDiskCheck(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, (&health.DiskCheck{Path: dir, MinFreeBytes: 1}).Check(context.Background()))
+	assert.Error(t, (&health.DiskCheck{Path: dir, MinFreeBytes: 1 << 62}).Check(context.Background()))
+	assert.Error(t, (&health.DiskCheck{Path: filepath.Join(dir, "missing")}).Check(context.Background()))
+}
+
+func TestLoadHealthChecks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checks.json")
+	require.NoError(t, os.WriteFile(path, []byte(`[
+		{"name": "db", "type": "postgres", "target": "db:5432", "timeout": "2s", "critical": true},
+		{"name": "events", "type": "kafka", "brokers": ["kafka:9092"]},
+		{"name": "data", "type": "disk", "target": "/", "min_free_mb": 10}
+	]`), 0o600))
+
+	deps, err := health.LoadChecks(path)
+	require.NoError(t, err)
+	require.Len(t, deps, 3)
+	assert.Equal(t, 2*time.Second, deps[0].Timeout)
+	assert.True(t, deps[0].Critical)
+	assert.IsType(t, &health.KafkaCheck{}, deps[1].Check)
+	assert.Equal(t, uint64(10<<20), deps[2].Check.(*health.DiskCheck).MinFreeBytes)
+
+	require.NoError(t, os.WriteFile(path, []byte(`[{"name": "x", "type": "mongodb", "target": "m:27017"}]`), 0o600))
+	_, err = health.LoadChecks(path)
+	assert.Error(t, err)
+}
@@ -0,0 +1,73 @@
+package unit
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/api"
+	"github.com/lsendel/impl-zamaz/pkg/i18n"
+	"github.com/lsendel/impl-zamaz/pkg/middleware"
+)
+
+func TestNegotiateLanguage(t *testing.T) {
+	tests := []struct {
+		header   string
+		expected string
+	}{
+		{header: "", expected: "en"},
+		{header: "es", expected: "es"},
+		{header: "pt-BR,pt;q=0.9,en;q=0.8", expected: "pt"},
+		{header: "fr-FR,es;q=0.5,en;q=0.7", expected: "en"},
+		{header: "de,fr", expected: "en"},
+		{header: "en;q=0,es-419", expected: "es"},
+		{header: "es;q=abc,pt;q=0.2", expected: "pt"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			assert.Equal(t, tt.expected, i18n.Negotiate(tt.header))
+		})
+	}
+}
+
+func TestTranslateFallback(t *testing.T) {
+	assert.Equal(t, "Rate limit exceeded", i18n.Translate("en", "RATE_LIMIT_EXCEEDED"))
+	assert.Equal(t, "Limite de requisições excedido", i18n.Translate("pt", "RATE_LIMIT_EXCEEDED"))
+	assert.Equal(t, "Rate limit exceeded", i18n.Translate("fr", "RATE_LIMIT_EXCEEDED"))
+	assert.Equal(t, "UNKNOWN_CODE", i18n.Translate("es", "UNKNOWN_CODE"))
+}
+
+func TestSupportedLanguages(t *testing.T) {
+	supported := i18n.Supported()
+	assert.Contains(t, supported, "en")
+	assert.Contains(t, supported, "es")
+	assert.Contains(t, supported, "pt")
+}
+
+func TestLocalizedErrorKeepsCode(t *testing.T) {
+	router := setupTestRouter()
+	router.Use(middleware.LocaleMiddleware())
+	handlers := api.NewHandlers()
+	router.POST("/login", handlers.Login)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/login", bytes.NewBufferString("invalid json"))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept-Language", "es-ES,es;q=0.9")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "es", w.Header().Get("Content-Language"))
+
+	var response api.ErrorResponse
+	err := json.Unmarshal(w.Body.Bytes(), &response)
+	require.NoError(t, err)
+	assert.Equal(t, "REQ_001", response.Code)
+	assert.Equal(t, "Formato de solicitud no válido", response.Message)
+}
@@ -0,0 +1,153 @@
+package unit
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/pkg/auth"
+)
+
+func newSigningKey(t *testing.T, alg string) *auth.SigningKey {
+	key, err := auth.GenerateSigningKey(alg)
+	require.NoError(t, err)
+	return key
+}
+
+func jwksKeyIDs(set auth.JSONWebKeySet) []string {
+	ids := make([]string, 0, len(set.Keys))
+	for _, k := range set.Keys {
+		ids = append(ids, k.KeyID)
+	}
+	return ids
+}
+
+func TestIssuerES256VerifiesDownstream(t *testing.T) {
+	key := newSigningKey(t, auth.AlgES256)
+	issuer, err := auth.NewRotatingIssuer(oidcIssuer, []auth.ScheduledKey{{Key: key}}, auth.Rotation{})
+	require.NoError(t, err)
+
+	jwks := issuer.JWKS()
+	require.Len(t, jwks.Keys, 1)
+	assert.Equal(t, "EC", jwks.Keys[0].KeyType)
+	assert.Equal(t, "P-256", jwks.Keys[0].Curve)
+	assert.Equal(t, auth.AlgES256, jwks.Keys[0].Algorithm)
+	assert.Empty(t, jwks.Keys[0].N)
+
+	// A relying party validates with nothing but the published JWKS
+	server := newJWKSServer(t, jwks)
+	client := auth.NewJWKSClient(auth.JWKSConfig{URL: server.URL}, &testLogger{}, nil)
+	token, err := client.Verify(context.Background(), signTestToken(t, issuer, map[string]interface{}{"sub": "u-1"}))
+	require.NoError(t, err)
+	assert.Equal(t, auth.AlgES256, token.Header["alg"])
+	assert.Equal(t, key.ID, token.Header["kid"])
+}
+
+func TestIssuerRotationOverlap(t *testing.T) {
+	now := time.Now()
+	old, current, next := newSigningKey(t, auth.AlgRS256), newSigningKey(t, auth.AlgES256), newSigningKey(t, auth.AlgRS256)
+	schedule := []auth.ScheduledKey{
+		{Key: old, ActiveFrom: now.Add(-48 * time.Hour)},
+		{Key: current, ActiveFrom: now.Add(-time.Hour)},
+		{Key: next, ActiveFrom: now.Add(30 * time.Minute)},
+	}
+
+	issuer, err := auth.NewRotatingIssuer(oidcIssuer, schedule, auth.Rotation{PrePublish: time.Hour, Overlap: 2 * time.Hour})
+	require.NoError(t, err)
+	assert.Equal(t, current.ID, issuer.KeyID())
+	// The superseded key is still in its overlap, the next one pre-published
+	assert.Equal(t, []string{old.ID, current.ID, next.ID}, jwksKeyIDs(issuer.JWKS()))
+
+	issuer, err = auth.NewRotatingIssuer(oidcIssuer, schedule, auth.Rotation{PrePublish: 10 * time.Minute, Overlap: 30 * time.Minute})
+	require.NoError(t, err)
+	assert.Equal(t, []string{current.ID}, jwksKeyIDs(issuer.JWKS()))
+
+	_, err = auth.NewRotatingIssuer(oidcIssuer, schedule[2:], auth.Rotation{})
+	assert.Error(t, err, "no key is active yet")
+}
+
+func TestIssuerRotateKeepsOldTokensValid(t *testing.T) {
+	first := newSigningKey(t, auth.AlgRS256)
+	issuer, err := auth.NewRotatingIssuer(oidcIssuer, []auth.ScheduledKey{{Key: first}}, auth.Rotation{})
+	require.NoError(t, err)
+	before := signTestToken(t, issuer, map[string]interface{}{"sub": "u-1"})
+
+	second := newSigningKey(t, auth.AlgES256)
+	issuer.Rotate(second)
+	assert.Equal(t, second.ID, issuer.KeyID())
+	assert.ElementsMatch(t, []string{first.ID, second.ID}, jwksKeyIDs(issuer.JWKS()))
+
+	after := signTestToken(t, issuer, map[string]interface{}{"sub": "u-2"})
+	for _, token := range []string{before, after} {
+		_, err := issuer.Verify(token)
+		assert.NoError(t, err)
+	}
+
+	// An unknown kid never falls back to another key
+	other, err := auth.NewRotatingIssuer(oidcIssuer, []auth.ScheduledKey{{Key: newSigningKey(t, auth.AlgES256)}}, auth.Rotation{})
+	require.NoError(t, err)
+	_, err = issuer.Verify(signTestToken(t, other, map[string]interface{}{"sub": "u-3"}))
+	assert.ErrorIs(t, err, auth.ErrTokenSignature)
+}
+
+func TestIssuerTokenPairRefresh(t *testing.T) {
+	issuer := newTestIssuer(t)
+	pair, err := issuer.IssueTokens(map[string]interface{}{"sub": "u-1", "roles": []string{"user"}}, time.Minute, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, 60, pair.ExpiresIn)
+	assert.Equal(t, "Bearer", pair.TokenType)
+
+	access, err := issuer.Verify(pair.AccessToken)
+	require.NoError(t, err)
+	assert.Equal(t, auth.TokenUseAccess, access["token_use"])
+	assert.Equal(t, auth.APIAudience, access["aud"])
+	assert.NotEmpty(t, access["jti"])
+
+	// Only refresh tokens refresh
+	_, err = issuer.Refresh(pair.AccessToken, time.Minute, time.Hour)
+	assert.ErrorIs(t, err, auth.ErrTokenUse)
+
+	renewed, err := issuer.Refresh(pair.RefreshToken, time.Minute, time.Hour)
+	require.NoError(t, err)
+	claims, err := issuer.Verify(renewed.AccessToken)
+	require.NoError(t, err)
+	assert.Equal(t, "u-1", claims["sub"])
+	assert.Equal(t, []interface{}{"user"}, claims["roles"])
+	assert.NotEqual(t, access["jti"], claims["jti"])
+}
+
+func TestLoadKeySchedule(t *testing.T) {
+	dir := t.TempDir()
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalECPrivateKey(ecKey)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "ec.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600))
+
+	rsaKey, err := auth.GenerateKey()
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "rsa.pem"), pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}), 0o600))
+
+	schedule := filepath.Join(dir, "keys.json")
+	require.NoError(t, os.WriteFile(schedule, []byte(`[
+		{"path": "rsa.pem", "active_from": "2026-01-01T00:00:00Z"},
+		{"path": "ec.pem", "active_from": "2026-04-01T00:00:00Z"}
+	]`), 0o600))
+
+	keys, err := auth.LoadKeySchedule(schedule)
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	assert.Equal(t, auth.AlgRS256, keys[0].Key.Algorithm)
+	assert.Equal(t, auth.AlgES256, keys[1].Key.Algorithm)
+	assert.Equal(t, time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC), keys[1].ActiveFrom.UTC())
+}
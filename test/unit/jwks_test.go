@@ -0,0 +1,267 @@
+package unit
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/pkg/auth"
+	"github.com/lsendel/impl-zamaz/pkg/authz"
+)
+
+// countingMetrics records counter increments by name and label set
+type countingMetrics struct {
+	mu       sync.Mutex
+	counters map[string]int
+}
+
+func (m *countingMetrics) IncrementCounter(name string, labels map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.counters == nil {
+		m.counters = make(map[string]int)
+	}
+	names := make([]string, 0, len(labels))
+	for k := range labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	key := name
+	for _, k := range names {
+		key += "," + k + "=" + labels[k]
+	}
+	m.counters[key]++
+}
+
+func (m *countingMetrics) ObserveHistogram(string, float64, map[string]string) {}
+func (m *countingMetrics) SetGauge(string, float64, map[string]string)         {}
+
+func (m *countingMetrics) count(key string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.counters[key]
+}
+
+// jwksServer serves a swappable key set with an ETag derived from its content
+type jwksServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	body     []byte
+	fail     bool
+	requests int32
+}
+
+func newJWKSServer(t *testing.T, set interface{}) *jwksServer {
+	s := &jwksServer{}
+	s.publish(t, set)
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&s.requests, 1)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		sum := sha256.Sum256(s.body)
+		etag := `"` + base64.RawURLEncoding.EncodeToString(sum[:8]) + `"`
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(s.body)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *jwksServer) publish(t *testing.T, set interface{}) {
+	body, err := json.Marshal(set)
+	require.NoError(t, err)
+	s.mu.Lock()
+	s.body = body
+	s.mu.Unlock()
+}
+
+func (s *jwksServer) setFailing(fail bool) {
+	s.mu.Lock()
+	s.fail = fail
+	s.mu.Unlock()
+}
+
+func (s *jwksServer) count() int {
+	return int(atomic.LoadInt32(&s.requests))
+}
+
+func newTestIssuer(t *testing.T) *auth.Issuer {
+	key, err := auth.GenerateKey()
+	require.NoError(t, err)
+	return auth.NewIssuer(oidcIssuer, key)
+}
+
+func signTestToken(t *testing.T, issuer *auth.Issuer, claims map[string]interface{}) string {
+	token, err := issuer.Sign(claims, time.Minute)
+	require.NoError(t, err)
+	return token
+}
+
+func TestJWKSClientVerifiesAndRevalidates(t *testing.T) {
+	issuer := newTestIssuer(t)
+	server := newJWKSServer(t, issuer.JWKS())
+	metrics := &countingMetrics{}
+	client := auth.NewJWKSClient(auth.JWKSConfig{URL: server.URL}, &testLogger{}, metrics)
+
+	token, err := client.Verify(context.Background(), signTestToken(t, issuer, map[string]interface{}{"sub": "u-1"}))
+	require.NoError(t, err)
+	assert.Equal(t, "u-1", token.Claims["sub"])
+
+	// Cached keys answer without another request
+	_, err = client.Verify(context.Background(), signTestToken(t, issuer, map[string]interface{}{"sub": "u-2"}))
+	require.NoError(t, err)
+	assert.Equal(t, 1, server.count())
+
+	require.NoError(t, client.Refresh(context.Background()))
+	assert.Equal(t, 1, metrics.count("jwks_fetch_total,result=success"))
+	assert.Equal(t, 1, metrics.count("jwks_fetch_total,result=not_modified"))
+}
+
+func TestJWKSClientKeyRollover(t *testing.T) {
+	oldIssuer := newTestIssuer(t)
+	server := newJWKSServer(t, oldIssuer.JWKS())
+	client := auth.NewJWKSClient(auth.JWKSConfig{URL: server.URL, MinRefetchInterval: time.Millisecond}, &testLogger{}, nil)
+	require.NoError(t, client.Refresh(context.Background()))
+
+	// The IdP rotates to a new key; tokens signed with it trigger a refetch
+	newIssuer := newTestIssuer(t)
+	server.publish(t, newIssuer.JWKS())
+	time.Sleep(5 * time.Millisecond)
+
+	_, err := client.Verify(context.Background(), signTestToken(t, newIssuer, map[string]interface{}{"sub": "u-1"}))
+	require.NoError(t, err)
+	assert.Equal(t, 2, server.count())
+}
+
+func TestJWKSClientThrottlesUnknownKidRefetch(t *testing.T) {
+	issuer := newTestIssuer(t)
+	server := newJWKSServer(t, issuer.JWKS())
+	metrics := &countingMetrics{}
+	client := auth.NewJWKSClient(auth.JWKSConfig{URL: server.URL, MinRefetchInterval: time.Hour}, &testLogger{}, metrics)
+
+	for i := 0; i < 5; i++ {
+		_, err := client.Key(context.Background(), "unknown-kid")
+		assert.ErrorIs(t, err, auth.ErrKeyNotFound)
+	}
+	assert.Equal(t, 1, server.count())
+	assert.Equal(t, 4, metrics.count("jwks_refetch_throttled_total"))
+
+	// Known keys are still served while refetches are throttled
+	_, err := client.Key(context.Background(), issuer.KeyID())
+	assert.NoError(t, err)
+}
+
+func TestJWKSClientKeepsKeysOnFailure(t *testing.T) {
+	issuer := newTestIssuer(t)
+	server := newJWKSServer(t, issuer.JWKS())
+	metrics := &countingMetrics{}
+	client := auth.NewJWKSClient(auth.JWKSConfig{URL: server.URL}, &testLogger{}, metrics)
+	require.NoError(t, client.Refresh(context.Background()))
+
+	server.setFailing(true)
+	assert.Error(t, client.Refresh(context.Background()))
+	assert.Equal(t, 1, metrics.count("jwks_fetch_total,result=error"))
+
+	_, err := client.Verify(context.Background(), signTestToken(t, issuer, map[string]interface{}{"sub": "u-1"}))
+	assert.NoError(t, err)
+}
+
+func TestJWKSClientRejectsForeignSignature(t *testing.T) {
+	issuer := newTestIssuer(t)
+	server := newJWKSServer(t, issuer.JWKS())
+	client := auth.NewJWKSClient(auth.JWKSConfig{URL: server.URL}, &testLogger{}, nil)
+
+	// A key the IdP never published
+	forged := newTestIssuer(t)
+	_, err := client.Verify(context.Background(), signTestToken(t, forged, map[string]interface{}{"sub": "u-1"}))
+	assert.ErrorIs(t, err, auth.ErrKeyNotFound)
+
+	// A published kid with a signature from another key
+	valid := signTestToken(t, issuer, map[string]interface{}{"sub": "u-1"})
+	other := signTestToken(t, forged, map[string]interface{}{"sub": "u-1"})
+	_, err = client.Verify(context.Background(), valid[:strings.LastIndex(valid, ".")]+other[strings.LastIndex(other, "."):])
+	assert.Error(t, err)
+}
+
+func TestJWKSClientVerifiesES256(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	b64 := base64.RawURLEncoding.EncodeToString
+	server := newJWKSServer(t, map[string]interface{}{"keys": []map[string]string{{
+		"kty": "EC", "crv": "P-256", "kid": "ec-1", "use": "sig",
+		"x": b64(key.X.FillBytes(make([]byte, 32))),
+		"y": b64(key.Y.FillBytes(make([]byte, 32))),
+	}}})
+	client := auth.NewJWKSClient(auth.JWKSConfig{URL: server.URL}, &testLogger{}, nil)
+
+	signingInput := b64([]byte(`{"alg":"ES256","kid":"ec-1","typ":"JWT"}`)) + "." + b64([]byte(`{"sub":"u-ec"}`))
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	require.NoError(t, err)
+	signature := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+
+	token, err := client.Verify(context.Background(), signingInput+"."+b64(signature))
+	require.NoError(t, err)
+	assert.Equal(t, "u-ec", token.Claims["sub"])
+
+	// An RSA algorithm cannot be used with an EC key
+	_, err = client.Verify(context.Background(), b64([]byte(`{"alg":"RS256","kid":"ec-1"}`))+"."+b64([]byte(`{}`))+"."+b64(signature))
+	assert.Error(t, err)
+}
+
+func TestJWTValidatorIdentity(t *testing.T) {
+	issuer := newTestIssuer(t)
+	server := newJWKSServer(t, issuer.JWKS())
+	client := auth.NewJWKSClient(auth.JWKSConfig{URL: server.URL}, &testLogger{}, nil)
+	validator := authz.NewJWTValidator(client, oidcIssuer, "zamaz")
+	validator.DefaultTrustLevel = 25
+
+	identity, err := validator.ValidateToken(context.Background(), signTestToken(t, issuer, map[string]interface{}{
+		"sub":                "u-7",
+		"preferred_username": "bob",
+		"aud":                []string{"account", "zamaz"},
+		"realm_access":       map[string]interface{}{"roles": []string{"user", "admin"}},
+		"trust_level":        75,
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, "u-7", identity.User.ID)
+	assert.Equal(t, "bob", identity.User.Username)
+	assert.Equal(t, []string{"user", "admin"}, identity.User.Roles)
+	assert.Equal(t, 75, identity.TrustLevel)
+
+	identity, err = validator.ValidateToken(context.Background(), signTestToken(t, issuer, map[string]interface{}{"sub": "u-8", "aud": "zamaz"}))
+	require.NoError(t, err)
+	assert.Equal(t, 25, identity.TrustLevel)
+
+	_, err = validator.ValidateToken(context.Background(), signTestToken(t, issuer, map[string]interface{}{"sub": "u-9", "aud": "other"}))
+	assert.ErrorIs(t, err, authz.ErrInvalidToken)
+
+	expired, err := issuer.Sign(map[string]interface{}{"sub": "u-1", "aud": "zamaz", "exp": time.Now().Add(-time.Hour).Unix()}, 0)
+	require.NoError(t, err)
+	_, err = validator.ValidateToken(context.Background(), expired)
+	assert.ErrorIs(t, err, authz.ErrInvalidToken)
+}
@@ -0,0 +1,117 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/pkg/auth"
+)
+
+// newKeycloakRealm serves a password grant token endpoint that accepts
+// alice/secret and answers every other user as Keycloak would
+func newKeycloakRealm(t *testing.T) *httptest.Server {
+	key, err := auth.GenerateKey()
+	require.NoError(t, err)
+	issuer := auth.NewIssuer("http://keycloak/realms/zerotrust-test", key)
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, "password", r.PostForm.Get("grant_type"))
+		if id, secret, _ := r.BasicAuth(); id != "zerotrust-client" || secret != "client-secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "unauthorized_client"})
+			return
+		}
+
+		reject := func(status int, description string) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant", "error_description": description})
+		}
+		switch r.PostForm.Get("username") {
+		case "outage":
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		case "disabled":
+			reject(http.StatusBadRequest, "Account disabled")
+			return
+		case "pending":
+			reject(http.StatusBadRequest, "Account is not fully set up")
+			return
+		}
+		if r.PostForm.Get("username") != "alice" || r.PostForm.Get("password") != "secret" {
+			reject(http.StatusUnauthorized, "Invalid user credentials")
+			return
+		}
+
+		token, err := issuer.Sign(map[string]interface{}{
+			"sub":                "f81d4fae-7dec-11d0-a765-00a0c91e6bf6",
+			"preferred_username": "alice",
+			"email":              "alice@example.com",
+			"realm_access":       map[string]interface{}{"roles": []string{"user", "admin"}},
+		}, 5*time.Minute)
+		require.NoError(t, err)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token":  token,
+			"refresh_token": "refresh",
+			"expires_in":    300,
+			"token_type":    "Bearer",
+		})
+	}))
+}
+
+func TestKeycloakPasswordGrant(t *testing.T) {
+	realm := newKeycloakRealm(t)
+	defer realm.Close()
+	client := auth.NewKeycloakClient(realm.URL, "zerotrust-client", "client-secret")
+
+	resp, err := client.Authenticate(context.Background(), "alice", "secret")
+	require.NoError(t, err)
+	assert.NotEmpty(t, resp.AccessToken)
+	assert.Equal(t, "refresh", resp.RefreshToken)
+	assert.Equal(t, 300, resp.ExpiresIn)
+	assert.Equal(t, "f81d4fae-7dec-11d0-a765-00a0c91e6bf6", resp.User.ID)
+	assert.Equal(t, "alice", resp.User.Username)
+	assert.Equal(t, "alice@example.com", resp.User.Email)
+	assert.Equal(t, []string{"user", "admin"}, resp.User.Roles)
+}
+
+func TestKeycloakPasswordGrantErrors(t *testing.T) {
+	realm := newKeycloakRealm(t)
+	client := auth.NewKeycloakClient(realm.URL, "zerotrust-client", "client-secret")
+
+	tests := []struct {
+		username, password string
+		status             int
+		code               string
+	}{
+		{"alice", "wrong", http.StatusUnauthorized, "INVALID_CREDENTIALS"},
+		{"disabled", "secret", http.StatusLocked, "ACCOUNT_LOCKED"},
+		{"pending", "secret", http.StatusForbidden, "ACCOUNT_SETUP_REQUIRED"},
+		{"outage", "secret", http.StatusServiceUnavailable, "IDP_UNAVAILABLE"},
+	}
+	for _, tt := range tests {
+		_, err := client.Authenticate(context.Background(), tt.username, tt.password)
+		require.Error(t, err, tt.username)
+		status, code := auth.LoginError(err)
+		assert.Equal(t, tt.status, status, tt.username)
+		assert.Equal(t, tt.code, code, tt.username)
+	}
+
+	// A misconfigured client is not the user's fault
+	_, err := auth.NewKeycloakClient(realm.URL, "zerotrust-client", "wrong").Authenticate(context.Background(), "alice", "secret")
+	status, _ := auth.LoginError(err)
+	assert.Equal(t, http.StatusBadGateway, status)
+
+	// The realm being down is an outage too
+	realm.Close()
+	_, err = client.Authenticate(context.Background(), "alice", "secret")
+	assert.ErrorIs(t, err, auth.ErrIdPUnavailable)
+}
@@ -0,0 +1,68 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/pkg/admin"
+	"github.com/lsendel/impl-zamaz/pkg/middleware"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+func TestKillSwitchesTakeRoutesOutOfUse(t *testing.T) {
+	ctx := context.Background()
+	m := admin.NewManager(store.NewMemoryStore(), testLogger{}, nil, admin.KillSwitchKind())
+	put := func(name, spec string) error {
+		_, _, err := m.Put(ctx, "kill-switch", name, json.RawMessage(spec), admin.Preconditions{})
+		return err
+	}
+	assert.Error(t, put("bad", `{"routes":["api/v1/devices"]}`))
+	assert.Error(t, put("bad", `{"retry_after":-1}`))
+
+	metrics := &countingMetrics{}
+	kills := middleware.NewKillSwitches(middleware.AdminKillSwitches(m), []string{"/health", "/api/v1/admin"}, time.Nanosecond, testLogger{}, metrics)
+	router := setupTestRouter()
+	router.Use(kills.Middleware())
+	router.Any("/*path", func(c *gin.Context) { c.Status(http.StatusOK) })
+	request := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+
+	assert.Equal(t, http.StatusOK, request("GET", "/api/v1/devices/42").Code)
+
+	// Switching off a route group
+	require.NoError(t, put("devices", `{"routes":["/api/v1/devices"],"message":"See status.example.com","retry_after":120}`))
+	w := request("POST", "/api/v1/devices/42/verify")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "120", w.Header().Get("Retry-After"))
+	assert.Equal(t, "maintenance", w.Header().Get(middleware.HeaderServiceMode))
+	assert.JSONEq(t, `{"error":"The service is under maintenance; try again later","code":"MAINTENANCE","switch":"devices","message":"See status.example.com","retry_after":120}`, w.Body.String())
+	assert.Equal(t, http.StatusOK, request("GET", "/api/v1/devicesets").Code)
+	assert.Equal(t, http.StatusOK, request("GET", "/api/v1/auth/me").Code)
+
+	// Maintenance mode spares health checks and administration
+	require.NoError(t, put("maintenance", `{"description":"Database upgrade"}`))
+	w = request("GET", "/api/v1/auth/me")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Empty(t, w.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusOK, request("GET", "/health").Code)
+	assert.Equal(t, http.StatusOK, request("DELETE", "/api/v1/admin/kill-switches/maintenance").Code)
+
+	// Turning switches off applies without a restart
+	require.NoError(t, m.Delete(ctx, "kill-switch", "maintenance", admin.Preconditions{}))
+	require.NoError(t, m.Delete(ctx, "kill-switch", "devices", admin.Preconditions{}))
+	assert.Equal(t, http.StatusOK, request("GET", "/api/v1/auth/me").Code)
+	assert.Equal(t, http.StatusOK, request("GET", "/api/v1/devices/42").Code)
+	assert.Equal(t, 1, metrics.count("kill_switch_rejections_total,switch=devices"))
+	assert.Equal(t, 1, metrics.count("kill_switch_rejections_total,switch=maintenance"))
+}
@@ -0,0 +1,80 @@
+package unit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/pkg/loadtest"
+)
+
+func TestParseMix(t *testing.T) {
+	mix, err := loadtest.ParseMix("login=20, validate=60,policy=20")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"login": 20, "validate": 60, "policy": 20}, mix)
+
+	for _, invalid := range []string{"", "login", "login=abc", "login=-1", "unknown=5"} {
+		_, err := loadtest.ParseMix(invalid)
+		assert.Error(t, err, "expected %q to be rejected", invalid)
+	}
+}
+
+func TestLoadTestRun(t *testing.T) {
+	var validateAuthorized int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/auth/login":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"access_token":"load-token"}`))
+		case "/api/v1/auth/validate":
+			if r.Header.Get("Authorization") == "Bearer load-token" {
+				atomic.AddInt64(&validateAuthorized, 1)
+			}
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	runner, err := loadtest.NewRunner(loadtest.Config{
+		Target:      server.URL,
+		Duration:    300 * time.Millisecond,
+		Concurrency: 4,
+		Mix:         map[string]int{"login": 1, "validate": 2, "policy": 1},
+		Username:    "demo",
+		Password:    "demo",
+	})
+	require.NoError(t, err)
+
+	report := runner.Run(context.Background())
+
+	assert.Greater(t, report.Requests, 0)
+	require.Contains(t, report.Operations, "policy")
+	policy := report.Operations["policy"]
+	assert.Equal(t, policy.Requests, policy.Errors)
+	assert.Equal(t, policy.Errors, policy.ErrorsBy["status_503"])
+	assert.LessOrEqual(t, policy.P50, policy.P99)
+	assert.LessOrEqual(t, policy.P99, policy.Max)
+
+	require.Contains(t, report.Operations, "login")
+	assert.Equal(t, 0, report.Operations["login"].Errors)
+	assert.Greater(t, atomic.LoadInt64(&validateAuthorized), int64(0))
+
+	var out strings.Builder
+	report.WriteText(&out)
+	assert.Contains(t, out.String(), "status_503")
+	assert.Contains(t, out.String(), "P99")
+}
+
+func TestLoadTestRequiresTarget(t *testing.T) {
+	_, err := loadtest.NewRunner(loadtest.Config{Duration: time.Second, Mix: map[string]int{"login": 1}})
+	assert.Error(t, err)
+}
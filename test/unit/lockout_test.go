@@ -0,0 +1,90 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/pkg/security"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+func TestLockoutLocksAfterMaxAttempts(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	lockout := security.NewLockout(security.LockoutConfig{MaxAttempts: 3, LockoutTime: time.Hour}, s, &testLogger{}, nil)
+
+	for i := 0; i < 2; i++ {
+		lock, err := lockout.Failure(ctx, "alice")
+		require.NoError(t, err)
+		assert.Nil(t, lock)
+	}
+	// A success forgets earlier failures
+	require.NoError(t, lockout.Success(ctx, "alice"))
+	for i := 0; i < 2; i++ {
+		_, err := lockout.Failure(ctx, "alice")
+		require.NoError(t, err)
+	}
+	lock, err := lockout.Status(ctx, "alice")
+	require.NoError(t, err)
+	assert.Nil(t, lock)
+
+	// Usernames are compared case-insensitively
+	lock, err = lockout.Failure(ctx, " Alice")
+	require.NoError(t, err)
+	require.NotNil(t, lock)
+	assert.Equal(t, "alice", lock.Username)
+	assert.EqualValues(t, 3, lock.Failures)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), lock.Until, time.Minute)
+
+	// The lock is in the shared store, so a fresh instance sees it
+	restarted := security.NewLockout(security.LockoutConfig{MaxAttempts: 3, LockoutTime: time.Hour}, s, &testLogger{}, nil)
+	lock, err = restarted.Status(ctx, "ALICE")
+	require.NoError(t, err)
+	require.NotNil(t, lock)
+
+	lock, err = restarted.Status(ctx, "bob")
+	require.NoError(t, err)
+	assert.Nil(t, lock)
+}
+
+func TestLockoutAdminRoutes(t *testing.T) {
+	ctx := context.Background()
+	lockout := security.NewLockout(security.LockoutConfig{MaxAttempts: 1, LockoutTime: time.Hour}, store.NewMemoryStore(), &testLogger{}, nil)
+	router := setupTestRouter()
+	lockout.RegisterRoutes(router.Group("/admin"))
+
+	for _, username := range []string{"alice", "mallory"} {
+		lock, err := lockout.Failure(ctx, username)
+		require.NoError(t, err)
+		require.NotNil(t, lock)
+	}
+
+	w := adminRequest(router, http.MethodGet, "/admin/lockouts", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var list struct {
+		Lockouts []security.Lock `json:"lockouts"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	assert.Len(t, list.Lockouts, 2)
+
+	assert.Equal(t, http.StatusOK, adminRequest(router, http.MethodGet, "/admin/lockouts/alice", "", nil).Code)
+	assert.Equal(t, http.StatusNoContent, adminRequest(router, http.MethodDelete, "/admin/lockouts/alice", "", nil).Code)
+	assert.Equal(t, http.StatusNotFound, adminRequest(router, http.MethodGet, "/admin/lockouts/alice", "", nil).Code)
+
+	// Only the named account is unlocked
+	lock, err := lockout.Status(ctx, "alice")
+	require.NoError(t, err)
+	assert.Nil(t, lock)
+	lock, err = lockout.Status(ctx, "mallory")
+	require.NoError(t, err)
+	assert.NotNil(t, lock)
+
+	// Unlocking an account that is not locked is idempotent
+	assert.Equal(t, http.StatusNoContent, adminRequest(router, http.MethodDelete, "/admin/lockouts/nobody", "", nil).Code)
+}
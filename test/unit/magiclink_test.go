@@ -0,0 +1,148 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/pkg/auth"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+// outbox records sent emails
+type outbox chan string
+
+func (o outbox) Send(_ context.Context, to, subject, body string) error {
+	o <- body
+	return nil
+}
+
+var (
+	linkPattern = regexp.MustCompile(`https://\S+`)
+	codePattern = regexp.MustCompile(`code (\d{6})`)
+)
+
+type magicLinkHarness struct {
+	router *gin.Engine
+	outbox outbox
+	issuer *auth.Issuer
+	users  []interfaces.UserInfo
+}
+
+func newMagicLinkHarness(t *testing.T) *magicLinkHarness {
+	h := &magicLinkHarness{router: setupTestRouter(), outbox: make(outbox, 10), issuer: newTestIssuer(t)}
+	m, err := auth.NewMagicLinks(auth.MagicLinkConfig{
+		VerifyURL: "https://app.example.com/api/v1/auth/magic-link/verify",
+		Lookup: func(_ context.Context, email string) (*interfaces.UserInfo, error) {
+			if email != "alice@example.com" {
+				return nil, auth.ErrInvalidCredentials
+			}
+			return &interfaces.UserInfo{ID: "u-alice", Username: "alice", Email: email, Roles: []string{"user"}}, nil
+		},
+		Complete: func(c *gin.Context, user interfaces.UserInfo) error {
+			h.users = append(h.users, user)
+			return nil
+		},
+	}, h.issuer, h.outbox, store.NewMemoryStore(), &testLogger{}, nil)
+	require.NoError(t, err)
+	m.RegisterRoutes(h.router.Group("/api/v1/auth"))
+	return h
+}
+
+// request asks for a link and returns its token and code
+func (h *magicLinkHarness) request(t *testing.T, body string) (string, string) {
+	w := adminRequest(h.router, http.MethodPost, "/api/v1/auth/magic-link", body, nil)
+	require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+	select {
+	case email := <-h.outbox:
+		link, err := url.Parse(linkPattern.FindString(email))
+		require.NoError(t, err)
+		return link.Query().Get("token"), codePattern.FindStringSubmatch(email)[1]
+	case <-time.After(time.Second):
+		t.Fatal("no email sent")
+		return "", ""
+	}
+}
+
+func TestMagicLinkBrowserLogin(t *testing.T) {
+	h := newMagicLinkHarness(t)
+	token, _ := h.request(t, `{"email": " Alice@Example.com ", "return_to": "/devices"}`)
+
+	w := adminRequest(h.router, http.MethodGet, "/api/v1/auth/magic-link/verify?token="+url.QueryEscape(token), "", nil)
+	require.Equal(t, http.StatusFound, w.Code, w.Body.String())
+	assert.Equal(t, "/devices", w.Header().Get("Location"))
+	require.Len(t, h.users, 1)
+	assert.Equal(t, "u-alice", h.users[0].ID)
+
+	// Links work once
+	w = adminRequest(h.router, http.MethodGet, "/api/v1/auth/magic-link/verify?token="+url.QueryEscape(token), "", nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), "MAGIC_LINK_INVALID")
+
+	// Other tokens from the same issuer are not links
+	pair, err := h.issuer.IssueTokens(map[string]interface{}{"sub": "u-alice", "email": "alice@example.com"}, time.Minute, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, adminRequest(h.router, http.MethodGet, "/api/v1/auth/magic-link/verify?token="+pair.AccessToken, "", nil).Code)
+}
+
+func TestMagicLinkCodeLogin(t *testing.T) {
+	h := newMagicLinkHarness(t)
+	first, _ := h.request(t, `{"email": "alice@example.com"}`)
+	_, code := h.request(t, `{"email": "alice@example.com"}`)
+
+	// A newer request supersedes older links
+	w := adminRequest(h.router, http.MethodPost, "/api/v1/auth/magic-link/verify", `{"token": "`+first+`"}`, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = adminRequest(h.router, http.MethodPost, "/api/v1/auth/magic-link/verify", `{"email": "alice@example.com", "code": "`+code+`"}`, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp interfaces.LoginResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "u-alice", resp.User.ID)
+	claims, err := h.issuer.Verify(resp.AccessToken)
+	require.NoError(t, err)
+	assert.Equal(t, auth.TokenUseAccess, claims["token_use"])
+	assert.Equal(t, "u-alice", claims["sub"])
+
+	// Wrong codes burn the pending login after five attempts
+	_, code = h.request(t, `{"email": "alice@example.com"}`)
+	for i := 0; i < 5; i++ {
+		w = adminRequest(h.router, http.MethodPost, "/api/v1/auth/magic-link/verify", `{"email": "alice@example.com", "code": "abcdef"}`, nil)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	}
+	w = adminRequest(h.router, http.MethodPost, "/api/v1/auth/magic-link/verify", `{"email": "alice@example.com", "code": "`+code+`"}`, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestMagicLinkDoesNotRevealAccounts(t *testing.T) {
+	h := newMagicLinkHarness(t)
+	w := adminRequest(h.router, http.MethodPost, "/api/v1/auth/magic-link", `{"email": "mallory@example.com"}`, nil)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	select {
+	case <-h.outbox:
+		t.Fatal("email sent to an unknown address")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Sends per address are limited, with the same response
+	for i := 0; i < 5; i++ {
+		h.request(t, `{"email": "alice@example.com"}`)
+	}
+	assert.Equal(t, http.StatusAccepted, adminRequest(h.router, http.MethodPost, "/api/v1/auth/magic-link", `{"email": "alice@example.com"}`, nil).Code)
+	select {
+	case <-h.outbox:
+		t.Fatal("send limit not applied")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	assert.Equal(t, http.StatusBadRequest, adminRequest(h.router, http.MethodPost, "/api/v1/auth/magic-link", `{"email": "Alice <alice@example.com>"}`, nil).Code)
+}
@@ -0,0 +1,194 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/pkg/device"
+	"github.com/lsendel/impl-zamaz/pkg/mdm"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+	"github.com/lsendel/impl-zamaz/pkg/trust"
+)
+
+// newMDMServer serves an OAuth token endpoint and the given JSON documents
+// by path, to requests bearing the token. "{{base}}" in documents is the
+// server's URL.
+func newMDMServer(t *testing.T, documents map[string]interface{}) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			require.NoError(t, r.ParseForm())
+			assert.Equal(t, "client_credentials", r.PostForm.Get("grant_type"))
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "mdm-token", "expires_in": 3600})
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer mdm-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		document, ok := documents[r.URL.RequestURI()]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		body, err := json.Marshal(document)
+		require.NoError(t, err)
+		_, _ = w.Write(bytes.ReplaceAll(body, []byte("{{base}}"), []byte(server.URL)))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestIntuneConnectorFollowsPages(t *testing.T) {
+	server := newMDMServer(t, map[string]interface{}{
+		"/v1.0/deviceManagement/managedDevices?$select=id,deviceName,complianceState,lastSyncDateTime": map[string]interface{}{
+			"value": []map[string]interface{}{
+				{"id": "m-1", "deviceName": "LAPTOP-1", "complianceState": "compliant", "lastSyncDateTime": "2026-06-01T10:00:00Z"},
+				{"id": "m-2", "deviceName": "LAPTOP-2", "complianceState": "noncompliant", "lastSyncDateTime": "2026-06-01T10:00:00Z"},
+			},
+			"@odata.nextLink": "{{base}}/v1.0/page2",
+		},
+		"/v1.0/page2": map[string]interface{}{
+			"value": []map[string]interface{}{
+				{"id": "m-3", "deviceName": "PHONE-1", "complianceState": "inGracePeriod", "lastSyncDateTime": "2026-06-01T10:00:00Z"},
+			},
+		},
+	})
+
+	intune, err := mdm.NewIntune(mdm.IntuneConfig{
+		TenantID: "tenant", ClientID: "client", ClientSecret: "secret",
+		TokenURL: server.URL + "/token", GraphURL: server.URL + "/v1.0",
+	})
+	require.NoError(t, err)
+	records, err := intune.Devices(context.Background())
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	assert.True(t, records[0].Compliant)
+	assert.False(t, records[1].Compliant)
+	assert.True(t, records[2].Compliant, "devices in their grace period are compliant")
+	assert.Equal(t, "inGracePeriod", records[2].State)
+}
+
+func TestJamfConnectorUsesComplianceGroup(t *testing.T) {
+	server := newMDMServer(t, map[string]interface{}{
+		"/api/v1/computers-inventory?section=GENERAL&page=0&page-size=200": map[string]interface{}{
+			"totalCount": 3,
+			"results": []map[string]interface{}{
+				{"id": "1", "general": map[string]interface{}{"name": "mac-1", "remoteManagement": map[string]bool{"managed": true}}},
+				{"id": "2", "general": map[string]interface{}{"name": "mac-2", "remoteManagement": map[string]bool{"managed": true}}},
+				{"id": "3", "general": map[string]interface{}{"name": "mac-3", "remoteManagement": map[string]bool{"managed": false}}},
+			},
+		},
+		"/JSSResource/computergroups/id/7": map[string]interface{}{
+			"computer_group": map[string]interface{}{"computers": []map[string]int{{"id": 1}, {"id": 3}}},
+		},
+	})
+	jamf, err := mdm.NewJamf(mdm.JamfConfig{URL: server.URL + "/", ClientID: "client", ClientSecret: "secret", ComplianceGroupID: 7})
+	require.NoError(t, err)
+	records, err := jamf.Devices(context.Background())
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	assert.True(t, records[0].Compliant)
+	assert.False(t, records[1].Compliant)
+	assert.Equal(t, "not_in_compliance_group", records[1].State)
+	assert.False(t, records[2].Compliant, "unmanaged computers are never compliant")
+}
+
+// staticConnector reports fixed records
+type staticConnector struct {
+	name    string
+	records []mdm.Record
+}
+
+func (s *staticConnector) Name() string { return s.name }
+
+func (s *staticConnector) Devices(context.Context) ([]mdm.Record, error) { return s.records, nil }
+
+func TestMDMSyncRecordsCompliance(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	registry := device.NewRegistry(device.Config{}, s)
+	laptop, err := registry.Register(ctx, "alice", device.Registration{Platform: "windows", Fingerprint: "fp-laptop"})
+	require.NoError(t, err)
+	intune := &staticConnector{name: "intune", records: []mdm.Record{{ID: "m-1", Compliant: false, State: "noncompliant"}}}
+	metrics := &countingMetrics{}
+	sync := mdm.NewService(mdm.Config{}, []mdm.Connector{intune}, registry, s, &testLogger{}, metrics)
+
+	r := setupTestRouter()
+	admin := r.Group("/admin")
+	sync.RegisterRoutes(admin)
+
+	w := adminRequest(r, http.MethodPut, "/admin/mdm/links/jamf/m-1", `{"device_id": "`+laptop.ID+`"}`, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = adminRequest(r, http.MethodPut, "/admin/mdm/links/intune/m-1", `{"device_id": "missing"}`, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = adminRequest(r, http.MethodPut, "/admin/mdm/links/intune/m-1", `{"device_id": "`+laptop.ID+`"}`, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	laptop, err = registry.Get(ctx, "alice", laptop.ID)
+	require.NoError(t, err)
+	assert.Equal(t, device.ComplianceUnknown, laptop.Compliance)
+
+	w = adminRequest(r, http.MethodPost, "/admin/mdm/sync", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"linked":1`)
+	assert.Equal(t, 1, metrics.count("mdm_syncs_total,connector=intune"))
+	laptop, err = registry.Get(ctx, "alice", laptop.ID)
+	require.NoError(t, err)
+	assert.Equal(t, device.ComplianceNoncompliant, laptop.Compliance)
+	assert.Equal(t, "intune", laptop.ComplianceSource)
+	assert.NotNil(t, laptop.ComplianceCheckedAt)
+
+	// Non-compliant devices lose device trust
+	result, err := trust.DeviceFactor().Evaluate(ctx, trust.Input{Subject: "alice", Device: laptop.ID, Context: map[string]string{
+		"device_verified": "true", trust.ContextDeviceCompliance: laptop.Compliance,
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, 0.2, result.Score)
+
+	intune.records[0].Compliant = true
+	_, err = sync.Sync(ctx, "intune")
+	require.NoError(t, err)
+	laptop, err = registry.Get(ctx, "alice", laptop.ID)
+	require.NoError(t, err)
+	assert.Equal(t, device.ComplianceCompliant, laptop.Compliance)
+
+	// Devices the MDM stops reporting become unknown
+	intune.records = nil
+	_, err = sync.Sync(ctx, "intune")
+	require.NoError(t, err)
+	laptop, err = registry.Get(ctx, "alice", laptop.ID)
+	require.NoError(t, err)
+	assert.Equal(t, device.ComplianceUnknown, laptop.Compliance)
+
+	w = adminRequest(r, http.MethodGet, "/admin/mdm/links", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var listed struct {
+		Links []mdm.Link `json:"links"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &listed))
+	require.Len(t, listed.Links, 1)
+	assert.Equal(t, laptop.ID, listed.Links[0].DeviceID)
+
+	w = adminRequest(r, http.MethodDelete, "/admin/mdm/links/intune/m-1", "", nil)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	laptop, err = registry.Get(ctx, "alice", laptop.ID)
+	require.NoError(t, err)
+	assert.Empty(t, laptop.Compliance)
+
+	// Links to deleted devices are dropped
+	_, err = sync.Link(ctx, "intune", "m-1", laptop.ID)
+	require.NoError(t, err)
+	require.NoError(t, registry.Delete(ctx, "alice", laptop.ID))
+	_, err = sync.Sync(ctx, "intune")
+	require.NoError(t, err)
+	links, err := sync.Links(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, links)
+}
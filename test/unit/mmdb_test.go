@@ -0,0 +1,284 @@
+package unit
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/pkg/trust"
+)
+
+// mmdbNetwork is one network of a generated MaxMind database
+type mmdbNetwork struct {
+	cidr   string
+	record map[string]interface{}
+}
+
+// writeTestMMDB writes a MaxMind DB with ipVersion 4 or 6 and recordSize
+// 24, 28 or 32 bits, the way MaxMind's writer lays it out
+func writeTestMMDB(t *testing.T, ipVersion, recordSize int, networks []mmdbNetwork) string {
+	type node struct{ child [2]int }
+	const empty, dataRef = -1, -2
+	nodes := []node{{child: [2]int{empty, empty}}}
+	refs := map[[2]int]int{}
+
+	var data []byte
+	for i, n := range networks {
+		_, network, err := net.ParseCIDR(n.cidr)
+		require.NoError(t, err)
+		ones, _ := network.Mask.Size()
+		ip := network.IP
+		if ip4 := ip.To4(); ip4 != nil && ipVersion == 6 {
+			// IPv4 lives under ::/96 in IPv6 databases
+			ip = append(make(net.IP, 12), ip4...)
+			ones += 96
+		}
+		cur := 0
+		for bit := 0; bit < ones; bit++ {
+			b := int(ip[bit/8]>>(7-uint(bit%8))) & 1
+			if bit == ones-1 {
+				nodes[cur].child[b] = dataRef
+				refs[[2]int{cur, b}] = len(data)
+				break
+			}
+			if nodes[cur].child[b] == empty {
+				nodes = append(nodes, node{child: [2]int{empty, empty}})
+				nodes[cur].child[b] = len(nodes) - 1
+			}
+			cur = nodes[cur].child[b]
+		}
+		// The second record points back at the first to exercise pointers
+		if i == 1 {
+			record := map[string]interface{}{}
+			for k, v := range n.record {
+				record[k] = v
+			}
+			record["registered_country"] = mmdbPointer(0)
+			n.record = record
+		}
+		data = append(data, encodeMMDB(n.record)...)
+	}
+
+	count := len(nodes)
+	var tree []byte
+	for i, nd := range nodes {
+		var records [2]uint32
+		for b, child := range nd.child {
+			switch child {
+			case empty:
+				records[b] = uint32(count)
+			case dataRef:
+				records[b] = uint32(count + 16 + refs[[2]int{i, b}])
+			default:
+				records[b] = uint32(child)
+			}
+		}
+		switch recordSize {
+		case 24:
+			tree = append(tree, byte(records[0]>>16), byte(records[0]>>8), byte(records[0]),
+				byte(records[1]>>16), byte(records[1]>>8), byte(records[1]))
+		case 28:
+			tree = append(tree, byte(records[0]>>16), byte(records[0]>>8), byte(records[0]),
+				byte(records[0]>>20&0xF0|records[1]>>24&0x0F),
+				byte(records[1]>>16), byte(records[1]>>8), byte(records[1]))
+		default:
+			tree = binary.BigEndian.AppendUint32(tree, records[0])
+			tree = binary.BigEndian.AppendUint32(tree, records[1])
+		}
+	}
+
+	file := append(tree, make([]byte, 16)...)
+	file = append(file, data...)
+	file = append(file, "\xAB\xCD\xEFMaxMind.com"...)
+	file = append(file, encodeMMDB(map[string]interface{}{
+		"node_count":                  uint32(count),
+		"record_size":                 uint16(recordSize),
+		"ip_version":                  uint16(ipVersion),
+		"database_type":               "Test-City",
+		"binary_format_major_version": uint16(2),
+		"languages":                   []interface{}{"en"},
+	})...)
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	require.NoError(t, os.WriteFile(path, file, 0o600))
+	return path
+}
+
+// mmdbPointer encodes a pointer to a data section offset below 2048
+type mmdbPointer int
+
+func encodeMMDB(v interface{}) []byte {
+	control := func(typ, size int) []byte {
+		var b []byte
+		first := byte(typ << 5)
+		if typ > 7 {
+			first = 0
+		}
+		switch {
+		case size < 29:
+			b = []byte{first | byte(size)}
+		default:
+			b = []byte{first | 29, byte(size - 29)}
+		}
+		if typ > 7 {
+			b = append(b[:1], append([]byte{byte(typ - 7)}, b[1:]...)...)
+		}
+		return b
+	}
+	switch v := v.(type) {
+	case mmdbPointer:
+		return []byte{1<<5 | byte(v>>8), byte(v)}
+	case string:
+		return append(control(2, len(v)), v...)
+	case float64:
+		return binary.BigEndian.AppendUint64(control(3, 8), math.Float64bits(v))
+	case uint16:
+		return append(control(5, 2), byte(v>>8), byte(v))
+	case uint32:
+		return binary.BigEndian.AppendUint32(control(6, 4), v)
+	case bool:
+		b := 0
+		if v {
+			b = 1
+		}
+		return control(14, b)
+	case []interface{}:
+		out := control(11, len(v))
+		for _, item := range v {
+			out = append(out, encodeMMDB(item)...)
+		}
+		return out
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		out := control(7, len(v))
+		for _, k := range keys {
+			out = append(out, encodeMMDB(k)...)
+			out = append(out, encodeMMDB(v[k])...)
+		}
+		return out
+	}
+	panic("unsupported MaxMind test value")
+}
+
+func mmdbCity(country, city string, lat, lon float64) map[string]interface{} {
+	return map[string]interface{}{
+		"country":      map[string]interface{}{"iso_code": country},
+		"city":         map[string]interface{}{"names": map[string]interface{}{"en": city}},
+		"location":     map[string]interface{}{"latitude": lat, "longitude": lon},
+		"subdivisions": []interface{}{map[string]interface{}{"iso_code": "X"}},
+		"is_anycast":   false,
+	}
+}
+
+func TestMMDBLocatorLooksUpCityAndASN(t *testing.T) {
+	for _, recordSize := range []int{24, 28, 32} {
+		city := writeTestMMDB(t, 6, recordSize, []mmdbNetwork{
+			{cidr: "81.2.69.0/24", record: mmdbCity("GB", "London", 51.5142, -0.0931)},
+			{cidr: "2001:db8::/32", record: mmdbCity("US", "Boston", 42.36, -71.06)},
+		})
+		asn := writeTestMMDB(t, 4, recordSize, []mmdbNetwork{
+			{cidr: "81.2.69.0/24", record: map[string]interface{}{
+				"autonomous_system_number":       uint32(20712),
+				"autonomous_system_organization": "Andrews & Arnold Ltd",
+			}},
+		})
+		geo, err := trust.OpenMMDB(city, asn)
+		require.NoError(t, err, recordSize)
+
+		location, ok := geo.Locate(net.ParseIP("81.2.69.142"))
+		require.True(t, ok, recordSize)
+		assert.Equal(t, trust.Location{
+			Country: "GB", City: "London", Latitude: 51.5142, Longitude: -0.0931,
+			ASN: 20712, Organization: "Andrews & Arnold Ltd",
+		}, *location)
+
+		location, ok = geo.Locate(net.ParseIP("2001:db8::1"))
+		require.True(t, ok, recordSize)
+		assert.Equal(t, "Boston", location.City)
+		assert.Zero(t, location.ASN)
+
+		_, ok = geo.Locate(net.ParseIP("192.0.2.1"))
+		assert.False(t, ok)
+		_, ok = geo.Locate(net.ParseIP("2001:db9::1"))
+		assert.False(t, ok)
+	}
+}
+
+func TestMMDBRejectsCorruptFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bad.mmdb")
+	require.NoError(t, os.WriteFile(path, []byte("not a database"), 0o600))
+	_, err := trust.OpenMMDB(path, "")
+	assert.Error(t, err)
+	_, err = trust.OpenMMDB(filepath.Join(t.TempDir(), "missing.mmdb"), "")
+	assert.Error(t, err)
+}
+
+// countingLocator counts lookups reaching geo
+type countingLocator struct {
+	geo     trust.GeoLocator
+	lookups int
+}
+
+func (l *countingLocator) Locate(ip net.IP) (*trust.Location, bool) {
+	l.lookups++
+	return l.geo.Locate(ip)
+}
+
+func TestCachedLocatorEvictsLeastRecentlyUsed(t *testing.T) {
+	counting := &countingLocator{geo: newTestGeoIP(t)}
+	geo := trust.NewCachedLocator(counting, 2)
+
+	london, _ := geo.Locate(net.ParseIP("203.0.113.9"))
+	london.City = "changed"
+	location, ok := geo.Locate(net.ParseIP("203.0.113.9"))
+	require.True(t, ok)
+	assert.Equal(t, "London", location.City)
+	_, ok = geo.Locate(net.ParseIP("10.0.0.1"))
+	assert.False(t, ok)
+	_, ok = geo.Locate(net.ParseIP("10.0.0.1"))
+	assert.False(t, ok)
+	assert.Equal(t, 2, counting.lookups)
+
+	geo.Locate(net.ParseIP("198.51.100.7"))
+	geo.Locate(net.ParseIP("203.0.113.9"))
+	assert.Equal(t, 4, counting.lookups)
+}
+
+func TestLocationFactorPolicy(t *testing.T) {
+	asns, err := trust.ParseASNs("AS64500, 64501")
+	require.NoError(t, err)
+	assert.Equal(t, []uint32{64500, 64501}, asns)
+	_, err = trust.ParseASNs("ASX")
+	assert.Error(t, err)
+
+	geo, err := trust.NewCIDRLocator([]trust.GeoIPRange{
+		{CIDR: "198.51.100.0/24", Location: trust.Location{Country: "US", ASN: 64500}},
+		{CIDR: "203.0.113.0/24", Location: trust.Location{Country: "GB", ASN: 64999}},
+		{CIDR: "192.0.2.0/24", Location: trust.Location{Country: "US", ASN: 64999}},
+	})
+	require.NoError(t, err)
+	factor := trust.LocationFactor(geo, trust.LocationPolicy{AllowedCountries: trust.ParseCountries("us, ca"), AllowedASNs: asns})
+	score := func(ip string) trust.FactorResult {
+		result, err := factor.Evaluate(context.Background(), trust.Input{Context: map[string]string{"ip": ip}})
+		require.NoError(t, err)
+		return result
+	}
+
+	assert.Equal(t, 1.0, score("198.51.100.7").Score)
+	assert.Equal(t, "64500", score("198.51.100.7").Evidence["asn"])
+	assert.Equal(t, 0.0, score("203.0.113.9").Score)
+	assert.Equal(t, 0.3, score("192.0.2.1").Score)
+	assert.Equal(t, 1.0, score("10.0.0.1").Score)
+	assert.Equal(t, 0.5, score("233.252.0.1").Score)
+}
@@ -0,0 +1,75 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/pkg/admin"
+	"github.com/lsendel/impl-zamaz/pkg/middleware"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+func TestNetworkACLAllowsAndDeniesPerRoute(t *testing.T) {
+	ctx := context.Background()
+	m := admin.NewManager(store.NewMemoryStore(), testLogger{}, nil, admin.NetworkRuleKind())
+	put := func(name, spec string) error {
+		_, _, err := m.Put(ctx, "network-rule", name, json.RawMessage(spec), admin.Preconditions{})
+		return err
+	}
+	require.NoError(t, put("vpn", `{"action":"allow","cidrs":["10.8.0.0/16"],"routes":["/admin"]}`))
+	require.NoError(t, put("abuse", `{"action":"deny","cidrs":["203.0.113.7","198.51.100.0/24"]}`))
+	require.NoError(t, put("contractor", `{"action":"deny","cidrs":["10.8.9.0/24"],"routes":["/admin/keys"]}`))
+	assert.Error(t, put("bad", `{"action":"deny","cidrs":["10.0.0.0/33"]}`))
+	assert.Error(t, put("bad", `{"action":"block","cidrs":["10.0.0.1"]}`))
+
+	acl := middleware.NewNetworkACL(middleware.AdminNetworkRules(m), nil, time.Nanosecond, testLogger{}, nil)
+	router := setupTestRouter()
+	router.Use(acl.Middleware())
+	router.GET("/*path", func(c *gin.Context) { c.Status(http.StatusOK) })
+	status := func(path, addr string) int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = addr + ":1234"
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, status("/health", "192.0.2.1"))
+	assert.Equal(t, http.StatusForbidden, status("/health", "203.0.113.7"))
+	assert.Equal(t, http.StatusForbidden, status("/health", "198.51.100.20"))
+	assert.Equal(t, http.StatusOK, status("/admin/users", "10.8.1.1"))
+	assert.Equal(t, http.StatusForbidden, status("/admin/users", "192.0.2.1"), "outside the allow list")
+	assert.Equal(t, http.StatusOK, status("/adminer", "192.0.2.1"))
+	assert.Equal(t, http.StatusForbidden, status("/admin/keys", "10.8.9.1"), "deny wins over allow")
+
+	// Removing an entry applies without a restart
+	require.NoError(t, m.Delete(ctx, "network-rule", "abuse", admin.Preconditions{}))
+	assert.Equal(t, http.StatusOK, status("/health", "203.0.113.7"))
+}
+
+func TestForwardedClientIPTrustsOnlyConfiguredProxies(t *testing.T) {
+	proxies, err := middleware.ParseNetworks([]string{"10.0.0.0/8", "192.0.2.1"})
+	require.NoError(t, err)
+	clientIP := func(remote, forwarded string) string {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remote + ":443"
+		if forwarded != "" {
+			req.Header.Set("X-Forwarded-For", forwarded)
+		}
+		return middleware.ForwardedClientIP(req, proxies).String()
+	}
+
+	assert.Equal(t, "198.51.100.5", clientIP("198.51.100.5", "203.0.113.7"), "untrusted peers cannot forward")
+	assert.Equal(t, "203.0.113.7", clientIP("10.1.1.1", "203.0.113.7"))
+	assert.Equal(t, "203.0.113.7", clientIP("10.1.1.1", "1.2.3.4, 203.0.113.7, 192.0.2.1"), "spoofed hops left of the client are ignored")
+	assert.Equal(t, "10.2.2.2", clientIP("10.1.1.1", "garbage, 10.2.2.2"))
+	assert.Equal(t, "10.1.1.1", clientIP("10.1.1.1", ""))
+}
@@ -0,0 +1,54 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/pkg/oauthclient"
+)
+
+func TestClientCredentialsCachesShortLivedTokens(t *testing.T) {
+	var issued, revoked atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			require.NoError(t, r.ParseForm())
+			assert.Equal(t, "client_credentials", r.PostForm.Get("grant_type"))
+			issued.Add(1)
+			// Shorter than the usual refresh margin
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "short-lived", "expires_in": 30})
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer short-lived" || revoked.CompareAndSwap(1, 0) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(`{"ok": true}`))
+	}))
+	t.Cleanup(server.Close)
+	cc := oauthclient.NewClientCredentials(server.URL+"/token", url.Values{"grant_type": {"client_credentials"}}, server.Client())
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		var out struct {
+			OK bool `json:"ok"`
+		}
+		require.NoError(t, cc.GetJSON(ctx, server.URL+"/resource", &out))
+		assert.True(t, out.OK)
+	}
+	assert.Equal(t, int32(1), issued.Load())
+
+	// A token revoked early is replaced on the next call
+	revoked.Store(1)
+	var out map[string]interface{}
+	assert.Error(t, cc.GetJSON(ctx, server.URL+"/resource", &out))
+	require.NoError(t, cc.GetJSON(ctx, server.URL+"/resource", &out))
+	assert.Equal(t, int32(2), issued.Load())
+}
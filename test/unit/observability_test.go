@@ -0,0 +1,115 @@
+package unit
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+
+	"github.com/lsendel/impl-zamaz/pkg/health"
+	"github.com/lsendel/impl-zamaz/pkg/observability"
+)
+
+func findRule(file observability.RuleFile, name string) []observability.Rule {
+	var rules []observability.Rule
+	for _, g := range file.Groups {
+		for _, r := range g.Rules {
+			if r.Alert == name || r.Record == name {
+				rules = append(rules, r)
+			}
+		}
+	}
+	return rules
+}
+
+func TestObservabilityRulesUseThresholds(t *testing.T) {
+	file := observability.Rules(observability.Thresholds{
+		Job:                "zamaz-prod",
+		AvailabilityTarget: 0.99,
+		AuthFailureRate:    2.5,
+		HealthInterval:     time.Minute,
+	}, map[string]health.DependencyStatus{
+		"redis": {Critical: true},
+		"mail":  {Critical: false},
+	})
+
+	spike := findRule(file, "ZamazAuthFailureSpike")
+	require.Len(t, spike, 1)
+	assert.Equal(t, "zamaz:auth_failures:rate5m > 2.5", spike[0].Expr)
+
+	fast := findRule(file, "ZamazErrorBudgetFastBurn")
+	require.Len(t, fast, 1)
+	assert.Contains(t, fast[0].Expr, "zamaz:http_errors:ratio_rate1h > 0.144")
+	assert.Equal(t, "critical", fast[0].Labels["severity"])
+
+	ratio := findRule(file, "zamaz:http_errors:ratio_rate5m")
+	require.Len(t, ratio, 1)
+	assert.Contains(t, ratio[0].Expr, `job="zamaz-prod"`)
+
+	down := findRule(file, "ZamazDependencyDown")
+	require.Len(t, down, 2)
+	assert.Equal(t, "mail", down[0].Labels["dependency"])
+	assert.Equal(t, "warning", down[0].Labels["severity"])
+	assert.Equal(t, "critical", down[1].Labels["severity"])
+	assert.Equal(t, "2m", down[1].For)
+
+	flap := findRule(file, "ZamazHealthFlapping")
+	require.Len(t, flap, 1)
+	assert.Contains(t, flap[0].Expr, "[15m])) > 4")
+
+	readOnly := findRule(file, "ZamazReadOnlyMode")
+	require.Len(t, readOnly, 1)
+	assert.Equal(t, `max(store_degraded{job="zamaz-prod"}) > 0`, readOnly[0].Expr)
+}
+
+// TestObservabilityRulesReferenceEmittedMetrics guards against rules that
+// drift from the metric names the code actually records
+func TestObservabilityRulesReferenceEmittedMetrics(t *testing.T) {
+	var source strings.Builder
+	require.NoError(t, filepath.Walk("../../pkg", func(path string, info os.FileInfo, err error) error {
+		if err == nil && strings.HasSuffix(path, ".go") && !strings.Contains(path, "observability") {
+			data, err := os.ReadFile(path)
+			source.Write(data)
+			return err
+		}
+		return err
+	}))
+
+	metric := regexp.MustCompile(`\b([a-z_]+_(total|up|seconds))\b`)
+	for _, g := range observability.Rules(observability.Thresholds{}, nil).Groups {
+		for _, r := range g.Rules {
+			for _, m := range metric.FindAllStringSubmatch(r.Expr, -1) {
+				assert.Contains(t, source.String(), `"`+m[1]+`"`, "rule %s%s", r.Alert, r.Record)
+			}
+		}
+	}
+}
+
+func TestObservabilityRulesHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	checker := health.NewChecker(&testLogger{}, nil)
+	require.NoError(t, checker.Register(health.Dependency{Name: "redis", Check: health.CheckFunc(nil), Critical: true}))
+	r := gin.New()
+	r.GET("/observability/rules", observability.RulesHandler(observability.Thresholds{}, checker))
+
+	w := adminRequest(r, http.MethodGet, "/observability/rules", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/yaml", w.Header().Get("Content-Type"))
+	var file observability.RuleFile
+	require.NoError(t, yaml.Unmarshal(w.Body.Bytes(), &file))
+	require.Len(t, file.Groups, 2)
+	down := findRule(file, "ZamazDependencyDown")
+	require.Len(t, down, 1)
+	assert.Equal(t, "redis", down[0].Labels["dependency"])
+
+	w = adminRequest(r, http.MethodGet, "/observability/rules?format=json", "", nil)
+	assert.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+}
@@ -0,0 +1,408 @@
+package unit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/lsendel/impl-zamaz/pkg/auth"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/oidc"
+	"github.com/lsendel/impl-zamaz/pkg/security"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+	"github.com/lsendel/impl-zamaz/pkg/trust"
+)
+
+const (
+	oidcIssuer      = "https://idp.example.test"
+	oidcRedirectURI = "https://app.example.test/callback"
+	oidcVerifier    = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+)
+
+type oidcFixture struct {
+	router *gin.Engine
+	issuer *auth.Issuer
+}
+
+func newOIDCFixture(t *testing.T) *oidcFixture {
+	return buildOIDCFixture(t, oidc.Config{})
+}
+
+func newOIDCFixtureWithSessions(t *testing.T) *oidcFixture {
+	return buildOIDCFixture(t, oidc.Config{Sessions: newTestSessions(t, store.NewMemoryStore())})
+}
+
+// buildOIDCFixture creates a provider with the test clients and cfg's other
+// settings, guarding its login form with loginGuards
+func buildOIDCFixture(t *testing.T, cfg oidc.Config, loginGuards ...gin.HandlerFunc) *oidcFixture {
+	gin.SetMode(gin.TestMode)
+	key, err := auth.GenerateKey()
+	require.NoError(t, err)
+	hash, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	issuer := auth.NewIssuer(oidcIssuer, key)
+	users := oidc.NewStaticUsers([]oidc.StaticUser{{
+		UserInfo: interfaces.UserInfo{
+			ID:         "u-42",
+			Username:   "alice",
+			Email:      "alice@example.com",
+			Roles:      []string{"user"},
+			TenantID:   "acme",
+			Attributes: map[string]string{"department": "finance"},
+		},
+		PasswordHash: string(hash),
+	}})
+	cfg.Clients = []oidc.Client{
+		{ID: "wiki", Name: "Team Wiki", RedirectURIs: []string{oidcRedirectURI}},
+		{ID: "billing", Secret: "billing-secret", RedirectURIs: []string{oidcRedirectURI}},
+	}
+	provider := oidc.NewProvider(cfg, issuer, store.NewMemoryStore(), users, &testLogger{})
+
+	r := gin.New()
+	provider.RegisterRoutes(r, loginGuards...)
+	return &oidcFixture{router: r, issuer: issuer}
+}
+
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func authorizeParams(clientID string) url.Values {
+	return url.Values{
+		"client_id":             {clientID},
+		"redirect_uri":          {oidcRedirectURI},
+		"response_type":         {"code"},
+		"scope":                 {"openid profile email"},
+		"state":                 {"xyz"},
+		"nonce":                 {"n-0S6_WzA2Mj"},
+		"code_challenge":        {pkceChallenge(oidcVerifier)},
+		"code_challenge_method": {"S256"},
+	}
+}
+
+func (f *oidcFixture) do(method, target string, form url.Values, mutate func(*http.Request)) *httptest.ResponseRecorder {
+	var req *http.Request
+	if form != nil {
+		req = httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		req = httptest.NewRequest(method, target, nil)
+	}
+	if mutate != nil {
+		mutate(req)
+	}
+	w := httptest.NewRecorder()
+	f.router.ServeHTTP(w, req)
+	return w
+}
+
+// login posts credentials to the authorization endpoint and returns the code
+func (f *oidcFixture) login(t *testing.T, clientID string) string {
+	form := authorizeParams(clientID)
+	form.Set("username", "alice")
+	form.Set("password", "correct horse")
+	w := f.do(http.MethodPost, oidc.AuthorizePath, form, nil)
+	require.Equal(t, http.StatusFound, w.Code)
+
+	location, err := url.Parse(w.Header().Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, "app.example.test", location.Host)
+	assert.Equal(t, "xyz", location.Query().Get("state"))
+	assert.Equal(t, oidcIssuer, location.Query().Get("iss"))
+	require.NotEmpty(t, location.Query().Get("code"))
+	return location.Query().Get("code")
+}
+
+func (f *oidcFixture) exchange(code, clientID, verifier string) *httptest.ResponseRecorder {
+	return f.do(http.MethodPost, oidc.TokenPath, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {oidcRedirectURI},
+		"client_id":     {clientID},
+		"code_verifier": {verifier},
+	}, nil)
+}
+
+func TestOIDCDiscovery(t *testing.T) {
+	f := newOIDCFixture(t)
+
+	w := f.do(http.MethodGet, oidc.DiscoveryPath, nil, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var doc map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &doc))
+	assert.Equal(t, oidcIssuer, doc["issuer"])
+	assert.Equal(t, oidcIssuer+oidc.TokenPath, doc["token_endpoint"])
+	assert.Equal(t, oidcIssuer+oidc.JWKSPath, doc["jwks_uri"])
+	assert.Equal(t, []interface{}{"S256"}, doc["code_challenge_methods_supported"])
+
+	w = f.do(http.MethodGet, oidc.JWKSPath, nil, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var jwks auth.JSONWebKeySet
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &jwks))
+	require.Len(t, jwks.Keys, 1)
+	assert.Equal(t, f.issuer.KeyID(), jwks.Keys[0].KeyID)
+	assert.Equal(t, "AQAB", jwks.Keys[0].E)
+}
+
+func TestOIDCAuthorizationCodeFlow(t *testing.T) {
+	f := newOIDCFixture(t)
+
+	w := f.do(http.MethodGet, oidc.AuthorizePath+"?"+authorizeParams("wiki").Encode(), nil, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Sign in to Team Wiki")
+	assert.Contains(t, w.Body.String(), `name="code_challenge"`)
+
+	code := f.login(t, "wiki")
+	w = f.exchange(code, "wiki", oidcVerifier)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+
+	var tokens map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &tokens))
+	assert.Equal(t, "Bearer", tokens["token_type"])
+
+	idClaims, err := f.issuer.Verify(tokens["id_token"].(string))
+	require.NoError(t, err)
+	assert.Equal(t, "u-42", idClaims["sub"])
+	assert.Equal(t, "wiki", idClaims["aud"])
+	assert.Equal(t, "n-0S6_WzA2Mj", idClaims["nonce"])
+	assert.Equal(t, "alice@example.com", idClaims["email"])
+
+	w = f.do(http.MethodGet, oidc.UserInfoPath, nil, func(r *http.Request) {
+		r.Header.Set("Authorization", "Bearer "+tokens["access_token"].(string))
+	})
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"preferred_username":"alice"`)
+
+	// ID tokens are not accepted as access tokens
+	w = f.do(http.MethodGet, oidc.UserInfoPath, nil, func(r *http.Request) {
+		r.Header.Set("Authorization", "Bearer "+tokens["id_token"].(string))
+	})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestOIDCCodeIsSingleUse(t *testing.T) {
+	f := newOIDCFixture(t)
+	code := f.login(t, "wiki")
+
+	require.Equal(t, http.StatusOK, f.exchange(code, "wiki", oidcVerifier).Code)
+	w := f.exchange(code, "wiki", oidcVerifier)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "invalid_grant")
+}
+
+func TestOIDCRejectsWrongVerifier(t *testing.T) {
+	f := newOIDCFixture(t)
+	code := f.login(t, "wiki")
+
+	w := f.exchange(code, "wiki", strings.Repeat("a", 43))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "invalid_grant")
+}
+
+func TestOIDCConfidentialClientAuthentication(t *testing.T) {
+	f := newOIDCFixture(t)
+	code := f.login(t, "billing")
+
+	w := f.exchange(code, "billing", oidcVerifier)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), "invalid_client")
+
+	w = f.do(http.MethodPost, oidc.TokenPath, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {oidcRedirectURI},
+		"code_verifier": {oidcVerifier},
+	}, func(r *http.Request) { r.SetBasicAuth("billing", "billing-secret") })
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+}
+
+func TestOIDCAuthorizeValidation(t *testing.T) {
+	f := newOIDCFixture(t)
+
+	params := authorizeParams("wiki")
+	params.Set("redirect_uri", "https://evil.example.test/callback")
+	w := f.do(http.MethodGet, oidc.AuthorizePath+"?"+params.Encode(), nil, nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Empty(t, w.Header().Get("Location"))
+
+	params = authorizeParams("wiki")
+	params.Set("code_challenge_method", "plain")
+	w = f.do(http.MethodGet, oidc.AuthorizePath+"?"+params.Encode(), nil, nil)
+	require.Equal(t, http.StatusFound, w.Code)
+	assert.Contains(t, w.Header().Get("Location"), "error=invalid_request")
+
+	form := authorizeParams("wiki")
+	form.Set("username", "alice")
+	form.Set("password", "wrong")
+	w = f.do(http.MethodPost, oidc.AuthorizePath, form, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), "Invalid username or password")
+}
+
+func TestOIDCLoginFormLocksOutAccounts(t *testing.T) {
+	lockout := security.NewLockout(security.LockoutConfig{MaxAttempts: 3, LockoutTime: time.Hour}, store.NewMemoryStore(), &testLogger{}, nil)
+	guarded := 0
+	f := buildOIDCFixture(t, oidc.Config{Lockout: lockout}, func(c *gin.Context) { guarded++ })
+	post := func(password string) *httptest.ResponseRecorder {
+		form := authorizeParams("wiki")
+		form.Set("username", "alice")
+		form.Set("password", password)
+		return f.do(http.MethodPost, oidc.AuthorizePath, form, nil)
+	}
+
+	assert.Equal(t, http.StatusOK, f.do(http.MethodGet, oidc.AuthorizePath+"?"+authorizeParams("wiki").Encode(), nil, nil).Code)
+	assert.Equal(t, 0, guarded, "showing the form is not a login")
+
+	assert.Equal(t, http.StatusUnauthorized, post("wrong").Code)
+	assert.Equal(t, http.StatusUnauthorized, post("wrong").Code)
+	w := post("wrong")
+	assert.Equal(t, http.StatusLocked, w.Code)
+	assert.Contains(t, w.Body.String(), "temporarily locked")
+
+	// The right password no longer gets in
+	w = post("correct horse")
+	assert.Equal(t, http.StatusLocked, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	assert.Empty(t, w.Header().Get("Location"))
+	assert.Equal(t, 4, guarded)
+
+	lock, err := lockout.Status(context.Background(), "alice")
+	require.NoError(t, err)
+	require.NotNil(t, lock)
+	assert.Equal(t, int64(3), lock.Failures)
+	_, err = lockout.Unlock(context.Background(), "alice")
+	require.NoError(t, err)
+	f.login(t, "wiki")
+}
+
+func TestOIDCAccessTokensAreNotAPIBearerTokens(t *testing.T) {
+	f := newOIDCFixture(t)
+	w := f.exchange(f.login(t, "wiki"), "wiki", oidcVerifier)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var tokens struct {
+		AccessToken string `json:"access_token"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &tokens))
+
+	_, err := f.issuer.VerifyAccess(tokens.AccessToken)
+	assert.ErrorIs(t, err, auth.ErrTokenAudience)
+
+	// The same issuer signs first-party tokens, and only those open the API
+	revocations := security.NewRevocationStore(store.NewMemoryStore(), time.Hour, &testLogger{}, nil)
+	api := setupTestRouter()
+	api.GET("/api/v1/profile", func(c *gin.Context) {
+		if user := revocations.AuthenticateBearer(c, f.issuer); user != nil {
+			c.JSON(http.StatusOK, user)
+		}
+	})
+	w = adminRequest(api, http.MethodGet, "/api/v1/profile", "", map[string]string{"Authorization": "Bearer " + tokens.AccessToken})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), "AUTH_001")
+
+	pair, err := f.issuer.IssueTokens(auth.UserClaims(interfaces.UserInfo{ID: "u-42", Username: "alice"}), time.Minute, time.Hour)
+	require.NoError(t, err)
+	w = adminRequest(api, http.MethodGet, "/api/v1/profile", "", map[string]string{"Authorization": "Bearer " + pair.AccessToken})
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestIssuerVerify(t *testing.T) {
+	key, err := auth.GenerateKey()
+	require.NoError(t, err)
+	issuer := auth.NewIssuer(oidcIssuer, key)
+
+	token, err := issuer.Sign(map[string]interface{}{"sub": "u-1"}, time.Minute)
+	require.NoError(t, err)
+	claims, err := issuer.Verify(token)
+	require.NoError(t, err)
+	assert.Equal(t, "u-1", claims["sub"])
+
+	tampered := token[:len(token)-2] + "AA"
+	_, err = issuer.Verify(tampered)
+	assert.Error(t, err)
+
+	expired, err := issuer.Sign(map[string]interface{}{"sub": "u-1", "exp": time.Now().Add(-time.Minute).Unix()}, 0)
+	require.NoError(t, err)
+	_, err = issuer.Verify(expired)
+	assert.ErrorIs(t, err, auth.ErrTokenExpired)
+
+	other := auth.NewIssuer("https://other.example.test", key)
+	foreign, err := other.Sign(map[string]interface{}{"sub": "u-1"}, time.Minute)
+	require.NoError(t, err)
+	_, err = issuer.Verify(foreign)
+	assert.ErrorIs(t, err, auth.ErrTokenIssuer)
+}
+
+// tokenClaims runs the code flow for wiki and returns the verified claims
+func (f *oidcFixture) tokenClaims(t *testing.T) (access, id map[string]interface{}) {
+	w := f.exchange(f.login(t, "wiki"), "wiki", oidcVerifier)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var tokens struct {
+		AccessToken string `json:"access_token"`
+		IDToken     string `json:"id_token"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &tokens))
+	access, err := f.issuer.Verify(tokens.AccessToken)
+	require.NoError(t, err)
+	id, err = f.issuer.Verify(tokens.IDToken)
+	require.NoError(t, err)
+	return access, id
+}
+
+func TestOIDCClaimMapping(t *testing.T) {
+	mapping := &oidc.ClaimMapping{
+		Namespace: "https://zamaz.example.com/",
+		Rename:    map[string]string{"roles": "groups"},
+		Remove:    []string{"preferred_username"},
+		Claims: []oidc.ClaimRule{
+			{Name: "tenant", Source: "user.tenant"},
+			{Name: "trust_level", Source: "trust.level", Tokens: []string{oidc.TokenAccess}},
+			{Name: "department", Source: "user.attributes.department", Scopes: []string{"admin"}},
+			{Name: "display", Value: "{{.User.Username}} ({{.User.TenantID}})", Namespaced: boolPtr(false)},
+		},
+	}
+	require.NoError(t, mapping.Compile())
+	f := buildOIDCFixture(t, oidc.Config{ClaimMapping: mapping, Trust: trust.DemoScorer{}})
+
+	access, id := f.tokenClaims(t)
+	assert.Equal(t, []interface{}{"user"}, access["groups"])
+	assert.NotContains(t, access, "roles")
+	assert.NotContains(t, access, "preferred_username")
+	assert.Equal(t, "acme", access["https://zamaz.example.com/tenant"])
+	assert.Equal(t, trust.AccessAdmin, access["https://zamaz.example.com/trust_level"])
+	assert.NotContains(t, access, "https://zamaz.example.com/department", "admin scope was not granted")
+	assert.Equal(t, "alice (acme)", access["display"])
+
+	assert.Equal(t, "acme", id["https://zamaz.example.com/tenant"])
+	assert.NotContains(t, id, "https://zamaz.example.com/trust_level")
+	assert.Equal(t, "u-42", id["sub"])
+}
+
+func TestOIDCClaimMappingRejectsReservedClaims(t *testing.T) {
+	for _, m := range []oidc.ClaimMapping{
+		{Rename: map[string]string{"sub": "user"}},
+		{Remove: []string{"aud"}},
+		{Claims: []oidc.ClaimRule{{Name: "iss", Value: "evil", Namespaced: boolPtr(false)}}},
+		{Claims: []oidc.ClaimRule{{Name: "tenant", Source: "user.password"}}},
+		{Claims: []oidc.ClaimRule{{Name: "tenant", Source: "user.tenant", Value: "x"}}},
+		{Claims: []oidc.ClaimRule{{Name: "bad", Value: "{{.User"}}},
+	} {
+		assert.Error(t, m.Compile())
+	}
+}
+
+func boolPtr(b bool) *bool { return &b }
@@ -0,0 +1,185 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/middleware"
+	"github.com/lsendel/impl-zamaz/pkg/policy"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+	"github.com/lsendel/impl-zamaz/pkg/trust"
+)
+
+// staticTrust rates every caller the same
+type staticTrust int
+
+func (s staticTrust) CurrentTrust(*gin.Context) (*interfaces.TrustScore, error) {
+	return &interfaces.TrustScore{Overall: int(s)}, nil
+}
+
+func newPDPRouter(engine *policy.Engine, cfg policy.PDPConfig, metrics interfaces.MetricsCollector) *gin.Engine {
+	r := setupTestRouter()
+	v1 := r.Group("/api/v1", func(c *gin.Context) {
+		if user := c.GetHeader("X-User"); user != "" {
+			c.Set("user", &interfaces.UserInfo{ID: user, Roles: strings.Split(c.GetHeader("X-Roles"), ",")})
+		}
+	}, engine.Middleware(cfg, testLogger{}, metrics))
+	ok := func(c *gin.Context) {
+		decision, _ := c.Get(policy.DecisionKey)
+		c.JSON(http.StatusOK, decision)
+	}
+	v1.GET("/devices/:id", ok)
+	v1.DELETE("/devices/:id", ok)
+	v1.POST("/admin/keys", ok)
+	v1.GET("/reports", ok)
+	return r
+}
+
+func TestPolicyDecisionPoint(t *testing.T) {
+	ctx := context.Background()
+	engine := policy.NewEngine(policy.Config{}, store.NewMemoryStore())
+	metrics := &countingMetrics{}
+	r := newPDPRouter(engine, policy.PDPConfig{
+		Defaults: []*policy.Policy{
+			{ID: "default-allow", Subjects: []string{"*"}, Resources: []string{"*"}, Actions: []string{"*"}, Effect: policy.EffectAllow},
+			{
+				ID: "default-admin", Subjects: []string{"*"}, Resources: []string{"admin/*"}, Actions: []string{"*"}, Effect: policy.EffectDeny,
+				Conditions: []policy.Condition{{Attribute: policy.AttributeRoles, Operator: policy.OpNotContains, Values: []string{"admin"}}},
+			},
+		},
+		CacheTTL: time.Nanosecond,
+	}, metrics)
+
+	w := adminRequest(r, "GET", "/api/v1/devices/42", "", nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = adminRequest(r, "GET", "/api/v1/devices/42", "", map[string]string{"X-User": "bob", "X-Roles": "user"})
+	require.Equal(t, http.StatusOK, w.Code)
+	var decision policy.Decision
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &decision))
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, []string{"default-allow"}, decision.Policies)
+
+	w = adminRequest(r, "POST", "/api/v1/admin/keys", "", map[string]string{"X-User": "bob", "X-Roles": "user,auditor", "Accept-Language": "es"})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	var denied struct {
+		Error    string   `json:"error"`
+		Code     string   `json:"code"`
+		Policies []string `json:"policies"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &denied))
+	assert.Equal(t, "POLICY_DENIED", denied.Code)
+	assert.Equal(t, "Una política no le permite acceder a este recurso", denied.Error)
+	assert.Equal(t, []string{"default-admin"}, denied.Policies)
+
+	w = adminRequest(r, "POST", "/api/v1/admin/keys", "", map[string]string{"X-User": "alice", "X-Roles": "user,admin"})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Stored policies are decided along with the defaults, by route
+	_, err := engine.Create(ctx, policy.Policy{
+		Name: "Devices are not deleted", Subjects: []string{"*"}, Resources: []string{"devices/*"}, Actions: []string{policy.ActionDelete}, Effect: policy.EffectDeny,
+		Conditions: []policy.Condition{{Attribute: policy.AttributeRoute, Operator: policy.OpEquals, Values: []string{"devices/:id"}}},
+	})
+	require.NoError(t, err)
+	w = adminRequest(r, "DELETE", "/api/v1/devices/42", "", map[string]string{"X-User": "alice", "X-Roles": "admin"})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = adminRequest(r, "GET", "/api/v1/devices/42", "", map[string]string{"X-User": "alice", "X-Roles": "admin"})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	assert.Equal(t, 3, metrics.count("policy_decisions_total,effect=allow"))
+	assert.Equal(t, 2, metrics.count("policy_decisions_total,effect=deny"))
+}
+
+func TestPolicyDecisionObligations(t *testing.T) {
+	ctx := context.Background()
+	engine := policy.NewEngine(policy.Config{}, store.NewMemoryStore())
+	_, err := engine.Create(ctx, policy.Policy{
+		Name: "Trusted callers read devices", Subjects: []string{"*"}, Resources: []string{"devices/*"}, Actions: []string{policy.ActionRead}, Effect: policy.EffectAllow,
+		Conditions:  []policy.Condition{{Attribute: policy.AttributeTrustScore, Operator: policy.OpGreaterThan, Values: []string{"60"}}},
+		Obligations: []string{"step_up"},
+	})
+	require.NoError(t, err)
+	_, err = engine.Create(ctx, policy.Policy{
+		Name: "Reports are watermarked", Subjects: []string{"*"}, Resources: []string{"reports"}, Actions: []string{"*"}, Effect: policy.EffectAllow,
+		Obligations: []string{"watermark"},
+	})
+	require.NoError(t, err)
+
+	var stepped []string
+	newRouter := func(trust int) *gin.Engine {
+		return newPDPRouter(engine, policy.PDPConfig{
+			Trust: staticTrust(trust),
+			Obligations: map[string]policy.Obligation{
+				policy.ObligationStepUp: {
+					Before: func(c *gin.Context, _ []string) bool {
+						stepped = append(stepped, c.Request.URL.Path)
+						middleware.UseTrustSource(staticTrust(trust))(c)
+						return middleware.CheckTrustLevel(c, 80)
+					},
+				},
+			},
+		}, nil)
+	}
+	bob := map[string]string{"X-User": "bob", "X-Roles": "user"}
+
+	// Conditions on the trust score hold for well rated callers, who must
+	// still fulfil the step-up obligation before the route
+	w := adminRequest(newRouter(40), "GET", "/api/v1/devices/42", "", bob)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "POLICY_DENIED")
+	assert.Empty(t, stepped)
+
+	w = adminRequest(newRouter(70), "GET", "/api/v1/devices/42", "", bob)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "INSUFFICIENT_TRUST")
+	assert.Equal(t, []string{"/api/v1/devices/42"}, stepped)
+
+	w = adminRequest(newRouter(90), "GET", "/api/v1/devices/42", "", bob)
+	require.Equal(t, http.StatusOK, w.Code)
+	var decision policy.Decision
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &decision))
+	assert.Equal(t, []string{"step_up"}, decision.Obligations)
+
+	// Obligations nothing fulfils deny the request
+	w = adminRequest(newRouter(90), "GET", "/api/v1/reports", "", bob)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "POLICY_DENIED")
+}
+
+func TestPolicyDecisionContext(t *testing.T) {
+	ctx := context.Background()
+	engine := policy.NewEngine(policy.Config{}, store.NewMemoryStore())
+	for _, window := range [][2]string{{"00:00", "12:00"}, {"12:00", "00:00"}} {
+		_, err := engine.Create(ctx, policy.Policy{
+			Name: "Any time", Subjects: []string{"*"}, Resources: []string{"*"}, Actions: []string{"*"}, Effect: policy.EffectAllow,
+			Conditions: []policy.Condition{{Attribute: policy.AttributeTime, Operator: policy.OpInWindow, Window: &policy.TimeWindow{Start: window[0], End: window[1]}}},
+		})
+		require.NoError(t, err)
+	}
+	_, err := engine.Create(ctx, policy.Policy{
+		Name: "Iberia only", Subjects: []string{"*"}, Resources: []string{"*"}, Actions: []string{"*"}, Effect: policy.EffectDeny,
+		Conditions: []policy.Condition{{Attribute: policy.AttributeCountry, Operator: policy.OpNotIn, Values: []string{"ES", "PT"}}},
+	})
+	require.NoError(t, err)
+	bob := map[string]string{"X-User": "bob", "X-Roles": "user"}
+
+	// httptest requests come from 192.0.2.1
+	for country, status := range map[string]int{"ES": http.StatusOK, "FR": http.StatusForbidden} {
+		geo, err := trust.NewCIDRLocator([]trust.GeoIPRange{{CIDR: "192.0.2.0/24", Location: trust.Location{Country: country}}})
+		require.NoError(t, err)
+		w := adminRequest(newPDPRouter(engine, policy.PDPConfig{Geo: geo}, nil), "GET", "/api/v1/reports", "", bob)
+		assert.Equal(t, status, w.Code, country)
+	}
+	// Callers no locator places are in no country, so not in Iberia
+	w := adminRequest(newPDPRouter(engine, policy.PDPConfig{}, nil), "GET", "/api/v1/reports", "", bob)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
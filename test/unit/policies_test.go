@@ -0,0 +1,343 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/api"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/policy"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+func newPolicyRouter(engine *policy.Engine) *gin.Engine {
+	handlers := api.NewHandlers().WithPolicies(engine)
+	r := setupTestRouter()
+	policies := r.Group("/policies", func(c *gin.Context) {
+		c.Set("user", &interfaces.UserInfo{ID: c.GetHeader("X-User"), Roles: strings.Split(c.GetHeader("X-Roles"), ",")})
+	})
+	policies.GET("", handlers.GetPolicies)
+	policies.POST("", handlers.CreatePolicy)
+	policies.GET("/:id", handlers.GetPolicy)
+	policies.PUT("/:id", handlers.UpdatePolicy)
+	policies.DELETE("/:id", handlers.DeletePolicy)
+	policies.POST("/evaluate", handlers.EvaluatePolicy)
+	policies.GET("/schema", handlers.GetPolicySchema)
+	policies.GET("/export", handlers.ExportPolicies)
+	policies.POST("/import", handlers.ImportPolicies)
+	policies.POST("/lint", handlers.LintPolicies)
+	policies.GET("/resources", handlers.GetPolicyResources)
+	policies.POST("/resources", handlers.CreatePolicyResource)
+	policies.GET("/resources/:id", handlers.GetPolicyResource)
+	policies.PUT("/resources/:id", handlers.UpdatePolicyResource)
+	policies.DELETE("/resources/:id", handlers.DeletePolicyResource)
+	policies.GET("/:id/versions", handlers.GetPolicyVersions)
+	policies.POST("/:id/rollback/:version", handlers.RollbackPolicy)
+	return r
+}
+
+func TestPolicyEvaluation(t *testing.T) {
+	ctx := context.Background()
+	engine := policy.NewEngine(policy.Config{}, store.NewMemoryStore())
+	admins, err := engine.Create(ctx, policy.Policy{
+		Name:      "Admins manage devices",
+		Subjects:  []string{"role:admin"},
+		Resources: []string{"devices/*"},
+		Actions:   []string{"*"},
+		Conditions: []policy.Condition{
+			{Attribute: "trust_score", Operator: policy.OpGreaterThan, Values: []string{"70"}},
+			{Attribute: "ip", Operator: policy.OpCIDR, Values: []string{"10.0.0.0/8"}},
+		},
+		Effect: policy.EffectAllow,
+	})
+	require.NoError(t, err)
+	readers, err := engine.Create(ctx, policy.Policy{
+		Name: "Everyone reads devices", Subjects: []string{"*"}, Resources: []string{"devices/*"}, Actions: []string{"read"}, Effect: policy.EffectAllow,
+	})
+	require.NoError(t, err)
+	blocked, err := engine.Create(ctx, policy.Policy{
+		Name: "Mallory is blocked", Subjects: []string{"user:mallory"}, Resources: []string{"*"}, Actions: []string{"*"}, Effect: policy.EffectDeny,
+	})
+	require.NoError(t, err)
+
+	trusted := map[string]string{"trust_score": "85", "ip": "10.1.2.3"}
+	for name, tc := range map[string]struct {
+		req      policy.Request
+		allowed  bool
+		policies []string
+	}{
+		"admin writes":            {policy.Request{Subject: "alice", Roles: []string{"admin"}, Resource: "devices/42", Action: "write", Context: trusted}, true, []string{admins.ID}},
+		"low trust admin":         {policy.Request{Subject: "alice", Roles: []string{"admin"}, Resource: "devices/42", Action: "write", Context: map[string]string{"trust_score": "40", "ip": "10.1.2.3"}}, false, []string{}},
+		"admin off network":       {policy.Request{Subject: "alice", Roles: []string{"admin"}, Resource: "devices/42", Action: "write", Context: map[string]string{"trust_score": "85", "ip": "203.0.113.7"}}, false, []string{}},
+		"user reads":              {policy.Request{Subject: "bob", Resource: "devices/42", Action: "read"}, true, []string{readers.ID}},
+		"user writes":             {policy.Request{Subject: "bob", Resource: "devices/42", Action: "write"}, false, []string{}},
+		"other resource":          {policy.Request{Subject: "bob", Resource: "policies/1", Action: "read"}, false, []string{}},
+		"denial wins over grants": {policy.Request{Subject: "mallory", Roles: []string{"admin"}, Resource: "devices/42", Action: "read", Context: trusted}, false, []string{blocked.ID}},
+	} {
+		decision, err := engine.Evaluate(ctx, tc.req)
+		require.NoError(t, err, name)
+		assert.Equal(t, tc.allowed, decision.Allowed, name)
+		assert.ElementsMatch(t, tc.policies, decision.Policies, name)
+	}
+
+	_, err = engine.Evaluate(ctx, policy.Request{Subject: "bob", Action: "read"})
+	assert.True(t, errors.Is(err, policy.ErrInvalid))
+}
+
+func TestPolicyValidation(t *testing.T) {
+	valid := func() policy.Policy {
+		return policy.Policy{Name: "p", Subjects: []string{"*"}, Resources: []string{"*"}, Actions: []string{"read"}, Effect: policy.EffectAllow}
+	}
+	p := valid()
+	assert.NoError(t, p.Validate())
+	for name, change := range map[string]func(*policy.Policy){
+		"no name":        func(p *policy.Policy) { p.Name = " " },
+		"effect":         func(p *policy.Policy) { p.Effect = "maybe" },
+		"no subjects":    func(p *policy.Policy) { p.Subjects = nil },
+		"subject format": func(p *policy.Policy) { p.Subjects = []string{"alice"} },
+		"empty action":   func(p *policy.Policy) { p.Actions = []string{""} },
+		"operator": func(p *policy.Policy) {
+			p.Conditions = []policy.Condition{{Attribute: "a", Operator: "like", Values: []string{"x"}}}
+		},
+		"not a number": func(p *policy.Policy) {
+			p.Conditions = []policy.Condition{{Attribute: "a", Operator: policy.OpLessThan, Values: []string{"x"}}}
+		},
+		"not a network": func(p *policy.Policy) {
+			p.Conditions = []policy.Condition{{Attribute: "ip", Operator: policy.OpCIDR, Values: []string{"10.0.0.1"}}}
+		},
+		"missing value": func(p *policy.Policy) { p.Conditions = []policy.Condition{{Attribute: "a", Operator: policy.OpEquals}} },
+		"no attribute": func(p *policy.Policy) {
+			p.Conditions = []policy.Condition{{Operator: policy.OpIn, Values: []string{"x"}}}
+		},
+		"too many values": func(p *policy.Policy) {
+			p.Conditions = []policy.Condition{{Attribute: "a", Operator: policy.OpEquals, Values: []string{"x", "y"}}}
+		},
+	} {
+		p := valid()
+		change(&p)
+		assert.True(t, errors.Is(p.Validate(), policy.ErrInvalid), name)
+	}
+}
+
+func TestPolicyHandlers(t *testing.T) {
+	engine := policy.NewEngine(policy.Config{MaxPolicies: 2}, store.NewMemoryStore())
+	r := newPolicyRouter(engine)
+	admin := map[string]string{"X-User": "alice", "X-Roles": "admin", "Content-Type": "application/json"}
+	body := `{"name": "Admins write", "subjects": ["role:admin"], "resources": ["devices/*"], "actions": ["write"], "effect": "allow"}`
+
+	w := adminRequest(r, http.MethodPost, "/policies", body, admin)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var created policy.Policy
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	assert.NotEmpty(t, created.ID)
+
+	w = adminRequest(r, http.MethodPost, "/policies", `{"name": "Bad", "subjects": ["*"], "resources": ["*"], "actions": ["*"], "effect": "maybe"}`, admin)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "VALIDATION_ERROR")
+
+	// The authenticated user is evaluated by default, with their roles
+	evaluate := `{"resource": "devices/42", "action": "write"}`
+	w = adminRequest(r, http.MethodPost, "/policies/evaluate", evaluate, admin)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var decision policy.Decision
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &decision))
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, []string{created.ID}, decision.Policies)
+	w = adminRequest(r, http.MethodPost, "/policies/evaluate", evaluate, map[string]string{"X-User": "bob"})
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &decision))
+	assert.False(t, decision.Allowed)
+	w = adminRequest(r, http.MethodPost, "/policies/evaluate", `{"subject": "bob", "roles": ["admin"], "resource": "devices/42", "action": "write"}`, admin)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &decision))
+	assert.True(t, decision.Allowed)
+	w = adminRequest(r, http.MethodPost, "/policies/evaluate", `{"action": "write"}`, admin)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = adminRequest(r, http.MethodPut, "/policies/"+created.ID, strings.Replace(body, `"allow"`, `"deny"`, 1), admin)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var updated policy.Policy
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &updated))
+	assert.Equal(t, created.ID, updated.ID)
+	assert.Equal(t, policy.EffectDeny, updated.Effect)
+	assert.Equal(t, created.CreatedAt.Unix(), updated.CreatedAt.Unix())
+
+	w = adminRequest(r, http.MethodPost, "/policies", strings.Replace(body, "Admins write", "Second", 1), admin)
+	require.Equal(t, http.StatusCreated, w.Code)
+	w = adminRequest(r, http.MethodPost, "/policies", strings.Replace(body, "Admins write", "Third", 1), admin)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), "POLICY_LIMIT_REACHED")
+
+	w = adminRequest(r, http.MethodGet, "/policies", "", admin)
+	require.Equal(t, http.StatusOK, w.Code)
+	var list api.PolicyListResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	require.Equal(t, 2, list.Total)
+	assert.Equal(t, "Admins write", list.Policies[0].Name)
+
+	w = adminRequest(r, http.MethodDelete, "/policies/"+created.ID, "", admin)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = adminRequest(r, http.MethodGet, "/policies/"+created.ID, "", admin)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = adminRequest(r, http.MethodPut, "/policies/"+created.ID, body, admin)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestPolicyVersions(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	engine := policy.NewEngine(policy.Config{MaxVersions: 3}, s)
+	r := newPolicyRouter(engine)
+	admin := map[string]string{"X-User": "alice", "X-Roles": "admin", "Content-Type": "application/json"}
+	body := `{"name": "Readers", "subjects": ["*"], "resources": ["devices/*"], "actions": ["read"], "effect": "allow"}`
+
+	w := adminRequest(r, http.MethodPost, "/policies", body, admin)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var p policy.Policy
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &p))
+	assert.Equal(t, 1, p.Version)
+	w = adminRequest(r, http.MethodPut, "/policies/"+p.ID, strings.Replace(body, `"allow"`, `"deny"`, 1), admin)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &p))
+	assert.Equal(t, 2, p.Version)
+
+	decision, err := engine.Evaluate(ctx, policy.Request{Subject: "bob", Resource: "devices/42", Action: "read"})
+	require.NoError(t, err)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, map[string]int{p.ID: 2}, decision.Versions)
+
+	// Rolling back makes the earlier version the next one
+	w = adminRequest(r, http.MethodPost, "/policies/"+p.ID+"/rollback/1", "", admin)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &p))
+	assert.Equal(t, 3, p.Version)
+	assert.Equal(t, policy.EffectAllow, p.Effect)
+	decision, err = engine.Evaluate(ctx, policy.Request{Subject: "bob", Resource: "devices/42", Action: "read"})
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, map[string]int{p.ID: 3}, decision.Versions)
+
+	w = adminRequest(r, http.MethodGet, "/policies/"+p.ID+"/versions", "", admin)
+	require.Equal(t, http.StatusOK, w.Code)
+	var versions api.PolicyVersionListResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &versions))
+	require.Equal(t, 3, versions.Total)
+	for i, effect := range []string{policy.EffectAllow, policy.EffectDeny, policy.EffectAllow} {
+		assert.Equal(t, 3-i, versions.Versions[i].Version)
+		assert.Equal(t, effect, versions.Versions[i].Effect)
+	}
+
+	// Only MaxVersions versions are kept
+	w = adminRequest(r, http.MethodPut, "/policies/"+p.ID, body, admin)
+	require.Equal(t, http.StatusOK, w.Code)
+	kept, err := engine.Versions(ctx, p.ID)
+	require.NoError(t, err)
+	require.Len(t, kept, 3)
+	assert.Equal(t, 2, kept[2].Version)
+	w = adminRequest(r, http.MethodPost, "/policies/"+p.ID+"/rollback/1", "", admin)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = adminRequest(r, http.MethodPost, "/policies/"+p.ID+"/rollback/9", "", admin)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = adminRequest(r, http.MethodPost, "/policies/"+p.ID+"/rollback/latest", "", admin)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Versions go with the policy
+	require.NoError(t, engine.Delete(ctx, p.ID))
+	keys, err := s.Keys(ctx, "policy:")
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+	w = adminRequest(r, http.MethodGet, "/policies/"+p.ID+"/versions", "", admin)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestPolicyContextConditions(t *testing.T) {
+	businessHours := &policy.TimeWindow{Days: []string{"Mon", "tue", "wed", "thu", "fri"}, Start: "09:00", End: "17:00", Timezone: "Europe/Madrid"}
+	nights := &policy.TimeWindow{Days: []string{"fri"}, Start: "22:00", End: "06:00"}
+	for name, tc := range map[string]struct {
+		cond       policy.Condition
+		attributes map[string]string
+		holds      bool
+	}{
+		// 2025-06-16 is a Monday; Madrid is UTC+2 in June
+		"in business hours":      {policy.Condition{Attribute: "time", Operator: policy.OpInWindow, Window: businessHours}, map[string]string{"time": "2025-06-16T07:30:00Z"}, true},
+		"before business hours":  {policy.Condition{Attribute: "time", Operator: policy.OpInWindow, Window: businessHours}, map[string]string{"time": "2025-06-16T06:59:00Z"}, false},
+		"end is excluded":        {policy.Condition{Attribute: "time", Operator: policy.OpInWindow, Window: businessHours}, map[string]string{"time": "2025-06-16T17:00:00+02:00"}, false},
+		"weekend":                {policy.Condition{Attribute: "time", Operator: policy.OpInWindow, Window: businessHours}, map[string]string{"time": "2025-06-21T10:00:00+02:00"}, false},
+		"outside window":         {policy.Condition{Attribute: "time", Operator: policy.OpNotInWindow, Window: businessHours}, map[string]string{"time": "2025-06-21T10:00:00+02:00"}, true},
+		"no time":                {policy.Condition{Attribute: "time", Operator: policy.OpInWindow, Window: businessHours}, nil, false},
+		"friday night":           {policy.Condition{Attribute: "time", Operator: policy.OpInWindow, Window: nights}, map[string]string{"time": "2025-06-20T23:00:00Z"}, true},
+		"past midnight":          {policy.Condition{Attribute: "time", Operator: policy.OpInWindow, Window: nights}, map[string]string{"time": "2025-06-21T05:59:00Z"}, true},
+		"saturday night":         {policy.Condition{Attribute: "time", Operator: policy.OpInWindow, Window: nights}, map[string]string{"time": "2025-06-21T23:00:00Z"}, false},
+		"thursday past midnight": {policy.Condition{Attribute: "time", Operator: policy.OpInWindow, Window: nights}, map[string]string{"time": "2025-06-20T01:00:00Z"}, false},
+		"off network":            {policy.Condition{Attribute: "ip", Operator: policy.OpNotCIDR, Values: []string{"10.0.0.0/8"}}, map[string]string{"ip": "203.0.113.7"}, true},
+		"on network":             {policy.Condition{Attribute: "ip", Operator: policy.OpNotCIDR, Values: []string{"10.0.0.0/8"}}, map[string]string{"ip": "10.1.2.3"}, false},
+		"country":                {policy.Condition{Attribute: "country", Operator: policy.OpIn, Values: []string{"ES", "PT"}}, map[string]string{"country": "PT"}, true},
+		"unplaced country":       {policy.Condition{Attribute: "country", Operator: policy.OpNotIn, Values: []string{"KP"}}, nil, true},
+		"compliant device":       {policy.Condition{Attribute: "device_compliance", Operator: policy.OpEquals, Values: []string{"compliant"}}, map[string]string{"device_compliance": "compliant"}, true},
+		"unmanaged device":       {policy.Condition{Attribute: "device_compliance", Operator: policy.OpEquals, Values: []string{"compliant"}}, nil, false},
+		"trust threshold":        {policy.Condition{Attribute: "trust_score", Operator: policy.OpGreaterOrEqual, Values: []string{"70"}}, map[string]string{"trust_score": "70"}, true},
+		"trust ceiling":          {policy.Condition{Attribute: "trust_score", Operator: policy.OpLessOrEqual, Values: []string{"30"}}, map[string]string{"trust_score": "31"}, false},
+	} {
+		assert.Equal(t, tc.holds, tc.cond.Holds(tc.attributes), name)
+	}
+
+	valid := policy.Policy{Name: "p", Subjects: []string{"*"}, Resources: []string{"*"}, Actions: []string{"*"}, Effect: policy.EffectAllow}
+	p := valid
+	p.Conditions = []policy.Condition{{Attribute: "time", Operator: policy.OpInWindow, Window: &policy.TimeWindow{Days: []string{" SAT "}, Start: "08:00", End: "12:00"}}}
+	require.NoError(t, p.Validate())
+	assert.Equal(t, []string{"sat"}, p.Conditions[0].Window.Days)
+	for name, cond := range map[string]policy.Condition{
+		"no window":     {Attribute: "time", Operator: policy.OpInWindow},
+		"window values": {Attribute: "time", Operator: policy.OpInWindow, Values: []string{"x"}, Window: &policy.TimeWindow{Start: "08:00", End: "12:00"}},
+		"stray window":  {Attribute: "ip", Operator: policy.OpCIDR, Values: []string{"10.0.0.0/8"}, Window: &policy.TimeWindow{Start: "08:00", End: "12:00"}},
+		"day":           {Attribute: "time", Operator: policy.OpInWindow, Window: &policy.TimeWindow{Days: []string{"someday"}, Start: "08:00", End: "12:00"}},
+		"clock":         {Attribute: "time", Operator: policy.OpInWindow, Window: &policy.TimeWindow{Start: "8am", End: "12:00"}},
+		"empty window":  {Attribute: "time", Operator: policy.OpInWindow, Window: &policy.TimeWindow{Start: "08:00", End: "08:00"}},
+		"time zone":     {Attribute: "time", Operator: policy.OpInWindow, Window: &policy.TimeWindow{Start: "08:00", End: "12:00", Timezone: "Mars/Olympus"}},
+		"not a network": {Attribute: "ip", Operator: policy.OpNotCIDR, Values: []string{"10.0.0.1"}},
+		"not a number":  {Attribute: "trust_score", Operator: policy.OpGreaterOrEqual, Values: []string{"high"}},
+	} {
+		p := valid
+		p.Conditions = []policy.Condition{cond}
+		assert.True(t, errors.Is(p.Validate(), policy.ErrInvalid), name)
+	}
+
+	// Evaluate decides at the current time unless the context gives one
+	ctx := context.Background()
+	engine := policy.NewEngine(policy.Config{}, store.NewMemoryStore())
+	_, err := engine.Create(ctx, policy.Policy{
+		Name: "Business hours", Subjects: []string{"*"}, Resources: []string{"*"}, Actions: []string{"*"}, Effect: policy.EffectAllow,
+		Conditions: []policy.Condition{{Attribute: policy.AttributeTime, Operator: policy.OpInWindow, Window: businessHours}},
+	})
+	require.NoError(t, err)
+	decision, err := engine.Evaluate(ctx, policy.Request{Subject: "bob", Resource: "devices/42", Action: "read", Context: map[string]string{"time": "2025-06-16T10:00:00+02:00"}})
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed)
+	decision, err = engine.Evaluate(ctx, policy.Request{Subject: "bob", Resource: "devices/42", Action: "read"})
+	require.NoError(t, err)
+	assert.Equal(t, businessHours.Contains(time.Now()), decision.Allowed)
+}
+
+func TestPolicySchema(t *testing.T) {
+	r := newPolicyRouter(policy.NewEngine(policy.Config{}, store.NewMemoryStore()))
+	w := adminRequest(r, http.MethodGet, "/policies/schema", "", map[string]string{"X-User": "bob"})
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/schema+json", w.Header().Get("Content-Type"))
+	var schema struct {
+		Required []string                   `json:"required"`
+		Defs     map[string]json.RawMessage `json:"$defs"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &schema))
+	assert.ElementsMatch(t, []string{"name", "subjects", "resources", "actions", "effect"}, schema.Required)
+	// Every operator is described
+	for _, operator := range []string{"equals", "greater_or_equal", "not_cidr", "contains", "in_window", "not_in_window"} {
+		assert.Contains(t, string(schema.Defs["condition"]), `"`+operator+`"`)
+	}
+}
@@ -0,0 +1,159 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+
+	"github.com/lsendel/impl-zamaz/pkg/policy"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+const policyBundleYAML = `policies:
+  - name: Readers
+    subjects: ["*"]
+    resources: [devices/*]
+    actions: [read]
+    effect: allow
+  - name: Business hours
+    subjects: [role:finance]
+    resources: [reports/*]
+    actions: ["*"]
+    effect: allow
+    conditions:
+      - attribute: time
+        operator: in_window
+        window: {days: [mon, tue, wed, thu, fri], start: "09:00", end: "18:00", timezone: Europe/Madrid}
+      - attribute: trust_score
+        operator: greater_or_equal
+        values: [70]
+`
+
+func decodeImport(t *testing.T, body []byte) policy.ImportResult {
+	var result policy.ImportResult
+	require.NoError(t, json.Unmarshal(body, &result), string(body))
+	return result
+}
+
+func TestPolicyBundleImport(t *testing.T) {
+	ctx := context.Background()
+	engine := policy.NewEngine(policy.Config{}, store.NewMemoryStore())
+	r := newPolicyRouter(engine)
+	yamlHeaders := map[string]string{"X-User": "alice", "X-Roles": "admin", "Content-Type": "application/yaml"}
+	stale, err := engine.Create(ctx, policy.Policy{Name: "Stale", Subjects: []string{"*"}, Resources: []string{"*"}, Actions: []string{"*"}, Effect: policy.EffectDeny})
+	require.NoError(t, err)
+
+	// A dry run plans the changes without making them
+	w := adminRequest(r, http.MethodPost, "/policies/import?dry_run=true&prune=true", policyBundleYAML, yamlHeaders)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	result := decodeImport(t, w.Body.Bytes())
+	assert.True(t, result.DryRun)
+	assert.False(t, result.Applied)
+	assert.Equal(t, 2, result.Created)
+	assert.Equal(t, 1, result.Deleted)
+	policies, err := engine.List(ctx)
+	require.NoError(t, err)
+	assert.Len(t, policies, 1)
+
+	w = adminRequest(r, http.MethodPost, "/policies/import?prune=true", policyBundleYAML, yamlHeaders)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	result = decodeImport(t, w.Body.Bytes())
+	assert.True(t, result.Applied)
+	assert.Equal(t, policy.ImportDelete, result.Changes[2].Action)
+	assert.Equal(t, stale.ID, result.Changes[2].ID)
+	policies, err = engine.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, policies, 2)
+	assert.Equal(t, "Business hours", policies[0].Name)
+	assert.Equal(t, "Europe/Madrid", policies[0].Conditions[0].Window.Timezone)
+	assert.Equal(t, []string{"70"}, policies[0].Conditions[1].Values)
+
+	// Importing the export again changes nothing
+	w = adminRequest(r, http.MethodGet, "/policies/export?format=yaml", "", yamlHeaders)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/yaml", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Header().Get("Content-Disposition"), ".yaml")
+	var exported policy.Bundle
+	require.NoError(t, yaml.Unmarshal(w.Body.Bytes(), &exported))
+	require.Len(t, exported.Policies, 2)
+	assert.Equal(t, policies[0].ID, exported.Policies[0].ID)
+	w = adminRequest(r, http.MethodPost, "/policies/import?prune=true", w.Body.String(), yamlHeaders)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	result = decodeImport(t, w.Body.Bytes())
+	assert.Equal(t, 2, result.Unchanged)
+	assert.Zero(t, result.Created+result.Updated+result.Deleted)
+
+	// Policies are matched by ID before name, so a bundle can rename them;
+	// changes make new versions
+	w = adminRequest(r, http.MethodGet, "/policies/export", "", yamlHeaders)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &exported))
+	exported.Policies[1].Name = "Everyone reads devices"
+	exported.Policies[1].Version = 42
+	body, err := json.Marshal(exported)
+	require.NoError(t, err)
+	jsonHeaders := map[string]string{"X-User": "alice", "X-Roles": "admin", "Content-Type": "application/json"}
+	w = adminRequest(r, http.MethodPost, "/policies/import", string(body), jsonHeaders)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	result = decodeImport(t, w.Body.Bytes())
+	assert.Equal(t, 1, result.Updated)
+	renamed, err := engine.Get(ctx, exported.Policies[1].ID)
+	require.NoError(t, err)
+	assert.Equal(t, "Everyone reads devices", renamed.Name)
+	assert.Equal(t, 2, renamed.Version)
+}
+
+func TestPolicyBundleRejection(t *testing.T) {
+	ctx := context.Background()
+	engine := policy.NewEngine(policy.Config{}, store.NewMemoryStore())
+	r := newPolicyRouter(engine)
+	headers := map[string]string{"X-User": "alice", "X-Roles": "admin", "Content-Type": "application/json"}
+
+	// One rejected policy keeps the others from being imported
+	w := adminRequest(r, http.MethodPost, "/policies/import", `{"policies": [
+		{"name": "Good", "subjects": ["*"], "resources": ["*"], "actions": ["read"], "effect": "allow"},
+		{"name": "Bad", "subjects": ["*"], "resources": ["*"], "actions": ["read"], "effect": "maybe"},
+		{"name": "Good", "subjects": ["*"], "resources": ["*"], "actions": ["write"], "effect": "allow"}
+	]}`, headers)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	result := decodeImport(t, w.Body.Bytes())
+	assert.False(t, result.Applied)
+	assert.Equal(t, 2, result.Rejected)
+	assert.Equal(t, policy.ImportCreate, result.Changes[0].Action)
+	assert.Equal(t, policy.ImportReject, result.Changes[1].Action)
+	assert.Contains(t, result.Changes[1].Error, "effect")
+	assert.Contains(t, result.Changes[2].Error, "policy 1")
+	policies, err := engine.List(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, policies)
+
+	// Names that several policies share need the id
+	for i := 0; i < 2; i++ {
+		_, err := engine.Create(ctx, policy.Policy{Name: "Twin", Subjects: []string{"*"}, Resources: []string{"*"}, Actions: []string{"*"}, Effect: policy.EffectAllow})
+		require.NoError(t, err)
+	}
+	w = adminRequest(r, http.MethodPost, "/policies/import", `{"policies": [{"name": "Twin", "subjects": ["*"], "resources": ["*"], "actions": ["read"], "effect": "allow"}]}`, headers)
+	result = decodeImport(t, w.Body.Bytes())
+	assert.Equal(t, 1, result.Rejected)
+	assert.Contains(t, result.Changes[0].Error, "2 policies are named")
+
+	for name, tc := range map[string]struct{ body, contentType, query string }{
+		"unknown field":  {`{"policies": [{"name": "x", "subject": ["*"]}]}`, "application/json", ""},
+		"unknown yaml":   {"policies:\n  - name: x\n    subject: ['*']\n", "application/yaml", ""},
+		"malformed yaml": {"policies: [", "text/yaml", ""},
+		"empty bundle":   {`{"policies": []}`, "application/json", ""},
+		"dry run flag":   {`{"policies": []}`, "application/json", "?dry_run=maybe"},
+	} {
+		w := adminRequest(r, http.MethodPost, "/policies/import"+tc.query, tc.body, map[string]string{"X-User": "alice", "Content-Type": tc.contentType})
+		assert.Equal(t, http.StatusBadRequest, w.Code, name)
+		assert.True(t, strings.Contains(w.Body.String(), "VALIDATION_ERROR"), name)
+	}
+	w = adminRequest(r, http.MethodGet, "/policies/export?format=xml", "", headers)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,100 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/pkg/policy"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+func lintPolicies(t *testing.T, engine *policy.Engine, query, body string) policy.LintResult {
+	w := adminRequest(newPolicyRouter(engine), http.MethodPost, "/policies/lint"+query, body, map[string]string{"X-User": "bob", "Content-Type": "application/json"})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var result policy.LintResult
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	return result
+}
+
+// findings indexes findings by rule and the names of their policies
+func findings(result policy.LintResult) map[string]policy.Finding {
+	byRule := make(map[string]policy.Finding, len(result.Findings))
+	for _, f := range result.Findings {
+		key := f.Rule
+		for _, ref := range f.Policies {
+			key += " " + ref.Name
+		}
+		byRule[key] = f
+	}
+	return byRule
+}
+
+func TestPolicyLint(t *testing.T) {
+	engine := policy.NewEngine(policy.Config{}, store.NewMemoryStore())
+	result := lintPolicies(t, engine, "", `{"policies": [
+		{"name": "Everyone", "subjects": ["*"], "resources": ["*"], "actions": ["read"], "effect": "allow"},
+		{"name": "Admins", "subjects": ["role:admin"], "resources": ["admin/*"], "actions": ["*"], "effect": "allow"},
+		{"name": "No admin writes", "subjects": ["*"], "resources": ["admin/*"], "actions": ["write"], "effect": "deny",
+		 "conditions": [{"attribute": "ip", "operator": "not_cidr", "values": ["10.0.0.0/8"]}]},
+		{"name": "Lock reports", "subjects": ["*"], "resources": ["reports*"], "actions": ["*"], "effect": "deny"},
+		{"name": "Auditors read reports", "subjects": ["role:auditor"], "resources": ["reports/q*"], "actions": ["read"], "effect": "allow"},
+		{"name": "Never", "subjects": ["*"], "resources": ["devices/*"], "actions": ["read"], "effect": "allow",
+		 "conditions": [{"attribute": "trust_score", "operator": "greater_than", "values": ["80"]}, {"attribute": "trust_score", "operator": "less_or_equal", "values": ["80"]}]},
+		{"name": "Nowhere", "subjects": ["*"], "resources": ["devices/*"], "actions": ["write"], "effect": "allow",
+		 "conditions": [{"attribute": "country", "operator": "in", "values": ["ES", "PT"]}, {"attribute": "country", "operator": "not_equals", "values": ["ES"]}, {"attribute": "country", "operator": "equals", "values": ["PT"]}, {"attribute": "country", "operator": "not_in", "values": ["PT"]}]},
+		{"name": "Secrets", "subjects": ["user:alice"], "resources": ["*secret"], "actions": ["read"], "effect": "allow"},
+		{"name": "Secrets again", "subjects": ["user:alice"], "resources": ["*secret"], "actions": ["read"], "effect": "allow"},
+		{"name": "Bad", "subjects": ["alice"], "resources": ["*"], "actions": ["*"], "effect": "allow"}
+	]}`)
+	byRule := findings(result)
+
+	assert.Equal(t, policy.SeverityError, byRule["invalid Bad"].Severity)
+	assert.Equal(t, 10, byRule["invalid Bad"].Policies[0].Policy)
+	assert.Contains(t, byRule["unreachable Never"].Message, "trust_score")
+	assert.Contains(t, byRule["unreachable Nowhere"].Message, "country")
+	// A deny without conditions covering an allow makes it unreachable
+	assert.Contains(t, byRule, "unreachable Auditors read reports Lock reports")
+	assert.Contains(t, byRule, "conflict Admins No admin writes")
+	assert.Contains(t, byRule, "conflict Everyone Lock reports")
+	assert.Contains(t, byRule, "conflict Secrets Lock reports")
+	// Policies that share no actions or resources do not conflict
+	assert.NotContains(t, byRule, "conflict Everyone No admin writes")
+	assert.NotContains(t, byRule, "conflict Admins Lock reports")
+	assert.Equal(t, policy.SeverityInfo, byRule["broad_wildcard Secrets"].Severity)
+	assert.Equal(t, policy.SeverityInfo, byRule["duplicate Secrets Secrets again"].Severity)
+	assert.Equal(t, 4, result.Errors)
+	assert.Equal(t, 5, result.Warnings)
+	assert.Len(t, result.Findings, 12)
+	assert.Equal(t, policy.SeverityError, result.Findings[0].Severity)
+	assert.Equal(t, policy.SeverityInfo, result.Findings[len(result.Findings)-1].Severity)
+}
+
+func TestPolicyLintStored(t *testing.T) {
+	ctx := context.Background()
+	engine := policy.NewEngine(policy.Config{}, store.NewMemoryStore())
+	open, err := engine.Create(ctx, policy.Policy{Name: "Open", Subjects: []string{"*"}, Resources: []string{"*"}, Actions: []string{"*"}, Effect: policy.EffectAllow})
+	require.NoError(t, err)
+	_, err = engine.Create(ctx, policy.Policy{Name: "No deletes", Subjects: []string{"*"}, Resources: []string{"devices/*"}, Actions: []string{"delete"}, Effect: policy.EffectDeny})
+	require.NoError(t, err)
+
+	// Without a body the stored policies are linted
+	byRule := findings(lintPolicies(t, engine, "", ""))
+	assert.Equal(t, policy.SeverityWarning, byRule["broad_wildcard Open"].Severity)
+	assert.Equal(t, open.ID, byRule["broad_wildcard Open"].Policies[0].ID)
+	assert.Contains(t, byRule, "conflict Open No deletes")
+
+	// A bundle replaces the stored policies it names, as importing it would
+	bundle := `{"policies": [{"name": "Open", "subjects": ["*"], "resources": ["devices/*"], "actions": ["read"], "effect": "allow"}]}`
+	result := lintPolicies(t, engine, "", bundle)
+	assert.Empty(t, result.Findings)
+	result = lintPolicies(t, engine, "?prune=true", `{"policies": [{"name": "Deny all", "subjects": ["*"], "resources": ["*"], "actions": ["*"], "effect": "deny"}]}`)
+	assert.Empty(t, result.Findings)
+	result = lintPolicies(t, engine, "", `{"policies": [{"name": "Deny all", "subjects": ["*"], "resources": ["*"], "actions": ["*"], "effect": "deny"}]}`)
+	byRule = findings(result)
+	assert.Contains(t, byRule, "unreachable Open Deny all")
+}
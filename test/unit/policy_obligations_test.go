@@ -0,0 +1,223 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/pkg/audit"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/middleware"
+	"github.com/lsendel/impl-zamaz/pkg/policy"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+// newObligationRouter serves people, a list with contact details, also as
+// CSV and NDJSON exports, and avatar, an image, behind a decision point
+// fulfilling mask and audit
+func newObligationRouter(engine *policy.Engine, log *audit.Log, extra map[string]policy.Obligation) *gin.Engine {
+	obligations := map[string]policy.Obligation{
+		policy.ObligationMask: policy.MaskFields(),
+		policy.ObligationAudit: policy.AuditRequests(log, func(*gin.Context) string {
+			return "acme"
+		}, testLogger{}),
+	}
+	for name, obligation := range extra {
+		obligations[name] = obligation
+	}
+	r := setupTestRouter()
+	v1 := r.Group("/api/v1", func(c *gin.Context) {
+		c.Set("user", &interfaces.UserInfo{ID: c.GetHeader("X-User")})
+	}, engine.Middleware(policy.PDPConfig{Obligations: obligations, CacheTTL: time.Nanosecond}, testLogger{}, nil))
+	v1.GET("/people", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"total": 2,
+			"people": []gin.H{
+				{"name": "Ana", "email": "ana@example.com", "phone": "555-0100", "manager": gin.H{"email": "lee@example.com"}},
+				{"name": "Bo", "email": "bo@example.com", "phone": "555-0101"},
+			},
+		})
+	})
+	v1.GET("/people/export", func(c *gin.Context) {
+		c.Data(http.StatusOK, "text/csv; charset=utf-8", []byte("name,email\nAna,ana@example.com\n"))
+	})
+	v1.GET("/people/stream", func(c *gin.Context) {
+		c.Header("Content-Type", "application/x-ndjson")
+		c.Status(http.StatusOK)
+		enc := json.NewEncoder(c.Writer)
+		enc.Encode(gin.H{"name": "Ana", "email": "ana@example.com"})
+		enc.Encode(gin.H{"name": "Bo", "email": "bo@example.com"})
+	})
+	v1.GET("/people/broken", func(c *gin.Context) {
+		c.Data(http.StatusOK, "application/json", []byte(`{"email": "ana@example.com"`))
+	})
+	v1.GET("/people/:id", func(c *gin.Context) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"code": "RESOURCE_NOT_FOUND", "id": c.Param("id")})
+	})
+	v1.GET("/avatar", func(c *gin.Context) {
+		c.Data(http.StatusOK, "image/png", []byte{0x89, 'P', 'N', 'G'})
+	})
+	return r
+}
+
+func TestPolicyObligationMask(t *testing.T) {
+	ctx := context.Background()
+	engine := policy.NewEngine(policy.Config{}, store.NewMemoryStore())
+	_, err := engine.Create(ctx, policy.Policy{
+		Name: "Contact details are private", Subjects: []string{"*"}, Resources: []string{"people*", "avatar"}, Actions: []string{"*"}, Effect: policy.EffectAllow,
+		Obligations: []string{"mask:email"},
+	})
+	require.NoError(t, err)
+	_, err = engine.Create(ctx, policy.Policy{
+		Name: "Listed phones are private", Subjects: []string{"*"}, Resources: []string{"people"}, Actions: []string{"*"}, Effect: policy.EffectAllow,
+		Obligations: []string{"mask:people.*.phone", "mask:email"},
+	})
+	require.NoError(t, err)
+	r := newObligationRouter(engine, audit.NewLog(store.NewMemoryStore(), time.Hour, testLogger{}, nil), nil)
+
+	w := adminRequest(r, http.MethodGet, "/api/v1/people", "", map[string]string{"X-User": "u-1"})
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+	var body struct {
+		Total  int                          `json:"total"`
+		People []map[string]json.RawMessage `json:"people"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, 2, body.Total)
+	require.Len(t, body.People, 2)
+	for _, person := range body.People {
+		assert.JSONEq(t, `"***"`, string(person["email"]))
+		assert.JSONEq(t, `"***"`, string(person["phone"]))
+	}
+	assert.JSONEq(t, `"Ana"`, string(body.People[0]["name"]))
+	assert.JSONEq(t, `{"email":"***"}`, string(body.People[0]["manager"]))
+
+	// Error responses keep their status
+	w = adminRequest(r, http.MethodGet, "/api/v1/people/7", "", map[string]string{"X-User": "u-1"})
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.JSONEq(t, `{"code":"RESOURCE_NOT_FOUND","id":"7"}`, w.Body.String())
+
+	// NDJSON is masked line by line
+	w = adminRequest(r, http.MethodGet, "/api/v1/people/stream", "", map[string]string{"X-User": "u-1"})
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/x-ndjson", w.Header().Get("Content-Type"))
+	assert.Equal(t, "{\"email\":\"***\",\"name\":\"Ana\"}\n{\"email\":\"***\",\"name\":\"Bo\"}\n", w.Body.String())
+
+	// Other content types, such as CSV exports and images, pass through
+	w = adminRequest(r, http.MethodGet, "/api/v1/people/export", "", map[string]string{"X-User": "u-1"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/csv; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, "name,email\nAna,ana@example.com\n", w.Body.String())
+	w = adminRequest(r, http.MethodGet, "/api/v1/avatar", "", map[string]string{"X-User": "u-1"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []byte{0x89, 'P', 'N', 'G'}, w.Body.Bytes())
+
+	// JSON that cannot be masked is withheld
+	w = adminRequest(r, http.MethodGet, "/api/v1/people/broken", "", map[string]string{"X-User": "u-1"})
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Contains(t, w.Body.String(), "INTERNAL_ERROR")
+	assert.NotContains(t, w.Body.String(), "ana@example.com")
+}
+
+func TestPolicyObligationAudit(t *testing.T) {
+	ctx := context.Background()
+	engine := policy.NewEngine(policy.Config{}, store.NewMemoryStore())
+	watched, err := engine.Create(ctx, policy.Policy{
+		Name: "People are watched", Subjects: []string{"*"}, Resources: []string{"people*"}, Actions: []string{"*"}, Effect: policy.EffectAllow,
+		Obligations: []string{"audit:pii-access", "mask:email", "approve"},
+	})
+	require.NoError(t, err)
+	log := audit.NewLog(store.NewMemoryStore(), time.Hour, testLogger{}, nil)
+	var order []string
+	r := newObligationRouter(engine, log, map[string]policy.Obligation{
+		"approve": {
+			Before: func(c *gin.Context, args []string) bool {
+				order = append(order, "approve")
+				if c.GetHeader("X-Approved") == "" {
+					c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"code": "APPROVAL_REQUIRED", "email": "approver@example.com"})
+					return false
+				}
+				return true
+			},
+		},
+	})
+
+	w := adminRequest(r, http.MethodGet, "/api/v1/people", "", map[string]string{"X-User": "u-1", "X-Approved": "yes", "User-Agent": "curl/8"})
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), "@example.com")
+
+	// A request an obligation stops is still masked and audited
+	w = adminRequest(r, http.MethodGet, "/api/v1/people", "", map[string]string{"X-User": "u-2"})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.JSONEq(t, `{"code":"APPROVAL_REQUIRED","email":"***"}`, w.Body.String())
+	assert.Equal(t, []string{"approve", "approve"}, order)
+
+	events, err := log.Events(ctx, "acme", 0, 10)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	assert.Equal(t, "policy.audit", events[0].Type)
+	assert.Equal(t, "u-1", events[0].Actor)
+	assert.EqualValues(t, http.StatusOK, events[0].Data["status"])
+	assert.Equal(t, "curl/8", events[0].Data["user_agent"])
+	assert.Equal(t, watched.ID+"@1", events[0].Data["policies"])
+	assert.Equal(t, []interface{}{"pii-access"}, events[0].Data["reasons"])
+	assert.Equal(t, "u-2", events[1].Actor)
+	assert.EqualValues(t, http.StatusForbidden, events[1].Data["status"])
+
+	// Arguments must not be empty
+	p := policy.Policy{Name: "x", Subjects: []string{"*"}, Resources: []string{"*"}, Actions: []string{"*"}, Effect: policy.EffectAllow}
+	for _, obligation := range []string{"mask:", ":email", " "} {
+		p.Obligations = []string{obligation}
+		assert.Error(t, p.Validate(), obligation)
+	}
+	assert.Equal(t, "mask", policy.ObligationName("mask:people.*.phone"))
+}
+
+// unratedTrust cannot rate callers
+type unratedTrust struct{}
+
+func (unratedTrust) CurrentTrust(*gin.Context) (*interfaces.TrustScore, error) {
+	return nil, errors.New("scorer unavailable")
+}
+
+func TestPolicySensitiveFieldsBelowTrust(t *testing.T) {
+	engine := policy.NewEngine(policy.Config{}, store.NewMemoryStore())
+	metrics := &countingMetrics{}
+	newRouter := func(src middleware.TrustSource) *gin.Engine {
+		r := setupTestRouter()
+		v1 := r.Group("/api/v1", func(c *gin.Context) {
+			c.Set("user", &interfaces.UserInfo{ID: "u-1"})
+		}, engine.Middleware(policy.PDPConfig{
+			Defaults:            []*policy.Policy{{ID: "allow", Subjects: []string{"*"}, Resources: []string{"*"}, Actions: []string{"*"}, Effect: policy.EffectAllow}},
+			Trust:               src,
+			SensitiveFields:     []string{"email", "session.token"},
+			SensitiveTrustLevel: 60,
+		}, testLogger{}, metrics))
+		v1.GET("/me", func(c *gin.Context) {
+			c.JSON(http.StatusOK, gin.H{"name": "Ana", "email": "ana@example.com", "session": gin.H{"token": "t-1", "email": "ana@example.com"}})
+		})
+		return r
+	}
+
+	w := adminRequest(newRouter(staticTrust(60)), http.MethodGet, "/api/v1/me", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"name":"Ana","email":"ana@example.com","session":{"token":"t-1","email":"ana@example.com"}}`, w.Body.String())
+
+	w = adminRequest(newRouter(staticTrust(59)), http.MethodGet, "/api/v1/me", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"name":"Ana","email":"***","session":{"token":"***","email":"***"}}`, w.Body.String())
+
+	// Callers who cannot be rated are treated as untrusted
+	w = adminRequest(newRouter(unratedTrust{}), http.MethodGet, "/api/v1/me", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), "ana@example.com")
+	assert.Equal(t, 1, metrics.count("policy_sensitive_fields_masked_total,reason=low_trust"))
+	assert.Equal(t, 1, metrics.count("policy_sensitive_fields_masked_total,reason=unrated"))
+}
@@ -0,0 +1,175 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/pkg/policy"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+func TestPolicyResourceTags(t *testing.T) {
+	ctx := context.Background()
+	engine := policy.NewEngine(policy.Config{}, store.NewMemoryStore())
+	service, err := engine.CreateResource(ctx, policy.Resource{
+		Name: "Device service", Patterns: []string{"devices*"}, Tags: map[string]string{"service": "devices", "tier": "internal"},
+	})
+	require.NoError(t, err)
+	posture, err := engine.CreateResource(ctx, policy.Resource{
+		Name: "Device posture", Parent: service.ID, Patterns: []string{"devices/*/posture"},
+		Tags:    map[string]string{"data-classification": "pii", "tier": "restricted"},
+		Actions: map[string]map[string]string{"delete": {"impact": "high"}},
+	})
+	require.NoError(t, err)
+	resources, err := engine.ListResources(ctx)
+	require.NoError(t, err)
+	require.Len(t, resources, 2)
+	assert.Equal(t, "Device posture", resources[0].Name)
+
+	// The longest pattern wins and inherits from its service
+	assert.Equal(t, map[string]string{"service": "devices", "tier": "restricted", "data-classification": "pii"},
+		policy.ResourceTags(resources, "devices/42/posture", "read"))
+	assert.Equal(t, "high", policy.ResourceTags(resources, "devices/42/posture", "delete")["impact"])
+	assert.Equal(t, map[string]string{"service": "devices", "tier": "internal"}, policy.ResourceTags(resources, "devices/42", "delete"))
+	assert.Nil(t, policy.ResourceTags(resources, "reports", "read"))
+
+	_, err = engine.Create(ctx, policy.Policy{
+		Name: "Everyone", Subjects: []string{"*"}, Resources: []string{"*"}, Actions: []string{"*"}, Effect: policy.EffectAllow,
+	})
+	require.NoError(t, err)
+	pii, err := engine.Create(ctx, policy.Policy{
+		Name: "PII on trusted networks", Subjects: []string{"*"}, Resources: []string{"tag:data-classification=pii", "tag:impact=h*"}, Actions: []string{"*"},
+		Conditions: []policy.Condition{{Attribute: policy.AttributeIP, Operator: policy.OpNotCIDR, Values: []string{"10.0.0.0/8"}}},
+		Effect:     policy.EffectDeny,
+	})
+	require.NoError(t, err)
+
+	decision, err := engine.Evaluate(ctx, policy.Request{Subject: "u-1", Resource: "devices/42/posture", Action: "read"})
+	require.NoError(t, err)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, []string{pii.ID}, decision.Policies)
+	decision, err = engine.Evaluate(ctx, policy.Request{Subject: "u-1", Resource: "devices/42", Action: "read"})
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed)
+	// Tags given with the request are used instead of the registry's
+	decision, err = engine.Evaluate(ctx, policy.Request{Subject: "u-1", Resource: "devices/42", Action: "read", Tags: map[string]string{"impact": "huge"}})
+	require.NoError(t, err)
+	assert.False(t, decision.Allowed)
+
+	// Retagging the service reaches the resources under it
+	_, err = engine.UpdateResource(ctx, service.ID, policy.Resource{
+		Name: "Device service", Patterns: []string{"devices*"}, Tags: map[string]string{"data-classification": "pii"},
+	})
+	require.NoError(t, err)
+	decision, err = engine.Evaluate(ctx, policy.Request{Subject: "u-1", Resource: "devices/42", Action: "read", Context: map[string]string{"ip": "10.1.1.1"}})
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed)
+	decision, err = engine.Evaluate(ctx, policy.Request{Subject: "u-1", Resource: "devices/42", Action: "read"})
+	require.NoError(t, err)
+	assert.False(t, decision.Allowed)
+
+	assert.True(t, errors.Is(engine.DeleteResource(ctx, service.ID), policy.ErrResourceInUse))
+	require.NoError(t, engine.DeleteResource(ctx, posture.ID))
+	require.NoError(t, engine.DeleteResource(ctx, service.ID))
+	_, err = engine.GetResource(ctx, service.ID)
+	assert.True(t, errors.Is(err, policy.ErrResourceNotFound))
+}
+
+func TestPolicyResourceValidation(t *testing.T) {
+	ctx := context.Background()
+	engine := policy.NewEngine(policy.Config{MaxResources: 3}, store.NewMemoryStore())
+	service, err := engine.CreateResource(ctx, policy.Resource{Name: "Payments"})
+	require.NoError(t, err)
+	invoices, err := engine.CreateResource(ctx, policy.Resource{Name: "Invoices", Parent: service.ID, Patterns: []string{"invoices/*"}})
+	require.NoError(t, err)
+
+	for name, r := range map[string]policy.Resource{
+		"no name":         {Patterns: []string{"x"}},
+		"selector":        {Name: "x", Patterns: []string{"tag:a=b"}},
+		"tag without key": {Name: "x", Tags: map[string]string{"": "b"}},
+		"wildcard key":    {Name: "x", Tags: map[string]string{"a*": "b"}},
+		"empty value":     {Name: "x", Tags: map[string]string{"a": " "}},
+		"untagged action": {Name: "x", Actions: map[string]map[string]string{"read": {}}},
+		"unknown parent":  {Name: "x", Parent: "missing"},
+	} {
+		_, err := engine.CreateResource(ctx, r)
+		assert.True(t, errors.Is(err, policy.ErrInvalid), name)
+	}
+	_, err = engine.UpdateResource(ctx, service.ID, policy.Resource{Name: "Payments", Parent: invoices.ID})
+	assert.True(t, errors.Is(err, policy.ErrInvalid), "loop")
+
+	_, err = engine.CreateResource(ctx, policy.Resource{Name: "Refunds", Parent: service.ID})
+	require.NoError(t, err)
+	_, err = engine.CreateResource(ctx, policy.Resource{Name: "Payouts", Parent: service.ID})
+	assert.True(t, errors.Is(err, policy.ErrLimit))
+
+	for _, resource := range []string{"tag:", "tag:=pii", "tag:a*=b", "tag:classification"} {
+		p := policy.Policy{Name: "x", Subjects: []string{"*"}, Resources: []string{resource}, Actions: []string{"*"}, Effect: policy.EffectAllow}
+		assert.True(t, errors.Is(p.Validate(), policy.ErrInvalid), resource)
+	}
+}
+
+func TestPolicyResourceAPI(t *testing.T) {
+	engine := policy.NewEngine(policy.Config{}, store.NewMemoryStore())
+	r := newPolicyRouter(engine)
+	headers := map[string]string{"X-User": "alice", "Content-Type": "application/json"}
+
+	w := adminRequest(r, http.MethodPost, "/policies/resources", `{"name":"Reports","patterns":["reports/*"],"tags":{"data-classification":"pii"}}`, headers)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var created policy.Resource
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	assert.NotEmpty(t, created.ID)
+
+	w = adminRequest(r, http.MethodPost, "/policies/resources", `{"name":"Orphan","parent":"missing"}`, headers)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = adminRequest(r, http.MethodGet, "/policies/resources", "", headers)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"total":1`)
+
+	w = adminRequest(r, http.MethodPost, "/policies", `{"name":"No PII","subjects":["*"],"resources":["tag:data-classification=pii"],"actions":["*"],"effect":"deny"}`, headers)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	w = adminRequest(r, http.MethodPost, "/policies/evaluate", `{"subject":"u-1","resource":"reports/q3","action":"read"}`, headers)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"reason":"denied by policy"`)
+
+	w = adminRequest(r, http.MethodPut, "/policies/resources/"+created.ID, `{"name":"Reports","patterns":["reports/*"],"tags":{"data-classification":"public"}}`, headers)
+	require.Equal(t, http.StatusOK, w.Code)
+	w = adminRequest(r, http.MethodPost, "/policies/evaluate", `{"subject":"u-1","resource":"reports/q3","action":"read"}`, headers)
+	assert.Contains(t, w.Body.String(), `"reason":"no policy allows the request"`)
+
+	w = adminRequest(r, http.MethodDelete, "/policies/resources/"+created.ID, "", headers)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = adminRequest(r, http.MethodGet, "/policies/resources/"+created.ID, "", headers)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestPolicyLintSelectors(t *testing.T) {
+	engine := policy.NewEngine(policy.Config{}, store.NewMemoryStore())
+	result, err := engine.Lint(context.Background(), policy.Bundle{Policies: []policy.Policy{
+		{Name: "Reports", Subjects: []string{"role:analyst"}, Resources: []string{"reports/*"}, Actions: []string{"read"}, Effect: policy.EffectAllow},
+		{Name: "PII", Subjects: []string{"*"}, Resources: []string{"tag:data-classification=pii"}, Actions: []string{"*"}, Effect: policy.EffectDeny,
+			Conditions: []policy.Condition{{Attribute: policy.AttributeIP, Operator: policy.OpNotCIDR, Values: []string{"10.0.0.0/8"}}}},
+		{Name: "Public", Subjects: []string{"*"}, Resources: []string{"tag:data-classification=public"}, Actions: []string{"read"}, Effect: policy.EffectAllow},
+		{Name: "Sensitive", Subjects: []string{"*"}, Resources: []string{"tag:data-classification=p*"}, Actions: []string{"*"}, Effect: policy.EffectDeny},
+	}}, policy.ImportOptions{})
+	require.NoError(t, err)
+
+	var rules []string
+	for _, f := range result.Findings {
+		rules = append(rules, f.Rule+":"+f.Policies[0].Name+"/"+f.Policies[len(f.Policies)-1].Name)
+	}
+	// A selector may select any path, but not a resource of another
+	// classification; a selector only covers one of its own tag
+	assert.ElementsMatch(t, []string{
+		"conflict:Reports/PII",
+		"conflict:Reports/Sensitive",
+		"unreachable:Public/Sensitive",
+	}, rules)
+}
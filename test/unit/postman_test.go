@@ -0,0 +1,122 @@
+package unit
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/api"
+)
+
+const testSwaggerSpec = `{
+  "swagger": "2.0",
+  "info": {"title": "impl-zamaz Zero Trust API", "version": "1.0.0"},
+  "basePath": "/api/v1",
+  "paths": {
+    "/auth/login": {
+      "post": {
+        "summary": "User login",
+        "tags": ["auth"],
+        "parameters": [{"name": "credentials", "in": "body", "required": true, "schema": {"$ref": "#/definitions/LoginRequest"}}]
+      }
+    },
+    "/devices/{id}": {
+      "get": {
+        "summary": "Get device",
+        "tags": ["devices"],
+        "security": [{"Bearer": []}],
+        "parameters": [
+          {"name": "id", "in": "path", "required": true, "type": "string"},
+          {"name": "verbose", "in": "query", "type": "boolean", "default": false}
+        ]
+      },
+      "delete": {
+        "tags": ["devices"],
+        "security": [{"Bearer": []}]
+      }
+    }
+  },
+  "definitions": {
+    "LoginRequest": {
+      "type": "object",
+      "properties": {
+        "username": {"type": "string", "example": "testuser"},
+        "password": {"type": "string", "example": "password123"}
+      }
+    }
+  }
+}`
+
+func TestPostmanCollectionFromSpec(t *testing.T) {
+	collection, err := api.NewPostmanCollection([]byte(testSwaggerSpec), "http://localhost:8080/api/v1")
+	require.NoError(t, err)
+
+	assert.Equal(t, api.PostmanSchema, collection.Info.Schema)
+	assert.Equal(t, "bearer", collection.Auth.Type)
+	require.Len(t, collection.Event, 1)
+	assert.Equal(t, "prerequest", collection.Event[0].Listen)
+	assert.Equal(t, api.VarBaseURL, collection.Variable[0].Key)
+	assert.Equal(t, "http://localhost:8080/api/v1", collection.Variable[0].Value)
+
+	require.Len(t, collection.Item, 2)
+	authFolder, devicesFolder := collection.Item[0], collection.Item[1]
+	assert.Equal(t, "auth", authFolder.Name)
+	assert.Equal(t, "devices", devicesFolder.Name)
+
+	login := authFolder.Item[0]
+	assert.Equal(t, "POST", login.Request.Method)
+	assert.Equal(t, "noauth", login.Request.Auth.Type)
+	require.NotNil(t, login.Request.Body)
+	assert.JSONEq(t, `{"username": "testuser", "password": "password123"}`, login.Request.Body.Raw)
+	require.Len(t, login.Event, 1)
+	assert.Equal(t, "test", login.Event[0].Listen)
+
+	require.Len(t, devicesFolder.Item, 2)
+	get := devicesFolder.Item[0]
+	assert.Equal(t, "Get device", get.Name)
+	assert.Nil(t, get.Request.Auth, "secured requests inherit the collection auth")
+	assert.Equal(t, "{{baseUrl}}/devices/:id", get.Request.URL.Raw)
+	assert.Equal(t, "id", get.Request.URL.Variable[0].Key)
+	assert.Equal(t, "false", get.Request.URL.Query[0].Value)
+	assert.True(t, get.Request.URL.Query[0].Disabled)
+	assert.Equal(t, "DELETE /devices/{id}", devicesFolder.Item[1].Name)
+}
+
+func TestPostmanCollectionRejectsEmptySpec(t *testing.T) {
+	_, err := api.NewPostmanCollection([]byte(`{"swagger": "2.0", "paths": {}}`), "")
+	assert.Error(t, err)
+}
+
+func TestPostmanHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/api-docs/postman", api.PostmanHandler(func() ([]byte, error) {
+		return []byte(testSwaggerSpec), nil
+	}))
+	r.GET("/broken", api.PostmanHandler(func() ([]byte, error) {
+		return nil, errors.New("no spec registered")
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/api-docs/postman", nil)
+	req.Host = "api.example.test"
+	req.Header.Set("X-Forwarded-Proto", "https")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Header().Get("Content-Disposition"), "impl-zamaz-zero-trust-api.postman_collection.json")
+	var collection api.PostmanCollection
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &collection))
+	assert.Equal(t, "https://api.example.test/api/v1", collection.Variable[0].Value)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/broken", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), "API_SPEC_UNAVAILABLE")
+}
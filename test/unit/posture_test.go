@@ -0,0 +1,154 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/pkg/device"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/posture"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+	"github.com/lsendel/impl-zamaz/pkg/trust"
+)
+
+func TestPosturePolicyEvaluate(t *testing.T) {
+	now := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	policy := posture.Policy{
+		MinOSVersions:         map[string]string{"windows": "10.0.19045"},
+		RequireDiskEncryption: true,
+		MaxPatchAge:           90 * 24 * time.Hour,
+		RequireEDR:            true,
+	}
+	healthy := posture.Report{OSVersion: "10.0.22631", DiskEncrypted: true, PatchLevel: "2026-05-10", EDRPresent: true}
+
+	assessment := policy.Evaluate("windows", healthy, now.Add(-time.Hour), now)
+	assert.True(t, assessment.Compliant)
+	assert.Equal(t, 1.0, assessment.Score)
+	assert.Empty(t, assessment.Flags)
+
+	outdated := healthy
+	outdated.OSVersion, outdated.DiskEncrypted = "10.0.19044", false
+	assessment = policy.Evaluate("windows", outdated, now, now)
+	assert.False(t, assessment.Compliant)
+	assert.Equal(t, []string{posture.FlagOSOutdated, posture.FlagDiskUnencrypted}, assessment.Flags)
+	assert.InDelta(t, 0.3, assessment.Score, 1e-9)
+	// Minimum versions apply to their platform only
+	assert.NotContains(t, policy.Evaluate("linux", outdated, now, now).Flags, posture.FlagOSOutdated)
+
+	neglected := healthy
+	neglected.PatchLevel, neglected.EDRPresent = "2025-12-01", false
+	assessment = policy.Evaluate("windows", neglected, now.Add(-48*time.Hour), now)
+	assert.Equal(t, []string{posture.FlagPatchStale, posture.FlagEDRMissing, posture.FlagReportStale}, assessment.Flags)
+	assert.Equal(t, 0.0, assessment.Score)
+
+	versions, err := posture.ParseMinOSVersions("Windows=10.0.19045, macos=14")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"windows": "10.0.19045", "macos": "14"}, versions)
+	_, err = posture.ParseMinOSVersions("windows=ten")
+	assert.Error(t, err)
+}
+
+func TestPostureReportsLowerDeviceTrust(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	registry := device.NewRegistry(device.Config{}, s)
+	laptop, err := registry.Register(ctx, "alice", device.Registration{Platform: "macos", Fingerprint: "fp-laptop"})
+	require.NoError(t, err)
+	metrics := &countingMetrics{}
+	postures := posture.NewService(posture.Policy{
+		MinOSVersions:         map[string]string{"macos": "14.0"},
+		RequireDiskEncryption: true,
+	}, registry, s, &testLogger{}, metrics)
+
+	r := setupTestRouter()
+	devices := r.Group("/devices", func(c *gin.Context) {
+		c.Set("user", &interfaces.UserInfo{ID: c.GetHeader("X-User")})
+	})
+	postures.RegisterRoutes(devices)
+	alice := map[string]string{"X-User": "alice"}
+
+	w := adminRequest(r, http.MethodGet, "/devices/"+laptop.ID+"/posture", "", alice)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = adminRequest(r, http.MethodPost, "/devices/"+laptop.ID+"/posture", `{"os_version": "fourteen", "patch_level": "2026-01-01"}`, alice)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = adminRequest(r, http.MethodPost, "/devices/"+laptop.ID+"/posture", `{"os_version": "14.5", "patch_level": "2026-01-01"}`, map[string]string{"X-User": "bob"})
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = adminRequest(r, http.MethodPost, "/devices/"+laptop.ID+"/posture", `{"os_version": "13.6", "disk_encrypted": false, "patch_level": "2026-01-01", "edr_present": true}`, alice)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var status posture.Status
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.False(t, status.Assessment.Compliant)
+	assert.Equal(t, []string{posture.FlagOSOutdated, posture.FlagDiskUnencrypted}, status.Assessment.Flags)
+	assert.Equal(t, 1, metrics.count("posture_reports_total,compliant=false"))
+
+	w = adminRequest(r, http.MethodGet, "/devices/"+laptop.ID+"/posture", "", alice)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.Equal(t, "macos", status.Platform)
+	assert.Equal(t, "13.6", status.Report.OSVersion)
+
+	// The device factor is scaled by the posture score
+	result, err := postures.Factor().Evaluate(ctx, trust.Input{Subject: "alice", Device: laptop.ID, Context: map[string]string{"device_verified": "true"}})
+	require.NoError(t, err)
+	assert.InDelta(t, 0.3, result.Score, 1e-9)
+	assert.Equal(t, "noncompliant", result.Evidence["posture"])
+	assert.Equal(t, "os_outdated,disk_unencrypted", result.Evidence["posture_flags"])
+
+	_, err = postures.Report(ctx, "alice", laptop.ID, posture.Report{OSVersion: "14.5", DiskEncrypted: true, PatchLevel: "2026-01-01"})
+	require.NoError(t, err)
+	result, err = postures.Factor().Evaluate(ctx, trust.Input{Subject: "alice", Device: laptop.ID, Context: map[string]string{"device_verified": "true"}})
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, result.Score)
+	assert.Equal(t, "compliant", result.Evidence["posture"])
+
+	// Devices without a report score as before
+	result, err = postures.Factor().Evaluate(ctx, trust.Input{Subject: "alice", Device: "unknown"})
+	require.NoError(t, err)
+	assert.Equal(t, 0.8, result.Score)
+}
+
+func TestPostureRequireCompliance(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	registry := device.NewRegistry(device.Config{}, s)
+	workstation, err := registry.Register(ctx, "alice", device.Registration{Platform: "windows", Fingerprint: "fp-ws"})
+	require.NoError(t, err)
+	metrics := &countingMetrics{}
+	postures := posture.NewService(posture.Policy{RequireDiskEncryption: true, RequireEDR: true}, registry, s, &testLogger{}, metrics)
+
+	r := setupTestRouter()
+	r.Use(func(c *gin.Context) {
+		c.Set("user", &interfaces.UserInfo{ID: "alice"})
+		if c.GetHeader("X-Bound") != "" {
+			c.Set(trust.BoundDeviceKey, workstation)
+		}
+	})
+	r.GET("/secrets", postures.RequireCompliance(), func(c *gin.Context) { c.Status(http.StatusOK) })
+	r.GET("/wiki", postures.RequireCompliance(posture.FlagDiskUnencrypted), func(c *gin.Context) { c.Status(http.StatusOK) })
+	bound := map[string]string{"X-Bound": "1"}
+
+	w := adminRequest(r, http.MethodGet, "/secrets", "", nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "DEVICE_NONCOMPLIANT")
+	w = adminRequest(r, http.MethodGet, "/secrets", "", bound)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "posture_unknown")
+
+	_, err = postures.Report(ctx, "alice", workstation.ID, posture.Report{OSVersion: "10.0.22631", DiskEncrypted: true, PatchLevel: "2026-01-01"})
+	require.NoError(t, err)
+	w = adminRequest(r, http.MethodGet, "/secrets", "", bound)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), posture.FlagEDRMissing)
+	// Routes may require only some flags to be clear
+	w = adminRequest(r, http.MethodGet, "/wiki", "", bound)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 3, metrics.count("posture_denials_total"))
+}
@@ -0,0 +1,299 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/pkg/authz"
+	"github.com/lsendel/impl-zamaz/pkg/discovery"
+	"github.com/lsendel/impl-zamaz/pkg/proxy"
+	"github.com/lsendel/impl-zamaz/pkg/security"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+// proxyRecorder adds CloseNotify, which gin requires to run a ReverseProxy
+type proxyRecorder struct {
+	*httptest.ResponseRecorder
+}
+
+func (proxyRecorder) CloseNotify() <-chan bool { return make(chan bool) }
+
+func serveProxy(r *gin.Engine, req *http.Request) *httptest.ResponseRecorder {
+	w := proxyRecorder{httptest.NewRecorder()}
+	r.ServeHTTP(w, req)
+	return w.ResponseRecorder
+}
+
+func newProxyRouter(t *testing.T, upstream string, minTrust int) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	enforcer, err := proxy.New(proxy.Config{
+		Upstream:   upstream,
+		LocalPaths: []string{"/health"},
+		Authorizer: newTestAuthorizer(t, authz.Config{MinTrustLevel: minTrust}),
+	}, &testLogger{}, nil)
+	require.NoError(t, err)
+
+	r := gin.New()
+	r.Use(enforcer.Middleware())
+	r.GET("/health", func(c *gin.Context) { c.String(http.StatusOK, "local") })
+	return r
+}
+
+func TestProxyForwardsWithIdentityHeaders(t *testing.T) {
+	var received http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+		w.Write([]byte("legacy:" + r.URL.Path))
+	}))
+	defer upstream.Close()
+
+	r := newProxyRouter(t, upstream.URL, 50)
+	req := httptest.NewRequest(http.MethodGet, "/reports/42", nil)
+	req.Header.Set("Authorization", "Bearer good")
+	req.Header.Set(authz.HeaderUserID, "spoofed")
+	req.Header.Set("X-Zamaz-Admin", "true")
+	w := serveProxy(r, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "legacy:/reports/42", w.Body.String())
+	assert.Equal(t, "u-1", received.Get(authz.HeaderUserID))
+	assert.Equal(t, "alice", received.Get(authz.HeaderUsername))
+	assert.Equal(t, "user,admin", received.Get(authz.HeaderRoles))
+	assert.Equal(t, "80", received.Get(authz.HeaderTrustLevel))
+	assert.Empty(t, received.Get("X-Zamaz-Admin"))
+	assert.Empty(t, received.Get("Authorization"))
+}
+
+func TestProxyRejectsBeforeForwarding(t *testing.T) {
+	forwarded := false
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = true
+	}))
+	defer upstream.Close()
+
+	r := newProxyRouter(t, upstream.URL, 50)
+	tests := []struct {
+		name   string
+		auth   string
+		status int
+		code   string
+	}{
+		{"missing token", "", http.StatusUnauthorized, "UNAUTHORIZED"},
+		{"invalid token", "Bearer nope", http.StatusUnauthorized, "AUTH_001"},
+		{"low trust", "Bearer weak", http.StatusForbidden, "INSUFFICIENT_TRUST"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/orders", nil)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			w := serveProxy(r, req)
+
+			assert.Equal(t, tt.status, w.Code)
+			var body map[string]interface{}
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+			assert.Equal(t, tt.code, body["code"])
+		})
+	}
+	assert.False(t, forwarded)
+}
+
+func TestProxyServesLocalPaths(t *testing.T) {
+	r := newProxyRouter(t, "http://127.0.0.1:1", 50)
+	w := serveProxy(r, httptest.NewRequest(http.MethodGet, "/health", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "local", w.Body.String())
+}
+
+func TestProxyUpstreamUnavailable(t *testing.T) {
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	upstream.Close()
+
+	r := newProxyRouter(t, upstream.URL, 0)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer good")
+	w := serveProxy(r, req)
+
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.Contains(t, w.Body.String(), "UPSTREAM_UNAVAILABLE")
+}
+
+func TestProxyRequiresValidUpstream(t *testing.T) {
+	_, err := proxy.New(proxy.Config{Upstream: "not a url", Authorizer: newTestAuthorizer(t, authz.Config{})}, &testLogger{}, nil)
+	assert.Error(t, err)
+
+	_, err = proxy.New(proxy.Config{Upstream: "http://legacy:8080"}, &testLogger{}, nil)
+	assert.Error(t, err)
+}
+
+func TestGatewayEnforcesServiceTrustLevels(t *testing.T) {
+	var received *http.Request
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/health" {
+			received = r.Clone(r.Context())
+		}
+		w.Write([]byte("orders:" + r.URL.Path))
+	}))
+	defer upstream.Close()
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	registry := discovery.NewServiceRegistry()
+	require.NoError(t, registry.RegisterService(&discovery.ServiceInfo{
+		Name:        "orders",
+		URL:         upstream.URL + "/api",
+		TrustLevel:  50,
+		HealthCheck: &discovery.HealthCheckConfig{Path: "/health"},
+		Endpoints: []discovery.EndpointInfo{
+			{Path: "/orders/{id}", Method: "DELETE", TrustLevel: 90},
+		},
+	}))
+	require.NoError(t, registry.RegisterService(&discovery.ServiceInfo{Name: "down", URL: dead.URL}))
+	require.Eventually(t, func() bool {
+		return len(registry.ListHealthyServices()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	gin.SetMode(gin.TestMode)
+	gateway, err := proxy.NewGateway(proxy.GatewayConfig{
+		Registry:   registry,
+		Authorizer: newTestAuthorizer(t, authz.Config{}),
+	}, &testLogger{}, nil)
+	require.NoError(t, err)
+	r := gin.New()
+	r.Any(proxy.GatewayPrefix+"/:service/*path", gateway.Handler())
+
+	req := httptest.NewRequest(http.MethodGet, "/proxy/orders/orders/7?expand=items", nil)
+	req.Header.Set("Authorization", "Bearer good")
+	req.Header.Set(authz.HeaderUserID, "spoofed")
+	w := serveProxy(r, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "orders:/api/orders/7", w.Body.String())
+	require.NotNil(t, received)
+	assert.Equal(t, "expand=items", received.URL.RawQuery)
+	assert.Equal(t, "u-1", received.Header.Get(authz.HeaderUserID))
+	assert.Equal(t, "/proxy/orders", received.Header.Get("X-Forwarded-Prefix"))
+	assert.Empty(t, received.Header.Get("Authorization"))
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		token    string
+		status   int
+		code     string
+		required float64
+	}{
+		{"missing token", "GET", "/proxy/orders/orders", "", http.StatusUnauthorized, "UNAUTHORIZED", 0},
+		{"below service level", "GET", "/proxy/orders/orders", "weak", http.StatusForbidden, "INSUFFICIENT_TRUST", 50},
+		{"below endpoint level", "DELETE", "/proxy/orders/orders/7", "good", http.StatusForbidden, "INSUFFICIENT_TRUST", 90},
+		{"dot segments", "DELETE", "/proxy/orders/reports/../orders/7", "good", http.StatusForbidden, "INSUFFICIENT_TRUST", 90},
+		{"unknown service", "GET", "/proxy/billing/invoices", "good", http.StatusNotFound, "SERVICE_NOT_FOUND", 0},
+		{"no healthy instance", "GET", "/proxy/down/", "good", http.StatusServiceUnavailable, "SERVICE_UNAVAILABLE", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			received = nil
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := serveProxy(r, req)
+
+			assert.Equal(t, tt.status, w.Code)
+			var body map[string]interface{}
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+			assert.Equal(t, tt.code, body["code"])
+			if tt.required > 0 {
+				assert.Equal(t, tt.required, body["required_trust_level"])
+			}
+			assert.Nil(t, received)
+		})
+	}
+}
+
+func TestGatewayCircuitBreakerDegradesService(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" && failing.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer upstream.Close()
+
+	registry := discovery.NewServiceRegistry()
+	require.NoError(t, registry.RegisterService(&discovery.ServiceInfo{Name: "orders", URL: upstream.URL}))
+	require.Eventually(t, func() bool {
+		return len(registry.ListHealthyServices()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	status := func() string {
+		services, _ := registry.QueryServices(discovery.ServiceQuery{})
+		require.Len(t, services, 1)
+		return services[0].Status
+	}
+
+	breakers := security.NewCircuitBreakerManager(store.NewMemoryStore(), &testLogger{}, nil)
+	require.NoError(t, breakers.Configure(proxy.GatewayBreakerPrefix+"orders", security.BreakerConfig{
+		MinRequests:    2,
+		OpenTimeout:    50 * time.Millisecond,
+		HalfOpenProbes: 1,
+	}))
+	metrics := &countingMetrics{}
+	gin.SetMode(gin.TestMode)
+	gateway, err := proxy.NewGateway(proxy.GatewayConfig{
+		Registry:   registry,
+		Authorizer: newTestAuthorizer(t, authz.Config{}),
+		Breaker:    breakers,
+	}, &testLogger{}, metrics)
+	require.NoError(t, err)
+	breakers.OnStateChange(gateway.BreakerStateChanged)
+	r := gin.New()
+	r.Any(proxy.GatewayPrefix+"/:service/*path", gateway.Handler())
+	call := func() int {
+		req := httptest.NewRequest(http.MethodGet, "/proxy/orders/orders", nil)
+		req.Header.Set("Authorization", "Bearer good")
+		return serveProxy(r, req).Code
+	}
+
+	// Server errors open the breaker, degrading the service
+	assert.Equal(t, http.StatusBadGateway, call())
+	assert.Equal(t, http.StatusBadGateway, call())
+	assert.Equal(t, discovery.StatusDegraded, status())
+	_, _, err = registry.Resolve("orders", "")
+	assert.ErrorIs(t, err, discovery.ErrCircuitOpen)
+	assert.Empty(t, registry.ListHealthyServices())
+	assert.Equal(t, http.StatusServiceUnavailable, call())
+	assert.Equal(t, 1, metrics.count("gateway_breaker_events_total,service=orders,state=open"))
+	assert.Equal(t, 1, metrics.count("gateway_requests_total,outcome=circuit_open,service=orders"))
+
+	// Once the open timeout passes a successful probe restores it
+	failing.Store(false)
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, http.StatusOK, call())
+	assert.Equal(t, discovery.StatusHealthy, status())
+	assert.Equal(t, 1, metrics.count("gateway_breaker_events_total,service=orders,state=half-open"))
+	assert.Equal(t, 1, metrics.count("gateway_breaker_events_total,service=orders,state=closed"))
+	_, release, err := registry.Resolve("orders", "")
+	require.NoError(t, err)
+	release()
+
+	// Health checks keep a degraded service degraded
+	require.NoError(t, registry.SetBreakerState("orders", discovery.BreakerOpen))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	registry.StartHealthChecks(ctx, 10*time.Millisecond)
+	assert.Equal(t, discovery.StatusDegraded, status())
+	assert.Error(t, registry.SetBreakerState("orders", "ajar"))
+}
@@ -0,0 +1,335 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/pkg/admin"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/middleware"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+// testLogger discards all log output
+type testLogger struct{}
+
+func (testLogger) Debug(string, ...interface{})            {}
+func (testLogger) Info(string, ...interface{})             {}
+func (testLogger) Warn(string, ...interface{})             {}
+func (testLogger) Error(string, ...interface{})            {}
+func (l testLogger) With(...interface{}) interfaces.Logger { return l }
+
+func TestRateLimitHeaders(t *testing.T) {
+	router := setupTestRouter()
+	router.Use(middleware.RateLimitMiddleware(middleware.RateLimitConfig{
+		RequestsPerMinute: 2,
+		RetryAfter:        30 * time.Second,
+	}, testLogger{}, nil))
+	router.GET("/test", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	})
+
+	for i := 1; i <= 2; i++ {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/test", nil)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "2", w.Header().Get(middleware.HeaderRateLimitLimit))
+		assert.Equal(t, strconv.Itoa(2-i), w.Header().Get(middleware.HeaderRateLimitRemaining))
+		assert.NotEmpty(t, w.Header().Get(middleware.HeaderRateLimitReset))
+		assert.Empty(t, w.Header().Get(middleware.HeaderRetryAfter))
+		assert.Equal(t, "2", w.Header().Get(middleware.HeaderStdRateLimitLimit))
+		assert.Equal(t, strconv.Itoa(2-i), w.Header().Get(middleware.HeaderStdRateLimitRemaining))
+		assert.Equal(t, "2;w=60", w.Header().Get(middleware.HeaderStdRateLimitPolicy))
+	}
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/test", nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "2", w.Header().Get(middleware.HeaderRateLimitLimit))
+	assert.Equal(t, "0", w.Header().Get(middleware.HeaderRateLimitRemaining))
+
+	reset, err := strconv.ParseInt(w.Header().Get(middleware.HeaderRateLimitReset), 10, 64)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, reset, time.Now().Unix())
+
+	retryAfter, err := strconv.Atoi(w.Header().Get(middleware.HeaderRetryAfter))
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, retryAfter, 30)
+
+	// The standard reset is in seconds from now
+	stdReset, err := strconv.Atoi(w.Header().Get(middleware.HeaderStdRateLimitReset))
+	require.NoError(t, err)
+	assert.InDelta(t, 60, stdReset, 1)
+	assert.Equal(t, "0", w.Header().Get(middleware.HeaderStdRateLimitRemaining))
+}
+
+func TestRateLimitPerClient(t *testing.T) {
+	router := setupTestRouter()
+	router.Use(middleware.RateLimitMiddleware(middleware.RateLimitConfig{
+		RequestsPerMinute: 1,
+	}, testLogger{}, nil))
+	router.GET("/test", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	for _, ip := range []string{"10.0.0.1:1234", "10.0.0.2:1234"} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/test", nil)
+		req.RemoteAddr = ip
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code, "first request from %s should pass", ip)
+	}
+}
+
+func allowN(t *testing.T, l middleware.Limiter, key string, n int) []middleware.RateLimitDecision {
+	decisions := make([]middleware.RateLimitDecision, n)
+	for i := range decisions {
+		d, err := l.Allow(context.Background(), key)
+		require.NoError(t, err)
+		decisions[i] = d
+	}
+	return decisions
+}
+
+func TestTokenBucketLimitsBurst(t *testing.T) {
+	l, err := middleware.NewLimiter(store.NewMemoryStore(), middleware.LimitDefinition{
+		Algorithm: middleware.AlgorithmTokenBucket,
+		Limit:     20,
+		Window:    200 * time.Millisecond,
+		Burst:     2,
+	})
+	require.NoError(t, err)
+
+	d := allowN(t, l, "alice", 3)
+	assert.True(t, d[0].Allowed)
+	assert.True(t, d[1].Allowed)
+	assert.Equal(t, 0, d[1].Remaining)
+	assert.False(t, d[2].Allowed)
+	assert.Equal(t, 2, d[2].Limit)
+	assert.Greater(t, d[2].RetryAfter, time.Duration(0))
+
+	// One token refills every 10ms
+	time.Sleep(15 * time.Millisecond)
+	assert.True(t, allowN(t, l, "alice", 1)[0].Allowed)
+	assert.True(t, allowN(t, l, "bob", 1)[0].Allowed, "buckets are per key")
+}
+
+func TestSlidingWindowLogHasNoBoundaryBurst(t *testing.T) {
+	l, err := middleware.NewLimiter(store.NewMemoryStore(), middleware.LimitDefinition{
+		Algorithm: middleware.AlgorithmSlidingWindowLog,
+		Limit:     2,
+		Window:    60 * time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	d := allowN(t, l, "alice", 1)
+	time.Sleep(30 * time.Millisecond)
+	d = append(d, allowN(t, l, "alice", 2)...)
+	assert.True(t, d[0].Allowed)
+	assert.True(t, d[1].Allowed)
+	assert.False(t, d[2].Allowed)
+	assert.LessOrEqual(t, d[2].RetryAfter, 30*time.Millisecond)
+
+	// The first request leaves the window; the second is still inside it
+	time.Sleep(35 * time.Millisecond)
+	d = allowN(t, l, "alice", 2)
+	assert.True(t, d[0].Allowed)
+	assert.False(t, d[1].Allowed)
+}
+
+func TestLeakyBucketSmoothsRequests(t *testing.T) {
+	l, err := middleware.NewLimiter(store.NewMemoryStore(), middleware.LimitDefinition{
+		Algorithm: middleware.AlgorithmLeakyBucket,
+		Limit:     10,
+		Window:    time.Second,
+		Burst:     1,
+	})
+	require.NoError(t, err)
+
+	d := allowN(t, l, "alice", 3)
+	assert.True(t, d[0].Allowed)
+	assert.Zero(t, d[0].Delay)
+	assert.True(t, d[1].Allowed)
+	assert.InDelta(t, float64(100*time.Millisecond), float64(d[1].Delay), float64(10*time.Millisecond))
+	assert.False(t, d[2].Allowed, "only one request may wait in the queue")
+	assert.Greater(t, d[2].RetryAfter, time.Duration(0))
+}
+
+func TestRateLimitMiddlewareWaitsForLeakyBucketSlot(t *testing.T) {
+	l, err := middleware.NewLimiter(store.NewMemoryStore(), middleware.LimitDefinition{
+		Algorithm: middleware.AlgorithmLeakyBucket,
+		Limit:     20,
+		Window:    time.Second,
+		Burst:     5,
+	})
+	require.NoError(t, err)
+	router := setupTestRouter()
+	router.Use(middleware.RateLimitMiddleware(middleware.RateLimitConfig{Limiter: l}, testLogger{}, nil))
+	router.GET("/test", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/test", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+	assert.GreaterOrEqual(t, time.Since(start), 90*time.Millisecond, "requests are spaced 50ms apart")
+}
+
+func TestNewLimiterRejectsInvalidDefinitions(t *testing.T) {
+	s := store.NewMemoryStore()
+	_, err := middleware.NewLimiter(s, middleware.LimitDefinition{Algorithm: "gcra", Limit: 1, Window: time.Second})
+	assert.Error(t, err)
+	_, err = middleware.NewLimiter(s, middleware.LimitDefinition{Algorithm: middleware.AlgorithmTokenBucket, Window: time.Second})
+	assert.Error(t, err)
+	_, err = middleware.NewLimiter(s, middleware.LimitDefinition{Limit: 1, Window: time.Second, Burst: -1})
+	assert.Error(t, err)
+}
+
+// scriptingStore answers script evaluations with canned replies, recording
+// the calls, as Redis would run them
+type scriptingStore struct {
+	*store.MemoryStore
+	replies []interface{}
+	keys    []string
+	args    [][]string
+}
+
+func (s *scriptingStore) Scripts() bool { return true }
+
+func (s *scriptingStore) Eval(_ context.Context, _ string, keys []string, args ...string) (interface{}, error) {
+	s.keys = append(s.keys, keys...)
+	s.args = append(s.args, args)
+	reply := s.replies[0]
+	s.replies = s.replies[1:]
+	return reply, nil
+}
+
+func TestLimitersRunScriptsOnScriptingStores(t *testing.T) {
+	scripts := &scriptingStore{MemoryStore: store.NewMemoryStore()}
+	_, ok := store.ScriptsOf(scripts)
+	assert.True(t, ok)
+	_, ok = store.ScriptsOf(store.NewFailStaticStore(scripts, 0, testLogger{}, nil))
+	assert.True(t, ok)
+	_, ok = store.ScriptsOf(store.NewFailStaticStore(store.NewMemoryStore(), 0, testLogger{}, nil))
+	assert.False(t, ok, "scripts depend on the wrapped store")
+
+	tb, err := middleware.NewLimiter(scripts, middleware.LimitDefinition{Name: "login", Algorithm: middleware.AlgorithmTokenBucket, Limit: 60, Window: time.Minute, Burst: 5})
+	require.NoError(t, err)
+	scripts.replies = []interface{}{
+		[]interface{}{int64(1), []byte("2.500000")},
+		[]interface{}{int64(0), []byte("0.250000")},
+	}
+	d, err := tb.Allow(context.Background(), "1.2.3.4")
+	require.NoError(t, err)
+	assert.True(t, d.Allowed)
+	assert.Equal(t, 2, d.Remaining)
+	assert.Equal(t, time.Minute, d.Window)
+	d, err = tb.Allow(context.Background(), "1.2.3.4")
+	require.NoError(t, err)
+	assert.False(t, d.Allowed)
+	assert.Equal(t, 750*time.Millisecond, d.RetryAfter)
+	assert.Equal(t, "ratelimit:login:tb:1.2.3.4", scripts.keys[0])
+	assert.Equal(t, []string{"5", "1000000000"}, scripts.args[0][1:3], "capacity and nanoseconds per token")
+
+	swl, err := middleware.NewLimiter(scripts, middleware.LimitDefinition{Algorithm: middleware.AlgorithmSlidingWindowLog, Limit: 3, Window: time.Minute})
+	require.NoError(t, err)
+	oldest := time.Now().Add(-45 * time.Second)
+	scripts.replies = []interface{}{[]interface{}{int64(0), int64(3), []byte(strconv.FormatInt(oldest.UnixNano(), 36))}}
+	d, err = swl.Allow(context.Background(), "1.2.3.4")
+	require.NoError(t, err)
+	assert.False(t, d.Allowed)
+	assert.InDelta(t, 15*time.Second, d.RetryAfter, float64(time.Second))
+	assert.Equal(t, "ratelimit:swl:1.2.3.4", scripts.keys[2])
+
+	lb, err := middleware.NewLimiter(scripts, middleware.LimitDefinition{Algorithm: middleware.AlgorithmLeakyBucket, Limit: 60, Window: time.Minute, Burst: 2})
+	require.NoError(t, err)
+	drainAt := time.Now().Add(2 * time.Second)
+	scripts.replies = []interface{}{[]interface{}{int64(1), []byte(strconv.FormatInt(drainAt.UnixNano(), 10))}}
+	d, err = lb.Allow(context.Background(), "1.2.3.4")
+	require.NoError(t, err)
+	assert.True(t, d.Allowed)
+	assert.InDelta(t, time.Second, d.Delay, float64(100*time.Millisecond))
+	assert.Equal(t, 1, d.Remaining)
+
+	scripts.replies = []interface{}{int64(1)}
+	_, err = lb.Allow(context.Background(), "1.2.3.4")
+	assert.Error(t, err, "malformed replies are errors, which the middleware fails open on")
+}
+
+func TestRateLimitPoliciesPerIdentityAndRoute(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	m := admin.NewManager(s, testLogger{}, nil, admin.RateLimitPolicyKind())
+	put := func(name, spec string) {
+		_, _, err := m.Put(ctx, "rate-limit-policy", name, json.RawMessage(spec), admin.Preconditions{})
+		require.NoError(t, err, name)
+	}
+	put("login", `{"routes":["/auth/login"],"limit":1}`)
+	put("health", `{"routes":["/health"],"limit":3}`)
+	put("partners", `{"roles":["partner"],"limit":5}`)
+	put("alice", `{"users":["alice"],"roles":["partner"],"limit":2}`)
+	put("batch", `{"api_keys":["batch"],"routes":["/reports"],"limit":1}`)
+	_, _, err := m.Put(ctx, "rate-limit-policy", "bad", json.RawMessage(`{"routes":["reports"],"limit":1}`), admin.Preconditions{})
+	require.Error(t, err)
+
+	policies := middleware.NewRateLimitPolicies(s, middleware.AdminRateLimitPolicies(m), time.Nanosecond, testLogger{}, nil)
+	router := setupTestRouter()
+	router.Use(policies.Middleware())
+	authenticate := func(c *gin.Context) {
+		if id := c.GetHeader("X-User"); id != "" {
+			c.Set("user", &interfaces.UserInfo{ID: id, Roles: strings.Split(c.GetHeader("X-Roles"), ",")})
+		}
+	}
+	router.Use(authenticate, policies.Middleware())
+	router.Any("/*path", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	request := func(path, user, roles string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		if user != "" {
+			req.Header.Set("X-User", user)
+			req.Header.Set("X-Roles", roles)
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+	expect := func(path, user, roles string, allowed int) {
+		for i := 0; i < allowed; i++ {
+			w := request(path, user, roles)
+			require.Equal(t, http.StatusOK, w.Code, "%s %s request %d", path, user, i+1)
+			assert.Equal(t, strconv.Itoa(allowed), w.Header().Get(middleware.HeaderRateLimitLimit))
+		}
+		assert.Equal(t, http.StatusTooManyRequests, request(path, user, roles).Code, "%s %s over the limit", path, user)
+	}
+
+	// The longest route wins, and each caller has its own budget
+	expect("/auth/login", "", "", 1)
+	expect("/health", "", "", 3)
+	// Once signed in, users outrank roles; selectors combine
+	expect("/profile", "bob", "partner", 5)
+	expect("/profile", "alice", "partner", 2)
+	expect("/reports/daily", "apikey:batch", "", 1)
+
+	// Priority overrides specificity, and changes apply at runtime
+	put("override", `{"routes":["/"],"limit":4,"priority":1}`)
+	expect("/profile", "carol", "partner", 4)
+	require.NoError(t, m.Delete(ctx, "rate-limit-policy", "override", admin.Preconditions{}))
+	assert.Equal(t, http.StatusOK, request("/other", "", "").Code)
+	assert.Empty(t, request("/other", "", "").Header().Get(middleware.HeaderRateLimitLimit))
+}
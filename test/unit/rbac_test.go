@@ -0,0 +1,671 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/api"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/policy"
+	"github.com/lsendel/impl-zamaz/pkg/rbac"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+func newRBACRouter(m *rbac.Manager) *gin.Engine {
+	handlers := api.NewHandlers().WithRBAC(m)
+	r := setupTestRouter()
+	group := r.Group("/rbac", func(c *gin.Context) {
+		c.Set("user", &interfaces.UserInfo{ID: c.GetHeader("X-User")})
+	})
+	group.GET("/roles", handlers.GetRoles)
+	group.POST("/roles", handlers.CreateRole)
+	group.GET("/roles/:id", handlers.GetRole)
+	group.PUT("/roles/:id", handlers.UpdateRole)
+	group.DELETE("/roles/:id", handlers.DeleteRole)
+	group.GET("/permissions", handlers.GetPermissions)
+	group.POST("/permissions", handlers.CreatePermission)
+	group.DELETE("/permissions/:name", handlers.DeletePermission)
+	group.POST("/assign", handlers.AssignRole)
+	group.GET("/users/:id/roles", handlers.GetUserRoles)
+	group.DELETE("/users/:id/roles/:role", handlers.UnassignRole)
+	group.GET("/users/:id/permissions", handlers.GetUserPermissions)
+	group.POST("/check", handlers.CheckPermission)
+	group.POST("/elevations", handlers.RequestElevation)
+	group.GET("/elevations", handlers.GetElevations)
+	group.GET("/elevations/:id", handlers.GetElevation)
+	group.POST("/elevations/:id/approve", handlers.ApproveElevation)
+	group.POST("/elevations/:id/deny", handlers.DenyElevation)
+	group.GET("/constraints", handlers.GetConstraints)
+	group.POST("/constraints", handlers.CreateConstraint)
+	group.GET("/constraints/violations", handlers.GetViolations)
+	group.DELETE("/constraints/:id", handlers.DeleteConstraint)
+	group.GET("/audit", handlers.GetRBACAudit)
+	return r
+}
+
+func TestRBACRoles(t *testing.T) {
+	ctx := context.Background()
+	m := rbac.NewManager(rbac.Config{MaxRoles: 2}, store.NewMemoryStore())
+	for _, name := range []string{"devices:read", "devices:write", "sessions:read"} {
+		_, err := m.CreatePermission(ctx, rbac.Permission{Name: name})
+		require.NoError(t, err)
+	}
+	_, err := m.CreatePermission(ctx, rbac.Permission{Name: "devices:read"})
+	assert.True(t, errors.Is(err, rbac.ErrExists))
+	for _, name := range []string{"devices", "Devices:Read", "devices:", ":read", "devices:read:all:now", "devices:*"} {
+		_, err := m.CreatePermission(ctx, rbac.Permission{Name: name})
+		assert.True(t, errors.Is(err, rbac.ErrInvalid), name)
+	}
+
+	support, err := m.CreateRole(ctx, rbac.Role{Name: "support", Permissions: []string{"sessions:read", "devices:read", "devices:read"}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"devices:read", "sessions:read"}, support.Permissions)
+	_, err = m.CreateRole(ctx, rbac.Role{Name: "support"})
+	assert.True(t, errors.Is(err, rbac.ErrExists))
+	_, err = m.CreateRole(ctx, rbac.Role{Name: "auditor", Permissions: []string{"audit:read"}})
+	assert.True(t, errors.Is(err, rbac.ErrInvalid), "unregistered permission")
+	_, err = m.CreateRole(ctx, rbac.Role{Name: "Support Team"})
+	assert.True(t, errors.Is(err, rbac.ErrInvalid), "name")
+	operator, err := m.CreateRole(ctx, rbac.Role{Name: "operator", Permissions: []string{"devices:write"}})
+	require.NoError(t, err)
+	_, err = m.CreateRole(ctx, rbac.Role{Name: "viewer"})
+	assert.True(t, errors.Is(err, rbac.ErrLimit))
+
+	// Renaming frees the old name and may not take another's
+	_, err = m.UpdateRole(ctx, operator.ID, rbac.Role{Name: "support"})
+	assert.True(t, errors.Is(err, rbac.ErrExists))
+	renamed, err := m.UpdateRole(ctx, operator.ID, rbac.Role{Name: "device-operator", Permissions: []string{"devices:read", "devices:write"}})
+	require.NoError(t, err)
+	assert.Equal(t, operator.CreatedAt, renamed.CreatedAt)
+	_, err = m.UpdateRole(ctx, support.ID, rbac.Role{Name: "operator", Permissions: support.Permissions})
+	require.NoError(t, err)
+
+	_, err = m.Assign(ctx, rbac.Assignment{UserID: "u-1", RoleID: support.ID, AssignedBy: "admin"})
+	require.NoError(t, err)
+	_, err = m.Assign(ctx, rbac.Assignment{UserID: "u-1", RoleID: operator.ID, AssignedBy: "admin"})
+	require.NoError(t, err)
+	_, err = m.Assign(ctx, rbac.Assignment{UserID: "u-1", RoleID: operator.ID, AssignedBy: "admin"})
+	assert.True(t, errors.Is(err, rbac.ErrExists))
+	_, err = m.Assign(ctx, rbac.Assignment{UserID: "u-1", RoleID: "missing", AssignedBy: "admin"})
+	assert.True(t, errors.Is(err, rbac.ErrNotFound))
+
+	roles, err := m.UserRoles(ctx, "u-1")
+	require.NoError(t, err)
+	require.Len(t, roles, 2)
+	assert.Equal(t, "device-operator", roles[0].Name)
+	permissions, err := m.UserPermissions(ctx, "u-1", false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"devices:read", "devices:write", "sessions:read"}, permissions)
+	permissions, err = m.UserPermissions(ctx, "u-2", false)
+	require.NoError(t, err)
+	assert.Empty(t, permissions)
+
+	// What is in use cannot be deleted
+	assert.True(t, errors.Is(m.DeletePermission(ctx, "devices:write"), rbac.ErrInUse))
+	assert.True(t, errors.Is(m.DeleteRole(ctx, operator.ID), rbac.ErrInUse))
+	require.NoError(t, m.Unassign(ctx, "u-1", operator.ID))
+	assert.True(t, errors.Is(m.Unassign(ctx, "u-1", operator.ID), rbac.ErrNotFound))
+	require.NoError(t, m.DeleteRole(ctx, operator.ID))
+	require.NoError(t, m.DeletePermission(ctx, "devices:write"))
+	_, err = m.CreateRole(ctx, rbac.Role{Name: "device-operator"})
+	require.NoError(t, err, "name is free again")
+}
+
+func TestRBACAPI(t *testing.T) {
+	r := newRBACRouter(rbac.NewManager(rbac.Config{}, store.NewMemoryStore()))
+	headers := map[string]string{"X-User": "alice", "Content-Type": "application/json"}
+
+	w := adminRequest(r, http.MethodPost, "/rbac/permissions", `{"name":"devices:read","description":"View devices"}`, headers)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	w = adminRequest(r, http.MethodPost, "/rbac/permissions", `{"name":"devices:read"}`, headers)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	w = adminRequest(r, http.MethodPost, "/rbac/roles", `{"name":"support","permissions":["devices:write"]}`, headers)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = adminRequest(r, http.MethodPost, "/rbac/roles", `{"name":"support","permissions":["devices:read"]}`, headers)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var role rbac.Role
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &role))
+
+	w = adminRequest(r, http.MethodPost, "/rbac/assign", `{"user_id":"bob","role_id":"`+role.ID+`"}`, headers)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), `"assigned_by":"alice"`)
+	w = adminRequest(r, http.MethodGet, "/rbac/users/bob/permissions", "", headers)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"permissions":["devices:read"]`)
+	w = adminRequest(r, http.MethodGet, "/rbac/users/bob/roles", "", headers)
+	assert.Contains(t, w.Body.String(), `"total":1`)
+
+	w = adminRequest(r, http.MethodDelete, "/rbac/roles/"+role.ID, "", headers)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	w = adminRequest(r, http.MethodDelete, "/rbac/users/bob/roles/"+role.ID, "", headers)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = adminRequest(r, http.MethodPut, "/rbac/roles/"+role.ID, `{"name":"helpdesk"}`, headers)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"permissions":[]`)
+	w = adminRequest(r, http.MethodDelete, "/rbac/roles/"+role.ID, "", headers)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = adminRequest(r, http.MethodGet, "/rbac/roles/"+role.ID, "", headers)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = adminRequest(r, http.MethodDelete, "/rbac/permissions/devices:read", "", headers)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = adminRequest(r, http.MethodGet, "/rbac/permissions", "", headers)
+	assert.Contains(t, w.Body.String(), `"total":0`)
+}
+
+func TestRBACInheritance(t *testing.T) {
+	ctx := context.Background()
+	m := rbac.NewManager(rbac.Config{}, store.NewMemoryStore())
+	for _, name := range []string{"profile:read", "devices:read", "devices:write"} {
+		_, err := m.CreatePermission(ctx, rbac.Permission{Name: name})
+		require.NoError(t, err)
+	}
+	user, err := m.CreateRole(ctx, rbac.Role{Name: "user", Permissions: []string{"profile:read"}})
+	require.NoError(t, err)
+	operator, err := m.CreateRole(ctx, rbac.Role{Name: "operator", Permissions: []string{"devices:read"}, Inherits: []string{user.ID}})
+	require.NoError(t, err)
+	admin, err := m.CreateRole(ctx, rbac.Role{Name: "admin", Permissions: []string{"devices:write"}, Inherits: []string{operator.ID}})
+	require.NoError(t, err)
+	_, err = m.CreateRole(ctx, rbac.Role{Name: "orphan", Inherits: []string{"missing"}})
+	assert.True(t, errors.Is(err, rbac.ErrInvalid))
+
+	// Neither directly nor through others may a role inherit itself
+	_, err = m.UpdateRole(ctx, user.ID, rbac.Role{Name: "user", Inherits: []string{user.ID}})
+	assert.True(t, errors.Is(err, rbac.ErrInvalid))
+	_, err = m.UpdateRole(ctx, user.ID, rbac.Role{Name: "user", Inherits: []string{admin.ID}})
+	assert.True(t, errors.Is(err, rbac.ErrInvalid))
+
+	_, err = m.Assign(ctx, rbac.Assignment{UserID: "u-1", RoleID: admin.ID, AssignedBy: "root"})
+	require.NoError(t, err)
+	permissions, err := m.UserPermissions(ctx, "u-1", false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"devices:write"}, permissions)
+	permissions, err = m.UserPermissions(ctx, "u-1", true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"devices:read", "devices:write", "profile:read"}, permissions)
+
+	assert.True(t, errors.Is(m.DeleteRole(ctx, operator.ID), rbac.ErrInUse))
+
+	// A loop written around the checks, e.g. by two replicas at once, is
+	// followed once round
+	s := store.NewMemoryStore()
+	looped := rbac.NewManager(rbac.Config{}, s)
+	a, err := looped.CreateRole(ctx, rbac.Role{Name: "a"})
+	require.NoError(t, err)
+	b, err := looped.CreateRole(ctx, rbac.Role{Name: "b", Inherits: []string{a.ID}})
+	require.NoError(t, err)
+	a.Inherits = []string{b.ID}
+	data, err := json.Marshal(a)
+	require.NoError(t, err)
+	require.NoError(t, s.Set(ctx, "rbac:role:"+a.ID, data, 0))
+	roles, err := looped.EffectiveRoles(ctx, []*rbac.Role{a})
+	require.NoError(t, err)
+	assert.Len(t, roles, 2)
+
+	r := newRBACRouter(m)
+	w := adminRequest(r, http.MethodGet, "/rbac/users/u-1/permissions?effective=true", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"effective":true,"permissions":["devices:read","devices:write","profile:read"]`)
+	w = adminRequest(r, http.MethodGet, "/rbac/users/u-1/permissions?effective=maybe", "", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestRBACConditions(t *testing.T) {
+	ctx := context.Background()
+	m := rbac.NewManager(rbac.Config{}, store.NewMemoryStore())
+	for _, name := range []string{"payroll:read", "payroll:approve"} {
+		_, err := m.CreatePermission(ctx, rbac.Permission{Name: name})
+		require.NoError(t, err)
+	}
+	finance := []policy.Condition{{Attribute: "department", Operator: policy.OpEquals, Values: []string{"finance"}}}
+	viewer, err := m.CreateRole(ctx, rbac.Role{Name: "payroll-viewer", Permissions: []string{"payroll:read"}})
+	require.NoError(t, err)
+	approver, err := m.CreateRole(ctx, rbac.Role{
+		Name: "payroll-approver", Permissions: []string{"payroll:approve"}, Inherits: []string{viewer.ID},
+		Conditions: map[string][]policy.Condition{
+			"payroll:approve": {{Attribute: rbac.AttributeTrustScore, Operator: policy.OpGreaterOrEqual, Values: []string{"70"}}},
+		},
+	})
+	require.NoError(t, err)
+	_, err = m.Assign(ctx, rbac.Assignment{UserID: "u-1", RoleID: approver.ID, Conditions: finance})
+	require.NoError(t, err)
+
+	for _, bad := range []rbac.Role{
+		{Name: "x", Conditions: map[string][]policy.Condition{"payroll:read": finance}},
+		{Name: "x", Permissions: []string{"payroll:read"}, Conditions: map[string][]policy.Condition{"payroll:read": {{Attribute: "department", Operator: "like"}}}},
+	} {
+		_, err := m.CreateRole(ctx, bad)
+		assert.True(t, errors.Is(err, rbac.ErrInvalid))
+	}
+	_, err = m.Assign(ctx, rbac.Assignment{UserID: "u-2", RoleID: viewer.ID, Conditions: []policy.Condition{{Attribute: "tenant", Operator: policy.OpIn}}})
+	assert.True(t, errors.Is(err, rbac.ErrInvalid))
+
+	for _, tc := range []struct {
+		permission string
+		attributes map[string]string
+		allowed    bool
+		reason     string
+	}{
+		{"payroll:read", map[string]string{"department": "finance"}, true, "granted by role"},
+		{"payroll:read", map[string]string{"department": "sales"}, false, "no role grants the permission"},
+		{"payroll:approve", map[string]string{"department": "finance", "trust_score": "80"}, true, "granted by role"},
+		{"payroll:approve", map[string]string{"department": "finance", "trust_score": "40"}, false, "conditions of the grant do not hold"},
+		{"payroll:delete", map[string]string{"department": "finance"}, false, "no role grants the permission"},
+	} {
+		decision, err := m.Check(ctx, rbac.CheckRequest{User: "u-1", Permission: tc.permission, Attributes: tc.attributes})
+		require.NoError(t, err)
+		assert.Equal(t, tc.allowed, decision.Allowed, tc.permission, tc.attributes)
+		assert.Equal(t, tc.reason, decision.Reason)
+	}
+	decision, err := m.Check(ctx, rbac.CheckRequest{User: "u-1", Permission: "payroll:read", Attributes: map[string]string{"department": "finance"}})
+	require.NoError(t, err)
+	assert.Equal(t, &rbac.Grant{RoleID: viewer.ID, Role: "payroll-viewer", Permission: "payroll:read"}, decision.Grant)
+
+	// The middleware tests the user's directory attributes and trust score
+	for _, tc := range []struct {
+		department string
+		trust      int
+		status     int
+	}{
+		{"finance", 90, http.StatusOK},
+		{"finance", 50, http.StatusForbidden},
+		{"sales", 90, http.StatusForbidden},
+	} {
+		r := setupTestRouter()
+		r.POST("/payroll/approve", func(c *gin.Context) {
+			c.Set("user", &interfaces.UserInfo{ID: "u-1", Attributes: map[string]string{"department": tc.department}})
+		}, rbac.Require(m, "payroll:approve", rbac.RequireConfig{Trust: staticTrust(tc.trust)}, testLogger{}), func(c *gin.Context) {
+			c.Status(http.StatusOK)
+		})
+		w := adminRequest(r, http.MethodPost, "/payroll/approve", "", nil)
+		assert.Equal(t, tc.status, w.Code, tc.department, tc.trust)
+		if w.Code == http.StatusForbidden {
+			assert.Contains(t, w.Body.String(), `"code":"PERMISSION_DENIED"`)
+		}
+	}
+	r := setupTestRouter()
+	r.GET("/payroll", rbac.Require(m, "payroll:read", rbac.RequireConfig{}, testLogger{}))
+	assert.Equal(t, http.StatusUnauthorized, adminRequest(r, http.MethodGet, "/payroll", "", nil).Code)
+}
+
+func TestRBACTimeBoundAssignments(t *testing.T) {
+	ctx := context.Background()
+	m := rbac.NewManager(rbac.Config{}, store.NewMemoryStore())
+	_, err := m.CreatePermission(ctx, rbac.Permission{Name: "prod:deploy"})
+	require.NoError(t, err)
+	deployer, err := m.CreateRole(ctx, rbac.Role{Name: "deployer", Permissions: []string{"prod:deploy"}})
+	require.NoError(t, err)
+
+	past := time.Now().Add(-time.Minute)
+	_, err = m.Assign(ctx, rbac.Assignment{UserID: "u-1", RoleID: deployer.ID, ExpiresAt: &past})
+	assert.True(t, errors.Is(err, rbac.ErrInvalid))
+	soon := time.Now().Add(50 * time.Millisecond)
+	_, err = m.Assign(ctx, rbac.Assignment{UserID: "u-1", RoleID: deployer.ID, ExpiresAt: &soon})
+	require.NoError(t, err)
+	check := rbac.CheckRequest{User: "u-1", Permission: "prod:deploy"}
+	decision, err := m.Check(ctx, check)
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed)
+
+	// A lapsed assignment no longer counts, even before it is reaped, and
+	// may be made again
+	time.Sleep(100 * time.Millisecond)
+	decision, err = m.Check(ctx, check)
+	require.NoError(t, err)
+	assert.False(t, decision.Allowed)
+	roles, err := m.UserRoles(ctx, "u-1")
+	require.NoError(t, err)
+	assert.Empty(t, roles)
+	_, err = m.Assign(ctx, rbac.Assignment{UserID: "u-2", RoleID: deployer.ID, ExpiresAt: &soon})
+	assert.True(t, errors.Is(err, rbac.ErrInvalid))
+	later := time.Now().Add(50 * time.Millisecond)
+	_, err = m.Assign(ctx, rbac.Assignment{UserID: "u-2", RoleID: deployer.ID, ExpiresAt: &later})
+	require.NoError(t, err)
+	_, err = m.Assign(ctx, rbac.Assignment{UserID: "u-3", RoleID: deployer.ID})
+	require.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+	_, err = m.Assign(ctx, rbac.Assignment{UserID: "u-2", RoleID: deployer.ID})
+	require.NoError(t, err)
+
+	reaped, err := m.Reap(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, reaped)
+	require.NoError(t, m.Unassign(ctx, "u-2", deployer.ID))
+	require.NoError(t, m.Unassign(ctx, "u-3", deployer.ID))
+	require.NoError(t, m.DeleteRole(ctx, deployer.ID))
+}
+
+func TestRBACElevations(t *testing.T) {
+	ctx := context.Background()
+	m := rbac.NewManager(rbac.Config{MaxElevation: 2 * time.Hour}, store.NewMemoryStore())
+	_, err := m.CreatePermission(ctx, rbac.Permission{Name: "prod:deploy"})
+	require.NoError(t, err)
+	deployer, err := m.CreateRole(ctx, rbac.Role{Name: "deployer", Permissions: []string{"prod:deploy"}})
+	require.NoError(t, err)
+	r := newRBACRouter(m)
+	bob := map[string]string{"X-User": "bob", "Content-Type": "application/json"}
+	alice := map[string]string{"X-User": "alice", "Content-Type": "application/json"}
+	carol := map[string]string{"X-User": "carol", "Content-Type": "application/json"}
+
+	for _, body := range []string{
+		`{"role_id":"` + deployer.ID + `","reason":"INC-1","duration":"3h"}`,
+		`{"role_id":"` + deployer.ID + `","reason":"INC-1","duration":"soon"}`,
+		`{"role_id":"` + deployer.ID + `","duration":"1h"}`,
+	} {
+		w := adminRequest(r, http.MethodPost, "/rbac/elevations", body, bob)
+		assert.Equal(t, http.StatusBadRequest, w.Code, body)
+	}
+	w := adminRequest(r, http.MethodPost, "/rbac/elevations", `{"role_id":"`+deployer.ID+`","reason":"INC-1","duration":"1h"}`, bob)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var elevation rbac.Elevation
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &elevation))
+	assert.Equal(t, rbac.ElevationPending, elevation.Status)
+	assert.Equal(t, "bob", elevation.UserID)
+
+	w = adminRequest(r, http.MethodGet, "/rbac/elevations?status=pending", "", alice)
+	assert.Contains(t, w.Body.String(), `"total":1`)
+	w = adminRequest(r, http.MethodPost, "/rbac/elevations/"+elevation.ID+"/approve", "", bob)
+	assert.Equal(t, http.StatusForbidden, w.Code, "no self-approval")
+	assert.Contains(t, w.Body.String(), "ELEVATION_APPROVER_INVALID")
+
+	w = adminRequest(r, http.MethodPost, "/rbac/elevations/"+elevation.ID+"/approve", "", alice)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var assignment rbac.Assignment
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &assignment))
+	assert.Equal(t, "alice", assignment.ApprovedBy)
+	require.NotNil(t, assignment.ExpiresAt)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), *assignment.ExpiresAt, time.Minute)
+	decision, err := m.Check(ctx, rbac.CheckRequest{User: "bob", Permission: "prod:deploy"})
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed)
+	w = adminRequest(r, http.MethodPost, "/rbac/elevations/"+elevation.ID+"/deny", "", carol)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), "ELEVATION_CLOSED")
+
+	// Assigning with an approver waits for that approver
+	until := time.Now().Add(30 * time.Minute).UTC().Format(time.RFC3339)
+	w = adminRequest(r, http.MethodPost, "/rbac/assign", `{"user_id":"dave","role_id":"`+deployer.ID+`","expires_at":"`+until+`","approver":"carol","reason":"release"}`, alice)
+	require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &elevation))
+	w = adminRequest(r, http.MethodPost, "/rbac/elevations/"+elevation.ID+"/approve", "", alice)
+	assert.Equal(t, http.StatusForbidden, w.Code, "another approver is named")
+	w = adminRequest(r, http.MethodPost, "/rbac/elevations/"+elevation.ID+"/deny", "", carol)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"status":"denied"`)
+	w = adminRequest(r, http.MethodGet, "/rbac/users/dave/roles", "", alice)
+	assert.Contains(t, w.Body.String(), `"total":0`)
+}
+
+func TestRBACCheckAPI(t *testing.T) {
+	ctx := context.Background()
+	m := rbac.NewManager(rbac.Config{}, store.NewMemoryStore())
+	_, err := m.CreatePermission(ctx, rbac.Permission{Name: "invoices:approve"})
+	require.NoError(t, err)
+	approver, err := m.CreateRole(ctx, rbac.Role{
+		Name: "invoice-approver", Permissions: []string{"invoices:approve"},
+		Conditions: map[string][]policy.Condition{
+			"invoices:approve": {{Attribute: "department", Operator: policy.OpEquals, Values: []string{"finance"}}},
+		},
+	})
+	require.NoError(t, err)
+	_, err = m.Assign(ctx, rbac.Assignment{UserID: "u-1", RoleID: approver.ID})
+	require.NoError(t, err)
+	r := newRBACRouter(m)
+	headers := map[string]string{"X-User": "billing-service", "Content-Type": "application/json"}
+
+	w := adminRequest(r, http.MethodPost, "/rbac/check", `{"subject":"u-1","resource":"invoices","action":"approve","context":{"department":"finance"}}`, headers)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var decision rbac.Decision
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &decision))
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, &rbac.Grant{RoleID: approver.ID, Role: "invoice-approver", Permission: "invoices:approve"}, decision.Grant)
+
+	w = adminRequest(r, http.MethodPost, "/rbac/check", `{"subject":"u-1","resource":"invoices","action":"approve"}`, headers)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"allowed":false,"reason":"conditions of the grant do not hold"}`, w.Body.String())
+	w = adminRequest(r, http.MethodPost, "/rbac/check", `{"subject":"u-2","resource":"invoices","action":"approve"}`, headers)
+	assert.JSONEq(t, `{"allowed":false,"reason":"no role grants the permission"}`, w.Body.String())
+	w = adminRequest(r, http.MethodPost, "/rbac/check", `{"subject":"u-1","resource":"invoices"}`, headers)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestRBACSeparationOfDuties(t *testing.T) {
+	ctx := context.Background()
+	m := rbac.NewManager(rbac.Config{}, store.NewMemoryStore())
+	requester, err := m.CreateRole(ctx, rbac.Role{Name: "requester"})
+	require.NoError(t, err)
+	approver, err := m.CreateRole(ctx, rbac.Role{Name: "approver"})
+	require.NoError(t, err)
+	lead, err := m.CreateRole(ctx, rbac.Role{Name: "lead"})
+	require.NoError(t, err)
+	_, err = m.Assign(ctx, rbac.Assignment{UserID: "u-1", RoleID: requester.ID})
+	require.NoError(t, err)
+	_, err = m.Assign(ctx, rbac.Assignment{UserID: "u-1", RoleID: approver.ID})
+	require.NoError(t, err)
+	r := newRBACRouter(m)
+	headers := map[string]string{"X-User": "alice", "Content-Type": "application/json"}
+
+	for _, body := range []string{
+		`{"roles":["` + requester.ID + `"]}`,
+		`{"roles":["` + requester.ID + `","` + requester.ID + `"]}`,
+		`{"roles":["` + requester.ID + `","missing"]}`,
+	} {
+		w := adminRequest(r, http.MethodPost, "/rbac/constraints", body, headers)
+		assert.Equal(t, http.StatusBadRequest, w.Code, body)
+	}
+	w := adminRequest(r, http.MethodPost, "/rbac/constraints", `{"roles":["`+requester.ID+`","`+approver.ID+`"],"description":"No approving own requests"}`, headers)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var constraint rbac.Constraint
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &constraint))
+	assert.Equal(t, "alice", constraint.CreatedBy)
+	w = adminRequest(r, http.MethodPost, "/rbac/constraints", `{"roles":["`+approver.ID+`","`+requester.ID+`"]}`, headers)
+	assert.Equal(t, http.StatusConflict, w.Code, "the same pair either way round")
+
+	// Users holding both before the constraint are reported, not removed
+	w = adminRequest(r, http.MethodGet, "/rbac/constraints/violations", "", headers)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"user_id":"u-1"`)
+	assert.Contains(t, w.Body.String(), `"total":1`)
+
+	_, err = m.Assign(ctx, rbac.Assignment{UserID: "u-2", RoleID: requester.ID})
+	require.NoError(t, err)
+	w = adminRequest(r, http.MethodPost, "/rbac/assign", `{"user_id":"u-2","role_id":"`+approver.ID+`"}`, headers)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), "SEPARATION_OF_DUTIES")
+	_, err = m.RequestElevation(ctx, rbac.Elevation{UserID: "u-2", RoleID: approver.ID, RequestedBy: "u-2"})
+	assert.True(t, errors.Is(err, rbac.ErrSeparation), "elevations are refused up front")
+
+	// Inheriting a role counts as holding it
+	_, err = m.UpdateRole(ctx, lead.ID, rbac.Role{Name: "lead", Inherits: []string{approver.ID}})
+	require.NoError(t, err)
+	_, err = m.Assign(ctx, rbac.Assignment{UserID: "u-2", RoleID: lead.ID})
+	assert.True(t, errors.Is(err, rbac.ErrSeparation))
+	_, err = m.Assign(ctx, rbac.Assignment{UserID: "u-3", RoleID: lead.ID})
+	require.NoError(t, err)
+	_, err = m.Assign(ctx, rbac.Assignment{UserID: "u-3", RoleID: requester.ID})
+	assert.True(t, errors.Is(err, rbac.ErrSeparation))
+
+	assert.True(t, errors.Is(m.DeleteRole(ctx, requester.ID), rbac.ErrInUse))
+	w = adminRequest(r, http.MethodDelete, "/rbac/constraints/"+constraint.ID, "", headers)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = adminRequest(r, http.MethodGet, "/rbac/constraints/violations", "", headers)
+	assert.JSONEq(t, `{"violations":[],"total":0}`, w.Body.String())
+	_, err = m.Assign(ctx, rbac.Assignment{UserID: "u-2", RoleID: approver.ID})
+	require.NoError(t, err)
+}
+
+func TestRBACPermissionMatcher(t *testing.T) {
+	matcher := rbac.NewMatcher("billing:invoices:read", "billing:*:read", "billing:*", "*:invoices:*", "devices:read")
+	for _, tc := range []struct {
+		permission string
+		matched    []string
+	}{
+		{"billing:invoices:read", []string{"billing:invoices:read", "billing:*:read", "billing:*", "*:invoices:*"}},
+		{"billing:payments:read", []string{"billing:*:read", "billing:*"}},
+		{"billing:payments", []string{"billing:*"}},
+		{"crm:invoices:write", []string{"*:invoices:*"}},
+		{"devices:read", []string{"devices:read"}},
+		{"devices:write", nil},
+		{"devices:read:all", nil},
+		{"crm:contacts:read", nil},
+	} {
+		assert.Equal(t, tc.matched, matcher.Match(tc.permission), tc.permission)
+	}
+	assert.True(t, rbac.MatchPermission("*:*", "billing:invoices:read"))
+	assert.False(t, rbac.MatchPermission("billing:invoices", "billing:invoices:read"))
+}
+
+func TestRBACScopedPermissions(t *testing.T) {
+	ctx := context.Background()
+	m := rbac.NewManager(rbac.Config{}, store.NewMemoryStore())
+	for _, name := range []string{"billing:invoices:read", "billing:invoices:delete", "billing:payments:read"} {
+		_, err := m.CreatePermission(ctx, rbac.Permission{Name: name})
+		require.NoError(t, err)
+	}
+	for _, bad := range []rbac.Role{
+		{Name: "x", Permissions: []string{"billing:**"}},
+		{Name: "x", Permissions: []string{"*"}},
+		{Name: "x", Deny: []string{"billing:invoices:refund"}},
+	} {
+		_, err := m.CreateRole(ctx, bad)
+		assert.True(t, errors.Is(err, rbac.ErrInvalid), bad)
+	}
+	accountant, err := m.CreateRole(ctx, rbac.Role{Name: "accountant", Permissions: []string{"billing:*"}, Deny: []string{"billing:invoices:delete"}})
+	require.NoError(t, err)
+	reader, err := m.CreateRole(ctx, rbac.Role{Name: "reader", Permissions: []string{"billing:invoices:read"}, Deny: []string{"billing:payments:*"}})
+	require.NoError(t, err)
+	owner, err := m.CreateRole(ctx, rbac.Role{Name: "owner", Permissions: []string{"billing:invoices:delete"}})
+	require.NoError(t, err)
+	for user, role := range map[string]*rbac.Role{"u-1": accountant, "u-2": reader} {
+		_, err = m.Assign(ctx, rbac.Assignment{UserID: user, RoleID: role.ID})
+		require.NoError(t, err)
+	}
+	_, err = m.Assign(ctx, rbac.Assignment{UserID: "u-1", RoleID: owner.ID})
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		user, permission string
+		allowed          bool
+		pattern          string
+		reason           string
+	}{
+		{"u-1", "billing:payments:read", true, "billing:*", "granted by role"},
+		{"u-1", "billing:refunds:issue", true, "billing:*", "granted by role"},
+		// An explicit deny wins over a wildcard allow, and even over
+		// another role granting the permission by name
+		{"u-1", "billing:invoices:delete", false, "billing:invoices:delete", "denied by role"},
+		{"u-1", "crm:invoices:read", false, "", "no role grants the permission"},
+		// A wildcard deny wins over an explicit allow
+		{"u-2", "billing:invoices:read", true, "billing:invoices:read", "granted by role"},
+		{"u-2", "billing:payments:read", false, "billing:payments:*", "denied by role"},
+	} {
+		decision, err := m.Check(ctx, rbac.CheckRequest{User: tc.user, Permission: tc.permission})
+		require.NoError(t, err)
+		assert.Equal(t, tc.allowed, decision.Allowed, tc.user, tc.permission)
+		assert.Equal(t, tc.reason, decision.Reason, tc.user, tc.permission)
+		switch {
+		case decision.Grant != nil:
+			assert.Equal(t, tc.pattern, decision.Grant.Permission)
+		case decision.Denial != nil:
+			assert.Equal(t, tc.pattern, decision.Denial.Permission)
+		default:
+			assert.Empty(t, tc.pattern)
+		}
+	}
+
+	// Denying by name keeps the permission in use
+	assert.True(t, errors.Is(m.DeletePermission(ctx, "billing:invoices:delete"), rbac.ErrInUse))
+
+	r := newRBACRouter(m)
+	headers := map[string]string{"X-User": "billing-service", "Content-Type": "application/json"}
+	w := adminRequest(r, http.MethodPost, "/rbac/check", `{"subject":"u-1","service":"billing","resource":"payments","action":"read"}`, headers)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), `"permission":"billing:*"`)
+	w = adminRequest(r, http.MethodPost, "/rbac/check", `{"subject":"u-1","service":"billing","resource":"invoices","action":"delete"}`, headers)
+	assert.Contains(t, w.Body.String(), `"denial":{"role_id":"`+accountant.ID+`"`)
+}
+
+func TestRBACAudit(t *testing.T) {
+	ctx := context.Background()
+	m := rbac.NewManager(rbac.Config{}, store.NewMemoryStore())
+	r := newRBACRouter(m)
+	alice := map[string]string{"X-User": "alice", "Content-Type": "application/json"}
+
+	for _, name := range []string{"devices:read", "devices:write"} {
+		w := adminRequest(r, http.MethodPost, "/rbac/permissions", `{"name":"`+name+`"}`, alice)
+		require.Equal(t, http.StatusCreated, w.Code)
+	}
+	w := adminRequest(r, http.MethodPost, "/rbac/roles", `{"name":"support","permissions":["devices:read"],"reason":"TICKET-1"}`, alice)
+	require.Equal(t, http.StatusCreated, w.Code)
+	var role rbac.Role
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &role))
+	w = adminRequest(r, http.MethodPut, "/rbac/roles/"+role.ID, `{"name":"support","description":"Helpdesk","permissions":["devices:write"],"reason":"Support resets devices"}`, alice)
+	require.Equal(t, http.StatusOK, w.Code)
+	w = adminRequest(r, http.MethodPost, "/rbac/assign", `{"user_id":"bob","role_id":"`+role.ID+`","reason":"Joined support"}`, alice)
+	require.Equal(t, http.StatusCreated, w.Code)
+	w = adminRequest(r, http.MethodDelete, "/rbac/users/bob/roles/"+role.ID+"?reason=Left+support", "", alice)
+	require.Equal(t, http.StatusNoContent, w.Code)
+	// Changes outside the API are recorded too, by whoever the context
+	// names
+	_, err := m.Assign(rbac.WithChange(ctx, "groupsync", "group engineers"), rbac.Assignment{UserID: "carol", RoleID: role.ID})
+	require.NoError(t, err)
+
+	type changes struct {
+		Changes       []*rbac.Change `json:"changes"`
+		Count         int            `json:"count"`
+		NextBeforeSeq int64          `json:"next_before_seq"`
+	}
+	list := func(query string) changes {
+		w := adminRequest(r, http.MethodGet, "/rbac/audit?"+query, "", alice)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var page changes
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+		return page
+	}
+	page := list("target=" + role.ID)
+	require.Equal(t, 2, page.Count)
+	update := page.Changes[0]
+	assert.Equal(t, rbac.ActionRoleUpdate, update.Action)
+	assert.Equal(t, "alice", update.Actor)
+	assert.Equal(t, "Support resets devices", update.Reason)
+	assert.Equal(t, []rbac.FieldChange{
+		{Field: "description", After: "Helpdesk"},
+		{Field: "permissions", Before: []interface{}{"devices:read"}, After: []interface{}{"devices:write"}, Added: []string{"devices:write"}, Removed: []string{"devices:read"}},
+	}, update.Diff)
+	assert.Contains(t, string(update.Before), `"permissions":["devices:read"]`)
+	assert.Equal(t, rbac.ActionRoleCreate, page.Changes[1].Action)
+	assert.Nil(t, page.Changes[1].Before)
+
+	page = list("target=bob/" + role.ID)
+	require.Equal(t, 2, page.Count)
+	assert.Equal(t, rbac.ActionUnassign, page.Changes[0].Action)
+	assert.Equal(t, "Left support", page.Changes[0].Reason)
+	assert.Nil(t, page.Changes[0].After)
+	assert.Equal(t, "Joined support", page.Changes[1].Reason)
+
+	page = list("actor=groupsync")
+	require.Equal(t, 1, page.Count)
+	assert.Equal(t, "group engineers", page.Changes[0].Reason)
+
+	// Pages continue below the last one
+	page = list("limit=4")
+	require.Equal(t, 4, page.Count)
+	page = list("limit=4&before_seq=" + strconv.FormatInt(page.NextBeforeSeq, 10))
+	assert.Equal(t, 3, page.Count)
+	assert.Zero(t, page.NextBeforeSeq)
+	assert.Equal(t, rbac.ActionPermissionCreate, page.Changes[2].Action)
+
+	for _, query := range []string{"limit=5000", "since=yesterday", "before_seq=-1"} {
+		w = adminRequest(r, http.MethodGet, "/rbac/audit?"+query, "", alice)
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+}
@@ -0,0 +1,195 @@
+package unit
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/pkg/auth"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+const rpRedirectURL = "https://app.example.com/api/v1/auth/callback"
+
+// fakeAuthorizationServer plays the provider's side of the code flow: the
+// test "logs in" by calling approve with the authorize redirect, and the
+// token endpoint only redeems the code with the matching PKCE verifier
+type fakeAuthorizationServer struct {
+	mu        sync.Mutex
+	challenge string
+	nonce     string
+	server    *httptest.Server
+}
+
+func newFakeAuthorizationServer(t *testing.T, issuer *auth.Issuer) *fakeAuthorizationServer {
+	as := &fakeAuthorizationServer{}
+	as.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		as.mu.Lock()
+		challenge, nonce := as.challenge, as.nonce
+		as.mu.Unlock()
+
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if r.PostForm.Get("grant_type") != "authorization_code" || r.PostForm.Get("code") != "good-code" ||
+			r.PostForm.Get("redirect_uri") != rpRedirectURL || base64.RawURLEncoding.EncodeToString(sum[:]) != challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		idToken, err := issuer.Sign(map[string]interface{}{
+			"sub":                "u-alice",
+			"aud":                "spa",
+			"nonce":              nonce,
+			"preferred_username": "alice",
+			"email":              "alice@example.com",
+		}, time.Minute)
+		require.NoError(t, err)
+		accessToken, err := issuer.Sign(map[string]interface{}{
+			"sub":          "u-alice",
+			"realm_access": map[string]interface{}{"roles": []string{"user"}},
+		}, time.Minute)
+		require.NoError(t, err)
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idToken, "access_token": accessToken, "token_type": "Bearer"})
+	}))
+	t.Cleanup(as.server.Close)
+	return as
+}
+
+// approve records the challenge and nonce of an authorize redirect
+func (as *fakeAuthorizationServer) approve(t *testing.T, location string) (state string) {
+	u, err := url.Parse(location)
+	require.NoError(t, err)
+	q := u.Query()
+	assert.Equal(t, "S256", q.Get("code_challenge_method"))
+	assert.Equal(t, "code", q.Get("response_type"))
+	assert.Equal(t, rpRedirectURL, q.Get("redirect_uri"))
+	as.mu.Lock()
+	as.challenge, as.nonce = q.Get("code_challenge"), q.Get("nonce")
+	as.mu.Unlock()
+	return q.Get("state")
+}
+
+type rpHarness struct {
+	router *gin.Engine
+	as     *fakeAuthorizationServer
+	users  []interfaces.UserInfo
+}
+
+func newRPHarness(t *testing.T) *rpHarness {
+	issuer := newTestIssuer(t)
+	h := &rpHarness{router: setupTestRouter(), as: newFakeAuthorizationServer(t, issuer)}
+	keys := auth.NewJWKSClient(auth.JWKSConfig{URL: newJWKSServer(t, issuer.JWKS()).URL}, &testLogger{}, nil)
+	rp, err := auth.NewRelyingParty(auth.RelyingPartyConfig{
+		Issuer:       oidcIssuer,
+		AuthorizeURL: "https://idp.example.com/auth",
+		TokenURL:     h.as.server.URL,
+		ClientID:     "spa",
+		RedirectURL:  rpRedirectURL,
+		Complete: func(c *gin.Context, user interfaces.UserInfo) error {
+			h.users = append(h.users, user)
+			return nil
+		},
+	}, store.NewMemoryStore(), keys, &testLogger{}, nil)
+	require.NoError(t, err)
+	h.router.GET("/api/v1/auth/authorize", rp.Authorize)
+	h.router.GET("/api/v1/auth/callback", rp.Callback)
+	return h
+}
+
+// authorize starts a login and returns the provider redirect and state cookie
+func (h *rpHarness) authorize(t *testing.T, returnTo string) (string, string) {
+	w := adminRequest(h.router, http.MethodGet, "/api/v1/auth/authorize?return_to="+url.QueryEscape(returnTo), "", nil)
+	require.Equal(t, http.StatusFound, w.Code)
+	var cookie string
+	for _, c := range w.Result().Cookies() {
+		if c.Name == auth.DefaultStateCookie {
+			assert.True(t, c.HttpOnly)
+			assert.Equal(t, "/api/v1/auth/callback", c.Path)
+			cookie = c.Name + "=" + c.Value
+		}
+	}
+	require.NotEmpty(t, cookie)
+	return w.Header().Get("Location"), cookie
+}
+
+func (h *rpHarness) callback(code, state, cookie string) *httptest.ResponseRecorder {
+	return adminRequest(h.router, http.MethodGet, "/api/v1/auth/callback?code="+code+"&state="+url.QueryEscape(state), "", map[string]string{"Cookie": cookie})
+}
+
+func TestRelyingPartyCodeFlowWithPKCE(t *testing.T) {
+	h := newRPHarness(t)
+	location, cookie := h.authorize(t, "/dashboard")
+	state := h.as.approve(t, location)
+
+	w := h.callback("good-code", state, cookie)
+	require.Equal(t, http.StatusFound, w.Code, w.Body.String())
+	assert.Equal(t, "/dashboard", w.Header().Get("Location"))
+	require.Len(t, h.users, 1)
+	assert.Equal(t, "u-alice", h.users[0].ID)
+	assert.Equal(t, "alice", h.users[0].Username)
+	assert.Equal(t, []string{"user"}, h.users[0].Roles)
+
+	// Each state logs in once
+	w = h.callback("good-code", state, cookie)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "OIDC_STATE_INVALID")
+}
+
+func TestRelyingPartyRejectsForgedCallbacks(t *testing.T) {
+	h := newRPHarness(t)
+
+	// A state from another browser's login is not accepted
+	location, _ := h.authorize(t, "/")
+	state := h.as.approve(t, location)
+	_, otherCookie := h.authorize(t, "/")
+	assert.Equal(t, http.StatusBadRequest, h.callback("good-code", state, otherCookie).Code)
+
+	// A nonce from another authorization request fails the ID token check
+	location, cookie := h.authorize(t, "/")
+	state = h.as.approve(t, location)
+	other, _ := h.authorize(t, "/")
+	h.as.approve(t, other)
+	h.as.mu.Lock()
+	h.as.challenge = mustQuery(t, location, "code_challenge")
+	h.as.mu.Unlock()
+	w := h.callback("good-code", state, cookie)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), "OIDC_LOGIN_FAILED")
+
+	// A code intercepted without the verifier cannot be redeemed
+	location, cookie = h.authorize(t, "/")
+	state = h.as.approve(t, location)
+	h.as.mu.Lock()
+	h.as.challenge = "intercepted"
+	h.as.mu.Unlock()
+	assert.Equal(t, http.StatusUnauthorized, h.callback("good-code", state, cookie).Code)
+	assert.Empty(t, h.users)
+}
+
+func TestRelyingPartyReturnToIsLocal(t *testing.T) {
+	h := newRPHarness(t)
+	for _, returnTo := range []string{"https://evil.example.com", "//evil.example.com", "/\\evil.example.com"} {
+		location, cookie := h.authorize(t, returnTo)
+		state := h.as.approve(t, location)
+		w := h.callback("good-code", state, cookie)
+		require.Equal(t, http.StatusFound, w.Code)
+		assert.Equal(t, "/", w.Header().Get("Location"), returnTo)
+	}
+}
+
+func mustQuery(t *testing.T, location, name string) string {
+	u, err := url.Parse(location)
+	require.NoError(t, err)
+	return u.Query().Get(name)
+}
@@ -0,0 +1,212 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/pkg/replication"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+const testReplicationSecret = "replication-secret-0123456789abcdef"
+
+type testRegion struct {
+	local      *store.MemoryStore
+	replicator *replication.Replicator
+	router     *gin.Engine
+	server     *httptest.Server
+}
+
+// newTestRegions starts one replicating region per name, each peered with
+// all the others
+func newTestRegions(t *testing.T, names ...string) map[string]*testRegion {
+	regions := make(map[string]*testRegion, len(names))
+	for _, name := range names {
+		region := &testRegion{local: store.NewMemoryStore(), router: setupTestRouter()}
+		region.server = httptest.NewServer(region.router)
+		t.Cleanup(region.server.Close)
+		regions[name] = region
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	for _, name := range names {
+		var peers []replication.Peer
+		for _, other := range names {
+			if other != name {
+				peers = append(peers, replication.Peer{Region: other, URL: regions[other].server.URL})
+			}
+		}
+		r, err := replication.New(regions[name].local, replication.Config{
+			Region:        name,
+			Secret:        testReplicationSecret,
+			Peers:         peers,
+			FlushInterval: 10 * time.Millisecond,
+		}, testLogger{}, nil)
+		require.NoError(t, err)
+		regions[name].replicator = r
+		regions[name].router.POST(replication.Path, r.Handler())
+	}
+	for _, name := range names {
+		regions[name].replicator.Start(ctx)
+	}
+	return regions
+}
+
+func waitForValue(t *testing.T, s store.Store, key string, want []byte) {
+	t.Helper()
+	assert.Eventually(t, func() bool {
+		value, err := s.Get(context.Background(), key)
+		if want == nil {
+			return err == store.ErrNotFound
+		}
+		return err == nil && string(value) == string(want)
+	}, 2*time.Second, 10*time.Millisecond, "key %s", key)
+}
+
+func TestReplicationConvergesAcrossRegions(t *testing.T) {
+	ctx := context.Background()
+	regions := newTestRegions(t, "eu-west", "us-east")
+	eu, us := regions["eu-west"], regions["us-east"]
+
+	require.NoError(t, eu.replicator.Set(ctx, "session:abc", []byte(`{"user":"alice"}`), time.Hour))
+	require.NoError(t, us.replicator.Set(ctx, "discovery:services:billing", []byte(`{"name":"billing"}`), 0))
+	waitForValue(t, us.local, "session:abc", []byte(`{"user":"alice"}`))
+	waitForValue(t, eu.local, "discovery:services:billing", []byte(`{"name":"billing"}`))
+
+	// A delete wins over the write it follows, wherever it happens
+	require.NoError(t, us.replicator.Delete(ctx, "session:abc"))
+	waitForValue(t, eu.local, "session:abc", nil)
+
+	// Regional counters are not replicated
+	_, _, err := eu.replicator.Incr(ctx, "ratelimit:client", time.Minute)
+	require.NoError(t, err)
+	_, err = us.local.Get(ctx, "ratelimit:client")
+	assert.ErrorIs(t, err, store.ErrNotFound)
+
+	for _, region := range regions {
+		assert.NoError(t, region.replicator.HealthCheck(ctx))
+	}
+}
+
+func TestReplicationLastWriterWins(t *testing.T) {
+	ctx := context.Background()
+	local := store.NewMemoryStore()
+	r, err := replication.New(local, replication.Config{
+		Region: "eu-west",
+		Secret: testReplicationSecret,
+		Peers:  []replication.Peer{{Region: "us-east", URL: "http://127.0.0.1:1"}},
+	}, testLogger{}, nil)
+	require.NoError(t, err)
+
+	changes := func(raw string) []replication.Change {
+		var changes []replication.Change
+		require.NoError(t, json.Unmarshal([]byte(raw), &changes))
+		return changes
+	}
+
+	// A local write outranks an older remote one, which counts as a conflict
+	require.NoError(t, r.Set(ctx, "session:1", []byte("local"), 0))
+	applied, conflicts, err := r.Apply(ctx, "us-east", changes(`[{"key":"session:1","value":"cmVtb3Rl","version":1,"region":"us-east"}]`))
+	require.NoError(t, err)
+	assert.Equal(t, 0, applied)
+	assert.Equal(t, 1, conflicts)
+	value, _ := local.Get(ctx, "session:1")
+	assert.Equal(t, "local", string(value))
+
+	// A newer remote write replaces it, and delivering it again is a no-op
+	newer := changes(`[{"key":"session:1","value":"cmVtb3Rl","version":` + strconv.FormatInt(time.Now().Add(time.Hour).UnixNano(), 10) + `,"region":"us-east"}]`)
+	for _, want := range []int{1, 0} {
+		applied, conflicts, err = r.Apply(ctx, "us-east", newer)
+		require.NoError(t, err)
+		assert.Equal(t, want, applied)
+		assert.Equal(t, 0, conflicts)
+	}
+	value, _ = local.Get(ctx, "session:1")
+	assert.Equal(t, "remote", string(value))
+
+	// Later local writes are versioned above everything seen
+	require.NoError(t, r.Set(ctx, "session:1", []byte("local again"), 0))
+	applied, _, err = r.Apply(ctx, "us-east", newer)
+	require.NoError(t, err)
+	assert.Equal(t, 0, applied)
+
+	// Expired values are not resurrected
+	applied, _, err = r.Apply(ctx, "us-east", changes(`[{"key":"session:2","value":"eA==","version":`+strconv.FormatInt(time.Now().Add(2*time.Hour).UnixNano(), 10)+`,"region":"us-east","expires_at":1}]`))
+	require.NoError(t, err)
+	assert.Equal(t, 0, applied)
+}
+
+func TestReplicationHandlerRejectsUnsignedPushes(t *testing.T) {
+	r, err := replication.New(store.NewMemoryStore(), replication.Config{
+		Region: "eu-west",
+		Secret: testReplicationSecret,
+		Peers:  []replication.Peer{{Region: "us-east", URL: "http://127.0.0.1:1"}},
+	}, testLogger{}, nil)
+	require.NoError(t, err)
+	router := setupTestRouter()
+	router.POST(replication.Path, r.Handler())
+
+	body := `[{"key":"session:1","value":"eA==","version":1,"region":"us-east"}]`
+	push := func(region, secret string, ts time.Time) int {
+		timestamp := strconv.FormatInt(ts.Unix(), 10)
+		return adminRequest(router, http.MethodPost, replication.Path, body, map[string]string{
+			replication.HeaderRegion:    region,
+			replication.HeaderTimestamp: timestamp,
+			replication.HeaderSignature: replication.Sign(secret, region, timestamp, []byte(body)),
+		}).Code
+	}
+
+	assert.Equal(t, http.StatusOK, push("us-east", testReplicationSecret, time.Now()))
+	assert.Equal(t, http.StatusUnauthorized, push("us-east", strings.Repeat("x", 40), time.Now()))
+	assert.Equal(t, http.StatusUnauthorized, push("ap-south", testReplicationSecret, time.Now()))
+	assert.Equal(t, http.StatusUnauthorized, push("us-east", testReplicationSecret, time.Now().Add(-time.Hour)))
+}
+
+func TestReplicationReportsStalePeers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	r, err := replication.New(store.NewMemoryStore(), replication.Config{
+		Region:        "eu-west",
+		Secret:        testReplicationSecret,
+		Peers:         []replication.Peer{{Region: "us-east", URL: down.URL}},
+		MaxStaleness:  50 * time.Millisecond,
+		FlushInterval: 10 * time.Millisecond,
+	}, testLogger{}, nil)
+	require.NoError(t, err)
+	r.Start(ctx)
+	require.NoError(t, r.Set(ctx, "session:1", []byte("alice"), 0))
+
+	assert.Eventually(t, func() bool { return r.HealthCheck(ctx) != nil }, 2*time.Second, 10*time.Millisecond)
+	status := r.Status()
+	require.Len(t, status, 1)
+	assert.True(t, status[0].Stale)
+	assert.Equal(t, 1, status[0].Pending)
+	assert.Contains(t, status[0].LastError, "503")
+}
+
+func TestReplicationConfigValidation(t *testing.T) {
+	_, err := replication.New(store.NewMemoryStore(), replication.Config{Region: "eu-west", Secret: "short"}, testLogger{}, nil)
+	assert.Error(t, err)
+	_, err = replication.New(store.NewMemoryStore(), replication.Config{
+		Region: "eu-west",
+		Secret: testReplicationSecret,
+		Peers:  []replication.Peer{{Region: "eu-west", URL: "http://self"}},
+	}, testLogger{}, nil)
+	assert.Error(t, err)
+}
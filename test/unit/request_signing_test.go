@@ -0,0 +1,151 @@
+package unit
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/middleware"
+	"github.com/lsendel/impl-zamaz/pkg/signedclient"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+const testAPISecret = "0123456789abcdef0123456789abcdef"
+
+func newSignedRouter(s store.Store) *gin.Engine {
+	router := setupTestRouter()
+	router.Use(middleware.SignedRequestMiddleware(middleware.SignatureConfig{
+		Keys:   []middleware.APIKey{{ID: "billing", Secret: testAPISecret, Roles: []string{"service"}}},
+		Window: time.Minute,
+	}, s, testLogger{}, nil))
+	handler := func(c *gin.Context) {
+		user, _ := c.Get("user")
+		if user == nil {
+			c.String(http.StatusOK, "anonymous")
+			return
+		}
+		c.String(http.StatusOK, user.(*interfaces.UserInfo).ID)
+	}
+	router.GET("/resource", handler)
+	router.POST("/resource", handler)
+	return router
+}
+
+func signedRequest(method, path, body string, ts time.Time, nonce string) *http.Request {
+	timestamp := strconv.FormatInt(ts.Unix(), 10)
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set(middleware.HeaderAPIKey, "billing")
+	req.Header.Set(middleware.HeaderTimestamp, timestamp)
+	req.Header.Set(middleware.HeaderNonce, nonce)
+	req.Header.Set(middleware.HeaderSignature, middleware.SignRequest(testAPISecret, method, path, timestamp, nonce, []byte(body)))
+	return req
+}
+
+func serve(r http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestSignedRequestAuthenticatesMachine(t *testing.T) {
+	r := newSignedRouter(store.NewMemoryStore())
+
+	w := serve(r, signedRequest("POST", "/resource?dry_run=1", `{"amount": 10}`, time.Now(), "n-1"))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "apikey:billing", w.Body.String())
+
+	w = serve(r, httptest.NewRequest("GET", "/resource", nil))
+	assert.Equal(t, "anonymous", w.Body.String(), "unsigned requests fall through")
+}
+
+func TestSignedRequestRejectsReplayAcrossReplicas(t *testing.T) {
+	shared := store.NewMemoryStore()
+	replicaA, replicaB := newSignedRouter(shared), newSignedRouter(shared)
+	now := time.Now()
+
+	assert.Equal(t, http.StatusOK, serve(replicaA, signedRequest("POST", "/resource", "{}", now, "n-1")).Code)
+	w := serve(replicaB, signedRequest("POST", "/resource", "{}", now, "n-1"))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), "REQUEST_REPLAYED")
+}
+
+func TestSignedRequestValidation(t *testing.T) {
+	r := newSignedRouter(store.NewMemoryStore())
+
+	w := serve(r, signedRequest("POST", "/resource", "{}", time.Now().Add(-2*time.Minute), "n-old"))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), "REQUEST_EXPIRED")
+
+	w = serve(r, signedRequest("POST", "/resource", "{}", time.Now(), ""))
+	assert.Contains(t, w.Body.String(), "SIGNATURE_INVALID", "mutations need a nonce")
+
+	req := signedRequest("POST", "/resource", "{}", time.Now(), "n-2")
+	req.Body = httptest.NewRequest("POST", "/resource", strings.NewReader(`{"tampered": true}`)).Body
+	w = serve(r, req)
+	assert.Contains(t, w.Body.String(), "SIGNATURE_INVALID")
+
+	w = serve(r, signedRequest("GET", "/resource", "", time.Now(), ""))
+	assert.Equal(t, http.StatusOK, w.Code, "reads only need a fresh timestamp")
+}
+
+func TestSignedRoutesRequireSignature(t *testing.T) {
+	router := setupTestRouter()
+	router.Use(func(c *gin.Context) {
+		// Stands in for a session or managed API key
+		if c.GetHeader("Authorization") != "" {
+			c.Set("user", &interfaces.UserInfo{ID: "alice"})
+		}
+	})
+	router.Use(middleware.SignedRequestMiddleware(middleware.SignatureConfig{
+		Keys:   []middleware.APIKey{{ID: "billing", Secret: testAPISecret}},
+		Routes: []string{"/hooks/"},
+	}, store.NewMemoryStore(), testLogger{}, nil))
+	router.POST("/*path", func(c *gin.Context) { c.String(http.StatusOK, c.GetString(middleware.SignedKeyContext)) })
+
+	w := serve(router, signedRequest("POST", "/hooks/payments", "{}", time.Now(), "n-1"))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "billing", w.Body.String())
+
+	req := httptest.NewRequest("POST", "/hooks/payments", strings.NewReader("{}"))
+	req.Header.Set("Authorization", "Bearer token")
+	w = serve(router, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "other credentials do not do")
+	assert.Contains(t, w.Body.String(), "SIGNATURE_REQUIRED")
+
+	w = serve(router, httptest.NewRequest("POST", "/hooks", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, http.StatusOK, serve(router, httptest.NewRequest("POST", "/hooksmith", nil)).Code)
+}
+
+func TestSignedClientSignsRequests(t *testing.T) {
+	shared := store.NewMemoryStore()
+	server := httptest.NewServer(newSignedRouter(shared))
+	defer server.Close()
+	client := &http.Client{Transport: &signedclient.Transport{KeyID: "billing", Secret: testAPISecret}}
+
+	for i := 0; i < 2; i++ {
+		// Each request gets its own nonce, so repeating one is no replay
+		resp, err := client.Post(server.URL+"/resource?dry_run=1", "application/json", strings.NewReader(`{"amount": 10}`))
+		require.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "apikey:billing", string(body))
+	}
+
+	stale := &http.Client{Transport: &signedclient.Transport{KeyID: "billing", Secret: testAPISecret,
+		Now: func() time.Time { return time.Now().Add(-time.Hour) }}}
+	resp, err := stale.Get(server.URL + "/resource")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
@@ -0,0 +1,138 @@
+package unit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/pkg/auth"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/security"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+func TestRevocationMiddlewareRejectsRevokedTokens(t *testing.T) {
+	ctx := context.Background()
+	revocations := security.NewRevocationStore(store.NewMemoryStore(), time.Hour, &testLogger{}, nil)
+	pair, err := newTestIssuer(t).IssueTokens(map[string]interface{}{"sub": "u-1"}, time.Minute, time.Hour)
+	require.NoError(t, err)
+
+	router := setupTestRouter()
+	router.Use(revocations.Middleware())
+	router.GET("/resource", func(c *gin.Context) { c.Status(http.StatusOK) })
+	get := func(authorization string) int {
+		return adminRequest(router, http.MethodGet, "/resource", "", map[string]string{"Authorization": authorization}).Code
+	}
+
+	assert.Equal(t, http.StatusOK, get("Bearer "+pair.AccessToken))
+	// Tokens without a jti are left to the authentication layer
+	assert.Equal(t, http.StatusOK, get("Bearer not-a-token"))
+	assert.Equal(t, http.StatusOK, get(""))
+
+	require.NoError(t, revocations.RevokeToken(ctx, pair.AccessToken, "u-1", "logout"))
+	w := adminRequest(router, http.MethodGet, "/resource", "", map[string]string{"Authorization": "Bearer " + pair.AccessToken})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), "TOKEN_REVOKED")
+	assert.Equal(t, `Bearer error="invalid_token"`, w.Header().Get("WWW-Authenticate"))
+
+	// Revocations are independent per token
+	assert.Equal(t, http.StatusOK, get("Bearer "+pair.RefreshToken))
+}
+
+func TestRevocationAuthenticateBearerRequiresAccessTokens(t *testing.T) {
+	ctx := context.Background()
+	revocations := security.NewRevocationStore(store.NewMemoryStore(), time.Hour, &testLogger{}, nil)
+	issuer := newTestIssuer(t)
+	pair, err := issuer.IssueTokens(auth.UserClaims(interfaces.UserInfo{ID: "u-1", Username: "alice", Roles: []string{"admin"}}), time.Minute, time.Hour)
+	require.NoError(t, err)
+	link, err := issuer.Sign(map[string]interface{}{"sub": "u-1", "jti": "link-1", "token_use": auth.TokenUseMagicLink}, time.Minute)
+	require.NoError(t, err)
+	noJTI, err := issuer.Sign(map[string]interface{}{"sub": "u-1", "token_use": auth.TokenUseAccess}, time.Minute)
+	require.NoError(t, err)
+
+	router := setupTestRouter()
+	router.GET("/resource", func(c *gin.Context) {
+		if user := revocations.AuthenticateBearer(c, issuer); user != nil {
+			c.JSON(http.StatusOK, user)
+		}
+	})
+	get := func(authorization string) *httptest.ResponseRecorder {
+		return adminRequest(router, http.MethodGet, "/resource", "", map[string]string{"Authorization": authorization})
+	}
+
+	w := get("Bearer " + pair.AccessToken)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"id":"u-1","username":"alice","email":"","roles":["admin"]}`, w.Body.String())
+
+	// No demo user stands in for a missing token
+	w = get("")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), "UNAUTHORIZED")
+	assert.Equal(t, "Bearer", w.Header().Get("WWW-Authenticate"))
+
+	for _, token := range []string{"not-a-token", pair.RefreshToken, link, noJTI} {
+		w = get("Bearer " + token)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Contains(t, w.Body.String(), "AUTH_001")
+	}
+
+	require.NoError(t, revocations.RevokeToken(ctx, pair.AccessToken, "u-1", "logout"))
+	w = get("Bearer " + pair.AccessToken)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), "TOKEN_REVOKED")
+}
+
+func TestRevocationConsumeTokenIsSingleUse(t *testing.T) {
+	ctx := context.Background()
+	revocations := security.NewRevocationStore(store.NewMemoryStore(), time.Hour, &testLogger{}, nil)
+	pair, err := newTestIssuer(t).IssueTokens(map[string]interface{}{"sub": "u-1"}, time.Minute, time.Hour)
+	require.NoError(t, err)
+
+	consumed, err := revocations.ConsumeToken(ctx, pair.RefreshToken, "", "refreshed")
+	require.NoError(t, err)
+	assert.True(t, consumed)
+	consumed, err = revocations.ConsumeToken(ctx, pair.RefreshToken, "", "refreshed")
+	require.NoError(t, err)
+	assert.False(t, consumed)
+
+	// Already expired tokens are never recorded, and never accepted
+	require.NoError(t, revocations.Revoke(ctx, "old", time.Now().Add(-time.Minute), "", ""))
+	revoked, err := revocations.IsRevoked(ctx, "old")
+	require.NoError(t, err)
+	assert.False(t, revoked)
+
+	assert.ErrorIs(t, revocations.Revoke(ctx, "", time.Time{}, "", ""), security.ErrInvalidJTI)
+}
+
+func TestRevocationAdminEndpoint(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	revocations := security.NewRevocationStore(s, time.Hour, &testLogger{}, nil)
+
+	router := setupTestRouter()
+	group := router.Group("/api/v1/auth", func(c *gin.Context) {
+		c.Set("user", &interfaces.UserInfo{ID: "admin-1", Roles: []string{"admin"}})
+	})
+	revocations.RegisterRoutes(group)
+
+	w := adminRequest(router, http.MethodDelete, "/api/v1/auth/tokens/jti-1", `{"reason":"compromised"}`, nil)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	value, err := s.Get(ctx, "revoked:jti-1")
+	require.NoError(t, err)
+	assert.Contains(t, string(value), `"revoked_by":"admin-1"`)
+	assert.Contains(t, string(value), `"reason":"compromised"`)
+
+	// The body is optional
+	assert.Equal(t, http.StatusNoContent, adminRequest(router, http.MethodDelete, "/api/v1/auth/tokens/jti-2", "", nil).Code)
+	revoked, err := revocations.IsRevoked(ctx, "jti-2")
+	require.NoError(t, err)
+	assert.True(t, revoked)
+
+	assert.Equal(t, http.StatusBadRequest, adminRequest(router, http.MethodDelete, "/api/v1/auth/tokens/jti-3", `{"expires_at":"soon"}`, nil).Code)
+}
@@ -0,0 +1,261 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/risk"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+	"github.com/lsendel/impl-zamaz/pkg/trust"
+)
+
+// fixedDetector reports the same risk for every request
+type fixedDetector struct {
+	name string
+	risk float64
+	err  error
+}
+
+func (d fixedDetector) Name() string { return d.name }
+
+func (d fixedDetector) Detect(context.Context, trust.Input) (float64, error) { return d.risk, d.err }
+
+func TestRiskFactorCombinesDetectors(t *testing.T) {
+	ctx := context.Background()
+	metrics := &countingMetrics{}
+	engine := risk.NewEngine([]risk.Detector{
+		fixedDetector{name: risk.DetectorVelocity, risk: 0.5},
+		fixedDetector{name: risk.DetectorNewGeo, risk: 0.6},
+		fixedDetector{name: risk.DetectorNewDevice},
+		fixedDetector{name: risk.DetectorOffHours, err: errors.New("unavailable")},
+	}, &testLogger{}, metrics)
+
+	result, err := engine.Factor().Evaluate(ctx, trust.Input{Subject: "alice"})
+	require.NoError(t, err)
+	assert.InDelta(t, 0.2, result.Score, 1e-9)
+	assert.Equal(t, "anomalies: new_geo, velocity", result.Reason)
+	assert.Equal(t, map[string]string{"velocity": "0.50", "new_geo": "0.60"}, result.Evidence)
+	assert.Equal(t, 1, metrics.count("risk_detections_total,detector=velocity"))
+	assert.Equal(t, 0, metrics.count("risk_detections_total,detector=new_device"))
+	assert.Equal(t, 1, metrics.count("risk_detector_errors_total,detector=off_hours"))
+
+	quiet, err := risk.NewEngine(nil, &testLogger{}, nil).Factor().Evaluate(ctx, trust.Input{Subject: "alice"})
+	require.NoError(t, err)
+	assert.Equal(t, trust.FactorResult{Score: 1, Reason: "no risk signals"}, quiet)
+}
+
+func TestParseDetectors(t *testing.T) {
+	enabled, err := risk.ParseDetectors(" velocity, off_hours,")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"velocity": true, "off_hours": true}, enabled)
+
+	_, err = risk.ParseDetectors("velocity,psychic")
+	assert.Error(t, err)
+}
+
+func TestVelocityDetector(t *testing.T) {
+	ctx := context.Background()
+	d := risk.NewVelocityDetector(risk.VelocityConfig{Limit: 4, Window: 24 * time.Hour}, store.NewMemoryStore())
+	in := trust.Input{Subject: "alice"}
+	detect := func() float64 {
+		score, err := d.Detect(ctx, in)
+		require.NoError(t, err)
+		return score
+	}
+
+	for i := 0; i < 4; i++ {
+		require.NoError(t, d.Record(ctx, in, http.StatusOK))
+	}
+	assert.Equal(t, 0.0, detect())
+	require.NoError(t, d.Record(ctx, in, http.StatusOK))
+	assert.Equal(t, 0.25, detect())
+	for i := 0; i < 10; i++ {
+		require.NoError(t, d.Record(ctx, in, http.StatusOK))
+	}
+	assert.Equal(t, 1.0, detect())
+
+	score, err := d.Detect(ctx, trust.Input{Subject: "bob"})
+	require.NoError(t, err)
+	assert.Equal(t, 0.0, score)
+}
+
+func TestNewGeoAndDeviceDetectors(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	geo := risk.NewGeoDetector(risk.HistoryConfig{}, newTestGeoIP(t), s)
+	device := risk.NewDeviceDetector(risk.HistoryConfig{MaxValues: 2}, s)
+	detect := func(d risk.Detector, in trust.Input) float64 {
+		score, err := d.Detect(ctx, in)
+		require.NoError(t, err)
+		return score
+	}
+	record := func(d risk.Detector, in trust.Input) {
+		require.NoError(t, d.(risk.Recorder).Record(ctx, in, http.StatusOK))
+	}
+	boston := trust.Input{Subject: "alice", Context: map[string]string{"ip": "198.51.7.7"}}
+	london := trust.Input{Subject: "alice", Context: map[string]string{"ip": "203.0.113.9"}}
+
+	// First sightings are not anomalies
+	assert.Equal(t, 0.0, detect(geo, boston))
+	record(geo, boston)
+	assert.Equal(t, 0.0, detect(geo, boston))
+	assert.Equal(t, 0.6, detect(geo, london))
+	record(geo, london)
+	assert.Equal(t, 0.0, detect(geo, london))
+	assert.Equal(t, 0.0, detect(geo, trust.Input{Subject: "alice", Context: map[string]string{"ip": "10.0.0.1"}}))
+
+	laptop := trust.Input{Subject: "alice", Context: firefox}
+	phone := trust.Input{Subject: "alice", Device: "phone-1"}
+	tablet := trust.Input{Subject: "alice", Device: "tablet-1"}
+	record(device, laptop)
+	assert.Equal(t, 0.0, detect(device, laptop))
+	assert.Equal(t, 0.5, detect(device, phone))
+	record(device, phone)
+	record(device, tablet)
+	// Only the two most recent devices are remembered
+	assert.Equal(t, 0.5, detect(device, laptop))
+	assert.Equal(t, 0.0, detect(device, phone))
+}
+
+func TestEscalationDetectorCountsDeniedRequests(t *testing.T) {
+	s := store.NewMemoryStore()
+	d := risk.NewEscalationDetector(risk.EscalationConfig{Threshold: 2}, s)
+	engine := risk.NewEngine([]risk.Detector{d}, &testLogger{}, nil)
+	r := setupTestRouter()
+	r.Use(engine.Middleware(), func(c *gin.Context) {
+		if user := c.GetHeader("X-User"); user != "" {
+			c.Set("user", &interfaces.UserInfo{ID: user})
+		}
+	})
+	r.GET("/admin", func(c *gin.Context) { c.Status(http.StatusForbidden) })
+	r.GET("/me", func(c *gin.Context) { c.Status(http.StatusOK) })
+	request := func(path, user string) {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("X-User", user)
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	detect := func(subject string) float64 {
+		score, err := d.Detect(context.Background(), trust.Input{Subject: subject})
+		require.NoError(t, err)
+		return score
+	}
+
+	request("/me", "alice")
+	request("/admin", "alice")
+	request("/admin", "")
+	assert.Equal(t, 0.0, detect("alice"))
+	request("/admin", "alice")
+	assert.Equal(t, 0.5, detect("alice"))
+	request("/admin", "alice")
+	request("/admin", "alice")
+	assert.Equal(t, 1.0, detect("alice"))
+	assert.Equal(t, 0.0, detect("bob"))
+}
+
+func TestOffHoursDetector(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	require.NoError(t, err)
+	d := risk.NewOffHoursDetector(risk.OffHoursConfig{Location: berlin, Start: 8, End: 18})
+	at := func(ts string) float64 {
+		score, err := d.Detect(context.Background(), trust.Input{Subject: "alice", Context: map[string]string{trust.ContextTime: ts}})
+		require.NoError(t, err)
+		return score
+	}
+
+	// Wednesday, 09:30 and 18:30 in Berlin
+	assert.Equal(t, 0.0, at("2024-06-12T07:30:00Z"))
+	assert.Equal(t, 0.4, at("2024-06-12T16:30:00Z"))
+	// Saturday morning
+	assert.Equal(t, 0.4, at("2024-06-15T08:00:00Z"))
+
+	weekends := risk.NewOffHoursDetector(risk.OffHoursConfig{Weekends: true})
+	score, err := weekends.Detect(context.Background(), trust.Input{Context: map[string]string{trust.ContextTime: "2024-06-15T08:00:00Z"}})
+	require.NoError(t, err)
+	assert.Equal(t, 0.0, score)
+}
+
+func TestBaselineScoresDeviations(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	baselines := risk.NewBaselines(risk.BaselineConfig{MinRequests: 10}, s, &testLogger{})
+	request := func(endpoint string) trust.Input {
+		return trust.Input{Subject: "alice", Context: map[string]string{trust.ContextEndpoint: endpoint}}
+	}
+	for i := 0; i < 9; i++ {
+		require.NoError(t, baselines.Record(ctx, request("GET /api/v1/devices"), http.StatusOK))
+	}
+	detect := func(endpoint string, at time.Time) float64 {
+		in := request(endpoint)
+		in.Context[trust.ContextTime] = at.Format(time.RFC3339)
+		score, err := baselines.Detect(ctx, in)
+		require.NoError(t, err)
+		return score
+	}
+	learned := func() risk.Baseline {
+		data, err := s.Get(ctx, "risk:baseline:alice")
+		require.NoError(t, err)
+		var baseline risk.Baseline
+		require.NoError(t, json.Unmarshal(data, &baseline))
+		return baseline
+	}
+
+	// Still learning
+	usual := learned().Hour.Add(30 * time.Minute)
+	assert.Equal(t, 0.0, detect("DELETE /api/v1/admin/users/:id", usual))
+
+	require.NoError(t, baselines.Record(ctx, request("GET /api/v1/devices"), http.StatusOK))
+	usual = learned().Hour.Add(30 * time.Minute)
+	assert.Equal(t, 0.0, detect("GET /api/v1/devices", usual))
+	assert.InDelta(t, 0.3, detect("DELETE /api/v1/admin/users/:id", usual), 1e-9)
+	assert.InDelta(t, 0.51, detect("DELETE /api/v1/admin/users/:id", usual.Add(12*time.Hour)), 1e-9)
+
+	// Ten requests this hour, counting this one, against a usual two
+	baseline := learned()
+	baseline.HourlyRate, baseline.HourCount = 2, 9
+	data, err := json.Marshal(baseline)
+	require.NoError(t, err)
+	require.NoError(t, s.Set(ctx, "risk:baseline:alice", data, 0))
+	assert.InDelta(t, 0.4, detect("GET /api/v1/devices", usual), 1e-9)
+}
+
+func TestBaselineEndpoint(t *testing.T) {
+	baselines := risk.NewBaselines(risk.BaselineConfig{MinRequests: 3}, store.NewMemoryStore(), &testLogger{})
+	engine := risk.NewEngine([]risk.Detector{baselines}, &testLogger{}, nil)
+	r := setupTestRouter()
+	r.Use(engine.Middleware(), func(c *gin.Context) {
+		c.Set("user", &interfaces.UserInfo{ID: "alice"})
+	})
+	r.GET("/devices/:id", func(c *gin.Context) { c.Status(http.StatusOK) })
+	baselines.RegisterRoutes(r.Group("/risk"))
+
+	assert.Equal(t, http.StatusNotFound, adminRequest(r, http.MethodGet, "/risk/baseline/alice", "", nil).Code)
+	for _, id := range []string{"1", "2", "3"} {
+		adminRequest(r, http.MethodGet, "/devices/"+id, "", nil)
+	}
+
+	w := adminRequest(r, http.MethodGet, "/risk/baseline/alice", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var summary risk.BaselineSummary
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &summary))
+	assert.Equal(t, "alice", summary.UserID)
+	assert.False(t, summary.Learning)
+	// The first lookup is learned from too
+	assert.EqualValues(t, 4, summary.Requests)
+	assert.Equal(t, "UTC", summary.Timezone)
+	assert.Equal(t, []int{summary.UpdatedAt.Hour()}, summary.TypicalHours)
+	assert.Equal(t, []risk.EndpointUsage{
+		{Endpoint: "GET /devices/:id", Requests: 3, Typical: true},
+		{Endpoint: "GET /risk/baseline/:userID", Requests: 1, Typical: true},
+	}, summary.Endpoints)
+	assert.Equal(t, http.StatusNotFound, adminRequest(r, http.MethodGet, "/risk/baseline/bob", "", nil).Code)
+}
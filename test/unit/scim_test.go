@@ -0,0 +1,200 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/pkg/groupsync"
+	"github.com/lsendel/impl-zamaz/pkg/rbac"
+	"github.com/lsendel/impl-zamaz/pkg/scim"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+// newSCIMRouter serves SCIM at /scim/v2, with provisioned groups synced to
+// roles as soon as they change
+func newSCIMRouter(t *testing.T) (*gin.Engine, *rbac.Manager, *groupsync.Service) {
+	gin.SetMode(gin.TestMode)
+	s := store.NewMemoryStore()
+	roles := rbac.NewManager(rbac.Config{}, s)
+	provisioning, err := scim.NewService(scim.Config{}, s, roles, &testLogger{})
+	require.NoError(t, err)
+	sync := groupsync.NewService(groupsync.Config{}, []groupsync.Source{provisioning}, roles, s, &testLogger{}, nil)
+	provisioning.OnGroupsChanged(func(ctx context.Context) {
+		_, err := sync.Sync(ctx, "scim")
+		assert.NoError(t, err)
+	})
+	r := gin.New()
+	provisioning.RegisterRoutes(r.Group("/scim/v2"))
+	return r, roles, sync
+}
+
+func scimRequest(r *gin.Engine, method, path, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", scim.ContentType)
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func roleNames(t *testing.T, roles *rbac.Manager, user string) []string {
+	assigned, err := roles.UserRoles(context.Background(), user)
+	require.NoError(t, err)
+	names := []string{}
+	for _, role := range assigned {
+		names = append(names, role.Name)
+	}
+	return names
+}
+
+func TestSCIMUserProvisioning(t *testing.T) {
+	r, roles, _ := newSCIMRouter(t)
+	ctx := context.Background()
+	_, err := roles.CreateRole(ctx, rbac.Role{Name: "support-agent"})
+	require.NoError(t, err)
+	_, err = roles.CreateRole(ctx, rbac.Role{Name: "billing"})
+	require.NoError(t, err)
+
+	w := scimRequest(r, http.MethodPost, "/scim/v2/Users", `{
+		"schemas": ["urn:ietf:params:scim:schemas:core:2.0:User"],
+		"userName": "alice@example.com",
+		"externalId": "00u1",
+		"name": {"givenName": "Alice", "familyName": "Smith"},
+		"emails": [{"value": "alice@example.com", "type": "work", "primary": true}],
+		"roles": [{"value": "support-agent"}]
+	}`)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	assert.Equal(t, scim.ContentType, w.Header().Get("Content-Type"))
+	var alice scim.User
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &alice))
+	assert.True(t, alice.Active, "users are active unless provisioned otherwise")
+	assert.Equal(t, "http://example.com/scim/v2/Users/"+alice.ID, alice.Meta.Location)
+	assert.Equal(t, []string{"support-agent"}, roleNames(t, roles, "alice@example.com"))
+
+	// User names are unique whatever their case
+	w = scimRequest(r, http.MethodPost, "/scim/v2/Users", `{"userName": "ALICE@example.com"}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), `"scimType":"uniqueness"`)
+	w = scimRequest(r, http.MethodPost, "/scim/v2/Users", `{"userName": "bob@example.com", "roles": [{"value": "root"}]}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code, "unknown roles")
+
+	// Identity providers look users up by filter before creating them
+	w = scimRequest(r, http.MethodGet, `/scim/v2/Users?filter=userName+eq+"Alice@Example.com"`, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var list struct {
+		TotalResults int         `json:"totalResults"`
+		Resources    []scim.User `json:"Resources"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	require.Equal(t, 1, list.TotalResults)
+	assert.Equal(t, alice.ID, list.Resources[0].ID)
+	assert.Equal(t, http.StatusBadRequest, scimRequest(r, http.MethodGet, `/scim/v2/Users?filter=title+co+"x"`, "").Code)
+
+	// Entra ID patches with capitalized ops and string booleans
+	w = scimRequest(r, http.MethodPatch, "/scim/v2/Users/"+alice.ID, `{
+		"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"],
+		"Operations": [
+			{"op": "Add", "path": "roles", "value": [{"value": "billing"}]},
+			{"op": "Replace", "path": "emails[type eq \"work\"].value", "value": "alice@corp.example.com"},
+			{"op": "Replace", "path": "urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:department", "value": "Support"}
+		]
+	}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &alice))
+	assert.Equal(t, "alice@corp.example.com", alice.Emails[0].Value)
+	assert.Equal(t, []string{"billing", "support-agent"}, roleNames(t, roles, "alice@example.com"))
+
+	// Roles assigned by hand survive provisioning
+	handRole, err := roles.CreateRole(ctx, rbac.Role{Name: "auditor"})
+	require.NoError(t, err)
+	_, err = roles.Assign(ctx, rbac.Assignment{UserID: "alice@example.com", RoleID: handRole.ID, AssignedBy: "admin"})
+	require.NoError(t, err)
+
+	// Deactivating takes back every role provisioning gave
+	w = scimRequest(r, http.MethodPatch, "/scim/v2/Users/"+alice.ID, `{"Operations": [{"op": "Replace", "value": {"active": "False"}}]}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, []string{"auditor"}, roleNames(t, roles, "alice@example.com"))
+
+	// Replacing reactivates with the roles given
+	w = scimRequest(r, http.MethodPut, "/scim/v2/Users/"+alice.ID, `{"userName": "alice@example.com", "active": true, "roles": [{"value": "billing"}]}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, []string{"auditor", "billing"}, roleNames(t, roles, "alice@example.com"))
+
+	assert.Equal(t, http.StatusNoContent, scimRequest(r, http.MethodDelete, "/scim/v2/Users/"+alice.ID, "").Code)
+	assert.Equal(t, []string{"auditor"}, roleNames(t, roles, "alice@example.com"))
+	w = scimRequest(r, http.MethodGet, "/scim/v2/Users/"+alice.ID, "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), scim.SchemaError)
+}
+
+func TestSCIMGroupProvisioning(t *testing.T) {
+	r, roles, sync := newSCIMRouter(t)
+	ctx := context.Background()
+	engineer, err := roles.CreateRole(ctx, rbac.Role{Name: "engineer"})
+	require.NoError(t, err)
+
+	create := func(userName string) string {
+		w := scimRequest(r, http.MethodPost, "/scim/v2/Users", `{"userName": "`+userName+`"}`)
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		var u scim.User
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &u))
+		return u.ID
+	}
+	alice, bob := create("alice"), create("bob")
+
+	_, err = sync.Map(ctx, groupsync.Mapping{Source: "scim", Group: "Engineering", RoleID: engineer.ID})
+	require.NoError(t, err)
+	w := scimRequest(r, http.MethodPost, "/scim/v2/Groups", `{"displayName": "Engineering", "members": [{"value": "`+alice+`"}]}`)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var group scim.Group
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &group))
+	assert.Equal(t, []string{"engineer"}, roleNames(t, roles, "alice"))
+	assert.Equal(t, http.StatusConflict, scimRequest(r, http.MethodPost, "/scim/v2/Groups", `{"displayName": "engineering"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, scimRequest(r, http.MethodPost, "/scim/v2/Groups", `{"displayName": "Ops", "members": [{"value": "nobody"}]}`).Code)
+
+	w = scimRequest(r, http.MethodGet, "/scim/v2/Users/"+alice, "")
+	var u scim.User
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &u))
+	require.Len(t, u.Groups, 1)
+	assert.Equal(t, group.ID, u.Groups[0].Value)
+
+	// Okta adds and removes members with PATCH
+	w = scimRequest(r, http.MethodPatch, "/scim/v2/Groups/"+group.ID, `{"Operations": [
+		{"op": "add", "path": "members", "value": [{"value": "`+bob+`"}]},
+		{"op": "remove", "path": "members[value eq \"`+alice+`\"]"}
+	]}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Empty(t, roleNames(t, roles, "alice"))
+	assert.Equal(t, []string{"engineer"}, roleNames(t, roles, "bob"))
+
+	w = scimRequest(r, http.MethodGet, `/scim/v2/Groups?filter=displayName+eq+"Engineering"&excludedAttributes=members`, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var list struct {
+		Resources []scim.Group `json:"Resources"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	require.Len(t, list.Resources, 1)
+	assert.Empty(t, list.Resources[0].Members)
+
+	// Deleting a member removes them from the group, and the group's roles
+	assert.Equal(t, http.StatusNoContent, scimRequest(r, http.MethodDelete, "/scim/v2/Users/"+bob, "").Code)
+	assert.Empty(t, roleNames(t, roles, "bob"))
+	w = scimRequest(r, http.MethodGet, "/scim/v2/Groups/"+group.ID, "")
+	var emptied scim.Group
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &emptied))
+	assert.Empty(t, emptied.Members)
+
+	assert.Equal(t, http.StatusNoContent, scimRequest(r, http.MethodDelete, "/scim/v2/Groups/"+group.ID, "").Code)
+	assert.Equal(t, http.StatusNotFound, scimRequest(r, http.MethodDelete, "/scim/v2/Groups/"+group.ID, "").Code)
+
+	w = scimRequest(r, http.MethodGet, "/scim/v2/ServiceProviderConfig", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"patch":{"supported":true}`)
+}
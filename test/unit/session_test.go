@@ -0,0 +1,211 @@
+package unit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/oidc"
+	"github.com/lsendel/impl-zamaz/pkg/session"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+const testSessionSecret = "0123456789abcdef0123456789abcdef"
+
+func newTestSessions(t *testing.T, s store.Store) *session.Manager {
+	sessions, err := session.NewManager(session.Config{
+		Domain: ".example.test",
+		Secure: true,
+		Secret: []byte(testSessionSecret),
+	}, s, &testLogger{}, nil)
+	require.NoError(t, err)
+	return sessions
+}
+
+func newSessionRouter(sessions *session.Manager) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/login", func(c *gin.Context) {
+		_, err := sessions.Create(c, interfaces.UserInfo{ID: "u-1", Username: "alice"})
+		if err != nil {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+	r.POST("/logout", func(c *gin.Context) {
+		_ = sessions.Destroy(c)
+		c.Status(http.StatusNoContent)
+	})
+	r.GET("/me", sessions.Middleware(), func(c *gin.Context) {
+		user, ok := c.Get(session.UserContextKey)
+		if !ok {
+			c.Status(http.StatusUnauthorized)
+			return
+		}
+		c.String(http.StatusOK, user.(*interfaces.UserInfo).Username)
+	})
+	return r
+}
+
+func sessionRequest(r http.Handler, method, path string, cookie *http.Cookie, userAgent string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("User-Agent", userAgent)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func sessionCookie(t *testing.T, w *httptest.ResponseRecorder) *http.Cookie {
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == "zamaz_session" {
+			return cookie
+		}
+	}
+	t.Fatal("session cookie not set")
+	return nil
+}
+
+func TestSessionCookieAttributes(t *testing.T) {
+	r := newSessionRouter(newTestSessions(t, store.NewMemoryStore()))
+
+	cookie := sessionCookie(t, sessionRequest(r, http.MethodPost, "/login", nil, "browser"))
+	assert.Equal(t, "example.test", cookie.Domain)
+	assert.True(t, cookie.HttpOnly)
+	assert.True(t, cookie.Secure)
+	assert.Equal(t, http.SameSiteLaxMode, cookie.SameSite)
+	assert.Equal(t, int((8 * time.Hour).Seconds()), cookie.MaxAge)
+}
+
+func TestSessionSharedAcrossReplicas(t *testing.T) {
+	shared := store.NewMemoryStore()
+	replicaA := newSessionRouter(newTestSessions(t, shared))
+	replicaB := newSessionRouter(newTestSessions(t, shared))
+
+	cookie := sessionCookie(t, sessionRequest(replicaA, http.MethodPost, "/login", nil, "browser"))
+	w := sessionRequest(replicaB, http.MethodGet, "/me", cookie, "browser")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "alice", w.Body.String())
+
+	// Logging out on one replica ends the session everywhere
+	sessionRequest(replicaB, http.MethodPost, "/logout", cookie, "browser")
+	assert.Equal(t, http.StatusUnauthorized, sessionRequest(replicaA, http.MethodGet, "/me", cookie, "browser").Code)
+}
+
+func TestSessionRejectsTamperingAndReplay(t *testing.T) {
+	r := newSessionRouter(newTestSessions(t, store.NewMemoryStore()))
+	cookie := sessionCookie(t, sessionRequest(r, http.MethodPost, "/login", nil, "browser"))
+
+	forged := *cookie
+	forged.Value = "attacker-chosen-id" + cookie.Value[strings.Index(cookie.Value, "."):]
+	assert.Equal(t, http.StatusUnauthorized, sessionRequest(r, http.MethodGet, "/me", &forged, "browser").Code)
+
+	// A stolen cookie replayed from another user agent is rejected
+	assert.Equal(t, http.StatusUnauthorized, sessionRequest(r, http.MethodGet, "/me", cookie, "curl/8.0").Code)
+}
+
+func TestSessionIdleTimeout(t *testing.T) {
+	metrics := &countingMetrics{}
+	shared := store.NewMemoryStore()
+	newReplica := func() *gin.Engine {
+		sessions, err := session.NewManager(session.Config{
+			Secret:      []byte(testSessionSecret),
+			IdleTimeout: 200 * time.Millisecond,
+		}, shared, &testLogger{}, metrics)
+		require.NoError(t, err)
+		return newSessionRouter(sessions)
+	}
+	replicaA, replicaB := newReplica(), newReplica()
+
+	cookie := sessionCookie(t, sessionRequest(replicaA, http.MethodPost, "/login", nil, "browser"))
+	// Activity on either replica keeps the session alive past the timeout
+	for _, r := range []*gin.Engine{replicaA, replicaB, replicaA} {
+		time.Sleep(120 * time.Millisecond)
+		require.Equal(t, http.StatusOK, sessionRequest(r, http.MethodGet, "/me", cookie, "browser").Code)
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	w := sessionRequest(replicaB, http.MethodGet, "/me", cookie, "browser")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, -1, sessionCookie(t, w).MaxAge)
+	assert.Equal(t, 1, metrics.count("sessions_expired_total,reason=idle"))
+
+	// The session is gone, not merely idle
+	assert.Equal(t, http.StatusUnauthorized, sessionRequest(replicaA, http.MethodGet, "/me", cookie, "browser").Code)
+}
+
+func TestSessionAbsoluteLifetime(t *testing.T) {
+	sessions, err := session.NewManager(session.Config{
+		Secret:      []byte(testSessionSecret),
+		TTL:         300 * time.Millisecond,
+		IdleTimeout: time.Hour,
+	}, store.NewMemoryStore(), &testLogger{}, nil)
+	require.NoError(t, err)
+	r := newSessionRouter(sessions)
+
+	cookie := sessionCookie(t, sessionRequest(r, http.MethodPost, "/login", nil, "browser"))
+	// Activity does not extend the lifetime
+	for i := 0; i < 2; i++ {
+		time.Sleep(100 * time.Millisecond)
+		require.Equal(t, http.StatusOK, sessionRequest(r, http.MethodGet, "/me", cookie, "browser").Code)
+	}
+	time.Sleep(150 * time.Millisecond)
+	assert.Equal(t, http.StatusUnauthorized, sessionRequest(r, http.MethodGet, "/me", cookie, "browser").Code)
+}
+
+func TestSessionConfigValidation(t *testing.T) {
+	_, err := session.NewManager(session.Config{Secret: []byte("short")}, store.NewMemoryStore(), &testLogger{}, nil)
+	assert.Error(t, err)
+
+	_, err = session.NewManager(session.Config{
+		Secret:   []byte(testSessionSecret),
+		SameSite: http.SameSiteNoneMode,
+	}, store.NewMemoryStore(), &testLogger{}, nil)
+	assert.Error(t, err)
+
+	sameSite, err := session.ParseSameSite("Strict")
+	require.NoError(t, err)
+	assert.Equal(t, http.SameSiteStrictMode, sameSite)
+	_, err = session.ParseSameSite("sometimes")
+	assert.Error(t, err)
+}
+
+func TestOIDCAuthorizeReusesSession(t *testing.T) {
+	f := newOIDCFixtureWithSessions(t)
+
+	form := authorizeParams("wiki")
+	form.Set("username", "alice")
+	form.Set("password", "correct horse")
+	w := f.do(http.MethodPost, oidc.AuthorizePath, form, nil)
+	require.Equal(t, http.StatusFound, w.Code)
+	cookie := sessionCookie(t, w)
+
+	// A second app is signed in without seeing the login form
+	w = f.do(http.MethodGet, oidc.AuthorizePath+"?"+authorizeParams("billing").Encode(), nil, func(r *http.Request) {
+		r.AddCookie(cookie)
+	})
+	require.Equal(t, http.StatusFound, w.Code)
+	location, err := url.Parse(w.Header().Get("Location"))
+	require.NoError(t, err)
+	code := location.Query().Get("code")
+	require.NotEmpty(t, code)
+
+	w = f.do(http.MethodPost, oidc.TokenPath, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {oidcRedirectURI},
+		"code_verifier": {oidcVerifier},
+	}, func(r *http.Request) { r.SetBasicAuth("billing", "billing-secret") })
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+}
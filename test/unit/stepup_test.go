@@ -0,0 +1,144 @@
+package unit
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/pkg/auth"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+	"github.com/lsendel/impl-zamaz/pkg/trust"
+)
+
+var stepUpSecret = []byte("0123456789abcdefghij")
+
+func newStepUpRouter(s store.Store) *gin.Engine {
+	stepUp := trust.NewStepUp(trust.StepUpConfig{MaxAttempts: 3}, s, fixedScorer{"u-alice": 40, "u-bob": 40},
+		[]trust.Factor{auth.NewTOTP(map[string][]byte{"u-alice": stepUpSecret}, s)}, &testLogger{}, nil)
+
+	router := setupTestRouter()
+	router.Use(func(c *gin.Context) {
+		c.Set("user", &interfaces.UserInfo{ID: c.GetHeader("X-Test-User")})
+	})
+	stepUp.RegisterRoutes(router.Group("/api/v1/auth"))
+	router.GET("/sensitive", stepUp.RequireTrust(75), func(c *gin.Context) { c.Status(http.StatusOK) })
+	return router
+}
+
+func stepUpHeaders(user, token string) map[string]string {
+	return map[string]string{"X-Test-User": user, "Authorization": "Bearer " + token}
+}
+
+func requireChallenge(t *testing.T, router *gin.Engine, headers map[string]string) string {
+	w := adminRequest(router, http.MethodGet, "/sensitive", "", headers)
+	require.Equal(t, http.StatusForbidden, w.Code)
+	var resp struct {
+		Code        string   `json:"code"`
+		ChallengeID string   `json:"challenge_id"`
+		Methods     []string `json:"methods"`
+		Required    int      `json:"required_trust_level"`
+		Current     int      `json:"current_trust_level"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "STEP_UP_REQUIRED", resp.Code)
+	assert.Equal(t, []string{"totp"}, resp.Methods)
+	assert.Equal(t, 75, resp.Required)
+	assert.Equal(t, 40, resp.Current)
+	require.NotEmpty(t, resp.ChallengeID)
+	return resp.ChallengeID
+}
+
+func stepUpBody(challenge, code string) string {
+	return `{"challenge_id": "` + challenge + `", "method": "totp", "response": "` + code + `"}`
+}
+
+func TestStepUpElevatesTheSession(t *testing.T) {
+	router := newStepUpRouter(store.NewMemoryStore())
+	headers := stepUpHeaders("u-alice", "token-1")
+	challenge := requireChallenge(t, router, headers)
+
+	w := adminRequest(router, http.MethodPost, "/api/v1/auth/step-up", stepUpBody(challenge, "000000"), headers)
+	if auth.TOTPCode(stepUpSecret, time.Now()) != "000000" {
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Contains(t, w.Body.String(), "STEP_UP_FAILED")
+	}
+
+	code := auth.TOTPCode(stepUpSecret, time.Now())
+	w = adminRequest(router, http.MethodPost, "/api/v1/auth/step-up", stepUpBody(challenge, code), headers)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), `"trust_level":75`)
+	assert.Equal(t, http.StatusOK, adminRequest(router, http.MethodGet, "/sensitive", "", headers).Code)
+
+	// The elevation belongs to the token that stepped up
+	assert.Equal(t, http.StatusForbidden, adminRequest(router, http.MethodGet, "/sensitive", "", stepUpHeaders("u-alice", "token-2")).Code)
+
+	// Challenges and codes are single-use
+	assert.Equal(t, http.StatusBadRequest, adminRequest(router, http.MethodPost, "/api/v1/auth/step-up", stepUpBody(challenge, code), headers).Code)
+	other := stepUpHeaders("u-alice", "token-3")
+	w = adminRequest(router, http.MethodPost, "/api/v1/auth/step-up", stepUpBody(requireChallenge(t, router, other), code), other)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestStepUpChallengesAreBound(t *testing.T) {
+	router := newStepUpRouter(store.NewMemoryStore())
+	challenge := requireChallenge(t, router, stepUpHeaders("u-alice", "token-1"))
+	code := auth.TOTPCode(stepUpSecret, time.Now())
+
+	// Another session of the same user cannot answer it
+	w := adminRequest(router, http.MethodPost, "/api/v1/auth/step-up", stepUpBody(challenge, code), stepUpHeaders("u-alice", "stolen"))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "STEP_UP_INVALID")
+
+	// Too many wrong answers burn the challenge
+	headers := stepUpHeaders("u-alice", "token-1")
+	for i := 0; i < 3; i++ {
+		adminRequest(router, http.MethodPost, "/api/v1/auth/step-up", stepUpBody(challenge, "12345x"), headers)
+	}
+	assert.Equal(t, http.StatusTooManyRequests, adminRequest(router, http.MethodPost, "/api/v1/auth/step-up", stepUpBody(challenge, code), headers).Code)
+	assert.Equal(t, http.StatusBadRequest, adminRequest(router, http.MethodPost, "/api/v1/auth/step-up", stepUpBody(challenge, code), headers).Code)
+
+	// Users without a factor are simply denied
+	w = adminRequest(router, http.MethodGet, "/sensitive", "", stepUpHeaders("u-bob", "token-4"))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "INSUFFICIENT_TRUST")
+}
+
+func TestStepUpAttemptsAreCappedAcrossChallenges(t *testing.T) {
+	router := newStepUpRouter(store.NewMemoryStore())
+	headers := stepUpHeaders("u-alice", "stolen")
+
+	// Each denied request mints a new challenge, but the wrong answers to
+	// all of them count against the same cap
+	for i := 0; i < 3; i++ {
+		w := adminRequest(router, http.MethodPost, "/api/v1/auth/step-up", stepUpBody(requireChallenge(t, router, headers), "12345x"), headers)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Contains(t, w.Body.String(), "STEP_UP_FAILED")
+	}
+	for i := 0; i < 2; i++ {
+		w := adminRequest(router, http.MethodPost, "/api/v1/auth/step-up", stepUpBody(requireChallenge(t, router, headers), "12345x"), headers)
+		assert.Equal(t, http.StatusTooManyRequests, w.Code)
+		assert.Contains(t, w.Body.String(), "STEP_UP_LOCKED")
+		assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	}
+
+	// The lock holds for the user's other tokens and for the right code
+	other := stepUpHeaders("u-alice", "token-2")
+	code := auth.TOTPCode(stepUpSecret, time.Now())
+	w := adminRequest(router, http.MethodPost, "/api/v1/auth/step-up", stepUpBody(requireChallenge(t, router, other), code), other)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, http.StatusForbidden, adminRequest(router, http.MethodGet, "/sensitive", "", other).Code)
+}
+
+func TestTOTPCodes(t *testing.T) {
+	// RFC 6238 appendix B, truncated to 6 digits
+	secret := []byte("12345678901234567890")
+	assert.Equal(t, "287082", auth.TOTPCode(secret, time.Unix(59, 0)))
+	assert.Equal(t, "081804", auth.TOTPCode(secret, time.Unix(1111111109, 0)))
+	assert.Equal(t, "005924", auth.TOTPCode(secret, time.Unix(1234567890, 0)))
+}
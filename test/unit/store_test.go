@@ -0,0 +1,237 @@
+package unit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/pkg/discovery"
+	"github.com/lsendel/impl-zamaz/pkg/middleware"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+)
+
+func TestMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+
+	_, err := s.Get(ctx, "missing")
+	assert.ErrorIs(t, err, store.ErrNotFound)
+
+	require.NoError(t, s.Set(ctx, "session:1", []byte("alice"), 0))
+	value, err := s.Get(ctx, "session:1")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("alice"), value)
+
+	require.NoError(t, s.Set(ctx, "session:2", []byte("bob"), 20*time.Millisecond))
+	keys, err := s.Keys(ctx, "session:")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"session:1", "session:2"}, keys)
+
+	time.Sleep(30 * time.Millisecond)
+	_, err = s.Get(ctx, "session:2")
+	assert.ErrorIs(t, err, store.ErrNotFound)
+
+	require.NoError(t, s.Delete(ctx, "session:1"))
+	keys, err = s.Keys(ctx, "session:")
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+}
+
+func TestMemoryStoreIncr(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+
+	count, ttl, err := s.Incr(ctx, "counter", time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+	assert.Greater(t, ttl, 59*time.Second)
+
+	count, _, err = s.Incr(ctx, "counter", time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), count)
+}
+
+func TestMemoryStoreCompareAndSwap(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+
+	swapped, err := s.CompareAndSwap(ctx, "state", nil, []byte("v1"), time.Minute)
+	require.NoError(t, err)
+	assert.True(t, swapped)
+
+	swapped, err = s.CompareAndSwap(ctx, "state", nil, []byte("v2"), time.Minute)
+	require.NoError(t, err)
+	assert.False(t, swapped, "key already exists")
+
+	swapped, err = s.CompareAndSwap(ctx, "state", []byte("stale"), []byte("v2"), time.Minute)
+	require.NoError(t, err)
+	assert.False(t, swapped)
+
+	swapped, err = s.CompareAndSwap(ctx, "state", []byte("v1"), []byte("v2"), time.Minute)
+	require.NoError(t, err)
+	assert.True(t, swapped)
+	value, _ := s.Get(ctx, "state")
+	assert.Equal(t, []byte("v2"), value)
+}
+
+func TestNewStoreRejectsUnknownBackend(t *testing.T) {
+	_, err := store.New("memcached", "")
+	assert.Error(t, err)
+
+	s, err := store.New("memory", "")
+	require.NoError(t, err)
+	assert.NoError(t, s.Ping(context.Background()))
+}
+
+func TestReplicasShareRateLimits(t *testing.T) {
+	shared := store.NewMemoryStore()
+	replicaA := middleware.NewStoreLimiter(shared, 2, time.Minute)
+	replicaB := middleware.NewStoreLimiter(shared, 2, time.Minute)
+	ctx := context.Background()
+
+	d, err := replicaA.Allow(ctx, "10.0.0.1")
+	require.NoError(t, err)
+	assert.True(t, d.Allowed)
+	assert.Equal(t, 1, d.Remaining)
+
+	d, err = replicaB.Allow(ctx, "10.0.0.1")
+	require.NoError(t, err)
+	assert.True(t, d.Allowed)
+	assert.Equal(t, 0, d.Remaining)
+
+	d, err = replicaA.Allow(ctx, "10.0.0.1")
+	require.NoError(t, err)
+	assert.False(t, d.Allowed)
+	assert.Greater(t, d.RetryAfter, time.Duration(0))
+}
+
+func TestReplicasShareServiceRegistry(t *testing.T) {
+	shared := store.NewMemoryStore()
+	replicaA := discovery.NewServiceRegistryWithStore(shared)
+	replicaB := discovery.NewServiceRegistryWithStore(shared)
+
+	err := replicaA.RegisterService(&discovery.ServiceInfo{
+		Name:       "billing",
+		URL:        "http://localhost:1",
+		TrustLevel: 50,
+	})
+	require.NoError(t, err)
+
+	service, err := replicaB.GetService("billing")
+	require.NoError(t, err)
+	assert.Equal(t, 50, service.TrustLevel)
+	assert.Len(t, replicaB.ListServices(), 1)
+}
+
+// outageStore fails every call with errOutage while down is set
+type outageStore struct {
+	*store.MemoryStore
+	down bool
+}
+
+var errOutage = errors.New("connection refused")
+
+func (s *outageStore) Get(ctx context.Context, key string) ([]byte, error) {
+	if s.down {
+		return nil, errOutage
+	}
+	return s.MemoryStore.Get(ctx, key)
+}
+
+func (s *outageStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if s.down {
+		return errOutage
+	}
+	return s.MemoryStore.Set(ctx, key, value, ttl)
+}
+
+func (s *outageStore) Ping(ctx context.Context) error {
+	if s.down {
+		return errOutage
+	}
+	return nil
+}
+
+func TestFailStaticStoreServesReadsDuringOutage(t *testing.T) {
+	ctx := context.Background()
+	primary := &outageStore{MemoryStore: store.NewMemoryStore()}
+	s := store.NewFailStaticStore(primary, time.Minute, &testLogger{}, nil)
+
+	require.NoError(t, s.Set(ctx, "session:1", []byte("alice"), 0))
+	require.NoError(t, primary.MemoryStore.Set(ctx, "policy:1", []byte("allow"), 0))
+	_, err := s.Get(ctx, "policy:1")
+	require.NoError(t, err)
+	assert.False(t, s.Degraded())
+
+	primary.down = true
+	assert.Error(t, s.Ping(ctx))
+	assert.True(t, s.Degraded())
+
+	value, err := s.Get(ctx, "session:1")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("alice"), value)
+	value, err = s.Get(ctx, "policy:1")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("allow"), value)
+	_, err = s.Get(ctx, "session:unknown")
+	assert.ErrorIs(t, err, store.ErrNotFound)
+
+	assert.ErrorIs(t, s.Set(ctx, "session:2", []byte("bob"), 0), store.ErrDegraded)
+	_, _, err = s.Incr(ctx, "counter", time.Minute)
+	assert.ErrorIs(t, err, store.ErrDegraded)
+
+	primary.down = false
+	require.NoError(t, s.Ping(ctx))
+	assert.False(t, s.Degraded())
+	require.NoError(t, s.Set(ctx, "session:2", []byte("bob"), 0))
+}
+
+func TestFailStaticStoreDetectsOutageOnRead(t *testing.T) {
+	ctx := context.Background()
+	primary := &outageStore{MemoryStore: store.NewMemoryStore(), down: true}
+	s := store.NewFailStaticStore(primary, time.Minute, &testLogger{}, nil)
+
+	_, err := s.Get(ctx, "session:1")
+	assert.ErrorIs(t, err, store.ErrNotFound)
+	assert.True(t, s.Degraded())
+	since, cause := s.DegradedSince()
+	assert.False(t, since.IsZero())
+	assert.ErrorIs(t, cause, errOutage)
+}
+
+type fixedDegradation bool
+
+func (d fixedDegradation) Degraded() bool { return bool(d) }
+
+func TestReadOnlyMiddleware(t *testing.T) {
+	for _, degraded := range []bool{false, true} {
+		r := setupTestRouter()
+		r.Use(middleware.ReadOnlyMiddleware(fixedDegradation(degraded), []string{"/exempt"}, 30, &testLogger{}, nil))
+		ok := func(c *gin.Context) { c.Status(http.StatusNoContent) }
+		r.GET("/resource", ok)
+		r.POST("/resource", ok)
+		r.POST("/exempt", ok)
+
+		w := adminRequest(r, http.MethodGet, "/resource", "", nil)
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		w = adminRequest(r, http.MethodPost, "/exempt", "", nil)
+		assert.Equal(t, http.StatusNoContent, w.Code)
+
+		w = adminRequest(r, http.MethodPost, "/resource", "{}", nil)
+		if !degraded {
+			assert.Equal(t, http.StatusNoContent, w.Code)
+			assert.Empty(t, w.Header().Get(middleware.HeaderServiceMode))
+			continue
+		}
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.Equal(t, "read-only", w.Header().Get(middleware.HeaderServiceMode))
+		assert.Equal(t, "30", w.Header().Get("Retry-After"))
+		assert.Contains(t, w.Body.String(), `"code":"SERVICE_DEGRADED"`)
+	}
+}
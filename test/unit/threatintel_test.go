@@ -0,0 +1,138 @@
+package unit
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/pkg/risk"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+	"github.com/lsendel/impl-zamaz/pkg/threatintel"
+	"github.com/lsendel/impl-zamaz/pkg/trust"
+)
+
+func TestThreatIntelListSources(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "drop.txt")
+	require.NoError(t, os.WriteFile(path, []byte("; Spamhaus DROP List\n203.0.113.0/24 ; SBL123\n# FireHOL\n198.51.100.7\n\nnot-an-address\n2001:db8:bad::/48\n"), 0o600))
+	list := threatintel.NewListSource(path, 0, nil)
+	require.NoError(t, list.Refresh(ctx))
+	assert.Equal(t, 3, list.Len())
+	lookup := func(l *threatintel.ListSource, ip string) float64 {
+		score, err := l.Lookup(ctx, net.ParseIP(ip))
+		require.NoError(t, err)
+		return score
+	}
+	assert.Equal(t, 1.0, lookup(list, "203.0.113.9"))
+	assert.Equal(t, 1.0, lookup(list, "198.51.100.7"))
+	assert.Equal(t, 1.0, lookup(list, "2001:db8:bad::1"))
+	assert.Equal(t, 0.0, lookup(list, "198.51.100.8"))
+
+	// A feed that fails to load keeps its previous entries
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	feed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(status.Load()))
+		fmt.Fprintln(w, "192.0.2.0/28")
+	}))
+	defer feed.Close()
+	remote := threatintel.NewListSource(feed.URL, 0.7, nil)
+	require.NoError(t, remote.Refresh(ctx))
+	assert.Equal(t, 0.7, lookup(remote, "192.0.2.3"))
+	status.Store(http.StatusInternalServerError)
+	assert.Error(t, remote.Refresh(ctx))
+	assert.Equal(t, 0.7, lookup(remote, "192.0.2.3"))
+}
+
+func TestThreatIntelCachesAPIVerdicts(t *testing.T) {
+	ctx := context.Background()
+	var calls atomic.Int32
+	var failing atomic.Bool
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if failing.Load() || r.Header.Get("Key") != "secret" {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		score := 0
+		if r.URL.Query().Get("ipAddress") == "192.0.2.66" {
+			score = 90
+		}
+		fmt.Fprintf(w, `{"data": {"ipAddress": %q, "abuseConfidenceScore": %d}}`, r.URL.Query().Get("ipAddress"), score)
+	}))
+	defer api.Close()
+	metrics := &countingMetrics{}
+	service := threatintel.NewService(threatintel.Config{}, []threatintel.Source{
+		threatintel.NewAPISource(api.URL, "secret", nil),
+	}, store.NewMemoryStore(), &testLogger{}, metrics)
+
+	verdict, err := service.Check(ctx, "192.0.2.66")
+	require.NoError(t, err)
+	assert.Equal(t, 0.9, verdict.Score)
+	assert.Equal(t, []string{"api"}, verdict.Sources)
+	score, err := service.Score(ctx, "192.0.2.66")
+	require.NoError(t, err)
+	assert.Equal(t, 0.9, score)
+	assert.EqualValues(t, 1, calls.Load())
+
+	// Failed lookups are not cached
+	failing.Store(true)
+	verdict, err = service.Check(ctx, "192.0.2.1")
+	require.NoError(t, err)
+	assert.Equal(t, 0.0, verdict.Score)
+	failing.Store(false)
+	verdict, err = service.Check(ctx, "192.0.2.1")
+	require.NoError(t, err)
+	assert.Equal(t, 0.0, verdict.Score)
+	assert.EqualValues(t, 3, calls.Load())
+	assert.Equal(t, 1, metrics.count("threat_intel_source_errors_total,source=api"))
+}
+
+func TestThreatIntelBlocksKnownBadSources(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "block.txt")
+	require.NoError(t, os.WriteFile(path, []byte("192.0.2.1\n"), 0o600))
+	list := threatintel.NewListSource(path, 0, nil)
+	newRouter := func(blockScore float64) *gin.Engine {
+		service := threatintel.NewService(threatintel.Config{BlockScore: blockScore}, []threatintel.Source{list}, store.NewMemoryStore(), &testLogger{}, nil)
+		service.Refresh(context.Background())
+		r := setupTestRouter()
+		r.Use(service.Middleware())
+		r.GET("/ping", func(c *gin.Context) { c.Status(http.StatusOK) })
+		return r
+	}
+
+	// httptest requests come from 192.0.2.1
+	w := adminRequest(newRouter(0.8), http.MethodGet, "/ping", "", nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "SOURCE_BLOCKED")
+	assert.Equal(t, http.StatusOK, adminRequest(newRouter(0), http.MethodGet, "/ping", "", nil).Code)
+}
+
+func TestReputationDetector(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "block.txt")
+	require.NoError(t, os.WriteFile(path, []byte("203.0.113.0/24\n"), 0o600))
+	list := threatintel.NewListSource(path, 0.8, nil)
+	service := threatintel.NewService(threatintel.Config{}, []threatintel.Source{list}, store.NewMemoryStore(), &testLogger{}, nil)
+	service.Refresh(context.Background())
+	engine := risk.NewEngine([]risk.Detector{risk.NewReputationDetector(service)}, &testLogger{}, nil)
+	factor := engine.Factor()
+
+	result, err := factor.Evaluate(context.Background(), trust.Input{Subject: "alice", Context: map[string]string{"ip": "203.0.113.9"}})
+	require.NoError(t, err)
+	assert.InDelta(t, 0.2, result.Score, 1e-9)
+	assert.Equal(t, "anomalies: ip_reputation", result.Reason)
+
+	result, err = factor.Evaluate(context.Background(), trust.Input{Subject: "alice", Context: map[string]string{"ip": "198.51.100.1"}})
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, result.Score)
+}
@@ -0,0 +1,127 @@
+package unit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/lsendel/impl-zamaz/pkg/authz"
+	"github.com/lsendel/impl-zamaz/pkg/health"
+	"github.com/lsendel/impl-zamaz/pkg/proxy"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+	"github.com/lsendel/impl-zamaz/pkg/tracing"
+)
+
+const incomingTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+// recordSpans installs a tracer provider recording the spans ended during
+// the test
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous, previousPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previous)
+		otel.SetTextMapPropagator(previousPropagator)
+	})
+	return recorder
+}
+
+func endedSpan(t *testing.T, recorder *tracetest.SpanRecorder, name string) sdktrace.ReadOnlySpan {
+	for _, span := range recorder.Ended() {
+		if span.Name() == name {
+			return span
+		}
+	}
+	t.Fatalf("no span %q", name)
+	return nil
+}
+
+func spanAttribute(span sdktrace.ReadOnlySpan, key attribute.Key) attribute.Value {
+	for _, kv := range span.Attributes() {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestTracingContinuesIncomingTrace(t *testing.T) {
+	recorder := recordSpans(t)
+	shared := store.NewTracedStore(store.NewMemoryStore())
+	checker := health.NewChecker(&testLogger{}, nil)
+	require.NoError(t, checker.Register(health.Dependency{
+		Name:     "idp",
+		Check:    health.CheckFunc(func(context.Context) error { return errors.New("down") }),
+		Critical: true,
+	}))
+
+	router := setupTestRouter()
+	router.Use(tracing.Middleware())
+	router.GET("/sessions/:id", func(c *gin.Context) {
+		ctx := c.Request.Context()
+		_, err := shared.Get(ctx, "session:"+c.Param("id"))
+		assert.ErrorIs(t, err, store.ErrNotFound)
+		checker.Run(ctx)
+		c.Status(http.StatusOK)
+	})
+
+	req := httptest.NewRequest("GET", "/sessions/s-42", nil)
+	req.Header.Set("traceparent", incomingTraceparent)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	server := endedSpan(t, recorder, "GET /sessions/:id")
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", server.SpanContext().TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", server.Parent().SpanID().String())
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-"+server.SpanContext().SpanID().String()+"-01", w.Header().Get("traceparent"))
+
+	get := endedSpan(t, recorder, "store.Get")
+	assert.Equal(t, server.SpanContext().SpanID(), get.Parent().SpanID())
+	assert.Equal(t, "session", spanAttribute(get, "store.key_prefix").AsString(), "keys are not recorded")
+	assert.Equal(t, codes.Unset, get.Status().Code, "missing keys are not errors")
+
+	check := endedSpan(t, recorder, "health.check idp")
+	assert.Equal(t, server.SpanContext().SpanID(), check.Parent().SpanID())
+	assert.Equal(t, codes.Error, check.Status().Code)
+}
+
+func TestProxyPropagatesTrace(t *testing.T) {
+	recorder := recordSpans(t)
+	var received http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+	}))
+	defer upstream.Close()
+
+	enforcer, err := proxy.New(proxy.Config{
+		Upstream:   upstream.URL,
+		Authorizer: newTestAuthorizer(t, authz.Config{}),
+	}, &testLogger{}, nil)
+	require.NoError(t, err)
+	router := setupTestRouter()
+	router.Use(tracing.Middleware(), enforcer.Middleware())
+
+	req := httptest.NewRequest("GET", "/reports/42", nil)
+	req.Header.Set("Authorization", "Bearer good")
+	req.Header.Set("traceparent", incomingTraceparent)
+	require.Equal(t, http.StatusOK, serveProxy(router, req).Code)
+
+	server := endedSpan(t, recorder, "GET")
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-"+server.SpanContext().SpanID().String()+"-01", received.Get("traceparent"))
+}
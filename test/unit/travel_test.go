@@ -0,0 +1,108 @@
+package unit
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/pkg/store"
+	"github.com/lsendel/impl-zamaz/pkg/trust"
+)
+
+func newTestGeoIP(t *testing.T) *trust.CIDRLocator {
+	geo, err := trust.NewCIDRLocator([]trust.GeoIPRange{
+		{CIDR: "198.51.0.0/16", Location: trust.Location{Country: "US", City: "Boston", Latitude: 42.36, Longitude: -71.06}},
+		{CIDR: "198.51.100.0/24", Location: trust.Location{Country: "US", City: "New York", Latitude: 40.71, Longitude: -74.01}},
+		{CIDR: "203.0.113.0/24", Location: trust.Location{Country: "GB", City: "London", Latitude: 51.51, Longitude: -0.13}},
+	})
+	require.NoError(t, err)
+	return geo
+}
+
+func TestGeoIPMostSpecificRangeWins(t *testing.T) {
+	geo := newTestGeoIP(t)
+
+	location, ok := geo.Locate(net.ParseIP("198.51.100.7"))
+	require.True(t, ok)
+	assert.Equal(t, "New York", location.City)
+	location, ok = geo.Locate(net.ParseIP("198.51.7.7"))
+	require.True(t, ok)
+	assert.Equal(t, "Boston", location.City)
+	_, ok = geo.Locate(net.ParseIP("10.0.0.1"))
+	assert.False(t, ok)
+
+	_, err := trust.NewCIDRLocator([]trust.GeoIPRange{{CIDR: "10.0.0.0/8", Location: trust.Location{Latitude: 91}}})
+	assert.Error(t, err)
+}
+
+func TestImpossibleTravelFlagsAndLowersTrust(t *testing.T) {
+	ctx := context.Background()
+	metrics := &countingMetrics{}
+	travel := trust.NewTravelDetector(trust.TravelConfig{}, store.NewMemoryStore(), newTestGeoIP(t), &testLogger{}, metrics)
+	scorer := travel.Scorer(trust.DemoScorer{})
+
+	check, err := travel.Check(ctx, "u-alice", "198.51.100.7")
+	require.NoError(t, err)
+	assert.False(t, check.Impossible)
+	assert.Nil(t, check.Previous)
+
+	// New York to Boston is within the error of GeoIP data
+	check, err = travel.Check(ctx, "u-alice", "198.51.7.7")
+	require.NoError(t, err)
+	assert.False(t, check.Impossible)
+	require.NotNil(t, check.Previous)
+	assert.Equal(t, "New York", check.Previous.City)
+
+	// Unknown addresses are neither judged nor recorded
+	check, err = travel.Check(ctx, "u-alice", "10.0.0.1")
+	require.NoError(t, err)
+	assert.Nil(t, check.Current)
+
+	score, err := scorer.Score(ctx, trust.Input{Subject: "u-alice"})
+	require.NoError(t, err)
+	assert.Equal(t, 88, score.Overall)
+
+	// Boston to London seconds later is not
+	check, err = travel.Check(ctx, "u-alice", "203.0.113.9")
+	require.NoError(t, err)
+	assert.True(t, check.Impossible)
+	assert.False(t, check.Denied)
+	assert.InDelta(t, 5270, check.DistanceKM, 50)
+	assert.Equal(t, 1, metrics.count("impossible_travel_total,action=flagged"))
+
+	score, err = scorer.Score(ctx, trust.Input{Subject: "u-alice"})
+	require.NoError(t, err)
+	assert.Equal(t, 68, score.Overall)
+	assert.Zero(t, score.Factors.Location)
+	assert.Zero(t, score.Factors.Risk)
+	assert.Equal(t, "impossible_travel", score.Context)
+
+	// Other subjects are unaffected
+	score, err = scorer.Score(ctx, trust.Input{Subject: "u-bob"})
+	require.NoError(t, err)
+	assert.Equal(t, 88, score.Overall)
+}
+
+func TestImpossibleTravelDenyKeepsPreviousLocation(t *testing.T) {
+	ctx := context.Background()
+	travel := trust.NewTravelDetector(trust.TravelConfig{Deny: true}, store.NewMemoryStore(), newTestGeoIP(t), &testLogger{}, nil)
+
+	_, err := travel.Check(ctx, "u-alice", "198.51.100.7")
+	require.NoError(t, err)
+	check, err := travel.Check(ctx, "u-alice", "203.0.113.9")
+	require.NoError(t, err)
+	assert.True(t, check.Denied)
+
+	// The refused login did not move the reference point to London
+	check, err = travel.Check(ctx, "u-alice", "198.51.100.8")
+	require.NoError(t, err)
+	assert.False(t, check.Impossible)
+	assert.Equal(t, "New York", check.Previous.City)
+
+	flagged, err := travel.Flagged(ctx, "u-alice")
+	require.NoError(t, err)
+	assert.True(t, flagged)
+}
@@ -0,0 +1,83 @@
+package unit
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/api"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/middleware"
+	"github.com/lsendel/impl-zamaz/pkg/trust"
+)
+
+func newTrustLevelRouter(t *testing.T) *gin.Engine {
+	engine, err := trust.NewScoreEngine(trust.EngineConfig{}, []trust.FactorProvider{
+		trust.StaticFactor(trust.FactorIdentity, 1, "multi-factor authentication"),
+		trust.StaticFactor(trust.FactorDevice, 0.4, "unidentified device"),
+		trust.StaticFactor(trust.FactorBehavior, 1, "no anomalies"),
+		trust.StaticFactor(trust.FactorLocation, 1, "internal network"),
+		trust.StaticFactor(trust.FactorRisk, 1, "no risk signals"),
+	}, &testLogger{}, nil)
+	require.NoError(t, err)
+	handlers := api.NewHandlers().WithScorer(engine)
+
+	router := setupTestRouter()
+	router.Use(func(c *gin.Context) {
+		if id := c.GetHeader("X-Test-User"); id != "" {
+			c.Set("user", &interfaces.UserInfo{ID: id})
+		}
+	}, middleware.UseTrustSource(handlers))
+	router.GET("/standard", middleware.RequireTrustLevel(50), handlers.GetProtectedResource)
+	router.GET("/sensitive", middleware.RequireTrustLevel(90), handlers.GetProtectedResource)
+	return router
+}
+
+func TestRequireTrustLevelEnforcesDeclaredLevel(t *testing.T) {
+	router := newTrustLevelRouter(t)
+	headers := map[string]string{"X-Test-User": "u-alice"}
+
+	// 30 + 10 + 20 + 15 + 10
+	w := adminRequest(router, http.MethodGet, "/standard", "", headers)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var granted map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &granted))
+	assert.Equal(t, float64(50), granted["trust_level_required"])
+	assert.Equal(t, float64(85), granted["your_trust_level"])
+
+	w = adminRequest(router, http.MethodGet, "/sensitive", "", headers)
+	require.Equal(t, http.StatusForbidden, w.Code)
+	var denied struct {
+		Code         string                         `json:"code"`
+		Required     int                            `json:"required_trust_level"`
+		Current      int                            `json:"current_trust_level"`
+		Deficit      int                            `json:"deficit"`
+		Explanations []interfaces.FactorExplanation `json:"explanations"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &denied))
+	assert.Equal(t, "INSUFFICIENT_TRUST", denied.Code)
+	assert.Equal(t, 90, denied.Required)
+	assert.Equal(t, 85, denied.Current)
+	assert.Equal(t, 5, denied.Deficit)
+	require.Len(t, denied.Explanations, 1)
+	assert.Equal(t, trust.FactorDevice, denied.Explanations[0].Factor)
+	assert.Equal(t, "unidentified device", denied.Explanations[0].Reason)
+}
+
+func TestRequireTrustLevelNeedsUserAndSource(t *testing.T) {
+	router := newTrustLevelRouter(t)
+	w := adminRequest(router, http.MethodGet, "/standard", "", nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// A route without a trust source fails closed
+	bare := setupTestRouter()
+	bare.GET("/standard", func(c *gin.Context) {
+		c.Set("user", &interfaces.UserInfo{ID: "u-alice"})
+	}, middleware.RequireTrustLevel(50), func(c *gin.Context) { c.Status(http.StatusOK) })
+	w = adminRequest(bare, http.MethodGet, "/standard", "", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
@@ -0,0 +1,337 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/pkg/admin"
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/security"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+	"github.com/lsendel/impl-zamaz/pkg/trust"
+)
+
+// fixedScorer scores subjects from a table and fails for unknown ones
+type fixedScorer map[string]int
+
+func (f fixedScorer) Score(_ context.Context, in trust.Input) (*interfaces.TrustScore, error) {
+	score, ok := f[in.Subject]
+	if !ok {
+		return nil, errors.New("scoring backend unavailable")
+	}
+	return &interfaces.TrustScore{UserID: in.Subject, Overall: score}, nil
+}
+
+func newTrustRouter(scorer trust.Scorer) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	trust.NewEvaluator(scorer, nil, &testLogger{}, nil).RegisterRoutes(r)
+	return r
+}
+
+func TestAccessLevel(t *testing.T) {
+	level, access := trust.AccessLevel(88, trust.DefaultThresholds)
+	assert.Equal(t, trust.AccessAdmin, level)
+	assert.Equal(t, []string{"read", "write", "admin"}, access)
+
+	level, access = trust.AccessLevel(10, trust.DefaultThresholds)
+	assert.Equal(t, trust.AccessNone, level)
+	assert.Empty(t, access)
+
+	level, _ = trust.AccessLevel(90, trust.DefaultThresholds)
+	assert.Equal(t, trust.AccessDelete, level)
+}
+
+func TestTrustBatchEvaluation(t *testing.T) {
+	r := newTrustRouter(fixedScorer{"alice": 92, "bob": 40})
+	body := `{"evaluations": [
+		{"subject": "alice", "device": "laptop-1", "context": {"ip": "10.0.0.1"}},
+		{"subject": "bob"},
+		{"subject": ""},
+		{"subject": "mallory"}
+	]}`
+
+	w := adminRequest(r, http.MethodPost, "/trust-score/evaluate", body, map[string]string{"Content-Type": "application/json"})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var resp struct {
+		Results []trust.Result `json:"results"`
+		Count   int            `json:"count"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Equal(t, 4, resp.Count)
+
+	alice := resp.Results[0]
+	assert.Equal(t, 92, alice.Score)
+	assert.Equal(t, "laptop-1", alice.Device)
+	assert.Equal(t, trust.AccessDelete, alice.AccessLevel)
+
+	bob := resp.Results[1]
+	assert.Equal(t, 1, bob.Index)
+	assert.Equal(t, trust.AccessRead, bob.AccessLevel)
+	assert.Equal(t, []string{"read"}, bob.Access)
+
+	assert.Equal(t, "VALIDATION_ERROR", resp.Results[2].Code)
+	assert.Equal(t, "INTERNAL_ERROR", resp.Results[3].Code)
+	assert.Equal(t, trust.AccessNone, resp.Results[3].AccessLevel)
+}
+
+func TestTrustBatchLimits(t *testing.T) {
+	r := newTrustRouter(trust.DemoScorer{})
+
+	w := adminRequest(r, http.MethodPost, "/trust-score/evaluate", `{"evaluations": []}`, nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	items := make([]string, trust.MaxBatchSize+1)
+	for i := range items {
+		items[i] = fmt.Sprintf(`{"subject": "u-%d"}`, i)
+	}
+	w = adminRequest(r, http.MethodPost, "/trust-score/evaluate", `{"evaluations": [`+strings.Join(items, ",")+`]}`, nil)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Contains(t, w.Body.String(), "BATCH_TOO_LARGE")
+}
+
+func TestScoreEngineWeightsAndExplains(t *testing.T) {
+	engine, err := trust.NewScoreEngine(trust.EngineConfig{}, trust.DefaultProviders(trust.ProviderConfig{Geo: newTestGeoIP(t)}), &testLogger{}, nil)
+	require.NoError(t, err)
+
+	score, err := engine.Score(context.Background(), trust.Input{
+		Subject: "u-alice",
+		Device:  "laptop-1",
+		Context: map[string]string{"ip": "203.0.113.9", "mfa": "true", "device_verified": "true"},
+	})
+	require.NoError(t, err)
+	// 30 + 25 + 0.9*20 + 0.8*15 + 0.8*10
+	assert.Equal(t, 93, score.Overall)
+	assert.Equal(t, interfaces.TrustFactors{Identity: 30, Device: 25, Behavior: 18, Location: 12, Risk: 8}, score.Factors)
+	require.Len(t, score.Explanations, 5)
+	assert.Equal(t, interfaces.FactorExplanation{
+		Factor: "location", Weight: 15, Score: 0.8, Points: 12, Reason: "located in GB",
+		Evidence: map[string]string{"country": "GB", "city": "London"},
+	}, score.Explanations[3])
+
+	// Weaker signals score lower
+	score, err = engine.Score(context.Background(), trust.Input{Subject: "u-alice", Context: map[string]string{"ip": "192.0.2.1"}})
+	require.NoError(t, err)
+	assert.Equal(t, 24+10+18+8+8, score.Overall)
+	assert.Equal(t, "unidentified device", score.Explanations[1].Reason)
+	assert.Equal(t, "unknown location", score.Explanations[3].Reason)
+}
+
+func TestScoreEngineConfiguredWeights(t *testing.T) {
+	weights, err := trust.ParseWeights("identity=50, device=50")
+	require.NoError(t, err)
+	failing := trust.FactorFunc(trust.FactorDevice, func(context.Context, trust.Input) (trust.FactorResult, error) {
+		return trust.FactorResult{}, errors.New("device inventory unavailable")
+	})
+	metrics := &countingMetrics{}
+	engine, err := trust.NewScoreEngine(trust.EngineConfig{Weights: weights}, []trust.FactorProvider{trust.IdentityFactor(), failing}, &testLogger{}, metrics)
+	require.NoError(t, err)
+
+	// A failing provider costs its points instead of failing the score
+	score, err := engine.Score(context.Background(), trust.Input{Subject: "u-alice", Context: map[string]string{"mfa": "true"}})
+	require.NoError(t, err)
+	assert.Equal(t, 50, score.Overall)
+	assert.Equal(t, "unavailable", score.Explanations[1].Reason)
+	assert.Equal(t, 1, metrics.count("trust_factor_errors_total,factor=device"))
+
+	for _, weights := range []string{"identity=60,device=50", "identity=100,luck=0", "identity=110,device=-10", "identity"} {
+		parsed, err := trust.ParseWeights(weights)
+		if err == nil {
+			_, err = trust.NewScoreEngine(trust.EngineConfig{Weights: parsed}, trust.DefaultProviders(trust.ProviderConfig{}), &testLogger{}, nil)
+		}
+		assert.Error(t, err, weights)
+	}
+	// Every weighted factor needs a provider
+	_, err = trust.NewScoreEngine(trust.EngineConfig{}, []trust.FactorProvider{trust.IdentityFactor()}, &testLogger{}, nil)
+	assert.Error(t, err)
+}
+
+// clearanceFactor is a custom factor scoring subjects by security clearance
+func clearanceFactor() trust.FactorProvider {
+	return trust.FactorFunc("clearance", func(_ context.Context, in trust.Input) (trust.FactorResult, error) {
+		level := map[string]string{"u-alice": "secret"}[in.Subject]
+		if level == "" {
+			return trust.FactorResult{Score: 0, Reason: "no clearance"}, nil
+		}
+		return trust.FactorResult{Score: 1, Reason: "cleared", Evidence: map[string]string{"level": level}}, nil
+	})
+}
+
+func TestScoreEngineCustomFactors(t *testing.T) {
+	weights, err := trust.ParseWeights("identity=30,device=20,behavior=20,location=10,risk=10,clearance=10")
+	require.NoError(t, err)
+	engine, err := trust.NewScoreEngine(trust.EngineConfig{Weights: weights}, append(trust.DefaultProviders(trust.ProviderConfig{}), clearanceFactor()), &testLogger{}, nil)
+	require.NoError(t, err)
+
+	score, err := engine.Score(context.Background(), trust.Input{Subject: "u-alice", Device: "laptop-1", Context: map[string]string{"mfa": "true"}})
+	require.NoError(t, err)
+	// 30 + 0.8*20 + 0.9*20 + 0.5*10 + 0.8*10 + 10
+	assert.Equal(t, 87, score.Overall)
+	require.Len(t, score.Explanations, 6)
+	assert.Equal(t, interfaces.FactorExplanation{
+		Factor: "clearance", Weight: 10, Score: 1, Points: 10, Reason: "cleared", Evidence: map[string]string{"level": "secret"},
+	}, score.Explanations[5])
+
+	// Custom names must be usable in TRUST_WEIGHTS and metric labels
+	_, err = trust.NewScoreEngine(trust.EngineConfig{}, append(trust.DefaultProviders(trust.ProviderConfig{}), trust.StaticFactor("HR Status", 1, "")), &testLogger{}, nil)
+	assert.Error(t, err)
+}
+
+func TestRegisterFactor(t *testing.T) {
+	trust.RegisterFactor(trust.StaticFactor("test_registered", 1, "registered"))
+	names := []string{}
+	for _, p := range trust.RegisteredFactors() {
+		names = append(names, p.Name())
+	}
+	assert.Contains(t, names, "test_registered")
+
+	assert.Panics(t, func() { trust.RegisterFactor(trust.StaticFactor("test_registered", 1, "")) })
+	assert.Panics(t, func() { trust.RegisterFactor(trust.StaticFactor(trust.FactorDevice, 1, "")) })
+}
+
+func TestGuardedFactorTimesOut(t *testing.T) {
+	stuck := trust.FactorFunc("hr_status", func(context.Context, trust.Input) (trust.FactorResult, error) {
+		time.Sleep(time.Second)
+		return trust.FactorResult{Score: 1}, nil
+	})
+	guarded := trust.Guard(stuck, trust.GuardOptions{Timeout: 20 * time.Millisecond})
+
+	started := time.Now()
+	_, err := guarded.Evaluate(context.Background(), trust.Input{Subject: "u-alice"})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(started), 500*time.Millisecond)
+	assert.Equal(t, "hr_status", guarded.Name())
+}
+
+func TestGuardedFactorCircuitBreaks(t *testing.T) {
+	breakers := security.NewCircuitBreakerManager(store.NewMemoryStore(), &testLogger{}, nil)
+	require.NoError(t, breakers.Configure("trust_factor:hr_status", security.BreakerConfig{MinRequests: 2, FailureRatio: 0.5}))
+	calls := 0
+	failing := trust.FactorFunc("hr_status", func(context.Context, trust.Input) (trust.FactorResult, error) {
+		calls++
+		return trust.FactorResult{}, errors.New("HR system down")
+	})
+	guarded := trust.Guard(failing, trust.GuardOptions{Breaker: breakers})
+
+	for i := 0; i < 2; i++ {
+		_, err := guarded.Evaluate(context.Background(), trust.Input{Subject: "u-alice"})
+		assert.Error(t, err)
+	}
+	_, err := guarded.Evaluate(context.Background(), trust.Input{Subject: "u-alice"})
+	assert.ErrorIs(t, err, security.ErrCircuitOpen)
+	assert.Equal(t, 2, calls)
+}
+
+func TestTrustSimulation(t *testing.T) {
+	engine, err := trust.NewScoreEngine(trust.EngineConfig{}, trust.DefaultProviders(trust.ProviderConfig{Geo: newTestGeoIP(t)}), &testLogger{}, nil)
+	require.NoError(t, err)
+	r := setupTestRouter()
+	trust.NewSimulator(engine, nil, &testLogger{}).RegisterRoutes(r)
+	simulate := func(body string) (int, map[string]interface{}) {
+		w := adminRequest(r, http.MethodPost, "/trust-score/simulate", body, map[string]string{"Content-Type": "application/json"})
+		var resp map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return w.Code, resp
+	}
+
+	code, resp := simulate(`{"subject": "alice", "device": "laptop-1",
+		"context": {"ip": "203.0.113.9", "mfa": "true", "device_verified": "true"},
+		"time": "2026-01-10T03:00:00Z"}`)
+	require.Equal(t, http.StatusOK, code, resp)
+	assert.Equal(t, 30.0+25+18+12+8, resp["score"])
+	assert.Equal(t, trust.AccessDelete, resp["access_level"])
+	assert.Equal(t, "2026-01-10T03:00:00Z", resp["simulated_at"])
+	assert.Equal(t, 30.0, resp["weights"].(map[string]interface{})["identity"])
+
+	code, resp = simulate(`{"subject": "alice",
+		"factors": {"device": 0, "location": 0.5},
+		"weights": {"identity": 20, "device": 50, "behavior": 10, "location": 10, "risk": 10}}`)
+	require.Equal(t, http.StatusOK, code, resp)
+	assert.Equal(t, 16.0+0+9+5+8, resp["score"])
+	assert.Equal(t, trust.AccessRead, resp["access_level"])
+	explanations := resp["explanations"].([]interface{})
+	assert.Equal(t, "simulated", explanations[1].(map[string]interface{})["reason"])
+
+	for _, body := range []string{
+		`{"weights": {"identity": 50}}`,
+		`{"weights": {"identity": 90, "luck": 10}}`,
+		`{"factors": {"luck": 1}}`,
+		`{"factors": {"device": 1.5}}`,
+		`{"time": "yesterday"}`,
+	} {
+		code, resp = simulate(body)
+		assert.Equal(t, http.StatusBadRequest, code, body)
+		assert.Equal(t, "VALIDATION_ERROR", resp["code"], body)
+	}
+
+	// Simulating leaves the engine's own weights alone
+	assert.Equal(t, trust.DefaultWeights, engine.Weights())
+}
+
+func TestInputTime(t *testing.T) {
+	at := time.Date(2026, 1, 10, 3, 0, 0, 0, time.UTC)
+	assert.True(t, at.Equal(trust.InputTime(trust.Input{Context: map[string]string{trust.ContextTime: "2026-01-10T03:00:00Z"}})))
+	assert.WithinDuration(t, time.Now(), trust.InputTime(trust.Input{}), time.Minute)
+}
+
+func TestAccessPolicyFromAdminResource(t *testing.T) {
+	ctx := context.Background()
+	manager := admin.NewManager(store.NewMemoryStore(), &testLogger{}, nil, admin.AccessPolicyKind())
+	policy := trust.NewAccessPolicy(trust.AdminThresholds(manager), time.Nanosecond, &testLogger{})
+	assert.Equal(t, trust.DefaultThresholds, policy.Thresholds(ctx))
+
+	_, _, err := manager.Put(ctx, "access-policy", "default", json.RawMessage(`{"levels": [
+		{"level": "read_only", "min_score": 50},
+		{"level": "user", "min_score": 70},
+		{"level": "admin", "min_score": 90}]}`), admin.Preconditions{})
+	require.NoError(t, err)
+	level, access := trust.AccessLevel(75, policy.Thresholds(ctx))
+	assert.Equal(t, "user", level)
+	assert.Equal(t, []string{"read_only", "user"}, access)
+
+	r := setupTestRouter()
+	trust.NewEvaluator(fixedScorer{"bob": 47}, policy, &testLogger{}, nil).RegisterRoutes(r)
+	w := adminRequest(r, http.MethodPost, "/trust-score/evaluate", `{"evaluations": [{"subject": "bob"}]}`, nil)
+	assert.Contains(t, w.Body.String(), `"access_level":"none"`)
+
+	for _, spec := range []string{
+		`{"levels": []}`,
+		`{"levels": [{"level": "read", "min_score": 101}]}`,
+		`{"levels": [{"level": "write", "min_score": 50}, {"level": "read", "min_score": 25}]}`,
+		`{"levels": [{"level": "read", "min_score": 25}, {"level": "read", "min_score": 50}]}`,
+		`{"levels": [{"level": "none", "min_score": 0}]}`,
+	} {
+		_, _, err := manager.Put(ctx, "access-policy", "default", json.RawMessage(spec), admin.Preconditions{})
+		assert.ErrorIs(t, err, admin.ErrInvalidSpec, spec)
+	}
+}
+
+// failingThresholds fails after its first load
+type failingThresholds struct{ loads int }
+
+func (f *failingThresholds) load(context.Context) ([]trust.Threshold, error) {
+	if f.loads++; f.loads > 1 {
+		return nil, errors.New("store unavailable")
+	}
+	return []trust.Threshold{{Level: "read", MinScore: 10}}, nil
+}
+
+func TestAccessPolicyKeepsLastThresholdsOnFailure(t *testing.T) {
+	source := &failingThresholds{}
+	policy := trust.NewAccessPolicy(source.load, time.Nanosecond, &testLogger{})
+	want := []trust.Threshold{{Level: "read", MinScore: 10}}
+	assert.Equal(t, want, policy.Thresholds(context.Background()))
+	assert.Equal(t, want, policy.Thresholds(context.Background()))
+	assert.Equal(t, 2, source.loads)
+}
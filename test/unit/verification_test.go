@@ -0,0 +1,116 @@
+package unit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/pkg/interfaces"
+	"github.com/lsendel/impl-zamaz/pkg/session"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+	"github.com/lsendel/impl-zamaz/pkg/trust"
+)
+
+// newVerifiedRouter serves the session routes plus /trust, which reports
+// the caller's trust level the way protected routes see it
+func newVerifiedRouter(sessions *session.Manager, scorer trust.Scorer, s store.Store) *gin.Engine {
+	r := newSessionRouter(sessions)
+	stepUp := trust.NewStepUp(trust.StepUpConfig{}, s, scorer, nil, &testLogger{}, nil)
+	r.GET("/trust", func(c *gin.Context) {
+		sess, err := sessions.Get(c)
+		if errors.Is(err, session.ErrReauthRequired) {
+			c.String(http.StatusUnauthorized, "REAUTH_REQUIRED")
+			return
+		}
+		if err != nil {
+			c.Status(http.StatusUnauthorized)
+			return
+		}
+		c.Set(session.ContextKey, sess)
+		level, err := stepUp.TrustLevel(c, &sess.User)
+		if err != nil {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"trust_level": level})
+	})
+	return r
+}
+
+func TestSessionVerifierActsOnRisk(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	sessions := newTestSessions(t, s)
+	scorer := fixedScorer{"u-1": 80}
+	r := newVerifiedRouter(sessions, scorer, s)
+	metrics := &countingMetrics{}
+	var audited []string
+	verifier := trust.NewSessionVerifier(trust.VerificationConfig{
+		TerminateBelow: 10,
+		OnAction: func(_ context.Context, sess *session.Session, action string, _ *interfaces.TrustScore) {
+			audited = append(audited, sess.User.ID+":"+action)
+		},
+	}, sessions, scorer, s, &testLogger{}, metrics)
+	verify := func() string {
+		list, err := sessions.List(ctx)
+		require.NoError(t, err)
+		require.Len(t, list, 1)
+		action, err := verifier.Verify(ctx, list[0])
+		require.NoError(t, err)
+		return action
+	}
+
+	cookie := sessionCookie(t, sessionRequest(r, http.MethodPost, "/login", nil, "browser"))
+	assert.Equal(t, trust.ActionNone, verify())
+
+	// A falling score caps the session, so sensitive routes need step-up
+	scorer["u-1"] = 40
+	assert.Equal(t, trust.ActionDowngrade, verify())
+	assert.Equal(t, trust.ActionNone, verify())
+	scorer["u-1"] = 80
+	w := sessionRequest(r, http.MethodGet, "/trust", cookie, "browser")
+	assert.JSONEq(t, `{"trust_level": 40}`, w.Body.String())
+
+	assert.Equal(t, trust.ActionRestore, verify())
+	w = sessionRequest(r, http.MethodGet, "/trust", cookie, "browser")
+	assert.JSONEq(t, `{"trust_level": 80}`, w.Body.String())
+
+	// Forced re-authentication ends the session at its next use
+	scorer["u-1"] = 20
+	assert.Equal(t, trust.ActionReauth, verify())
+	assert.Equal(t, trust.ActionNone, verify())
+	w = sessionRequest(r, http.MethodGet, "/trust", cookie, "browser")
+	assert.Equal(t, "REAUTH_REQUIRED", w.Body.String())
+	assert.Equal(t, http.StatusUnauthorized, sessionRequest(r, http.MethodGet, "/me", cookie, "browser").Code)
+
+	// Terminated sessions end at once
+	cookie = sessionCookie(t, sessionRequest(r, http.MethodPost, "/login", nil, "browser"))
+	scorer["u-1"] = 5
+	assert.Equal(t, trust.ActionTerminate, verify())
+	assert.Equal(t, http.StatusUnauthorized, sessionRequest(r, http.MethodGet, "/me", cookie, "browser").Code)
+	list, err := sessions.List(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, list)
+
+	assert.Equal(t, []string{"u-1:downgrade", "u-1:restore", "u-1:reauth", "u-1:terminate"}, audited)
+	assert.Equal(t, 3, metrics.count("session_verifications_total,action=none"))
+	assert.Equal(t, 1, metrics.count("session_verifications_total,action=terminate"))
+}
+
+func TestSessionVerifierSkipsUnscoredUsers(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	sessions := newTestSessions(t, s)
+	r := newSessionRouter(sessions)
+	cookie := sessionCookie(t, sessionRequest(r, http.MethodPost, "/login", nil, "browser"))
+
+	// The scoring backend knows no one, so the session is left alone
+	verifier := trust.NewSessionVerifier(trust.VerificationConfig{TerminateBelow: 10}, sessions, fixedScorer{}, s, &testLogger{}, nil)
+	require.NoError(t, verifier.VerifyAll(ctx))
+	assert.Equal(t, http.StatusOK, sessionRequest(r, http.MethodGet, "/me", cookie, "browser").Code)
+}
@@ -0,0 +1,177 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lsendel/impl-zamaz/pkg/admin"
+	"github.com/lsendel/impl-zamaz/pkg/store"
+	"github.com/lsendel/impl-zamaz/pkg/trust"
+	"github.com/lsendel/impl-zamaz/pkg/webhook"
+)
+
+const testWebhookSecret = "0123456789abcdef-secret"
+
+// webhookReceiver records verified deliveries and answers with the
+// statuses queued in fail before succeeding
+type webhookReceiver struct {
+	*httptest.Server
+	events   chan webhook.Event
+	fail     []int
+	attempts int32
+}
+
+func newWebhookReceiver(t *testing.T, fail ...int) *webhookReceiver {
+	rcv := &webhookReceiver{events: make(chan webhook.Event, 10), fail: fail}
+	rcv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(atomic.AddInt32(&rcv.attempts, 1))
+		if n <= len(rcv.fail) {
+			w.WriteHeader(rcv.fail[n-1])
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get(webhook.HeaderSignature) != webhook.Sign(testWebhookSecret, r.Header.Get(webhook.HeaderTimestamp), body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var event webhook.Event
+		if err := json.Unmarshal(body, &event); err != nil || event.ID != r.Header.Get(webhook.HeaderEventID) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		rcv.events <- event
+	}))
+	t.Cleanup(rcv.Close)
+	return rcv
+}
+
+func (rcv *webhookReceiver) next(t *testing.T) webhook.Event {
+	select {
+	case event := <-rcv.events:
+		return event
+	case <-time.After(2 * time.Second):
+		t.Fatal("no webhook delivered")
+		return webhook.Event{}
+	}
+}
+
+func newTestNotifier(metrics *countingMetrics, endpoints ...webhook.Endpoint) *webhook.Notifier {
+	return webhook.NewNotifier(webhook.Config{InitialBackoff: 10 * time.Millisecond, MaxAttempts: 3},
+		store.NewMemoryStore(),
+		func(context.Context) ([]webhook.Endpoint, error) { return endpoints, nil },
+		&testLogger{}, metrics)
+}
+
+func TestWebhookNotifiesThresholdCrossings(t *testing.T) {
+	ctx := context.Background()
+	rcv := newWebhookReceiver(t)
+	notifier := newTestNotifier(&countingMetrics{}, webhook.Endpoint{
+		Name: "soc", URL: rcv.URL, Secret: testWebhookSecret, Thresholds: []int{50, 80}, Direction: webhook.Below,
+	})
+	defer notifier.Close()
+	scores := fixedScorer{"alice": 90}
+	scorer := notifier.Scorer(scores)
+
+	// The first score is only the baseline
+	_, err := scorer.Score(ctx, trust.Input{Subject: "alice"})
+	require.NoError(t, err)
+
+	scores["alice"] = 40
+	score, err := scorer.Score(ctx, trust.Input{Subject: "alice"})
+	require.NoError(t, err)
+	assert.Equal(t, 40, score.Overall)
+
+	crossed := map[int]webhook.Event{}
+	for i := 0; i < 2; i++ {
+		event := rcv.next(t)
+		crossed[event.Threshold] = event
+	}
+	require.Contains(t, crossed, 50)
+	require.Contains(t, crossed, 80)
+	event := crossed[50]
+	assert.Equal(t, webhook.EventTrustCrossed, event.Type)
+	assert.Equal(t, "soc", event.Webhook)
+	assert.Equal(t, "alice", event.Subject)
+	assert.Equal(t, webhook.Below, event.Direction)
+	assert.Equal(t, 90, event.PreviousScore)
+	assert.Equal(t, 40, event.Score)
+
+	// Recovering is not a "below" crossing, and unchanged scores are quiet
+	scores["alice"] = 95
+	_, err = scorer.Score(ctx, trust.Input{Subject: "alice"})
+	require.NoError(t, err)
+	_, err = scorer.Score(ctx, trust.Input{Subject: "alice"})
+	require.NoError(t, err)
+	notifier.Close()
+	assert.Empty(t, rcv.events)
+}
+
+func TestWebhookRetriesTransientFailures(t *testing.T) {
+	ctx := context.Background()
+	metrics := &countingMetrics{}
+	rcv := newWebhookReceiver(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	notifier := newTestNotifier(metrics, webhook.Endpoint{
+		Name: "soc", URL: rcv.URL, Secret: testWebhookSecret, Thresholds: []int{50},
+	})
+	defer notifier.Close()
+
+	require.NoError(t, notifier.Observe(ctx, "bob", 30))
+	require.NoError(t, notifier.Observe(ctx, "bob", 70))
+	event := rcv.next(t)
+	assert.Equal(t, webhook.Above, event.Direction)
+	notifier.Close()
+	assert.Equal(t, int32(3), atomic.LoadInt32(&rcv.attempts))
+	assert.Equal(t, 2, metrics.count("webhook_deliveries_total,result=retried"))
+	assert.Equal(t, 1, metrics.count("webhook_deliveries_total,result=delivered"))
+}
+
+func TestWebhookDoesNotRetryRejectedEvents(t *testing.T) {
+	ctx := context.Background()
+	metrics := &countingMetrics{}
+	rcv := newWebhookReceiver(t, http.StatusBadRequest)
+	notifier := newTestNotifier(metrics, webhook.Endpoint{
+		Name: "soc", URL: rcv.URL, Secret: testWebhookSecret, Thresholds: []int{50},
+	})
+
+	require.NoError(t, notifier.Observe(ctx, "bob", 70))
+	require.NoError(t, notifier.Observe(ctx, "bob", 30))
+	notifier.Close()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&rcv.attempts))
+	assert.Equal(t, 1, metrics.count("webhook_deliveries_total,result=failed"))
+}
+
+func TestWebhookKindValidation(t *testing.T) {
+	validate := admin.WebhookKind().Validate
+	assert.NoError(t, validate(json.RawMessage(`{"url": "https://soc.example.com/hook", "secret": "`+testWebhookSecret+`", "thresholds": [50], "direction": "below"}`)))
+	for name, spec := range map[string]string{
+		"relative url":  `{"url": "/hook", "secret": "` + testWebhookSecret + `", "thresholds": [50]}`,
+		"short secret":  `{"url": "https://soc.example.com/hook", "secret": "short", "thresholds": [50]}`,
+		"no thresholds": `{"url": "https://soc.example.com/hook", "secret": "` + testWebhookSecret + `"}`,
+		"out of range":  `{"url": "https://soc.example.com/hook", "secret": "` + testWebhookSecret + `", "thresholds": [101]}`,
+		"direction":     `{"url": "https://soc.example.com/hook", "secret": "` + testWebhookSecret + `", "thresholds": [50], "direction": "down"}`,
+	} {
+		assert.Error(t, validate(json.RawMessage(spec)), name)
+	}
+}
+
+func TestWebhookAdminSource(t *testing.T) {
+	ctx := context.Background()
+	m := admin.NewManager(store.NewMemoryStore(), &testLogger{}, nil, admin.WebhookKind())
+	_, _, err := m.Put(ctx, "webhook", "soc", json.RawMessage(`{"url": "https://soc.example.com/hook", "secret": "`+testWebhookSecret+`", "thresholds": [50]}`), admin.Preconditions{})
+	require.NoError(t, err)
+
+	endpoints, err := webhook.AdminSource(m)(ctx)
+	require.NoError(t, err)
+	require.Len(t, endpoints, 1)
+	assert.Equal(t, "soc", endpoints[0].Name)
+	assert.Equal(t, []int{50}, endpoints[0].Thresholds)
+}